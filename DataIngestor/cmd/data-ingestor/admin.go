@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// shutdownTimeout bounds how long the drain sequence may take
+const shutdownTimeout = 30 * time.Second
+
+// AdminConfig configures the protected /admin endpoints
+type AdminConfig struct {
+	// Token must be presented as "Authorization: Bearer <token>".
+	// The admin API is disabled when it is empty.
+	Token string `yaml:"token"`
+}
+
+// requireAdmin rejects requests that don't carry the configured admin token
+func requireAdmin(config AdminConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if config.Token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+				"error": "admin API is disabled",
+			})
+			return
+		}
+
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(config.Token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "invalid admin token",
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// shutdownState records a shutdown request so that repeated calls agree
+type shutdownState struct {
+	once      sync.Once
+	requested chan time.Duration
+	deadline  time.Time
+}
+
+func newShutdownState() *shutdownState {
+	return &shutdownState{requested: make(chan time.Duration, 1)}
+}
+
+// RequestShutdown asks Run to drain and exit after delay. Only the first call
+// takes effect; every call returns the drain deadline of that first request.
+func (di *DataIngestor) RequestShutdown(delay time.Duration) time.Time {
+	di.shutdown.once.Do(func() {
+		di.shutdown.deadline = time.Now().Add(delay + shutdownTimeout)
+		di.shutdown.requested <- delay
+	})
+	return di.shutdown.deadline
+}
+
+// handleShutdown serves POST /admin/shutdown
+func (di *DataIngestor) handleShutdown(c *gin.Context) {
+	var delay time.Duration
+	if raw := c.Query("delay"); raw != "" {
+		parsed, err := time.ParseDuration(raw)
+		if err != nil || parsed < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "delay must be a non-negative duration such as 10s",
+			})
+			return
+		}
+		delay = parsed
+	}
+
+	deadline := di.RequestShutdown(delay)
+	di.logger.WithField("drain_deadline", deadline).Info("Shutdown requested via admin API")
+
+	c.JSON(http.StatusAccepted, gin.H{
+		"message":        "Shutdown initiated",
+		"drain_deadline": deadline,
+	})
+}
+
+// handlePause serves POST /admin/pause: polling stops until resumed, while
+// POST /ingest keeps working
+func (di *DataIngestor) handlePause(c *gin.Context) {
+	di.setPaused(c, true)
+}
+
+// handleResume serves POST /admin/resume
+func (di *DataIngestor) handleResume(c *gin.Context) {
+	di.setPaused(c, false)
+}
+
+func (di *DataIngestor) setPaused(c *gin.Context, paused bool) {
+	if di.paused.Swap(paused) != paused {
+		di.logger.WithFields(logrus.Fields{
+			"client": c.ClientIP(),
+			"paused": paused,
+		}).Warn("Polling paused state changed via admin API")
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"paused": paused,
+	})
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newAdminTestIngestor(t *testing.T) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(5 * time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+func TestRequireAdmin(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/shutdown", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req = httptest.NewRequest(http.MethodPost, "/admin/shutdown", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	ingestor.config.Admin.Token = ""
+	router = setupRoutes(ingestor)
+	req = httptest.NewRequest(http.MethodPost, "/admin/shutdown", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+func TestHandleShutdown_InvalidDelay(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/shutdown?delay=soon", nil)
+	req.Header.Set("Authorization", "Bearer letmein")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestRun_ShutdownEndpoint(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- ingestor.Run(context.Background(), listener)
+	}()
+
+	shutdown := func() (int, time.Time) {
+		req, err := http.NewRequest(http.MethodPost, "http://"+listener.Addr().String()+"/admin/shutdown?delay=200ms", nil)
+		require.NoError(t, err)
+		req.Header.Set("Authorization", "Bearer letmein")
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+
+		var body struct {
+			DrainDeadline time.Time `json:"drain_deadline"`
+		}
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&body))
+		return resp.StatusCode, body.DrainDeadline
+	}
+
+	status, first := shutdown()
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.True(t, first.After(time.Now()))
+
+	// A second call during the delay is idempotent
+	status, second := shutdown()
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.True(t, first.Equal(second))
+
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after shutdown was requested")
+	}
+
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	assert.True(t, channel.closed)
+}
+
+func TestPause_SkipsPolling(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	ingestor.config.API.PollInterval = Duration(5 * time.Millisecond)
+	ingestor.paused.Store(true)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.pollSource(ctx, ingestor.sources[0])
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, channel.messages())
+
+	ingestor.paused.Store(false)
+	assert.Eventually(t, func() bool { return len(channel.messages()) > 0 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAggregatesStateFile = "aggregates.json"
+	// Five weeks keep the previous week complete
+	defaultAggregatesRetention = 35 * 24 * time.Hour
+	defaultAggregatesTolerance = time.Hour
+	defaultAggregatesSaveEvery = 30 * time.Second
+	// aggregatesStateVersion is bumped when the state file format changes
+	aggregatesStateVersion = 1
+)
+
+// Aggregation periods
+const (
+	periodDay  = "day"
+	periodWeek = "week"
+)
+
+// Why a reading was left out of the aggregates, as counted in
+// aggregates_skipped_readings_total
+const (
+	aggregateSkippedLate   = "late"
+	aggregateSkippedFuture = "future"
+)
+
+// aggregateExcluded are the triggers left out: replays publish readings
+// counted before, and load tests readings that are not real
+var aggregateExcluded = map[string]bool{triggerReplay: true, triggerLoadTest: true}
+
+// AggregatesConfig keeps the daily and weekly min, max and average of the
+// numeric payload fields of every location
+type AggregatesConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// StateFile keeps the aggregates across restarts, aggregates.json by
+	// default
+	StateFile string `yaml:"state_file"`
+	// Timezone is the IANA time zone days and weeks begin in, UTC by default.
+	// Weeks begin on Monday.
+	Timezone string `yaml:"timezone"`
+	// Fields are the payload fields aggregated, all numeric ones by default
+	Fields []string `yaml:"fields"`
+	// Retention is how long past days and weeks are kept, 35 days by default
+	Retention Duration `yaml:"retention"`
+	// Tolerance is how long after its day ended a reading is still counted,
+	// and how far ahead of the clock its own time may lie, one hour by
+	// default
+	Tolerance Duration `yaml:"tolerance"`
+	// SaveInterval is how often the state file is written while readings
+	// come in, 30s by default. It is also written on a clean shutdown.
+	SaveInterval Duration `yaml:"save_interval"`
+}
+
+func (c AggregatesConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if _, err := c.location(); err != nil {
+		return err
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("aggregates.retention must not be negative")
+	}
+	if c.Tolerance < 0 {
+		return fmt.Errorf("aggregates.tolerance must not be negative")
+	}
+	if c.SaveInterval < 0 {
+		return fmt.Errorf("aggregates.save_interval must not be negative")
+	}
+	return nil
+}
+
+func (c AggregatesConfig) location() (*time.Location, error) {
+	if c.Timezone == "" {
+		return time.UTC, nil
+	}
+	loc, err := time.LoadLocation(c.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("aggregates.timezone: %w", err)
+	}
+	return loc, nil
+}
+
+// fieldAggregate sums up the values of one field in one period
+type fieldAggregate struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Sum   float64 `json:"sum"`
+	Count int64   `json:"count"`
+}
+
+func (f *fieldAggregate) add(value float64) {
+	if f.Count == 0 || value < f.Min {
+		f.Min = value
+	}
+	if f.Count == 0 || value > f.Max {
+		f.Max = value
+	}
+	f.Sum += value
+	f.Count++
+}
+
+// aggregateBucket is one day or week of a location
+type aggregateBucket struct {
+	Start  time.Time                  `json:"start"`
+	End    time.Time                  `json:"end"`
+	Fields map[string]*fieldAggregate `json:"fields"`
+}
+
+// aggregatesState is the state file format. The buckets are those of one
+// time zone; another one starts over.
+type aggregatesState struct {
+	Version  int       `json:"version"`
+	SavedAt  time.Time `json:"saved_at"`
+	Timezone string    `json:"timezone"`
+	// Locations maps a location and a period to its buckets, oldest first
+	Locations map[string]map[string][]*aggregateBucket `json:"locations"`
+}
+
+// aggregates maintains the per-location aggregates of the published
+// readings
+type aggregates struct {
+	config         AggregatesConfig
+	loc            *time.Location
+	fields         map[string]bool
+	timestampField string
+	retention      time.Duration
+	tolerance      time.Duration
+	saveInterval   time.Duration
+	logger         *logrus.Logger
+	metrics        *Metrics
+	// now is replaced in tests
+	now func() time.Time
+
+	mu        sync.Mutex
+	locations map[string]map[string][]*aggregateBucket
+	// dirty is set by readings not saved yet
+	dirty bool
+}
+
+// newAggregates returns nil unless aggregates.enabled is set
+func (di *DataIngestor) newAggregates() *aggregates {
+	config := di.config.Aggregates
+	if !config.Enabled {
+		return nil
+	}
+	loc, err := config.location()
+	if err != nil {
+		di.logger.WithError(err).Error("Aggregates disabled")
+		return nil
+	}
+	if config.StateFile == "" {
+		config.StateFile = defaultAggregatesStateFile
+	}
+	a := &aggregates{
+		config:         config,
+		loc:            loc,
+		timestampField: di.config.API.Incremental.TimestampField,
+		retention:      time.Duration(config.Retention),
+		tolerance:      time.Duration(config.Tolerance),
+		saveInterval:   time.Duration(config.SaveInterval),
+		logger:         di.logger,
+		metrics:        di.metrics,
+		now:            time.Now,
+		locations:      make(map[string]map[string][]*aggregateBucket),
+	}
+	if a.timestampField == "" {
+		a.timestampField = defaultPartitionTimestampField
+	}
+	if a.retention <= 0 {
+		a.retention = defaultAggregatesRetention
+	}
+	if a.tolerance <= 0 {
+		a.tolerance = defaultAggregatesTolerance
+	}
+	if a.saveInterval <= 0 {
+		a.saveInterval = defaultAggregatesSaveEvery
+	}
+	if len(config.Fields) > 0 {
+		a.fields = make(map[string]bool, len(config.Fields))
+		for _, field := range config.Fields {
+			a.fields[field] = true
+		}
+	}
+	a.restore()
+	return a
+}
+
+// restore loads the state file. A missing file is not an error.
+func (a *aggregates) restore() {
+	body, err := os.ReadFile(a.config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var state aggregatesState
+	if err == nil {
+		err = json.Unmarshal(body, &state)
+	}
+	if err == nil && state.Version != aggregatesStateVersion {
+		err = fmt.Errorf("unsupported version %d", state.Version)
+	}
+	if err == nil && state.Timezone != a.loc.String() {
+		err = fmt.Errorf("the aggregates are of time zone %s", state.Timezone)
+	}
+	if err != nil {
+		a.logger.WithError(err).Warn("Discarding aggregates state, the aggregates start over")
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for location, periods := range state.Locations {
+		a.locations[location] = periods
+	}
+}
+
+// periodStart returns the beginning of the day or week of t. Days are not
+// always 24 hours long where daylight saving time begins or ends.
+func (a *aggregates) periodStart(t time.Time, period string) time.Time {
+	local := t.In(a.loc)
+	day := local.Day()
+	if period == periodWeek {
+		// Monday is the first day of the week
+		day -= (int(local.Weekday()) + 6) % 7
+	}
+	return time.Date(local.Year(), local.Month(), day, 0, 0, 0, 0, a.loc)
+}
+
+func (a *aggregates) periodEnd(start time.Time, period string) time.Time {
+	days := 1
+	if period == periodWeek {
+		days = 7
+	}
+	return time.Date(start.Year(), start.Month(), start.Day()+days, 0, 0, 0, 0, a.loc)
+}
+
+// observe adds the published readings of location. Readings of excluded
+// triggers are ignored; a reading is counted in the periods of its own time,
+// or of now without one, unless its day ended more than the tolerance ago
+// or its time lies more than the tolerance ahead. The state file is written
+// by run, not here.
+func (a *aggregates) observe(location, trigger string, data WeatherData) {
+	if a == nil || aggregateExcluded[trigger] || len(data) == 0 {
+		return
+	}
+	now := a.now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, sensor := range data {
+		at, ok := readingTimestamp(sensor, a.timestampField)
+		if !ok {
+			at = now
+		}
+		day := a.periodEnd(a.periodStart(at, periodDay), periodDay)
+		switch {
+		case now.Sub(day) > a.tolerance:
+			a.metrics.AggregatesSkipped.WithLabelValues(location, aggregateSkippedLate).Inc()
+			continue
+		case at.Sub(now) > a.tolerance:
+			a.metrics.AggregatesSkipped.WithLabelValues(location, aggregateSkippedFuture).Inc()
+			continue
+		}
+		for _, period := range []string{periodDay, periodWeek} {
+			bucket := a.bucket(location, period, at)
+			for field, value := range sensor.Payload {
+				number, ok := value.(float64)
+				if !ok || field == a.timestampField || (a.fields != nil && !a.fields[field]) {
+					continue
+				}
+				aggregate, ok := bucket.Fields[field]
+				if !ok {
+					aggregate = &fieldAggregate{}
+					bucket.Fields[field] = aggregate
+				}
+				aggregate.add(number)
+			}
+		}
+		a.dirty = true
+	}
+	a.prune(now)
+}
+
+// run writes the state file every save interval while readings come in
+func (a *aggregates) run(ctx context.Context) {
+	ticker := time.NewTicker(a.saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			a.flush()
+		}
+	}
+}
+
+// flush writes the state file if readings came in since it was last
+// written. A nil aggregates has nothing to write.
+func (a *aggregates) flush() {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.dirty {
+		a.save(a.now())
+	}
+}
+
+// bucket returns the bucket of location holding at, creating it; mu must be
+// held
+func (a *aggregates) bucket(location, period string, at time.Time) *aggregateBucket {
+	periods, ok := a.locations[location]
+	if !ok {
+		periods = make(map[string][]*aggregateBucket)
+		a.locations[location] = periods
+	}
+	start := a.periodStart(at, period)
+	buckets := periods[period]
+	for _, bucket := range buckets {
+		if bucket.Start.Equal(start) {
+			return bucket
+		}
+	}
+	bucket := &aggregateBucket{Start: start, End: a.periodEnd(start, period), Fields: make(map[string]*fieldAggregate)}
+	buckets = append(buckets, bucket)
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start.Before(buckets[j].Start) })
+	periods[period] = buckets
+	return bucket
+}
+
+// prune drops the periods that ended longer than the retention ago; mu
+// must be held
+func (a *aggregates) prune(now time.Time) {
+	cutoff := now.Add(-a.retention)
+	for location, periods := range a.locations {
+		for period, buckets := range periods {
+			kept := buckets[:0]
+			for _, bucket := range buckets {
+				if bucket.End.After(cutoff) {
+					kept = append(kept, bucket)
+				}
+			}
+			if len(kept) == 0 {
+				delete(periods, period)
+			} else {
+				periods[period] = kept
+			}
+		}
+		if len(periods) == 0 {
+			delete(a.locations, location)
+		}
+	}
+}
+
+// save prunes the aggregates and writes the state file; mu must be held
+func (a *aggregates) save(now time.Time) {
+	a.prune(now)
+	state := aggregatesState{
+		Version:   aggregatesStateVersion,
+		SavedAt:   now.UTC(),
+		Timezone:  a.loc.String(),
+		Locations: a.locations,
+	}
+	body, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(a.config.StateFile, body)
+	}
+	if err != nil {
+		a.logger.WithError(err).Error("Failed to save aggregates state")
+		return
+	}
+	a.dirty = false
+}
+
+// FieldStats are the aggregates of one field in a period
+type FieldStats struct {
+	Min   float64 `json:"min"`
+	Max   float64 `json:"max"`
+	Avg   float64 `json:"avg"`
+	Count int64   `json:"count"`
+}
+
+// Aggregates is the body of GET /aggregates
+type Aggregates struct {
+	Period   string    `json:"period"`
+	Timezone string    `json:"timezone"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	// Locations maps a location to the stats of its fields
+	Locations map[string]map[string]FieldStats `json:"locations"`
+}
+
+// query returns the aggregates of the period holding at, of location or of
+// every location when it is empty
+func (a *aggregates) query(location, period string, at time.Time) Aggregates {
+	start := a.periodStart(at, period)
+	result := Aggregates{
+		Period:    period,
+		Timezone:  a.loc.String(),
+		From:      start,
+		To:        a.periodEnd(start, period),
+		Locations: make(map[string]map[string]FieldStats),
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for name, periods := range a.locations {
+		if location != "" && name != location {
+			continue
+		}
+		for _, bucket := range periods[period] {
+			if !bucket.Start.Equal(start) {
+				continue
+			}
+			fields := make(map[string]FieldStats, len(bucket.Fields))
+			for field, aggregate := range bucket.Fields {
+				fields[field] = FieldStats{
+					Min:   aggregate.Min,
+					Max:   aggregate.Max,
+					Avg:   aggregate.Sum / float64(aggregate.Count),
+					Count: aggregate.Count,
+				}
+			}
+			result.Locations[name] = fields
+		}
+	}
+	return result
+}
+
+// handleAggregates serves GET /aggregates. ?period= is day, the default, or
+// week; ?date= picks an earlier period by a date in the aggregates' time
+// zone, and ?location= a single location.
+func (di *DataIngestor) handleAggregates(c *gin.Context) {
+	a := di.aggregates
+	if a == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "aggregates are disabled",
+		})
+		return
+	}
+	period := c.DefaultQuery("period", periodDay)
+	if period != periodDay && period != periodWeek {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("period must be %q or %q", periodDay, periodWeek),
+		})
+		return
+	}
+	at := a.now()
+	if date := c.Query("date"); date != "" {
+		parsed, err := time.ParseInLocation("2006-01-02", date, a.loc)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "date must be a date like 2024-03-01",
+			})
+			return
+		}
+		at = parsed
+	}
+	location := c.Query("location")
+	result := a.query(location, period, at)
+	if _, ok := result.Locations[location]; location != "" && !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("no aggregates of %s for the %s", location, period),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAggregates keeps the aggregates in state on a clock that starts at
+// *now
+func newTestAggregates(t *testing.T, config AggregatesConfig, state string, now *time.Time) *aggregates {
+	t.Helper()
+	config.Enabled, config.StateFile = true, state
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Aggregates: config,
+		Logging:    LoggingConfig{Level: "panic"},
+	})
+	a := ingestor.aggregates
+	require.NotNil(t, a)
+	a.now = func() time.Time { return *now }
+	return a
+}
+
+// aggregated is a reading of name taken at at, or without a time when at is
+// zero
+func aggregated(name string, at time.Time, payload map[string]interface{}) SensorData {
+	if !at.IsZero() {
+		payload["timestamp"] = at.Format(time.RFC3339)
+	}
+	return SensorData{Type: "weather", Name: name, Payload: payload}
+}
+
+func TestAggregatesConfig_Validate(t *testing.T) {
+	assert.NoError(t, AggregatesConfig{}.Validate())
+	assert.NoError(t, AggregatesConfig{Enabled: true, Timezone: "Europe/Berlin"}.Validate())
+	assert.ErrorContains(t, AggregatesConfig{Enabled: true, Timezone: "Mars/Olympus"}.Validate(), "aggregates.timezone")
+	assert.ErrorContains(t, AggregatesConfig{Enabled: true, Retention: -1}.Validate(), "aggregates.retention")
+	assert.ErrorContains(t, AggregatesConfig{Enabled: true, Tolerance: -1}.Validate(), "aggregates.tolerance")
+	assert.ErrorContains(t, AggregatesConfig{Enabled: true, SaveInterval: -1}.Validate(), "aggregates.save_interval")
+}
+
+func TestAggregates_DayAndWeek(t *testing.T) {
+	// Wednesday
+	now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	a := newTestAggregates(t, AggregatesConfig{}, filepath.Join(t.TempDir(), "aggregates.json"), &now)
+
+	a.observe("berlin", triggerPoll, WeatherData{
+		aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 10.0, "condition": "rain"}),
+		aggregated("berlin-2", time.Time{}, map[string]interface{}{"temperature": 20.0, "humidity": 50.0}),
+	})
+	now = now.Add(24 * time.Hour)
+	a.observe("berlin", triggerManual, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": -3.0})})
+
+	today := a.query("berlin", periodDay, now)
+	assert.Equal(t, time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC), today.From)
+	assert.Equal(t, time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC), today.To)
+	assert.Equal(t, FieldStats{Min: -3, Max: -3, Avg: -3, Count: 1}, today.Locations["berlin"]["temperature"])
+	assert.NotContains(t, today.Locations["berlin"], "humidity")
+
+	yesterday := a.query("berlin", periodDay, now.Add(-24*time.Hour))
+	assert.Equal(t, FieldStats{Min: 10, Max: 20, Avg: 15, Count: 2}, yesterday.Locations["berlin"]["temperature"])
+	assert.NotContains(t, yesterday.Locations["berlin"], "condition", "not a number")
+
+	week := a.query("", periodWeek, now)
+	assert.Equal(t, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), week.From, "weeks begin on Monday")
+	assert.Equal(t, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC), week.To)
+	assert.Equal(t, FieldStats{Min: -3, Max: 20, Avg: 9, Count: 3}, week.Locations["berlin"]["temperature"])
+	assert.Equal(t, FieldStats{Min: 50, Max: 50, Avg: 50, Count: 1}, week.Locations["berlin"]["humidity"])
+}
+
+func TestAggregates_OnlyTheConfiguredFields(t *testing.T) {
+	now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	a := newTestAggregates(t, AggregatesConfig{Fields: []string{"temperature"}}, filepath.Join(t.TempDir(), "aggregates.json"), &now)
+	a.observe("berlin", triggerPoll, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 1.0, "humidity": 50.0})})
+	fields := a.query("berlin", periodDay, now).Locations["berlin"]
+	assert.Contains(t, fields, "temperature")
+	assert.NotContains(t, fields, "humidity")
+}
+
+func TestAggregates_SurviveARestartMidDay(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "aggregates.json")
+	now := time.Date(2024, 3, 6, 9, 0, 0, 0, time.UTC)
+	a := newTestAggregates(t, AggregatesConfig{}, state, &now)
+	a.observe("berlin", triggerPoll, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 4.0})})
+	_, err := os.Stat(state)
+	assert.ErrorIs(t, err, os.ErrNotExist, "not written for every reading")
+	a.flush()
+
+	now = now.Add(6 * time.Hour)
+	restarted := newTestAggregates(t, AggregatesConfig{}, state, &now)
+	restarted.observe("berlin", triggerPoll, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 8.0})})
+	restarted.flush()
+	assert.Equal(t, FieldStats{Min: 4, Max: 8, Avg: 6, Count: 2}, restarted.query("berlin", periodDay, now).Locations["berlin"]["temperature"])
+	assert.Equal(t, int64(2), restarted.query("berlin", periodWeek, now).Locations["berlin"]["temperature"].Count)
+
+	// The next day starts over, the week goes on
+	now = time.Date(2024, 3, 7, 0, 30, 0, 0, time.UTC)
+	again := newTestAggregates(t, AggregatesConfig{}, state, &now)
+	again.observe("berlin", triggerPoll, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 0.0})})
+	assert.Equal(t, int64(1), again.query("berlin", periodDay, now).Locations["berlin"]["temperature"].Count)
+	assert.Equal(t, int64(3), again.query("berlin", periodWeek, now).Locations["berlin"]["temperature"].Count)
+}
+
+func TestAggregates_TimezoneBoundaries(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	require.NoError(t, err)
+	// Sunday 23:30 in Berlin, 22:30 UTC
+	now := time.Date(2024, 3, 10, 22, 30, 0, 0, time.UTC)
+	a := newTestAggregates(t, AggregatesConfig{Timezone: "Europe/Berlin"}, filepath.Join(t.TempDir(), "aggregates.json"), &now)
+	a.observe("berlin", triggerPoll, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 1.0})})
+
+	// Monday 00:30 in Berlin, still Sunday in UTC
+	now = now.Add(time.Hour)
+	a.observe("berlin", triggerPoll, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 2.0})})
+
+	monday := a.query("berlin", periodDay, now)
+	assert.True(t, monday.From.Equal(time.Date(2024, 3, 11, 0, 0, 0, 0, berlin)))
+	assert.Equal(t, "Europe/Berlin", monday.Timezone)
+	assert.Equal(t, 2.0, monday.Locations["berlin"]["temperature"].Max)
+	assert.Equal(t, int64(1), a.query("berlin", periodWeek, now).Locations["berlin"]["temperature"].Count, "a new week")
+	sunday := a.query("berlin", periodWeek, now.Add(-time.Hour))
+	assert.True(t, sunday.From.Equal(time.Date(2024, 3, 4, 0, 0, 0, 0, berlin)))
+	assert.Equal(t, 1.0, sunday.Locations["berlin"]["temperature"].Max)
+
+	// The day daylight saving time begins has 23 hours
+	dst := a.query("", periodDay, time.Date(2024, 3, 31, 12, 0, 0, 0, berlin))
+	assert.Equal(t, 23*time.Hour, dst.To.Sub(dst.From))
+}
+
+func TestAggregates_OutOfOrderReadings(t *testing.T) {
+	// 00:10, just after midnight
+	now := time.Date(2024, 3, 7, 0, 10, 0, 0, time.UTC)
+	a := newTestAggregates(t, AggregatesConfig{Tolerance: Duration(30 * time.Minute)}, filepath.Join(t.TempDir(), "aggregates.json"), &now)
+	a.observe("berlin", triggerPoll, WeatherData{
+		// The day before ended within the tolerance: counted in it, however
+		// early that day the reading was taken
+		aggregated("berlin-1", now.Add(-20*time.Minute), map[string]interface{}{"temperature": 5.0}),
+		aggregated("berlin-1", now.Add(-20*time.Hour), map[string]interface{}{"temperature": 3.0}),
+		// Two days ago
+		aggregated("berlin-1", now.Add(-26*time.Hour), map[string]interface{}{"temperature": 99.0}),
+		aggregated("berlin-1", now.Add(2*time.Hour), map[string]interface{}{"temperature": -99.0}),
+		aggregated("berlin-1", now, map[string]interface{}{"temperature": 7.0}),
+	})
+
+	yesterday := a.query("berlin", periodDay, now.Add(-time.Hour)).Locations["berlin"]
+	assert.Equal(t, FieldStats{Min: 3, Max: 5, Avg: 4, Count: 2}, yesterday["temperature"])
+	assert.NotContains(t, yesterday, "timestamp", "the reading time is no value")
+	assert.Equal(t, FieldStats{Min: 7, Max: 7, Avg: 7, Count: 1}, a.query("berlin", periodDay, now).Locations["berlin"]["temperature"])
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.metrics.AggregatesSkipped.WithLabelValues("berlin", aggregateSkippedLate)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(a.metrics.AggregatesSkipped.WithLabelValues("berlin", aggregateSkippedFuture)))
+}
+
+func TestAggregates_ExcludeReplayAndLoadTest(t *testing.T) {
+	now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	a := newTestAggregates(t, AggregatesConfig{}, filepath.Join(t.TempDir(), "aggregates.json"), &now)
+	for _, trigger := range []string{triggerReplay, triggerLoadTest} {
+		a.observe("berlin", trigger, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 1.0})})
+	}
+	assert.Empty(t, a.query("", periodDay, now).Locations)
+}
+
+func TestAggregates_Retention(t *testing.T) {
+	now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	a := newTestAggregates(t, AggregatesConfig{Retention: Duration(48 * time.Hour)}, filepath.Join(t.TempDir(), "aggregates.json"), &now)
+	a.observe("berlin", triggerPoll, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 1.0})})
+	now = now.Add(3 * 24 * time.Hour)
+	a.observe("paris", triggerPoll, WeatherData{aggregated("paris-1", time.Time{}, map[string]interface{}{"temperature": 1.0})})
+
+	assert.Empty(t, a.query("berlin", periodDay, now.Add(-3*24*time.Hour)).Locations, "the day ended over 48h ago")
+	assert.Contains(t, a.query("berlin", periodWeek, now).Locations, "berlin", "the week has not")
+}
+
+func TestAggregates_DiscardedForAnotherTimezone(t *testing.T) {
+	state := filepath.Join(t.TempDir(), "aggregates.json")
+	now := time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC)
+	a := newTestAggregates(t, AggregatesConfig{}, state, &now)
+	a.observe("berlin", triggerPoll, WeatherData{aggregated("berlin-1", time.Time{}, map[string]interface{}{"temperature": 1.0})})
+
+	a.flush()
+	moved := newTestAggregates(t, AggregatesConfig{Timezone: "Asia/Tokyo"}, state, &now)
+	assert.Empty(t, moved.query("", periodDay, now).Locations)
+}
+
+func TestAggregates_Endpoint(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"weather","name":"berlin-1","payload":{"temperature":21.5}}]`))
+	}))
+	t.Cleanup(upstream.Close)
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			Locations: []LocationSource{{Name: "berlin", BaseURL: upstream.URL}},
+			Timeout:   Duration(5 * time.Second),
+		},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Aggregates: AggregatesConfig{Enabled: true, StateFile: filepath.Join(t.TempDir(), "aggregates.json")},
+		Logging:    LoggingConfig{Level: "panic"},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	router := setupRoutes(ingestor)
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/aggregates"+query, nil))
+		return w
+	}
+
+	require.Equal(t, outcomePublished, ingestor.ingestOnce(context.Background(), ingestor.sources[0]).Outcome)
+	w := get("?location=berlin&period=week")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result Aggregates
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &result))
+	assert.Equal(t, periodWeek, result.Period)
+	assert.Equal(t, "UTC", result.Timezone)
+	assert.Equal(t, FieldStats{Min: 21.5, Max: 21.5, Avg: 21.5, Count: 1}, result.Locations["berlin"]["temperature"])
+
+	assert.Equal(t, http.StatusOK, get("").Code)
+	assert.Equal(t, http.StatusNotFound, get("?location=paris").Code)
+	assert.Equal(t, http.StatusNotFound, get("?location=berlin&date=2020-01-01").Code)
+	assert.Equal(t, http.StatusBadRequest, get("?period=month").Code)
+	assert.Equal(t, http.StatusBadRequest, get("?date=yesterday").Code)
+}
+
+func TestAggregates_Disabled(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	hook := test.NewLocal(ingestor.logger)
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/aggregates", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+	ingestor.aggregates.observe("berlin", triggerPoll, WeatherData{{Type: "weather", Name: "berlin-1"}})
+	assert.Empty(t, hook.AllEntries())
+}
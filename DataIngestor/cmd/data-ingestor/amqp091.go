@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	amqp091 "github.com/rabbitmq/amqp091-go"
+	"github.com/streadway/amqp"
+)
+
+// amqp091Client dials with github.com/rabbitmq/amqp091-go, the maintained
+// fork of streadway. Its types have the same fields; tables, errors and
+// notifications are converted at the boundary.
+type amqp091Client struct{}
+
+func (amqp091Client) Dial(url string) (amqpConnection, error) {
+	conn, err := amqp091.Dial(url)
+	if err != nil {
+		return nil, fromAMQP091Error(err)
+	}
+	return amqp091Conn{conn}, nil
+}
+
+type amqp091Conn struct {
+	conn *amqp091.Connection
+}
+
+func (c amqp091Conn) Channel() (amqpSession, error) {
+	channel, err := c.conn.Channel()
+	if err != nil {
+		return nil, fromAMQP091Error(err)
+	}
+	return amqp091Channel{channel}, nil
+}
+
+func (c amqp091Conn) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	source := c.conn.NotifyClose(make(chan *amqp091.Error, cap(receiver)))
+	forward(source, receiver, func(err *amqp091.Error) *amqp.Error {
+		if err == nil {
+			return nil
+		}
+		return fromAMQP091Error(err).(*amqp.Error)
+	})
+	return receiver
+}
+
+func (c amqp091Conn) NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking {
+	source := c.conn.NotifyBlocked(make(chan amqp091.Blocking, cap(receiver)))
+	forward(source, receiver, func(b amqp091.Blocking) amqp.Blocking {
+		return amqp.Blocking{Active: b.Active, Reason: b.Reason}
+	})
+	return receiver
+}
+
+func (c amqp091Conn) Close() error {
+	return fromAMQP091Error(c.conn.Close())
+}
+
+type amqp091Channel struct {
+	channel *amqp091.Channel
+}
+
+func (c amqp091Channel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	return fromAMQP091Error(c.channel.PublishWithContext(ctx, exchange, key, mandatory, immediate, toAMQP091Publishing(msg)))
+}
+
+func (c amqp091Channel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	queue, err := c.channel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, toAMQP091Table(args))
+	return amqp.Queue(queue), fromAMQP091Error(err)
+}
+
+func (c amqp091Channel) QueueInspect(name string) (amqp.Queue, error) {
+	queue, err := c.channel.QueueInspect(name)
+	return amqp.Queue(queue), fromAMQP091Error(err)
+}
+
+func (c amqp091Channel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	return fromAMQP091Error(c.channel.QueueBind(name, key, exchange, noWait, toAMQP091Table(args)))
+}
+
+func (c amqp091Channel) Close() error {
+	return fromAMQP091Error(c.channel.Close())
+}
+
+func (c amqp091Channel) Tx() error {
+	return fromAMQP091Error(c.channel.Tx())
+}
+
+func (c amqp091Channel) TxCommit() error {
+	return fromAMQP091Error(c.channel.TxCommit())
+}
+
+func (c amqp091Channel) TxRollback() error {
+	return fromAMQP091Error(c.channel.TxRollback())
+}
+
+func (c amqp091Channel) Confirm(noWait bool) error {
+	return fromAMQP091Error(c.channel.Confirm(noWait))
+}
+
+func (c amqp091Channel) NotifyPublish(receiver chan amqp.Confirmation) chan amqp.Confirmation {
+	source := c.channel.NotifyPublish(make(chan amqp091.Confirmation, cap(receiver)))
+	forward(source, receiver, func(confirm amqp091.Confirmation) amqp.Confirmation {
+		return amqp.Confirmation(confirm)
+	})
+	return receiver
+}
+
+func (c amqp091Channel) NotifyFlow(receiver chan bool) chan bool {
+	return c.channel.NotifyFlow(receiver)
+}
+
+// NotifyReturn relays the fields of a return the ingestor reads. The relay
+// runs apart from the one of the confirms, so a return may in rare cases
+// arrive after the ack of its message and go unnoticed.
+func (c amqp091Channel) NotifyReturn(receiver chan amqp.Return) chan amqp.Return {
+	source := c.channel.NotifyReturn(make(chan amqp091.Return, cap(receiver)))
+	forward(source, receiver, func(ret amqp091.Return) amqp.Return {
+		return amqp.Return{
+			ReplyCode:     ret.ReplyCode,
+			ReplyText:     ret.ReplyText,
+			Exchange:      ret.Exchange,
+			RoutingKey:    ret.RoutingKey,
+			MessageId:     ret.MessageId,
+			CorrelationId: ret.CorrelationId,
+		}
+	})
+	return receiver
+}
+
+// forward relays a notification channel of amqp091 to receiver, closing
+// receiver when the source closes, as the library closes its own
+func forward[From, To any](source <-chan From, receiver chan<- To, convert func(From) To) {
+	go func() {
+		for value := range source {
+			receiver <- convert(value)
+		}
+		close(receiver)
+	}()
+}
+
+// fromAMQP091Error returns the streadway error of err, so errors.As and
+// comparisons with amqp.ErrClosed keep working
+func fromAMQP091Error(err error) error {
+	var amqpErr *amqp091.Error
+	if !errors.As(err, &amqpErr) || amqpErr == nil {
+		return err
+	}
+	if amqpErr == amqp091.ErrClosed {
+		return amqp.ErrClosed
+	}
+	return &amqp.Error{Code: amqpErr.Code, Reason: amqpErr.Reason, Server: amqpErr.Server, Recover: amqpErr.Recover}
+}
+
+func toAMQP091Publishing(msg amqp.Publishing) amqp091.Publishing {
+	return amqp091.Publishing{
+		Headers:         toAMQP091Table(msg.Headers),
+		ContentType:     msg.ContentType,
+		ContentEncoding: msg.ContentEncoding,
+		DeliveryMode:    msg.DeliveryMode,
+		Priority:        msg.Priority,
+		CorrelationId:   msg.CorrelationId,
+		ReplyTo:         msg.ReplyTo,
+		Expiration:      msg.Expiration,
+		MessageId:       msg.MessageId,
+		Timestamp:       msg.Timestamp,
+		Type:            msg.Type,
+		UserId:          msg.UserId,
+		AppId:           msg.AppId,
+		Body:            msg.Body,
+	}
+}
+
+// toAMQP091Table converts a table and the tables and decimals nested in it,
+// which amqp091 would reject as unsupported types
+func toAMQP091Table(table amqp.Table) amqp091.Table {
+	if table == nil {
+		return nil
+	}
+	converted := make(amqp091.Table, len(table))
+	for key, value := range table {
+		converted[key] = toAMQP091Value(value)
+	}
+	return converted
+}
+
+func toAMQP091Value(value interface{}) interface{} {
+	switch v := value.(type) {
+	case amqp.Table:
+		return toAMQP091Table(v)
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			converted[i] = toAMQP091Value(item)
+		}
+		return converted
+	case amqp.Decimal:
+		return amqp091.Decimal(v)
+	}
+	return value
+}
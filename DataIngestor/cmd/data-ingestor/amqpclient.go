@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// AMQP client libraries rabbitmq.client selects between
+const (
+	amqpClientStreadway = "streadway"
+	amqpClientAMQP091   = "amqp091"
+)
+
+// defaultAMQPClient is used when rabbitmq.client is not set
+const defaultAMQPClient = amqpClientStreadway
+
+// amqpClient opens broker connections with one AMQP client library. Every
+// implementation speaks the streadway types, so nothing past dial depends on
+// the library.
+type amqpClient interface {
+	Dial(url string) (amqpConnection, error)
+}
+
+// amqpConnection is an open connection of an amqpClient
+type amqpConnection interface {
+	Channel() (amqpSession, error)
+	// NotifyClose receives an error when the connection drops and is closed
+	// without one on a graceful close
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	NotifyBlocked(receiver chan amqp.Blocking) chan amqp.Blocking
+	Close() error
+}
+
+// amqpSession is a channel with the confirm, transaction and flow control
+// support dial sets up
+type amqpSession interface {
+	amqpChannel
+	txChannel
+	queueBinder
+	Confirm(noWait bool) error
+	NotifyPublish(receiver chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyFlow(receiver chan bool) chan bool
+	NotifyReturn(receiver chan amqp.Return) chan amqp.Return
+}
+
+// validateAMQPClient checks rabbitmq.client
+func (c RabbitMQConfig) validateAMQPClient() error {
+	switch c.Client {
+	case "", amqpClientStreadway, amqpClientAMQP091:
+		return nil
+	}
+	return fmt.Errorf("rabbitmq.client must be %s or %s, got %q", amqpClientStreadway, amqpClientAMQP091, c.Client)
+}
+
+func (c RabbitMQConfig) amqpClient() string {
+	if c.Client == "" {
+		return defaultAMQPClient
+	}
+	return c.Client
+}
+
+// newAMQPClient returns the implementation of the client library name
+func newAMQPClient(name string) amqpClient {
+	if name == amqpClientAMQP091 {
+		return amqp091Client{}
+	}
+	return streadwayClient{}
+}
+
+// streadwayClient dials with github.com/streadway/amqp
+type streadwayClient struct{}
+
+func (streadwayClient) Dial(url string) (amqpConnection, error) {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return nil, err
+	}
+	return streadwayConn{conn}, nil
+}
+
+type streadwayConn struct {
+	*amqp.Connection
+}
+
+func (c streadwayConn) Channel() (amqpSession, error) {
+	channel, err := c.Connection.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return streadwayChannel{channel}, nil
+}
+
+// streadwayChannel adds PublishWithContext, which streadway lacks. The
+// context is only checked before the publish; a blocked write is not
+// interrupted, see publishWithin.
+type streadwayChannel struct {
+	*amqp.Channel
+}
+
+func (c streadwayChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return c.Channel.Publish(exchange, key, mandatory, immediate, msg)
+}
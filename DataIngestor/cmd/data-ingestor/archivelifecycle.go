@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultRetentionAt            = "03:00"
+	defaultDiskGuardCheckInterval = time.Minute
+
+	// Why an archive file was removed, the reason label of
+	// data_ingestor_archive_files_removed_total
+	removedMaxAge    = "max_age"
+	removedMaxSize   = "max_size"
+	removedDiskGuard = "disk_guard"
+)
+
+// ArchiveRetentionConfig removes sealed archive files once a day, at a time
+// with little traffic. The file being written is never removed.
+type ArchiveRetentionConfig struct {
+	// MaxAge removes files last written longer ago
+	MaxAge Duration `yaml:"max_age"`
+	// MaxSize removes the oldest files while the archive is larger
+	MaxSize ByteSize `yaml:"max_size"`
+	// At is the time of day (UTC) retention runs, "03:00" by default
+	At string `yaml:"at"`
+}
+
+func (c ArchiveRetentionConfig) enabled() bool {
+	return c.MaxAge > 0 || c.MaxSize > 0
+}
+
+// schedule parses At
+func (c ArchiveRetentionConfig) schedule() (hour, minute int, err error) {
+	at := c.At
+	if at == "" {
+		at = defaultRetentionAt
+	}
+	parsed, err := time.Parse("15:04", at)
+	if err != nil {
+		return 0, 0, fmt.Errorf("file_sink.retention.at must be a time of day like 03:00, got %q", c.At)
+	}
+	return parsed.Hour(), parsed.Minute(), nil
+}
+
+// next returns the first scheduled run after now
+func (c ArchiveRetentionConfig) next(now time.Time) time.Time {
+	hour, minute, _ := c.schedule()
+	now = now.UTC()
+	next := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, time.UTC)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// DiskGuardConfig removes the oldest archive files while the volume of
+// file_sink.dir is nearly full, so the archive cannot fill the disk the
+// service runs on
+type DiskGuardConfig struct {
+	// Threshold is the share of the volume in use, above 0 and below 1, at
+	// which the oldest files are dropped
+	Threshold float64 `yaml:"threshold"`
+	// CheckInterval is how often the volume is sampled, 1m by default
+	CheckInterval Duration `yaml:"check_interval"`
+}
+
+func (c DiskGuardConfig) enabled() bool {
+	return c.Threshold > 0
+}
+
+func (c DiskGuardConfig) checkInterval() time.Duration {
+	if c.CheckInterval > 0 {
+		return time.Duration(c.CheckInterval)
+	}
+	return defaultDiskGuardCheckInterval
+}
+
+// validateLifecycle checks the retention and the disk guard
+func (c FileSinkConfig) validateLifecycle() error {
+	r := c.Retention
+	if r.MaxAge < 0 || r.MaxSize < 0 {
+		return fmt.Errorf("file_sink.retention.max_age and file_sink.retention.max_size must not be negative")
+	}
+	if _, _, err := r.schedule(); err != nil {
+		return err
+	}
+	g := c.DiskGuard
+	if g.Threshold < 0 || g.Threshold >= 1 {
+		return fmt.Errorf("file_sink.disk_guard.threshold must be above 0 and below 1, got %v", g.Threshold)
+	}
+	if g.CheckInterval < 0 {
+		return fmt.Errorf("file_sink.disk_guard.check_interval must not be negative")
+	}
+	if g.enabled() && !diskUsageSupported {
+		return fmt.Errorf("file_sink.disk_guard is only supported on Linux")
+	}
+	if (r.enabled() || g.enabled()) && c.Dir == "" {
+		return fmt.Errorf("file_sink.retention and file_sink.disk_guard need file_sink.dir")
+	}
+	return nil
+}
+
+// archiveFile is a file of the archive the sink is not writing to
+type archiveFile struct {
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// archiveFiles returns the files of the archive, oldest first, leaving out
+// the one being written. Callers hold mu.
+func (s *FileSink) archiveFiles() ([]archiveFile, error) {
+	entries, err := os.ReadDir(s.config.Dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the archive: %w", err)
+	}
+	var files []archiveFile
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, s.config.Prefix+"-") || !strings.HasSuffix(name, ".ndjson") {
+			continue
+		}
+		path := filepath.Join(s.config.Dir, name)
+		if s.file != nil && path == s.path {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, archiveFile{path: path, size: info.Size(), modified: info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		if !files[i].modified.Equal(files[j].modified) {
+			return files[i].modified.Before(files[j].modified)
+		}
+		return files[i].path < files[j].path
+	})
+	return files, nil
+}
+
+// removeArchiveFile removes a file and its checksum
+func removeArchiveFile(file archiveFile) error {
+	if err := os.Remove(file.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove archive file: %w", err)
+	}
+	if err := os.Remove(file.path + checksumSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove archive checksum: %w", err)
+	}
+	return nil
+}
+
+// claim marks files as being removed, so the sink does not open them while
+// they are removed without holding mu. Callers hold mu.
+func (s *FileSink) claim(files []archiveFile) {
+	if s.removing == nil {
+		s.removing = map[string]bool{}
+	}
+	for _, file := range files {
+		s.removing[file.path] = true
+	}
+}
+
+// release lets the sink open the paths of files again
+func (s *FileSink) release(files []archiveFile) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, file := range files {
+		delete(s.removing, file.path)
+	}
+}
+
+// DiskGuardStatus is the disk guard in GET /ready
+type DiskGuardStatus struct {
+	// Used is the share of the volume in use at the last check
+	Used float64
+	// Dropping is set while the oldest archive files are dropped
+	Dropping bool
+	Err      error
+}
+
+// archiveLifecycle applies file_sink.retention and file_sink.disk_guard to
+// the archive of the file sink
+type archiveLifecycle struct {
+	sink    *FileSink
+	config  FileSinkConfig
+	metrics *Metrics
+	logger  func() *logrus.Entry
+	now     func() time.Time
+	// usage returns the bytes used and free on the volume of dir
+	usage func(dir string) (used, free uint64, err error)
+	// spool is switched to drop-oldest while the guard drops files
+	spool *spool
+
+	mu     sync.Mutex
+	status DiskGuardStatus
+}
+
+// newArchiveLifecycle returns nil without a file sink or neither retention
+// nor a disk guard
+func (di *DataIngestor) newArchiveLifecycle() *archiveLifecycle {
+	config := di.config.FileSink
+	if di.fileSink == nil || (!config.Retention.enabled() && !config.DiskGuard.enabled()) {
+		return nil
+	}
+	return &archiveLifecycle{
+		sink:    di.fileSink,
+		config:  config,
+		metrics: di.metrics,
+		logger:  func() *logrus.Entry { return di.log(logIngestion).WithField("dir", config.Dir) },
+		now:     time.Now,
+		usage:   diskUsage,
+		spool:   di.spool,
+	}
+}
+
+// run checks the disk every check interval and applies retention at its
+// time of day until ctx is done
+func (a *archiveLifecycle) run(ctx context.Context) {
+	var guard, retention <-chan time.Time
+	if a.config.DiskGuard.enabled() {
+		a.checkDisk()
+		ticker := time.NewTicker(a.config.DiskGuard.checkInterval())
+		defer ticker.Stop()
+		guard = ticker.C
+	}
+	var timer *time.Timer
+	if a.config.Retention.enabled() {
+		timer = time.NewTimer(a.config.Retention.next(a.now()).Sub(a.now()))
+		defer timer.Stop()
+		retention = timer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-guard:
+			a.checkDisk()
+		case <-retention:
+			a.applyRetention()
+			timer.Reset(a.config.Retention.next(a.now()).Sub(a.now()))
+		}
+	}
+}
+
+// applyRetention removes the files older than max_age, then the oldest while
+// the archive is larger than max_size
+func (a *archiveLifecycle) applyRetention() {
+	retention := a.config.Retention
+	cutoff := a.now().Add(-time.Duration(retention.MaxAge))
+
+	a.sink.mu.Lock()
+	files, err := a.sink.archiveFiles()
+	if err != nil {
+		a.sink.mu.Unlock()
+		a.logger().WithError(err).Error("Failed to apply archive retention")
+		return
+	}
+	// The file being written counts towards max_size but is kept
+	var total int64
+	if a.sink.file != nil {
+		total = a.sink.size
+	}
+	for _, file := range files {
+		total += file.size
+	}
+	var victims []archiveFile
+	var reasons []string
+	kept := total
+	for _, file := range files {
+		switch {
+		case retention.MaxAge > 0 && file.modified.Before(cutoff):
+			reasons = append(reasons, removedMaxAge)
+		case retention.MaxSize > 0 && kept > int64(retention.MaxSize):
+			reasons = append(reasons, removedMaxSize)
+		default:
+			continue
+		}
+		victims = append(victims, file)
+		kept -= file.size
+	}
+	a.sink.claim(victims)
+	a.sink.mu.Unlock()
+	defer a.sink.release(victims)
+
+	removed := map[string]int{}
+	var freed int64
+	for i, file := range victims {
+		if err := removeArchiveFile(file); err != nil {
+			a.logger().WithError(err).WithField("file", filepath.Base(file.path)).Error("Failed to apply archive retention")
+			continue
+		}
+		total -= file.size
+		freed += file.size
+		removed[reasons[i]]++
+		a.metrics.ArchiveFilesRemoved.WithLabelValues(reasons[i]).Inc()
+	}
+	a.logger().WithFields(logrus.Fields{
+		"max_age":     removed[removedMaxAge],
+		"max_size":    removed[removedMaxSize],
+		"freed_bytes": freed,
+		"kept_bytes":  total,
+	}).Info("Archive retention applied")
+}
+
+// checkDisk samples the volume and, above the threshold, drops the oldest
+// archive files until it is below again or only the file being written is
+// left. The guard, and the spool with it, drop the oldest until the volume
+// is below the threshold.
+func (a *archiveLifecycle) checkDisk() {
+	threshold := a.config.DiskGuard.Threshold
+	used, free, err := a.sample()
+	if err != nil {
+		a.setStatus(DiskGuardStatus{Err: err})
+		a.logger().WithError(err).Error("Failed to check the archive volume")
+		return
+	}
+	if usedShare(used, free) < threshold {
+		a.setStatus(DiskGuardStatus{Used: usedShare(used, free)})
+		a.spool.setDropOldest(false)
+		return
+	}
+
+	// The oldest files that bring the volume below the threshold, removed
+	// without holding up the writes of the sink
+	excess := int64(used) - int64(threshold*float64(used+free))
+	a.sink.mu.Lock()
+	files, err := a.sink.archiveFiles()
+	var victims []archiveFile
+	for _, file := range files {
+		if excess <= 0 {
+			break
+		}
+		victims = append(victims, file)
+		excess -= file.size
+	}
+	a.sink.claim(victims)
+	a.sink.mu.Unlock()
+
+	dropped, freed := 0, int64(0)
+	for _, file := range victims {
+		if err = removeArchiveFile(file); err != nil {
+			break
+		}
+		dropped++
+		freed += file.size
+		a.metrics.ArchiveFilesRemoved.WithLabelValues(removedDiskGuard).Inc()
+	}
+	a.sink.release(victims)
+	if err == nil {
+		used, free, err = a.sample()
+	}
+	a.spool.setDropOldest(true)
+
+	logger := a.logger().WithFields(logrus.Fields{
+		"used":        fmt.Sprintf("%.0f%%", usedShare(used, free)*100),
+		"threshold":   fmt.Sprintf("%.0f%%", threshold*100),
+		"dropped":     dropped,
+		"freed_bytes": freed,
+	})
+	if err != nil {
+		logger = logger.WithError(err)
+	}
+	logger.Warn("Archive volume nearly full, dropping the oldest archive files")
+	a.setStatus(DiskGuardStatus{Used: usedShare(used, free), Dropping: true, Err: err})
+}
+
+// sample returns the bytes used and free on the volume and observes the
+// share in use
+func (a *archiveLifecycle) sample() (used, free uint64, err error) {
+	if err := os.MkdirAll(a.config.Dir, 0o755); err != nil {
+		return 0, 0, fmt.Errorf("failed to create file sink directory: %w", err)
+	}
+	used, free, err = a.usage(a.config.Dir)
+	if err != nil {
+		return 0, 0, err
+	}
+	a.metrics.ArchiveDiskUsage.Set(usedShare(used, free))
+	return used, free, nil
+}
+
+// usedShare returns the share of a volume in use
+func usedShare(used, free uint64) float64 {
+	if used+free == 0 {
+		return 0
+	}
+	return float64(used) / float64(used+free)
+}
+
+func (a *archiveLifecycle) setStatus(status DiskGuardStatus) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.status = status
+}
+
+// Status returns the disk guard at its last check, nil without one
+func (a *archiveLifecycle) Status() *DiskGuardStatus {
+	if a == nil || !a.config.DiskGuard.enabled() {
+		return nil
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	status := a.status
+	return &status
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeArchiveFile writes a sealed archive file of size bytes last written
+// at modified
+func writeArchiveFile(t *testing.T, dir, name string, size int, modified time.Time) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(strings.Repeat("x", size)), 0o644))
+	require.NoError(t, os.WriteFile(path+checksumSuffix, []byte("00  "+name+"\n"), 0o644))
+	require.NoError(t, os.Chtimes(path, modified, modified))
+}
+
+// newLifecycleIngestor archives to a temp dir whose volume holds 1000 bytes
+// besides the archive files, out of capacity
+func newLifecycleIngestor(t *testing.T, fileSink FileSinkConfig, capacity uint64) (*DataIngestor, string) {
+	t.Helper()
+	fileSink.Dir = t.TempDir()
+	config := &Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+		FileSink: fileSink,
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+	t.Cleanup(func() { ingestor.fileSink.Close() })
+	require.NotNil(t, ingestor.archive)
+	ingestor.archive.now = func() time.Time { return time.Date(2024, 5, 10, 3, 0, 0, 0, time.UTC) }
+	ingestor.archive.usage = func(dir string) (uint64, uint64, error) {
+		used := uint64(1000)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			require.NoError(t, err)
+			used += uint64(info.Size())
+		}
+		return used, capacity - used, nil
+	}
+	return ingestor, fileSink.Dir
+}
+
+func TestArchiveRetention(t *testing.T) {
+	ingestor, dir := newLifecycleIngestor(t, FileSinkConfig{Retention: ArchiveRetentionConfig{
+		MaxAge: Duration(72 * time.Hour), MaxSize: 2500,
+	}}, 1<<20)
+	now := ingestor.archive.now()
+	writeArchiveFile(t, dir, "weather-2024-05-01T10.ndjson", 100, now.Add(-9*24*time.Hour))
+	writeArchiveFile(t, dir, "weather-2024-05-06T10.ndjson", 1000, now.Add(-4*24*time.Hour))
+	writeArchiveFile(t, dir, "weather-2024-05-08T10.ndjson", 1000, now.Add(-2*24*time.Hour))
+	writeArchiveFile(t, dir, "weather-2024-05-08T10.1.ndjson", 1000, now.Add(-2*24*time.Hour+time.Minute))
+	writeArchiveFile(t, dir, "weather-2024-05-09T10.ndjson", 1000, now.Add(-24*time.Hour))
+	writeArchiveFile(t, dir, "other-2024-05-01T10.ndjson", 100, now.Add(-9*24*time.Hour))
+	// The file being written is kept, though it counts towards max_size
+	require.NoError(t, ingestor.fileSink.Write(now, *testReadings()))
+
+	ingestor.archive.applyRetention()
+
+	assert.Equal(t, []string{
+		"other-2024-05-01T10.ndjson",
+		"weather-2024-05-08T10.1.ndjson",
+		"weather-2024-05-09T10.ndjson",
+		"weather-2024-05-10T03.ndjson",
+	}, archiveFiles(t, dir))
+	_, err := os.Stat(filepath.Join(dir, "weather-2024-05-06T10.ndjson"+checksumSuffix))
+	assert.ErrorIs(t, err, os.ErrNotExist, "the checksum goes with its file")
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.ArchiveFilesRemoved.WithLabelValues(removedMaxAge)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ArchiveFilesRemoved.WithLabelValues(removedMaxSize)))
+
+	// The sink keeps writing to its file
+	require.NoError(t, ingestor.fileSink.Write(now, *testReadings()))
+	assert.Len(t, readArchive(t, filepath.Join(dir, "weather-2024-05-10T03.ndjson")), 2*len(*testReadings()))
+}
+
+func TestArchiveRetention_Schedule(t *testing.T) {
+	at := func(s string) time.Time {
+		parsed, err := time.Parse(time.RFC3339, s)
+		require.NoError(t, err)
+		return parsed
+	}
+	retention := ArchiveRetentionConfig{MaxAge: Duration(time.Hour)}
+	assert.Equal(t, at("2024-05-10T03:00:00Z"), retention.next(at("2024-05-10T01:30:00Z")))
+	assert.Equal(t, at("2024-05-11T03:00:00Z"), retention.next(at("2024-05-10T03:00:00Z")))
+	retention.At = "23:15"
+	assert.Equal(t, at("2024-05-10T23:15:00Z"), retention.next(at("2024-05-11T01:00:00+02:00")))
+}
+
+func readyBody(t *testing.T, ingestor *DataIngestor) map[string]interface{} {
+	t.Helper()
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return body
+}
+
+func TestDiskGuard_DropsTheOldestFiles(t *testing.T) {
+	// 1000 bytes of other data on a 5000 byte volume
+	ingestor, dir := newLifecycleIngestor(t, FileSinkConfig{DiskGuard: DiskGuardConfig{Threshold: 0.7}}, 5000)
+	ingestor.connState = StateReady
+	now := ingestor.archive.now()
+	ingestor.archive.checkDisk()
+	ready := readyBody(t, ingestor)
+	assert.Equal(t, false, ready["degraded"])
+	assert.Equal(t, "20% used", ready["checks"].(map[string]interface{})["disk"])
+
+	writeArchiveFile(t, dir, "weather-2024-05-09T10.ndjson", 1000, now.Add(-3*time.Hour))
+	writeArchiveFile(t, dir, "weather-2024-05-09T11.ndjson", 1000, now.Add(-2*time.Hour))
+	writeArchiveFile(t, dir, "weather-2024-05-09T12.ndjson", 1000, now.Add(-time.Hour))
+	ingestor.archive.checkDisk()
+
+	// The oldest is dropped, and the guard is degraded until the next check
+	assert.Equal(t, []string{"weather-2024-05-09T11.ndjson", "weather-2024-05-09T12.ndjson"}, archiveFiles(t, dir))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ArchiveFilesRemoved.WithLabelValues(removedDiskGuard)))
+	assert.InDelta(t, 0.61, testutil.ToFloat64(ingestor.metrics.ArchiveDiskUsage), 0.01)
+	ready = readyBody(t, ingestor)
+	assert.Equal(t, true, ready["degraded"])
+	assert.Equal(t, true, ready["ready"], "degraded, not unready")
+	assert.Equal(t, "drop_oldest: 61% of the archive volume used, above file_sink.disk_guard.threshold",
+		ready["checks"].(map[string]interface{})["disk"])
+
+	ingestor.archive.checkDisk()
+	assert.Equal(t, false, readyBody(t, ingestor)["degraded"])
+	assert.Len(t, archiveFiles(t, dir), 2)
+}
+
+func TestDiskGuard_KeepsTheFileBeingWritten(t *testing.T) {
+	// The other data alone is above the threshold
+	ingestor, dir := newLifecycleIngestor(t, FileSinkConfig{DiskGuard: DiskGuardConfig{Threshold: 0.5}}, 1500)
+	now := ingestor.archive.now()
+	writeArchiveFile(t, dir, "weather-2024-05-09T10.ndjson", 100, now.Add(-time.Hour))
+	require.NoError(t, ingestor.fileSink.Write(now, *testReadings()))
+
+	ingestor.archive.checkDisk()
+	assert.Equal(t, []string{"weather-2024-05-10T03.ndjson"}, archiveFiles(t, dir))
+	status := ingestor.archive.Status()
+	assert.True(t, status.Dropping)
+	assert.Greater(t, status.Used, 0.5)
+	require.NoError(t, ingestor.fileSink.Write(now, *testReadings()))
+}
+
+func TestDiskGuard_SwitchesTheSpoolToDropOldest(t *testing.T) {
+	config := &Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue", Spool: SpoolConfig{Dir: t.TempDir()}},
+		Logging:  LoggingConfig{Level: "panic"},
+		FileSink: FileSinkConfig{Dir: t.TempDir(), DiskGuard: DiskGuardConfig{Threshold: 0.7}},
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+	t.Cleanup(ingestor.spool.close)
+	require.Same(t, ingestor.spool, ingestor.archive.spool)
+
+	used := uint64(4000)
+	ingestor.archive.usage = func(string) (uint64, uint64, error) { return used, 5000 - used, nil }
+	ingestor.archive.checkDisk()
+	assert.True(t, ingestor.spool.status().DropOldest, "nothing to drop from the archive, the spool stops growing")
+	_, err := ingestor.spool.append(spoolEntry{RoutingKey: "meter-data-queue", Body: []byte(`[]`)})
+	assert.ErrorIs(t, err, ErrSpoolFull, "empty when the guard tripped, the spool takes nothing")
+
+	used = 1000
+	ingestor.archive.checkDisk()
+	assert.False(t, ingestor.spool.status().DropOldest)
+	_, err = ingestor.spool.append(spoolEntry{RoutingKey: "meter-data-queue", Body: []byte(`[]`)})
+	assert.NoError(t, err)
+}
+
+func TestArchiveLifecycle_SinkSkipsFilesBeingRemoved(t *testing.T) {
+	ingestor, dir := newLifecycleIngestor(t, FileSinkConfig{DiskGuard: DiskGuardConfig{Threshold: 0.9}}, 1<<20)
+	now := ingestor.archive.now()
+	writeArchiveFile(t, dir, "weather-2024-05-10T03.ndjson", 100, now.Add(-time.Minute))
+	claimed := []archiveFile{{path: filepath.Join(dir, "weather-2024-05-10T03.ndjson")}}
+	ingestor.fileSink.mu.Lock()
+	ingestor.fileSink.claim(claimed)
+	ingestor.fileSink.mu.Unlock()
+
+	// Removed without the lock, the file is not opened meanwhile
+	require.NoError(t, ingestor.fileSink.Write(now, *testReadings()))
+	assert.Equal(t, filepath.Join(dir, "weather-2024-05-10T03.1.ndjson"), ingestor.fileSink.path)
+	ingestor.fileSink.release(claimed)
+	assert.Empty(t, ingestor.fileSink.removing)
+}
+
+func TestDiskUsage(t *testing.T) {
+	if !diskUsageSupported {
+		t.Skip("disk usage is only sampled on Linux")
+	}
+	used, free, err := diskUsage(t.TempDir())
+	require.NoError(t, err)
+	assert.NotZero(t, used+free)
+	_, _, err = diskUsage(filepath.Join(t.TempDir(), "missing"))
+	assert.Error(t, err)
+}
+
+func TestArchiveLifecycle_Validate(t *testing.T) {
+	assert.Nil(t, NewDataIngestor(&Config{Logging: LoggingConfig{Level: "panic"}, FileSink: FileSinkConfig{Dir: t.TempDir()}}).archive)
+	for want, config := range map[string]FileSinkConfig{
+		"must not be negative":         {Dir: "/archive", Retention: ArchiveRetentionConfig{MaxSize: -1}},
+		`like 03:00, got "3am"`:        {Dir: "/archive", Retention: ArchiveRetentionConfig{MaxAge: Duration(time.Hour), At: "3am"}},
+		"above 0 and below 1, got 1.5": {Dir: "/archive", DiskGuard: DiskGuardConfig{Threshold: 1.5}},
+		"need file_sink.dir":           {Retention: ArchiveRetentionConfig{MaxAge: Duration(time.Hour)}},
+		"check_interval":               {Dir: "/archive", DiskGuard: DiskGuardConfig{Threshold: 0.9, CheckInterval: -1}},
+	} {
+		assert.ErrorContains(t, config.Validate(), want)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// ErrTokenAcquisition marks failures to obtain an upstream access token, as
+// opposed to failures of the data request itself
+var ErrTokenAcquisition = errors.New("failed to acquire upstream access token")
+
+// AuthConfig configures how requests to the upstream are authenticated
+type AuthConfig struct {
+	OAuth2 *OAuth2Config `yaml:"oauth2"`
+	// APIKeyFile holds the X-Api-Key of every request, read again every
+	// secrets.poll_interval
+	APIKeyFile string `yaml:"api_key_file"`
+}
+
+// OAuth2Config configures the OAuth2 client credentials flow. The secret is
+// read from exactly one of ClientSecret, ClientSecretEnv and ClientSecretFile.
+type OAuth2Config struct {
+	TokenURL         string            `yaml:"token_url" json:"token_url"`
+	ClientID         string            `yaml:"client_id" json:"client_id"`
+	ClientSecret     string            `yaml:"client_secret" json:"client_secret"`
+	ClientSecretEnv  string            `yaml:"client_secret_env" json:"client_secret_env"`
+	ClientSecretFile string            `yaml:"client_secret_file" json:"client_secret_file"`
+	Scopes           []string          `yaml:"scopes" json:"scopes"`
+	EndpointParams   map[string]string `yaml:"endpoint_params" json:"endpoint_params"`
+}
+
+// Validate checks that the required fields and one secret source are set
+func (c *OAuth2Config) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.TokenURL == "" || c.ClientID == "" {
+		return fmt.Errorf("api.auth.oauth2: token_url and client_id are required")
+	}
+	sources := 0
+	for _, source := range []string{c.ClientSecret, c.ClientSecretEnv, c.ClientSecretFile} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("api.auth.oauth2: set exactly one of client_secret, client_secret_env and client_secret_file")
+	}
+	return nil
+}
+
+// secret resolves the client secret from its configured source
+func (c *OAuth2Config) secret() (string, error) {
+	switch {
+	case c.ClientSecretEnv != "":
+		secret, ok := os.LookupEnv(c.ClientSecretEnv)
+		if !ok {
+			return "", fmt.Errorf("api.auth.oauth2: environment variable %s is not set", c.ClientSecretEnv)
+		}
+		return secret, nil
+	case c.ClientSecretFile != "":
+		secret, err := os.ReadFile(c.ClientSecretFile)
+		if err != nil {
+			return "", fmt.Errorf("api.auth.oauth2: failed to read client secret file: %w", err)
+		}
+		return strings.TrimSpace(string(secret)), nil
+	}
+	return c.ClientSecret, nil
+}
+
+// oauth2Transport adds a client credentials bearer token to every request.
+// Unlike oauth2.Transport it fetches tokens with the request's context, so the
+// token call is bounded by the same timeout as the data request, and it
+// refreshes the token once when the upstream answers 401.
+type oauth2Transport struct {
+	// source is the config of the credentials in config
+	source *OAuth2Config
+	config *clientcredentials.Config
+	base   http.RoundTripper
+	// tokenClient is used for the token endpoint
+	tokenClient *http.Client
+
+	mu        sync.Mutex
+	token     *oauth2.Token
+	lastError error
+}
+
+func newOAuth2Transport(config *OAuth2Config, timeout time.Duration, base http.RoundTripper) (*oauth2Transport, error) {
+	credentials, err := config.credentials()
+	if err != nil {
+		return nil, err
+	}
+	return &oauth2Transport{
+		source:      config,
+		config:      credentials,
+		base:        base,
+		tokenClient: &http.Client{Timeout: timeout, Transport: base},
+	}, nil
+}
+
+// credentials resolves the secret into a client credentials config
+func (c *OAuth2Config) credentials() (*clientcredentials.Config, error) {
+	secret, err := c.secret()
+	if err != nil {
+		return nil, err
+	}
+	params := make(map[string][]string, len(c.EndpointParams))
+	for key, value := range c.EndpointParams {
+		params[key] = []string{value}
+	}
+	return &clientcredentials.Config{
+		ClientID:       c.ClientID,
+		ClientSecret:   secret,
+		TokenURL:       c.TokenURL,
+		Scopes:         c.Scopes,
+		EndpointParams: params,
+	}, nil
+}
+
+// swap replaces the client credentials and drops the cached token. Requests
+// that already hold a token finish with it.
+func (t *oauth2Transport) swap(config *OAuth2Config) error {
+	credentials, err := config.credentials()
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.source, t.config, t.token, t.lastError = config, credentials, nil, nil
+	return nil
+}
+
+// configured returns the config the credentials were built from
+func (t *oauth2Transport) configured() *OAuth2Config {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.source
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *oauth2Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.currentToken(req.Context(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := t.base.RoundTrip(authorize(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return resp, err
+	}
+
+	// The token was revoked or expired early: refresh once and retry
+	resp.Body.Close()
+	token, err = t.currentToken(req.Context(), token.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+	retry := authorize(req, token)
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	return t.base.RoundTrip(retry)
+}
+
+// currentToken returns a valid token, fetching a new one when there is none,
+// it expired, or it is the rejected token
+func (t *oauth2Transport) currentToken(ctx context.Context, rejected string) (*oauth2.Token, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.token.Valid() && t.token.AccessToken != rejected {
+		return t.token, nil
+	}
+
+	token, err := t.config.Token(context.WithValue(ctx, oauth2.HTTPClient, t.tokenClient))
+	if err != nil {
+		t.lastError = tokenError(err)
+		return nil, t.lastError
+	}
+	t.token, t.lastError = token, nil
+	return token, nil
+}
+
+// tokenError classifies a token failure without echoing the endpoint's
+// response body, which may contain credentials
+func tokenError(err error) error {
+	var retrieve *oauth2.RetrieveError
+	if errors.As(err, &retrieve) {
+		if retrieve.ErrorCode != "" {
+			return fmt.Errorf("%w: token endpoint returned status %d (%s)", ErrTokenAcquisition, retrieve.Response.StatusCode, retrieve.ErrorCode)
+		}
+		return fmt.Errorf("%w: token endpoint returned status %d", ErrTokenAcquisition, retrieve.Response.StatusCode)
+	}
+	return fmt.Errorf("%w: %v", ErrTokenAcquisition, err)
+}
+
+// status reports whether the last token request succeeded
+func (t *oauth2Transport) status() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.lastError
+}
+
+// authorize returns a copy of req carrying the bearer token
+func authorize(req *http.Request, token *oauth2.Token) *http.Request {
+	authorized := req.Clone(req.Context())
+	token.SetAuthHeader(authorized)
+	return authorized
+}
+
+// ConfigureAuth wraps the upstream HTTP client for the configured auth
+// method. It fails when the OAuth2 client secret or a secret file cannot be
+// read.
+func (di *DataIngestor) ConfigureAuth() error {
+	if err := di.secrets.load(); err != nil {
+		return err
+	}
+	config := di.config.API.Auth.OAuth2
+	if config == nil {
+		return nil
+	}
+
+	base := di.httpClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	transport, err := newOAuth2Transport(config, time.Duration(di.config.API.Timeout), base)
+	if err != nil {
+		return err
+	}
+	di.auth = transport
+	di.httpClient.Transport = transport
+	return nil
+}
+
+// handleReady reports whether the service can currently ingest: the broker
+// connection is ready and, with OAuth2, the last token request succeeded.
+// It is degraded but ready while the broker throttles publishers, the
+// memory guard sheds load, until it pauses fetching, or the disk guard drops
+// archive files. With health_checks the
+// cached probe results count too; nothing is probed for the request.
+func (di *DataIngestor) handleReady(c *gin.Context) {
+	ready := true
+	checks := gin.H{"rabbitmq": di.ConnectionState().String()}
+	if di.ConnectionState() != StateReady {
+		ready = false
+	}
+	if drift := di.currentQueueDrift(); drift != nil {
+		checks["queue"] = "drift: " + drift.Reason
+		if di.config.RabbitMQ.StrictDeclare {
+			ready = false
+		}
+	}
+	if location, drift, ok := di.schemaDrift.notReady(); ok {
+		checks["schema"] = fmt.Sprintf("drift: %s in %s", drift.signature(), location)
+		ready = false
+	}
+	degraded := false
+	if flow := di.flow.status(); flow.Throttled {
+		degraded = true
+		checks["broker_flow"] = "throttled: " + flow.Reason
+	}
+	if memory := di.memory.Status(); memory != nil && memory.Level > 0 {
+		degraded = true
+		checks["memory"] = "shedding: " + memory.Step
+		if memory.Step == memoryStepPauseFetching {
+			ready = false
+		}
+	}
+	if resources := di.resources.Status(); resources != nil && resources.Protecting {
+		degraded = true
+		checks["resources"] = "protecting: " + strings.Join(resources.hard(), ", ") + " above the hard threshold"
+	}
+	if disk := di.archive.Status(); disk != nil {
+		switch {
+		case disk.Dropping:
+			degraded = true
+			checks["disk"] = fmt.Sprintf("drop_oldest: %.0f%% of the archive volume used, above file_sink.disk_guard.threshold", disk.Used*100)
+		case disk.Err != nil:
+			degraded = true
+			checks["disk"] = disk.Err.Error()
+		default:
+			checks["disk"] = fmt.Sprintf("%.0f%% used", disk.Used*100)
+		}
+	}
+	if di.auth != nil {
+		checks["upstream_auth"] = "ok"
+		if err := di.auth.status(); err != nil {
+			ready = false
+			checks["upstream_auth"] = err.Error()
+		}
+	}
+	response := gin.H{"checks": checks}
+	if di.health != nil {
+		results, probesReady, probesDegraded := di.health.readiness()
+		ready = ready && probesReady
+		degraded = degraded || probesDegraded
+		response["dependencies"] = results
+	}
+
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	response["ready"] = ready
+	response["degraded"] = degraded
+	c.JSON(status, response)
+}
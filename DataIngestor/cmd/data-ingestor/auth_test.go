@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testClientSecret = "s3cr3t-value"
+
+// tokenEndpoint is a fake OAuth2 token endpoint issuing token-1, token-2, ...
+type tokenEndpoint struct {
+	mu        sync.Mutex
+	issued    int
+	expiresIn int
+	status    int
+}
+
+func newTokenEndpoint(t *testing.T, expiresIn int) (*tokenEndpoint, *httptest.Server) {
+	t.Helper()
+	endpoint := &tokenEndpoint{expiresIn: expiresIn}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		endpoint.mu.Lock()
+		defer endpoint.mu.Unlock()
+
+		id, secret, _ := r.BasicAuth()
+		w.Header().Set("Content-Type", "application/json")
+		if endpoint.status != 0 {
+			w.WriteHeader(endpoint.status)
+			fmt.Fprintf(w, `{"error":"server_error","error_description":"bad secret %s"}`, secret)
+			return
+		}
+		if id != "ingestor" || secret != testClientSecret {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_client"}`)
+			return
+		}
+		endpoint.issued++
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token-%d", endpoint.issued),
+			"token_type":   "Bearer",
+			"expires_in":   endpoint.expiresIn,
+		})
+	}))
+	t.Cleanup(server.Close)
+	return endpoint, server
+}
+
+func (e *tokenEndpoint) fail(status int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.status = status
+}
+
+func (e *tokenEndpoint) count() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.issued
+}
+
+// newAuthUpstream serves meter data to requests carrying an accepted token
+func newAuthUpstream(t *testing.T, accept func(token string) bool) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		fmt.Sscanf(r.Header.Get("Authorization"), "Bearer %s", &token)
+		if !accept(token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newAuthIngestor(t *testing.T, upstreamURL string, oauth *OAuth2Config) *DataIngestor {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL: upstreamURL,
+			Timeout: Duration(time.Second),
+			Auth:    AuthConfig{OAuth2: oauth},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	require.NoError(t, ingestor.ConfigureAuth())
+	return ingestor
+}
+
+func TestOAuth2_RefreshesExpiredToken(t *testing.T) {
+	// Tokens expiring within the oauth2 package's 10s leeway are never reused
+	endpoint, tokens := newTokenEndpoint(t, 1)
+	upstream := newAuthUpstream(t, func(token string) bool { return token != "" })
+	ingestor := newAuthIngestor(t, upstream.URL, &OAuth2Config{
+		TokenURL: tokens.URL, ClientID: "ingestor", ClientSecret: testClientSecret,
+	})
+
+	for i := 0; i < 2; i++ {
+		_, err := ingestor.FetchDataFromAPI(context.Background())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, endpoint.count())
+}
+
+func TestOAuth2_ReusesValidToken(t *testing.T) {
+	endpoint, tokens := newTokenEndpoint(t, 3600)
+	upstream := newAuthUpstream(t, func(token string) bool { return token == "token-1" })
+	ingestor := newAuthIngestor(t, upstream.URL, &OAuth2Config{
+		TokenURL: tokens.URL, ClientID: "ingestor", ClientSecret: testClientSecret,
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := ingestor.FetchDataFromAPI(context.Background())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, endpoint.count())
+}
+
+func TestOAuth2_RefreshesOnUnauthorized(t *testing.T) {
+	endpoint, tokens := newTokenEndpoint(t, 3600)
+	// The upstream revoked token-1 before it expired
+	upstream := newAuthUpstream(t, func(token string) bool { return token == "token-2" })
+	ingestor := newAuthIngestor(t, upstream.URL, &OAuth2Config{
+		TokenURL: tokens.URL, ClientID: "ingestor", ClientSecret: testClientSecret,
+	})
+
+	data, err := ingestor.FetchDataFromAPI(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, *data, 1)
+	assert.Equal(t, 2, endpoint.count())
+}
+
+func TestOAuth2_TokenFailuresAreClassified(t *testing.T) {
+	endpoint, tokens := newTokenEndpoint(t, 3600)
+	endpoint.fail(http.StatusInternalServerError)
+	upstream := newAuthUpstream(t, func(string) bool { return true })
+	ingestor := newAuthIngestor(t, upstream.URL, &OAuth2Config{
+		TokenURL: tokens.URL, ClientID: "ingestor", ClientSecret: testClientSecret,
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+
+	_, err := ingestor.ingest(context.Background())
+	require.ErrorIs(t, err, ErrTokenAcquisition)
+	assert.Contains(t, err.Error(), "status 500 (server_error)")
+	assert.NotContains(t, err.Error(), testClientSecret, "token endpoint bodies are not echoed")
+
+	// A token failure is not the location's fault, so its breaker is untouched
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamAuthFailures))
+	assert.Equal(t, 0.0, testutil.ToFloat64(ingestor.metrics.UpstreamFailures.WithLabelValues("default")))
+	assert.False(t, isRetryable(err))
+}
+
+func TestOAuth2_RejectedCredentials(t *testing.T) {
+	_, tokens := newTokenEndpoint(t, 3600)
+	upstream := newAuthUpstream(t, func(string) bool { return true })
+	ingestor := newAuthIngestor(t, upstream.URL, &OAuth2Config{
+		TokenURL: tokens.URL, ClientID: "ingestor", ClientSecret: "wrong",
+	})
+
+	_, err := ingestor.FetchDataFromAPI(context.Background())
+	require.ErrorIs(t, err, ErrTokenAcquisition)
+	assert.Contains(t, err.Error(), "invalid_client")
+}
+
+func TestReady_ReportsUpstreamAuth(t *testing.T) {
+	endpoint, tokens := newTokenEndpoint(t, 3600)
+	upstream := newAuthUpstream(t, func(string) bool { return true })
+	ingestor := newAuthIngestor(t, upstream.URL, &OAuth2Config{
+		TokenURL: tokens.URL, ClientID: "ingestor", ClientSecret: testClientSecret,
+	})
+	router := setupRoutes(ingestor)
+
+	ready := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body["checks"].(map[string]interface{})
+	}
+
+	code, checks := ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "disconnected", checks["rabbitmq"])
+
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	_, err := ingestor.FetchDataFromAPI(context.Background())
+	require.NoError(t, err)
+	code, checks = ready()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "ok", checks["upstream_auth"])
+
+	// Force a token request that fails
+	endpoint.fail(http.StatusBadGateway)
+	ingestor.auth.mu.Lock()
+	ingestor.auth.token = nil
+	ingestor.auth.mu.Unlock()
+	_, err = ingestor.FetchDataFromAPI(context.Background())
+	require.Error(t, err)
+
+	code, checks = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, checks["upstream_auth"], "status 502")
+}
+
+func TestOAuth2Config_SecretSources(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	require.NoError(t, os.WriteFile(path, []byte(testClientSecret+"\n"), 0o600))
+	t.Setenv("TEST_OAUTH2_SECRET", testClientSecret)
+
+	for _, config := range []OAuth2Config{
+		{ClientSecretEnv: "TEST_OAUTH2_SECRET"},
+		{ClientSecretFile: path},
+	} {
+		config.TokenURL, config.ClientID = "http://token", "ingestor"
+		require.NoError(t, config.Validate())
+		secret, err := config.secret()
+		require.NoError(t, err)
+		assert.Equal(t, testClientSecret, secret)
+	}
+
+	_, err := (&OAuth2Config{ClientSecretEnv: "TEST_OAUTH2_UNSET"}).secret()
+	assert.ErrorContains(t, err, "TEST_OAUTH2_UNSET is not set")
+
+	err = (&OAuth2Config{TokenURL: "http://token", ClientID: "ingestor", ClientSecret: "a", ClientSecretEnv: "B"}).Validate()
+	assert.ErrorContains(t, err, "exactly one")
+}
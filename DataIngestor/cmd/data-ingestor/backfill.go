@@ -0,0 +1,925 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBackfillStateFile = "backfill.json"
+	defaultBackfillPageSize  = time.Hour
+	defaultBackfillRetention = 7 * 24 * time.Hour
+	// backfillStateVersion is bumped when the state file format changes
+	backfillStateVersion = 1
+)
+
+// States of a backfill job. Pending and running jobs are resumed after a
+// restart; the others are finished.
+const (
+	jobPending   = "pending"
+	jobRunning   = "running"
+	jobCompleted = "completed"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// Outcomes of a backfill page
+const (
+	pagePublished = "published"
+	pageNoData    = "no_data"
+	pageFailed    = "failed"
+)
+
+var (
+	errJobNotFound = errors.New("backfill job not found")
+	errJobFinished = errors.New("backfill job already finished")
+)
+
+// BackfillConfig enables backfill jobs, which fetch a location's past
+// readings page by page and publish them
+type BackfillConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// StateFile keeps the jobs, their progress and the finished ones across
+	// restarts
+	StateFile string `yaml:"state_file"`
+	// PageSize is the time span fetched by one upstream call, one hour by
+	// default
+	PageSize Duration `yaml:"page_size"`
+	// Retention is how long finished jobs stay listed, seven days by default
+	Retention Duration                `yaml:"retention"`
+	Streaming BackfillStreamingConfig `yaml:"streaming"`
+	// Order is the order of the pages of new jobs: oldest_first, the
+	// default, newest_first or live_first
+	Order     string                  `yaml:"order"`
+	LiveFirst BackfillLiveFirstConfig `yaml:"live_first"`
+	// MaxWorkers is the most workers a job may ask for, 4 by default
+	MaxWorkers int `yaml:"max_workers"`
+}
+
+func (c BackfillConfig) Validate() error {
+	if c.PageSize < 0 {
+		return fmt.Errorf("backfill.page_size must not be negative")
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("backfill.retention must not be negative")
+	}
+	if err := c.validateOrder(); err != nil {
+		return err
+	}
+	if err := c.validateWorkers(); err != nil {
+		return err
+	}
+	return c.Streaming.Validate()
+}
+
+// BackfillJob is a backfill of one location between From and To
+type BackfillJob struct {
+	ID       string    `json:"id"`
+	Location string    `json:"location"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	PageSize string    `json:"page_size"`
+	State    string    `json:"state"`
+	// Order is the order the pages are fetched in, see backfill.order
+	Order string `json:"order,omitempty"`
+	// Cursor is the start of the first page not completed yet, or with
+	// newest_first the end of the last one
+	Cursor     time.Time `json:"cursor"`
+	PagesDone  int       `json:"pages_done"`
+	PagesTotal int       `json:"pages_total"`
+	Readings   int       `json:"readings"`
+	Error      string    `json:"error,omitempty"`
+	// Resumed counts the restarts the job was continued after
+	Resumed    int            `json:"resumed,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+	FinishedAt *time.Time     `json:"finished_at,omitempty"`
+	Pages      []BackfillPage `json:"pages,omitempty"`
+	// Workers run the Chunks of the range in parallel; jobs without
+	// workers run their pages one at a time from Cursor
+	Workers   int             `json:"workers,omitempty"`
+	ChunkSize string          `json:"chunk_size,omitempty"`
+	Chunks    []BackfillChunk `json:"chunks,omitempty"`
+}
+
+// BackfillPage is the outcome of one page of a job
+type BackfillPage struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Outcome  string    `json:"outcome"`
+	Readings int       `json:"readings"`
+	Messages int       `json:"messages"`
+	// Skipped counts the elements of a streamed page that were no reading
+	Skipped int    `json:"skipped,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (j *BackfillJob) finished() bool {
+	return j.State == jobCompleted || j.State == jobFailed || j.State == jobCancelled
+}
+
+func (j *BackfillJob) pageSize() time.Duration {
+	size, err := time.ParseDuration(j.PageSize)
+	if err != nil || size <= 0 {
+		return defaultBackfillPageSize
+	}
+	return size
+}
+
+// pageCount returns the number of pages between from and to
+func pageCount(from, to time.Time, size time.Duration) int {
+	span := to.Sub(from)
+	return int((span + size - 1) / size)
+}
+
+// backfillState is the state file format
+type backfillState struct {
+	Version int            `json:"version"`
+	SavedAt time.Time      `json:"saved_at"`
+	Jobs    []*BackfillJob `json:"jobs"`
+}
+
+// backfiller runs the backfill jobs one at a time, in the order they were
+// created, and persists their progress after every page. A job interrupted
+// by a restart continues from its cursor, or those of its chunks; the page
+// that was running is fetched again and published with the same MessageIds.
+type backfiller struct {
+	config    BackfillConfig
+	pageSize  time.Duration
+	retention time.Duration
+	di        *DataIngestor
+	logger    *logrus.Logger
+	// now and clock are replaced in tests
+	now   func() time.Time
+	clock clock
+
+	mu   sync.Mutex
+	jobs map[string]*BackfillJob
+	// running is the job being run and cancel ends it
+	running string
+	cancel  context.CancelFunc
+	// wake is signalled when a job was added
+	wake chan struct{}
+	// background holds a token for every live_first page being published
+	background chan struct{}
+}
+
+// newBackfiller returns nil unless backfill.enabled is set. Jobs that were
+// pending or running when the service stopped are queued again.
+func (di *DataIngestor) newBackfiller() *backfiller {
+	config := di.config.Backfill
+	if !config.Enabled {
+		return nil
+	}
+	if config.StateFile == "" {
+		config.StateFile = defaultBackfillStateFile
+	}
+	b := &backfiller{
+		config:     config,
+		pageSize:   time.Duration(config.PageSize),
+		retention:  time.Duration(config.Retention),
+		di:         di,
+		logger:     di.logger,
+		now:        time.Now,
+		clock:      realClock{},
+		jobs:       make(map[string]*BackfillJob),
+		wake:       make(chan struct{}, 1),
+		background: make(chan struct{}, config.LiveFirst.maxInFlight()),
+	}
+	if b.pageSize <= 0 {
+		b.pageSize = defaultBackfillPageSize
+	}
+	if b.retention <= 0 {
+		b.retention = defaultBackfillRetention
+	}
+	b.restore()
+	return b
+}
+
+// restore loads the state file. A missing file is not an error.
+func (b *backfiller) restore() {
+	body, err := os.ReadFile(b.config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var state backfillState
+	if err == nil {
+		err = json.Unmarshal(body, &state)
+	}
+	if err == nil && state.Version != backfillStateVersion {
+		err = fmt.Errorf("unsupported version %d", state.Version)
+	}
+	if err != nil {
+		b.logger.WithError(err).Warn("Discarding backfill state, the jobs are lost")
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, job := range state.Jobs {
+		for i := range job.Chunks {
+			if job.Chunks[i].State == jobRunning {
+				job.Chunks[i].State = jobPending
+			}
+		}
+		if job.State == jobRunning {
+			job.State = jobPending
+			job.Resumed++
+			b.logger.WithFields(logrus.Fields{
+				"job":      job.ID,
+				"location": job.Location,
+				"cursor":   job.Cursor,
+			}).Info("Resuming interrupted backfill job")
+		}
+		b.jobs[job.ID] = job
+	}
+	b.save()
+}
+
+// save prunes the expired jobs and writes the state file. Callers hold mu.
+func (b *backfiller) save() {
+	now := b.now()
+	for id, job := range b.jobs {
+		if job.finished() && job.FinishedAt != nil && now.Sub(*job.FinishedAt) > b.retention {
+			delete(b.jobs, id)
+		}
+	}
+	state := backfillState{Version: backfillStateVersion, SavedAt: now.UTC(), Jobs: b.sorted()}
+	body, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(b.config.StateFile, body)
+	}
+	if err != nil {
+		b.logger.WithError(err).Error("Failed to save backfill state")
+	}
+}
+
+// sorted returns the jobs oldest first. Callers hold mu.
+func (b *backfiller) sorted() []*BackfillJob {
+	jobs := make([]*BackfillJob, 0, len(b.jobs))
+	for _, job := range b.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].CreatedAt.Equal(jobs[j].CreatedAt) {
+			return jobs[i].CreatedAt.Before(jobs[j].CreatedAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// withDefaults fills in the page size and order of new jobs
+func (b *backfiller) withDefaults(options backfillOptions) backfillOptions {
+	if options.PageSize <= 0 {
+		options.PageSize = b.pageSize
+	}
+	if options.Order == "" {
+		options.Order = b.config.order()
+	}
+	return options
+}
+
+// validate checks a job over from to with options, their defaults applied
+func (b *backfiller) validate(from, to time.Time, options backfillOptions) error {
+	if from.IsZero() || !from.Before(to) {
+		return fmt.Errorf("from is required and must be before to")
+	}
+	if err := checkOrder(options.Order); err != nil {
+		return fmt.Errorf("order %w", err)
+	}
+	if options.Order == orderLiveFirst && b.di.config.Backfill.LiveFirst.RoutingKey == "" {
+		return fmt.Errorf("order live_first needs backfill.live_first.routing_key")
+	}
+	if options.Order == orderNewestFirst && b.di.ordering != nil {
+		return fmt.Errorf("order newest_first cannot be used with publishing.ordering per_location")
+	}
+	return b.checkWorkers(from, to, options)
+}
+
+// create queues a job, see backfillOptions for the defaults
+func (b *backfiller) create(location string, from, to time.Time, options backfillOptions) BackfillJob {
+	options = b.withDefaults(options)
+	from, to = from.UTC(), to.UTC()
+	cursor := from
+	if options.Order == orderNewestFirst {
+		cursor = to
+	}
+	now := b.now().UTC()
+	job := &BackfillJob{
+		ID:         newMessageID(),
+		Location:   location,
+		From:       from,
+		To:         to,
+		PageSize:   options.PageSize.String(),
+		State:      jobPending,
+		Order:      options.Order,
+		Cursor:     cursor,
+		PagesTotal: pageCount(from, to, options.PageSize),
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	if options.Workers > 1 {
+		job.Workers = options.Workers
+		job.ChunkSize = chunkSize(from, to, options).String()
+		job.Chunks = chunk(from, to, options)
+		job.PagesTotal = 0
+		for _, chunk := range job.Chunks {
+			job.PagesTotal += chunk.PagesTotal
+		}
+	}
+	b.mu.Lock()
+	b.jobs[job.ID] = job
+	b.save()
+	copied := job.copy()
+	b.mu.Unlock()
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return copied
+}
+
+// get returns a copy of a job
+func (b *backfiller) get(id string) (BackfillJob, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	job, ok := b.jobs[id]
+	if !ok {
+		return BackfillJob{}, false
+	}
+	return job.copy(), true
+}
+
+// backfillFilter selects the listed jobs; empty fields match every job
+type backfillFilter struct {
+	State    string
+	Location string
+	Since    time.Time
+}
+
+// list returns the jobs matching filter, newest first, without their pages
+func (b *backfiller) list(filter backfillFilter) []BackfillJob {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sorted := b.sorted()
+	jobs := make([]BackfillJob, 0, len(sorted))
+	for i := len(sorted) - 1; i >= 0; i-- {
+		job := sorted[i]
+		switch {
+		case filter.State != "" && job.State != filter.State:
+			continue
+		case filter.Location != "" && job.Location != filter.Location:
+			continue
+		case !filter.Since.IsZero() && job.CreatedAt.Before(filter.Since):
+			continue
+		}
+		copied := *job
+		copied.Pages, copied.Chunks = nil, nil
+		jobs = append(jobs, copied)
+	}
+	return jobs
+}
+
+// stop cancels a job that has not finished. The job is kept, marked
+// cancelled, with the pages it completed.
+func (b *backfiller) stop(id string) (BackfillJob, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	job, ok := b.jobs[id]
+	if !ok {
+		return BackfillJob{}, errJobNotFound
+	}
+	if job.finished() {
+		return job.copy(), errJobFinished
+	}
+	b.finish(job, jobCancelled, "")
+	if b.running == id {
+		b.cancel()
+	}
+	b.save()
+	return job.copy(), nil
+}
+
+// open returns the ids of the jobs that have not finished, oldest first
+func (b *backfiller) open() []string {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var ids []string
+	for _, job := range b.sorted() {
+		if !job.finished() {
+			ids = append(ids, job.ID)
+		}
+	}
+	return ids
+}
+
+// finish moves a job to a final state. A job that already finished keeps its
+// state, so the run a cancel stopped doesn't mark the job completed or
+// failed after all. It reports whether the job moved. Callers hold mu.
+func (b *backfiller) finish(job *BackfillJob, state, reason string) bool {
+	if job.finished() {
+		return false
+	}
+	now := b.now().UTC()
+	job.State, job.Error = state, reason
+	job.UpdatedAt, job.FinishedAt = now, &now
+	b.di.metrics.BackfillJobs.WithLabelValues(state).Inc()
+	return true
+}
+
+// next returns the oldest pending job and marks it running, or nil
+func (b *backfiller) next(ctx context.Context) (*BackfillJob, context.Context) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, job := range b.sorted() {
+		if job.State != jobPending {
+			continue
+		}
+		job.State, job.UpdatedAt = jobRunning, b.now().UTC()
+		b.save()
+		jobCtx, cancel := context.WithCancel(ctx)
+		b.running, b.cancel = job.ID, cancel
+		return job, jobCtx
+	}
+	return nil, nil
+}
+
+// run works through the pending jobs until ctx is done. A job stopped by
+// the shutdown stays running in the state file and is resumed on the next
+// start.
+func (b *backfiller) run(ctx context.Context) {
+	for {
+		job, jobCtx := b.next(ctx)
+		if job == nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-b.wake:
+				continue
+			}
+		}
+		b.runJob(jobCtx, job)
+		b.mu.Lock()
+		b.cancel()
+		b.running, b.cancel = "", nil
+		b.mu.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// runJob fetches and publishes the pages of job from its cursor on, in the
+// order of the job
+func (b *backfiller) runJob(ctx context.Context, job *BackfillJob) {
+	src := b.di.sourceByName(job.Location)
+	b.mu.Lock()
+	if src == nil {
+		b.finish(job, jobFailed, fmt.Sprintf("unknown location %q", job.Location))
+		b.save()
+		b.mu.Unlock()
+		return
+	}
+	if job.order() == orderNewestFirst && b.di.ordering != nil {
+		// Saved before publishing.ordering was switched on
+		b.finish(job, jobFailed, "order newest_first cannot be used with publishing.ordering per_location")
+		b.save()
+		b.mu.Unlock()
+		return
+	}
+	if job.order() == orderLiveFirst && b.di.config.Backfill.LiveFirst.RoutingKey == "" {
+		// Saved before backfill.live_first.routing_key was removed
+		b.finish(job, jobFailed, "order live_first needs backfill.live_first.routing_key")
+		b.save()
+		b.mu.Unlock()
+		return
+	}
+	id, order, cursor, chunked := job.ID, job.order(), job.Cursor, len(job.Chunks) > 0
+	b.mu.Unlock()
+
+	logger := b.logger.WithFields(logrus.Fields{"job": id, "location": src.name, "trigger": triggerBackfill})
+	logger.WithFields(logrus.Fields{"cursor": cursor, "order": order}).Info("Backfill job started")
+	if order == orderLiveFirst {
+		ctx = withBackgroundDrain(ctx)
+	}
+	if chunked {
+		b.runChunks(ctx, job, src, logger)
+		return
+	}
+	var last time.Time
+	for {
+		b.mu.Lock()
+		from, end, ok := job.nextPage()
+		b.mu.Unlock()
+		if !ok {
+			break
+		}
+		if order == orderLiveFirst {
+			if !b.yield(ctx, last) {
+				logger.WithField("cursor", from).Info("Backfill job stopped")
+				return
+			}
+			last = b.clock.Now()
+		}
+		page := b.di.backfillPage(ctx, src, id, from, end)
+
+		b.mu.Lock()
+		if ctx.Err() != nil {
+			// Cancelled, or interrupted by the shutdown: the page is not
+			// counted and is fetched again when the job is resumed
+			b.mu.Unlock()
+			logger.WithField("cursor", from).Info("Backfill job stopped")
+			return
+		}
+		b.di.metrics.BackfillPages.WithLabelValues(page.Outcome).Inc()
+		job.Pages = append(job.Pages, page)
+		job.UpdatedAt = b.now().UTC()
+		if page.Outcome == pageFailed {
+			b.finish(job, jobFailed, page.Error)
+			b.save()
+			b.mu.Unlock()
+			logger.WithFields(logrus.Fields{
+				"from": page.From,
+				"to":   page.To,
+			}).Error("Backfill job failed: " + page.Error)
+			return
+		}
+		job.advance(from, end)
+		job.PagesDone++
+		job.Readings += page.Readings
+		b.save()
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	completed := b.finish(job, jobCompleted, "")
+	readings := job.Readings
+	b.save()
+	b.mu.Unlock()
+	if !completed {
+		logger.Info("Backfill job stopped")
+		return
+	}
+	logger.WithField("readings", readings).Info("Backfill job completed")
+}
+
+// backfillPage fetches the readings of src between from and to and
+// publishes them like the polled ones, with MessageIds derived from the job
+// and the page
+func (di *DataIngestor) backfillPage(ctx context.Context, src *source, jobID string, from, to time.Time) BackfillPage {
+	page := BackfillPage{From: from, To: to}
+	fail := func(err error) BackfillPage {
+		page.Outcome, page.Error = pageFailed, err.Error()
+		return page
+	}
+
+	ctx = withFetchWindow(withUpstreamClass(withTrigger(ctx, triggerBackfill), upstreamBackfill), from, to)
+	if di.config.Backfill.Streaming.Enabled {
+		return di.backfillStreamedPage(ctx, src, jobID, page)
+	}
+	fetched, err := di.fetchSource(ctx, src)
+	if !errors.Is(err, ErrUpstreamRateLimited) {
+		// Counted apart from the polled fetches; backfills don't feed the
+		// breaker or the error budget
+		di.metrics.UpstreamFetches.WithLabelValues(src.name, triggerBackfill).Inc()
+	}
+	if errors.Is(err, ErrNoData) {
+		page.Outcome = pageNoData
+		return page
+	}
+	if err != nil {
+		return fail(fmt.Errorf("failed to fetch data from API: %w", err))
+	}
+	page.Outcome = pagePublished
+	if err := di.publishBackfill(ctx, src, jobID, &page, *fetched.Data, fetched.Headers); err != nil {
+		return fail(err)
+	}
+	return page
+}
+
+// backfillStreamedPage is backfillPage with backfill.streaming: the page is
+// published chunk by chunk while the response is decoded
+func (di *DataIngestor) backfillStreamedPage(ctx context.Context, src *source, jobID string, page BackfillPage) BackfillPage {
+	config := di.config.Backfill.Streaming
+	var counts streamCounts
+	// failed is a publish failure, reported as it is and not as a fetch's
+	var failed error
+	err := di.retryFetch(ctx, src.name, func(ctx context.Context) error {
+		// An attempt starts the page over; only attempts that published
+		// nothing are retried
+		attempt, published := page, false
+		failed = nil
+		var err error
+		counts, err = di.streamFrom(ctx, src, config, func(data WeatherData, headers map[string]string) error {
+			if err := di.publishBackfill(ctx, src, jobID, &attempt, data, headers); err != nil {
+				failed = err
+				return err
+			}
+			published = true
+			return nil
+		})
+		if err != nil && published {
+			err = fmt.Errorf("%w: %w", errStreamInterrupted, err)
+		}
+		page = attempt
+		return err
+	})
+	if !errors.Is(err, ErrUpstreamRateLimited) {
+		di.metrics.UpstreamFetches.WithLabelValues(src.name, triggerBackfill).Inc()
+	}
+	page.Skipped = counts.Skipped
+	if errors.Is(err, ErrNoData) {
+		page.Outcome = pageNoData
+		return page
+	}
+	if failed != nil {
+		page.Outcome, page.Error = pageFailed, failed.Error()
+		return page
+	}
+	if err != nil {
+		page.Outcome, page.Error = pageFailed, fmt.Sprintf("failed to fetch data from API: %s", err)
+		return page
+	}
+	page.Outcome = pagePublished
+	if counts.Skipped > 0 {
+		logFor(ctx, logFetch).WithFields(logrus.Fields{
+			"location": src.name,
+			"job":      jobID,
+			"skipped":  counts.Skipped,
+		}).Warn("Skipped backfill elements that are no reading")
+	}
+	return page
+}
+
+// publishBackfill publishes the readings of page that are in its window and
+// adds them to its counts. The MessageIds are derived from the job and the
+// page.
+func (di *DataIngestor) publishBackfill(ctx context.Context, src *source, jobID string, page *BackfillPage, data WeatherData, headers map[string]string) error {
+	readings := di.prepareReadings(ctx, di.inWindow(data, page.From, page.To))
+	var claim *dedupClaim
+	if di.dedup != nil {
+		var err error
+		if readings, claim, err = di.dedup.claim(ctx, readings, nil); err != nil {
+			return err
+		}
+	}
+	if len(readings) == 0 {
+		return nil
+	}
+	env := Envelope{
+		CorrelationID:   jobID,
+		UpstreamHeaders: headers,
+		MessageIDSeed:   jobID + "/" + page.From.Format(time.RFC3339Nano),
+		Trigger:         triggerBackfill,
+	}
+	publish := di.publishReadings
+	if backgroundDrainOf(ctx) {
+		release, err := di.backfill.holdBackground(ctx)
+		if err != nil {
+			di.dedup.release(claim)
+			return err
+		}
+		defer release()
+		publish = di.publishBackground
+	}
+	// Pages are history: they keep the order of their job, behind the
+	// fetches of the location in flight
+	ticket := di.ordering.ticket(src.name)
+	if err := di.enterOrder(ctx, ticket); err != nil {
+		di.dedup.release(claim)
+		return err
+	}
+	messageIDs, err := publish(&readings, env)
+	ticket.leave()
+	if err != nil {
+		di.dedup.release(claim)
+		return fmt.Errorf("failed to publish data to queue: %w", err)
+	}
+	di.dedup.commit(claim)
+	di.metrics.ReadingsPublished.WithLabelValues(src.name, triggerBackfill).Add(float64(len(readings)))
+	page.Readings += len(readings)
+	page.Messages += len(messageIDs)
+	return nil
+}
+
+// inWindow drops the readings timestamped outside [from, to), for upstreams
+// that ignore the until parameter. Readings without a timestamp are kept.
+func (di *DataIngestor) inWindow(data WeatherData, from, to time.Time) WeatherData {
+	field := di.config.API.Incremental.TimestampField
+	if field == "" {
+		field = defaultPartitionTimestampField
+	}
+	kept := make(WeatherData, 0, len(data))
+	for _, sensor := range data {
+		if t, ok := readingTimestamp(sensor, field); ok && (t.Before(from) || !t.Before(to)) {
+			continue
+		}
+		kept = append(kept, sensor)
+	}
+	return kept
+}
+
+type fetchWindowKey struct{}
+
+type fetchWindow struct {
+	from, to time.Time
+}
+
+// withFetchWindow makes the upstream calls made with ctx fetch the readings
+// between from and to instead of the cursor's
+func withFetchWindow(ctx context.Context, from, to time.Time) context.Context {
+	return context.WithValue(ctx, fetchWindowKey{}, fetchWindow{from: from, to: to})
+}
+
+func fetchWindowOf(ctx context.Context) (from, to time.Time, ok bool) {
+	window, ok := ctx.Value(fetchWindowKey{}).(fetchWindow)
+	return window.from, window.to, ok
+}
+
+// backfillRequest is the body of POST /backfill
+type backfillRequest struct {
+	Location string    `json:"location"`
+	From     time.Time `json:"from"`
+	// To is now by default
+	To time.Time `json:"to"`
+	// PageSize is a duration like "30m", backfill.page_size by default
+	PageSize string `json:"page_size"`
+	// Order is backfill.order by default
+	Order string `json:"order"`
+	// Workers run chunks of the range in parallel, 1 by default
+	Workers int `json:"workers"`
+	// ChunkSize is a duration like "24h", the range split evenly between
+	// the workers by default
+	ChunkSize string `json:"chunk_size"`
+}
+
+// handleBackfillCreate serves POST /backfill
+func (di *DataIngestor) handleBackfillCreate(c *gin.Context) {
+	if di.backfill == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "backfill is disabled",
+		})
+		return
+	}
+	if di.resources.rejects(resourceActionRejectBackfills) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": errResourceGuard.Error(),
+		})
+		return
+	}
+	var req backfillRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid backfill request: %v", err),
+		})
+		return
+	}
+	if di.sourceByName(req.Location) == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("unknown location %q", req.Location),
+		})
+		return
+	}
+	if req.To.IsZero() {
+		req.To = di.backfill.now()
+	}
+	var pageSize time.Duration
+	if req.PageSize != "" {
+		size, err := time.ParseDuration(req.PageSize)
+		if err != nil || size < minDuration {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("invalid page_size %q, use a duration like \"30m\"", req.PageSize),
+			})
+			return
+		}
+		pageSize = size
+	}
+	var size time.Duration
+	if req.ChunkSize != "" {
+		parsed, err := time.ParseDuration(req.ChunkSize)
+		if err != nil || parsed < minDuration {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("invalid chunk_size %q, use a duration like \"24h\"", req.ChunkSize),
+			})
+			return
+		}
+		size = parsed
+	}
+	options := di.backfill.withDefaults(backfillOptions{PageSize: pageSize, Order: req.Order, Workers: req.Workers, ChunkSize: size})
+	if err := di.backfill.validate(req.From, req.To, options); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	job := di.backfill.create(req.Location, req.From, req.To, options)
+	di.logger.WithFields(logrus.Fields{
+		"job":      job.ID,
+		"location": job.Location,
+		"from":     job.From,
+		"to":       job.To,
+		"pages":    job.PagesTotal,
+		"order":    job.Order,
+		"workers":  job.Workers,
+		"chunks":   len(job.Chunks),
+	}).Info("Backfill job created")
+	c.JSON(http.StatusAccepted, job)
+}
+
+// handleBackfillList serves GET /backfill, filtered by ?state=, ?location=
+// and ?since=
+func (di *DataIngestor) handleBackfillList(c *gin.Context) {
+	if di.backfill == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "backfill is disabled",
+		})
+		return
+	}
+	filter := backfillFilter{State: c.Query("state"), Location: c.Query("location")}
+	switch filter.State {
+	case "", jobPending, jobRunning, jobCompleted, jobFailed, jobCancelled:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("unknown state %q", filter.State),
+		})
+		return
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "since must be an RFC 3339 time",
+			})
+			return
+		}
+		filter.Since = t
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"jobs": di.backfill.list(filter),
+	})
+}
+
+// handleBackfillGet serves GET /backfill/:id with the outcome of every page
+func (di *DataIngestor) handleBackfillGet(c *gin.Context) {
+	if di.backfill == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "backfill is disabled",
+		})
+		return
+	}
+	job, ok := di.backfill.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": errJobNotFound.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// handleBackfillCancel serves DELETE /backfill/:id. The job is cancelled and
+// kept, not erased.
+func (di *DataIngestor) handleBackfillCancel(c *gin.Context) {
+	if di.backfill == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "backfill is disabled",
+		})
+		return
+	}
+	job, err := di.backfill.stop(c.Param("id"))
+	switch {
+	case errors.Is(err, errJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case errors.Is(err, errJobFinished):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+			"state": job.State,
+		})
+		return
+	}
+	di.logger.WithFields(logrus.Fields{
+		"job":      job.ID,
+		"location": job.Location,
+		"cursor":   job.Cursor,
+	}).Warn("Backfill job cancelled")
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var backfillStart = time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+
+// historyUpstream serves one reading a minute into every requested window,
+// and one just before it that the backfill has to drop. Requests for the
+// window starting at hold block until release is closed.
+type historyUpstream struct {
+	mu      sync.Mutex
+	windows []string
+	hold    time.Time
+	held    chan struct{}
+	release chan struct{}
+	server  *httptest.Server
+}
+
+func newHistoryUpstream(t *testing.T) *historyUpstream {
+	t.Helper()
+	upstream := &historyUpstream{held: make(chan struct{}, 10), release: make(chan struct{})}
+	upstream.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		since, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("since"))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		upstream.mu.Lock()
+		upstream.windows = append(upstream.windows, r.URL.Query().Get("since")+"/"+r.URL.Query().Get("until"))
+		hold := since.Equal(upstream.hold)
+		upstream.mu.Unlock()
+		if hold {
+			upstream.held <- struct{}{}
+			select {
+			case <-upstream.release:
+			case <-r.Context().Done():
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[
+			{"type":"weather","name":"berlin-1","payload":{"timestamp":%q}},
+			{"type":"weather","name":"berlin-1","payload":{"timestamp":%q}}
+		]`, since.Add(time.Minute).Format(time.RFC3339), since.Add(-time.Minute).Format(time.RFC3339))
+	}))
+	t.Cleanup(func() {
+		upstream.unblock()
+		upstream.server.Close()
+	})
+	return upstream
+}
+
+func (u *historyUpstream) holdAt(since time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.hold = since
+}
+
+func (u *historyUpstream) unblock() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	select {
+	case <-u.release:
+	default:
+		close(u.release)
+	}
+}
+
+func (u *historyUpstream) requests() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.windows...)
+}
+
+func newBackfillIngestor(t *testing.T, baseURL, stateFile string) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: baseURL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Backfill: BackfillConfig{Enabled: true, StateFile: stateFile, PageSize: Duration(time.Hour)},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+// runBackfill runs the ingestor's backfill jobs until the test ends or the
+// returned stop is called
+func runBackfill(t *testing.T, ingestor *DataIngestor) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.backfill.run(ctx)
+	}()
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			cancel()
+			<-done
+		})
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+func backfillCall(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer letmein")
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func createBackfill(t *testing.T, router http.Handler, hours int) BackfillJob {
+	t.Helper()
+	w := backfillCall(router, http.MethodPost, "/backfill", fmt.Sprintf(`{"location":"default","from":%q,"to":%q}`,
+		backfillStart.Format(time.RFC3339), backfillStart.Add(time.Duration(hours)*time.Hour).Format(time.RFC3339)))
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var job BackfillJob
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	return job
+}
+
+func waitForJob(t *testing.T, ingestor *DataIngestor, id, state string) BackfillJob {
+	t.Helper()
+	var job BackfillJob
+	require.Eventually(t, func() bool {
+		job, _ = ingestor.backfill.get(id)
+		return job.State == state
+	}, 5*time.Second, 5*time.Millisecond, "job never became %s", state)
+	return job
+}
+
+func TestBackfill_PublishesEveryPage(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	ingestor, channel := newBackfillIngestor(t, upstream.server.URL, filepath.Join(t.TempDir(), "backfill.json"))
+	router := setupRoutes(ingestor)
+	runBackfill(t, ingestor)
+
+	created := createBackfill(t, router, 3)
+	assert.Equal(t, jobPending, created.State)
+	assert.Equal(t, 3, created.PagesTotal)
+	assert.Equal(t, "1h0m0s", created.PageSize)
+
+	job := waitForJob(t, ingestor, created.ID, jobCompleted)
+	assert.Equal(t, 3, job.PagesDone)
+	assert.Equal(t, 3, job.Readings, "the reading before each window is dropped")
+	assert.Equal(t, backfillStart.Add(3*time.Hour), job.Cursor)
+	require.Len(t, job.Pages, 3)
+	for i, page := range job.Pages {
+		assert.Equal(t, backfillStart.Add(time.Duration(i)*time.Hour), page.From)
+		assert.Equal(t, pagePublished, page.Outcome)
+		assert.Equal(t, 1, page.Messages)
+	}
+	assert.Equal(t, []string{
+		"2026-03-01T00:00:00Z/2026-03-01T01:00:00Z",
+		"2026-03-01T01:00:00Z/2026-03-01T02:00:00Z",
+		"2026-03-01T02:00:00Z/2026-03-01T03:00:00Z",
+	}, upstream.requests())
+
+	messages := channel.messages()
+	require.Len(t, messages, 3)
+	for _, message := range messages {
+		assert.Equal(t, created.ID, message.Msg.CorrelationId)
+	}
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.BackfillPages.WithLabelValues(pagePublished)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.BackfillJobs.WithLabelValues(jobCompleted)))
+
+	w := backfillCall(router, http.MethodGet, "/backfill/"+created.ID, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"pages":[`)
+}
+
+func TestBackfill_RepublishedPageKeepsMessageIDs(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	ingestor, channel := newBackfillIngestor(t, upstream.server.URL, filepath.Join(t.TempDir(), "backfill.json"))
+	src := ingestor.sourceByName(defaultSourceName)
+
+	first := ingestor.backfillPage(context.Background(), src, "job-1", backfillStart, backfillStart.Add(time.Hour))
+	again := ingestor.backfillPage(context.Background(), src, "job-1", backfillStart, backfillStart.Add(time.Hour))
+	other := ingestor.backfillPage(context.Background(), src, "job-2", backfillStart, backfillStart.Add(time.Hour))
+	require.Equal(t, pagePublished, first.Outcome)
+	require.Equal(t, pagePublished, again.Outcome)
+	require.Equal(t, pagePublished, other.Outcome)
+
+	messages := channel.messages()
+	require.Len(t, messages, 3)
+	assert.Equal(t, messages[0].Msg.MessageId, messages[1].Msg.MessageId, "consumers see the repeated page as a duplicate")
+	assert.NotEqual(t, messages[0].Msg.MessageId, messages[2].Msg.MessageId, "another job's page is not a duplicate")
+}
+
+func TestBackfill_ResumesAfterCrash(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	upstream.holdAt(backfillStart.Add(2 * time.Hour))
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "backfill.json")
+
+	first, firstChannel := newBackfillIngestor(t, upstream.server.URL, stateFile)
+	runBackfill(t, first)
+	created := createBackfill(t, setupRoutes(first), 5)
+
+	// The process dies on the third page: the state file is what is left
+	select {
+	case <-upstream.held:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the third page was never fetched")
+	}
+	crashed, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	crashFile := filepath.Join(dir, "crashed.json")
+	require.NoError(t, os.WriteFile(crashFile, crashed, 0o600))
+	assert.Len(t, firstChannel.messages(), 2)
+
+	upstream.holdAt(time.Time{})
+	second, secondChannel := newBackfillIngestor(t, upstream.server.URL, crashFile)
+	resumed, ok := second.backfill.get(created.ID)
+	require.True(t, ok)
+	assert.Equal(t, jobPending, resumed.State)
+	assert.Equal(t, 1, resumed.Resumed)
+	assert.Equal(t, backfillStart.Add(2*time.Hour), resumed.Cursor)
+
+	runBackfill(t, second)
+	job := waitForJob(t, second, created.ID, jobCompleted)
+	assert.Equal(t, 5, job.PagesDone)
+	assert.Equal(t, 5, job.Readings)
+	require.Len(t, job.Pages, 5)
+	assert.Equal(t, backfillStart.Add(2*time.Hour), job.Pages[2].From)
+
+	// Only the pages the first process did not complete are published again
+	messages := secondChannel.messages()
+	require.Len(t, messages, 3)
+	var data WeatherData
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &data))
+	assert.Equal(t, backfillStart.Add(2*time.Hour+time.Minute).Format(time.RFC3339), data[0].Payload["timestamp"])
+
+	// The restarted process shows the job as finished
+	state, err := os.ReadFile(crashFile)
+	require.NoError(t, err)
+	assert.Contains(t, string(state), `"state": "completed"`)
+}
+
+func TestBackfill_ShutdownLeavesJobToResume(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	upstream.holdAt(backfillStart.Add(time.Hour))
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+
+	first, _ := newBackfillIngestor(t, upstream.server.URL, stateFile)
+	stop := runBackfill(t, first)
+	created := createBackfill(t, setupRoutes(first), 3)
+	<-upstream.held
+	stop()
+	job, _ := first.backfill.get(created.ID)
+	assert.Equal(t, jobRunning, job.State)
+	assert.Len(t, job.Pages, 1, "the interrupted page is not recorded")
+
+	upstream.holdAt(time.Time{})
+	second, _ := newBackfillIngestor(t, upstream.server.URL, stateFile)
+	runBackfill(t, second)
+	job = waitForJob(t, second, created.ID, jobCompleted)
+	assert.Equal(t, 1, job.Resumed)
+	assert.Equal(t, 3, job.PagesDone)
+}
+
+func TestBackfill_CancelMarksJob(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	upstream.holdAt(backfillStart.Add(time.Hour))
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+	ingestor, _ := newBackfillIngestor(t, upstream.server.URL, stateFile)
+	router := setupRoutes(ingestor)
+	runBackfill(t, ingestor)
+
+	created := createBackfill(t, router, 3)
+	<-upstream.held
+	w := backfillCall(router, http.MethodDelete, "/backfill/"+created.ID, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	job := waitForJob(t, ingestor, created.ID, jobCancelled)
+	assert.Equal(t, 1, job.PagesDone, "the completed page is kept")
+	assert.NotNil(t, job.FinishedAt)
+	assert.Equal(t, http.StatusConflict, backfillCall(router, http.MethodDelete, "/backfill/"+created.ID, "").Code)
+	assert.Equal(t, http.StatusNotFound, backfillCall(router, http.MethodDelete, "/backfill/unknown", "").Code)
+
+	// Still listed, and not resumed after a restart
+	w = backfillCall(router, http.MethodGet, "/backfill?state=cancelled", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	var list struct {
+		Jobs []BackfillJob `json:"jobs"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+	require.Len(t, list.Jobs, 1)
+	assert.Equal(t, created.ID, list.Jobs[0].ID)
+	assert.Empty(t, list.Jobs[0].Pages, "the list leaves the pages out")
+
+	restarted, _ := newBackfillIngestor(t, upstream.server.URL, stateFile)
+	job, ok := restarted.backfill.get(created.ID)
+	require.True(t, ok)
+	assert.Equal(t, jobCancelled, job.State)
+	assert.Zero(t, job.Resumed)
+}
+
+func TestBackfill_FinalStatesAreSticky(t *testing.T) {
+	ingestor, _ := newBackfillIngestor(t, "http://127.0.0.1:1", filepath.Join(t.TempDir(), "backfill.json"))
+	b := ingestor.backfill
+	created := b.create("default", backfillStart, backfillStart.Add(time.Hour), backfillOptions{})
+
+	// The run that was cancelled returns after the cancel
+	b.mu.Lock()
+	b.finish(b.jobs[created.ID], jobCancelled, "")
+	b.finish(b.jobs[created.ID], jobCompleted, "")
+	b.finish(b.jobs[created.ID], jobFailed, "context canceled")
+	b.mu.Unlock()
+
+	job, ok := b.get(created.ID)
+	require.True(t, ok)
+	assert.Equal(t, jobCancelled, job.State)
+	assert.Empty(t, job.Error)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.BackfillJobs.WithLabelValues(jobCancelled)))
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.BackfillJobs.WithLabelValues(jobCompleted)))
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.BackfillJobs.WithLabelValues(jobFailed)))
+}
+
+func TestBackfill_ListFiltersAndRetention(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+	ingestor, _ := newBackfillIngestor(t, "http://127.0.0.1:1", stateFile)
+	b := ingestor.backfill
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	b.now = func() time.Time { return now }
+
+	old := b.create("default", backfillStart, backfillStart.Add(time.Hour), backfillOptions{})
+	now = now.Add(time.Hour)
+	recent := b.create("default", backfillStart, backfillStart.Add(2*time.Hour), backfillOptions{PageSize: 30 * time.Minute})
+	assert.Equal(t, 4, recent.PagesTotal)
+
+	b.mu.Lock()
+	b.finish(b.jobs[old.ID], jobCompleted, "")
+	b.mu.Unlock()
+
+	router := setupRoutes(ingestor)
+	list := func(query string) []string {
+		w := backfillCall(router, http.MethodGet, "/backfill"+query, "")
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var body struct {
+			Jobs []BackfillJob `json:"jobs"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		ids := make([]string, len(body.Jobs))
+		for i, job := range body.Jobs {
+			ids[i] = job.ID
+		}
+		return ids
+	}
+	assert.Equal(t, []string{recent.ID, old.ID}, list(""), "newest first")
+	assert.Equal(t, []string{old.ID}, list("?state=completed"))
+	assert.Equal(t, []string{recent.ID}, list("?since=2026-03-10T12:30:00Z"))
+	assert.Empty(t, list("?location=elsewhere"))
+	assert.Equal(t, http.StatusBadRequest, backfillCall(router, http.MethodGet, "/backfill?state=done", "").Code)
+
+	// Finished jobs are kept for the retention period, then dropped
+	now = now.Add(defaultBackfillRetention + time.Minute)
+	b.mu.Lock()
+	b.save()
+	b.mu.Unlock()
+	assert.Equal(t, []string{recent.ID}, list(""))
+}
+
+func TestBackfill_CreateValidation(t *testing.T) {
+	ingestor, _ := newBackfillIngestor(t, "http://127.0.0.1:1", filepath.Join(t.TempDir(), "backfill.json"))
+	router := setupRoutes(ingestor)
+
+	for body, code := range map[string]int{
+		`{"location":"moscow","from":"2026-03-01T00:00:00Z"}`:                              http.StatusNotFound,
+		`{"location":"default","from":"2026-03-02T00:00:00Z","to":"2026-03-01T00:00:00Z"}`: http.StatusBadRequest,
+		`{"location":"default"}`: http.StatusBadRequest,
+		`{"location":"default","from":"2026-03-01T00:00:00Z","page_size":"soon"}`: http.StatusBadRequest,
+		`{"location":`: http.StatusBadRequest,
+	} {
+		assert.Equal(t, code, backfillCall(router, http.MethodPost, "/backfill", body).Code, body)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/backfill", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code, "the jobs are behind the admin token")
+
+	disabled := NewDataIngestor(&Config{Logging: LoggingConfig{Level: "panic"}, Admin: AdminConfig{Token: "letmein"}})
+	assert.Equal(t, http.StatusConflict, backfillCall(setupRoutes(disabled), http.MethodGet, "/backfill", "").Code)
+
+	assert.ErrorContains(t, (&Config{
+		Backfill:   BackfillConfig{Enabled: true},
+		Publishing: PublishingConfig{Passthrough: true},
+	}).Validate(), "backfill cannot be combined with publishing.passthrough")
+	assert.ErrorContains(t, BackfillConfig{PageSize: -1}.Validate(), "backfill.page_size")
+}
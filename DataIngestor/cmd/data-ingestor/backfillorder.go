@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Orders in which a backfill job works through its pages
+const (
+	// orderOldestFirst walks from the start of the job to its end
+	orderOldestFirst = "oldest_first"
+	// orderNewestFirst walks from the end of the job back to its start, so
+	// the freshest of the missing readings arrive first
+	orderNewestFirst = "newest_first"
+	// orderLiveFirst walks oldest first at a throttled rate, never while an
+	// ingestion cycle is running, and publishes on a routing key of its own
+	orderLiveFirst = "live_first"
+)
+
+const (
+	defaultLiveFirstInterval    = time.Second
+	defaultLiveFirstMaxInFlight = 1
+	// liveFirstYieldPoll is how often a live_first job checks whether the
+	// running cycles have ended
+	liveFirstYieldPoll = 100 * time.Millisecond
+)
+
+// Reasons a live_first job waited before its next page
+const (
+	yieldInterval  = "interval"
+	yieldLiveCycle = "live_cycle"
+)
+
+// BackfillLiveFirstConfig is the throttle and the target of live_first jobs
+type BackfillLiveFirstConfig struct {
+	// Interval is the least time between the starts of two pages, one
+	// second by default
+	Interval Duration `yaml:"interval"`
+	// Exchange and RoutingKey receive the pages instead of the queues the
+	// polled readings go to. The queue or binding must exist.
+	Exchange   string `yaml:"exchange"`
+	RoutingKey string `yaml:"routing_key"`
+	// MaxInFlight is the most pages published to the target at once, over
+	// all live_first jobs and chunks, one by default
+	MaxInFlight int `yaml:"max_in_flight"`
+}
+
+// ErrNoBackgroundTarget is returned for a live_first page when
+// backfill.live_first.routing_key is not set
+var ErrNoBackgroundTarget = errors.New("backfill.live_first.routing_key is not set")
+
+func (c BackfillLiveFirstConfig) maxInFlight() int {
+	if c.MaxInFlight > 0 {
+		return c.MaxInFlight
+	}
+	return defaultLiveFirstMaxInFlight
+}
+
+func (c BackfillLiveFirstConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval)
+	}
+	return defaultLiveFirstInterval
+}
+
+// validateOrder checks backfill.order and, for live_first jobs, the
+// live_first settings
+func (c BackfillConfig) validateOrder() error {
+	if err := checkOrder(c.Order); err != nil {
+		return fmt.Errorf("backfill.order: %w", err)
+	}
+	if c.LiveFirst.Interval < 0 {
+		return fmt.Errorf("backfill.live_first.interval must not be negative")
+	}
+	if c.LiveFirst.MaxInFlight < 0 {
+		return fmt.Errorf("backfill.live_first.max_in_flight must not be negative")
+	}
+	if c.order() == orderLiveFirst && c.LiveFirst.RoutingKey == "" {
+		return fmt.Errorf("backfill.live_first.routing_key is required with order live_first")
+	}
+	return nil
+}
+
+func (c BackfillConfig) order() string {
+	if c.Order == "" {
+		return orderOldestFirst
+	}
+	return c.Order
+}
+
+func checkOrder(order string) error {
+	switch order {
+	case "", orderOldestFirst, orderNewestFirst, orderLiveFirst:
+		return nil
+	}
+	return fmt.Errorf("must be oldest_first, newest_first or live_first, got %q", order)
+}
+
+// order returns the order of the job. Jobs saved before there were orders
+// are oldest first.
+func (j *BackfillJob) order() string {
+	if j.Order == "" {
+		return orderOldestFirst
+	}
+	return j.Order
+}
+
+// nextPage returns the next page of the job from its cursor, or false when
+// no page is left
+func (j *BackfillJob) nextPage() (from, to time.Time, ok bool) {
+	size := j.pageSize()
+	if j.order() == orderNewestFirst {
+		if !j.Cursor.After(j.From) {
+			return time.Time{}, time.Time{}, false
+		}
+		from = j.Cursor.Add(-size)
+		if from.Before(j.From) {
+			from = j.From
+		}
+		return from, j.Cursor, true
+	}
+	if !j.Cursor.Before(j.To) {
+		return time.Time{}, time.Time{}, false
+	}
+	to = j.Cursor.Add(size)
+	if to.After(j.To) {
+		to = j.To
+	}
+	return j.Cursor, to, true
+}
+
+// advance moves the cursor of the job past the page from to
+func (j *BackfillJob) advance(from, to time.Time) {
+	if j.order() == orderNewestFirst {
+		j.Cursor = from
+		return
+	}
+	j.Cursor = to
+}
+
+// yield holds a live_first job before its next page until the interval since
+// the last page has passed and no ingestion cycle is running. It returns
+// false when ctx is done first.
+func (b *backfiller) yield(ctx context.Context, last time.Time) bool {
+	if !last.IsZero() {
+		if wait := last.Add(b.config.LiveFirst.interval()).Sub(b.clock.Now()); wait > 0 {
+			b.di.metrics.BackfillYields.WithLabelValues(yieldInterval).Inc()
+			select {
+			case <-ctx.Done():
+				return false
+			case <-b.clock.After(wait):
+			}
+		}
+	}
+	return b.waitForCycles(ctx)
+}
+
+// waitForCycles returns once no ingestion cycle is running, or false when
+// ctx is done first
+func (b *backfiller) waitForCycles(ctx context.Context) bool {
+	if b.di.cycles.busy() {
+		b.di.metrics.BackfillYields.WithLabelValues(yieldLiveCycle).Inc()
+		for b.di.cycles.busy() {
+			select {
+			case <-ctx.Done():
+				return false
+			case <-b.clock.After(liveFirstYieldPoll):
+			}
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// holdBackground takes one of the live_first.max_in_flight slots for the
+// publish of a live_first page, waiting for a free slot and then for the
+// running cycles to end, so the readings fetched while a cycle started are
+// not published ahead of it. The returned function frees the slot.
+func (b *backfiller) holdBackground(ctx context.Context) (func(), error) {
+	select {
+	case b.background <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	release := func() { <-b.background }
+	if !b.waitForCycles(ctx) {
+		release()
+		return nil, ctx.Err()
+	}
+	return release, nil
+}
+
+type backgroundDrainKey struct{}
+
+// withBackgroundDrain makes the backfill pages published with ctx go to the
+// live_first target
+func withBackgroundDrain(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundDrainKey{}, true)
+}
+
+func backgroundDrainOf(ctx context.Context) bool {
+	drain, _ := ctx.Value(backgroundDrainKey{}).(bool)
+	return drain
+}
+
+// publishBackground publishes the readings of a live_first page as one
+// message to backfill.live_first, without a priority, whatever the batch
+// mode, partitions and routes of the polled readings
+func (di *DataIngestor) publishBackground(data *WeatherData, env Envelope) ([]string, error) {
+	if di.enricher != nil {
+		di.enricher.Enrich(*data)
+	}
+	target := di.config.Backfill.LiveFirst
+	if target.RoutingKey == "" {
+		// Reloaded without one while a saved live_first job runs
+		return nil, ErrNoBackgroundTarget
+	}
+	messageID, err := di.publish(target.Exchange, target.RoutingKey, data, env)
+	if err != nil {
+		return nil, err
+	}
+	di.log(logPublish).WithFields(logrus.Fields{
+		"exchange":    target.Exchange,
+		"routing_key": target.RoutingKey,
+		"count":       len(*data),
+	}).Info("Backfill data published in the background")
+	return []string{messageID}, nil
+}
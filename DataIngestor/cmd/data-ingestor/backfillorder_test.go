@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const backgroundKey = "meter-data-queue.backfill"
+
+func newOrderedIngestor(t *testing.T, baseURL, stateFile string, config BackfillConfig) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	config.Enabled, config.StateFile, config.PageSize = true, stateFile, Duration(time.Hour)
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: baseURL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Backfill: config,
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+// writeBackfillState pre-populates a state file with pending jobs, as left
+// behind by a long downtime
+func writeBackfillState(t *testing.T, stateFile string, jobs ...*BackfillJob) {
+	t.Helper()
+	body, err := json.Marshal(backfillState{Version: backfillStateVersion, Jobs: jobs})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(stateFile, body, 0o600))
+}
+
+func pendingJob(id, order string, hours int) *BackfillJob {
+	to := backfillStart.Add(time.Duration(hours) * time.Hour)
+	cursor := backfillStart
+	if order == orderNewestFirst {
+		cursor = to
+	}
+	return &BackfillJob{
+		ID:         id,
+		Location:   "default",
+		From:       backfillStart,
+		To:         to,
+		PageSize:   "1h0m0s",
+		State:      jobPending,
+		Order:      order,
+		Cursor:     cursor,
+		PagesTotal: hours,
+		CreatedAt:  backfillStart,
+	}
+}
+
+func window(from, to int) string {
+	return backfillStart.Add(time.Duration(from)*time.Hour).Format(time.RFC3339Nano) + "/" +
+		backfillStart.Add(time.Duration(to)*time.Hour).Format(time.RFC3339Nano)
+}
+
+func TestBackfillConfig_ValidateOrder(t *testing.T) {
+	assert.NoError(t, BackfillConfig{}.Validate())
+	assert.NoError(t, BackfillConfig{Order: orderNewestFirst}.Validate())
+	assert.NoError(t, BackfillConfig{Order: orderLiveFirst, LiveFirst: BackfillLiveFirstConfig{RoutingKey: backgroundKey}}.Validate())
+
+	assert.ErrorContains(t, BackfillConfig{Order: "random"}.Validate(), "backfill.order")
+	assert.ErrorContains(t, BackfillConfig{Order: orderLiveFirst}.Validate(), "routing_key is required")
+	assert.ErrorContains(t, BackfillConfig{LiveFirst: BackfillLiveFirstConfig{Interval: -1}}.Validate(), "interval")
+	assert.ErrorContains(t, BackfillConfig{LiveFirst: BackfillLiveFirstConfig{MaxInFlight: -1}}.Validate(), "max_in_flight")
+}
+
+func TestBackfillJob_NextPage(t *testing.T) {
+	job := &BackfillJob{
+		From:     backfillStart,
+		To:       backfillStart.Add(150 * time.Minute),
+		PageSize: "1h0m0s",
+		Order:    orderNewestFirst,
+		Cursor:   backfillStart.Add(150 * time.Minute),
+	}
+	var pages []string
+	for {
+		from, to, ok := job.nextPage()
+		if !ok {
+			break
+		}
+		pages = append(pages, from.Format("15:04")+"-"+to.Format("15:04"))
+		job.advance(from, to)
+	}
+	assert.Equal(t, []string{"01:30-02:30", "00:30-01:30", "00:00-00:30"}, pages, "the last page is cut at from")
+	assert.Equal(t, backfillStart, job.Cursor)
+
+	job.Order, job.Cursor = "", backfillStart
+	from, to, ok := job.nextPage()
+	require.True(t, ok, "jobs without an order are oldest first")
+	assert.Equal(t, backfillStart, from)
+	assert.Equal(t, backfillStart.Add(time.Hour), to)
+}
+
+func TestBackfill_NewestFirstDrainsTheFreshestPagesFirst(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+	legacy := pendingJob("legacy", "", 2)
+	legacy.CreatedAt = legacy.CreatedAt.Add(time.Second)
+	writeBackfillState(t, stateFile, pendingJob("outage", orderNewestFirst, 3), legacy)
+	ingestor, _ := newOrderedIngestor(t, upstream.server.URL, stateFile, BackfillConfig{Order: orderNewestFirst})
+	runBackfill(t, ingestor)
+
+	job := waitForJob(t, ingestor, "outage", jobCompleted)
+	assert.Equal(t, 3, job.PagesDone)
+	assert.Equal(t, backfillStart, job.Cursor)
+	waitForJob(t, ingestor, "legacy", jobCompleted)
+	assert.Equal(t, []string{
+		window(2, 3), window(1, 2), window(0, 1),
+		// The job saved without an order keeps the order it was created in
+		window(0, 1), window(1, 2),
+	}, upstream.requests())
+
+	// New jobs take backfill.order unless the request names one
+	router := setupRoutes(ingestor)
+	created := createBackfill(t, router, 2)
+	assert.Equal(t, orderNewestFirst, created.Order)
+	assert.Equal(t, backfillStart.Add(2*time.Hour), created.Cursor)
+
+	w := backfillCall(router, http.MethodPost, "/backfill", `{"location":"default","from":"2026-03-01T00:00:00Z","to":"2026-03-01T02:00:00Z","order":"oldest_first"}`)
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var job2 BackfillJob
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job2))
+	assert.Equal(t, orderOldestFirst, job2.Order)
+	assert.Equal(t, job2.From, job2.Cursor)
+
+	w = backfillCall(router, http.MethodPost, "/backfill", `{"location":"default","from":"2026-03-01T00:00:00Z","order":"sideways"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	w = backfillCall(router, http.MethodPost, "/backfill", `{"location":"default","from":"2026-03-01T00:00:00Z","order":"live_first"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "live_first needs a routing key")
+}
+
+func TestBackfill_LiveFirstYieldsToLiveTraffic(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+	writeBackfillState(t, stateFile, pendingJob("outage", orderLiveFirst, 3))
+	ingestor, channel := newOrderedIngestor(t, upstream.server.URL, stateFile, BackfillConfig{
+		Order:     orderLiveFirst,
+		LiveFirst: BackfillLiveFirstConfig{Interval: Duration(time.Minute), RoutingKey: backgroundKey},
+	})
+	clock := &fakeClock{now: backfillStart}
+	ingestor.backfill.now, ingestor.backfill.clock = clock.Now, clock
+	runBackfill(t, ingestor)
+
+	// The first page goes out at once, then the job waits for the interval
+	require.Eventually(t, func() bool { return clock.waiting() == 1 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{window(0, 1)}, upstream.requests())
+
+	// A live cycle starts while the job waits, and outlasts the interval
+	done := ingestor.cycles.begin("default", clock.Now())
+	clock.Advance(time.Minute)
+	require.Eventually(t, func() bool { return clock.waiting() == 1 }, 5*time.Second, 5*time.Millisecond)
+	live := WeatherData{{Type: "weather", Name: "berlin-1", Payload: map[string]interface{}{"timestamp": "2026-03-01T09:00:00Z"}}}
+	_, err := ingestor.publishReadings(&live, Envelope{Trigger: triggerPoll})
+	require.NoError(t, err)
+	clock.Advance(liveFirstYieldPoll)
+	require.Eventually(t, func() bool { return clock.waiting() == 1 }, 5*time.Second, 5*time.Millisecond)
+	assert.Len(t, upstream.requests(), 1, "no page is fetched while a live cycle runs")
+
+	done()
+	clock.Advance(liveFirstYieldPoll)
+	require.Eventually(t, func() bool { return len(upstream.requests()) == 2 }, 5*time.Second, 5*time.Millisecond)
+	require.Eventually(t, func() bool { return clock.waiting() == 1 }, 5*time.Second, 5*time.Millisecond)
+	clock.Advance(time.Minute)
+	job := waitForJob(t, ingestor, "outage", jobCompleted)
+	assert.Equal(t, 3, job.PagesDone)
+	assert.Equal(t, []string{window(0, 1), window(1, 2), window(2, 3)}, upstream.requests())
+
+	messages := channel.messages()
+	require.Len(t, messages, 4)
+	assert.Equal(t, backgroundKey, messages[0].RoutingKey)
+	assert.Equal(t, "meter-data-queue", messages[1].RoutingKey, "the live readings are not queued behind the backlog")
+	for _, message := range []publishedMessage{messages[0], messages[2], messages[3]} {
+		assert.Equal(t, backgroundKey, message.RoutingKey)
+		assert.Zero(t, message.Msg.Priority)
+		assert.Equal(t, triggerBackfill, message.Msg.Headers["trigger"])
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.BackfillYields.WithLabelValues(yieldInterval)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.BackfillYields.WithLabelValues(yieldLiveCycle)))
+}
+
+func TestBackfill_LiveFirstWithoutRoutingKeyFails(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+	// Saved under a config that had a routing key
+	writeBackfillState(t, stateFile, pendingJob("outage", orderLiveFirst, 2))
+	ingestor, channel := newOrderedIngestor(t, upstream.server.URL, stateFile, BackfillConfig{})
+	runBackfill(t, ingestor)
+
+	job := waitForJob(t, ingestor, "outage", jobFailed)
+	assert.Contains(t, job.Error, "live_first.routing_key")
+	assert.Empty(t, upstream.requests())
+	assert.Empty(t, channel.messages())
+
+	data := WeatherData{{Type: "weather", Name: "berlin-1"}}
+	_, err := ingestor.publishBackground(&data, Envelope{Trigger: triggerBackfill})
+	assert.ErrorIs(t, err, ErrNoBackgroundTarget)
+	assert.Empty(t, channel.messages(), "nothing is published to an empty routing key")
+}
+
+func TestBackfill_BackgroundPublishesAreBounded(t *testing.T) {
+	ingestor, _ := newOrderedIngestor(t, "http://127.0.0.1:1", filepath.Join(t.TempDir(), "backfill.json"), BackfillConfig{
+		Order:     orderLiveFirst,
+		LiveFirst: BackfillLiveFirstConfig{RoutingKey: backgroundKey},
+	})
+	clock := &fakeClock{now: backfillStart}
+	ingestor.backfill.clock = clock
+
+	release, err := ingestor.backfill.holdBackground(context.Background())
+	require.NoError(t, err)
+
+	// A second page waits for the slot, then for the cycle that started
+	held := make(chan func(), 1)
+	go func() {
+		release, err := ingestor.backfill.holdBackground(context.Background())
+		assert.NoError(t, err)
+		held <- release
+	}()
+	done := ingestor.cycles.begin("default", clock.Now())
+	release()
+	require.Eventually(t, func() bool { return clock.waiting() == 1 }, 5*time.Second, 5*time.Millisecond)
+	select {
+	case <-held:
+		t.Fatal("published while a live cycle runs")
+	default:
+	}
+	done()
+	clock.Advance(liveFirstYieldPoll)
+	select {
+	case release := <-held:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("the page was not published after the cycle ended")
+	}
+
+	// A cancelled page gives up its place in the queue
+	release, err = ingestor.backfill.holdBackground(context.Background())
+	require.NoError(t, err)
+	defer release()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = ingestor.backfill.holdBackground(ctx)
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBackfillMaxWorkers = 4
+	// maxBackfillWorkers bounds backfill.max_workers
+	maxBackfillWorkers = 32
+	// maxBackfillChunks bounds the chunks of one job, which are all kept in
+	// the state file
+	maxBackfillChunks = 1000
+)
+
+// validateWorkers checks backfill.max_workers, where 0 is the default
+func (c BackfillConfig) validateWorkers() error {
+	if c.MaxWorkers < 0 || c.MaxWorkers > maxBackfillWorkers {
+		return fmt.Errorf("backfill.max_workers must be between 1 and %d, or 0 for the default %d, got %d", maxBackfillWorkers, defaultBackfillMaxWorkers, c.MaxWorkers)
+	}
+	return nil
+}
+
+func (c BackfillConfig) maxWorkers() int {
+	if c.MaxWorkers > 0 {
+		return c.MaxWorkers
+	}
+	return defaultBackfillMaxWorkers
+}
+
+// BackfillChunk is a part of the range of a job with workers. A worker takes
+// a pending chunk and works through its pages from the chunk's own cursor,
+// which is saved after every page. Chunks are half-open like pages,
+// [From, To), so a reading on a seam belongs to the later chunk only.
+type BackfillChunk struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// State is pending, running, completed or failed
+	State      string    `json:"state"`
+	Cursor     time.Time `json:"cursor"`
+	PagesDone  int       `json:"pages_done"`
+	PagesTotal int       `json:"pages_total"`
+	Readings   int       `json:"readings"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// nextPage returns the next page of the chunk from its cursor, or false when
+// no page is left
+func (c *BackfillChunk) nextPage(size time.Duration) (from, to time.Time, ok bool) {
+	if !c.Cursor.Before(c.To) {
+		return time.Time{}, time.Time{}, false
+	}
+	to = c.Cursor.Add(size)
+	if to.After(c.To) {
+		to = c.To
+	}
+	return c.Cursor, to, true
+}
+
+// backfillOptions are the parameters of a new job
+type backfillOptions struct {
+	// PageSize 0 uses backfill.page_size
+	PageSize time.Duration
+	// Order "" uses backfill.order
+	Order string
+	// Workers above 1 split the range into chunks run in parallel
+	Workers int
+	// ChunkSize 0 splits the range evenly between the workers, in whole
+	// pages
+	ChunkSize time.Duration
+}
+
+// checkWorkers validates the workers and chunk size of a job over from to
+// with the page size and order it will have
+func (b *backfiller) checkWorkers(from, to time.Time, options backfillOptions) error {
+	if options.Workers < 0 || options.Workers > b.config.maxWorkers() {
+		return fmt.Errorf("workers must be between 1 and %d (backfill.max_workers), or 0 for one, got %d", b.config.maxWorkers(), options.Workers)
+	}
+	if options.Workers <= 1 {
+		if options.ChunkSize != 0 {
+			return fmt.Errorf("chunk_size needs workers above 1")
+		}
+		return nil
+	}
+	if options.Order != orderOldestFirst {
+		return fmt.Errorf("workers need order oldest_first, got %s", options.Order)
+	}
+	if b.di.ordering != nil {
+		return fmt.Errorf("workers cannot be used with publishing.ordering per_location")
+	}
+	if options.ChunkSize != 0 && options.ChunkSize < options.PageSize {
+		return fmt.Errorf("chunk_size %s must be at least the page size %s", options.ChunkSize, options.PageSize)
+	}
+	if chunks := pageCount(from, to, chunkSize(from, to, options)); chunks > maxBackfillChunks {
+		return fmt.Errorf("%d chunks of %s, at most %d are allowed", chunks, options.ChunkSize, maxBackfillChunks)
+	}
+	return nil
+}
+
+// chunkSize returns the chunk size of a job, by default the range split
+// evenly between the workers and rounded up to whole pages
+func chunkSize(from, to time.Time, options backfillOptions) time.Duration {
+	if options.ChunkSize > 0 {
+		return options.ChunkSize
+	}
+	pages := pageCount(from, to, options.PageSize)
+	perWorker := (pages + options.Workers - 1) / options.Workers
+	return time.Duration(perWorker) * options.PageSize
+}
+
+// chunk splits from to into the chunks of a job with workers
+func chunk(from, to time.Time, options backfillOptions) []BackfillChunk {
+	size := chunkSize(from, to, options)
+	var chunks []BackfillChunk
+	for start := from; start.Before(to); start = start.Add(size) {
+		end := start.Add(size)
+		if end.After(to) {
+			end = to
+		}
+		chunks = append(chunks, BackfillChunk{
+			From:       start,
+			To:         end,
+			State:      jobPending,
+			Cursor:     start,
+			PagesTotal: pageCount(start, end, options.PageSize),
+		})
+	}
+	return chunks
+}
+
+// copy returns a copy of the job that shares no slices with it
+func (j *BackfillJob) copy() BackfillJob {
+	copied := *j
+	copied.Pages = append([]BackfillPage(nil), j.Pages...)
+	copied.Chunks = append([]BackfillChunk(nil), j.Chunks...)
+	return copied
+}
+
+// nextChunk marks the first pending chunk of job running and returns its
+// index, or -1 when none is left
+func (b *backfiller) nextChunk(job *BackfillJob) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if job.finished() {
+		return -1
+	}
+	for i := range job.Chunks {
+		if job.Chunks[i].State == jobPending {
+			job.Chunks[i].State = jobRunning
+			job.UpdatedAt = b.now().UTC()
+			b.save()
+			return i
+		}
+	}
+	return -1
+}
+
+// runChunks runs the chunks of job on its workers until every chunk is
+// completed. The first failed page fails the job and stops the other
+// workers; a chunk interrupted by that, a cancel or the shutdown goes back
+// to pending with its cursor.
+func (b *backfiller) runChunks(ctx context.Context, job *BackfillJob, src *source, logger *logrus.Entry) {
+	workerCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	b.mu.Lock()
+	workers := job.Workers
+	b.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			defer b.di.crashOnPanic("backfill")
+			for workerCtx.Err() == nil {
+				i := b.nextChunk(job)
+				if i < 0 {
+					return
+				}
+				if !b.runChunk(workerCtx, job, i, src, logger.WithFields(logrus.Fields{"worker": worker, "chunk": i})) {
+					stop()
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	b.mu.Lock()
+	if job.finished() {
+		// Failed by a chunk or cancelled
+		b.mu.Unlock()
+		return
+	}
+	if ctx.Err() != nil {
+		cursor := job.Cursor
+		b.mu.Unlock()
+		logger.WithField("cursor", cursor).Info("Backfill job stopped")
+		return
+	}
+	completed := b.finish(job, jobCompleted, "")
+	readings := job.Readings
+	b.save()
+	b.mu.Unlock()
+	if !completed {
+		logger.Info("Backfill job stopped")
+		return
+	}
+	logger.WithField("readings", readings).Info("Backfill job completed")
+}
+
+// runChunk works through the pages of chunk i of job. It returns false when
+// the worker has to stop: a page failed or ctx is done.
+func (b *backfiller) runChunk(ctx context.Context, job *BackfillJob, i int, src *source, logger *logrus.Entry) bool {
+	b.mu.Lock()
+	size := job.pageSize()
+	b.mu.Unlock()
+	for {
+		b.mu.Lock()
+		chunk := &job.Chunks[i]
+		from, end, ok := chunk.nextPage(size)
+		if !ok {
+			chunk.State = jobCompleted
+			job.Cursor = job.chunkCursor()
+			b.save()
+			b.mu.Unlock()
+			return true
+		}
+		b.mu.Unlock()
+
+		page := b.di.backfillPage(ctx, src, job.ID, from, end)
+
+		b.mu.Lock()
+		if ctx.Err() != nil {
+			// Not counted; the page is fetched again when the chunk runs
+			chunk.State = jobPending
+			b.save()
+			b.mu.Unlock()
+			return false
+		}
+		b.di.metrics.BackfillPages.WithLabelValues(page.Outcome).Inc()
+		job.Pages = append(job.Pages, page)
+		job.UpdatedAt = b.now().UTC()
+		if page.Outcome == pageFailed {
+			chunk.State, chunk.Error = jobFailed, page.Error
+			if !job.finished() {
+				b.finish(job, jobFailed, page.Error)
+			}
+			b.save()
+			b.mu.Unlock()
+			logger.WithFields(logrus.Fields{
+				"from": page.From,
+				"to":   page.To,
+			}).Error("Backfill job failed: " + page.Error)
+			return false
+		}
+		chunk.Cursor = end
+		chunk.PagesDone++
+		chunk.Readings += page.Readings
+		job.PagesDone++
+		job.Readings += page.Readings
+		job.Cursor = job.chunkCursor()
+		b.save()
+		b.mu.Unlock()
+	}
+}
+
+// chunkCursor returns the cursor of the first chunk not completed, before
+// which the whole range is done, or the end of the job. Callers hold mu.
+func (j *BackfillJob) chunkCursor() time.Time {
+	for _, chunk := range j.Chunks {
+		if chunk.State != jobCompleted {
+			return chunk.Cursor
+		}
+	}
+	return j.To
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createBackfillWith(t *testing.T, router http.Handler, hours int, params string) BackfillJob {
+	t.Helper()
+	w := backfillCall(router, http.MethodPost, "/backfill", fmt.Sprintf(`{"location":"default","from":%q,"to":%q,%s}`,
+		backfillStart.Format(time.RFC3339), backfillStart.Add(time.Duration(hours)*time.Hour).Format(time.RFC3339), params))
+	require.Equal(t, http.StatusAccepted, w.Code, w.Body.String())
+	var job BackfillJob
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &job))
+	return job
+}
+
+func TestBackfillWorkers_CompletesEveryChunk(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	ingestor, channel := newBackfillIngestor(t, upstream.server.URL, filepath.Join(t.TempDir(), "backfill.json"))
+	router := setupRoutes(ingestor)
+	runBackfill(t, ingestor)
+
+	created := createBackfillWith(t, router, 7, `"workers":3`)
+	assert.Equal(t, 3, created.Workers)
+	assert.Equal(t, "3h0m0s", created.ChunkSize, "7 pages split between 3 workers")
+	require.Len(t, created.Chunks, 3)
+	assert.Equal(t, 7, created.PagesTotal)
+	assert.Equal(t, backfillStart.Add(6*time.Hour), created.Chunks[2].From)
+	assert.Equal(t, 1, created.Chunks[2].PagesTotal)
+
+	job := waitForJob(t, ingestor, created.ID, jobCompleted)
+	assert.Equal(t, 7, job.PagesDone)
+	assert.Equal(t, 7, job.Readings)
+	assert.Equal(t, backfillStart.Add(7*time.Hour), job.Cursor)
+	for _, chunk := range job.Chunks {
+		assert.Equal(t, jobCompleted, chunk.State)
+		assert.Equal(t, chunk.To, chunk.Cursor)
+		assert.Equal(t, chunk.PagesTotal, chunk.PagesDone)
+	}
+	assert.ElementsMatch(t, []string{
+		"2026-03-01T00:00:00Z/2026-03-01T01:00:00Z",
+		"2026-03-01T01:00:00Z/2026-03-01T02:00:00Z",
+		"2026-03-01T02:00:00Z/2026-03-01T03:00:00Z",
+		"2026-03-01T03:00:00Z/2026-03-01T04:00:00Z",
+		"2026-03-01T04:00:00Z/2026-03-01T05:00:00Z",
+		"2026-03-01T05:00:00Z/2026-03-01T06:00:00Z",
+		"2026-03-01T06:00:00Z/2026-03-01T07:00:00Z",
+	}, upstream.requests())
+	assert.Len(t, channel.messages(), 7)
+
+	// The job shows its chunks, the list leaves them out
+	w := backfillCall(router, http.MethodGet, "/backfill/"+created.ID, "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"chunks":[`)
+	w = backfillCall(router, http.MethodGet, "/backfill", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), `"chunks"`)
+}
+
+func TestBackfillWorkers_SeamsPublishOnce(t *testing.T) {
+	// Every window gets readings exactly on both of its boundaries
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[
+			{"type":"weather","name":"berlin-1","payload":{"timestamp":%q}},
+			{"type":"weather","name":"berlin-1","payload":{"timestamp":%q}}
+		]`, r.URL.Query().Get("since"), r.URL.Query().Get("until"))
+	}))
+	t.Cleanup(upstream.Close)
+	ingestor, channel := newBackfillIngestor(t, upstream.URL, filepath.Join(t.TempDir(), "backfill.json"))
+	router := setupRoutes(ingestor)
+	runBackfill(t, ingestor)
+
+	created := createBackfillWith(t, router, 6, `"workers":4,"chunk_size":"2h"`)
+	require.Len(t, created.Chunks, 3)
+	job := waitForJob(t, ingestor, created.ID, jobCompleted)
+	assert.Equal(t, 6, job.Readings)
+
+	published := map[string]int{}
+	for _, message := range channel.messages() {
+		var data WeatherData
+		require.NoError(t, json.Unmarshal(message.Msg.Body, &data))
+		for _, reading := range data {
+			published[reading.Payload["timestamp"].(string)]++
+		}
+	}
+	want := map[string]int{}
+	for hour := 0; hour < 6; hour++ {
+		want[backfillStart.Add(time.Duration(hour)*time.Hour).Format(time.RFC3339)] = 1
+	}
+	assert.Equal(t, want, published, "each seam once, the end of the range not at all")
+}
+
+func TestBackfillWorkers_ResumesChunksAfterCrash(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	// The second page of the second chunk
+	upstream.holdAt(backfillStart.Add(3 * time.Hour))
+	dir := t.TempDir()
+	stateFile := filepath.Join(dir, "backfill.json")
+
+	first, _ := newBackfillIngestor(t, upstream.server.URL, stateFile)
+	runBackfill(t, first)
+	created := createBackfillWith(t, setupRoutes(first), 4, `"workers":2`)
+	require.Len(t, created.Chunks, 2)
+
+	select {
+	case <-upstream.held:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the held page was never fetched")
+	}
+	// Wait for the other worker to finish the first chunk
+	require.Eventually(t, func() bool {
+		job, _ := first.backfill.get(created.ID)
+		return job.Chunks[0].State == jobCompleted
+	}, 5*time.Second, 5*time.Millisecond)
+	crashed, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	crashFile := filepath.Join(dir, "crashed.json")
+	require.NoError(t, os.WriteFile(crashFile, crashed, 0o600))
+
+	upstream.holdAt(time.Time{})
+	second, secondChannel := newBackfillIngestor(t, upstream.server.URL, crashFile)
+	resumed, ok := second.backfill.get(created.ID)
+	require.True(t, ok)
+	assert.Equal(t, jobPending, resumed.State)
+	assert.Equal(t, jobCompleted, resumed.Chunks[0].State)
+	assert.Equal(t, jobPending, resumed.Chunks[1].State, "the running chunk is run again")
+	assert.Equal(t, backfillStart.Add(3*time.Hour), resumed.Chunks[1].Cursor)
+	assert.Equal(t, backfillStart.Add(3*time.Hour), resumed.Cursor, "everything before it is done")
+
+	runBackfill(t, second)
+	job := waitForJob(t, second, created.ID, jobCompleted)
+	assert.Equal(t, 4, job.PagesDone)
+	assert.Equal(t, 4, job.Readings)
+	messages := secondChannel.messages()
+	require.Len(t, messages, 1, "only the interrupted page is fetched again")
+	var data WeatherData
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &data))
+	assert.Equal(t, backfillStart.Add(3*time.Hour+time.Minute).Format(time.RFC3339), data[0].Payload["timestamp"])
+}
+
+func TestBackfillWorkers_FailedPageFailsJob(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("since") == backfillStart.Add(2*time.Hour).Format(time.RFC3339) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[]`))
+	}))
+	t.Cleanup(upstream.Close)
+	ingestor, _ := newBackfillIngestor(t, upstream.URL, filepath.Join(t.TempDir(), "backfill.json"))
+	runBackfill(t, ingestor)
+
+	created := createBackfillWith(t, setupRoutes(ingestor), 4, `"workers":2`)
+	job := waitForJob(t, ingestor, created.ID, jobFailed)
+	assert.NotEmpty(t, job.Error)
+	assert.Equal(t, jobFailed, job.Chunks[1].State)
+	assert.Equal(t, job.Error, job.Chunks[1].Error)
+}
+
+func TestBackfillWorkers_Validation(t *testing.T) {
+	ingestor, _ := newBackfillIngestor(t, "http://127.0.0.1:1", filepath.Join(t.TempDir(), "backfill.json"))
+	router := setupRoutes(ingestor)
+	from, to := backfillStart.Format(time.RFC3339), backfillStart.Add(2000*time.Hour).Format(time.RFC3339)
+
+	for params, message := range map[string]string{
+		`"workers":5`:                         "workers must be between 1 and 4 (backfill.max_workers), or 0 for one, got 5",
+		`"workers":-1`:                        "workers must be between 1 and 4",
+		`"chunk_size":"2h"`:                   "chunk_size needs workers above 1",
+		`"workers":2,"chunk_size":"30m"`:      "chunk_size 30m0s must be at least the page size 1h0m0s",
+		`"workers":2,"chunk_size":"1h"`:       "2000 chunks of 1h0m0s, at most 1000 are allowed",
+		`"workers":2,"chunk_size":"tomorrow"`: `invalid chunk_size \"tomorrow\"`,
+		`"workers":2,"order":"newest_first"`:  "workers need order oldest_first, got newest_first",
+	} {
+		w := backfillCall(router, http.MethodPost, "/backfill", fmt.Sprintf(`{"location":"default","from":%q,"to":%q,%s}`, from, to, params))
+		assert.Equal(t, http.StatusBadRequest, w.Code, params)
+		assert.Contains(t, w.Body.String(), message, params)
+	}
+	w := backfillCall(router, http.MethodPost, "/backfill", fmt.Sprintf(`{"location":"default","from":%q,"to":%q,"workers":1}`, from, to))
+	require.Equal(t, http.StatusAccepted, w.Code, "one worker is the sequential job")
+	assert.NotContains(t, w.Body.String(), `"chunks"`)
+
+	ingestor.ordering = newPublishOrder(PublishingConfig{Ordering: orderingPerLocation})
+	w = backfillCall(router, http.MethodPost, "/backfill", fmt.Sprintf(`{"location":"default","from":%q,"to":%q,"workers":2}`, from, to))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "publishing.ordering")
+
+	assert.ErrorContains(t, BackfillConfig{MaxWorkers: 33}.Validate(), "backfill.max_workers must be between 1 and 32, or 0 for the default 4, got 33")
+	assert.NoError(t, BackfillConfig{MaxWorkers: 8}.Validate())
+	assert.NoError(t, BackfillConfig{}.Validate(), "0 is the default")
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBackpressureCheckInterval = 10 * time.Second
+	// maxBackpressureFactor caps how far the poll interval is stretched; the
+	// result is also capped by api.max_poll_interval
+	maxBackpressureFactor = 64
+)
+
+// Throttle modes: automatic from the queue depth, or forced by an operator
+const (
+	throttleAuto = "auto"
+	throttleOn   = "on"
+	throttleOff  = "off"
+)
+
+// BackpressureConfig slows ingestion down while consumers lag behind. Above
+// HighWater messages in the queue the poll interval doubles with every check,
+// until the depth falls below LowWater.
+type BackpressureConfig struct {
+	// HighWater enables the throttle; zero disables it
+	HighWater     int      `yaml:"high_water"`
+	LowWater      int      `yaml:"low_water"`
+	CheckInterval Duration `yaml:"check_interval"`
+}
+
+// Validate checks that the water marks leave room for hysteresis
+func (c BackpressureConfig) Validate() error {
+	if c.HighWater < 0 || c.LowWater < 0 {
+		return fmt.Errorf("rabbitmq.backpressure water marks must not be negative")
+	}
+	if c.HighWater > 0 && c.LowWater >= c.HighWater {
+		return fmt.Errorf("rabbitmq.backpressure.low_water must be below high_water")
+	}
+	return nil
+}
+
+// ThrottleStatus is the throttle state reported by /ingestion/status
+type ThrottleStatus struct {
+	Mode      string    `json:"mode"`
+	Throttled bool      `json:"throttled"`
+	Factor    int       `json:"factor"`
+	Depth     int       `json:"depth"`
+	HighWater int       `json:"high_water"`
+	LowWater  int       `json:"low_water"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+// backpressure holds the throttle state derived from queue depth readings
+type backpressure struct {
+	config BackpressureConfig
+	logger *logrus.Logger
+
+	mu        sync.Mutex
+	mode      string
+	throttled bool
+	factor    int
+	depth     int
+	checkedAt time.Time
+}
+
+func newBackpressure(config BackpressureConfig, logger *logrus.Logger) *backpressure {
+	return &backpressure{config: config, logger: logger, mode: throttleAuto, factor: 1}
+}
+
+// observe feeds one depth reading. Between the water marks the previous
+// decision stands, so the throttle does not flap around a single threshold.
+func (b *backpressure) observe(depth int, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.depth, b.checkedAt = depth, now
+	fields := logrus.Fields{
+		"depth":      depth,
+		"high_water": b.config.HighWater,
+		"low_water":  b.config.LowWater,
+	}
+	switch {
+	case depth > b.config.HighWater:
+		if b.factor < maxBackpressureFactor {
+			b.factor *= 2
+		}
+		entry := b.logger.WithFields(fields).WithField("factor", b.factor)
+		switch {
+		case b.mode != throttleAuto:
+		case !b.throttled:
+			entry.Warn("Queue above high-water mark, slowing ingestion")
+		default:
+			entry.Debug("Queue still above high-water mark, slowing ingestion further")
+		}
+		b.throttled = true
+	case depth < b.config.LowWater && b.throttled:
+		b.throttled, b.factor = false, 1
+		if b.mode == throttleAuto {
+			b.logger.WithFields(fields).Info("Queue below low-water mark, resuming normal ingestion")
+		}
+	}
+}
+
+// scale stretches a poll delay by the current throttle factor
+func (b *backpressure) scale(delay, max time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	factor := b.factor
+	switch b.mode {
+	case throttleOn:
+		factor = maxBackpressureFactor
+	case throttleOff:
+		factor = 1
+	}
+	if factor == 1 {
+		return delay
+	}
+	scaled := delay * time.Duration(factor)
+	if scaled > max {
+		scaled = max
+	}
+	if scaled < delay {
+		return delay
+	}
+	return scaled
+}
+
+// setMode overrides the automatic decision until the mode is set back to auto
+func (b *backpressure) setMode(mode string) error {
+	switch mode {
+	case throttleAuto, throttleOn, throttleOff:
+	default:
+		return fmt.Errorf("mode must be auto, on or off, got %q", mode)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.mode = mode
+	return nil
+}
+
+func (b *backpressure) status() ThrottleStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	throttled, factor := b.throttled, b.factor
+	switch b.mode {
+	case throttleOn:
+		throttled, factor = true, maxBackpressureFactor
+	case throttleOff:
+		throttled, factor = false, 1
+	}
+	return ThrottleStatus{
+		Mode:      b.mode,
+		Throttled: throttled,
+		Factor:    factor,
+		Depth:     b.depth,
+		HighWater: b.config.HighWater,
+		LowWater:  b.config.LowWater,
+		CheckedAt: b.checkedAt,
+	}
+}
+
+// probeQueueDepth reads the queue depth every check interval until ctx is
+// cancelled. Failed probes leave the last decision in place.
+func (di *DataIngestor) probeQueueDepth(ctx context.Context) {
+	interval := time.Duration(di.config.RabbitMQ.Backpressure.CheckInterval)
+	if interval <= 0 {
+		interval = defaultBackpressureCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := di.checkQueueDepth(); err != nil {
+				di.logger.WithError(err).Debug("Queue depth probe failed")
+			}
+		}
+	}
+}
+
+// checkQueueDepth inspects the queue once and feeds the result to the throttle.
+// The probe runs on a channel of its own, so a failed inspect never closes
+// the channel publishes are in flight on.
+func (di *DataIngestor) checkQueueDepth() error {
+	queue, err := di.inspectQueue(di.config.RabbitMQ.QueueName)
+	if err != nil {
+		return fmt.Errorf("failed to inspect queue: %w", err)
+	}
+	di.backpressure.observe(queue.Messages, time.Now())
+	di.metrics.QueueDepth.Set(float64(queue.Messages))
+	di.metrics.ThrottleFactor.Set(float64(di.backpressure.status().Factor))
+	return nil
+}
+
+// handleIngestionStatus serves GET /ingestion/status
+func (di *DataIngestor) handleIngestionStatus(c *gin.Context) {
+	response := gin.H{
+		"rabbitmq":     di.ConnectionState().String(),
+		"paused":       di.paused.Load(),
+		"backpressure": nil,
+		"sharding":     di.shard.status(),
+		"rate_limit":   di.upstreamLimit.status(),
+		"error_budget": di.budget.Status(),
+		"websocket":    di.push.status(),
+		"maintenance":  di.maintenance.status(),
+		"discovery":    di.discovery.status(),
+		"spool":        di.spool.status(),
+	}
+	if di.backpressure != nil {
+		response["backpressure"] = di.backpressure.status()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handleThrottle serves POST /admin/throttle?mode=auto|on|off
+func (di *DataIngestor) handleThrottle(c *gin.Context) {
+	if di.backpressure == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "backpressure is disabled",
+		})
+		return
+	}
+	mode := c.Query("mode")
+	if err := di.backpressure.setMode(mode); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	di.logger.WithField("mode", mode).Warn("Throttle mode set by admin")
+	c.JSON(http.StatusOK, di.backpressure.status())
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBackpressureIngestor probes the queue on channel; publishes go to a
+// channel of their own
+func newBackpressureIngestor(t *testing.T, channel *fakeChannel) *DataIngestor {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: "http://127.0.0.1:1", Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue", Backpressure: BackpressureConfig{HighWater: 1000, LowWater: 200}},
+		Logging:  LoggingConfig{Level: "error"},
+		Admin:    AdminConfig{Token: "admin-token"},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	ingestor.openChannel = func() (amqpChannel, error) { return channel, nil }
+	return ingestor
+}
+
+func TestBackpressure_Simulation(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	b := newBackpressure(BackpressureConfig{HighWater: 1000, LowWater: 200}, logger)
+	interval, max := 5*time.Second, 5*time.Minute
+
+	steps := []struct {
+		depth     int
+		throttled bool
+		delay     time.Duration
+	}{
+		{500, false, 5 * time.Second},
+		{1500, true, 10 * time.Second},
+		{3000, true, 20 * time.Second},
+		// Between the marks the throttle holds
+		{800, true, 20 * time.Second},
+		{300, true, 20 * time.Second},
+		{5000, true, 40 * time.Second},
+		{6000, true, 80 * time.Second},
+		{7000, true, 160 * time.Second},
+		// Capped at max_poll_interval
+		{8000, true, 5 * time.Minute},
+		{100, false, 5 * time.Second},
+		// Rising again stays unthrottled until the high-water mark
+		{900, false, 5 * time.Second},
+	}
+	now := time.Now()
+	for i, step := range steps {
+		b.observe(step.depth, now.Add(time.Duration(i)*time.Second))
+		status := b.status()
+		assert.Equal(t, step.throttled, status.Throttled, "step %d (depth %d)", i, step.depth)
+		assert.Equal(t, step.delay, b.scale(interval, max), "step %d (depth %d)", i, step.depth)
+		assert.Equal(t, step.depth, status.Depth)
+	}
+
+	var throttling, released []*logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		switch entry.Level {
+		case logrus.WarnLevel:
+			throttling = append(throttling, entry)
+		case logrus.InfoLevel:
+			released = append(released, entry)
+		}
+	}
+	// Only the change of state warns; the factor growing is logged at debug
+	require.Len(t, throttling, 1)
+	assert.Equal(t, 1500, throttling[0].Data["depth"])
+	assert.Equal(t, 2, throttling[0].Data["factor"])
+	require.Len(t, released, 1)
+	assert.Equal(t, 100, released[0].Data["depth"])
+}
+
+func TestBackpressure_FactorIsCapped(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	b := newBackpressure(BackpressureConfig{HighWater: 10, LowWater: 5}, logger)
+	for i := 0; i < 20; i++ {
+		b.observe(100, time.Now())
+	}
+	assert.Equal(t, maxBackpressureFactor, b.status().Factor)
+	assert.Equal(t, 64*time.Second, b.scale(time.Second, time.Hour))
+	assert.Equal(t, time.Hour, b.scale(time.Minute, time.Hour), "the delay never exceeds max")
+}
+
+func TestBackpressure_ManualOverride(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	b := newBackpressure(BackpressureConfig{HighWater: 10, LowWater: 5}, logger)
+
+	require.NoError(t, b.setMode(throttleOn))
+	assert.True(t, b.status().Throttled)
+	assert.Equal(t, time.Minute, b.scale(time.Second, time.Minute))
+
+	// Automatic decisions keep being tracked underneath
+	b.observe(100, time.Now())
+	require.NoError(t, b.setMode(throttleOff))
+	assert.False(t, b.status().Throttled)
+	assert.Equal(t, time.Second, b.scale(time.Second, time.Minute))
+
+	require.NoError(t, b.setMode(throttleAuto))
+	assert.Equal(t, 2*time.Second, b.scale(time.Second, time.Minute))
+
+	assert.Error(t, b.setMode("sometimes"))
+}
+
+func TestCheckQueueDepth(t *testing.T) {
+	channel := &fakeChannel{depth: 1500}
+	ingestor := newBackpressureIngestor(t, channel)
+
+	require.NoError(t, ingestor.checkQueueDepth())
+	assert.True(t, ingestor.backpressure.status().Throttled)
+	assert.True(t, channel.closed, "the probe runs on a channel of its own")
+	publishChannel, _, err := ingestor.activeChannel()
+	require.NoError(t, err)
+	assert.False(t, publishChannel.(*fakeChannel).closed)
+	assert.Equal(t, 1500.0, testutil.ToFloat64(ingestor.metrics.QueueDepth))
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.ThrottleFactor))
+}
+
+func TestIngestionStatus_Endpoint(t *testing.T) {
+	ingestor := newBackpressureIngestor(t, &fakeChannel{depth: 1500})
+	require.NoError(t, ingestor.checkQueueDepth())
+	router := setupRoutes(ingestor)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ingestion/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Backpressure ThrottleStatus `json:"backpressure"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, throttleAuto, body.Backpressure.Mode)
+	assert.True(t, body.Backpressure.Throttled)
+	assert.Equal(t, 1500, body.Backpressure.Depth)
+	assert.Equal(t, 1000, body.Backpressure.HighWater)
+}
+
+func TestThrottle_Endpoint(t *testing.T) {
+	ingestor := newBackpressureIngestor(t, &fakeChannel{})
+	router := setupRoutes(ingestor)
+
+	post := func(query, token string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/throttle"+query, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, post("?mode=on", "wrong"))
+	assert.Equal(t, http.StatusBadRequest, post("?mode=maybe", "admin-token"))
+	assert.Equal(t, http.StatusOK, post("?mode=on", "admin-token"))
+	assert.Equal(t, throttleOn, ingestor.backpressure.status().Mode)
+
+	disabled := NewDataIngestor(&Config{Logging: LoggingConfig{Level: "error"}, Admin: AdminConfig{Token: "admin-token"}})
+	router = setupRoutes(disabled)
+	assert.Equal(t, http.StatusConflict, post("?mode=on", "admin-token"))
+}
+
+func TestBackpressureConfig_Validate(t *testing.T) {
+	assert.NoError(t, BackpressureConfig{}.Validate())
+	assert.NoError(t, BackpressureConfig{HighWater: 10, LowWater: 5}.Validate())
+	assert.ErrorContains(t, BackpressureConfig{HighWater: 10, LowWater: 10}.Validate(), "below high_water")
+	assert.Error(t, BackpressureConfig{HighWater: -1}.Validate())
+}
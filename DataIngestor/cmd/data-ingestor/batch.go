@@ -0,0 +1,231 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	batchModeNone   = "none"
+	batchModeTx     = "tx"
+	batchModeSingle = "single_message"
+
+	// batchMessageType is the AMQP Type of single_message batches
+	batchMessageType = "reading_batch"
+
+	batchPublished = "published"
+	batchFailed    = "failed"
+)
+
+// errTxChannelChanged fails a transaction whose connection was replaced, by
+// a reconnect, before it committed
+var errTxChannelChanged = errors.New("the RabbitMQ channel changed during the transaction")
+
+// txChannel is the transaction support of *amqp.Channel
+type txChannel interface {
+	Tx() error
+	TxCommit() error
+	TxRollback() error
+}
+
+// txBatch is a transaction in progress. Its messages carry it in their
+// Envelope, so only they are published on the transaction channel.
+type txBatch struct {
+	channel amqpChannel
+	// conn is the connection the channel was opened on
+	conn io.Closer
+	// routingKeys of the messages published in the transaction, counted as
+	// published once it commits
+	routingKeys []string
+}
+
+// batchMessage is the body of a single_message batch. Its keys are fixed;
+// field naming only applies to the readings.
+type batchMessage struct {
+	BatchID  string          `json:"batch_id"`
+	Count    int             `json:"count"`
+	Readings json.RawMessage `json:"readings"`
+}
+
+// validateBatchMode checks publishing.batch_mode against the settings that
+// publish outside of a batch or split a cycle over several queues
+func (c *Config) validateBatchMode() error {
+	switch c.Publishing.BatchMode {
+	case "", batchModeNone:
+		return nil
+	case batchModeTx, batchModeSingle:
+	default:
+		return fmt.Errorf("publishing.batch_mode must be %q, %q or %q, got %q",
+			batchModeNone, batchModeTx, batchModeSingle, c.Publishing.BatchMode)
+	}
+	if c.Publishing.Passthrough {
+		return fmt.Errorf("publishing.batch_mode %s cannot be combined with publishing.passthrough", c.Publishing.BatchMode)
+	}
+	if c.Publishing.BatchMode == batchModeSingle &&
+		(len(c.Routing.Rules) > 0 || c.RabbitMQ.Partitioning.Daily || c.RabbitMQ.Partitioning.Count > 0 || len(c.Publishing.MessageRules) > 0) {
+		return fmt.Errorf("publishing.batch_mode single_message publishes one message to the queue and cannot be combined with routing rules, partitioning or message rules")
+	}
+	return nil
+}
+
+// publishTx publishes the messages of one cycle in an AMQP transaction, so
+// the queues get all of them or none. Transactions run on a channel of their
+// own, next to the confirm mode channel every other message is published on,
+// and hold it, so batches are published one at a time.
+func (di *DataIngestor) publishTx(data *WeatherData, env Envelope) ([]string, error) {
+	di.txMu.Lock()
+	defer di.txMu.Unlock()
+
+	channel, conn, err := di.openTxChannel()
+	if err != nil {
+		return nil, err
+	}
+	tx := &txBatch{channel: channel, conn: conn}
+	env.tx = tx
+
+	env.BatchID, env.BatchSize = newMessageID(), len(*data)
+	messageIDs, err := di.publishGroups(data, env)
+	if err == nil {
+		if err = channel.(txChannel).TxCommit(); err != nil {
+			err = fmt.Errorf("failed to commit batch: %w", err)
+		}
+	}
+	if err != nil {
+		// Uncommitted messages are discarded with the channel if this fails
+		if rollbackErr := channel.(txChannel).TxRollback(); rollbackErr != nil {
+			di.log(logPublish).WithError(rollbackErr).Debug("Failed to roll back batch")
+			di.closeTxChannel()
+		}
+		di.recordBatch(batchModeTx, env, len(messageIDs), err)
+		return nil, fmt.Errorf("batch %s rolled back: %w", env.BatchID, err)
+	}
+
+	for _, routingKey := range tx.routingKeys {
+		di.metrics.PublishedMessages.WithLabelValues(sinkAMQP, routingKey).Inc()
+	}
+	di.recordBatch(batchModeTx, env, len(messageIDs), nil)
+	return messageIDs, nil
+}
+
+// openTxChannel returns the transaction channel of the active connection,
+// opening it in transaction mode when there is none yet or it belongs to a
+// previous connection. Callers hold txMu.
+func (di *DataIngestor) openTxChannel() (amqpChannel, io.Closer, error) {
+	di.connMu.Lock()
+	open, conn, state := di.openChannel, di.conn, di.connState
+	di.connMu.Unlock()
+	if state != StateReady || open == nil {
+		return nil, nil, fmt.Errorf("%w (connection is %s)", ErrNotConnected, state)
+	}
+	if di.txChannel != nil && di.txConn == conn {
+		return di.txChannel, conn, nil
+	}
+	di.closeTxChannel()
+
+	channel, err := open()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open transaction channel: %w", unreachable(err))
+	}
+	tx, ok := channel.(txChannel)
+	if !ok {
+		channel.Close()
+		return nil, nil, fmt.Errorf("the RabbitMQ channel does not support transactions")
+	}
+	if err := tx.Tx(); err != nil {
+		channel.Close()
+		return nil, nil, fmt.Errorf("failed to enable transactions: %w", err)
+	}
+	di.txChannel, di.txConn = channel, conn
+	return channel, conn, nil
+}
+
+// closeTxChannel closes the transaction channel, so the next batch opens a
+// new one. Callers hold txMu.
+func (di *DataIngestor) closeTxChannel() {
+	if di.txChannel != nil {
+		di.txChannel.Close()
+	}
+	di.txChannel, di.txConn = nil, nil
+}
+
+// txBatchChannel returns the channel the messages of tx are published on,
+// which must still be on the active connection
+func (di *DataIngestor) txBatchChannel(tx *txBatch) (amqpChannel, error) {
+	di.connMu.Lock()
+	defer di.connMu.Unlock()
+	if di.connState != StateReady {
+		return nil, fmt.Errorf("%w (connection is %s)", ErrNotConnected, di.connState)
+	}
+	if di.conn != tx.conn {
+		return nil, errTxChannelChanged
+	}
+	return tx.channel, nil
+}
+
+// publishSingle publishes every reading of one cycle as one message holding
+// the batch id and count. With publishing.max_message_size the batch is split
+// into as many messages as it takes to stay under it.
+func (di *DataIngestor) publishSingle(data *WeatherData, env Envelope) ([]string, error) {
+	env.BatchID, env.BatchSize, env.Type = newMessageID(), len(*data), batchMessageType
+	parts := []WeatherData{*data}
+	if di.config.Publishing.MaxMessageSize > 0 {
+		var err error
+		if parts, err = di.splitForSize(data, env); err != nil {
+			di.recordBatch(batchModeSingle, env, 0, err)
+			return nil, err
+		}
+	}
+
+	var messageIDs []string
+	for i := range parts {
+		if len(parts) > 1 {
+			env.BatchPart, env.BatchParts = i+1, len(parts)
+		}
+		messageID, err := di.publishBatchPart(&parts[i], env)
+		if err != nil {
+			di.recordBatch(batchModeSingle, env, len(messageIDs), err)
+			return messageIDs, err
+		}
+		messageIDs = append(messageIDs, messageID)
+	}
+	di.recordBatch(batchModeSingle, env, len(messageIDs), nil)
+	return messageIDs, nil
+}
+
+// publishBatchPart publishes readings as one single_message batch message
+func (di *DataIngestor) publishBatchPart(data *WeatherData, env Envelope) (string, error) {
+	readings, err := di.naming.marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal data: %w", err)
+	}
+	body, err := json.Marshal(batchMessage{BatchID: env.BatchID, Count: len(*data), Readings: readings})
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal batch: %w", err)
+	}
+	return di.publishBody("", di.config.RabbitMQ.QueueName, body, di.readingEnvelope(env, *data))
+}
+
+// recordBatch counts and logs the outcome of one batch
+func (di *DataIngestor) recordBatch(mode string, env Envelope, messages int, err error) {
+	entry := di.log(logPublish).WithFields(logrus.Fields{
+		"batch_id":   env.BatchID,
+		"batch_size": env.BatchSize,
+		"batch_mode": mode,
+		"messages":   messages,
+	})
+	if env.BatchParts > 0 {
+		entry = entry.WithField("batch_parts", env.BatchParts)
+	}
+	if err != nil {
+		di.metrics.Batches.WithLabelValues(mode, batchFailed).Inc()
+		entry.WithError(err).Warn("Batch not published")
+		return
+	}
+	di.metrics.Batches.WithLabelValues(mode, batchPublished).Inc()
+	di.metrics.BatchSize.WithLabelValues(mode).Observe(float64(env.BatchSize))
+	entry.Info("Batch published")
+}
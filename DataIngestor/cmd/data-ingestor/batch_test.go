@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// txFakeChannel is a fakeChannel in transaction mode: messages reach the
+// queue when the transaction commits
+type txFakeChannel struct {
+	fakeChannel
+	pending []publishedMessage
+	// failAt fails the nth publish, counting from 1
+	failAt    int
+	publishes int
+	commits   int
+	rollbacks int
+}
+
+func (f *txFakeChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.publishes++
+	if f.publishes == f.failAt {
+		return errors.New("channel closed")
+	}
+	f.pending = append(f.pending, publishedMessage{Exchange: exchange, RoutingKey: key, Msg: msg})
+	return nil
+}
+
+func (f *txFakeChannel) Tx() error { return nil }
+
+func (f *txFakeChannel) TxCommit() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.published = append(f.published, f.pending...)
+	f.pending = nil
+	f.commits++
+	return nil
+}
+
+func (f *txFakeChannel) TxRollback() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pending = nil
+	f.rollbacks++
+	return nil
+}
+
+// newBatchTestIngestor polls the three-location upstream of the dedup tests
+// with a routing rule per location, so every cycle publishes three messages
+func newBatchTestIngestor(t *testing.T, mode string, channel amqpChannel) *DataIngestor {
+	t.Helper()
+	config := &Config{
+		API:          APIConfig{BaseURL: dedupUpstream(t, dedupUpstreamBody), Timeout: Duration(5 * time.Second)},
+		RabbitMQ:     RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:      LoggingConfig{Level: "panic"},
+		Publishing:   PublishingConfig{BatchMode: mode},
+		ReadingDedup: ReadingDedupConfig{Enabled: true},
+	}
+	if mode != batchModeSingle {
+		for _, location := range []string{"moscow", "berlin", "paris"} {
+			config.Routing.Rules = append(config.Routing.Rules, RoutingRule{
+				Name:    location,
+				Match:   MatchCondition{Location: location},
+				Targets: []RoutingTarget{{RoutingKey: "weather." + location}},
+			})
+		}
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+	if mode == batchModeTx {
+		// Batches open their own channel; channel is the one they get
+		attachChannel(ingestor, &fakeChannel{}, nil)
+		ingestor.openChannel = func() (amqpChannel, error) { return channel, nil }
+	} else {
+		attachChannel(ingestor, channel, nil)
+	}
+	return ingestor
+}
+
+func TestBatchTx_CommitsTheCycle(t *testing.T) {
+	channel := &txFakeChannel{}
+	ingestor := newBatchTestIngestor(t, batchModeTx, channel)
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, result.MessageIDs, 3)
+	assert.Equal(t, 1, channel.commits)
+
+	messages := channel.messages()
+	require.Len(t, messages, 3)
+	batchID := messages[0].Msg.Headers["batch_id"]
+	assert.NotEmpty(t, batchID)
+	for _, msg := range messages {
+		assert.Equal(t, batchID, msg.Msg.Headers["batch_id"], "one batch id per cycle")
+		assert.Equal(t, 3, msg.Msg.Headers["batch_size"])
+	}
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Batches.WithLabelValues(batchModeTx, batchPublished)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.PublishedMessages.WithLabelValues(sinkAMQP, "weather.moscow")))
+	assert.Equal(t, 1, testutil.CollectAndCount(ingestor.metrics.BatchSize))
+}
+
+func TestBatchTx_RollsBackTheCycle(t *testing.T) {
+	channel := &txFakeChannel{failAt: 2}
+	ingestor := newBatchTestIngestor(t, batchModeTx, channel)
+
+	_, err := ingestor.ingest(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "rolled back")
+	assert.Empty(t, channel.messages(), "no partial batch reaches the queues")
+	assert.Equal(t, 1, channel.rollbacks)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Batches.WithLabelValues(batchModeTx, batchFailed)))
+	assert.Equal(t, 0.0, testutil.ToFloat64(ingestor.metrics.PublishedMessages.WithLabelValues(sinkAMQP, "weather.moscow")),
+		"rolled back messages are not counted as published")
+
+	// The next cycle publishes the whole batch again, dedup claims included
+	_, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, channel.messages(), 3)
+	assert.Equal(t, []string{"moscow", "berlin", "paris"}, dedupPublished(t, &channel.fakeChannel))
+}
+
+func TestBatchTx_ChannelChanged(t *testing.T) {
+	channel := &txFakeChannel{}
+	ingestor := newBatchTestIngestor(t, batchModeTx, channel)
+	// Opened on a connection since replaced by a reconnect
+	tx := &txBatch{channel: channel, conn: io.NopCloser(strings.NewReader(""))}
+
+	_, err := ingestor.publishBody("", "meter-data-queue", []byte("[]"), Envelope{tx: tx})
+	assert.ErrorIs(t, err, errTxChannelChanged)
+	assert.Zero(t, channel.publishes)
+}
+
+func TestBatchTx_OtherPublishesStayOutOfTheTransaction(t *testing.T) {
+	txChannel := &txFakeChannel{}
+	opened := 0
+	ingestor := newBatchTestIngestor(t, batchModeTx, txChannel)
+	ingestor.openChannel = func() (amqpChannel, error) {
+		opened++
+		return txChannel, nil
+	}
+	confirmChannel := &fakeChannel{}
+	attachChannel(ingestor, confirmChannel, nil)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	_, err = ingestor.publishBody("", "meter-data-queue", []byte("[]"), Envelope{})
+	require.NoError(t, err)
+	assert.Len(t, confirmChannel.messages(), 1, "a message outside a batch is published on the confirm channel")
+	assert.Len(t, txChannel.messages(), 3)
+	assert.Equal(t, 3, txChannel.publishes)
+
+	// The transaction channel is kept for the next batch
+	ingestor.config.API.BaseURL = dedupUpstream(t, `[{"type":"weather","name":"moscow","payload":{"temp":1}}]`)
+	ingestor.sources[0].baseURL = ingestor.config.API.BaseURL
+	_, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, opened)
+	assert.Equal(t, 2, txChannel.commits)
+}
+
+func TestBatchSingle_PublishesOneMessage(t *testing.T) {
+	channel := &fakeChannel{}
+	ingestor := newBatchTestIngestor(t, batchModeSingle, channel)
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, result.MessageIDs, 1)
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	msg := messages[0]
+	assert.Equal(t, "meter-data-queue", msg.RoutingKey)
+	assert.Equal(t, batchMessageType, msg.Msg.Type)
+
+	var batch batchMessage
+	require.NoError(t, json.Unmarshal(msg.Msg.Body, &batch))
+	assert.Equal(t, msg.Msg.Headers["batch_id"], batch.BatchID)
+	assert.Equal(t, 3, batch.Count)
+	assert.Equal(t, 3, msg.Msg.Headers["batch_size"])
+
+	readings, err := unwrapBatch(msg.Msg.Body)
+	require.NoError(t, err)
+	var data WeatherData
+	require.NoError(t, json.Unmarshal(readings, &data))
+	assert.Len(t, data, 3)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Batches.WithLabelValues(batchModeSingle, batchPublished)))
+}
+
+func TestBatchSingle_KeepsWrapperKeys(t *testing.T) {
+	ingestor := newBatchTestIngestor(t, batchModeSingle, &fakeChannel{})
+	ingestor.naming = newFieldNamer(PublishingConfig{FieldNaming: "camelCase"})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	_, err := ingestor.publishReadings(&WeatherData{weatherReading("moscow", map[string]interface{}{"wind_speed": 3.0})}, Envelope{})
+	require.NoError(t, err)
+	body := string(channel.messages()[0].Msg.Body)
+	assert.Contains(t, body, `"batch_id":`)
+	assert.Contains(t, body, `"windSpeed":3`)
+}
+
+func TestConfig_ValidateBatchMode(t *testing.T) {
+	assert.NoError(t, (&Config{}).Validate())
+	assert.NoError(t, (&Config{Publishing: PublishingConfig{BatchMode: batchModeNone}}).Validate())
+	assert.NoError(t, (&Config{Publishing: PublishingConfig{BatchMode: batchModeTx}, Routing: testRoutingConfig(false)}).Validate())
+	assert.ErrorContains(t, (&Config{Publishing: PublishingConfig{BatchMode: "always"}}).Validate(), "publishing.batch_mode must be")
+	assert.ErrorContains(t, (&Config{Publishing: PublishingConfig{BatchMode: batchModeTx, Passthrough: true}}).Validate(), "passthrough")
+	assert.ErrorContains(t, (&Config{Publishing: PublishingConfig{BatchMode: batchModeSingle}, Routing: testRoutingConfig(false)}).Validate(), "routing rules")
+	assert.ErrorContains(t, (&Config{Publishing: PublishingConfig{BatchMode: batchModeSingle}, RabbitMQ: RabbitMQConfig{Partitioning: PartitionConfig{Daily: true}}}).Validate(), "partitioning")
+}
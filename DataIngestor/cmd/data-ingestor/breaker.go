@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+const (
+	defaultFailureThreshold = 5
+	defaultOpenTimeout      = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned while a breaker is open
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitBreakerConfig controls when a breaker opens and for how long
+type CircuitBreakerConfig struct {
+	// FailureThreshold is the number of consecutive failures that opens the breaker
+	FailureThreshold int `yaml:"failure_threshold"`
+	// OpenTimeout is how long the breaker stays open before a probe is allowed
+	OpenTimeout Duration `yaml:"open_timeout"`
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half_open"
+	case breakerOpen:
+		return "open"
+	}
+	return "unknown"
+}
+
+// circuitBreaker counts consecutive failures of one dependency. It is not
+// safe for concurrent use; the owner guards it with its own lock.
+type circuitBreaker struct {
+	config   CircuitBreakerConfig
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// newCircuitBreaker returns a closed breaker, filling in config defaults
+func newCircuitBreaker(config CircuitBreakerConfig) circuitBreaker {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = defaultFailureThreshold
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = Duration(defaultOpenTimeout)
+	}
+	return circuitBreaker{config: config}
+}
+
+// allow reports whether a call may go ahead. An open breaker lets a single
+// probe through once its timeout has passed.
+func (b *circuitBreaker) allow(now time.Time) error {
+	switch b.state {
+	case breakerOpen:
+		if now.Sub(b.openedAt) < time.Duration(b.config.OpenTimeout) {
+			return ErrCircuitOpen
+		}
+		b.state = breakerHalfOpen
+	case breakerHalfOpen:
+		if b.probing {
+			return ErrCircuitOpen
+		}
+	}
+	b.probing = b.state == breakerHalfOpen
+	return nil
+}
+
+// record updates the breaker with the outcome of a call and returns the
+// states before and after
+func (b *circuitBreaker) record(now time.Time, success bool) (from, to breakerState) {
+	from = b.state
+	b.probing = false
+	if success {
+		b.state = breakerClosed
+		b.failures = 0
+		return from, b.state
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.config.FailureThreshold {
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+	return from, b.state
+}
+
+// release ends a probe without an outcome, letting the next call probe again
+func (b *circuitBreaker) release() {
+	b.probing = false
+}
+
+// reopensAt returns when an open breaker lets the next probe through, or the
+// zero time when it is not open
+func (b *circuitBreaker) reopensAt() time.Time {
+	if b.state != breakerOpen {
+		return time.Time{}
+	}
+	return b.openedAt.Add(time.Duration(b.config.OpenTimeout))
+}
+
+// forceOpen opens the breaker until until, when it lets a probe through
+func (b *circuitBreaker) forceOpen(until time.Time) {
+	b.state = breakerOpen
+	b.probing = false
+	b.openedAt = until.Add(-time.Duration(b.config.OpenTimeout))
+}
+
+// endForcedOpen lets the next call probe a breaker forceOpen opened until
+// until, unless a failure has reopened it since
+func (b *circuitBreaker) endForcedOpen(now, until time.Time) {
+	if b.state == breakerOpen && b.reopensAt().Equal(until) {
+		b.openedAt = now.Add(-time.Duration(b.config.OpenTimeout))
+	}
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Fetch strategies, see APIConfig.Strategy
+const (
+	strategyPerLocation = "per_location"
+	strategyBulk        = "bulk"
+)
+
+const (
+	defaultBulkPath        = "/weather/bulk"
+	defaultBulkMaxStations = 100
+	// bulkSourceName names the bulk endpoint in logs, traces and fixtures
+	bulkSourceName = "bulk"
+)
+
+// Outcomes of a bulk request
+const (
+	bulkOK          = "ok"
+	bulkNoData      = "no_data"
+	bulkFailed      = "failed"
+	bulkUnsupported = "unsupported"
+)
+
+// errBulkUnsupported is a bulk endpoint the upstream does not have. The
+// cycle falls back to fetching every location on its own.
+var errBulkUnsupported = errors.New("upstream does not support the bulk endpoint")
+
+// BulkConfig configures api.strategy: bulk
+type BulkConfig struct {
+	// Path is appended to api.base_url, /weather/bulk by default
+	Path string `yaml:"path"`
+	// MaxStations is the most station ids sent in one request, 100 by
+	// default; longer lists are split over several requests
+	MaxStations int `yaml:"max_stations"`
+}
+
+func (c APIConfig) bulk() bool {
+	return c.Strategy == strategyBulk
+}
+
+// validateStrategy checks api.strategy and what bulk fetching requires
+func (c APIConfig) validateStrategy() error {
+	switch c.Strategy {
+	case "", strategyPerLocation:
+		return nil
+	case strategyBulk:
+	default:
+		return fmt.Errorf("api.strategy must be per_location or bulk, got %q", c.Strategy)
+	}
+	if c.BaseURL == "" {
+		return fmt.Errorf("api.strategy bulk requires api.base_url")
+	}
+	if len(c.Locations) == 0 && !c.Discovery.enabled() {
+		return fmt.Errorf("api.strategy bulk requires api.locations or api.discovery")
+	}
+	if c.Format != "" && c.Format != formatJSON {
+		return fmt.Errorf("api.strategy bulk requires JSON responses, got api.format %s", c.Format)
+	}
+	if c.Incremental.Enabled {
+		return fmt.Errorf("api.strategy bulk cannot be combined with api.incremental")
+	}
+	if c.Bulk.MaxStations < 0 {
+		return fmt.Errorf("api.bulk.max_stations must not be negative")
+	}
+	if c.Bulk.Path != "" && !strings.HasPrefix(c.Bulk.Path, "/") {
+		return fmt.Errorf("api.bulk.path must start with /")
+	}
+	stations := make(map[string]string)
+	for _, location := range c.Locations {
+		id := location.StationID
+		if id == "" {
+			id = location.Name
+		}
+		if other, ok := stations[id]; ok {
+			return fmt.Errorf("api.locations %s and %s have the same station_id %q", other, location.Name, id)
+		}
+		stations[id] = location.Name
+	}
+	return nil
+}
+
+func (c BulkConfig) path() string {
+	if c.Path != "" {
+		return c.Path
+	}
+	return defaultBulkPath
+}
+
+func (c BulkConfig) maxStations() int {
+	if c.MaxStations > 0 {
+		return c.MaxStations
+	}
+	return defaultBulkMaxStations
+}
+
+// newBulkSource returns the source the bulk requests are sent as, with its
+// own adaptive timeout and a breaker that stops sending bulk requests while
+// the endpoint keeps failing. The locations keep their breakers and
+// throttling.
+func newBulkSource(config APIConfig) *source {
+	return &source{
+		name:     bulkSourceName,
+		baseURL:  config.BaseURL,
+		format:   formatJSON,
+		breaker:  newCircuitBreaker(config.CircuitBreaker),
+		timeouts: newAdaptiveTimeout(config.AdaptiveTimeout, time.Duration(config.Timeout)),
+	}
+}
+
+// bulkRequest is the body of a bulk request
+type bulkRequest struct {
+	StationIDs []string `json:"station_ids"`
+}
+
+// bulkEntry is a reading of a bulk response with the station it belongs to
+type bulkEntry struct {
+	StationID string `json:"station_id"`
+	SensorData
+}
+
+// bulkResponse is a decoded bulk response
+type bulkResponse struct {
+	entries []bulkEntry
+	headers map[string]string
+	latency time.Duration
+}
+
+// bulkFetch is what a location got from the bulk requests of a cycle
+type bulkFetch struct {
+	// allowErr is set when the location was not fetched at all, see
+	// source.allow
+	allowErr error
+	fetched  *fetchResult
+	err      error
+	// ticket is the location's place in the publish order, taken before
+	// the bulk request was sent
+	ticket *orderTicket
+}
+
+// orderTicket returns the ticket of the fetch; nil on a nil fetch
+func (f *bulkFetch) orderTicket() *orderTicket {
+	if f == nil {
+		return nil
+	}
+	return f.ticket
+}
+
+// finishBulkTickets gives up the tickets of the locations of a cycle that
+// did not run, e.g. as they were removed during it
+func finishBulkTickets(ctx context.Context) {
+	fetches, _ := ctx.Value(bulkFetchKey{}).(map[string]*bulkFetch)
+	for _, fetch := range fetches {
+		fetch.ticket.finish()
+	}
+}
+
+type bulkFetchKey struct{}
+
+// withBulkFetches makes the locations of a cycle take their readings from
+// fetches instead of calling the upstream
+func withBulkFetches(ctx context.Context, fetches map[string]*bulkFetch) context.Context {
+	return context.WithValue(ctx, bulkFetchKey{}, fetches)
+}
+
+func bulkFetchOf(ctx context.Context, location string) (*bulkFetch, bool) {
+	fetches, _ := ctx.Value(bulkFetchKey{}).(map[string]*bulkFetch)
+	fetch, ok := fetches[location]
+	return fetch, ok
+}
+
+// fetchBulk fetches every location that may be fetched now with as few bulk
+// requests as max_stations allows. It returns ctx with the readings of every
+// location, see withBulkFetches, and the locations whose station was in a
+// request but not in its response. When the upstream has no bulk endpoint
+// or the breaker of the bulk endpoint is open, the locations of the requests
+// not sent yet are left out of ctx and fetched on their own, while those of
+// the requests that were sent keep their readings. While the upstream
+// throttles the bulk endpoint the remaining locations are not fetched.
+func (di *DataIngestor) fetchBulk(ctx context.Context) (context.Context, []string) {
+	now := time.Now()
+	sources := di.currentSources()
+	fetches := make(map[string]*bulkFetch, len(sources))
+	var allowed []*source
+	for _, src := range sources {
+		if err := src.allow(now); err != nil {
+			fetches[src.name] = &bulkFetch{allowErr: err}
+			continue
+		}
+		allowed = append(allowed, src)
+	}
+
+	var gaps []string
+	size := di.config.API.Bulk.maxStations()
+	for start := 0; start < len(allowed); start += size {
+		end := start + size
+		if end > len(allowed) {
+			end = len(allowed)
+		}
+		chunk := allowed[start:end]
+		err := di.bulkSource.allow(time.Now())
+		var response *bulkResponse
+		tickets := make(map[string]*orderTicket, len(chunk))
+		if err == nil {
+			for _, src := range chunk {
+				tickets[src.name] = di.ordering.ticket(src.name)
+			}
+			response, err = di.fetchBulkChunk(ctx, chunk)
+			di.recordBulk(err)
+		}
+		if errors.Is(err, ErrThrottled) {
+			// The upstream asked for a pause, which the GETs respect as well
+			for _, src := range allowed[start:] {
+				src.release()
+				fetches[src.name] = &bulkFetch{allowErr: err, ticket: tickets[src.name]}
+			}
+			break
+		}
+		if errors.Is(err, errBulkUnsupported) || errors.Is(err, ErrCircuitOpen) {
+			for _, src := range allowed[start:] {
+				// Ends the half-open probes, which the fallback asks for again
+				src.release()
+				// The fetches on their own take tickets of their own
+				tickets[src.name].finish()
+			}
+			di.log(logFetch).WithError(err).WithField("locations", len(allowed)-start).
+				Warn("Bulk endpoint not available, fetching the remaining locations on their own")
+			break
+		}
+		gaps = append(gaps, di.assignBulk(chunk, response, err, fetches)...)
+		for name, ticket := range tickets {
+			fetches[name].ticket = ticket
+		}
+	}
+	return withBulkFetches(ctx, fetches), gaps
+}
+
+// recordBulk updates the breaker of the bulk endpoint with the outcome of a
+// bulk request. Like a location's, it ignores requests that never reached
+// the upstream and responses without data, and a missing endpoint, which
+// the next cycle asks for again.
+func (di *DataIngestor) recordBulk(err error) {
+	src := di.bulkSource
+	if errors.Is(err, ErrUpstreamRateLimited) || errors.Is(err, ErrNoData) || errors.Is(err, errBulkUnsupported) || errors.Is(err, ErrTokenAcquisition) {
+		src.release()
+		return
+	}
+	from, to := src.record(time.Now(), err)
+	if from != to {
+		di.log(logFetch).WithFields(logrus.Fields{
+			"location": bulkSourceName,
+			"from":     from.String(),
+			"to":       to.String(),
+		}).Warn("Circuit breaker state changed")
+	}
+}
+
+// fetchBulkChunk sends one bulk request for the stations of chunk, retrying
+// it like the per-location GETs; the POST is idempotent
+func (di *DataIngestor) fetchBulkChunk(ctx context.Context, chunk []*source) (*bulkResponse, error) {
+	ids := make([]string, len(chunk))
+	for i, src := range chunk {
+		ids[i] = src.stationID
+	}
+	// The retries send the same key
+	key := newMessageID()
+	var response *bulkResponse
+	err := di.retryFetch(ctx, bulkSourceName, func(ctx context.Context) (err error) {
+		response, err = di.postBulk(ctx, ids, key)
+		return err
+	})
+	outcome := bulkOK
+	switch {
+	case errors.Is(err, ErrUpstreamRateLimited):
+		// The upstream was not called
+		return nil, err
+	case errors.Is(err, errBulkUnsupported):
+		outcome = bulkUnsupported
+	case errors.Is(err, ErrNoData):
+		outcome = bulkNoData
+	case err != nil:
+		outcome = bulkFailed
+	}
+	di.metrics.UpstreamBulkRequests.WithLabelValues(outcome).Inc()
+	return response, err
+}
+
+// postBulk requests the readings of the stations ids. key is sent as the
+// Idempotency-Key.
+func (di *DataIngestor) postBulk(ctx context.Context, ids []string, key string) (*bulkResponse, error) {
+	body, err := json.Marshal(bulkRequest{StationIDs: ids})
+	if err != nil {
+		return nil, err
+	}
+	maxBody := int64(di.config.API.MaxBodyBytes)
+	if maxBody <= 0 {
+		maxBody = defaultMaxBodyBytes
+	}
+	call, err := di.sendUpstream(ctx, di.bulkSource, maxBody+1, func(ctx context.Context, src *source) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, src.target()+di.config.API.Bulk.path(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		// Marks the POST as idempotent, so net/http may resend it on a
+		// broken keep-alive connection like a GET
+		req.Header.Set("Idempotency-Key", key)
+		return req, nil
+	})
+	var status *statusError
+	if errors.As(err, &status) {
+		switch status.Code {
+		case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+			return nil, fmt.Errorf("%w: %w", errBulkUnsupported, err)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer call.close()
+
+	resp := call.resp
+	read, err := io.ReadAll(io.LimitReader(resp.Body, maxBody+1))
+	call.trace.readDone()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+	latency := time.Since(call.start)
+	di.observeLatency(di.bulkSource, latency)
+	logFor(ctx, logFetch).WithFields(logrus.Fields{
+		"location":   bulkSourceName,
+		"stations":   len(ids),
+		"status":     resp.StatusCode,
+		"bytes":      len(read),
+		"latency_ms": latency.Milliseconds(),
+	}).Debug("Upstream responded")
+	if int64(len(read)) > maxBody {
+		return nil, fmt.Errorf("response body exceeds %d bytes", maxBody)
+	}
+	if isNoData(resp.StatusCode, read) {
+		return nil, ErrNoData
+	}
+	if format, err := responseFormat("", resp.Header.Get("Content-Type")); err != nil {
+		return nil, err
+	} else if format != formatJSON {
+		return nil, fmt.Errorf("bulk responses must be JSON, got %s", format)
+	}
+	var entries []bulkEntry
+	if err := json.Unmarshal(read, &entries); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return &bulkResponse{
+		entries: entries,
+		headers: captureHeaders(di.config.API.CaptureHeaders, resp.Header),
+		latency: latency,
+	}, nil
+}
+
+// assignBulk hands the readings of a bulk response to the locations of
+// chunk and returns the locations that got none
+func (di *DataIngestor) assignBulk(chunk []*source, response *bulkResponse, err error, fetches map[string]*bulkFetch) []string {
+	if err != nil {
+		for _, src := range chunk {
+			fetches[src.name] = &bulkFetch{err: err}
+		}
+		return nil
+	}
+
+	byStation := make(map[string]*source, len(chunk))
+	readings := make(map[string]WeatherData, len(chunk))
+	for _, src := range chunk {
+		byStation[src.stationID] = src
+	}
+	unknown := 0
+	for _, entry := range response.entries {
+		src, ok := byStation[entry.StationID]
+		if !ok {
+			unknown++
+			continue
+		}
+		reading := entry.SensorData
+		if response.headers != nil {
+			reading.Headers = response.headers
+		}
+		readings[src.name] = append(readings[src.name], reading)
+	}
+	if unknown > 0 {
+		di.log(logFetch).WithField("readings", unknown).Warn("Dropped bulk readings of stations that were not requested")
+	}
+
+	var gaps []string
+	for _, src := range chunk {
+		data, ok := readings[src.name]
+		if !ok {
+			gaps = append(gaps, src.name)
+			di.metrics.BulkMissingStations.WithLabelValues(src.name).Inc()
+			di.log(logFetch).WithFields(logrus.Fields{
+				"location": src.name,
+				"station":  src.stationID,
+			}).Warn("Station missing from the bulk response")
+			fetches[src.name] = &bulkFetch{err: fmt.Errorf("%w: station %s is missing from the bulk response", ErrNoData, src.stationID)}
+			continue
+		}
+		fetches[src.name] = &bulkFetch{fetched: &fetchResult{
+			Data:     &data,
+			Headers:  response.headers,
+			Latency:  response.latency,
+			Replayed: di.fixtures != nil && di.fixtures.replay,
+		}}
+	}
+	return gaps
+}
+
+// pollBulk runs ingestion cycles over every location until ctx is
+// cancelled, for api.strategy: bulk. The locations share one schedule, as
+// every cycle fetches them together.
+func (di *DataIngestor) pollBulk(ctx context.Context) {
+	if len(di.currentSources()) == 0 && di.discovery == nil {
+		// Every location is polled by other shards
+		return
+	}
+	interval := di.config.API.pollInterval()
+	first := time.Now().Add(interval)
+	var schedule cycleSchedule
+	schedule.start(first, interval)
+	for _, src := range di.currentSources() {
+		src.schedule.start(first, interval)
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			started := time.Now()
+			ticks := schedule.due(started)
+			// Discovered locations join the cycle after the one they appeared in
+			sources := di.currentSources()
+			if len(sources) > 0 && !di.paused.Load() && !di.memory.pausesFetching() && !di.pushing() && !di.maintenance.holdsPolling() {
+				switch di.budget.polling() {
+				case budgetNormal:
+					done := di.cycles.begin(bulkSourceName, started)
+					result := di.RunCycle(context.WithoutCancel(ctx))
+					done()
+					finished := time.Now()
+					for _, outcome := range result.Locations {
+						di.logOutcome(outcome)
+						if src := di.sourceByName(outcome.Location); src != nil {
+							di.recordSchedule(src, ticks, started, finished, outcome.Outcome == outcomePublished)
+						}
+					}
+					if result.Status == CycleSucceeded || result.Status == CycleDegraded {
+						di.metrics.CycleDuration.Observe(finished.Sub(started).Seconds())
+					}
+				case budgetModeHeartbeats:
+					for _, src := range sources {
+						di.heartbeatOnce(context.WithoutCancel(ctx), src)
+					}
+				}
+			}
+			now := time.Now()
+			delay := di.pollDelay(now, sources...)
+			schedule.advance(ticks[len(ticks)-1], now, delay, interval)
+			for _, src := range sources {
+				src.schedule.advance(ticks[len(ticks)-1], now, delay, interval)
+			}
+			timer.Reset(schedule.wait(now))
+		}
+	}
+}
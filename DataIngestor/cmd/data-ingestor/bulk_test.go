@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// bulkUpstream answers POST /weather/bulk with one reading per requested
+// station, leaving out the missing ones, and GET /meters with one reading
+type bulkUpstream struct {
+	server *httptest.Server
+
+	mu       sync.Mutex
+	missing  map[string]bool
+	status   []int
+	requests []bulkRequest
+	keys     []string
+	gets     int
+}
+
+// calls returns the bulk requests, their Idempotency-Keys and the number
+// of GETs received so far
+func (u *bulkUpstream) calls() ([]bulkRequest, []string, int) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]bulkRequest(nil), u.requests...), append([]string(nil), u.keys...), u.gets
+}
+
+func newBulkUpstream(t *testing.T) *bulkUpstream {
+	t.Helper()
+	upstream := &bulkUpstream{missing: make(map[string]bool)}
+	upstream.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodGet && r.URL.Path == "/meters" {
+			upstream.gets++
+			fmt.Fprint(w, `[{"type":"weather","name":"single","payload":{"temperature":20}}]`)
+			return
+		}
+		if r.Method != http.MethodPost || r.URL.Path != defaultBulkPath {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		var request bulkRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		upstream.requests = append(upstream.requests, request)
+		upstream.keys = append(upstream.keys, r.Header.Get("Idempotency-Key"))
+		if len(upstream.status) > 0 {
+			status := upstream.status[0]
+			upstream.status = upstream.status[1:]
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+		}
+		entries := []map[string]interface{}{}
+		for _, id := range request.StationIDs {
+			if upstream.missing[id] {
+				continue
+			}
+			entries = append(entries, map[string]interface{}{
+				"station_id": id, "type": "weather", "name": id, "payload": map[string]interface{}{"temperature": 21.5},
+			})
+		}
+		json.NewEncoder(w).Encode(entries)
+	}))
+	t.Cleanup(upstream.server.Close)
+	return upstream
+}
+
+// newBulkIngestor returns an ingestor fetching the locations with the
+// stations st-<name> from upstream in bulk
+func newBulkIngestor(t *testing.T, upstream *bulkUpstream, maxStations int, names ...string) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	locations := make([]LocationSource, len(names))
+	for i, name := range names {
+		locations[i] = LocationSource{Name: name, StationID: "st-" + name}
+	}
+	config := &Config{
+		API: APIConfig{
+			BaseURL:      upstream.server.URL,
+			Timeout:      Duration(time.Second),
+			RetryBackoff: Duration(time.Millisecond),
+			Locations:    locations,
+			Strategy:     strategyBulk,
+			Bulk:         BulkConfig{MaxStations: maxStations},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+	}
+	require.NoError(t, config.API.Validate())
+	ingestor := NewDataIngestor(config)
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+func TestAPIConfig_ValidateStrategy(t *testing.T) {
+	locations := []LocationSource{{Name: "berlin"}, {Name: "paris", StationID: "st-paris"}}
+	tests := []struct {
+		name   string
+		config APIConfig
+		err    string
+	}{
+		{"per_location", APIConfig{Strategy: strategyPerLocation}, ""},
+		{"bulk without location base URLs", APIConfig{Strategy: strategyBulk, BaseURL: "http://upstream", Locations: locations}, ""},
+		{"unknown", APIConfig{Strategy: "batch"}, `api.strategy must be per_location or bulk, got "batch"`},
+		{"per_location needs location base URLs", APIConfig{BaseURL: "http://upstream", Locations: locations}, "api.locations[0] (berlin): base_url is required"},
+		{"no base URL", APIConfig{Strategy: strategyBulk, Locations: []LocationSource{{Name: "berlin", BaseURL: "http://berlin"}}}, "api.strategy bulk requires api.base_url"},
+		{"no locations", APIConfig{Strategy: strategyBulk, BaseURL: "http://upstream"}, "api.strategy bulk requires api.locations"},
+		{"csv", APIConfig{Strategy: strategyBulk, BaseURL: "http://upstream", Locations: locations, Format: formatCSV}, "requires JSON responses"},
+		{"incremental", APIConfig{Strategy: strategyBulk, BaseURL: "http://upstream", Locations: locations, Incremental: IncrementalConfig{Enabled: true}}, "cannot be combined with api.incremental"},
+		{"negative max_stations", APIConfig{Strategy: strategyBulk, BaseURL: "http://upstream", Locations: locations, Bulk: BulkConfig{MaxStations: -1}}, "api.bulk.max_stations must not be negative"},
+		{"relative path", APIConfig{Strategy: strategyBulk, BaseURL: "http://upstream", Locations: locations, Bulk: BulkConfig{Path: "bulk"}}, "api.bulk.path must start with /"},
+		{"duplicate station", APIConfig{Strategy: strategyBulk, BaseURL: "http://upstream", Locations: []LocationSource{{Name: "berlin", StationID: "st-1"}, {Name: "paris", StationID: "st-1"}}}, `api.locations berlin and paris have the same station_id "st-1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+
+	config := &Config{API: APIConfig{Strategy: strategyBulk, BaseURL: "http://upstream", Locations: locations}, Publishing: PublishingConfig{Passthrough: true}}
+	assert.ErrorContains(t, config.Validate(), "publishing.passthrough cannot be combined with api.strategy bulk")
+}
+
+func TestBulk_ChunksStations(t *testing.T) {
+	upstream := newBulkUpstream(t)
+	ingestor, channel := newBulkIngestor(t, upstream, 2, "berlin", "paris", "rome", "oslo", "lima")
+
+	cycle := ingestor.RunCycle(context.Background())
+	requests, _, gets := upstream.calls()
+	assert.Equal(t, CycleSucceeded, cycle.Status)
+	assert.Empty(t, cycle.Gaps)
+	for _, location := range cycle.Locations {
+		assert.Equal(t, outcomePublished, location.Outcome, location.Location)
+		assert.Equal(t, 1, location.Readings, location.Location)
+	}
+	assert.Equal(t, []bulkRequest{
+		{StationIDs: []string{"st-berlin", "st-paris"}},
+		{StationIDs: []string{"st-rome", "st-oslo"}},
+		{StationIDs: []string{"st-lima"}},
+	}, requests)
+	assert.Zero(t, gets)
+	assert.Len(t, channel.messages(), 5)
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.UpstreamBulkRequests.WithLabelValues(bulkOK)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamFetches.WithLabelValues("rome", triggerPoll)))
+
+	// Every location gets the readings of its own station
+	for _, location := range cycle.Locations {
+		assert.Equal(t, "st-"+location.Location, (*location.data)[0].Name)
+	}
+}
+
+func TestBulk_MissingStations(t *testing.T) {
+	upstream := newBulkUpstream(t)
+	upstream.missing["st-paris"] = true
+	ingestor, channel := newBulkIngestor(t, upstream, 0, "berlin", "paris", "rome")
+
+	cycle := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleSucceeded, cycle.Status)
+	assert.Equal(t, []string{"paris"}, cycle.Gaps)
+	assert.Equal(t, outcomeNoData, cycle.Locations[1].Outcome)
+	assert.Equal(t, outcomePublished, cycle.Locations[0].Outcome)
+	assert.Equal(t, outcomePublished, cycle.Locations[2].Outcome)
+	requests, _, _ := upstream.calls()
+	assert.Len(t, requests, 1)
+	assert.Len(t, channel.messages(), 2)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.BulkMissingStations.WithLabelValues("paris")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.NoDataResponses.WithLabelValues("paris")))
+	assert.Equal(t, breakerClosed.String(), ingestor.sources[1].status(time.Now()).Breaker)
+
+	// The gaps are in the response of POST /ingest
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ingest", nil))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		Gaps []string `json:"gaps"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, []string{"paris"}, body.Gaps)
+}
+
+func TestBulk_RetriesThePost(t *testing.T) {
+	upstream := newBulkUpstream(t)
+	upstream.status = []int{http.StatusServiceUnavailable, http.StatusOK}
+	ingestor, channel := newBulkIngestor(t, upstream, 0, "berlin", "paris")
+	ingestor.config.API.RetryCount = 1
+
+	cycle := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleSucceeded, cycle.Status)
+	_, keys, _ := upstream.calls()
+	require.Len(t, keys, 2)
+	assert.NotEmpty(t, keys[0])
+	assert.Equal(t, keys[0], keys[1], "the retry is the same request")
+	assert.Len(t, channel.messages(), 2)
+
+	// The next cycle is a new request
+	ingestor.RunCycle(context.Background())
+	_, keys, _ = upstream.calls()
+	require.Len(t, keys, 3)
+	assert.NotEqual(t, keys[0], keys[2])
+}
+
+func TestBulk_FailedRequestFailsItsStations(t *testing.T) {
+	upstream := newBulkUpstream(t)
+	upstream.status = []int{http.StatusOK, http.StatusBadRequest}
+	ingestor, channel := newBulkIngestor(t, upstream, 1, "berlin", "paris")
+
+	cycle := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleDegraded, cycle.Status)
+	assert.Equal(t, outcomePublished, cycle.Locations[0].Outcome)
+	assert.Equal(t, outcomeFailed, cycle.Locations[1].Outcome)
+	assert.Contains(t, cycle.Locations[1].Error, "API returned status 400")
+	assert.Len(t, channel.messages(), 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamBulkRequests.WithLabelValues(bulkFailed)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamFailures.WithLabelValues("paris")))
+}
+
+func TestBulk_FallsBackToPerLocation(t *testing.T) {
+	upstream := newBulkUpstream(t)
+	upstream.status = []int{http.StatusNotFound}
+	ingestor, channel := newBulkIngestor(t, upstream, 0, "berlin", "paris")
+
+	cycle := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleSucceeded, cycle.Status)
+	requests, _, gets := upstream.calls()
+	assert.Len(t, requests, 1)
+	assert.Equal(t, 2, gets, "every location was fetched on its own")
+	assert.Len(t, channel.messages(), 2)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamBulkRequests.WithLabelValues(bulkUnsupported)))
+
+	// The bulk endpoint is tried again with the next cycle
+	ingestor.RunCycle(context.Background())
+	requests, _, gets = upstream.calls()
+	assert.Len(t, requests, 2)
+	assert.Equal(t, 2, gets)
+}
+
+func TestBulk_FallsBackOnlyForTheRemainingChunks(t *testing.T) {
+	upstream := newBulkUpstream(t)
+	upstream.status = []int{http.StatusOK, http.StatusNotFound}
+	ingestor, channel := newBulkIngestor(t, upstream, 1, "berlin", "paris", "rome")
+
+	cycle := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleSucceeded, cycle.Status)
+	requests, _, gets := upstream.calls()
+	assert.Equal(t, []bulkRequest{{StationIDs: []string{"st-berlin"}}, {StationIDs: []string{"st-paris"}}}, requests)
+	assert.Equal(t, 2, gets, "paris and rome were fetched on their own")
+	assert.Len(t, channel.messages(), 3)
+	assert.Equal(t, "st-berlin", (*cycle.Locations[0].data)[0].Name, "berlin kept its bulk readings")
+	assert.Equal(t, "single", (*cycle.Locations[1].data)[0].Name)
+}
+
+func TestBulk_OpenBreakerFallsBackToPerLocation(t *testing.T) {
+	upstream := newBulkUpstream(t)
+	upstream.status = []int{http.StatusBadRequest}
+	ingestor, channel := newBulkIngestor(t, upstream, 0, "berlin", "paris")
+	ingestor.bulkSource.breaker = newCircuitBreaker(CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: Duration(time.Hour)})
+
+	cycle := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleFailed, cycle.Status)
+	assert.Equal(t, breakerOpen, ingestor.bulkSource.breaker.state, "the failed bulk request opened its breaker")
+
+	cycle = ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleSucceeded, cycle.Status)
+	requests, _, gets := upstream.calls()
+	assert.Len(t, requests, 1, "no bulk request while the breaker is open")
+	assert.Equal(t, 2, gets)
+	assert.Len(t, channel.messages(), 2)
+}
+
+func TestBulk_ReloadRetargetsTheBulkEndpoint(t *testing.T) {
+	old, moved := newBulkUpstream(t), newBulkUpstream(t)
+	ingestor, channel := newBulkIngestor(t, old, 0, "berlin", "paris")
+
+	reloaded := *ingestor.config
+	reloaded.API.BaseURL = moved.server.URL + "/"
+	require.NoError(t, ingestor.reloadUpstreams(&reloaded))
+	assert.Equal(t, moved.server.URL, ingestor.bulkSource.target())
+
+	cycle := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleSucceeded, cycle.Status)
+	requests, _, _ := old.calls()
+	assert.Empty(t, requests)
+	requests, _, _ = moved.calls()
+	assert.Len(t, requests, 1)
+	assert.Len(t, channel.messages(), 2)
+}
+
+func TestBulk_PerLocationIsTheDefault(t *testing.T) {
+	upstream := newBulkUpstream(t)
+	ingestor, _ := newBulkIngestor(t, upstream, 0, "berlin", "paris")
+	ingestor.config.API.Strategy = ""
+
+	cycle := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleSucceeded, cycle.Status)
+	requests, _, gets := upstream.calls()
+	assert.Empty(t, requests)
+	assert.Equal(t, 2, gets)
+}
+
+func TestBulk_Polling(t *testing.T) {
+	upstream := newBulkUpstream(t)
+	ingestor, channel := newBulkIngestor(t, upstream, 0, "berlin", "paris")
+	ingestor.config.API.PollInterval = Duration(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.StartIngestion(ctx)
+	}()
+	require.Eventually(t, func() bool { return len(channel.messages()) >= 4 }, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	requests, _, gets := upstream.calls()
+	assert.Zero(t, gets)
+	for _, request := range requests {
+		assert.Equal(t, []string{"st-berlin", "st-paris"}, request.StationIDs, "one request per cycle")
+	}
+	assert.GreaterOrEqual(t, testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleSucceeded), triggerPoll)), 2.0)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// canonicalTimeLayout is the one layout timestamps are hashed in: UTC with
+// nanoseconds, always nine digits
+const canonicalTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// canonicalize re-encodes a JSON document for hashing only. Logically equal
+// documents encode to the same bytes whatever the key order, number spelling
+// or time zone:
+//   - object keys are sorted by their bytes, without insignificant whitespace
+//   - numbers are float64, written by canonicalNumber
+//   - strings that are RFC 3339 timestamps are converted to UTC in
+//     canonicalTimeLayout
+//   - strings escape only what JSON requires, no HTML escaping
+//
+// Any change to these rules changes every hash; the vectors in
+// testdata/canonical catch that.
+func canonicalize(raw []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("unexpected data after the JSON value")
+	}
+	var out bytes.Buffer
+	if err := writeCanonical(&out, value); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func writeCanonical(out *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		out.WriteString("null")
+	case bool:
+		out.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		f, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil || math.IsInf(f, 0) {
+			return fmt.Errorf("number %s is out of range", v)
+		}
+		out.WriteString(canonicalNumber(f))
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			v = t.UTC().Format(canonicalTimeLayout)
+		}
+		writeCanonicalString(out, v)
+	case []interface{}:
+		out.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeCanonical(out, item); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		out.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			writeCanonicalString(out, key)
+			out.WriteByte(':')
+			if err := writeCanonical(out, v[key]); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	default:
+		return fmt.Errorf("unexpected JSON value %T", value)
+	}
+	return nil
+}
+
+// canonicalNumber writes the shortest digits that round-trip, like
+// JavaScript does: without an exponent from 1e-6 up to 1e21, so 1, 1.0 and 1e0
+// are all 1, and -0 is 0. Integers beyond 2^53 lose precision as float64.
+func canonicalNumber(f float64) string {
+	abs := math.Abs(f)
+	switch {
+	case f == 0:
+		return "0"
+	case abs >= 1e-6 && abs < 1e21:
+		return strconv.FormatFloat(f, 'f', -1, 64)
+	default:
+		return strconv.FormatFloat(f, 'e', -1, 64)
+	}
+}
+
+func writeCanonicalString(out *bytes.Buffer, s string) {
+	enc := json.NewEncoder(out)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	// Encode terminates the value with a newline
+	out.Truncate(out.Len() - 1)
+}
+
+// fingerprint identifies a body by the SHA-256 of its canonical encoding,
+// or of the bytes themselves when it is not JSON
+func fingerprint(body []byte) [sha256.Size]byte {
+	if canonical, err := canonicalize(body); err == nil {
+		return sha256.Sum256(canonical)
+	}
+	return sha256.Sum256(body)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// canonicalVector is one entry of testdata/canonical/vectors.json. The file is
+// never rewritten by the tests: a failure means a change to canonicalization,
+// which changes every fingerprint and must be made deliberately.
+type canonicalVector struct {
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+	Canonical string          `json:"canonical"`
+	SHA256    string          `json:"sha256"`
+}
+
+func TestCanonicalize_Vectors(t *testing.T) {
+	body, err := os.ReadFile(filepath.Join("testdata", "canonical", "vectors.json"))
+	require.NoError(t, err)
+	var vectors []canonicalVector
+	require.NoError(t, json.Unmarshal(body, &vectors))
+	require.NotEmpty(t, vectors)
+
+	for _, v := range vectors {
+		canonical, err := canonicalize(v.Input)
+		require.NoError(t, err, v.Name)
+		assert.Equal(t, v.Canonical, string(canonical), v.Name)
+		sum := fingerprint(v.Input)
+		assert.Equal(t, v.SHA256, hex.EncodeToString(sum[:]), v.Name)
+	}
+}
+
+func TestCanonicalize_MapOrderAndTimeZones(t *testing.T) {
+	moscow := time.FixedZone("MSK", 3*60*60)
+	at := time.Date(2026, 3, 1, 12, 0, 0, 0, moscow)
+	reading := func(payload map[string]interface{}) []byte {
+		body, err := json.Marshal(SensorData{Type: "weather", Name: "moscow", Payload: payload})
+		require.NoError(t, err)
+		return body
+	}
+
+	want := fingerprint(reading(map[string]interface{}{"temperature": -3.5, "humidity": 80, "at": at.UTC()}))
+	for i := 0; i < 20; i++ {
+		got := fingerprint(reading(map[string]interface{}{"at": at, "humidity": 80.0, "temperature": -3.5}))
+		require.Equal(t, want, got)
+	}
+	assert.NotEqual(t, want, fingerprint(reading(map[string]interface{}{"temperature": -3.4, "humidity": 80, "at": at})))
+}
+
+func TestCanonicalize_Numbers(t *testing.T) {
+	tests := map[float64]string{
+		0:                  "0",
+		1:                  "1",
+		-2.5:               "-2.5",
+		0.1:                "0.1",
+		1e-6:               "0.000001",
+		1e-7:               "1e-07",
+		123456789012:       "123456789012",
+		1e20:               "100000000000000000000",
+		1e21:               "1e+21",
+		1.0 / 3:            "0.3333333333333333",
+		9007199254740993.0: "9007199254740992",
+	}
+	for f, want := range tests {
+		assert.Equal(t, want, canonicalNumber(f), "%v", f)
+	}
+}
+
+func TestCanonicalize_Rejects(t *testing.T) {
+	for _, raw := range []string{``, `{`, `{"a":1} {"b":2}`, `1e400`} {
+		_, err := canonicalize([]byte(raw))
+		assert.Error(t, err, raw)
+	}
+	// Not JSON: the bytes themselves are fingerprinted
+	assert.NotEqual(t, fingerprint([]byte("a=1")), fingerprint([]byte("a=2")))
+	assert.Equal(t, fingerprint(nil), fingerprint([]byte{}))
+}
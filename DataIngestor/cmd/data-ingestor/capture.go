@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// validateCaptureHeaders checks api.capture_headers. A trailing * captures
+// every header starting with the rest of the name.
+func validateCaptureHeaders(names []string) error {
+	for i, name := range names {
+		prefix := strings.TrimSuffix(name, "*")
+		if prefix == "" {
+			return fmt.Errorf("api.capture_headers[%d]: header name is required", i)
+		}
+		if strings.Contains(prefix, "*") {
+			return fmt.Errorf("api.capture_headers[%d]: * is only allowed at the end of %q", i, name)
+		}
+	}
+	return nil
+}
+
+// captureHeaders copies the response headers matching names, compared
+// case-insensitively, keyed by their canonical name. Headers with several
+// values are joined with ", ". It returns nil when nothing matched.
+func captureHeaders(names []string, header http.Header) map[string]string {
+	if len(names) == 0 {
+		return nil
+	}
+	var captured map[string]string
+	capture := func(key string, values []string) {
+		if captured == nil {
+			captured = make(map[string]string)
+		}
+		captured[http.CanonicalHeaderKey(key)] = strings.Join(values, ", ")
+	}
+
+	for _, name := range names {
+		if prefix, ok := strings.CutSuffix(name, "*"); ok {
+			prefix = strings.ToLower(prefix)
+			for key, values := range header {
+				if strings.HasPrefix(strings.ToLower(key), prefix) {
+					capture(key, values)
+				}
+			}
+			continue
+		}
+		if values := header.Values(name); len(values) > 0 {
+			capture(name, values)
+		}
+	}
+	return captured
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Station-Id", "st-42")
+	header.Set("X-Data-Quality", "high")
+	header.Set("X-Data-Source", "radar")
+	header.Add("X-Data-Source", "satellite")
+	header.Set("Content-Type", "application/json")
+
+	tests := []struct {
+		name  string
+		names []string
+		want  map[string]string
+	}{
+		{"exact", []string{"X-Station-Id"}, map[string]string{"X-Station-Id": "st-42"}},
+		{"case insensitive", []string{"x-station-id", "X-DATA-QUALITY"}, map[string]string{
+			"X-Station-Id":   "st-42",
+			"X-Data-Quality": "high",
+		}},
+		{"prefix", []string{"x-data-*"}, map[string]string{
+			"X-Data-Quality": "high",
+			"X-Data-Source":  "radar, satellite",
+		}},
+		{"missing headers are omitted", []string{"X-Station-Id", "X-Battery", "X-Nothing-*"}, map[string]string{
+			"X-Station-Id": "st-42",
+		}},
+		{"nothing matched", []string{"X-Battery"}, nil},
+		{"not configured", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, captureHeaders(tt.names, header))
+		})
+	}
+}
+
+func TestValidateCaptureHeaders(t *testing.T) {
+	assert.NoError(t, validateCaptureHeaders([]string{"X-Station-Id", "X-Data-*"}))
+	assert.Error(t, validateCaptureHeaders([]string{""}))
+	assert.Error(t, validateCaptureHeaders([]string{"*"}))
+	assert.Error(t, validateCaptureHeaders([]string{"X-*-Quality"}))
+}
+
+func TestMatchCondition_Headers(t *testing.T) {
+	condition := MatchCondition{Headers: map[string]string{"x-data-quality": "h*"}}
+	reading := SensorData{Name: "berlin-1", Headers: map[string]string{"X-Data-Quality": "high"}}
+	assert.True(t, condition.Matches(reading))
+
+	reading.Headers["X-Data-Quality"] = "low"
+	assert.False(t, condition.Matches(reading))
+	assert.False(t, condition.Matches(SensorData{Name: "berlin-1"}), "missing headers never match")
+
+	assert.Error(t, MatchCondition{Headers: map[string]string{"X-Data-Quality": "["}}.validate())
+}
+
+func TestTransformer_Headers(t *testing.T) {
+	transformer := newTestTransformer(t,
+		TransformConfig{Assign: `station = headers["X-Station-Id"]`},
+		TransformConfig{Filter: `headers["X-Data-Quality"] != "low"`},
+	)
+	data := transformer.Apply(WeatherData{
+		{Name: "berlin-1", Payload: map[string]interface{}{}, Headers: map[string]string{"X-Station-Id": "st-42"}},
+		{Name: "berlin-2", Payload: map[string]interface{}{}, Headers: map[string]string{"X-Data-Quality": "low"}},
+		{Name: "berlin-3", Payload: map[string]interface{}{}},
+	})
+
+	require.Len(t, data, 2)
+	assert.Equal(t, "st-42", data[0].Payload["station"])
+	assert.Equal(t, "berlin-3", data[1].Name)
+}
+
+func TestIngest_CapturesHeaders(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Station-Id", "st-42")
+		w.Header().Set("X-Data-Quality", "low")
+		w.Header().Set("X-Request-Id", "not-captured")
+		w.Write([]byte(`[{"type":"weather","name":"berlin-1","payload":{"temperature":21.5}}]`))
+	}))
+	defer upstream.Close()
+
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL:        upstream.URL,
+			Timeout:        Duration(time.Second),
+			CaptureHeaders: []string{"x-station-id", "X-Data-*"},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+		Routing: RoutingConfig{Rules: []RoutingRule{{
+			Name:    "low-quality",
+			Match:   MatchCondition{Headers: map[string]string{"X-Data-Quality": "low"}},
+			Targets: []RoutingTarget{{Exchange: "weather", RoutingKey: "quarantine"}},
+		}}},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "quarantine", messages[0].RoutingKey)
+	assert.Equal(t, amqp.Table{
+		"X-Station-Id":   "st-42",
+		"X-Data-Quality": "low",
+	}, messages[0].Msg.Headers["upstream_headers"])
+
+	var published []map[string]interface{}
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &published))
+	require.Len(t, published, 1)
+	assert.NotContains(t, published[0], "Headers", "headers travel in the envelope only")
+}
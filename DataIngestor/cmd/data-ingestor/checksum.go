@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checksumSuffix names the checksum file next to an archive file. It is in
+// the format of sha256sum, so `sha256sum -c` checks it as well.
+const checksumSuffix = ".sha256"
+
+var (
+	// errArchiveCorrupt is an archive file that does not match its checksum
+	errArchiveCorrupt = errors.New("archive file does not match its checksum")
+	// errNoChecksum is an archive file without a checksum file: still being
+	// written, left by a crash or written before checksums
+	errNoChecksum = errors.New("archive file has no checksum")
+)
+
+// hashingWriter hashes and counts what is written through it, so the
+// checksum of a file is ready once the file is
+type hashingWriter struct {
+	w    io.Writer
+	hash hash.Hash
+	n    int64
+}
+
+func newHashingWriter(w io.Writer) *hashingWriter {
+	return &hashingWriter{w: w, hash: sha256.New()}
+}
+
+func (h *hashingWriter) Write(p []byte) (int, error) {
+	n, err := h.w.Write(p)
+	h.hash.Write(p[:n])
+	h.n += int64(n)
+	return n, err
+}
+
+// resume hashes the content the file at path already has, before it is
+// appended to
+func (h *hashingWriter) resume(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	n, err := io.Copy(h.hash, file)
+	h.n += n
+	return err
+}
+
+// sum returns the hex SHA-256 of what was written
+func (h *hashingWriter) sum() string {
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// hashFile streams the file at path through a SHA-256
+func hashFile(path string) (string, int64, error) {
+	h := newHashingWriter(io.Discard)
+	if err := h.resume(path); err != nil {
+		return "", 0, err
+	}
+	return h.sum(), h.n, nil
+}
+
+// writeChecksum seals an archive file with its checksum
+func writeChecksum(path, sum string) error {
+	line := fmt.Sprintf("%s  %s\n", sum, filepath.Base(path))
+	if err := writeFileAtomic(path+checksumSuffix, []byte(line)); err != nil {
+		return fmt.Errorf("failed to write archive checksum: %w", err)
+	}
+	return nil
+}
+
+// readChecksum returns the checksum recorded for an archive file
+func readChecksum(path string) (string, error) {
+	file, err := os.Open(path + checksumSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return "", errNoChecksum
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	line, err := bufio.NewReader(file).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	sum, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("%w: unreadable checksum file %s", errArchiveCorrupt, path+checksumSuffix)
+	}
+	return sum, nil
+}
+
+// verifyArchive checks an archive file against its checksum file, reading
+// it once. It returns errNoChecksum for a file that was never sealed.
+func verifyArchive(path string) error {
+	want, err := readChecksum(path)
+	if err != nil {
+		return err
+	}
+	got, size, err := hashFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read archive file: %w", err)
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s has sha256 %s over %d bytes, the checksum file says %s", errArchiveCorrupt, path, got, size, want)
+	}
+	return nil
+}
+
+// runVerify implements the verify subcommand: every archive file named is
+// checked against its checksum, and the command fails when one does not
+// match
+func runVerify(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	strict := flags.Bool("strict", false, "also fail for files without a checksum")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return fmt.Errorf("usage: data-ingestor verify [flags] FILE.ndjson...")
+	}
+	return verifyArchives(os.Stdout, flags.Args(), *strict)
+}
+
+// verifyArchives prints the result for every file and returns an error
+// counting the failed ones
+func verifyArchives(w io.Writer, paths []string, strict bool) error {
+	checked, failed := 0, 0
+	for _, path := range paths {
+		if strings.HasSuffix(path, checksumSuffix) {
+			continue
+		}
+		checked++
+		err := verifyArchive(path)
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "%s: OK\n", path)
+		case errors.Is(err, errNoChecksum):
+			fmt.Fprintf(w, "%s: no checksum\n", path)
+			if strict {
+				failed++
+			}
+		default:
+			fmt.Fprintf(w, "%s: FAILED: %v\n", path, err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d archive files failed verification", failed, checked)
+	}
+	return nil
+}
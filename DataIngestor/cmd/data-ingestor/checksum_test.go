@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func sha256Of(t *testing.T, path string) string {
+	t.Helper()
+	body, err := os.ReadFile(path)
+	require.NoError(t, err)
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+// writeHourlyArchives writes one reading per hour from 14:00 and seals
+// every file
+func writeHourlyArchives(t *testing.T, dir string, hours int) []string {
+	t.Helper()
+	sink := NewFileSink(FileSinkConfig{Dir: dir})
+	start := time.Date(2024, 5, 3, 14, 0, 0, 0, time.UTC)
+	for i := 0; i < hours; i++ {
+		require.NoError(t, sink.Write(start.Add(time.Duration(i)*time.Hour), WeatherData{
+			{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": float64(i)}},
+		}))
+	}
+	require.NoError(t, sink.Close())
+
+	var paths []string
+	for _, name := range archiveFiles(t, dir) {
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return paths
+}
+
+// corrupt flips one byte of the file in place
+func corrupt(t *testing.T, path string) {
+	t.Helper()
+	body, err := os.ReadFile(path)
+	require.NoError(t, err)
+	body[len(body)/2] ^= 0x20
+	require.NoError(t, os.WriteFile(path, body, 0o644))
+}
+
+func TestFileSink_SealsFilesWithTheirChecksum(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewFileSink(FileSinkConfig{Dir: dir})
+	at := time.Date(2024, 5, 3, 14, 59, 0, 0, time.UTC)
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	require.NoError(t, sink.Write(at, data))
+	require.NoError(t, sink.Write(at.Add(2*time.Minute), data))
+
+	first := filepath.Join(dir, "weather-2024-05-03T14.ndjson")
+	second := filepath.Join(dir, "weather-2024-05-03T15.ndjson")
+	checksum, err := os.ReadFile(first + checksumSuffix)
+	require.NoError(t, err, "sealed once the sink moved on")
+	assert.Equal(t, sha256Of(t, first)+"  weather-2024-05-03T14.ndjson\n", string(checksum))
+	assert.NoFileExists(t, second+checksumSuffix, "still open")
+
+	require.NoError(t, sink.Close())
+	assert.NoError(t, verifyArchive(second))
+
+	// Appending after a restart unseals the file and seals it again over
+	// the whole content
+	sink = NewFileSink(FileSinkConfig{Dir: dir})
+	require.NoError(t, sink.Write(at.Add(3*time.Minute), data))
+	assert.NoFileExists(t, second+checksumSuffix)
+	require.NoError(t, sink.Close())
+	assert.NoError(t, verifyArchive(second))
+	assert.Len(t, readArchive(t, second), 2)
+}
+
+func TestFileSink_DoesNotAppendToACorruptedFile(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeHourlyArchives(t, dir, 1)
+	corrupt(t, paths[0])
+
+	sink := NewFileSink(FileSinkConfig{Dir: dir})
+	require.NoError(t, sink.Write(time.Date(2024, 5, 3, 14, 30, 0, 0, time.UTC), WeatherData{
+		{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 2.0}},
+	}))
+	require.NoError(t, sink.Close())
+
+	assert.Equal(t, []string{"weather-2024-05-03T14.1.ndjson", "weather-2024-05-03T14.ndjson"}, archiveFiles(t, dir))
+	assert.ErrorIs(t, verifyArchive(paths[0]), errArchiveCorrupt, "left for replay and verify to report")
+	assert.NoError(t, verifyArchive(filepath.Join(dir, "weather-2024-05-03T14.1.ndjson")))
+}
+
+func TestReplay_SkipsCorruptedFilesAndDrainsTheRest(t *testing.T) {
+	paths := writeHourlyArchives(t, t.TempDir(), 3)
+	require.Len(t, paths, 3)
+	corrupt(t, paths[1])
+
+	ingestor, channel := newReplayIngestor()
+	count, err := ingestor.Replay(context.Background(), paths, ReplayOptions{})
+	assert.ErrorIs(t, err, errArchiveCorrupt)
+	assert.ErrorContains(t, err, "skipped 1 of the archive files")
+	assert.Equal(t, 2, count, "the files after the corrupted one are replayed")
+
+	var energies []float64
+	for _, msg := range channel.messages() {
+		var readings WeatherData
+		require.NoError(t, json.Unmarshal(msg.Msg.Body, &readings))
+		for _, reading := range readings {
+			energies = append(energies, reading.Payload["energy"].(float64))
+		}
+	}
+	assert.Equal(t, []float64{0, 2}, energies, "nothing of the corrupted file is published")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ArchiveCorruptFiles))
+}
+
+func TestVerifyArchives(t *testing.T) {
+	dir := t.TempDir()
+	paths := writeHourlyArchives(t, dir, 3)
+	corrupt(t, paths[0])
+	require.NoError(t, os.Remove(paths[2]+checksumSuffix))
+
+	var out bytes.Buffer
+	err := verifyArchives(&out, append(paths, paths[1]+checksumSuffix), false)
+	assert.EqualError(t, err, "1 of 3 archive files failed verification")
+	assert.Contains(t, out.String(), paths[0]+": FAILED: archive file does not match its checksum")
+	assert.Contains(t, out.String(), paths[1]+": OK\n")
+	assert.Contains(t, out.String(), paths[2]+": no checksum\n")
+
+	out.Reset()
+	assert.EqualError(t, verifyArchives(&out, paths[1:], true), "1 of 2 archive files failed verification")
+	assert.NoError(t, verifyArchives(&out, paths[1:2], true))
+
+	assert.ErrorContains(t, runVerify(context.Background(), nil), "usage")
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"data-ingestor/pkg/client"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// These tests run pkg/client against the real routes, so that the two can't
+// drift apart
+
+func newClientTestServer(t *testing.T) (*DataIngestor, *fakeChannel, *client.Client) {
+	t.Helper()
+	ingestor, channel := newAdminTestIngestor(t)
+	server := httptest.NewServer(setupRoutes(ingestor))
+	t.Cleanup(server.Close)
+	return ingestor, channel, client.New(server.URL,
+		client.WithAdminToken("letmein"),
+		client.WithRetries(1, time.Millisecond),
+	)
+}
+
+func TestClient_IngestNow(t *testing.T) {
+	_, channel, c := newClientTestServer(t)
+	ctx := context.Background()
+
+	result, err := c.IngestNow(ctx, client.IngestOptions{IdempotencyKey: "client-1"})
+	require.NoError(t, err)
+	assert.False(t, result.NoData)
+	require.Len(t, result.Readings, 1)
+	assert.Equal(t, "meter-1", result.Readings[0].Name)
+	assert.Equal(t, 1.0, result.Readings[0].Payload["energy"])
+	require.Len(t, result.MessageIDs, 1)
+	assert.Equal(t, channel.messages()[0].Msg.MessageId, result.MessageIDs[0])
+	assert.Len(t, result.CorrelationIDs, 1)
+	assert.Equal(t, "succeeded", result.Status)
+	require.Len(t, result.Locations, 1)
+	assert.Equal(t, "published", result.Locations[0].Outcome)
+	assert.Equal(t, result.CorrelationIDs[0], result.Locations[0].CorrelationID)
+	assert.False(t, result.Replayed)
+
+	again, err := c.IngestNow(ctx, client.IngestOptions{IdempotencyKey: "client-1"})
+	require.NoError(t, err)
+	assert.True(t, again.Replayed)
+	assert.Equal(t, result.MessageIDs, again.MessageIDs)
+	assert.Len(t, channel.messages(), 1)
+}
+
+func TestClient_IngestNowNotConnected(t *testing.T) {
+	ingestor, _, c := newClientTestServer(t)
+	ingestor.Close()
+
+	_, err := c.IngestNow(context.Background(), client.IngestOptions{})
+	assert.ErrorIs(t, err, client.ErrUnavailable)
+	var apiErr *client.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, "disconnected", apiErr.State)
+	assert.Contains(t, apiErr.Message, "not connected")
+}
+
+func TestClient_StatsAndHealth(t *testing.T) {
+	_, _, c := newClientTestServer(t)
+	ctx := context.Background()
+
+	stats, err := c.Stats(ctx)
+	require.NoError(t, err)
+	assert.Empty(t, stats.Subscribers)
+	assert.Equal(t, "ready", stats.RabbitMQ.State)
+	assert.True(t, stats.RabbitMQ.Primary)
+	assert.Contains(t, stats.Triggers, "backfill")
+
+	health, err := c.Health(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "healthy", health.Status)
+	assert.Equal(t, "data-ingestor", health.Service)
+	assert.NotEmpty(t, health.InstanceID)
+	assert.Equal(t, "ready", health.RabbitMQ)
+	assert.False(t, health.Timestamp.IsZero())
+}
+
+func TestClient_Recent(t *testing.T) {
+	ingestor, _, c := newClientTestServer(t)
+	ingestor.stream.Broadcast("cycle-1", triggerPoll, WeatherData{
+		{Type: "weather", Name: "berlin-1", Payload: map[string]interface{}{"temperature": 21.5}},
+		{Type: "weather", Name: "moscow-1", Payload: map[string]interface{}{"temperature": 3.0}},
+		{Type: "weather", Name: "berlin-2", Payload: map[string]interface{}{"temperature": 22.0}},
+	})
+	ctx := context.Background()
+
+	readings, err := c.Recent(ctx, 10, "berlin-*")
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.Equal(t, "cycle-1-0", readings[0].ID)
+	assert.Equal(t, "poll", readings[0].Trigger)
+	assert.Equal(t, "berlin-2", readings[1].Reading.Name)
+	assert.Equal(t, 22.0, readings[1].Reading.Payload["temperature"])
+
+	readings, err = c.Recent(ctx, 1, "")
+	require.NoError(t, err)
+	require.Len(t, readings, 1)
+	assert.Equal(t, "berlin-2", readings[0].Reading.Name, "the newest readings are returned")
+
+	_, err = c.Recent(ctx, 1, "[")
+	var apiErr *client.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 400, apiErr.StatusCode)
+}
+
+func TestClient_PauseResume(t *testing.T) {
+	ingestor, _, c := newClientTestServer(t)
+	ctx := context.Background()
+
+	require.NoError(t, c.Pause(ctx))
+	assert.True(t, ingestor.paused.Load())
+	require.NoError(t, c.Resume(ctx))
+	assert.False(t, ingestor.paused.Load())
+
+	server := httptest.NewServer(setupRoutes(ingestor))
+	defer server.Close()
+	unauthenticated := client.New(server.URL)
+	assert.ErrorIs(t, unauthenticated.Pause(ctx), client.ErrUnauthorized)
+}
+
+func TestClient_StreamResumesAfterDisconnect(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	server := httptest.NewServer(setupRoutes(ingestor))
+	t.Cleanup(server.Close)
+	c := client.New(server.URL, client.WithRetries(1, time.Millisecond))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.Stream(ctx, "berlin-*")
+	require.NoError(t, err)
+	waitForClients(t, ingestor, 1)
+	ingestor.stream.Broadcast("cycle-1", triggerPoll, WeatherData{
+		{Type: "weather", Name: "moscow-1"},
+		{Type: "weather", Name: "berlin-1", Payload: map[string]interface{}{"temperature": 21.5}},
+	})
+	reading := <-stream.C
+	assert.Equal(t, "cycle-1-1", reading.ID)
+	assert.Equal(t, 21.5, reading.Reading.Payload["temperature"])
+
+	// Whether the client already reconnected or not, Last-Event-ID replays
+	// what it missed
+	server.CloseClientConnections()
+	ingestor.stream.Broadcast("cycle-2", triggerPoll, WeatherData{{Type: "weather", Name: "berlin-2"}})
+	ingestor.stream.Broadcast("cycle-3", triggerPoll, WeatherData{{Type: "weather", Name: "berlin-3"}})
+
+	var names []string
+	for len(names) < 2 {
+		select {
+		case reading := <-stream.C:
+			names = append(names, reading.Reading.Name)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %v", names)
+		}
+	}
+	assert.Equal(t, []string{"berlin-2", "berlin-3"}, names)
+
+	cancel()
+	for range stream.C {
+	}
+	assert.ErrorIs(t, stream.Err(), context.Canceled)
+}
+
+func TestClient_History(t *testing.T) {
+	ingestor, _, c := newClientTestServer(t)
+	ingestor.stream.resize(2000)
+	// More readings than fit on a page
+	broadcastHistory(ingestor, 700)
+	ctx := context.Background()
+
+	readings, err := c.History(ctx, time.Time{}, time.Time{}, "")
+	require.NoError(t, err)
+	require.Len(t, readings, 1400)
+	assert.Equal(t, "1200-0", readings[0].ID)
+	assert.Equal(t, "2019-1", readings[999].ID, "the last reading of the first page")
+	assert.Equal(t, "2339-1", readings[1399].ID)
+
+	from := time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC)
+	readings, err = c.History(ctx, from, from.Add(2*time.Minute), "moscow-*")
+	require.NoError(t, err)
+	require.Len(t, readings, 2)
+	assert.Equal(t, "moscow-1", readings[0].Reading.Name)
+	assert.Equal(t, 1.0, readings[0].Reading.Payload["temperature"])
+	assert.Equal(t, from, readings[0].Time)
+
+	readings, err = c.History(ctx, from.Add(time.Hour*24), time.Time{}, "")
+	require.NoError(t, err)
+	assert.Empty(t, readings)
+
+	_, err = c.History(ctx, from, from, "")
+	var apiErr *client.APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 400, apiErr.StatusCode)
+	assert.Equal(t, "from must be before to", apiErr.Message)
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = c.History(canceled, time.Time{}, time.Time{}, "")
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultCoalesceWindow = 2 * time.Second
+
+// How a fetch was shared with another caller
+const (
+	coalescedInFlight = "in_flight"
+	coalescedReused   = "reused"
+)
+
+// CoalescingConfig shares one upstream request between the poller, manual
+// ingests and any other trigger fetching the same location at once
+type CoalescingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Window is how long a successful result is handed to later fetches of
+	// the same location, 2s by default
+	Window Duration `yaml:"window"`
+}
+
+// Validate checks the window
+func (c CoalescingConfig) Validate() error {
+	if c.Window < 0 {
+		return fmt.Errorf("api.coalescing.window must not be negative")
+	}
+	return nil
+}
+
+func (c CoalescingConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return defaultCoalesceWindow
+	}
+	return time.Duration(c.Window)
+}
+
+// fetchFlight is one upstream fetch that every caller with the same key
+// waits for. Its fields are written before done is closed.
+type fetchFlight struct {
+	done     chan struct{}
+	result   *fetchResult
+	err      error
+	retries  int
+	finalURL string
+	// waiters counts the callers that joined the fetch in flight; guarded by
+	// the coalescer
+	waiters int
+	// finished is when the fetch ended, zero while it is in flight; guarded
+	// by the coalescer
+	finished time.Time
+}
+
+// fetchCoalescer is a single-flight layer over the fetches of the locations.
+// It is nil unless api.coalescing.enabled is set.
+type fetchCoalescer struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	flights map[string]*fetchFlight
+}
+
+func newFetchCoalescer(config CoalescingConfig) *fetchCoalescer {
+	if !config.Enabled {
+		return nil
+	}
+	return &fetchCoalescer{window: config.window(), flights: make(map[string]*fetchFlight)}
+}
+
+// do returns the result of the fetch in flight for key, or of one that
+// succeeded within the window, or else starts fetch. The fetch runs apart
+// from the caller that started it, so a caller that gives up does not fail
+// the others. Every caller gets its own copy of the readings; how the result
+// was shared is empty for the caller that started the fetch.
+func (c *fetchCoalescer) do(ctx context.Context, key string, fetch func(ctx context.Context) (*fetchResult, error)) (*fetchResult, string, error) {
+	c.mu.Lock()
+	flight, ok := c.flights[key]
+	shared := ""
+	switch {
+	case ok && flight.finished.IsZero():
+		shared = coalescedInFlight
+		flight.waiters++
+	case ok && flight.err == nil && time.Since(flight.finished) < c.window:
+		shared = coalescedReused
+	default:
+		flight = &fetchFlight{done: make(chan struct{})}
+		c.flights[key] = flight
+		go c.run(context.WithoutCancel(ctx), key, flight, fetch)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-flight.done:
+	case <-ctx.Done():
+		return nil, shared, ctx.Err()
+	}
+	stats := locationStatsOf(ctx)
+	for i := 0; i < flight.retries; i++ {
+		stats.retried()
+	}
+	if flight.finalURL != "" {
+		stats.redirected(flight.finalURL)
+	}
+	if flight.err != nil {
+		return nil, shared, flight.err
+	}
+	return flight.result.copy(), shared, nil
+}
+
+// run fetches for flight. The retries and redirects are counted for the
+// flight, not in the stats of the cycle that started it, which may be gone.
+func (c *fetchCoalescer) run(ctx context.Context, key string, flight *fetchFlight, fetch func(ctx context.Context) (*fetchResult, error)) {
+	stats := &locationStats{}
+	result, err := fetch(withLocationStats(ctx, stats))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	flight.result, flight.err = result, err
+	flight.retries, flight.finalURL = stats.retries, stats.finalURL
+	flight.finished = time.Now()
+	switch {
+	case err != nil:
+		// Failures are shared while in flight, never reused
+		c.forget(key, flight)
+	default:
+		// Nothing reuses the result after the window, and the key of a
+		// location that was removed or retargeted is never asked for again
+		time.AfterFunc(c.window, func() {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			c.forget(key, flight)
+		})
+	}
+	close(flight.done)
+}
+
+// forget removes flight unless a later one replaced it. Callers hold mu.
+func (c *fetchCoalescer) forget(key string, flight *fetchFlight) {
+	if c.flights[key] == flight {
+		delete(c.flights, key)
+	}
+}
+
+// copy returns the result with readings and payload maps of its own, since
+// every caller transforms and enriches the readings it publishes
+func (r *fetchResult) copy() *fetchResult {
+	shared := *r
+	if r.Data != nil {
+		data := make(WeatherData, len(*r.Data))
+		for i, reading := range *r.Data {
+			data[i] = reading.clone()
+		}
+		shared.Data = &data
+	}
+	return &shared
+}
+
+// fetchCoalesced fetches src through the coalescer, if enabled. Fetches of
+// a backfill window are never shared. It reports how the result was shared,
+// so only the caller that fetched feeds the outcome to the breaker.
+func (di *DataIngestor) fetchCoalesced(ctx context.Context, src *source) (*fetchResult, string, error) {
+	if _, _, windowed := fetchWindowOf(ctx); di.coalescer == nil || windowed {
+		result, err := di.fetchSource(ctx, src)
+		return result, "", err
+	}
+	key := src.name + "\x00" + src.target()
+	result, shared, err := di.coalescer.do(ctx, key, func(ctx context.Context) (*fetchResult, error) {
+		return di.fetchSource(ctx, src)
+	})
+	if shared != "" {
+		di.metrics.CoalescedFetches.WithLabelValues(src.name, shared).Inc()
+		locationStatsOf(ctx).coalesced(shared)
+	}
+	return result, shared, err
+}
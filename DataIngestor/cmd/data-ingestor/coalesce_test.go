@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// coalescingUpstream counts its hits and answers once its gate is open
+type coalescingUpstream struct {
+	hits    atomic.Int32
+	status  atomic.Int32
+	gate    chan struct{}
+	release sync.Once
+}
+
+// open lets the held requests and every later one through
+func (u *coalescingUpstream) open() {
+	u.release.Do(func() { close(u.gate) })
+}
+
+// newCoalescingIngestor polls an upstream whose gate starts closed when held
+// is set, and open otherwise
+func newCoalescingIngestor(t *testing.T, window time.Duration, held bool) (*DataIngestor, *fakeChannel, *coalescingUpstream) {
+	t.Helper()
+	upstream := &coalescingUpstream{gate: make(chan struct{})}
+	if !held {
+		upstream.open()
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.hits.Add(1)
+		<-upstream.gate
+		if status := upstream.status.Load(); status != 0 {
+			w.WriteHeader(int(status))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"weather","name":"moscow-1","payload":{"temperature":-5}}]`))
+	}))
+	t.Cleanup(server.Close)
+	// Cleanups run last first: a failed test must not leave a request held
+	// while the server closes
+	t.Cleanup(upstream.open)
+
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			Locations:  []LocationSource{{Name: "moscow", BaseURL: server.URL}},
+			Timeout:    Duration(5 * time.Second),
+			Coalescing: CoalescingConfig{Enabled: true, Window: Duration(window)},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel, upstream
+}
+
+func TestCoalescingConfig_Validate(t *testing.T) {
+	assert.NoError(t, CoalescingConfig{}.Validate())
+	assert.Equal(t, defaultCoalesceWindow, CoalescingConfig{}.window())
+	assert.ErrorContains(t, CoalescingConfig{Window: -1}.Validate(), "api.coalescing.window")
+	assert.Nil(t, newFetchCoalescer(CoalescingConfig{Window: Duration(time.Second)}))
+}
+
+func TestCoalescing_ParallelCallersShareOneUpstreamRequest(t *testing.T) {
+	ingestor, channel, upstream := newCoalescingIngestor(t, time.Millisecond, true)
+	src := ingestor.sources[0]
+	waiters := func() int {
+		ingestor.coalescer.mu.Lock()
+		defer ingestor.coalescer.mu.Unlock()
+		if flight, ok := ingestor.coalescer.flights[src.name+"\x00"+src.target()]; ok {
+			return flight.waiters
+		}
+		return 0
+	}
+
+	const callers = 8
+	outcomes := make([]LocationOutcome, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trigger := triggerPoll
+			if i%2 == 1 {
+				trigger = triggerManual
+			}
+			outcomes[i] = ingestor.runLocation(withTrigger(context.Background(), trigger), src)
+		}()
+	}
+	require.Eventually(t, func() bool { return upstream.hits.Load() == 1 }, 5*time.Second, time.Millisecond)
+	require.Eventually(t, func() bool { return waiters() == callers-1 }, 5*time.Second, time.Millisecond)
+	upstream.open()
+	wg.Wait()
+
+	assert.Equal(t, int32(1), upstream.hits.Load(), "one upstream request for every caller")
+	shared := 0
+	for _, outcome := range outcomes {
+		assert.Equal(t, outcomePublished, outcome.Outcome)
+		assert.Equal(t, 1, outcome.Readings)
+		if outcome.Coalesced == coalescedInFlight {
+			shared++
+		}
+	}
+	assert.Equal(t, callers-1, shared)
+	assert.Equal(t, float64(callers-1), testutil.ToFloat64(ingestor.metrics.CoalescedFetches.WithLabelValues("moscow", coalescedInFlight)))
+	assert.Len(t, channel.messages(), callers, "every caller publishes what it got")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamFetches.WithLabelValues("moscow", triggerPoll))+
+		testutil.ToFloat64(ingestor.metrics.UpstreamFetches.WithLabelValues("moscow", triggerManual)), "only the fetch is recorded")
+}
+
+func TestCoalescing_CallersGetTheirOwnReadings(t *testing.T) {
+	coalescer := newFetchCoalescer(CoalescingConfig{Enabled: true, Window: Duration(time.Minute)})
+	fetch := func(ctx context.Context) (*fetchResult, error) {
+		return &fetchResult{Data: &WeatherData{{Type: "weather", Name: "moscow-1", Payload: map[string]interface{}{"temperature": -5.0}}}}, nil
+	}
+	first, shared, err := coalescer.do(context.Background(), "moscow", fetch)
+	require.NoError(t, err)
+	assert.Empty(t, shared)
+	(*first.Data)[0].Payload["temperature"] = 268.15
+
+	second, shared, err := coalescer.do(context.Background(), "moscow", fetch)
+	require.NoError(t, err)
+	assert.Equal(t, coalescedReused, shared)
+	assert.Equal(t, -5.0, (*second.Data)[0].Payload["temperature"], "the first caller's transforms did not leak")
+}
+
+func TestCoalescing_ReuseWindow(t *testing.T) {
+	ingestor, _, upstream := newCoalescingIngestor(t, 100*time.Millisecond, false)
+	router := setupRoutes(ingestor)
+	src := ingestor.sources[0]
+	require.Equal(t, outcomePublished, ingestor.ingestOnce(context.Background(), src).Outcome)
+
+	// A manual ingest right after the poll is served its result
+	w := postIngest(router, "", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var response struct {
+		Coalesced bool              `json:"coalesced"`
+		Locations []LocationOutcome `json:"locations"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.True(t, response.Coalesced)
+	require.Len(t, response.Locations, 1)
+	assert.Equal(t, coalescedReused, response.Locations[0].Coalesced)
+	assert.Equal(t, int32(1), upstream.hits.Load())
+
+	time.Sleep(150 * time.Millisecond)
+	w = postIngest(router, "", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	response.Coalesced = false
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.False(t, response.Coalesced, "the window has passed")
+	assert.Equal(t, int32(2), upstream.hits.Load())
+
+	// Finished flights leave the coalescer once their window has passed
+	require.Eventually(t, func() bool {
+		ingestor.coalescer.mu.Lock()
+		defer ingestor.coalescer.mu.Unlock()
+		return len(ingestor.coalescer.flights) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestCoalescing_FailuresAreNotReused(t *testing.T) {
+	ingestor, _, upstream := newCoalescingIngestor(t, time.Minute, false)
+	upstream.status.Store(http.StatusBadGateway)
+	src := ingestor.sources[0]
+	assert.Equal(t, outcomeFailed, ingestor.ingestOnce(context.Background(), src).Outcome)
+	assert.Equal(t, outcomeFailed, ingestor.ingestOnce(context.Background(), src).Outcome)
+	assert.Equal(t, int32(2), upstream.hits.Load())
+	assert.Equal(t, 2, src.status(time.Now()).ConsecutiveFailures)
+
+	ingestor.coalescer.mu.Lock()
+	assert.Empty(t, ingestor.coalescer.flights, "a failed flight is removed when it ends")
+	ingestor.coalescer.mu.Unlock()
+
+	upstream.status.Store(0)
+	assert.Equal(t, outcomePublished, ingestor.ingestOnce(context.Background(), src).Outcome)
+	assert.Zero(t, src.status(time.Now()).ConsecutiveFailures)
+}
+
+func TestCoalescing_BackfillWindowsAreNotShared(t *testing.T) {
+	ingestor, _, upstream := newCoalescingIngestor(t, time.Minute, false)
+	src := ingestor.sources[0]
+	from := time.Now().Add(-time.Hour)
+	for i := 0; i < 2; i++ {
+		_, shared, err := ingestor.fetchCoalesced(withFetchWindow(context.Background(), from, from.Add(time.Minute)), src)
+		require.NoError(t, err)
+		assert.Empty(t, shared)
+	}
+	assert.Equal(t, int32(2), upstream.hits.Load())
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Values of publishing.compression, sent as the AMQP ContentEncoding
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+)
+
+const (
+	// defaultCompressionMinBytes is used when publishing.compression_min_bytes
+	// is not set; smaller bodies are published uncompressed
+	defaultCompressionMinBytes = 1024
+	// maxDecodedBytes bounds a decompressed body
+	maxDecodedBytes = 64 << 20
+)
+
+// validateCompression checks publishing.compression and its level. Level 0
+// is the encoding's default.
+func (c PublishingConfig) validateCompression() error {
+	switch c.Compression {
+	case "", compressionNone:
+	case compressionGzip:
+		if c.CompressionLevel < 0 || c.CompressionLevel > gzip.BestCompression {
+			return fmt.Errorf("publishing.compression_level must be between 1 and %d for gzip", gzip.BestCompression)
+		}
+	case compressionZstd:
+		if c.CompressionLevel < 0 || c.CompressionLevel > 22 {
+			return fmt.Errorf("publishing.compression_level must be between 1 and 22 for zstd")
+		}
+	default:
+		return fmt.Errorf("publishing.compression must be none, gzip or zstd, got %q", c.Compression)
+	}
+	if c.CompressionMinBytes < 0 {
+		return fmt.Errorf("publishing.compression_min_bytes must not be negative")
+	}
+	return nil
+}
+
+// compressor encodes message bodies. It is safe for concurrent use.
+type compressor struct {
+	encoding string
+	minBytes int
+
+	gzipLevel int
+	gzipPool  sync.Pool
+	zstd      *zstd.Encoder
+}
+
+// newCompressor returns nil when compression is disabled
+func newCompressor(config PublishingConfig) (*compressor, error) {
+	if err := config.validateCompression(); err != nil {
+		return nil, err
+	}
+	if config.Compression == "" || config.Compression == compressionNone {
+		return nil, nil
+	}
+
+	c := &compressor{encoding: config.Compression, minBytes: int(config.CompressionMinBytes)}
+	if c.minBytes == 0 {
+		c.minBytes = defaultCompressionMinBytes
+	}
+	switch c.encoding {
+	case compressionGzip:
+		c.gzipLevel = config.CompressionLevel
+		if c.gzipLevel == 0 {
+			c.gzipLevel = gzip.DefaultCompression
+		}
+	case compressionZstd:
+		level := zstd.SpeedDefault
+		if config.CompressionLevel > 0 {
+			level = zstd.EncoderLevelFromZstd(config.CompressionLevel)
+		}
+		encoder, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(level))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create zstd encoder: %w", err)
+		}
+		c.zstd = encoder
+	}
+	return c, nil
+}
+
+// encode compresses body and returns it with its ContentEncoding. Bodies
+// below the minimum size are returned as they are, with no encoding.
+func (c *compressor) encode(body []byte) ([]byte, string, error) {
+	if c == nil || len(body) < c.minBytes {
+		return body, "", nil
+	}
+	switch c.encoding {
+	case compressionGzip:
+		var buf bytes.Buffer
+		writer, _ := c.gzipPool.Get().(*gzip.Writer)
+		if writer == nil {
+			var err error
+			if writer, err = gzip.NewWriterLevel(&buf, c.gzipLevel); err != nil {
+				return nil, "", fmt.Errorf("failed to compress message: %w", err)
+			}
+		} else {
+			writer.Reset(&buf)
+		}
+		defer c.gzipPool.Put(writer)
+		if _, err := writer.Write(body); err != nil {
+			return nil, "", fmt.Errorf("failed to compress message: %w", err)
+		}
+		if err := writer.Close(); err != nil {
+			return nil, "", fmt.Errorf("failed to compress message: %w", err)
+		}
+		return buf.Bytes(), compressionGzip, nil
+	case compressionZstd:
+		return c.zstd.EncodeAll(body, make([]byte, 0, len(body)/2)), compressionZstd, nil
+	}
+	return body, "", nil
+}
+
+var (
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdDecoderErr  error
+)
+
+// decodeBody reverses encode for any supported ContentEncoding
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "", compressionNone, "identity":
+		return body, nil
+	case compressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode gzip body: %w", err)
+		}
+		defer reader.Close()
+		decoded, err := io.ReadAll(io.LimitReader(reader, maxDecodedBytes+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode gzip body: %w", err)
+		}
+		if len(decoded) > maxDecodedBytes {
+			return nil, fmt.Errorf("decoded body exceeds %d bytes", maxDecodedBytes)
+		}
+		return decoded, nil
+	case compressionZstd:
+		zstdDecoderOnce.Do(func() {
+			zstdDecoder, zstdDecoderErr = zstd.NewReader(nil,
+				zstd.WithDecoderConcurrency(0),
+				zstd.WithDecoderMaxMemory(maxDecodedBytes))
+		})
+		if zstdDecoderErr != nil {
+			return nil, fmt.Errorf("failed to create zstd decoder: %w", zstdDecoderErr)
+		}
+		decoded, err := zstdDecoder.DecodeAll(body, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode zstd body: %w", err)
+		}
+		return decoded, nil
+	}
+	return nil, fmt.Errorf("unsupported content encoding %q", encoding)
+}
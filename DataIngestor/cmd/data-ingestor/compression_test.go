@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// benchmarkBatch is a realistic batch: a few hundred readings of the kinds
+// the upstream reports, across many locations
+func benchmarkBatch(t testing.TB, readings int) []byte {
+	t.Helper()
+	data := make(WeatherData, 0, readings)
+	cities := []string{"berlin", "moscow", "paris", "madrid", "oslo", "rome", "vienna", "prague"}
+	for i := 0; i < readings; i++ {
+		name := fmt.Sprintf("%s-%d", cities[i%len(cities)], i/len(cities))
+		switch i % 3 {
+		case 0:
+			data = append(data, SensorData{Type: "weather", Name: name, Payload: map[string]interface{}{
+				"temperature": 15 + float64(i%17)*0.37,
+				"humidity":    40 + float64(i%29),
+				"pressure":    1000 + float64(i%31)*0.8,
+				"timestamp":   fmt.Sprintf("2024-05-03T14:%02d:%02dZ", i%60, (i*7)%60),
+			}})
+		case 1:
+			data = append(data, SensorData{Type: "air_quality", Name: name, Payload: map[string]interface{}{
+				"co2":       400 + float64(i%600),
+				"pm25":      float64(i%80) * 0.5,
+				"timestamp": fmt.Sprintf("2024-05-03T14:%02d:%02dZ", i%60, (i*11)%60),
+			}})
+		default:
+			data = append(data, SensorData{Type: "energy", Name: name, Payload: map[string]interface{}{
+				"energy":    float64(i) * 1.25,
+				"voltage":   228 + float64(i%5),
+				"timestamp": fmt.Sprintf("2024-05-03T14:%02d:%02dZ", i%60, (i*13)%60),
+			}})
+		}
+	}
+	body, err := json.Marshal(data)
+	require.NoError(t, err)
+	return body
+}
+
+func TestCompressor_RoundTrip(t *testing.T) {
+	body := benchmarkBatch(t, 200)
+	tests := []struct {
+		encoding string
+		level    int
+	}{
+		{compressionGzip, 0},
+		{compressionGzip, 1},
+		{compressionGzip, 9},
+		{compressionZstd, 0},
+		{compressionZstd, 1},
+		{compressionZstd, 19},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s level %d", tt.encoding, tt.level), func(t *testing.T) {
+			c, err := newCompressor(PublishingConfig{Compression: tt.encoding, CompressionLevel: tt.level})
+			require.NoError(t, err)
+
+			encoded, encoding, err := c.encode(body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.encoding, encoding)
+			assert.Less(t, len(encoded), len(body)/2)
+
+			decoded, err := decodeBody(encoding, encoded)
+			require.NoError(t, err)
+			assert.Equal(t, body, decoded)
+		})
+	}
+}
+
+func TestCompressor_Concurrent(t *testing.T) {
+	body := benchmarkBatch(t, 50)
+	for _, encoding := range []string{compressionGzip, compressionZstd} {
+		c, err := newCompressor(PublishingConfig{Compression: encoding})
+		require.NoError(t, err)
+		done := make(chan []byte)
+		for i := 0; i < 8; i++ {
+			go func() {
+				encoded, _, _ := c.encode(body)
+				decoded, _ := decodeBody(encoding, encoded)
+				done <- decoded
+			}()
+		}
+		for i := 0; i < 8; i++ {
+			assert.Equal(t, body, <-done)
+		}
+	}
+}
+
+func TestCompressor_MinBytes(t *testing.T) {
+	c, err := newCompressor(PublishingConfig{Compression: compressionZstd})
+	require.NoError(t, err)
+	small := []byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`)
+	encoded, encoding, err := c.encode(small)
+	require.NoError(t, err)
+	assert.Empty(t, encoding, "bodies below the default threshold stay uncompressed")
+	assert.Equal(t, small, encoded)
+
+	c, err = newCompressor(PublishingConfig{Compression: compressionGzip, CompressionMinBytes: 10})
+	require.NoError(t, err)
+	_, encoding, err = c.encode(small)
+	require.NoError(t, err)
+	assert.Equal(t, compressionGzip, encoding)
+}
+
+func TestCompressor_Disabled(t *testing.T) {
+	for _, compression := range []string{"", compressionNone} {
+		c, err := newCompressor(PublishingConfig{Compression: compression})
+		require.NoError(t, err)
+		assert.Nil(t, c)
+
+		body := benchmarkBatch(t, 10)
+		encoded, encoding, err := c.encode(body)
+		require.NoError(t, err)
+		assert.Empty(t, encoding)
+		assert.Equal(t, body, encoded)
+	}
+}
+
+func TestPublishingConfig_ValidateCompression(t *testing.T) {
+	assert.NoError(t, PublishingConfig{Compression: compressionZstd, CompressionLevel: 22}.validateCompression())
+	assert.Error(t, PublishingConfig{Compression: "brotli"}.validateCompression())
+	assert.Error(t, PublishingConfig{Compression: compressionGzip, CompressionLevel: 10}.validateCompression())
+	assert.Error(t, PublishingConfig{Compression: compressionZstd, CompressionLevel: 23}.validateCompression())
+	assert.Error(t, PublishingConfig{Compression: compressionGzip, CompressionMinBytes: -1}.validateCompression())
+}
+
+func TestDecodeBody_Errors(t *testing.T) {
+	_, err := decodeBody("br", []byte("x"))
+	assert.ErrorContains(t, err, `unsupported content encoding "br"`)
+	_, err = decodeBody(compressionGzip, []byte("not gzip"))
+	assert.Error(t, err)
+	_, err = decodeBody(compressionZstd, []byte("not zstd"))
+	assert.Error(t, err)
+}
+
+func TestPublish_SetsContentEncoding(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Publishing: PublishingConfig{Compression: compressionZstd, CompressionMinBytes: 1},
+		Logging:    LoggingConfig{Level: "error"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	require.NoError(t, ingestor.PublishToQueue(&data))
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, compressionZstd, messages[0].Msg.ContentEncoding)
+	assert.Equal(t, "application/json", messages[0].Msg.ContentType)
+	decoded, err := decodeBody(messages[0].Msg.ContentEncoding, messages[0].Msg.Body)
+	require.NoError(t, err)
+	var published WeatherData
+	require.NoError(t, json.Unmarshal(decoded, &published))
+	assert.Equal(t, data, published)
+}
+
+// BenchmarkCompression compares the encodings on a 500 reading batch. The
+// ratio metric is the compressed size as a share of the original.
+func BenchmarkCompression(b *testing.B) {
+	body := benchmarkBatch(b, 500)
+	options := []PublishingConfig{
+		{Compression: compressionNone},
+		{Compression: compressionGzip, CompressionLevel: 1},
+		{Compression: compressionGzip},
+		{Compression: compressionGzip, CompressionLevel: 9},
+		{Compression: compressionZstd, CompressionLevel: 1},
+		{Compression: compressionZstd},
+		{Compression: compressionZstd, CompressionLevel: 9},
+		{Compression: compressionZstd, CompressionLevel: 19},
+	}
+	for _, option := range options {
+		c, err := newCompressor(option)
+		require.NoError(b, err)
+		encoded, encoding, err := c.encode(body)
+		require.NoError(b, err)
+
+		name := fmt.Sprintf("%s/level-%d", option.Compression, option.CompressionLevel)
+		b.Run("encode/"+name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := c.encode(body); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(len(encoded)), "bytes")
+			b.ReportMetric(float64(len(encoded))/float64(len(body)), "ratio")
+		})
+		b.Run("decode/"+name, func(b *testing.B) {
+			b.SetBytes(int64(len(body)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := decodeBody(encoding, encoded); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
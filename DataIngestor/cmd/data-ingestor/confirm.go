@@ -0,0 +1,230 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// defaultConfirmTimeout is used when rabbitmq.confirm_timeout is not set
+const defaultConfirmTimeout = 5 * time.Second
+
+// defaultPublishTimeout is used when rabbitmq.publish_timeout is not set
+const defaultPublishTimeout = 10 * time.Second
+
+var (
+	// ErrPublishNacked is returned when the broker negatively acknowledges a message
+	ErrPublishNacked = errors.New("broker rejected message")
+	// ErrConfirmTimeout is returned when no confirm arrives within the confirm timeout
+	ErrConfirmTimeout = errors.New("timed out waiting for publish confirm")
+	// ErrPublishTimeout is returned when the write of a message does not end
+	// within the publish timeout
+	ErrPublishTimeout = errors.New("timed out writing message to the broker")
+	// ErrConfirmsClosed is returned when the channel closes before a confirm arrives
+	ErrConfirmsClosed = errors.New("channel closed before publish confirm")
+)
+
+// pendingConfirm is a published message waiting for its broker confirm
+type pendingConfirm struct {
+	sent       time.Time
+	routingKey string
+	messageID  string
+	done       chan error
+}
+
+// confirmTracker matches broker confirms to published messages. Delivery tags
+// are assigned by the channel in publish order starting at 1, so callers must
+// hold the publish lock between track and Publish.
+type confirmTracker struct {
+	mu      sync.Mutex
+	nextTag uint64
+	pending map[uint64]pendingConfirm
+	// returns receives the mandatory messages the broker could not route,
+	// each before the ack of the message; nil without rabbitmq.mandatory
+	returns <-chan amqp.Return
+	// returned are the returns not yet matched to their ack, by MessageId;
+	// guarded by mu
+	returned map[string]amqp.Return
+	// forgotten are the MessageIds of the tags whose confirm timed out, so
+	// their return is dropped when the confirm comes after all; guarded by mu
+	forgotten map[uint64]string
+}
+
+func newConfirmTracker() *confirmTracker {
+	return &confirmTracker{
+		pending:   make(map[uint64]pendingConfirm),
+		returned:  make(map[string]amqp.Return),
+		forgotten: make(map[uint64]string),
+	}
+}
+
+// track registers the next delivery tag and returns a channel that receives
+// the confirm outcome
+func (t *confirmTracker) track(routingKey string) (uint64, <-chan error) {
+	return t.trackID(routingKey, "")
+}
+
+// trackID is track for the message with messageID, whose return is matched
+// to its ack by it
+func (t *confirmTracker) trackID(routingKey, messageID string) (uint64, <-chan error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextTag++
+	done := make(chan error, 1)
+	t.pending[t.nextTag] = pendingConfirm{sent: time.Now(), routingKey: routingKey, messageID: messageID, done: done}
+	return t.nextTag, done
+}
+
+// untrack releases a tag whose Publish call failed. The channel only assigns
+// a delivery tag to messages it actually sent, so the tag is reused.
+func (t *confirmTracker) untrack(tag uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.pending, tag)
+	if tag == t.nextTag {
+		t.nextTag--
+	}
+}
+
+// forget drops a tag whose confirm is no longer awaited. A return already
+// received for it is dropped too.
+func (t *confirmTracker) forget(tag uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.drainReturns()
+	p, ok := t.pending[tag]
+	delete(t.pending, tag)
+	if !ok || p.messageID == "" {
+		return
+	}
+	if _, returned := t.returned[p.messageID]; returned {
+		delete(t.returned, p.messageID)
+		return
+	}
+	t.forgotten[tag] = p.messageID
+}
+
+// waitIdle waits until no message awaits its confirm, up to timeout. It
+// reports whether that happened.
+func (t *confirmTracker) waitIdle(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		t.mu.Lock()
+		idle := len(t.pending) == 0
+		t.mu.Unlock()
+		if idle {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// outstanding returns the number of messages awaiting their confirm
+func (t *confirmTracker) outstanding() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.pending)
+}
+
+// resolve completes the pending message for a confirm and returns it
+func (t *confirmTracker) resolve(confirm amqp.Confirmation) (pendingConfirm, bool) {
+	t.mu.Lock()
+	t.drainReturns()
+	p, ok := t.pending[confirm.DeliveryTag]
+	delete(t.pending, confirm.DeliveryTag)
+	if !ok {
+		if messageID, forgotten := t.forgotten[confirm.DeliveryTag]; forgotten {
+			delete(t.forgotten, confirm.DeliveryTag)
+			delete(t.returned, messageID)
+		}
+	}
+	ret, returned := t.returned[p.messageID]
+	if ok && returned {
+		delete(t.returned, p.messageID)
+	}
+	t.mu.Unlock()
+
+	switch {
+	case !ok:
+		return p, false
+	case !confirm.Ack:
+		p.done <- ErrPublishNacked
+	case returned && p.messageID != "":
+		// The broker acks the messages it returns
+		p.done <- returnedError(ret)
+	default:
+		p.done <- nil
+	}
+	return p, true
+}
+
+// drainReturns takes the returns received so far. The broker sends the
+// return of a message before its ack, so it is in by the time the ack is
+// resolved. Callers hold mu.
+func (t *confirmTracker) drainReturns() {
+	for {
+		select {
+		case ret, ok := <-t.returns:
+			if !ok {
+				t.returns = nil
+				return
+			}
+			if ret.MessageId != "" {
+				t.returned[ret.MessageId] = ret
+			}
+		default:
+			return
+		}
+	}
+}
+
+// failAll completes every pending message with err
+func (t *confirmTracker) failAll(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for tag, p := range t.pending {
+		p.done <- err
+		delete(t.pending, tag)
+	}
+	// No confirm follows on this channel
+	t.returned = make(map[string]amqp.Return)
+	t.forgotten = make(map[uint64]string)
+}
+
+// listenConfirms records confirm latency for every confirm received until the
+// channel's confirm stream is closed
+func (di *DataIngestor) listenConfirms(tracker *confirmTracker, confirms <-chan amqp.Confirmation) {
+	for confirm := range confirms {
+		p, ok := tracker.resolve(confirm)
+		if !ok {
+			continue
+		}
+		di.metrics.PublishConfirmLatency.
+			WithLabelValues(sinkAMQP, p.routingKey).
+			Observe(time.Since(p.sent).Seconds())
+	}
+	tracker.failAll(ErrConfirmsClosed)
+}
+
+// confirmTimeout returns the configured confirm timeout or the default
+func (di *DataIngestor) confirmTimeout() time.Duration {
+	if di.config.RabbitMQ.ConfirmTimeout > 0 {
+		return time.Duration(di.config.RabbitMQ.ConfirmTimeout)
+	}
+	return defaultConfirmTimeout
+}
+
+// publishTimeout returns the configured publish timeout or the default
+func (di *DataIngestor) publishTimeout() time.Duration {
+	if di.config.RabbitMQ.PublishTimeout > 0 {
+		return time.Duration(di.config.RabbitMQ.PublishTimeout)
+	}
+	return defaultPublishTimeout
+}
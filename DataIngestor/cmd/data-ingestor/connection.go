@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/streadway/amqp"
+)
+
+// ConnState is the lifecycle state of the RabbitMQ connection
+type ConnState int
+
+const (
+	StateDisconnected ConnState = iota
+	StateConnecting
+	StateReady
+	StateClosing
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateReady:
+		return "ready"
+	case StateClosing:
+		return "closing"
+	}
+	return "unknown"
+}
+
+var (
+	// ErrNotConnected is returned when publishing without a ready channel
+	ErrNotConnected = errors.New("not connected to RabbitMQ")
+	// ErrConnectInProgress is returned by ConnectToRabbitMQ when the
+	// connection is not currently disconnected
+	ErrConnectInProgress = errors.New("RabbitMQ connection already established or in progress")
+	// ErrClosedWhileConnecting is returned when Close is called before a
+	// connection attempt finishes
+	ErrClosedWhileConnecting = errors.New("connection closed while connecting")
+
+	// errConnectionLost is the last connection error of a connection the
+	// broker closed without a reason
+	errConnectionLost = errors.New("RabbitMQ connection lost")
+)
+
+// ConnectToRabbitMQ establishes connection to RabbitMQ, trying the brokers
+// in order
+func (di *DataIngestor) ConnectToRabbitMQ() error {
+	di.connMu.Lock()
+	if di.connState != StateDisconnected {
+		di.connMu.Unlock()
+		return ErrConnectInProgress
+	}
+	di.connState = StateConnecting
+	generation := di.connGeneration
+	di.connMu.Unlock()
+
+	// Dial without holding the lock so publishers fail fast meanwhile
+	broker, index, err := di.dialAny()
+
+	di.connMu.Lock()
+	defer di.connMu.Unlock()
+
+	if generation != di.connGeneration {
+		if err == nil {
+			broker.close()
+		}
+		return ErrClosedWhileConnecting
+	}
+	if err != nil {
+		di.connState = StateDisconnected
+		di.connErr = err
+		return err
+	}
+
+	di.install(broker, index)
+	di.log(logReconnect).WithField("broker", brokerLabel(di.brokerURL(index))).Info("Connected to RabbitMQ successfully")
+	return nil
+}
+
+// brokerConn is an open connection with its confirm mode channel
+type brokerConn struct {
+	conn     io.Closer
+	channel  amqpChannel
+	confirms <-chan amqp.Confirmation
+	// returns is nil without rabbitmq.mandatory
+	returns <-chan amqp.Return
+	// closed receives an error when the connection drops; it is closed
+	// without one on a graceful close
+	closed <-chan *amqp.Error
+	// flow and blocked receive the broker's flow control notifications
+	flow    <-chan bool
+	blocked <-chan amqp.Blocking
+	// drift is set when the queue on the broker differs from the configuration
+	drift *QueueDrift
+	// openChannel opens another channel on the connection; nil for fakes
+	openChannel func() (amqpChannel, error)
+}
+
+func (b *brokerConn) close() {
+	b.channel.Close()
+	b.conn.Close()
+}
+
+// dial opens a connection and a confirm mode channel with the queue declared
+func (di *DataIngestor) dial(url string) (*brokerConn, error) {
+	dialURL, err := di.brokerDialURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read RabbitMQ credentials: %w", err)
+	}
+	conn, err := di.amqp.Dial(dialURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open channel: %w", err)
+	}
+
+	openChannel := func() (amqpChannel, error) {
+		return conn.Channel()
+	}
+	// Declaring can close the channel, in which case it is replaced
+	drift, err := di.declareQueue(channel, func() (amqpChannel, error) {
+		reopened, err := conn.Channel()
+		if err == nil {
+			channel = reopened
+		}
+		return reopened, err
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := di.declareDeadLetterQueue(channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := di.declareHashPartitions(channel); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Transactions run on a channel of their own, see publishTx
+	if err := channel.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	confirms := channel.NotifyPublish(make(chan amqp.Confirmation, 100))
+	var returns <-chan amqp.Return
+	if di.config.RabbitMQ.Mandatory {
+		returns = channel.NotifyReturn(make(chan amqp.Return, 100))
+	}
+
+	return &brokerConn{
+		conn:        conn,
+		channel:     channel,
+		confirms:    confirms,
+		returns:     returns,
+		closed:      conn.NotifyClose(make(chan *amqp.Error, 1)),
+		flow:        channel.NotifyFlow(make(chan bool, 1)),
+		blocked:     conn.NotifyBlocked(make(chan amqp.Blocking, 1)),
+		drift:       drift,
+		openChannel: openChannel,
+	}, nil
+}
+
+// install makes broker the active connection. Callers hold connMu.
+func (di *DataIngestor) install(broker *brokerConn, index int) {
+	var tracker *confirmTracker
+	if broker.confirms != nil {
+		tracker = newConfirmTracker()
+		tracker.returns = broker.returns
+		go di.listenConfirms(tracker, broker.confirms)
+	}
+	di.conn = broker.conn
+	di.channel = broker.channel
+	di.confirms = tracker
+	di.closed = broker.closed
+	di.queueDrift = broker.drift
+	di.openChannel = broker.openChannel
+	di.connState = StateReady
+	di.connErr = nil
+	if broker.drift != nil {
+		di.logQueueDrift(broker.drift, brokerLabel(di.brokerURL(index)))
+	}
+	// A new connection starts unthrottled
+	di.flow.reset()
+	go di.listenFlow(broker.flow, broker.blocked)
+
+	if index != di.broker {
+		di.recordFailover(di.broker, index)
+	}
+	di.broker = index
+	di.setActiveBroker(index)
+}
+
+// activeChannel returns the channel and confirm tracker to publish on, or
+// ErrNotConnected when the connection is not ready
+func (di *DataIngestor) activeChannel() (amqpChannel, *confirmTracker, error) {
+	di.connMu.Lock()
+	defer di.connMu.Unlock()
+
+	if di.connState != StateReady || di.channel == nil {
+		return nil, nil, fmt.Errorf("%w (connection is %s)", ErrNotConnected, di.connState)
+	}
+	return di.channel, di.confirms, nil
+}
+
+// ConnectionState returns the current RabbitMQ connection state
+func (di *DataIngestor) ConnectionState() ConnState {
+	di.connMu.Lock()
+	defer di.connMu.Unlock()
+	return di.connState
+}
+
+// Close closes connections. It is safe to call in any state and more than once.
+func (di *DataIngestor) Close() error {
+	di.connMu.Lock()
+	if di.connState == StateClosing {
+		di.connMu.Unlock()
+		return nil
+	}
+	di.connState = StateClosing
+	di.connGeneration++
+	channel, conn := di.channel, di.conn
+	di.channel, di.conn, di.confirms, di.closed = nil, nil, nil, nil
+	di.connMu.Unlock()
+
+	if di.fileSink != nil {
+		di.fileSink.Close()
+	}
+	if di.pubsub != nil {
+		di.pubsub.Close()
+	}
+	di.dedup.Close()
+	di.spool.close()
+	di.quarantine.close()
+	di.journal.close()
+	di.aggregates.flush()
+	if channel != nil {
+		channel.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+
+	di.connMu.Lock()
+	di.connState = StateDisconnected
+	di.connMu.Unlock()
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// consumeMessages writes the decoded bodies of up to count deliveries to out,
+// one per line. Bodies are decrypted and their signatures verified with the
+// keys of security. A single_message batch is checked against its count and
+// written as its readings, like the messages of the other batch modes.
+// Without ack the deliveries are left unacknowledged, so the broker requeues
+// them once the consumer goes away.
+func consumeMessages(ctx context.Context, deliveries <-chan amqp.Delivery, count int, ack bool, security *messageSecurity, out io.Writer) (int, error) {
+	consumed := 0
+	for count <= 0 || consumed < count {
+		var delivery amqp.Delivery
+		var ok bool
+		select {
+		case <-ctx.Done():
+			return consumed, nil
+		case delivery, ok = <-deliveries:
+			if !ok {
+				return consumed, errors.New("consumer channel closed")
+			}
+		}
+
+		body, err := security.open(delivery.ContentEncoding, delivery.Body, delivery.Headers)
+		if err == nil && delivery.Type == batchMessageType {
+			body, err = unwrapBatch(body)
+		}
+		if err != nil {
+			return consumed, fmt.Errorf("message %s: %w", delivery.MessageId, err)
+		}
+		if _, err := fmt.Fprintf(out, "%s\n", body); err != nil {
+			return consumed, err
+		}
+		if ack {
+			if err := delivery.Ack(false); err != nil {
+				return consumed, fmt.Errorf("failed to ack message: %w", err)
+			}
+		}
+		consumed++
+	}
+	return consumed, nil
+}
+
+// unwrapBatch returns the readings of a single_message batch body
+func unwrapBatch(body []byte) ([]byte, error) {
+	var batch batchMessage
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, fmt.Errorf("invalid batch: %w", err)
+	}
+	var readings []json.RawMessage
+	if err := json.Unmarshal(batch.Readings, &readings); err != nil {
+		return nil, fmt.Errorf("invalid batch %s: %w", batch.BatchID, err)
+	}
+	if len(readings) != batch.Count {
+		return nil, fmt.Errorf("batch %s holds %d readings, expected %d", batch.BatchID, len(readings), batch.Count)
+	}
+	return batch.Readings, nil
+}
+
+// runConsume implements the consume subcommand, which prints queued messages
+// for debugging
+func runConsume(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("consume", flag.ContinueOnError)
+	configPath := flags.String("config", "config.yaml", "path to the config file")
+	queue := flags.String("queue", "", "queue to read from (default rabbitmq.queue_name)")
+	count := flags.Int("count", 10, "number of messages to print, 0 for no limit")
+	ack := flags.Bool("ack", false, "remove the printed messages from the queue instead of requeueing them")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config from %s: %w", *configPath, err)
+	}
+	if *queue == "" {
+		*queue = config.RabbitMQ.QueueName
+	}
+	security, err := newMessageSecurity(config.Publishing.Security)
+	if err != nil {
+		return err
+	}
+
+	conn, err := dialFirst(config.RabbitMQ.brokers(), logrus.StandardLogger())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer channel.Close()
+	if *count > 0 {
+		// Don't hold more messages than will be printed
+		if err := channel.Qos(*count, 0, false); err != nil {
+			return fmt.Errorf("failed to set prefetch: %w", err)
+		}
+	}
+	deliveries, err := channel.Consume(*queue, "", false, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to consume from %s: %w", *queue, err)
+	}
+
+	consumed, err := consumeMessages(ctx, deliveries, *count, *ack, security, os.Stdout)
+	logrus.WithFields(logrus.Fields{
+		"queue":    *queue,
+		"count":    consumed,
+		"acked":    *ack,
+		"requeued": !*ack,
+	}).Info("Consume finished")
+	return err
+}
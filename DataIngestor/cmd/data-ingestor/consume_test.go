@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingAcknowledger records acked delivery tags
+type recordingAcknowledger struct {
+	acked []uint64
+}
+
+func (r *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	r.acked = append(r.acked, tag)
+	return nil
+}
+
+func (r *recordingAcknowledger) Nack(tag uint64, multiple, requeue bool) error { return nil }
+
+func (r *recordingAcknowledger) Reject(tag uint64, requeue bool) error { return nil }
+
+// encodedDeliveries publishes body with every encoding and returns the deliveries
+func encodedDeliveries(t *testing.T, body []byte, acknowledger amqp.Acknowledger) chan amqp.Delivery {
+	t.Helper()
+	deliveries := make(chan amqp.Delivery, 3)
+	for i, encoding := range []string{compressionNone, compressionGzip, compressionZstd} {
+		c, err := newCompressor(PublishingConfig{Compression: encoding, CompressionMinBytes: 1})
+		require.NoError(t, err)
+		encoded, contentEncoding, err := c.encode(body)
+		require.NoError(t, err)
+		deliveries <- amqp.Delivery{
+			Acknowledger:    acknowledger,
+			DeliveryTag:     uint64(i + 1),
+			ContentEncoding: contentEncoding,
+			Body:            encoded,
+		}
+	}
+	return deliveries
+}
+
+func TestConsumeMessages_DecodesEveryEncoding(t *testing.T) {
+	body := []byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`)
+	var out bytes.Buffer
+
+	consumed, err := consumeMessages(context.Background(), encodedDeliveries(t, body, nil), 3, false, nil, &out)
+	require.NoError(t, err)
+	assert.Equal(t, 3, consumed)
+	assert.Equal(t, strings.Repeat(string(body)+"\n", 3), out.String())
+}
+
+func TestConsumeMessages_Ack(t *testing.T) {
+	acknowledger := &recordingAcknowledger{}
+	var out bytes.Buffer
+
+	consumed, err := consumeMessages(context.Background(), encodedDeliveries(t, []byte("{}"), acknowledger), 2, true, nil, &out)
+	require.NoError(t, err)
+	assert.Equal(t, 2, consumed)
+	assert.Equal(t, []uint64{1, 2}, acknowledger.acked)
+}
+
+func TestConsumeMessages_StopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	var out bytes.Buffer
+
+	consumed, err := consumeMessages(ctx, encodedDeliveries(t, []byte("{}"), nil), 0, false, nil, &out)
+	require.NoError(t, err)
+	assert.Equal(t, 3, consumed)
+}
+
+func TestConsumeMessages_UnknownEncoding(t *testing.T) {
+	deliveries := make(chan amqp.Delivery, 1)
+	deliveries <- amqp.Delivery{MessageId: "m-1", ContentEncoding: "br", Body: []byte("x")}
+	var out bytes.Buffer
+
+	_, err := consumeMessages(context.Background(), deliveries, 1, false, nil, &out)
+	assert.ErrorContains(t, err, "message m-1")
+	assert.Empty(t, out.String())
+}
+
+func TestConsumeMessages_Batches(t *testing.T) {
+	readings := `[{"type":"energy","name":"meter-1","payload":{"energy":1}},{"type":"energy","name":"meter-2","payload":{"energy":2}}]`
+	deliveries := make(chan amqp.Delivery, 1)
+	deliveries <- amqp.Delivery{Type: batchMessageType, Body: []byte(`{"batch_id":"b-1","count":2,"readings":` + readings + `}`)}
+	var out bytes.Buffer
+
+	consumed, err := consumeMessages(context.Background(), deliveries, 1, false, nil, &out)
+	require.NoError(t, err)
+	assert.Equal(t, 1, consumed)
+	assert.Equal(t, readings+"\n", out.String())
+
+	// A batch that lost readings on the way is reported
+	deliveries <- amqp.Delivery{MessageId: "m-2", Type: batchMessageType, Body: []byte(`{"batch_id":"b-2","count":3,"readings":` + readings + `}`)}
+	out.Reset()
+	_, err = consumeMessages(context.Background(), deliveries, 1, false, nil, &out)
+	assert.ErrorContains(t, err, "message m-2: batch b-2 holds 2 readings, expected 3")
+	assert.Empty(t, out.String())
+}
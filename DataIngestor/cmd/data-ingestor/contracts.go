@@ -0,0 +1,488 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// ConsumerContract is the contract file of a consumer of the messages of
+// readings: what it reads from them, per schema version
+type ConsumerContract struct {
+	Consumer string `json:"consumer"`
+	// Schema is the schema the contract is for, weather-reading
+	Schema   string                     `json:"schema"`
+	Versions map[string]ContractVersion `json:"versions"`
+
+	path string
+}
+
+// ContractVersion is what a consumer reads from the messages of one schema
+// version. The body of every message must be an array of readings.
+type ContractVersion struct {
+	// Fields are the fields every reading must have by dotted path, like
+	// payload.energy, with their JSON type; "number|null" allows either and
+	// "integer" whole numbers only
+	Fields map[string]string `json:"fields"`
+	// Headers are the AMQP headers every message must have, by their
+	// published name, with their JSON type
+	Headers map[string]string `json:"headers"`
+	// ContentEncodings are the compressions the consumer decodes; it always
+	// reads uncompressed bodies
+	ContentEncodings []string `json:"content_encodings"`
+	// Decrypts is set for consumers with the publishing.security keys, and
+	// UnwrapsBatches for those that read single_message batches
+	Decrypts       bool `json:"decrypts"`
+	UnwrapsBatches bool `json:"unwraps_batches"`
+	// Examples are readings as the upstream serves them. They are published
+	// through the pipeline of the configuration, and the messages that come
+	// out are what the contract is checked against.
+	Examples json.RawMessage `json:"examples"`
+}
+
+var contractTypes = map[string]bool{
+	jsonString: true, jsonNumber: true, "integer": true, jsonBoolean: true,
+	jsonObject: true, jsonArray: true, jsonNull: true,
+}
+
+// loadContracts reads the *.json contract files of dir in name order
+func loadContracts(dir string) ([]*ConsumerContract, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(paths) == 0 {
+		return nil, fmt.Errorf("no contract files in %s", dir)
+	}
+	sort.Strings(paths)
+	contracts := make([]*ConsumerContract, 0, len(paths))
+	for _, path := range paths {
+		contract, err := loadContract(path)
+		if err != nil {
+			return nil, err
+		}
+		contracts = append(contracts, contract)
+	}
+	return contracts, nil
+}
+
+func loadContract(path string) (*ConsumerContract, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+	contract := &ConsumerContract{path: path}
+	if err := dec.Decode(contract); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if err := contract.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return contract, nil
+}
+
+func (c *ConsumerContract) validate() error {
+	if c.Consumer == "" {
+		return fmt.Errorf("consumer is required")
+	}
+	if c.Schema != readingSchemaName {
+		return fmt.Errorf("schema must be %q, got %q", readingSchemaName, c.Schema)
+	}
+	if len(c.Versions) == 0 {
+		return fmt.Errorf("versions is required")
+	}
+	for version, v := range c.Versions {
+		var examples []json.RawMessage
+		if err := json.Unmarshal(v.Examples, &examples); err != nil || len(examples) == 0 {
+			return fmt.Errorf("versions.%s.examples must be an array of readings", version)
+		}
+		for field, want := range v.Fields {
+			if err := checkContractType(want); err != nil {
+				return fmt.Errorf("versions.%s.fields.%s: %w", version, field, err)
+			}
+		}
+		for header, want := range v.Headers {
+			if err := checkContractType(want); err != nil {
+				return fmt.Errorf("versions.%s.headers.%s: %w", version, header, err)
+			}
+		}
+	}
+	return nil
+}
+
+func checkContractType(want string) error {
+	for _, t := range strings.Split(want, "|") {
+		if !contractTypes[t] {
+			return fmt.Errorf("unknown type %q", t)
+		}
+	}
+	return nil
+}
+
+// contractChannel stands in for the broker while the contracts are checked,
+// keeping what is published. It takes transactions for batch_mode tx.
+type contractChannel struct {
+	mu        sync.Mutex
+	published []amqp.Publishing
+}
+
+func (c *contractChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published = append(c.published, msg)
+	return nil
+}
+
+func (c *contractChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *contractChannel) QueueInspect(name string) (amqp.Queue, error) {
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *contractChannel) Close() error      { return nil }
+func (c *contractChannel) Tx() error         { return nil }
+func (c *contractChannel) TxCommit() error   { return nil }
+func (c *contractChannel) TxRollback() error { return nil }
+
+// take returns what was published since the last call
+func (c *contractChannel) take() []amqp.Publishing {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	published := c.published
+	c.published = nil
+	return published
+}
+
+// contractPublisher publishes example readings the way polled ones are, to a
+// contractChannel instead of the broker
+type contractPublisher struct {
+	di      *DataIngestor
+	channel *contractChannel
+}
+
+func newContractPublisher(di *DataIngestor) *contractPublisher {
+	p := &contractPublisher{di: di, channel: &contractChannel{}}
+	di.connMu.Lock()
+	di.channel = p.channel
+	di.connState = StateReady
+	di.connMu.Unlock()
+	return p
+}
+
+// publish runs examples through shapeReadings and the AMQP sink and returns
+// the messages they came out as. Other sinks are left out.
+func (p *contractPublisher) publish(examples json.RawMessage) ([]amqp.Publishing, error) {
+	di := p.di
+	var data WeatherData
+	if err := json.Unmarshal(examples, &data); err != nil {
+		return nil, fmt.Errorf("invalid examples: %w", err)
+	}
+	ctx := di.withFeatures(withTrigger(context.Background(), triggerPoll))
+	location := defaultSourceName
+	if sources := di.currentSources(); len(sources) > 0 {
+		location = sources[0].name
+	}
+	shaped := di.shapeReadings(ctx, location, data, fetchSignals{})
+	if len(shaped) == 0 {
+		return nil, nil
+	}
+	batch := &sinkBatch{
+		fetched: &fetchResult{Data: &shaped, Body: examples},
+		data:    shaped,
+		env:     Envelope{CorrelationID: newMessageID(), Trigger: triggerPoll},
+	}
+	if _, err := (amqpSink{di}).Deliver(ctx, batch); err != nil {
+		return nil, err
+	}
+	return p.channel.take(), nil
+}
+
+// contractViolation is one difference between a contract and the messages,
+// with the number of messages or readings it was found in
+type contractViolation struct {
+	// kind is - for a missing field, ~ for one of another type and ! for a
+	// message the consumer cannot read
+	kind  byte
+	field string
+	want  string
+	got   string
+	count int
+	of    int
+	unit  string
+}
+
+func (v contractViolation) String() string {
+	line := fmt.Sprintf("  %c %s: ", v.kind, v.field)
+	switch v.kind {
+	case '-':
+		line += fmt.Sprintf("want %s, missing", v.want)
+	case '~':
+		line += fmt.Sprintf("want %s, got %s", v.want, v.got)
+	default:
+		line += v.got
+	}
+	if v.of > 0 {
+		line += fmt.Sprintf(" in %d of %d %s", v.count, v.of, v.unit)
+	}
+	return line
+}
+
+// contractCheck collects the violations of one contract version
+type contractCheck struct {
+	version    ContractVersion
+	security   *messageSecurity
+	violations map[contractViolation]int
+	order      []contractViolation
+	messages   int
+	readings   int
+}
+
+func (c *contractCheck) add(v contractViolation) {
+	if c.violations == nil {
+		c.violations = map[contractViolation]int{}
+	}
+	if _, ok := c.violations[v]; !ok {
+		c.order = append(c.order, v)
+	}
+	c.violations[v]++
+}
+
+// result returns the violations in the order they were first found, with
+// their counts
+func (c *contractCheck) result() []contractViolation {
+	result := make([]contractViolation, 0, len(c.order))
+	for _, v := range c.order {
+		v.count = c.violations[v]
+		switch v.unit {
+		case "messages":
+			v.of = c.messages
+		case "readings":
+			v.of = c.readings
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// message checks one published message as the consumer reads it
+func (c *contractCheck) message(msg amqp.Publishing) {
+	c.messages++
+	for _, header := range sortedFields(c.version.Headers) {
+		want := c.version.Headers[header]
+		value, ok := msg.Headers[header]
+		if !ok {
+			c.add(contractViolation{kind: '-', field: "header " + header, want: want, unit: "messages"})
+		} else if got := headerJSONType(value); !contractTypeMatches(want, got, nil) {
+			c.add(contractViolation{kind: '~', field: "header " + header, want: want, got: got, unit: "messages"})
+		}
+	}
+
+	if msg.ContentEncoding != "" && !contains(c.version.ContentEncodings, msg.ContentEncoding) {
+		c.add(contractViolation{kind: '!', field: "content_encoding", got: fmt.Sprintf("%s, which the consumer does not decode", msg.ContentEncoding), unit: "messages"})
+		return
+	}
+	if _, encrypted := msg.Headers[headerEncryptionKeyID]; encrypted && !c.version.Decrypts {
+		c.add(contractViolation{kind: '!', field: "body", got: "encrypted, and the consumer does not decrypt", unit: "messages"})
+		return
+	}
+	body, err := c.security.open(msg.ContentEncoding, msg.Body, msg.Headers)
+	if err == nil && msg.Type == batchMessageType && c.version.UnwrapsBatches {
+		body, err = unwrapBatch(body)
+	}
+	if err != nil {
+		c.add(contractViolation{kind: '!', field: "body", got: err.Error(), unit: "messages"})
+		return
+	}
+	var readings []json.RawMessage
+	if err := json.Unmarshal(body, &readings); err != nil {
+		c.add(contractViolation{kind: '~', field: "body", want: "array of readings", got: jsonType(body), unit: "messages"})
+		return
+	}
+	for _, reading := range readings {
+		c.reading(reading)
+	}
+}
+
+func (c *contractCheck) reading(reading json.RawMessage) {
+	c.readings++
+	for _, field := range sortedFields(c.version.Fields) {
+		want := c.version.Fields[field]
+		value, ok := lookupJSON(reading, field)
+		if !ok {
+			c.add(contractViolation{kind: '-', field: field, want: want, unit: "readings"})
+		} else if got := jsonType(value); !contractTypeMatches(want, got, value) {
+			c.add(contractViolation{kind: '~', field: field, want: want, got: got, unit: "readings"})
+		}
+	}
+}
+
+// sortedFields returns the names of fields in order, so violations are
+// reported in the same order on every run
+func sortedFields(fields map[string]string) []string {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupJSON returns the value at the dotted path in a JSON object
+func lookupJSON(raw json.RawMessage, path string) (json.RawMessage, bool) {
+	for _, key := range strings.Split(path, ".") {
+		var object map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &object); err != nil {
+			return nil, false
+		}
+		value, ok := object[key]
+		if !ok {
+			return nil, false
+		}
+		raw = value
+	}
+	return raw, true
+}
+
+// contractTypeMatches reports whether got is one of the types of want.
+// integer takes a number without fraction or exponent; raw is nil for
+// headers, whose numbers are whole.
+func contractTypeMatches(want, got string, raw json.RawMessage) bool {
+	for _, t := range strings.Split(want, "|") {
+		switch {
+		case t == got:
+			return true
+		case t == "integer" && got == jsonNumber:
+			if raw == nil || !bytes.ContainsAny(raw, ".eE") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// headerJSONType returns the JSON type of an AMQP header value
+func headerJSONType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return jsonNull
+	case string:
+		return jsonString
+	case bool:
+		return jsonBoolean
+	case []interface{}:
+		return jsonArray
+	case amqp.Table:
+		return jsonObject
+	}
+	return jsonNumber
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// verifyContracts checks every contract against the messages its examples
+// are published as, prints the result and the violations of every contract
+// and returns an error counting the violated ones
+func verifyContracts(w io.Writer, di *DataIngestor, contracts []*ConsumerContract) error {
+	publisher := newContractPublisher(di)
+	violated := 0
+	for _, contract := range contracts {
+		header := fmt.Sprintf("%s (%s), %s %s", contract.Consumer, contract.path, readingSchemaName, readingSchemaVersion)
+		violations, err := checkContract(publisher, contract)
+		if err != nil {
+			return fmt.Errorf("%s: %w", contract.path, err)
+		}
+		if len(violations) == 0 {
+			fmt.Fprintf(w, "%s: OK\n", header)
+			continue
+		}
+		violated++
+		fmt.Fprintf(w, "%s: VIOLATED\n", header)
+		for _, v := range violations {
+			fmt.Fprintln(w, v)
+		}
+	}
+	if violated > 0 {
+		return fmt.Errorf("%d of %d consumer contracts would be violated", violated, len(contracts))
+	}
+	return nil
+}
+
+// checkContract returns the violations of the current schema version of
+// contract
+func checkContract(publisher *contractPublisher, contract *ConsumerContract) ([]contractViolation, error) {
+	version, ok := contract.Versions[readingSchemaVersion]
+	if !ok {
+		known := make([]string, 0, len(contract.Versions))
+		for v := range contract.Versions {
+			known = append(known, v)
+		}
+		sort.Strings(known)
+		return []contractViolation{{kind: '!', field: "schema", got: fmt.Sprintf("%s is published, the consumer knows %s", readingSchemaVersion, strings.Join(known, ", "))}}, nil
+	}
+
+	messages, err := publisher.publish(version.Examples)
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) == 0 {
+		return []contractViolation{{kind: '!', field: "examples", got: "no message was published for them, were they all dropped?"}}, nil
+	}
+	check := &contractCheck{version: version, security: publisher.di.security}
+	for _, msg := range messages {
+		check.message(msg)
+	}
+	return check.result(), nil
+}
+
+// runVerifyContracts implements the verify-contracts subcommand: the
+// consumer contracts in a directory are checked against the messages the
+// configuration publishes, and the command fails when one would be violated
+func runVerifyContracts(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("verify-contracts", flag.ContinueOnError)
+	configPath := flags.String("config", "config.yaml", "path to the config file")
+	profile := flags.String("profile", os.Getenv(profileEnv), "config profile to apply, default $"+profileEnv)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: data-ingestor verify-contracts [flags] DIR")
+	}
+	config, err := LoadConfigProfile(*configPath, *profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config from %s: %w", *configPath, err)
+	}
+	contracts, err := loadContracts(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	// Only problems are logged, the result goes to stdout
+	config.Logging = LoggingConfig{Level: "warn"}
+	ingestor := NewDataIngestor(config)
+	defer ingestor.Close()
+	if err := ingestor.LoadEnrichment(); err != nil {
+		return err
+	}
+	return verifyContracts(os.Stdout, ingestor, contracts)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var shippedContracts = filepath.Join("testdata", "contracts")
+
+func newContractIngestor(publishing PublishingConfig) *DataIngestor {
+	return NewDataIngestor(&Config{
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Publishing: publishing,
+	})
+}
+
+func verifyShipped(t *testing.T, di *DataIngestor) (string, error) {
+	t.Helper()
+	contracts, err := loadContracts(shippedContracts)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	err = verifyContracts(&out, di, contracts)
+	return out.String(), err
+}
+
+func TestVerifyContracts_ShippedContractsHold(t *testing.T) {
+	out, err := verifyShipped(t, newContractIngestor(PublishingConfig{}))
+	require.NoError(t, err, out)
+	assert.Equal(t, ""+
+		"data-processor-service (testdata/contracts/data-processor-service.json), weather-reading v1: OK\n"+
+		"graphql-gateway (testdata/contracts/graphql-gateway.json), weather-reading v1: OK\n", out)
+
+	// Field naming keeps the names of these fields
+	_, err = verifyShipped(t, newContractIngestor(PublishingConfig{FieldNaming: namingCamel}))
+	assert.NoError(t, err)
+}
+
+func TestVerifyContracts_ReportsViolations(t *testing.T) {
+	for name, test := range map[string]struct {
+		publishing PublishingConfig
+		want       string
+	}{
+		"renamed payload": {
+			publishing: PublishingConfig{FieldRenames: map[string]string{"payload": "data"}},
+			want: "" +
+				"data-processor-service (testdata/contracts/data-processor-service.json), weather-reading v1: VIOLATED\n" +
+				"  - payload: want object, missing in 3 of 3 readings\n" +
+				"graphql-gateway (testdata/contracts/graphql-gateway.json), weather-reading v1: VIOLATED\n" +
+				"  - payload.energy: want number, missing in 2 of 2 readings\n",
+		},
+		"single message batches": {
+			publishing: PublishingConfig{BatchMode: batchModeSingle},
+			want: "" +
+				"data-processor-service (testdata/contracts/data-processor-service.json), weather-reading v1: VIOLATED\n" +
+				"  ~ body: want array of readings, got object in 1 of 1 messages\n" +
+				"graphql-gateway (testdata/contracts/graphql-gateway.json), weather-reading v1: VIOLATED\n" +
+				"  ~ body: want array of readings, got object in 1 of 1 messages\n",
+		},
+		"compression": {
+			publishing: PublishingConfig{Compression: compressionGzip, CompressionMinBytes: 1},
+			want: "" +
+				"data-processor-service (testdata/contracts/data-processor-service.json), weather-reading v1: VIOLATED\n" +
+				"  ! content_encoding: gzip, which the consumer does not decode in 1 of 1 messages\n" +
+				"graphql-gateway (testdata/contracts/graphql-gateway.json), weather-reading v1: VIOLATED\n" +
+				"  ! content_encoding: gzip, which the consumer does not decode in 1 of 1 messages\n",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			out, err := verifyShipped(t, newContractIngestor(test.publishing))
+			assert.EqualError(t, err, "2 of 2 consumer contracts would be violated")
+			assert.Equal(t, test.want, out)
+		})
+	}
+}
+
+func writeContract(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "consumer.json"), []byte(content), 0o644))
+	return dir
+}
+
+func TestVerifyContracts_Stages(t *testing.T) {
+	dir := writeContract(t, `{
+		"consumer": "archiver",
+		"schema": "weather-reading",
+		"versions": {"v1": {
+			"fields": {"payload.id": "string", "payload.energy": "number|null"},
+			"headers": {"instance_id": "string", "source_id": "array", "batch_size": "integer"},
+			"content_encodings": ["gzip"],
+			"unwraps_batches": true,
+			"examples": [{"type": "energy", "name": "meter-1", "payload": {"id": 7, "energy": null}}]
+		}}
+	}`)
+	contracts, err := loadContracts(dir)
+	require.NoError(t, err)
+
+	var out bytes.Buffer
+	err = verifyContracts(&out, newContractIngestor(PublishingConfig{}), contracts)
+	assert.Error(t, err)
+	assert.Equal(t, ""+
+		"archiver ("+filepath.Join(dir, "consumer.json")+"), weather-reading v1: VIOLATED\n"+
+		"  - header batch_size: want integer, missing in 1 of 1 messages\n"+
+		"  - header source_id: want array, missing in 1 of 1 messages\n"+
+		"  ~ payload.id: want string, got number in 1 of 1 readings\n", out.String())
+
+	// The reading IDs, batches and compression the contract relies on
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Publishing: PublishingConfig{BatchMode: batchModeSingle, Compression: compressionGzip, CompressionMinBytes: 1},
+		ReadingIDs: ReadingIDConfig{Strategy: idUUIDv7},
+	})
+	out.Reset()
+	assert.NoError(t, verifyContracts(&out, ingestor, contracts), out.String())
+}
+
+func TestVerifyContracts_UnknownVersion(t *testing.T) {
+	dir := writeContract(t, `{"consumer": "legacy", "schema": "weather-reading", "versions": {"v0": {"examples": [{"type": "energy", "name": "meter-1", "payload": {}}]}}}`)
+	contracts, err := loadContracts(dir)
+	require.NoError(t, err)
+	var out bytes.Buffer
+	assert.Error(t, verifyContracts(&out, newContractIngestor(PublishingConfig{}), contracts))
+	assert.Contains(t, out.String(), "  ! schema: v1 is published, the consumer knows v0\n")
+}
+
+func TestLoadContracts_Invalid(t *testing.T) {
+	for content, message := range map[string]string{
+		`{"consumer": "x", "schema": "weather-reading", "versions": {"v1": {"examples": [{}]}}, "owner": "y"}`:            `unknown field "owner"`,
+		`{"schema": "weather-reading", "versions": {"v1": {"examples": [{}]}}}`:                                           "consumer is required",
+		`{"consumer": "x", "schema": "readings", "versions": {"v1": {"examples": [{}]}}}`:                                 `schema must be "weather-reading", got "readings"`,
+		`{"consumer": "x", "schema": "weather-reading"}`:                                                                  "versions is required",
+		`{"consumer": "x", "schema": "weather-reading", "versions": {"v1": {"examples": []}}}`:                            "versions.v1.examples must be an array of readings",
+		`{"consumer": "x", "schema": "weather-reading", "versions": {"v1": {"fields": {"a": "text"}, "examples": [{}]}}}`: `versions.v1.fields.a: unknown type "text"`,
+	} {
+		_, err := loadContracts(writeContract(t, content))
+		assert.ErrorContains(t, err, message, content)
+	}
+	_, err := loadContracts(t.TempDir())
+	assert.ErrorContains(t, err, "no contract files in")
+}
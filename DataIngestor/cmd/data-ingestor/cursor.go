@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultCursorStateFile = "cursor.json"
+	defaultCursorLookback  = time.Hour
+	defaultCursorMaxAge    = 24 * time.Hour
+)
+
+// IncrementalConfig enables fetching only readings newer than the last one
+// published, by passing the per-location cursor as the since query parameter
+type IncrementalConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// StateFile persists the cursors across restarts
+	StateFile string `yaml:"state_file"`
+	// TimestampField is the payload field holding the reading time, as RFC
+	// 3339 or Unix seconds
+	TimestampField string `yaml:"timestamp_field"`
+	// Lookback is how far back to fetch when a location has no usable cursor
+	Lookback Duration `yaml:"lookback"`
+	// MaxAge is how old a cursor may be before the lookback is used instead
+	MaxAge Duration `yaml:"max_age"`
+}
+
+// cursorState is the state file format
+type cursorState struct {
+	Locations map[string]time.Time `json:"locations"`
+}
+
+// cursorStore tracks the newest published reading per location
+type cursorStore struct {
+	config IncrementalConfig
+
+	mu      sync.Mutex
+	cursors map[string]time.Time
+}
+
+func newCursorStore(config IncrementalConfig) *cursorStore {
+	if config.StateFile == "" {
+		config.StateFile = defaultCursorStateFile
+	}
+	if config.TimestampField == "" {
+		config.TimestampField = defaultPartitionTimestampField
+	}
+	if config.Lookback <= 0 {
+		config.Lookback = Duration(defaultCursorLookback)
+	}
+	if config.MaxAge <= 0 {
+		config.MaxAge = Duration(defaultCursorMaxAge)
+	}
+	return &cursorStore{config: config, cursors: make(map[string]time.Time)}
+}
+
+// Load reads the state file. A missing file is not an error: every location
+// then starts from the lookback window.
+func (s *cursorStore) Load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	body, err := os.ReadFile(s.config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read cursor state: %w", err)
+	}
+	var state cursorState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return fmt.Errorf("failed to parse cursor state %s: %w", s.config.StateFile, err)
+	}
+	for location, cursor := range state.Locations {
+		s.cursors[location] = cursor
+	}
+	return nil
+}
+
+// since returns the value of the since parameter for a location: its cursor,
+// or now minus the lookback when there is none or it is older than MaxAge
+func (s *cursorStore) since(location string, now time.Time) time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cursor, ok := s.cursors[location]
+	if !ok || now.Sub(cursor) > time.Duration(s.config.MaxAge) {
+		return now.Add(-time.Duration(s.config.Lookback)).UTC()
+	}
+	return cursor
+}
+
+// advance moves a location's cursor to the newest reading timestamp in data
+// and persists it. The cursor never moves backwards.
+func (s *cursorStore) advance(location string, data WeatherData) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current := s.cursors[location]
+	newest := current
+	for _, sensor := range data {
+		if t, ok := readingTimestamp(sensor, s.config.TimestampField); ok && t.After(newest) {
+			newest = t.UTC()
+		}
+	}
+	if !newest.After(current) {
+		return nil
+	}
+	s.cursors[location] = newest
+	return s.save()
+}
+
+// reset forgets the cursor of one location, or of all when location is empty
+func (s *cursorStore) reset(location string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if location == "" {
+		s.cursors = make(map[string]time.Time)
+	} else {
+		delete(s.cursors, location)
+	}
+	return s.save()
+}
+
+// save writes the state file atomically. Callers hold mu.
+func (s *cursorStore) save() error {
+	body, err := json.MarshalIndent(cursorState{Locations: s.cursors}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.config.StateFile, body); err != nil {
+		return fmt.Errorf("failed to write cursor state: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with body through a temporary file in the
+// same directory, so readers never see a partial file
+func writeFileAtomic(path string, body []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// handleCursorReset serves POST /admin/cursor/reset, for when the upstream
+// rewrote history. Without ?location= every cursor is reset.
+func (di *DataIngestor) handleCursorReset(c *gin.Context) {
+	if di.cursors == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "incremental fetching is disabled",
+		})
+		return
+	}
+
+	location := c.Query("location")
+	if location != "" && di.sourceByName(location) == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("unknown location %q", location),
+		})
+		return
+	}
+	if err := di.cursors.reset(location); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	di.logger.WithField("location", location).Warn("Cursor reset")
+	c.JSON(http.StatusOK, gin.H{
+		"message":  "cursor reset",
+		"location": location,
+	})
+}
+
+// sourceByName returns the location with the given name, or nil
+func (di *DataIngestor) sourceByName(name string) *source {
+	for _, src := range di.currentSources() {
+		if src.name == name {
+			return src
+		}
+	}
+	return nil
+}
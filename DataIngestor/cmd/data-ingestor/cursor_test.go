@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sinceUpstream records the since parameter of every request
+type sinceUpstream struct {
+	mu     sync.Mutex
+	since  []string
+	server *httptest.Server
+}
+
+func newSinceUpstream(t *testing.T, body string) *sinceUpstream {
+	t.Helper()
+	upstream := &sinceUpstream{}
+	upstream.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.mu.Lock()
+		upstream.since = append(upstream.since, r.URL.Query().Get("since"))
+		upstream.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(upstream.server.Close)
+	return upstream
+}
+
+func (u *sinceUpstream) last(t *testing.T) time.Time {
+	t.Helper()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	require.NotEmpty(t, u.since)
+	since, err := time.Parse(time.RFC3339Nano, u.since[len(u.since)-1])
+	require.NoError(t, err)
+	return since
+}
+
+func newIncrementalIngestor(t *testing.T, baseURL, stateFile string) *DataIngestor {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL: baseURL,
+			Timeout: Duration(time.Second),
+			Incremental: IncrementalConfig{
+				Enabled:   true,
+				StateFile: stateFile,
+				Lookback:  Duration(time.Hour),
+				MaxAge:    Duration(24 * time.Hour),
+			},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+		Admin:    AdminConfig{Token: "admin-token"},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	return ingestor
+}
+
+func TestCursor_PersistsAcrossRestarts(t *testing.T) {
+	newest := time.Now().UTC().Add(-10 * time.Minute).Truncate(time.Second)
+	upstream := newSinceUpstream(t, fmt.Sprintf(`[
+		{"type":"weather","name":"berlin-1","payload":{"timestamp":%q}},
+		{"type":"weather","name":"berlin-2","payload":{"timestamp":%q}}
+	]`, newest.Add(-time.Minute).Format(time.RFC3339), newest.Format(time.RFC3339)))
+	stateFile := filepath.Join(t.TempDir(), "cursor.json")
+
+	// No state yet: the lookback window is fetched
+	first := newIncrementalIngestor(t, upstream.server.URL, stateFile)
+	before := time.Now()
+	_, err := first.ingest(context.Background())
+	require.NoError(t, err)
+	assert.WithinDuration(t, before.Add(-time.Hour), upstream.last(t), time.Second)
+
+	// After a restart the persisted cursor is used
+	second := newIncrementalIngestor(t, upstream.server.URL, stateFile)
+	_, err = second.ingest(context.Background())
+	require.NoError(t, err)
+	assert.True(t, newest.Equal(upstream.last(t)), "since is the newest published reading")
+}
+
+func TestCursor_FallsBackToLookback(t *testing.T) {
+	tests := []struct {
+		name  string
+		state string
+	}{
+		{"stale", fmt.Sprintf(`{"locations":{"default":%q}}`, time.Now().Add(-48*time.Hour).UTC().Format(time.RFC3339))},
+		{"corrupt", `{"locations":`},
+		{"other location", fmt.Sprintf(`{"locations":{"moscow":%q}}`, time.Now().UTC().Format(time.RFC3339))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stateFile := filepath.Join(t.TempDir(), "cursor.json")
+			require.NoError(t, os.WriteFile(stateFile, []byte(tt.state), 0o644))
+			upstream := newSinceUpstream(t, `[{"type":"weather","name":"berlin-1","payload":{}}]`)
+
+			ingestor := newIncrementalIngestor(t, upstream.server.URL, stateFile)
+			before := time.Now()
+			_, err := ingestor.FetchDataFromAPI(context.Background())
+			require.NoError(t, err)
+			assert.WithinDuration(t, before.Add(-time.Hour), upstream.last(t), time.Second)
+		})
+	}
+}
+
+func TestCursor_NeverMovesBackwards(t *testing.T) {
+	store := newCursorStore(IncrementalConfig{StateFile: filepath.Join(t.TempDir(), "cursor.json")})
+	now := time.Now().UTC().Truncate(time.Second)
+
+	require.NoError(t, store.advance("berlin", WeatherData{{Payload: map[string]interface{}{"timestamp": float64(now.Unix())}}}))
+	require.NoError(t, store.advance("berlin", WeatherData{
+		{Payload: map[string]interface{}{"timestamp": now.Add(-time.Hour).Format(time.RFC3339)}},
+		{Payload: map[string]interface{}{}},
+	}))
+	assert.True(t, now.Equal(store.since("berlin", now)))
+}
+
+func TestCursorReset_Endpoint(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "cursor.json")
+	upstream := newSinceUpstream(t, `[]`)
+	ingestor := newIncrementalIngestor(t, upstream.server.URL, stateFile)
+	now := time.Now().UTC().Truncate(time.Second)
+	require.NoError(t, ingestor.cursors.advance("default", WeatherData{
+		{Payload: map[string]interface{}{"timestamp": now.Format(time.RFC3339)}},
+	}))
+	router := setupRoutes(ingestor)
+
+	post := func(query string) int {
+		req := httptest.NewRequest(http.MethodPost, "/admin/cursor/reset"+query, nil)
+		req.Header.Set("Authorization", "Bearer admin-token")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusNotFound, post("?location=atlantis"))
+	assert.True(t, now.Equal(ingestor.cursors.since("default", now)))
+
+	assert.Equal(t, http.StatusOK, post("?location=default"))
+	assert.True(t, ingestor.cursors.since("default", now).Equal(now.Add(-time.Hour)))
+
+	// The reset is persisted
+	body, err := os.ReadFile(stateFile)
+	require.NoError(t, err)
+	assert.NotContains(t, string(body), "default")
+}
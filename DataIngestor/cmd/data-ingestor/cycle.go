@@ -0,0 +1,372 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Outcomes of one location in a cycle
+const (
+	outcomePublished = "published"
+	outcomeNoData    = "no_data"
+	// outcomeSkipped is a location that was not fetched or not published:
+	// its breaker is open, it or the broker throttles, or the rate limit
+	// turned it away
+	outcomeSkipped = "skipped"
+	outcomeFailed  = "failed"
+)
+
+// CycleStatus summarizes the outcomes of the locations of a cycle
+type CycleStatus string
+
+const (
+	// CycleSucceeded is a cycle where every location published or had no
+	// data, and at least one published
+	CycleSucceeded CycleStatus = "succeeded"
+	// CycleDegraded is a cycle where some locations published and others
+	// failed or were skipped
+	CycleDegraded CycleStatus = "degraded"
+	// CycleFailed is a cycle where locations failed and none published
+	CycleFailed CycleStatus = "failed"
+	// CycleSkipped is a cycle where locations were skipped and none ran
+	CycleSkipped CycleStatus = "skipped"
+	// CycleNoData is a cycle where no location had data yet
+	CycleNoData CycleStatus = "no_data"
+)
+
+// LocationOutcome is what one location did in a cycle
+type LocationOutcome struct {
+	Location string `json:"location"`
+	// Outcome is published, no_data, skipped or failed
+	Outcome       string   `json:"outcome"`
+	Readings      int      `json:"readings"`
+	MessageIDs    []string `json:"message_ids,omitempty"`
+	CorrelationID string   `json:"correlation_id,omitempty"`
+	DurationMS    int64    `json:"duration_ms"`
+	// Retries is the number of fetch attempts after the first
+	Retries int `json:"retries"`
+	// Bytes is the size of the upstream response that was published
+	Bytes int `json:"bytes"`
+	// Delivery is how the readings reached the sinks, once they were tried
+	Delivery *DeliveryResult `json:"delivery,omitempty"`
+	// FinalURL is where the response came from when the upstream redirected
+	FinalURL string `json:"final_url,omitempty"`
+	// Coalesced is set when the readings came from a fetch shared with
+	// another trigger: in_flight or reused
+	Coalesced string `json:"coalesced,omitempty"`
+	// PublishFailure is the kind of failed publish that failed the cycle:
+	// rejected, returned, unreachable or confirm_timeout
+	PublishFailure string `json:"publish_failure,omitempty"`
+	Error          string `json:"error,omitempty"`
+
+	err     error
+	data    *WeatherData
+	trigger string
+	// diagnosis is the connectivity diagnostic run for a network failure
+	diagnosis *Diagnosis
+}
+
+// CycleResult is the outcome of one ingestion cycle, location by location
+type CycleResult struct {
+	// ID identifies the cycle in its cycle_complete log entry
+	ID     string      `json:"cycle_id"`
+	Status CycleStatus `json:"status"`
+	// Trigger is what started the cycle, see triggerOf
+	Trigger    string            `json:"trigger"`
+	Started    time.Time         `json:"started"`
+	DurationMS int64             `json:"duration_ms"`
+	Locations  []LocationOutcome `json:"locations"`
+	// Gaps are the locations whose station was requested with
+	// api.strategy: bulk but missing from the response
+	Gaps []string `json:"gaps,omitempty"`
+	// Summary is what the cycle_complete entry logged
+	Summary CycleSummary `json:"summary"`
+}
+
+// status derives the cycle status from the location outcomes
+func (r *CycleResult) status() CycleStatus {
+	counts := make(map[string]int)
+	for _, location := range r.Locations {
+		counts[location.Outcome]++
+	}
+	published, failed, skipped := counts[outcomePublished], counts[outcomeFailed], counts[outcomeSkipped]
+	switch {
+	case published > 0 && failed+skipped > 0:
+		return CycleDegraded
+	case published > 0:
+		return CycleSucceeded
+	case failed > 0:
+		return CycleFailed
+	case skipped > 0:
+		return CycleSkipped
+	}
+	return CycleNoData
+}
+
+// failures returns the locations that failed or were skipped
+func (r *CycleResult) failures() []LocationOutcome {
+	var failures []LocationOutcome
+	for _, location := range r.Locations {
+		if location.Outcome == outcomeFailed || location.Outcome == outcomeSkipped {
+			failures = append(failures, location)
+		}
+	}
+	return failures
+}
+
+// ingestResult combines the published readings of the cycle. It fails like
+// the cycle: with ErrNoData when no location had data, and with the errors
+// of the locations when none published.
+func (r *CycleResult) ingestResult() (*IngestResult, error) {
+	switch r.Status {
+	case CycleNoData:
+		return nil, ErrNoData
+	case CycleFailed, CycleSkipped:
+		var errs []error
+		for _, location := range r.failures() {
+			errs = append(errs, r.locationErr(location))
+		}
+		return nil, errors.Join(errs...)
+	}
+
+	combined := &IngestResult{Data: &WeatherData{}}
+	for _, location := range r.Locations {
+		switch location.Outcome {
+		case outcomePublished:
+			*combined.Data = append(*combined.Data, *location.data...)
+			combined.MessageIDs = append(combined.MessageIDs, location.MessageIDs...)
+			if location.CorrelationID != "" {
+				combined.CorrelationIDs = append(combined.CorrelationIDs, location.CorrelationID)
+			}
+		case outcomeFailed, outcomeSkipped:
+			if combined.SourceErrors == nil {
+				combined.SourceErrors = make(map[string]string)
+			}
+			combined.SourceErrors[location.Location] = r.locationErr(location).Error()
+		}
+	}
+	return combined, nil
+}
+
+// locationErr names the location in its error when the cycle has several
+func (r *CycleResult) locationErr(location LocationOutcome) error {
+	if len(r.Locations) > 1 {
+		return fmt.Errorf("location %s: %w", location.Location, location.err)
+	}
+	return location.err
+}
+
+// RunCycle fetches every location concurrently and publishes what they
+// returned. Every location's outcome is in the result, whose status tells
+// whether the cycle succeeded, degraded or failed. A panic in a cycle that
+// was not started by the poller is re-raised to the caller, see recoverCycle.
+func (di *DataIngestor) RunCycle(ctx context.Context) *CycleResult {
+	ctx = di.withFeatures(withLogLevels(ctx, di.logLevels))
+	sources := di.currentSources()
+	result := &CycleResult{Started: time.Now(), Trigger: triggerOf(ctx), Locations: make([]LocationOutcome, len(sources))}
+	if di.config.API.bulk() {
+		ctx, result.Gaps = di.fetchBulk(ctx)
+	}
+	var wg sync.WaitGroup
+	var panicked atomic.Pointer[cyclePanic]
+	for i, src := range sources {
+		wg.Add(1)
+		go func(i int, src *source) {
+			defer wg.Done()
+			defer di.recoverCycle(ctx, &panicked)
+			result.Locations[i] = di.runLocation(ctx, src)
+		}(i, src)
+	}
+	wg.Wait()
+	if di.config.API.bulk() {
+		finishBulkTickets(ctx)
+	}
+	if p := panicked.Load(); p != nil {
+		panic(*p)
+	}
+	di.finishCycle(result)
+
+	if result.Status == CycleDegraded {
+		failed := make(map[string]string)
+		for _, location := range result.failures() {
+			failed[location.Location] = location.Error
+		}
+		di.log(logIngestion).WithFields(logrus.Fields{
+			"locations": len(result.Locations),
+			"failed":    failed,
+		}).Warn("Ingestion cycle degraded")
+	}
+	return result
+}
+
+// finishCycle derives the status of a finished cycle, counts it, logs its
+// cycle_complete entry and adds it to the cycle journal
+func (di *DataIngestor) finishCycle(result *CycleResult) {
+	result.ID = newMessageID()
+	result.DurationMS = time.Since(result.Started).Milliseconds()
+	result.Status = result.status()
+	di.metrics.Cycles.WithLabelValues(string(result.Status), result.Trigger).Inc()
+	result.Summary = di.summarize(result)
+	di.logCycle(result.Summary)
+	di.journal.record(result)
+}
+
+// runLocation runs the cycle of one location and records its outcome
+func (di *DataIngestor) runLocation(ctx context.Context, src *source) LocationOutcome {
+	start := time.Now()
+	stats := &locationStats{}
+	result, err := di.ingestSource(withLocationStats(ctx, stats), src)
+
+	outcome := LocationOutcome{
+		Location:   src.name,
+		DurationMS: time.Since(start).Milliseconds(),
+		Retries:    stats.retries,
+		Bytes:      stats.bytes,
+		Delivery:   stats.delivery,
+		FinalURL:   stats.finalURL,
+		Coalesced:  stats.shared,
+		err:        err,
+		trigger:    triggerOf(ctx),
+		diagnosis:  stats.diagnosis,
+	}
+	switch {
+	case err == nil:
+		outcome.Outcome = outcomePublished
+		outcome.data = result.Data
+		outcome.Readings = len(*result.Data)
+		outcome.MessageIDs = result.MessageIDs
+		if len(result.CorrelationIDs) > 0 {
+			outcome.CorrelationID = result.CorrelationIDs[0]
+		}
+	case errors.Is(err, ErrNoData):
+		outcome.Outcome = outcomeNoData
+	case errors.Is(err, ErrCircuitOpen), errors.Is(err, ErrThrottled),
+		errors.Is(err, ErrBrokerThrottled), errors.Is(err, ErrUpstreamRateLimited):
+		outcome.Outcome = outcomeSkipped
+	default:
+		outcome.Outcome = outcomeFailed
+	}
+	if err != nil && outcome.Outcome != outcomeNoData {
+		// A failed publish can be looked up by its correlation id too
+		outcome.CorrelationID = stats.correlationID
+		outcome.Error = err.Error()
+		outcome.PublishFailure = publishFailureOf(err)
+	}
+	return outcome
+}
+
+// logOutcome logs how the cycle of a polled location went
+func (di *DataIngestor) logOutcome(outcome LocationOutcome) {
+	logger := di.log(logIngestion).WithFields(logrus.Fields{
+		"location": outcome.Location,
+		"trigger":  outcome.trigger,
+	})
+	if outcome.diagnosis != nil {
+		logger = logger.WithFields(outcome.diagnosis.fields())
+	}
+	if outcome.CorrelationID != "" {
+		logger = logger.WithField("correlation_id", outcome.CorrelationID)
+	}
+	err := outcome.err
+	switch {
+	case outcome.Outcome == outcomePublished:
+		types := make([]string, len(*outcome.data))
+		for i, sensor := range *outcome.data {
+			types[i] = sensor.Type
+		}
+		logger.WithFields(logrus.Fields{
+			"count":   outcome.Readings,
+			"types":   types,
+			"retries": outcome.Retries,
+			"bytes":   outcome.Bytes,
+		}).Info("Successfully processed data")
+	case outcome.Outcome == outcomeNoData:
+		logger.Debug("No data yet")
+	case errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrThrottled):
+		logger.WithError(err).Debug("Skipping ingestion cycle")
+	case errors.Is(err, ErrBrokerThrottled):
+		logger.WithError(err).Warn("Ingestion cycle deferred while the broker throttles")
+	case errors.Is(err, ErrUpstreamRateLimited):
+		logger.WithError(err).Warn("Ingestion cycle skipped by the upstream rate limit")
+	case errors.Is(err, ErrTokenAcquisition):
+		logger.WithError(err).Error("Upstream authentication failed")
+	case errors.Is(err, ErrUpstreamRedirect):
+		logger.WithError(err).Error("Upstream redirected instead of answering")
+	case outcome.PublishFailure != "":
+		logger.WithError(err).WithField("publish_failure", outcome.PublishFailure).Error("Ingestion cycle failed to publish")
+	case di.maintenance.active():
+		logger.WithError(err).Warn("Ingestion cycle failed during upstream maintenance")
+	default:
+		logger.WithError(err).WithField("retries", outcome.Retries).Error("Ingestion cycle failed")
+	}
+}
+
+type locationStatsKey struct{}
+
+// locationStats collects what the fetch of one location took, counted
+// where it happens deep in the fetch path
+type locationStats struct {
+	retries  int
+	bytes    int
+	delivery *DeliveryResult
+	finalURL string
+	// diagnosis is set by diagnoseFailure
+	diagnosis *Diagnosis
+	// shared is how the fetch was coalesced with another, if it was
+	shared string
+	// correlationID is set once the cycle publishes, or tries to
+	correlationID string
+}
+
+// withLocationStats has the fetches made with ctx counted in stats
+func withLocationStats(ctx context.Context, stats *locationStats) context.Context {
+	return context.WithValue(ctx, locationStatsKey{}, stats)
+}
+
+// locationStatsOf returns the stats of ctx, nil outside of a cycle
+func locationStatsOf(ctx context.Context) *locationStats {
+	stats, _ := ctx.Value(locationStatsKey{}).(*locationStats)
+	return stats
+}
+
+func (s *locationStats) correlated(correlationID string) {
+	if s != nil {
+		s.correlationID = correlationID
+	}
+}
+
+func (s *locationStats) retried() {
+	if s != nil {
+		s.retries++
+	}
+}
+
+func (s *locationStats) fetched(bytes int) {
+	if s != nil {
+		s.bytes = bytes
+	}
+}
+
+func (s *locationStats) redirected(finalURL string) {
+	if s != nil {
+		s.finalURL = finalURL
+	}
+}
+
+func (s *locationStats) coalesced(shared string) {
+	if s != nil {
+		s.shared = shared
+	}
+}
+
+func (s *locationStats) delivered(result *DeliveryResult) {
+	if s != nil {
+		s.delivery = result
+	}
+}
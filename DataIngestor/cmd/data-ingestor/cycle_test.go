@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func outcome(location, kind string) LocationOutcome {
+	o := LocationOutcome{Location: location, Outcome: kind}
+	switch kind {
+	case outcomePublished:
+		o.data = &WeatherData{{Type: "energy", Name: location + "-1"}}
+		o.Readings, o.MessageIDs, o.CorrelationID = 1, []string{location + "-msg"}, location+"-cycle"
+	case outcomeFailed:
+		o.err = errors.New("API returned status 502")
+	case outcomeSkipped:
+		o.err = ErrCircuitOpen
+	case outcomeNoData:
+		o.err = ErrNoData
+	}
+	if o.err != nil && kind != outcomeNoData {
+		o.Error = o.err.Error()
+	}
+	return o
+}
+
+func TestCycleResult_Status(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		outcomes []string
+		want     CycleStatus
+	}{
+		{"all published", []string{outcomePublished, outcomePublished}, CycleSucceeded},
+		{"published and no data", []string{outcomePublished, outcomeNoData}, CycleSucceeded},
+		{"some failed", []string{outcomePublished, outcomePublished, outcomeFailed}, CycleDegraded},
+		{"some skipped", []string{outcomeSkipped, outcomePublished}, CycleDegraded},
+		{"failed and no data", []string{outcomeFailed, outcomeNoData}, CycleFailed},
+		{"failed and skipped", []string{outcomeSkipped, outcomeFailed}, CycleFailed},
+		{"all skipped", []string{outcomeSkipped, outcomeNoData}, CycleSkipped},
+		{"no data", []string{outcomeNoData, outcomeNoData}, CycleNoData},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			result := &CycleResult{}
+			for i, kind := range tc.outcomes {
+				result.Locations = append(result.Locations, outcome(string(rune('a'+i)), kind))
+			}
+			assert.Equal(t, tc.want, result.status())
+		})
+	}
+}
+
+func TestCycleResult_IngestResult(t *testing.T) {
+	degraded := &CycleResult{Status: CycleDegraded, Locations: []LocationOutcome{
+		outcome("berlin", outcomePublished),
+		outcome("moscow", outcomeFailed),
+		outcome("oslo", outcomeNoData),
+		outcome("paris", outcomePublished),
+	}}
+	result, err := degraded.ingestResult()
+	require.NoError(t, err)
+	assert.Equal(t, WeatherData{{Type: "energy", Name: "berlin-1"}, {Type: "energy", Name: "paris-1"}}, *result.Data)
+	assert.Equal(t, []string{"berlin-msg", "paris-msg"}, result.MessageIDs)
+	assert.Equal(t, []string{"berlin-cycle", "paris-cycle"}, result.CorrelationIDs)
+	assert.Equal(t, map[string]string{"moscow": "location moscow: API returned status 502"}, result.SourceErrors)
+
+	failed := &CycleResult{Status: CycleFailed, Locations: []LocationOutcome{
+		outcome("berlin", outcomeSkipped),
+		outcome("moscow", outcomeFailed),
+	}}
+	_, err = failed.ingestResult()
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.ErrorContains(t, err, "location moscow: API returned status 502")
+
+	single := &CycleResult{Status: CycleFailed, Locations: []LocationOutcome{outcome("default", outcomeFailed)}}
+	_, err = single.ingestResult()
+	assert.EqualError(t, err, "API returned status 502", "a single location is not named")
+
+	_, err = (&CycleResult{Status: CycleNoData, Locations: []LocationOutcome{outcome("default", outcomeNoData)}}).ingestResult()
+	assert.ErrorIs(t, err, ErrNoData)
+}
+
+func TestRunCycle_Degraded(t *testing.T) {
+	ingestor, channel, _, moscowHits := newTwoLocationIngestor(t, APIConfig{
+		RetryCount:   2,
+		RetryBackoff: Duration(time.Millisecond),
+	})
+
+	result := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleDegraded, result.Status)
+	assert.False(t, result.Started.IsZero())
+	require.Len(t, result.Locations, 2)
+
+	berlin, moscow := result.Locations[0], result.Locations[1]
+	assert.Equal(t, "berlin", berlin.Location)
+	assert.Equal(t, outcomePublished, berlin.Outcome)
+	assert.Equal(t, 1, berlin.Readings)
+	assert.Equal(t, []string{channel.messages()[0].Msg.MessageId}, berlin.MessageIDs)
+	assert.Equal(t, channel.messages()[0].Msg.CorrelationId, berlin.CorrelationID)
+	assert.Zero(t, berlin.Retries)
+	assert.Equal(t, len(`[{"type":"energy","name":"berlin-1","payload":{"energy":1}}]`), berlin.Bytes)
+
+	assert.Equal(t, "moscow", moscow.Location)
+	assert.Equal(t, outcomeFailed, moscow.Outcome)
+	assert.Equal(t, 2, moscow.Retries)
+	assert.EqualValues(t, 3, *moscowHits)
+	assert.Contains(t, moscow.Error, "500")
+	assert.Zero(t, moscow.Bytes)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleDegraded), triggerPoll)))
+}
+
+func TestIngestOnce_CountsCycleOfOneLocation(t *testing.T) {
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{})
+
+	ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	ingestor.ingestOnce(context.Background(), ingestor.sources[1])
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleSucceeded), triggerPoll)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleFailed), triggerPoll)))
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleDegraded), triggerPoll)),
+		"polled locations are cycles of their own")
+}
+
+func TestHandleIngest_ReturnsCycle(t *testing.T) {
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{})
+
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ingest", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Status       CycleStatus       `json:"status"`
+		Locations    []LocationOutcome `json:"locations"`
+		SourceErrors map[string]string `json:"source_errors"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, CycleDegraded, body.Status)
+	require.Len(t, body.Locations, 2)
+	assert.Equal(t, outcomePublished, body.Locations[0].Outcome)
+	assert.Equal(t, outcomeFailed, body.Locations[1].Outcome)
+	assert.Contains(t, body.SourceErrors, "moscow")
+}
+
+// panickingChannel panics on every publish
+type panickingChannel struct {
+	*fakeChannel
+}
+
+func (p panickingChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	panic("publish exploded")
+}
+
+func TestHandleIngest_PanicAnswers500(t *testing.T) {
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{})
+	attachChannel(ingestor, panickingChannel{&fakeChannel{}}, nil)
+	exitCode := -1
+	ingestor.exit = func(code int) { exitCode = code }
+
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ingest", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"error":"internal server error"}`, w.Body.String())
+	assert.Equal(t, -1, exitCode, "a request cycle must not take the process down")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Panics.WithLabelValues("handler")))
+}
+
+func TestRunCycle_PollPanicCrashes(t *testing.T) {
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{})
+	attachChannel(ingestor, panickingChannel{&fakeChannel{}}, nil)
+	exitCode := -1
+	ingestor.exit = func(code int) { exitCode = code }
+
+	ingestor.RunCycle(withTrigger(context.Background(), triggerPoll))
+
+	assert.Equal(t, exitCodePanic, exitCode)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Panics.WithLabelValues("ingestion")))
+}
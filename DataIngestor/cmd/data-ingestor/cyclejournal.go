@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	cycleJournalVersion = 1
+	// cycleJournalCompactSlack is how many entries the journal file may
+	// hold over twice the cycles kept before it is compacted
+	cycleJournalCompactSlack = 64
+	defaultCyclesLimit       = 20
+)
+
+// CycleJournalConfig keeps the finished cycles, with their traces, across
+// restarts
+type CycleJournalConfig struct {
+	// StateFile is the journal; without it the cycles are kept in memory
+	// only
+	StateFile string `yaml:"state_file"`
+}
+
+// cycleJournalRecord is a line of the journal file: the header with the
+// version, then one finished cycle per line with the traces of its
+// locations
+type cycleJournalRecord struct {
+	Version int           `json:"version,omitempty"`
+	Cycle   *CycleResult  `json:"cycle,omitempty"`
+	Traces  []TraceRecord `json:"traces,omitempty"`
+}
+
+// cycleJournal keeps the outcome of as many finished cycles as the history
+// keeps readings, stream.buffer_size, oldest first. With a state file every
+// cycle is appended to it with the traces of its locations, which are
+// restored into the trace store on start.
+type cycleJournal struct {
+	path   string
+	keep   int
+	traces *traceStore
+	logger *logrus.Logger
+
+	mu     sync.Mutex
+	cycles []CycleResult
+	// log is the state file open for appending, nil in memory or after a
+	// failed write
+	log     *os.File
+	records int
+}
+
+func (di *DataIngestor) newCycleJournal() *cycleJournal {
+	j := &cycleJournal{
+		path:   di.config.CycleJournal.StateFile,
+		keep:   di.config.Stream.bufferSize(),
+		traces: di.cycleTraces,
+		logger: di.logger,
+	}
+	if j.path != "" {
+		j.restore()
+	}
+	return j
+}
+
+// restore replays the state file and compacts it. A missing file is not an
+// error; a torn last line, from a crash while it was written, is left out.
+func (j *cycleJournal) restore() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	defer j.compact()
+
+	body, err := os.ReadFile(j.path)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(bytes.TrimSpace(body)) == 0) {
+		return
+	}
+	var records []cycleJournalRecord
+	if err == nil {
+		records, err = replayCycleJournal(body)
+	}
+	if err != nil {
+		j.logger.WithError(err).Warn("Discarding the cycle journal")
+		return
+	}
+	if len(records) > j.keep {
+		records = records[len(records)-j.keep:]
+	}
+	for _, record := range records {
+		j.cycles = append(j.cycles, *record.Cycle)
+		for _, trace := range record.Traces {
+			j.traces.restore(trace)
+		}
+	}
+}
+
+// replayCycleJournal returns the cycles of a journal file, oldest first
+func replayCycleJournal(body []byte) ([]cycleJournalRecord, error) {
+	lines := bytes.Split(body, []byte{'\n'})
+	var header cycleJournalRecord
+	if err := json.Unmarshal(lines[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Version != cycleJournalVersion {
+		return nil, fmt.Errorf("unsupported version %d", header.Version)
+	}
+	var records []cycleJournalRecord
+	for i, line := range lines[1:] {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record cycleJournalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-2 {
+				break
+			}
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		if record.Cycle != nil {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// record adds a finished cycle, the oldest making way
+func (j *cycleJournal) record(result *CycleResult) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cycles = append(j.cycles, *result)
+	if over := len(j.cycles) - j.keep; over > 0 {
+		j.cycles = append(j.cycles[:0:0], j.cycles[over:]...)
+	}
+	if j.path == "" {
+		return
+	}
+	if j.log == nil {
+		// The last write failed
+		j.compact()
+		return
+	}
+	line, err := json.Marshal(j.entry(*result))
+	if err != nil {
+		j.logger.WithError(err).Error("Failed to save cycle journal")
+		return
+	}
+	if _, err := j.log.Write(append(line, '\n')); err != nil {
+		j.logger.WithError(err).Error("Failed to save cycle journal")
+		j.log.Close()
+		j.log = nil
+		return
+	}
+	j.records++
+	if j.records > 2*len(j.cycles)+cycleJournalCompactSlack {
+		j.compact()
+	}
+}
+
+// recent returns up to limit of the cycles kept, newest first, and how many
+// are kept
+func (j *cycleJournal) recent(limit int) ([]CycleResult, int) {
+	if j == nil {
+		return []CycleResult{}, 0
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	cycles := make([]CycleResult, 0, min(limit, len(j.cycles)))
+	for i := len(j.cycles) - 1; i >= 0 && len(cycles) < limit; i-- {
+		cycles = append(cycles, j.cycles[i])
+	}
+	return cycles, len(j.cycles)
+}
+
+// handleCycles serves GET /cycles: the cycles the journal keeps, newest
+// first
+func (di *DataIngestor) handleCycles(c *gin.Context) {
+	limit, err := queryInt(c, "limit", defaultCyclesLimit)
+	if err != nil || limit < 1 || limit > maxHistoryLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit),
+		})
+		return
+	}
+	cycles, total := di.journal.recent(limit)
+	c.JSON(http.StatusOK, gin.H{
+		"cycles": cycles,
+		"total":  total,
+	})
+}
+
+// entry is the journal line of a cycle, with the traces of its locations
+// the trace store still keeps
+func (j *cycleJournal) entry(cycle CycleResult) cycleJournalRecord {
+	record := cycleJournalRecord{Cycle: &cycle}
+	for _, location := range cycle.Locations {
+		if trace := j.traces.lookup(location.CorrelationID); trace != nil {
+			saved := trace.snapshot()
+			// The readings are the history's
+			saved.Readings = nil
+			record.Traces = append(record.Traces, saved)
+		}
+	}
+	return record
+}
+
+// compact rewrites the state file with the cycles kept and opens it for
+// appending. Callers hold mu.
+func (j *cycleJournal) compact() {
+	if j.log != nil {
+		j.log.Close()
+		j.log = nil
+	}
+	body, err := json.Marshal(cycleJournalRecord{Version: cycleJournalVersion})
+	if err != nil {
+		j.logger.WithError(err).Error("Failed to save cycle journal")
+		return
+	}
+	body = append(body, '\n')
+	for _, cycle := range j.cycles {
+		line, err := json.Marshal(j.entry(cycle))
+		if err != nil {
+			j.logger.WithError(err).Error("Failed to save cycle journal")
+			return
+		}
+		body = append(append(body, line...), '\n')
+	}
+	if err := writeFileAtomic(j.path, body); err != nil {
+		j.logger.WithError(err).Error("Failed to save cycle journal")
+		return
+	}
+	log, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		j.logger.WithError(err).Error("Failed to save cycle journal")
+		return
+	}
+	j.log, j.records = log, len(j.cycles)
+}
+
+// close closes the state file
+func (j *cycleJournal) close() {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.log != nil {
+		j.log.Close()
+		j.log = nil
+	}
+}
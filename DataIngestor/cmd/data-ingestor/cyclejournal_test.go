@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newJournalIngestor traces its cycles and keeps them in the journal at path,
+// as many as buffer
+func newJournalIngestor(t *testing.T, path string, buffer int) *DataIngestor {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API:          APIConfig{BaseURL: newUpstream(t, "application/json", traceUpstreamBody).URL},
+		RabbitMQ:     RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:        AdminConfig{Token: "letmein"},
+		Logging:      LoggingConfig{Level: "panic"},
+		Debug:        DebugConfig{Enabled: true, Trace: true, TraceExcerpt: 16},
+		Stream:       StreamConfig{BufferSize: buffer},
+		CycleJournal: CycleJournalConfig{StateFile: path},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	return ingestor
+}
+
+func TestCycleJournal_TracesSurviveARestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cycles.journal")
+	ingestor := newJournalIngestor(t, path, 10)
+	cycle := ingestor.RunCycle(context.Background())
+	require.Equal(t, CycleSucceeded, cycle.Status)
+	correlationID := cycle.Locations[0].CorrelationID
+	require.NoError(t, ingestor.Close())
+
+	restarted := newJournalIngestor(t, path, 10)
+	defer restarted.Close()
+	restarted.journal.mu.Lock()
+	require.Len(t, restarted.journal.cycles, 1)
+	kept := restarted.journal.cycles[0]
+	restarted.journal.mu.Unlock()
+	assert.Equal(t, cycle.ID, kept.ID)
+	assert.Equal(t, cycle.Summary, kept.Summary)
+	assert.Equal(t, outcomePublished, kept.Locations[0].Outcome)
+
+	w := getTrace(t, restarted, correlationID)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var trace TraceRecord
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &trace))
+	assert.Equal(t, traceUpstreamBody[:16], trace.Upstream.Excerpt)
+	assert.Len(t, trace.Routing, 1)
+	assert.Len(t, trace.Publishes, 1)
+	assert.Empty(t, trace.Readings, "the history does not survive the restart")
+}
+
+func TestCycleJournal_KeepsAsManyCyclesAsTheHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cycles.journal")
+	ingestor := newJournalIngestor(t, path, 2)
+	var ids []string
+	for i := 0; i < cycleJournalCompactSlack+10; i++ {
+		ids = append(ids, ingestor.RunCycle(context.Background()).ID)
+	}
+	require.NoError(t, ingestor.Close())
+	body, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, bytes.Count(body, []byte{'\n'}), 1+2*2+cycleJournalCompactSlack, "the file is compacted")
+
+	// A line torn by a crash is left out
+	require.NoError(t, os.WriteFile(path, append(body, []byte(`{"cycle":{"cycle_id":"to`)...), 0o644))
+	restarted := newJournalIngestor(t, path, 2)
+	defer restarted.Close()
+	restarted.journal.mu.Lock()
+	defer restarted.journal.mu.Unlock()
+	require.Len(t, restarted.journal.cycles, 2)
+	assert.Equal(t, ids[len(ids)-2:], []string{restarted.journal.cycles[0].ID, restarted.journal.cycles[1].ID})
+}
+
+func TestCycleJournal_InMemoryWithoutAStateFile(t *testing.T) {
+	ingestor := newJournalIngestor(t, "", 10)
+	ingestor.RunCycle(context.Background())
+	ingestor.journal.mu.Lock()
+	defer ingestor.journal.mu.Unlock()
+	assert.Len(t, ingestor.journal.cycles, 1)
+	assert.Nil(t, ingestor.journal.log)
+}
+
+func TestCycleJournal_ServesTheCyclesNewestFirst(t *testing.T) {
+	ingestor := newJournalIngestor(t, "", 10)
+	defer ingestor.Close()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		ids = append(ids, ingestor.RunCycle(context.Background()).ID)
+	}
+	last := ingestor.RunCycle(withTrigger(context.Background(), triggerManual))
+	ids = append(ids, last.ID)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cycles"+query, nil))
+		return w
+	}
+	w := get("?limit=2")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		Cycles []CycleResult `json:"cycles"`
+		Total  int           `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, 4, body.Total)
+	require.Len(t, body.Cycles, 2)
+	assert.Equal(t, []string{ids[3], ids[2]}, []string{body.Cycles[0].ID, body.Cycles[1].ID})
+	// The journal and the cycle_complete entry agree
+	assert.Equal(t, last.Summary, body.Cycles[0].Summary)
+	assert.Equal(t, triggerManual, body.Cycles[0].Trigger)
+
+	require.NoError(t, json.Unmarshal(get("").Body.Bytes(), &body))
+	assert.Len(t, body.Cycles, 4)
+	for _, query := range []string{"?limit=0", "?limit=1001", "?limit=many"} {
+		assert.Equal(t, http.StatusBadRequest, get(query).Code, query)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cycleCompleteMessage is the message of the entry every cycle ends with
+const cycleCompleteMessage = "cycle_complete"
+
+// CycleSummary is the cycle_complete log entry of a cycle and the summary of
+// its POST /ingest response. Dashboards and log-based alerts parse it, so
+// its fields are a contract frozen in testdata/logs/cycle_complete.json:
+// add fields, don't rename or retype them.
+type CycleSummary struct {
+	CycleID        string `json:"cycle_id"`
+	Trigger        string `json:"trigger"`
+	LocationsTotal int    `json:"locations_total"`
+	// Published, Suppressed and Failed count the locations that published,
+	// were skipped and failed; the others had no data
+	Published  int   `json:"published"`
+	Suppressed int   `json:"suppressed"`
+	Failed     int   `json:"failed"`
+	DurationMS int64 `json:"duration_ms"`
+	// Retries is the number of fetch retries of all locations
+	Retries int `json:"retries"`
+	// EffectiveInterval is the wait until the locations are polled again,
+	// with backoff, throttling and backpressure; the shortest of them
+	EffectiveInterval string `json:"effective_interval"`
+	// BreakerState is the state of the most open breaker of the locations
+	BreakerState string `json:"breaker_state"`
+	// Maintenance is whether the upstream announced maintenance when the
+	// cycle ended
+	Maintenance bool `json:"maintenance"`
+}
+
+// fields returns the summary as log fields
+func (s CycleSummary) fields() logrus.Fields {
+	return logrus.Fields{
+		"cycle_id":           s.CycleID,
+		"trigger":            s.Trigger,
+		"locations_total":    s.LocationsTotal,
+		"published":          s.Published,
+		"suppressed":         s.Suppressed,
+		"failed":             s.Failed,
+		"duration_ms":        s.DurationMS,
+		"retries":            s.Retries,
+		"effective_interval": s.EffectiveInterval,
+		"breaker_state":      s.BreakerState,
+		"maintenance":        s.Maintenance,
+	}
+}
+
+// summarize sums up a finished cycle
+func (di *DataIngestor) summarize(result *CycleResult) CycleSummary {
+	summary := CycleSummary{
+		CycleID:        result.ID,
+		Trigger:        result.Trigger,
+		LocationsTotal: len(result.Locations),
+		DurationMS:     result.DurationMS,
+		Maintenance:    di.maintenance.active(),
+	}
+	for _, location := range result.Locations {
+		switch location.Outcome {
+		case outcomePublished:
+			summary.Published++
+		case outcomeSkipped:
+			summary.Suppressed++
+		case outcomeFailed:
+			summary.Failed++
+		}
+		summary.Retries += location.Retries
+	}
+
+	sources := make([]*source, 0, len(result.Locations))
+	for _, location := range result.Locations {
+		for _, src := range di.currentSources() {
+			if src.name == location.Location {
+				sources = append(sources, src)
+			}
+		}
+	}
+	now := time.Now()
+	breaker := breakerClosed
+	for _, src := range sources {
+		src.mu.Lock()
+		if src.breaker.state > breaker {
+			breaker = src.breaker.state
+		}
+		src.mu.Unlock()
+	}
+	summary.BreakerState = breaker.String()
+	summary.EffectiveInterval = di.pollDelay(now, sources...).String()
+	return summary
+}
+
+// logCycle writes the cycle_complete entry of a finished cycle
+func (di *DataIngestor) logCycle(summary CycleSummary) {
+	di.log(logIngestion).WithFields(summary.fields()).Info(cycleCompleteMessage)
+}
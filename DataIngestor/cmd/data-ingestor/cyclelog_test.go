@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// cycleEntries returns the cycle_complete entries logged so far
+func cycleEntries(hook *test.Hook) []*logrus.Entry {
+	var entries []*logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == cycleCompleteMessage {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// jsonTypes maps every field of a JSON object to the JSON type of its value
+func jsonTypes(t *testing.T, line []byte) map[string]string {
+	t.Helper()
+	var fields map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(line, &fields))
+	types := make(map[string]string, len(fields))
+	for field, value := range fields {
+		types[field] = jsonType(value)
+	}
+	return types
+}
+
+func TestCycleComplete_Golden(t *testing.T) {
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{
+		RetryCount: 1, RetryBackoff: Duration(time.Millisecond),
+		PollInterval: Duration(30 * time.Second), MaxPollInterval: Duration(5 * time.Minute),
+	})
+	ingestor.logger.SetLevel(logrus.InfoLevel)
+	ingestor.logger.SetOutput(io.Discard)
+	hook := test.NewLocal(ingestor.logger)
+
+	ingestor.RunCycle(context.Background())
+	entries := cycleEntries(hook)
+	require.Len(t, entries, 1, "exactly one per cycle")
+	line, err := (&logrus.JSONFormatter{}).Format(entries[0])
+	require.NoError(t, err)
+	got := jsonTypes(t, line)
+
+	path := filepath.Join("testdata", "logs", "cycle_complete.json")
+	if *updateGolden {
+		content, err := json.MarshalIndent(got, "", "  ")
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, append(content, '\n'), 0o644))
+	}
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var want map[string]string
+	require.NoError(t, json.Unmarshal(content, &want))
+	assert.Equal(t, want, got, "the fields of cycle_complete are a contract; rerun with -update only after adding one")
+
+	// Every field of the summary is logged under its JSON name
+	summary, err := json.Marshal(CycleSummary{})
+	require.NoError(t, err)
+	for field := range jsonTypes(t, summary) {
+		assert.Contains(t, entries[0].Data, field)
+	}
+}
+
+func TestCycleComplete_Fields(t *testing.T) {
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{
+		RetryCount: 1, RetryBackoff: Duration(time.Millisecond),
+		PollInterval: Duration(30 * time.Second), MaxPollInterval: Duration(5 * time.Minute),
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: Duration(time.Minute)},
+	})
+	ingestor.logger.SetLevel(logrus.InfoLevel)
+	ingestor.logger.SetOutput(io.Discard)
+	hook := test.NewLocal(ingestor.logger)
+
+	first := ingestor.RunCycle(context.Background())
+	assert.Equal(t, CycleSummary{
+		CycleID:        first.ID,
+		Trigger:        triggerPoll,
+		LocationsTotal: 2,
+		Published:      1,
+		Failed:         1,
+		DurationMS:     first.DurationMS,
+		Retries:        1,
+		// moscow failed once and backs off, berlin polls on time
+		EffectiveInterval: "30s",
+		BreakerState:      "open",
+	}, first.Summary)
+	assert.NotEmpty(t, first.ID)
+
+	// The open breaker skips moscow
+	second := ingestor.ingestOnce(context.Background(), ingestor.sources[1])
+	assert.Equal(t, outcomeSkipped, second.Outcome)
+	entries := cycleEntries(hook)
+	require.Len(t, entries, 2)
+	assert.Equal(t, 1, entries[1].Data["suppressed"])
+	assert.Equal(t, 1, entries[1].Data["locations_total"])
+	assert.Equal(t, "1m0s", entries[1].Data["effective_interval"], "until the breaker closes")
+	assert.NotEqual(t, entries[0].Data["cycle_id"], entries[1].Data["cycle_id"])
+
+	// POST /ingest answers with the summary it logged
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ingest", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Summary CycleSummary `json:"summary"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	entries = cycleEntries(hook)
+	require.Len(t, entries, 3)
+	assert.Equal(t, summaryOf(t, entries[2]), body.Summary)
+	assert.Equal(t, triggerManual, body.Summary.Trigger)
+}
+
+// summaryOf reads a cycle_complete entry back as a CycleSummary
+func summaryOf(t *testing.T, entry *logrus.Entry) CycleSummary {
+	t.Helper()
+	line, err := (&logrus.JSONFormatter{}).Format(entry)
+	require.NoError(t, err)
+	var summary CycleSummary
+	require.NoError(t, json.Unmarshal(line, &summary))
+	return summary
+}
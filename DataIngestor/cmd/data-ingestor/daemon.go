@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStallTimeout = 5 * time.Minute
+	defaultServiceName  = "data-ingestor"
+
+	// brokerReadyPollInterval is how often wait_for_broker checks the connection
+	brokerReadyPollInterval = 100 * time.Millisecond
+)
+
+// sd_notify states sent to systemd
+const (
+	sdReady    = "READY=1"
+	sdWatchdog = "WATCHDOG=1"
+	sdStopping = "STOPPING=1"
+)
+
+// DaemonConfig integrates with the service manager when running on a plain
+// VM. Everything is off by default.
+type DaemonConfig struct {
+	// SystemdNotify sends sd_notify messages to systemd, for Type=notify
+	// units. It does nothing on other platforms or without NOTIFY_SOCKET.
+	SystemdNotify bool `yaml:"systemd_notify"`
+	// WaitForBroker holds READY=1 back until the RabbitMQ connection is ready
+	WaitForBroker bool `yaml:"wait_for_broker"`
+	// StallTimeout is how long one ingestion cycle may run before watchdog
+	// pings stop, so systemd restarts the service; 5m by default
+	StallTimeout Duration `yaml:"stall_timeout"`
+	// WindowsService runs under the Windows service control manager when
+	// started by it. It does nothing on other platforms.
+	WindowsService bool `yaml:"windows_service"`
+	// ServiceName is the Windows service name, data-ingestor by default
+	ServiceName string `yaml:"service_name"`
+	// ShutdownReport is a file the outcome of the run is written to as JSON
+	// when the process exits
+	ShutdownReport string `yaml:"shutdown_report"`
+}
+
+func (c DaemonConfig) Validate() error {
+	if c.StallTimeout < 0 {
+		return fmt.Errorf("daemon.stall_timeout must not be negative")
+	}
+	return nil
+}
+
+func (c DaemonConfig) stallTimeout() time.Duration {
+	if c.StallTimeout > 0 {
+		return time.Duration(c.StallTimeout)
+	}
+	return defaultStallTimeout
+}
+
+func (c DaemonConfig) serviceName() string {
+	if c.ServiceName != "" {
+		return c.ServiceName
+	}
+	return defaultServiceName
+}
+
+// lifecycleNotifier tells the service manager about state changes
+type lifecycleNotifier interface {
+	Notify(state string) error
+}
+
+// lifecyclePhase orders the notifications: ready at most once, and nothing
+// but stopping after it
+type lifecyclePhase int
+
+const (
+	phaseStarting lifecyclePhase = iota
+	phaseReady
+	phaseStopping
+)
+
+// lifecycle reports the service state to systemd. A nil *lifecycle does
+// nothing.
+type lifecycle struct {
+	notifier lifecycleNotifier
+	// watchdog is the interval systemd expects pings in, 0 when disabled
+	watchdog time.Duration
+	logger   *logrus.Logger
+
+	mu    sync.Mutex
+	phase lifecyclePhase
+}
+
+// ready sends READY=1, once
+func (l *lifecycle) ready() {
+	l.transition(phaseReady, sdReady)
+}
+
+// stopping sends STOPPING=1 when the drain begins
+func (l *lifecycle) stopping() {
+	l.transition(phaseStopping, sdStopping)
+}
+
+func (l *lifecycle) transition(to lifecyclePhase, state string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.phase >= to {
+		return
+	}
+	l.phase = to
+	l.notify(state)
+}
+
+// ping sends WATCHDOG=1 while the service is ready
+func (l *lifecycle) ping() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.phase == phaseReady {
+		l.notify(sdWatchdog)
+	}
+}
+
+// watchdogInterval is how often to ping, half the interval systemd expects
+func (l *lifecycle) watchdogInterval() time.Duration {
+	if l == nil {
+		return 0
+	}
+	return l.watchdog / 2
+}
+
+// notify sends a state. Callers hold mu.
+func (l *lifecycle) notify(state string) {
+	if err := l.notifier.Notify(state); err != nil {
+		l.logger.WithField("state", state).WithError(err).Warn("Failed to notify service manager")
+	}
+}
+
+// newLifecycle connects to systemd when enabled and started by it
+func newLifecycle(config DaemonConfig, logger *logrus.Logger) *lifecycle {
+	if !config.SystemdNotify {
+		return nil
+	}
+	notifier, watchdog, err := newSystemdNotifier()
+	if err != nil {
+		logger.WithError(err).Warn("Systemd notifications disabled")
+		return nil
+	}
+	if notifier == nil {
+		logger.Info("Not started by systemd, notifications disabled")
+		return nil
+	}
+	return &lifecycle{notifier: notifier, watchdog: watchdog, logger: logger}
+}
+
+// cycleWatch tracks the ingestion cycles that are running, so the watchdog
+// can tell a hung loop from a slow upstream
+type cycleWatch struct {
+	mu      sync.Mutex
+	running map[string]time.Time
+}
+
+func newCycleWatch() *cycleWatch {
+	return &cycleWatch{running: make(map[string]time.Time)}
+}
+
+// begin records that a location's cycle started and returns the function
+// that records its end
+func (w *cycleWatch) begin(location string, now time.Time) func() {
+	w.mu.Lock()
+	w.running[location] = now
+	w.mu.Unlock()
+	return func() {
+		w.mu.Lock()
+		delete(w.running, location)
+		w.mu.Unlock()
+	}
+}
+
+// busy reports whether any ingestion cycle is running
+func (w *cycleWatch) busy() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.running) > 0
+}
+
+// stalled returns a location whose cycle has been running longer than limit
+func (w *cycleWatch) stalled(now time.Time, limit time.Duration) (string, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for location, started := range w.running {
+		if now.Sub(started) > limit {
+			return location, true
+		}
+	}
+	return "", false
+}
+
+// announceReady sends READY=1 once the HTTP server is serving and, with
+// wait_for_broker, the broker connection is ready
+func (di *DataIngestor) announceReady(ctx context.Context) {
+	if di.config.Daemon.WaitForBroker {
+		ticker := time.NewTicker(brokerReadyPollInterval)
+		defer ticker.Stop()
+		for di.ConnectionState() != StateReady {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+	di.lifecycle.ready()
+}
+
+// runWatchdog pings systemd until ctx is cancelled, except while an
+// ingestion cycle is stalled
+func (di *DataIngestor) runWatchdog(ctx context.Context) {
+	ticker := time.NewTicker(di.lifecycle.watchdogInterval())
+	defer ticker.Stop()
+	limit := di.config.Daemon.stallTimeout()
+	wasStalled := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			location, stalled := di.cycles.stalled(now, limit)
+			if stalled && !wasStalled {
+				di.logger.WithFields(logrus.Fields{
+					"location":      location,
+					"stall_timeout": limit.String(),
+				}).Error("Ingestion cycle stalled, withholding watchdog pings")
+			}
+			wasStalled = stalled
+			if !stalled {
+				di.lifecycle.ping()
+			}
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNotifier records the states sent to the service manager
+type fakeNotifier struct {
+	mu     sync.Mutex
+	states []string
+}
+
+func (n *fakeNotifier) Notify(state string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.states = append(n.states, state)
+	return nil
+}
+
+func (n *fakeNotifier) sent() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return append([]string(nil), n.states...)
+}
+
+func (n *fakeNotifier) count(state string) int {
+	count := 0
+	for _, sent := range n.sent() {
+		if sent == state {
+			count++
+		}
+	}
+	return count
+}
+
+func withLifecycle(di *DataIngestor, watchdog time.Duration) *fakeNotifier {
+	notifier := &fakeNotifier{}
+	di.lifecycle = &lifecycle{notifier: notifier, watchdog: watchdog, logger: di.logger}
+	return notifier
+}
+
+func TestLifecycle_Transitions(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	notifier := &fakeNotifier{}
+	l := &lifecycle{notifier: notifier, logger: logger}
+
+	l.ping()
+	l.ready()
+	l.ready()
+	l.ping()
+	l.stopping()
+	l.ping()
+	l.ready()
+	l.stopping()
+	assert.Equal(t, []string{sdReady, sdWatchdog, sdStopping}, notifier.sent())
+
+	// Stopping before ready is still reported
+	notifier = &fakeNotifier{}
+	l = &lifecycle{notifier: notifier, logger: logger}
+	l.stopping()
+	l.ready()
+	assert.Equal(t, []string{sdStopping}, notifier.sent())
+
+	var disabled *lifecycle
+	assert.NotPanics(t, func() {
+		disabled.ready()
+		disabled.ping()
+		disabled.stopping()
+	})
+	assert.Zero(t, disabled.watchdogInterval())
+}
+
+func TestRun_NotifiesSystemd(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	notifier := withLifecycle(ingestor, 20*time.Millisecond)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ingestor.Run(ctx, listener) }()
+
+	require.Eventually(t, func() bool { return notifier.count(sdWatchdog) >= 2 }, time.Second, 5*time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+
+	sent := notifier.sent()
+	assert.Equal(t, sdReady, sent[0])
+	assert.Equal(t, sdStopping, sent[len(sent)-1])
+	assert.Equal(t, 1, notifier.count(sdReady))
+}
+
+func TestAnnounceReady_WaitsForBroker(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.Close()
+	ingestor.config.Daemon.WaitForBroker = true
+	notifier := withLifecycle(ingestor, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ingestor.announceReady(ctx)
+
+	time.Sleep(3 * brokerReadyPollInterval)
+	assert.Empty(t, notifier.sent(), "not ready without a broker")
+
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	require.Eventually(t, func() bool { return notifier.count(sdReady) == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestWatchdog_WithheldWhileStalled(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.config.Daemon.StallTimeout = Duration(time.Minute)
+	notifier := withLifecycle(ingestor, 10*time.Millisecond)
+	ingestor.lifecycle.ready()
+
+	done := ingestor.cycles.begin("berlin", time.Now().Add(-2*time.Minute))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ingestor.runWatchdog(ctx)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, notifier.count(sdWatchdog), "a stalled cycle stops the pings")
+
+	done()
+	require.Eventually(t, func() bool { return notifier.count(sdWatchdog) > 0 }, time.Second, 5*time.Millisecond)
+}
+
+func TestCycleWatch(t *testing.T) {
+	w := newCycleWatch()
+	now := time.Now()
+	_, stalled := w.stalled(now, time.Minute)
+	assert.False(t, stalled)
+
+	doneBerlin := w.begin("berlin", now.Add(-2*time.Minute))
+	doneMoscow := w.begin("moscow", now)
+	location, stalled := w.stalled(now, time.Minute)
+	assert.True(t, stalled)
+	assert.Equal(t, "berlin", location)
+
+	doneBerlin()
+	_, stalled = w.stalled(now, time.Minute)
+	assert.False(t, stalled, "a slow cycle is not stalled until the limit")
+	doneMoscow()
+}
+
+func TestServeControls(t *testing.T) {
+	controls := make(chan serviceControl)
+	var states []serviceState
+	var mu sync.Mutex
+	status := func(state serviceState) {
+		mu.Lock()
+		defer mu.Unlock()
+		states = append(states, state)
+	}
+	drained := make(chan struct{})
+	run := func(ctx context.Context) error {
+		<-ctx.Done()
+		close(drained)
+		return nil
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- serveControls(controls, status, run) }()
+
+	controls <- controlInterrogate
+	controls <- controlStop
+	<-drained
+	require.NoError(t, <-result)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []serviceState{serviceStartPending, serviceRunning, serviceRunning, serviceStopPending, serviceStopped}, states)
+}
+
+func TestServeControls_ShutdownAndFailures(t *testing.T) {
+	controls := make(chan serviceControl, 2)
+	controls <- controlShutdown
+	controls <- controlStop
+	var states []serviceState
+	err := serveControls(controls, func(state serviceState) { states = append(states, state) }, func(ctx context.Context) error {
+		<-ctx.Done()
+		// Give the second request time to arrive while draining
+		time.Sleep(10 * time.Millisecond)
+		return errors.New("broker close failed")
+	})
+	assert.EqualError(t, err, "broker close failed")
+	assert.Equal(t, []serviceState{serviceStartPending, serviceRunning, serviceStopPending, serviceStopped}, states)
+
+	// A run that ends on its own, e.g. after POST /admin/shutdown
+	states = nil
+	err = serveControls(make(chan serviceControl), func(state serviceState) { states = append(states, state) }, func(ctx context.Context) error {
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []serviceState{serviceStartPending, serviceRunning, serviceStopped}, states)
+}
+
+func TestDaemonConfig_Defaults(t *testing.T) {
+	assert.Equal(t, defaultStallTimeout, DaemonConfig{}.stallTimeout())
+	assert.Equal(t, "data-ingestor", DaemonConfig{}.serviceName())
+	assert.Error(t, DaemonConfig{StallTimeout: Duration(-time.Second)}.Validate())
+
+	logger, _ := test.NewNullLogger()
+	assert.Nil(t, newLifecycle(DaemonConfig{}, logger), "off unless enabled")
+}
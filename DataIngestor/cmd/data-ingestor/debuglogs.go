@@ -0,0 +1,306 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultLogRingSize = 1000
+	// logTailClientBuffer is how many entries a /debug/logs client may fall
+	// behind before it is dropped
+	logTailClientBuffer = 256
+)
+
+// DebugConfig enables the debugging endpoints under /debug, which require
+// the admin token
+type DebugConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// LogRingSize is the number of recent log entries GET /debug/logs
+	// starts with
+	LogRingSize int `yaml:"log_ring_size"`
+	// RecordResponses saves every upstream response as a fixture in this
+	// directory; ReplayResponses serves the fixtures of a directory instead
+	// of calling the upstream. Neither needs Enabled.
+	RecordResponses string `yaml:"record_responses"`
+	ReplayResponses string `yaml:"replay_responses"`
+	// ReplayTiming waits the recorded duration before every replayed response
+	ReplayTiming bool `yaml:"replay_timing"`
+	// AllowFaults lets release builds inject faults through /debug/faults;
+	// development builds allow them whenever Enabled is set
+	AllowFaults bool `yaml:"allow_faults"`
+	// Trace records what every cycle did under its correlation id, for
+	// GET /debug/trace/{correlation_id}; TraceExcerpt keeps the start of the
+	// upstream response with it, nothing by default
+	Trace        bool     `yaml:"trace"`
+	TraceExcerpt ByteSize `yaml:"trace_excerpt"`
+	// TraceMaxBytes bounds the excerpts of all traces kept together, 8MiB
+	// by default; the oldest traces lose theirs first
+	TraceMaxBytes ByteSize `yaml:"trace_max_bytes"`
+	// CaptureDir receives what is captured for a post-mortem, such as the
+	// goroutine profiles of the resource guard. It does not need Enabled.
+	CaptureDir string `yaml:"capture_dir"`
+}
+
+// Validate checks the ring size and that responses are either recorded or
+// replayed
+func (c DebugConfig) Validate() error {
+	if c.LogRingSize < 0 {
+		return fmt.Errorf("debug.log_ring_size must not be negative")
+	}
+	if c.RecordResponses != "" && c.ReplayResponses != "" {
+		return fmt.Errorf("debug.record_responses and debug.replay_responses cannot both be set")
+	}
+	if c.TraceExcerpt < 0 || c.TraceExcerpt > maxTraceExcerpt {
+		return fmt.Errorf("debug.trace_excerpt must be between 0 and %d bytes", maxTraceExcerpt)
+	}
+	if c.TraceMaxBytes < 0 {
+		return fmt.Errorf("debug.trace_max_bytes must not be negative")
+	}
+	return nil
+}
+
+func (c DebugConfig) traceMaxBytes() int {
+	if c.TraceMaxBytes > 0 {
+		return int(c.TraceMaxBytes)
+	}
+	return defaultTraceMaxBytes
+}
+
+// logLine is one formatted log entry with what the filters look at
+type logLine struct {
+	level   logrus.Level
+	message string
+	fields  logrus.Fields
+	json    []byte
+}
+
+// logFilter selects the entries a /debug/logs client receives
+type logFilter struct {
+	level    logrus.Level
+	contains string
+	fields   map[string]string
+}
+
+func (f logFilter) matches(line logLine) bool {
+	if line.level > f.level {
+		return false
+	}
+	for key, want := range f.fields {
+		value, ok := line.fields[key]
+		if !ok || fmt.Sprint(value) != want {
+			return false
+		}
+	}
+	if f.contains == "" || strings.Contains(line.message, f.contains) {
+		return true
+	}
+	for _, value := range line.fields {
+		if strings.Contains(fmt.Sprint(value), f.contains) {
+			return true
+		}
+	}
+	return false
+}
+
+// logTailClient is one connected /debug/logs client. The tail closes lines
+// when the client is unsubscribed or dropped.
+type logTailClient struct {
+	filter  logFilter
+	lines   chan []byte
+	dropped bool
+}
+
+// logTail is a logrus hook keeping a ring buffer of recent entries and
+// fanning new ones out to /debug/logs clients. Firing never blocks logging:
+// a client whose buffer is full is dropped.
+type logTail struct {
+	formatter logrus.Formatter
+
+	mu      sync.Mutex
+	ring    []logLine
+	next    int
+	full    bool
+	clients map[*logTailClient]struct{}
+	closed  bool
+}
+
+func newLogTail(size int) *logTail {
+	if size <= 0 {
+		size = defaultLogRingSize
+	}
+	return &logTail{
+		formatter: &logrus.JSONFormatter{},
+		ring:      make([]logLine, size),
+		clients:   make(map[*logTailClient]struct{}),
+	}
+}
+
+func (t *logTail) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (t *logTail) Fire(entry *logrus.Entry) error {
+	body, err := t.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	fields := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		fields[key] = value
+	}
+	line := logLine{level: entry.Level, message: entry.Message, fields: fields, json: body}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ring[t.next] = line
+	t.next = (t.next + 1) % len(t.ring)
+	if t.next == 0 {
+		t.full = true
+	}
+	for client := range t.clients {
+		if !client.filter.matches(line) {
+			continue
+		}
+		select {
+		case client.lines <- line.json:
+		default:
+			client.dropped = true
+			t.remove(client)
+		}
+	}
+	return nil
+}
+
+// subscribe registers a client and returns the buffered entries matching
+// its filter, oldest first
+func (t *logTail) subscribe(filter logFilter) (*logTailClient, [][]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return nil, nil, errStreamClosed
+	}
+
+	buffered := t.ring[:t.next]
+	if t.full {
+		buffered = append(append([]logLine{}, t.ring[t.next:]...), t.ring[:t.next]...)
+	}
+	var backlog [][]byte
+	for _, line := range buffered {
+		if filter.matches(line) {
+			backlog = append(backlog, line.json)
+		}
+	}
+
+	client := &logTailClient{filter: filter, lines: make(chan []byte, logTailClientBuffer)}
+	t.clients[client] = struct{}{}
+	return client, backlog, nil
+}
+
+func (t *logTail) unsubscribe(client *logTailClient) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.remove(client)
+}
+
+func (t *logTail) remove(client *logTailClient) {
+	if _, ok := t.clients[client]; !ok {
+		return
+	}
+	delete(t.clients, client)
+	close(client.lines)
+}
+
+// Close disconnects every client and rejects new ones
+func (t *logTail) Close() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.closed = true
+	for client := range t.clients {
+		t.remove(client)
+	}
+}
+
+// parseLogFilter reads ?level=, ?contains= and repeated ?field=key=value
+func parseLogFilter(c *gin.Context) (logFilter, error) {
+	filter := logFilter{level: logrus.TraceLevel, contains: c.Query("contains")}
+	if level := c.Query("level"); level != "" {
+		parsed, err := logrus.ParseLevel(level)
+		if err != nil {
+			return filter, err
+		}
+		filter.level = parsed
+	}
+	for _, field := range c.QueryArray("field") {
+		key, value, ok := strings.Cut(field, "=")
+		if !ok || key == "" {
+			return filter, fmt.Errorf("field filter %q must look like key=value", field)
+		}
+		if filter.fields == nil {
+			filter.fields = map[string]string{}
+		}
+		filter.fields[key] = value
+	}
+	return filter, nil
+}
+
+// handleDebugLogs streams the buffered and then the live log entries as
+// NDJSON, GET /debug/logs?level=&contains=&field=key=value
+func (di *DataIngestor) handleDebugLogs(c *gin.Context) {
+	filter, err := parseLogFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if di.resources.rejects(resourceActionRejectStreams) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": errResourceGuard.Error(),
+		})
+		return
+	}
+	client, backlog, err := di.logTail.subscribe(filter)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	defer di.logTail.unsubscribe(client)
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	for _, line := range backlog {
+		w.Write(line)
+	}
+	w.Flush()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case line, ok := <-client.lines:
+			if !ok {
+				if client.dropped {
+					fmt.Fprintf(w, "{\"error\":%q}\n", "client fell behind and was dropped, reconnect to resume")
+					w.Flush()
+				}
+				return
+			}
+			w.Write(line)
+			w.Flush()
+		}
+	}
+}
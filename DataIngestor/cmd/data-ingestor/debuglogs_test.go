@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDebugTestIngestor(t *testing.T, ringSize int) (*DataIngestor, *httptest.Server) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Logging:  LoggingConfig{Level: "debug"},
+		Debug:    DebugConfig{Enabled: true, LogRingSize: ringSize},
+	})
+	ingestor.logger.SetOutput(io.Discard)
+	server := httptest.NewServer(setupRoutes(ingestor))
+	t.Cleanup(server.Close)
+	return ingestor, server
+}
+
+// tailLogs connects to /debug/logs and returns the decoded entries as they
+// arrive
+func tailLogs(t *testing.T, server *httptest.Server, query string) <-chan map[string]interface{} {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/debug/logs"+query, nil)
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer letmein")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	entries := make(chan map[string]interface{}, 100)
+	go func() {
+		defer close(entries)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			var entry map[string]interface{}
+			if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+				entries <- entry
+			}
+		}
+	}()
+	return entries
+}
+
+func nextEntry(t *testing.T, entries <-chan map[string]interface{}) map[string]interface{} {
+	t.Helper()
+	select {
+	case entry := <-entries:
+		return entry
+	case <-time.After(2 * time.Second):
+		t.Fatal("no log entry received")
+		return nil
+	}
+}
+
+// waitClients waits until n clients are attached to the tail
+func waitClients(t *testing.T, tail *logTail, n int) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		tail.mu.Lock()
+		defer tail.mu.Unlock()
+		return len(tail.clients) == n
+	}, 2*time.Second, 5*time.Millisecond)
+}
+
+func TestDebugLogs_RecentThenLive(t *testing.T) {
+	ingestor, server := newDebugTestIngestor(t, 0)
+	ingestor.logger.WithField("location", "moscow").Info("Fetched before connecting")
+
+	entries := tailLogs(t, server, "")
+	entry := nextEntry(t, entries)
+	assert.Equal(t, "Fetched before connecting", entry["msg"])
+	assert.Equal(t, "moscow", entry["location"])
+	assert.Equal(t, "info", entry["level"])
+	assert.Equal(t, ingestor.instanceID, entry["instance_id"])
+
+	waitClients(t, ingestor.logTail, 1)
+	ingestor.logger.Warn("Live entry")
+	assert.Equal(t, "Live entry", nextEntry(t, entries)["msg"])
+}
+
+func TestDebugLogs_Filters(t *testing.T) {
+	ingestor, server := newDebugTestIngestor(t, 0)
+	ingestor.logger.WithField("location", "moscow").Debug("Skipping ingestion cycle")
+
+	levelOnly := tailLogs(t, server, "?level=warning")
+	byField := tailLogs(t, server, "?field=location=berlin")
+	byText := tailLogs(t, server, "?contains=timeout&level=info")
+	waitClients(t, ingestor.logTail, 3)
+
+	ingestor.logger.WithField("location", "moscow").Info("Data published to queue")
+	ingestor.logger.WithField("location", "berlin").WithError(fmt.Errorf("upstream timeout")).Error("Failed to fetch data")
+	ingestor.logger.WithField("location", "berlin").Debug("Upstream timeout adjusted")
+
+	assert.Equal(t, "Failed to fetch data", nextEntry(t, levelOnly)["msg"])
+
+	assert.Equal(t, "Failed to fetch data", nextEntry(t, byField)["msg"])
+	assert.Equal(t, "Upstream timeout adjusted", nextEntry(t, byField)["msg"])
+
+	// Matches the error field, but not the debug entry below the level
+	entry := nextEntry(t, byText)
+	assert.Equal(t, "Failed to fetch data", entry["msg"])
+	assert.Equal(t, "upstream timeout", entry["error"])
+
+	select {
+	case entry := <-levelOnly:
+		t.Fatalf("unexpected entry %v", entry)
+	case entry := <-byText:
+		t.Fatalf("unexpected entry %v", entry)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDebugLogs_DropsSlowReaders(t *testing.T) {
+	ingestor, _ := newDebugTestIngestor(t, 10)
+	client, _, err := ingestor.logTail.subscribe(logFilter{level: logrus.TraceLevel})
+	require.NoError(t, err)
+
+	// Nobody reads the client; logging must go on regardless
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < logTailClientBuffer*2; i++ {
+			ingestor.logger.Infof("entry %d", i)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("logging blocked on a slow /debug/logs client")
+	}
+
+	received := 0
+	for range client.lines {
+		received++
+	}
+	assert.Equal(t, logTailClientBuffer, received, "the buffered entries, then the channel is closed")
+	assert.True(t, client.dropped)
+	waitClients(t, ingestor.logTail, 0)
+}
+
+func TestDebugLogs_RingSize(t *testing.T) {
+	ingestor, _ := newDebugTestIngestor(t, 3)
+	for i := 0; i < 5; i++ {
+		ingestor.logger.Infof("entry %d", i)
+	}
+	_, backlog, err := ingestor.logTail.subscribe(logFilter{level: logrus.TraceLevel})
+	require.NoError(t, err)
+	require.Len(t, backlog, 3)
+	for i, line := range backlog {
+		var entry map[string]interface{}
+		require.NoError(t, json.Unmarshal(line, &entry))
+		assert.Equal(t, fmt.Sprintf("entry %d", i+2), entry["msg"])
+	}
+}
+
+func TestDebugLogs_RequiresFlagAndToken(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	assert.Nil(t, ingestor.logTail)
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/logs", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	_, server := newDebugTestIngestor(t, 0)
+	resp, err := http.Get(server.URL + "/debug/logs")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+}
+
+func TestDebugLogs_BadFilters(t *testing.T) {
+	ingestor, _ := newDebugTestIngestor(t, 0)
+	router := setupRoutes(ingestor)
+	for _, query := range []string{"?level=loud", "?field=location", "?field==moscow"} {
+		req := httptest.NewRequest(http.MethodGet, "/debug/logs"+query, nil)
+		req.Header.Set("Authorization", "Bearer letmein")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+	}
+}
+
+func TestDebugLogs_CloseDisconnects(t *testing.T) {
+	ingestor, server := newDebugTestIngestor(t, 0)
+	entries := tailLogs(t, server, "")
+	waitClients(t, ingestor.logTail, 1)
+
+	ingestor.logTail.Close()
+	select {
+	case _, ok := <-entries:
+		assert.False(t, ok, "the response ends")
+	case <-time.After(2 * time.Second):
+		t.Fatal("client still connected")
+	}
+	_, _, err := ingestor.logTail.subscribe(logFilter{})
+	assert.ErrorIs(t, err, errStreamClosed)
+}
+
+func TestDebugConfig_Validate(t *testing.T) {
+	assert.NoError(t, DebugConfig{}.Validate())
+	assert.EqualError(t, DebugConfig{LogRingSize: -1}.Validate(), "debug.log_ring_size must not be negative")
+}
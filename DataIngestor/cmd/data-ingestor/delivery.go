@@ -0,0 +1,523 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Sinks a delivery policy applies to, next to sinkAMQP and sinkPubSub
+const (
+	sinkFile     = "file"
+	sinkWebhooks = "webhooks"
+)
+
+// deliverySinks are the sinks readings are delivered to, in delivery order
+var deliverySinks = []string{sinkAMQP, sinkPubSub, sinkFile, sinkWebhooks}
+
+// Delivery policies of a sink
+const (
+	// deliveryRequired sinks must take every reading, or the cycle fails and
+	// is retried
+	deliveryRequired = "required"
+	// deliveryQuorum sinks count towards delivery.quorum
+	deliveryQuorum = "quorum"
+	// deliveryBestEffort sinks are tried once; what they miss is logged and
+	// counted but never retried
+	deliveryBestEffort = "best_effort"
+)
+
+// defaultDeliveryPolicies keep RabbitMQ and Pub/Sub required and the archive
+// and subscribers best effort
+var defaultDeliveryPolicies = map[string]string{
+	sinkAMQP:     deliveryRequired,
+	sinkPubSub:   deliveryRequired,
+	sinkFile:     deliveryBestEffort,
+	sinkWebhooks: deliveryBestEffort,
+}
+
+// Delivery outcomes of a reading
+const (
+	readingDelivered = "delivered"
+	// readingPartial is a reading the policy was satisfied with that some
+	// best-effort or quorum sink missed
+	readingPartial = "partial"
+	readingFailed  = "failed"
+)
+
+// ErrDeliveryQuorum is returned when fewer quorum sinks than delivery.quorum
+// took a reading
+var ErrDeliveryQuorum = errors.New("delivery quorum not met")
+
+// DeliveryConfig declares what a reading has to reach to count as ingested
+type DeliveryConfig struct {
+	// Sinks maps amqp, pubsub, file and webhooks to required, quorum or
+	// best_effort. Sinks left out keep their default policy.
+	Sinks map[string]string `yaml:"sinks"`
+	// Quorum is how many of the quorum sinks must take every reading
+	Quorum int `yaml:"quorum"`
+}
+
+// Validate checks the sinks and policies, and that enough of the quorum
+// sinks are configured to reach the quorum
+func (c DeliveryConfig) Validate(enabled map[string]bool) error {
+	quorumSinks := 0
+	for sink, policy := range c.Sinks {
+		if _, ok := defaultDeliveryPolicies[sink]; !ok {
+			return fmt.Errorf("delivery.sinks: unknown sink %q", sink)
+		}
+		switch policy {
+		case deliveryRequired, deliveryQuorum, deliveryBestEffort:
+		default:
+			return fmt.Errorf("delivery.sinks.%s must be required, quorum or best_effort, got %q", sink, policy)
+		}
+		if !enabled[sink] {
+			return fmt.Errorf("delivery.sinks.%s: the %s sink is not configured", sink, sink)
+		}
+		if policy == deliveryQuorum {
+			quorumSinks++
+		}
+	}
+	switch {
+	case c.Quorum < 0:
+		return fmt.Errorf("delivery.quorum cannot be negative")
+	case quorumSinks > 0 && c.Quorum == 0:
+		return fmt.Errorf("delivery.quorum is required with quorum sinks")
+	case c.Quorum > quorumSinks:
+		return fmt.Errorf("delivery.quorum is %d but only %d sinks have the quorum policy", c.Quorum, quorumSinks)
+	}
+	return nil
+}
+
+// policy returns the delivery policy of a sink
+func (c DeliveryConfig) policy(sink string) string {
+	if policy, ok := c.Sinks[sink]; ok {
+		return policy
+	}
+	return defaultDeliveryPolicies[sink]
+}
+
+// enabledSinks returns the sinks the config delivers to
+func (c *Config) enabledSinks() map[string]bool {
+	return map[string]bool{
+		sinkAMQP:     true,
+		sinkPubSub:   c.PubSub.Topic != "",
+		sinkFile:     c.FileSink.Dir != "",
+		sinkWebhooks: len(c.Subscribers) > 0,
+	}
+}
+
+// sinkResult is what one sink took of the readings of a cycle
+type sinkResult struct {
+	sink   string
+	policy string
+	// took is set for every reading the sink accepted
+	took []bool
+	err  error
+}
+
+// taken returns a took slice of n readings, all set to ok
+func taken(n int, ok bool) []bool {
+	took := make([]bool, n)
+	for i := range took {
+		took[i] = ok
+	}
+	return took
+}
+
+// evaluate derives the outcome of each of n readings from what the sinks
+// took. A reading fails when a required sink missed it or fewer quorum sinks
+// than the quorum took it, and is partial when it did not fail but some sink
+// missed it.
+func (c DeliveryConfig) evaluate(n int, results []sinkResult) []string {
+	outcomes := make([]string, n)
+	for i := range outcomes {
+		failed, missed := false, false
+		quorumSinks, quorum := 0, 0
+		for _, result := range results {
+			took := result.took[i]
+			switch result.policy {
+			case deliveryRequired:
+				failed = failed || !took
+			case deliveryQuorum:
+				quorumSinks++
+				if took {
+					quorum++
+				}
+			}
+			missed = missed || !took
+		}
+		switch {
+		case failed, quorumSinks > 0 && quorum < c.Quorum:
+			outcomes[i] = readingFailed
+		case missed:
+			outcomes[i] = readingPartial
+		default:
+			outcomes[i] = readingDelivered
+		}
+	}
+	return outcomes
+}
+
+// DeliveryResult is how the readings of one location cycle were delivered
+type DeliveryResult struct {
+	Delivered int `json:"delivered"`
+	Partial   int `json:"partial"`
+	Failed    int `json:"failed"`
+	// PartialReadings names the readings some sink missed
+	PartialReadings []string       `json:"partial_readings,omitempty"`
+	Sinks           []SinkDelivery `json:"sinks"`
+}
+
+// SinkDelivery is what one sink took of a cycle. Best-effort sinks are not
+// tried when the required and quorum sinks already failed the cycle.
+type SinkDelivery struct {
+	Sink   string `json:"sink"`
+	Policy string `json:"policy"`
+	// Readings is the number of readings the sink took
+	Readings int    `json:"readings"`
+	Error    string `json:"error,omitempty"`
+}
+
+// delivery is the delivery of the readings of one location cycle in progress
+type delivery struct {
+	policy     DeliveryConfig
+	data       WeatherData
+	results    []sinkResult
+	outcomes   []string
+	messageIDs []string
+	// progress is what the sinks took in the failed deliveries this one
+	// retries; keys identify the readings in it
+	progress *sinkProgress
+	keys     []string
+}
+
+// deliver hands the fetched readings to the required sinks, then to the
+// quorum sinks and, once the required sinks took them, to the best-effort
+// sinks. RabbitMQ takes them last, so its messages carry the
+// partial_delivery factor of the readings another sink missed. It fails, so
+// the cycle is retried, when a reading failed the policy; a failed required
+// sink leaves the others for the retry. Readings a sink took in a failed
+// delivery of progress are not handed to it again.
+func (di *DataIngestor) deliver(ctx context.Context, fetched *fetchResult, env Envelope, progress *sinkProgress) (*delivery, error) {
+	d := &delivery{policy: di.config.Delivery, data: *fetched.Data, progress: progress}
+	defer di.recordDelivery(ctx, d)
+
+	di.deliverTo(ctx, d, deliveryRequired, fetched, env)
+	requiredErr := d.requiredErr()
+	if requiredErr == nil {
+		di.deliverTo(ctx, d, deliveryQuorum, fetched, env)
+		di.deliverTo(ctx, d, deliveryBestEffort, fetched, env)
+	}
+	if requiredErr == nil || d.policy.policy(sinkAMQP) == deliveryRequired {
+		di.flagPartial(d)
+		di.deliverSink(ctx, d, amqpSink{di}, fetched, env)
+	}
+	d.sortResults()
+
+	d.outcomes = d.policy.evaluate(len(d.data), d.results)
+	if err := d.requiredErr(); err != nil {
+		return d, err
+	}
+	return d, d.quorumErr()
+}
+
+// deliverTo hands the readings to the configured sinks with policy but
+// RabbitMQ, which deliver publishes to last
+func (di *DataIngestor) deliverTo(ctx context.Context, d *delivery, policy string, fetched *fetchResult, env Envelope) {
+	for _, sink := range di.sinks() {
+		if sink.Name() != sinkAMQP && d.policy.policy(sink.Name()) == policy {
+			di.deliverSink(ctx, d, sink, fetched, env)
+		}
+	}
+}
+
+// deliverSink hands the readings sink has not taken yet to it
+func (di *DataIngestor) deliverSink(ctx context.Context, d *delivery, sink Sink, fetched *fetchResult, env Envelope) {
+	name := sink.Name()
+	result := sinkResult{sink: name, policy: d.policy.policy(name), took: make([]bool, len(d.data))}
+	batch := &sinkBatch{fetched: fetched, env: env}
+	missing := d.missing(di, name, result.took)
+	if len(missing) == len(d.data) {
+		batch.data = d.data
+	} else {
+		for _, i := range missing {
+			batch.data = append(batch.data, d.data[i])
+		}
+	}
+	if len(batch.data) > 0 {
+		took, err := sink.Deliver(ctx, batch)
+		for j, i := range missing {
+			result.took[i] = took[j]
+		}
+		result.err = err
+	}
+	if name == sinkAMQP {
+		d.messageIDs = batch.messageIDs
+	}
+	d.results = append(d.results, result)
+}
+
+// sortResults orders the results by policy, required first, and by sink
+// within a policy, as the sinks would take the readings without RabbitMQ
+// going last
+func (d *delivery) sortResults() {
+	rank := map[string]int{deliveryRequired: 0, deliveryQuorum: 1, deliveryBestEffort: 2}
+	order := make(map[string]int, len(deliverySinks))
+	for i, sink := range deliverySinks {
+		order[sink] = i
+	}
+	sort.SliceStable(d.results, func(i, j int) bool {
+		a, b := d.results[i], d.results[j]
+		if rank[a.policy] != rank[b.policy] {
+			return rank[a.policy] < rank[b.policy]
+		}
+		return order[a.sink] < order[b.sink]
+	})
+}
+
+// requiredErr returns the error of the first required sink that failed
+func (d *delivery) requiredErr() error {
+	for _, result := range d.results {
+		if result.policy == deliveryRequired && result.err != nil {
+			return result.err
+		}
+	}
+	return nil
+}
+
+// flagPartial gives the readings a sink missed so far the partial_delivery
+// factor, with quality enabled
+func (di *DataIngestor) flagPartial(d *delivery) {
+	for i := range d.data {
+		for _, result := range d.results {
+			if !result.took[i] {
+				d.flag(di, i)
+				break
+			}
+		}
+	}
+}
+
+// flag gives reading i the partial_delivery factor once
+func (d *delivery) flag(di *DataIngestor, i int) {
+	quality := d.data[i].Quality
+	if quality == nil || quality.Factors[qualityPartialDelivery] > 0 {
+		return
+	}
+	flagged := quality.with(qualityPartialDelivery, di.config.Quality.weight(qualityPartialDelivery))
+	d.data[i].Quality = &flagged
+}
+
+// missing returns the indexes of the readings the sink has not taken yet,
+// and sets took for the others
+func (d *delivery) missing(di *DataIngestor, sink string, took []bool) []int {
+	taken := d.progress.sinkTook(sink)
+	indexes := make([]int, 0, len(d.data))
+	for i := range d.data {
+		if len(taken) > 0 && taken[d.key(di, i)] {
+			took[i] = true
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	return indexes
+}
+
+// key identifies reading i across refetches, by the key reading dedup
+// claims it under
+func (d *delivery) key(di *DataIngestor, i int) string {
+	if d.keys == nil {
+		d.keys = make([]string, len(d.data))
+		for j, sensor := range d.data {
+			d.keys[j] = di.deliveryKey(sensor)
+		}
+	}
+	return d.keys[i]
+}
+
+// deliveryKey identifies a reading for sinkProgress: by its dedup key, so
+// the claims can be matched, or by its hash without reading dedup
+func (di *DataIngestor) deliveryKey(sensor SensorData) string {
+	key := readingHash
+	if di.dedup != nil {
+		key = di.dedup.key
+	}
+	hash, err := key(sensor)
+	if err != nil {
+		// Never matched, so the reading goes to every sink again
+		return ""
+	}
+	return hash
+}
+
+// sinkProgress is what the sinks took of a location's readings in a
+// delivery that failed, so its retry hands each reading only to the sinks
+// that missed it
+type sinkProgress struct {
+	// took holds the keys of the readings each sink took
+	took map[string]map[string]bool
+	// claim holds the dedup claims of the readings some sink took. They are
+	// not released, so no other instance publishes them again.
+	claim *dedupClaim
+}
+
+func (p *sinkProgress) sinkTook(sink string) map[string]bool {
+	if p == nil {
+		return nil
+	}
+	return p.took[sink]
+}
+
+func (p *sinkProgress) heldClaim() *dedupClaim {
+	if p == nil {
+		return nil
+	}
+	return p.claim
+}
+
+// deliveryProgress keeps the sinkProgress of every location whose last
+// delivery failed, until the location delivers
+type deliveryProgress struct {
+	mu        sync.Mutex
+	locations map[string]*sinkProgress
+}
+
+// take removes and returns the progress of a location
+func (p *deliveryProgress) take(location string) *sinkProgress {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	progress := p.locations[location]
+	delete(p.locations, location)
+	return progress
+}
+
+func (p *deliveryProgress) keep(location string, progress *sinkProgress) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.locations == nil {
+		p.locations = make(map[string]*sinkProgress)
+	}
+	p.locations[location] = progress
+}
+
+// keepProgress records what the sinks took of a failed delivery d, which
+// is nil when the readings never reached the sinks, on top of the progress
+// it retried. It returns the claims of the readings no sink took, for the
+// caller to release.
+func (di *DataIngestor) keepProgress(location string, progress *sinkProgress, d *delivery, claim *dedupClaim) *dedupClaim {
+	kept := &sinkProgress{took: make(map[string]map[string]bool)}
+	if progress != nil {
+		for sink, keys := range progress.took {
+			kept.took[sink] = keys
+		}
+	}
+	if d != nil {
+		for _, result := range d.results {
+			for i, took := range result.took {
+				key := d.key(di, i)
+				if !took || key == "" {
+					continue
+				}
+				if kept.took[result.sink] == nil {
+					kept.took[result.sink] = make(map[string]bool)
+				}
+				kept.took[result.sink][key] = true
+			}
+		}
+	}
+	taken := func(key string) bool {
+		for _, keys := range kept.took {
+			if keys[key] {
+				return true
+			}
+		}
+		return false
+	}
+	var release *dedupClaim
+	kept.claim, release = claim.split(taken)
+	if len(kept.took) > 0 {
+		di.deliveries.keep(location, kept)
+	}
+	return release
+}
+
+// quorumErr returns ErrDeliveryQuorum with the quorum sinks' errors when a
+// reading failed the policy
+func (d *delivery) quorumErr() error {
+	for _, outcome := range d.outcomes {
+		if outcome != readingFailed {
+			continue
+		}
+		errs := []error{fmt.Errorf("%w: %d required", ErrDeliveryQuorum, d.policy.Quorum)}
+		for _, result := range d.results {
+			if result.policy == deliveryQuorum && result.err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", result.sink, result.err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+	return nil
+}
+
+// result summarizes the delivery for the cycle result
+func (d *delivery) result() *DeliveryResult {
+	result := &DeliveryResult{Sinks: make([]SinkDelivery, 0, len(d.results))}
+	for i, outcome := range d.outcomes {
+		switch outcome {
+		case readingDelivered:
+			result.Delivered++
+		case readingPartial:
+			result.Partial++
+			result.PartialReadings = append(result.PartialReadings, d.data[i].Name)
+		case readingFailed:
+			result.Failed++
+		}
+	}
+	for _, r := range d.results {
+		sink := SinkDelivery{Sink: r.sink, Policy: r.policy, Readings: count(r.took)}
+		if r.err != nil {
+			sink.Error = r.err.Error()
+		}
+		result.Sinks = append(result.Sinks, sink)
+	}
+	return result
+}
+
+// recordDelivery counts the outcomes and misses, flags the partially
+// delivered readings and hands the summary to the cycle result
+func (di *DataIngestor) recordDelivery(ctx context.Context, d *delivery) {
+	for i, outcome := range d.outcomes {
+		di.metrics.Deliveries.WithLabelValues(outcome).Inc()
+		if outcome == readingPartial {
+			d.flag(di, i)
+		}
+	}
+	for _, result := range d.results {
+		if missed := len(d.data) - count(result.took); missed > 0 {
+			di.metrics.SinkMisses.WithLabelValues(result.sink, result.policy).Add(float64(missed))
+			if result.policy == deliveryBestEffort {
+				di.logger.WithFields(logrus.Fields{
+					"sink":   result.sink,
+					"missed": missed,
+				}).WithError(result.err).Warn("Best-effort sink missed readings")
+			}
+		}
+	}
+	locationStatsOf(ctx).delivered(d.result())
+}
+
+// count returns the number of set flags
+func count(flags []bool) int {
+	n := 0
+	for _, flag := range flags {
+		if flag {
+			n++
+		}
+	}
+	return n
+}
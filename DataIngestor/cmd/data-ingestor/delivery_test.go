@@ -0,0 +1,366 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// took builds a took slice from pattern, x for a taken reading and . for a
+// missed one
+func took(pattern string) []bool {
+	flags := make([]bool, len(pattern))
+	for i, c := range pattern {
+		flags[i] = c == 'x'
+	}
+	return flags
+}
+
+func TestDeliveryConfig_Evaluate(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		quorum  int
+		results []sinkResult
+		want    []string
+	}{
+		{
+			name: "every sink took every reading",
+			results: []sinkResult{
+				{policy: deliveryRequired, took: took("xx")},
+				{policy: deliveryBestEffort, took: took("xx")},
+			},
+			want: []string{readingDelivered, readingDelivered},
+		},
+		{
+			name: "best effort misses make readings partial",
+			results: []sinkResult{
+				{policy: deliveryRequired, took: took("xxx")},
+				{policy: deliveryBestEffort, took: took("x..")},
+				{policy: deliveryBestEffort, took: took("xx.")},
+			},
+			want: []string{readingDelivered, readingPartial, readingPartial},
+		},
+		{
+			name: "a required miss fails only its reading",
+			results: []sinkResult{
+				{policy: deliveryRequired, took: took("x.x")},
+				{policy: deliveryRequired, took: took("xxx")},
+				{policy: deliveryBestEffort, took: took("...")},
+			},
+			want: []string{readingPartial, readingFailed, readingPartial},
+		},
+		{
+			name:   "overlapping quorum misses still meet two of three",
+			quorum: 2,
+			results: []sinkResult{
+				{policy: deliveryQuorum, took: took(".xxx")},
+				{policy: deliveryQuorum, took: took("x.xx")},
+				{policy: deliveryQuorum, took: took("xx.x")},
+			},
+			want: []string{readingPartial, readingPartial, readingPartial, readingDelivered},
+		},
+		{
+			name:   "two misses of one reading break two of three",
+			quorum: 2,
+			results: []sinkResult{
+				{policy: deliveryQuorum, took: took("..x")},
+				{policy: deliveryQuorum, took: took(".xx")},
+				{policy: deliveryQuorum, took: took("x.x")},
+			},
+			want: []string{readingFailed, readingFailed, readingDelivered},
+		},
+		{
+			name:   "a quorum of all sinks fails on any miss",
+			quorum: 2,
+			results: []sinkResult{
+				{policy: deliveryQuorum, took: took("x.")},
+				{policy: deliveryQuorum, took: took("xx")},
+			},
+			want: []string{readingDelivered, readingFailed},
+		},
+		{
+			name:   "a quorum of one needs any sink",
+			quorum: 1,
+			results: []sinkResult{
+				{policy: deliveryQuorum, took: took("x..")},
+				{policy: deliveryQuorum, took: took(".x.")},
+			},
+			want: []string{readingPartial, readingPartial, readingFailed},
+		},
+		{
+			name:   "a met quorum does not cover a required miss",
+			quorum: 1,
+			results: []sinkResult{
+				{policy: deliveryRequired, took: took(".x")},
+				{policy: deliveryQuorum, took: took("xx")},
+				{policy: deliveryQuorum, took: took("xx")},
+			},
+			want: []string{readingFailed, readingDelivered},
+		},
+		{
+			name:   "quorum sinks that did not run yet are not counted",
+			quorum: 2,
+			results: []sinkResult{
+				{policy: deliveryRequired, took: took("x.")},
+			},
+			want: []string{readingDelivered, readingFailed},
+		},
+		{
+			name: "no readings",
+			want: []string{},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			n := len(tc.want)
+			assert.Equal(t, tc.want, DeliveryConfig{Quorum: tc.quorum}.evaluate(n, tc.results))
+		})
+	}
+}
+
+func TestDeliveryConfig_Validate(t *testing.T) {
+	all := map[string]bool{sinkAMQP: true, sinkPubSub: true, sinkFile: true, sinkWebhooks: true}
+
+	assert.NoError(t, DeliveryConfig{}.Validate(map[string]bool{sinkAMQP: true}))
+	assert.NoError(t, DeliveryConfig{
+		Sinks:  map[string]string{sinkAMQP: deliveryQuorum, sinkFile: deliveryQuorum, sinkWebhooks: deliveryQuorum},
+		Quorum: 2,
+	}.Validate(all))
+
+	for _, tc := range []struct {
+		config  DeliveryConfig
+		enabled map[string]bool
+		want    string
+	}{
+		{DeliveryConfig{Sinks: map[string]string{"s3": deliveryRequired}}, all, `unknown sink "s3"`},
+		{DeliveryConfig{Sinks: map[string]string{sinkFile: "always"}}, all, "delivery.sinks.file must be required, quorum or best_effort"},
+		{DeliveryConfig{Sinks: map[string]string{sinkPubSub: deliveryRequired}}, map[string]bool{sinkAMQP: true}, "the pubsub sink is not configured"},
+		{DeliveryConfig{Sinks: map[string]string{sinkFile: deliveryQuorum}}, all, "delivery.quorum is required"},
+		{DeliveryConfig{Sinks: map[string]string{sinkFile: deliveryQuorum}, Quorum: 2}, all, "only 1 sinks have the quorum policy"},
+		{DeliveryConfig{Quorum: 1}, all, "only 0 sinks"},
+		{DeliveryConfig{Quorum: -1}, all, "cannot be negative"},
+	} {
+		assert.ErrorContains(t, tc.config.Validate(tc.enabled), tc.want)
+	}
+
+	config := &Config{Delivery: DeliveryConfig{Sinks: map[string]string{sinkWebhooks: deliveryRequired}}}
+	assert.ErrorContains(t, config.Validate(), "delivery.sinks.webhooks: the webhooks sink is not configured")
+}
+
+// newDeliveryIngestor returns an ingestor publishing three readings to a fake
+// channel, a file sink and a subscriber
+func newDeliveryIngestor(t *testing.T, delivery DeliveryConfig) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	upstream := newUpstream(t, "application/json", `[
+		{"type":"energy","name":"meter-1","payload":{"energy":1}},
+		{"type":"energy","name":"meter-2","payload":{"energy":2}},
+		{"type":"energy","name":"meter-3","payload":{"energy":3}}
+	]`)
+	subscriber := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(subscriber.Close)
+
+	ingestor := NewDataIngestor(&Config{
+		API:         APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:    RabbitMQConfig{QueueName: "meter-data-queue"},
+		FileSink:    FileSinkConfig{Dir: t.TempDir()},
+		Subscribers: []SubscriberConfig{{Name: "alerts", URL: subscriber.URL}},
+		Delivery:    delivery,
+		Logging:     LoggingConfig{Level: "error"},
+	})
+	t.Cleanup(func() { ingestor.fileSink.Close() })
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+// breakFileSink points the file sink at a regular file, so no archive can be
+// created
+func breakFileSink(t *testing.T, ingestor *DataIngestor) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "archive")
+	require.NoError(t, os.WriteFile(path, nil, 0o644))
+	ingestor.fileSink = NewFileSink(FileSinkConfig{Dir: path})
+}
+
+func archivedRecords(t *testing.T, ingestor *DataIngestor) int {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(ingestor.config.FileSink.Dir, "*.ndjson"))
+	require.NoError(t, err)
+	records := 0
+	for _, file := range files {
+		body, err := os.ReadFile(file)
+		require.NoError(t, err)
+		for _, b := range body {
+			if b == '\n' {
+				records++
+			}
+		}
+	}
+	return records
+}
+
+func TestDeliver_DefaultPolicyKeepsArchiveBestEffort(t *testing.T) {
+	ingestor, channel := newDeliveryIngestor(t, DeliveryConfig{})
+	breakFileSink(t, ingestor)
+
+	result := ingestor.RunCycle(context.Background())
+	require.Equal(t, CycleSucceeded, result.Status, "a best-effort miss does not fail the cycle")
+	assert.Len(t, channel.messages(), 1)
+
+	delivery := result.Locations[0].Delivery
+	require.NotNil(t, delivery)
+	assert.Equal(t, 0, delivery.Delivered)
+	assert.Equal(t, 3, delivery.Partial)
+	assert.Equal(t, []string{"meter-1", "meter-2", "meter-3"}, delivery.PartialReadings)
+	require.Len(t, delivery.Sinks, 3)
+	assert.Equal(t, SinkDelivery{Sink: sinkAMQP, Policy: deliveryRequired, Readings: 3}, delivery.Sinks[0])
+	assert.Equal(t, sinkFile, delivery.Sinks[1].Sink)
+	assert.Equal(t, deliveryBestEffort, delivery.Sinks[1].Policy)
+	assert.Zero(t, delivery.Sinks[1].Readings)
+	assert.NotEmpty(t, delivery.Sinks[1].Error)
+	assert.Equal(t, SinkDelivery{Sink: sinkWebhooks, Policy: deliveryBestEffort, Readings: 3}, delivery.Sinks[2])
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.Deliveries.WithLabelValues(readingPartial)))
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.SinkMisses.WithLabelValues(sinkFile, deliveryBestEffort)))
+}
+
+func TestDeliver_RequiredSinkFailsAndRetriesTheCycle(t *testing.T) {
+	ingestor, channel := newDeliveryIngestor(t, DeliveryConfig{
+		Sinks: map[string]string{sinkFile: deliveryRequired},
+	})
+	archive := ingestor.fileSink
+	breakFileSink(t, ingestor)
+
+	result := ingestor.RunCycle(context.Background())
+	require.Equal(t, CycleFailed, result.Status)
+	assert.Contains(t, result.Locations[0].Error, "failed to create file sink directory")
+	delivery := result.Locations[0].Delivery
+	require.NotNil(t, delivery)
+	assert.Equal(t, 3, delivery.Failed)
+	require.Len(t, delivery.Sinks, 2, "the best-effort subscribers are left for the retry")
+	assert.Len(t, channel.messages(), 1, "RabbitMQ took the readings before the archive failed")
+	assert.Zero(t, ingestor.notifier.Stats()["alerts"].Queued)
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.Deliveries.WithLabelValues(readingFailed)))
+
+	// The retry only delivers to the sinks that missed the readings
+	ingestor.fileSink = archive
+	result = ingestor.RunCycle(context.Background())
+	require.Equal(t, CycleSucceeded, result.Status)
+	assert.Equal(t, 3, result.Locations[0].Delivery.Delivered)
+	assert.Len(t, channel.messages(), 1, "RabbitMQ is not published to again")
+	assert.Equal(t, 3, archivedRecords(t, ingestor))
+	assert.Equal(t, 3, ingestor.notifier.Stats()["alerts"].Queued)
+}
+
+func TestDeliver_RetriesOnlyNewReadingsOnTheSinksThatTookOthers(t *testing.T) {
+	ingestor, channel := newDeliveryIngestor(t, DeliveryConfig{
+		Sinks: map[string]string{sinkFile: deliveryRequired},
+	})
+	archive := ingestor.fileSink
+	breakFileSink(t, ingestor)
+	require.Equal(t, CycleFailed, ingestor.RunCycle(context.Background()).Status)
+
+	// A reading the failed delivery did not have goes to every sink
+	ingestor.sources[0].baseURL = newUpstream(t, "application/json", `[
+		{"type":"energy","name":"meter-1","payload":{"energy":1}},
+		{"type":"energy","name":"meter-4","payload":{"energy":4}}
+	]`).URL
+	ingestor.fileSink = archive
+	result := ingestor.RunCycle(context.Background())
+	require.Equal(t, CycleSucceeded, result.Status)
+	assert.Equal(t, SinkDelivery{Sink: sinkAMQP, Policy: deliveryRequired, Readings: 2}, result.Locations[0].Delivery.Sinks[0])
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	var republished WeatherData
+	require.NoError(t, json.Unmarshal(messages[1].Msg.Body, &republished))
+	require.Len(t, republished, 1)
+	assert.Equal(t, "meter-4", republished[0].Name)
+	assert.Equal(t, 2, archivedRecords(t, ingestor))
+}
+
+func TestDeliver_Quorum(t *testing.T) {
+	policy := DeliveryConfig{
+		Sinks:  map[string]string{sinkAMQP: deliveryQuorum, sinkFile: deliveryQuorum, sinkWebhooks: deliveryQuorum},
+		Quorum: 2,
+	}
+
+	t.Run("one sink down", func(t *testing.T) {
+		ingestor, channel := newDeliveryIngestor(t, policy)
+		channel.err = errors.New("channel closed")
+
+		result := ingestor.RunCycle(context.Background())
+		require.Equal(t, CycleSucceeded, result.Status)
+		assert.Equal(t, 3, result.Locations[0].Delivery.Partial)
+		assert.Empty(t, result.Locations[0].MessageIDs)
+		assert.Equal(t, 3, archivedRecords(t, ingestor))
+		assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.SinkMisses.WithLabelValues(sinkAMQP, deliveryQuorum)))
+	})
+
+	t.Run("two sinks down", func(t *testing.T) {
+		ingestor, channel := newDeliveryIngestor(t, policy)
+		channel.err = errors.New("channel closed")
+		breakFileSink(t, ingestor)
+
+		result := ingestor.RunCycle(context.Background())
+		require.Equal(t, CycleFailed, result.Status)
+		err := result.Locations[0].err
+		assert.ErrorIs(t, err, ErrDeliveryQuorum)
+		assert.ErrorContains(t, err, "amqp: failed to publish data to queue: failed to publish message: channel closed")
+		assert.ErrorContains(t, err, "file: failed to create file sink directory")
+		assert.Equal(t, 3, result.Locations[0].Delivery.Failed)
+	})
+}
+
+func TestDeliver_FlagsPartialReadingsInTheirQuality(t *testing.T) {
+	ingestor, channel := newDeliveryIngestor(t, DeliveryConfig{})
+	ingestor.config.Quality.Enabled = true
+	ingestor.notifier.shedding.Store(true)
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	for _, reading := range *result.Data {
+		require.NotNil(t, reading.Quality)
+		assert.Equal(t, 90, reading.Quality.Score)
+		assert.Equal(t, map[string]int{qualityPartialDelivery: 10}, reading.Quality.Factors, "flagged once")
+	}
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.SinkMisses.WithLabelValues(sinkWebhooks, deliveryBestEffort)))
+
+	// RabbitMQ takes the readings after the subscribers missed them, so the
+	// message carries the factor
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, 90, messages[0].Msg.Headers["quality_score"])
+	quality := messages[0].Msg.Headers["quality"].([]interface{})
+	require.Len(t, quality, 3)
+	assert.Equal(t, amqp.Table{qualityPartialDelivery: 10}, quality[0].(amqp.Table)["factors"])
+}
+
+func TestHandleIngest_ReturnsDelivery(t *testing.T) {
+	ingestor, _ := newDeliveryIngestor(t, DeliveryConfig{})
+
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ingest", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Locations []LocationOutcome `json:"locations"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Len(t, body.Locations, 1)
+	assert.Equal(t, &DeliveryResult{Delivered: 3, Sinks: []SinkDelivery{
+		{Sink: sinkAMQP, Policy: deliveryRequired, Readings: 3},
+		{Sink: sinkFile, Policy: deliveryBestEffort, Readings: 3},
+		{Sink: sinkWebhooks, Policy: deliveryBestEffort, Readings: 3},
+	}}, body.Locations[0].Delivery)
+}
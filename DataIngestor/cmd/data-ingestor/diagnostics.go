@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	xproxy "golang.org/x/net/proxy"
+)
+
+const defaultDiagnosticsTimeout = 2 * time.Second
+
+// Results of a connectivity diagnostic
+const (
+	diagnosisDNSFailed  = "dns_failed"
+	diagnosisDialFailed = "dial_failed"
+	diagnosisReachable  = "reachable"
+)
+
+// DiagnosticsConfig checks the connectivity to the upstream host when a
+// fetch fails with a network error
+type DiagnosticsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Timeout bounds the DNS lookup and the dial each, 2s by default
+	Timeout Duration `yaml:"timeout"`
+}
+
+// Validate checks the timeout
+func (c DiagnosticsConfig) Validate() error {
+	if c.Timeout < 0 {
+		return fmt.Errorf("api.diagnostics.timeout must not be negative")
+	}
+	return nil
+}
+
+func (c DiagnosticsConfig) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return defaultDiagnosticsTimeout
+	}
+	return time.Duration(c.Timeout)
+}
+
+// Diagnosis is what the connectivity diagnostic of one failure streak
+// found, in GET /debug/connectivity
+type Diagnosis struct {
+	Location string    `json:"location"`
+	Time     time.Time `json:"time"`
+	// Error is the fetch failure the diagnostic was run for
+	Error string `json:"error"`
+	Host  string `json:"host"`
+	Port  string `json:"port"`
+	// Proxy is the proxy the upstream requests go through, if any
+	Proxy string   `json:"proxy,omitempty"`
+	DNS   DNSCheck `json:"dns"`
+	// Dial is left out when the host did not resolve
+	Dial *DialCheck `json:"dial,omitempty"`
+	// Result is dns_failed, dial_failed or reachable
+	Result string `json:"result"`
+}
+
+// DNSCheck is the lookup of the upstream host, or of the proxy when the
+// requests go through one. A host given as an IP address is not looked up.
+type DNSCheck struct {
+	DurationMS int64    `json:"duration_ms"`
+	Addresses  []string `json:"addresses,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// DialCheck is a TCP connect to the first address the host resolved to.
+// Through a proxy it is a connect to the proxy and a tunnel to Tunnel, the
+// upstream host and port.
+type DialCheck struct {
+	Address    string `json:"address"`
+	Tunnel     string `json:"tunnel,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// fields are the findings as log fields
+func (d *Diagnosis) fields() logrus.Fields {
+	fields := logrus.Fields{
+		"connectivity": d.Result,
+		"dns_ms":       d.DNS.DurationMS,
+	}
+	if len(d.DNS.Addresses) > 0 {
+		fields["dns_addresses"] = d.DNS.Addresses
+	}
+	if d.DNS.Error != "" {
+		fields["dns_error"] = d.DNS.Error
+	}
+	if d.Dial != nil {
+		fields["dial_address"] = d.Dial.Address
+		fields["dial_ms"] = d.Dial.DurationMS
+		if d.Dial.Tunnel != "" {
+			fields["dial_tunnel"] = d.Dial.Tunnel
+		}
+		if d.Dial.Error != "" {
+			fields["dial_error"] = d.Dial.Error
+		}
+	}
+	if d.Proxy != "" {
+		fields["proxy"] = d.Proxy
+	}
+	return fields
+}
+
+// hostResolver looks up host names; net.DefaultResolver outside of tests
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// connectivityDiagnostics runs the checks and keeps the latest diagnosis
+// of every location. It is nil unless api.diagnostics.enabled is set.
+type connectivityDiagnostics struct {
+	timeout  time.Duration
+	resolver hostResolver
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	proxy    func(*http.Request) (*url.URL, error)
+
+	mu         sync.Mutex
+	latest     *Diagnosis
+	byLocation map[string]Diagnosis
+}
+
+func newConnectivityDiagnostics(config DiagnosticsConfig) *connectivityDiagnostics {
+	if !config.Enabled {
+		return nil
+	}
+	return &connectivityDiagnostics{
+		timeout:    config.timeout(),
+		resolver:   net.DefaultResolver,
+		dial:       (&net.Dialer{}).DialContext,
+		proxy:      http.ProxyFromEnvironment,
+		byLocation: make(map[string]Diagnosis),
+	}
+}
+
+// run diagnoses the connection from here to target and keeps the result.
+// The lookup and the dial have a timeout of their own and ignore the
+// cancellation of ctx, whose request may just have timed out.
+func (d *connectivityDiagnostics) run(ctx context.Context, location, target string, cause error) Diagnosis {
+	ctx = context.WithoutCancel(ctx)
+	diagnosis := Diagnosis{Location: location, Time: time.Now().UTC(), Error: cause.Error()}
+	defer d.keep(&diagnosis)
+
+	u, err := url.Parse(target)
+	if err != nil {
+		diagnosis.DNS.Error = err.Error()
+		diagnosis.Result = diagnosisDNSFailed
+		return diagnosis
+	}
+	diagnosis.Host, diagnosis.Port = u.Hostname(), u.Port()
+	if diagnosis.Port == "" {
+		diagnosis.Port = "80"
+		if u.Scheme == "https" {
+			diagnosis.Port = "443"
+		}
+	}
+	// Through a proxy the connection is to the proxy, which tunnels it
+	host, port := diagnosis.Host, diagnosis.Port
+	proxy, err := d.proxy(&http.Request{URL: u})
+	if err != nil {
+		proxy = nil
+	}
+	if proxy != nil {
+		diagnosis.Proxy = proxy.Redacted()
+		host, port = proxy.Hostname(), proxyPort(proxy)
+	}
+
+	if net.ParseIP(host) != nil {
+		diagnosis.DNS.Addresses = []string{host}
+	} else {
+		lookupCtx, cancel := context.WithTimeout(ctx, d.timeout)
+		start := time.Now()
+		addresses, err := d.resolver.LookupHost(lookupCtx, host)
+		cancel()
+		diagnosis.DNS.DurationMS = time.Since(start).Milliseconds()
+		diagnosis.DNS.Addresses = addresses
+		if err == nil && len(addresses) == 0 {
+			err = fmt.Errorf("no addresses for %s", host)
+		}
+		if err != nil {
+			diagnosis.DNS.Error = err.Error()
+			diagnosis.Result = diagnosisDNSFailed
+			return diagnosis
+		}
+	}
+
+	dial := &DialCheck{Address: net.JoinHostPort(diagnosis.DNS.Addresses[0], port)}
+	diagnosis.Dial = dial
+	dialCtx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	start := time.Now()
+	var conn net.Conn
+	if proxy != nil {
+		dial.Tunnel = net.JoinHostPort(diagnosis.Host, diagnosis.Port)
+		conn, err = d.dialProxy(dialCtx, proxy, dial.Address, dial.Tunnel)
+	} else {
+		conn, err = d.dial(dialCtx, "tcp", dial.Address)
+	}
+	dial.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		dial.Error = err.Error()
+		diagnosis.Result = diagnosisDialFailed
+		return diagnosis
+	}
+	conn.Close()
+	diagnosis.Result = diagnosisReachable
+	return diagnosis
+}
+
+// proxyPort is the port of a proxy URL, or the default of its scheme
+func proxyPort(proxy *url.URL) string {
+	if port := proxy.Port(); port != "" {
+		return port
+	}
+	switch proxy.Scheme {
+	case "https":
+		return "443"
+	case "socks5", "socks5h":
+		return "1080"
+	}
+	return "80"
+}
+
+// dialProxy connects to the proxy at address and has it open a tunnel to
+// target, the way the upstream requests go: SOCKS5 proxies through the
+// x/net proxy dialer, HTTP and HTTPS proxies with a CONNECT request
+func (d *connectivityDiagnostics) dialProxy(ctx context.Context, proxy *url.URL, address, target string) (net.Conn, error) {
+	forward := proxyForward{dial: d.dial, address: address}
+	if proxy.Scheme == "socks5" || proxy.Scheme == "socks5h" {
+		dialer, err := xproxy.FromURL(proxy, forward)
+		if err != nil {
+			return nil, err
+		}
+		if contextDialer, ok := dialer.(xproxy.ContextDialer); ok {
+			return contextDialer.DialContext(ctx, "tcp", target)
+		}
+		return dialer.Dial("tcp", target)
+	}
+
+	conn, err := forward.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if proxy.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("proxy TLS handshake: %w", err)
+		}
+		conn = tlsConn
+	}
+	connect := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(user.Username() + ":" + password))
+		connect.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := connect.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT: %w", err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), connect)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy CONNECT: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused the tunnel to %s: %s", target, resp.Status)
+	}
+	return conn, nil
+}
+
+// proxyForward dials the proxy at the address the diagnostic resolved,
+// whatever address the proxy dialer asks for
+type proxyForward struct {
+	dial    func(ctx context.Context, network, address string) (net.Conn, error)
+	address string
+}
+
+func (f proxyForward) Dial(network, _ string) (net.Conn, error) {
+	return f.dial(context.Background(), network, f.address)
+}
+
+func (f proxyForward) DialContext(ctx context.Context, network, _ string) (net.Conn, error) {
+	return f.dial(ctx, network, f.address)
+}
+
+func (d *connectivityDiagnostics) keep(diagnosis *Diagnosis) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	latest := *diagnosis
+	d.latest = &latest
+	d.byLocation[diagnosis.Location] = latest
+}
+
+// ConnectivityStatus is the body of GET /debug/connectivity
+type ConnectivityStatus struct {
+	// Latest is the most recent diagnosis of any location, null before the
+	// first network failure
+	Latest    *Diagnosis           `json:"latest"`
+	Locations map[string]Diagnosis `json:"locations"`
+}
+
+func (d *connectivityDiagnostics) status() ConnectivityStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := ConnectivityStatus{Latest: d.latest, Locations: make(map[string]Diagnosis, len(d.byLocation))}
+	for location, diagnosis := range d.byLocation {
+		status.Locations[location] = diagnosis
+	}
+	return status
+}
+
+// isNetworkError reports whether a fetch failed below HTTP: the host did
+// not resolve, the connection was refused or reset, or the request timed out
+func isNetworkError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	if errors.As(err, &dnsErr) || errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// diagnoseFailure runs the connectivity diagnostic for the first network
+// failure of a streak. The findings go with the error the cycle logs, or
+// are logged on their own outside of a cycle.
+func (di *DataIngestor) diagnoseFailure(ctx context.Context, src *source, err error) {
+	if di.diagnostics == nil || !isNetworkError(err) || !src.diagnoseOnce() {
+		return
+	}
+	diagnosis := di.diagnostics.run(ctx, src.name, src.target(), err)
+	di.metrics.UpstreamDiagnostics.WithLabelValues(src.name, diagnosis.Result).Inc()
+	if stats := locationStatsOf(ctx); stats != nil {
+		stats.diagnosis = &diagnosis
+		return
+	}
+	di.log(logFetch).WithField("location", src.name).WithFields(diagnosis.fields()).
+		WithError(err).Warn("Upstream connectivity diagnosed")
+}
+
+// handleConnectivity serves GET /debug/connectivity
+func (di *DataIngestor) handleConnectivity(c *gin.Context) {
+	if di.diagnostics == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "connectivity diagnostics are disabled",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, di.diagnostics.status())
+}
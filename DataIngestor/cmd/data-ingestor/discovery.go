@@ -0,0 +1,603 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultDiscoveryInterval = 5 * time.Minute
+	defaultDiscoveryTimeout  = 10 * time.Second
+	// maxCatalogBody bounds the catalog response that is read
+	maxCatalogBody = 4 << 20
+
+	catalogChangeMessageType = "catalog_change"
+)
+
+// Results of a catalog fetch
+const (
+	catalogFetchOK     = "ok"
+	catalogFetchFailed = "failed"
+)
+
+// Changes the catalog made to the locations
+const (
+	catalogAdded   = "added"
+	catalogRemoved = "removed"
+	catalogMoved   = "moved"
+)
+
+// DiscoveryConfig polls the station catalog of the upstream, a JSON array of
+// {"id": "<station>", "base_url": "<URL>"}, and polls every station it lists
+// besides api.locations. Each station is a location named by its id.
+type DiscoveryConfig struct {
+	// CatalogURL is an http(s) URL or a path on api.base_url, /stations on
+	// most upstreams; without it the locations are the configured ones
+	CatalogURL string `yaml:"catalog_url"`
+	// Interval is how often the catalog is fetched, 5m by default
+	Interval Duration `yaml:"interval"`
+	// Timeout bounds one catalog request, 10s by default
+	Timeout Duration `yaml:"timeout"`
+	// Include and Exclude are globs on the station ids. Only stations
+	// matching an include, all without one, and no exclude are polled.
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+	// StateFile keeps the last catalog fetched, so the stations are polled
+	// after a restart while the catalog is down
+	StateFile string `yaml:"state_file"`
+	// Exchange and RoutingKey receive a catalog_change event whenever the
+	// catalog adds, removes or moves a location; without a routing key
+	// the changes are only logged
+	Exchange   string `yaml:"exchange"`
+	RoutingKey string `yaml:"routing_key"`
+}
+
+func (c DiscoveryConfig) enabled() bool {
+	return c.CatalogURL != ""
+}
+
+func (c DiscoveryConfig) Validate(baseURL string) error {
+	if !c.enabled() {
+		return nil
+	}
+	if err := validateEndpointURL("api.discovery.catalog_url", c.CatalogURL, baseURL); err != nil {
+		return err
+	}
+	if c.Interval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("api.discovery: interval and timeout must not be negative")
+	}
+	for _, pattern := range append(append([]string{}, c.Include...), c.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("api.discovery: invalid glob %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+func (c DiscoveryConfig) interval() time.Duration {
+	if c.Interval > 0 {
+		return time.Duration(c.Interval)
+	}
+	return defaultDiscoveryInterval
+}
+
+func (c DiscoveryConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return defaultDiscoveryTimeout
+}
+
+// matches reports whether the globs let the station with id be polled
+func (c DiscoveryConfig) matches(id string) bool {
+	for _, pattern := range c.Exclude {
+		if ok, _ := path.Match(pattern, id); ok {
+			return false
+		}
+	}
+	if len(c.Include) == 0 {
+		return true
+	}
+	for _, pattern := range c.Include {
+		if ok, _ := path.Match(pattern, id); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Station is one entry of the upstream catalog. Without a base URL the
+// station is fetched from api.base_url.
+type Station struct {
+	ID      string `json:"id"`
+	BaseURL string `json:"base_url,omitempty"`
+}
+
+// catalogState is the state file of the last catalog fetched
+type catalogState struct {
+	FetchedAt time.Time `json:"fetched_at"`
+	Stations  []Station `json:"stations"`
+}
+
+// CatalogChange is the catalog_change event, published when a catalog
+// fetch changed the locations
+type CatalogChange struct {
+	At      time.Time `json:"at"`
+	Added   []string  `json:"added"`
+	Removed []string  `json:"removed"`
+	// Moved are the stations whose base URL changed
+	Moved []string `json:"moved"`
+	// Locations are every location after the change, polled here or by
+	// another shard
+	Locations []string `json:"locations"`
+}
+
+func (c CatalogChange) empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Moved) == 0
+}
+
+// stationDiscovery fetches the station catalog and keeps the locations in
+// step with it. A failed fetch keeps the stations of the last catalog.
+type stationDiscovery struct {
+	di     *DataIngestor
+	config DiscoveryConfig
+	url    string
+	// configured are the sources of api.locations, polled whatever the
+	// catalog lists
+	configured []*source
+
+	mu sync.Mutex
+	// all are the configured and discovered sources, owned by this shard
+	// or not
+	all       []*source
+	stations  []Station
+	fetchedAt time.Time
+	checkedAt time.Time
+	err       error
+	// breaker stops fetching the catalog while it keeps failing
+	breaker circuitBreaker
+}
+
+// newStationDiscovery returns nil unless api.discovery is enabled. The
+// stations of the state file are added to di.sources right away.
+func (di *DataIngestor) newStationDiscovery() *stationDiscovery {
+	config := di.config.API.Discovery
+	if !config.enabled() {
+		return nil
+	}
+	d := &stationDiscovery{
+		di:         di,
+		config:     config,
+		url:        resolveEndpointURL(config.CatalogURL, di.config.API.BaseURL),
+		configured: di.sources,
+		all:        di.sources,
+		breaker:    newCircuitBreaker(di.config.API.CircuitBreaker),
+	}
+	logger := di.log(logFetch).WithField("url", d.url)
+	state, err := d.load()
+	if err != nil {
+		logger.WithError(err).Warn("Ignoring the station catalog state, polling the configured locations until the catalog is fetched")
+	}
+	if state != nil {
+		d.stations, d.fetchedAt = state.Stations, state.FetchedAt
+		d.all, _ = d.merge(state.Stations)
+		di.sources = d.all
+		logger.WithFields(logrus.Fields{
+			"stations":   len(state.Stations),
+			"fetched_at": state.FetchedAt,
+		}).Info("Station catalog restored")
+	}
+	di.metrics.DiscoveredStations.Set(float64(len(d.all) - len(d.configured)))
+	return d
+}
+
+// load reads the state file, nil when there is none
+func (d *stationDiscovery) load() (*catalogState, error) {
+	if d.config.StateFile == "" {
+		return nil, nil
+	}
+	body, err := os.ReadFile(d.config.StateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read station catalog state: %w", err)
+	}
+	var state catalogState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse station catalog state %s: %w", d.config.StateFile, err)
+	}
+	return &state, nil
+}
+
+func (d *stationDiscovery) save(state catalogState) error {
+	if d.config.StateFile == "" {
+		return nil
+	}
+	body, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(d.config.StateFile, body); err != nil {
+		return fmt.Errorf("failed to write station catalog state: %w", err)
+	}
+	return nil
+}
+
+// fetch gets the catalog, a call of the poll class of the upstream rate
+// limit that its own breaker stops while the catalog keeps failing. A
+// catalog without stations counts as a failure, so an upstream answering
+// with an empty list while it is broken does not stop every discovered
+// location.
+func (d *stationDiscovery) fetch(ctx context.Context) ([]Station, error) {
+	d.mu.Lock()
+	err := d.breaker.allow(time.Now())
+	d.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	ctx = withUpstreamClass(ctx, upstreamPoll)
+	if err := d.di.upstreamLimit.wait(ctx, upstreamPoll); err != nil {
+		d.mu.Lock()
+		d.breaker.release()
+		d.mu.Unlock()
+		return nil, err
+	}
+	stations, err := d.get(ctx)
+	d.mu.Lock()
+	if ctx.Err() != nil {
+		// Shutdown, not the catalog
+		d.breaker.release()
+		d.mu.Unlock()
+		return nil, err
+	}
+	from, to := d.breaker.record(time.Now(), err == nil)
+	d.mu.Unlock()
+	if from != to {
+		d.di.log(logFetch).WithFields(logrus.Fields{
+			"url":  d.url,
+			"from": from.String(),
+			"to":   to.String(),
+		}).Warn("Circuit breaker state changed")
+	}
+	return stations, err
+}
+
+// get sends the request for the catalog
+func (d *stationDiscovery) get(ctx context.Context) ([]Station, error) {
+	di := d.di
+	ctx, cancel := context.WithTimeout(ctx, d.config.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	key, err := di.apiKey()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Api-Key", key)
+	di.tagRequest(req)
+	req = di.decorateRequest(req)
+	resp, err := di.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxCatalogBody))
+	if err != nil {
+		return nil, err
+	}
+	var stations []Station
+	if err := json.Unmarshal(body, &stations); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal catalog: %w", err)
+	}
+	if len(stations) == 0 {
+		return nil, fmt.Errorf("catalog lists no stations")
+	}
+	return stations, nil
+}
+
+// merge returns the configured sources and a source per station the
+// catalog lists and the globs let through. The sources of the stations
+// already known are kept, and pointed at their new base URL when they
+// moved. Callers hold mu, or own d alone.
+func (d *stationDiscovery) merge(stations []Station) ([]*source, CatalogChange) {
+	di := d.di
+	known := make(map[string]*source, len(d.all))
+	for _, src := range d.all {
+		known[src.name] = src
+	}
+	next := append([]*source{}, d.configured...)
+	names := make(map[string]bool, len(next)+len(stations))
+	for _, src := range next {
+		names[src.name] = true
+	}
+	change := CatalogChange{Added: []string{}, Removed: []string{}, Moved: []string{}}
+	for _, station := range stations {
+		logger := di.log(logIngestion).WithField("station", station.ID)
+		switch {
+		case station.ID == "" || names[station.ID] || !d.config.matches(station.ID):
+			// Configured locations take precedence over the catalog
+			continue
+		case station.BaseURL == "" && di.config.API.BaseURL == "" && !di.config.API.bulk():
+			logger.Warn("Skipping catalog station without a base_url, api.base_url is not set")
+			continue
+		case station.BaseURL != "":
+			if err := validateBaseURL(station.BaseURL); err != nil {
+				logger.WithError(err).Warn("Skipping catalog station")
+				continue
+			}
+		}
+		names[station.ID] = true
+		src := known[station.ID]
+		switch {
+		case src == nil:
+			src = newSource(di.config.API, LocationSource{Name: station.ID, BaseURL: station.BaseURL})
+			change.Added = append(change.Added, station.ID)
+		case station.BaseURL != "" && strings.TrimRight(station.BaseURL, "/") != strings.TrimRight(src.target(), "/"):
+			logger.WithFields(logrus.Fields{
+				"from": src.target(),
+				"to":   station.BaseURL,
+			}).Warn("Catalog station moved to another base URL")
+			src.retarget(station.BaseURL)
+			change.Moved = append(change.Moved, station.ID)
+		}
+		next = append(next, src)
+	}
+	for _, src := range d.all {
+		if !names[src.name] {
+			change.Removed = append(change.Removed, src.name)
+		}
+	}
+	for _, src := range next {
+		change.Locations = append(change.Locations, src.name)
+	}
+	return next, change
+}
+
+// refresh fetches the catalog once and applies it. A failed fetch keeps the
+// locations as they are.
+func (d *stationDiscovery) refresh(ctx context.Context) {
+	di := d.di
+	stations, err := d.fetch(ctx)
+	now := time.Now()
+	logger := di.log(logFetch).WithField("url", d.url)
+	if err != nil {
+		di.metrics.CatalogFetches.WithLabelValues(catalogFetchFailed).Inc()
+		d.mu.Lock()
+		failing := d.err != nil
+		d.checkedAt, d.err = now, err
+		known := len(d.stations)
+		d.mu.Unlock()
+		if !failing {
+			logger.WithError(err).WithField("stations", known).Warn("Station catalog fetch failed, keeping the last known stations")
+		}
+		return
+	}
+	di.metrics.CatalogFetches.WithLabelValues(catalogFetchOK).Inc()
+
+	d.mu.Lock()
+	if d.err != nil {
+		logger.Info("Station catalog fetched again")
+	}
+	d.checkedAt, d.err = now, nil
+	changed := !reflect.DeepEqual(stations, d.stations)
+	d.stations, d.fetchedAt = stations, now
+	next, change := d.merge(stations)
+	d.all = next
+	d.mu.Unlock()
+
+	if changed {
+		if err := d.save(catalogState{FetchedAt: now, Stations: stations}); err != nil {
+			logger.WithError(err).Warn("Station catalog not saved")
+		}
+	}
+	if change.empty() {
+		return
+	}
+	change.At = now
+	d.apply(next, change)
+}
+
+// apply polls the locations of next this shard owns instead of the ones
+// it polled, and reports the change
+func (d *stationDiscovery) apply(next []*source, change CatalogChange) {
+	di := d.di
+	owned := di.shard.filter(next)
+	di.shard.setLocations(next)
+	di.sourcesMu.Lock()
+	stopped := di.sources
+	di.sources = owned
+	di.sourcesMu.Unlock()
+	if di.shard != nil {
+		di.metrics.ShardLocations.Set(float64(len(owned)))
+	}
+	di.metrics.DiscoveredStations.Set(float64(len(next) - len(d.configured)))
+
+	polled := make(map[*source]bool, len(owned))
+	for _, src := range owned {
+		polled[src] = true
+	}
+	wasPolled := make(map[*source]bool, len(stopped))
+	for _, src := range stopped {
+		wasPolled[src] = true
+		if polled[src] {
+			continue
+		}
+		di.pollers.stop(src)
+		// Its readings go stale without a fetch to replace them
+		di.latest.forget(src.name)
+		di.metrics.forgetLocation(src.name)
+		di.log(logIngestion).WithField("location", src.name).Info("Location left the catalog, polling stopped")
+	}
+	for _, src := range owned {
+		if wasPolled[src] {
+			continue
+		}
+		di.latest.track(src.name)
+		di.metrics.CircuitBreakerState.WithLabelValues(src.name).Set(float64(breakerClosed))
+		di.pollers.start(src)
+		di.log(logIngestion).WithField("location", src.name).Info("Location discovered in the catalog, polling started")
+	}
+	for _, name := range change.Added {
+		di.metrics.CatalogChanges.WithLabelValues(catalogAdded).Inc()
+		if !di.shard.owns(name) {
+			di.log(logIngestion).WithField("location", name).Info("Location discovered in the catalog, polled by another shard")
+		}
+	}
+	di.metrics.CatalogChanges.WithLabelValues(catalogRemoved).Add(float64(len(change.Removed)))
+	di.metrics.CatalogChanges.WithLabelValues(catalogMoved).Add(float64(len(change.Moved)))
+
+	if err := d.publish(change); err != nil {
+		di.log(logPublish).WithError(err).Warn("Catalog change event not published")
+	}
+}
+
+// publish sends the catalog_change event, when api.discovery names a
+// routing key for it
+func (d *stationDiscovery) publish(change CatalogChange) error {
+	if d.config.RoutingKey == "" {
+		return nil
+	}
+	body, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("failed to marshal catalog change: %w", err)
+	}
+	_, err = d.di.publishBody(d.config.Exchange, d.config.RoutingKey, body, Envelope{Type: catalogChangeMessageType})
+	return err
+}
+
+// run fetches the catalog right away and then every interval, until ctx is
+// cancelled
+func (d *stationDiscovery) run(ctx context.Context) {
+	for {
+		d.refresh(ctx)
+		if !waitFor(ctx, d.config.interval()) {
+			return
+		}
+	}
+}
+
+// DiscoveryStatus is the discovery entry of GET /ingestion/status
+type DiscoveryStatus struct {
+	CatalogURL string `json:"catalog_url"`
+	// Stations are the stations of the last catalog, Locations the
+	// configured and discovered locations, polled here or by another shard
+	Stations  int        `json:"stations"`
+	Locations []string   `json:"locations"`
+	FetchedAt *time.Time `json:"fetched_at,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	// Error is why the latest fetch failed; the last stations are kept
+	Error string `json:"error,omitempty"`
+}
+
+func (d *stationDiscovery) status() *DiscoveryStatus {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	status := &DiscoveryStatus{CatalogURL: d.url, Stations: len(d.stations), Locations: []string{}}
+	for _, src := range d.all {
+		status.Locations = append(status.Locations, src.name)
+	}
+	if !d.fetchedAt.IsZero() {
+		fetchedAt := d.fetchedAt
+		status.FetchedAt = &fetchedAt
+	}
+	if !d.checkedAt.IsZero() {
+		checkedAt := d.checkedAt
+		status.CheckedAt = &checkedAt
+	}
+	if d.err != nil {
+		status.Error = d.err.Error()
+	}
+	return status
+}
+
+// sourcePollers runs pollSource for every location while ingestion runs,
+// and starts and stops them as api.discovery changes the locations
+type sourcePollers struct {
+	mu sync.Mutex
+	// ctx is nil unless ingestion runs with a poller per location
+	ctx     context.Context
+	poll    func(ctx context.Context, src *source)
+	running map[*source]*poller
+	wg      sync.WaitGroup
+}
+
+// poller is the pollSource of one location
+type poller struct {
+	cancel context.CancelFunc
+	// done is closed once pollSource returned
+	done chan struct{}
+}
+
+// run polls sources and the locations started later until ctx is
+// cancelled, and waits for the pollers to return
+func (p *sourcePollers) run(ctx context.Context, sources func() []*source, poll func(ctx context.Context, src *source)) {
+	p.mu.Lock()
+	p.ctx, p.poll, p.running = ctx, poll, make(map[*source]*poller)
+	for _, src := range sources() {
+		p.startLocked(src)
+	}
+	p.mu.Unlock()
+
+	<-ctx.Done()
+	p.mu.Lock()
+	p.ctx = nil
+	p.mu.Unlock()
+	p.wg.Wait()
+}
+
+// start polls src, unless it is polled already or ingestion does not run
+func (p *sourcePollers) start(src *source) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.startLocked(src)
+}
+
+func (p *sourcePollers) startLocked(src *source) {
+	if p.ctx == nil || p.running[src] != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	running := &poller{cancel: cancel, done: make(chan struct{})}
+	p.running[src] = running
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer close(running.done)
+		p.poll(ctx, src)
+	}()
+}
+
+// stop ends the polling of src and waits for a cycle it is running to
+// finish
+func (p *sourcePollers) stop(src *source) {
+	p.mu.Lock()
+	running := p.running[src]
+	delete(p.running, src)
+	p.mu.Unlock()
+	if running != nil {
+		running.cancel()
+		<-running.done
+	}
+}
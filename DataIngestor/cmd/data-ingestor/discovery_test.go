@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// catalogUpstream serves its stations on /stations and the readings of
+// every station on /<station>/meters, one reading named <station>-1. The
+// catalog fetches are counted as the hits of /stations.
+type catalogUpstream struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	stations []Station
+	status   int
+	hits     map[string]int
+}
+
+func newCatalogUpstream(t *testing.T) *catalogUpstream {
+	t.Helper()
+	u := &catalogUpstream{status: http.StatusOK, hits: make(map[string]int)}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		defer u.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/stations" {
+			u.hits[r.URL.Path]++
+			w.WriteHeader(u.status)
+			json.NewEncoder(w).Encode(u.stations)
+			return
+		}
+		station := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), "/meters")
+		u.hits[station]++
+		fmt.Fprintf(w, `[{"type":"energy","name":"%s-1","payload":{"energy":1}}]`, station)
+	}))
+	t.Cleanup(u.Server.Close)
+	return u
+}
+
+// list makes the catalog list the stations with ids, each served here
+func (u *catalogUpstream) list(ids ...string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stations, u.status = []Station{}, http.StatusOK
+	for _, id := range ids {
+		u.stations = append(u.stations, Station{ID: id, BaseURL: u.URL + "/" + id})
+	}
+}
+
+func (u *catalogUpstream) fail(status int) {
+	u.mu.Lock()
+	u.status = status
+	u.mu.Unlock()
+}
+
+func (u *catalogUpstream) hitsOf(station string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.hits[station]
+}
+
+func newDiscoveryIngestor(t *testing.T, upstream *catalogUpstream, config *Config) *DataIngestor {
+	t.Helper()
+	config.API.BaseURL = upstream.URL
+	config.API.Timeout = Duration(time.Second)
+	config.API.PollInterval = Duration(10 * time.Millisecond)
+	config.API.Discovery.CatalogURL = "/stations"
+	config.RabbitMQ = RabbitMQConfig{QueueName: "meter-data-queue"}
+	config.Logging = LoggingConfig{Level: "panic"}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+	require.NotNil(t, ingestor.discovery)
+	return ingestor
+}
+
+func sourceNames(sources []*source) []string {
+	names := []string{}
+	for _, src := range sources {
+		names = append(names, src.name)
+	}
+	return names
+}
+
+func catalogChanges(t *testing.T, channel *fakeChannel) []CatalogChange {
+	t.Helper()
+	var changes []CatalogChange
+	for _, message := range channel.messages() {
+		if message.Msg.Type != catalogChangeMessageType {
+			continue
+		}
+		assert.Equal(t, "control", message.RoutingKey)
+		var change CatalogChange
+		require.NoError(t, json.Unmarshal(message.Msg.Body, &change))
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func latestStatus(router http.Handler, location string) int {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/weather/latest/"+location, nil))
+	return w.Code
+}
+
+// locationSeries counts the metric series of location
+func locationSeries(t *testing.T, ingestor *DataIngestor, location string) int {
+	t.Helper()
+	families, err := ingestor.metrics.registry.Gather()
+	require.NoError(t, err)
+	series := 0
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if label.GetName() == "location" && label.GetValue() == location {
+					series++
+				}
+			}
+		}
+	}
+	return series
+}
+
+func TestDiscovery_StationsAppearAndDisappear(t *testing.T) {
+	upstream := newCatalogUpstream(t)
+	ingestor := newDiscoveryIngestor(t, upstream, &Config{API: APIConfig{
+		Locations: []LocationSource{{Name: "static", BaseURL: upstream.URL + "/static"}},
+		Discovery: DiscoveryConfig{Exclude: []string{"test-*"}, RoutingKey: "control"},
+	}})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	router := setupRoutes(ingestor)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ingestor.StartIngestion(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	assert.Equal(t, []string{"static"}, sourceNames(ingestor.currentSources()), "the configured locations before the catalog is fetched")
+
+	upstream.list("alpha", "bravo", "test-1", "static")
+	ingestor.discovery.refresh(ctx)
+	assert.Equal(t, []string{"static", "alpha", "bravo"}, sourceNames(ingestor.currentSources()), "excluded and configured stations are left out")
+	require.Eventually(t, func() bool {
+		return upstream.hitsOf("alpha") > 0 && upstream.hitsOf("bravo") > 0
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Zero(t, upstream.hitsOf("test-1"))
+	require.Eventually(t, func() bool { return latestStatus(router, "alpha-1") == http.StatusOK }, time.Second, 5*time.Millisecond)
+	assert.Positive(t, locationSeries(t, ingestor, "alpha"))
+
+	upstream.list("bravo", "charlie")
+	ingestor.discovery.refresh(ctx)
+	assert.Equal(t, []string{"static", "bravo", "charlie"}, sourceNames(ingestor.currentSources()))
+	require.Eventually(t, func() bool { return upstream.hitsOf("charlie") > 0 }, 2*time.Second, 5*time.Millisecond)
+	stopped := upstream.hitsOf("alpha")
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, stopped, upstream.hitsOf("alpha"), "the cycle in flight finished before the station was removed")
+	assert.Equal(t, http.StatusNotFound, latestStatus(router, "alpha-1"), "a removed station's reading is not served")
+	assert.Zero(t, locationSeries(t, ingestor, "alpha"), "a removed station leaves no metric series")
+	assert.Greater(t, upstream.hitsOf("static"), 0)
+
+	changes := catalogChanges(t, channel)
+	require.Len(t, changes, 2)
+	assert.Equal(t, []string{"alpha", "bravo"}, changes[0].Added)
+	assert.Empty(t, changes[0].Removed)
+	assert.Equal(t, []string{"charlie"}, changes[1].Added)
+	assert.Equal(t, []string{"alpha"}, changes[1].Removed)
+	assert.Equal(t, []string{"static", "bravo", "charlie"}, changes[1].Locations)
+
+	// The same catalog again changes nothing
+	ingestor.discovery.refresh(ctx)
+	assert.Len(t, catalogChanges(t, channel), 2)
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.CatalogChanges.WithLabelValues(catalogAdded)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.CatalogChanges.WithLabelValues(catalogRemoved)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.DiscoveredStations))
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.CatalogFetches.WithLabelValues(catalogFetchOK)))
+}
+
+func TestDiscovery_CatalogOutageKeepsStations(t *testing.T) {
+	upstream := newCatalogUpstream(t)
+	state := filepath.Join(t.TempDir(), "catalog.json")
+	config := func() *Config {
+		return &Config{API: APIConfig{Discovery: DiscoveryConfig{StateFile: state}}}
+	}
+	ingestor := newDiscoveryIngestor(t, upstream, config())
+	assert.Empty(t, ingestor.currentSources(), "no default location with discovery")
+
+	upstream.list("alpha", "bravo")
+	ingestor.discovery.refresh(context.Background())
+	assert.Equal(t, []string{"alpha", "bravo"}, sourceNames(ingestor.currentSources()))
+
+	upstream.fail(http.StatusServiceUnavailable)
+	ingestor.discovery.refresh(context.Background())
+	upstream.list()
+	ingestor.discovery.refresh(context.Background())
+	assert.Equal(t, []string{"alpha", "bravo"}, sourceNames(ingestor.currentSources()), "neither an error nor an empty catalog removes stations")
+	status := ingestor.discovery.status()
+	assert.Equal(t, "catalog lists no stations", status.Error)
+	assert.Equal(t, 2, status.Stations)
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.CatalogFetches.WithLabelValues(catalogFetchFailed)))
+
+	// A restart while the catalog is down polls the last known stations
+	upstream.fail(http.StatusInternalServerError)
+	restarted := newDiscoveryIngestor(t, upstream, config())
+	assert.Equal(t, []string{"alpha", "bravo"}, sourceNames(restarted.currentSources()))
+	restarted.discovery.refresh(context.Background())
+	assert.Equal(t, []string{"alpha", "bravo"}, sourceNames(restarted.currentSources()))
+	attachChannel(restarted, &fakeChannel{}, nil)
+	result, err := restarted.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, *result.Data, 2)
+
+	w := httptest.NewRecorder()
+	setupRoutes(restarted).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ingestion/status", nil))
+	var body struct {
+		Discovery DiscoveryStatus `json:"discovery"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, upstream.URL+"/stations", body.Discovery.CatalogURL)
+	assert.Equal(t, []string{"alpha", "bravo"}, body.Discovery.Locations)
+	assert.NotNil(t, body.Discovery.FetchedAt, "restored from the state file")
+	assert.Equal(t, "status 500", body.Discovery.Error)
+}
+
+func TestDiscovery_CatalogFetchesPassTheBreakerAndRateLimit(t *testing.T) {
+	upstream := newCatalogUpstream(t)
+	ingestor := newDiscoveryIngestor(t, upstream, &Config{API: APIConfig{
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: Duration(time.Hour)},
+	}})
+	upstream.fail(http.StatusInternalServerError)
+	ingestor.discovery.refresh(context.Background())
+	ingestor.discovery.refresh(context.Background())
+	ingestor.discovery.refresh(context.Background())
+	assert.Equal(t, 2, upstream.hitsOf("/stations"), "the breaker opened after two failures")
+	assert.Equal(t, ErrCircuitOpen.Error(), ingestor.discovery.status().Error)
+
+	ingestor = newDiscoveryIngestor(t, upstream, &Config{API: APIConfig{
+		RateLimit: UpstreamRateLimitConfig{Rate: 0.001, Burst: 1, Classes: map[string]RateLimitClassConfig{
+			upstreamPoll: {Policy: rateLimitReject},
+		}},
+	}})
+	upstream.list("alpha")
+	ingestor.discovery.refresh(context.Background())
+	ingestor.discovery.refresh(context.Background())
+	assert.Equal(t, 3, upstream.hitsOf("/stations"), "the second fetch is turned away by the rate limit")
+	assert.Equal(t, []string{"alpha"}, sourceNames(ingestor.currentSources()))
+}
+
+func TestDiscovery_ShardsSplitTheStations(t *testing.T) {
+	upstream := newCatalogUpstream(t)
+	ingestor := newDiscoveryIngestor(t, upstream, &Config{
+		InstanceID: "ingestor-0",
+		Sharding:   ShardingConfig{Members: []string{"ingestor-0", "ingestor-1"}},
+	})
+	router := setupRoutes(ingestor)
+	stations := []string{"s1", "s2", "s3", "s4", "s5", "s6", "s7", "s8"}
+	upstream.list(stations...)
+	ingestor.discovery.refresh(context.Background())
+
+	var owned, other []string
+	for _, station := range stations {
+		if ingestor.shard.owns(station) {
+			owned = append(owned, station)
+		} else {
+			other = append(other, station)
+		}
+	}
+	require.NotEmpty(t, owned)
+	require.NotEmpty(t, other)
+	assert.Equal(t, owned, sourceNames(ingestor.currentSources()))
+	assert.Equal(t, float64(len(owned)), testutil.ToFloat64(ingestor.metrics.ShardLocations))
+	assert.Equal(t, len(stations), ingestor.shard.status().Locations)
+	assert.Equal(t, http.StatusMisdirectedRequest, latestStatus(router, other[0]), "a discovered station of another shard")
+
+	// Removing a station of the other shard leaves this one's alone
+	upstream.list(append(append([]string{}, owned...), other[1:]...)...)
+	ingestor.discovery.refresh(context.Background())
+	assert.Equal(t, owned, sourceNames(ingestor.currentSources()))
+	assert.Equal(t, len(stations)-1, ingestor.shard.status().Locations)
+	assert.Equal(t, http.StatusNotFound, latestStatus(router, other[0]), "no longer known to any shard")
+}
+
+func TestDiscovery_IncludeAndMove(t *testing.T) {
+	upstream := newCatalogUpstream(t)
+	ingestor := newDiscoveryIngestor(t, upstream, &Config{API: APIConfig{
+		Discovery: DiscoveryConfig{Include: []string{"de-*"}},
+	}})
+	upstream.list("de-1", "fr-1")
+	ingestor.discovery.refresh(context.Background())
+	require.Equal(t, []string{"de-1"}, sourceNames(ingestor.currentSources()))
+	src := ingestor.currentSources()[0]
+
+	upstream.mu.Lock()
+	upstream.stations[0].BaseURL = upstream.URL + "/de-1-new"
+	upstream.mu.Unlock()
+	ingestor.discovery.refresh(context.Background())
+	assert.Same(t, src, ingestor.currentSources()[0], "a moved station keeps its source")
+	assert.Equal(t, upstream.URL+"/de-1-new", src.target())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.CatalogChanges.WithLabelValues(catalogMoved)))
+}
+
+func TestDiscoveryConfig_Validate(t *testing.T) {
+	for config, message := range map[*Config]string{
+		{API: APIConfig{Discovery: DiscoveryConfig{CatalogURL: "/stations"}}}:                                                             "api.discovery.catalog_url \"/stations\" is a path, which needs api.base_url",
+		{API: APIConfig{Discovery: DiscoveryConfig{CatalogURL: "ftp://catalog/stations"}}}:                                                "api.discovery.catalog_url must be an http:// or https:// URL or a path",
+		{API: APIConfig{BaseURL: "https://api.example.com", Discovery: DiscoveryConfig{CatalogURL: "/stations", Include: []string{"["}}}}: `api.discovery: invalid glob "["`,
+		{API: APIConfig{BaseURL: "https://api.example.com", Discovery: DiscoveryConfig{CatalogURL: "/stations", Interval: Duration(-1)}}}: "api.discovery: interval and timeout must not be negative",
+	} {
+		assert.ErrorContains(t, config.Validate(), message)
+	}
+	assert.True(t, DiscoveryConfig{Include: []string{"de-*"}, Exclude: []string{"de-test*"}}.matches("de-1"))
+	assert.False(t, DiscoveryConfig{Include: []string{"de-*"}, Exclude: []string{"de-test*"}}.matches("de-test-1"))
+	assert.False(t, DiscoveryConfig{Include: []string{"de-*"}}.matches("fr-1"))
+}
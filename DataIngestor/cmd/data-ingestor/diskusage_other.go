@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// diskUsageSupported reports whether diskUsage can sample volumes
+const diskUsageSupported = false
+
+// diskUsage is not implemented outside Linux
+func diskUsage(dir string) (used, free uint64, err error) {
+	return 0, 0, errors.New("disk usage is only sampled on Linux")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// drainLogInterval is how often a shutdown reports what it is waiting for
+const drainLogInterval = time.Second
+
+// connTracker counts the HTTP connections by state, from http.Server.ConnState
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[net.Conn]http.ConnState
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[net.Conn]http.ConnState)}
+}
+
+func (t *connTracker) track(conn net.Conn, state http.ConnState) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch state {
+	case http.StateHijacked, http.StateClosed:
+		delete(t.conns, conn)
+	default:
+		t.conns[conn] = state
+	}
+}
+
+// active returns the connections serving a request, which Shutdown waits for
+func (t *connTracker) active() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	active := 0
+	for _, state := range t.conns {
+		if state == http.StateActive {
+			active++
+		}
+	}
+	return active
+}
+
+// drainFields describes what is holding up the shutdown
+func (di *DataIngestor) drainFields(conns *connTracker) logrus.Fields {
+	return logrus.Fields{
+		"active_connections": conns.active(),
+		"stream_clients":     di.stream.serving.Load(),
+		"manual_ingestions":  di.ingestLimit.Stats().InFlight,
+	}
+}
+
+// drainServer shuts the HTTP server down, logging every drainLogInterval
+// which connections it is still waiting for until they finished or ctx
+// expired
+func (di *DataIngestor) drainServer(ctx context.Context, server *http.Server, conns *connTracker) error {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(drainLogInterval)
+		defer ticker.Stop()
+		for {
+			if conns.active() > 0 {
+				di.logger.WithFields(di.drainFields(conns)).Info("Waiting for connections to finish")
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	err := server.Shutdown(ctx)
+	close(done)
+	if err != nil {
+		di.logger.WithFields(di.drainFields(conns)).WithError(err).Error("Server forced to shutdown")
+	}
+	return err
+}
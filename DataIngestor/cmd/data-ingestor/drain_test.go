@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// runIngestor serves ingestor on a local listener and returns its address
+// and the channel Run's result is sent to
+func runIngestor(t *testing.T, ctx context.Context, ingestor *DataIngestor) (string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	done := make(chan error, 1)
+	go func() { done <- ingestor.Run(ctx, listener) }()
+	return "http://" + listener.Addr().String(), done
+}
+
+func TestShutdown_StreamClientsGetShutdownEvent(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, done := runIngestor(t, ctx, ingestor)
+
+	var resp *http.Response
+	require.Eventually(t, func() bool {
+		var err error
+		resp, err = http.Get(addr + "/stream")
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+	defer resp.Body.Close()
+	waitForClients(t, ingestor, 1)
+
+	cancel()
+	body, err := io.ReadAll(bufio.NewReader(resp.Body))
+	require.NoError(t, err, "the stream ends cleanly")
+	assert.Equal(t, "event: shutdown\nretry: 5000\ndata: {\"message\":\"server is shutting down\"}\n\n", string(body))
+	require.NoError(t, <-done)
+
+	_, err = http.Get(addr + "/stream")
+	assert.Error(t, err, "no new connections after the drain")
+}
+
+func TestShutdown_LogsBlockingConnections(t *testing.T) {
+	upstream := newSlowUpstream(t, 1)
+	ingestor, _ := newLimitedIngestor(t, upstream, IngestLimitConfig{})
+	logger, hook := test.NewNullLogger()
+	ingestor.logger = logger
+
+	ctx, cancel := context.WithCancel(context.Background())
+	addr, done := runIngestor(t, ctx, ingestor)
+
+	ingested := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(addr+"/ingest", "application/json", nil)
+		if err != nil {
+			ingested <- 0
+			return
+		}
+		resp.Body.Close()
+		ingested <- resp.StatusCode
+	}()
+	<-upstream.started
+
+	cancel()
+	require.Eventually(t, func() bool {
+		for _, entry := range hook.AllEntries() {
+			if entry.Message == "Waiting for connections to finish" {
+				assert.Equal(t, 1, entry.Data["active_connections"])
+				assert.Equal(t, int64(1), entry.Data["manual_ingestions"])
+				assert.Equal(t, int64(0), entry.Data["stream_clients"])
+				return true
+			}
+		}
+		return false
+	}, time.Second, 5*time.Millisecond)
+
+	// The in-flight ingestion completes before the server stops
+	close(upstream.release)
+	assert.Equal(t, http.StatusOK, <-ingested)
+	require.NoError(t, <-done)
+}
+
+func TestStreamHub_CloseMarksClients(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	client, _, err := ingestor.stream.subscribe("", "")
+	require.NoError(t, err)
+	dropped, _, err := ingestor.stream.subscribe("", "")
+	require.NoError(t, err)
+	ingestor.stream.unsubscribe(dropped)
+
+	assert.Equal(t, 1, ingestor.stream.Close())
+	_, ok := <-client.events
+	assert.False(t, ok)
+	assert.True(t, client.shutdown)
+	assert.False(t, dropped.shutdown, "clients that left earlier get no shutdown event")
+}
+
+func TestConnTracker(t *testing.T) {
+	tracker := newConnTracker()
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	tracker.track(a, http.StateNew)
+	assert.Zero(t, tracker.active())
+	tracker.track(a, http.StateActive)
+	tracker.track(b, http.StateActive)
+	assert.Equal(t, 2, tracker.active())
+	tracker.track(a, http.StateIdle)
+	tracker.track(b, http.StateHijacked)
+	assert.Zero(t, tracker.active())
+	tracker.track(a, http.StateClosed)
+	assert.Empty(t, tracker.conns)
+}
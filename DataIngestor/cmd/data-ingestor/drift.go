@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// QueueDrift is a difference between the configured queue and the queue on
+// the broker. AMQP doesn't expose queue arguments, so drift is found when the
+// broker rejects our declare, and its reason names the argument.
+type QueueDrift struct {
+	Queue string `json:"queue"`
+	// Argument is the queue argument or property the broker named, if any
+	Argument string `json:"argument,omitempty"`
+	// Expected is the configured value of Argument; nil when we don't set it
+	Expected   interface{} `json:"expected,omitempty"`
+	Reason     string      `json:"reason"`
+	DetectedAt time.Time   `json:"detected_at"`
+}
+
+// inequivalentArg extracts the argument from RabbitMQ's 406 reply text, e.g.
+// "PRECONDITION_FAILED - inequivalent arg 'x-max-priority' for queue ..."
+var inequivalentArg = regexp.MustCompile(`inequivalent arg '([^']+)'`)
+
+// declareQueue checks the queue with a passive declare and then declares it.
+// The broker closes the channel on a passive declare of a missing queue (404)
+// and on a declare that doesn't match the existing queue (406); reopen
+// replaces it then. A mismatch is returned as drift rather than an error, and
+// the queue is published to as it is on the broker.
+func (di *DataIngestor) declareQueue(channel amqpChannel, reopen func() (amqpChannel, error)) (*QueueDrift, error) {
+	name := di.config.RabbitMQ.QueueName
+	args := di.config.queueArguments()
+
+	if _, err := channel.QueueInspect(name); err != nil {
+		if !isAMQPCode(err, amqp.NotFound) {
+			return nil, fmt.Errorf("failed to inspect queue: %w", err)
+		}
+		// The queue doesn't exist yet, so there is nothing to drift from
+		if channel, err = reopen(); err != nil {
+			return nil, fmt.Errorf("failed to reopen channel: %w", err)
+		}
+	}
+
+	_, err := channel.QueueDeclare(
+		name,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		args,
+	)
+	if err == nil {
+		return nil, nil
+	}
+	if !isAMQPCode(err, amqp.PreconditionFailed) {
+		return nil, fmt.Errorf("failed to declare queue: %w", err)
+	}
+	drift := newQueueDrift(name, args, err)
+	if _, err := reopen(); err != nil {
+		return nil, fmt.Errorf("failed to reopen channel: %w", err)
+	}
+	return drift, nil
+}
+
+// newQueueDrift describes the mismatch the broker reported in err
+func newQueueDrift(queue string, args amqp.Table, err error) *QueueDrift {
+	drift := &QueueDrift{Queue: queue, Reason: err.Error(), DetectedAt: time.Now()}
+	var amqpErr *amqp.Error
+	if errors.As(err, &amqpErr) {
+		drift.Reason = amqpErr.Reason
+	}
+	if match := inequivalentArg.FindStringSubmatch(drift.Reason); match != nil {
+		drift.Argument = match[1]
+		switch drift.Argument {
+		case "durable":
+			drift.Expected = true
+		case "auto_delete", "exclusive":
+			drift.Expected = false
+		default:
+			drift.Expected = args[drift.Argument]
+		}
+	}
+	return drift
+}
+
+func isAMQPCode(err error, code int) bool {
+	var amqpErr *amqp.Error
+	return errors.As(err, &amqpErr) && amqpErr.Code == code
+}
+
+// logQueueDrift reports drift of a newly installed connection
+func (di *DataIngestor) logQueueDrift(drift *QueueDrift, broker string) {
+	di.logger.WithFields(logrus.Fields{
+		"broker":   broker,
+		"queue":    drift.Queue,
+		"argument": drift.Argument,
+		"expected": drift.Expected,
+		"reason":   drift.Reason,
+		"strict":   di.config.RabbitMQ.StrictDeclare,
+	}).Warn("Queue on the broker differs from the configuration, publishing to it as it is")
+}
+
+// currentQueueDrift returns the drift found on the active connection
+func (di *DataIngestor) currentQueueDrift() *QueueDrift {
+	di.connMu.Lock()
+	defer di.connMu.Unlock()
+	return di.queueDrift
+}
+
+// inspectQueue looks the queue up on a channel of its own, since a passive
+// declare of a missing queue closes the channel
+func (di *DataIngestor) inspectQueue(name string) (amqp.Queue, error) {
+	return di.inspectQueueContext(context.Background(), name)
+}
+
+// inspectQueueContext is inspectQueue that closes its channel once ctx is
+// done, which ends an inspect still waiting for the broker
+func (di *DataIngestor) inspectQueueContext(ctx context.Context, name string) (amqp.Queue, error) {
+	di.connMu.Lock()
+	open, state := di.openChannel, di.connState
+	di.connMu.Unlock()
+	if state != StateReady || open == nil {
+		return amqp.Queue{}, fmt.Errorf("%w (connection is %s)", ErrNotConnected, state)
+	}
+
+	channel, err := open()
+	if err != nil {
+		return amqp.Queue{}, fmt.Errorf("failed to open channel: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { channel.Close() })
+	defer func() {
+		if stop() {
+			channel.Close()
+		}
+	}()
+	return channel.QueueInspect(name)
+}
+
+// handleQueue shows the broker's view of the queue next to the configuration
+func (di *DataIngestor) handleQueue(c *gin.Context) {
+	name := di.config.RabbitMQ.QueueName
+	queue, err := di.inspectQueue(name)
+	switch {
+	case errors.Is(err, ErrNotConnected):
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	case isAMQPCode(err, amqp.NotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("queue %q does not exist on the broker", name)})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+
+	arguments := gin.H{}
+	for key, value := range di.config.queueArguments() {
+		arguments[key] = value
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"queue": name,
+		"broker": gin.H{
+			"messages":  queue.Messages,
+			"consumers": queue.Consumers,
+		},
+		"config": gin.H{
+			"durable":   true,
+			"arguments": arguments,
+		},
+		"drift":  di.currentQueueDrift(),
+		"strict": di.config.RabbitMQ.StrictDeclare,
+	})
+}
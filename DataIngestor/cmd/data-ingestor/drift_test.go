@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// strictChannel is a fakeChannel whose passive and active declares fail like
+// a broker's would, closing the channel
+type strictChannel struct {
+	*fakeChannel
+	inspectErr error
+	declareErr error
+}
+
+func (s *strictChannel) QueueInspect(name string) (amqp.Queue, error) {
+	if s.inspectErr != nil {
+		s.Close()
+		return amqp.Queue{}, s.inspectErr
+	}
+	return s.fakeChannel.QueueInspect(name)
+}
+
+func (s *strictChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if s.declareErr != nil {
+		s.Close()
+		return amqp.Queue{}, s.declareErr
+	}
+	return s.fakeChannel.QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+// reopener hands out fresh fake channels and counts them
+func reopener(opened *[]*fakeChannel) func() (amqpChannel, error) {
+	return func() (amqpChannel, error) {
+		channel := &fakeChannel{}
+		*opened = append(*opened, channel)
+		return channel, nil
+	}
+}
+
+var errInequivalentPriority = &amqp.Error{
+	Code:   amqp.PreconditionFailed,
+	Reason: "PRECONDITION_FAILED - inequivalent arg 'x-max-priority' for queue 'meter-data-queue' in vhost '/': received the value '5' of type 'signedint' but current is none",
+}
+
+func newDriftTestIngestor(t *testing.T) *DataIngestor {
+	t.Helper()
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.config.RabbitMQ.MaxPriority = 5
+	return ingestor
+}
+
+func TestDeclareQueue_MissingQueue(t *testing.T) {
+	ingestor := newDriftTestIngestor(t)
+	channel := &strictChannel{fakeChannel: &fakeChannel{}, inspectErr: &amqp.Error{Code: amqp.NotFound, Reason: "NOT_FOUND - no queue 'meter-data-queue'"}}
+	var opened []*fakeChannel
+
+	drift, err := ingestor.declareQueue(channel, reopener(&opened))
+	require.NoError(t, err)
+	assert.Nil(t, drift)
+	require.Len(t, opened, 1, "the channel closed by the 404 is replaced")
+	require.Len(t, opened[0].declared(), 1)
+	assert.Equal(t, amqp.Table{"x-max-priority": int32(5)}, opened[0].declared()[0].Args)
+}
+
+func TestDeclareQueue_Matching(t *testing.T) {
+	ingestor := newDriftTestIngestor(t)
+	channel := &fakeChannel{}
+	var opened []*fakeChannel
+
+	drift, err := ingestor.declareQueue(channel, reopener(&opened))
+	require.NoError(t, err)
+	assert.Nil(t, drift)
+	assert.Empty(t, opened)
+	assert.Len(t, channel.declared(), 1)
+}
+
+func TestDeclareQueue_Drift(t *testing.T) {
+	ingestor := newDriftTestIngestor(t)
+	channel := &strictChannel{fakeChannel: &fakeChannel{}, declareErr: errInequivalentPriority}
+	var opened []*fakeChannel
+
+	drift, err := ingestor.declareQueue(channel, reopener(&opened))
+	require.NoError(t, err, "drift does not fail the connection")
+	require.NotNil(t, drift)
+	assert.Equal(t, "meter-data-queue", drift.Queue)
+	assert.Equal(t, "x-max-priority", drift.Argument)
+	assert.Equal(t, int32(5), drift.Expected)
+	assert.Contains(t, drift.Reason, "current is none")
+	assert.Len(t, opened, 1, "the channel closed by the 406 is replaced")
+}
+
+func TestDeclareQueue_OtherErrors(t *testing.T) {
+	ingestor := newDriftTestIngestor(t)
+	var opened []*fakeChannel
+
+	_, err := ingestor.declareQueue(&strictChannel{fakeChannel: &fakeChannel{}, declareErr: &amqp.Error{Code: amqp.AccessRefused}}, reopener(&opened))
+	assert.ErrorContains(t, err, "failed to declare queue")
+
+	_, err = ingestor.declareQueue(&strictChannel{fakeChannel: &fakeChannel{}, inspectErr: errors.New("channel closed")}, reopener(&opened))
+	assert.ErrorContains(t, err, "failed to inspect queue")
+	assert.Empty(t, opened)
+}
+
+func TestNewQueueDrift_Durable(t *testing.T) {
+	drift := newQueueDrift("meter-data-queue", nil, &amqp.Error{
+		Code:   amqp.PreconditionFailed,
+		Reason: "PRECONDITION_FAILED - inequivalent arg 'durable' for queue 'meter-data-queue' in vhost '/': received 'true' but current is 'false'",
+	})
+	assert.Equal(t, "durable", drift.Argument)
+	assert.Equal(t, true, drift.Expected)
+}
+
+// installDrift makes the ingestor look connected to a broker that rejected
+// the queue declare
+func installDrift(ingestor *DataIngestor, channel *fakeChannel) {
+	ingestor.connMu.Lock()
+	defer ingestor.connMu.Unlock()
+	ingestor.install(&brokerConn{
+		conn:        channel,
+		channel:     channel,
+		confirms:    make(chan amqp.Confirmation),
+		drift:       newQueueDrift("meter-data-queue", ingestor.config.queueArguments(), errInequivalentPriority),
+		openChannel: func() (amqpChannel, error) { return channel, nil },
+	}, 0)
+}
+
+func TestReady_QueueDrift(t *testing.T) {
+	for _, strict := range []bool{false, true} {
+		ingestor := newDriftTestIngestor(t)
+		ingestor.config.RabbitMQ.StrictDeclare = strict
+		installDrift(ingestor, &fakeChannel{})
+
+		w := adminRequest(setupRoutes(ingestor), http.MethodGet, "/ready")
+		var body struct {
+			Ready  bool              `json:"ready"`
+			Checks map[string]string `json:"checks"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.Contains(t, body.Checks["queue"], "drift: PRECONDITION_FAILED")
+		if strict {
+			assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+			assert.False(t, body.Ready)
+		} else {
+			assert.Equal(t, http.StatusOK, w.Code, "drift only degrades readiness with strict_declare")
+			assert.True(t, body.Ready)
+		}
+	}
+}
+
+func TestAdminQueue(t *testing.T) {
+	ingestor := newDriftTestIngestor(t)
+	router := setupRoutes(ingestor)
+
+	w := adminRequest(router, http.MethodGet, "/admin/queue")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "fake channels attached without a connection can't open channels")
+
+	installDrift(ingestor, &fakeChannel{depth: 42})
+	w = adminRequest(router, http.MethodGet, "/admin/queue")
+	require.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Queue  string `json:"queue"`
+		Broker struct {
+			Messages  int `json:"messages"`
+			Consumers int `json:"consumers"`
+		} `json:"broker"`
+		Config struct {
+			Durable   bool                   `json:"durable"`
+			Arguments map[string]interface{} `json:"arguments"`
+		} `json:"config"`
+		Drift *QueueDrift `json:"drift"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "meter-data-queue", body.Queue)
+	assert.Equal(t, 42, body.Broker.Messages)
+	assert.True(t, body.Config.Durable)
+	assert.Equal(t, 5.0, body.Config.Arguments["x-max-priority"])
+	require.NotNil(t, body.Drift)
+	assert.Equal(t, "x-max-priority", body.Drift.Argument)
+
+	ingestor.connMu.Lock()
+	ingestor.openChannel = func() (amqpChannel, error) {
+		return &strictChannel{fakeChannel: &fakeChannel{}, inspectErr: &amqp.Error{Code: amqp.NotFound}}, nil
+	}
+	ingestor.connMu.Unlock()
+	w = adminRequest(router, http.MethodGet, "/admin/queue")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
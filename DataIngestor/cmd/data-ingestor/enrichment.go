@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// defaultMetadataReloadInterval is how often the metadata file checksum is checked
+const defaultMetadataReloadInterval = 30 * time.Second
+
+// EnrichmentConfig configures location metadata enrichment
+type EnrichmentConfig struct {
+	// MetadataFile is a YAML or CSV file mapping locations to metadata.
+	// Enrichment is disabled when it is empty.
+	MetadataFile   string   `yaml:"metadata_file"`
+	ReloadInterval Duration `yaml:"reload_interval"`
+}
+
+// LocationMetadata describes where a location is
+type LocationMetadata struct {
+	Lat       float64 `yaml:"lat" json:"lat"`
+	Lon       float64 `yaml:"lon" json:"lon"`
+	Country   string  `yaml:"country" json:"country"`
+	AltitudeM float64 `yaml:"altitude_m" json:"altitude_m"`
+	// Validation overrides the global bounds for this location. It is not
+	// published with the reading.
+	Validation *LocationValidation `yaml:"validation" json:"-"`
+}
+
+// metadataFile is the YAML layout of the metadata file
+type metadataFile struct {
+	Locations map[string]LocationMetadata `yaml:"locations"`
+	Aliases   map[string]string           `yaml:"aliases"`
+}
+
+// Enricher attaches location metadata to readings
+type Enricher struct {
+	path   string
+	logger *logrus.Logger
+
+	mu        sync.RWMutex
+	locations map[string]LocationMetadata
+	aliases   map[string]string
+	checksum  [sha256.Size]byte
+
+	warnedMu sync.Mutex
+	warned   map[string]bool
+}
+
+// NewEnricher loads the metadata file at path
+func NewEnricher(path string, logger *logrus.Logger) (*Enricher, error) {
+	e := &Enricher{
+		path:   path,
+		logger: logger,
+		warned: make(map[string]bool),
+	}
+	if _, err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload re-reads the metadata file if its checksum changed. It reports
+// whether new metadata was applied; on error the previous metadata is kept.
+func (e *Enricher) Reload() (bool, error) {
+	raw, err := os.ReadFile(e.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read metadata file: %w", err)
+	}
+
+	checksum := sha256.Sum256(raw)
+	e.mu.RLock()
+	unchanged := checksum == e.checksum
+	e.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	parsed, err := parseMetadata(e.path, raw)
+	if err != nil {
+		return false, err
+	}
+
+	locations := make(map[string]LocationMetadata, len(parsed.Locations))
+	for name, meta := range parsed.Locations {
+		if meta.Validation != nil {
+			if err := meta.Validation.Validate(); err != nil {
+				return false, fmt.Errorf("location %q: validation.%w", name, err)
+			}
+		}
+		locations[normalizeLocation(name)] = meta
+	}
+	aliases := make(map[string]string, len(parsed.Aliases))
+	for alias, name := range parsed.Aliases {
+		aliases[normalizeLocation(alias)] = normalizeLocation(name)
+	}
+
+	e.mu.Lock()
+	e.locations = locations
+	e.aliases = aliases
+	e.checksum = checksum
+	e.mu.Unlock()
+
+	// Locations may have been added, so warn again if they are still unknown
+	e.warnedMu.Lock()
+	e.warned = make(map[string]bool)
+	e.warnedMu.Unlock()
+
+	e.logger.WithFields(logrus.Fields{
+		"file":      e.path,
+		"locations": len(locations),
+		"aliases":   len(aliases),
+	}).Info("Location metadata loaded")
+	return true, nil
+}
+
+// Lookup returns the metadata for a location, resolving aliases. Names are
+// compared case-insensitively.
+func (e *Enricher) Lookup(location string) (LocationMetadata, bool) {
+	key := normalizeLocation(location)
+
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if canonical, ok := e.aliases[key]; ok {
+		key = canonical
+	}
+	meta, ok := e.locations[key]
+	return meta, ok
+}
+
+// Enrich attaches metadata to every reading with a known location. Unknown
+// locations are logged once until the next reload.
+func (e *Enricher) Enrich(data WeatherData) {
+	for i := range data {
+		meta, ok := e.Lookup(data[i].Location())
+		if !ok {
+			e.warnUnknown(data[i].Location())
+			continue
+		}
+		data[i].Metadata = &meta
+	}
+}
+
+func (e *Enricher) warnUnknown(location string) {
+	key := normalizeLocation(location)
+
+	e.warnedMu.Lock()
+	defer e.warnedMu.Unlock()
+	if e.warned[key] {
+		return
+	}
+	e.warned[key] = true
+	e.logger.WithField("location", location).Warn("No metadata for location")
+}
+
+// Watch reloads the metadata file whenever its checksum changes until ctx is done
+func (e *Enricher) Watch(ctx context.Context, interval time.Duration) {
+	if interval <= 0 {
+		interval = defaultMetadataReloadInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if _, err := e.Reload(); err != nil {
+				e.logger.WithError(err).Error("Failed to reload location metadata")
+			}
+		}
+	}
+}
+
+func normalizeLocation(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+// parseMetadata decodes the file as CSV when it has a .csv extension and as YAML otherwise
+func parseMetadata(path string, raw []byte) (*metadataFile, error) {
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		return parseMetadataCSV(raw)
+	}
+
+	var parsed metadataFile
+	if err := yaml.Unmarshal(raw, &parsed); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal metadata file: %w", err)
+	}
+	return &parsed, nil
+}
+
+// parseMetadataCSV reads rows of location,lat,lon,country,altitude_m with a header row
+func parseMetadataCSV(raw []byte) (*metadataFile, error) {
+	reader := csv.NewReader(bytes.NewReader(raw))
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metadata header: %w", err)
+	}
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, required := range []string{"location", "lat", "lon"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("metadata file is missing the %q column", required)
+		}
+	}
+
+	parsed := &metadataFile{Locations: make(map[string]LocationMetadata)}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metadata line %d: %w", line, err)
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		number := func(name string) (float64, error) {
+			value := field(name)
+			if value == "" {
+				return 0, nil
+			}
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return 0, fmt.Errorf("metadata line %d: invalid %s %q", line, name, value)
+			}
+			return n, nil
+		}
+
+		var meta LocationMetadata
+		if meta.Lat, err = number("lat"); err != nil {
+			return nil, err
+		}
+		if meta.Lon, err = number("lon"); err != nil {
+			return nil, err
+		}
+		if meta.AltitudeM, err = number("altitude_m"); err != nil {
+			return nil, err
+		}
+		meta.Country = field("country")
+		parsed.Locations[field("location")] = meta
+	}
+	return parsed, nil
+}
+
+// LoadEnrichment loads the metadata file when enrichment is configured
+func (di *DataIngestor) LoadEnrichment() error {
+	if di.config.Enrichment.MetadataFile == "" {
+		return nil
+	}
+	enricher, err := NewEnricher(di.config.Enrichment.MetadataFile, di.logger)
+	if err != nil {
+		return fmt.Errorf("failed to load location metadata: %w", err)
+	}
+	di.enricher = enricher
+	return nil
+}
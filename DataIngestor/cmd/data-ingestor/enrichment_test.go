@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testMetadataYAML = `
+locations:
+  Moscow:
+    lat: 55.75
+    lon: 37.62
+    country: RU
+    altitude_m: 156
+aliases:
+  MSK: moscow
+`
+
+func newTestEnricher(t *testing.T, name, content string) (*Enricher, string, *bytes.Buffer) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	var logs bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logs)
+
+	enricher, err := NewEnricher(path, logger)
+	require.NoError(t, err)
+	return enricher, path, &logs
+}
+
+func TestEnricher_LookupCaseInsensitiveAndAliases(t *testing.T) {
+	enricher, _, _ := newTestEnricher(t, "locations.yaml", testMetadataYAML)
+
+	for _, name := range []string{"Moscow", "moscow", " MOSCOW ", "msk", "Msk"} {
+		meta, ok := enricher.Lookup(name)
+		require.True(t, ok, name)
+		assert.Equal(t, LocationMetadata{Lat: 55.75, Lon: 37.62, Country: "RU", AltitudeM: 156}, meta)
+	}
+}
+
+func TestEnricher_UnknownLocationWarnsOnce(t *testing.T) {
+	enricher, _, logs := newTestEnricher(t, "locations.yaml", testMetadataYAML)
+
+	data := WeatherData{
+		{Type: "energy", Name: "Atlantis"},
+		{Type: "energy", Name: "atlantis"},
+		{Type: "energy", Name: "moscow"},
+	}
+	enricher.Enrich(data)
+	enricher.Enrich(data)
+
+	assert.Nil(t, data[0].Metadata)
+	assert.Nil(t, data[1].Metadata)
+	require.NotNil(t, data[2].Metadata)
+	assert.Equal(t, "RU", data[2].Metadata.Country)
+	assert.Equal(t, 1, bytes.Count(logs.Bytes(), []byte("No metadata for location")))
+}
+
+func TestEnricher_Reload(t *testing.T) {
+	enricher, path, logs := newTestEnricher(t, "locations.yaml", testMetadataYAML)
+
+	// Unchanged checksum is a no-op
+	changed, err := enricher.Reload()
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	enricher.Enrich(WeatherData{{Name: "berlin"}})
+
+	require.NoError(t, os.WriteFile(path, []byte(`
+locations:
+  Moscow: {lat: 55.75, lon: 37.62, country: RU, altitude_m: 156}
+  Berlin: {lat: 52.52, lon: 13.40, country: DE, altitude_m: 34}
+`), 0o644))
+
+	changed, err = enricher.Reload()
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	meta, ok := enricher.Lookup("berlin")
+	require.True(t, ok)
+	assert.Equal(t, "DE", meta.Country)
+	_, ok = enricher.Lookup("msk")
+	assert.False(t, ok, "aliases are replaced along with locations")
+
+	// A broken file keeps the previous metadata
+	require.NoError(t, os.WriteFile(path, []byte("locations: [oops"), 0o644))
+	_, err = enricher.Reload()
+	assert.Error(t, err)
+	_, ok = enricher.Lookup("berlin")
+	assert.True(t, ok)
+
+	// Unknown-location warnings reset on reload
+	enricher.Enrich(WeatherData{{Name: "atlantis"}})
+	assert.Equal(t, 2, bytes.Count(logs.Bytes(), []byte("No metadata for location")))
+}
+
+func TestEnricher_CSV(t *testing.T) {
+	enricher, _, _ := newTestEnricher(t, "locations.csv", "location,lat,lon,country,altitude_m\nReykjavik, 64.15, -21.94, IS, 61\n")
+
+	meta, ok := enricher.Lookup("REYKJAVIK")
+	require.True(t, ok)
+	assert.Equal(t, LocationMetadata{Lat: 64.15, Lon: -21.94, Country: "IS", AltitudeM: 61}, meta)
+}
+
+func TestEnricher_CSVErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "locations.csv")
+
+	require.NoError(t, os.WriteFile(path, []byte("name,lat\nx,1\n"), 0o644))
+	_, err := NewEnricher(path, logrus.New())
+	assert.ErrorContains(t, err, `"location"`)
+
+	require.NoError(t, os.WriteFile(path, []byte("location,lat,lon\nx,north,1\n"), 0o644))
+	_, err = NewEnricher(path, logrus.New())
+	assert.ErrorContains(t, err, "line 2")
+}
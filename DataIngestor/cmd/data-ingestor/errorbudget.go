@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultBudgetRatio           = 0.2
+	defaultErrorBudgetWindow     = 15 * time.Minute
+	defaultErrorBudgetMinFetches = 10
+	errorBudgetAlertTimeout      = 5 * time.Second
+)
+
+// Reduced modes error_budget.mode selects
+const (
+	budgetModePaused     = "paused"
+	budgetModeHeartbeats = "heartbeats"
+)
+
+// Error budget states
+const (
+	budgetNormal  = "normal"
+	budgetReduced = "reduced"
+)
+
+// Operator overrides of POST /admin/error-budget
+const (
+	budgetOverrideAuto   = "auto"
+	budgetOverridePause  = "pause"
+	budgetOverrideResume = "resume"
+)
+
+// ErrorBudgetConfig pauses polling, or reduces it to heartbeats, while too
+// many upstream fetches fail, and resumes once the failure ratio recovers
+type ErrorBudgetConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MaxFailureRatio of the fetches in the window exhausts the budget, 0.2
+	// by default
+	MaxFailureRatio float64 `yaml:"max_failure_ratio"`
+	// ResumeRatio is the failure ratio at or below which polling resumes,
+	// half of MaxFailureRatio by default
+	ResumeRatio float64 `yaml:"resume_ratio"`
+	// Window is the rolling window fetches are counted over, 15m by default
+	Window Duration `yaml:"window"`
+	// MinFetches in the window are needed before the budget can run out, 10
+	// by default
+	MinFetches int `yaml:"min_fetches"`
+	// Mode is what polling is reduced to: paused, the default, or
+	// heartbeats
+	Mode string `yaml:"mode"`
+	// AlertURL is POSTed every decision, signed with AlertSecret like
+	// subscriber deliveries
+	AlertURL    string `yaml:"alert_url"`
+	AlertSecret string `yaml:"alert_secret"`
+}
+
+// Validate checks the ratios, the mode and the alert URL
+func (c ErrorBudgetConfig) Validate() error {
+	if c.MaxFailureRatio < 0 || c.MaxFailureRatio >= 1 {
+		return fmt.Errorf("error_budget.max_failure_ratio must be between 0 and 1, got %g", c.MaxFailureRatio)
+	}
+	if c.ResumeRatio < 0 || c.ResumeRatio > c.maxFailureRatio() {
+		return fmt.Errorf("error_budget.resume_ratio must be between 0 and max_failure_ratio %g, got %g", c.maxFailureRatio(), c.ResumeRatio)
+	}
+	if c.Window < 0 || c.MinFetches < 0 {
+		return fmt.Errorf("error_budget.window and error_budget.min_fetches must not be negative")
+	}
+	switch c.Mode {
+	case "", budgetModePaused, budgetModeHeartbeats:
+	default:
+		return fmt.Errorf("error_budget.mode must be %s or %s, got %q", budgetModePaused, budgetModeHeartbeats, c.Mode)
+	}
+	if c.AlertURL != "" {
+		u, err := url.Parse(c.AlertURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("error_budget.alert_url must be an absolute http(s) URL, got %q", c.AlertURL)
+		}
+	}
+	return nil
+}
+
+func (c ErrorBudgetConfig) maxFailureRatio() float64 {
+	if c.MaxFailureRatio <= 0 {
+		return defaultBudgetRatio
+	}
+	return c.MaxFailureRatio
+}
+
+func (c ErrorBudgetConfig) resumeRatio() float64 {
+	if c.ResumeRatio <= 0 {
+		return c.maxFailureRatio() / 2
+	}
+	return c.ResumeRatio
+}
+
+func (c ErrorBudgetConfig) window() time.Duration {
+	if c.Window <= 0 {
+		return defaultErrorBudgetWindow
+	}
+	return time.Duration(c.Window)
+}
+
+func (c ErrorBudgetConfig) minFetches() int {
+	if c.MinFetches <= 0 {
+		return defaultErrorBudgetMinFetches
+	}
+	return c.MinFetches
+}
+
+func (c ErrorBudgetConfig) mode() string {
+	if c.Mode == "" {
+		return budgetModePaused
+	}
+	return c.Mode
+}
+
+// ErrorBudgetStatus is the error budget section of /ingestion/status
+type ErrorBudgetStatus struct {
+	// State is normal or reduced; Polling is what polling does now, normal,
+	// paused or heartbeats, with the override applied
+	State           string       `json:"state"`
+	Polling         string       `json:"polling"`
+	Override        string       `json:"override"`
+	Window          BudgetWindow `json:"window"`
+	MaxFailureRatio float64      `json:"max_failure_ratio"`
+	ResumeRatio     float64      `json:"resume_ratio"`
+	Since           time.Time    `json:"since"`
+}
+
+// BudgetWindow counts the fetches in the rolling window
+type BudgetWindow struct {
+	Length   string `json:"length"`
+	Fetches  int    `json:"fetches"`
+	Failures int    `json:"failures"`
+	// MissedTicks are the poll ticks an overrunning cycle held up. They are
+	// counted in Fetches and Failures.
+	MissedTicks int     `json:"missed_ticks"`
+	Ratio       float64 `json:"ratio"`
+}
+
+func (w BudgetWindow) fields() logrus.Fields {
+	return logrus.Fields{
+		"window":   w.Length,
+		"fetches":  w.Fetches,
+		"failures": w.Failures,
+		"missed":   w.MissedTicks,
+		"ratio":    w.Ratio,
+	}
+}
+
+// budgetAlert is the body POSTed to error_budget.alert_url
+type budgetAlert struct {
+	Service  string       `json:"service"`
+	Instance string       `json:"instance"`
+	Event    string       `json:"event"`
+	Polling  string       `json:"polling"`
+	Window   BudgetWindow `json:"window"`
+	Time     time.Time    `json:"time"`
+}
+
+type fetchOutcome struct {
+	at     time.Time
+	failed bool
+	// missed is a poll tick that was not fetched on time
+	missed bool
+}
+
+// errorBudget counts fetch outcomes over a rolling window and decides when
+// polling is reduced. A nil budget never reduces polling.
+type errorBudget struct {
+	config  ErrorBudgetConfig
+	logger  *logrus.Logger
+	metrics *Metrics
+	now     func() time.Time
+	// alert sends a decision to the alert webhook; replaced in tests
+	alert func(budgetAlert)
+
+	mu       sync.Mutex
+	outcomes []fetchOutcome
+	state    string
+	override string
+	since    time.Time
+}
+
+// newErrorBudget returns nil unless error_budget is enabled
+func (di *DataIngestor) newErrorBudget() *errorBudget {
+	config := di.config.ErrorBudget
+	if !config.Enabled {
+		return nil
+	}
+	b := &errorBudget{
+		config:   config,
+		logger:   di.logger,
+		metrics:  di.metrics,
+		now:      time.Now,
+		state:    budgetNormal,
+		override: budgetOverrideAuto,
+	}
+	b.since = b.now()
+	b.alert = func(alert budgetAlert) {
+		alert.Instance = di.instanceID
+		go di.sendBudgetAlert(alert)
+	}
+	return b
+}
+
+// record counts one fetch outcome and re-evaluates the budget
+func (b *errorBudget) record(failed bool) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.outcomes = append(b.outcomes, fetchOutcome{at: now, failed: failed})
+	b.evaluateLocked(now)
+}
+
+// missed counts n poll ticks an overrunning cycle held up as failed fetches,
+// so a slow upstream spends the budget as a failing one does, instead of
+// only being fetched less often
+func (b *errorBudget) missed(n int) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	for i := 0; i < n; i++ {
+		b.outcomes = append(b.outcomes, fetchOutcome{at: now, failed: true, missed: true})
+	}
+	b.evaluateLocked(now)
+}
+
+// polling re-evaluates the budget, so an idle window recovers, and returns
+// what polling does now: normal, paused or heartbeats
+func (b *errorBudget) polling() string {
+	if b == nil {
+		return budgetNormal
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.evaluateLocked(b.now())
+	return b.pollingLocked()
+}
+
+func (b *errorBudget) pollingLocked() string {
+	switch {
+	case b.override == budgetOverridePause:
+		return budgetModePaused
+	case b.override == budgetOverrideResume, b.state == budgetNormal:
+		return budgetNormal
+	}
+	return b.config.mode()
+}
+
+// windowLocked drops the outcomes older than the window and counts the
+// rest. Callers hold mu.
+func (b *errorBudget) windowLocked(now time.Time) BudgetWindow {
+	cutoff := now.Add(-b.config.window())
+	kept := b.outcomes[:0]
+	for _, outcome := range b.outcomes {
+		if outcome.at.After(cutoff) {
+			kept = append(kept, outcome)
+		}
+	}
+	b.outcomes = kept
+
+	w := BudgetWindow{Length: b.config.window().String(), Fetches: len(kept)}
+	for _, outcome := range kept {
+		if outcome.failed {
+			w.Failures++
+		}
+		if outcome.missed {
+			w.MissedTicks++
+		}
+	}
+	if w.Fetches > 0 {
+		w.Ratio = float64(w.Failures) / float64(w.Fetches)
+	}
+	b.metrics.BudgetRatio.Set(w.Ratio)
+	return w
+}
+
+// evaluateLocked exhausts the budget above max_failure_ratio and recovers
+// it at or below resume_ratio. An override pins polling but not the state.
+// Callers hold mu.
+func (b *errorBudget) evaluateLocked(now time.Time) {
+	w := b.windowLocked(now)
+	switch {
+	case b.state == budgetNormal && w.Fetches >= b.config.minFetches() && w.Ratio > b.config.maxFailureRatio():
+		b.setStateLocked(budgetReduced, now, w)
+	case b.state == budgetReduced && w.Ratio <= b.config.resumeRatio():
+		b.setStateLocked(budgetNormal, now, w)
+	}
+}
+
+func (b *errorBudget) setStateLocked(state string, now time.Time, w BudgetWindow) {
+	b.state, b.since = state, now
+	b.metrics.BudgetTransitions.WithLabelValues(state).Inc()
+	polling := b.pollingLocked()
+	entry := b.logger.WithFields(w.fields()).WithFields(logrus.Fields{
+		"polling":  polling,
+		"override": b.override,
+	})
+	event := "exhausted"
+	if state == budgetReduced {
+		entry.WithField("max_failure_ratio", b.config.maxFailureRatio()).Warn("Error budget exhausted, reducing polling")
+	} else {
+		event = "recovered"
+		entry.WithField("resume_ratio", b.config.resumeRatio()).Info("Error budget recovered, resuming polling")
+	}
+	b.alert(budgetAlert{Service: "data-ingestor", Event: event, Polling: polling, Window: w, Time: now.UTC()})
+}
+
+// setOverride pins polling to pause or resume until set back to auto
+func (b *errorBudget) setOverride(override string) error {
+	switch override {
+	case budgetOverrideAuto, budgetOverridePause, budgetOverrideResume:
+	default:
+		return fmt.Errorf("mode must be %s, %s or %s, got %q", budgetOverrideAuto, budgetOverridePause, budgetOverrideResume, override)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.override == override {
+		return nil
+	}
+	now := b.now()
+	b.override = override
+	b.metrics.BudgetTransitions.WithLabelValues("override_" + override).Inc()
+	w := b.windowLocked(now)
+	polling := b.pollingLocked()
+	b.logger.WithFields(w.fields()).WithFields(logrus.Fields{
+		"override": override,
+		"state":    b.state,
+		"polling":  polling,
+	}).Warn("Error budget override set")
+	b.alert(budgetAlert{Service: "data-ingestor", Event: "override_" + override, Polling: polling, Window: w, Time: now.UTC()})
+	// Released, the window decides again right away
+	b.evaluateLocked(now)
+	return nil
+}
+
+// Status returns the budget state, nil when it is disabled
+func (b *errorBudget) Status() *ErrorBudgetStatus {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.evaluateLocked(now)
+	return &ErrorBudgetStatus{
+		State:           b.state,
+		Polling:         b.pollingLocked(),
+		Override:        b.override,
+		Window:          b.windowLocked(now),
+		MaxFailureRatio: b.config.maxFailureRatio(),
+		ResumeRatio:     b.config.resumeRatio(),
+		Since:           b.since,
+	}
+}
+
+// sendBudgetAlert POSTs a decision to error_budget.alert_url. Failures are
+// only logged; the decision stands either way.
+func (di *DataIngestor) sendBudgetAlert(alert budgetAlert) {
+	config := di.config.ErrorBudget
+	if config.AlertURL == "" {
+		return
+	}
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), errorBudgetAlertTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.AlertURL, bytes.NewReader(body))
+	if err != nil {
+		di.logger.WithError(err).Error("Failed to send error budget alert")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.AlertSecret != "" {
+		req.Header.Set(SignatureHeader, signPayload(config.AlertSecret, body))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		di.logger.WithError(err).Error("Failed to send error budget alert")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		di.logger.WithField("status", resp.StatusCode).Error("Error budget alert was rejected")
+	}
+}
+
+// heartbeat is published instead of the readings while polling is reduced
+// to heartbeats
+type heartbeat struct {
+	Type       string    `json:"type"`
+	Location   string    `json:"location"`
+	InstanceID string    `json:"instance_id"`
+	UpstreamOK bool      `json:"upstream_ok"`
+	Time       time.Time `json:"time"`
+}
+
+// heartbeatOnce fetches src, so the budget keeps measuring, and publishes a
+// heartbeat instead of the readings. The cursor does not move, so the
+// readings are fetched again once polling resumes.
+func (di *DataIngestor) heartbeatOnce(ctx context.Context, src *source) {
+	if err := src.allow(time.Now()); err != nil {
+		di.logger.WithField("location", src.name).WithError(err).Debug("Skipping heartbeat cycle")
+		return
+	}
+	_, err := di.fetchSource(ctx, src)
+	di.recordFetch(ctx, src, err)
+
+	body, err2 := json.Marshal(heartbeat{
+		Type:       "heartbeat",
+		Location:   src.name,
+		InstanceID: di.instanceID,
+		UpstreamOK: err == nil,
+		Time:       time.Now().UTC(),
+	})
+	if err2 != nil {
+		return
+	}
+	env := Envelope{CorrelationID: newMessageID(), InstanceID: di.instanceID}
+	// A heartbeat waits for a running tx batch, so it lands before or after
+	// the messages of the batch, not among them
+	di.txMu.Lock()
+	_, err = di.publishMessage("", di.config.RabbitMQ.QueueName, body, env)
+	di.txMu.Unlock()
+	if err != nil {
+		di.logger.WithField("location", src.name).WithError(err).Error("Failed to publish heartbeat")
+	}
+}
+
+// handleErrorBudget serves POST /admin/error-budget?mode=auto|pause|resume
+func (di *DataIngestor) handleErrorBudget(c *gin.Context) {
+	if di.budget == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "error budget is disabled",
+		})
+		return
+	}
+	if err := di.budget.setOverride(c.Query("mode")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, di.budget.Status())
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBudgetIngestor polls upstream with an error budget of 20% over 15m
+// from 10 fetches, on a fake clock. Alerts are collected instead of sent.
+func newBudgetIngestor(t *testing.T, upstream string, mode string) (*DataIngestor, *fakeClock, *[]budgetAlert) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API:         APIConfig{BaseURL: upstream, Timeout: Duration(time.Second), RetryCount: 1, RetryBackoff: Duration(time.Millisecond)},
+		RabbitMQ:    RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:       AdminConfig{Token: "letmein"},
+		Logging:     LoggingConfig{Level: "panic"},
+		ErrorBudget: ErrorBudgetConfig{Enabled: true, MaxFailureRatio: 0.2, Window: Duration(15 * time.Minute), MinFetches: 10, Mode: mode},
+	})
+	require.NotNil(t, ingestor.budget)
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	var alerts []budgetAlert
+	ingestor.budget.now = clock.Now
+	ingestor.budget.since = clock.Now()
+	ingestor.budget.alert = func(alert budgetAlert) { alerts = append(alerts, alert) }
+	return ingestor, clock, &alerts
+}
+
+// recordOutcomes records ok successes and failed failures, a second apart
+func recordOutcomes(b *errorBudget, clock *fakeClock, ok, failed int) {
+	for i := 0; i < ok+failed; i++ {
+		b.record(i >= ok)
+		clock.Advance(time.Second)
+	}
+}
+
+func TestErrorBudget_DisabledByDefault(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	assert.Nil(t, ingestor.budget)
+	assert.Equal(t, budgetNormal, ingestor.budget.polling())
+	assert.Nil(t, ingestor.budget.Status())
+	ingestor.budget.record(true)
+
+	w := adminRequest(setupRoutes(ingestor), http.MethodPost, "/admin/error-budget?mode=pause")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "error budget is disabled")
+}
+
+func TestErrorBudget_Validate(t *testing.T) {
+	assert.NoError(t, ErrorBudgetConfig{}.Validate())
+	assert.NoError(t, ErrorBudgetConfig{MaxFailureRatio: 0.3, ResumeRatio: 0.3, Mode: budgetModeHeartbeats}.Validate())
+	for _, config := range []ErrorBudgetConfig{
+		{MaxFailureRatio: 1},
+		{MaxFailureRatio: -0.1},
+		{MaxFailureRatio: 0.2, ResumeRatio: 0.3},
+		{ResumeRatio: 0.25},
+		{Window: Duration(-time.Minute)},
+		{MinFetches: -1},
+		{Mode: "degraded"},
+		{AlertURL: "ftp://alerts.example.com"},
+		{AlertURL: "/alerts"},
+	} {
+		assert.Error(t, config.Validate(), "%+v", config)
+	}
+	assert.Error(t, (&Config{ErrorBudget: ErrorBudgetConfig{Mode: "degraded"}}).Validate())
+}
+
+func TestErrorBudget_Defaults(t *testing.T) {
+	config := ErrorBudgetConfig{}
+	assert.Equal(t, 0.2, config.maxFailureRatio())
+	assert.Equal(t, 0.1, config.resumeRatio())
+	assert.Equal(t, 15*time.Minute, config.window())
+	assert.Equal(t, 10, config.minFetches())
+	assert.Equal(t, budgetModePaused, config.mode())
+}
+
+func TestErrorBudget_ExhaustsAboveTheRatio(t *testing.T) {
+	ingestor, clock, alerts := newBudgetIngestor(t, "http://127.0.0.1:1", "")
+	b := ingestor.budget
+
+	// 2 of 10 is at the ratio, not above it
+	recordOutcomes(b, clock, 8, 2)
+	assert.Equal(t, budgetNormal, b.polling())
+	assert.Empty(t, *alerts)
+
+	b.record(true)
+	assert.Equal(t, budgetModePaused, b.polling())
+	status := b.Status()
+	assert.Equal(t, budgetReduced, status.State)
+	assert.Equal(t, BudgetWindow{Length: "15m0s", Fetches: 11, Failures: 3, Ratio: 3.0 / 11}, status.Window)
+	assert.Equal(t, clock.Now(), status.Since)
+
+	require.Len(t, *alerts, 1)
+	alert := (*alerts)[0]
+	assert.Equal(t, "exhausted", alert.Event)
+	assert.Equal(t, budgetModePaused, alert.Polling)
+	assert.Equal(t, 3, alert.Window.Failures)
+	assert.Equal(t, 11, alert.Window.Fetches)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.BudgetTransitions.WithLabelValues(budgetReduced)))
+	assert.InDelta(t, 3.0/11, testutil.ToFloat64(ingestor.metrics.BudgetRatio), 1e-9)
+}
+
+func TestErrorBudget_NeedsMinFetches(t *testing.T) {
+	ingestor, clock, _ := newBudgetIngestor(t, "http://127.0.0.1:1", "")
+	recordOutcomes(ingestor.budget, clock, 0, 9)
+	assert.Equal(t, budgetNormal, ingestor.budget.polling(), "9 failures are below min_fetches")
+
+	ingestor.budget.record(true)
+	assert.Equal(t, budgetModePaused, ingestor.budget.polling())
+}
+
+func TestErrorBudget_ForgetsFetchesOutsideTheWindow(t *testing.T) {
+	ingestor, clock, _ := newBudgetIngestor(t, "http://127.0.0.1:1", "")
+	b := ingestor.budget
+
+	recordOutcomes(b, clock, 0, 5)
+	clock.Advance(15 * time.Minute)
+	recordOutcomes(b, clock, 8, 2)
+	assert.Equal(t, budgetNormal, b.polling(), "the first failures left the window")
+	assert.Equal(t, 10, b.Status().Window.Fetches)
+}
+
+func TestErrorBudget_RecoversAtTheResumeRatio(t *testing.T) {
+	ingestor, clock, alerts := newBudgetIngestor(t, "http://127.0.0.1:1", budgetModeHeartbeats)
+	b := ingestor.budget
+
+	recordOutcomes(b, clock, 7, 3)
+	require.Equal(t, budgetModeHeartbeats, b.polling())
+
+	// Heartbeat cycles keep fetching; 3 of 29 is above 10%, 3 of 30 is not
+	recordOutcomes(b, clock, 19, 0)
+	assert.Equal(t, budgetModeHeartbeats, b.polling())
+	b.record(false)
+	assert.Equal(t, budgetNormal, b.polling())
+
+	require.Len(t, *alerts, 2)
+	assert.Equal(t, "recovered", (*alerts)[1].Event)
+	assert.Equal(t, BudgetWindow{Length: "15m0s", Fetches: 30, Failures: 3, Ratio: 0.1}, (*alerts)[1].Window)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.BudgetTransitions.WithLabelValues(budgetNormal)))
+}
+
+func TestErrorBudget_PausedRecoversOnceTheWindowEmpties(t *testing.T) {
+	ingestor, clock, _ := newBudgetIngestor(t, "http://127.0.0.1:1", "")
+	recordOutcomes(ingestor.budget, clock, 0, 10)
+	require.Equal(t, budgetModePaused, ingestor.budget.polling())
+
+	clock.Advance(14 * time.Minute)
+	assert.Equal(t, budgetModePaused, ingestor.budget.polling())
+	clock.Advance(time.Minute)
+	assert.Equal(t, budgetNormal, ingestor.budget.polling())
+}
+
+func TestErrorBudget_OverridePinsUntilReleased(t *testing.T) {
+	ingestor, clock, alerts := newBudgetIngestor(t, "http://127.0.0.1:1", "")
+	b := ingestor.budget
+
+	require.NoError(t, b.setOverride(budgetOverridePause))
+	assert.Equal(t, budgetModePaused, b.polling(), "a healthy budget stays paused")
+	clock.Advance(time.Hour)
+	assert.Equal(t, budgetModePaused, b.polling())
+
+	require.NoError(t, b.setOverride(budgetOverrideResume))
+	recordOutcomes(b, clock, 0, 20)
+	assert.Equal(t, budgetNormal, b.polling(), "an exhausted budget keeps polling")
+	assert.Equal(t, budgetReduced, b.Status().State)
+	clock.Advance(time.Hour)
+	assert.Equal(t, budgetNormal, b.polling())
+
+	recordOutcomes(b, clock, 0, 10)
+	require.NoError(t, b.setOverride(budgetOverrideAuto))
+	assert.Equal(t, budgetModePaused, b.polling(), "released, the window decides again")
+
+	assert.Error(t, b.setOverride("sometimes"))
+	var events []string
+	for _, alert := range *alerts {
+		events = append(events, alert.Event)
+	}
+	assert.Equal(t, []string{"override_pause", "override_resume", "exhausted", "recovered", "exhausted", "override_auto"}, events)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.BudgetTransitions.WithLabelValues("override_pause")))
+}
+
+func TestErrorBudget_Endpoint(t *testing.T) {
+	ingestor, _, _ := newBudgetIngestor(t, "http://127.0.0.1:1", "")
+	router := setupRoutes(ingestor)
+
+	w := adminRequest(router, http.MethodPost, "/admin/error-budget?mode=sometimes")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = adminRequest(router, http.MethodPost, "/admin/error-budget?mode=pause")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var status ErrorBudgetStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, budgetOverridePause, status.Override)
+	assert.Equal(t, budgetModePaused, status.Polling)
+	assert.Equal(t, budgetNormal, status.State)
+
+	w = adminRequest(router, http.MethodGet, "/ingestion/status")
+	require.Equal(t, http.StatusOK, w.Code)
+	var response struct {
+		ErrorBudget ErrorBudgetStatus `json:"error_budget"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, budgetModePaused, response.ErrorBudget.Polling)
+
+	w = adminRequest(router, http.MethodPost, "/admin/error-budget?mode=auto")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"polling":"normal"`)
+}
+
+func TestErrorBudget_FailedFetchesCount(t *testing.T) {
+	upstream, _ := countingUpstream(t, http.StatusInternalServerError, `{}`, nil)
+	ingestor, _, _ := newBudgetIngestor(t, upstream.URL, "")
+	attachChannel(ingestor, &fakeChannel{}, nil)
+
+	_, err := ingestor.ingestSource(context.Background(), ingestor.sources[0])
+	require.Error(t, err)
+	status := ingestor.budget.Status()
+	assert.Equal(t, 1, status.Window.Fetches)
+	assert.Equal(t, 1, status.Window.Failures)
+
+	// Rate limited fetches never reached the upstream and are not counted
+	ingestor.recordFetch(context.Background(), ingestor.sources[0], ErrUpstreamRateLimited)
+	ingestor.recordFetch(context.Background(), ingestor.sources[0], ErrNoData)
+	assert.Equal(t, 1, ingestor.budget.Status().Window.Fetches)
+}
+
+func TestErrorBudget_PollingSkipsWhilePaused(t *testing.T) {
+	upstream, hits := countingUpstream(t, http.StatusOK, rawUpstreamBody, nil)
+	ingestor, _, _ := newBudgetIngestor(t, upstream.URL, "")
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	ingestor.config.API.PollInterval = Duration(5 * time.Millisecond)
+	require.NoError(t, ingestor.budget.setOverride(budgetOverridePause))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.pollSource(ctx, ingestor.sources[0])
+	}()
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, *hits)
+	assert.Empty(t, channel.messages())
+
+	require.NoError(t, ingestor.budget.setOverride(budgetOverrideAuto))
+	assert.Eventually(t, func() bool { return len(channel.messages()) > 0 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+}
+
+func TestErrorBudget_HeartbeatsReplaceReadings(t *testing.T) {
+	upstream, hits := countingUpstream(t, http.StatusOK, rawUpstreamBody, nil)
+	ingestor, _, _ := newBudgetIngestor(t, upstream.URL, budgetModeHeartbeats)
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	ingestor.heartbeatOnce(context.Background(), ingestor.sources[0])
+	assert.EqualValues(t, 1, *hits, "heartbeat cycles keep measuring the upstream")
+	assert.Equal(t, 1, ingestor.budget.Status().Window.Fetches)
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "meter-data-queue", messages[0].RoutingKey)
+	var beat heartbeat
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &beat))
+	assert.Equal(t, "heartbeat", beat.Type)
+	assert.Equal(t, defaultSourceName, beat.Location)
+	assert.Equal(t, ingestor.instanceID, beat.InstanceID)
+	assert.True(t, beat.UpstreamOK)
+}
+
+func TestErrorBudget_HeartbeatWaitsForTxBatch(t *testing.T) {
+	upstream, _ := countingUpstream(t, http.StatusOK, rawUpstreamBody, nil)
+	ingestor, _, _ := newBudgetIngestor(t, upstream.URL, budgetModeHeartbeats)
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	ingestor.txMu.Lock()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.heartbeatOnce(context.Background(), ingestor.sources[0])
+	}()
+	select {
+	case <-done:
+		t.Fatal("the heartbeat was published during a batch")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Empty(t, channel.messages())
+
+	ingestor.txMu.Unlock()
+	<-done
+	assert.Len(t, channel.messages(), 1)
+}
+
+func TestErrorBudget_SendsSignedAlerts(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer server.Close()
+
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.config.ErrorBudget = ErrorBudgetConfig{Enabled: true, AlertURL: server.URL, AlertSecret: "s3cret"}
+	ingestor.sendBudgetAlert(budgetAlert{Service: "data-ingestor", Event: "exhausted", Polling: budgetModePaused})
+
+	r := <-received
+	body := <-bodies
+	assert.Equal(t, signPayload("s3cret", body), r.Header.Get(SignatureHeader))
+	var alert budgetAlert
+	require.NoError(t, json.Unmarshal(body, &alert))
+	assert.Equal(t, "exhausted", alert.Event)
+	assert.Equal(t, budgetModePaused, alert.Polling)
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultFailoverProbeInterval  = 30 * time.Second
+	defaultFailoverStablePeriod   = 2 * time.Minute
+	defaultFailoverReconnectDelay = 5 * time.Second
+)
+
+// FailoverConfig controls reconnecting and failing back between the brokers
+// of rabbitmq.urls
+type FailoverConfig struct {
+	// ProbeInterval is how often the primary is probed while on a secondary
+	ProbeInterval Duration `yaml:"probe_interval"`
+	// StablePeriod is how long the primary has to stay reachable before
+	// failing back to it
+	StablePeriod Duration `yaml:"stable_period"`
+	// ReconnectDelay is the pause between rounds of connection attempts after
+	// the connection dropped
+	ReconnectDelay Duration `yaml:"reconnect_delay"`
+}
+
+// withDefaults fills in unset durations
+func (c FailoverConfig) withDefaults() FailoverConfig {
+	if c.ProbeInterval <= 0 {
+		c.ProbeInterval = Duration(defaultFailoverProbeInterval)
+	}
+	if c.StablePeriod < 0 {
+		c.StablePeriod = 0
+	} else if c.StablePeriod == 0 {
+		c.StablePeriod = Duration(defaultFailoverStablePeriod)
+	}
+	if c.ReconnectDelay <= 0 {
+		c.ReconnectDelay = Duration(defaultFailoverReconnectDelay)
+	}
+	return c
+}
+
+// brokers returns the broker URLs in order of preference
+func (c RabbitMQConfig) brokers() []string {
+	if len(c.URLs) > 0 {
+		return c.URLs
+	}
+	return []string{c.URL}
+}
+
+// validateBrokers checks rabbitmq.url and rabbitmq.urls
+func (c RabbitMQConfig) validateBrokers() error {
+	if c.URL != "" && len(c.URLs) > 0 {
+		return fmt.Errorf("rabbitmq.url and rabbitmq.urls cannot both be set")
+	}
+	for i, url := range c.URLs {
+		if _, err := brokerURIOf(url); err != nil {
+			return fmt.Errorf("rabbitmq.urls[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// brokerLabel identifies a broker in logs, metrics and /stats without its
+// credentials
+func brokerLabel(url string) string {
+	uri, err := brokerURIOf(url)
+	if err != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%s:%d/%s", uri.Host, uri.Port, strings.TrimPrefix(uri.Vhost, "/"))
+}
+
+// brokerURL returns the URL of the broker at index
+func (di *DataIngestor) brokerURL(index int) string {
+	return di.config.RabbitMQ.brokers()[index]
+}
+
+// dialAny connects to the first reachable broker, in order of preference
+func (di *DataIngestor) dialAny() (*brokerConn, int, error) {
+	if err := di.faults.brokerDown(); err != nil {
+		return nil, 0, err
+	}
+	urls := di.config.RabbitMQ.brokers()
+	var lastErr error
+	for i, url := range urls {
+		broker, err := di.dialBroker(url)
+		if err == nil {
+			return broker, i, nil
+		}
+		lastErr = err
+		if len(urls) > 1 {
+			di.log(logReconnect).WithField("broker", brokerLabel(url)).WithError(err).Warn("RabbitMQ broker unreachable")
+		}
+	}
+	if len(urls) == 1 {
+		return nil, 0, lastErr
+	}
+	return nil, 0, fmt.Errorf("all %d RabbitMQ brokers are unreachable: %w", len(urls), lastErr)
+}
+
+// recordFailover counts and logs a change of the active broker. Callers hold
+// connMu.
+func (di *DataIngestor) recordFailover(from, to int) {
+	di.failovers++
+	di.metrics.BrokerFailovers.Inc()
+	entry := di.log(logReconnect).WithFields(logrus.Fields{
+		"from":      brokerLabel(di.brokerURL(from)),
+		"to":        brokerLabel(di.brokerURL(to)),
+		"failovers": di.failovers,
+	})
+	if to == 0 {
+		entry.Info("Failed back to the primary RabbitMQ broker")
+		return
+	}
+	entry.Warn("Failed over to another RabbitMQ broker")
+}
+
+// setActiveBroker exports which broker is active
+func (di *DataIngestor) setActiveBroker(index int) {
+	for i, url := range di.config.RabbitMQ.brokers() {
+		active := 0.0
+		if i == index {
+			active = 1
+		}
+		di.metrics.ActiveBroker.WithLabelValues(brokerLabel(url)).Set(active)
+	}
+}
+
+// BrokerStatus is the broker section of /stats
+type BrokerStatus struct {
+	State     string `json:"state"`
+	Active    string `json:"active"`
+	Primary   bool   `json:"primary"`
+	Failovers int    `json:"failovers"`
+	// Client is the AMQP client library in use
+	Client string `json:"client"`
+}
+
+// brokerStatus reports the active broker
+func (di *DataIngestor) brokerStatus() BrokerStatus {
+	di.connMu.Lock()
+	defer di.connMu.Unlock()
+	return BrokerStatus{
+		State:     di.connState.String(),
+		Active:    brokerLabel(di.brokerURL(di.broker)),
+		Primary:   di.broker == 0,
+		Failovers: di.failovers,
+		Client:    di.config.RabbitMQ.amqpClient(),
+	}
+}
+
+// superviseConnection reconnects when the connection drops and fails back to
+// the primary broker once it has been reachable for the stable period. It
+// returns when ctx is cancelled.
+func (di *DataIngestor) superviseConnection(ctx context.Context) {
+	config := di.config.RabbitMQ.Failover.withDefaults()
+	probe := time.NewTicker(time.Duration(config.ProbeInterval))
+	defer probe.Stop()
+
+	var primaryUp time.Time
+	for {
+		di.connMu.Lock()
+		closed, broker := di.closed, di.broker
+		di.connMu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-closed:
+			if !di.connectionLost(closed, err) {
+				continue
+			}
+			primaryUp = time.Time{}
+			di.reconnect(ctx, time.Duration(config.ReconnectDelay))
+		case <-probe.C:
+			if broker == 0 || di.ConnectionState() != StateReady {
+				primaryUp = time.Time{}
+				continue
+			}
+			if err := di.probeBroker(di.brokerURL(0)); err != nil {
+				primaryUp = time.Time{}
+				continue
+			}
+			now := time.Now()
+			if primaryUp.IsZero() {
+				primaryUp = now
+				di.log(logReconnect).WithField("stable_period", config.StablePeriod).Info("Primary RabbitMQ broker is reachable again")
+			}
+			if now.Sub(primaryUp) < time.Duration(config.StablePeriod) {
+				continue
+			}
+			primaryUp = time.Time{}
+			if err := di.failBack(); err != nil {
+				di.log(logReconnect).WithError(err).Warn("Failed to fail back to the primary RabbitMQ broker")
+			}
+		}
+	}
+}
+
+// connectionLost marks the connection disconnected after it dropped. It
+// reports false when closed no longer belongs to the active connection,
+// because it was closed by Close or replaced by failBack.
+func (di *DataIngestor) connectionLost(closed <-chan *amqp.Error, cause *amqp.Error) bool {
+	di.connMu.Lock()
+	if closed == nil || di.closed != closed || di.connState != StateReady {
+		di.connMu.Unlock()
+		return false
+	}
+	channel, conn, tracker := di.channel, di.conn, di.confirms
+	di.channel, di.conn, di.confirms, di.closed = nil, nil, nil, nil
+	di.connState = StateDisconnected
+	di.connErr = errConnectionLost
+	if cause != nil {
+		di.connErr = cause
+	}
+	broker := di.broker
+	di.connMu.Unlock()
+
+	entry := di.log(logReconnect).WithField("broker", brokerLabel(di.brokerURL(broker)))
+	if cause != nil {
+		entry = entry.WithError(cause)
+	}
+	entry.Warn("RabbitMQ connection lost")
+
+	// Messages awaiting a confirm fail, so their cycle reports an error
+	if tracker != nil {
+		tracker.failAll(ErrConfirmsClosed)
+	}
+	if channel != nil {
+		channel.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	return true
+}
+
+// reconnect tries every broker in order until one accepts the connection
+func (di *DataIngestor) reconnect(ctx context.Context, delay time.Duration) {
+	for attempt := 1; ; attempt++ {
+		err := di.ConnectToRabbitMQ()
+		if err == nil || errors.Is(err, ErrConnectInProgress) || errors.Is(err, ErrClosedWhileConnecting) {
+			return
+		}
+		di.log(logReconnect).WithError(err).WithField("attempt", attempt).Error("Failed to reconnect to RabbitMQ")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// probeBroker checks that a broker accepts connections
+func (di *DataIngestor) probeBroker(url string) error {
+	if err := di.faults.brokerDown(); err != nil {
+		return err
+	}
+	broker, err := di.dialBroker(url)
+	if err != nil {
+		return err
+	}
+	broker.close()
+	return nil
+}
+
+// failBack switches publishing to the primary broker
+func (di *DataIngestor) failBack() error {
+	return di.switchBroker(0)
+}
+
+// switchBroker switches publishing to a new connection to the broker at
+// index. The switch happens under the publish lock, and the previous
+// connection is only closed once the messages published to it are confirmed.
+func (di *DataIngestor) switchBroker(index int) error {
+	broker, err := di.dialBroker(di.brokerURL(index))
+	if err != nil {
+		return err
+	}
+
+	// Not in the middle of a transaction, which must commit on its channel
+	di.txMu.Lock()
+	defer di.txMu.Unlock()
+	di.publishMu.Lock()
+	di.connMu.Lock()
+	if di.connState != StateReady {
+		state := di.connState
+		di.connMu.Unlock()
+		di.publishMu.Unlock()
+		broker.close()
+		return fmt.Errorf("%w (connection is %s)", ErrNotConnected, state)
+	}
+	channel, conn, tracker := di.channel, di.conn, di.confirms
+	di.install(broker, index)
+	di.connMu.Unlock()
+	di.publishMu.Unlock()
+
+	if tracker != nil && !tracker.waitIdle(di.confirmTimeout()) {
+		di.log(logReconnect).Warn("Closing the previous RabbitMQ connection with unconfirmed messages")
+	}
+	if channel != nil {
+		channel.Close()
+	}
+	if conn != nil {
+		conn.Close()
+	}
+	return nil
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Fault types POST /debug/faults can inject
+const (
+	faultUpstreamError    = "upstream_error"
+	faultPublishDelay     = "publish_delay"
+	faultBrokerDisconnect = "broker_disconnect"
+	faultDropReadings     = "drop_readings"
+	faultBreakerOpen      = "breaker_open"
+)
+
+// Classes of injected upstream failures
+const (
+	faultClassTimeout     = "timeout"
+	faultClassConnection  = "connection"
+	faultClassServerError = "server_error"
+	faultClassRateLimited = "rate_limited"
+	faultClassNoData      = "no_data"
+)
+
+const (
+	// maxFaultDuration bounds how long a fault stays active
+	maxFaultDuration = time.Hour
+	// maxFaultDelay bounds the delay of publish_delay
+	maxFaultDelay = time.Minute
+)
+
+var (
+	errFaultNotFound = errors.New("fault not found")
+	// errBrokerDown is returned when dialing while a broker_disconnect fault
+	// is active
+	errBrokerDown = errors.New("RabbitMQ broker down by an injected fault")
+)
+
+// errInjectedTimeout is the upstream_error of the timeout class, a net.Error
+// like the timeouts of the HTTP client
+type errInjectedTimeout struct{}
+
+func (errInjectedTimeout) Error() string   { return "upstream timeout injected by a fault" }
+func (errInjectedTimeout) Timeout() bool   { return true }
+func (errInjectedTimeout) Temporary() bool { return true }
+
+// Fault is a failure injected for a bounded time
+type Fault struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	// Location limits upstream_error, drop_readings and breaker_open to one
+	// location; every location when empty
+	Location string `json:"location,omitempty"`
+	// Class is the upstream_error to fail fetches with
+	Class string `json:"class,omitempty"`
+	// DelayMS is the publish_delay in milliseconds
+	DelayMS int `json:"delay_ms,omitempty"`
+	// Percent of the fetched readings drop_readings drops
+	Percent   float64   `json:"percent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func (f *Fault) appliesTo(location string) bool {
+	return f.Location == "" || f.Location == location
+}
+
+// faultRequest is the body of POST /debug/faults
+type faultRequest struct {
+	Type     string  `json:"type"`
+	Location string  `json:"location"`
+	Class    string  `json:"class"`
+	DelayMS  int     `json:"delay_ms"`
+	Percent  float64 `json:"percent"`
+	// Duration is how long the fault stays active, like "30s"
+	Duration string `json:"duration"`
+}
+
+// faultsAllowed reports whether the debug config allows fault injection.
+// Release builds, with a version set at build time, also need
+// debug.allow_faults, which has no command-line flag.
+func faultsAllowed(config DebugConfig) bool {
+	return config.Enabled && (version == "dev" || config.AllowFaults)
+}
+
+// faultInjector holds the active faults. A nil injector injects nothing.
+type faultInjector struct {
+	logger  *logrus.Logger
+	metrics *Metrics
+	now     func() time.Time
+	// roll returns a number in [0, 100) for drop_readings
+	roll func() float64
+	// sleep waits out publish_delay; replaced in tests
+	sleep func(time.Duration)
+
+	mu     sync.Mutex
+	faults map[string]*Fault
+}
+
+// newFaultInjector returns nil unless the debug config allows faults
+func newFaultInjector(config DebugConfig, logger *logrus.Logger, metrics *Metrics) *faultInjector {
+	if !faultsAllowed(config) {
+		return nil
+	}
+	return &faultInjector{
+		logger:  logger,
+		metrics: metrics,
+		now:     time.Now,
+		roll:    func() float64 { return rand.Float64() * 100 },
+		sleep:   time.Sleep,
+		faults:  make(map[string]*Fault),
+	}
+}
+
+// pruneLocked removes the expired faults. Callers hold mu.
+func (f *faultInjector) pruneLocked(now time.Time) {
+	for id, fault := range f.faults {
+		if !now.Before(fault.ExpiresAt) {
+			delete(f.faults, id)
+			f.logger.WithFields(logrus.Fields{"fault": id, "type": fault.Type}).Warn("Fault expired")
+		}
+	}
+}
+
+// active returns the first active fault of kind that applies to location
+func (f *faultInjector) active(kind, location string) *Fault {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pruneLocked(f.now())
+	var found *Fault
+	for _, fault := range f.faults {
+		if fault.Type != kind || !fault.appliesTo(location) {
+			continue
+		}
+		if found == nil || fault.CreatedAt.Before(found.CreatedAt) {
+			found = fault
+		}
+	}
+	if found == nil {
+		return nil
+	}
+	copied := *found
+	return &copied
+}
+
+func (f *faultInjector) add(fault *Fault) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults[fault.ID] = fault
+}
+
+func (f *faultInjector) list() []Fault {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pruneLocked(f.now())
+	faults := make([]Fault, 0, len(f.faults))
+	for _, fault := range f.faults {
+		faults = append(faults, *fault)
+	}
+	sort.Slice(faults, func(i, j int) bool { return faults[i].CreatedAt.Before(faults[j].CreatedAt) })
+	return faults
+}
+
+func (f *faultInjector) remove(id string) (Fault, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pruneLocked(f.now())
+	fault, ok := f.faults[id]
+	if !ok {
+		return Fault{}, errFaultNotFound
+	}
+	delete(f.faults, id)
+	return *fault, nil
+}
+
+func (f *faultInjector) count(kind string) {
+	f.metrics.FaultsInjected.WithLabelValues(kind).Inc()
+}
+
+// upstreamError returns the error an upstream_error fault fails a fetch of
+// location with, or nil
+func (f *faultInjector) upstreamError(location string) error {
+	fault := f.active(faultUpstreamError, location)
+	if fault == nil {
+		return nil
+	}
+	f.count(faultUpstreamError)
+	switch fault.Class {
+	case faultClassTimeout:
+		return errInjectedTimeout{}
+	case faultClassConnection:
+		return &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused by an injected fault")}
+	case faultClassRateLimited:
+		// Throttles the location until the fault expires
+		return &statusError{Code: http.StatusTooManyRequests, RetryAfter: fault.ExpiresAt.Sub(f.now())}
+	case faultClassNoData:
+		return ErrNoData
+	}
+	return &statusError{Code: http.StatusServiceUnavailable}
+}
+
+// delayPublish waits out an active publish_delay fault
+func (f *faultInjector) delayPublish() {
+	if fault := f.active(faultPublishDelay, ""); fault != nil {
+		f.count(faultPublishDelay)
+		f.sleep(time.Duration(fault.DelayMS) * time.Millisecond)
+	}
+}
+
+// brokerDown returns errBrokerDown while a broker_disconnect fault is active
+func (f *faultInjector) brokerDown() error {
+	if f.active(faultBrokerDisconnect, "") != nil {
+		return errBrokerDown
+	}
+	return nil
+}
+
+// dropReadings drops the share of data a drop_readings fault asks for
+func (f *faultInjector) dropReadings(location string, data WeatherData) WeatherData {
+	fault := f.active(faultDropReadings, location)
+	if fault == nil {
+		return data
+	}
+	kept := make(WeatherData, 0, len(data))
+	for _, reading := range data {
+		if f.roll() < fault.Percent {
+			f.count(faultDropReadings)
+			continue
+		}
+		kept = append(kept, reading)
+	}
+	return kept
+}
+
+// newFault checks a request and returns the fault it injects
+func (di *DataIngestor) newFault(req faultRequest) (*Fault, error) {
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration <= 0 || duration > maxFaultDuration {
+		return nil, fmt.Errorf("duration must be a duration up to %s, like \"30s\"", maxFaultDuration)
+	}
+	fault := &Fault{Type: req.Type, Location: req.Location}
+	switch req.Type {
+	case faultUpstreamError:
+		switch req.Class {
+		case faultClassTimeout, faultClassConnection, faultClassServerError, faultClassRateLimited, faultClassNoData:
+		default:
+			return nil, fmt.Errorf("class must be %s, %s, %s, %s or %s", faultClassTimeout, faultClassConnection, faultClassServerError, faultClassRateLimited, faultClassNoData)
+		}
+		fault.Class = req.Class
+	case faultPublishDelay:
+		if req.DelayMS <= 0 || time.Duration(req.DelayMS)*time.Millisecond > maxFaultDelay {
+			return nil, fmt.Errorf("delay_ms must be between 1 and %d", maxFaultDelay.Milliseconds())
+		}
+		fault.DelayMS = req.DelayMS
+	case faultDropReadings:
+		if req.Percent <= 0 || req.Percent > 100 {
+			return nil, fmt.Errorf("percent must be above 0 and at most 100")
+		}
+		fault.Percent = req.Percent
+	case faultBrokerDisconnect, faultBreakerOpen:
+	default:
+		return nil, fmt.Errorf("type must be %s, %s, %s, %s or %s", faultUpstreamError, faultPublishDelay, faultBrokerDisconnect, faultDropReadings, faultBreakerOpen)
+	}
+	if req.Location != "" && (req.Type == faultPublishDelay || req.Type == faultBrokerDisconnect) {
+		return nil, fmt.Errorf("%s applies to every location", req.Type)
+	}
+
+	fault.ID = newMessageID()
+	fault.CreatedAt = di.faults.now()
+	fault.ExpiresAt = fault.CreatedAt.Add(duration)
+	return fault, nil
+}
+
+// injectFault starts a fault. broker_disconnect drops the connection, and
+// breaker_open opens the breakers, until the fault expires.
+func (di *DataIngestor) injectFault(fault *Fault) error {
+	switch fault.Type {
+	case faultBrokerDisconnect:
+		// The connection supervisor sees the close and reconnects, which
+		// fails until the fault expires
+		di.connMu.Lock()
+		conn := di.conn
+		di.connMu.Unlock()
+		if conn == nil {
+			return ErrNotConnected
+		}
+		di.faults.add(fault)
+		di.faults.count(faultBrokerDisconnect)
+		conn.Close()
+		return nil
+	case faultBreakerOpen:
+		for _, src := range di.currentSources() {
+			if fault.appliesTo(src.name) {
+				di.forceBreaker(src, fault.ExpiresAt)
+				di.faults.count(faultBreakerOpen)
+			}
+		}
+	}
+	di.faults.add(fault)
+	return nil
+}
+
+// forceBreaker opens the breaker of src until until, when it lets a probe
+// through as after any other open timeout
+func (di *DataIngestor) forceBreaker(src *source, until time.Time) {
+	src.mu.Lock()
+	from := src.breaker.state
+	src.breaker.forceOpen(until)
+	src.mu.Unlock()
+	di.metrics.CircuitBreakerState.WithLabelValues(src.name).Set(float64(breakerOpen))
+	di.logger.WithFields(logrus.Fields{
+		"location": src.name,
+		"from":     from.String(),
+		"to":       breakerOpen.String(),
+		"until":    until.Format(time.RFC3339),
+	}).Warn("Circuit breaker state changed")
+}
+
+// faultsDisabled answers 409 when fault injection is not allowed
+func (di *DataIngestor) faultsDisabled(c *gin.Context) bool {
+	if di.faults != nil {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error": "fault injection is disabled; release builds need debug.allow_faults",
+	})
+	return true
+}
+
+// handleFaultCreate serves POST /debug/faults
+func (di *DataIngestor) handleFaultCreate(c *gin.Context) {
+	if di.faultsDisabled(c) {
+		return
+	}
+	var req faultRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid fault request: %v", err),
+		})
+		return
+	}
+	if req.Location != "" && di.sourceByName(req.Location) == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("unknown location %q", req.Location),
+		})
+		return
+	}
+	fault, err := di.newFault(req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err := di.injectFault(fault); err != nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	di.logger.WithFields(logrus.Fields{
+		"fault":      fault.ID,
+		"type":       fault.Type,
+		"location":   fault.Location,
+		"expires_at": fault.ExpiresAt.Format(time.RFC3339),
+	}).Warn("Fault injected")
+	c.JSON(http.StatusCreated, fault)
+}
+
+// handleFaultList serves GET /debug/faults
+func (di *DataIngestor) handleFaultList(c *gin.Context) {
+	if di.faultsDisabled(c) {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"faults": di.faults.list()})
+}
+
+// handleFaultCancel serves DELETE /debug/faults/:id. A cancelled
+// breaker_open lets the next fetch probe.
+func (di *DataIngestor) handleFaultCancel(c *gin.Context) {
+	if di.faultsDisabled(c) {
+		return
+	}
+	fault, err := di.faults.remove(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if fault.Type == faultBreakerOpen {
+		now := di.faults.now()
+		for _, src := range di.currentSources() {
+			if fault.appliesTo(src.name) {
+				src.mu.Lock()
+				src.breaker.endForcedOpen(now, fault.ExpiresAt)
+				src.mu.Unlock()
+			}
+		}
+	}
+	di.logger.WithFields(logrus.Fields{"fault": fault.ID, "type": fault.Type}).Warn("Fault cancelled")
+	c.JSON(http.StatusOK, fault)
+}
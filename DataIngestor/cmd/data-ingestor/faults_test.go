@@ -0,0 +1,364 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newFaultIngestor polls upstream with the debug flag on and faults allowed
+func newFaultIngestor(t *testing.T, upstream string) *DataIngestor {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream, Timeout: Duration(time.Second), RetryCount: 1, RetryBackoff: Duration(time.Millisecond)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Logging:  LoggingConfig{Level: "panic"},
+		Debug:    DebugConfig{Enabled: true},
+	})
+	require.NotNil(t, ingestor.faults)
+	return ingestor
+}
+
+func postFault(router http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/debug/faults", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer letmein")
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func injectFault(t *testing.T, router http.Handler, body string) Fault {
+	t.Helper()
+	w := postFault(router, body)
+	require.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+	var fault Fault
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &fault))
+	return fault
+}
+
+func TestFaults_ReleaseBuildsNeedAllowFaults(t *testing.T) {
+	saved := version
+	version = "1.4.0"
+	defer func() { version = saved }()
+
+	assert.False(t, faultsAllowed(DebugConfig{}))
+	assert.False(t, faultsAllowed(DebugConfig{Enabled: true}))
+	assert.False(t, faultsAllowed(DebugConfig{AllowFaults: true}), "faults also need the debug flag")
+	assert.True(t, faultsAllowed(DebugConfig{Enabled: true, AllowFaults: true}))
+
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Logging:  LoggingConfig{Level: "panic"},
+		Debug:    DebugConfig{Enabled: true},
+	})
+	assert.Nil(t, ingestor.faults)
+	router := setupRoutes(ingestor)
+	w := postFault(router, `{"type":"publish_delay","delay_ms":10,"duration":"1m"}`)
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Contains(t, w.Body.String(), "debug.allow_faults")
+	assert.Equal(t, http.StatusConflict, adminRequest(router, http.MethodGet, "/debug/faults").Code)
+
+	version = "dev"
+	assert.True(t, faultsAllowed(DebugConfig{Enabled: true}))
+}
+
+func TestFaults_RequireFlagAndToken(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	assert.Nil(t, ingestor.faults)
+	assert.Equal(t, http.StatusNotFound, adminRequest(setupRoutes(ingestor), http.MethodGet, "/debug/faults").Code)
+
+	router := setupRoutes(newFaultIngestor(t, "http://127.0.0.1:1"))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/debug/faults", strings.NewReader(`{"type":"breaker_open","duration":"1m"}`)))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
+
+func TestFaults_BadRequests(t *testing.T) {
+	router := setupRoutes(newFaultIngestor(t, "http://127.0.0.1:1"))
+	for _, body := range []string{
+		`{"type":"publish_delay","delay_ms":10}`,
+		`{"type":"publish_delay","delay_ms":10,"duration":"2h"}`,
+		`{"type":"publish_delay","delay_ms":10,"duration":"-1s"}`,
+		`{"type":"publish_delay","duration":"1m"}`,
+		`{"type":"publish_delay","delay_ms":120000,"duration":"1m"}`,
+		`{"type":"upstream_error","class":"flaky","duration":"1m"}`,
+		`{"type":"drop_readings","percent":0,"duration":"1m"}`,
+		`{"type":"drop_readings","percent":101,"duration":"1m"}`,
+		`{"type":"broker_disconnect","location":"default","duration":"1m"}`,
+		`{"type":"meteor","duration":"1m"}`,
+		`not json`,
+	} {
+		assert.Equal(t, http.StatusBadRequest, postFault(router, body).Code, body)
+	}
+
+	w := postFault(router, `{"type":"breaker_open","location":"moscow","duration":"1m"}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `unknown location \"moscow\"`)
+
+	w = postFault(router, `{"type":"broker_disconnect","duration":"1m"}`)
+	assert.Equal(t, http.StatusConflict, w.Code, "there is no connection to drop")
+	assert.Equal(t, http.StatusNotFound, adminRequest(router, http.MethodDelete, "/debug/faults/nope").Code)
+}
+
+func TestFaults_ListCancelAndExpire(t *testing.T) {
+	ingestor := newFaultIngestor(t, "http://127.0.0.1:1")
+	now := time.Date(2026, 10, 14, 12, 0, 0, 0, time.UTC)
+	ingestor.faults.now = func() time.Time { return now }
+	router := setupRoutes(ingestor)
+
+	drop := injectFault(t, router, `{"type":"drop_readings","percent":25,"duration":"1m"}`)
+	assert.Equal(t, now.Add(time.Minute), drop.ExpiresAt)
+	now = now.Add(time.Second)
+	delay := injectFault(t, router, `{"type":"publish_delay","delay_ms":50,"duration":"5m"}`)
+
+	list := func() []Fault {
+		w := adminRequest(router, http.MethodGet, "/debug/faults")
+		require.Equal(t, http.StatusOK, w.Code)
+		var body struct {
+			Faults []Fault `json:"faults"`
+		}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body.Faults
+	}
+	faults := list()
+	require.Len(t, faults, 2)
+	assert.Equal(t, drop.ID, faults[0].ID, "oldest first")
+	assert.Equal(t, 25.0, faults[0].Percent)
+	assert.Equal(t, delay.ID, faults[1].ID)
+
+	assert.Equal(t, http.StatusOK, adminRequest(router, http.MethodDelete, "/debug/faults/"+drop.ID).Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(router, http.MethodDelete, "/debug/faults/"+drop.ID).Code)
+	require.Len(t, list(), 1)
+
+	now = now.Add(5 * time.Minute)
+	assert.Empty(t, list(), "faults expire on their own")
+	assert.Nil(t, ingestor.faults.active(faultPublishDelay, ""))
+}
+
+func TestFaults_UpstreamErrors(t *testing.T) {
+	tests := []struct {
+		class    string
+		attempts float64
+		check    func(t *testing.T, ingestor *DataIngestor, err error)
+	}{
+		{faultClassTimeout, 2, func(t *testing.T, ingestor *DataIngestor, err error) {
+			assert.ErrorContains(t, err, "upstream timeout injected by a fault")
+			assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamFailures.WithLabelValues(defaultSourceName)))
+		}},
+		{faultClassConnection, 2, func(t *testing.T, ingestor *DataIngestor, err error) {
+			assert.ErrorContains(t, err, "connection refused")
+			assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamFailures.WithLabelValues(defaultSourceName)))
+		}},
+		{faultClassServerError, 2, func(t *testing.T, ingestor *DataIngestor, err error) {
+			assert.ErrorContains(t, err, "503")
+			assert.Equal(t, 1, ingestor.sources[0].status(time.Now()).ConsecutiveFailures)
+		}},
+		{faultClassRateLimited, 1, func(t *testing.T, ingestor *DataIngestor, err error) {
+			assert.ErrorContains(t, err, "429")
+			_, err = ingestor.ingest(context.Background())
+			assert.ErrorIs(t, err, ErrThrottled, "the location is throttled until the fault expires")
+		}},
+		{faultClassNoData, 1, func(t *testing.T, ingestor *DataIngestor, err error) {
+			assert.ErrorIs(t, err, ErrNoData)
+			assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.NoDataResponses.WithLabelValues(defaultSourceName)))
+			assert.Zero(t, ingestor.sources[0].status(time.Now()).ConsecutiveFailures)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.class, func(t *testing.T) {
+			upstream, hits := countingUpstream(t, http.StatusOK, `[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`, nil)
+			ingestor := newFaultIngestor(t, upstream.URL)
+			attachChannel(ingestor, &fakeChannel{}, nil)
+			fault := injectFault(t, setupRoutes(ingestor), `{"type":"upstream_error","location":"default","class":"`+tt.class+`","duration":"1m"}`)
+			assert.Equal(t, tt.class, fault.Class)
+
+			_, err := ingestor.ingest(context.Background())
+			require.Error(t, err)
+			tt.check(t, ingestor, err)
+			assert.Zero(t, atomic.LoadInt32(hits), "the upstream is never called")
+			assert.Equal(t, tt.attempts, testutil.ToFloat64(ingestor.metrics.FaultsInjected.WithLabelValues(faultUpstreamError)))
+		})
+	}
+}
+
+func TestFaults_UpstreamErrorOnlyHitsItsLocation(t *testing.T) {
+	ingestor, _, berlinHits, _ := newTwoLocationIngestor(t, APIConfig{})
+	ingestor.faults = newFaultInjector(DebugConfig{Enabled: true}, ingestor.logger, ingestor.metrics)
+	fault, err := ingestor.newFault(faultRequest{Type: faultUpstreamError, Location: "moscow", Class: faultClassTimeout, Duration: "1m"})
+	require.NoError(t, err)
+	require.NoError(t, ingestor.injectFault(fault))
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(berlinHits))
+	assert.Contains(t, result.SourceErrors["moscow"], "upstream timeout injected by a fault")
+}
+
+func TestFaults_PublishDelay(t *testing.T) {
+	ingestor := newFaultIngestor(t, "http://127.0.0.1:1")
+	var slept []time.Duration
+	ingestor.faults.sleep = func(d time.Duration) { slept = append(slept, d) }
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+	router := setupRoutes(ingestor)
+
+	require.NoError(t, ingestor.PublishToQueue(testReadings()))
+	assert.Empty(t, slept)
+
+	fault := injectFault(t, router, `{"type":"publish_delay","delay_ms":250,"duration":"1m"}`)
+	require.NoError(t, ingestor.PublishToQueue(testReadings()))
+	assert.Equal(t, []time.Duration{250 * time.Millisecond}, slept)
+	assert.Len(t, channel.messages(), 2)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.FaultsInjected.WithLabelValues(faultPublishDelay)))
+
+	require.Equal(t, http.StatusOK, adminRequest(router, http.MethodDelete, "/debug/faults/"+fault.ID).Code)
+	require.NoError(t, ingestor.PublishToQueue(testReadings()))
+	assert.Len(t, slept, 1)
+}
+
+func TestFaults_PublishDelayWaits(t *testing.T) {
+	ingestor := newFaultIngestor(t, "http://127.0.0.1:1")
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+	start := time.Now()
+	injectFault(t, setupRoutes(ingestor), `{"type":"publish_delay","delay_ms":100,"duration":"1m"}`)
+
+	require.NoError(t, ingestor.PublishToQueue(testReadings()))
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+}
+
+// closingConn closes the notification channel of its connection like a
+// real AMQP connection does
+type closingConn struct {
+	io.Closer
+	once   sync.Once
+	closed chan *amqp.Error
+}
+
+func (c *closingConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Closer.Close()
+}
+
+func TestFaults_BrokerDisconnect(t *testing.T) {
+	broker := startFakeBroker(t)
+	ingestor := newFailoverIngestor(t, broker)
+	ingestor.faults = newFaultInjector(DebugConfig{Enabled: true}, ingestor.logger, ingestor.metrics)
+	dial := fakeDialer(broker)
+	var dials int32
+	ingestor.dialBroker = func(url string) (*brokerConn, error) {
+		conn, err := dial(url)
+		if err != nil {
+			return nil, err
+		}
+		atomic.AddInt32(&dials, 1)
+		closed := make(chan *amqp.Error, 1)
+		conn.closed = closed
+		conn.conn = &closingConn{Closer: conn.conn, closed: closed}
+		return conn, nil
+	}
+	require.NoError(t, ingestor.ConnectToRabbitMQ())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ingestor.superviseConnection(ctx)
+
+	fault, err := ingestor.newFault(faultRequest{Type: faultBrokerDisconnect, Duration: "300ms"})
+	require.NoError(t, err)
+	require.NoError(t, ingestor.injectFault(fault))
+	require.Eventually(t, func() bool {
+		return ingestor.ConnectionState() == StateDisconnected
+	}, time.Second, 5*time.Millisecond)
+	assert.ErrorIs(t, ingestor.ConnectToRabbitMQ(), errBrokerDown)
+	assert.Error(t, ingestor.PublishToQueue(testReadings()), "publishing fails while the broker is down")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&dials), "reconnecting fails until the fault expires")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.FaultsInjected.WithLabelValues(faultBrokerDisconnect)))
+
+	require.Eventually(t, func() bool {
+		return ingestor.ConnectionState() == StateReady
+	}, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&dials))
+	require.NoError(t, ingestor.PublishToQueue(testReadings()))
+}
+
+func TestFaults_DropReadings(t *testing.T) {
+	upstream := newUpstream(t, "application/json", `[
+		{"type":"energy","name":"meter-1","payload":{"energy":1}},
+		{"type":"energy","name":"meter-2","payload":{"energy":2}},
+		{"type":"energy","name":"meter-3","payload":{"energy":3}}
+	]`)
+	ingestor := newFaultIngestor(t, upstream.URL)
+	rolls := []float64{10, 90, 49.9}
+	ingestor.faults.roll = func() float64 {
+		roll := rolls[0]
+		rolls = rolls[1:]
+		return roll
+	}
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+	injectFault(t, setupRoutes(ingestor), `{"type":"drop_readings","percent":50,"duration":"1m"}`)
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	require.Len(t, *result.Data, 1)
+	assert.Equal(t, "meter-2", (*result.Data)[0].Name)
+	assert.Len(t, channel.messages(), 1)
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.FaultsInjected.WithLabelValues(faultDropReadings)))
+}
+
+func TestFaults_BreakerOpen(t *testing.T) {
+	upstream, hits := countingUpstream(t, http.StatusOK, `[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`, nil)
+	ingestor := newFaultIngestor(t, upstream.URL)
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	router := setupRoutes(ingestor)
+	gauge := ingestor.metrics.CircuitBreakerState.WithLabelValues(defaultSourceName)
+
+	fault := injectFault(t, router, `{"type":"breaker_open","duration":"10m"}`)
+	assert.Equal(t, float64(breakerOpen), testutil.ToFloat64(gauge))
+	status := ingestor.sources[0].status(time.Now())
+	assert.Equal(t, "open", status.Breaker)
+
+	_, err := ingestor.ingest(context.Background())
+	assert.ErrorIs(t, err, ErrCircuitOpen)
+	assert.Zero(t, atomic.LoadInt32(hits))
+
+	// Cancelled, the next fetch probes and closes the breaker
+	require.Equal(t, http.StatusOK, adminRequest(router, http.MethodDelete, "/debug/faults/"+fault.ID).Code)
+	_, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+	assert.Equal(t, "closed", ingestor.sources[0].status(time.Now()).Breaker)
+	assert.Equal(t, float64(breakerClosed), testutil.ToFloat64(gauge))
+}
+
+func TestCircuitBreaker_ForceOpen(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(CircuitBreakerConfig{OpenTimeout: Duration(time.Minute)})
+	b.forceOpen(now.Add(10 * time.Minute))
+	assert.ErrorIs(t, b.allow(now.Add(9*time.Minute)), ErrCircuitOpen)
+	assert.Equal(t, now.Add(10*time.Minute), b.reopensAt())
+	assert.NoError(t, b.allow(now.Add(10*time.Minute)), "a probe goes through once the fault expires")
+
+	b.record(now.Add(10*time.Minute), false)
+	b.endForcedOpen(now.Add(10*time.Minute), now.Add(10*time.Minute))
+	assert.ErrorIs(t, b.allow(now.Add(10*time.Minute)), ErrCircuitOpen, "a breaker reopened by a failed probe stays open")
+
+	b.forceOpen(now.Add(time.Hour))
+	b.endForcedOpen(now, now.Add(time.Hour))
+	assert.NoError(t, b.allow(now), "a cancelled fault lets the next call probe")
+}
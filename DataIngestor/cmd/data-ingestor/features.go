@@ -0,0 +1,422 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// featuresStateVersion is bumped when the state file format changes
+const featuresStateVersion = 1
+
+// Pipeline stages, in the order readings pass them
+const (
+	stageTransforms   = "transforms"
+	stageValidation   = "validation"
+	stageEnrichment   = "enrichment"
+	stageQuality      = "quality"
+	stageReadingIDs   = "reading_ids"
+	stageReadingDedup = "reading_dedup"
+	stageSchemaDrift  = "schema_drift"
+)
+
+var (
+	errUnknownStage      = errors.New("unknown pipeline stage")
+	errStageNotRuntime   = errors.New("pipeline stage cannot be toggled at runtime")
+	errStageNotConfigure = errors.New("pipeline stage is not configured")
+)
+
+// FeaturesConfig keeps the stages switched off through the admin API
+// across restarts
+type FeaturesConfig struct {
+	// StateFile persists the overrides; without it they last until the
+	// process exits
+	StateFile string `yaml:"state_file"`
+}
+
+// pipelineStage describes an optional stage of the pipeline
+type pipelineStage struct {
+	name string
+	// toggleable stages can be switched off and on between cycles; the
+	// others keep state that a switch would leave inconsistent
+	toggleable bool
+	configured func(c *Config) bool
+	summary    func(c *Config) map[string]interface{}
+	// counters are the persisted counters of the stage, without namespace
+	counters []string
+}
+
+var pipelineStages = []pipelineStage{
+	{
+		name:       stageTransforms,
+		toggleable: true,
+		configured: func(c *Config) bool { return len(c.Transforms) > 0 },
+		summary: func(c *Config) map[string]interface{} {
+			return map[string]interface{}{"transforms": len(c.Transforms)}
+		},
+		counters: []string{"transform_errors_total", "transform_filtered_total"},
+	},
+	{
+		name:       stageValidation,
+		toggleable: true,
+		configured: func(c *Config) bool {
+			return len(c.Validation.Bounds) > 0 || len(c.Validation.Sentinels) > 0 || c.Enrichment.MetadataFile != ""
+		},
+		summary: func(c *Config) map[string]interface{} {
+			return map[string]interface{}{"action": c.Validation.action(), "bounds": len(c.Validation.Bounds), "sentinels": len(c.Validation.Sentinels)}
+		},
+		counters: []string{"validation_failures_total", "sentinel_values_total"},
+	},
+	{
+		// Switching it off would also drop the location bounds of validation
+		name:       stageEnrichment,
+		configured: func(c *Config) bool { return c.Enrichment.MetadataFile != "" },
+		summary: func(c *Config) map[string]interface{} {
+			return map[string]interface{}{"metadata_file": c.Enrichment.MetadataFile}
+		},
+	},
+	{
+		name:       stageQuality,
+		toggleable: true,
+		configured: func(c *Config) bool { return c.Quality.Enabled },
+		summary: func(c *Config) map[string]interface{} {
+			return map[string]interface{}{"required_fields": len(c.Quality.RequiredFields)}
+		},
+	},
+	{
+		// Switching would change the IDs the dedup keys and MessageIds
+		// derive from
+		name:       stageReadingIDs,
+		configured: func(c *Config) bool { return c.ReadingIDs.replaces() },
+		summary: func(c *Config) map[string]interface{} {
+			strategy := c.ReadingIDs.Strategy
+			if strategy == "" {
+				strategy = idUpstream
+			}
+			return map[string]interface{}{"strategy": strategy}
+		},
+	},
+	{
+		// Switching it off on one instance would publish the readings the
+		// others claimed
+		name:       stageReadingDedup,
+		configured: func(c *Config) bool { return c.ReadingDedup.Enabled },
+		summary: func(c *Config) map[string]interface{} {
+			return map[string]interface{}{"redis": c.ReadingDedup.Redis.Addr != ""}
+		},
+		counters: []string{"dedup_suppressed_total", "dedup_redis_errors_total"},
+	},
+	{
+		// Switching it off would keep a drift that fails readiness
+		name:       stageSchemaDrift,
+		configured: func(c *Config) bool { return c.SchemaDrift.Enabled },
+		summary: func(c *Config) map[string]interface{} {
+			return map[string]interface{}{"fields": len(c.SchemaDrift.Fields)}
+		},
+		counters: []string{"schema_drift_total"},
+	},
+}
+
+func stageByName(name string) (pipelineStage, bool) {
+	for _, stage := range pipelineStages {
+		if stage.name == name {
+			return stage, true
+		}
+	}
+	return pipelineStage{}, false
+}
+
+// featureSet is the stages switched off for one cycle. It is never changed
+// once published; a toggle publishes a new one.
+type featureSet map[string]bool
+
+// off reports whether the admin API switched stage off
+func (s featureSet) off(stage string) bool {
+	return s[stage]
+}
+
+// featureFlags holds the stages switched off through the admin API. Cycles
+// take the set when they start, so a toggle applies from the next cycle on
+// and never to half of one.
+type featureFlags struct {
+	config *Config
+	file   string
+	logger *logrus.Logger
+
+	// mu serializes the toggles; readers only load current
+	mu      sync.Mutex
+	current atomic.Pointer[featureSet]
+}
+
+// featuresState is the state file format
+type featuresState struct {
+	Version  int      `json:"version"`
+	Disabled []string `json:"disabled"`
+}
+
+func newFeatureFlags(config *Config, logger *logrus.Logger) *featureFlags {
+	f := &featureFlags{config: config, file: config.Features.StateFile, logger: logger}
+	f.current.Store(&featureSet{})
+	f.restore()
+	return f
+}
+
+// restore loads the state file. A missing file is not an error; stages that
+// cannot be switched off anymore are dropped from it.
+func (f *featureFlags) restore() {
+	if f.file == "" {
+		return
+	}
+	body, err := os.ReadFile(f.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var state featuresState
+	if err == nil {
+		err = json.Unmarshal(body, &state)
+	}
+	if err == nil && state.Version != featuresStateVersion {
+		err = fmt.Errorf("unsupported version %d", state.Version)
+	}
+	if err != nil {
+		f.logger.WithError(err).Warn("Discarding the pipeline stage overrides")
+		return
+	}
+	set := featureSet{}
+	for _, name := range state.Disabled {
+		if err := f.check(name); err != nil {
+			f.logger.WithField("stage", name).WithError(err).Warn("Dropping pipeline stage override")
+			continue
+		}
+		set[name] = true
+		f.logger.WithField("stage", name).Warn("Pipeline stage switched off by a saved override")
+	}
+	f.current.Store(&set)
+}
+
+// snapshot returns the set in effect, nil without flags
+func (f *featureFlags) snapshot() featureSet {
+	if f == nil {
+		return nil
+	}
+	return *f.current.Load()
+}
+
+// check returns why stage cannot be toggled, or nil
+func (f *featureFlags) check(name string) error {
+	stage, ok := stageByName(name)
+	switch {
+	case !ok:
+		return fmt.Errorf("%w %q", errUnknownStage, name)
+	case !stage.toggleable:
+		return fmt.Errorf("%w: %s", errStageNotRuntime, name)
+	case !stage.configured(f.config):
+		return fmt.Errorf("%w: %s", errStageNotConfigure, name)
+	}
+	return nil
+}
+
+// set switches a configured stage on or off. With a state file the new set
+// is saved before it applies, so a failed save changes nothing.
+func (f *featureFlags) set(name string, enabled bool) (changed bool, err error) {
+	if err := f.check(name); err != nil {
+		return false, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	current := f.snapshot()
+	if current.off(name) == !enabled {
+		return false, nil
+	}
+	next := make(featureSet, len(current)+1)
+	for stage := range current {
+		next[stage] = true
+	}
+	if enabled {
+		delete(next, name)
+	} else {
+		next[name] = true
+	}
+	if err := f.save(next); err != nil {
+		return false, err
+	}
+	f.current.Store(&next)
+	return true, nil
+}
+
+func (f *featureFlags) save(set featureSet) error {
+	if f.file == "" {
+		return nil
+	}
+	state := featuresState{Version: featuresStateVersion, Disabled: []string{}}
+	for stage := range set {
+		state.Disabled = append(state.Disabled, stage)
+	}
+	sort.Strings(state.Disabled)
+	body, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(f.file, body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save the pipeline stage overrides: %w", err)
+	}
+	return nil
+}
+
+// FeatureChange is a stage the reloaded config configures differently from
+// the running one
+type FeatureChange struct {
+	Stage      string `json:"stage"`
+	Configured bool   `json:"configured"`
+	Reloaded   bool   `json:"reloaded"`
+	// Override is set when the admin API switched the stage off
+	Override bool `json:"override,omitempty"`
+}
+
+// diff compares the stages of a reloaded config with the running ones.
+// Stages are configured once at start, so the changes need a restart.
+func (f *featureFlags) diff(reloaded *Config) []FeatureChange {
+	set := f.snapshot()
+	var changes []FeatureChange
+	for _, stage := range pipelineStages {
+		configured, next := stage.configured(f.config), stage.configured(reloaded)
+		if configured == next {
+			continue
+		}
+		changes = append(changes, FeatureChange{
+			Stage:      stage.name,
+			Configured: configured,
+			Reloaded:   next,
+			Override:   set.off(stage.name),
+		})
+	}
+	return changes
+}
+
+// reloadFeatures logs the stages a reloaded config changes
+func (di *DataIngestor) reloadFeatures(reloaded *Config) {
+	for _, change := range di.features.diff(reloaded) {
+		di.logger.WithFields(logrus.Fields{
+			"stage":      change.Stage,
+			"configured": change.Configured,
+			"reloaded":   change.Reloaded,
+			"override":   change.Override,
+		}).Warn("Pipeline stage changed in the config; that needs a restart")
+	}
+}
+
+type featuresKey struct{}
+
+// withFeatures makes the cycle run with ctx use the stages in effect now,
+// unless ctx has them already
+func (di *DataIngestor) withFeatures(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(featuresKey{}).(featureSet); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, featuresKey{}, di.features.snapshot())
+}
+
+// featuresOf returns the stages of the cycle of ctx, or those in effect now
+func (di *DataIngestor) featuresOf(ctx context.Context) featureSet {
+	if set, ok := ctx.Value(featuresKey{}).(featureSet); ok {
+		return set
+	}
+	return di.features.snapshot()
+}
+
+// FeatureStage is one entry of GET /admin/features
+type FeatureStage struct {
+	Name string `json:"name"`
+	// Enabled is whether the stage runs: configured and not switched off
+	Enabled    bool                   `json:"enabled"`
+	Configured bool                   `json:"configured"`
+	Toggleable bool                   `json:"toggleable"`
+	Override   bool                   `json:"override,omitempty"`
+	Config     map[string]interface{} `json:"config"`
+	Counters   map[string]float64     `json:"counters"`
+}
+
+func (di *DataIngestor) featureStage(stage pipelineStage, set featureSet, totals map[string]float64) FeatureStage {
+	configured := stage.configured(di.config)
+	entry := FeatureStage{
+		Name:       stage.name,
+		Enabled:    configured && !set.off(stage.name),
+		Configured: configured,
+		Toggleable: stage.toggleable,
+		Override:   set.off(stage.name),
+		Config:     stage.summary(di.config),
+		Counters:   make(map[string]float64, len(stage.counters)),
+	}
+	for _, counter := range stage.counters {
+		entry.Counters[counter] = totals[counter]
+	}
+	return entry
+}
+
+// handleFeatures serves GET /admin/features with every pipeline stage
+func (di *DataIngestor) handleFeatures(c *gin.Context) {
+	set, totals := di.features.snapshot(), di.metrics.totals()
+	stages := make([]FeatureStage, 0, len(pipelineStages))
+	for _, stage := range pipelineStages {
+		stages = append(stages, di.featureStage(stage, set, totals))
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"stages":    stages,
+		"persisted": di.features.file != "",
+	})
+}
+
+// featureToggle is the body of PATCH /admin/features/:name
+type featureToggle struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// handleFeatureToggle serves PATCH /admin/features/:name. The toggle applies
+// from the next cycle on.
+func (di *DataIngestor) handleFeatureToggle(c *gin.Context) {
+	name := c.Param("name")
+	var req featureToggle
+	if err := c.ShouldBindJSON(&req); err != nil || req.Enabled == nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": `the body must be {"enabled": true} or {"enabled": false}`,
+		})
+		return
+	}
+	changed, err := di.features.set(name, *req.Enabled)
+	switch {
+	case errors.Is(err, errUnknownStage):
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case errors.Is(err, errStageNotRuntime), errors.Is(err, errStageNotConfigure):
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if changed {
+		di.logger.WithFields(logrus.Fields{
+			"stage":   name,
+			"enabled": *req.Enabled,
+			"client":  c.ClientIP(),
+		}).Warn("Pipeline stage toggled by admin")
+		di.reloadSchema()
+	}
+	stage, _ := stageByName(name)
+	c.JSON(http.StatusOK, di.featureStage(stage, di.features.snapshot(), di.metrics.totals()))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFeaturesIngestor(t *testing.T, stateFile string) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	upstream := newUpstream(t, "application/json", `[
+		{"type":"energy","name":"meter-1","payload":{"energy":10}},
+		{"type":"energy","name":"meter-2","payload":{"energy":500}},
+		{"type":"energy","name":"meter-3","payload":{"energy":-1}}
+	]`)
+	ingestor := NewDataIngestor(&Config{
+		API:        APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "warn"},
+		Admin:      AdminConfig{Token: "letmein"},
+		Transforms: []TransformConfig{{Filter: "energy >= 0"}},
+		Validation: ValidationConfig{Bounds: map[string]Bounds{"energy": {Min: bound(0), Max: bound(100)}}},
+		Features:   FeaturesConfig{StateFile: stateFile},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+func featureCall(ingestor *DataIngestor, method, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer letmein")
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, req)
+	return w
+}
+
+func publishedNames(t *testing.T, channel *fakeChannel) []string {
+	t.Helper()
+	var names []string
+	for _, msg := range channel.messages() {
+		var data WeatherData
+		require.NoError(t, json.Unmarshal(msg.Msg.Body, &data))
+		for _, sensor := range data {
+			names = append(names, sensor.Name)
+		}
+	}
+	return names
+}
+
+func listFeatures(t *testing.T, ingestor *DataIngestor) map[string]FeatureStage {
+	t.Helper()
+	w := featureCall(ingestor, http.MethodGet, "/admin/features", "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		Stages []FeatureStage `json:"stages"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	stages := make(map[string]FeatureStage, len(body.Stages))
+	for _, stage := range body.Stages {
+		stages[stage.Name] = stage
+	}
+	return stages
+}
+
+func TestFeatures_ListAndToggle(t *testing.T) {
+	ingestor, channel := newFeaturesIngestor(t, "")
+	hook := test.NewLocal(ingestor.logger)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"meter-1"}, publishedNames(t, channel), "filtered and validated")
+
+	stages := listFeatures(t, ingestor)
+	require.Len(t, stages, len(pipelineStages))
+	assert.True(t, stages[stageTransforms].Enabled)
+	assert.True(t, stages[stageTransforms].Toggleable)
+	assert.Equal(t, 1.0, stages[stageTransforms].Counters["transform_filtered_total"])
+	assert.Equal(t, 1.0, stages[stageValidation].Counters["validation_failures_total"])
+	assert.Equal(t, float64(1), stages[stageValidation].Config["bounds"])
+	assert.False(t, stages[stageQuality].Configured)
+	assert.False(t, stages[stageReadingDedup].Toggleable)
+
+	w := featureCall(ingestor, http.MethodPatch, "/admin/features/validation", `{"enabled":false}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var stage FeatureStage
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stage))
+	assert.False(t, stage.Enabled)
+	assert.True(t, stage.Configured)
+	assert.True(t, stage.Override)
+	require.NotEmpty(t, hook.Entries)
+	assert.Equal(t, "Pipeline stage toggled by admin", hook.LastEntry().Message)
+	assert.Equal(t, "validation", hook.LastEntry().Data["stage"])
+
+	_, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"meter-1", "meter-1", "meter-2"}, publishedNames(t, channel), "the next cycle skips validation")
+
+	w = featureCall(ingestor, http.MethodPatch, "/admin/features/validation", `{"enabled":true}`)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, listFeatures(t, ingestor)[stageValidation].Enabled)
+	assert.False(t, listFeatures(t, ingestor)[stageValidation].Override)
+
+	w = featureCall(ingestor, http.MethodPatch, "/admin/features/quality", `{"enabled":false}`)
+	assert.Equal(t, http.StatusConflict, w.Code, "not configured")
+	w = featureCall(ingestor, http.MethodPatch, "/admin/features/reading_dedup", `{"enabled":false}`)
+	assert.Equal(t, http.StatusConflict, w.Code, "not toggleable")
+	w = featureCall(ingestor, http.MethodPatch, "/admin/features/anomalies", `{"enabled":false}`)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = featureCall(ingestor, http.MethodPatch, "/admin/features/transforms", `{}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestFeatures_CycleKeepsItsSnapshot(t *testing.T) {
+	ingestor, _ := newFeaturesIngestor(t, "")
+	data := WeatherData{
+		{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 10.0}},
+		{Type: "energy", Name: "meter-3", Payload: map[string]interface{}{"energy": -1.0}},
+	}
+
+	// Toggled while the cycle runs
+	cycle := ingestor.withFeatures(context.Background())
+	_, err := ingestor.features.set(stageTransforms, false)
+	require.NoError(t, err)
+	_, err = ingestor.features.set(stageValidation, false)
+	require.NoError(t, err)
+	assert.Len(t, ingestor.prepareReadings(cycle, data), 1, "the running cycle keeps both stages")
+	assert.Len(t, ingestor.prepareReadings(ingestor.withFeatures(cycle), data), 1, "nested lookups keep the cycle's stages")
+	assert.Len(t, ingestor.prepareReadings(ingestor.withFeatures(context.Background()), data), 2, "the next cycle has neither")
+}
+
+func TestFeatures_Persisted(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "features.json")
+	ingestor, _ := newFeaturesIngestor(t, stateFile)
+	w := featureCall(ingestor, http.MethodPatch, "/admin/features/transforms", `{"enabled":false}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	restarted, channel := newFeaturesIngestor(t, stateFile)
+	assert.True(t, restarted.features.snapshot().off(stageTransforms), "the override survives a restart")
+	_, err := restarted.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"meter-1"}, publishedNames(t, channel), "meter-3 passes the transforms and fails validation")
+
+	// Stages that cannot be switched off anymore are dropped
+	require.NoError(t, os.WriteFile(stateFile, []byte(`{"version":1,"disabled":["reading_dedup","anomalies","validation"]}`), 0o600))
+	restarted, _ = newFeaturesIngestor(t, stateFile)
+	assert.Equal(t, featureSet{stageValidation: true}, restarted.features.snapshot())
+
+	// A toggle that cannot be saved is not applied
+	broken, _ := newFeaturesIngestor(t, filepath.Join(t.TempDir(), "missing", "features.json"))
+	w = featureCall(broken, http.MethodPatch, "/admin/features/transforms", `{"enabled":false}`)
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.False(t, broken.features.snapshot().off(stageTransforms))
+}
+
+func TestFeatures_ConcurrentToggles(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "features.json")
+	ingestor, _ := newFeaturesIngestor(t, stateFile)
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 10.0}}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			name, body := stageTransforms, `{"enabled":false}`
+			if i%2 == 1 {
+				name = stageValidation
+			}
+			if i%4 < 2 {
+				body = `{"enabled":true}`
+			}
+			w := featureCall(ingestor, http.MethodPatch, "/admin/features/"+name, body)
+			assert.Equal(t, http.StatusOK, w.Code)
+		}(i)
+		go func() {
+			defer wg.Done()
+			assert.Len(t, ingestor.prepareReadings(ingestor.withFeatures(context.Background()), data), 1)
+		}()
+	}
+	wg.Wait()
+
+	// The saved state is the one in effect
+	restarted, _ := newFeaturesIngestor(t, stateFile)
+	assert.Equal(t, ingestor.features.snapshot(), restarted.features.snapshot())
+}
+
+func TestFeatures_ReloadNeedsARestart(t *testing.T) {
+	ingestor, _ := newFeaturesIngestor(t, "")
+	_, err := ingestor.features.set(stageTransforms, false)
+	require.NoError(t, err)
+
+	reloaded := *ingestor.config
+	reloaded.Transforms = nil
+	reloaded.Quality = QualityConfig{Enabled: true}
+	assert.Equal(t, []FeatureChange{
+		{Stage: stageTransforms, Configured: true, Reloaded: false, Override: true},
+		{Stage: stageQuality, Configured: false, Reloaded: true},
+	}, ingestor.features.diff(&reloaded))
+	assert.Empty(t, ingestor.features.diff(ingestor.config))
+
+	hook := test.NewLocal(ingestor.logger)
+	ingestor.reloadFeatures(&reloaded)
+	require.Len(t, hook.Entries, 2)
+	assert.Equal(t, "Pipeline stage changed in the config; that needs a restart", hook.Entries[0].Message)
+}
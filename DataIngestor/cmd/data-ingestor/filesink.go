@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	rotateHourly = "hourly"
+	rotateDaily  = "daily"
+
+	defaultFileSinkPrefix = "weather"
+)
+
+// FileSinkConfig configures the NDJSON archive of published readings
+type FileSinkConfig struct {
+	// Dir receives the archive files. The file sink is disabled when it is empty.
+	Dir    string `yaml:"dir"`
+	Prefix string `yaml:"prefix"`
+	// Rotate starts a new file every hour or day (UTC)
+	Rotate string `yaml:"rotate"`
+	// MaxFileSize starts a new numbered part once a file reaches this many bytes
+	MaxFileSize ByteSize `yaml:"max_file_size"`
+	// Retention removes old files once a day
+	Retention ArchiveRetentionConfig `yaml:"retention"`
+	// DiskGuard drops the oldest files while the volume is nearly full
+	DiskGuard DiskGuardConfig `yaml:"disk_guard"`
+}
+
+// Validate checks the rotation setting, the retention and the disk guard
+func (c FileSinkConfig) Validate() error {
+	switch c.Rotate {
+	case "", rotateHourly, rotateDaily:
+	default:
+		return fmt.Errorf("file_sink.rotate must be %q or %q, got %q", rotateHourly, rotateDaily, c.Rotate)
+	}
+	if c.MaxFileSize < 0 {
+		return fmt.Errorf("file_sink.max_file_size must not be negative")
+	}
+	return c.validateLifecycle()
+}
+
+// ArchiveRecord is one line of an archive file
+type ArchiveRecord struct {
+	ReceivedAt time.Time `json:"received_at"`
+	SensorData
+}
+
+// FileSink appends published readings to time-bucketed NDJSON files such as
+// weather-2024-05-03T14.ndjson. A file is sealed with its SHA-256 in
+// weather-2024-05-03T14.ndjson.sha256 once the sink moves on from it.
+type FileSink struct {
+	config FileSinkConfig
+
+	mu     sync.Mutex
+	file   *os.File
+	path   string
+	out    *hashingWriter
+	bucket string
+	part   int
+	size   int64
+	// removing holds the files retention or the disk guard are removing,
+	// which open skips
+	removing map[string]bool
+}
+
+// NewFileSink returns a FileSink, or nil when no directory is configured
+func NewFileSink(config FileSinkConfig) *FileSink {
+	if config.Dir == "" {
+		return nil
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultFileSinkPrefix
+	}
+	if config.Rotate == "" {
+		config.Rotate = rotateHourly
+	}
+	return &FileSink{config: config}
+}
+
+// bucketFor returns the time bucket a record received at t belongs to
+func (s *FileSink) bucketFor(t time.Time) string {
+	if s.config.Rotate == rotateDaily {
+		return t.UTC().Format("2006-01-02")
+	}
+	return t.UTC().Format("2006-01-02T15")
+}
+
+// fileName returns the archive file name for a bucket and part
+func (s *FileSink) fileName(bucket string, part int) string {
+	if part == 0 {
+		return fmt.Sprintf("%s-%s.ndjson", s.config.Prefix, bucket)
+	}
+	return fmt.Sprintf("%s-%s.%d.ndjson", s.config.Prefix, bucket, part)
+}
+
+// Write appends one record per reading, all stamped with receivedAt
+func (s *FileSink) Write(receivedAt time.Time, data WeatherData) error {
+	_, err := s.write(receivedAt, data)
+	return err
+}
+
+// write is Write that also returns how many records were written before it
+// failed
+func (s *FileSink) write(receivedAt time.Time, data WeatherData) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, sensor := range data {
+		line, err := json.Marshal(ArchiveRecord{ReceivedAt: receivedAt.UTC(), SensorData: sensor})
+		if err != nil {
+			return i, fmt.Errorf("failed to marshal archive record: %w", err)
+		}
+		line = append(line, '\n')
+
+		if err := s.rotate(receivedAt, int64(len(line))); err != nil {
+			return i, err
+		}
+		n, err := s.out.Write(line)
+		s.size += int64(n)
+		if err != nil {
+			return i, fmt.Errorf("failed to write archive record: %w", err)
+		}
+	}
+	return len(data), nil
+}
+
+// rotate makes sure the open file matches the record's bucket and has room
+// for another n bytes
+func (s *FileSink) rotate(receivedAt time.Time, n int64) error {
+	bucket := s.bucketFor(receivedAt)
+	full := s.config.MaxFileSize > 0 && s.size > 0 && s.size+n > int64(s.config.MaxFileSize)
+
+	if s.file != nil && bucket == s.bucket && !full {
+		return nil
+	}
+
+	part := 0
+	if bucket == s.bucket {
+		part = s.part
+		if full {
+			part++
+		}
+	}
+	return s.open(bucket, part, n)
+}
+
+// open opens the first part at or after part that has room for n more
+// bytes, appending to files left over from a previous run. A sealed file
+// that no longer matches its checksum is left as it is for replay and
+// verify to report.
+func (s *FileSink) open(bucket string, part int, n int64) error {
+	if err := s.seal(); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.config.Dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create file sink directory: %w", err)
+	}
+
+	for ; ; part++ {
+		path := filepath.Join(s.config.Dir, s.fileName(bucket, part))
+		if s.removing[path] {
+			continue
+		}
+		var size int64
+		if info, err := os.Stat(path); err == nil {
+			size = info.Size()
+		}
+		if s.config.MaxFileSize > 0 && size > 0 && size+n > int64(s.config.MaxFileSize) {
+			continue
+		}
+
+		file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to open archive file: %w", err)
+		}
+		out := newHashingWriter(file)
+		if size > 0 {
+			want, sealed := readChecksum(path)
+			if err := out.resume(path); err != nil {
+				file.Close()
+				return fmt.Errorf("failed to hash archive file: %w", err)
+			}
+			if errors.Is(sealed, errArchiveCorrupt) || (sealed == nil && out.sum() != want) {
+				file.Close()
+				continue
+			}
+		}
+		// Appended to, the file is no longer sealed
+		if err := os.Remove(path + checksumSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			file.Close()
+			return fmt.Errorf("failed to unseal archive file: %w", err)
+		}
+		s.file, s.path, s.out, s.bucket, s.part, s.size = file, path, out, bucket, part, size
+		return nil
+	}
+}
+
+// seal closes the current file and writes its checksum, computed as it was
+// written
+func (s *FileSink) seal() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return fmt.Errorf("failed to close archive file: %w", err)
+	}
+	return writeChecksum(s.path, s.out.sum())
+}
+
+// Close closes and seals the current file
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.seal()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// archiveFiles lists the archive files in dir, without their checksums
+func archiveFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), checksumSuffix) {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func readArchive(t *testing.T, path string) []ArchiveRecord {
+	t.Helper()
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	var records []ArchiveRecord
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var record ArchiveRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	require.NoError(t, scanner.Err())
+	return records
+}
+
+func TestFileSink_HourlyRotation(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewFileSink(FileSinkConfig{Dir: dir, Rotate: rotateHourly})
+	defer sink.Close()
+
+	at := time.Date(2024, 5, 3, 14, 59, 0, 0, time.UTC)
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	require.NoError(t, sink.Write(at, data))
+	require.NoError(t, sink.Write(at.Add(2*time.Minute), data))
+
+	assert.Equal(t, []string{"weather-2024-05-03T14.ndjson", "weather-2024-05-03T15.ndjson"}, archiveFiles(t, dir))
+
+	records := readArchive(t, filepath.Join(dir, "weather-2024-05-03T14.ndjson"))
+	require.Len(t, records, 1)
+	assert.True(t, at.Equal(records[0].ReceivedAt))
+	assert.Equal(t, "meter-1", records[0].Name)
+	assert.Equal(t, 1.0, records[0].Payload["energy"])
+}
+
+func TestFileSink_DailyRotationUsesUTC(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewFileSink(FileSinkConfig{Dir: dir, Rotate: rotateDaily, Prefix: "readings"})
+	defer sink.Close()
+
+	moscow := time.FixedZone("MSK", 3*3600)
+	data := WeatherData{{Type: "energy", Name: "meter-1"}}
+	require.NoError(t, sink.Write(time.Date(2024, 5, 4, 1, 0, 0, 0, moscow), data))
+	require.NoError(t, sink.Write(time.Date(2024, 5, 3, 23, 0, 0, 0, time.UTC), data))
+
+	assert.Equal(t, []string{"readings-2024-05-03.ndjson"}, archiveFiles(t, dir))
+}
+
+func TestFileSink_MaxFileSize(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewFileSink(FileSinkConfig{Dir: dir, MaxFileSize: 150})
+
+	at := time.Date(2024, 5, 3, 14, 0, 0, 0, time.UTC)
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sink.Write(at, data))
+	}
+	require.NoError(t, sink.Close())
+
+	files := archiveFiles(t, dir)
+	assert.Equal(t, []string{
+		"weather-2024-05-03T14.1.ndjson",
+		"weather-2024-05-03T14.2.ndjson",
+		"weather-2024-05-03T14.ndjson",
+	}, files)
+	for _, name := range files {
+		info, err := os.Stat(filepath.Join(dir, name))
+		require.NoError(t, err)
+		assert.LessOrEqual(t, info.Size(), int64(150))
+	}
+
+	// A restarted sink continues after the existing full parts
+	sink = NewFileSink(FileSinkConfig{Dir: dir, MaxFileSize: 150})
+	require.NoError(t, sink.Write(at, data))
+	require.NoError(t, sink.Close())
+	assert.Contains(t, archiveFiles(t, dir), "weather-2024-05-03T14.3.ndjson")
+}
+
+func TestFileSinkConfig_Validate(t *testing.T) {
+	assert.NoError(t, FileSinkConfig{Rotate: "daily"}.Validate())
+	assert.Error(t, FileSinkConfig{Rotate: "weekly"}.Validate())
+	assert.Nil(t, NewFileSink(FileSinkConfig{}))
+}
+
+func TestIngest_WritesFileSink(t *testing.T) {
+	dir := t.TempDir()
+	upstream := newUpstream(t, "application/json", rawUpstreamBody)
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		FileSink: FileSinkConfig{Dir: dir},
+	})
+	withConfirms(ingestor, &fakeChannel{})
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, ingestor.Close())
+
+	files := archiveFiles(t, dir)
+	require.Len(t, files, 1)
+	records := readArchive(t, filepath.Join(dir, files[0]))
+	require.Len(t, records, 1)
+	assert.Equal(t, "meter-1", records[0].Name)
+}
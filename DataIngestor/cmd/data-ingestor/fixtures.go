@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// fixtureNameFormat numbers the fixture files of a location in the order
+// they were recorded
+const fixtureNameFormat = "%06d.json"
+
+// fixture is one recorded upstream response, or the error in its place.
+// Request headers are not recorded, so fixtures hold no credentials.
+type fixture struct {
+	Request fixtureRequest `json:"request"`
+	Status  int            `json:"status,omitempty"`
+	Headers http.Header    `json:"headers,omitempty"`
+	Body    string         `json:"body,omitempty"`
+	// Error is why the request failed without a response
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+type fixtureRequest struct {
+	Method string `json:"method"`
+	URL    string `json:"url"`
+}
+
+// fixtureStore records upstream responses to, or replays them from, a
+// directory with a subdirectory per location
+type fixtureStore struct {
+	dir    string
+	replay bool
+	// timing sleeps for the recorded duration before replaying a response
+	timing bool
+	logger *logrus.Logger
+
+	mu sync.Mutex
+	// next is the number of the next fixture per location
+	next map[string]int
+	// replayed holds the fixture files per location, read on first use
+	replayed map[string][]string
+}
+
+// newFixtureStore returns nil unless debug.record_responses or
+// debug.replay_responses is set
+func newFixtureStore(config DebugConfig, logger *logrus.Logger) *fixtureStore {
+	store := &fixtureStore{
+		dir:      config.RecordResponses,
+		timing:   config.ReplayTiming,
+		logger:   logger,
+		next:     make(map[string]int),
+		replayed: make(map[string][]string),
+	}
+	if config.ReplayResponses != "" {
+		store.dir, store.replay = config.ReplayResponses, true
+	}
+	if store.dir == "" {
+		return nil
+	}
+	return store
+}
+
+func (s *fixtureStore) locationDir(location string) string {
+	return filepath.Join(s.dir, url.PathEscape(location))
+}
+
+// record saves the outcome of one request. The body is read, up to limit
+// bytes, and put back for the caller.
+func (s *fixtureStore) record(location string, req *http.Request, resp *http.Response, err error, start time.Time, limit int64) (*http.Response, error) {
+	f := fixture{Request: fixtureRequest{Method: req.Method, URL: req.URL.RequestURI()}}
+	if err != nil {
+		f.Error = err.Error()
+	} else {
+		body, readErr := io.ReadAll(io.LimitReader(resp.Body, limit))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if readErr != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", readErr)
+		}
+		f.Status, f.Body = resp.StatusCode, string(body)
+		f.Headers = resp.Header.Clone()
+		f.Headers.Del("Set-Cookie")
+	}
+	f.DurationMs = time.Since(start).Milliseconds()
+
+	if saveErr := s.save(location, f); saveErr != nil {
+		s.logger.WithError(saveErr).WithField("location", location).Error("Failed to record upstream response")
+	}
+	return resp, err
+}
+
+func (s *fixtureStore) save(location string, f fixture) error {
+	body, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir := s.locationDir(location)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	next, ok := s.next[location]
+	if !ok {
+		// Continue after the fixtures of an earlier run
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+		existing, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		next = len(existing) + 1
+	}
+	path := filepath.Join(dir, fmt.Sprintf(fixtureNameFormat, next))
+	if err := os.WriteFile(path, append(body, '\n'), 0o644); err != nil {
+		return err
+	}
+	s.next[location] = next + 1
+	return nil
+}
+
+// serve returns the next recorded response of location. Once every fixture
+// was served it answers 204, which the pipeline treats as no data.
+func (s *fixtureStore) serve(ctx context.Context, location string, req *http.Request) (*http.Response, error) {
+	f, err := s.nextFixture(location)
+	if err != nil {
+		return nil, err
+	}
+	if f == nil {
+		return fixtureResponse(req, http.StatusNoContent, nil, ""), nil
+	}
+	if s.timing && f.DurationMs > 0 {
+		if err := sleepContext(ctx, time.Duration(f.DurationMs)*time.Millisecond); err != nil {
+			return nil, err
+		}
+	}
+	if f.Error != "" {
+		return nil, errors.New(f.Error)
+	}
+	return fixtureResponse(req, f.Status, f.Headers, f.Body), nil
+}
+
+// nextFixture reads the next fixture of location, or returns nil when there
+// are no more
+func (s *fixtureStore) nextFixture(location string) (*fixture, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	files, ok := s.replayed[location]
+	if !ok {
+		var err error
+		files, err = filepath.Glob(filepath.Join(s.locationDir(location), "*.json"))
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(files)
+		if len(files) == 0 {
+			s.logger.WithField("location", location).Warn("No replay fixtures for location")
+		}
+	}
+	if len(files) == 0 {
+		s.replayed[location] = files
+		return nil, nil
+	}
+
+	path := files[0]
+	s.replayed[location] = files[1:]
+	if len(files) == 1 {
+		s.logger.WithField("location", location).Info("Replayed the last fixture")
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fixture: %w", err)
+	}
+	var f fixture
+	if err := json.Unmarshal(body, &f); err != nil {
+		return nil, fmt.Errorf("invalid fixture %s: %w", path, err)
+	}
+	return &f, nil
+}
+
+func fixtureResponse(req *http.Request, status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// doUpstream sends a request to the upstream of src, recording the response
+// or replaying a recorded one instead when fixtures are configured
+func (di *DataIngestor) doUpstream(src *source, req *http.Request, limit int64) (*http.Response, error) {
+	if err := di.faults.upstreamError(src.name); err != nil {
+		return nil, err
+	}
+	if di.fixtures != nil && di.fixtures.replay {
+		return di.fixtures.serve(req.Context(), src.name, req)
+	}
+	start := time.Now()
+	resp, err := di.httpClient.Do(req)
+	if di.fixtures != nil {
+		return di.fixtures.record(src.name, req, resp, err, start, limit)
+	}
+	return resp, err
+}
+
+// replayFlags registers the flags that replay fixtures instead of calling
+// the upstream
+func replayFlags(flags *flag.FlagSet) (dir *string, timing *bool) {
+	dir = flags.String("replay-dir", "", "serve upstream responses from the fixtures in this directory, like debug.replay_responses")
+	timing = flags.Bool("replay-timing", false, "wait the recorded duration before every replayed response, like debug.replay_timing")
+	return dir, timing
+}
+
+// applyReplayFlags overrides the replay settings of config with the flags
+func applyReplayFlags(config *Config, dir string, timing bool) {
+	if dir != "" {
+		config.Debug.ReplayResponses = dir
+		config.Debug.RecordResponses = ""
+	}
+	config.Debug.ReplayTiming = config.Debug.ReplayTiming || timing
+}
+
+// runIngestOnce implements the ingest-once subcommand, which runs a single
+// ingestion cycle for every location and exits
+func runIngestOnce(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("ingest-once", flag.ContinueOnError)
+	configPath := flags.String("config", "config.yaml", "path to the config file")
+	replayDir, replayTiming := replayFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config from %s: %w", *configPath, err)
+	}
+	applyReplayFlags(config, *replayDir, *replayTiming)
+
+	ingestor := NewDataIngestor(config)
+	defer ingestor.Close()
+	if err := ingestor.LoadEnrichment(); err != nil {
+		return err
+	}
+	if err := ingestor.ConfigureAuth(); err != nil {
+		return fmt.Errorf("failed to configure upstream auth: %w", err)
+	}
+	if err := ingestor.ConnectPubSub(ctx); err != nil {
+		return fmt.Errorf("failed to connect to Pub/Sub: %w", err)
+	}
+	if err := ingestor.ConnectToRabbitMQ(); err != nil {
+		return err
+	}
+
+	cycle := ingestor.RunCycle(ctx)
+	for _, outcome := range cycle.Locations {
+		ingestor.logOutcome(outcome)
+	}
+	result, err := cycle.ingestResult()
+	if errors.Is(err, ErrNoData) {
+		ingestor.logger.Info("No data to ingest")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	ingestor.logger.WithFields(logrus.Fields{
+		"status":   cycle.Status,
+		"readings": len(*result.Data),
+		"messages": len(result.MessageIDs),
+	}).Info("Ingested once")
+	return nil
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// weakappFixtures is a sanitized recording of the upstream: three readings,
+// a 500, two readings and no data
+var weakappFixtures = filepath.Join("testdata", "fixtures", "weakapp")
+
+func newFixtureTestIngestor(t *testing.T, baseURL string, debug DebugConfig) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: baseURL, Timeout: Duration(5 * time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+		Debug:    debug,
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+func TestFixtures_ReplayRunsThePipeline(t *testing.T) {
+	// Nothing listens here; every response comes from the fixtures
+	ingestor, channel := newFixtureTestIngestor(t, "http://127.0.0.1:1", DebugConfig{ReplayResponses: weakappFixtures})
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, *result.Data, 3)
+
+	_, err = ingestor.ingest(context.Background())
+	assert.ErrorContains(t, err, "500")
+
+	result, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, *result.Data, 2)
+
+	for i := 0; i < 2; i++ {
+		_, err = ingestor.ingest(context.Background())
+		assert.ErrorIs(t, err, ErrNoData, "the last fixture and past the end")
+	}
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	var first WeatherData
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &first))
+	assert.Equal(t, "moscow", first[0].Name)
+	assert.Equal(t, -3.5, first[0].Payload["temperature"])
+	assert.Equal(t, "meter-1", first[2].Name)
+}
+
+func TestFixtures_RecordThenReplay(t *testing.T) {
+	var calls atomic.Int64
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 2 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Set-Cookie", "session=secret")
+		w.Write([]byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`))
+	}))
+	defer upstream.Close()
+	dir := t.TempDir()
+
+	recorder, recorded := newFixtureTestIngestor(t, upstream.URL, DebugConfig{RecordResponses: dir})
+	for i := 0; i < 3; i++ {
+		recorder.ingest(context.Background())
+	}
+	files, err := filepath.Glob(filepath.Join(dir, defaultSourceName, "*.json"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join(dir, defaultSourceName, "000001.json"),
+		filepath.Join(dir, defaultSourceName, "000002.json"),
+		filepath.Join(dir, defaultSourceName, "000003.json"),
+	}, files)
+
+	body, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	var f fixture
+	require.NoError(t, json.Unmarshal(body, &f))
+	assert.Equal(t, http.StatusOK, f.Status)
+	assert.Equal(t, fixtureRequest{Method: http.MethodGet, URL: "/meters"}, f.Request)
+	assert.Equal(t, "application/json", f.Headers.Get("Content-Type"))
+	assert.Empty(t, f.Headers.Get("Set-Cookie"), "cookies are not recorded")
+
+	// Replaying publishes what the live run published
+	upstream.Close()
+	replayer, replayed := newFixtureTestIngestor(t, upstream.URL, DebugConfig{ReplayResponses: dir})
+	for i := 0; i < 3; i++ {
+		replayer.ingest(context.Background())
+	}
+	require.Len(t, replayed.messages(), 2)
+	for i, msg := range replayed.messages() {
+		assert.Equal(t, recorded.messages()[i].Msg.Body, msg.Msg.Body)
+	}
+
+	// A second recording continues the numbering
+	recorder, _ = newFixtureTestIngestor(t, upstream.URL, DebugConfig{RecordResponses: dir})
+	_, liveErr := recorder.ingest(context.Background())
+	require.Error(t, liveErr)
+	body, err = os.ReadFile(filepath.Join(dir, defaultSourceName, "000004.json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(body, &f))
+	assert.NotEmpty(t, f.Error, "the failed request is recorded as an error")
+
+	// and replayed as one
+	replayer, _ = newFixtureTestIngestor(t, upstream.URL, DebugConfig{ReplayResponses: dir})
+	for i := 0; i < 3; i++ {
+		replayer.ingest(context.Background())
+	}
+	_, err = replayer.ingest(context.Background())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), f.Error)
+}
+
+func TestFixtures_ReplayTiming(t *testing.T) {
+	dir := t.TempDir()
+	store := newFixtureStore(DebugConfig{RecordResponses: dir}, logrus.New())
+	require.NoError(t, store.save("default", fixture{Status: http.StatusNoContent, DurationMs: 60}))
+
+	for _, timing := range []bool{false, true} {
+		ingestor, _ := newFixtureTestIngestor(t, "http://127.0.0.1:1", DebugConfig{ReplayResponses: dir, ReplayTiming: timing})
+		start := time.Now()
+		_, err := ingestor.ingest(context.Background())
+		elapsed := time.Since(start)
+		assert.ErrorIs(t, err, ErrNoData)
+		if timing {
+			assert.GreaterOrEqual(t, elapsed, 60*time.Millisecond)
+		} else {
+			assert.Less(t, elapsed, 60*time.Millisecond)
+		}
+	}
+}
+
+func TestApplyReplayFlags(t *testing.T) {
+	config := &Config{Debug: DebugConfig{RecordResponses: "recordings"}}
+	applyReplayFlags(config, "", false)
+	assert.Equal(t, "recordings", config.Debug.RecordResponses)
+
+	applyReplayFlags(config, "fixtures", true)
+	assert.Equal(t, DebugConfig{ReplayResponses: "fixtures", ReplayTiming: true}, config.Debug)
+	assert.NoError(t, config.Validate())
+
+	assert.ErrorContains(t, DebugConfig{RecordResponses: "a", ReplayResponses: "b"}.Validate(), "cannot both be set")
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// defaultFlowMaxWait is how long a publish waits for the broker to stop
+// throttling before the cycle gives up
+const defaultFlowMaxWait = 30 * time.Second
+
+// ErrBrokerThrottled is returned when the broker throttled publishers for
+// longer than rabbitmq.flow_control.max_wait
+var ErrBrokerThrottled = errors.New("broker is throttling publishers")
+
+// FlowControlConfig controls how publishing cooperates with broker flow
+// control and resource alarms
+type FlowControlConfig struct {
+	// MaxWait is how long a publish waits for the broker to lift the throttle
+	MaxWait Duration `yaml:"max_wait"`
+}
+
+// Validate checks the wait is not negative
+func (c FlowControlConfig) Validate() error {
+	if c.MaxWait < 0 {
+		return fmt.Errorf("rabbitmq.flow_control.max_wait must not be negative")
+	}
+	return nil
+}
+
+func (c FlowControlConfig) maxWait() time.Duration {
+	if c.MaxWait <= 0 {
+		return defaultFlowMaxWait
+	}
+	return time.Duration(c.MaxWait)
+}
+
+// FlowStatus is the broker throttling state reported by /ready
+type FlowStatus struct {
+	Throttled bool      `json:"throttled"`
+	Reason    string    `json:"reason,omitempty"`
+	Since     time.Time `json:"since,omitempty"`
+}
+
+// brokerFlow tracks whether the broker is throttling publishers, either with
+// channel.flow or with connection.blocked during a memory or disk alarm
+type brokerFlow struct {
+	logger  *logrus.Logger
+	metrics *Metrics
+
+	mu sync.Mutex
+	// paused is set by channel.flow, blocked by connection.blocked
+	paused  bool
+	blocked string
+	since   time.Time
+	// released is closed when the throttle is lifted
+	released chan struct{}
+	// factor stretches the poll interval, doubling every poll interval
+	// while the broker throttles; grownAt is when it last doubled
+	factor  int
+	grownAt time.Time
+}
+
+func newBrokerFlow(logger *logrus.Logger, metrics *Metrics) *brokerFlow {
+	return &brokerFlow{logger: logger, metrics: metrics, released: make(chan struct{}), factor: 1}
+}
+
+// reason describes why the broker throttles. Callers hold mu.
+func (f *brokerFlow) reason() string {
+	switch {
+	case f.blocked != "":
+		return f.blocked
+	case f.paused:
+		return "channel flow paused"
+	}
+	return ""
+}
+
+// update applies a change and logs when throttling starts or ends. Callers
+// hold mu; throttled is the state before the change.
+func (f *brokerFlow) update(throttled bool, now time.Time) {
+	switch reason := f.reason(); {
+	case !throttled && reason != "":
+		f.since = now
+		f.metrics.BrokerThrottled.Set(1)
+		f.logger.WithField("reason", reason).Warn("Broker is throttling publishers, backing off")
+	case throttled && reason == "":
+		f.metrics.BrokerThrottled.Set(0)
+		f.logger.WithField("duration", now.Sub(f.since).String()).Info("Broker stopped throttling publishers")
+		f.since = time.Time{}
+		f.factor, f.grownAt = 1, time.Time{}
+		close(f.released)
+		f.released = make(chan struct{})
+	}
+}
+
+// setFlow records a channel.flow change; active is false while paused
+func (f *brokerFlow) setFlow(active bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	throttled := f.reason() != ""
+	f.paused = !active
+	f.update(throttled, time.Now())
+}
+
+// setBlocked records a connection.blocked or connection.unblocked
+func (f *brokerFlow) setBlocked(blocking amqp.Blocking) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	throttled := f.reason() != ""
+	f.blocked = ""
+	if blocking.Active {
+		f.blocked = "connection blocked"
+		if blocking.Reason != "" {
+			f.blocked += ": " + blocking.Reason
+		}
+	}
+	f.update(throttled, time.Now())
+}
+
+// reset clears the state of a previous connection
+func (f *brokerFlow) reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	throttled := f.reason() != ""
+	f.paused, f.blocked = false, ""
+	f.update(throttled, time.Now())
+}
+
+func (f *brokerFlow) status() FlowStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	reason := f.reason()
+	return FlowStatus{Throttled: reason != "", Reason: reason, Since: f.since}
+}
+
+// wait blocks while the broker throttles, for at most maxWait, instead of
+// adding publishes the broker cannot take yet
+func (f *brokerFlow) wait(maxWait time.Duration) error {
+	f.mu.Lock()
+	if f.reason() == "" {
+		f.mu.Unlock()
+		return nil
+	}
+	released := f.released
+	f.mu.Unlock()
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+	select {
+	case <-released:
+		f.metrics.FlowWaits.WithLabelValues("released").Inc()
+		return nil
+	case <-timer.C:
+		f.metrics.FlowWaits.WithLabelValues("timeout").Inc()
+		return fmt.Errorf("%w after waiting %s", ErrBrokerThrottled, maxWait)
+	}
+}
+
+// scale stretches a poll delay while the broker throttles. The factor
+// doubles at most once per poll interval, however many locations end a
+// cycle in it, until the throttle is lifted.
+func (f *brokerFlow) scale(now time.Time, delay, interval, max time.Duration) time.Duration {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.reason() == "" {
+		return delay
+	}
+	if f.factor < maxBackpressureFactor && (f.grownAt.IsZero() || now.Sub(f.grownAt) >= interval) {
+		f.factor *= 2
+		f.grownAt = now
+	}
+	scaled := delay * time.Duration(f.factor)
+	if scaled > max {
+		scaled = max
+	}
+	if scaled < delay {
+		return delay
+	}
+	return scaled
+}
+
+// listenFlow feeds the broker's flow notifications to the throttle state
+// until both channels are closed with the connection
+func (di *DataIngestor) listenFlow(flow <-chan bool, blocked <-chan amqp.Blocking) {
+	for flow != nil || blocked != nil {
+		select {
+		case active, ok := <-flow:
+			if !ok {
+				flow = nil
+				continue
+			}
+			di.flow.setFlow(active)
+		case blocking, ok := <-blocked:
+			if !ok {
+				blocked = nil
+				continue
+			}
+			di.flow.setBlocked(blocking)
+		}
+	}
+}
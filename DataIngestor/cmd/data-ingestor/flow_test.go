@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// simulateFlow feeds flow notifications to the ingestor like a broker
+// connection would, returning the channels to toggle them
+func simulateFlow(t *testing.T, di *DataIngestor) (chan<- bool, chan<- amqp.Blocking) {
+	t.Helper()
+	flow := make(chan bool)
+	blocked := make(chan amqp.Blocking)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		di.listenFlow(flow, blocked)
+	}()
+	t.Cleanup(func() {
+		close(flow)
+		close(blocked)
+		<-done
+	})
+	return flow, blocked
+}
+
+func waitThrottled(t *testing.T, di *DataIngestor, throttled bool) {
+	t.Helper()
+	require.Eventually(t, func() bool { return di.flow.status().Throttled == throttled }, time.Second, time.Millisecond)
+}
+
+func TestBrokerFlow_EntryAndExitLoggedOnce(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	logger, hook := test.NewNullLogger()
+	ingestor.flow.logger = logger
+	f := ingestor.flow
+
+	f.setFlow(false)
+	f.setBlocked(amqp.Blocking{Active: true, Reason: "low on memory"})
+	assert.Equal(t, FlowStatus{Throttled: true, Reason: "connection blocked: low on memory", Since: ingestor.flow.status().Since}, ingestor.flow.status())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.BrokerThrottled))
+
+	f.setFlow(true)
+	assert.True(t, ingestor.flow.status().Throttled, "still blocked by the alarm")
+	f.setBlocked(amqp.Blocking{Active: false})
+	assert.False(t, ingestor.flow.status().Throttled)
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.BrokerThrottled))
+
+	entries := hook.AllEntries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, logrus.WarnLevel, entries[0].Level)
+	assert.Equal(t, "channel flow paused", entries[0].Data["reason"])
+	assert.Equal(t, logrus.InfoLevel, entries[1].Level)
+	assert.Equal(t, "Broker stopped throttling publishers", entries[1].Message)
+
+	// A reconnect clears the state of the old connection
+	f.setFlow(false)
+	f.reset()
+	assert.False(t, ingestor.flow.status().Throttled)
+	assert.Len(t, hook.AllEntries(), 4)
+}
+
+func TestPublish_WaitsWhileBrokerThrottles(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	flow, _ := simulateFlow(t, ingestor)
+	flow <- false
+	waitThrottled(t, ingestor, true)
+
+	published := make(chan error, 1)
+	go func() {
+		published <- ingestor.PublishToQueue(&WeatherData{{Type: "energy", Name: "meter-1"}})
+	}()
+
+	select {
+	case err := <-published:
+		t.Fatalf("published while throttled: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Empty(t, channel.messages())
+
+	flow <- true
+	require.NoError(t, <-published)
+	assert.Len(t, channel.messages(), 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.FlowWaits.WithLabelValues("released")))
+}
+
+func TestIngest_DeferredWhenThrottledTooLong(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	ingestor.config.RabbitMQ.FlowControl.MaxWait = Duration(20 * time.Millisecond)
+	_, blocked := simulateFlow(t, ingestor)
+	blocked <- amqp.Blocking{Active: true, Reason: "low on disk"}
+	waitThrottled(t, ingestor, true)
+
+	_, err := ingestor.ingestSource(context.Background(), ingestor.sources[0])
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, ErrBrokerThrottled), err.Error())
+	assert.Empty(t, channel.messages())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.FlowWaits.WithLabelValues("timeout")))
+}
+
+func TestBrokerFlow_ScaleBacksOffExponentially(t *testing.T) {
+	logger, _ := test.NewNullLogger()
+	ingestor, _ := newAdminTestIngestor(t)
+	f := newBrokerFlow(logger, ingestor.metrics)
+	interval, max := 5*time.Second, time.Minute
+
+	now := time.Now()
+	assert.Equal(t, interval, f.scale(now, interval, interval, max))
+	f.setFlow(false)
+	for _, want := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute, time.Minute} {
+		assert.Equal(t, want, f.scale(now, interval, interval, max))
+		assert.Equal(t, want, f.scale(now.Add(time.Second), interval, interval, max), "the factor doubles once per interval")
+		now = now.Add(interval)
+	}
+	f.setFlow(true)
+	assert.Equal(t, interval, f.scale(now, interval, interval, max))
+	f.setFlow(false)
+	assert.Equal(t, 10*time.Second, f.scale(now, interval, interval, max), "the backoff starts over")
+}
+
+func TestPollDelay_FlowAndBackpressureDoNotCompound(t *testing.T) {
+	ingestor := newBackpressureIngestor(t, &fakeChannel{})
+	ingestor.config.API.PollInterval = Duration(time.Second)
+	ingestor.config.API.MaxPollInterval = Duration(time.Hour)
+	ingestor.backpressure.observe(1500, time.Now())
+	ingestor.backpressure.observe(1500, time.Now())
+	ingestor.flow.setFlow(false)
+
+	// Backpressure stretches 4x and flow control 2x: the larger wins
+	now := time.Now()
+	assert.Equal(t, 4*time.Second, ingestor.pollDelay(now))
+	assert.Equal(t, 4*time.Second, ingestor.pollDelay(now), "asking again does not stretch it further")
+	for i := 0; i < 10; i++ {
+		now = now.Add(time.Minute)
+		ingestor.pollDelay(now)
+	}
+	assert.Equal(t, 64*time.Second, ingestor.pollDelay(now), "the flow factor is capped and applied to the base delay")
+}
+
+func TestReady_DegradedWhileBrokerThrottles(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+	_, blocked := simulateFlow(t, ingestor)
+
+	get := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+
+	code, body := get()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, false, body["degraded"])
+
+	blocked <- amqp.Blocking{Active: true, Reason: "low on memory"}
+	waitThrottled(t, ingestor, true)
+	code, body = get()
+	assert.Equal(t, http.StatusOK, code, "a throttling broker still takes messages")
+	assert.Equal(t, true, body["ready"])
+	assert.Equal(t, true, body["degraded"])
+	assert.Equal(t, "throttled: connection blocked: low on memory", body["checks"].(map[string]interface{})["broker_flow"])
+}
+
+func TestFlowControlConfig(t *testing.T) {
+	assert.Equal(t, defaultFlowMaxWait, FlowControlConfig{}.maxWait())
+	assert.Equal(t, time.Second, FlowControlConfig{MaxWait: Duration(time.Second)}.maxWait())
+	assert.Error(t, FlowControlConfig{MaxWait: Duration(-time.Second)}.Validate())
+}
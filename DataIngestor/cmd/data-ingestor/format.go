@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Upstream response formats
+const (
+	formatJSON = "json"
+	formatXML  = "xml"
+	formatCSV  = "csv"
+)
+
+// CSVConfig describes how CSV rows map to readings
+type CSVConfig struct {
+	// Delimiter separates fields; defaults to ","
+	Delimiter string `yaml:"delimiter"`
+	// NoHeader means the first row is data. Columns are then keyed by
+	// position ("0", "1", ...) instead of header name.
+	NoHeader bool `yaml:"no_header"`
+	// Columns maps a column to a reading field. "type" and "name" set the
+	// reading's type and name, anything else a payload field. With a header,
+	// unmapped columns are kept under their header name; without one they are
+	// dropped.
+	Columns map[string]string `yaml:"columns"`
+	// DecimalComma parses "12,5" as 12.5
+	DecimalComma bool `yaml:"decimal_comma"`
+}
+
+// validateFormat checks a format override and its CSV settings
+func validateFormat(format string, config CSVConfig) error {
+	switch format {
+	case "", formatJSON, formatXML, formatCSV:
+	default:
+		return fmt.Errorf("unknown format %q, expected json, xml or csv", format)
+	}
+	if utf8.RuneCountInString(config.Delimiter) > 1 {
+		return fmt.Errorf("csv.delimiter must be a single character, got %q", config.Delimiter)
+	}
+	return nil
+}
+
+// responseFormat picks the decoder: the configured format wins, otherwise the
+// Content-Type decides. Responses without a Content-Type are read as JSON.
+func responseFormat(configured, contentType string) (string, error) {
+	if configured != "" {
+		return configured, nil
+	}
+	if contentType == "" {
+		return formatJSON, nil
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil {
+		switch {
+		case isJSONContentType(contentType):
+			return formatJSON, nil
+		case mediaType == "application/xml" || mediaType == "text/xml" || strings.HasSuffix(mediaType, "+xml"):
+			return formatXML, nil
+		case mediaType == "text/csv" || mediaType == "application/csv":
+			return formatCSV, nil
+		}
+	}
+	return "", fmt.Errorf("API returned unexpected content type %q", contentType)
+}
+
+// decodeReadings decodes a response body. skipped is the number of malformed
+// CSV rows that were left out of the batch.
+func decodeReadings(format string, config CSVConfig, body []byte) (data WeatherData, skipped int, err error) {
+	switch format {
+	case formatXML:
+		data, err = decodeXML(body)
+	case formatCSV:
+		data, skipped, err = decodeCSV(config, body)
+	default:
+		err = json.Unmarshal(body, &data)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to unmarshal response: %w", err)
+	}
+	return data, skipped, nil
+}
+
+// decodeXML reads every child element of the document root as a reading.
+// Element names are matched without their namespace.
+func decodeXML(body []byte) (WeatherData, error) {
+	decoder := xml.NewDecoder(bytes.NewReader(body))
+	data := WeatherData{}
+	depth := 0
+	for {
+		token, err := decoder.Token()
+		if errors.Is(err, io.EOF) {
+			if depth != 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				depth++
+				continue
+			}
+			var reading SensorData
+			if err := decoder.DecodeElement(&reading, &element); err != nil {
+				return nil, err
+			}
+			data = append(data, reading)
+		case xml.EndElement:
+			depth--
+		}
+	}
+}
+
+// UnmarshalXML decodes a reading from <type>, <name> and <payload> child
+// elements; type and name may also be attributes
+func (s *SensorData) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	var aux struct {
+		Type     string     `xml:"type"`
+		Name     string     `xml:"name"`
+		TypeAttr string     `xml:"type,attr"`
+		NameAttr string     `xml:"name,attr"`
+		Payload  xmlPayload `xml:"payload"`
+	}
+	if err := d.DecodeElement(&aux, &start); err != nil {
+		return err
+	}
+	s.Type, s.Name = aux.Type, aux.Name
+	if s.Type == "" {
+		s.Type = aux.TypeAttr
+	}
+	if s.Name == "" {
+		s.Name = aux.NameAttr
+	}
+	s.Payload = map[string]interface{}(aux.Payload)
+	return nil
+}
+
+// xmlPayload decodes <payload><field>value</field>...</payload>
+type xmlPayload map[string]interface{}
+
+func (p *xmlPayload) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	*p = xmlPayload{}
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return err
+		}
+		switch element := token.(type) {
+		case xml.StartElement:
+			var value string
+			if err := d.DecodeElement(&value, &element); err != nil {
+				return err
+			}
+			(*p)[element.Name.Local] = parseScalar(strings.TrimSpace(value), false)
+		case xml.EndElement:
+			return nil
+		}
+	}
+}
+
+// decodeCSV maps each row to a reading. Rows with the wrong number of fields
+// or without a name are skipped and counted rather than failing the batch.
+func decodeCSV(config CSVConfig, body []byte) (WeatherData, int, error) {
+	reader := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))))
+	if config.Delimiter != "" {
+		reader.Comma, _ = utf8.DecodeRuneInString(config.Delimiter)
+	}
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var columns []string
+	if config.NoHeader {
+		for key, field := range config.Columns {
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 {
+				continue
+			}
+			for len(columns) <= index {
+				columns = append(columns, "")
+			}
+			columns[index] = field
+		}
+	} else {
+		header, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return WeatherData{}, 0, nil
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		columns = make([]string, len(header))
+		for i, name := range header {
+			name = strings.TrimSpace(name)
+			columns[i] = name
+			if field, ok := config.Columns[name]; ok {
+				columns[i] = field
+			}
+		}
+	}
+
+	data := WeatherData{}
+	skipped := 0
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return data, skipped, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			skipped++
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// Without a header extra trailing columns are unmapped and ignored
+		if len(row) < len(columns) || (!config.NoHeader && len(row) != len(columns)) {
+			skipped++
+			continue
+		}
+
+		reading := SensorData{Payload: map[string]interface{}{}}
+		for i, field := range columns {
+			value := strings.TrimSpace(row[i])
+			switch field {
+			case "":
+			case "type":
+				reading.Type = value
+			case "name":
+				reading.Name = value
+			default:
+				if value != "" {
+					reading.Payload[field] = parseScalar(value, config.DecimalComma)
+				}
+			}
+		}
+		if reading.Name == "" {
+			skipped++
+			continue
+		}
+		data = append(data, reading)
+	}
+}
+
+// parseScalar turns numbers and booleans in text formats into the values
+// JSON decoding would have produced
+func parseScalar(value string, decimalComma bool) interface{} {
+	number := value
+	if decimalComma {
+		number = strings.Replace(number, ",", ".", 1)
+	}
+	if f, err := strconv.ParseFloat(number, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+		return f
+	}
+	switch value {
+	case "true":
+		return true
+	case "false":
+		return false
+	}
+	return value
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return body
+}
+
+func TestDecodeXML_Namespaced(t *testing.T) {
+	data, _, err := decodeReadings(formatXML, CSVConfig{}, readFixture(t, "readings_namespaced.xml"))
+	require.NoError(t, err)
+
+	require.Len(t, data, 2)
+	assert.Equal(t, SensorData{
+		Type: "weather",
+		Name: "berlin-1",
+		Payload: map[string]interface{}{
+			"temperature": 21.5,
+			"humidity":    60.0,
+			"timestamp":   "2024-05-03T10:00:00Z",
+		},
+	}, data[0])
+	assert.Equal(t, "moscow-1", data[1].Name)
+	assert.Equal(t, false, data[1].Payload["raining"])
+}
+
+func TestDecodeXML_Malformed(t *testing.T) {
+	_, _, err := decodeReadings(formatXML, CSVConfig{}, []byte(`<readings><reading><name>x</name>`))
+	assert.ErrorContains(t, err, "failed to unmarshal response")
+}
+
+func TestDecodeCSV_SkipsMalformedRows(t *testing.T) {
+	data, skipped, err := decodeReadings(formatCSV, CSVConfig{}, readFixture(t, "readings.csv"))
+	require.NoError(t, err)
+
+	// The bare quote and the extra field are skipped, the batch is not
+	assert.Equal(t, 2, skipped)
+	require.Len(t, data, 2)
+	assert.Equal(t, "berlin-1", data[0].Name)
+	assert.Equal(t, map[string]interface{}{"temperature": 21.5, "humidity": 60.0}, data[0].Payload)
+	assert.Equal(t, "madrid-1", data[1].Name)
+}
+
+func TestDecodeCSV_SemicolonsAndColumnMapping(t *testing.T) {
+	config := CSVConfig{
+		Delimiter:    ";",
+		DecimalComma: true,
+		Columns: map[string]string{
+			"Station":  "name",
+			"Kind":     "type",
+			"Temp (C)": "temperature",
+			"Humidity": "humidity",
+		},
+	}
+	data, skipped, err := decodeReadings(formatCSV, config, readFixture(t, "readings_semicolon.csv"))
+	require.NoError(t, err)
+
+	// The row without a station and the short cairo row are skipped
+	assert.Equal(t, 2, skipped)
+	require.Len(t, data, 3)
+	assert.Equal(t, SensorData{
+		Type:    "weather",
+		Name:    "berlin-1",
+		Payload: map[string]interface{}{"temperature": 21.5, "humidity": 60.0},
+	}, data[0])
+	assert.NotContains(t, data[1].Payload, "humidity", "empty cells are left out")
+	assert.Equal(t, 18.0, data[2].Payload["temperature"])
+}
+
+func TestDecodeCSV_NoHeader(t *testing.T) {
+	config := CSVConfig{
+		NoHeader: true,
+		Columns:  map[string]string{"0": "name", "1": "type", "3": "temperature"},
+	}
+	data, skipped, err := decodeReadings(formatCSV, config, []byte("berlin-1,weather,ignored,21\nshort,weather\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, skipped)
+	require.Len(t, data, 1)
+	assert.Equal(t, map[string]interface{}{"temperature": 21.0}, data[0].Payload)
+}
+
+func TestResponseFormat(t *testing.T) {
+	tests := []struct {
+		configured  string
+		contentType string
+		want        string
+		wantErr     bool
+	}{
+		{"", "", formatJSON, false},
+		{"", "application/json; charset=utf-8", formatJSON, false},
+		{"", "application/xml", formatXML, false},
+		{"", "text/xml; charset=utf-8", formatXML, false},
+		{"", "application/atom+xml", formatXML, false},
+		{"", "text/csv", formatCSV, false},
+		{"", "text/html", "", true},
+		// Providers that label CSV as text/plain need the override
+		{formatCSV, "text/plain", formatCSV, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.configured+" "+tt.contentType, func(t *testing.T) {
+			got, err := responseFormat(tt.configured, tt.contentType)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestFetch_DispatchesByLocationFormat(t *testing.T) {
+	xmlUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/xml")
+		w.Write(readFixture(t, "readings_namespaced.xml"))
+	}))
+	defer xmlUpstream.Close()
+	csvUpstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(readFixture(t, "readings.csv"))
+	}))
+	defer csvUpstream.Close()
+
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			Timeout: Duration(time.Second),
+			Locations: []LocationSource{
+				{Name: "legacy-xml", BaseURL: xmlUpstream.URL},
+				{Name: "legacy-csv", BaseURL: csvUpstream.URL, Format: formatCSV},
+			},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+
+	data, err := ingestor.FetchDataFromAPI(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, *data, 4)
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.MalformedRows.WithLabelValues("legacy-csv")))
+}
+
+func TestAPIConfig_ValidateFormat(t *testing.T) {
+	assert.ErrorContains(t, APIConfig{Format: "yaml"}.Validate(), "unknown format")
+	assert.ErrorContains(t, APIConfig{CSV: CSVConfig{Delimiter: ";;"}}.Validate(), "single character")
+	assert.ErrorContains(t, APIConfig{Locations: []LocationSource{
+		{Name: "a", BaseURL: "http://a", Format: "tsv"},
+	}}.Validate(), "api.locations[0] (a)")
+}
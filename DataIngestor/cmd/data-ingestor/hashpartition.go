@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultPartitionRoutingKeyPrefix = "weather.p"
+	defaultPartitionStateFile        = "partitions.json"
+	partitionStateVersion            = 1
+)
+
+// queueBinder is the binding support of *amqp.Channel
+type queueBinder interface {
+	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
+}
+
+// partitionOf maps location to one of count partitions by the canonical
+// fingerprint of the location as a JSON string. The mapping must not change
+// between releases: consumers rely on a location staying on its partition,
+// and the vectors in testdata/partitions catch a change.
+func partitionOf(location string, count int) int {
+	encoded, _ := json.Marshal(location)
+	sum := fingerprint(encoded)
+	return int(binary.BigEndian.Uint64(sum[:8]) % uint64(count))
+}
+
+// hashPartitioner spreads the readings over rabbitmq.partitioning.count
+// routing keys by their location, so that competing consumers, one per
+// partition, still see each location in order
+type hashPartitioner struct {
+	prefix   string
+	exchange string
+	declare  bool
+	args     amqp.Table
+	file     string
+	// configured is rabbitmq.partitioning.count
+	configured int
+
+	mu    sync.Mutex
+	count int
+	// seen are the locations published since startup, whose moves a
+	// repartition logs
+	seen map[string]bool
+}
+
+// newHashPartitioner returns nil unless rabbitmq.partitioning.count is set
+func newHashPartitioner(config *Config) *hashPartitioner {
+	partitioning := config.RabbitMQ.Partitioning
+	if partitioning.Count <= 0 {
+		return nil
+	}
+	prefix := partitioning.RoutingKeyPrefix
+	if prefix == "" {
+		prefix = defaultPartitionRoutingKeyPrefix
+	}
+	file := partitioning.StateFile
+	if file == "" {
+		file = defaultPartitionStateFile
+	}
+	return &hashPartitioner{
+		prefix:     prefix,
+		exchange:   partitioning.Exchange,
+		declare:    partitioning.DeclarePartitions,
+		args:       config.queueArguments(),
+		file:       file,
+		configured: partitioning.Count,
+		count:      partitioning.Count,
+		seen:       make(map[string]bool),
+	}
+}
+
+// partitionState is the state file format. Configured is the configured
+// count the repartition was made against.
+type partitionState struct {
+	Version    int `json:"version"`
+	Count      int `json:"count"`
+	Configured int `json:"configured"`
+}
+
+// restore applies the count of the last repartition. It is discarded once
+// the configured count changed: the config was updated since, and wins.
+// Either way a count that differs from the one in effect before the restart
+// moves locations to other partitions, which is logged.
+func (p *hashPartitioner) restore(logger *logrus.Entry) {
+	if p == nil {
+		return
+	}
+	body, err := os.ReadFile(p.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var state partitionState
+	if err == nil {
+		err = json.Unmarshal(body, &state)
+	}
+	if err == nil && (state.Version != partitionStateVersion || state.Count < 1) {
+		err = fmt.Errorf("unsupported version %d or count %d", state.Version, state.Count)
+	}
+	if err != nil {
+		logger.WithError(err).WithField("count", p.configured).Warn("Discarding the saved partition count")
+		return
+	}
+	if state.Configured != p.configured {
+		if state.Count != p.configured {
+			logger.WithFields(logrus.Fields{
+				"from_count": state.Count,
+				"to_count":   p.configured,
+			}).Warn("Configured partition count replaces the saved one, locations move to other partitions")
+		}
+		if err := os.Remove(p.file); err != nil {
+			logger.WithError(err).Warn("Failed to remove the saved partition count")
+		}
+		return
+	}
+	if state.Count != p.configured {
+		logger.WithFields(logrus.Fields{
+			"configured": p.configured,
+			"count":      state.Count,
+		}).Warn("Partition count set by a saved repartition, update rabbitmq.partitioning.count to match")
+	}
+	p.count = state.Count
+}
+
+// save keeps count for the next start
+func (p *hashPartitioner) save(count int) error {
+	body, err := json.MarshalIndent(partitionState{Version: partitionStateVersion, Count: count, Configured: p.configured}, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(p.file, body)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save the partition count: %w", err)
+	}
+	return nil
+}
+
+// routingKey names partition; its queue has the same name
+func (p *hashPartitioner) routingKey(partition int) string {
+	return p.prefix + strconv.Itoa(partition)
+}
+
+// split groups readings by partition, in order of first appearance
+func (p *hashPartitioner) split(data WeatherData) []partitionGroup {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var groups []partitionGroup
+	index := make(map[int]int)
+	for _, sensor := range data {
+		location := sensor.Location()
+		p.seen[location] = true
+		partition := partitionOf(location, p.count)
+		i, ok := index[partition]
+		if !ok {
+			i = len(groups)
+			index[partition] = i
+			groups = append(groups, partitionGroup{Exchange: p.exchange, Queue: p.routingKey(partition)})
+		}
+		groups[i].Readings = append(groups[i].Readings, sensor)
+	}
+	return groups
+}
+
+// partitions returns the partition count in effect
+func (p *hashPartitioner) partitions() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.count
+}
+
+// declareAll declares the queue of every one of count partitions and binds
+// it to the exchange, if one is configured. Declaring is idempotent, so it
+// is repeated on every connection.
+func (p *hashPartitioner) declareAll(channel amqpChannel, count int) error {
+	binder, canBind := channel.(queueBinder)
+	if p.exchange != "" && !canBind {
+		return fmt.Errorf("the RabbitMQ channel does not support bindings")
+	}
+	for partition := 0; partition < count; partition++ {
+		queue := p.routingKey(partition)
+		_, err := channel.QueueDeclare(
+			queue,
+			true,  // durable
+			false, // delete when unused
+			false, // exclusive
+			false, // no-wait
+			p.args,
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare partition %s: %w", queue, err)
+		}
+		if p.exchange == "" {
+			// The default exchange routes by queue name
+			continue
+		}
+		if err := binder.QueueBind(queue, queue, p.exchange, false, nil); err != nil {
+			return fmt.Errorf("failed to bind partition %s to %s: %w", queue, p.exchange, err)
+		}
+	}
+	return nil
+}
+
+// PartitionMove is a location that a repartition moved
+type PartitionMove struct {
+	Location string `json:"location"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+}
+
+// repartition switches to count partitions and returns the previous count
+// and the seen locations that moved, sorted by location. The count is saved
+// before it applies, so a failed save changes nothing.
+func (p *hashPartitioner) repartition(count int) (int, []PartitionMove, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.save(count); err != nil {
+		return p.count, nil, err
+	}
+	previous := p.count
+	p.count = count
+	moves := []PartitionMove{}
+	for location := range p.seen {
+		from, to := partitionOf(location, previous), partitionOf(location, count)
+		if from != to {
+			moves = append(moves, PartitionMove{Location: location, From: from, To: to})
+		}
+	}
+	sort.Slice(moves, func(i, j int) bool { return moves[i].Location < moves[j].Location })
+	return previous, moves, nil
+}
+
+// PartitionStatus is the body of GET /admin/partitions
+type PartitionStatus struct {
+	Count int `json:"count"`
+	// Configured is rabbitmq.partitioning.count, which differs from Count
+	// after a repartition
+	Configured       int    `json:"configured"`
+	RoutingKeyPrefix string `json:"routing_key_prefix"`
+	Exchange         string `json:"exchange"`
+	// Locations maps the locations seen since startup to their partition
+	Locations map[string]int `json:"locations"`
+}
+
+func (p *hashPartitioner) status() PartitionStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := PartitionStatus{
+		Count:            p.count,
+		Configured:       p.configured,
+		RoutingKeyPrefix: p.prefix,
+		Exchange:         p.exchange,
+		Locations:        make(map[string]int, len(p.seen)),
+	}
+	for location := range p.seen {
+		status.Locations[location] = partitionOf(location, p.count)
+	}
+	return status
+}
+
+// declareHashPartitions declares the partitions on a new channel with
+// rabbitmq.partitioning.declare_partitions
+func (di *DataIngestor) declareHashPartitions(channel amqpChannel) error {
+	p := di.hashPartitions
+	if p == nil || !p.declare {
+		return nil
+	}
+	return p.declareAll(channel, p.partitions())
+}
+
+// handlePartitions serves GET /admin/partitions
+func (di *DataIngestor) handlePartitions(c *gin.Context) {
+	if di.partitionsDisabled(c) {
+		return
+	}
+	c.JSON(http.StatusOK, di.hashPartitions.status())
+}
+
+// Repartition is the body of POST /admin/partitions
+type Repartition struct {
+	Count int `json:"count"`
+}
+
+// handleRepartition serves POST /admin/partitions. With declare_partitions
+// the new partitions are declared before any reading is published to them;
+// without a connection that is left to the next one. The count is saved to
+// the state file, so a restart keeps the locations where they are.
+func (di *DataIngestor) handleRepartition(c *gin.Context) {
+	if di.partitionsDisabled(c) {
+		return
+	}
+	var change Repartition
+	if err := c.ShouldBindJSON(&change); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid repartition: %v", err),
+		})
+		return
+	}
+	if change.Count < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "count must be at least 1",
+		})
+		return
+	}
+	p := di.hashPartitions
+	if p.declare {
+		channel, _, err := di.activeChannel()
+		if err == nil {
+			err = p.declareAll(channel, change.Count)
+		} else if errors.Is(err, ErrNotConnected) {
+			err = nil
+		}
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+	}
+
+	previous, moves, err := p.repartition(change.Count)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	logger := di.log(logPublish)
+	for _, move := range moves {
+		logger.WithFields(logrus.Fields{
+			"location": move.Location,
+			"from":     p.routingKey(move.From),
+			"to":       p.routingKey(move.To),
+		}).Info("Location moved to another partition")
+	}
+	logger.WithFields(logrus.Fields{
+		"from_count": previous,
+		"to_count":   change.Count,
+		"moved":      len(moves),
+		"configured": p.configured,
+	}).Warn("Repartitioned")
+	c.JSON(http.StatusOK, gin.H{
+		"previous": previous,
+		"count":    change.Count,
+		"moved":    moves,
+	})
+}
+
+// partitionsDisabled answers 409 and returns true without hash partitioning
+func (di *DataIngestor) partitionsDisabled(c *gin.Context) bool {
+	if di.hashPartitions != nil {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error": "hash partitioning is disabled",
+	})
+	return true
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultHealthCheckInterval = 15 * time.Second
+	defaultHealthCheckTimeout  = 2 * time.Second
+
+	dependencyRabbitMQ = "rabbitmq"
+	dependencyUpstream = "upstream"
+	dependencyRedis    = "redis"
+
+	// Cached states of a dependency
+	healthOK      = "ok"
+	healthFailing = "failing"
+	healthStale   = "stale"
+	healthPending = "pending"
+	// healthMaintenance is a failing upstream while it announced maintenance
+	healthMaintenance = "maintenance"
+)
+
+// HealthChecksConfig probes the dependencies in the background, so that
+// /ready, /health and /stats answer from the last results instead of adding
+// traffic with every probe request. The defaults apply to every dependency
+// unless it overrides them.
+type HealthChecksConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Interval is the time between two probes of a dependency, 15s by default
+	Interval Duration `yaml:"interval"`
+	// Jitter is the most added to every interval, and waited before the
+	// first probe, so replicas don't probe in step; a fifth of the interval by
+	// default
+	Jitter Duration `yaml:"jitter"`
+	// Timeout bounds a single probe, 2s by default
+	Timeout Duration `yaml:"timeout"`
+	// StaleAfter is how old a result may be before it no longer counts,
+	// twice the interval plus the jitter by default
+	StaleAfter Duration `yaml:"stale_after"`
+
+	RabbitMQ DependencyCheckConfig `yaml:"rabbitmq"`
+	Upstream DependencyCheckConfig `yaml:"upstream"`
+	Redis    DependencyCheckConfig `yaml:"redis"`
+}
+
+// DependencyCheckConfig overrides the probe settings for one dependency
+type DependencyCheckConfig struct {
+	Disabled   bool     `yaml:"disabled"`
+	Interval   Duration `yaml:"interval"`
+	Jitter     Duration `yaml:"jitter"`
+	Timeout    Duration `yaml:"timeout"`
+	StaleAfter Duration `yaml:"stale_after"`
+}
+
+// Validate checks that every probe finishes before the next is due and is
+// not stale before it could have run
+func (c HealthChecksConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	for _, name := range []string{dependencyRabbitMQ, dependencyUpstream, dependencyRedis} {
+		d := c.dependency(name)
+		if d.Interval < 0 || d.Jitter < 0 || d.Timeout < 0 || d.StaleAfter < 0 {
+			return fmt.Errorf("health_checks.%s: interval, jitter, timeout and stale_after must not be negative", name)
+		}
+		s := c.settings(name)
+		if s.timeout >= s.interval {
+			return fmt.Errorf("health_checks.%s.timeout (%s) must be below the interval (%s)", name, s.timeout, s.interval)
+		}
+		if s.staleAfter < s.interval+s.jitter+s.timeout {
+			return fmt.Errorf("health_checks.%s.stale_after (%s) must be at least the interval, jitter and timeout (%s)",
+				name, s.staleAfter, s.interval+s.jitter+s.timeout)
+		}
+	}
+	return nil
+}
+
+func (c HealthChecksConfig) dependency(name string) DependencyCheckConfig {
+	switch name {
+	case dependencyRabbitMQ:
+		return c.RabbitMQ
+	case dependencyUpstream:
+		return c.Upstream
+	default:
+		return c.Redis
+	}
+}
+
+// checkSettings are the effective probe settings of a dependency
+type checkSettings struct {
+	interval, jitter, timeout, staleAfter time.Duration
+}
+
+func (c HealthChecksConfig) settings(name string) checkSettings {
+	d := c.dependency(name)
+	pick := func(override, fallback Duration) time.Duration {
+		if override > 0 {
+			return time.Duration(override)
+		}
+		return time.Duration(fallback)
+	}
+	s := checkSettings{
+		interval:   pick(d.Interval, c.Interval),
+		jitter:     pick(d.Jitter, c.Jitter),
+		timeout:    pick(d.Timeout, c.Timeout),
+		staleAfter: pick(d.StaleAfter, c.StaleAfter),
+	}
+	if s.interval <= 0 {
+		s.interval = defaultHealthCheckInterval
+	}
+	if s.jitter <= 0 {
+		s.jitter = s.interval / 5
+	}
+	if s.timeout <= 0 {
+		s.timeout = min(defaultHealthCheckTimeout, s.interval/2)
+	}
+	if s.staleAfter <= 0 {
+		s.staleAfter = 2*s.interval + s.jitter
+	}
+	return s
+}
+
+// DependencyHealth is the cached result of a dependency's probes
+type DependencyHealth struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	// Required dependencies make the service not ready when they fail;
+	// the others only degrade it
+	Required   bool      `json:"required"`
+	CheckedAt  time.Time `json:"checked_at,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+}
+
+// dependencyCheck probes one dependency
+type dependencyCheck struct {
+	name     string
+	required bool
+	checkSettings
+	probe func(ctx context.Context) error
+	// expected reports whether a failure is expected right now, which is
+	// neither logged nor degrades the service
+	expected func() bool
+
+	// guarded by healthChecker.mu
+	err       error
+	checkedAt time.Time
+	duration  time.Duration
+	// wasExpected is whether err was expected when it was probed
+	wasExpected bool
+}
+
+// healthChecker runs the dependency probes and caches their results
+type healthChecker struct {
+	checks  []*dependencyCheck
+	logger  *logrus.Logger
+	metrics *Metrics
+	// now and wait are replaced in tests
+	now  func() time.Time
+	wait func(ctx context.Context, d time.Duration) bool
+
+	mu sync.Mutex
+}
+
+// newHealthChecker returns nil unless health_checks.enabled is set. Redis is
+// only probed when reading dedup uses it, and is required when dedup fails
+// closed. The upstream is not probed while replaying fixtures.
+func (di *DataIngestor) newHealthChecker() *healthChecker {
+	config := di.config.HealthChecks
+	if !config.Enabled {
+		return nil
+	}
+	h := &healthChecker{logger: di.logger, metrics: di.metrics, now: time.Now, wait: waitFor}
+	add := func(name string, required bool, probe func(context.Context) error) *dependencyCheck {
+		if config.dependency(name).Disabled {
+			return nil
+		}
+		check := &dependencyCheck{name: name, required: required, checkSettings: config.settings(name), probe: probe}
+		h.checks = append(h.checks, check)
+		return check
+	}
+	add(dependencyRabbitMQ, true, di.probeRabbitMQ)
+	if di.fixtures == nil || !di.fixtures.replay {
+		if check := add(dependencyUpstream, false, di.probeUpstream); check != nil {
+			check.expected = di.maintenance.active
+		}
+	}
+	if di.dedup != nil && di.dedup.redis != nil {
+		add(dependencyRedis, di.dedup.failClosed, func(ctx context.Context) error {
+			return di.dedup.redis.Ping(ctx).Err()
+		})
+	}
+	return h
+}
+
+// probeRabbitMQ looks the queue up on a channel of its own, a round trip to
+// the broker that publishes nothing. The probe returns when ctx is done; the
+// lookup ends with it, as its channel is closed.
+func (di *DataIngestor) probeRabbitMQ(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		_, err := di.inspectQueueContext(ctx, di.config.RabbitMQ.QueueName)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// probeUpstream sends a HEAD request to every location. Any answer below 500
+// means the upstream is reachable; the circuit breakers are left alone.
+func (di *DataIngestor) probeUpstream(ctx context.Context) error {
+	var errs []error
+	limited := 0
+	ctx = withUpstreamClass(ctx, upstreamHealth)
+	sources := di.currentSources()
+	for _, src := range sources {
+		if err := di.upstreamLimit.wait(ctx, upstreamHealth); err != nil {
+			// Left to the ingestion; the other locations still tell
+			if limited++; limited == len(sources) {
+				return err
+			}
+			continue
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, src.target(), nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", src.name, err))
+			continue
+		}
+		resp, err := di.httpClient.Do(req)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", src.name, err))
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusInternalServerError {
+			errs = append(errs, fmt.Errorf("%s: status %d", src.name, resp.StatusCode))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// waitFor sleeps for d and reports whether ctx is still running
+func waitFor(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+func jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+// run probes every dependency on its own schedule until ctx is cancelled
+func (h *healthChecker) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, check := range h.checks {
+		wg.Add(1)
+		go func(check *dependencyCheck) {
+			defer wg.Done()
+			for wait := jitter(check.jitter); h.wait(ctx, wait); wait = check.interval + jitter(check.jitter) {
+				h.probe(ctx, check)
+			}
+		}(check)
+	}
+	wg.Wait()
+}
+
+// probe runs one probe and caches its result
+func (h *healthChecker) probe(ctx context.Context, check *dependencyCheck) {
+	probeCtx, cancel := context.WithTimeout(ctx, check.timeout)
+	defer cancel()
+	start := h.now()
+	err := check.probe(probeCtx)
+	if probeCtx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("no answer within %s", check.timeout)
+	}
+	end := h.now()
+
+	expected := err != nil && check.expected != nil && check.expected()
+
+	h.mu.Lock()
+	wasFailing := check.err != nil && !check.wasExpected
+	check.err, check.checkedAt, check.duration, check.wasExpected = err, end, end.Sub(start), expected
+	h.mu.Unlock()
+
+	result, up := healthOK, 1.0
+	switch {
+	case expected:
+		result, up = healthMaintenance, 0
+	case err != nil:
+		result, up = healthFailing, 0
+	}
+	h.metrics.HealthChecks.WithLabelValues(check.name, result).Inc()
+	h.metrics.DependencyUp.WithLabelValues(check.name).Set(up)
+	entry := h.logger.WithField("dependency", check.name)
+	switch {
+	case expected:
+	case err != nil && !wasFailing:
+		entry.WithError(err).Warn("Dependency health check failing")
+	case err == nil && wasFailing:
+		entry.Info("Dependency health check recovered")
+	}
+}
+
+// Results returns the cached state of every probed dependency. A result
+// older than stale_after counts as failing, as does none before the first
+// probe.
+func (h *healthChecker) Results() map[string]DependencyHealth {
+	if h == nil {
+		return nil
+	}
+	now := h.now()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	results := make(map[string]DependencyHealth, len(h.checks))
+	for _, check := range h.checks {
+		result := DependencyHealth{Status: healthOK, Required: check.required, CheckedAt: check.checkedAt, DurationMS: check.duration.Milliseconds()}
+		switch {
+		case check.checkedAt.IsZero():
+			result.Status = healthPending
+		case now.Sub(check.checkedAt) > check.staleAfter:
+			result.Status = healthStale
+			result.Error = fmt.Sprintf("last checked %s ago", now.Sub(check.checkedAt).Round(time.Second))
+		case check.err != nil && check.wasExpected:
+			result.Status = healthMaintenance
+			result.Error = check.err.Error()
+		case check.err != nil:
+			result.Status = healthFailing
+			result.Error = check.err.Error()
+		}
+		results[check.name] = result
+	}
+	return results
+}
+
+// readiness reports whether the cached results leave the service ready and
+// whether they degrade it
+func (h *healthChecker) readiness() (results map[string]DependencyHealth, ready, degraded bool) {
+	results = h.Results()
+	ready = true
+	for _, result := range results {
+		switch {
+		case result.Status == healthOK, result.Status == healthMaintenance:
+		case result.Required:
+			ready = false
+		default:
+			degraded = true
+		}
+	}
+	return results, ready, degraded
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inspectCountingChannel counts the queue lookups of the RabbitMQ probe
+type inspectCountingChannel struct {
+	*fakeChannel
+	inspects atomic.Int32
+	fail     atomic.Bool
+}
+
+func (c *inspectCountingChannel) QueueInspect(name string) (queue amqp.Queue, err error) {
+	c.inspects.Add(1)
+	if c.fail.Load() {
+		return queue, errors.New("channel closed")
+	}
+	return c.fakeChannel.QueueInspect(name)
+}
+
+// healthTestUpstream counts the requests it gets and answers them with status
+type healthTestUpstream struct {
+	requests atomic.Int32
+	status   atomic.Int32
+}
+
+// newHealthTestIngestor has every probe enabled against a fake broker and an
+// upstream, and a clock the test moves
+func newHealthTestIngestor(t *testing.T, config HealthChecksConfig) (*DataIngestor, *inspectCountingChannel, *healthTestUpstream, *time.Time) {
+	t.Helper()
+	upstream := &healthTestUpstream{}
+	upstream.status.Store(http.StatusOK)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.requests.Add(1)
+		w.WriteHeader(int(upstream.status.Load()))
+	}))
+	t.Cleanup(server.Close)
+
+	config.Enabled = true
+	ingestor := NewDataIngestor(&Config{
+		API:          APIConfig{BaseURL: server.URL, Timeout: Duration(5 * time.Second)},
+		RabbitMQ:     RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:      LoggingConfig{Level: "panic"},
+		HealthChecks: config,
+	})
+	require.NotNil(t, ingestor.health)
+	channel := &inspectCountingChannel{fakeChannel: &fakeChannel{}}
+	attachChannel(ingestor, channel, nil)
+	ingestor.openChannel = func() (amqpChannel, error) { return channel, nil }
+
+	now := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	ingestor.health.now = func() time.Time { return now }
+	return ingestor, channel, upstream, &now
+}
+
+// probeAll runs every probe once, like one pass of the background loop
+func probeAll(ingestor *DataIngestor) {
+	for _, check := range ingestor.health.checks {
+		ingestor.health.probe(context.Background(), check)
+	}
+}
+
+func getReady(t *testing.T, router http.Handler) (int, map[string]DependencyHealth, bool) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	var body struct {
+		Degraded     bool                        `json:"degraded"`
+		Dependencies map[string]DependencyHealth `json:"dependencies"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return w.Code, body.Dependencies, body.Degraded
+}
+
+func TestHealthChecks_ProbeEndpointsServeTheCache(t *testing.T) {
+	ingestor, channel, upstream, _ := newHealthTestIngestor(t, HealthChecksConfig{})
+	router := setupRoutes(ingestor)
+	probeAll(ingestor)
+	require.Equal(t, int32(1), channel.inspects.Load())
+	require.Equal(t, int32(1), upstream.requests.Load())
+
+	for i := 0; i < 20; i++ {
+		for _, path := range []string{"/ready", "/health", "/stats"} {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+			require.Equal(t, http.StatusOK, w.Code, path)
+			assert.Contains(t, w.Body.String(), `"dependencies":{`, path)
+		}
+	}
+	assert.Equal(t, int32(1), channel.inspects.Load(), "probe requests never reach the broker")
+	assert.Equal(t, int32(1), upstream.requests.Load(), "probe requests never reach the upstream")
+
+	code, dependencies, degraded := getReady(t, router)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, degraded)
+	assert.Equal(t, healthOK, dependencies[dependencyRabbitMQ].Status)
+	assert.True(t, dependencies[dependencyRabbitMQ].Required)
+	assert.Equal(t, healthOK, dependencies[dependencyUpstream].Status)
+	assert.False(t, dependencies[dependencyUpstream].Required)
+}
+
+func TestHealthChecks_Readiness(t *testing.T) {
+	ingestor, channel, upstream, now := newHealthTestIngestor(t, HealthChecksConfig{Interval: Duration(10 * time.Second), Jitter: Duration(time.Second)})
+	router := setupRoutes(ingestor)
+
+	code, dependencies, _ := getReady(t, router)
+	assert.Equal(t, http.StatusServiceUnavailable, code, "not ready before the first probe")
+	assert.Equal(t, healthPending, dependencies[dependencyRabbitMQ].Status)
+
+	probeAll(ingestor)
+	code, _, _ = getReady(t, router)
+	assert.Equal(t, http.StatusOK, code)
+
+	// A failing upstream degrades the service, a failing broker takes it out
+	upstream.status.Store(http.StatusBadGateway)
+	probeAll(ingestor)
+	code, dependencies, degraded := getReady(t, router)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, degraded)
+	assert.Equal(t, healthFailing, dependencies[dependencyUpstream].Status)
+	assert.Contains(t, dependencies[dependencyUpstream].Error, "status 502")
+
+	channel.fail.Store(true)
+	probeAll(ingestor)
+	code, dependencies, _ = getReady(t, router)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Contains(t, dependencies[dependencyRabbitMQ].Error, "channel closed")
+	assert.Equal(t, 0.0, testutil.ToFloat64(ingestor.metrics.DependencyUp.WithLabelValues(dependencyRabbitMQ)))
+
+	// Recovery shows up with the next probe
+	channel.fail.Store(false)
+	upstream.status.Store(http.StatusNotFound)
+	probeAll(ingestor)
+	code, _, degraded = getReady(t, router)
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, degraded, "any answer below 500 means the upstream is up")
+
+	// Results stop counting once the probes stall for stale_after, 21s here
+	*now = now.Add(21 * time.Second)
+	code, _, _ = getReady(t, router)
+	assert.Equal(t, http.StatusOK, code)
+	*now = now.Add(time.Second)
+	code, dependencies, _ = getReady(t, router)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthStale, dependencies[dependencyRabbitMQ].Status)
+	assert.Equal(t, "last checked 22s ago", dependencies[dependencyRabbitMQ].Error)
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.HealthChecks.WithLabelValues(dependencyRabbitMQ, healthOK)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.HealthChecks.WithLabelValues(dependencyRabbitMQ, healthFailing)))
+}
+
+func TestHealthChecks_Timeout(t *testing.T) {
+	ingestor, _, _, _ := newHealthTestIngestor(t, HealthChecksConfig{Timeout: Duration(10 * time.Millisecond)})
+	check := &dependencyCheck{name: "slow", required: true, checkSettings: checkSettings{timeout: 10 * time.Millisecond, staleAfter: time.Minute},
+		probe: func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		}}
+	ingestor.health.checks = []*dependencyCheck{check}
+
+	ingestor.health.probe(context.Background(), check)
+	result := ingestor.health.Results()["slow"]
+	assert.Equal(t, healthFailing, result.Status)
+	assert.Equal(t, "no answer within 10ms", result.Error)
+}
+
+func TestHealthChecks_JitteredSchedule(t *testing.T) {
+	ingestor, channel, _, _ := newHealthTestIngestor(t, HealthChecksConfig{
+		Interval: Duration(10 * time.Second),
+		Jitter:   Duration(2 * time.Second),
+		Upstream: DependencyCheckConfig{Disabled: true},
+	})
+	var waits []time.Duration
+	ingestor.health.wait = func(ctx context.Context, d time.Duration) bool {
+		waits = append(waits, d)
+		return len(waits) <= 50
+	}
+
+	ingestor.health.run(context.Background())
+	require.Len(t, waits, 51)
+	assert.Equal(t, int32(50), channel.inspects.Load())
+	assert.Less(t, waits[0], 2*time.Second, "the first probe waits for the jitter only")
+	distinct := map[time.Duration]bool{}
+	for _, wait := range waits[1:] {
+		assert.GreaterOrEqual(t, wait, 10*time.Second)
+		assert.Less(t, wait, 12*time.Second)
+		distinct[wait] = true
+	}
+	assert.Greater(t, len(distinct), 1, "replicas don't probe in step")
+}
+
+// hangingChannel is a broker that never answers a queue lookup; closing the
+// channel ends it
+type hangingChannel struct {
+	*fakeChannel
+	closed chan struct{}
+	done   chan struct{}
+}
+
+func (c *hangingChannel) QueueInspect(name string) (amqp.Queue, error) {
+	defer close(c.done)
+	<-c.closed
+	return amqp.Queue{}, amqp.ErrClosed
+}
+
+func (c *hangingChannel) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestHealthChecks_ProbeEndsWithTheContext(t *testing.T) {
+	ingestor, _, _, _ := newHealthTestIngestor(t, HealthChecksConfig{Upstream: DependencyCheckConfig{Disabled: true}})
+	channel := &hangingChannel{fakeChannel: &fakeChannel{}, closed: make(chan struct{}), done: make(chan struct{})}
+	ingestor.openChannel = func() (amqpChannel, error) { return channel, nil }
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ingestor.health.probe(ctx, ingestor.health.checks[0])
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the probe outlives its context")
+	}
+	select {
+	case <-channel.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the queue lookup outlives the probe")
+	}
+	assert.Equal(t, healthFailing, ingestor.health.Results()[dependencyRabbitMQ].Status)
+}
+
+func TestHealthChecks_Redis(t *testing.T) {
+	redis := miniredis.RunT(t)
+	ingestor := NewDataIngestor(&Config{
+		Logging:      LoggingConfig{Level: "panic"},
+		ReadingDedup: ReadingDedupConfig{Enabled: true, Redis: RedisDedupConfig{Addr: redis.Addr(), OnError: redisFailClosed}},
+		HealthChecks: HealthChecksConfig{Enabled: true, RabbitMQ: DependencyCheckConfig{Disabled: true}, Upstream: DependencyCheckConfig{Disabled: true}},
+	})
+	probeAll(ingestor)
+	assert.Equal(t, healthOK, ingestor.health.Results()[dependencyRedis].Status)
+	assert.True(t, ingestor.health.Results()[dependencyRedis].Required, "required when dedup fails closed")
+
+	redis.Close()
+	probeAll(ingestor)
+	_, ready, _ := ingestor.health.readiness()
+	assert.False(t, ready)
+}
+
+func TestConfig_ValidateHealthChecks(t *testing.T) {
+	settings := HealthChecksConfig{Interval: Duration(10 * time.Second)}.settings(dependencyUpstream)
+	assert.Equal(t, checkSettings{interval: 10 * time.Second, jitter: 2 * time.Second, timeout: 2 * time.Second, staleAfter: 22 * time.Second}, settings)
+	settings = HealthChecksConfig{Interval: Duration(10 * time.Second), Upstream: DependencyCheckConfig{Interval: Duration(time.Minute)}}.settings(dependencyUpstream)
+	assert.Equal(t, time.Minute, settings.interval, "dependencies override the defaults")
+
+	assert.NoError(t, (&Config{HealthChecks: HealthChecksConfig{Enabled: true}}).Validate())
+	assert.ErrorContains(t, (&Config{HealthChecks: HealthChecksConfig{Enabled: true, Interval: Duration(time.Second), Timeout: Duration(2 * time.Second)}}).Validate(),
+		"health_checks.rabbitmq.timeout (2s) must be below the interval (1s)")
+	assert.ErrorContains(t, (&Config{HealthChecks: HealthChecksConfig{Enabled: true, Redis: DependencyCheckConfig{StaleAfter: Duration(time.Second)}}}).Validate(),
+		"health_checks.redis.stale_after (1s) must be at least the interval, jitter and timeout")
+	assert.ErrorContains(t, (&Config{HealthChecks: HealthChecksConfig{Enabled: true, Upstream: DependencyCheckConfig{Jitter: Duration(-1)}}}).Validate(),
+		"must not be negative")
+}
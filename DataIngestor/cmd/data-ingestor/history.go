@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// errHistoryCursorGone is returned when the after cursor has left the ring
+// buffer, so the page that follows it is unknown
+var errHistoryCursorGone = errors.New("cursor is no longer buffered")
+
+// historyQuery selects buffered readings published in [From, To), oldest
+// first. A zero From or To leaves that end open.
+type historyQuery struct {
+	From     time.Time
+	To       time.Time
+	Location string
+	// After is the id of the last reading of the previous page
+	After string
+	Limit int
+}
+
+func (q historyQuery) matches(event streamEvent) bool {
+	if !q.From.IsZero() && event.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !event.Time.Before(q.To) {
+		return false
+	}
+	return globMatch(q.Location, event.Location)
+}
+
+// history returns a page of buffered readings matching q and whether more
+// follow it
+func (h *streamHub) history(q historyQuery) ([]streamEvent, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := h.buffered()
+	if q.After != "" {
+		found := false
+		for i := range events {
+			if events[i].ID == q.After {
+				events, found = events[i+1:], true
+				break
+			}
+		}
+		if !found {
+			return nil, false, errHistoryCursorGone
+		}
+	}
+
+	var page []streamEvent
+	for _, event := range events {
+		if !q.matches(event) {
+			continue
+		}
+		if len(page) == q.Limit {
+			return page, true, nil
+		}
+		page = append(page, event)
+	}
+	return page, false, nil
+}
+
+// ofCorrelation returns the buffered readings published by the cycle of
+// correlationID, in order
+func (h *streamHub) ofCorrelation(correlationID string) []streamEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var events []streamEvent
+	for _, event := range h.buffered() {
+		if event.CorrelationID == correlationID {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// historyReading is one entry of the GET /history response
+type historyReading struct {
+	ID      string          `json:"id"`
+	Time    time.Time       `json:"time"`
+	Reading json.RawMessage `json:"reading"`
+}
+
+// handleHistory serves the buffered readings of a time range a page at a
+// time, GET /history?from=&to=&location=&after=&limit=
+func (di *DataIngestor) handleHistory(c *gin.Context) {
+	q := historyQuery{Location: c.Query("location"), After: c.Query("after")}
+	if _, err := path.Match(q.Location, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid location pattern: %v", err),
+		})
+		return
+	}
+	for _, bound := range []struct {
+		name string
+		at   *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		raw := c.Query(bound.name)
+		if raw == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("%s must be an RFC 3339 time", bound.name),
+			})
+			return
+		}
+		*bound.at = t
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "from must be before to",
+		})
+		return
+	}
+	limit, err := queryInt(c, "limit", defaultHistoryLimit)
+	if err != nil || limit < 1 || limit > maxHistoryLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit),
+		})
+		return
+	}
+	q.Limit = limit
+
+	events, more, err := di.stream.history(q)
+	if err != nil {
+		c.JSON(http.StatusGone, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	readings := []historyReading{}
+	for _, event := range events {
+		readings = append(readings, historyReading{ID: event.ID, Time: event.Time, Reading: event.Data})
+	}
+	next := ""
+	if more {
+		next = readings[len(readings)-1].ID
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"readings": readings,
+		"next":     next,
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type historyResponse struct {
+	Readings []historyReading `json:"readings"`
+	Next     string           `json:"next"`
+}
+
+func getHistory(t *testing.T, ingestor *DataIngestor, query string) (int, historyResponse) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/history"+query, nil))
+	var response historyResponse
+	if w.Code == http.StatusOK {
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	}
+	return w.Code, response
+}
+
+// broadcastHistory broadcasts a cycle of berlin and moscow readings every
+// minute from 12:00 UTC
+func broadcastHistory(ingestor *DataIngestor, cycles int) {
+	clock := &fakeClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	ingestor.stream.now = clock.Now
+	for i := 0; i < cycles; i++ {
+		ingestor.stream.Broadcast(clock.Now().Format("1504"), triggerPoll, WeatherData{
+			{Type: "weather", Name: "berlin-1", Payload: map[string]interface{}{"temperature": float64(i)}},
+			{Type: "weather", Name: "moscow-1", Payload: map[string]interface{}{"temperature": float64(i)}},
+		})
+		clock.Advance(time.Minute)
+	}
+}
+
+func TestHistory_TimeRangeAndLocation(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	broadcastHistory(ingestor, 5)
+
+	code, response := getHistory(t, ingestor, "?from=2024-03-01T12:01:00Z&to=2024-03-01T12:03:00Z&location=berlin-*")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, response.Readings, 2, "to is exclusive")
+	assert.Equal(t, "1201-0", response.Readings[0].ID)
+	assert.Equal(t, time.Date(2024, 3, 1, 12, 1, 0, 0, time.UTC), response.Readings[0].Time)
+	assert.Equal(t, "1202-0", response.Readings[1].ID)
+	assert.JSONEq(t, `{"type":"weather","name":"berlin-1","payload":{"temperature":2}}`, string(response.Readings[1].Reading))
+	assert.Empty(t, response.Next)
+
+	code, response = getHistory(t, ingestor, "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, response.Readings, 10, "both ends are open by default")
+}
+
+func TestHistory_Pages(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	broadcastHistory(ingestor, 3)
+
+	var ids []string
+	query := "?location=moscow-*&limit=2"
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		code, response := getHistory(t, ingestor, query)
+		require.Equal(t, http.StatusOK, code)
+		for _, reading := range response.Readings {
+			ids = append(ids, reading.ID)
+		}
+		if response.Next == "" {
+			break
+		}
+		query = "?location=moscow-*&limit=2&after=" + response.Next
+	}
+	assert.Equal(t, []string{"1200-1", "1201-1", "1202-1"}, ids)
+
+	code, response := getHistory(t, ingestor, "?limit=6")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, response.Readings, 6)
+	assert.Empty(t, response.Next, "no reading follows a full last page")
+}
+
+func TestHistory_CursorLeftTheBuffer(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.stream.resize(2)
+	broadcastHistory(ingestor, 2)
+
+	code, _ := getHistory(t, ingestor, "?after=1200-0")
+	assert.Equal(t, http.StatusGone, code)
+	code, response := getHistory(t, ingestor, "?after=1201-0")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, response.Readings, 1)
+	assert.Equal(t, "1201-1", response.Readings[0].ID)
+}
+
+func TestHistory_BadRequests(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	for _, query := range []string{
+		"?from=yesterday",
+		"?to=2024-03-01",
+		"?from=2024-03-01T12:00:00Z&to=2024-03-01T12:00:00Z",
+		"?location=[",
+		"?limit=0",
+		"?limit=1001",
+	} {
+		code, _ := getHistory(t, ingestor, query)
+		assert.Equal(t, http.StatusBadRequest, code, query)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"data-ingestor/pkg/hooks"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The hook API is in pkg/hooks, so hook packages can import it. The names
+// are kept here for the code that embeds the ingestor.
+type (
+	RequestDecorator   = hooks.RequestDecorator
+	ReadingInterceptor = hooks.ReadingInterceptor
+	PublishObserver    = hooks.PublishObserver
+	PublishOutcome     = hooks.PublishOutcome
+)
+
+// Option configures a DataIngestor beyond its Config
+type Option func(*DataIngestor)
+
+// WithRequestDecorator registers a request decorator. Hooks of one kind run
+// in registration order; name labels their metrics and logs.
+func WithRequestDecorator(name string, decorator RequestDecorator) Option {
+	return func(di *DataIngestor) {
+		di.hooks.decorators = append(di.hooks.decorators, namedDecorator{name, decorator})
+	}
+}
+
+// WithReadingInterceptor registers a reading interceptor
+func WithReadingInterceptor(name string, interceptor ReadingInterceptor) Option {
+	return func(di *DataIngestor) {
+		di.hooks.interceptors = append(di.hooks.interceptors, namedInterceptor{name, interceptor})
+	}
+}
+
+// WithPublishObserver registers a publish observer
+func WithPublishObserver(name string, observer PublishObserver) Option {
+	return func(di *DataIngestor) {
+		di.hooks.observers = append(di.hooks.observers, namedObserver{name, observer})
+	}
+}
+
+type namedDecorator struct {
+	name string
+	hook RequestDecorator
+}
+
+type namedInterceptor struct {
+	name string
+	hook ReadingInterceptor
+}
+
+type namedObserver struct {
+	name string
+	hook PublishObserver
+}
+
+// hookSet holds the registered hooks of every kind
+type hookSet struct {
+	decorators   []namedDecorator
+	interceptors []namedInterceptor
+	observers    []namedObserver
+}
+
+// registeredHooks returns the hooks the packages of the build registered with
+// pkg/hooks, which run before the ones passed as options
+func registeredHooks() hookSet {
+	var set hookSet
+	for _, h := range hooks.RequestDecorators() {
+		set.decorators = append(set.decorators, namedDecorator{h.Name, h.Hook})
+	}
+	for _, h := range hooks.ReadingInterceptors() {
+		set.interceptors = append(set.interceptors, namedInterceptor{h.Name, h.Hook})
+	}
+	for _, h := range hooks.PublishObservers() {
+		set.observers = append(set.observers, namedObserver{h.Name, h.Hook})
+	}
+	return set
+}
+
+// runHook times fn and contains its panics, which are logged and reported as
+// false so the hook's result is discarded
+func (di *DataIngestor) runHook(name string, fn func()) (ok bool) {
+	start := time.Now()
+	defer func() {
+		di.metrics.HookDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+		if r := recover(); r != nil {
+			di.metrics.HookPanics.WithLabelValues(name).Inc()
+			di.logger.WithFields(logrus.Fields{
+				"hook":  name,
+				"panic": fmt.Sprint(r),
+				"stack": string(debug.Stack()),
+			}).Error("Hook panicked, skipping it")
+			ok = false
+		}
+	}()
+	fn()
+	return true
+}
+
+// decorateRequest applies the request decorators. Each works on a copy, so a
+// panicking decorator leaves the request as it was.
+func (di *DataIngestor) decorateRequest(req *http.Request) *http.Request {
+	for _, h := range di.hooks.decorators {
+		decorated := req.Clone(req.Context())
+		if di.runHook(h.name, func() { h.hook.DecorateRequest(decorated) }) {
+			req = decorated
+		}
+	}
+	return req
+}
+
+// interceptReadings passes every reading through the interceptors. Each
+// works on a copy, so a panicking interceptor leaves the reading as it was.
+func (di *DataIngestor) interceptReadings(data WeatherData) WeatherData {
+	kept := make(WeatherData, 0, len(data))
+	for _, reading := range data {
+		keep := true
+		for _, h := range di.hooks.interceptors {
+			intercepted := reading.hookReading()
+			var ok bool
+			if !di.runHook(h.name, func() { ok = h.hook.InterceptReading(&intercepted) }) {
+				continue
+			}
+			reading.Type, reading.Name, reading.Payload = intercepted.Type, intercepted.Name, intercepted.Payload
+			if !ok {
+				keep = false
+				break
+			}
+		}
+		if keep {
+			kept = append(kept, reading)
+		}
+	}
+	return kept
+}
+
+// observePublish tells the publish observers about one publish attempt
+func (di *DataIngestor) observePublish(body []byte, outcome PublishOutcome) {
+	for _, h := range di.hooks.observers {
+		di.runHook(h.name, func() { h.hook.ObservePublish(body, outcome) })
+	}
+}
+
+// clone copies the reading and its payload map, not the values in it
+func (s SensorData) clone() SensorData {
+	if s.Payload == nil {
+		return s
+	}
+	payload := make(map[string]interface{}, len(s.Payload))
+	for key, value := range s.Payload {
+		payload[key] = value
+	}
+	s.Payload = payload
+	return s
+}
+
+// hookReading is what interceptors see of the reading, with its payload and
+// headers copied
+func (s SensorData) hookReading() hooks.Reading {
+	s = s.clone()
+	var headers map[string]string
+	if s.Headers != nil {
+		headers = make(map[string]string, len(s.Headers))
+		for key, value := range s.Headers {
+			headers[key] = value
+		}
+	}
+	return hooks.Reading{Type: s.Type, Name: s.Name, Payload: s.Payload, Headers: headers}
+}
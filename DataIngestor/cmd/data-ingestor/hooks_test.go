@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"data-ingestor/pkg/hooks"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recorder collects hook calls in order
+type recorder struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (r *recorder) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+func (r *recorder) got() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+type decoratorFunc func(req *http.Request)
+
+func (f decoratorFunc) DecorateRequest(req *http.Request) { f(req) }
+
+type interceptorFunc func(reading *hooks.Reading) bool
+
+func (f interceptorFunc) InterceptReading(reading *hooks.Reading) bool { return f(reading) }
+
+type observerFunc func(body []byte, outcome PublishOutcome)
+
+func (f observerFunc) ObservePublish(body []byte, outcome PublishOutcome) { f(body, outcome) }
+
+func newHookIngestor(t *testing.T, headers chan<- http.Header, opts ...Option) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if headers != nil {
+			headers <- r.Header.Clone()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[
+			{"type":"weather","name":"berlin-1","payload":{"temperature":21.5}},
+			{"type":"weather","name":"berlin-2","payload":{"temperature":22,"humidity":60}}
+		]`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "fatal"},
+	}, opts...)
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+	return ingestor, channel
+}
+
+func publishedReadings(t *testing.T, channel *fakeChannel) WeatherData {
+	t.Helper()
+	var data WeatherData
+	for _, msg := range channel.messages() {
+		var batch WeatherData
+		require.NoError(t, json.Unmarshal(msg.Msg.Body, &batch))
+		data = append(data, batch...)
+	}
+	return data
+}
+
+func TestHooks_RunInRegistrationOrder(t *testing.T) {
+	calls := &recorder{}
+	headers := make(chan http.Header, 1)
+	ingestor, channel := newHookIngestor(t, headers,
+		WithRequestDecorator("first", decoratorFunc(func(req *http.Request) {
+			calls.record("decorate first")
+			req.Header.Set("X-Tenant", "first")
+		})),
+		WithRequestDecorator("second", decoratorFunc(func(req *http.Request) {
+			calls.record("decorate second saw " + req.Header.Get("X-Tenant"))
+			req.Header.Add("X-Tenant", "second")
+		})),
+		WithReadingInterceptor("scale", interceptorFunc(func(reading *hooks.Reading) bool {
+			calls.record("intercept scale " + reading.Name)
+			reading.Payload["temperature"] = reading.Payload["temperature"].(float64) * 10
+			return true
+		})),
+		WithReadingInterceptor("tag", interceptorFunc(func(reading *hooks.Reading) bool {
+			calls.record("intercept tag " + reading.Name)
+			reading.Payload["scaled"] = reading.Payload["temperature"].(float64) > 100
+			return true
+		})),
+		WithPublishObserver("observer", observerFunc(func(body []byte, outcome PublishOutcome) {
+			calls.record("observe " + outcome.RoutingKey)
+		})),
+	)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{
+		"decorate first",
+		"decorate second saw first",
+		"intercept scale berlin-1",
+		"intercept tag berlin-1",
+		"intercept scale berlin-2",
+		"intercept tag berlin-2",
+		"observe meter-data-queue",
+	}, calls.got())
+	assert.Equal(t, []string{"first", "second"}, (<-headers)["X-Tenant"])
+
+	// Later hooks and the published message see the changes
+	published := publishedReadings(t, channel)
+	require.Len(t, published, 2)
+	assert.Equal(t, 215.0, published[0].Payload["temperature"])
+	assert.Equal(t, true, published[0].Payload["scaled"])
+}
+
+func TestHooks_InterceptorDropsReading(t *testing.T) {
+	ingestor, channel := newHookIngestor(t, nil,
+		WithReadingInterceptor("drop-berlin-1", interceptorFunc(func(reading *hooks.Reading) bool {
+			return reading.Name != "berlin-1"
+		})),
+	)
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	require.Len(t, *result.Data, 1)
+	published := publishedReadings(t, channel)
+	require.Len(t, published, 1)
+	assert.Equal(t, "berlin-2", published[0].Name)
+}
+
+func TestHooks_PanicsAreContained(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	var observed []PublishOutcome
+	ingestor, channel := newHookIngestor(t, headers,
+		WithRequestDecorator("broken-decorator", decoratorFunc(func(req *http.Request) {
+			req.Header.Set("X-Half-Done", "yes")
+			panic("decorator bug")
+		})),
+		WithReadingInterceptor("broken-interceptor", interceptorFunc(func(reading *hooks.Reading) bool {
+			reading.Payload["temperature"] = "corrupted"
+			panic("interceptor bug")
+		})),
+		WithReadingInterceptor("working-interceptor", interceptorFunc(func(reading *hooks.Reading) bool {
+			reading.Payload["checked"] = true
+			return true
+		})),
+		WithPublishObserver("broken-observer", observerFunc(func(body []byte, outcome PublishOutcome) {
+			panic("observer bug")
+		})),
+		WithPublishObserver("working-observer", observerFunc(func(body []byte, outcome PublishOutcome) {
+			observed = append(observed, outcome)
+		})),
+	)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err, "a panicking hook does not fail the cycle")
+
+	assert.Empty(t, (<-headers).Get("X-Half-Done"), "changes of a panicking decorator are discarded")
+	published := publishedReadings(t, channel)
+	require.Len(t, published, 2)
+	assert.Equal(t, 21.5, published[0].Payload["temperature"], "changes of a panicking interceptor are discarded")
+	assert.Equal(t, true, published[0].Payload["checked"], "the next interceptor still runs")
+
+	require.Len(t, observed, 1)
+	assert.NoError(t, observed[0].Err)
+	assert.Equal(t, channel.messages()[0].Msg.MessageId, observed[0].MessageID)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.HookPanics.WithLabelValues("broken-decorator")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.HookPanics.WithLabelValues("broken-interceptor")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.HookPanics.WithLabelValues("broken-observer")))
+	assert.Equal(t, 5, testutil.CollectAndCount(ingestor.metrics.HookDuration), "every hook is timed")
+}
+
+func TestHooks_ObserverSeesFailedPublish(t *testing.T) {
+	var observed []PublishOutcome
+	ingestor, _ := newHookIngestor(t, nil,
+		WithPublishObserver("observer", observerFunc(func(body []byte, outcome PublishOutcome) {
+			observed = append(observed, outcome)
+		})),
+	)
+	ingestor.Close()
+
+	_, err := ingestor.ingest(context.Background())
+	require.Error(t, err)
+	require.Len(t, observed, 1)
+	assert.ErrorIs(t, observed[0].Err, ErrNotConnected)
+}
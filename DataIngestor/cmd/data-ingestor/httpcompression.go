@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+)
+
+const defaultHTTPCompressionMinBytes = 1 << 10
+
+// Directions of the bytes saved by compression on the HTTP API
+const (
+	compressedRequest  = "request"
+	compressedResponse = "response"
+)
+
+// HTTPCompressionConfig gzips the responses of the HTTP API for clients that
+// accept it. Compressed request bodies are decoded either way.
+type HTTPCompressionConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// MinBytes is the smallest response compressed, 1 KiB by default
+	MinBytes ByteSize `yaml:"min_bytes"`
+	// Level is the gzip level, the default level when 0
+	Level int `yaml:"level"`
+}
+
+// Validate checks the threshold and the level
+func (c HTTPCompressionConfig) Validate() error {
+	if c.MinBytes < 0 {
+		return fmt.Errorf("server.compression.min_bytes must not be negative")
+	}
+	if c.Level < 0 || c.Level > gzip.BestCompression {
+		return fmt.Errorf("server.compression.level must be between 1 and %d, or 0 for the default level", gzip.BestCompression)
+	}
+	return nil
+}
+
+func (c HTTPCompressionConfig) minBytes() int {
+	if c.MinBytes > 0 {
+		return int(c.MinBytes)
+	}
+	return defaultHTTPCompressionMinBytes
+}
+
+func (c HTTPCompressionConfig) level() int {
+	if c.Level > 0 {
+		return c.Level
+	}
+	return gzip.DefaultCompression
+}
+
+// httpCompression decodes gzip and deflate request bodies and, with
+// server.compression.enabled, gzips the responses of clients that accept it.
+// The live stream and the metrics, which gzip on their own, are left alone.
+func (di *DataIngestor) httpCompression() gin.HandlerFunc {
+	config := di.config.Server.Compression
+	return func(c *gin.Context) {
+		if !di.decodeRequestBody(c) {
+			c.Abort()
+			return
+		}
+		if !config.Enabled || !acceptsGzip(c.GetHeader("Accept-Encoding")) || uncompressedPath(c.Request.URL.Path) {
+			c.Next()
+			return
+		}
+		// Tenant routes are served again by the tenant's own engine, which
+		// must not compress a second time
+		c.Request.Header.Del("Accept-Encoding")
+		writer := &gzipResponseWriter{ResponseWriter: c.Writer, min: config.minBytes(), level: config.level()}
+		c.Writer = writer
+		defer func() {
+			if saved := writer.close(); saved > 0 {
+				di.metrics.HTTPCompressionSaved.WithLabelValues(compressedResponse).Add(float64(saved))
+			}
+		}()
+		c.Next()
+	}
+}
+
+// decodeRequestBody replaces a gzip or deflate request body with its
+// decoded bytes, up to api.max_body_bytes of them. It answers the request
+// and returns false when the body cannot be decoded.
+func (di *DataIngestor) decodeRequestBody(c *gin.Context) bool {
+	encoding := strings.ToLower(strings.TrimSpace(c.GetHeader("Content-Encoding")))
+	if encoding == "" || encoding == "identity" || c.Request.Body == nil {
+		return true
+	}
+	maxBody := int64(di.config.API.MaxBodyBytes)
+	if maxBody <= 0 {
+		maxBody = defaultMaxBodyBytes
+	}
+	compressed := &countingReader{r: io.LimitReader(c.Request.Body, maxBody+1)}
+	var decoder io.Reader
+	var err error
+	switch encoding {
+	case "gzip", "x-gzip":
+		decoder, err = gzip.NewReader(compressed)
+	case "deflate":
+		decoder, err = zlib.NewReader(compressed)
+	default:
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{
+			"error": fmt.Sprintf("unsupported Content-Encoding %q, use gzip or deflate", encoding),
+		})
+		return false
+	}
+	var body []byte
+	if err == nil {
+		// Read past the limit only by a byte, however far the body inflates
+		body, err = io.ReadAll(io.LimitReader(decoder, maxBody+1))
+	}
+	if int64(len(body)) > maxBody || compressed.n > maxBody {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{
+			"error": fmt.Sprintf("decompressed request body exceeds %d bytes", maxBody),
+		})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("failed to decode %s request body: %v", encoding, err),
+		})
+		return false
+	}
+	if saved := int64(len(body)) - compressed.n; saved > 0 {
+		di.metrics.HTTPCompressionSaved.WithLabelValues(compressedRequest).Add(float64(saved))
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	c.Request.ContentLength = int64(len(body))
+	c.Request.Header.Del("Content-Encoding")
+	c.Request.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return true
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		for _, param := range params[1:] {
+			value, ok := strings.CutPrefix(strings.TrimSpace(param), "q=")
+			if q, err := strconv.ParseFloat(value, 64); ok && err == nil && q == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// uncompressedPath is the live stream and the metrics, also of a tenant
+func uncompressedPath(path string) bool {
+	if rest, ok := strings.CutPrefix(path, "/tenants/"); ok {
+		if _, scoped, found := strings.Cut(rest, "/"); found {
+			path = "/" + scoped
+		}
+	}
+	return path == "/stream" || path == "/metrics"
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written to w
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// gzipResponseWriter holds the start of a response until it is min bytes
+// long, then gzips it. Shorter responses and those already encoded or
+// streamed as events are sent as they are.
+type gzipResponseWriter struct {
+	gin.ResponseWriter
+	min, level  int
+	buffered    []byte
+	passthrough bool
+	gz          *gzip.Writer
+	compressed  *countingWriter
+	plain       int64
+}
+
+func (w *gzipResponseWriter) Write(p []byte) (int, error) {
+	if w.passthrough {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.gz != nil {
+		w.plain += int64(len(p))
+		return w.gz.Write(p)
+	}
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" || strings.HasPrefix(header.Get("Content-Type"), "text/event-stream") {
+		w.passthrough = true
+		return w.ResponseWriter.Write(p)
+	}
+	w.buffered = append(w.buffered, p...)
+	if len(w.buffered) < w.min {
+		return len(p), nil
+	}
+	if err := w.start(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *gzipResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+// start switches to gzip and compresses what was held
+func (w *gzipResponseWriter) start() error {
+	header := w.Header()
+	header.Set("Content-Encoding", "gzip")
+	header.Add("Vary", "Accept-Encoding")
+	header.Del("Content-Length")
+	w.compressed = &countingWriter{w: w.ResponseWriter}
+	w.gz, _ = gzip.NewWriterLevel(w.compressed, w.level)
+	held := w.buffered
+	w.buffered = nil
+	w.plain = int64(len(held))
+	_, err := w.gz.Write(held)
+	return err
+}
+
+// Flush sends what is held uncompressed: a response flushed before it
+// reached the threshold is streamed, and streams are not compressed
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	} else if !w.passthrough {
+		w.passthrough = true
+		if len(w.buffered) > 0 {
+			w.ResponseWriter.Write(w.buffered)
+			w.buffered = nil
+		}
+	}
+	w.ResponseWriter.Flush()
+}
+
+// close ends the response and returns the bytes compression saved
+func (w *gzipResponseWriter) close() int64 {
+	if w.gz == nil {
+		if len(w.buffered) > 0 {
+			w.ResponseWriter.Write(w.buffered)
+		}
+		return 0
+	}
+	w.gz.Close()
+	return w.plain - w.compressed.n
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zlib"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const postedReadings = `[{"type":"weather","name":"moscow-1","payload":{"temperature":-5}},{"type":"weather","name":"moscow-2","payload":{"temperature":-6}}]`
+
+func gzipped(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	_, err := writer.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func postEncoded(router http.Handler, encoding string, body []byte) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/ingest", bytes.NewReader(body))
+	req.Header.Set("Content-Encoding", encoding)
+	req.Header.Set("Authorization", "Bearer letmein")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// newCompressingRouter serves a response of size bytes on /big, an event
+// stream on /stream and /tenants/north/stream, through the compression of
+// an ingestor with server.compression
+func newCompressingRouter(t *testing.T, config HTTPCompressionConfig) (*DataIngestor, *gin.Engine) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		Server:   ServerConfig{Compression: config},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+	})
+	r := gin.New()
+	r.Use(ingestor.httpCompression())
+	r.GET("/big", func(c *gin.Context) {
+		size := 4 << 10
+		if c.Query("small") != "" {
+			size = 100
+		}
+		c.Data(http.StatusOK, "application/json", bytes.Repeat([]byte("a"), size))
+	})
+	events := func(c *gin.Context) {
+		c.Header("Content-Type", "text/event-stream")
+		for i := 0; i < 100; i++ {
+			c.Writer.WriteString("data: " + strings.Repeat("b", 100) + "\n\n")
+			c.Writer.Flush()
+		}
+	}
+	r.GET("/stream", events)
+	r.GET("/tenants/north/stream", events)
+	return ingestor, r
+}
+
+func getEncoded(router http.Handler, path, accept string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	if accept != "" {
+		req.Header.Set("Accept-Encoding", accept)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestHTTPCompressionConfig_Validate(t *testing.T) {
+	assert.NoError(t, HTTPCompressionConfig{Enabled: true}.Validate())
+	assert.Equal(t, defaultHTTPCompressionMinBytes, HTTPCompressionConfig{}.minBytes())
+	assert.ErrorContains(t, HTTPCompressionConfig{MinBytes: -1}.Validate(), "server.compression.min_bytes")
+	assert.NoError(t, HTTPCompressionConfig{Level: 0}.Validate(), "0 is the default level")
+	assert.Equal(t, gzip.DefaultCompression, HTTPCompressionConfig{}.level())
+	assert.ErrorContains(t, HTTPCompressionConfig{Level: 12}.Validate(), "between 1 and 9, or 0 for the default level")
+	assert.ErrorContains(t, HTTPCompressionConfig{Level: -1}.Validate(), "server.compression.level")
+}
+
+func TestHTTPCompression_DecodesRequestBodies(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+
+	w := postEncoded(router, "gzip", gzipped(t, []byte(postedReadings)))
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Len(t, channel.messages(), 2, "a message per posted reading")
+	assert.Contains(t, string(channel.messages()[1].Msg.Body), "moscow-2")
+
+	var deflated bytes.Buffer
+	writer := zlib.NewWriter(&deflated)
+	writer.Write([]byte(postedReadings))
+	writer.Close()
+	w = postEncoded(router, "deflate", deflated.Bytes())
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, channel.messages(), 4)
+	assert.Positive(t, testutil.ToFloat64(ingestor.metrics.HTTPCompressionSaved.WithLabelValues(compressedRequest)))
+}
+
+func TestHTTPCompression_RejectsDecompressionBombs(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	ingestor.config.API.MaxBodyBytes = 64 << 10
+	router := setupRoutes(ingestor)
+
+	// 16 MiB of zeros deflate to a few KiB
+	bomb := gzipped(t, make([]byte, 16<<20))
+	require.Less(t, len(bomb), 64<<10)
+	w := postEncoded(router, "gzip", bomb)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, w.Code)
+	assert.Contains(t, w.Body.String(), "exceeds 65536 bytes")
+	assert.Empty(t, channel.messages())
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.HTTPCompressionSaved.WithLabelValues(compressedRequest)))
+
+	// A body just under the limit still goes through
+	readings := `[{"type":"weather","name":"moscow-1","payload":{"note":"` + strings.Repeat("x", 60<<10) + `"}}]`
+	w = postEncoded(router, "gzip", gzipped(t, []byte(readings)))
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+}
+
+func TestHTTPCompression_RejectsUndecodableBodies(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+
+	w := postEncoded(router, "br", []byte(postedReadings))
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code)
+	w = postEncoded(router, "gzip", []byte(postedReadings))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "failed to decode gzip request body")
+	truncated := gzipped(t, []byte(postedReadings))
+	w = postEncoded(router, "gzip", truncated[:len(truncated)-10])
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, channel.messages())
+}
+
+func TestHTTPCompression_GzipsLargeResponses(t *testing.T) {
+	ingestor, router := newCompressingRouter(t, HTTPCompressionConfig{Enabled: true})
+
+	w := getEncoded(router, "/big", "deflate, gzip;q=0.8")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	assert.Equal(t, "Accept-Encoding", w.Header().Get("Vary"))
+	reader, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Len(t, body, 4<<10)
+	assert.Positive(t, testutil.ToFloat64(ingestor.metrics.HTTPCompressionSaved.WithLabelValues(compressedResponse)))
+
+	for name, w := range map[string]*httptest.ResponseRecorder{
+		"below min_bytes":      getEncoded(router, "/big?small=1", "gzip"),
+		"no Accept-Encoding":   getEncoded(router, "/big", ""),
+		"gzip refused":         getEncoded(router, "/big", "gzip;q=0, identity"),
+		"stream":               getEncoded(router, "/stream", "gzip"),
+		"stream of the tenant": getEncoded(router, "/tenants/north/stream", "gzip"),
+	} {
+		assert.Empty(t, w.Header().Get("Content-Encoding"), name)
+		assert.NotContains(t, w.Body.String(), "\x1f\x8b", name)
+	}
+	assert.True(t, strings.HasPrefix(getEncoded(router, "/stream", "gzip").Body.String(), "data: "))
+}
+
+func TestHTTPCompression_Disabled(t *testing.T) {
+	_, router := newCompressingRouter(t, HTTPCompressionConfig{})
+	w := getEncoded(router, "/big", "gzip")
+	assert.Empty(t, w.Header().Get("Content-Encoding"))
+	assert.Len(t, w.Body.Bytes(), 4<<10)
+}
+
+func TestHTTPCompression_LeavesTheMetricsAlone(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.config.Server.Compression = HTTPCompressionConfig{Enabled: true, MinBytes: 1}
+	router := setupRoutes(ingestor)
+
+	// The exposition handler gzips by itself, once
+	w := getEncoded(router, "/metrics", "gzip")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+	reader, err := gzip.NewReader(w.Body)
+	require.NoError(t, err)
+	body, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Contains(t, string(body), "data_ingestor_")
+
+	// Other routes of the service are compressed
+	w = getEncoded(router, "/status", "gzip")
+	assert.Equal(t, "gzip", w.Header().Get("Content-Encoding"))
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, want := range map[string]bool{
+		"":                       false,
+		"gzip":                   true,
+		"GZIP":                   true,
+		"deflate, gzip;q=1.0":    true,
+		"br;q=1, *;q=0.1":        true,
+		"gzip;q=0":               false,
+		"gzip; q=0.000, deflate": false,
+		"identity":               false,
+	} {
+		assert.Equal(t, want, acceptsGzip(header), header)
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// IdempotencyKeyHeader carries the client-supplied idempotency key
+	IdempotencyKeyHeader = "Idempotency-Key"
+	// IdempotentReplayedHeader is set on responses served from the cache
+	IdempotentReplayedHeader = "Idempotent-Replayed"
+
+	defaultIdempotencyTTL     = 10 * time.Minute
+	defaultIdempotencyMaxKeys = 1000
+	maxIdempotentBodyBytes    = 1 << 20
+
+	defaultDedupPageSize = 100
+	maxDedupPageSize     = 1000
+)
+
+// errIdempotencyMismatch is returned when a key is reused with a different request body
+var errIdempotencyMismatch = errors.New("idempotency key was already used with a different request body")
+
+// IdempotencyConfig bounds the cache of responses to keyed /ingest requests
+type IdempotencyConfig struct {
+	TTL     Duration `yaml:"ttl"`
+	MaxKeys int      `yaml:"max_keys"`
+}
+
+// idempotencyEntry is the outcome of the first request made with a key.
+// done is closed once status and body are set.
+type idempotencyEntry struct {
+	key         string
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	status      int
+	body        []byte
+	contentType string
+	created     time.Time
+	expires     time.Time
+	element     *list.Element
+}
+
+// idempotencyCache is a bounded, TTL-limited cache of keyed responses
+type idempotencyCache struct {
+	ttl     time.Duration
+	maxKeys int
+	now     func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*idempotencyEntry
+	order   *list.List // oldest first
+}
+
+func newIdempotencyCache(config IdempotencyConfig) *idempotencyCache {
+	ttl := time.Duration(config.TTL)
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	maxKeys := config.MaxKeys
+	if maxKeys <= 0 {
+		maxKeys = defaultIdempotencyMaxKeys
+	}
+	return &idempotencyCache{
+		ttl:     ttl,
+		maxKeys: maxKeys,
+		now:     time.Now,
+		entries: make(map[string]*idempotencyEntry),
+		order:   list.New(),
+	}
+}
+
+// begin returns the entry for key. leader is true when the caller is the first
+// request for the key and must call complete; otherwise it should wait on done.
+func (c *idempotencyCache) begin(key string, fingerprint [sha256.Size]byte) (entry *idempotencyEntry, leader bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if existing, ok := c.entries[key]; ok {
+		expired := !existing.expires.IsZero() && now.After(existing.expires)
+		if !expired {
+			if existing.fingerprint != fingerprint {
+				return nil, false, errIdempotencyMismatch
+			}
+			return existing, false, nil
+		}
+		c.remove(existing)
+	}
+
+	entry = &idempotencyEntry{key: key, fingerprint: fingerprint, done: make(chan struct{}), created: now}
+	entry.element = c.order.PushBack(entry)
+	c.entries[key] = entry
+
+	for c.order.Len() > c.maxKeys {
+		c.remove(c.order.Front().Value.(*idempotencyEntry))
+	}
+	return entry, true, nil
+}
+
+// complete records the leader's response and releases waiting requests
+func (c *idempotencyCache) complete(entry *idempotencyEntry, status int, contentType string, body []byte) {
+	c.mu.Lock()
+	entry.status = status
+	entry.contentType = contentType
+	entry.body = body
+	entry.expires = c.now().Add(c.ttl)
+	// Server errors and rejections by the ingest limiter are handed to
+	// waiting followers but not kept, so a retry after e.g. a 503 executes
+	// again
+	if status >= http.StatusInternalServerError || status == http.StatusTooManyRequests {
+		c.remove(entry)
+	}
+	c.mu.Unlock()
+
+	close(entry.done)
+}
+
+func (c *idempotencyCache) remove(entry *idempotencyEntry) {
+	c.order.Remove(entry.element)
+	if c.entries[entry.key] == entry {
+		delete(c.entries, entry.key)
+	}
+}
+
+// Len returns the number of cached keys, including in-flight requests
+func (c *idempotencyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// IdempotencyKeyInfo describes a cached key for GET /admin/dedup
+type IdempotencyKeyInfo struct {
+	Key string `json:"key"`
+	// Age is in seconds since the first request with the key
+	Age float64 `json:"age_seconds"`
+	// Status is the cached response status, 0 while the request is in flight
+	Status    int        `json:"status"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// keys returns up to limit keys starting at offset, oldest first, and the
+// total number of keys
+func (c *idempotencyCache) keys(offset, limit int) ([]IdempotencyKeyInfo, int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	keys := []IdempotencyKeyInfo{}
+	i := 0
+	for element := c.order.Front(); element != nil && len(keys) < limit; element = element.Next() {
+		if i++; i <= offset {
+			continue
+		}
+		entry := element.Value.(*idempotencyEntry)
+		info := IdempotencyKeyInfo{
+			Key:    entry.key,
+			Age:    now.Sub(entry.created).Seconds(),
+			Status: entry.status,
+		}
+		if !entry.expires.IsZero() {
+			expires := entry.expires
+			info.ExpiresAt = &expires
+		}
+		keys = append(keys, info)
+	}
+	return keys, c.order.Len()
+}
+
+// forget removes one key. A request still in flight with it completes, but
+// its response is not kept for later requests.
+func (c *idempotencyCache) forget(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if ok {
+		c.remove(entry)
+	}
+	return ok
+}
+
+// flush removes every key and returns how many there were
+func (c *idempotencyCache) flush() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Entries are removed one by one so that requests still in flight can
+	// complete against them safely
+	n := c.order.Len()
+	for element := c.order.Front(); element != nil; {
+		next := element.Next()
+		c.remove(element.Value.(*idempotencyEntry))
+		element = next
+	}
+	return n
+}
+
+// handleDedupList serves GET /admin/dedup?offset=&limit=
+func (di *DataIngestor) handleDedupList(c *gin.Context) {
+	offset, err := queryInt(c, "offset", 0)
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "offset must be a non-negative integer",
+		})
+		return
+	}
+	limit, err := queryInt(c, "limit", defaultDedupPageSize)
+	if err != nil || limit < 1 || limit > maxDedupPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("limit must be between 1 and %d", maxDedupPageSize),
+		})
+		return
+	}
+
+	keys, total := di.idempotency.keys(offset, limit)
+	c.JSON(http.StatusOK, gin.H{
+		"keys":   keys,
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+	})
+}
+
+// handleDedupFlush serves DELETE /admin/dedup
+func (di *DataIngestor) handleDedupFlush(c *gin.Context) {
+	removed := di.idempotency.flush()
+	di.logger.WithFields(logrus.Fields{
+		"client":  c.ClientIP(),
+		"removed": removed,
+	}).Warn("Idempotency cache flushed via admin API")
+	c.JSON(http.StatusOK, gin.H{
+		"removed": removed,
+	})
+}
+
+// handleDedupDelete serves DELETE /admin/dedup/:key
+func (di *DataIngestor) handleDedupDelete(c *gin.Context) {
+	key := c.Param("key")
+	if !di.idempotency.forget(key) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("unknown key %q", key),
+		})
+		return
+	}
+	di.logger.WithFields(logrus.Fields{
+		"client": c.ClientIP(),
+		"key":    key,
+	}).Warn("Idempotency key removed via admin API")
+	c.JSON(http.StatusOK, gin.H{
+		"removed": 1,
+	})
+}
+
+// queryInt parses an integer query parameter, returning def when it is absent
+func queryInt(c *gin.Context, name string, def int) (int, error) {
+	raw := c.Query(name)
+	if raw == "" {
+		return def, nil
+	}
+	return strconv.Atoi(raw)
+}
+
+// capturingWriter records the response body while writing it through
+type capturingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *capturingWriter) Write(b []byte) (int, error) {
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *capturingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Middleware executes at most one request per Idempotency-Key. Concurrent
+// requests with the same key wait for the first one and all of them receive
+// its response. Requests without a key pass straight through.
+func (c *idempotencyCache) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		key := ctx.GetHeader(IdempotencyKeyHeader)
+		if key == "" {
+			ctx.Next()
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(ctx.Request.Body, maxIdempotentBodyBytes))
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusBadRequest, gin.H{
+				"error": "failed to read request body",
+			})
+			return
+		}
+		ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		entry, leader, err := c.begin(key, fingerprint(body))
+		if err != nil {
+			ctx.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{
+				"error": err.Error(),
+			})
+			return
+		}
+
+		if !leader {
+			select {
+			case <-entry.done:
+			case <-ctx.Request.Context().Done():
+				ctx.Abort()
+				return
+			}
+			ctx.Header(IdempotentReplayedHeader, "true")
+			ctx.Data(entry.status, entry.contentType, entry.body)
+			ctx.Abort()
+			return
+		}
+
+		// Retries are expected when the client gives up, so the first request
+		// runs to completion even if its client disconnects.
+		ctx.Request = ctx.Request.WithContext(context.WithoutCancel(ctx.Request.Context()))
+
+		writer := &capturingWriter{ResponseWriter: ctx.Writer}
+		ctx.Writer = writer
+		defer func() {
+			c.complete(entry, writer.Status(), writer.Header().Get("Content-Type"), writer.body.Bytes())
+		}()
+
+		ctx.Next()
+	}
+}
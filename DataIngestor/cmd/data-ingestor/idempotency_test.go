@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSlowIngestor returns an ingestor whose upstream blocks until release is closed
+func newSlowIngestor(t *testing.T) (*DataIngestor, *fakeChannel, *int32, chan struct{}) {
+	t.Helper()
+
+	var hits int32
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(5 * time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+	return ingestor, channel, &hits, release
+}
+
+func postIngest(router http.Handler, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+	if key != "" {
+		req.Header.Set(IdempotencyKeyHeader, key)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestIdempotency_ConcurrentRequestsCoalesce(t *testing.T) {
+	ingestor, channel, hits, release := newSlowIngestor(t)
+	router := setupRoutes(ingestor)
+
+	const callers = 8
+	responses := make([]*httptest.ResponseRecorder, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = postIngest(router, "retry-1", "")
+		}(i)
+	}
+
+	// Wait until the leader reaches the upstream and the others are queued behind it
+	require.Eventually(t, func() bool { return atomic.LoadInt32(hits) == 1 }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+	assert.Len(t, channel.messages(), 1)
+
+	replayed := 0
+	for _, w := range responses {
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, responses[0].Body.String(), w.Body.String())
+		if w.Header().Get(IdempotentReplayedHeader) == "true" {
+			replayed++
+		}
+	}
+	assert.Equal(t, callers-1, replayed)
+
+	var body struct {
+		MessageIDs []string `json:"message_ids"`
+	}
+	require.NoError(t, json.Unmarshal(responses[0].Body.Bytes(), &body))
+	require.Len(t, body.MessageIDs, 1)
+	assert.Equal(t, channel.messages()[0].Msg.MessageId, body.MessageIDs[0])
+}
+
+func TestIdempotency_RetryAfterCompletionIsCached(t *testing.T) {
+	ingestor, channel, hits, release := newSlowIngestor(t)
+	close(release)
+	router := setupRoutes(ingestor)
+
+	first := postIngest(router, "retry-2", "")
+	second := postIngest(router, "retry-2", "")
+	assert.Equal(t, http.StatusOK, first.Code)
+	assert.Equal(t, first.Body.String(), second.Body.String())
+	assert.Equal(t, "true", second.Header().Get(IdempotentReplayedHeader))
+
+	// Requests without a key, or with another key, execute normally
+	postIngest(router, "", "")
+	postIngest(router, "retry-3", "")
+	assert.Equal(t, int32(3), atomic.LoadInt32(hits))
+	assert.Len(t, channel.messages(), 3)
+}
+
+func TestIdempotency_MismatchedBody(t *testing.T) {
+	ingestor, _, _, release := newSlowIngestor(t)
+	close(release)
+	router := setupRoutes(ingestor)
+
+	assert.Equal(t, http.StatusOK, postIngest(router, "retry-4", `{"n":1}`).Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, postIngest(router, "retry-4", `{"n":2}`).Code)
+}
+
+func TestIdempotency_SameBodyReordered(t *testing.T) {
+	ingestor, _, hits, release := newSlowIngestor(t)
+	close(release)
+	router := setupRoutes(ingestor)
+
+	// JSON bodies are compared by their canonical encoding
+	assert.Equal(t, http.StatusOK, postIngest(router, "retry-6", `{"n":1,"at":"2026-03-01T12:00:00+03:00"}`).Code)
+	replay := postIngest(router, "retry-6", `{ "at": "2026-03-01T09:00:00Z", "n": 1.0 }`)
+	assert.Equal(t, http.StatusOK, replay.Code)
+	assert.Equal(t, "true", replay.Header().Get(IdempotentReplayedHeader))
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+}
+
+func TestIdempotencyCache_BoundedAndExpires(t *testing.T) {
+	cache := newIdempotencyCache(IdempotencyConfig{TTL: Duration(time.Minute), MaxKeys: 2})
+	now := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	cache.now = func() time.Time { return now }
+	fp := sha256.Sum256(nil)
+
+	for _, key := range []string{"a", "b", "c"} {
+		entry, leader, err := cache.begin(key, fp)
+		require.NoError(t, err)
+		require.True(t, leader)
+		cache.complete(entry, http.StatusOK, "application/json", []byte(key))
+	}
+	assert.Equal(t, 2, cache.Len())
+
+	// "a" was evicted, so it executes again
+	_, leader, err := cache.begin("a", fp)
+	require.NoError(t, err)
+	assert.True(t, leader)
+
+	_, leader, _ = cache.begin("c", fp)
+	assert.False(t, leader)
+
+	now = now.Add(2 * time.Minute)
+	_, leader, _ = cache.begin("c", fp)
+	assert.True(t, leader, "expired keys execute again")
+}
+
+func adminRequest(router http.Handler, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer letmein")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestDedupAdmin_FlushLetsSuppressedRequestPublish(t *testing.T) {
+	ingestor, channel, _, release := newSlowIngestor(t)
+	close(release)
+	ingestor.config.Admin.Token = "letmein"
+	router := setupRoutes(ingestor)
+
+	require.Equal(t, http.StatusOK, postIngest(router, "deploy-1", "").Code)
+	require.Equal(t, "true", postIngest(router, "deploy-1", "").Header().Get(IdempotentReplayedHeader))
+	assert.Len(t, channel.messages(), 1)
+
+	// Mutations need the admin token
+	req := httptest.NewRequest(http.MethodDelete, "/admin/dedup", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = adminRequest(router, http.MethodDelete, "/admin/dedup")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"removed":1}`, w.Body.String())
+
+	again := postIngest(router, "deploy-1", "")
+	assert.Equal(t, http.StatusOK, again.Code)
+	assert.Empty(t, again.Header().Get(IdempotentReplayedHeader))
+	assert.Len(t, channel.messages(), 2)
+}
+
+func TestDedupAdmin_DeleteKey(t *testing.T) {
+	ingestor, channel, _, release := newSlowIngestor(t)
+	close(release)
+	ingestor.config.Admin.Token = "letmein"
+	router := setupRoutes(ingestor)
+
+	postIngest(router, "deploy-1", "")
+	postIngest(router, "deploy-2", "")
+
+	assert.Equal(t, http.StatusNotFound, adminRequest(router, http.MethodDelete, "/admin/dedup/unknown").Code)
+	assert.Equal(t, http.StatusOK, adminRequest(router, http.MethodDelete, "/admin/dedup/deploy-1").Code)
+
+	postIngest(router, "deploy-1", "")
+	assert.Equal(t, "true", postIngest(router, "deploy-2", "").Header().Get(IdempotentReplayedHeader), "other keys are kept")
+	assert.Len(t, channel.messages(), 3)
+}
+
+func TestDedupAdmin_ListPaginated(t *testing.T) {
+	ingestor, _, _, release := newSlowIngestor(t)
+	close(release)
+	ingestor.config.Admin.Token = "letmein"
+	router := setupRoutes(ingestor)
+	for _, key := range []string{"a", "b", "c"} {
+		postIngest(router, key, "")
+	}
+
+	w := adminRequest(router, http.MethodGet, "/admin/dedup?offset=1&limit=1")
+	require.Equal(t, http.StatusOK, w.Code)
+	var page struct {
+		Keys  []IdempotencyKeyInfo `json:"keys"`
+		Total int                  `json:"total"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &page))
+	assert.Equal(t, 3, page.Total)
+	require.Len(t, page.Keys, 1)
+	assert.Equal(t, "b", page.Keys[0].Key)
+	assert.Equal(t, http.StatusOK, page.Keys[0].Status)
+	assert.NotNil(t, page.Keys[0].ExpiresAt)
+	assert.GreaterOrEqual(t, page.Keys[0].Age, 0.0)
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(router, http.MethodGet, "/admin/dedup?limit=0").Code)
+	assert.Equal(t, http.StatusBadRequest, adminRequest(router, http.MethodGet, "/admin/dedup?offset=x").Code)
+}
+
+func TestIdempotencyCache_FlushDuringInFlightRequest(t *testing.T) {
+	ingestor, channel, hits, release := newSlowIngestor(t)
+	router := setupRoutes(ingestor)
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postIngest(router, "in-flight", "") }()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(hits) == 1 }, time.Second, 5*time.Millisecond)
+
+	assert.Equal(t, 1, ingestor.idempotency.flush())
+	close(release)
+	assert.Equal(t, http.StatusOK, (<-done).Code)
+
+	// The flushed request completed but its response was not kept
+	assert.Equal(t, 0, ingestor.idempotency.Len())
+	postIngest(router, "in-flight", "")
+	assert.Len(t, channel.messages(), 2)
+}
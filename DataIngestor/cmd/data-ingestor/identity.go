@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// version is set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// ClientConfig identifies our requests to the upstream
+type ClientConfig struct {
+	// UserAgent defaults to data-ingestor/<version> (+<instance id>)
+	UserAgent string `yaml:"user_agent"`
+	// QueryParams are added to every upstream request, e.g. client: ingestor
+	QueryParams map[string]string `yaml:"query_params"`
+}
+
+// instanceIDPattern keeps instance ids usable in headers and log fields
+var instanceIDPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// validateInstanceID checks a configured instance_id
+func validateInstanceID(id string) error {
+	if id != "" && !instanceIDPattern.MatchString(id) {
+		return fmt.Errorf("instance_id must be 1 to 64 letters, digits, '.', '_' or '-', got %q", id)
+	}
+	return nil
+}
+
+// newInstanceID returns the configured id, or one made of the host name and
+// a random suffix, which stays the same for the life of the process
+func newInstanceID(configured string) string {
+	if configured != "" {
+		return configured
+	}
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "data-ingestor"
+	}
+	host = strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '_', r == '-':
+			return r
+		}
+		return '-'
+	}, host)
+	if len(host) > 50 {
+		host = host[:50]
+	}
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		panic(err)
+	}
+	return host + "-" + hex.EncodeToString(suffix)
+}
+
+// userAgent returns the User-Agent sent to the upstream
+func (di *DataIngestor) userAgent() string {
+	if di.config.API.Client.UserAgent != "" {
+		return di.config.API.Client.UserAgent
+	}
+	return fmt.Sprintf("data-ingestor/%s (+%s)", version, di.instanceID)
+}
+
+// tagRequest identifies the ingestor on an upstream request
+func (di *DataIngestor) tagRequest(req *http.Request) {
+	req.Header.Set("User-Agent", di.userAgent())
+	req.Header.Set("X-Instance-Id", di.instanceID)
+}
+
+// instanceHook adds the instance id to every log entry
+type instanceHook struct {
+	id string
+}
+
+func (h instanceHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h instanceHook) Fire(entry *logrus.Entry) error {
+	entry.Data["instance_id"] = h.id
+	return nil
+}
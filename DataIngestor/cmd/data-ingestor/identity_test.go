@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordRequests serves one reading and hands every request to requests
+func recordRequests(t *testing.T) (*httptest.Server, <-chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r.Clone(context.Background())
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream, requests
+}
+
+func TestFetch_TagsRequests(t *testing.T) {
+	upstream, requests := recordRequests(t)
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL: upstream.URL,
+			Timeout: Duration(time.Second),
+			Client:  ClientConfig{QueryParams: map[string]string{"client": "ingestor"}},
+			Incremental: IncrementalConfig{
+				Enabled:   true,
+				StateFile: t.TempDir() + "/cursor.json",
+			},
+		},
+		InstanceID: "ingestor-eu-1",
+		Logging:    LoggingConfig{Level: "error"},
+	})
+
+	_, err := ingestor.FetchDataFromAPI(context.Background())
+	require.NoError(t, err)
+
+	req := <-requests
+	assert.Equal(t, "/meters", req.URL.Path)
+	assert.Equal(t, "data-ingestor/"+version+" (+ingestor-eu-1)", req.Header.Get("User-Agent"))
+	assert.Equal(t, "ingestor-eu-1", req.Header.Get("X-Instance-Id"))
+	assert.Equal(t, "supersecret", req.Header.Get("X-Api-Key"))
+	query := req.URL.Query()
+	assert.Equal(t, "ingestor", query.Get("client"))
+	_, err = time.Parse(time.RFC3339Nano, query.Get("since"))
+	assert.NoError(t, err, "static parameters are sent next to the cursor")
+}
+
+func TestFetch_UserAgentOverride(t *testing.T) {
+	upstream, requests := recordRequests(t)
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL: upstream.URL,
+			Timeout: Duration(time.Second),
+			Client:  ClientConfig{UserAgent: "weather-team/2"},
+		},
+		Logging: LoggingConfig{Level: "error"},
+	})
+
+	_, err := ingestor.FetchDataFromAPI(context.Background())
+	require.NoError(t, err)
+
+	req := <-requests
+	assert.Equal(t, "weather-team/2", req.Header.Get("User-Agent"))
+	assert.Equal(t, ingestor.instanceID, req.Header.Get("X-Instance-Id"))
+	assert.Empty(t, req.URL.RawQuery)
+}
+
+func TestNewInstanceID(t *testing.T) {
+	assert.Equal(t, "ingestor-eu-1", newInstanceID("ingestor-eu-1"))
+
+	generated := newInstanceID("")
+	assert.NoError(t, validateInstanceID(generated))
+	assert.NotEqual(t, generated, newInstanceID(""), "every process gets its own id")
+
+	assert.Error(t, validateInstanceID("has space"))
+	assert.Error(t, validateInstanceID(string(bytes.Repeat([]byte("a"), 65))))
+}
+
+func TestInstanceID_InLogsAndMessages(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		InstanceID: "ingestor-eu-1",
+		Logging:    LoggingConfig{Level: "info"},
+	})
+	var logs bytes.Buffer
+	ingestor.logger.SetOutput(&logs)
+	ingestor.logger.SetFormatter(&logrus.JSONFormatter{})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	require.NoError(t, ingestor.PublishToQueue(&data))
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "ingestor-eu-1", messages[0].Msg.Headers["instance_id"])
+
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(bytes.SplitN(logs.Bytes(), []byte("\n"), 2)[0], &entry))
+	assert.Equal(t, "ingestor-eu-1", entry["instance_id"])
+
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	var health map[string]interface{}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &health))
+	assert.Equal(t, "ingestor-eu-1", health["instance_id"])
+	assert.Equal(t, version, health["version"])
+}
+
+func TestQueryParamsAreEscaped(t *testing.T) {
+	upstream, requests := recordRequests(t)
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL: upstream.URL,
+			Timeout: Duration(time.Second),
+			Client:  ClientConfig{QueryParams: map[string]string{"client": "ingestor & co"}},
+		},
+		Logging: LoggingConfig{Level: "error"},
+	})
+
+	_, err := ingestor.FetchDataFromAPI(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, url.Values{"client": {"ingestor & co"}}, (<-requests).URL.Query())
+}
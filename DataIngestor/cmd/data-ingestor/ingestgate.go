@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// How the gate answered a triggered POST /ingest, the behavior label of
+	// data_ingestor_manual_ingest_gated_total
+	gateRejected         = "rejected"
+	gateSpooled          = "spooled"
+	gateSpoolUnavailable = "spool_unavailable"
+)
+
+// sinkDown returns the state of the RabbitMQ connection and, when it is not
+// ready, why: the error it was lost or failed to connect with
+func (di *DataIngestor) sinkDown() (ConnState, error) {
+	di.connMu.Lock()
+	defer di.connMu.Unlock()
+	if di.connState == StateReady && di.channel != nil {
+		return di.connState, nil
+	}
+	if di.connErr != nil {
+		return di.connState, fmt.Errorf("%w: %w", ErrNotConnected, di.connErr)
+	}
+	return di.connState, fmt.Errorf("%w (connection is %s)", ErrNotConnected, di.connState)
+}
+
+// needsAMQP reports whether the delivery policy fails a cycle RabbitMQ does
+// not take: it is a required sink, or a quorum sink the quorum cannot be met
+// without
+func (di *DataIngestor) needsAMQP() bool {
+	policy := di.config.Delivery
+	switch policy.policy(sinkAMQP) {
+	case deliveryRequired:
+		return true
+	case deliveryQuorum:
+		others := 0
+		for sink, enabled := range di.config.enabledSinks() {
+			if enabled && sink != sinkAMQP && policy.policy(sink) == deliveryQuorum {
+				others++
+			}
+		}
+		return others < policy.Quorum
+	}
+	return false
+}
+
+// spoolRequest collects the spool positions of the messages of a POST
+// /ingest?spool=true, which go to the spool without a live publish
+type spoolRequest struct {
+	// reason is why RabbitMQ is not taking them
+	reason error
+
+	mu        sync.Mutex
+	positions []uint64
+}
+
+type spoolRequestKey struct{}
+
+func withSpoolRequest(ctx context.Context, request *spoolRequest) context.Context {
+	return context.WithValue(ctx, spoolRequestKey{}, request)
+}
+
+// spoolRequestOf returns the spool request of ctx, nil for every other
+// publish
+func spoolRequestOf(ctx context.Context) *spoolRequest {
+	request, _ := ctx.Value(spoolRequestKey{}).(*spoolRequest)
+	return request
+}
+
+func (r *spoolRequest) add(position uint64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.positions = append(r.positions, position)
+}
+
+func (r *spoolRequest) spooled() []uint64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]uint64(nil), r.positions...)
+}
+
+// gateIngest answers a triggered POST /ingest before its fetch while
+// RabbitMQ is not connected and the delivery policy needs it, so the
+// upstream budget is not spent on readings that cannot be delivered. With
+// ?spool=true it lets the fetch go ahead into rabbitmq.spool instead, and
+// returns the request that collects the spool positions. It reports whether
+// the fetch may go ahead.
+func (di *DataIngestor) gateIngest(c *gin.Context) (*spoolRequest, bool) {
+	spool := false
+	if value := c.Query("spool"); value != "" {
+		var err error
+		if spool, err = strconv.ParseBool(value); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("spool must be true or false, got %q", value),
+			})
+			return nil, false
+		}
+	}
+	if spool && (di.spool == nil || di.config.Publishing.BatchMode == batchModeTx) {
+		reason := "spool=true needs rabbitmq.spool.dir"
+		if di.spool != nil {
+			reason = "spool=true cannot be combined with publishing.batch_mode tx, whose batches are never spooled"
+		}
+		di.metrics.ManualIngestGated.WithLabelValues(gateSpoolUnavailable).Inc()
+		c.JSON(http.StatusConflict, gin.H{
+			"error":    reason,
+			"behavior": gateSpoolUnavailable,
+		})
+		return nil, false
+	}
+
+	state, err := di.sinkDown()
+	if err == nil || !di.needsAMQP() {
+		return nil, true
+	}
+	if spool {
+		di.metrics.ManualIngestGated.WithLabelValues(gateSpooled).Inc()
+		di.log(logIngestion).WithError(err).Debug("Manual ingestion fetching into the spool, RabbitMQ is not connected")
+		return &spoolRequest{reason: err}, true
+	}
+	retry := "retry once the connection is ready"
+	if di.spool != nil {
+		retry += ", or with spool=true"
+	}
+	di.metrics.ManualIngestGated.WithLabelValues(gateRejected).Inc()
+	di.log(logIngestion).WithError(err).Debug("Manual ingestion rejected before fetching, RabbitMQ is not connected")
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":    fmt.Sprintf("nothing was fetched: %v; %s", err, retry),
+		"state":    state.String(),
+		"behavior": gateRejected,
+	})
+	return nil, false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMaxInFlightIngests = 2
+
+// IngestLimitConfig bounds concurrent POST /ingest executions. The polling
+// loop is not limited.
+type IngestLimitConfig struct {
+	// MaxInFlight defaults to 2
+	MaxInFlight int `yaml:"max_in_flight"`
+	// Wait is how long an excess request waits for a free slot before it is
+	// rejected with 429; 0 rejects it immediately
+	Wait Duration `yaml:"wait"`
+}
+
+func (c IngestLimitConfig) Validate() error {
+	if c.MaxInFlight < 0 {
+		return fmt.Errorf("ingest_limit.max_in_flight must not be negative")
+	}
+	if c.Wait < 0 {
+		return fmt.Errorf("ingest_limit.wait must not be negative")
+	}
+	return nil
+}
+
+// IngestLimitStats is the manual ingestion section of GET /stats
+type IngestLimitStats struct {
+	MaxInFlight int   `json:"max_in_flight"`
+	InFlight    int64 `json:"in_flight"`
+	Waiting     int64 `json:"waiting"`
+	Rejected    int64 `json:"rejected"`
+}
+
+// ingestLimiter is a semaphore for manual ingestions
+type ingestLimiter struct {
+	slots chan struct{}
+	wait  time.Duration
+
+	inFlight atomic.Int64
+	waiting  atomic.Int64
+	rejected atomic.Int64
+}
+
+func newIngestLimiter(config IngestLimitConfig) *ingestLimiter {
+	max := config.MaxInFlight
+	if max <= 0 {
+		max = defaultMaxInFlightIngests
+	}
+	return &ingestLimiter{
+		slots: make(chan struct{}, max),
+		wait:  time.Duration(config.Wait),
+	}
+}
+
+// acquire takes a slot, waiting up to the configured deadline or until the
+// request goes away
+func (l *ingestLimiter) acquire(c *gin.Context) bool {
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if l.wait <= 0 {
+		return false
+	}
+
+	l.waiting.Add(1)
+	defer l.waiting.Add(-1)
+	timer := time.NewTimer(l.wait)
+	defer timer.Stop()
+	select {
+	case l.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-c.Request.Context().Done():
+		return false
+	}
+}
+
+// Middleware runs the handler once a slot is free and answers 429 otherwise
+func (l *ingestLimiter) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.acquire(c) {
+			l.rejected.Add(1)
+			c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(l.wait)))
+			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error":         "too many concurrent ingestions, retry later",
+				"in_flight":     l.inFlight.Load(),
+				"max_in_flight": cap(l.slots),
+			})
+			return
+		}
+		l.inFlight.Add(1)
+		defer func() {
+			l.inFlight.Add(-1)
+			<-l.slots
+		}()
+		c.Next()
+	}
+}
+
+// Stats returns the current limiter counters
+func (l *ingestLimiter) Stats() IngestLimitStats {
+	return IngestLimitStats{
+		MaxInFlight: cap(l.slots),
+		InFlight:    l.inFlight.Load(),
+		Waiting:     l.waiting.Load(),
+		Rejected:    l.rejected.Load(),
+	}
+}
+
+// retryAfterSeconds rounds wait up to whole seconds, at least one
+func retryAfterSeconds(wait time.Duration) int {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return seconds
+}
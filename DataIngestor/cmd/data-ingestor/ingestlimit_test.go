@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// slowUpstream holds the first blocked requests until release is closed and
+// answers the rest immediately. It records the highest concurrency seen.
+type slowUpstream struct {
+	*httptest.Server
+	release chan struct{}
+	started chan struct{}
+
+	requests atomic.Int64
+	active   atomic.Int64
+	peak     atomic.Int64
+}
+
+func newSlowUpstream(t *testing.T, blocked int64) *slowUpstream {
+	u := &slowUpstream{release: make(chan struct{}), started: make(chan struct{}, 100)}
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		active := u.active.Add(1)
+		defer u.active.Add(-1)
+		for peak := u.peak.Load(); active > peak && !u.peak.CompareAndSwap(peak, active); peak = u.peak.Load() {
+		}
+		if u.requests.Add(1) <= blocked {
+			u.started <- struct{}{}
+			<-u.release
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`))
+	}))
+	t.Cleanup(u.Close)
+	return u
+}
+
+func newLimitedIngestor(t *testing.T, upstream *slowUpstream, limit IngestLimitConfig) (*DataIngestor, *fakeChannel) {
+	ingestor := NewDataIngestor(&Config{
+		API:         APIConfig{BaseURL: upstream.URL, Timeout: Duration(5 * time.Second)},
+		RabbitMQ:    RabbitMQConfig{QueueName: "meter-data-queue"},
+		IngestLimit: limit,
+		Logging:     LoggingConfig{Level: "error"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+func TestIngestLimit_CapHolds(t *testing.T) {
+	upstream := newSlowUpstream(t, 2)
+	ingestor, channel := newLimitedIngestor(t, upstream, IngestLimitConfig{})
+	router := setupRoutes(ingestor)
+
+	const parallel = 20
+	responses := make(chan *httptest.ResponseRecorder, parallel)
+	var wg sync.WaitGroup
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			responses <- postIngest(router, "", "")
+		}()
+	}
+
+	// Everything beyond the two slots is rejected while they are held
+	for i := 0; i < parallel-2; i++ {
+		w := <-responses
+		require.Equal(t, http.StatusTooManyRequests, w.Code)
+		assert.Equal(t, "1", w.Header().Get("Retry-After"))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		assert.EqualValues(t, 2, body["in_flight"])
+		assert.EqualValues(t, 2, body["max_in_flight"])
+	}
+	<-upstream.started
+	<-upstream.started
+
+	var stats struct {
+		Ingest IngestLimitStats `json:"ingest"`
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, IngestLimitStats{MaxInFlight: 2, InFlight: 2, Rejected: parallel - 2}, stats.Ingest)
+
+	// The polling loop is not limited
+	ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	assert.Len(t, channel.messages(), 1)
+
+	close(upstream.release)
+	wg.Wait()
+	close(responses)
+	for w := range responses {
+		assert.Equal(t, http.StatusOK, w.Code)
+	}
+	assert.EqualValues(t, 3, upstream.requests.Load())
+	assert.EqualValues(t, 3, upstream.peak.Load(), "two manual ingestions and the polling loop")
+	assert.Len(t, channel.messages(), 3)
+	assert.Equal(t, IngestLimitStats{MaxInFlight: 2, Rejected: parallel - 2}, ingestor.ingestLimit.Stats())
+}
+
+func TestIngestLimit_WaitsForSlot(t *testing.T) {
+	upstream := newSlowUpstream(t, 1)
+	ingestor, _ := newLimitedIngestor(t, upstream, IngestLimitConfig{MaxInFlight: 1, Wait: Duration(5 * time.Second)})
+	router := setupRoutes(ingestor)
+
+	first := make(chan *httptest.ResponseRecorder, 1)
+	go func() { first <- postIngest(router, "", "") }()
+	<-upstream.started
+
+	second := make(chan *httptest.ResponseRecorder, 1)
+	go func() { second <- postIngest(router, "", "") }()
+	require.Eventually(t, func() bool { return ingestor.ingestLimit.Stats().Waiting == 1 }, time.Second, 5*time.Millisecond)
+
+	close(upstream.release)
+	assert.Equal(t, http.StatusOK, (<-first).Code)
+	assert.Equal(t, http.StatusOK, (<-second).Code)
+	assert.Zero(t, ingestor.ingestLimit.Stats().Rejected)
+}
+
+func TestIngestLimit_WaitDeadline(t *testing.T) {
+	upstream := newSlowUpstream(t, 1)
+	ingestor, _ := newLimitedIngestor(t, upstream, IngestLimitConfig{MaxInFlight: 1, Wait: Duration(20 * time.Millisecond)})
+	router := setupRoutes(ingestor)
+	defer close(upstream.release)
+
+	go postIngest(router, "", "")
+	<-upstream.started
+
+	start := time.Now()
+	w := postIngest(router, "", "")
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.GreaterOrEqual(t, time.Since(start), 20*time.Millisecond)
+	assert.EqualValues(t, 1, ingestor.ingestLimit.Stats().Rejected)
+}
+
+func TestIngestLimit_RejectionIsNotCached(t *testing.T) {
+	upstream := newSlowUpstream(t, 1)
+	ingestor, _ := newLimitedIngestor(t, upstream, IngestLimitConfig{MaxInFlight: 1})
+	router := setupRoutes(ingestor)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		postIngest(router, "", "")
+	}()
+	<-upstream.started
+
+	assert.Equal(t, http.StatusTooManyRequests, postIngest(router, "job-1", "").Code)
+
+	close(upstream.release)
+	<-done
+	assert.Equal(t, http.StatusOK, postIngest(router, "job-1", "").Code, "a retry with the same key runs once a slot is free")
+}
+
+func TestIngestLimitConfig_Validate(t *testing.T) {
+	assert.NoError(t, IngestLimitConfig{}.Validate())
+	assert.Error(t, IngestLimitConfig{MaxInFlight: -1}.Validate())
+	assert.Error(t, IngestLimitConfig{Wait: Duration(-time.Second)}.Validate())
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Outcomes of a posted record
+const (
+	recordPublished = "published"
+	recordInvalid   = "invalid"
+	recordFailed    = "failed"
+	// recordDuplicate is a reading that reading dedup saw published before
+	recordDuplicate = "duplicate"
+)
+
+// RecordOutcome is what happened to one posted reading. Code is set for
+// invalid and failed records.
+type RecordOutcome struct {
+	Index      int      `json:"index"`
+	Status     string   `json:"status"`
+	Code       string   `json:"code,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	MessageIDs []string `json:"message_ids,omitempty"`
+	// QuarantineID is the invalid record's ID in the quarantine
+	QuarantineID string `json:"quarantine_id,omitempty"`
+}
+
+// RecordSummary counts the outcomes of a batch
+type RecordSummary struct {
+	Total     int `json:"total"`
+	Published int `json:"published"`
+	Invalid   int `json:"invalid"`
+	Failed    int `json:"failed"`
+	Duplicate int `json:"duplicate,omitempty"`
+}
+
+// RecordResults is the multi-status report of a batch of records, one
+// outcome per record in the order they were given
+type RecordResults struct {
+	Summary RecordSummary   `json:"summary"`
+	Records []RecordOutcome `json:"records"`
+}
+
+func newRecordResults(total int) *RecordResults {
+	return &RecordResults{Summary: RecordSummary{Total: total}, Records: make([]RecordOutcome, 0, total)}
+}
+
+// add records the outcome of the next record
+func (r *RecordResults) add(outcome RecordOutcome) {
+	switch outcome.Status {
+	case recordPublished:
+		r.Summary.Published++
+	case recordInvalid:
+		r.Summary.Invalid++
+	case recordFailed:
+		r.Summary.Failed++
+	case recordDuplicate:
+		r.Summary.Duplicate++
+	}
+	r.Records = append(r.Records, outcome)
+}
+
+// status is 200 when every record was published, now or before, and 207
+// otherwise. Batches of which no record could be attempted are answered
+// before.
+func (r *RecordResults) status() int {
+	if r.Summary.Published+r.Summary.Duplicate == r.Summary.Total {
+		return http.StatusOK
+	}
+	return http.StatusMultiStatus
+}
+
+// postedRecords returns the readings of a POST /ingest body that is a JSON
+// array. Any other body, including none, is not records and ok is false;
+// such requests fetch from the upstream as before.
+func postedRecords(c *gin.Context, limit int64) (records []json.RawMessage, ok bool, err error) {
+	if c.Request.Body == nil {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, limit+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read request body: %w", err)
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 || trimmed[0] != '[' {
+		return nil, false, nil
+	}
+	if int64(len(body)) > limit {
+		return nil, true, fmt.Errorf("request body exceeds %d bytes", limit)
+	}
+	if err := json.Unmarshal(trimmed, &records); err != nil {
+		return nil, true, fmt.Errorf("request body is not a JSON array of readings: %w", err)
+	}
+	return records, true, nil
+}
+
+// checkRecord decodes one posted record and returns the code and reason it
+// is malformed for, or an empty code. Its values are checked by validation
+// with the other stages.
+func checkRecord(raw json.RawMessage) (SensorData, string, string) {
+	var reading SensorData
+	if err := json.Unmarshal(raw, &reading); err != nil {
+		return reading, "malformed", err.Error()
+	}
+	switch {
+	case reading.Type == "":
+		return reading, "missing_type", "type is required"
+	case reading.Name == "":
+		return reading, "missing_name", "name is required"
+	case len(reading.Payload) == 0:
+		return reading, "missing_payload", "payload is required"
+	}
+	return reading, "", ""
+}
+
+// deliverRecord runs one posted or reprocessed reading through the stages
+// and sinks polled readings go through: sentinels, interceptors, transforms,
+// validation and quality, then dedup and the delivery policy. A reading the
+// stages drop is invalid, with the reason validation gave.
+func (di *DataIngestor) deliverRecord(ctx context.Context, reading SensorData, raw json.RawMessage, env Envelope) RecordOutcome {
+	drops := validationDropsOf(ctx)
+	if drops == nil {
+		drops = &validationDrops{}
+		ctx = withValidationDrops(ctx, drops)
+	}
+	drops.reasons, drops.held = nil, nil
+	if di.quarantine != nil {
+		reading.Raw = raw
+	}
+	data := di.shapeReadings(ctx, reading.Location(), WeatherData{reading}, fetchSignals{})
+	if len(data) == 0 {
+		outcome := RecordOutcome{Status: recordInvalid, Code: "filtered", Error: "dropped by a transform or an interceptor"}
+		if len(drops.reasons) > 0 {
+			outcome.Code, outcome.Error = "out_of_range", drops.reasons[0]
+		}
+		if len(drops.held) > 0 {
+			outcome.QuarantineID = drops.held[0].ID
+		}
+		return outcome
+	}
+
+	var claim *dedupClaim
+	if di.dedup != nil {
+		unique, claimed, err := di.dedup.claim(ctx, data, nil)
+		if err != nil {
+			return RecordOutcome{Status: recordFailed, Code: "dedup_unavailable", Error: err.Error()}
+		}
+		if len(unique) == 0 {
+			return RecordOutcome{Status: recordDuplicate}
+		}
+		data, claim = unique, claimed
+	}
+	// Passthrough publishes the record as it was posted
+	fetched := &fetchResult{Data: &data, Body: append(append([]byte{'['}, raw...), ']')}
+	// In line behind the fetches of the location in flight
+	ticket := di.ordering.ticket(reading.Location())
+	if err := di.enterOrder(ctx, ticket); err != nil {
+		di.dedup.release(claim)
+		return RecordOutcome{Status: recordFailed, Code: "publish_failed", Error: err.Error()}
+	}
+	delivered, err := di.deliver(ctx, fetched, env, nil)
+	ticket.leave()
+	if err != nil {
+		// Nothing retries a record but its sender, so nothing stays claimed
+		di.dedup.release(claim)
+		return RecordOutcome{Status: recordFailed, Code: publishErrorCode(err), Error: err.Error(), MessageIDs: delivered.messageIDs}
+	}
+	di.dedup.commit(claim)
+	trigger := triggerOf(ctx)
+	di.metrics.ReadingsPublished.WithLabelValues("", trigger).Inc()
+	di.stream.Broadcast(env.CorrelationID, trigger, data)
+	return RecordOutcome{Status: recordPublished, MessageIDs: delivered.messageIDs}
+}
+
+// quarantineRecord holds a malformed record as it was posted and returns its
+// ID in the quarantine
+func (di *DataIngestor) quarantineRecord(reading SensorData, raw json.RawMessage, code, reason string) string {
+	held := di.quarantine.hold([]QuarantinedReading{{
+		Location: reading.Location(),
+		Trigger:  triggerWebhook,
+		Code:     code,
+		Reason:   reason,
+		Raw:      string(raw),
+	}})
+	if len(held) == 0 {
+		return ""
+	}
+	return held[0].ID
+}
+
+// publishErrorCode classifies a failed publish for the record outcome
+func publishErrorCode(err error) string {
+	switch {
+	case errors.Is(err, ErrNotConnected):
+		return "not_connected"
+	case errors.Is(err, ErrBrokerThrottled):
+		return "broker_throttled"
+	case errors.Is(err, errMessageTooLarge):
+		return "message_too_large"
+	case errors.Is(err, ErrPublishNacked):
+		return "nacked"
+	case errors.Is(err, ErrPublishReturned):
+		return "returned"
+	case errors.Is(err, ErrConfirmTimeout), errors.Is(err, ErrConfirmsClosed):
+		return "unconfirmed"
+	}
+	return "publish_failed"
+}
+
+// ingestRecords delivers posted readings one at a time, so each gets its own
+// outcome. Posting readings requires the admin token.
+func (di *DataIngestor) ingestRecords(c *gin.Context, records []json.RawMessage) {
+	if requireAdmin(di.config.Admin)(c); c.IsAborted() {
+		return
+	}
+	if len(records) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "the request body has no readings",
+		})
+		return
+	}
+	if di.ConnectionState() != StateReady {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "RabbitMQ is not connected, no reading was published; retry once the connection is ready",
+			"state": di.ConnectionState().String(),
+		})
+		return
+	}
+
+	ctx := di.withFeatures(withTrigger(c.Request.Context(), triggerWebhook))
+	env := Envelope{CorrelationID: newMessageID(), Trigger: triggerWebhook}
+	outcomes := make([]RecordOutcome, len(records))
+	attempted := 0
+	for i, raw := range records {
+		reading, code, reason := checkRecord(raw)
+		if code != "" {
+			outcomes[i] = RecordOutcome{Status: recordInvalid, Code: code, Error: reason,
+				QuarantineID: di.quarantineRecord(reading, raw, code, reason)}
+		} else {
+			outcomes[i] = di.deliverRecord(ctx, reading, raw, env)
+		}
+		outcomes[i].Index = i
+		if outcomes[i].Status != recordInvalid {
+			attempted++
+		}
+	}
+	results := newRecordResults(len(records))
+	for _, outcome := range outcomes {
+		results.add(outcome)
+	}
+	if attempted == 0 {
+		c.JSON(http.StatusBadRequest, results)
+		return
+	}
+
+	di.logger.WithFields(logrus.Fields{
+		"correlation_id": env.CorrelationID,
+		"trigger":        triggerWebhook,
+		"total":          results.Summary.Total,
+		"published":      results.Summary.Published,
+		"invalid":        results.Summary.Invalid,
+		"failed":         results.Summary.Failed,
+		"duplicate":      results.Summary.Duplicate,
+	}).Info("Posted readings ingested")
+	c.JSON(results.status(), results)
+}
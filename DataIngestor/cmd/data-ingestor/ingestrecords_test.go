@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newRecordsIngestor publishes posted readings to a fake channel. Readings
+// must keep energy between 0 and 100, and messages under 512 bytes.
+func newRecordsIngestor(t *testing.T) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API:        APIConfig{Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Admin:      AdminConfig{Token: "letmein"},
+		Validation: ValidationConfig{Bounds: map[string]Bounds{"energy": {Min: bound(0), Max: bound(100)}}},
+		Publishing: PublishingConfig{MaxMessageSize: 512},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+	return ingestor, channel
+}
+
+func meterReading(i int) string {
+	return fmt.Sprintf(`{"type":"energy","name":"meter-%d","payload":{"energy":%d}}`, i, i)
+}
+
+// postReadings posts body to /ingest with the admin token
+func postReadings(router http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/ingest", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer letmein")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func postRecords(t *testing.T, router http.Handler, records []string) (int, RecordResults) {
+	t.Helper()
+	w := postReadings(router, "["+strings.Join(records, ",")+"]")
+	var results RecordResults
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &results), w.Body.String())
+	return w.Code, results
+}
+
+func TestIngestRecords_MixedBatch(t *testing.T) {
+	ingestor, channel := newRecordsIngestor(t)
+	router := setupRoutes(ingestor)
+
+	records := make([]string, 20)
+	for i := range records {
+		records[i] = meterReading(i)
+	}
+	records[3] = `{"name":"meter-3","payload":{"energy":3}}`
+	records[7] = `{"type":"energy","name":"meter-7","payload":{"energy":700}}`
+	records[11] = `"meter-11"`
+	huge := strings.Repeat("x", 600)
+	records[14] = fmt.Sprintf(`{"type":"energy","name":"meter-14","payload":{"energy":14,"note":%q}}`, huge)
+	records[18] = fmt.Sprintf(`{"type":"energy","name":"meter-18","payload":{"energy":18,"note":%q}}`, huge)
+
+	code, results := postRecords(t, router, records)
+	assert.Equal(t, http.StatusMultiStatus, code)
+	assert.Equal(t, RecordSummary{Total: 20, Published: 15, Invalid: 3, Failed: 2}, results.Summary)
+	require.Len(t, results.Records, 20)
+	for i, record := range results.Records {
+		assert.Equal(t, i, record.Index)
+	}
+
+	expected := map[int]RecordOutcome{
+		3:  {Status: recordInvalid, Code: "missing_type", Error: "type is required"},
+		7:  {Status: recordInvalid, Code: "out_of_range", Error: "energy 700 is out of range"},
+		11: {Status: recordInvalid, Code: "malformed"},
+		14: {Status: recordFailed, Code: "message_too_large"},
+		18: {Status: recordFailed, Code: "message_too_large"},
+	}
+	for i, record := range results.Records {
+		want, ok := expected[i]
+		if !ok {
+			assert.Equal(t, recordPublished, record.Status, i)
+			assert.Len(t, record.MessageIDs, 1, i)
+			assert.Empty(t, record.Code, i)
+			continue
+		}
+		assert.Equal(t, want.Status, record.Status, i)
+		assert.Equal(t, want.Code, record.Code, i)
+		if want.Error != "" {
+			assert.Equal(t, want.Error, record.Error, i)
+		}
+		assert.NotEmpty(t, record.Error, i)
+		assert.Empty(t, record.MessageIDs, i)
+	}
+
+	// One message per published reading, in order
+	messages := channel.messages()
+	require.Len(t, messages, 15)
+	var first WeatherData
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &first))
+	assert.Equal(t, "meter-0", first[0].Name)
+	assert.Equal(t, messages[0].Msg.CorrelationId, messages[14].Msg.CorrelationId, "a batch shares its correlation id")
+	assert.Equal(t, results.Records[0].MessageIDs[0], messages[0].Msg.MessageId)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ValidationFailures.WithLabelValues("energy", boundsGlobal)))
+}
+
+func TestIngestRecords_AllPublished(t *testing.T) {
+	ingestor, channel := newRecordsIngestor(t)
+	code, results := postRecords(t, setupRoutes(ingestor), []string{meterReading(1), meterReading(2)})
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, RecordSummary{Total: 2, Published: 2}, results.Summary)
+	assert.Len(t, channel.messages(), 2)
+}
+
+func TestIngestRecords_PublishFailures(t *testing.T) {
+	ingestor, channel := newRecordsIngestor(t)
+	channel.mu.Lock()
+	channel.err = errors.New("channel closed")
+	channel.mu.Unlock()
+
+	// Publishing was attempted for every record, so the outcome is per record
+	code, results := postRecords(t, setupRoutes(ingestor), []string{meterReading(1), `{"type":"energy","name":"meter-2"}`})
+	assert.Equal(t, http.StatusMultiStatus, code)
+	assert.Equal(t, RecordSummary{Total: 2, Invalid: 1, Failed: 1}, results.Summary)
+	assert.Equal(t, "publish_failed", results.Records[0].Code)
+	assert.Contains(t, results.Records[0].Error, "channel closed")
+	assert.Equal(t, "missing_payload", results.Records[1].Code)
+}
+
+func TestIngestRecords_NothingAttempted(t *testing.T) {
+	ingestor, channel := newRecordsIngestor(t)
+	router := setupRoutes(ingestor)
+
+	code, results := postRecords(t, router, []string{`{"type":"energy","payload":{"energy":1}}`, `{"type":"energy","name":"meter-2","payload":{"energy":-5}}`})
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, RecordSummary{Total: 2, Invalid: 2}, results.Summary)
+	assert.Equal(t, "missing_name", results.Records[0].Code)
+	assert.Equal(t, "out_of_range", results.Records[1].Code)
+
+	for body, message := range map[string]string{
+		`[]`:          "the request body has no readings",
+		`[{"type":1}`: "request body is not a JSON array of readings",
+	} {
+		w := postReadings(router, body)
+		assert.Equal(t, http.StatusBadRequest, w.Code, body)
+		assert.Contains(t, w.Body.String(), message, body)
+	}
+	assert.Empty(t, channel.messages())
+
+	disconnected := NewDataIngestor(&Config{Logging: LoggingConfig{Level: "panic"}, Admin: AdminConfig{Token: "letmein"}})
+	w := postReadings(setupRoutes(disconnected), "["+meterReading(1)+"]")
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "no reading was published")
+}
+
+func TestIngestRecords_RequireTheAdminToken(t *testing.T) {
+	ingestor, channel := newRecordsIngestor(t)
+	router := setupRoutes(ingestor)
+	body := "[" + meterReading(1) + "]"
+
+	w := postIngest(router, "", body)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	ingestor.config.Admin.Token = ""
+	w = postReadings(setupRoutes(ingestor), body)
+	assert.Equal(t, http.StatusForbidden, w.Code, "no token configured, no posted readings")
+	assert.Empty(t, channel.messages())
+}
+
+func TestIngestRecords_GoThroughTheStagesAndSinks(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		API:          APIConfig{Timeout: Duration(time.Second)},
+		RabbitMQ:     RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:      LoggingConfig{Level: "panic"},
+		Admin:        AdminConfig{Token: "letmein"},
+		Transforms:   []TransformConfig{{Filter: "energy >= 0"}, {Assign: "energy = energy * 2"}},
+		ReadingDedup: ReadingDedupConfig{Enabled: true},
+		Validation:   ValidationConfig{Bounds: map[string]Bounds{"energy": {Min: bound(0), Max: bound(100)}}},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+	router := setupRoutes(ingestor)
+
+	code, results := postRecords(t, router, []string{
+		meterReading(10),
+		`{"type":"energy","name":"meter-2","payload":{"energy":-5}}`,
+		`{"type":"energy","name":"meter-3","payload":{"energy":60}}`,
+		meterReading(10),
+	})
+	assert.Equal(t, http.StatusMultiStatus, code)
+	assert.Equal(t, RecordSummary{Total: 4, Published: 1, Invalid: 2, Duplicate: 1}, results.Summary)
+	assert.Equal(t, "filtered", results.Records[1].Code)
+	assert.Equal(t, "out_of_range", results.Records[2].Code, "validated after the transforms")
+	assert.Equal(t, "energy 120 is out of range", results.Records[2].Error)
+	assert.Equal(t, recordDuplicate, results.Records[3].Status)
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	var published WeatherData
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &published))
+	assert.Equal(t, 20.0, published[0].Payload["energy"])
+}
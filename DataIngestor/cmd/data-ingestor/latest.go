@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultLatestFreshness       = 5 * time.Minute
+	defaultLatestRefreshInterval = 10 * time.Second
+
+	latestResultOK          = "ok"
+	latestResultNotModified = "not_modified"
+	latestResultNotFound    = "not_found"
+	latestResultStale       = "stale"
+)
+
+// LatestConfig configures GET /weather/latest, which serves the newest
+// reading per location to internal clients instead of the upstream
+type LatestConfig struct {
+	// Freshness is how old a reading may be before it is answered with 503,
+	// 5m by default
+	Freshness Duration `yaml:"freshness"`
+	// RefreshInterval is the minimum time between upstream fetches forced
+	// with ?refresh=true, 10s by default
+	RefreshInterval Duration `yaml:"refresh_interval"`
+}
+
+func (c LatestConfig) Validate() error {
+	if c.Freshness < 0 || c.RefreshInterval < 0 {
+		return fmt.Errorf("latest.freshness and latest.refresh_interval must not be negative")
+	}
+	return nil
+}
+
+func (c LatestConfig) freshness() time.Duration {
+	if c.Freshness > 0 {
+		return time.Duration(c.Freshness)
+	}
+	return defaultLatestFreshness
+}
+
+func (c LatestConfig) refreshInterval() time.Duration {
+	if c.RefreshInterval > 0 {
+		return time.Duration(c.RefreshInterval)
+	}
+	return defaultLatestRefreshInterval
+}
+
+// latestReading is the newest reading of one location, encoded once
+type latestReading struct {
+	location string
+	// source is the polled location the reading came from
+	source     string
+	body       []byte
+	receivedAt time.Time
+}
+
+// latestCache keeps the newest validated reading per location
+type latestCache struct {
+	refreshInterval time.Duration
+
+	mu       sync.RWMutex
+	readings map[string]latestReading
+	// forgotten are the sources no longer polled, whose readings are not
+	// cached
+	forgotten map[string]bool
+	// refreshed is when the last forced fetch started
+	refreshed time.Time
+}
+
+func newLatestCache(config LatestConfig) *latestCache {
+	return &latestCache{
+		refreshInterval: config.refreshInterval(),
+		readings:        make(map[string]latestReading),
+	}
+}
+
+// update replaces the cached reading of every location in data, fetched
+// from source
+func (c *latestCache) update(source string, data WeatherData, at time.Time) {
+	encoded := make([]latestReading, 0, len(data))
+	for _, reading := range data {
+		body, err := json.Marshal(reading)
+		if err != nil {
+			continue
+		}
+		encoded = append(encoded, latestReading{location: reading.Location(), source: source, body: body, receivedAt: at})
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.forgotten[source] {
+		return
+	}
+	for _, reading := range encoded {
+		c.readings[reading.location] = reading
+	}
+}
+
+// forget drops the readings fetched from source, once it is no longer
+// polled, and the ones it still delivers until track
+func (c *latestCache) forget(source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for location, reading := range c.readings {
+		if reading.source == source {
+			delete(c.readings, location)
+		}
+	}
+	if c.forgotten == nil {
+		c.forgotten = make(map[string]bool)
+	}
+	c.forgotten[source] = true
+}
+
+// track caches the readings of source again once it is polled again
+func (c *latestCache) track(source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.forgotten, source)
+}
+
+func (c *latestCache) get(location string) (latestReading, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	reading, ok := c.readings[location]
+	return reading, ok
+}
+
+// fresh returns the readings received after since, by location
+func (c *latestCache) fresh(since time.Time) []latestReading {
+	c.mu.RLock()
+	readings := make([]latestReading, 0, len(c.readings))
+	for _, reading := range c.readings {
+		if reading.receivedAt.After(since) {
+			readings = append(readings, reading)
+		}
+	}
+	c.mu.RUnlock()
+	sort.Slice(readings, func(i, j int) bool { return readings[i].location < readings[j].location })
+	return readings
+}
+
+// allowRefresh takes the refresh slot, or returns how long until it is free
+func (c *latestCache) allowRefresh(now time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if wait := c.refreshed.Add(c.refreshInterval).Sub(now); !c.refreshed.IsZero() && wait > 0 {
+		return wait, false
+	}
+	c.refreshed = now
+	return 0, true
+}
+
+// handleLatest serves GET /weather/latest, the fresh readings of every
+// location, and GET /weather/latest/{location}. Responses carry an ETag over
+// the body, the Age of the oldest reading in it and the freshness threshold as
+// max-age, so HTTP caches keep them no longer than they are served here.
+func (di *DataIngestor) handleLatest(c *gin.Context) {
+	if refresh, _ := strconv.ParseBool(c.Query("refresh")); refresh && !di.refreshLatest(c) {
+		return
+	}
+
+	location := c.Param("location")
+	freshness := di.config.Latest.freshness()
+	di.markGap(c)
+	expectedGap := di.markMaintenance(c)
+	now := time.Now()
+	retryAfter := strconv.Itoa(retryAfterSeconds(di.config.API.pollInterval()))
+	di.scheduleLag(c, location, now)
+
+	var body []byte
+	var oldest time.Time
+	if location != "" {
+		if di.shard.misdirected(c, location) {
+			return
+		}
+		reading, ok := di.latest.get(location)
+		if !ok {
+			di.metrics.LatestRequests.WithLabelValues(latestResultNotFound).Inc()
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": fmt.Sprintf("no readings for location %q", location),
+			})
+			return
+		}
+		if age := now.Sub(reading.receivedAt); age > freshness {
+			di.metrics.LatestRequests.WithLabelValues(latestResultStale).Inc()
+			c.Header("Retry-After", retryAfter)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error":        fmt.Sprintf("the latest reading for %s is %s old, older than %s", location, age.Truncate(time.Second), freshness),
+				"received_at":  reading.receivedAt,
+				"expected_gap": expectedGap,
+			})
+			return
+		}
+		body, oldest = reading.body, reading.receivedAt
+	} else {
+		readings := di.latest.fresh(now.Add(-freshness))
+		if len(readings) == 0 {
+			di.metrics.LatestRequests.WithLabelValues(latestResultStale).Inc()
+			c.Header("Retry-After", retryAfter)
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error":        fmt.Sprintf("no reading is newer than %s", freshness),
+				"expected_gap": expectedGap,
+			})
+			return
+		}
+		items := make([]json.RawMessage, len(readings))
+		oldest = now
+		for i, reading := range readings {
+			items[i] = reading.body
+			if reading.receivedAt.Before(oldest) {
+				oldest = reading.receivedAt
+			}
+		}
+		body, _ = json.Marshal(items)
+	}
+
+	sum := fingerprint(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	age := now.Sub(oldest)
+	c.Header("ETag", etag)
+	c.Header("Age", strconv.Itoa(int(age/time.Second)))
+	c.Header("Cache-Control", fmt.Sprintf("public, max-age=%d", int(freshness/time.Second)))
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		di.metrics.LatestRequests.WithLabelValues(latestResultNotModified).Inc()
+		c.Status(http.StatusNotModified)
+		return
+	}
+	di.metrics.LatestRequests.WithLabelValues(latestResultOK).Inc()
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// refreshLatest runs an ingestion cycle for ?refresh=true. It requires the
+// admin token and runs at most once per refresh interval; the response is
+// written and false returned when the request may not refresh.
+func (di *DataIngestor) refreshLatest(c *gin.Context) bool {
+	requireAdmin(di.config.Admin)(c)
+	if c.IsAborted() {
+		return false
+	}
+	if wait, ok := di.latest.allowRefresh(time.Now()); !ok {
+		c.Header("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": "refreshed recently, retry later",
+		})
+		return false
+	}
+
+	// A forced fetch is a manual one, for the rate limit and the counters
+	ctx := withUpstreamClass(withTrigger(c.Request.Context(), triggerManual), upstreamManual)
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	if _, err := di.ingest(ctx); err != nil && !errors.Is(err, ErrNoData) {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": fmt.Sprintf("refresh failed: %v", err),
+		})
+		return false
+	}
+	return true
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, compared
+// weakly as RFC 9110 requires for If-None-Match
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func getLatest(router http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestLatest_ServesWithCacheHeaders(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+	reading := weatherReading("moscow", map[string]interface{}{"temperature": -3.5})
+	ingestor.latest.update(defaultSourceName, WeatherData{reading}, time.Now().Add(-90*time.Second))
+
+	w := getLatest(router, "/weather/latest/moscow", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var got SensorData
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &got))
+	assert.Equal(t, "moscow", got.Name)
+	assert.Equal(t, -3.5, got.Payload["temperature"])
+	assert.Regexp(t, `^"[0-9a-f]{32}"$`, w.Header().Get("ETag"))
+	assert.Equal(t, "90", w.Header().Get("Age"))
+	assert.Equal(t, "public, max-age=300", w.Header().Get("Cache-Control"))
+
+	// A new cycle with the same reading keeps the ETag
+	etag := w.Header().Get("ETag")
+	ingestor.latest.update(defaultSourceName, WeatherData{reading}, time.Now())
+	w = getLatest(router, "/weather/latest/moscow", nil)
+	assert.Equal(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, "0", w.Header().Get("Age"))
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.LatestRequests.WithLabelValues(latestResultOK)))
+}
+
+func TestLatest_AllLocations(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+	now := time.Now()
+	ingestor.latest.update(defaultSourceName, WeatherData{weatherReading("paris", map[string]interface{}{"temperature": 7.5})}, now.Add(-time.Minute))
+	ingestor.latest.update(defaultSourceName, WeatherData{weatherReading("berlin", map[string]interface{}{"temperature": 4.0})}, now)
+	ingestor.latest.update(defaultSourceName, WeatherData{weatherReading("oslo", map[string]interface{}{"temperature": -8.0})}, now.Add(-time.Hour))
+
+	w := getLatest(router, "/weather/latest", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var data WeatherData
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &data))
+	require.Len(t, data, 2, "stale locations are left out")
+	assert.Equal(t, "berlin", data[0].Name)
+	assert.Equal(t, "paris", data[1].Name)
+	assert.Equal(t, "60", w.Header().Get("Age"), "the age of the oldest reading")
+	assert.Equal(t, "public, max-age=300", w.Header().Get("Cache-Control"))
+}
+
+func TestLatest_IfNoneMatch(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+	ingestor.latest.update(defaultSourceName, WeatherData{weatherReading("moscow", map[string]interface{}{"temperature": -3.5})}, time.Now())
+
+	for _, path := range []string{"/weather/latest/moscow", "/weather/latest"} {
+		etag := getLatest(router, path, nil).Header().Get("ETag")
+		require.NotEmpty(t, etag)
+
+		for _, header := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+			w := getLatest(router, path, http.Header{"If-None-Match": {header}})
+			assert.Equal(t, http.StatusNotModified, w.Code, "%s: %s", path, header)
+			assert.Empty(t, w.Body.String())
+			assert.Equal(t, etag, w.Header().Get("ETag"))
+			assert.NotEmpty(t, w.Header().Get("Cache-Control"))
+			assert.NotEmpty(t, w.Header().Get("Age"))
+		}
+		w := getLatest(router, path, http.Header{"If-None-Match": {`"other"`}})
+		assert.Equal(t, http.StatusOK, w.Code, path)
+	}
+
+	// The reading changed, so the client's copy is outdated
+	etag := getLatest(router, "/weather/latest/moscow", nil).Header().Get("ETag")
+	ingestor.latest.update(defaultSourceName, WeatherData{weatherReading("moscow", map[string]interface{}{"temperature": -2.0})}, time.Now())
+	w := getLatest(router, "/weather/latest/moscow", http.Header{"If-None-Match": {etag}})
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotEqual(t, etag, w.Header().Get("ETag"))
+	assert.Equal(t, 8.0, testutil.ToFloat64(ingestor.metrics.LatestRequests.WithLabelValues(latestResultNotModified)))
+}
+
+func TestLatest_UnknownAndStale(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+
+	w := getLatest(router, "/weather/latest", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "nothing fetched yet")
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+
+	w = getLatest(router, "/weather/latest/moscow", nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Contains(t, w.Body.String(), `no readings for location \"moscow\"`)
+
+	ingestor.latest.update(defaultSourceName, WeatherData{weatherReading("moscow", map[string]interface{}{"temperature": -3.5})}, time.Now().Add(-6*time.Minute))
+	w = getLatest(router, "/weather/latest/moscow", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, "5", w.Header().Get("Retry-After"))
+	assert.Contains(t, w.Body.String(), "older than 5m0s")
+	assert.Empty(t, w.Header().Get("ETag"))
+
+	w = getLatest(router, "/weather/latest", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.LatestRequests.WithLabelValues(latestResultNotFound)))
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.LatestRequests.WithLabelValues(latestResultStale)))
+}
+
+func TestLatest_Refresh(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	ingestor.config.Latest.RefreshInterval = Duration(time.Minute)
+	ingestor.latest = newLatestCache(ingestor.config.Latest)
+	router := setupRoutes(ingestor)
+
+	w := getLatest(router, "/weather/latest/meter-1?refresh=true", nil)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	assert.Empty(t, channel.messages(), "refreshing requires the admin token")
+
+	admin := http.Header{"Authorization": {"Bearer letmein"}}
+	w = getLatest(router, "/weather/latest/meter-1?refresh=true", admin)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"name":"meter-1"`)
+	assert.Len(t, channel.messages(), 1, "a refresh is an ingestion cycle")
+
+	w = getLatest(router, "/weather/latest/meter-1?refresh=true", admin)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	retryAfter := w.Header().Get("Retry-After")
+	assert.Contains(t, []string{"59", "60"}, retryAfter)
+	assert.Len(t, channel.messages(), 1)
+
+	// Without refresh the cached reading is served as usual
+	w = getLatest(router, "/weather/latest/meter-1", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestLatest_CachesValidatedReadings(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.config.Validation = ValidationConfig{
+		Action: validationDrop,
+		Bounds: map[string]Bounds{"energy": {Max: bound(0)}},
+	}
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	_, ok := ingestor.latest.get("meter-1")
+	assert.False(t, ok, "dropped readings are not served")
+}
+
+func TestLatest_IgnoresForgottenSources(t *testing.T) {
+	cache := newLatestCache(LatestConfig{})
+	reading := weatherReading("moscow", map[string]interface{}{"temperature": -3.5})
+	cache.update("east", WeatherData{reading}, time.Now())
+	cache.forget("east")
+	_, ok := cache.get("moscow")
+	assert.False(t, ok)
+
+	cache.update("east", WeatherData{reading}, time.Now())
+	_, ok = cache.get("moscow")
+	assert.False(t, ok, "a cycle that finishes after the source stopped is not cached")
+
+	cache.track("east")
+	cache.update("east", WeatherData{reading}, time.Now())
+	_, ok = cache.get("moscow")
+	assert.True(t, ok)
+}
+
+func TestEtagMatches(t *testing.T) {
+	assert.False(t, etagMatches("", `"a"`))
+	assert.True(t, etagMatches(`"a"`, `"a"`))
+	assert.True(t, etagMatches(`W/"a"`, `"a"`))
+	assert.True(t, etagMatches(`"b" , "a"`, `"a"`))
+	assert.True(t, etagMatches(`*`, `"a"`))
+	assert.False(t, etagMatches(`"b"`, `"a"`))
+	assert.False(t, etagMatches(`a`, `"a"`))
+}
+
+func TestLatestConfig_Validate(t *testing.T) {
+	assert.NoError(t, LatestConfig{}.Validate())
+	assert.NoError(t, LatestConfig{Freshness: Duration(time.Minute), RefreshInterval: Duration(time.Second)}.Validate())
+	assert.ErrorContains(t, LatestConfig{Freshness: -1}.Validate(), "must not be negative")
+}
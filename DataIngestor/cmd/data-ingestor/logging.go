@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// logComponent names a part of the service whose log level can be set
+// apart from logging.level
+type logComponent string
+
+const (
+	// logIngestion is the polling loop and the outcome of every cycle
+	logIngestion logComponent = "ingestion"
+	// logFetch is the upstream requests, their retries and breakers
+	logFetch logComponent = "fetch"
+	// logPublish is publishing to RabbitMQ
+	logPublish logComponent = "publish"
+	// logHTTP is the access log of the HTTP server
+	logHTTP logComponent = "http"
+	// logReconnect is connecting, reconnecting and failing over to brokers
+	logReconnect logComponent = "reconnect"
+	// logSpool is rabbitmq.spool: spooling, draining and compacting it
+	logSpool logComponent = "spool"
+)
+
+var logComponents = []logComponent{logIngestion, logFetch, logPublish, logHTTP, logReconnect, logSpool}
+
+// inheritLevel drops a component's own level, so it follows logging.level
+const inheritLevel = "inherit"
+
+// validateLogLevels checks the components and levels of logging.levels
+func validateLogLevels(levels map[string]string) error {
+	for component, level := range levels {
+		if !knownLogComponent(component) {
+			return fmt.Errorf("logging.levels: unknown component %q, use one of %v", component, logComponents)
+		}
+		if _, err := logrus.ParseLevel(level); err != nil {
+			return fmt.Errorf("logging.levels.%s: %w", component, err)
+		}
+	}
+	return nil
+}
+
+func knownLogComponent(name string) bool {
+	for _, component := range logComponents {
+		if string(component) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// logLevels hands out the loggers of the components. A component without a
+// level of its own logs through the root logger; one with a level gets a
+// logger of its own that writes, formats and hooks like the root.
+type logLevels struct {
+	// root returns the service's logger, which tests may replace
+	root func() *logrus.Logger
+
+	mu      sync.Mutex
+	loggers map[logComponent]*logrus.Logger
+}
+
+func newLogLevels(root func() *logrus.Logger, levels map[string]string) *logLevels {
+	l := &logLevels{root: root, loggers: make(map[logComponent]*logrus.Logger)}
+	for component, level := range levels {
+		// Checked with the config; invalid entries are ignored like an
+		// invalid logging.level
+		if parsed, err := logrus.ParseLevel(level); err == nil && knownLogComponent(component) {
+			l.loggers[logComponent(component)] = l.componentLogger(parsed)
+		}
+	}
+	return l
+}
+
+// componentLogger returns a logger at level that writes, formats and hooks
+// like the root does at the time of every entry
+func (l *logLevels) componentLogger(level logrus.Level) *logrus.Logger {
+	logger := &logrus.Logger{
+		Out:       rootOutput{l.root},
+		Formatter: rootFormatter{l.root},
+		Hooks:     make(logrus.LevelHooks),
+		Level:     level,
+		ExitFunc:  os.Exit,
+	}
+	logger.AddHook(rootHooks{l.root})
+	return logger
+}
+
+// logger returns the logger of component, with a component field
+func (l *logLevels) logger(component logComponent) *logrus.Entry {
+	l.mu.Lock()
+	logger, ok := l.loggers[component]
+	l.mu.Unlock()
+	if !ok {
+		logger = l.root()
+	}
+	return logger.WithField("component", string(component))
+}
+
+// set changes the level of component, or of the root logger when it is
+// empty. inheritLevel makes the component follow the root again.
+func (l *logLevels) set(component, level string) error {
+	if component != "" && !knownLogComponent(component) {
+		return fmt.Errorf("unknown component %q, use one of %v", component, logComponents)
+	}
+	if component != "" && level == inheritLevel {
+		l.mu.Lock()
+		delete(l.loggers, logComponent(component))
+		l.mu.Unlock()
+		return nil
+	}
+	parsed, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	if component == "" {
+		l.root().SetLevel(parsed)
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if logger, ok := l.loggers[logComponent(component)]; ok {
+		logger.SetLevel(parsed)
+	} else {
+		l.loggers[logComponent(component)] = l.componentLogger(parsed)
+	}
+	return nil
+}
+
+// apply replaces every level with those of a reloaded config. Levels set
+// through the admin API are dropped.
+func (l *logLevels) apply(config LoggingConfig) {
+	if level, err := logrus.ParseLevel(config.Level); err == nil {
+		l.root().SetLevel(level)
+	}
+	next := newLogLevels(l.root, config.Levels)
+	l.mu.Lock()
+	l.loggers = next.loggers
+	l.mu.Unlock()
+}
+
+// LogLevels is the body of GET /admin/log-levels
+type LogLevels struct {
+	Level string `json:"level"`
+	// Levels is the effective level of every component
+	Levels map[string]string `json:"levels"`
+	// Overrides are the components with a level of their own
+	Overrides []string `json:"overrides"`
+}
+
+func (l *logLevels) snapshot() LogLevels {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	root := l.root().GetLevel().String()
+	levels := LogLevels{Level: root, Levels: make(map[string]string), Overrides: []string{}}
+	for _, component := range logComponents {
+		levels.Levels[string(component)] = root
+		if logger, ok := l.loggers[component]; ok {
+			levels.Levels[string(component)] = logger.GetLevel().String()
+			levels.Overrides = append(levels.Overrides, string(component))
+		}
+	}
+	sort.Strings(levels.Overrides)
+	return levels
+}
+
+// rootOutput writes where the root logger writes at the time
+type rootOutput struct{ root func() *logrus.Logger }
+
+func (o rootOutput) Write(p []byte) (int, error) {
+	return o.root().Out.Write(p)
+}
+
+// rootFormatter formats like the root logger does at the time
+type rootFormatter struct{ root func() *logrus.Logger }
+
+func (f rootFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	return f.root().Formatter.Format(entry)
+}
+
+// rootHooks fires the hooks of the root logger at the time
+type rootHooks struct{ root func() *logrus.Logger }
+
+func (h rootHooks) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h rootHooks) Fire(entry *logrus.Entry) error {
+	return h.root().Hooks.Fire(entry.Level, entry)
+}
+
+type logLevelsKey struct{}
+
+// withLogLevels makes the component loggers obtainable from ctx
+func withLogLevels(ctx context.Context, levels *logLevels) context.Context {
+	return context.WithValue(ctx, logLevelsKey{}, levels)
+}
+
+// logFor returns the logger of component from ctx, with the trigger of ctx
+// when it has one. Outside of the service's contexts it falls back to the
+// standard logger.
+func logFor(ctx context.Context, component logComponent) *logrus.Entry {
+	entry := logrus.StandardLogger().WithField("component", string(component))
+	if levels, ok := ctx.Value(logLevelsKey{}).(*logLevels); ok {
+		entry = levels.logger(component)
+	}
+	if trigger, ok := ctx.Value(triggerKey{}).(string); ok {
+		entry = entry.WithField("trigger", trigger)
+	}
+	return entry
+}
+
+// log returns the logger of component
+func (di *DataIngestor) log(component logComponent) *logrus.Entry {
+	return di.logLevels.logger(component)
+}
+
+// accessLog replaces gin's access log with one entry per request at info
+// under the http component, and makes the component loggers obtainable from
+// the request context
+func (di *DataIngestor) accessLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(withLogLevels(c.Request.Context(), di.logLevels))
+		start := time.Now()
+		c.Next()
+		di.log(logHTTP).WithFields(logrus.Fields{
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     c.Writer.Status(),
+			"latency_ms": time.Since(start).Milliseconds(),
+			"client_ip":  c.ClientIP(),
+		}).Info("HTTP request")
+	}
+}
+
+// handleLogLevels serves GET /admin/log-levels
+func (di *DataIngestor) handleLogLevels(c *gin.Context) {
+	c.JSON(http.StatusOK, di.logLevels.snapshot())
+}
+
+// handleSetLogLevel serves POST /admin/log-levels?component=&level=. Without
+// a component the root level is set.
+func (di *DataIngestor) handleSetLogLevel(c *gin.Context) {
+	component, level := c.Query("component"), c.Query("level")
+	if err := di.logLevels.set(component, level); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	di.logger.WithFields(logrus.Fields{
+		"target": component,
+		"level":  level,
+	}).Warn("Log level set by admin")
+	c.JSON(http.StatusOK, di.logLevels.snapshot())
+}
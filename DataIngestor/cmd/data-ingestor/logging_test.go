@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// debugComponents returns the components of the debug entries logged
+func debugComponents(hook *test.Hook) map[string][]string {
+	components := make(map[string][]string)
+	for _, entry := range hook.AllEntries() {
+		if entry.Level != logrus.DebugLevel {
+			continue
+		}
+		component, _ := entry.Data["component"].(string)
+		components[component] = append(components[component], entry.Message)
+	}
+	return components
+}
+
+func postLogLevel(t *testing.T, ingestor *DataIngestor, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/admin/log-levels?"+query, nil)
+	req.Header.Set("Authorization", "Bearer letmein")
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, req)
+	return w
+}
+
+func TestValidateLogLevels(t *testing.T) {
+	assert.NoError(t, validateLogLevels(nil))
+	assert.NoError(t, validateLogLevels(map[string]string{"publish": "debug", "http": "warn", "spool": "debug"}))
+
+	err := validateLogLevels(map[string]string{"archive": "debug"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `unknown component "archive"`)
+
+	err = validateLogLevels(map[string]string{"fetch": "loud"})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "logging.levels.fetch")
+}
+
+func TestLogLevels_PublishDebugWithRootInfo(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.InfoLevel)
+	ingestor.logger = logger
+	require.NoError(t, ingestor.logLevels.set("publish", "debug"))
+
+	result := ingestor.RunCycle(context.Background())
+	require.Equal(t, CycleSucceeded, result.Status)
+	require.Len(t, channel.messages(), 1)
+
+	debug := debugComponents(hook)
+	assert.Contains(t, debug[string(logPublish)], "Message published")
+	assert.NotContains(t, debug, string(logFetch), "fetch stays at the root's info")
+	assert.Len(t, debug, 1)
+}
+
+func TestLogLevels_FromConfig(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: "http://weakapp:8080"},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "info", Levels: map[string]string{"fetch": "debug", "http": "warn"}},
+	})
+
+	levels := ingestor.logLevels.snapshot()
+	assert.Equal(t, "info", levels.Level)
+	assert.Equal(t, "debug", levels.Levels["fetch"])
+	assert.Equal(t, "warning", levels.Levels["http"])
+	assert.Equal(t, "info", levels.Levels["publish"])
+	assert.Equal(t, []string{"fetch", "http"}, levels.Overrides)
+}
+
+func TestLogLevels_SetAtRuntime(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.InfoLevel)
+	ingestor.logger = logger
+
+	w := postLogLevel(t, ingestor, "component=fetch&level=debug")
+	require.Equal(t, http.StatusOK, w.Code)
+	var levels LogLevels
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &levels))
+	assert.Equal(t, "debug", levels.Levels["fetch"])
+	assert.Equal(t, []string{"fetch"}, levels.Overrides)
+
+	ingestor.RunCycle(context.Background())
+	assert.Contains(t, debugComponents(hook)[string(logFetch)], "Upstream responded")
+
+	hook.Reset()
+	w = postLogLevel(t, ingestor, "component=fetch&level=inherit")
+	require.Equal(t, http.StatusOK, w.Code)
+	ingestor.RunCycle(context.Background())
+	assert.Empty(t, debugComponents(hook))
+
+	w = postLogLevel(t, ingestor, "level=warn")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, logrus.WarnLevel, logger.GetLevel())
+}
+
+func TestLogLevels_RejectsBadChanges(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+
+	for _, query := range []string{
+		"component=archive&level=debug",
+		"component=fetch&level=loud",
+		"component=fetch",
+		"level=inherit",
+	} {
+		w := postLogLevel(t, ingestor, query)
+		assert.Equal(t, http.StatusBadRequest, w.Code, query)
+		assert.Contains(t, w.Body.String(), `"error"`, query)
+	}
+	assert.Empty(t, ingestor.logLevels.snapshot().Overrides)
+}
+
+func TestLogLevels_GetSnapshot(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	require.NoError(t, ingestor.logLevels.set("reconnect", "trace"))
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/log-levels", nil)
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, req)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	req.Header.Set("Authorization", "Bearer letmein")
+	w = httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, req)
+	require.Equal(t, http.StatusOK, w.Code)
+	var levels LogLevels
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &levels))
+	assert.Equal(t, "error", levels.Level)
+	assert.Equal(t, "trace", levels.Levels["reconnect"])
+	assert.Equal(t, "error", levels.Levels["ingestion"])
+}
+
+func TestLogLevels_ReloadReplacesOverrides(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	require.NoError(t, ingestor.logLevels.set("publish", "debug"))
+
+	ingestor.logLevels.apply(LoggingConfig{Level: "warn", Levels: map[string]string{"fetch": "info"}})
+
+	levels := ingestor.logLevels.snapshot()
+	assert.Equal(t, "warning", levels.Level)
+	assert.Equal(t, []string{"fetch"}, levels.Overrides, "the admin override of publish is dropped")
+	assert.Equal(t, "info", levels.Levels["fetch"])
+	assert.Equal(t, "warning", levels.Levels["publish"])
+}
+
+func TestLogFor_FromContext(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.WarnLevel)
+	ingestor.logger = logger
+	require.NoError(t, ingestor.logLevels.set("fetch", "debug"))
+
+	ctx := withLogLevels(context.Background(), ingestor.logLevels)
+	logFor(ctx, logFetch).Debug("deep call site")
+	logFor(ctx, logPublish).Info("filtered at the root level")
+
+	require.Len(t, hook.AllEntries(), 1, "the component logger fires the root's hooks")
+	assert.Equal(t, "deep call site", hook.LastEntry().Message)
+	assert.Equal(t, "fetch", hook.LastEntry().Data["component"])
+
+	// Outside of the service's contexts the standard logger is used
+	assert.Equal(t, logrus.StandardLogger(), logFor(context.Background(), logFetch).Logger)
+}
+
+func TestAccessLog(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.WarnLevel)
+	ingestor.logger = logger
+	router := setupRoutes(ingestor)
+
+	req := httptest.NewRequest(http.MethodGet, "/health", nil)
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Empty(t, hook.AllEntries(), "access lines are info and filtered at the root's warn")
+
+	require.NoError(t, ingestor.logLevels.set("http", "info"))
+	router.ServeHTTP(httptest.NewRecorder(), req)
+	require.NotNil(t, hook.LastEntry())
+	entry := hook.LastEntry()
+	assert.Equal(t, "HTTP request", entry.Message)
+	assert.Equal(t, "http", entry.Data["component"])
+	assert.Equal(t, "/health", entry.Data["path"])
+	assert.Equal(t, http.MethodGet, entry.Data["method"])
+}
@@ -3,350 +3,2104 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 	"github.com/streadway/amqp"
-	"gopkg.in/yaml.v3"
 )
 
 // Config represents application configuration
 type Config struct {
-	Server   ServerConfig   `yaml:"server"`
-	API      APIConfig      `yaml:"api"`
-	RabbitMQ RabbitMQConfig `yaml:"rabbitmq"`
-	Logging  LoggingConfig  `yaml:"logging"`
+	Server      ServerConfig      `yaml:"server"`
+	API         APIConfig         `yaml:"api"`
+	RabbitMQ    RabbitMQConfig    `yaml:"rabbitmq"`
+	Logging     LoggingConfig     `yaml:"logging"`
+	Routing     RoutingConfig     `yaml:"routing"`
+	Admin       AdminConfig       `yaml:"admin"`
+	Enrichment  EnrichmentConfig  `yaml:"enrichment"`
+	Publishing  PublishingConfig  `yaml:"publishing"`
+	Idempotency IdempotencyConfig `yaml:"idempotency"`
+	// ReadingDedup publishes each reading once, also across instances
+	ReadingDedup ReadingDedupConfig `yaml:"reading_dedup"`
+	// ReadingIDs replaces the upstream's reading IDs
+	ReadingIDs ReadingIDConfig `yaml:"reading_ids"`
+	// Features keeps the pipeline stages switched off at runtime
+	Features    FeaturesConfig     `yaml:"features"`
+	IngestLimit IngestLimitConfig  `yaml:"ingest_limit"`
+	FileSink    FileSinkConfig     `yaml:"file_sink"`
+	PubSub      PubSubConfig       `yaml:"pubsub"`
+	Subscribers []SubscriberConfig `yaml:"subscribers"`
+	// Delivery declares which sinks a reading has to reach
+	Delivery DeliveryConfig `yaml:"delivery"`
+	Stream   StreamConfig   `yaml:"stream"`
+	// Latest serves the newest reading per location over HTTP
+	Latest     LatestConfig      `yaml:"latest"`
+	Transforms []TransformConfig `yaml:"transforms"`
+	Validation ValidationConfig  `yaml:"validation"`
+	// Quarantine keeps invalid readings for reprocessing
+	Quarantine QuarantineConfig `yaml:"quarantine"`
+	// Aggregates keep daily and weekly stats per location
+	Aggregates AggregatesConfig `yaml:"aggregates"`
+	// CycleJournal keeps the finished cycles and their traces across
+	// restarts
+	CycleJournal CycleJournalConfig `yaml:"cycle_journal"`
+	CrashReport  CrashReportConfig  `yaml:"crash_report"`
+	// InstanceID identifies this deployment to the upstream, in logs and in
+	// published messages. It is generated at startup when empty.
+	InstanceID string `yaml:"instance_id"`
+	// Env names the deployment for the {env} placeholder of queue,
+	// exchange and routing key names, $DATA_INGESTOR_ENV by default
+	Env string `yaml:"env"`
+	// MetricsSnapshot keeps the counters across restarts
+	MetricsSnapshot MetricsSnapshotConfig `yaml:"metrics_snapshot"`
+	Daemon          DaemonConfig          `yaml:"daemon"`
+	Debug           DebugConfig           `yaml:"debug"`
+	// MemoryGuard sheds load when the heap grows too large
+	MemoryGuard MemoryGuardConfig `yaml:"memory_guard"`
+	// ResourceGuard protects the process from goroutine, file descriptor
+	// and heap leaks
+	ResourceGuard ResourceGuardConfig `yaml:"resource_guard"`
+	// Sharding splits the locations between replicas
+	Sharding ShardingConfig `yaml:"sharding"`
+	// HealthChecks probe the dependencies in the background for /ready
+	HealthChecks HealthChecksConfig `yaml:"health_checks"`
+	// Report publishes a daily summary of the counters
+	Report ReportConfig `yaml:"report"`
+	// Backfill fetches and publishes past readings in background jobs
+	Backfill BackfillConfig `yaml:"backfill"`
+	// Quality scores every polled reading for the consumers and the routing
+	// rules
+	Quality QualityConfig `yaml:"quality"`
+	// ErrorBudget reduces polling while too many upstream fetches fail
+	ErrorBudget ErrorBudgetConfig `yaml:"error_budget"`
+	// SchemaDrift reports upstream responses that differ from the expected
+	// schema
+	SchemaDrift SchemaDriftConfig `yaml:"schema_drift"`
+
+	Secrets SecretsConfig `yaml:"secrets"`
+	// Tenants run their own pipelines next to the top-level one, which is
+	// the "default" tenant
+	Tenants map[string]TenantConfig `yaml:"tenants"`
+
+	// warnings are deprecations found while loading, logged at startup
+	warnings []string
+	// tenant is set in the configuration derived for a tenant
+	tenant string
+	// profile is the config profile applied on top of the file
+	profile string
+	// unresolved is the config before its names were resolved
+	unresolved *Config
 }
 
 type ServerConfig struct {
 	Port string `yaml:"port"`
 	Host string `yaml:"host"`
+	// Compression gzips the larger responses
+	Compression HTTPCompressionConfig `yaml:"compression"`
 }
 
 type APIConfig struct {
-	BaseURL    string        `yaml:"base_url"`
-	Timeout    time.Duration `yaml:"timeout"`
-	RetryCount int           `yaml:"retry_count"`
+	BaseURL      string   `yaml:"base_url"`
+	Timeout      Duration `yaml:"timeout"`
+	RetryCount   int      `yaml:"retry_count"`
+	RetryBackoff Duration `yaml:"retry_backoff"`
+	MaxBodyBytes ByteSize `yaml:"max_body_bytes"`
+	// Locations are polled independently, each with its own retries,
+	// breaker, throttling and adaptive interval
+	Locations       []LocationSource     `yaml:"locations"`
+	PollInterval    Duration             `yaml:"poll_interval"`
+	MaxPollInterval Duration             `yaml:"max_poll_interval"`
+	CircuitBreaker  CircuitBreakerConfig `yaml:"circuit_breaker"`
+	Auth            AuthConfig           `yaml:"auth"`
+	// Signing adds an HMAC-SHA256 signature to every upstream request
+	Signing RequestSigningConfig `yaml:"signing"`
+	// Format overrides the Content-Type: json, xml or csv
+	Format      string            `yaml:"format"`
+	CSV         CSVConfig         `yaml:"csv"`
+	Incremental IncrementalConfig `yaml:"incremental"`
+	// CaptureHeaders are response headers copied into the message envelope
+	// and made available to transforms and routing rules
+	CaptureHeaders []string     `yaml:"capture_headers"`
+	Client         ClientConfig `yaml:"client"`
+	// AdaptiveTimeout replaces Timeout per attempt once enough latencies are known
+	AdaptiveTimeout AdaptiveTimeoutConfig `yaml:"adaptive_timeout"`
+	// RateLimit bounds the calls to the upstream from every location and path
+	RateLimit UpstreamRateLimitConfig `yaml:"rate_limit"`
+	// Trace times the DNS, connect, TLS, first byte and body phases of
+	// every upstream request
+	Trace TraceConfig `yaml:"trace"`
+	// Strategy is per_location, the default, to GET every location on its
+	// own, or bulk to fetch them all with one POST per cycle
+	Strategy string     `yaml:"strategy"`
+	Bulk     BulkConfig `yaml:"bulk"`
+	// Redirects is what fetches do when the upstream answers with a 3xx
+	Redirects RedirectConfig `yaml:"redirects"`
+	// AllowCrossHostRedirects follows redirects to another host
+	AllowCrossHostRedirects bool `yaml:"allow_cross_host_redirects"`
+	// WebSocket receives the readings an upstream pushes instead of
+	// polling for them
+	WebSocket WebSocketConfig `yaml:"websocket"`
+	// Maintenance suspends polling while the upstream's status endpoint
+	// announces maintenance
+	Maintenance MaintenanceConfig `yaml:"maintenance"`
+	// Discovery polls the stations of the upstream catalog besides the
+	// configured locations
+	Discovery DiscoveryConfig `yaml:"discovery"`
+	// Diagnostics checks DNS and TCP connectivity to the upstream host
+	// after a network failure
+	Diagnostics DiagnosticsConfig `yaml:"diagnostics"`
+	// Coalescing shares a fetch between triggers wanting the same location
+	Coalescing CoalescingConfig `yaml:"coalescing"`
 }
 
 type RabbitMQConfig struct {
-	URL       string `yaml:"url"`
-	QueueName string `yaml:"queue_name"`
+	URL string `yaml:"url"`
+	// URLs are brokers in order of preference, the first being the primary
+	URLs []string `yaml:"urls"`
+	// PasswordFile holds the password of the user of the broker URLs. It
+	// is read again every secrets.poll_interval and a rotation reconnects.
+	PasswordFile   string         `yaml:"password_file"`
+	Failover       FailoverConfig `yaml:"failover"`
+	QueueName      string         `yaml:"queue_name"`
+	ConfirmTimeout Duration       `yaml:"confirm_timeout"`
+	// PublishTimeout bounds the write of a message to the broker. A write
+	// still blocked then drops the connection, which is reconnected.
+	PublishTimeout Duration `yaml:"publish_timeout"`
+	// MaxPriority declares the queue with x-max-priority. It defaults to the
+	// highest message rule priority.
+	MaxPriority  uint8              `yaml:"max_priority"`
+	Partitioning PartitionConfig    `yaml:"partitioning"`
+	Backpressure BackpressureConfig `yaml:"backpressure"`
+	FlowControl  FlowControlConfig  `yaml:"flow_control"`
+	// StrictDeclare reports the service as not ready while the queue on the
+	// broker differs from the configuration
+	StrictDeclare bool `yaml:"strict_declare"`
+	// Client is the AMQP client library, streadway or amqp091
+	Client string `yaml:"client"`
+	// Mandatory publishes with the mandatory flag, so the broker returns the
+	// messages no queue is bound for instead of dropping them
+	Mandatory    bool               `yaml:"mandatory"`
+	PublishRetry PublishRetryConfig `yaml:"publish_retry"`
+	Spool        SpoolConfig        `yaml:"spool"`
 }
 
 type LoggingConfig struct {
 	Level string `yaml:"level"`
+	// Levels sets the level of single components, e.g. publish: debug;
+	// the others log at Level
+	Levels map[string]string `yaml:"levels"`
+	// File is appended to in addition to stderr
+	File string `yaml:"file"`
 }
 
 // SensorData represents a single sensor reading
 type SensorData struct {
-	Type    string                 `json:"type"`
-	Name    string                 `json:"name"`
-	Payload map[string]interface{} `json:"payload"`
+	Type     string                 `json:"type"`
+	Name     string                 `json:"name"`
+	Payload  map[string]interface{} `json:"payload"`
+	Metadata *LocationMetadata      `json:"location_metadata,omitempty"`
+	// Headers are the captured headers of the response the reading came in.
+	// They are published in the envelope, not with the reading.
+	Headers map[string]string `json:"-"`
+	// Quality is the reading's score with quality.enabled, also published
+	// in the envelope
+	Quality *QualityScore `json:"-"`
+	// ID is the ID reading_ids gave the reading, empty when it kept the
+	// upstream's, and SourceID the upstream's it replaced, published in the
+	// envelope
+	ID       string `json:"-"`
+	SourceID string `json:"-"`
+	// Raw is the reading as it came in, kept with quarantine.enabled so an
+	// invalid reading is quarantined byte for byte
+	Raw json.RawMessage `json:"-"`
 }
 
 // WeatherData represents the structure of data from unstable API (array of sensor data)
 type WeatherData []SensorData
 
+// amqpChannel is the subset of an AMQP channel used for publishing
+type amqpChannel interface {
+	PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error)
+	QueueInspect(name string) (amqp.Queue, error)
+	Close() error
+}
+
 // DataIngestor handles data ingestion from external API
 type DataIngestor struct {
 	config     *Config
 	logger     *logrus.Logger
+	logLevels  *logLevels
 	httpClient *http.Client
-	conn       *amqp.Connection
-	channel    *amqp.Channel
+	publishMu  sync.Mutex
+	router     *Router
+	metrics    *Metrics
+	shutdown   *shutdownState
+	enricher   *Enricher
+	// txMu is held for a whole batch with publishing.batch_mode tx. It guards
+	// the transaction channel and the connection it was opened on.
+	txMu      sync.Mutex
+	txChannel amqpChannel
+	txConn    io.Closer
+
+	idempotency *idempotencyCache
+	dedup       *readingDedup
+	ids         *readingIDs
+	features    *featureFlags
+	push        *pushSource
+	maintenance *maintenanceWatch
+	ingestLimit *ingestLimiter
+	fileSink    *FileSink
+	// deliveries remembers what the sinks took of failed deliveries
+	deliveries deliveryProgress
+	archive    *archiveLifecycle
+	pubsub     *PubSubSink
+	naming     *fieldNamer
+	logTail    *logTail
+	faults     *faultInjector
+	memory     *memoryGuard
+	resources  *resourceGuard
+	health     *healthChecker
+	fixtures   *fixtureStore
+	// sources are read with currentSources; api.discovery replaces them
+	// under sourcesMu
+	sources   []*source
+	sourcesMu sync.RWMutex
+	// discovery is set with api.discovery.catalog_url
+	discovery *stationDiscovery
+	pollers   sourcePollers
+	// bulkSource sends the bulk requests with api.strategy: bulk
+	bulkSource *source
+	notifier   *Notifier
+	stream     *streamHub
+	// cycleTraces are the cycles kept for GET /debug/trace, nil unless
+	// debug.trace is set
+	cycleTraces *traceStore
+	// journal keeps the finished cycles
+	journal     *cycleJournal
+	latest      *latestCache
+	schemaDrift *schemaDrift
+	transformer *Transformer
+	// schema is what the messages of readings name in their headers, nil
+	// unless publishing.schema is enabled
+	schema     *publishedSchema
+	auth       *oauth2Transport
+	partitions *partitioner
+	// hashPartitions is set with rabbitmq.partitioning.count
+	hashPartitions *hashPartitioner
+	cursors        *cursorStore
+	backpressure   *backpressure
+	flow           *brokerFlow
+	compressor     *compressor
+	security       *messageSecurity
+	// securityErr fails every publish when the security keys failed to load
+	securityErr error
+	hooks       hookSet
+	instanceID  string
+	lifecycle   *lifecycle
+	cycles      *cycleWatch
+	// shard is set with sharding; sources are then the owned locations only
+	shard *shardAssignment
+	// report is set with report.enabled and counts the day of the owned
+	// locations
+	report *reporter
+	// backfill is set with backfill.enabled and runs the backfill jobs
+	backfill *backfiller
+	// quarantine is set with quarantine.enabled and keeps invalid readings
+	quarantine *quarantine
+	aggregates *aggregates
+	// spool is set with rabbitmq.spool.dir and keeps the messages the broker
+	// could not be reached for
+	spool *spool
+	// upstreamLimit is passed by every call to the upstream, with
+	// api.rate_limit set
+	upstreamLimit *upstreamLimiter
+	// budget is set with error_budget.enabled and reduces polling while too
+	// many fetches fail
+	budget *errorBudget
+	// traces keeps the last slow upstream request with api.trace.enabled
+	traces *upstreamTraces
+	// diagnostics runs connectivity checks with api.diagnostics.enabled
+	diagnostics *connectivityDiagnostics
+	// coalescer shares fetches with api.coalescing.enabled
+	coalescer *fetchCoalescer
+	// ordering keeps each location in order with publishing.ordering
+	// per_location
+	ordering *publishOrder
+	// tenants are the configured tenants, on the default ingestor only
+	tenants map[string]*tenant
+	// paused stops polling; set over the admin API
+	paused  atomic.Bool
+	logFile *os.File
+	// exit terminates the process after a panic; replaced in tests
+	exit func(code int)
+	// started is when the ingestor was created, for the shutdown report
+	started time.Time
+	// drainTimeout bounds the HTTP drain; replaced in tests
+	drainTimeout time.Duration
+
+	// connMu guards the connection state and the fields below it
+	connMu         sync.Mutex
+	connState      ConnState
+	connGeneration uint64
+	conn           io.Closer
+	channel        amqpChannel
+	confirms       *confirmTracker
+	closed         <-chan *amqp.Error
+	// connErr is why the last connect failed or the connection dropped,
+	// cleared once connected
+	connErr error
+	// broker is the index of the active, or last active, broker
+	broker    int
+	failovers int
+	// queueDrift is set when the active broker rejected the queue declare
+	queueDrift *QueueDrift
+	// openChannel opens another channel on the active connection
+	openChannel func() (amqpChannel, error)
+	// amqp is the client library dial connects with
+	amqp amqpClient
+	// dialBroker opens a connection to one broker; replaced in tests
+	dialBroker func(url string) (*brokerConn, error)
+	// secrets are the credentials read from files, nil without any
+	secrets *secretFiles
 }
 
 // NewDataIngestor creates a new DataIngestor instance
-func NewDataIngestor(config *Config) *DataIngestor {
+func NewDataIngestor(config *Config, opts ...Option) *DataIngestor {
 	logger := logrus.New()
 	level, err := logrus.ParseLevel(config.Logging.Level)
 	if err != nil {
 		level = logrus.InfoLevel
 	}
 	logger.SetLevel(level)
+	instanceID := newInstanceID(config.InstanceID)
+	config = config.resolvedNames(instanceID)
+	logger.AddHook(instanceHook{id: instanceID})
+	if config.tenant != "" {
+		logger.AddHook(tenantHook{name: config.tenant})
+	}
 
 	httpClient := &http.Client{
-		Timeout: config.API.Timeout,
+		Timeout: config.API.clientTimeout(),
 	}
 
-	return &DataIngestor{
+	di := &DataIngestor{
 		config:     config,
 		logger:     logger,
 		httpClient: httpClient,
+		router:     &Router{config: config.Routing},
+		metrics:    NewMetrics(prometheus.NewRegistry()),
+		shutdown:   newShutdownState(),
+
+		idempotency: newIdempotencyCache(config.Idempotency),
+		ingestLimit: newIngestLimiter(config.IngestLimit),
+		fileSink:    NewFileSink(config.FileSink),
+		naming:      newFieldNamer(config.Publishing),
+		sources:     newSources(config.API),
+		diagnostics: newConnectivityDiagnostics(config.API.Diagnostics),
+		coalescer:   newFetchCoalescer(config.API.Coalescing),
+		ordering:    newPublishOrder(config.Publishing),
+		bulkSource:  newBulkSource(config.API),
+		notifier:    NewNotifier(config.Subscribers, logger),
+		instanceID:  instanceID,
+		lifecycle:   newLifecycle(config.Daemon, logger),
+		cycles:      newCycleWatch(),
+		exit:        os.Exit,
+		started:     time.Now(),
+
+		drainTimeout: shutdownTimeout,
+	}
+	httpClient.CheckRedirect = di.checkRedirect
+	di.logLevels = newLogLevels(func() *logrus.Logger { return di.logger }, config.Logging.Levels)
+	di.amqp = newAMQPClient(config.RabbitMQ.amqpClient())
+	di.dialBroker = di.dial
+	di.secrets = newSecretFiles(di)
+	di.upstreamLimit = newUpstreamLimiter(config.API.RateLimit, di.metrics)
+	if di.notifier != nil {
+		di.notifier.naming = di.naming
+	}
+	if config.Logging.File != "" {
+		if di.logFile, err = openLogFile(logger, config.Logging.File); err != nil {
+			logger.WithError(err).Error("Logging to stderr only")
+		}
+	}
+	if config.Debug.Enabled {
+		di.logTail = newLogTail(config.Debug.LogRingSize)
+		logger.AddHook(di.logTail)
+	}
+	di.faults = newFaultInjector(config.Debug, logger, di.metrics)
+	if config.profile != "" {
+		logger.WithField("profile", config.profile).Info("Config profile applied")
+	}
+	for _, warning := range config.warnings {
+		logger.Warn("Config: " + warning)
+	}
+	di.fixtures = newFixtureStore(config.Debug, logger)
+	di.stream = newStreamHub(config.Stream, di.metrics)
+	di.cycleTraces = newTraceStore(config.Debug, config.Stream)
+	di.latest = newLatestCache(config.Latest)
+	di.schemaDrift = newSchemaDrift(config.SchemaDrift, di.metrics)
+	di.flow = newBrokerFlow(logger, di.metrics)
+	di.ids = newReadingIDs(config.ReadingIDs, config.API.Incremental.TimestampField)
+	di.features = newFeatureFlags(config, logger)
+	di.push = newPushSource(di, config.API.WebSocket)
+	di.maintenance = newMaintenanceWatch(di, config.API.Maintenance)
+	di.dedup = newReadingDedup(config.ReadingDedup, instanceID, di.metrics, logger)
+	if di.dedup != nil && di.ids != nil {
+		di.dedup.key = di.ids.dedupKey
+	}
+	di.memory = di.newMemoryGuard()
+	di.resources = di.newResourceGuard()
+	di.budget = di.newErrorBudget()
+	if config.API.Trace.Enabled {
+		di.traces = &upstreamTraces{}
+	}
+	di.health = di.newHealthChecker()
+	if config.RabbitMQ.Partitioning.Daily {
+		di.partitions = newPartitioner(config)
+	}
+	di.hashPartitions = newHashPartitioner(config)
+	di.hashPartitions.restore(di.log(logPublish))
+	if config.RabbitMQ.Backpressure.HighWater > 0 {
+		di.backpressure = newBackpressure(config.RabbitMQ.Backpressure, logger)
+	}
+	if config.API.Incremental.Enabled {
+		di.cursors = newCursorStore(config.API.Incremental)
+		if err := di.cursors.Load(); err != nil {
+			logger.WithError(err).Warn("Ignoring cursor state, fetching the lookback window")
+		}
+	}
+	di.restoreMetrics()
+	if di.compressor, err = newCompressor(config.Publishing); err != nil {
+		logger.WithError(err).Error("Compression disabled")
+	}
+	if di.security, di.securityErr = newMessageSecurity(config.Publishing.Security); di.securityErr != nil {
+		logger.WithError(di.securityErr).Error("Publishing disabled, the message security keys failed to load")
+	}
+	// Transforms were compiled once by Config.Validate already
+	if di.transformer, err = NewTransformer(config.Transforms, di.metrics, logger); err != nil {
+		logger.WithError(err).Error("Transforms disabled")
+	}
+	// Before sharding, which splits the restored stations too
+	di.discovery = di.newStationDiscovery()
+	if di.shard = newShardAssignment(config.Sharding, config.InstanceID, di.sources); di.shard != nil {
+		di.sources = di.shard.filter(di.sources)
+		di.metrics.ShardLocations.Set(float64(len(di.sources)))
+		status := di.shard.status()
+		logger.WithFields(logrus.Fields{
+			"member":    status.Member,
+			"index":     status.Index,
+			"total":     status.Total,
+			"owned":     len(status.Owned),
+			"locations": status.Locations,
+		}).Info("Polling the locations of this shard")
+	}
+	di.report = di.newReporter()
+	di.backfill = di.newBackfiller()
+	di.quarantine = di.newQuarantine()
+	di.spool = di.newSpool()
+	// After the spool, which the disk guard switches to drop-oldest
+	di.archive = di.newArchiveLifecycle()
+	di.aggregates = di.newAggregates()
+	di.journal = di.newCycleJournal()
+	di.schema = newPublishedSchema(di)
+	for _, src := range di.sources {
+		di.metrics.CircuitBreakerState.WithLabelValues(src.name).Set(float64(breakerClosed))
+	}
+	di.hooks = registeredHooks()
+	for _, opt := range opts {
+		opt(di)
 	}
+	// Last, so the signature covers what the other decorators changed
+	if signer := di.newRequestSigner(); signer != nil {
+		di.hooks.decorators = append(di.hooks.decorators, namedDecorator{signingDecorator, signer})
+	}
+	if config.Publishing.Passthrough && len(di.hooks.interceptors) > 0 {
+		logger.Warn("Reading interceptors do not change passthrough messages")
+	}
+	return di
 }
 
-// ConnectToRabbitMQ establishes connection to RabbitMQ
-func (di *DataIngestor) ConnectToRabbitMQ() error {
-	var err error
-	di.conn, err = amqp.Dial(di.config.RabbitMQ.URL)
-	if err != nil {
-		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
-	}
+// defaultMaxBodyBytes is used when api.max_body_bytes is not set
+const defaultMaxBodyBytes = 10 << 20
 
-	di.channel, err = di.conn.Channel()
-	if err != nil {
-		return fmt.Errorf("failed to open channel: %w", err)
-	}
+// fetchResult is one upstream response, decoded and as received
+type fetchResult struct {
+	Data *WeatherData
+	Body []byte
+	// Headers are the response headers listed in api.capture_headers
+	Headers map[string]string
+	// Latency is how long the upstream took to respond; Replayed is set
+	// when the response came from recorded fixtures
+	Latency  time.Duration
+	Replayed bool
+}
 
-	// Declare queue
-	_, err = di.channel.QueueDeclare(
-		di.config.RabbitMQ.QueueName,
-		true,  // durable
-		false, // delete when unused
-		false, // exclusive
-		false, // no-wait
-		nil,   // arguments
-	)
-	if err != nil {
-		return fmt.Errorf("failed to declare queue: %w", err)
+// FetchDataFromAPI retrieves data from the unstable external API, from
+// every location in turn. It returns ErrNoData when no location has data yet.
+func (di *DataIngestor) FetchDataFromAPI(ctx context.Context) (*WeatherData, error) {
+	var data WeatherData
+	noData := 0
+	sources := di.currentSources()
+	for _, src := range sources {
+		result, err := di.fetchFrom(ctx, src)
+		if errors.Is(err, ErrNoData) {
+			noData++
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, *result.Data...)
 	}
+	if noData == len(sources) {
+		return nil, ErrNoData
+	}
+	return &data, nil
+}
 
-	di.logger.Info("Connected to RabbitMQ successfully")
-	return nil
+// upstreamCall is a response of the upstream whose body is still to be read.
+// close releases the response, the trace and the attempt timeout.
+type upstreamCall struct {
+	resp  *http.Response
+	start time.Time
+	trace *requestTrace
+	close func()
 }
 
-// FetchDataFromAPI retrieves data from the unstable external API
-func (di *DataIngestor) FetchDataFromAPI(ctx context.Context) (*WeatherData, error) {
-	req, err := http.NewRequestWithContext(ctx, "GET", di.config.API.BaseURL+"/meters", nil)
+// callUpstream requests the readings of src and checks the status of the
+// response. limit is the most of the body the fixtures record.
+func (di *DataIngestor) callUpstream(ctx context.Context, src *source, limit int64) (*upstreamCall, error) {
+	return di.sendUpstream(ctx, src, limit, di.metersRequest)
+}
+
+// upstreamRequest creates a request to src bound to ctx
+type upstreamRequest func(ctx context.Context, src *source) (*http.Request, error)
+
+// metersRequest is the GET of the readings of one location
+func (di *DataIngestor) metersRequest(ctx context.Context, src *source) (*http.Request, error) {
+	endpoint := src.target() + "/meters"
+	query := url.Values{}
+	for key, value := range di.config.API.Client.QueryParams {
+		query.Set(key, value)
+	}
+	if from, to, ok := fetchWindowOf(ctx); ok {
+		query.Set("since", from.Format(time.RFC3339Nano))
+		query.Set("until", to.Format(time.RFC3339Nano))
+	} else if di.cursors != nil {
+		since := di.cursors.since(src.name, time.Now())
+		query.Set("since", since.Format(time.RFC3339Nano))
+	}
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	return http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+}
+
+// sendUpstream sends the request newRequest creates for src with the rate
+// limit, attempt timeout, authentication and tracing of every upstream call,
+// and checks the status of the response
+func (di *DataIngestor) sendUpstream(ctx context.Context, src *source, limit int64, newRequest upstreamRequest) (*upstreamCall, error) {
+	// Waiting for a token does not count against the attempt timeout
+	if err := di.waitUpstream(ctx); err != nil {
+		return nil, err
+	}
+	cancel := func() {}
+	if timeout := src.attemptTimeout(); timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+	chain := &redirectChain{}
+	ctx = withRedirectChain(ctx, chain)
+	req, err := newRequest(ctx, src)
 	if err != nil {
+		cancel()
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
 	// Add API key header
-	req.Header.Set("X-Api-Key", "supersecret")
+	key, err := di.apiKey()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	req.Header.Set("X-Api-Key", key)
+	di.tagRequest(req)
+	req = di.decorateRequest(req)
+	req, trace := di.traceRequest(req)
 
-	resp, err := di.httpClient.Do(req)
+	start := time.Now()
+	resp, err := di.doUpstream(src, req, limit)
 	if err != nil {
+		di.finishTrace(src, trace)
+		cancel()
 		return nil, fmt.Errorf("failed to make request: %w", err)
 	}
-	defer resp.Body.Close()
+	call := &upstreamCall{resp: resp, start: start, trace: trace, close: func() {
+		resp.Body.Close()
+		di.finishTrace(src, trace)
+		cancel()
+	}}
+
+	if isRedirect(resp.StatusCode) {
+		call.close()
+		return nil, di.redirectError(src, resp, chain)
+	}
+	di.followedRedirects(ctx, src, resp, chain)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		call.close()
+		return nil, &statusError{
+			Code:       resp.StatusCode,
+			RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+		}
+	}
+	return call, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("API returned status %d", resp.StatusCode)
+// fetchFrom retrieves and decodes one response, keeping the raw body
+func (di *DataIngestor) fetchFrom(ctx context.Context, src *source) (*fetchResult, error) {
+	maxBody := int64(di.config.API.MaxBodyBytes)
+	if maxBody <= 0 {
+		maxBody = defaultMaxBodyBytes
 	}
+	call, err := di.callUpstream(ctx, src, maxBody+1)
+	if err != nil {
+		return nil, err
+	}
+	defer call.close()
+	return di.readResponse(ctx, src, call, call.resp.Body, maxBody)
+}
 
-	body, err := io.ReadAll(resp.Body)
+// readResponse reads the body of call from r and decodes it whole
+func (di *DataIngestor) readResponse(ctx context.Context, src *source, call *upstreamCall, r io.Reader, maxBody int64) (*fetchResult, error) {
+	resp, trace, start := call.resp, call.trace, call.start
+	body, err := io.ReadAll(io.LimitReader(r, maxBody+1))
+	trace.readDone()
 	if err != nil {
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
+	latency := time.Since(start)
+	di.observeLatency(src, latency)
+	cycleTraceOf(ctx).upstream(resp, body, latency, di.fixtures != nil && di.fixtures.replay)
+	logFor(ctx, logFetch).WithFields(logrus.Fields{
+		"location":   src.name,
+		"status":     resp.StatusCode,
+		"bytes":      len(body),
+		"latency_ms": latency.Milliseconds(),
+	}).Debug("Upstream responded")
+	if int64(len(body)) > maxBody {
+		return nil, fmt.Errorf("response body exceeds %d bytes", maxBody)
+	}
 
-	var weatherData WeatherData
-	if err := json.Unmarshal(body, &weatherData); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal response: %w", err)
+	// Checked before the content type, since empty responses often have none
+	if isNoData(resp.StatusCode, body) {
+		return nil, ErrNoData
+	}
+	format, err := responseFormat(src.format, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, err
+	}
+	if format == formatJSON {
+		// Before decoding, so type changes the decoder rejects are reported
+		di.checkSchema(ctx, src, body)
+	}
+	if format != formatJSON && di.config.Publishing.Passthrough {
+		return nil, fmt.Errorf("publishing.passthrough requires JSON responses, got %s", format)
 	}
 
-	return &weatherData, nil
+	weatherData, skipped, err := decodeReadings(format, src.csv, body)
+	if err != nil {
+		di.quarantineResponse(ctx, src.name, format, body, err)
+		return nil, err
+	}
+	if di.quarantine != nil {
+		keepRaw(format, body, weatherData)
+	}
+	if skipped > 0 {
+		di.metrics.MalformedRows.WithLabelValues(src.name).Add(float64(skipped))
+		logFor(ctx, logFetch).WithFields(logrus.Fields{
+			"location": src.name,
+			"skipped":  skipped,
+		}).Warn("Skipped malformed CSV rows")
+		cycleTraceOf(ctx).decodeWarning(TraceNote{Action: "skipped_rows", Detail: fmt.Sprintf("%d malformed CSV rows", skipped)})
+	}
+
+	headers := captureHeaders(di.config.API.CaptureHeaders, resp.Header)
+	if headers != nil {
+		for i := range weatherData {
+			weatherData[i].Headers = headers
+		}
+	}
+
+	return &fetchResult{
+		Data:     &weatherData,
+		Body:     body,
+		Headers:  headers,
+		Latency:  latency,
+		Replayed: di.fixtures != nil && di.fixtures.replay,
+	}, nil
 }
 
-// PublishToQueue sends data to RabbitMQ queue
+// isJSONContentType accepts application/json and structured +json types
+func isJSONContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+// PublishToQueue sends data to RabbitMQ queue. When routing rules are
+// configured the readings are fanned out to every matched target instead.
 func (di *DataIngestor) PublishToQueue(data *WeatherData) error {
-	body, err := json.Marshal(data)
+	_, err := di.publishReadings(data, Envelope{})
+	return err
+}
+
+// publishReadings publishes data and returns the MessageIds it published
+func (di *DataIngestor) publishReadings(data *WeatherData, env Envelope) ([]string, error) {
+	if di.enricher != nil {
+		di.enricher.Enrich(*data)
+	}
+
+	switch di.config.Publishing.BatchMode {
+	case batchModeTx:
+		return di.publishTx(data, env)
+	case batchModeSingle:
+		return di.publishSingle(data, env)
+	}
+	return di.publishGroups(data, env)
+}
+
+// publishGroups publishes a message per target, queue and message class
+func (di *DataIngestor) publishGroups(data *WeatherData, env Envelope) ([]string, error) {
+	if di.router.Enabled() {
+		return di.publishRouted(data, env)
+	}
+
+	queues := []partitionGroup{{Queue: di.config.RabbitMQ.QueueName, Readings: *data}}
+	if di.partitions != nil {
+		queues = di.partitions.split(*data)
+	} else if di.hashPartitions != nil {
+		queues = di.hashPartitions.split(*data)
+	}
+
+	var messageIDs []string
+	for _, queue := range queues {
+		if di.partitions != nil {
+			if err := di.declarePartition(queue.Queue); err != nil {
+				return messageIDs, err
+			}
+		}
+		di.cycleTraces.lookup(env.CorrelationID).routed(TraceRoute{Exchange: queue.Exchange, RoutingKey: queue.Queue}, queue.Readings)
+		for _, group := range groupByClass(di.config.Publishing.MessageRules, queue.Readings) {
+			messageID, err := di.publish(queue.Exchange, queue.Queue, &group.Readings, group.envelope(env))
+			if err != nil {
+				return messageIDs, err
+			}
+			messageIDs = append(messageIDs, messageID)
+
+			di.log(logPublish).WithFields(logrus.Fields{
+				"queue":    queue.Queue,
+				"count":    len(group.Readings),
+				"priority": group.Class.Priority,
+				"types": func() []string {
+					types := make([]string, len(group.Readings))
+					for i, sensor := range group.Readings {
+						types[i] = sensor.Type
+					}
+					return types
+				}(),
+			}).Info("Data published to queue")
+		}
+	}
+	return messageIDs, nil
+}
+
+// publishRouted publishes each group of readings planned by the router
+func (di *DataIngestor) publishRouted(data *WeatherData, env Envelope) ([]string, error) {
+	var messageIDs []string
+	fallback := RoutingTarget{RoutingKey: di.config.RabbitMQ.QueueName}
+	for _, route := range splitRoutes(di.router.Plan(*data, fallback), time.Now()) {
+		readings := WeatherData(route.Readings)
+		rule := route.Rule
+		if rule == "" {
+			rule = "default"
+		}
+		di.cycleTraces.lookup(env.CorrelationID).routed(TraceRoute{Rule: rule, Exchange: route.Target.Exchange, RoutingKey: route.Target.RoutingKey}, readings)
+		labels := route.labels()
+		for _, group := range groupByClass(di.config.Publishing.MessageRules, readings) {
+			groupEnv := group.envelope(env)
+			if route.Template != nil {
+				groupEnv.RoutingLabel = labels.RoutingKey
+			}
+			messageID, err := di.publish(route.Target.Exchange, route.Target.RoutingKey, &group.Readings, groupEnv)
+			if err != nil {
+				return messageIDs, err
+			}
+			messageIDs = append(messageIDs, messageID)
+		}
+
+		di.metrics.RoutingRulePublishes.
+			WithLabelValues(rule, labels.Exchange, labels.RoutingKey).
+			Add(float64(len(readings)))
+
+		di.log(logPublish).WithFields(logrus.Fields{
+			"rule":        rule,
+			"exchange":    route.Target.Exchange,
+			"routing_key": route.Target.RoutingKey,
+			"count":       len(readings),
+		}).Info("Data published to route")
+	}
+	return messageIDs, nil
+}
+
+// publish marshals data and publishes it as a single persistent message
+func (di *DataIngestor) publish(exchange, routingKey string, data *WeatherData, env Envelope) (string, error) {
+	body, err := di.naming.marshal(data)
 	if err != nil {
-		return fmt.Errorf("failed to marshal data: %w", err)
+		return "", fmt.Errorf("failed to marshal data: %w", err)
 	}
+	return di.publishBody(exchange, routingKey, body, di.readingEnvelope(env, *data))
+}
 
-	err = di.channel.Publish(
-		"",                           // exchange
-		di.config.RabbitMQ.QueueName, // routing key
-		false,                        // mandatory
-		false,                        // immediate
+// publishBody publishes body as a single persistent message and returns its
+// MessageId. When publisher confirms are enabled it waits for the broker
+// confirm, and handles a failure by rabbitmq.publish_retry, or spools it by
+// rabbitmq.spool. The outcome is reported to the publish observers.
+func (di *DataIngestor) publishBody(exchange, routingKey string, body []byte, env Envelope) (string, error) {
+	messageID, spooled, err := di.publishWithPolicy(exchange, routingKey, body, env)
+	di.observePublish(body, PublishOutcome{
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		MessageID:  messageID,
+		Err:        err,
+		Spooled:    spooled,
+	})
+	return messageID, err
+}
+
+// publishMessage compresses, signs and encrypts, and publishes one message and
+// waits for its confirm
+func (di *DataIngestor) publishMessage(exchange, routingKey string, body []byte, env Envelope) (string, error) {
+	di.faults.delayPublish()
+	plain := body
+	body, encoding, err := di.compressor.encode(body)
+	if err != nil {
+		return "", err
+	}
+	env.InstanceID = di.instanceID
+	body, headers, err := di.seal(encoding, body, di.naming.table(env.Headers()))
+	if err != nil {
+		return "", err
+	}
+	if err := di.checkMessageSize(routingKey, body); err != nil {
+		return "", err
+	}
+	if err := di.flow.wait(di.config.RabbitMQ.FlowControl.maxWait()); err != nil {
+		return "", fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	// The channel is looked up under the publish lock, so nothing is published
+	// to the previous broker once failBack has switched
+	di.publishMu.Lock()
+	var (
+		channel  amqpChannel
+		confirms *confirmTracker
+	)
+	if env.tx != nil {
+		channel, err = di.txBatchChannel(env.tx)
+	} else {
+		channel, confirms, err = di.activeChannel()
+	}
+	if err != nil {
+		di.publishMu.Unlock()
+		return "", err
+	}
+
+	messageID := env.messageID(exchange, routingKey, plain)
+	label := env.routingLabel(routingKey)
+	di.metrics.MessageSize.WithLabelValues(sinkAMQP, label).Observe(float64(len(body)))
+
+	var (
+		tag       uint64
+		confirmed <-chan error
+	)
+	if confirms != nil {
+		tag, confirmed = confirms.trackID(label, messageID)
+	}
+	// Returns are only told apart from acks with publisher confirms
+	mandatory := di.config.RabbitMQ.Mandatory && confirmed != nil
+
+	err = di.publishWithin(
+		channel,
+		exchange,   // exchange
+		routingKey, // routing key
+		mandatory,  // mandatory
+		false,      // immediate
 		amqp.Publishing{
-			ContentType:  "application/json",
-			Body:         body,
-			DeliveryMode: amqp.Persistent, // make message persistent
+			ContentType:     "application/json",
+			ContentEncoding: encoding,
+			Body:            body,
+			DeliveryMode:    amqp.Persistent, // make message persistent
+			MessageId:       messageID,
+			CorrelationId:   env.CorrelationID,
+			Type:            env.Type,
+			Priority:        env.Priority,
+			Expiration:      env.expiration(),
+			Timestamp:       time.Now(),
+			Headers:         headers,
 		},
 	)
 	if err != nil {
-		return fmt.Errorf("failed to publish message: %w", err)
+		if confirmed != nil {
+			confirms.untrack(tag)
+		}
+		di.publishMu.Unlock()
+		return "", fmt.Errorf("failed to publish message: %w", unreachable(err))
+	}
+	di.publishMu.Unlock()
+
+	published := di.log(logPublish).WithFields(logrus.Fields{
+		"exchange":    exchange,
+		"routing_key": routingKey,
+		"message_id":  messageID,
+		"bytes":       len(body),
+	})
+	if confirmed == nil {
+		if env.tx != nil {
+			env.tx.routingKeys = append(env.tx.routingKeys, label)
+		} else {
+			di.metrics.PublishedMessages.WithLabelValues(sinkAMQP, label).Inc()
+		}
+		published.Debug("Message published")
+		return messageID, nil
+	}
+
+	timer := time.NewTimer(di.confirmTimeout())
+	defer timer.Stop()
+	select {
+	case err := <-confirmed:
+		if errors.Is(err, ErrConfirmsClosed) {
+			// The broker may have the message, so the copy spooled or
+			// published again repeats its MessageId
+			return messageID, fmt.Errorf("failed to publish message: %w", err)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to publish message: %w", err)
+		}
+		di.metrics.PublishedMessages.WithLabelValues(sinkAMQP, label).Inc()
+		published.Debug("Message published and confirmed")
+		return messageID, nil
+	case <-timer.C:
+		confirms.forget(tag)
+		// The MessageId goes back with the error, for the copy published
+		// again to repeat it
+		return messageID, fmt.Errorf("failed to publish message: %w", ErrConfirmTimeout)
 	}
+}
 
-	di.logger.WithFields(logrus.Fields{
-		"count": len(*data),
-		"types": func() []string {
-			types := make([]string, len(*data))
-			for i, sensor := range *data {
-				types[i] = sensor.Type
+// publishWithin publishes msg on channel, giving up after the publish
+// timeout. Neither client interrupts a write the broker stopped reading, so
+// a publish still blocked then closes the connection: that ends the write,
+// and the supervisor reconnects. Callers hold publishMu.
+func (di *DataIngestor) publishWithin(channel amqpChannel, exchange, routingKey string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(context.Background(), di.publishTimeout())
+	defer cancel()
+	type result struct {
+		err error
+		// panicked is what the publish panicked with, raised again here so
+		// the cycle's own recovery sees it
+		panicked interface{}
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- result{panicked: p}
 			}
-			return types
-		}(),
-	}).Info("Data published to queue")
+		}()
+		done <- result{err: channel.PublishWithContext(ctx, exchange, routingKey, mandatory, immediate, msg)}
+	}()
+	select {
+	case r := <-done:
+		if r.panicked != nil {
+			panic(r.panicked)
+		}
+		return r.err
+	case <-ctx.Done():
+	}
 
-	return nil
+	di.connMu.Lock()
+	conn := di.conn
+	di.connMu.Unlock()
+	if conn != nil {
+		conn.Close()
+	}
+	di.log(logPublish).WithFields(logrus.Fields{
+		"routing_key": routingKey,
+		"message_id":  msg.MessageId,
+	}).Warn("Publish blocked past rabbitmq.publish_timeout, dropping the connection")
+	return ErrPublishTimeout
 }
 
-// StartIngestion starts the data ingestion process
+// StartIngestion starts the data ingestion process. Every location is polled
+// on its own schedule, so a failing upstream only slows down itself.
+// Cancelling ctx stops polling; cycles that are already running are allowed
+// to finish.
 func (di *DataIngestor) StartIngestion(ctx context.Context) {
-	ticker := time.NewTicker(5 * time.Second) // Fetch data every 5 seconds
-	defer ticker.Stop()
+	ctx = withTrigger(withLogLevels(ctx, di.logLevels), triggerPoll)
+	var wg sync.WaitGroup
+	for _, src := range di.pushSources() {
+		wg.Add(1)
+		go func(src Source) {
+			defer wg.Done()
+			defer di.crashOnPanic("ingestion")
+			src.Run(ctx)
+		}(src)
+	}
+	if di.push != nil {
+		if !di.config.API.WebSocket.PollFallback {
+			wg.Wait()
+			di.log(logIngestion).Info("Ingestion stopped")
+			return
+		}
+	}
+	if di.config.API.bulk() {
+		di.pollBulk(ctx)
+		wg.Wait()
+		di.log(logIngestion).Info("Ingestion stopped")
+		return
+	}
+	// One poller per location; api.discovery starts and stops them as the
+	// catalog changes
+	di.pollers.run(ctx, di.currentSources, func(ctx context.Context, src *source) {
+		defer di.crashOnPanic("ingestion")
+		di.pollSource(ctx, src)
+	})
+	wg.Wait()
+	di.log(logIngestion).Info("Ingestion stopped")
+}
+
+// pollSource runs ingestion cycles for one location until ctx is cancelled.
+// Cycles follow the location's schedule, see cycleSchedule.
+func (di *DataIngestor) pollSource(ctx context.Context, src *source) {
+	interval := di.config.API.pollInterval()
+	src.schedule.start(time.Now().Add(interval), interval)
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			di.logger.Info("Ingestion stopped")
 			return
-		case <-ticker.C:
-			data, err := di.FetchDataFromAPI(ctx)
-			if err != nil {
-				di.logger.WithError(err).Error("Failed to fetch data from API")
-				continue
+		case <-timer.C:
+			started := time.Now()
+			ticks := src.schedule.due(started)
+			// With a WebSocket upstream, polling only stands in while it is down
+			if !di.paused.Load() && !di.memory.pausesFetching() && !di.pushing() && !di.maintenance.holdsPolling() {
+				switch di.budget.polling() {
+				case budgetNormal:
+					done := di.cycles.begin(src.name, started)
+					outcome := di.ingestOnce(context.WithoutCancel(ctx), src)
+					done()
+					di.recordSchedule(src, ticks, started, time.Now(), outcome.Outcome == outcomePublished)
+				case budgetModeHeartbeats:
+					di.heartbeatOnce(context.WithoutCancel(ctx), src)
+				}
 			}
+			now := time.Now()
+			src.schedule.advance(ticks[len(ticks)-1], now, di.pollDelay(now, src), interval)
+			timer.Reset(src.schedule.wait(now))
+		}
+	}
+}
 
-			if err := di.PublishToQueue(data); err != nil {
-				di.logger.WithError(err).Error("Failed to publish data to queue")
-				continue
-			}
+// pollDelay returns how long to wait before the locations are polled again:
+// the shortest delay of them, so one backing off does not hold up the
+// others, scaled by backpressure or broker flow control. Both factors apply
+// to that base delay and the larger one wins, so they do not compound.
+func (di *DataIngestor) pollDelay(now time.Time, sources ...*source) time.Duration {
+	interval, max := di.config.API.pollInterval(), di.config.API.maxPollInterval()
+	delay := max
+	if len(sources) == 0 {
+		// Nothing to back off from until discovery adds a location
+		delay = interval
+	}
+	for _, src := range sources {
+		if d := src.nextDelay(now, interval, max); d < delay {
+			delay = d
+		}
+	}
+	scaled := delay
+	if di.backpressure != nil {
+		scaled = di.backpressure.scale(delay, max)
+	}
+	if flowed := di.flow.scale(now, delay, interval, max); flowed > scaled {
+		scaled = flowed
+	}
+	return scaled
+}
 
-			di.logger.WithFields(logrus.Fields{
-				"count": len(*data),
-				"types": func() []string {
-					types := make([]string, len(*data))
-					for i, sensor := range *data {
-						types[i] = sensor.Type
-					}
-					return types
-				}(),
-			}).Info("Successfully processed data")
+// ingestOnce runs a single fetch and publish cycle for one location. Each
+// location is polled on its own, so its cycle is a cycle of one location.
+func (di *DataIngestor) ingestOnce(ctx context.Context, src *source) LocationOutcome {
+	result := &CycleResult{Started: time.Now(), Trigger: triggerOf(ctx)}
+	outcome := di.runLocation(ctx, src)
+	result.Locations = []LocationOutcome{outcome}
+	di.finishCycle(result)
+	if outcome.Outcome == outcomePublished {
+		di.metrics.CycleDuration.Observe(time.Since(result.Started).Seconds())
+	}
+	di.logOutcome(outcome)
+	return outcome
+}
+
+// IngestResult describes the data one ingestion published
+type IngestResult struct {
+	Data       *WeatherData
+	MessageIDs []string
+	// CorrelationIDs has one entry per location cycle that published
+	CorrelationIDs []string
+	// SourceErrors holds the error of every location that failed while
+	// others succeeded
+	SourceErrors map[string]string
+}
+
+// ingest runs a cycle over every location and combines what they published.
+// It only fails when no location succeeded, and returns ErrNoData when none
+// of them had data.
+func (di *DataIngestor) ingest(ctx context.Context) (*IngestResult, error) {
+	return di.RunCycle(ctx).ingestResult()
+}
+
+// ingestSource fetches data from one location and publishes it
+func (di *DataIngestor) ingestSource(ctx context.Context, src *source) (*IngestResult, error) {
+	ctx = di.withFeatures(ctx)
+	// The correlation id joins what every stage records for the cycle
+	correlationID := newMessageID()
+	trace := di.cycleTraces.start(correlationID, src.name, triggerOf(ctx))
+	ctx = withCycleTrace(ctx, trace)
+	var fetched *fetchResult
+	var shared string
+	var err error
+	bulk, bulked := bulkFetchOf(ctx, src.name)
+	ticket := bulk.orderTicket()
+	if ticket == nil {
+		// Taken before the request is sent, see publishOrder.ticket
+		ticket = di.ordering.ticket(src.name)
+	}
+	// Every way out but a publish gives up the ticket's place
+	defer ticket.finish()
+	if bulked {
+		// Allowed and fetched together with the other locations
+		if bulk.allowErr != nil {
+			return nil, bulk.allowErr
+		}
+		fetched, err = bulk.fetched, bulk.err
+	} else {
+		if err := src.allow(time.Now()); err != nil {
+			return nil, err
+		}
+		fetched, shared, err = di.fetchCoalesced(ctx, src)
+	}
+	if shared != "" {
+		// The caller that fetched recorded the outcome
+		src.release()
+	} else {
+		di.recordFetch(ctx, src, err)
+	}
+	if errors.Is(err, ErrNoData) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch data from API: %w", err)
+	}
+	locationStatsOf(ctx).fetched(len(fetched.Body))
+	// The cursor covers every fetched reading, including filtered ones
+	seen := *fetched.Data
+	prepared := di.shapeReadings(ctx, src.name, di.faults.dropReadings(src.name, *fetched.Data), fetchSignals{Replayed: fetched.Replayed, Latency: fetched.Latency})
+	fetched.Data = &prepared
+	// Served as the latest readings even when they were published before
+	di.latest.update(src.name, *fetched.Data, time.Now())
+	// What the sinks took of the readings when the location last failed
+	progress := di.deliveries.take(src.name)
+	var claim *dedupClaim
+	if di.dedup != nil {
+		unique, claimed, err := di.dedup.claim(ctx, *fetched.Data, progress.heldClaim())
+		if err != nil {
+			di.keepProgress(src.name, progress, nil, progress.heldClaim())
+			return nil, err
+		}
+		fetched.Data, claim = &unique, claimed
+		if len(unique) == 0 {
+			// Everything was published before, here or by another instance
+			di.advanceCursor(src, seen)
+			di.report.observe(src.name, time.Now())
+			return &IngestResult{Data: fetched.Data}, nil
 		}
 	}
+
+	trigger := triggerOf(ctx)
+	env := Envelope{CorrelationID: correlationID, UpstreamHeaders: fetched.Headers, Trigger: trigger}
+	locationStatsOf(ctx).correlated(correlationID)
+	di.cycleTraces.keep(trace)
+	if err := di.enterOrder(ctx, ticket); err != nil {
+		trace.failed(err)
+		di.dedup.release(di.keepProgress(src.name, progress, nil, claim))
+		return nil, err
+	}
+	delivered, err := di.deliver(ctx, fetched, env, progress)
+	ticket.leave()
+	if err != nil {
+		trace.failed(err)
+		// The retry only goes to the sinks that missed readings, and the
+		// readings some sink took stay claimed
+		di.dedup.release(di.keepProgress(src.name, progress, delivered, claim))
+		return nil, err
+	}
+	di.dedup.commit(claim)
+	di.advanceCursor(src, seen)
+	di.metrics.ReadingsPublished.WithLabelValues(src.name, trigger).Add(float64(len(*fetched.Data)))
+	di.report.observe(src.name, time.Now())
+	di.aggregates.observe(src.name, trigger, *fetched.Data)
+
+	di.stream.Broadcast(env.CorrelationID, trigger, *fetched.Data)
+
+	return &IngestResult{
+		Data:           fetched.Data,
+		MessageIDs:     delivered.messageIDs,
+		CorrelationIDs: []string{env.CorrelationID},
+	}, nil
 }
 
-// Close closes connections
-func (di *DataIngestor) Close() error {
-	if di.channel != nil {
-		di.channel.Close()
+// prepareReadings clears the sentinels and runs the interceptors, transforms
+// and validation over fetched readings, skipping the stages switched off for the cycle of ctx
+func (di *DataIngestor) prepareReadings(ctx context.Context, data WeatherData) WeatherData {
+	features := di.featuresOf(ctx)
+	if di.sentinelsEnabled() && !di.config.Publishing.Passthrough && !features.off(stageValidation) {
+		data = di.clearSentinels(ctx, data)
 	}
-	if di.conn != nil {
-		di.conn.Close()
+	if len(di.hooks.interceptors) > 0 {
+		data = di.interceptReadings(data)
+	}
+	if di.transformer != nil && !features.off(stageTransforms) {
+		data = di.transformTraced(ctx, data)
+	}
+	if di.validationEnabled() && !di.config.Publishing.Passthrough && !features.off(stageValidation) {
+		data = di.validateReadings(ctx, data)
+	}
+	di.ids.assign(data)
+	return data
+}
+
+// shapeReadings runs every stage between the fetch and the sinks over the
+// readings of a location: prepareReadings, then the quality scores.
+// verify-contracts shapes its example readings here as well, so a stage
+// added here or to prepareReadings is checked against the consumer contracts.
+func (di *DataIngestor) shapeReadings(ctx context.Context, location string, data WeatherData, signals fetchSignals) WeatherData {
+	prepared := di.prepareReadings(ctx, data)
+	if di.config.Quality.Enabled && !di.featuresOf(ctx).off(stageQuality) {
+		di.scoreReadings(prepared, signals, location)
+	}
+	return prepared
+}
+
+// advanceCursor moves the cursor of src past the fetched readings
+func (di *DataIngestor) advanceCursor(src *source, seen WeatherData) {
+	if di.cursors == nil {
+		return
+	}
+	if err := di.cursors.advance(src.name, seen); err != nil {
+		di.logger.WithField("location", src.name).WithError(err).Error("Failed to save cursor")
 	}
-	return nil
 }
 
 // LoadConfig loads configuration from file
 func LoadConfig(filename string) (*Config, error) {
-	data, err := os.ReadFile(filename)
+	return LoadConfigProfile(filename, os.Getenv(profileEnv))
+}
+
+// LoadConfigProfile loads configuration from file with profile applied. An
+// empty profile loads the file as it is, without its profiles.
+func LoadConfigProfile(filename, profile string) (*Config, error) {
+	merged, err := loadMergedConfig(filename, profile)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read config file: %w", err)
+		return nil, err
 	}
 
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	warnings, err := decodeConfig(merged.root, &config)
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
 	}
+	config.warnings = warnings
+	config.profile = profile
+	config.defaultEnv()
+
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 
 	return &config, nil
 }
 
+// Validate checks the configuration for values that cannot work at runtime
+func (c *Config) Validate() error {
+	if err := validateUnits(reflect.ValueOf(c).Elem(), ""); err != nil {
+		return err
+	}
+	if err := c.API.Validate(); err != nil {
+		return err
+	}
+	if err := c.Server.Compression.Validate(); err != nil {
+		return err
+	}
+	if err := c.API.Auth.OAuth2.Validate(); err != nil {
+		return err
+	}
+	if err := c.API.Signing.Validate(); err != nil {
+		return err
+	}
+	if err := c.Routing.Validate(); err != nil {
+		return err
+	}
+	if err := c.validateNames(); err != nil {
+		return err
+	}
+	if err := c.Publishing.validateCompression(); err != nil {
+		return err
+	}
+	if err := c.Publishing.validateFieldNaming(); err != nil {
+		return err
+	}
+	if c.Publishing.Passthrough && c.API.WebSocket.enabled() {
+		return fmt.Errorf("publishing.passthrough cannot be combined with api.websocket")
+	}
+	if c.Publishing.Passthrough && c.API.bulk() {
+		return fmt.Errorf("publishing.passthrough cannot be combined with api.strategy bulk")
+	}
+	if c.Publishing.Passthrough && len(c.Routing.Rules) > 0 {
+		return fmt.Errorf("publishing.passthrough cannot be combined with routing rules")
+	}
+	if c.Publishing.Passthrough && len(c.Transforms) > 0 {
+		return fmt.Errorf("publishing.passthrough cannot be combined with transforms")
+	}
+	if _, err := compileTransforms(c.Transforms); err != nil {
+		return err
+	}
+	if c.Publishing.Passthrough && len(c.Validation.Bounds) > 0 {
+		return fmt.Errorf("publishing.passthrough cannot be combined with validation bounds")
+	}
+	if c.Publishing.Passthrough && len(c.Validation.Sentinels) > 0 {
+		return fmt.Errorf("publishing.passthrough cannot be combined with validation sentinels")
+	}
+	if err := c.Validation.Validate(); err != nil {
+		return err
+	}
+	if err := c.validateMessageRules(); err != nil {
+		return err
+	}
+	if err := c.validateOrdering(); err != nil {
+		return err
+	}
+	if err := c.RabbitMQ.validateBrokers(); err != nil {
+		return err
+	}
+	if err := c.RabbitMQ.validateAMQPClient(); err != nil {
+		return err
+	}
+	if err := c.RabbitMQ.Backpressure.Validate(); err != nil {
+		return err
+	}
+	if c.RabbitMQ.PublishTimeout < 0 {
+		return fmt.Errorf("rabbitmq.publish_timeout must not be negative")
+	}
+	if err := c.RabbitMQ.FlowControl.Validate(); err != nil {
+		return err
+	}
+	partitioned := c.RabbitMQ.Partitioning.Daily || c.RabbitMQ.Partitioning.Count > 0
+	if c.RabbitMQ.Backpressure.HighWater > 0 && partitioned {
+		// Only the base queue is inspected
+		return fmt.Errorf("rabbitmq.backpressure cannot be combined with rabbitmq.partitioning")
+	}
+	if partitioned && (len(c.Routing.Rules) > 0 || c.Publishing.Passthrough) {
+		return fmt.Errorf("rabbitmq.partitioning cannot be combined with routing rules or publishing.passthrough")
+	}
+	if err := c.RabbitMQ.Partitioning.Validate(); err != nil {
+		return err
+	}
+	if err := c.FileSink.Validate(); err != nil {
+		return err
+	}
+	if err := c.PubSub.Validate(); err != nil {
+		return err
+	}
+	if err := c.ReadingDedup.Validate(); err != nil {
+		return err
+	}
+	if err := c.validateBatchMode(); err != nil {
+		return err
+	}
+	if err := c.Publishing.validateMaxMessageSize(); err != nil {
+		return err
+	}
+	if err := c.RabbitMQ.PublishRetry.Validate(); err != nil {
+		return err
+	}
+	if err := c.RabbitMQ.Spool.Validate(); err != nil {
+		return err
+	}
+	if err := c.validateMandatory(); err != nil {
+		return err
+	}
+	if err := c.validateSecrets(); err != nil {
+		return err
+	}
+	if err := c.validateSchemaRef(); err != nil {
+		return err
+	}
+	if err := c.Publishing.Security.Validate(); err != nil {
+		return err
+	}
+	if c.ReadingDedup.Enabled && c.Publishing.Passthrough {
+		return fmt.Errorf("reading_dedup cannot be combined with publishing.passthrough")
+	}
+	if err := validateSubscribers(c.Subscribers); err != nil {
+		return err
+	}
+	if err := c.Debug.Validate(); err != nil {
+		return err
+	}
+	if err := c.CrashReport.Validate(); err != nil {
+		return err
+	}
+	if err := validateInstanceID(c.InstanceID); err != nil {
+		return err
+	}
+	if err := c.IngestLimit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Latest.Validate(); err != nil {
+		return err
+	}
+	if err := c.MemoryGuard.Validate(); err != nil {
+		return err
+	}
+	if err := c.ResourceGuard.Validate(); err != nil {
+		return err
+	}
+	if err := c.Sharding.Validate(c.InstanceID); err != nil {
+		return err
+	}
+	if err := c.HealthChecks.Validate(); err != nil {
+		return err
+	}
+	if err := c.Report.Validate(c.MetricsSnapshot); err != nil {
+		return err
+	}
+	if err := c.Backfill.Validate(); err != nil {
+		return err
+	}
+	if c.API.Maintenance.Backfill && !c.Backfill.Enabled {
+		return fmt.Errorf("api.maintenance.backfill needs backfill.enabled")
+	}
+	if c.Backfill.Enabled && c.Publishing.Passthrough {
+		return fmt.Errorf("backfill cannot be combined with publishing.passthrough")
+	}
+	if err := c.Quarantine.Validate(); err != nil {
+		return err
+	}
+	if err := c.Aggregates.Validate(); err != nil {
+		return err
+	}
+	if err := c.Quality.Validate(); err != nil {
+		return err
+	}
+	if c.Quality.Enabled && c.Publishing.Passthrough {
+		return fmt.Errorf("quality cannot be combined with publishing.passthrough")
+	}
+	if err := c.ReadingIDs.Validate(); err != nil {
+		return err
+	}
+	if c.ReadingIDs.replaces() && c.Publishing.Passthrough {
+		return fmt.Errorf("reading_ids cannot replace the upstream IDs with publishing.passthrough")
+	}
+	if err := c.ErrorBudget.Validate(); err != nil {
+		return err
+	}
+	if err := c.Delivery.Validate(c.enabledSinks()); err != nil {
+		return err
+	}
+	if err := validateLogLevels(c.Logging.Levels); err != nil {
+		return err
+	}
+	if err := c.SchemaDrift.Validate(); err != nil {
+		return err
+	}
+	if err := c.MetricsSnapshot.Validate(); err != nil {
+		return err
+	}
+	if err := c.Daemon.Validate(); err != nil {
+		return err
+	}
+	return nil
+}
+
 // setupRoutes sets up HTTP routes
 func setupRoutes(di *DataIngestor) *gin.Engine {
-	r := gin.Default()
+	r := gin.New()
+	r.Use(di.accessLog(), di.recoverPanics(), di.httpCompression())
+
+	// Readiness: broker connected and upstream credentials working
+	r.GET("/ready", di.handleReady)
+
+	r.GET("/ingestion/status", di.handleIngestionStatus)
 
 	// Health check endpoint
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(http.StatusOK, gin.H{
-			"status":    "healthy",
-			"timestamp": time.Now(),
-			"service":   "data-ingestor",
+			"status":      "healthy",
+			"timestamp":   time.Now(),
+			"service":     "data-ingestor",
+			"version":     version,
+			"instance_id": di.instanceID,
+			"rabbitmq":    di.ConnectionState().String(),
+			// Cached, never probed by this request
+			"dependencies": di.health.Results(),
 		})
 	})
 
-	// Manual trigger endpoint
-	r.POST("/meters", func(c *gin.Context) {
-		ctx, cancel := context.WithTimeout(c.Request.Context(), 30*time.Second)
-		defer cancel()
+	// Per-location upstream status
+	r.GET("/status", di.handleStatus)
 
-		data, err := di.FetchDataFromAPI(ctx)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": err.Error(),
-			})
-			return
-		}
+	// Live readings as Server-Sent Events, the newest of them and those of a
+	// time range
+	r.GET("/stream", di.handleStream)
+	r.GET("/recent", di.handleRecent)
+	r.GET("/history", di.handleHistory)
+	r.GET("/cycles", di.handleCycles)
+	// Daily and weekly stats per location
+	r.GET("/aggregates", di.handleAggregates)
 
-		if err := di.PublishToQueue(data); err != nil {
-			c.JSON(http.StatusInternalServerError, gin.H{
-				"error": err.Error(),
-			})
-			return
-		}
+	// The newest reading per location, cacheable by other internal clients
+	r.GET("/weather/latest", di.handleLatest)
+	r.GET("/weather/latest/:location", di.handleLatest)
 
-		c.JSON(http.StatusOK, gin.H{
-			"message": "Data ingested successfully",
-			"data":    data,
-		})
-	})
+	// Subscriber delivery statistics
+	r.GET("/stats", di.handleStats)
+
+	// The JSON Schema of the published messages
+	r.GET("/schemas/"+readingSchemaName+"/:version", di.handleSchema)
+
+	// Prometheus metrics endpoint, of every tenant when there are any
+	if len(di.tenants) > 0 {
+		r.GET("/metrics", di.tenantMetrics())
+	} else {
+		r.GET("/metrics", di.metrics.Handler())
+	}
+
+	// Admin endpoints
+	admin := r.Group("/admin", requireAdmin(di.config.Admin))
+	admin.POST("/shutdown", di.handleShutdown)
+	admin.POST("/cursor/reset", di.handleCursorReset)
+	admin.PUT("/upstream", di.handleUpstream)
+	admin.GET("/log-levels", di.handleLogLevels)
+	admin.POST("/log-levels", di.handleSetLogLevel)
+	admin.POST("/throttle", di.handleThrottle)
+	admin.POST("/error-budget", di.handleErrorBudget)
+	admin.POST("/pause", di.handlePause)
+	admin.POST("/resume", di.handleResume)
+	admin.POST("/report", di.handleReport)
+	admin.GET("/dedup", di.handleDedupList)
+	admin.DELETE("/dedup", di.handleDedupFlush)
+	admin.DELETE("/dedup/:key", di.handleDedupDelete)
+	admin.GET("/queue", di.handleQueue)
+	admin.GET("/features", di.handleFeatures)
+	admin.PATCH("/features/:name", di.handleFeatureToggle)
+	admin.GET("/partitions", di.handlePartitions)
+	admin.POST("/partitions", di.handleRepartition)
+
+	// Backfill jobs
+	backfill := r.Group("/backfill", requireAdmin(di.config.Admin))
+	backfill.POST("", di.handleBackfillCreate)
+	backfill.GET("", di.handleBackfillList)
+	backfill.GET("/:id", di.handleBackfillGet)
+	backfill.DELETE("/:id", di.handleBackfillCancel)
+
+	// Invalid readings kept for reprocessing
+	quarantine := r.Group("/quarantine", requireAdmin(di.config.Admin))
+	quarantine.GET("", di.handleQuarantineList)
+	quarantine.POST("/reprocess", di.handleQuarantineReprocessAll)
+	quarantine.GET("/:id", di.handleQuarantineGet)
+	quarantine.POST("/:id/reprocess", di.handleQuarantineReprocess)
+	quarantine.DELETE("/:id", di.handleQuarantineDiscard)
+
+	// Log tail for debugging, only with the debug flag
+	if di.logTail != nil {
+		debug := r.Group("/debug", requireAdmin(di.config.Admin))
+		debug.GET("/logs", di.handleDebugLogs)
+		debug.POST("/faults", di.handleFaultCreate)
+		debug.GET("/faults", di.handleFaultList)
+		debug.DELETE("/faults/:id", di.handleFaultCancel)
+		debug.GET("/trace/:correlation_id", di.handleTrace)
+	}
+
+	r.GET("/debug/schema-drift", requireAdmin(di.config.Admin), di.handleSchemaDrift)
+	r.GET("/debug/connectivity", requireAdmin(di.config.Admin), di.handleConnectivity)
+
+	// Manual trigger endpoint. Replayed responses don't take a slot.
+	ingest := []gin.HandlerFunc{di.idempotency.Middleware(), di.ingestLimit.Middleware(), di.handleIngest}
+	r.POST("/ingest", ingest...)
+	r.POST("/meters", ingest...)
+
+	// The same routes scoped by tenant
+	if di.config.tenant == "" {
+		r.Any("/tenants/:tenant/*path", di.handleTenant(r))
+	}
 
 	return r
 }
 
-func main() {
-	// Get config file path from command line argument or use default
-	configPath := "config.yaml"
-	if len(os.Args) > 1 && os.Args[1] == "-config" && len(os.Args) > 2 {
-		configPath = os.Args[2]
+// handleIngest fetches and publishes data on demand, or publishes the
+// readings posted as a JSON array
+func (di *DataIngestor) handleIngest(c *gin.Context) {
+	maxBody := int64(di.config.API.MaxBodyBytes)
+	if maxBody <= 0 {
+		maxBody = defaultMaxBodyBytes
+	}
+	records, ok, err := postedRecords(c, maxBody)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if ok {
+		di.ingestRecords(c, records)
+		return
 	}
 
-	// Load configuration
-	config, err := LoadConfig(configPath)
+	trigger, class, err := manualTrigger(c.GetHeader(ingestTriggerHeader))
 	if err != nil {
-		logrus.Fatalf("Failed to load config from %s: %v", configPath, err)
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	spooled, ok := di.gateIngest(c)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(withUpstreamClass(withTrigger(c.Request.Context(), trigger), class), 30*time.Second)
+	defer cancel()
+	if spooled != nil {
+		ctx = withSpoolRequest(ctx, spooled)
 	}
 
-	// Create data ingestor
-	ingestor := NewDataIngestor(config)
+	cycle := di.RunCycle(ctx)
+	result, err := cycle.ingestResult()
+	if errors.Is(err, ErrNoData) {
+		c.Status(http.StatusNoContent)
+		return
+	}
+	if errors.Is(err, ErrNotConnected) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": "RabbitMQ is not connected, data was not published; retry once the connection is ready",
+			"state": di.ConnectionState().String(),
+		})
+		return
+	}
+	if errors.Is(err, ErrCircuitOpen) || errors.Is(err, ErrThrottled) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if errors.Is(err, ErrUpstreamRateLimited) {
+		c.JSON(http.StatusTooManyRequests, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
 
-	// Connect to RabbitMQ
-	if err := ingestor.ConnectToRabbitMQ(); err != nil {
-		logrus.Fatalf("Failed to connect to RabbitMQ: %v", err)
+	response := gin.H{
+		"message":         "Data ingested successfully",
+		"data":            result.Data,
+		"message_ids":     result.MessageIDs,
+		"correlation_ids": result.CorrelationIDs,
+		"status":          cycle.Status,
+		"trigger":         cycle.Trigger,
+		"locations":       cycle.Locations,
+		"summary":         cycle.Summary,
 	}
-	defer ingestor.Close()
+	if len(result.SourceErrors) > 0 {
+		response["source_errors"] = result.SourceErrors
+	}
+	if len(cycle.Gaps) > 0 {
+		response["gaps"] = cycle.Gaps
+	}
+	for _, location := range cycle.Locations {
+		if location.Coalesced != "" {
+			response["coalesced"] = true
+		}
+	}
+	if spooled != nil {
+		// Nothing went to RabbitMQ yet
+		response["message"] = "Data fetched and spooled, it is published once RabbitMQ is connected"
+		response["behavior"] = gateSpooled
+		response["spool"] = gin.H{
+			"positions": spooled.spooled(),
+			"pending":   di.spool.pending(),
+		}
+		c.JSON(http.StatusAccepted, response)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
 
-	// Setup HTTP server
-	router := setupRoutes(ingestor)
+// Run serves HTTP on listener and runs the ingestion loop until ctx is
+// cancelled or a shutdown is requested over the admin API. Both paths perform
+// the same drain sequence: stop polling, wait for the in-flight cycles, stop
+// the HTTP server and close the broker connection.
+func (di *DataIngestor) Run(ctx context.Context, listener net.Listener) error {
+	return di.run(ctx, listener).err
+}
+
+// run is Run returning how the run ended, which maps to the exit status
+func (di *DataIngestor) run(ctx context.Context, listener net.Listener) *ShutdownReport {
+	report := &ShutdownReport{StartedAt: di.started}
+	conns := newConnTracker()
 	server := &http.Server{
-		Addr:    config.Server.Host + ":" + config.Server.Port,
-		Handler: router,
+		Handler:   setupRoutes(di),
+		ConnState: conns.track,
 	}
 
-	// Start HTTP server in goroutine
+	serverErr := make(chan error, 1)
 	go func() {
-		ingestor.logger.WithField("addr", server.Addr).Info("Starting HTTP server")
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			ingestor.logger.Fatalf("Failed to start server: %v", err)
+		di.logger.WithField("addr", listener.Addr().String()).Info("Starting HTTP server")
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			serverErr <- err
 		}
 	}()
 
-	// Start data ingestion in goroutine
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	stopIngestion := di.startWorkers()
+	di.startTenants()
+	if di.memory != nil {
+		guardCtx, stopGuard := context.WithCancel(ctx)
+		defer stopGuard()
+		go di.memory.run(guardCtx)
+	}
+	if di.resources != nil {
+		guardCtx, stopGuard := context.WithCancel(ctx)
+		defer stopGuard()
+		go di.resources.run(guardCtx)
+	}
 
-	go ingestor.StartIngestion(ctx)
+	select {
+	case <-ctx.Done():
+	case delay := <-di.shutdown.requested:
+		if delay > 0 {
+			di.logger.WithField("delay", delay.String()).Info("Shutdown requested, waiting before drain")
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+			}
+		}
+	case report.err = <-serverErr:
+		di.logger.WithError(report.err).Error("HTTP server failed")
+	}
 
-	// Wait for interrupt signal
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-	<-quit
+	di.logger.Info("Shutting down server...")
+	di.lifecycle.stopping()
 
-	ingestor.logger.Info("Shutting down server...")
+	// Stop polling and wait for the in-flight cycles
+	stopIngestion()
 
-	// Cancel ingestion context
-	cancel()
+	// Disconnect stream clients, which would otherwise keep the server busy,
+	// after telling them why
+	if clients := di.stream.Close(); clients > 0 {
+		di.logger.WithField("stream_clients", clients).Info("Stream clients notified of shutdown")
+	}
+	di.logTail.Close()
+	di.stopTenants()
 
-	// Shutdown HTTP server
-	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
+	// Shutdown HTTP server; responses already being written are completed
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), di.drainTimeout)
 	defer shutdownCancel()
+	if err := di.drainServer(shutdownCtx, server, conns); err != nil {
+		report.DrainForced, report.ForcedConnections = true, conns.active()
+	}
+	// Once nothing increments the counters any more
+	di.saveMetrics()
+
+	report.Messages = di.drainConfirms()
+	report.Messages.Spooled = di.spool.pending()
+	report.InterruptedJobs = di.backfill.open()
+	di.closeTenants()
+	di.Close()
+	di.finishRun(report)
+	return report
+}
+
+// startWorkers starts the ingestion loop and the background tasks of the
+// pipeline. The returned function stops them and waits for the in-flight
+// cycles.
+func (di *DataIngestor) startWorkers() (stop func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var ingestion sync.WaitGroup
+	ingestion.Add(1)
+	go func() {
+		defer ingestion.Done()
+		di.StartIngestion(ctx)
+	}()
+
+	if di.enricher != nil {
+		go di.enricher.Watch(ctx, time.Duration(di.config.Enrichment.ReloadInterval))
+	}
+	if di.notifier != nil {
+		go di.notifier.Run(ctx)
+	}
+	if di.partitions != nil {
+		go di.declarePartitionsAhead(ctx)
+	}
+	if di.backpressure != nil {
+		go di.probeQueueDepth(ctx)
+	}
+	if di.health != nil {
+		ingestion.Add(1)
+		go func() {
+			defer ingestion.Done()
+			di.health.run(ctx)
+		}()
+	}
+	if di.report != nil {
+		go di.report.run(ctx)
+	}
+	if di.backfill != nil {
+		ingestion.Add(1)
+		go func() {
+			defer ingestion.Done()
+			di.backfill.run(ctx)
+		}()
+	}
+	if di.discovery != nil {
+		// Stops and starts pollers
+		ingestion.Add(1)
+		go func() {
+			defer ingestion.Done()
+			di.discovery.run(ctx)
+		}()
+	}
+	if di.spool != nil {
+		ingestion.Add(1)
+		go func() {
+			defer ingestion.Done()
+			di.runSpool(ctx)
+		}()
+	}
+	if di.maintenance != nil {
+		// Runs the catch-up cycle when a window ends
+		ingestion.Add(1)
+		go func() {
+			defer ingestion.Done()
+			di.maintenance.run(ctx)
+		}()
+	}
+	if di.config.MetricsSnapshot.StateFile != "" {
+		go di.snapshotMetrics(ctx)
+	}
+	if di.aggregates != nil {
+		go di.aggregates.run(ctx)
+	}
+	go di.superviseConnection(ctx)
+	if di.secrets != nil {
+		go di.secrets.watch(ctx)
+	}
+	if di.archive != nil {
+		go di.archive.run(ctx)
+	}
+	go di.announceReady(ctx)
+	if di.lifecycle.watchdogInterval() > 0 {
+		go di.runWatchdog(ctx)
+	}
+
+	return func() {
+		cancel()
+		// Cycles outlive ctx to drain; the ones waiting for a token give up
+		di.upstreamLimit.close()
+		ingestion.Wait()
+	}
+}
+
+// subcommands run instead of the service when named as the first argument
+var subcommands = map[string]func(ctx context.Context, args []string) error{
+	"replay":           runReplay,
+	"verify":           runVerify,
+	"consume":          runConsume,
+	"migrate-queue":    runMigrateQueue,
+	"ingest-once":      runIngestOnce,
+	"keygen":           runKeygen,
+	"print-config":     runPrintConfig,
+	"validate-config":  runValidateConfig,
+	"verify-contracts": runVerifyContracts,
+}
 
-	if err := server.Shutdown(shutdownCtx); err != nil {
-		ingestor.logger.Errorf("Server forced to shutdown: %v", err)
+func main() {
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer stop()
+			if err := run(ctx, os.Args[2:]); err != nil {
+				logrus.Fatalf("%s failed: %v", os.Args[1], err)
+			}
+			return
+		}
 	}
+	os.Exit(serve(os.Args[1:]))
+}
+
+// serve runs the service and returns its exit status
+func serve(args []string) int {
+	flags := flag.NewFlagSet("data-ingestor", flag.ExitOnError)
+	configFlag := flags.String("config", "config.yaml", "path to the config file")
+	profile := flags.String("profile", os.Getenv(profileEnv), "config profile to apply, default $"+profileEnv)
+	resetCursor := flags.Bool("reset-cursor", false, "forget the incremental fetch cursors before starting")
+	systemdNotify := flags.Bool("systemd-notify", false, "send sd_notify messages to systemd, like daemon.systemd_notify")
+	windowsService := flags.Bool("windows-service", false, "run under the Windows service manager, like daemon.windows_service")
+	debug := flags.Bool("debug", false, "serve the /debug endpoints, like debug.enabled")
+	replayDir, replayTiming := replayFlags(flags)
+	flags.Parse(args)
+	configPath := *configFlag
 
-	ingestor.logger.Info("Server exited")
+	// Load configuration
+	config, err := LoadConfigProfile(configPath, *profile)
+	if err != nil {
+		logrus.Errorf("Failed to load config from %s: %v", configPath, err)
+		return exitCodeFailed
+	}
+	config.Daemon.SystemdNotify = config.Daemon.SystemdNotify || *systemdNotify
+	config.Daemon.WindowsService = config.Daemon.WindowsService || *windowsService
+	config.Debug.Enabled = config.Debug.Enabled || *debug
+	applyReplayFlags(config, *replayDir, *replayTiming)
+
+	// Create data ingestor
+	ingestor := NewDataIngestor(config)
+	defer ingestor.crashOnPanic("main")
+
+	if *resetCursor && ingestor.cursors != nil {
+		if err := ingestor.cursors.reset(""); err != nil {
+			ingestor.logger.Errorf("Failed to reset cursors: %v", err)
+			return exitCodeFailed
+		}
+		ingestor.logger.Warn("Cursors reset, fetching the lookback window")
+	}
+
+	if err := ingestor.startDependencies(); err != nil {
+		ingestor.logger.Error(err.Error())
+		ingestor.Close()
+		return ingestor.startupFailed(err).ExitCode
+	}
+
+	// Start the tenants; one that fails is disabled, not fatal
+	ingestor.SetupTenants()
+
+	listener, err := net.Listen("tcp", config.Server.Host+":"+config.Server.Port)
+	if err != nil {
+		err = fmt.Errorf("failed to start server: %w", err)
+		ingestor.logger.Error(err.Error())
+		ingestor.closeTenants()
+		ingestor.Close()
+		return ingestor.startupFailed(err).ExitCode
+	}
+
+	// Stop on interrupt signal
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	// Reload location metadata, the log levels and the upstream targets on
+	// SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if ingestor.enricher != nil {
+				if _, err := ingestor.enricher.Reload(); err != nil {
+					ingestor.logger.WithError(err).Error("Failed to reload location metadata")
+				}
+			}
+			reloaded, err := LoadConfigProfile(configPath, *profile)
+			if err == nil {
+				ingestor.logLevels.apply(reloaded.Logging)
+				ingestor.reloadFeatures(reloaded)
+				err = ingestor.reloadUpstreams(reloaded)
+				ingestor.reloadSchema()
+			}
+			if err != nil {
+				ingestor.logger.WithError(err).Error("Failed to reload the upstream config")
+			}
+		}
+	}()
+
+	if config.Daemon.WindowsService {
+		var report *ShutdownReport
+		run := func(ctx context.Context) error {
+			report = ingestor.run(ctx, listener)
+			return report.err
+		}
+		handled, err := runService(config.Daemon.serviceName(), run)
+		if handled {
+			if report == nil {
+				ingestor.logger.Errorf("Service failed: %v", err)
+				return exitCodeFailed
+			}
+			return report.ExitCode
+		}
+		if err != nil {
+			ingestor.logger.WithError(err).Warn("Running in the foreground")
+		}
+	}
+
+	return ingestor.run(ctx, listener).ExitCode
+}
+
+// startDependencies loads the location metadata, resolves the upstream
+// credentials and connects to Pub/Sub and RabbitMQ
+func (di *DataIngestor) startDependencies() error {
+	if err := di.LoadEnrichment(); err != nil {
+		return fmt.Errorf("failed to load enrichment: %w", err)
+	}
+	if err := di.ConfigureAuth(); err != nil {
+		return fmt.Errorf("failed to configure upstream auth: %w", err)
+	}
+	if err := di.ConnectPubSub(context.Background()); err != nil {
+		return fmt.Errorf("failed to connect to Pub/Sub: %w", err)
+	}
+	if err := di.ConnectToRabbitMQ(); err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	return nil
 }
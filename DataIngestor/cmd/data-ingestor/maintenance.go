@@ -0,0 +1,397 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMaintenanceCheckInterval = time.Minute
+	defaultMaintenanceTimeout       = 5 * time.Second
+	// maxMaintenanceBody bounds the status response that is read
+	maxMaintenanceBody = 64 << 10
+)
+
+// States of the upstream in GET /ingestion/status
+const (
+	upstreamOperational = "operational"
+	upstreamMaintenance = "maintenance"
+)
+
+// Results of a status check
+const (
+	statusCheckOK          = "ok"
+	statusCheckMaintenance = "maintenance"
+	statusCheckFailed      = "failed"
+	statusCheckLimited     = "rate_limited"
+)
+
+// maintenanceHeader carries until when the upstream announced maintenance
+// on GET /weather/latest while it lasts
+const maintenanceHeader = "X-Upstream-Maintenance-Until"
+
+// MaintenanceConfig checks the status endpoint where the upstream announces
+// planned maintenance, {"state": "maintenance", "until": "<RFC 3339>"}
+type MaintenanceConfig struct {
+	// StatusURL is an http(s) URL or a path on api.base_url; without it the
+	// status is not checked
+	StatusURL string `yaml:"status_url"`
+	// CheckInterval is how often the status is fetched, 1m by default
+	CheckInterval Duration `yaml:"check_interval"`
+	// Timeout bounds one status request, 5s by default
+	Timeout Duration `yaml:"timeout"`
+	// Backfill creates a backfill job over the window of every location
+	// once maintenance ends. It needs backfill.enabled.
+	Backfill bool `yaml:"backfill"`
+}
+
+func (c MaintenanceConfig) enabled() bool {
+	return c.StatusURL != ""
+}
+
+func (c MaintenanceConfig) Validate(baseURL string) error {
+	if !c.enabled() {
+		return nil
+	}
+	if err := validateEndpointURL("api.maintenance.status_url", c.StatusURL, baseURL); err != nil {
+		return err
+	}
+	if c.CheckInterval < 0 || c.Timeout < 0 {
+		return fmt.Errorf("api.maintenance: check_interval and timeout must not be negative")
+	}
+	return nil
+}
+
+func (c MaintenanceConfig) checkInterval() time.Duration {
+	if c.CheckInterval > 0 {
+		return time.Duration(c.CheckInterval)
+	}
+	return defaultMaintenanceCheckInterval
+}
+
+func (c MaintenanceConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return defaultMaintenanceTimeout
+}
+
+// MaintenanceWindow is a maintenance of the upstream, from when it was
+// first reported to when it ended
+type MaintenanceWindow struct {
+	Since time.Time `json:"since"`
+	// Until is the end the upstream announced, if it did
+	Until *time.Time `json:"until,omitempty"`
+	Ended *time.Time `json:"ended,omitempty"`
+}
+
+// maintenanceWatch checks the status endpoint of the upstream and tracks
+// its maintenance windows. Polling is suspended while a window is open.
+type maintenanceWatch struct {
+	di     *DataIngestor
+	config MaintenanceConfig
+	url    string
+
+	mu     sync.Mutex
+	window *MaintenanceWindow
+	last   *MaintenanceWindow
+	// resuming holds polling back from when a window ends until the
+	// catch-up cycle is done
+	resuming  bool
+	checkedAt time.Time
+	err       error
+}
+
+func newMaintenanceWatch(di *DataIngestor, config MaintenanceConfig) *maintenanceWatch {
+	if !config.enabled() {
+		return nil
+	}
+	return &maintenanceWatch{di: di, config: config, url: resolveEndpointURL(config.StatusURL, di.config.API.BaseURL)}
+}
+
+// active reports whether the upstream is in maintenance: it said so and
+// the end it announced has not passed
+func (m *maintenanceWatch) active() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.openLocked(time.Now())
+}
+
+// holdsPolling reports whether the pollers skip their cycles: the upstream
+// is in maintenance or the catch-up cycle after it has not finished
+func (m *maintenanceWatch) holdsPolling() bool {
+	if m == nil {
+		return false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.resuming || m.openLocked(time.Now())
+}
+
+// openLocked reports whether the window is open at now. Callers hold mu.
+func (m *maintenanceWatch) openLocked(now time.Time) bool {
+	return m.window != nil && (m.window.Until == nil || now.Before(*m.window.Until))
+}
+
+// until returns the end of the open window, zero when none was announced
+func (m *maintenanceWatch) until() (time.Time, bool) {
+	if m == nil {
+		return time.Time{}, false
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.openLocked(time.Now()) {
+		return time.Time{}, false
+	}
+	if m.window.Until == nil {
+		return time.Time{}, true
+	}
+	return *m.window.Until, true
+}
+
+// upstreamStatus is the body of the status endpoint
+type upstreamStatus struct {
+	State string `json:"state"`
+	Until string `json:"until"`
+}
+
+// fetch gets the status of the upstream, a call of the health class of the
+// upstream rate limit. until is zero when the upstream announced no end.
+func (m *maintenanceWatch) fetch(ctx context.Context) (maintenance bool, until time.Time, err error) {
+	ctx = withUpstreamClass(ctx, upstreamHealth)
+	if err := m.di.upstreamLimit.wait(ctx, upstreamHealth); err != nil {
+		return false, time.Time{}, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.config.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url, nil)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	key, err := m.di.apiKey()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Api-Key", key)
+	m.di.tagRequest(req)
+	req = m.di.decorateRequest(req)
+	resp, err := m.di.httpClient.Do(req)
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, time.Time{}, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMaintenanceBody))
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	var status upstreamStatus
+	if err := json.Unmarshal(body, &status); err != nil {
+		return false, time.Time{}, fmt.Errorf("failed to unmarshal status: %w", err)
+	}
+	if status.State == "" {
+		return false, time.Time{}, fmt.Errorf("status has no state")
+	}
+	if !strings.EqualFold(status.State, upstreamMaintenance) {
+		return false, time.Time{}, nil
+	}
+	if status.Until != "" {
+		if until, err = time.Parse(time.RFC3339, status.Until); err != nil {
+			return false, time.Time{}, fmt.Errorf("until must be an RFC 3339 time, got %q", status.Until)
+		}
+	}
+	return true, until, nil
+}
+
+// check fetches the status once and opens, extends or closes the window.
+// A failed check counts as operational, so a broken status endpoint never
+// holds up polling. A check the upstream rate limit turns away leaves the
+// window as it is. ended is the window that closed with this check.
+func (m *maintenanceWatch) check(ctx context.Context) (ended *MaintenanceWindow) {
+	maintenance, until, err := m.fetch(ctx)
+	logger := m.di.log(logFetch).WithField("url", m.url)
+	if errors.Is(err, ErrUpstreamRateLimited) {
+		m.di.metrics.UpstreamStatusChecks.WithLabelValues(statusCheckLimited).Inc()
+		logger.WithError(err).Debug("Upstream status check skipped")
+		return nil
+	}
+	result := statusCheckOK
+	switch {
+	case err != nil:
+		result = statusCheckFailed
+	case maintenance:
+		result = statusCheckMaintenance
+	}
+	m.di.metrics.UpstreamStatusChecks.WithLabelValues(result).Inc()
+
+	now := time.Now()
+	m.mu.Lock()
+	failing := m.err != nil
+	m.checkedAt, m.err = now, err
+	if maintenance && (until.IsZero() || now.Before(until)) {
+		opened := m.window == nil
+		if opened {
+			m.window = &MaintenanceWindow{Since: now}
+		}
+		m.window.Until = nil
+		if !until.IsZero() {
+			m.window.Until = &until
+		}
+		window := *m.window
+		m.mu.Unlock()
+		m.di.metrics.UpstreamMaintenance.Set(1)
+		if opened {
+			entry := logger
+			if window.Until != nil {
+				entry = entry.WithField("until", *window.Until)
+			}
+			entry.Warn("Upstream in maintenance, polling suspended")
+		}
+		return nil
+	}
+	if m.window != nil {
+		ended = m.closeLocked(now)
+	}
+	m.mu.Unlock()
+	m.di.metrics.UpstreamMaintenance.Set(0)
+	if err != nil && !failing {
+		logger.WithError(err).Warn("Upstream status check failed, assuming it is operational")
+	}
+	return ended
+}
+
+// closeLocked ends the open window at now or at the end it announced,
+// whichever was first, and holds polling back until resume is done. Callers
+// hold mu.
+func (m *maintenanceWatch) closeLocked(now time.Time) *MaintenanceWindow {
+	end := now
+	if m.window.Until != nil && m.window.Until.Before(now) {
+		end = *m.window.Until
+	}
+	m.window.Ended = &end
+	ended := *m.window
+	m.last, m.window = &ended, nil
+	m.resuming = true
+	return &ended
+}
+
+// run checks the status every check interval, and when the announced end
+// of a window comes first, at that end, until ctx is cancelled
+func (m *maintenanceWatch) run(ctx context.Context) {
+	for {
+		if ended := m.check(ctx); ended != nil {
+			m.resume(ctx, *ended)
+		}
+		wait := m.config.checkInterval()
+		if until, ok := m.until(); ok && !until.IsZero() {
+			if left := time.Until(until); left < wait {
+				wait = left
+			}
+		}
+		if !waitFor(ctx, wait) {
+			return
+		}
+	}
+}
+
+// resume runs a cycle over every location right away once a window ended,
+// before the pollers take over again, and with api.maintenance.backfill
+// creates a backfill job over the window of every location
+func (m *maintenanceWatch) resume(ctx context.Context, window MaintenanceWindow) {
+	di := m.di
+	defer func() {
+		m.mu.Lock()
+		m.resuming = false
+		m.mu.Unlock()
+	}()
+	di.log(logFetch).WithFields(logrus.Fields{
+		"since": window.Since,
+		"ended": *window.Ended,
+	}).Info("Upstream maintenance ended, polling resumed")
+
+	switch {
+	case !m.config.Backfill || di.backfill == nil || !window.Since.Before(*window.Ended):
+	case di.resources.rejects(resourceActionRejectBackfills):
+		di.log(logIngestion).Warn("Backfill of the maintenance window rejected by the resource guard")
+	default:
+		options := di.backfill.withDefaults(backfillOptions{})
+		for _, src := range di.currentSources() {
+			logger := di.log(logIngestion).WithField("location", src.name)
+			if err := di.backfill.validate(window.Since, *window.Ended, options); err != nil {
+				logger.WithError(err).Warn("Backfill of the maintenance window rejected")
+				continue
+			}
+			job := di.backfill.create(src.name, window.Since, *window.Ended, options)
+			logger.WithField("job", job.ID).Info("Backfill of the maintenance window created")
+		}
+	}
+	result := di.RunCycle(context.WithoutCancel(withTrigger(ctx, triggerPoll)))
+	for _, outcome := range result.Locations {
+		di.logOutcome(outcome)
+	}
+}
+
+// MaintenanceStatus is the maintenance entry of GET /ingestion/status
+type MaintenanceStatus struct {
+	// State is maintenance or operational
+	State  string             `json:"state"`
+	Window *MaintenanceWindow `json:"window,omitempty"`
+	// LastWindow is the latest window that ended
+	LastWindow *MaintenanceWindow `json:"last_window,omitempty"`
+	CheckedAt  *time.Time         `json:"checked_at,omitempty"`
+	// Error is why the latest check failed, which counts as operational
+	Error string `json:"error,omitempty"`
+}
+
+func (m *maintenanceWatch) status() *MaintenanceStatus {
+	if m == nil {
+		return nil
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := &MaintenanceStatus{State: upstreamOperational, LastWindow: m.last}
+	if m.openLocked(time.Now()) {
+		window := *m.window
+		status.State, status.Window = upstreamMaintenance, &window
+	}
+	if !m.checkedAt.IsZero() {
+		checkedAt := m.checkedAt
+		status.CheckedAt = &checkedAt
+	}
+	if m.err != nil {
+		status.Error = m.err.Error()
+	}
+	return status
+}
+
+// markMaintenance adds the announced end of the maintenance to a response
+// while it lasts, "unknown" when none was announced, and reports whether
+// the upstream is in maintenance
+func (di *DataIngestor) markMaintenance(c *gin.Context) bool {
+	until, ok := di.maintenance.until()
+	if !ok {
+		return false
+	}
+	value := "unknown"
+	if !until.IsZero() {
+		value = until.UTC().Format(time.RFC3339)
+	}
+	c.Header(maintenanceHeader, value)
+	return true
+}
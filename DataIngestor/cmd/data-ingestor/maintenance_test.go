@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statusUpstream serves GET /status with the body it was last set to
+type statusUpstream struct {
+	server *httptest.Server
+	checks atomic.Int32
+
+	mu     sync.Mutex
+	status int
+	body   string
+}
+
+func newStatusUpstream(t *testing.T, body string) *statusUpstream {
+	t.Helper()
+	upstream := &statusUpstream{status: http.StatusOK, body: body}
+	upstream.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.checks.Add(1)
+		upstream.mu.Lock()
+		status, body := upstream.status, upstream.body
+		upstream.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.server.Close)
+	return upstream
+}
+
+func (u *statusUpstream) set(status int, body string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.status, u.body = status, body
+}
+
+func maintenanceBody(until time.Time) string {
+	if until.IsZero() {
+		return `{"state":"maintenance"}`
+	}
+	return fmt.Sprintf(`{"state":"maintenance","until":%q}`, until.UTC().Format(time.RFC3339Nano))
+}
+
+func TestMaintenance_SuspendsPollingAndCatchesUp(t *testing.T) {
+	status := newStatusUpstream(t, maintenanceBody(time.Time{}))
+	ingestor, channel, berlinHits, _ := newTwoLocationIngestor(t, APIConfig{
+		PollInterval:    Duration(10 * time.Millisecond),
+		MaxPollInterval: Duration(10 * time.Millisecond),
+		Maintenance:     MaintenanceConfig{StatusURL: status.server.URL + "/status", CheckInterval: Duration(20 * time.Millisecond)},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+	require.Nil(t, ingestor.maintenance.check(ctx))
+	require.True(t, ingestor.maintenance.active())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamMaintenance))
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		ingestor.StartIngestion(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		ingestor.maintenance.run(ctx)
+	}()
+	require.Eventually(t, func() bool { return status.checks.Load() >= 4 }, 5*time.Second, 5*time.Millisecond)
+	assert.Zero(t, atomic.LoadInt32(berlinHits), "nothing is polled during maintenance")
+
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ingestion/status", nil))
+	var body struct {
+		Maintenance MaintenanceStatus `json:"maintenance"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, upstreamMaintenance, body.Maintenance.State)
+	require.NotNil(t, body.Maintenance.Window)
+	assert.Nil(t, body.Maintenance.Window.Until)
+
+	status.set(http.StatusOK, `{"state":"operational"}`)
+	require.Eventually(t, func() bool { return len(channel.messages()) > 0 }, 5*time.Second, 5*time.Millisecond, "the catch-up cycle")
+	assert.False(t, ingestor.maintenance.active())
+	snapshot := ingestor.maintenance.status()
+	assert.Equal(t, upstreamOperational, snapshot.State)
+	require.NotNil(t, snapshot.LastWindow)
+	assert.NotNil(t, snapshot.LastWindow.Ended)
+	assert.Equal(t, 0.0, testutil.ToFloat64(ingestor.metrics.UpstreamMaintenance))
+}
+
+func TestMaintenance_EndsWhenUntilPasses(t *testing.T) {
+	until := time.Now().Add(100 * time.Millisecond)
+	// The status still says maintenance once the announced end is past
+	status := newStatusUpstream(t, maintenanceBody(until))
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{
+		Maintenance: MaintenanceConfig{StatusURL: status.server.URL + "/status", CheckInterval: Duration(time.Hour)},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.maintenance.run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	require.Eventually(t, ingestor.maintenance.active, 5*time.Second, time.Millisecond)
+	require.Eventually(t, func() bool { return ingestor.maintenance.status().LastWindow != nil }, 5*time.Second, 5*time.Millisecond,
+		"the watch wakes at until instead of the check interval")
+	assert.False(t, ingestor.maintenance.active())
+	last := ingestor.maintenance.status().LastWindow
+	assert.True(t, until.Equal(*last.Ended), "the window ends at until")
+	assert.Equal(t, int32(2), status.checks.Load())
+}
+
+func TestMaintenance_StatusFailuresAssumeOperational(t *testing.T) {
+	status := newStatusUpstream(t, maintenanceBody(time.Time{}))
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{
+		Maintenance: MaintenanceConfig{StatusURL: status.server.URL + "/status", Timeout: Duration(50 * time.Millisecond)},
+	})
+	checks := ingestor.metrics.UpstreamStatusChecks
+
+	for name, set := range map[string]func(){
+		"server error":  func() { status.set(http.StatusInternalServerError, `{"state":"maintenance"}`) },
+		"not json":      func() { status.set(http.StatusOK, `<html>down</html>`) },
+		"no state":      func() { status.set(http.StatusOK, `{}`) },
+		"invalid until": func() { status.set(http.StatusOK, `{"state":"maintenance","until":"soon"}`) },
+	} {
+		status.set(http.StatusOK, maintenanceBody(time.Time{}))
+		ingestor.maintenance.check(context.Background())
+		require.True(t, ingestor.maintenance.active(), name)
+
+		set()
+		ended := ingestor.maintenance.check(context.Background())
+		assert.NotNil(t, ended, name)
+		assert.False(t, ingestor.maintenance.active(), name)
+		assert.NotEmpty(t, ingestor.maintenance.status().Error, name)
+	}
+	assert.Equal(t, 4.0, testutil.ToFloat64(checks.WithLabelValues(statusCheckFailed)))
+	assert.Equal(t, 4.0, testutil.ToFloat64(checks.WithLabelValues(statusCheckMaintenance)))
+
+	// An endpoint that hangs is given up on after the timeout
+	hang := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	t.Cleanup(hang.Close)
+	ingestor.maintenance.url = hang.URL
+	start := time.Now()
+	ingestor.maintenance.check(context.Background())
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.False(t, ingestor.maintenance.active())
+}
+
+func TestMaintenance_SuppressesFailureAlerts(t *testing.T) {
+	status := newStatusUpstream(t, maintenanceBody(time.Now().Add(time.Hour)))
+	ingestor, _, _, moscowHits := newTwoLocationIngestor(t, APIConfig{
+		RetryCount:     1,
+		RetryBackoff:   Duration(time.Millisecond),
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: Duration(time.Minute)},
+		Maintenance:    MaintenanceConfig{StatusURL: status.server.URL + "/status"},
+	})
+	ingestor.maintenance.check(context.Background())
+	require.True(t, ingestor.maintenance.active())
+
+	// A manual cycle still runs, its failures are expected
+	result := ingestor.RunCycle(withTrigger(context.Background(), triggerManual))
+	assert.True(t, result.Summary.Maintenance)
+	assert.Equal(t, 1, result.Summary.Failed)
+	assert.Equal(t, "closed", result.Summary.BreakerState)
+	assert.Equal(t, 0.0, testutil.ToFloat64(ingestor.metrics.UpstreamFailures.WithLabelValues("moscow")))
+	outcome := ingestor.ingestOnce(context.Background(), ingestor.sources[1])
+	assert.Equal(t, outcomeFailed, outcome.Outcome, "not skipped by an open breaker")
+	assert.Equal(t, int32(4), atomic.LoadInt32(moscowHits), "two attempts each")
+
+	// The readings go stale as expected
+	router := setupRoutes(ingestor)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/weather/latest/moscow-1", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = httptest.NewRecorder()
+	ingestor.latest.update(defaultSourceName, WeatherData{{Type: "energy", Name: "berlin-1"}}, time.Now().Add(-time.Hour))
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/weather/latest/berlin-1", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	until, _ := ingestor.maintenance.until()
+	assert.Equal(t, until.UTC().Format(time.RFC3339), w.Header().Get(maintenanceHeader))
+	assert.Contains(t, w.Body.String(), `"expected_gap":true`)
+
+	// Once it ends, failures count again
+	status.set(http.StatusOK, `{"state":"operational"}`)
+	ingestor.maintenance.check(context.Background())
+	ingestor.ingestOnce(context.Background(), ingestor.sources[1])
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamFailures.WithLabelValues("moscow")))
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/weather/latest/berlin-1", nil))
+	assert.Empty(t, w.Header().Get(maintenanceHeader))
+	assert.Contains(t, w.Body.String(), `"expected_gap":false`)
+}
+
+func TestMaintenance_UpstreamHealthCheck(t *testing.T) {
+	status := newStatusUpstream(t, maintenanceBody(time.Time{}))
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(down.Close)
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL:     down.URL,
+			Timeout:     Duration(time.Second),
+			Maintenance: MaintenanceConfig{StatusURL: status.server.URL + "/status"},
+		},
+		RabbitMQ:     RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:      LoggingConfig{Level: "panic"},
+		HealthChecks: HealthChecksConfig{Enabled: true, RabbitMQ: DependencyCheckConfig{Disabled: true}},
+	})
+	check := ingestor.health.checks[0]
+	require.Equal(t, dependencyUpstream, check.name)
+
+	ingestor.maintenance.check(context.Background())
+	ingestor.health.probe(context.Background(), check)
+	results, ready, degraded := ingestor.health.readiness()
+	assert.Equal(t, healthMaintenance, results[dependencyUpstream].Status)
+	assert.True(t, ready)
+	assert.False(t, degraded, "an announced maintenance does not degrade the service")
+
+	status.set(http.StatusOK, `{"state":"operational"}`)
+	ingestor.maintenance.check(context.Background())
+	ingestor.health.probe(context.Background(), check)
+	results, _, degraded = ingestor.health.readiness()
+	assert.Equal(t, healthFailing, results[dependencyUpstream].Status)
+	assert.True(t, degraded)
+}
+
+func TestMaintenance_BackfillsTheWindow(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	ingestor, _ := newBackfillIngestor(t, upstream.server.URL, filepath.Join(t.TempDir(), "backfill.json"))
+	status := newStatusUpstream(t, maintenanceBody(time.Time{}))
+	ingestor.maintenance = newMaintenanceWatch(ingestor, MaintenanceConfig{StatusURL: status.server.URL + "/status", Backfill: true})
+
+	ingestor.maintenance.check(context.Background())
+	status.set(http.StatusOK, `{"state":"operational"}`)
+	ended := ingestor.maintenance.check(context.Background())
+	require.NotNil(t, ended)
+	ingestor.maintenance.resume(context.Background(), *ended)
+
+	jobs := ingestor.backfill.list(backfillFilter{})
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "default", jobs[0].Location)
+	assert.Equal(t, ended.Since.UTC(), jobs[0].From)
+	assert.Equal(t, ended.Ended.UTC(), jobs[0].To)
+}
+
+func TestMaintenance_HoldsPollingUntilTheCatchUpIsDone(t *testing.T) {
+	status := newStatusUpstream(t, maintenanceBody(time.Time{}))
+	ingestor, channel, _, _ := newTwoLocationIngestor(t, APIConfig{
+		Maintenance: MaintenanceConfig{StatusURL: status.server.URL + "/status"},
+	})
+	require.Nil(t, ingestor.maintenance.check(context.Background()))
+	status.set(http.StatusOK, `{"state":"operational"}`)
+	ended := ingestor.maintenance.check(context.Background())
+	require.NotNil(t, ended)
+	assert.False(t, ingestor.maintenance.active())
+	assert.True(t, ingestor.maintenance.holdsPolling(), "the pollers wait for the catch-up cycle")
+
+	ingestor.maintenance.resume(context.Background(), *ended)
+	assert.NotEmpty(t, channel.messages(), "the catch-up cycle")
+	assert.False(t, ingestor.maintenance.holdsPolling())
+}
+
+func TestMaintenance_RateLimitedChecksKeepTheWindow(t *testing.T) {
+	status := newStatusUpstream(t, maintenanceBody(time.Time{}))
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{
+		Maintenance: MaintenanceConfig{StatusURL: status.server.URL + "/status"},
+	})
+	require.Nil(t, ingestor.maintenance.check(context.Background()))
+	ingestor.upstreamLimit = newUpstreamLimiter(UpstreamRateLimitConfig{Rate: 0.001, Burst: 1}, ingestor.metrics)
+	ingestor.maintenance.check(context.Background())
+	checks := status.checks.Load()
+
+	assert.Nil(t, ingestor.maintenance.check(context.Background()))
+	assert.Equal(t, checks, status.checks.Load(), "the status endpoint is not called")
+	assert.True(t, ingestor.maintenance.active(), "a skipped check does not end the window")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamStatusChecks.WithLabelValues(statusCheckLimited)))
+}
+
+func TestMaintenance_ValidatesTheBackfillOfTheWindow(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	ingestor, _ := newBackfillIngestor(t, upstream.server.URL, filepath.Join(t.TempDir(), "backfill.json"))
+	status := newStatusUpstream(t, maintenanceBody(time.Time{}))
+	ingestor.maintenance = newMaintenanceWatch(ingestor, MaintenanceConfig{StatusURL: status.server.URL + "/status", Backfill: true})
+	ingestor.backfill.config.Order = orderNewestFirst
+	ingestor.ordering = newPublishOrder(PublishingConfig{Ordering: orderingPerLocation})
+
+	ingestor.maintenance.check(context.Background())
+	status.set(http.StatusOK, `{"state":"operational"}`)
+	ended := ingestor.maintenance.check(context.Background())
+	require.NotNil(t, ended)
+	ingestor.maintenance.resume(context.Background(), *ended)
+
+	assert.Empty(t, ingestor.backfill.list(backfillFilter{}), "newest_first is rejected with per-location ordering, as on POST /backfill")
+}
+
+func TestMaintenanceConfig_Validate(t *testing.T) {
+	for config, message := range map[*Config]string{
+		{API: APIConfig{Maintenance: MaintenanceConfig{StatusURL: "/status"}}}:                                                     "needs api.base_url",
+		{API: APIConfig{Maintenance: MaintenanceConfig{StatusURL: "ftp://status.example.com/"}}}:                                   "must be an http:// or https:// URL or a path",
+		{API: APIConfig{Maintenance: MaintenanceConfig{StatusURL: "https://status.example.com/", Timeout: Duration(-1)}}}:          "must not be negative",
+		{API: APIConfig{BaseURL: "https://api.example.com", Maintenance: MaintenanceConfig{StatusURL: "/status", Backfill: true}}}: "api.maintenance.backfill needs backfill.enabled",
+	} {
+		assert.ErrorContains(t, config.Validate(), message)
+	}
+	assert.NoError(t, (&Config{API: APIConfig{BaseURL: "https://api.example.com/v1/", Maintenance: MaintenanceConfig{StatusURL: "status"}}}).Validate())
+	assert.Equal(t, "https://api.example.com/status", resolveEndpointURL("/status", "https://api.example.com/v1/readings"))
+	assert.Equal(t, "https://status.example.com/", resolveEndpointURL("https://status.example.com/", "https://api.example.com"))
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultMemoryGuardCheckInterval = 5 * time.Second
+	// memoryGuardRingSize is what the stream buffer shrinks to, enough for a
+	// default GET /recent
+	memoryGuardRingSize = defaultRecentLimit
+
+	// Degradation steps, in the order they are taken
+	memoryStepShrinkBuffers = "shrink_buffers"
+	memoryStepDropStreams   = "drop_streams"
+	memoryStepShedQueues    = "shed_queues"
+	memoryStepPauseFetching = "pause_fetching"
+	memoryStepNone          = "none"
+
+	memoryStepEntered = "entered"
+	memoryStepLeft    = "left"
+)
+
+// errStreamShed is returned when subscribing while the memory guard sheds
+// stream clients
+var errStreamShed = errors.New("stream clients are shed while memory is low, retry later")
+
+// MemoryGuardConfig sheds load as the heap grows, so buffers filling up
+// during a broker outage degrade the service instead of getting it killed.
+// Each threshold enables one step; steps are taken in the order below and
+// undone in reverse.
+type MemoryGuardConfig struct {
+	// CheckInterval is how often the heap is sampled, 5s by default
+	CheckInterval Duration `yaml:"check_interval"`
+	// ShrinkBuffers shrinks the stream's recent readings buffer
+	ShrinkBuffers ByteSize `yaml:"shrink_buffers"`
+	// DropStreams disconnects /stream clients and rejects new ones
+	DropStreams ByteSize `yaml:"drop_streams"`
+	// ShedQueues empties the webhook delivery queues and drops new
+	// notifications
+	ShedQueues ByteSize `yaml:"shed_queues"`
+	// PauseFetching stops polling the upstream
+	PauseFetching ByteSize `yaml:"pause_fetching"`
+	// Hysteresis is how far below its threshold the heap must fall before a
+	// step is undone, 10% of the threshold by default
+	Hysteresis ByteSize `yaml:"hysteresis"`
+}
+
+func (c MemoryGuardConfig) enabled() bool {
+	return c.ShrinkBuffers > 0 || c.DropStreams > 0 || c.ShedQueues > 0 || c.PauseFetching > 0
+}
+
+// Validate checks that the thresholds rise in the order of the steps
+func (c MemoryGuardConfig) Validate() error {
+	if c.CheckInterval < 0 || c.Hysteresis < 0 {
+		return fmt.Errorf("memory_guard.check_interval and memory_guard.hysteresis must not be negative")
+	}
+	var last ByteSize
+	lastName := ""
+	for _, step := range c.thresholds() {
+		switch {
+		case step.threshold < 0:
+			return fmt.Errorf("memory_guard.%s must not be negative", step.name)
+		case step.threshold == 0:
+			continue
+		case step.threshold <= last:
+			return fmt.Errorf("memory_guard.%s (%s) must be above memory_guard.%s (%s)", step.name, step.threshold, lastName, last)
+		case c.Hysteresis >= step.threshold:
+			return fmt.Errorf("memory_guard.hysteresis must be below memory_guard.%s", step.name)
+		}
+		last, lastName = step.threshold, step.name
+	}
+	return nil
+}
+
+type memoryThreshold struct {
+	name      string
+	threshold ByteSize
+}
+
+func (c MemoryGuardConfig) thresholds() []memoryThreshold {
+	return []memoryThreshold{
+		{memoryStepShrinkBuffers, c.ShrinkBuffers},
+		{memoryStepDropStreams, c.DropStreams},
+		{memoryStepShedQueues, c.ShedQueues},
+		{memoryStepPauseFetching, c.PauseFetching},
+	}
+}
+
+// MemoryGuardStatus is the degradation state reported by /stats
+type MemoryGuardStatus struct {
+	// Level is the number of steps taken and Step the last of them
+	Level     int       `json:"level"`
+	Step      string    `json:"step"`
+	HeapBytes uint64    `json:"heap_bytes"`
+	CheckedAt time.Time `json:"checked_at,omitempty"`
+}
+
+// memoryStep is one configured degradation step
+type memoryStep struct {
+	name string
+	// the step is taken at threshold bytes and undone below recover
+	threshold uint64
+	recover   uint64
+	enter     func()
+	leave     func()
+}
+
+// memoryGuard samples the heap and takes or undoes degradation steps
+type memoryGuard struct {
+	interval time.Duration
+	steps    []memoryStep
+	// sample returns the heap in use; replaced in tests
+	sample  func() uint64
+	logger  *logrus.Logger
+	metrics *Metrics
+
+	// fetchPaused is set while pause_fetching is in effect
+	fetchPaused atomic.Bool
+
+	mu        sync.Mutex
+	level     int
+	heap      uint64
+	checkedAt time.Time
+}
+
+// newMemoryGuard returns nil unless a memory_guard threshold is set. The steps
+// act on the tenants too, whose heap they share.
+func (di *DataIngestor) newMemoryGuard() *memoryGuard {
+	config := di.config.MemoryGuard
+	if !config.enabled() {
+		return nil
+	}
+	g := &memoryGuard{
+		interval: time.Duration(config.CheckInterval),
+		sample:   heapInUse,
+		logger:   di.logger,
+		metrics:  di.metrics,
+	}
+	if g.interval <= 0 {
+		g.interval = defaultMemoryGuardCheckInterval
+	}
+	actions := map[string][2]func(){
+		memoryStepShrinkBuffers: {
+			func() {
+				di.eachIngestor(func(in *DataIngestor) { in.stream.resize(min(memoryGuardRingSize, in.config.Stream.bufferSize())) })
+			},
+			func() { di.eachIngestor(func(in *DataIngestor) { in.stream.resize(in.config.Stream.bufferSize()) }) },
+		},
+		memoryStepDropStreams: {
+			func() { di.eachIngestor(func(in *DataIngestor) { in.stream.shed(true) }) },
+			func() { di.eachIngestor(func(in *DataIngestor) { in.stream.shed(false) }) },
+		},
+		memoryStepShedQueues: {
+			func() { di.eachIngestor(func(in *DataIngestor) { in.notifier.shed(true) }) },
+			func() { di.eachIngestor(func(in *DataIngestor) { in.notifier.shed(false) }) },
+		},
+		memoryStepPauseFetching: {
+			func() { g.fetchPaused.Store(true) },
+			func() { g.fetchPaused.Store(false) },
+		},
+	}
+	for _, t := range config.thresholds() {
+		if t.threshold <= 0 {
+			continue
+		}
+		hysteresis := config.Hysteresis
+		if hysteresis == 0 {
+			hysteresis = t.threshold / 10
+		}
+		g.steps = append(g.steps, memoryStep{
+			name:      t.name,
+			threshold: uint64(t.threshold),
+			recover:   uint64(t.threshold - hysteresis),
+			enter:     actions[t.name][0],
+			leave:     actions[t.name][1],
+		})
+	}
+	return g
+}
+
+// eachIngestor calls fn for di and the running tenants
+func (di *DataIngestor) eachIngestor(fn func(*DataIngestor)) {
+	fn(di)
+	for _, t := range di.tenants {
+		if t.ingestor != nil {
+			fn(t.ingestor)
+		}
+	}
+}
+
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// run checks the heap every interval until ctx is cancelled
+func (g *memoryGuard) run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.check(now)
+		}
+	}
+}
+
+// check samples the heap, takes every step whose threshold it reached and
+// undoes, last first, those it fell far enough below
+func (g *memoryGuard) check(now time.Time) {
+	heap := g.sample()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.heap, g.checkedAt = heap, now
+
+	for g.level < len(g.steps) && heap >= g.steps[g.level].threshold {
+		step := g.steps[g.level]
+		step.enter()
+		g.level++
+		g.record(step, memoryStepEntered, heap).Warn("Memory guard shedding load")
+	}
+	for g.level > 0 && heap < g.steps[g.level-1].recover {
+		g.level--
+		step := g.steps[g.level]
+		step.leave()
+		g.record(step, memoryStepLeft, heap).Info("Memory guard restored load")
+	}
+	g.metrics.MemoryGuardLevel.Set(float64(g.level))
+}
+
+// record counts a step change and returns its log entry; mu must be held
+func (g *memoryGuard) record(step memoryStep, direction string, heap uint64) *logrus.Entry {
+	g.metrics.MemoryGuardSteps.WithLabelValues(step.name, direction).Inc()
+	threshold := step.threshold
+	if direction == memoryStepLeft {
+		threshold = step.recover
+	}
+	return g.logger.WithFields(logrus.Fields{
+		"step":       step.name,
+		"level":      g.level,
+		"heap_bytes": heap,
+		"threshold":  ByteSize(threshold).String(),
+	})
+}
+
+// Status returns the current degradation state
+func (g *memoryGuard) Status() *MemoryGuardStatus {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	status := &MemoryGuardStatus{Level: g.level, Step: memoryStepNone, HeapBytes: g.heap, CheckedAt: g.checkedAt}
+	if g.level > 0 {
+		status.Step = g.steps[g.level-1].name
+	}
+	return status
+}
+
+// pausesFetching reports whether polling is paused for memory
+func (g *memoryGuard) pausesFetching() bool {
+	return g != nil && g.fetchPaused.Load()
+}
+
+func (c StreamConfig) bufferSize() int {
+	if c.BufferSize > 0 {
+		return c.BufferSize
+	}
+	return defaultStreamBufferSize
+}
+
+// resize replaces the ring buffer with one of size entries, keeping the
+// newest readings that fit
+func (h *streamHub) resize(size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if size == len(h.ring) {
+		return
+	}
+	events := h.buffered()
+	if len(events) > size {
+		events = events[len(events)-size:]
+	}
+	ring := make([]streamEvent, size)
+	copy(ring, events)
+	h.ring, h.next, h.full = ring, len(events)%size, len(events) == size
+}
+
+// shed disconnects every client and rejects new ones until it is called with
+// false. Clients are sent the shutdown event, which tells them when to retry.
+func (h *streamHub) shed(shed bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.shedding = shed
+	if !shed {
+		return
+	}
+	for client := range h.clients {
+		client.shutdown = true
+		h.remove(client)
+		h.metrics.StreamDroppedClients.Inc()
+	}
+}
+
+// shed empties the delivery queues and drops new notifications, counted as
+// dropped, until it is called with false
+func (n *Notifier) shed(shed bool) {
+	if n == nil {
+		return
+	}
+	n.shedding.Store(shed)
+	if !shed {
+		return
+	}
+	for _, sub := range n.subscribers {
+		for drained := false; !drained; {
+			select {
+			case <-sub.queue:
+				sub.drop()
+			default:
+				drained = true
+			}
+		}
+	}
+}
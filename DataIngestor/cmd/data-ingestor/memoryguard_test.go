@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newMemoryGuardTestIngestor has every degradation step at 100, 200, 300 and
+// 400 bytes and a guard that reads the heap from the returned pointer
+func newMemoryGuardTestIngestor(t *testing.T) (*DataIngestor, *uint64) {
+	t.Helper()
+	config := &Config{
+		Logging:     LoggingConfig{Level: "panic"},
+		Subscribers: []SubscriberConfig{{Name: "hook", URL: "http://127.0.0.1:1/hook"}},
+		MemoryGuard: MemoryGuardConfig{
+			ShrinkBuffers: 100,
+			DropStreams:   200,
+			ShedQueues:    300,
+			PauseFetching: 400,
+			Hysteresis:    20,
+		},
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+	require.NotNil(t, ingestor.memory)
+	heap := new(uint64)
+	ingestor.memory.sample = func() uint64 { return *heap }
+	return ingestor, heap
+}
+
+func broadcastReadings(hub *streamHub, count int) {
+	data := make(WeatherData, count)
+	for i := range data {
+		data[i] = weatherReading(fmt.Sprintf("station-%d", i), map[string]interface{}{"temperature": 1.0})
+	}
+	hub.Broadcast("cycle", triggerPoll, data)
+}
+
+func TestMemoryGuard_ShedsInOrderAndRecoversInReverse(t *testing.T) {
+	ingestor, heap := newMemoryGuardTestIngestor(t)
+	guard := ingestor.memory
+	broadcastReadings(ingestor.stream, 500)
+	client, _, err := ingestor.stream.subscribe("", "")
+	require.NoError(t, err)
+	ingestor.notifier.Notify(WeatherData{weatherReading("moscow", nil)})
+
+	check := func(bytes uint64) {
+		*heap = bytes
+		guard.check(time.Now())
+	}
+
+	check(50)
+	assert.Equal(t, memoryStepNone, guard.Status().Step)
+
+	check(250)
+	assert.Equal(t, 2, guard.Status().Level)
+	assert.Equal(t, memoryStepDropStreams, guard.Status().Step)
+	assert.Len(t, ingestor.stream.ring, memoryGuardRingSize)
+	assert.Len(t, ingestor.stream.recent("", "", 1000), memoryGuardRingSize, "the newest readings are kept")
+	_, ok := <-client.events
+	assert.False(t, ok, "connected clients are dropped")
+	assert.True(t, client.shutdown)
+	_, _, err = ingestor.stream.subscribe("", "")
+	assert.ErrorIs(t, err, errStreamShed)
+	assert.Equal(t, 1, len(ingestor.notifier.subscribers[0].queue), "webhooks are not shed yet")
+
+	check(450)
+	assert.Equal(t, memoryStepPauseFetching, guard.Status().Step)
+	assert.True(t, guard.pausesFetching())
+	assert.Empty(t, ingestor.notifier.subscribers[0].queue)
+	ingestor.notifier.Notify(WeatherData{weatherReading("moscow", nil)})
+	assert.Empty(t, ingestor.notifier.subscribers[0].queue)
+	assert.Equal(t, int64(2), ingestor.notifier.Stats()["hook"].Dropped)
+
+	// Recovery waits until the heap is the hysteresis below a threshold
+	check(390)
+	assert.Equal(t, 4, guard.Status().Level)
+	check(370)
+	assert.Equal(t, memoryStepShedQueues, guard.Status().Step)
+	assert.False(t, guard.pausesFetching())
+
+	check(0)
+	assert.Equal(t, 0, guard.Status().Level)
+	assert.Len(t, ingestor.stream.ring, defaultStreamBufferSize)
+	_, _, err = ingestor.stream.subscribe("", "")
+	assert.NoError(t, err)
+	ingestor.notifier.Notify(WeatherData{weatherReading("moscow", nil)})
+	assert.Len(t, ingestor.notifier.subscribers[0].queue, 1)
+
+	for _, step := range []string{memoryStepShrinkBuffers, memoryStepDropStreams, memoryStepShedQueues, memoryStepPauseFetching} {
+		assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.MemoryGuardSteps.WithLabelValues(step, memoryStepEntered)), step)
+		assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.MemoryGuardSteps.WithLabelValues(step, memoryStepLeft)), step)
+	}
+	assert.Equal(t, 0.0, testutil.ToFloat64(ingestor.metrics.MemoryGuardLevel))
+}
+
+func TestMemoryGuard_SkipsUnsetSteps(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		Logging:     LoggingConfig{Level: "panic"},
+		MemoryGuard: MemoryGuardConfig{PauseFetching: 1 << 20},
+	})
+	heap := uint64(2 << 20)
+	ingestor.memory.sample = func() uint64 { return heap }
+
+	ingestor.memory.check(time.Now())
+	assert.Equal(t, MemoryGuardStatus{Level: 1, Step: memoryStepPauseFetching, HeapBytes: heap, CheckedAt: ingestor.memory.checkedAt}, *ingestor.memory.Status())
+	assert.Len(t, ingestor.stream.ring, defaultStreamBufferSize, "buffers are not shrunk")
+
+	// The default hysteresis is 10% of the threshold
+	heap = 1<<20 - 1<<20/10
+	ingestor.memory.check(time.Now())
+	assert.True(t, ingestor.memory.pausesFetching())
+	heap--
+	ingestor.memory.check(time.Now())
+	assert.False(t, ingestor.memory.pausesFetching())
+}
+
+func TestMemoryGuard_ReadyAndStats(t *testing.T) {
+	ingestor, heap := newMemoryGuardTestIngestor(t)
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	router := setupRoutes(ingestor)
+	ready := func() (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body
+	}
+
+	*heap = 150
+	ingestor.memory.check(time.Now())
+	code, body := ready()
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, true, body["degraded"])
+	assert.Equal(t, "shedding: shrink_buffers", body["checks"].(map[string]interface{})["memory"])
+
+	*heap = 500
+	ingestor.memory.check(time.Now())
+	code, body = ready()
+	assert.Equal(t, http.StatusServiceUnavailable, code, "not ready while fetching is paused")
+	assert.Equal(t, "shedding: pause_fetching", body["checks"].(map[string]interface{})["memory"])
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		Memory MemoryGuardStatus `json:"memory"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, 4, stats.Memory.Level)
+	assert.Equal(t, memoryStepPauseFetching, stats.Memory.Step)
+	assert.Equal(t, uint64(500), stats.Memory.HeapBytes)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stream", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
+
+func TestStreamHub_Resize(t *testing.T) {
+	hub := newStreamHub(StreamConfig{BufferSize: 10}, NewMetrics(prometheus.NewRegistry()))
+	broadcastReadings(hub, 7)
+
+	hub.resize(3)
+	events := hub.recent("", "", 100)
+	require.Len(t, events, 3)
+	assert.Equal(t, "station-4", events[0].Location)
+
+	broadcastReadings(hub, 1)
+	assert.Len(t, hub.recent("", "", 100), 3, "the shrunk ring wraps")
+
+	hub.resize(10)
+	assert.Len(t, hub.recent("", "", 100), 3, "growing keeps what is buffered")
+	broadcastReadings(hub, 2)
+	assert.Len(t, hub.recent("", "", 100), 5)
+}
+
+func TestConfig_ValidateMemoryGuard(t *testing.T) {
+	assert.NoError(t, (&Config{MemoryGuard: MemoryGuardConfig{DropStreams: 1 << 20, PauseFetching: 2 << 20}}).Validate())
+	assert.ErrorContains(t, (&Config{MemoryGuard: MemoryGuardConfig{ShrinkBuffers: 2 << 20, ShedQueues: 1 << 20}}).Validate(),
+		"memory_guard.shed_queues (1MiB) must be above memory_guard.shrink_buffers (2MiB)")
+	assert.ErrorContains(t, (&Config{MemoryGuard: MemoryGuardConfig{PauseFetching: -1}}).Validate(), "must not be negative")
+	assert.ErrorContains(t, (&Config{MemoryGuard: MemoryGuardConfig{PauseFetching: 1 << 20, Hysteresis: 1 << 20}}).Validate(), "hysteresis must be below")
+}
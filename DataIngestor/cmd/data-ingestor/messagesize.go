@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// deadLetterSizeExceeded is the dead-letter reason of a reading larger
+	// than publishing.max_message_size on its own
+	deadLetterSizeExceeded = "size_exceeded"
+
+	// deadLetterType is the AMQP Type of dead-letter messages
+	deadLetterType = "dead_letter"
+)
+
+// errMessageTooLarge fails a publish that the broker would reject, and close
+// the channel for, because of its size
+var errMessageTooLarge = errors.New("message exceeds publishing.max_message_size")
+
+// deadLetter is published to publishing.dead_letter_queue in place of a
+// reading that cannot be published. It describes the reading rather than
+// holding it, since an oversized reading would not fit either.
+type deadLetter struct {
+	Reason   string `json:"reason"`
+	Type     string `json:"type"`
+	Location string `json:"location"`
+	BatchID  string `json:"batch_id,omitempty"`
+	// Size is the encoded size of the reading and Limit the maximum message
+	// size, in bytes
+	Size  int   `json:"size"`
+	Limit int64 `json:"limit"`
+}
+
+// validateMaxMessageSize checks publishing.max_message_size. The dead-letter
+// queue also takes the messages the broker refuses, so it needs neither the
+// limit nor single_message batches.
+func (c PublishingConfig) validateMaxMessageSize() error {
+	if c.MaxMessageSize < 0 {
+		return fmt.Errorf("publishing.max_message_size must not be negative")
+	}
+	return nil
+}
+
+// checkMessageSize returns errMessageTooLarge when body, as it goes on the
+// wire, is over publishing.max_message_size
+func (di *DataIngestor) checkMessageSize(routingKey string, body []byte) error {
+	limit := di.config.Publishing.MaxMessageSize
+	if limit <= 0 || int64(len(body)) <= int64(limit) {
+		return nil
+	}
+	return fmt.Errorf("%w: %d bytes for %s, the limit is %s", errMessageTooLarge, len(body), routingKey, limit)
+}
+
+// splitBatch packs readings of the given encoded sizes, in order, into parts
+// whose batch message stays within limit bytes, overhead being the size of a
+// batch message without readings. Readings that exceed the limit in a part of
+// their own are returned in oversized. Both hold indexes into sizes.
+func splitBatch(sizes []int, overhead, limit int) (parts [][]int, oversized []int) {
+	var part []int
+	// size is what the readings of part add to the batch message: the
+	// brackets of the array and a comma between readings
+	size := 2
+	for i, reading := range sizes {
+		if overhead+2+reading > limit {
+			oversized = append(oversized, i)
+			continue
+		}
+		added := reading
+		if len(part) > 0 {
+			added++
+		}
+		if overhead+size+added > limit {
+			parts = append(parts, part)
+			part, size, added = nil, 2, reading
+		}
+		part = append(part, i)
+		size += added
+	}
+	if len(part) > 0 {
+		parts = append(parts, part)
+	}
+	return parts, oversized
+}
+
+// splitForSize splits data into the parts of a single_message batch that fit
+// under publishing.max_message_size, and dead-letters the readings too large
+// for any part
+func (di *DataIngestor) splitForSize(data *WeatherData, env Envelope) ([]WeatherData, error) {
+	limit := int(di.config.Publishing.MaxMessageSize)
+	sizes := make([]int, len(*data))
+	for i := range *data {
+		encoded, err := di.naming.marshal(&(*data)[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal data: %w", err)
+		}
+		sizes[i] = len(encoded)
+	}
+	// The count of a part never has more digits than the whole batch's
+	empty, err := json.Marshal(batchMessage{BatchID: env.BatchID, Count: len(*data), Readings: json.RawMessage("[]")})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal batch: %w", err)
+	}
+
+	indexes, oversized := splitBatch(sizes, len(empty)-2, limit)
+	for _, i := range oversized {
+		if err := di.deadLetter((*data)[i], deadLetterSizeExceeded, sizes[i], env); err != nil {
+			return nil, err
+		}
+	}
+	parts := make([]WeatherData, len(indexes))
+	for i, part := range indexes {
+		parts[i] = make(WeatherData, len(part))
+		for j, index := range part {
+			parts[i][j] = (*data)[index]
+		}
+	}
+	if len(parts) > 1 {
+		di.metrics.BatchSplits.Inc()
+	}
+	return parts, nil
+}
+
+// deadLetter publishes a description of reading to publishing.dead_letter_queue,
+// or only logs it when there is none
+func (di *DataIngestor) deadLetter(reading SensorData, reason string, size int, env Envelope) error {
+	letter := deadLetter{
+		Reason:   reason,
+		Type:     reading.Type,
+		Location: reading.Location(),
+		BatchID:  env.BatchID,
+		Size:     size,
+		Limit:    int64(di.config.Publishing.MaxMessageSize),
+	}
+	entry := di.log(logPublish).WithFields(logrus.Fields{
+		"reason":   letter.Reason,
+		"type":     letter.Type,
+		"location": letter.Location,
+		"batch_id": letter.BatchID,
+		"size":     letter.Size,
+		"limit":    letter.Limit,
+	})
+	di.metrics.DeadLetters.WithLabelValues(reason).Inc()
+
+	queue := di.config.Publishing.DeadLetterQueue
+	if queue == "" {
+		entry.Error("Reading not published")
+		return nil
+	}
+	body, err := json.Marshal(letter)
+	if err != nil {
+		return fmt.Errorf("failed to marshal dead letter: %w", err)
+	}
+	if _, err := di.publishBody("", queue, body, Envelope{
+		CorrelationID:    env.CorrelationID,
+		Type:             deadLetterType,
+		DeadLetterReason: reason,
+	}); err != nil {
+		return fmt.Errorf("failed to dead-letter reading of %s: %w", letter.Location, err)
+	}
+	entry.WithField("queue", queue).Warn("Reading dead-lettered")
+	return nil
+}
+
+// declareDeadLetterQueue declares publishing.dead_letter_queue, if set
+func (di *DataIngestor) declareDeadLetterQueue(channel amqpChannel) error {
+	queue := di.config.Publishing.DeadLetterQueue
+	if queue == "" {
+		return nil
+	}
+	_, err := channel.QueueDeclare(
+		queue,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare dead-letter queue %s: %w", queue, err)
+	}
+	return nil
+}
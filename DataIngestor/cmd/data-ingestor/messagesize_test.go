@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// largeReading is a reading whose encoding is about size bytes
+func largeReading(name string, size int) SensorData {
+	return weatherReading(name, map[string]interface{}{"raw": strings.Repeat("x", size)})
+}
+
+func TestSplitBatch(t *testing.T) {
+	tests := []struct {
+		name      string
+		sizes     []int
+		overhead  int
+		limit     int
+		parts     [][]int
+		oversized []int
+	}{
+		{"fits", []int{10, 10, 10}, 20, 100, [][]int{{0, 1, 2}}, nil},
+		// 20 + 2 + 10+1+10+1+10 = 54
+		{"exact limit", []int{10, 10, 10}, 20, 54, [][]int{{0, 1, 2}}, nil},
+		{"one byte over", []int{10, 10, 10}, 20, 53, [][]int{{0, 1}, {2}}, nil},
+		{"one per part", []int{30, 30, 30}, 20, 60, [][]int{{0}, {1}, {2}}, nil},
+		{"keeps order", []int{40, 5, 5, 40, 5}, 10, 64, [][]int{{0, 1, 2}, {3, 4}}, nil},
+		{"oversized", []int{10, 100, 10}, 20, 60, [][]int{{0, 2}}, []int{1}},
+		{"only oversized", []int{100}, 20, 60, nil, []int{0}},
+		{"empty", nil, 20, 60, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parts, oversized := splitBatch(tt.sizes, tt.overhead, tt.limit)
+			assert.Equal(t, tt.parts, parts)
+			assert.Equal(t, tt.oversized, oversized)
+		})
+	}
+}
+
+func TestBatchSingle_SplitsBySize(t *testing.T) {
+	channel := &fakeChannel{}
+	ingestor := newBatchTestIngestor(t, batchModeSingle, channel)
+	ingestor.config.Publishing.MaxMessageSize = 128 << 10
+
+	data := make(WeatherData, 10)
+	for i := range data {
+		data[i] = largeReading(fmt.Sprintf("station-%d", i), 30<<10)
+	}
+	messageIDs, err := ingestor.publishReadings(&data, Envelope{})
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 3, "four 30KiB readings per 128KiB message")
+	assert.Len(t, messageIDs, 3)
+	batchID := messages[0].Msg.Headers["batch_id"]
+	var names []string
+	for i, msg := range messages {
+		assert.LessOrEqual(t, len(msg.Msg.Body), 128<<10)
+		assert.Equal(t, batchID, msg.Msg.Headers["batch_id"])
+		assert.Equal(t, 10, msg.Msg.Headers["batch_size"])
+		assert.Equal(t, i+1, msg.Msg.Headers["batch_part"])
+		assert.Equal(t, 3, msg.Msg.Headers["batch_parts"])
+
+		readings, err := unwrapBatch(msg.Msg.Body)
+		require.NoError(t, err)
+		var part WeatherData
+		require.NoError(t, json.Unmarshal(readings, &part))
+		for _, reading := range part {
+			names = append(names, reading.Name)
+		}
+	}
+	assert.Equal(t, []string{
+		"station-0", "station-1", "station-2", "station-3", "station-4",
+		"station-5", "station-6", "station-7", "station-8", "station-9",
+	}, names, "every reading once, in order")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.BatchSplits))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Batches.WithLabelValues(batchModeSingle, batchPublished)))
+}
+
+func TestBatchSingle_UnderTheLimitIsNotSplit(t *testing.T) {
+	channel := &fakeChannel{}
+	ingestor := newBatchTestIngestor(t, batchModeSingle, channel)
+	ingestor.config.Publishing.MaxMessageSize = 128 << 10
+
+	data := WeatherData{largeReading("moscow", 1<<10), largeReading("berlin", 1<<10)}
+	_, err := ingestor.publishReadings(&data, Envelope{})
+	require.NoError(t, err)
+	require.Len(t, channel.messages(), 1)
+	assert.NotContains(t, channel.messages()[0].Msg.Headers, "batch_part")
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.BatchSplits))
+}
+
+func TestBatchSingle_DeadLettersOversizedReadings(t *testing.T) {
+	channel := &fakeChannel{}
+	ingestor := newBatchTestIngestor(t, batchModeSingle, channel)
+	ingestor.config.Publishing.MaxMessageSize = 128 << 10
+	ingestor.config.Publishing.DeadLetterQueue = "meter-data-dead"
+
+	data := WeatherData{largeReading("moscow", 1<<10), largeReading("berlin", 200<<10), largeReading("paris", 1<<10)}
+	messageIDs, err := ingestor.publishReadings(&data, Envelope{CorrelationID: "cycle-1"})
+	require.NoError(t, err)
+	assert.Len(t, messageIDs, 1, "dead letters are not batch messages")
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	dead := messages[0]
+	assert.Equal(t, "meter-data-dead", dead.RoutingKey)
+	assert.Equal(t, deadLetterType, dead.Msg.Type)
+	assert.Equal(t, "cycle-1", dead.Msg.CorrelationId)
+	assert.Equal(t, deadLetterSizeExceeded, dead.Msg.Headers["dead_letter_reason"])
+	var letter deadLetter
+	require.NoError(t, json.Unmarshal(dead.Msg.Body, &letter))
+	assert.Equal(t, deadLetterSizeExceeded, letter.Reason)
+	assert.Equal(t, "berlin", letter.Location)
+	assert.Equal(t, messages[1].Msg.Headers["batch_id"], letter.BatchID)
+	assert.Greater(t, letter.Size, 200<<10)
+	assert.Equal(t, int64(128<<10), letter.Limit)
+
+	readings, err := unwrapBatch(messages[1].Msg.Body)
+	require.NoError(t, err)
+	var rest WeatherData
+	require.NoError(t, json.Unmarshal(readings, &rest))
+	assert.Len(t, rest, 2)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.DeadLetters.WithLabelValues(deadLetterSizeExceeded)))
+}
+
+func TestBatchSingle_OversizedWithoutDeadLetterQueue(t *testing.T) {
+	channel := &fakeChannel{}
+	ingestor := newBatchTestIngestor(t, batchModeSingle, channel)
+	ingestor.config.Publishing.MaxMessageSize = 64 << 10
+
+	data := WeatherData{largeReading("berlin", 100<<10)}
+	messageIDs, err := ingestor.publishReadings(&data, Envelope{})
+	require.NoError(t, err)
+	assert.Empty(t, messageIDs)
+	assert.Empty(t, channel.messages(), "the reading is only logged")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.DeadLetters.WithLabelValues(deadLetterSizeExceeded)))
+}
+
+func TestPublish_RefusesOversizedMessages(t *testing.T) {
+	channel := &fakeChannel{}
+	ingestor := newBatchTestIngestor(t, batchModeNone, channel)
+	ingestor.config.Publishing.MaxMessageSize = 1 << 10
+
+	_, err := ingestor.publishBody("", "meter-data-queue", []byte(strings.Repeat("x", 2<<10)), Envelope{})
+	assert.ErrorIs(t, err, errMessageTooLarge)
+	assert.Empty(t, channel.messages(), "never sent to the broker")
+
+	_, err = ingestor.publishBody("", "meter-data-queue", []byte("[]"), Envelope{})
+	assert.NoError(t, err)
+}
+
+func TestConfig_ValidateMaxMessageSize(t *testing.T) {
+	single := PublishingConfig{BatchMode: batchModeSingle, MaxMessageSize: 128 << 10}
+	assert.NoError(t, (&Config{Publishing: single}).Validate())
+	single.DeadLetterQueue = "meter-data-dead"
+	assert.NoError(t, (&Config{Publishing: single}).Validate())
+
+	assert.ErrorContains(t, (&Config{Publishing: PublishingConfig{MaxMessageSize: -1}}).Validate(), "must not be negative")
+	// The dead-letter queue also takes the messages the broker refuses
+	assert.NoError(t, (&Config{Publishing: PublishingConfig{BatchMode: batchModeSingle, DeadLetterQueue: "dead"}}).Validate())
+	assert.NoError(t, (&Config{Publishing: PublishingConfig{MaxMessageSize: 1 << 10, DeadLetterQueue: "dead"}}).Validate())
+}
@@ -0,0 +1,762 @@
+package main
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "data_ingestor"
+
+// sinkAMQP labels metrics for messages published to RabbitMQ
+const sinkAMQP = "amqp"
+
+// Metrics holds the Prometheus collectors exported by the ingestor
+type Metrics struct {
+	registry *prometheus.Registry
+
+	RoutingRulePublishes    *prometheus.CounterVec
+	MessageSize             *prometheus.HistogramVec
+	PublishConfirmLatency   *prometheus.HistogramVec
+	CycleDuration           prometheus.Summary
+	ReplayedReadings        prometheus.Counter
+	ArchiveCorruptFiles     prometheus.Counter
+	ArchiveFilesRemoved     *prometheus.CounterVec
+	ArchiveDiskUsage        prometheus.Gauge
+	ManualIngestGated       *prometheus.CounterVec
+	CircuitBreakerState     *prometheus.GaugeVec
+	UpstreamFailures        *prometheus.CounterVec
+	NoDataResponses         *prometheus.CounterVec
+	MalformedRows           *prometheus.CounterVec
+	UpstreamAuthFailures    prometheus.Counter
+	StreamClients           prometheus.Gauge
+	StreamDroppedClients    prometheus.Counter
+	TransformErrors         *prometheus.CounterVec
+	TransformFiltered       *prometheus.CounterVec
+	ValidationFailures      *prometheus.CounterVec
+	SentinelValues          *prometheus.CounterVec
+	Panics                  *prometheus.CounterVec
+	QueueDepth              prometheus.Gauge
+	ThrottleFactor          prometheus.Gauge
+	ActiveBroker            *prometheus.GaugeVec
+	BrokerFailovers         prometheus.Counter
+	BrokerThrottled         prometheus.Gauge
+	FlowWaits               *prometheus.CounterVec
+	HookDuration            *prometheus.HistogramVec
+	HookPanics              *prometheus.CounterVec
+	UpstreamFetches         *prometheus.CounterVec
+	UpstreamTimeout         *prometheus.GaugeVec
+	PublishedMessages       *prometheus.CounterVec
+	DedupClaimLatency       prometheus.Histogram
+	DedupSuppressed         *prometheus.CounterVec
+	DedupRedisErrors        prometheus.Counter
+	LatestRequests          *prometheus.CounterVec
+	Batches                 *prometheus.CounterVec
+	BatchSize               *prometheus.HistogramVec
+	BatchSplits             prometheus.Counter
+	DeadLetters             *prometheus.CounterVec
+	MemoryGuardLevel        prometheus.Gauge
+	Goroutines              prometheus.Gauge
+	OpenFileDescriptors     prometheus.Gauge
+	HeapBytes               prometheus.Gauge
+	ResourceCrossings       *prometheus.CounterVec
+	ResourceGuardProtecting prometheus.Gauge
+	GoroutineDumps          prometheus.Counter
+	MemoryGuardSteps        *prometheus.CounterVec
+	HealthChecks            *prometheus.CounterVec
+	ShardLocations          prometheus.Gauge
+	DependencyUp            *prometheus.GaugeVec
+	ReadingsPublished       *prometheus.CounterVec
+	Reports                 *prometheus.CounterVec
+	RateLimitTokens         *prometheus.CounterVec
+	RateLimitRejections     *prometheus.CounterVec
+	UpstreamBulkRequests    *prometheus.CounterVec
+	BulkMissingStations     *prometheus.CounterVec
+	BackfillPages           *prometheus.CounterVec
+	BackfillJobs            *prometheus.CounterVec
+	BackfillSkippedElements *prometheus.CounterVec
+	BackfillYields          *prometheus.CounterVec
+	QualityScore            *prometheus.HistogramVec
+	FaultsInjected          *prometheus.CounterVec
+	BudgetRatio             prometheus.Gauge
+	BudgetTransitions       *prometheus.CounterVec
+	UpstreamPhase           *prometheus.HistogramVec
+	Cycles                  *prometheus.CounterVec
+	UpstreamSwitches        *prometheus.CounterVec
+	Deliveries              *prometheus.CounterVec
+	SinkMisses              *prometheus.CounterVec
+	ScheduleLag             *prometheus.HistogramVec
+	CycleLatency            *prometheus.HistogramVec
+	MissedTicks             *prometheus.CounterVec
+	SchemaDrift             *prometheus.CounterVec
+	UpstreamRedirects       *prometheus.CounterVec
+	WebSocketConnected      prometheus.Gauge
+	WebSocketReconnects     prometheus.Counter
+	WebSocketFrames         *prometheus.CounterVec
+	UpstreamMaintenance     prometheus.Gauge
+	UpstreamStatusChecks    *prometheus.CounterVec
+	DiscoveredStations      prometheus.Gauge
+	CatalogFetches          *prometheus.CounterVec
+	CatalogChanges          *prometheus.CounterVec
+	SpoolMessages           prometheus.Gauge
+	SpoolBytes              prometheus.Gauge
+	SpoolDrained            *prometheus.CounterVec
+	SpoolCompactedBytes     prometheus.Counter
+	QuarantineReadings      prometheus.Gauge
+	Quarantined             *prometheus.CounterVec
+	QuarantineReprocessed   *prometheus.CounterVec
+	QuarantineEvicted       *prometheus.CounterVec
+	UpstreamDiagnostics     *prometheus.CounterVec
+	CoalescedFetches        *prometheus.CounterVec
+	AggregatesSkipped       *prometheus.CounterVec
+	OrderingHeld            *prometheus.CounterVec
+	PublishFailures         *prometheus.CounterVec
+	SecretReloads           *prometheus.CounterVec
+	HTTPCompressionSaved    *prometheus.CounterVec
+}
+
+// NewMetrics creates the collectors and registers them with the given registry
+func NewMetrics(registry *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		registry: registry,
+		RoutingRulePublishes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "routing_rule_publishes_total",
+			Help:      "Readings published per routing rule and target.",
+		}, []string{"rule", "exchange", "routing_key"}),
+		MessageSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "message_size_bytes",
+			Help:      "Size of published message bodies.",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 8), // 256B .. 4MiB
+		}, []string{"sink", "routing_key"}),
+		PublishConfirmLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_confirm_latency_seconds",
+			Help:      "Time between publishing a message and receiving the broker confirm.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+		}, []string{"sink", "routing_key"}),
+		CycleDuration: prometheus.NewSummary(prometheus.SummaryOpts{
+			Namespace:  metricsNamespace,
+			Name:       "cycle_duration_seconds",
+			Help:       "End-to-end ingestion cycle duration from fetch start to publish confirm.",
+			Objectives: map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001},
+		}),
+		ReplayedReadings: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "replayed_readings_total",
+			Help:      "Readings republished from archive files by the replay command.",
+		}),
+		ArchiveCorruptFiles: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "archive_corrupt_files_total",
+			Help:      "Archive files skipped by the replay command because they did not match their checksum.",
+		}),
+		ArchiveFilesRemoved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "archive_files_removed_total",
+			Help:      "Archive files removed, by reason: max_age or max_size of the retention, or disk_guard.",
+		}, []string{"reason"}),
+		ArchiveDiskUsage: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "archive_disk_usage_ratio",
+			Help:      "Share of the volume of the archive in use at the last disk guard check.",
+		}),
+		ManualIngestGated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "manual_ingest_gated_total",
+			Help:      "Triggered POST /ingest requests answered by the gate, by behavior: rejected without fetching while RabbitMQ is not connected, spooled, or spool_unavailable for spool=true without a spool.",
+		}, []string{"behavior"}),
+		CircuitBreakerState: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "circuit_breaker_state",
+			Help:      "Upstream circuit breaker state per location: 0 closed, 1 half-open, 2 open.",
+		}, []string{"location"}),
+		UpstreamFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_fetch_failures_total",
+			Help:      "Failed upstream fetches per location, after retries.",
+		}, []string{"location"}),
+		NoDataResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_no_data_total",
+			Help:      "Upstream responses meaning the location has not reported yet.",
+		}, []string{"location"}),
+		MalformedRows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_malformed_rows_total",
+			Help:      "CSV rows skipped because they could not be mapped to a reading.",
+		}, []string{"location"}),
+		UpstreamAuthFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_auth_failures_total",
+			Help:      "Fetches that failed because no upstream access token could be acquired.",
+		}),
+		StreamClients: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "stream_clients",
+			Help:      "Connected GET /stream clients.",
+		}),
+		StreamDroppedClients: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "stream_dropped_clients_total",
+			Help:      "GET /stream clients disconnected for falling too far behind.",
+		}),
+		TransformErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transform_errors_total",
+			Help:      "Transform evaluations that failed; the reading was passed through unmodified.",
+		}, []string{"transform"}),
+		TransformFiltered: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "transform_filtered_total",
+			Help:      "Readings dropped by a filter transform.",
+		}, []string{"transform"}),
+		ValidationFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "validation_failures_total",
+			Help:      "Reading fields out of range, by the bound set that applied: global, location or season.",
+		}, []string{"field", "bounds"}),
+		SentinelValues: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sentinel_values_total",
+			Help:      "Payload fields set to null as a sentinel of a missing value, by the sentinel set that applied: global or location.",
+		}, []string{"field", "sentinels"}),
+		Panics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "panics_total",
+			Help:      "Panics recovered in HTTP handlers or caught before crashing.",
+		}, []string{"where"}),
+		QueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "queue_depth",
+			Help:      "Messages ready in the queue at the last backpressure check.",
+		}),
+		ThrottleFactor: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "throttle_factor",
+			Help:      "Multiplier applied to the poll interval by backpressure; 1 when not throttled.",
+		}),
+		ActiveBroker: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rabbitmq_active_broker",
+			Help:      "1 for the RabbitMQ broker currently published to, 0 for the others.",
+		}, []string{"broker"}),
+		BrokerFailovers: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rabbitmq_failovers_total",
+			Help:      "Changes of the active RabbitMQ broker, failing over or back.",
+		}),
+		BrokerThrottled: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "rabbitmq_broker_throttled",
+			Help:      "1 while the broker throttles publishers with flow control or a resource alarm.",
+		}),
+		FlowWaits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rabbitmq_flow_waits_total",
+			Help:      "Publishes that waited for the broker to stop throttling, by outcome: released or timeout.",
+		}, []string{"outcome"}),
+		HookDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "hook_duration_seconds",
+			Help:      "Time spent in one call of a registered pipeline hook.",
+			Buckets:   []float64{.00001, .0001, .001, .01, .1, 1},
+		}, []string{"hook"}),
+		HookPanics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "hook_panics_total",
+			Help:      "Pipeline hook calls that panicked and were skipped.",
+		}, []string{"hook"}),
+		UpstreamFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_fetches_total",
+			Help:      "Upstream fetches per location and trigger after retries, whatever their outcome.",
+		}, []string{"location", "trigger"}),
+		UpstreamTimeout: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_timeout_seconds",
+			Help:      "Effective per-attempt upstream timeout per location with adaptive timeouts.",
+		}, []string{"location"}),
+		PublishedMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "messages_published_total",
+			Help:      "Messages published, and confirmed when confirms are enabled.",
+		}, []string{"sink", "routing_key"}),
+		DedupClaimLatency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "dedup_claim_duration_seconds",
+			Help:      "Time to claim a cycle's readings in the shared Redis dedup cache.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}),
+		DedupSuppressed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dedup_suppressed_total",
+			Help:      "Readings not published because they were published before, found in the local or the Redis cache.",
+		}, []string{"level"}),
+		DedupRedisErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dedup_redis_errors_total",
+			Help:      "Failed claims and releases in the shared Redis dedup cache.",
+		}),
+		LatestRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "latest_requests_total",
+			Help:      "Requests for the latest readings by result: ok, not_modified, not_found or stale.",
+		}, []string{"result"}),
+		Batches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "batches_total",
+			Help:      "Cycle batches by batch mode and outcome: published, or failed and rolled back.",
+		}, []string{"mode", "outcome"}),
+		BatchSize: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "batch_size",
+			Help:      "Readings per published batch.",
+			Buckets:   []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+		}, []string{"mode"}),
+		BatchSplits: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "batch_splits_total",
+			Help:      "single_message batches split into several messages to stay under publishing.max_message_size.",
+		}),
+		DeadLetters: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dead_letters_total",
+			Help:      "Readings dead-lettered instead of published, by reason.",
+		}, []string{"reason"}),
+		MemoryGuardLevel: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "memory_guard_level",
+			Help:      "Degradation steps in effect because of heap usage; 0 when none.",
+		}),
+		Goroutines: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "goroutines",
+			Help:      "Goroutines of the process at the latest resource guard sample.",
+		}),
+		OpenFileDescriptors: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "open_file_descriptors",
+			Help:      "Open file descriptors of the process at the latest resource guard sample.",
+		}),
+		HeapBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "heap_bytes",
+			Help:      "Heap in use at the latest resource guard sample.",
+		}),
+		ResourceCrossings: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "resource_threshold_crossings_total",
+			Help:      "Resources that went above their soft or hard threshold.",
+		}, []string{"resource", "threshold"}),
+		ResourceGuardProtecting: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "resource_guard_protecting",
+			Help:      "Whether a resource is above its hard threshold and the protective actions are taken (1) or not (0).",
+		}),
+		GoroutineDumps: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "goroutine_dumps_total",
+			Help:      "Goroutine profiles written for hard threshold crossings.",
+		}),
+		MemoryGuardSteps: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "memory_guard_steps_total",
+			Help:      "Degradation steps taken or undone by the memory guard, by step and direction: entered or left.",
+		}, []string{"step", "direction"}),
+		ShardLocations: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "sharding_owned_locations",
+			Help:      "Locations polled by this replica with sharding.",
+		}),
+		HealthChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "health_checks_total",
+			Help:      "Background dependency probes, by dependency and result: ok or failing.",
+		}, []string{"dependency", "result"}),
+		DependencyUp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "dependency_up",
+			Help:      "Whether the last probe of a dependency succeeded (1) or failed (0).",
+		}, []string{"dependency"}),
+		ReadingsPublished: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "readings_published_total",
+			Help:      "Readings published per location and trigger: poll, manual, webhook, backfill, replay or loadtest. Posted and replayed readings have no location.",
+		}, []string{"location", "trigger"}),
+		Reports: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reports_total",
+			Help:      "Daily reports sent, by sink (amqp or email) and outcome: published or failed.",
+		}, []string{"sink", "outcome"}),
+		RateLimitTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_rate_limit_tokens_total",
+			Help:      "Tokens of the upstream rate limit consumed, by caller class.",
+		}, []string{"class"}),
+		RateLimitRejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_rate_limit_rejections_total",
+			Help:      "Upstream calls turned away by the rate limit, by caller class.",
+		}, []string{"class"}),
+		UpstreamBulkRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_bulk_requests_total",
+			Help:      "Bulk requests by outcome: ok, no_data, failed or unsupported.",
+		}, []string{"outcome"}),
+		BulkMissingStations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_bulk_missing_stations_total",
+			Help:      "Stations requested in a bulk request but missing from its response, per location.",
+		}, []string{"location"}),
+		BackfillPages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "backfill_pages_total",
+			Help:      "Backfill pages by outcome: published, no_data or failed.",
+		}, []string{"outcome"}),
+		BackfillJobs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "backfill_jobs_total",
+			Help:      "Finished backfill jobs by final state.",
+		}, []string{"state"}),
+		BackfillSkippedElements: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "backfill_skipped_elements_total",
+			Help:      "Elements of streamed backfill pages skipped as no reading, per location.",
+		}, []string{"location"}),
+		BackfillYields: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "backfill_yields_total",
+			Help:      "Times a live_first backfill job waited before a page, by reason: interval or live_cycle.",
+		}, []string{"reason"}),
+		QualityScore: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "reading_quality_score",
+			Help:      "Quality scores of polled readings per location.",
+			Buckets:   []float64{10, 20, 30, 40, 50, 60, 70, 80, 90, 100},
+		}, []string{"location"}),
+		FaultsInjected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "faults_injected_total",
+			Help:      "Injected faults that took effect, by fault type.",
+		}, []string{"fault"}),
+		BudgetRatio: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "error_budget_failure_ratio",
+			Help:      "Ratio of failed upstream fetches in the error budget window.",
+		}),
+		BudgetTransitions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "error_budget_transitions_total",
+			Help:      "Error budget state changes and operator overrides, by new state.",
+		}, []string{"state"}),
+		UpstreamPhase: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_phase_duration_seconds",
+			Help:      "Durations of the DNS, connect, TLS, first byte and body phases of upstream requests.",
+			Buckets:   []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"location", "phase"}),
+		Cycles: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cycles_total",
+			Help:      "Ingestion cycles by status: succeeded, degraded, failed, skipped or no_data, and trigger.",
+		}, []string{"status", "trigger"}),
+		UpstreamSwitches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_switches_total",
+			Help:      "Base URL changes of a location while running.",
+		}, []string{"location"}),
+		Deliveries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "reading_deliveries_total",
+			Help:      "Readings by delivery outcome under the delivery policy: delivered, partial or failed.",
+		}, []string{"outcome"}),
+		SinkMisses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "sink_missed_readings_total",
+			Help:      "Readings a sink was handed but did not take, by sink and delivery policy.",
+		}, []string{"sink", "policy"}),
+		ScheduleLag: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "cycle_schedule_lag_seconds",
+			Help:      "Time from the intended start of a poll tick to the start of the cycle that served it, per tick.",
+			Buckets:   []float64{.001, .01, .1, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		}, []string{"location"}),
+		CycleLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "cycle_latency_seconds",
+			Help:      "Time from the intended start of a poll tick to the end of the cycle that published it, per tick.",
+			Buckets:   []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300},
+		}, []string{"location"}),
+		MissedTicks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cycle_missed_ticks_total",
+			Help:      "Poll ticks that passed while the previous cycle of the location still ran.",
+		}, []string{"location"}),
+		SchemaDrift: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "schema_drift_total",
+			Help:      "Upstream responses that differed from the expected schema, by location, drift kind and signature.",
+		}, []string{"location", "kind", "signature"}),
+		UpstreamRedirects: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_redirects_total",
+			Help:      "Redirects answered by the upstream, by location and whether they were followed or why not.",
+		}, []string{"location", "outcome"}),
+		WebSocketConnected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "websocket_connected",
+			Help:      "Whether the WebSocket upstream is connected (1) or not (0).",
+		}),
+		WebSocketReconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "websocket_reconnects_total",
+			Help:      "Lost or failed connections to the WebSocket upstream.",
+		}),
+		WebSocketFrames: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "websocket_frames_total",
+			Help:      "Frames received from the WebSocket upstream: ok, malformed or unknown_station.",
+		}, []string{"outcome"}),
+		UpstreamMaintenance: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_maintenance",
+			Help:      "Whether the upstream status endpoint announces maintenance (1) or not (0).",
+		}),
+		UpstreamStatusChecks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_status_checks_total",
+			Help:      "Checks of the upstream status endpoint: ok, maintenance or failed.",
+		}, []string{"result"}),
+		DiscoveredStations: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "discovered_stations",
+			Help:      "Stations of the upstream catalog that passed the include and exclude globs.",
+		}),
+		CatalogFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "catalog_fetches_total",
+			Help:      "Fetches of the upstream station catalog: ok or failed.",
+		}, []string{"result"}),
+		CatalogChanges: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "catalog_changes_total",
+			Help:      "Locations the station catalog changed: added, removed or moved.",
+		}, []string{"change"}),
+		SpoolMessages: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "spool_messages",
+			Help:      "Messages in rabbitmq.spool waiting to be published.",
+		}),
+		SpoolBytes: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "spool_bytes",
+			Help:      "Size of the segment files of rabbitmq.spool.",
+		}),
+		SpoolDrained: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "spool_drained_total",
+			Help:      "Spooled messages taken off the spool: published, dropped when the broker refused them, expired, or evicted while the disk guard dropped files.",
+		}, []string{"result"}),
+		SpoolCompactedBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "spool_compacted_bytes_total",
+			Help:      "Bytes of published messages removed from rabbitmq.spool segments by compaction.",
+		}),
+		QuarantineReadings: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "quarantine_readings",
+			Help:      "Invalid readings held in the quarantine.",
+		}),
+		Quarantined: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "quarantined_total",
+			Help:      "Invalid readings put into the quarantine, by why they were invalid.",
+		}, []string{"code"}),
+		QuarantineReprocessed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "quarantine_reprocessed_total",
+			Help:      "Quarantined readings reprocessed, by outcome: published, invalid or failed.",
+		}, []string{"outcome"}),
+		QuarantineEvicted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "quarantine_evicted_total",
+			Help:      "Quarantined readings dropped unprocessed, by reason: expired or capacity.",
+		}, []string{"reason"}),
+		UpstreamDiagnostics: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_diagnostics_total",
+			Help:      "Connectivity diagnostics run after network failures, by result: dns_failed, dial_failed or reachable.",
+		}, []string{"location", "result"}),
+		CoalescedFetches: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "upstream_coalesced_fetches_total",
+			Help:      "Fetches served from another trigger's fetch of the location, by mode: in_flight or reused.",
+		}, []string{"location", "mode"}),
+		AggregatesSkipped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "aggregates_skipped_readings_total",
+			Help:      "Readings left out of the aggregates, by reason: late or future.",
+		}, []string{"location", "reason"}),
+		OrderingHeld: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ordering_held_fetches_total",
+			Help:      "Publishes that waited for an earlier fetch of the location to publish first, with publishing.ordering per_location.",
+		}, []string{"location"}),
+		HTTPCompressionSaved: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_compression_saved_bytes_total",
+			Help:      "Bytes compression saved on the HTTP API, by direction: request or response.",
+		}, []string{"direction"}),
+		PublishFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "publish_failures_total",
+			Help:      "Failed publishes, by kind: rejected, returned, unreachable or confirm_timeout, and action: retried, dead_lettered, spooled or failed.",
+		}, []string{"kind", "action"}),
+		SecretReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "secret_reloads_total",
+			Help:      "Secret files read again that had rotated, or could not be read, by secret: rabbitmq, api_key or oauth2, and result: rotated or failed.",
+		}, []string{"secret", "result"}),
+	}
+
+	registry.MustRegister(
+		m.RoutingRulePublishes,
+		m.MessageSize,
+		m.PublishConfirmLatency,
+		m.CycleDuration,
+		m.ReplayedReadings,
+		m.ArchiveCorruptFiles,
+		m.ArchiveFilesRemoved,
+		m.ArchiveDiskUsage,
+		m.ManualIngestGated,
+		m.CircuitBreakerState,
+		m.UpstreamFailures,
+		m.NoDataResponses,
+		m.MalformedRows,
+		m.UpstreamAuthFailures,
+		m.StreamClients,
+		m.StreamDroppedClients,
+		m.TransformErrors,
+		m.TransformFiltered,
+		m.ValidationFailures,
+		m.SentinelValues,
+		m.Panics,
+		m.QueueDepth,
+		m.ThrottleFactor,
+		m.ActiveBroker,
+		m.BrokerFailovers,
+		m.BrokerThrottled,
+		m.FlowWaits,
+		m.HookDuration,
+		m.HookPanics,
+		m.UpstreamFetches,
+		m.UpstreamTimeout,
+		m.PublishedMessages,
+		m.DedupClaimLatency,
+		m.DedupSuppressed,
+		m.DedupRedisErrors,
+		m.LatestRequests,
+		m.Batches,
+		m.BatchSize,
+		m.BatchSplits,
+		m.DeadLetters,
+		m.MemoryGuardLevel,
+		m.Goroutines,
+		m.OpenFileDescriptors,
+		m.HeapBytes,
+		m.ResourceCrossings,
+		m.ResourceGuardProtecting,
+		m.GoroutineDumps,
+		m.MemoryGuardSteps,
+		m.ShardLocations,
+		m.HealthChecks,
+		m.DependencyUp,
+		m.ReadingsPublished,
+		m.Reports,
+		m.RateLimitTokens,
+		m.RateLimitRejections,
+		m.UpstreamBulkRequests,
+		m.BulkMissingStations,
+		m.BackfillPages,
+		m.BackfillJobs,
+		m.BackfillSkippedElements,
+		m.BackfillYields,
+		m.QualityScore,
+		m.FaultsInjected,
+		m.BudgetRatio,
+		m.BudgetTransitions,
+		m.UpstreamPhase,
+		m.Cycles,
+		m.UpstreamSwitches,
+		m.Deliveries,
+		m.SinkMisses,
+		m.ScheduleLag,
+		m.CycleLatency,
+		m.MissedTicks,
+		m.SchemaDrift,
+		m.UpstreamRedirects,
+		m.WebSocketConnected,
+		m.WebSocketReconnects,
+		m.WebSocketFrames,
+		m.UpstreamMaintenance,
+		m.UpstreamStatusChecks,
+		m.DiscoveredStations,
+		m.CatalogFetches,
+		m.CatalogChanges,
+		m.SpoolMessages,
+		m.SpoolBytes,
+		m.SpoolDrained,
+		m.SpoolCompactedBytes,
+		m.QuarantineReadings,
+		m.Quarantined,
+		m.QuarantineReprocessed,
+		m.QuarantineEvicted,
+		m.UpstreamDiagnostics,
+		m.CoalescedFetches,
+		m.AggregatesSkipped,
+		m.OrderingHeld,
+		m.HTTPCompressionSaved,
+		m.PublishFailures,
+		m.SecretReloads,
+	)
+	return m
+}
+
+// forgetLocation deletes the series of a location that is no longer polled
+func (m *Metrics) forgetLocation(location string) {
+	labels := prometheus.Labels{"location": location}
+	for _, vector := range []interface {
+		DeletePartialMatch(labels prometheus.Labels) int
+	}{
+		m.CircuitBreakerState,
+		m.UpstreamFailures,
+		m.NoDataResponses,
+		m.MalformedRows,
+		m.UpstreamFetches,
+		m.UpstreamTimeout,
+		m.ReadingsPublished,
+		m.BulkMissingStations,
+		m.BackfillSkippedElements,
+		m.QualityScore,
+		m.UpstreamPhase,
+		m.UpstreamSwitches,
+		m.ScheduleLag,
+		m.CycleLatency,
+		m.MissedTicks,
+		m.SchemaDrift,
+		m.UpstreamRedirects,
+		m.UpstreamDiagnostics,
+		m.CoalescedFetches,
+		m.AggregatesSkipped,
+		m.OrderingHeld,
+	} {
+		vector.DeletePartialMatch(labels)
+	}
+}
+
+// Handler serves the registry in the Prometheus exposition format
+func (m *Metrics) Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+}
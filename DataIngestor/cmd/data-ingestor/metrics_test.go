@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// findMetric returns the gathered metric with the given name and labels
+func findMetric(t *testing.T, di *DataIngestor, name string, labels map[string]string) *dto.Metric {
+	t.Helper()
+
+	families, err := di.metrics.registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			if labelsMatch(metric, labels) {
+				return metric
+			}
+		}
+	}
+	return nil
+}
+
+func labelsMatch(metric *dto.Metric, labels map[string]string) bool {
+	found := 0
+	for _, pair := range metric.GetLabel() {
+		if want, ok := labels[pair.GetName()]; ok {
+			if want != pair.GetValue() {
+				return false
+			}
+			found++
+		}
+	}
+	return found == len(labels)
+}
+
+func TestMetrics_MessageSizeAndConfirmLatency(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"}})
+	withConfirms(ingestor, &fakeChannel{})
+
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	require.NoError(t, ingestor.PublishToQueue(&data))
+	require.NoError(t, ingestor.PublishToQueue(&data))
+
+	labels := map[string]string{"sink": sinkAMQP, "routing_key": "meter-data-queue"}
+
+	size := findMetric(t, ingestor, "data_ingestor_message_size_bytes", labels)
+	require.NotNil(t, size)
+	assert.Equal(t, uint64(2), size.GetHistogram().GetSampleCount())
+	assert.Greater(t, size.GetHistogram().GetSampleSum(), 0.0)
+
+	assert.Eventually(t, func() bool {
+		latency := findMetric(t, ingestor, "data_ingestor_publish_confirm_latency_seconds", labels)
+		return latency != nil && latency.GetHistogram().GetSampleCount() == 2
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestPublishToQueue_Nack(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"}})
+	withConfirms(ingestor, &fakeChannel{nack: true})
+
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	err := ingestor.PublishToQueue(&data)
+	assert.ErrorIs(t, err, ErrPublishNacked)
+}
+
+func TestPublishToQueue_ConfirmTimeout(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{RabbitMQ: RabbitMQConfig{
+		QueueName:      "meter-data-queue",
+		ConfirmTimeout: Duration(20 * time.Millisecond),
+	}})
+	// Confirm mode is on but the broker never answers
+	attachChannel(ingestor, &fakeChannel{}, newConfirmTracker())
+
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	err := ingestor.PublishToQueue(&data)
+	assert.ErrorIs(t, err, ErrConfirmTimeout)
+}
+
+func TestMetrics_CycleDuration(t *testing.T) {
+	upstream := newUpstream(t, "application/json", `[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`)
+
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+	})
+	withConfirms(ingestor, &fakeChannel{})
+
+	ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+
+	cycle := findMetric(t, ingestor, "data_ingestor_cycle_duration_seconds", nil)
+	require.NotNil(t, cycle)
+	assert.Equal(t, uint64(1), cycle.GetSummary().GetSampleCount())
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"}})
+	withConfirms(ingestor, &fakeChannel{})
+
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	require.NoError(t, ingestor.PublishToQueue(&data))
+
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), "data_ingestor_message_size_bytes_bucket")
+	assert.Contains(t, w.Body.String(), "data_ingestor_cycle_duration_seconds")
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultMigrateProgressEvery  = 1000
+	defaultMigrateConfirmTimeout = 10 * time.Second
+)
+
+// MigrateOptions configures moving the contents of one queue to another
+// destination
+type MigrateOptions struct {
+	Source     string
+	Exchange   string
+	RoutingKey string
+	// DryRun only counts the messages that would be moved
+	DryRun bool
+	// MaxMessages stops after this many messages; 0 moves everything
+	MaxMessages int
+	// ProgressEvery logs progress after every this many messages
+	ProgressEvery  int
+	ConfirmTimeout time.Duration
+}
+
+// withDefaults fills in the options left at zero
+func (o MigrateOptions) withDefaults() MigrateOptions {
+	if o.ProgressEvery == 0 {
+		o.ProgressEvery = defaultMigrateProgressEvery
+	}
+	if o.ConfirmTimeout == 0 {
+		o.ConfirmTimeout = defaultMigrateConfirmTimeout
+	}
+	return o
+}
+
+// Validate checks the options, which are left at zero for the defaults
+func (o MigrateOptions) Validate() error {
+	if o.Source == "" {
+		return fmt.Errorf("source queue is required")
+	}
+	if o.Exchange == "" && o.RoutingKey == o.Source {
+		return fmt.Errorf("source and destination are the same queue")
+	}
+	if o.MaxMessages < 0 {
+		return fmt.Errorf("max messages must not be negative")
+	}
+	if o.ProgressEvery < 0 {
+		return fmt.Errorf("progress every must not be negative")
+	}
+	if o.ConfirmTimeout < 0 {
+		return fmt.Errorf("confirm timeout must not be negative")
+	}
+	return nil
+}
+
+// MigrateSummary is the outcome of a migration
+type MigrateSummary struct {
+	Moved int
+	// WouldMove is what a dry run would have moved
+	WouldMove int
+	// Remaining is the number of messages left on the source, -1 if unknown
+	Remaining int
+}
+
+// ErrUnroutable is returned when the destination has no queue bound for the
+// routing key, so a moved message would be lost
+var ErrUnroutable = errors.New("destination is unroutable")
+
+// migrationChannel is the subset of *amqp.Channel used by a migration. The
+// channel must be in confirm mode.
+type migrationChannel interface {
+	Get(queue string, autoAck bool) (amqp.Delivery, bool, error)
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	QueueInspect(name string) (amqp.Queue, error)
+}
+
+// queueMigrator moves messages one at a time: each is acked on the source
+// only after the broker confirmed its copy, so a migration that stops at any
+// point loses nothing. A copy confirmed just before a crash can be moved a
+// second time, which consumers deduplicating by MessageId absorb.
+type queueMigrator struct {
+	channel  migrationChannel
+	confirms <-chan amqp.Confirmation
+	returns  <-chan amqp.Return
+	opts     MigrateOptions
+	logger   *logrus.Logger
+}
+
+func (m *queueMigrator) run(ctx context.Context) (MigrateSummary, error) {
+	var summary MigrateSummary
+	if err := m.opts.Validate(); err != nil {
+		return summary, err
+	}
+	m.opts = m.opts.withDefaults()
+	queue, err := m.channel.QueueInspect(m.opts.Source)
+	if err != nil {
+		return summary, fmt.Errorf("failed to inspect %s: %w", m.opts.Source, err)
+	}
+	if m.opts.DryRun {
+		summary.WouldMove, summary.Remaining = queue.Messages, queue.Messages
+		if m.opts.MaxMessages > 0 && summary.WouldMove > m.opts.MaxMessages {
+			summary.WouldMove = m.opts.MaxMessages
+		}
+		return summary, nil
+	}
+
+	for m.opts.MaxMessages <= 0 || summary.Moved < m.opts.MaxMessages {
+		if ctx.Err() != nil {
+			break
+		}
+		delivery, ok, err := m.channel.Get(m.opts.Source, false)
+		if err != nil {
+			return m.finish(summary, fmt.Errorf("failed to get message: %w", err))
+		}
+		if !ok {
+			break
+		}
+		if err := m.move(delivery); err != nil {
+			// Requeued, so nothing is lost even though the copy may exist
+			delivery.Nack(false, true)
+			return m.finish(summary, fmt.Errorf("message %s: %w", delivery.MessageId, err))
+		}
+		summary.Moved++
+		if summary.Moved%m.opts.ProgressEvery == 0 {
+			m.logger.WithField("moved", summary.Moved).Info("Migration progress")
+		}
+	}
+	return m.finish(summary, nil)
+}
+
+// move republishes one delivery with all its properties and acks it once
+// the copy is confirmed
+func (m *queueMigrator) move(delivery amqp.Delivery) error {
+	err := m.channel.Publish(m.opts.Exchange, m.opts.RoutingKey, true, false, amqp.Publishing{
+		Headers:         delivery.Headers,
+		ContentType:     delivery.ContentType,
+		ContentEncoding: delivery.ContentEncoding,
+		DeliveryMode:    delivery.DeliveryMode,
+		Priority:        delivery.Priority,
+		CorrelationId:   delivery.CorrelationId,
+		ReplyTo:         delivery.ReplyTo,
+		Expiration:      delivery.Expiration,
+		MessageId:       delivery.MessageId,
+		Timestamp:       delivery.Timestamp,
+		Type:            delivery.Type,
+		UserId:          delivery.UserId,
+		AppId:           delivery.AppId,
+		Body:            delivery.Body,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish: %w", err)
+	}
+
+	// The in-flight message is finished even when interrupted
+	timer := time.NewTimer(m.opts.ConfirmTimeout)
+	defer timer.Stop()
+	select {
+	case confirm, ok := <-m.confirms:
+		if !ok {
+			return ErrConfirmsClosed
+		}
+		if !confirm.Ack {
+			return ErrPublishNacked
+		}
+	case <-timer.C:
+		return ErrConfirmTimeout
+	}
+	// The broker sends a return before the ack of the same message
+	select {
+	case <-m.returns:
+		return fmt.Errorf("%w: %s %q", ErrUnroutable, m.opts.Exchange, m.opts.RoutingKey)
+	default:
+	}
+	return delivery.Ack(false)
+}
+
+// finish fills in the messages left on the source
+func (m *queueMigrator) finish(summary MigrateSummary, err error) (MigrateSummary, error) {
+	if queue, inspectErr := m.channel.QueueInspect(m.opts.Source); inspectErr == nil {
+		summary.Remaining = queue.Messages
+	} else {
+		summary.Remaining = -1
+	}
+	return summary, err
+}
+
+// MigrateQueue moves the messages of opts.Source to opts.Exchange and
+// opts.RoutingKey on the first reachable broker
+func MigrateQueue(ctx context.Context, config *Config, opts MigrateOptions, logger *logrus.Logger) (MigrateSummary, error) {
+	if err := opts.Validate(); err != nil {
+		return MigrateSummary{}, err
+	}
+	conn, err := dialFirst(config.RabbitMQ.brokers(), logger)
+	if err != nil {
+		return MigrateSummary{}, err
+	}
+	defer conn.Close()
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return MigrateSummary{}, fmt.Errorf("failed to open channel: %w", err)
+	}
+	defer channel.Close()
+	if err := channel.Confirm(false); err != nil {
+		return MigrateSummary{}, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	m := &queueMigrator{
+		channel:  channel,
+		confirms: channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  channel.NotifyReturn(make(chan amqp.Return, 1)),
+		opts:     opts,
+		logger:   logger,
+	}
+	return m.run(ctx)
+}
+
+// dialFirst connects to the first of urls that accepts the connection
+func dialFirst(urls []string, logger *logrus.Logger) (*amqp.Connection, error) {
+	var err error
+	for _, url := range urls {
+		var conn *amqp.Connection
+		if conn, err = amqp.Dial(url); err == nil {
+			return conn, nil
+		}
+		logger.WithField("broker", brokerLabel(url)).WithError(err).Warn("Failed to connect to RabbitMQ")
+	}
+	return nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+}
+
+// runMigrateQueue implements the migrate-queue subcommand
+func runMigrateQueue(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("migrate-queue", flag.ContinueOnError)
+	configPath := flags.String("config", "config.yaml", "path to the config file")
+	opts := MigrateOptions{}
+	flags.StringVar(&opts.Source, "source", "", "queue to move messages from")
+	flags.StringVar(&opts.Exchange, "exchange", "", "exchange to move messages to (default exchange when empty)")
+	flags.StringVar(&opts.RoutingKey, "routing-key", "", "routing key to move messages to, the queue name for the default exchange")
+	flags.BoolVar(&opts.DryRun, "dry-run", false, "only count the messages that would be moved")
+	flags.IntVar(&opts.MaxMessages, "max-messages", 0, "stop after moving this many messages, 0 for all")
+	flags.IntVar(&opts.ProgressEvery, "progress-every", defaultMigrateProgressEvery, "log progress every this many messages")
+	flags.DurationVar(&opts.ConfirmTimeout, "confirm-timeout", defaultMigrateConfirmTimeout, "how long to wait for each broker confirm")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if opts.Source == "" || opts.RoutingKey == "" {
+		return fmt.Errorf("usage: data-ingestor migrate-queue -source QUEUE [-exchange EXCHANGE] -routing-key KEY [flags]")
+	}
+	if err := opts.Validate(); err != nil {
+		return err
+	}
+
+	config, err := LoadConfig(*configPath)
+	if err != nil {
+		return fmt.Errorf("failed to load config from %s: %w", *configPath, err)
+	}
+	logger := logrus.New()
+
+	summary, err := MigrateQueue(ctx, config, opts, logger)
+	entry := logger.WithFields(logrus.Fields{
+		"source":      opts.Source,
+		"exchange":    opts.Exchange,
+		"routing_key": opts.RoutingKey,
+		"remaining":   summary.Remaining,
+	})
+	switch {
+	case opts.DryRun:
+		entry.WithField("would_move", summary.WouldMove).Info("Dry run finished, nothing was moved")
+	case ctx.Err() != nil:
+		entry.WithField("moved", summary.Moved).Warn("Migration interrupted")
+	default:
+		entry.WithField("moved", summary.Moved).Info("Migration finished")
+	}
+	return err
+}
@@ -0,0 +1,100 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+// startRabbitMQ runs a broker in a container for the length of the test
+func startRabbitMQ(t *testing.T) string {
+	t.Helper()
+	ctx := context.Background()
+	container, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: testcontainers.ContainerRequest{
+			Image:        "rabbitmq:3.13-alpine",
+			ExposedPorts: []string{"5672/tcp"},
+			WaitingFor:   wait.ForLog("Server startup complete").WithStartupTimeout(2 * time.Minute),
+		},
+		Started: true,
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { container.Terminate(context.Background()) })
+
+	host, err := container.Host(ctx)
+	require.NoError(t, err)
+	port, err := container.MappedPort(ctx, "5672")
+	require.NoError(t, err)
+	return fmt.Sprintf("amqp://guest:guest@%s:%s/", host, port.Port())
+}
+
+func TestMigrateQueue_Integration(t *testing.T) {
+	url := startRabbitMQ(t)
+	conn, err := amqp.Dial(url)
+	require.NoError(t, err)
+	defer conn.Close()
+	channel, err := conn.Channel()
+	require.NoError(t, err)
+	defer channel.Close()
+
+	for _, queue := range []string{"weather_data", "weather_data.v2"} {
+		_, err := channel.QueueDeclare(queue, true, false, false, false, nil)
+		require.NoError(t, err)
+	}
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, channel.Publish("", "weather_data", false, false, amqp.Publishing{
+			MessageId:     fmt.Sprintf("m-%d", i),
+			CorrelationId: "cycle-1",
+			ContentType:   "application/json",
+			DeliveryMode:  amqp.Persistent,
+			Headers:       amqp.Table{"replayed": true},
+			Body:          []byte(fmt.Sprintf(`[{"name":"berlin-%d"}]`, i)),
+		}))
+	}
+	require.Eventually(t, func() bool {
+		queue, err := channel.QueueInspect("weather_data")
+		return err == nil && queue.Messages == 5
+	}, 10*time.Second, 50*time.Millisecond)
+
+	config := &Config{RabbitMQ: RabbitMQConfig{URL: url}}
+	logger, _ := test.NewNullLogger()
+	opts := MigrateOptions{Source: "weather_data", RoutingKey: "weather_data.v2"}
+
+	summary, err := MigrateQueue(context.Background(), config, MigrateOptions{Source: "weather_data", RoutingKey: "weather_data.v2", DryRun: true}, logger)
+	require.NoError(t, err)
+	assert.Equal(t, MigrateSummary{WouldMove: 5, Remaining: 5}, summary)
+
+	summary, err = MigrateQueue(context.Background(), config, opts, logger)
+	require.NoError(t, err)
+	assert.Equal(t, MigrateSummary{Moved: 5, Remaining: 0}, summary)
+
+	for i := 1; i <= 5; i++ {
+		delivery, ok, err := channel.Get("weather_data.v2", true)
+		require.NoError(t, err)
+		require.True(t, ok)
+		assert.Equal(t, fmt.Sprintf("m-%d", i), delivery.MessageId, "order is kept")
+		assert.Equal(t, "cycle-1", delivery.CorrelationId)
+		assert.Equal(t, true, delivery.Headers["replayed"])
+		assert.Equal(t, uint8(amqp.Persistent), delivery.DeliveryMode)
+	}
+
+	// Nothing is bound for the key, so the message stays on the source
+	require.NoError(t, channel.Publish("", "weather_data", false, false, amqp.Publishing{MessageId: "m-6", Body: []byte(`[]`)}))
+	require.Eventually(t, func() bool {
+		queue, err := channel.QueueInspect("weather_data")
+		return err == nil && queue.Messages == 1
+	}, 10*time.Second, 50*time.Millisecond)
+	summary, err = MigrateQueue(context.Background(), config, MigrateOptions{Source: "weather_data", RoutingKey: "nowhere"}, logger)
+	assert.ErrorIs(t, err, ErrUnroutable)
+	assert.Equal(t, MigrateSummary{Moved: 0, Remaining: 1}, summary)
+}
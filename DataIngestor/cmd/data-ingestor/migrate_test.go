@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMigrationBroker is an in-memory source queue and destination in
+// confirm mode. Gotten messages stay unacked until acked or requeued.
+type fakeMigrationBroker struct {
+	mu        sync.Mutex
+	source    []amqp.Delivery
+	unacked   map[uint64]amqp.Delivery
+	published []amqp.Publishing
+	nextTag   uint64
+
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	// nack, unroutable and silent change how publishes are answered
+	nack       bool
+	unroutable bool
+	silent     bool
+	// onPublish runs after every publish
+	onPublish func(count int)
+}
+
+func newFakeMigrationBroker(messages int) *fakeMigrationBroker {
+	b := &fakeMigrationBroker{
+		unacked:  make(map[uint64]amqp.Delivery),
+		confirms: make(chan amqp.Confirmation, 1),
+		returns:  make(chan amqp.Return, 1),
+	}
+	for i := 1; i <= messages; i++ {
+		b.source = append(b.source, amqp.Delivery{
+			MessageId:       fmt.Sprintf("m-%d", i),
+			CorrelationId:   "cycle-1",
+			ContentType:     "application/json",
+			ContentEncoding: compressionZstd,
+			DeliveryMode:    amqp.Persistent,
+			Priority:        uint8(i % 3),
+			Expiration:      "60000",
+			Timestamp:       time.Date(2024, 5, 3, 14, 0, i, 0, time.UTC),
+			Headers:         amqp.Table{"replayed": true, "upstream_headers": amqp.Table{"X-Station-Id": "st-42"}},
+			Body:            []byte(fmt.Sprintf(`[{"name":"berlin-%d"}]`, i)),
+		})
+	}
+	return b
+}
+
+func (b *fakeMigrationBroker) Get(queue string, autoAck bool) (amqp.Delivery, bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.source) == 0 {
+		return amqp.Delivery{}, false, nil
+	}
+	delivery := b.source[0]
+	b.source = b.source[1:]
+	b.nextTag++
+	delivery.DeliveryTag = b.nextTag
+	delivery.Acknowledger = b
+	b.unacked[delivery.DeliveryTag] = delivery
+	return delivery, true, nil
+}
+
+func (b *fakeMigrationBroker) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	b.mu.Lock()
+	b.published = append(b.published, msg)
+	count := len(b.published)
+	b.mu.Unlock()
+
+	if b.unroutable && mandatory {
+		b.returns <- amqp.Return{MessageId: msg.MessageId}
+	}
+	if !b.silent {
+		b.confirms <- amqp.Confirmation{DeliveryTag: uint64(count), Ack: !b.nack}
+	}
+	if b.onPublish != nil {
+		b.onPublish(count)
+	}
+	return nil
+}
+
+func (b *fakeMigrationBroker) QueueInspect(name string) (amqp.Queue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return amqp.Queue{Name: name, Messages: len(b.source)}, nil
+}
+
+func (b *fakeMigrationBroker) Ack(tag uint64, multiple bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.unacked, tag)
+	return nil
+}
+
+func (b *fakeMigrationBroker) Nack(tag uint64, multiple, requeue bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if delivery, ok := b.unacked[tag]; ok && requeue {
+		b.source = append([]amqp.Delivery{delivery}, b.source...)
+	}
+	delete(b.unacked, tag)
+	return nil
+}
+
+func (b *fakeMigrationBroker) Reject(tag uint64, requeue bool) error {
+	return b.Nack(tag, false, requeue)
+}
+
+func newTestMigrator(broker *fakeMigrationBroker, opts MigrateOptions) (*queueMigrator, *test.Hook) {
+	logger, hook := test.NewNullLogger()
+	opts.Source = "weather_data"
+	opts.Exchange, opts.RoutingKey = "weather", "weather.readings.v1"
+	if opts.ConfirmTimeout == 0 {
+		opts.ConfirmTimeout = time.Second
+	}
+	return &queueMigrator{
+		channel:  broker,
+		confirms: broker.confirms,
+		returns:  broker.returns,
+		opts:     opts,
+		logger:   logger,
+	}, hook
+}
+
+func progressLogs(hook *test.Hook) int {
+	count := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Migration progress" {
+			count++
+		}
+	}
+	return count
+}
+
+func TestMigrate_MovesEverything(t *testing.T) {
+	broker := newFakeMigrationBroker(5)
+	original := append([]amqp.Delivery(nil), broker.source...)
+	m, hook := newTestMigrator(broker, MigrateOptions{ProgressEvery: 2})
+
+	summary, err := m.run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, MigrateSummary{Moved: 5, Remaining: 0}, summary)
+	assert.Empty(t, broker.unacked)
+	assert.Equal(t, 2, progressLogs(hook))
+
+	require.Len(t, broker.published, 5)
+	for i, msg := range broker.published {
+		want := original[i]
+		assert.Equal(t, want.MessageId, msg.MessageId)
+		assert.Equal(t, want.CorrelationId, msg.CorrelationId)
+		assert.Equal(t, want.ContentType, msg.ContentType)
+		assert.Equal(t, want.ContentEncoding, msg.ContentEncoding)
+		assert.Equal(t, want.DeliveryMode, msg.DeliveryMode)
+		assert.Equal(t, want.Priority, msg.Priority)
+		assert.Equal(t, want.Expiration, msg.Expiration)
+		assert.Equal(t, want.Timestamp, msg.Timestamp)
+		assert.Equal(t, want.Headers, msg.Headers)
+		assert.Equal(t, want.Body, msg.Body)
+	}
+}
+
+func TestMigrate_MaxMessages(t *testing.T) {
+	broker := newFakeMigrationBroker(5)
+	m, _ := newTestMigrator(broker, MigrateOptions{MaxMessages: 2})
+
+	summary, err := m.run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, MigrateSummary{Moved: 2, Remaining: 3}, summary)
+	assert.Len(t, broker.published, 2)
+}
+
+func TestMigrate_DryRun(t *testing.T) {
+	broker := newFakeMigrationBroker(5)
+	m, _ := newTestMigrator(broker, MigrateOptions{DryRun: true, MaxMessages: 3})
+
+	summary, err := m.run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, MigrateSummary{WouldMove: 3, Remaining: 5}, summary)
+	assert.Empty(t, broker.published)
+	assert.Len(t, broker.source, 5)
+}
+
+func TestMigrate_FailedPublishIsRequeued(t *testing.T) {
+	tests := []struct {
+		name   string
+		broker func(b *fakeMigrationBroker)
+		err    error
+	}{
+		{"nacked", func(b *fakeMigrationBroker) { b.nack = true }, ErrPublishNacked},
+		{"unroutable", func(b *fakeMigrationBroker) { b.unroutable = true }, ErrUnroutable},
+		{"no confirm", func(b *fakeMigrationBroker) { b.silent = true }, ErrConfirmTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			broker := newFakeMigrationBroker(3)
+			tt.broker(broker)
+			m, _ := newTestMigrator(broker, MigrateOptions{ConfirmTimeout: 20 * time.Millisecond})
+
+			summary, err := m.run(context.Background())
+			assert.ErrorIs(t, err, tt.err)
+			assert.Equal(t, MigrateSummary{Moved: 0, Remaining: 3}, summary)
+			assert.Equal(t, "m-1", broker.source[0].MessageId, "the message is back at the head of the source")
+			assert.Empty(t, broker.unacked)
+		})
+	}
+}
+
+func TestMigrate_InterruptedAndRerun(t *testing.T) {
+	broker := newFakeMigrationBroker(5)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	broker.onPublish = func(count int) {
+		if count == 2 {
+			cancel()
+		}
+	}
+	m, _ := newTestMigrator(broker, MigrateOptions{})
+
+	summary, err := m.run(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, MigrateSummary{Moved: 2, Remaining: 3}, summary, "the in-flight message is finished")
+	assert.Empty(t, broker.unacked)
+
+	broker.onPublish = nil
+	summary, err = m.run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, MigrateSummary{Moved: 3, Remaining: 0}, summary)
+
+	ids := make(map[string]bool)
+	for _, msg := range broker.published {
+		ids[msg.MessageId] = true
+	}
+	assert.Len(t, ids, 5, "each message is moved once")
+}
+
+func TestMigrate_ZeroOptionsUseTheDefaults(t *testing.T) {
+	broker := newFakeMigrationBroker(3)
+	m, hook := newTestMigrator(broker, MigrateOptions{})
+	m.opts.ConfirmTimeout = 0
+
+	summary, err := m.run(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, MigrateSummary{Moved: 3, Remaining: 0}, summary)
+	assert.Zero(t, progressLogs(hook))
+	assert.Equal(t, defaultMigrateProgressEvery, m.opts.ProgressEvery)
+	assert.Equal(t, defaultMigrateConfirmTimeout, m.opts.ConfirmTimeout)
+}
+
+func TestMigrateOptions_Validate(t *testing.T) {
+	valid := MigrateOptions{Source: "weather_data", Exchange: "weather", RoutingKey: "weather.readings.v1"}
+	assert.NoError(t, valid.Validate())
+
+	for name, change := range map[string]func(o *MigrateOptions){
+		"no source":               func(o *MigrateOptions) { o.Source = "" },
+		"same queue":              func(o *MigrateOptions) { o.Exchange, o.RoutingKey = "", o.Source },
+		"negative max messages":   func(o *MigrateOptions) { o.MaxMessages = -1 },
+		"negative progress every": func(o *MigrateOptions) { o.ProgressEvery = -1 },
+		"negative confirm wait":   func(o *MigrateOptions) { o.ConfirmTimeout = -time.Second },
+	} {
+		opts := valid
+		change(&opts)
+		assert.Error(t, opts.Validate(), name)
+	}
+
+	broker := newFakeMigrationBroker(1)
+	m, _ := newTestMigrator(broker, MigrateOptions{ProgressEvery: -1})
+	_, err := m.run(context.Background())
+	assert.Error(t, err)
+	assert.Empty(t, broker.published)
+}
+
+func TestRunMigrateQueue_Usage(t *testing.T) {
+	assert.ErrorContains(t, runMigrateQueue(context.Background(), []string{"-routing-key", "weather.readings.v1"}), "usage")
+	assert.ErrorContains(t, runMigrateQueue(context.Background(), []string{"-source", "weather_data", "-routing-key", "weather_data"}), "same queue")
+	assert.ErrorContains(t, runMigrateQueue(context.Background(), []string{"-source", "weather_data", "-routing-key", "weather.readings.v1", "-confirm-timeout", "-1s"}), "confirm timeout")
+}
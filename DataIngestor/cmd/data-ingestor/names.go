@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// envEnv sets env when the config does not
+const envEnv = "DATA_INGESTOR_ENV"
+
+// Placeholders of queue, exchange and routing key names. env and instance
+// are resolved at startup, location and date for every message.
+const (
+	placeholderEnv      = "{env}"
+	placeholderInstance = "{instance}"
+	placeholderLocation = "{location}"
+	placeholderDate     = "{date}"
+)
+
+// defaultEnv sets env from $DATA_INGESTOR_ENV when the config has none
+func (c *Config) defaultEnv() {
+	if c.Env == "" {
+		c.Env = os.Getenv(envEnv)
+	}
+}
+
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// templatedName is a name field of the config that may hold placeholders
+type templatedName struct {
+	field string
+	value *string
+	// perMessage allows location and date
+	perMessage bool
+}
+
+// templatedNames returns the name fields of c: the queue and the dead
+// letter queue, which are declared at startup, and the routing targets
+func (c *Config) templatedNames() []templatedName {
+	names := []templatedName{
+		{field: "rabbitmq.queue_name", value: &c.RabbitMQ.QueueName},
+		{field: "publishing.dead_letter_queue", value: &c.Publishing.DeadLetterQueue},
+	}
+	for i := range c.Routing.Rules {
+		rule := &c.Routing.Rules[i]
+		for j := range rule.Targets {
+			prefix := fmt.Sprintf("routing.rules[%d].targets[%d]", i, j)
+			names = append(names,
+				templatedName{field: prefix + ".exchange", value: &rule.Targets[j].Exchange, perMessage: true},
+				templatedName{field: prefix + ".routing_key", value: &rule.Targets[j].RoutingKey, perMessage: true},
+			)
+		}
+	}
+	return names
+}
+
+// validateNames fails on unknown placeholders, stray braces and
+// placeholders that cannot be resolved, so no name is used with braces
+func (c *Config) validateNames() error {
+	for _, name := range c.templatedNames() {
+		value := *name.value
+		for _, placeholder := range placeholderPattern.FindAllString(value, -1) {
+			switch placeholder {
+			case placeholderEnv:
+				if c.Env == "" {
+					return fmt.Errorf("%s uses {env}, which needs env or $%s", name.field, envEnv)
+				}
+			case placeholderInstance:
+				if c.InstanceID == "" {
+					// A generated id would name a new queue on every start
+					return fmt.Errorf("%s uses {instance}, which needs instance_id", name.field)
+				}
+			case placeholderLocation, placeholderDate:
+				if !name.perMessage {
+					return fmt.Errorf("%s cannot use %s, it is declared at startup; use it in routing targets", name.field, placeholder)
+				}
+			default:
+				return fmt.Errorf("%s has unknown placeholder %s, want {env}, {instance}, {location} or {date}", name.field, placeholder)
+			}
+		}
+		if rest := placeholderPattern.ReplaceAllString(value, ""); strings.ContainsAny(rest, "{}") {
+			return fmt.Errorf("%s has an unbalanced brace: %q", name.field, value)
+		}
+	}
+	return nil
+}
+
+// resolvedNames returns c with env and instance resolved in every name, or
+// c itself when no name has placeholders. The copy keeps c as unresolved,
+// so tenants are derived from the names as configured.
+func (c *Config) resolvedNames(instanceID string) *Config {
+	templated := false
+	for _, name := range c.templatedNames() {
+		templated = templated || placeholderPattern.MatchString(*name.value)
+	}
+	if !templated {
+		return c
+	}
+
+	resolved := *c
+	resolved.unresolved = c
+	// withPrefix copies the rules and their targets
+	resolved.Routing = c.Routing.withPrefix("")
+	replacer := strings.NewReplacer(placeholderEnv, c.Env, placeholderInstance, instanceID)
+	for _, name := range resolved.templatedNames() {
+		*name.value = replacer.Replace(*name.value)
+	}
+	return &resolved
+}
+
+// configured returns the config as loaded, before resolvedNames
+func (c *Config) configured() *Config {
+	if c.unresolved != nil {
+		return c.unresolved
+	}
+	return c
+}
+
+// resolveTarget resolves the location and date of target for a reading of
+// location published at now
+func resolveTarget(target RoutingTarget, location string, now time.Time) RoutingTarget {
+	replacer := strings.NewReplacer(placeholderLocation, location, placeholderDate, now.UTC().Format(partitionDateLayout))
+	return RoutingTarget{
+		Exchange:   replacer.Replace(target.Exchange),
+		RoutingKey: replacer.Replace(target.RoutingKey),
+	}
+}
+
+func (t RoutingTarget) perMessage() bool {
+	for _, name := range []string{t.Exchange, t.RoutingKey} {
+		if strings.Contains(name, placeholderLocation) || strings.Contains(name, placeholderDate) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRoutes splits the routes whose target has location or date
+// placeholders into a route per resolved target, in the order of the
+// readings
+func splitRoutes(routes []Route, now time.Time) []Route {
+	var split []Route
+	for _, route := range routes {
+		if !route.Target.perMessage() {
+			split = append(split, route)
+			continue
+		}
+		index := make(map[RoutingTarget]int)
+		template := route.Target
+		for _, sensor := range route.Readings {
+			target := resolveTarget(route.Target, sensor.Location(), now)
+			i, ok := index[target]
+			if !ok {
+				i = len(split)
+				index[target] = i
+				split = append(split, Route{Rule: route.Rule, Target: target, Template: &template})
+			}
+			split[i].Readings = append(split[i].Readings, sensor)
+		}
+	}
+	return split
+}
+
+// runValidateConfig implements the validate-config subcommand: it checks
+// the config and prints the names it resolves to
+func runValidateConfig(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("validate-config", flag.ContinueOnError)
+	configPath := flags.String("config", "config.yaml", "path to the config file")
+	profile := flags.String("profile", os.Getenv(profileEnv), "config profile to apply, default $"+profileEnv)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	config, err := LoadConfigProfile(*configPath, *profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config from %s: %w", *configPath, err)
+	}
+	printNames(os.Stdout, config)
+	return nil
+}
+
+// printNames prints every name of config resolved as at startup. Location
+// and date placeholders are left for the messages to fill in.
+func printNames(w io.Writer, config *Config) {
+	resolved := config.resolvedNames(config.InstanceID)
+	fmt.Fprintf(w, "config ok, env %q, instance %q\n", config.Env, config.InstanceID)
+	for _, name := range resolved.templatedNames() {
+		if *name.value == "" {
+			continue
+		}
+		line := fmt.Sprintf("%s: %s", name.field, *name.value)
+		if placeholderPattern.MatchString(*name.value) {
+			line += "  # resolved per message"
+		}
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func templatedConfig() *Config {
+	return &Config{
+		Env:        "stage",
+		InstanceID: "ingestor-2",
+		RabbitMQ:   RabbitMQConfig{QueueName: "weather-{env}-{instance}"},
+		Routing: RoutingConfig{Rules: []RoutingRule{{
+			Name:    "per-location",
+			Targets: []RoutingTarget{{Exchange: "weather-{env}", RoutingKey: "{location}.{date}"}},
+		}}},
+	}
+}
+
+func TestNames_Validate(t *testing.T) {
+	assert.NoError(t, templatedConfig().Validate())
+	assert.NoError(t, (&Config{RabbitMQ: RabbitMQConfig{QueueName: "plain"}}).validateNames())
+
+	for _, tc := range []struct {
+		name   string
+		mutate func(c *Config)
+		want   string
+	}{
+		{"unknown placeholder", func(c *Config) { c.RabbitMQ.QueueName = "weather-{region}" }, "rabbitmq.queue_name has unknown placeholder {region}"},
+		{"empty placeholder", func(c *Config) { c.Routing.Rules[0].Targets[0].RoutingKey = "weather.{}" }, "unknown placeholder {}"},
+		{"stray brace", func(c *Config) { c.RabbitMQ.QueueName = "weather-{env" }, "unbalanced brace"},
+		{"closing brace", func(c *Config) { c.Routing.Rules[0].Targets[0].Exchange = "weather}" }, "unbalanced brace"},
+		{"env unset", func(c *Config) { c.Env = "" }, "needs env or $DATA_INGESTOR_ENV"},
+		{"instance unset", func(c *Config) { c.InstanceID = "" }, "needs instance_id"},
+		{"location in queue", func(c *Config) { c.RabbitMQ.QueueName = "weather-{location}" }, "rabbitmq.queue_name cannot use {location}"},
+		{"date in dead letter queue", func(c *Config) { c.Publishing.DeadLetterQueue = "oversized-{date}" }, "publishing.dead_letter_queue cannot use {date}"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			config := templatedConfig()
+			tc.mutate(config)
+			err := config.validateNames()
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.want)
+		})
+	}
+
+	config := templatedConfig()
+	config.RabbitMQ.QueueName = "weather-{region}"
+	assert.ErrorContains(t, config.Validate(), "unknown placeholder {region}")
+}
+
+func TestNames_ResolveEnvAndInstance(t *testing.T) {
+	config := templatedConfig()
+	config.Publishing.DeadLetterQueue = "weather-{env}-oversized"
+	resolved := config.resolvedNames("ingestor-2")
+
+	assert.Equal(t, "weather-stage-ingestor-2", resolved.RabbitMQ.QueueName)
+	assert.Equal(t, "weather-stage-oversized", resolved.Publishing.DeadLetterQueue)
+	assert.Equal(t, RoutingTarget{Exchange: "weather-stage", RoutingKey: "{location}.{date}"}, resolved.Routing.Rules[0].Targets[0],
+		"location and date are left for the messages")
+
+	assert.Equal(t, "weather-{env}-{instance}", config.RabbitMQ.QueueName, "the config is left as configured")
+	assert.Equal(t, "weather-{env}", config.Routing.Rules[0].Targets[0].Exchange)
+	assert.Same(t, config, resolved.configured())
+
+	plain := &Config{RabbitMQ: RabbitMQConfig{QueueName: "plain"}}
+	assert.Same(t, plain, plain.resolvedNames("ingestor-2"))
+	assert.Same(t, plain, plain.configured())
+}
+
+func TestNames_ResolveLocationAndDate(t *testing.T) {
+	now := time.Date(2024, 3, 1, 23, 30, 0, 0, time.FixedZone("CET", 3600))
+	target := resolveTarget(RoutingTarget{Exchange: "weather-{location}", RoutingKey: "{location}.{date}"}, "berlin", now)
+	assert.Equal(t, RoutingTarget{Exchange: "weather-berlin", RoutingKey: "berlin.2024-03-01"}, target, "the date is the UTC day")
+
+	routes := splitRoutes([]Route{
+		{Rule: "plain", Target: RoutingTarget{RoutingKey: "all"}, Readings: []SensorData{{Name: "berlin"}, {Name: "moscow"}}},
+		{Rule: "per-location", Target: RoutingTarget{RoutingKey: "{location}"}, Readings: []SensorData{{Name: "berlin"}, {Name: "moscow"}, {Name: "berlin"}}},
+	}, now)
+	require.Len(t, routes, 3)
+	assert.Equal(t, "all", routes[0].Target.RoutingKey)
+	assert.Len(t, routes[0].Readings, 2)
+	template := &RoutingTarget{RoutingKey: "{location}"}
+	assert.Equal(t, Route{Rule: "per-location", Target: RoutingTarget{RoutingKey: "berlin"}, Template: template, Readings: []SensorData{{Name: "berlin"}, {Name: "berlin"}}}, routes[1])
+	assert.Equal(t, Route{Rule: "per-location", Target: RoutingTarget{RoutingKey: "moscow"}, Template: template, Readings: []SensorData{{Name: "moscow"}}}, routes[2])
+	assert.Equal(t, RoutingTarget{RoutingKey: "all"}, routes[0].labels())
+	assert.Equal(t, *template, routes[1].labels(), "metrics are labelled with the configured target")
+}
+
+func TestNames_PublishToResolvedNames(t *testing.T) {
+	upstream := newUpstream(t, "application/json",
+		`[{"name":"berlin","type":"temperature","payload":{"value":1}},{"name":"moscow","type":"temperature","payload":{"value":2}}]`)
+	ingestor := NewDataIngestor(&Config{
+		Env:        "prod",
+		InstanceID: "ingestor-1",
+		API:        APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "weather-{env}"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Routing: RoutingConfig{Rules: []RoutingRule{{
+			Name:    "by-location",
+			Match:   MatchCondition{Location: "berlin"},
+			Targets: []RoutingTarget{{Exchange: "weather-{env}", RoutingKey: "{instance}.{location}.{date}"}},
+		}}},
+	})
+	assert.Equal(t, "weather-prod", ingestor.config.RabbitMQ.QueueName)
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	today := time.Now().UTC().Format(partitionDateLayout)
+	assert.Equal(t, "weather-prod", messages[0].Exchange)
+	assert.Equal(t, "ingestor-1.berlin."+today, messages[0].RoutingKey)
+	assert.Equal(t, "", messages[1].Exchange)
+	assert.Equal(t, "weather-prod", messages[1].RoutingKey, "unmatched readings go to the resolved queue")
+
+	// The per message placeholders stay in the labels, so a new day or
+	// location is no new series
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.PublishedMessages.WithLabelValues(sinkAMQP, "ingestor-1.{location}.{date}")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.RoutingRulePublishes.WithLabelValues("by-location", "weather-prod", "ingestor-1.{location}.{date}")))
+	assert.Equal(t, 2, testutil.CollectAndCount(ingestor.metrics.PublishedMessages), "the routed and the queue series")
+}
+
+func TestNames_EnvFromEnvironment(t *testing.T) {
+	path := writeConfigFiles(t, map[string]string{"config.yaml": `rabbitmq:
+  queue_name: "weather-{env}"
+`})
+	t.Setenv(envEnv, "")
+	_, err := LoadConfigProfile(path, "")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "needs env")
+
+	t.Setenv(envEnv, "dev")
+	config, err := LoadConfigProfile(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, "dev", config.Env)
+
+	path = writeConfigFiles(t, map[string]string{"config.yaml": `env: stage
+rabbitmq:
+  queue_name: "weather-{env}"
+`})
+	config, err = LoadConfigProfile(path, "")
+	require.NoError(t, err)
+	assert.Equal(t, "stage", config.Env, "the config wins over the environment")
+}
+
+func TestNames_PrintedByValidateConfig(t *testing.T) {
+	var out bytes.Buffer
+	printNames(&out, templatedConfig())
+	assert.Equal(t, `config ok, env "stage", instance "ingestor-2"
+rabbitmq.queue_name: weather-stage-ingestor-2
+routing.rules[0].targets[0].exchange: weather-stage
+routing.rules[0].targets[0].routing_key: {location}.{date}  # resolved per message
+`, out.String())
+}
+
+func TestNames_TenantsResolveTheirOwnInstance(t *testing.T) {
+	config := templatedConfig()
+	config.Tenants = map[string]TenantConfig{"acme": {QueuePrefix: "acme-"}}
+	resolved := config.resolvedNames("ingestor-2")
+
+	derived, err := resolved.configured().tenantConfig("acme")
+	require.NoError(t, err)
+	tenant := derived.resolvedNames(derived.InstanceID)
+	assert.Equal(t, "acme-weather-stage-ingestor-2-acme", tenant.RabbitMQ.QueueName)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	namingAsIs  = "as_is"
+	namingSnake = "snake_case"
+	namingCamel = "camelCase"
+)
+
+// validateFieldNaming checks publishing.field_naming and field_renames
+func (c PublishingConfig) validateFieldNaming() error {
+	switch c.FieldNaming {
+	case "", namingAsIs, namingSnake, namingCamel:
+	default:
+		return fmt.Errorf("publishing.field_naming must be %q, %q or %q, got %q", namingAsIs, namingSnake, namingCamel, c.FieldNaming)
+	}
+	for from, to := range c.FieldRenames {
+		if from == "" || to == "" {
+			return fmt.Errorf("publishing.field_renames: field names must not be empty")
+		}
+	}
+	if c.Passthrough && (c.FieldNaming != "" && c.FieldNaming != namingAsIs || len(c.FieldRenames) > 0) {
+		return fmt.Errorf("publishing.passthrough cannot be combined with field_naming or field_renames")
+	}
+	return nil
+}
+
+// fieldNamer renames the keys of published JSON: first by the naming policy,
+// then by the explicit renames. A nil fieldNamer leaves every key as is.
+type fieldNamer struct {
+	policy  func(string) string
+	renames map[string]string
+}
+
+// newFieldNamer returns nil when names are published as is
+func newFieldNamer(config PublishingConfig) *fieldNamer {
+	n := &fieldNamer{renames: config.FieldRenames}
+	switch config.FieldNaming {
+	case namingSnake:
+		n.policy = snakeCase
+	case namingCamel:
+		n.policy = camelCase
+	}
+	if n.policy == nil && len(n.renames) == 0 {
+		return nil
+	}
+	return n
+}
+
+// name returns the published name of a key
+func (n *fieldNamer) name(key string) string {
+	if n == nil {
+		return key
+	}
+	if n.policy != nil {
+		key = n.policy(key)
+	}
+	if renamed, ok := n.renames[key]; ok {
+		return renamed
+	}
+	return key
+}
+
+// marshal encodes v as JSON with every object key renamed, keeping the order
+// of the keys. A key keeps its original name when the new name is taken by
+// another key of the same object, so no field is lost.
+func (n *fieldNamer) marshal(v interface{}) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil || n == nil {
+		return body, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var out bytes.Buffer
+	if err := n.rewrite(dec, &out); err != nil {
+		return nil, fmt.Errorf("failed to rename fields: %w", err)
+	}
+	return out.Bytes(), nil
+}
+
+// rewrite copies one JSON value from dec to out, renaming object keys
+func (n *fieldNamer) rewrite(dec *json.Decoder, out *bytes.Buffer) error {
+	token, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case json.Delim('{'):
+		type field struct {
+			key   string
+			value bytes.Buffer
+		}
+		var fields []*field
+		original := map[string]bool{}
+		for dec.More() {
+			token, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			f := &field{key: token.(string)}
+			if err := n.rewrite(dec, &f.value); err != nil {
+				return err
+			}
+			fields = append(fields, f)
+			original[f.key] = true
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+
+		out.WriteByte('{')
+		taken := map[string]bool{}
+		for i, f := range fields {
+			name := n.name(f.key)
+			if name != f.key && (original[name] || taken[name]) {
+				name = f.key
+			}
+			taken[name] = true
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			writeJSON(out, name)
+			out.WriteByte(':')
+			out.Write(f.value.Bytes())
+		}
+		out.WriteByte('}')
+	case json.Delim('['):
+		out.WriteByte('[')
+		for first := true; dec.More(); first = false {
+			if !first {
+				out.WriteByte(',')
+			}
+			if err := n.rewrite(dec, out); err != nil {
+				return err
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+		out.WriteByte(']')
+	default:
+		if number, ok := token.(json.Number); ok {
+			out.WriteString(number.String())
+			return nil
+		}
+		writeJSON(out, token)
+	}
+	return nil
+}
+
+// writeJSON writes a string, bool or null token
+func writeJSON(out io.Writer, v interface{}) {
+	body, _ := json.Marshal(v)
+	out.Write(body)
+}
+
+// table renames the top-level AMQP headers of the envelope. Nested tables,
+// like the captured response headers, and the x- headers, whose names
+// consumers look up as they are, keep their names.
+func (n *fieldNamer) table(headers amqp.Table) amqp.Table {
+	if n == nil || headers == nil {
+		return headers
+	}
+	renamed := make(amqp.Table, len(headers))
+	for key, value := range headers {
+		if strings.HasPrefix(key, "x-") {
+			renamed[key] = value
+			continue
+		}
+		renamed[n.name(key)] = value
+	}
+	return renamed
+}
+
+// words splits a field name at underscores, hyphens, spaces and case
+// changes: "windSpeed", "wind_speed" and "WindSpeed" are all "wind speed",
+// and "HTTPStatus" is "http status". Digits stay with the word before them.
+func words(name string) []string {
+	runes := []rune(name)
+	var (
+		result []string
+		word   []rune
+	)
+	flush := func() {
+		if len(word) > 0 {
+			result = append(result, strings.ToLower(string(word)))
+			word = word[:0]
+		}
+	}
+	for i, r := range runes {
+		switch {
+		case r == '_' || r == '-' || r == ' ':
+			flush()
+			continue
+		case unicode.IsUpper(r) && i > 0:
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				flush()
+			}
+		}
+		word = append(word, r)
+	}
+	flush()
+	return result
+}
+
+func snakeCase(name string) string {
+	parts := words(name)
+	if len(parts) == 0 {
+		return name
+	}
+	return strings.Join(parts, "_")
+}
+
+func camelCase(name string) string {
+	parts := words(name)
+	if len(parts) == 0 {
+		return name
+	}
+	for i := 1; i < len(parts); i++ {
+		runes := []rune(parts[i])
+		runes[0] = unicode.ToUpper(runes[0])
+		parts[i] = string(runes)
+	}
+	return strings.Join(parts, "")
+}
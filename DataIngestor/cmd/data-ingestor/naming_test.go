@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// namingUpstreamBody mixes the naming styles upstreams send
+const namingUpstreamBody = `[{"type":"weather","name":"moscow","payload":{
+	"temperature": -3.5,
+	"windSpeed": 4.2,
+	"wind_gust": 7,
+	"HTTPStatus": 200,
+	"pm2_5": 12,
+	"Dew-Point": -8.25,
+	"stationInfo": {"stationId": "st-1", "elevationM": 156, "sensors": [{"sensorType": "pt100"}]}
+}}]`
+
+const namingMetadataYAML = `
+locations:
+  Moscow:
+    lat: 55.75
+    lon: 37.62
+    country: RU
+    altitude_m: 156
+`
+
+// publishedWithNaming ingests namingUpstreamBody with the given publishing
+// config and returns the published body and headers as indented JSON
+func publishedWithNaming(t *testing.T, publishing PublishingConfig) []byte {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Station-Id", "st-1")
+		w.Write([]byte(namingUpstreamBody))
+	}))
+	t.Cleanup(upstream.Close)
+
+	ingestor := NewDataIngestor(&Config{
+		InstanceID: "ingestor-test",
+		API:        APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second), CaptureHeaders: []string{"X-Station-Id"}},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Publishing: publishing,
+		Logging:    LoggingConfig{Level: "error"},
+	})
+	enricher, _, _ := newTestEnricher(t, "locations.yaml", namingMetadataYAML)
+	ingestor.enricher = enricher
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+
+	published, err := json.MarshalIndent(struct {
+		Headers interface{}     `json:"headers"`
+		Body    json.RawMessage `json:"body"`
+	}{messages[0].Msg.Headers, messages[0].Msg.Body}, "", "  ")
+	require.NoError(t, err)
+	return append(published, '\n')
+}
+
+func TestFieldNaming_Golden(t *testing.T) {
+	tests := []struct {
+		golden     string
+		publishing PublishingConfig
+	}{
+		{"as_is", PublishingConfig{}},
+		{"as_is", PublishingConfig{FieldNaming: namingAsIs}},
+		{"snake_case", PublishingConfig{FieldNaming: namingSnake}},
+		{"camelCase", PublishingConfig{FieldNaming: namingCamel}},
+		{"camelCase_renamed", PublishingConfig{FieldNaming: namingCamel, FieldRenames: map[string]string{
+			"windSpeed":  "windSpeedMs",
+			"instanceId": "publisher",
+		}}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join("testdata", "naming", tt.golden+".json")
+		got := publishedWithNaming(t, tt.publishing)
+		if *updateGolden {
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+			require.NoError(t, os.WriteFile(path, got, 0o644))
+		}
+		want, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, string(want), string(got), "%s; rerun with -update after intended changes", path)
+	}
+}
+
+func TestNamingPolicies(t *testing.T) {
+	tests := []struct {
+		in, snake, camel string
+	}{
+		{"windSpeed", "wind_speed", "windSpeed"},
+		{"wind_speed", "wind_speed", "windSpeed"},
+		{"WindSpeed", "wind_speed", "windSpeed"},
+		{"HTTPStatus", "http_status", "httpStatus"},
+		{"altitude_m", "altitude_m", "altitudeM"},
+		{"Dew-Point", "dew_point", "dewPoint"},
+		{"pm25Value", "pm25_value", "pm25Value"},
+		{"temperature", "temperature", "temperature"},
+		{"ID", "id", "id"},
+		{"_", "_", "_"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.snake, snakeCase(tt.in), tt.in)
+		assert.Equal(t, tt.camel, camelCase(tt.in), tt.in)
+	}
+}
+
+func TestFieldNamer_KeepsCollidingFields(t *testing.T) {
+	namer := newFieldNamer(PublishingConfig{FieldNaming: namingSnake})
+	body, err := namer.marshal(map[string]interface{}{"windSpeed": 1, "wind_speed": 2})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"wind_speed": 2, "windSpeed": 1}`, string(body))
+
+	namer = newFieldNamer(PublishingConfig{FieldNaming: namingSnake, FieldRenames: map[string]string{"gust": "wind_gust"}})
+	body, err = namer.marshal(map[string]interface{}{"gust": 1, "windGust": 2})
+	require.NoError(t, err)
+	assert.Equal(t, `{"wind_gust":1,"windGust":2}`, string(body), "the first field with a name wins")
+}
+
+func TestFieldNamer_AsIsIsNil(t *testing.T) {
+	assert.Nil(t, newFieldNamer(PublishingConfig{}))
+	assert.Nil(t, newFieldNamer(PublishingConfig{FieldNaming: namingAsIs}))
+	assert.NotNil(t, newFieldNamer(PublishingConfig{FieldRenames: map[string]string{"a": "b"}}))
+
+	var namer *fieldNamer
+	body, err := namer.marshal(SensorData{Type: "weather", Name: "moscow"})
+	require.NoError(t, err)
+	assert.Equal(t, `{"type":"weather","name":"moscow","payload":null}`, string(body))
+}
+
+func TestFieldNaming_WebhooksAndPubSub(t *testing.T) {
+	naming := newFieldNamer(PublishingConfig{FieldNaming: namingCamel})
+
+	sink, server := newTestPubSub(t, PubSubConfig{}, true)
+	sink.naming = naming
+	reading := SensorData{Type: "weather", Name: "moscow", Payload: map[string]interface{}{"wind_speed": 4.2}}
+	_, err := sink.Publish(context.Background(), WeatherData{reading}, Envelope{CorrelationID: "cycle-1"})
+	require.NoError(t, err)
+	messages := server.Messages()
+	require.Len(t, messages, 1)
+	assert.JSONEq(t, `{"type":"weather","name":"moscow","payload":{"windSpeed":4.2}}`, string(messages[0].Data))
+	assert.Equal(t, "cycle-1", messages[0].Attributes["correlationId"])
+	assert.Equal(t, "application/json", messages[0].Attributes["contentType"])
+
+	notifier := NewNotifier([]SubscriberConfig{{URL: "http://example.com"}}, nil)
+	notifier.naming = naming
+	notifier.Notify(WeatherData{reading})
+	assert.JSONEq(t, `{"type":"weather","name":"moscow","payload":{"windSpeed":4.2}}`, string(<-notifier.subscribers[0].queue))
+}
+
+func TestPublishingConfig_ValidateFieldNaming(t *testing.T) {
+	assert.NoError(t, PublishingConfig{FieldNaming: namingCamel}.validateFieldNaming())
+	assert.EqualError(t, PublishingConfig{FieldNaming: "kebab"}.validateFieldNaming(),
+		`publishing.field_naming must be "as_is", "snake_case" or "camelCase", got "kebab"`)
+	assert.ErrorContains(t, PublishingConfig{FieldRenames: map[string]string{"wind": ""}}.validateFieldNaming(), "must not be empty")
+	assert.ErrorContains(t, PublishingConfig{Passthrough: true, FieldNaming: namingSnake}.validateFieldNaming(), "passthrough")
+	assert.NoError(t, PublishingConfig{Passthrough: true, FieldNaming: namingAsIs}.validateFieldNaming())
+}
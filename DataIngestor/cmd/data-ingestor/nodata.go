@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+)
+
+// ErrNoData is returned when a location has not reported in the current
+// window. It is an expected outcome, not a failure: nothing is published and
+// the circuit breaker is left alone.
+var ErrNoData = errors.New("upstream has no data yet")
+
+// isNoData reports whether a response means "no data yet": 204 No Content,
+// an empty body, or a JSON object without an id whose fields are all zero
+func isNoData(statusCode int, body []byte) bool {
+	if statusCode == http.StatusNoContent {
+		return true
+	}
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return true
+	}
+	if body[0] != '{' {
+		return false
+	}
+
+	var object map[string]interface{}
+	if err := json.Unmarshal(body, &object); err != nil {
+		return false
+	}
+	if _, ok := object["id"]; ok {
+		return false
+	}
+	for _, value := range object {
+		if value != nil && !reflect.ValueOf(value).IsZero() && !isEmptyCollection(value) {
+			return false
+		}
+	}
+	return true
+}
+
+func isEmptyCollection(value interface{}) bool {
+	switch v := value.(type) {
+	case []interface{}:
+		return len(v) == 0
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var noDataResponses = []struct {
+	name   string
+	status int
+	body   string
+}{
+	{"204 No Content", http.StatusNoContent, ""},
+	{"empty body", http.StatusOK, ""},
+	{"empty object", http.StatusOK, `{}`},
+	{"zero-valued object", http.StatusOK, `{"temperature": 0, "location": "", "readings": [], "meta": null}`},
+}
+
+func newNoDataIngestor(t *testing.T, status int, body string) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL:        upstream.URL,
+			Timeout:        Duration(time.Second),
+			CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: Duration(time.Minute)},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+func TestFetchDataFromAPI_NoData(t *testing.T) {
+	for _, tt := range noDataResponses {
+		t.Run(tt.name, func(t *testing.T) {
+			ingestor, _ := newNoDataIngestor(t, tt.status, tt.body)
+			_, err := ingestor.FetchDataFromAPI(context.Background())
+			assert.ErrorIs(t, err, ErrNoData)
+		})
+	}
+}
+
+func TestIngest_NoDataLeavesBreakerAlone(t *testing.T) {
+	for _, tt := range noDataResponses {
+		t.Run(tt.name, func(t *testing.T) {
+			ingestor, channel := newNoDataIngestor(t, tt.status, tt.body)
+
+			// With a threshold of one, any counted failure would open the breaker
+			for i := 0; i < 3; i++ {
+				_, err := ingestor.ingest(context.Background())
+				assert.ErrorIs(t, err, ErrNoData)
+			}
+
+			assert.Empty(t, channel.messages())
+			status := ingestor.sources[0].status(time.Now())
+			assert.Equal(t, "closed", status.Breaker)
+			assert.Zero(t, status.ConsecutiveFailures)
+			assert.Nil(t, status.LastSuccess)
+			assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.NoDataResponses.WithLabelValues(defaultSourceName)))
+			assert.Zero(t, testutil.ToFloat64(ingestor.metrics.UpstreamFailures.WithLabelValues(defaultSourceName)))
+		})
+	}
+}
+
+func TestHandleIngest_NoData(t *testing.T) {
+	for _, tt := range noDataResponses {
+		t.Run(tt.name, func(t *testing.T) {
+			ingestor, _ := newNoDataIngestor(t, tt.status, tt.body)
+			w := postIngest(setupRoutes(ingestor), "", "")
+			assert.Equal(t, http.StatusNoContent, w.Code)
+			assert.Empty(t, w.Body.String())
+		})
+	}
+}
+
+func TestIsNoData_RealPayloads(t *testing.T) {
+	assert.False(t, isNoData(http.StatusOK, []byte(`{"id": 0}`)), "an id means the object is a reading")
+	assert.False(t, isNoData(http.StatusOK, []byte(`{"temperature": 21.5}`)))
+	assert.False(t, isNoData(http.StatusOK, []byte(`[]`)))
+	assert.False(t, isNoData(http.StatusOK, []byte(`[{"type":"energy","name":"meter-1"}]`)))
+}
+
+func TestIngest_NoDataDoesNotCloseHalfOpenBreaker(t *testing.T) {
+	ingestor, _ := newNoDataIngestor(t, http.StatusNoContent, "")
+	src := ingestor.sources[0]
+	now := time.Now()
+	src.record(now.Add(-2*time.Minute), assert.AnError)
+	require.Equal(t, "open", src.status(now).Breaker)
+
+	// The probe gets no data: the breaker stays half-open and may probe again
+	_, err := ingestor.ingest(context.Background())
+	assert.ErrorIs(t, err, ErrNoData)
+	assert.Equal(t, "half_open", src.status(now).Breaker)
+	assert.NoError(t, src.allow(time.Now()))
+}
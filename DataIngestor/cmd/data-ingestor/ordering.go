@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// Values of publishing.ordering
+const (
+	orderingNone        = "none"
+	orderingPerLocation = "per_location"
+)
+
+const defaultOrderingLanes = 16
+
+// validateOrdering checks publishing.ordering and the settings that would
+// reorder the readings of a location behind its back
+func (c *Config) validateOrdering() error {
+	switch c.Publishing.Ordering {
+	case "", orderingNone, orderingPerLocation:
+	default:
+		return fmt.Errorf("publishing.ordering must be none or per_location, got %q", c.Publishing.Ordering)
+	}
+	if c.Publishing.OrderingLanes < 0 {
+		return fmt.Errorf("publishing.ordering_lanes must not be negative")
+	}
+	if c.Publishing.Ordering != orderingPerLocation {
+		return nil
+	}
+	for _, rule := range c.Publishing.MessageRules {
+		if rule.Priority > 0 {
+			// The broker hands out higher priorities first, whatever the
+			// order they were published in
+			return fmt.Errorf("publishing.ordering per_location cannot be combined with message rule %q, which sets a priority", rule.Name)
+		}
+	}
+	if c.Backfill.order() == orderNewestFirst {
+		return fmt.Errorf("publishing.ordering per_location cannot be combined with backfill.order newest_first")
+	}
+	return nil
+}
+
+func (c PublishingConfig) orderingLanes() int {
+	if c.OrderingLanes > 0 {
+		return c.OrderingLanes
+	}
+	return defaultOrderingLanes
+}
+
+// orderLane publishes the readings of the locations hashed onto it one
+// delivery at a time
+type orderLane struct {
+	mu sync.Mutex
+
+	turnsMu sync.Mutex
+	// turns are the tickets of the locations with fetches in flight;
+	// guarded by turnsMu
+	turns map[string]*locationTurns
+}
+
+// locationTurns hands out the turns of one location in ticket order
+type locationTurns struct {
+	// issued is the newest ticket and turn the one that may publish now
+	issued, turn uint64
+	// finished are tickets that ended before their turn came
+	finished map[uint64]bool
+	// changed is closed and replaced when the turn moves on
+	changed chan struct{}
+}
+
+// publishOrder keeps the readings of each location in the order they were
+// fetched, with publishing.ordering per_location. It is nil otherwise.
+type publishOrder struct {
+	lanes []*orderLane
+}
+
+func newPublishOrder(c PublishingConfig) *publishOrder {
+	if c.Ordering != orderingPerLocation {
+		return nil
+	}
+	o := &publishOrder{lanes: make([]*orderLane, c.orderingLanes())}
+	for i := range o.lanes {
+		o.lanes[i] = &orderLane{turns: map[string]*locationTurns{}}
+	}
+	return o
+}
+
+// enterOrder waits for the turn of ticket, counting the publishes that have
+// to wait for an older one of their location
+func (di *DataIngestor) enterOrder(ctx context.Context, ticket *orderTicket) error {
+	if ticket.queued() {
+		di.metrics.OrderingHeld.WithLabelValues(ticket.location).Inc()
+	}
+	if err := ticket.enter(ctx); err != nil {
+		return fmt.Errorf("waiting for an earlier fetch of the location to publish: %w", err)
+	}
+	return nil
+}
+
+// lane returns the lane of location, by the same hash as the partitions
+func (o *publishOrder) lane(location string) int {
+	return partitionOf(location, len(o.lanes))
+}
+
+// orderTicket is the place of one fetch, or of posted readings or a
+// backfill page, in the line of its location. A nil ticket has no place in
+// any line.
+type orderTicket struct {
+	lane     *orderLane
+	location string
+	number   uint64
+	// done is set once the ticket finished; guarded by the lane's turnsMu
+	done bool
+}
+
+// ticket returns the next place in the line of location. Fetches take it
+// before their request is sent, so a slow fetch keeps its place before the
+// ones sent after it. Every ticket must be finished, published or not.
+func (o *publishOrder) ticket(location string) *orderTicket {
+	if o == nil {
+		return nil
+	}
+	lane := o.lanes[o.lane(location)]
+	lane.turnsMu.Lock()
+	defer lane.turnsMu.Unlock()
+	turns, ok := lane.turns[location]
+	if !ok {
+		turns = &locationTurns{turn: 1, finished: map[uint64]bool{}, changed: make(chan struct{})}
+		lane.turns[location] = turns
+	}
+	turns.issued++
+	return &orderTicket{lane: lane, location: location, number: turns.issued}
+}
+
+// queued reports whether an earlier ticket of the location has not
+// finished yet
+func (t *orderTicket) queued() bool {
+	if t == nil {
+		return false
+	}
+	t.lane.turnsMu.Lock()
+	defer t.lane.turnsMu.Unlock()
+	return t.lane.turns[t.location].turn != t.number
+}
+
+// enter waits until every earlier ticket of the location finished, then for
+// the lane, which is held until leave. It fails when ctx ends first; the
+// ticket is finished then.
+func (t *orderTicket) enter(ctx context.Context) error {
+	if t == nil {
+		return nil
+	}
+	for {
+		t.lane.turnsMu.Lock()
+		turns := t.lane.turns[t.location]
+		if turns.turn == t.number {
+			t.lane.turnsMu.Unlock()
+			break
+		}
+		changed := turns.changed
+		t.lane.turnsMu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			t.finish()
+			return ctx.Err()
+		}
+	}
+	t.lane.mu.Lock()
+	return nil
+}
+
+// leave releases the lane and finishes the ticket
+func (t *orderTicket) leave() {
+	if t == nil {
+		return
+	}
+	t.lane.mu.Unlock()
+	t.finish()
+}
+
+// finish gives up the ticket's place, letting the next ticket of the
+// location publish. A fetch that failed finishes its ticket without
+// publishing; finishing twice does nothing.
+func (t *orderTicket) finish() {
+	if t == nil {
+		return
+	}
+	t.lane.turnsMu.Lock()
+	defer t.lane.turnsMu.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	turns := t.lane.turns[t.location]
+	turns.finished[t.number] = true
+	for turns.finished[turns.turn] {
+		delete(turns.finished, turns.turn)
+		turns.turn++
+	}
+	close(turns.changed)
+	turns.changed = make(chan struct{})
+	if turns.turn > turns.issued {
+		// Nothing in flight; removed locations leave nothing behind
+		delete(t.lane.turns, t.location)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gatedChannel confirms its publishes itself, and nacks the ones of the
+// readings naming hold once open is closed
+type gatedChannel struct {
+	*fakeChannel
+	hold     string
+	tags     atomic.Uint64
+	confirms chan amqp.Confirmation
+	entered  chan struct{}
+	open     chan struct{}
+}
+
+func (g *gatedChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := g.fakeChannel.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+	tag := g.tags.Add(1)
+	if !bytes.Contains(msg.Body, []byte(g.hold)) {
+		g.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: true}
+		return nil
+	}
+	g.entered <- struct{}{}
+	go func() {
+		<-g.open
+		g.confirms <- amqp.Confirmation{DeliveryTag: tag, Ack: false}
+	}()
+	return nil
+}
+
+func newOrderingIngestor(t *testing.T, lanes int, locations ...string) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	sources := make([]LocationSource, len(locations))
+	for i, name := range locations {
+		sources[i] = LocationSource{Name: name, BaseURL: "http://127.0.0.1:1"}
+	}
+	ingestor := NewDataIngestor(&Config{
+		API:        APIConfig{Locations: sources, Timeout: Duration(5 * time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Publishing: PublishingConfig{Ordering: orderingPerLocation, OrderingLanes: lanes},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+// deliverFetch runs the cycle of location over readings fetched with
+// ticket, or with a ticket of its own when it is nil
+func deliverFetch(ingestor *DataIngestor, location string, ticket *orderTicket, temperature float64) (*IngestResult, error) {
+	data := WeatherData{{Type: "weather", Name: location, Payload: map[string]interface{}{"temperature": temperature}}}
+	fetches := map[string]*bulkFetch{location: {fetched: &fetchResult{Data: &data}, ticket: ticket}}
+	return ingestor.ingestSource(withBulkFetches(context.Background(), fetches), ingestor.sourceByName(location))
+}
+
+// publishedTemperatures returns the temperatures of every message on
+// channel, in publish order
+func publishedTemperatures(t *testing.T, channel *fakeChannel) []float64 {
+	t.Helper()
+	var temperatures []float64
+	for _, msg := range channel.messages() {
+		var data WeatherData
+		require.NoError(t, json.Unmarshal(msg.Msg.Body, &data))
+		for _, reading := range data {
+			temperatures = append(temperatures, reading.Payload["temperature"].(float64))
+		}
+	}
+	return temperatures
+}
+
+// laneNeighbours returns a location on the lane of location and one on
+// another lane
+func laneNeighbours(t *testing.T, location string, lanes int) (same, other string) {
+	t.Helper()
+	for i := 0; same == "" || other == ""; i++ {
+		require.Less(t, i, 1000)
+		name := fmt.Sprintf("station-%d", i)
+		if partitionOf(name, lanes) == partitionOf(location, lanes) {
+			if same == "" {
+				same = name
+			}
+		} else if other == "" {
+			other = name
+		}
+	}
+	return same, other
+}
+
+func TestOrdering_Validate(t *testing.T) {
+	valid := &Config{Publishing: PublishingConfig{Ordering: orderingPerLocation}}
+	assert.NoError(t, valid.validateOrdering())
+	assert.NoError(t, (&Config{}).validateOrdering())
+	assert.Nil(t, newPublishOrder(PublishingConfig{Ordering: orderingNone}))
+	assert.Len(t, newPublishOrder(valid.Publishing).lanes, defaultOrderingLanes)
+
+	for name, config := range map[string]*Config{
+		"publishing.ordering must be": {Publishing: PublishingConfig{Ordering: "strict"}},
+		"publishing.ordering_lanes":   {Publishing: PublishingConfig{OrderingLanes: -1}},
+		`message rule "alerts"`:       {Publishing: PublishingConfig{Ordering: orderingPerLocation, MessageRules: []MessageRule{{Name: "alerts", Priority: 5}}}},
+		"backfill.order newest_first": {Publishing: PublishingConfig{Ordering: orderingPerLocation}, Backfill: BackfillConfig{Order: orderNewestFirst}},
+	} {
+		assert.ErrorContains(t, config.validateOrdering(), name)
+	}
+	// Expirations do not reorder anything
+	ttl := &Config{Publishing: PublishingConfig{Ordering: orderingPerLocation, MessageRules: []MessageRule{{Name: "stale", TTL: Duration(time.Minute)}}}}
+	assert.NoError(t, ttl.validateOrdering())
+}
+
+func TestOrdering_LanesFollowThePartitionHash(t *testing.T) {
+	order := newPublishOrder(PublishingConfig{Ordering: orderingPerLocation, OrderingLanes: 4})
+	for _, location := range []string{"moscow", "oslo", "lima"} {
+		assert.Equal(t, partitionOf(location, 4), order.lane(location))
+	}
+
+	var none *publishOrder
+	ticket := none.ticket("moscow")
+	assert.Nil(t, ticket)
+	assert.False(t, ticket.queued())
+	assert.NoError(t, ticket.enter(context.Background()))
+	ticket.leave()
+	ticket.finish()
+}
+
+func TestOrdering_SlowerOlderFetchIsPublishedFirst(t *testing.T) {
+	var hits atomic.Int32
+	first := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		temperature := -4
+		if hits.Add(1) == 1 {
+			close(first)
+			<-release
+			temperature = -5
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `[{"type":"weather","name":"moscow-1","payload":{"temperature":%d}}]`, temperature)
+	}))
+	defer upstream.Close()
+	ingestor, channel := newOrderingIngestor(t, 0, "moscow")
+	ingestor.sources[0].baseURL = upstream.URL
+	src := ingestor.sources[0]
+
+	older := make(chan LocationOutcome, 1)
+	go func() { older <- ingestor.ingestOnce(context.Background(), src) }()
+	<-first
+	newer := make(chan LocationOutcome, 1)
+	go func() { newer <- ingestor.ingestOnce(withTrigger(context.Background(), triggerManual), src) }()
+
+	// The newer fetch returned first and waits for the older one
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(ingestor.metrics.OrderingHeld.WithLabelValues("moscow")) == 1
+	}, 5*time.Second, time.Millisecond)
+	assert.Empty(t, channel.messages())
+
+	close(release)
+	assert.Equal(t, outcomePublished, (<-older).Outcome)
+	assert.Equal(t, outcomePublished, (<-newer).Outcome)
+	assert.Equal(t, []float64{-5, -4}, publishedTemperatures(t, channel), "in the order the requests were sent, none dropped")
+}
+
+func TestOrdering_FailedFetchesGiveUpTheirPlace(t *testing.T) {
+	ingestor, channel := newOrderingIngestor(t, 0, "moscow")
+	failed := ingestor.ordering.ticket("moscow")
+	published := ingestor.ordering.ticket("moscow")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := deliverFetch(ingestor, "moscow", published, -4)
+		done <- err
+	}()
+	select {
+	case <-done:
+		t.Fatal("published before the earlier fetch ended")
+	case <-time.After(50 * time.Millisecond):
+	}
+	// The earlier fetch failed and published nothing
+	failed.finish()
+	require.NoError(t, <-done)
+	assert.Equal(t, []float64{-4}, publishedTemperatures(t, channel))
+
+	// A failed publish lets the later fetches go as well
+	channel.err = errors.New("channel closed")
+	_, err := deliverFetch(ingestor, "moscow", nil, -3)
+	require.Error(t, err)
+	channel.err = nil
+	_, err = deliverFetch(ingestor, "moscow", nil, -2)
+	require.NoError(t, err)
+	assert.Equal(t, []float64{-4, -2}, publishedTemperatures(t, channel))
+
+	// Nothing is kept once no fetch is in flight
+	lane := ingestor.ordering.lanes[ingestor.ordering.lane("moscow")]
+	lane.turnsMu.Lock()
+	assert.Empty(t, lane.turns)
+	lane.turnsMu.Unlock()
+}
+
+func TestOrdering_WaitEndsWithTheContext(t *testing.T) {
+	ingestor, channel := newOrderingIngestor(t, 0, "moscow")
+	stuck := ingestor.ordering.ticket("moscow")
+	waiting := ingestor.ordering.ticket("moscow")
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.True(t, waiting.queued())
+	assert.ErrorIs(t, waiting.enter(ctx), context.DeadlineExceeded)
+	assert.Empty(t, channel.messages())
+
+	// The cancelled ticket does not hold up the ones after it
+	stuck.finish()
+	_, err := deliverFetch(ingestor, "moscow", nil, -1)
+	require.NoError(t, err)
+}
+
+func TestOrdering_PostedReadingsWaitInLine(t *testing.T) {
+	ingestor, channel := newOrderingIngestor(t, 0, "moscow")
+	ingestor.config.Admin.Token = "letmein"
+	router := setupRoutes(ingestor)
+	inFlight := ingestor.ordering.ticket("moscow")
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		done <- postReadings(router, `[{"type":"weather","name":"moscow","payload":{"temperature":1}}]`)
+	}()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(ingestor.metrics.OrderingHeld.WithLabelValues("moscow")) == 1
+	}, 5*time.Second, time.Millisecond)
+	assert.Empty(t, channel.messages())
+	inFlight.finish()
+	w := <-done
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, channel.messages(), 1)
+}
+
+func TestOrdering_FailedPublishBlocksOnlyItsLane(t *testing.T) {
+	const lanes = 4
+	same, other := laneNeighbours(t, "moscow", lanes)
+	ingestor, channel := newOrderingIngestor(t, lanes, "moscow", same, other)
+	gated := &gatedChannel{
+		fakeChannel: channel,
+		hold:        `"moscow"`,
+		confirms:    make(chan amqp.Confirmation, 10),
+		entered:     make(chan struct{}, 1),
+		open:        make(chan struct{}),
+	}
+	tracker := newConfirmTracker()
+	attachChannel(ingestor, gated, tracker)
+	go ingestor.listenConfirms(tracker, gated.confirms)
+	var release sync.Once
+	defer release.Do(func() { close(gated.open) })
+
+	// moscow's message waits for a confirmation that turns out a nack
+	held := make(chan error, 1)
+	go func() {
+		_, err := deliverFetch(ingestor, "moscow", nil, -5)
+		held <- err
+	}()
+	<-gated.entered
+
+	queued := make(chan error, 1)
+	go func() {
+		_, err := deliverFetch(ingestor, same, nil, -4)
+		queued <- err
+	}()
+	_, err := deliverFetch(ingestor, other, nil, -3)
+	require.NoError(t, err, "another lane publishes while moscow's waits")
+	select {
+	case <-queued:
+		t.Fatal("a location on the waiting lane published past it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release.Do(func() { close(gated.open) })
+	require.Error(t, <-held)
+	require.NoError(t, <-queued)
+	messages := channel.messages()
+	require.Len(t, messages, 3)
+	assert.Contains(t, string(messages[0].Msg.Body), `"moscow"`)
+	assert.Contains(t, string(messages[1].Msg.Body), `"`+other+`"`)
+	assert.Contains(t, string(messages[2].Msg.Body), `"`+same+`"`)
+}
+
+func TestOrdering_NewestFirstBackfillIsRefused(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	stateFile := filepath.Join(t.TempDir(), "backfill.json")
+	writeBackfillState(t, stateFile, pendingJob("outage", orderNewestFirst, 2), pendingJob("legacy", "", 1))
+	ingestor, channel := newOrderedIngestor(t, upstream.server.URL, stateFile, BackfillConfig{})
+	ingestor.ordering = newPublishOrder(PublishingConfig{Ordering: orderingPerLocation})
+	stop := runBackfill(t, ingestor)
+	defer stop()
+
+	// Saved before the mode was switched on
+	job := waitForJob(t, ingestor, "outage", jobFailed)
+	assert.Contains(t, job.Error, "newest_first")
+	waitForJob(t, ingestor, "legacy", jobCompleted)
+	assert.Len(t, channel.messages(), 1)
+
+	router := setupRoutes(ingestor)
+	w := backfillCall(router, http.MethodPost, "/backfill", `{"location":"default","from":"2026-03-01T00:00:00Z","to":"2026-03-01T02:00:00Z","order":"newest_first"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "publishing.ordering")
+}
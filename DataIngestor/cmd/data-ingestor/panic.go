@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// exitCodePanic is the exit status after an unrecovered panic, so
+	// supervisors can tell crashes from ordinary fatal errors (status 1)
+	exitCodePanic = 3
+
+	defaultCrashReportTimeout = 5 * time.Second
+)
+
+// CrashReportConfig is an alerting webhook notified before the process exits
+// on a panic
+type CrashReportConfig struct {
+	URL string `yaml:"url"`
+	// Secret signs the report like subscriber deliveries
+	Secret  string   `yaml:"secret"`
+	Timeout Duration `yaml:"timeout"`
+}
+
+// Validate checks that the webhook URL is usable
+func (c CrashReportConfig) Validate() error {
+	if c.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("crash_report.url must be an absolute http(s) URL, got %q", c.URL)
+	}
+	return nil
+}
+
+// crashReport is the body POSTed to the crash report webhook
+type crashReport struct {
+	Service string    `json:"service"`
+	Where   string    `json:"where"`
+	Panic   string    `json:"panic"`
+	Stack   string    `json:"stack"`
+	Time    time.Time `json:"time"`
+}
+
+// openLogFile adds the configured log file as a second logger output
+func openLogFile(logger *logrus.Logger, path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %w", err)
+	}
+	logger.SetOutput(io.MultiWriter(os.Stderr, file))
+	return file, nil
+}
+
+// recoverPanics replaces gin's recovery middleware: the panic is logged and
+// counted, and the client gets our error envelope instead of an empty 500
+func (di *DataIngestor) recoverPanics() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				// Deliberate aborts are not crashes
+				panic(p)
+			}
+			p, stack := unwrapPanic(p)
+			di.reportPanic("handler", p, stack, logrus.Fields{
+				"method": c.Request.Method,
+				"path":   c.Request.URL.Path,
+			})
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": "internal server error",
+			})
+		}()
+		c.Next()
+	}
+}
+
+// crashOnPanic is deferred at the top of main and of long-running goroutines.
+// An unrecovered panic is logged, counted and reported, then the process
+// exits with exitCodePanic once the log file is flushed.
+func (di *DataIngestor) crashOnPanic(where string) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	p, stack := unwrapPanic(p)
+	di.crash(where, p, stack)
+}
+
+// crash reports a panic and exits with exitCodePanic once the log file is
+// flushed
+func (di *DataIngestor) crash(where string, p interface{}, stack []byte) {
+	di.reportPanic(where, p, stack, nil)
+	di.sendCrashReport(where, p, stack)
+	di.rotateLogFile()
+	di.exit(exitCodePanic)
+}
+
+// cyclePanic carries a panic out of a location goroutine of RunCycle with the
+// stack it was raised on
+type cyclePanic struct {
+	value interface{}
+	stack []byte
+}
+
+// recoverCycle is deferred by the location goroutines of RunCycle. A poll
+// cycle runs in the background and crashes like any other worker. A cycle run
+// for a request keeps the panic for RunCycle to re-raise on the calling
+// goroutine, where recoverPanics answers 500 and the process keeps serving.
+func (di *DataIngestor) recoverCycle(ctx context.Context, panicked *atomic.Pointer[cyclePanic]) {
+	p := recover()
+	if p == nil {
+		return
+	}
+	value, stack := unwrapPanic(p)
+	if triggerOf(ctx) == triggerPoll {
+		di.crash("ingestion", value, stack)
+		return
+	}
+	panicked.CompareAndSwap(nil, &cyclePanic{value: value, stack: stack})
+}
+
+// unwrapPanic returns the original value and stack of a panic re-raised by
+// RunCycle. Other panics get the stack of the goroutine recovering them.
+func unwrapPanic(p interface{}) (interface{}, []byte) {
+	if cp, ok := p.(cyclePanic); ok {
+		return cp.value, cp.stack
+	}
+	return p, debug.Stack()
+}
+
+// reportPanic logs a panic with its stack as structured fields and flushes the
+// log file, so the lines survive if the process dies right after
+func (di *DataIngestor) reportPanic(where string, p interface{}, stack []byte, fields logrus.Fields) {
+	di.metrics.Panics.WithLabelValues(where).Inc()
+	di.logger.WithFields(fields).WithFields(logrus.Fields{
+		"where": where,
+		"panic": fmt.Sprint(p),
+		"stack": string(stack),
+	}).Error("Recovered from panic")
+	di.flushLogFile()
+}
+
+// sendCrashReport POSTs the panic to the crash report webhook, if configured.
+// Failures are only logged: the process is exiting either way.
+func (di *DataIngestor) sendCrashReport(where string, p interface{}, stack []byte) {
+	config := di.config.CrashReport
+	if config.URL == "" {
+		return
+	}
+	timeout := time.Duration(config.Timeout)
+	if timeout <= 0 {
+		timeout = defaultCrashReportTimeout
+	}
+
+	body, err := json.Marshal(crashReport{
+		Service: "data-ingestor",
+		Where:   where,
+		Panic:   fmt.Sprint(p),
+		Stack:   string(stack),
+		Time:    time.Now().UTC(),
+	})
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.URL, bytes.NewReader(body))
+	if err != nil {
+		di.logger.WithError(err).Error("Failed to send crash report")
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.Secret != "" {
+		req.Header.Set(SignatureHeader, signPayload(config.Secret, body))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		di.logger.WithError(err).Error("Failed to send crash report")
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		di.logger.WithField("status", resp.StatusCode).Error("Crash report was rejected")
+	}
+}
+
+// flushLogFile syncs the log file to disk
+func (di *DataIngestor) flushLogFile() {
+	if di.logFile != nil {
+		di.logFile.Sync()
+	}
+}
+
+// rotateLogFile moves the log file aside as <file>.crash-<timestamp>, so the
+// crash is kept out of the way of the next run
+func (di *DataIngestor) rotateLogFile() {
+	if di.logFile == nil {
+		return
+	}
+	di.logFile.Sync()
+	di.logFile.Close()
+	path := di.logFile.Name()
+	os.Rename(path, fmt.Sprintf("%s.crash-%s", path, time.Now().UTC().Format("20060102T150405Z")))
+}
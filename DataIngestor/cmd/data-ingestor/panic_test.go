@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverPanics_ReturnsErrorEnvelope(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "ingestor.log")
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error", File: logPath},
+	})
+	router := setupRoutes(ingestor)
+	router.GET("/boom", func(c *gin.Context) {
+		panic("handler exploded")
+	})
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/boom", nil))
+
+	assert.Equal(t, http.StatusInternalServerError, w.Code)
+	assert.JSONEq(t, `{"error":"internal server error"}`, w.Body.String())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Panics.WithLabelValues("handler")))
+
+	// The log line is flushed to the file with the stack as a field
+	logged, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(logged), "panic=\"handler exploded\"")
+	assert.Contains(t, string(logged), "stack=")
+	assert.Contains(t, string(logged), "path=/boom")
+
+	// The server keeps serving after a recovered panic
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestCrashOnPanic_ReportsAndExits(t *testing.T) {
+	reports := make(chan crashReport, 1)
+	signatures := make(chan string, 1)
+	alerting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var report crashReport
+		json.Unmarshal(body, &report)
+		reports <- report
+		signatures <- r.Header.Get(SignatureHeader)
+	}))
+	defer alerting.Close()
+
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "ingestor.log")
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ:    RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:     LoggingConfig{Level: "error", File: logPath},
+		CrashReport: CrashReportConfig{URL: alerting.URL, Secret: "alert-secret"},
+	})
+	exitCode := -1
+	ingestor.exit = func(code int) { exitCode = code }
+
+	func() {
+		defer ingestor.crashOnPanic("ingestion")
+		panic("loop exploded")
+	}()
+
+	assert.Equal(t, exitCodePanic, exitCode)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Panics.WithLabelValues("ingestion")))
+
+	report := <-reports
+	assert.Equal(t, "ingestion", report.Where)
+	assert.Equal(t, "loop exploded", report.Panic)
+	assert.Contains(t, report.Stack, "panic_test.go")
+	assert.Contains(t, <-signatures, "sha256=")
+
+	// The log is moved aside with the panic in it
+	_, err := os.Stat(logPath)
+	assert.True(t, os.IsNotExist(err))
+	rotated, err := filepath.Glob(logPath + ".crash-*")
+	require.NoError(t, err)
+	require.Len(t, rotated, 1)
+	logged, err := os.ReadFile(rotated[0])
+	require.NoError(t, err)
+	assert.Contains(t, string(logged), "loop exploded")
+}
+
+func TestCrashReportConfig_Validate(t *testing.T) {
+	assert.NoError(t, CrashReportConfig{}.Validate())
+	assert.NoError(t, CrashReportConfig{URL: "https://alerts.example.com/hook"}.Validate())
+	assert.ErrorContains(t, CrashReportConfig{URL: "alerts"}.Validate(), "crash_report.url")
+}
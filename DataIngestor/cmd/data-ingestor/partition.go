@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultPartitionTimestampField = "timestamp"
+	defaultPartitionDeclareAhead   = 5 * time.Minute
+	partitionDateLayout            = "2006-01-02"
+)
+
+// PartitionConfig splits the queue into one queue per UTC calendar day, named
+// <queue_name>.<YYYY-MM-DD>, so a batch loader can drain a day completely
+type PartitionConfig struct {
+	Daily bool `yaml:"daily"`
+	// TimestampField is the payload field holding the reading time, as RFC 3339
+	// or Unix seconds. Readings without it go to the partition of the fetch time.
+	TimestampField string `yaml:"timestamp_field"`
+	// DeclareAhead is how long before midnight the next day's queue is declared
+	DeclareAhead Duration `yaml:"declare_ahead"`
+	// Expires is the x-expires of partition queues: they are deleted after
+	// being unused for this long. Zero keeps them forever.
+	Expires Duration `yaml:"expires"`
+
+	// Count publishes every reading to one of Count routing keys by a hash
+	// of its location instead of to the queue, see hashPartitioner
+	Count int `yaml:"count"`
+	// RoutingKeyPrefix is followed by the partition number, weather.p by
+	// default
+	RoutingKeyPrefix string `yaml:"routing_key_prefix"`
+	// Exchange the partitions are published to, the default exchange if empty
+	Exchange string `yaml:"exchange"`
+	// DeclarePartitions declares a queue per partition, named like its
+	// routing key, and binds it to Exchange
+	DeclarePartitions bool `yaml:"declare_partitions"`
+	// StateFile keeps a count set through POST /admin/partitions across
+	// restarts, partitions.json by default
+	StateFile string `yaml:"state_file"`
+}
+
+// Validate checks the durations
+func (c PartitionConfig) Validate() error {
+	if c.DeclareAhead < 0 || c.DeclareAhead >= Duration(24*time.Hour) {
+		return fmt.Errorf("rabbitmq.partitioning.declare_ahead must be between 0 and 24h")
+	}
+	if c.Expires < 0 {
+		return fmt.Errorf("rabbitmq.partitioning.expires must not be negative")
+	}
+	if c.Count < 0 {
+		return fmt.Errorf("rabbitmq.partitioning.count must not be negative")
+	}
+	if c.Daily && c.Count > 0 {
+		return fmt.Errorf("rabbitmq.partitioning.daily and rabbitmq.partitioning.count are mutually exclusive")
+	}
+	if c.Count == 0 && (c.RoutingKeyPrefix != "" || c.Exchange != "" || c.DeclarePartitions || c.StateFile != "") {
+		return fmt.Errorf("rabbitmq.partitioning.routing_key_prefix, exchange, declare_partitions and state_file require rabbitmq.partitioning.count")
+	}
+	return nil
+}
+
+// clock abstracts time so the midnight rollover can be tested
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+// partitioner maps readings to their day's queue and declares each partition
+// once per channel before it is published to, since the default exchange
+// silently drops messages for queues that do not exist
+type partitioner struct {
+	config PartitionConfig
+	base   string
+	args   amqp.Table
+	clock  clock
+
+	mu       sync.Mutex
+	channel  amqpChannel
+	declared map[string]bool
+}
+
+// partitionGroup is the readings bound for one partition queue, or for one
+// routing key of Exchange with hash partitioning
+type partitionGroup struct {
+	Exchange string
+	Queue    string
+	Readings WeatherData
+}
+
+func newPartitioner(config *Config) *partitioner {
+	partitioning := config.RabbitMQ.Partitioning
+	if partitioning.TimestampField == "" {
+		partitioning.TimestampField = defaultPartitionTimestampField
+	}
+	if partitioning.DeclareAhead == 0 {
+		partitioning.DeclareAhead = Duration(defaultPartitionDeclareAhead)
+	}
+
+	args := amqp.Table{}
+	for key, value := range config.queueArguments() {
+		args[key] = value
+	}
+	if partitioning.Expires > 0 {
+		args["x-expires"] = time.Duration(partitioning.Expires).Milliseconds()
+	}
+	if len(args) == 0 {
+		args = nil
+	}
+
+	return &partitioner{
+		config:   partitioning,
+		base:     config.RabbitMQ.QueueName,
+		args:     args,
+		clock:    realClock{},
+		declared: make(map[string]bool),
+	}
+}
+
+// queueName returns the partition queue for the UTC day containing t
+func (p *partitioner) queueName(t time.Time) string {
+	return p.base + "." + t.UTC().Format(partitionDateLayout)
+}
+
+// readingTime returns the reading's timestamp, or now when it has none
+func (p *partitioner) readingTime(sensor SensorData, now time.Time) time.Time {
+	if t, ok := readingTimestamp(sensor, p.config.TimestampField); ok {
+		return t
+	}
+	return now
+}
+
+// readingTimestamp reads a payload field holding RFC 3339 or Unix seconds
+func readingTimestamp(sensor SensorData, field string) (time.Time, bool) {
+	switch value := sensor.Payload[field].(type) {
+	case string:
+		if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			return t, true
+		}
+		if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return time.Unix(seconds, 0), true
+		}
+	case float64:
+		return time.Unix(int64(value), 0), true
+	}
+	return time.Time{}, false
+}
+
+// split groups readings by partition, in order of first appearance. Late
+// readings go to their own day's partition, not today's.
+func (p *partitioner) split(data WeatherData) []partitionGroup {
+	now := p.clock.Now()
+	var groups []partitionGroup
+	index := make(map[string]int)
+	for _, sensor := range data {
+		queue := p.queueName(p.readingTime(sensor, now))
+		i, ok := index[queue]
+		if !ok {
+			i = len(groups)
+			index[queue] = i
+			groups = append(groups, partitionGroup{Queue: queue})
+		}
+		groups[i].Readings = append(groups[i].Readings, sensor)
+	}
+	return groups
+}
+
+// ensure declares queue on channel unless it was already declared on it
+func (p *partitioner) ensure(channel amqpChannel, queue string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.channel != channel {
+		// A new connection: declarations have to be repeated
+		p.channel = channel
+		p.declared = make(map[string]bool)
+	}
+	if p.declared[queue] {
+		return nil
+	}
+	_, err := channel.QueueDeclare(
+		queue,
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		p.args,
+	)
+	if err != nil {
+		return fmt.Errorf("failed to declare partition %s: %w", queue, err)
+	}
+	p.declared[queue] = true
+	return nil
+}
+
+// nextAhead returns the next day to declare ahead of time, the first one after
+// last, and when to declare it
+func (p *partitioner) nextAhead(now, last time.Time) (day, at time.Time) {
+	now = now.UTC()
+	day = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	if !day.After(last) {
+		day = last.AddDate(0, 0, 1)
+	}
+	return day, day.Add(-time.Duration(p.config.DeclareAhead))
+}
+
+// declarePartition declares queue on the active channel
+func (di *DataIngestor) declarePartition(queue string) error {
+	channel, _, err := di.activeChannel()
+	if err != nil {
+		return err
+	}
+	return di.partitions.ensure(channel, queue)
+}
+
+// declarePartitionsAhead declares every day's partition shortly before
+// midnight, so the loader can bind to it before the first reading arrives
+func (di *DataIngestor) declarePartitionsAhead(ctx context.Context) {
+	p := di.partitions
+	var last time.Time
+	for {
+		now := p.clock.Now()
+		day, at := p.nextAhead(now, last)
+		select {
+		case <-ctx.Done():
+			return
+		case <-p.clock.After(at.Sub(now)):
+		}
+
+		last = day
+		queue := p.queueName(day)
+		if err := di.declarePartition(queue); err != nil {
+			// Publishing declares it lazily as well
+			di.logger.WithField("queue", queue).WithError(err).Warn("Failed to declare partition ahead of time")
+			continue
+		}
+		di.logger.WithField("queue", queue).Info("Declared next partition")
+	}
+}
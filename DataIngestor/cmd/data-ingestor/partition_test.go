@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock only moves when advanced. After channels fire once the clock
+// reaches their deadline.
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.waiters = append(c.waiters, fakeWaiter{deadline: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if c.now.Before(w.deadline) {
+			pending = append(pending, w)
+			continue
+		}
+		w.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+func (c *fakeClock) waiting() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.waiters)
+}
+
+func newPartitionedIngestor(t *testing.T, now time.Time) (*DataIngestor, *fakeChannel, *fakeClock) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{
+			QueueName: "weather_data",
+			Partitioning: PartitionConfig{
+				Daily:        true,
+				DeclareAhead: Duration(5 * time.Minute),
+				Expires:      Duration(72 * time.Hour),
+			},
+		},
+		Logging: LoggingConfig{Level: "error"},
+	})
+	clock := &fakeClock{now: now}
+	ingestor.partitions.clock = clock
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel, clock
+}
+
+func TestPartition_RoutesReadingsToTheirDay(t *testing.T) {
+	ingestor, channel, _ := newPartitionedIngestor(t, time.Date(2024, 5, 3, 0, 2, 0, 0, time.UTC))
+
+	_, err := ingestor.publishReadings(&WeatherData{
+		{Type: "weather", Name: "berlin-1", Payload: map[string]interface{}{"timestamp": "2024-05-03T00:01:00Z"}},
+		// Late data from before midnight, in a different zone
+		{Type: "weather", Name: "berlin-2", Payload: map[string]interface{}{"timestamp": "2024-05-03T01:55:00+02:00"}},
+		{Type: "weather", Name: "berlin-3", Payload: map[string]interface{}{"timestamp": float64(time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC).Unix())}},
+		// No timestamp: the fetch time decides
+		{Type: "weather", Name: "berlin-4", Payload: map[string]interface{}{}},
+	}, Envelope{})
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	assert.Equal(t, "weather_data.2024-05-03", messages[0].RoutingKey)
+	assert.Equal(t, "weather_data.2024-05-02", messages[1].RoutingKey)
+
+	// Each partition is declared once, before it is published to
+	_, err = ingestor.publishReadings(&WeatherData{{Type: "weather", Name: "berlin-5"}}, Envelope{})
+	require.NoError(t, err)
+	queues := channel.declared()
+	require.Len(t, queues, 2)
+	assert.Equal(t, "weather_data.2024-05-03", queues[0].Name)
+	assert.Equal(t, amqp.Table{"x-expires": int64(72 * time.Hour / time.Millisecond)}, queues[0].Args)
+}
+
+func TestPartition_RedeclaresOnNewChannel(t *testing.T) {
+	ingestor, first, _ := newPartitionedIngestor(t, time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC))
+	require.NoError(t, ingestor.PublishToQueue(&WeatherData{{Type: "weather", Name: "berlin-1"}}))
+
+	second := &fakeChannel{}
+	attachChannel(ingestor, second, nil)
+	require.NoError(t, ingestor.PublishToQueue(&WeatherData{{Type: "weather", Name: "berlin-1"}}))
+
+	assert.Len(t, first.declared(), 1)
+	assert.Len(t, second.declared(), 1)
+}
+
+func TestPartition_DeclaresTomorrowBeforeMidnight(t *testing.T) {
+	ingestor, channel, clock := newPartitionedIngestor(t, time.Date(2024, 5, 2, 23, 50, 0, 0, time.UTC))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.declarePartitionsAhead(ctx)
+	}()
+
+	waitForWaiter := func() {
+		require.Eventually(t, func() bool { return clock.waiting() == 1 }, time.Second, time.Millisecond)
+	}
+
+	// 23:54: still too early
+	waitForWaiter()
+	clock.Advance(4 * time.Minute)
+	assert.Empty(t, channel.declared())
+
+	// 23:55: tomorrow's queue is declared ahead of midnight
+	clock.Advance(time.Minute)
+	require.Eventually(t, func() bool { return len(channel.declared()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, "weather_data.2024-05-03", channel.declared()[0].Name)
+
+	// Crossing midnight does not declare anything new; the next one is due
+	// at 23:55 on the 3rd
+	waitForWaiter()
+	clock.Advance(10 * time.Minute)
+	assert.Len(t, channel.declared(), 1)
+	clock.Advance(23*time.Hour + 50*time.Minute)
+	require.Eventually(t, func() bool { return len(channel.declared()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, "weather_data.2024-05-04", channel.declared()[1].Name)
+
+	cancel()
+	<-done
+}
+
+func TestPartition_StartupInsideDeclareWindow(t *testing.T) {
+	p := newPartitioner(&Config{RabbitMQ: RabbitMQConfig{
+		QueueName:    "weather_data",
+		Partitioning: PartitionConfig{Daily: true, DeclareAhead: Duration(5 * time.Minute)},
+	}})
+	now := time.Date(2024, 5, 2, 23, 58, 0, 0, time.UTC)
+
+	day, at := p.nextAhead(now, time.Time{})
+	assert.Equal(t, time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC), day)
+	assert.True(t, at.Before(now), "tomorrow is declared right away")
+
+	day, _ = p.nextAhead(now, day)
+	assert.Equal(t, time.Date(2024, 5, 4, 0, 0, 0, 0, time.UTC), day)
+}
+
+func TestPartition_Validate(t *testing.T) {
+	config := &Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "q", Partitioning: PartitionConfig{Daily: true}},
+		Routing:  RoutingConfig{Rules: []RoutingRule{{Name: "r", Targets: []RoutingTarget{{RoutingKey: "k"}}}}},
+	}
+	assert.ErrorContains(t, config.Validate(), "cannot be combined")
+
+	assert.Error(t, PartitionConfig{DeclareAhead: Duration(25 * time.Hour)}.Validate())
+	assert.Error(t, PartitionConfig{Expires: Duration(-time.Hour)}.Validate())
+}
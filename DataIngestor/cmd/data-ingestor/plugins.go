@@ -0,0 +1,6 @@
+package main
+
+// Hook packages are built into the service by importing them here for their
+// registrations, see pkg/hooks:
+//
+//	import _ "example.com/ingestor-audit"
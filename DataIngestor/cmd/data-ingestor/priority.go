@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// MessageRule sets the AMQP priority and expiration of messages carrying
+// matching readings. Rules are evaluated in order and the first match wins;
+// readings that match no rule get priority 0 and never expire.
+type MessageRule struct {
+	Name     string         `yaml:"name"`
+	Match    MatchCondition `yaml:"match"`
+	Priority uint8          `yaml:"priority"`
+	// TTL is the per-message expiration; zero means the message never expires
+	TTL Duration `yaml:"ttl"`
+}
+
+// messageClass is the priority and expiration shared by the readings of one message
+type messageClass struct {
+	Priority uint8
+	TTL      time.Duration
+}
+
+// messageGroup is a set of readings published as one message
+type messageGroup struct {
+	Class    messageClass
+	Readings WeatherData
+}
+
+// validateMessageRules checks the rules against the queue's maximum priority
+func (c *Config) validateMessageRules() error {
+	rules := c.Publishing.MessageRules
+	if len(rules) > 0 && c.Publishing.Passthrough {
+		return fmt.Errorf("publishing.passthrough cannot be combined with message rules")
+	}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("message rule %d: name is required", i)
+		}
+		if err := rule.Match.validate(); err != nil {
+			return fmt.Errorf("message rule %q: %w", rule.Name, err)
+		}
+		if rule.TTL < 0 {
+			return fmt.Errorf("message rule %q: ttl must not be negative", rule.Name)
+		}
+		if max := c.RabbitMQ.MaxPriority; max > 0 && rule.Priority > max {
+			return fmt.Errorf("message rule %q: priority %d exceeds rabbitmq.max_priority %d", rule.Name, rule.Priority, max)
+		}
+	}
+	return nil
+}
+
+// maxPriority is the x-max-priority the queue is declared with: the configured
+// value, or the highest rule priority. Zero declares a queue without priorities.
+func (c *Config) maxPriority() uint8 {
+	max := c.RabbitMQ.MaxPriority
+	if max > 0 {
+		return max
+	}
+	for _, rule := range c.Publishing.MessageRules {
+		if rule.Priority > max {
+			max = rule.Priority
+		}
+	}
+	return max
+}
+
+// queueArguments returns the arguments the queue is declared with
+func (c *Config) queueArguments() amqp.Table {
+	max := c.maxPriority()
+	if max == 0 {
+		return nil
+	}
+	return amqp.Table{"x-max-priority": int32(max)}
+}
+
+// classify returns the class of the first rule matching the reading
+func classify(rules []MessageRule, sensor SensorData) messageClass {
+	for _, rule := range rules {
+		if rule.Match.Matches(sensor) {
+			return messageClass{Priority: rule.Priority, TTL: time.Duration(rule.TTL)}
+		}
+	}
+	return messageClass{}
+}
+
+// groupByClass splits readings into one group per message class, highest
+// priority first, so urgent readings are published ahead of the rest. Without
+// rules all readings stay in a single group.
+func groupByClass(rules []MessageRule, data WeatherData) []messageGroup {
+	if len(rules) == 0 {
+		return []messageGroup{{Readings: data}}
+	}
+
+	var groups []messageGroup
+	index := make(map[messageClass]int)
+	for _, sensor := range data {
+		class := classify(rules, sensor)
+		i, ok := index[class]
+		if !ok {
+			i = len(groups)
+			index[class] = i
+			groups = append(groups, messageGroup{Class: class})
+		}
+		groups[i].Readings = append(groups[i].Readings, sensor)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		return groups[i].Class.Priority > groups[j].Class.Priority
+	})
+	return groups
+}
+
+// envelope returns env carrying the group's priority and TTL
+func (g messageGroup) envelope(env Envelope) Envelope {
+	env.Priority, env.TTL = g.Class.Priority, g.Class.TTL
+	return env
+}
+
+// expiration formats the TTL as the AMQP Expiration property, in milliseconds
+func (e Envelope) expiration() string {
+	if e.TTL <= 0 {
+		return ""
+	}
+	return strconv.FormatInt(e.TTL.Milliseconds(), 10)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var urgentRules = []MessageRule{
+	{
+		Name:     "urgent",
+		Match:    MatchCondition{Fields: []FieldCondition{{Field: "temperature", Op: "gt", Value: 40}}},
+		Priority: 9,
+	},
+	{Name: "stale-tolerant", TTL: Duration(10 * time.Second)},
+}
+
+func TestPublish_SetsPriorityAndExpiration(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "error"},
+		Publishing: PublishingConfig{MessageRules: urgentRules},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	_, err := ingestor.publishReadings(&WeatherData{
+		{Type: "weather", Name: "berlin-1", Payload: map[string]interface{}{"temperature": 20.0}},
+		{Type: "weather", Name: "cairo-1", Payload: map[string]interface{}{"temperature": 45.0}},
+	}, Envelope{})
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+
+	// The urgent reading is published first, on its own
+	urgent, normal := messages[0].Msg, messages[1].Msg
+	assert.Equal(t, uint8(9), urgent.Priority)
+	assert.Empty(t, urgent.Expiration)
+	assert.Equal(t, uint8(0), normal.Priority)
+	assert.Equal(t, "10000", normal.Expiration)
+
+	var readings WeatherData
+	require.NoError(t, json.Unmarshal(urgent.Body, &readings))
+	require.Len(t, readings, 1)
+	assert.Equal(t, "cairo-1", readings[0].Name)
+}
+
+func TestPublish_WithoutMessageRules(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	require.NoError(t, ingestor.PublishToQueue(&WeatherData{
+		{Type: "weather", Name: "berlin-1"},
+		{Type: "weather", Name: "cairo-1"},
+	}))
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, uint8(0), messages[0].Msg.Priority)
+	assert.Empty(t, messages[0].Msg.Expiration)
+}
+
+func TestPublishRouted_SplitsRouteByClass(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+		Routing: RoutingConfig{Rules: []RoutingRule{
+			{Name: "all", Targets: []RoutingTarget{{Exchange: "weather", RoutingKey: "readings"}}},
+		}},
+		Publishing: PublishingConfig{MessageRules: urgentRules},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	_, err := ingestor.publishReadings(&WeatherData{
+		{Type: "weather", Name: "berlin-1", Payload: map[string]interface{}{"temperature": 20.0}},
+		{Type: "weather", Name: "cairo-1", Payload: map[string]interface{}{"temperature": 45.0}},
+		{Type: "weather", Name: "cairo-2", Payload: map[string]interface{}{"temperature": 41.0}},
+	}, Envelope{})
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	for _, message := range messages {
+		assert.Equal(t, "readings", message.RoutingKey)
+	}
+	assert.Equal(t, uint8(9), messages[0].Msg.Priority)
+	assert.Equal(t, "10000", messages[1].Msg.Expiration)
+}
+
+func TestQueueArguments(t *testing.T) {
+	tests := []struct {
+		name   string
+		config Config
+		want   amqp.Table
+	}{
+		{"no priorities", Config{}, nil},
+		{"from rules", Config{Publishing: PublishingConfig{MessageRules: urgentRules}}, amqp.Table{"x-max-priority": int32(9)}},
+		{"configured", Config{
+			RabbitMQ:   RabbitMQConfig{MaxPriority: 10},
+			Publishing: PublishingConfig{MessageRules: urgentRules},
+		}, amqp.Table{"x-max-priority": int32(10)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.config.queueArguments())
+		})
+	}
+}
+
+func TestValidateMessageRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr string
+	}{
+		{"above max priority", Config{
+			RabbitMQ:   RabbitMQConfig{MaxPriority: 5},
+			Publishing: PublishingConfig{MessageRules: urgentRules},
+		}, "exceeds rabbitmq.max_priority"},
+		{"passthrough", Config{
+			Publishing: PublishingConfig{Passthrough: true, MessageRules: urgentRules},
+		}, "passthrough"},
+		{"missing name", Config{
+			Publishing: PublishingConfig{MessageRules: []MessageRule{{Priority: 1}}},
+		}, "name is required"},
+		{"bad glob", Config{
+			Publishing: PublishingConfig{MessageRules: []MessageRule{{Name: "x", Match: MatchCondition{Location: "["}}}},
+		}, "invalid glob"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.ErrorContains(t, tt.config.validateMessageRules(), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,414 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// profileEnv selects the config profile when -profile is not given
+const profileEnv = "DATA_INGESTOR_PROFILE"
+
+// baseLayer names the config file itself among the merged layers
+const baseLayer = "base"
+
+// redacted replaces secrets in print-config, like url.URL.Redacted
+const redacted = "xxxxx"
+
+var profileName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// secretKeys are the config keys whose values print-config redacts
+var secretKeys = map[string]bool{
+	"token":         true,
+	"client_secret": true,
+	"secret":        true,
+	"password":      true,
+	"key":           true,
+	"auth_keys":     true,
+}
+
+// mergedConfig is a config file with a profile applied. origin maps every
+// node taken from a layer to the layer's name, so print-config can tell
+// where a value came from.
+type mergedConfig struct {
+	root   *yaml.Node
+	layers []string
+	origin map[*yaml.Node]string
+}
+
+// loadMergedConfig reads filename and applies profile, and the profiles it
+// extends, on top of it. A profile is defined under profiles: in the file,
+// or in a sibling file named after it, config.<profile>.yaml next to
+// config.yaml. Mappings are merged key by key; lists and scalars replace
+// the value below them, and a null unsets it.
+func loadMergedConfig(filename, profile string) (*mergedConfig, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	root, err := parseLayer(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal config: %w", err)
+	}
+	profiles, err := takeKey(root, "profiles")
+	if err != nil {
+		return nil, err
+	}
+	if profiles != nil && !isNull(profiles) && profiles.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("profiles must be a mapping of profile names, line %d", profiles.Line)
+	}
+
+	merged := &mergedConfig{root: root, layers: []string{baseLayer}, origin: map[*yaml.Node]string{}}
+	merged.mark(root, baseLayer)
+	if profile == "" {
+		return merged, nil
+	}
+
+	resolver := profileResolver{filename: filename, profiles: profiles}
+	chain, err := resolver.chain(profile, nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range chain {
+		merged.mark(layer.root, layer.name)
+		merged.layers = append(merged.layers, layer.name)
+		merged.root = mergeNodes(merged.root, layer.root)
+	}
+	if merged.root == nil {
+		merged.root = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+	return merged, nil
+}
+
+// parseLayer parses a config document into its top-level mapping; an
+// empty document is an empty mapping
+func parseLayer(data []byte) (*yaml.Node, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	root := resolveAlias(doc.Content[0])
+	if isNull(root) {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, nil
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: the config must be a mapping", root.Line)
+	}
+	return root, nil
+}
+
+// profileLayer is a profile, without its extends key
+type profileLayer struct {
+	name string
+	root *yaml.Node
+}
+
+type profileResolver struct {
+	filename string
+	profiles *yaml.Node
+}
+
+// chain returns the layers of profile, the profiles it extends first.
+// visiting holds the profiles being resolved, to report cycles.
+func (r profileResolver) chain(profile string, visiting []string) ([]profileLayer, error) {
+	for _, name := range visiting {
+		if name == profile {
+			return nil, fmt.Errorf("profile %s extends itself: %s", profile, strings.Join(append(visiting, profile), " -> "))
+		}
+	}
+	root, source, err := r.lookup(profile)
+	if err != nil {
+		return nil, err
+	}
+	if key, _ := findKey(root, "profiles"); key >= 0 {
+		return nil, fmt.Errorf("profile %s: profiles can only be defined in the base config", profile)
+	}
+	extends, err := takeKey(root, "extends")
+	if err != nil {
+		return nil, err
+	}
+
+	var chain []profileLayer
+	if extends != nil && !isNull(extends) {
+		if extends.Kind != yaml.ScalarNode || extends.Value == "" {
+			return nil, fmt.Errorf("profile %s: extends must name a profile, line %d", profile, extends.Line)
+		}
+		if chain, err = r.chain(extends.Value, append(visiting, profile)); err != nil {
+			return nil, err
+		}
+	}
+	name := "profile " + profile
+	if source != "" {
+		name += " (" + filepath.Base(source) + ")"
+	}
+	return append(chain, profileLayer{name: name, root: root}), nil
+}
+
+// lookup finds the definition of profile, and the sibling file it was read
+// from if it is not defined in the config file
+func (r profileResolver) lookup(profile string) (*yaml.Node, string, error) {
+	if !profileName.MatchString(profile) {
+		return nil, "", fmt.Errorf("invalid profile name %q: use letters, digits, - and _", profile)
+	}
+	var inline *yaml.Node
+	if r.profiles != nil && r.profiles.Kind == yaml.MappingNode {
+		if i, _ := findKey(r.profiles, profile); i >= 0 {
+			inline = r.profiles.Content[i+1]
+		}
+	}
+
+	sibling := siblingFile(r.filename, profile)
+	data, err := os.ReadFile(sibling)
+	switch {
+	case err == nil && inline != nil:
+		return nil, "", fmt.Errorf("profile %s is defined both in %s and in %s", profile, r.filename, sibling)
+	case err == nil:
+		root, err := parseLayer(data)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to unmarshal profile %s from %s: %w", profile, sibling, err)
+		}
+		return root, sibling, nil
+	case !os.IsNotExist(err):
+		return nil, "", fmt.Errorf("failed to read profile %s: %w", profile, err)
+	case inline == nil:
+		return nil, "", fmt.Errorf("unknown profile %q, defined profiles: %s", profile, strings.Join(r.defined(), ", "))
+	}
+
+	inline = resolveAlias(inline)
+	if isNull(inline) {
+		return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}, "", nil
+	}
+	if inline.Kind != yaml.MappingNode {
+		return nil, "", fmt.Errorf("profile %s must be a mapping, line %d", profile, inline.Line)
+	}
+	return inline, "", nil
+}
+
+// defined lists the profiles of the config file and of its sibling files
+func (r profileResolver) defined() []string {
+	seen := map[string]bool{}
+	if r.profiles != nil && r.profiles.Kind == yaml.MappingNode {
+		for i := 0; i+1 < len(r.profiles.Content); i += 2 {
+			seen[r.profiles.Content[i].Value] = true
+		}
+	}
+	ext := filepath.Ext(r.filename)
+	prefix := strings.TrimSuffix(r.filename, ext) + "."
+	matches, _ := filepath.Glob(prefix + "*" + ext)
+	for _, match := range matches {
+		if name := strings.TrimSuffix(strings.TrimPrefix(match, prefix), ext); profileName.MatchString(name) {
+			seen[name] = true
+		}
+	}
+	if len(seen) == 0 {
+		return []string{"none"}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// siblingFile is the file of profile next to the config file:
+// config.yaml has config.prod.yaml for the prod profile
+func siblingFile(filename, profile string) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + profile + ext
+}
+
+// mergeNodes returns base with overlay applied, or nil when the overlay
+// unsets it. Mappings merge key by key; anything else replaces base,
+// including an empty list.
+func mergeNodes(base, overlay *yaml.Node) *yaml.Node {
+	overlay = resolveAlias(overlay)
+	if isNull(overlay) {
+		return nil
+	}
+	if overlay.Kind != yaml.MappingNode {
+		return overlay
+	}
+	base = resolveAlias(base)
+	if base == nil || base.Kind != yaml.MappingNode {
+		// Nulls in a new mapping still unset nothing, so drop them
+		base = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	}
+
+	merged := &yaml.Node{Kind: yaml.MappingNode, Tag: base.Tag, Style: base.Style, Line: base.Line, Column: base.Column}
+	merged.Content = append([]*yaml.Node(nil), base.Content...)
+	for i := 0; i+1 < len(overlay.Content); i += 2 {
+		key, value := overlay.Content[i], overlay.Content[i+1]
+		at, _ := findKey(merged, key.Value)
+		if at < 0 {
+			if value := mergeNodes(nil, value); value != nil {
+				merged.Content = append(merged.Content, key, value)
+			}
+			continue
+		}
+		if value := mergeNodes(merged.Content[at+1], value); value != nil {
+			merged.Content[at+1] = value
+		} else {
+			merged.Content = append(merged.Content[:at], merged.Content[at+2:]...)
+		}
+	}
+	return merged
+}
+
+// findKey returns the index of key in mapping, or -1
+func findKey(mapping *yaml.Node, key string) (int, *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return i, mapping.Content[i+1]
+		}
+	}
+	return -1, nil
+}
+
+// takeKey removes key from mapping and returns its value, nil if it is not
+// set. A key given twice is an error, as the merge could not tell which one
+// applies.
+func takeKey(mapping *yaml.Node, key string) (*yaml.Node, error) {
+	i, value := findKey(mapping, key)
+	if i < 0 {
+		return nil, nil
+	}
+	mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+	if again, _ := findKey(mapping, key); again >= 0 {
+		return nil, fmt.Errorf("line %d: %s is set twice", mapping.Content[again].Line, key)
+	}
+	return resolveAlias(value), nil
+}
+
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node != nil && node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	return node
+}
+
+func isNull(node *yaml.Node) bool {
+	return node != nil && node.Kind == yaml.ScalarNode && node.Tag == "!!null"
+}
+
+// mark records layer as the origin of node and of the nodes below it. A
+// node shared through an alias keeps the layer that defined it.
+func (m *mergedConfig) mark(node *yaml.Node, layer string) {
+	if node == nil {
+		return
+	}
+	if _, ok := m.origin[node]; ok {
+		return
+	}
+	m.origin[node] = layer
+	for _, child := range node.Content {
+		m.mark(child, layer)
+	}
+}
+
+// annotate comments every value with the layer it came from and redacts
+// the secrets, for print-config. It rewrites the merged nodes in place.
+func (m *mergedConfig) annotate() {
+	m.annotateNode(m.root, "", true)
+}
+
+// annotateNode annotates node, the value of key. The items of a list come
+// from the layer of the list, so only the list is commented.
+func (m *mergedConfig) annotateNode(node *yaml.Node, key string, comment bool) {
+	origin := resolveAlias(node)
+	if origin != node {
+		*node = *origin
+	}
+	node.Anchor = ""
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			key.Anchor = ""
+			m.annotateNode(value, key.Value, comment)
+			if value.Kind == yaml.SequenceNode && value.Style&yaml.FlowStyle == 0 && len(value.Content) > 0 {
+				// A block list has no line of its own to comment
+				key.LineComment, value.LineComment = value.LineComment, ""
+			}
+		}
+		return
+	case yaml.SequenceNode:
+		for _, item := range node.Content {
+			if secretKeys[key] {
+				redact(item)
+			}
+			m.annotateNode(item, "", false)
+		}
+	case yaml.ScalarNode:
+		if secretKeys[key] {
+			redact(node)
+		} else if u, err := url.Parse(node.Value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				node.Value = u.Redacted()
+			}
+		}
+	}
+	if layer, ok := m.origin[origin]; ok && comment {
+		node.LineComment = "# " + layer
+	}
+}
+
+func redact(node *yaml.Node) {
+	if node.Kind == yaml.ScalarNode && node.Value != "" && !isNull(node) {
+		node.Value, node.Tag, node.Style = redacted, "!!str", 0
+	}
+}
+
+// runPrintConfig is the print-config subcommand: it prints the config
+// with the profile applied, every value commented with the layer it came
+// from and the secrets redacted. It fails when the merged config is
+// invalid, after printing it.
+func runPrintConfig(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("print-config", flag.ContinueOnError)
+	configPath := flags.String("config", "config.yaml", "path to the config file")
+	profile := flags.String("profile", os.Getenv(profileEnv), "config profile to apply, default $"+profileEnv)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return printConfig(os.Stdout, *configPath, *profile)
+}
+
+func printConfig(w io.Writer, filename, profile string) error {
+	merged, err := loadMergedConfig(filename, profile)
+	if err != nil {
+		return fmt.Errorf("failed to load config from %s: %w", filename, err)
+	}
+	var config Config
+	_, decodeErr := decodeConfig(merged.root, &config)
+	config.defaultEnv()
+	if decodeErr == nil {
+		decodeErr = config.Validate()
+	}
+
+	merged.annotate()
+	fmt.Fprintf(w, "# %s, layers: %s\n", filename, strings.Join(merged.layers, " < "))
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(merged.root); err != nil {
+		return err
+	}
+	if err := encoder.Close(); err != nil {
+		return err
+	}
+	if decodeErr != nil {
+		return fmt.Errorf("invalid config: %w", decodeErr)
+	}
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// Kinds of failed publishes, which the publish policy handles apart
+const (
+	// publishRejected is a message the broker nacked, e.g. for a queue at
+	// its length limit with overflow: reject-publish
+	publishRejected = "rejected"
+	// publishReturned is a message the broker returned as unroutable, with
+	// rabbitmq.mandatory
+	publishReturned = "returned"
+	// publishUnreachable is a publish that never reached the broker, or
+	// whose channel closed before it was confirmed
+	publishUnreachable = "unreachable"
+	// publishTimedOut is a message whose confirm did not arrive in time;
+	// the broker may have it
+	publishTimedOut = "confirm_timeout"
+)
+
+// What the publish policy did about a failure
+const (
+	publishActionRetried      = "retried"
+	publishActionDeadLettered = "dead_lettered"
+	publishActionSpooled      = "spooled"
+	publishActionFailed       = "failed"
+)
+
+const (
+	defaultRejectedRetries = 0
+	maxRejectedRetries     = 5
+	defaultRejectedBackoff = 100 * time.Millisecond
+	defaultReconnectWait   = 30 * time.Second
+	// reconnectPoll is how often a timed-out publish checks the connection
+	reconnectPoll = 50 * time.Millisecond
+)
+
+var (
+	// ErrPublishReturned is returned when the broker returns a mandatory
+	// message it could not route
+	ErrPublishReturned = errors.New("broker returned unroutable message")
+	// ErrBrokerUnreachable wraps the errors of publishes the client could
+	// not send
+	ErrBrokerUnreachable = errors.New("broker unreachable")
+)
+
+// PublishRetryConfig is how failed publishes are retried, by kind.
+// Connection failures are not retried: the cycle fails and the next one
+// fetches the readings again.
+type PublishRetryConfig struct {
+	// RejectedRetries is how often a nacked message is published again
+	// before it is dead-lettered, at most 5; nacks are not retried by default
+	RejectedRetries int `yaml:"rejected_retries"`
+	// RejectedBackoff is the wait before the first of them, doubling with
+	// every retry, 100ms by default
+	RejectedBackoff Duration `yaml:"rejected_backoff"`
+	// ReconnectWait is how long a message whose confirm timed out waits for
+	// the connection to be ready before it is published once more, 30s by
+	// default
+	ReconnectWait Duration `yaml:"reconnect_wait"`
+}
+
+// Validate checks the retries and waits
+func (c PublishRetryConfig) Validate() error {
+	if c.RejectedRetries < 0 || c.RejectedRetries > maxRejectedRetries {
+		return fmt.Errorf("rabbitmq.publish_retry.rejected_retries must be between 0 and %d", maxRejectedRetries)
+	}
+	if c.RejectedBackoff < 0 || c.ReconnectWait < 0 {
+		return fmt.Errorf("rabbitmq.publish_retry waits must not be negative")
+	}
+	return nil
+}
+
+func (c PublishRetryConfig) rejectedRetries() int {
+	if c.RejectedRetries > 0 {
+		return c.RejectedRetries
+	}
+	return defaultRejectedRetries
+}
+
+func (c PublishRetryConfig) rejectedBackoff() time.Duration {
+	if c.RejectedBackoff > 0 {
+		return time.Duration(c.RejectedBackoff)
+	}
+	return defaultRejectedBackoff
+}
+
+func (c PublishRetryConfig) reconnectWait() time.Duration {
+	if c.ReconnectWait > 0 {
+		return time.Duration(c.ReconnectWait)
+	}
+	return defaultReconnectWait
+}
+
+// validateMandatory checks that returns can be told from confirms
+func (c *Config) validateMandatory() error {
+	if c.RabbitMQ.Mandatory && c.Publishing.BatchMode == batchModeTx {
+		return fmt.Errorf("rabbitmq.mandatory needs publisher confirms and cannot be combined with publishing.batch_mode tx")
+	}
+	return nil
+}
+
+// publishFailureOf returns the kind of a failed publish, or "" for
+// failures that are not the broker's, like an oversized message
+func publishFailureOf(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrPublishNacked):
+		return publishRejected
+	case errors.Is(err, ErrPublishReturned):
+		return publishReturned
+	case errors.Is(err, ErrConfirmTimeout):
+		return publishTimedOut
+	case errors.Is(err, ErrNotConnected), errors.Is(err, ErrBrokerUnreachable), errors.Is(err, ErrConfirmsClosed):
+		return publishUnreachable
+	}
+	return ""
+}
+
+// unreachableError is a publish the client could not send. It reads as the
+// client's error and matches ErrBrokerUnreachable too.
+type unreachableError struct {
+	err error
+}
+
+func unreachable(err error) error {
+	return unreachableError{err: err}
+}
+
+func (e unreachableError) Error() string { return e.err.Error() }
+
+func (e unreachableError) Unwrap() []error { return []error{ErrBrokerUnreachable, e.err} }
+
+// returnedError describes the return of a mandatory message
+func returnedError(ret amqp.Return) error {
+	return fmt.Errorf("%w: %d %s", ErrPublishReturned, ret.ReplyCode, ret.ReplyText)
+}
+
+// publishWithPolicy publishes body and handles its failure by kind: a
+// rejection is retried a few times, then dead-lettered like a return; a
+// timed-out message is published once more, with the same MessageId, once
+// the connection is ready. Connection failures go to rabbitmq.spool, and
+// fail at once without it. spooled reports a message written to the spool.
+// The waits end with the context of env, which fails the message as it
+// failed last.
+func (di *DataIngestor) publishWithPolicy(exchange, routingKey string, body []byte, env Envelope) (messageID string, spooled bool, err error) {
+	policy := di.config.RabbitMQ.PublishRetry
+	ctx := env.context()
+	if request := spoolRequestOf(ctx); request != nil && di.spoolable(request.reason, env) {
+		// POST /ingest?spool=true while RabbitMQ is not connected
+		spooledID, err := di.spoolMessage(exchange, routingKey, body, env, "", request.reason)
+		if err != nil {
+			return "", false, err
+		}
+		return spooledID, true, nil
+	}
+	messageID, err = di.publishTraced(exchange, routingKey, body, env)
+	for retry := 0; publishFailureOf(err) == publishRejected && retry < policy.rejectedRetries(); retry++ {
+		di.recordPublishFailure(err, publishActionRetried)
+		if sleepContext(ctx, policy.rejectedBackoff()<<retry) != nil {
+			break
+		}
+		messageID, err = di.publishTraced(exchange, routingKey, body, env)
+	}
+	if publishFailureOf(err) == publishTimedOut && messageID != "" {
+		di.recordPublishFailure(err, publishActionRetried)
+		if di.awaitReady(ctx, policy.reconnectWait()) {
+			env.repeatMessageID = messageID
+			messageID, err = di.publishTraced(exchange, routingKey, body, env)
+		}
+	}
+	switch kind := publishFailureOf(err); {
+	case err == nil:
+		return messageID, false, nil
+	case (kind == publishRejected || kind == publishReturned) && di.deadLettersTo(exchange, routingKey):
+		deadLetterID, deadErr := di.deadLetterMessage(exchange, routingKey, body, env, err)
+		if deadErr != nil {
+			di.recordPublishFailure(err, publishActionFailed)
+			return "", false, fmt.Errorf("%w; %v", err, deadErr)
+		}
+		di.recordPublishFailure(err, publishActionDeadLettered)
+		return deadLetterID, false, nil
+	case di.spoolable(err, env):
+		spooledID, spoolErr := di.spoolMessage(exchange, routingKey, body, env, messageID, err)
+		if spoolErr != nil {
+			di.recordPublishFailure(err, publishActionFailed)
+			return "", false, fmt.Errorf("%w; %v", err, spoolErr)
+		}
+		di.recordPublishFailure(err, publishActionSpooled)
+		return spooledID, true, nil
+	default:
+		di.recordPublishFailure(err, publishActionFailed)
+		return "", false, err
+	}
+}
+
+// deadLettersTo reports whether messages refused on their way to routingKey
+// are dead-lettered, which those to the dead-letter queue itself are not
+func (di *DataIngestor) deadLettersTo(exchange, routingKey string) bool {
+	queue := di.config.Publishing.DeadLetterQueue
+	return queue != "" && !(exchange == "" && routingKey == queue)
+}
+
+// recordPublishFailure counts a failed publish of a broker kind
+func (di *DataIngestor) recordPublishFailure(err error, action string) {
+	if kind := publishFailureOf(err); kind != "" {
+		di.metrics.PublishFailures.WithLabelValues(kind, action).Inc()
+	}
+}
+
+// awaitReady waits up to wait for the connection to be ready, as it is at
+// once unless it dropped. It gives up when ctx ends or the ingestor closes.
+func (di *DataIngestor) awaitReady(ctx context.Context, wait time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	ticker := time.NewTicker(reconnectPoll)
+	defer ticker.Stop()
+	for {
+		switch di.ConnectionState() {
+		case StateReady:
+			return true
+		case StateClosing:
+			return false
+		}
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// deadLetterMessage publishes a message the broker refused, whole, to
+// publishing.dead_letter_queue, with the kind as its dead_letter_reason and
+// what the broker said as its dead_letter_detail
+func (di *DataIngestor) deadLetterMessage(exchange, routingKey string, body []byte, env Envelope, failure error) (string, error) {
+	kind := publishFailureOf(failure)
+	queue := di.config.Publishing.DeadLetterQueue
+	env.Type = deadLetterType
+	env.DeadLetterReason = kind
+	env.DeadLetterDetail = failure.Error()
+	env.repeatMessageID = ""
+	messageID, err := di.publishTraced("", queue, body, env)
+	if err != nil {
+		return "", fmt.Errorf("failed to dead-letter message for %s: %w", routingKey, err)
+	}
+	di.log(logPublish).WithFields(logrus.Fields{
+		"reason":         kind,
+		"exchange":       exchange,
+		"routing_key":    routingKey,
+		"queue":          queue,
+		"correlation_id": env.CorrelationID,
+	}).WithError(failure).Warn("Message dead-lettered")
+	return messageID, nil
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// refusingChannel confirms its publishes itself: it nacks those to the
+// routing key refused and leaves the first silent ones unconfirmed
+type refusingChannel struct {
+	*fakeChannel
+	confirms chan amqp.Confirmation
+	refused  string
+
+	mu     sync.Mutex
+	tags   uint64
+	silent int
+}
+
+func (r *refusingChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	if err := r.fakeChannel.PublishWithContext(ctx, exchange, key, mandatory, immediate, msg); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tags++
+	if r.silent > 0 {
+		r.silent--
+		return nil
+	}
+	r.confirms <- amqp.Confirmation{DeliveryTag: r.tags, Ack: key != r.refused}
+	return nil
+}
+
+func newRefusingIngestor(t *testing.T, publishing PublishingConfig, retry PublishRetryConfig) (*DataIngestor, *refusingChannel) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{
+			QueueName:      "meter-data-queue",
+			ConfirmTimeout: Duration(20 * time.Millisecond),
+			PublishRetry:   retry,
+		},
+		Publishing: publishing,
+		Logging:    LoggingConfig{Level: "panic"},
+	})
+	channel := &refusingChannel{fakeChannel: &fakeChannel{}, confirms: make(chan amqp.Confirmation, 100)}
+	tracker := newConfirmTracker()
+	attachChannel(ingestor, channel, tracker)
+	go ingestor.listenConfirms(tracker, channel.confirms)
+	t.Cleanup(func() { close(channel.confirms) })
+	return ingestor, channel
+}
+
+func publishFailures(ingestor *DataIngestor, kind, action string) float64 {
+	return testutil.ToFloat64(ingestor.metrics.PublishFailures.WithLabelValues(kind, action))
+}
+
+func TestPublishFailureOf(t *testing.T) {
+	closed := unreachable(amqp.ErrClosed)
+	assert.Equal(t, amqp.ErrClosed.Error(), closed.Error(), "the client's error reads as before")
+	assert.ErrorIs(t, closed, amqp.ErrClosed)
+
+	returned := returnedError(amqp.Return{ReplyCode: amqp.NoRoute, ReplyText: "NO_ROUTE"})
+	assert.Equal(t, "broker returned unroutable message: 312 NO_ROUTE", returned.Error())
+	for err, want := range map[error]string{
+		nil:                             "",
+		wrapPublish(ErrPublishNacked):   publishRejected,
+		returned:                        publishReturned,
+		wrapPublish(ErrConfirmTimeout):  publishTimedOut,
+		wrapPublish(closed):             publishUnreachable,
+		ErrNotConnected:                 publishUnreachable,
+		wrapPublish(ErrConfirmsClosed):  publishUnreachable,
+		wrapPublish(errMessageTooLarge): "",
+		errors.New("failed to marshal"): "",
+	} {
+		assert.Equal(t, want, publishFailureOf(err), "%v", err)
+	}
+	assert.Equal(t, "returned", publishErrorCode(returned))
+}
+
+func wrapPublish(err error) error {
+	return fmt.Errorf("failed to publish message: %w", err)
+}
+
+func TestPublishRetryConfig_Validate(t *testing.T) {
+	assert.NoError(t, PublishRetryConfig{}.Validate())
+	assert.Zero(t, PublishRetryConfig{}.rejectedRetries(), "nacks are retried only when asked to")
+	assert.Equal(t, defaultReconnectWait, PublishRetryConfig{}.reconnectWait())
+	assert.ErrorContains(t, PublishRetryConfig{RejectedRetries: 6}.Validate(), "between 0 and 5")
+	assert.ErrorContains(t, PublishRetryConfig{ReconnectWait: -1}.Validate(), "must not be negative")
+
+	mandatory := &Config{RabbitMQ: RabbitMQConfig{Mandatory: true}}
+	assert.NoError(t, mandatory.validateMandatory())
+	mandatory.Publishing.BatchMode = batchModeTx
+	assert.ErrorContains(t, mandatory.validateMandatory(), "needs publisher confirms")
+}
+
+func TestPublishFailure_RejectedIsRetriedThenDeadLettered(t *testing.T) {
+	ingestor, channel := newRefusingIngestor(t,
+		PublishingConfig{DeadLetterQueue: "meter-data-dead"},
+		PublishRetryConfig{RejectedRetries: 2, RejectedBackoff: Duration(time.Millisecond)})
+	channel.refused = "meter-data-queue"
+
+	messageID, err := ingestor.publishBody("", "meter-data-queue", []byte(`[{"name":"moscow-1"}]`), Envelope{CorrelationID: "cycle-1"})
+	require.NoError(t, err, "a dead-lettered message is handled")
+	messages := channel.messages()
+	require.Len(t, messages, 1+2+1)
+	dead := messages[len(messages)-1]
+	assert.Equal(t, "meter-data-dead", dead.RoutingKey)
+	assert.Equal(t, messageID, dead.Msg.MessageId)
+	assert.Equal(t, deadLetterType, dead.Msg.Type)
+	assert.Equal(t, "cycle-1", dead.Msg.CorrelationId)
+	assert.JSONEq(t, `[{"name":"moscow-1"}]`, string(dead.Msg.Body), "the message is kept whole")
+	assert.Equal(t, publishRejected, dead.Msg.Headers["dead_letter_reason"])
+	assert.Contains(t, dead.Msg.Headers["dead_letter_detail"], "broker rejected message")
+
+	assert.Equal(t, 2.0, publishFailures(ingestor, publishRejected, publishActionRetried))
+	assert.Equal(t, 1.0, publishFailures(ingestor, publishRejected, publishActionDeadLettered))
+	assert.Zero(t, publishFailures(ingestor, publishRejected, publishActionFailed))
+}
+
+func TestPublishFailure_RejectedWithoutDeadLetterQueueFailsTheCycle(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"weather","name":"moscow-1","payload":{"temperature":-5}}]`))
+	}))
+	defer upstream.Close()
+	ingestor, channel := newRefusingIngestor(t, PublishingConfig{}, PublishRetryConfig{RejectedRetries: 1, RejectedBackoff: Duration(time.Millisecond)})
+	ingestor.config.API = APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)}
+	ingestor.sources = newSources(ingestor.config.API)
+	channel.refused = "meter-data-queue"
+
+	outcome := ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	assert.Equal(t, outcomeFailed, outcome.Outcome)
+	assert.Equal(t, publishRejected, outcome.PublishFailure)
+	assert.Len(t, channel.messages(), 2)
+	assert.Equal(t, 1.0, publishFailures(ingestor, publishRejected, publishActionFailed))
+}
+
+func TestPublishFailure_ReturnedIsDeadLetteredAtOnce(t *testing.T) {
+	ingestor, client := newFakeClientIngestor(t, PublishingConfig{DeadLetterQueue: "meter-data-dead"})
+	ingestor.config.RabbitMQ.Mandatory = true
+	require.NoError(t, ingestor.ConnectToRabbitMQ())
+	session := client.last().session()
+	require.NotNil(t, session.returns)
+	session.unroutable = "meter-data-queue"
+
+	require.NoError(t, ingestor.PublishToQueue(testReadings()))
+	messages := session.messages()
+	require.Len(t, messages, 2, "a return is not retried")
+	assert.Equal(t, "meter-data-dead", messages[1].RoutingKey)
+	assert.Equal(t, publishReturned, messages[1].Msg.Headers["dead_letter_reason"])
+	assert.Contains(t, messages[1].Msg.Headers["dead_letter_detail"], "312 NO_ROUTE")
+	assert.Equal(t, 1.0, publishFailures(ingestor, publishReturned, publishActionDeadLettered))
+
+	// Routed messages are acked as they were
+	session.unroutable = ""
+	require.NoError(t, ingestor.PublishToQueue(testReadings()))
+	assert.Len(t, session.messages(), 3)
+}
+
+func TestPublishFailure_ReturnsNeedMandatory(t *testing.T) {
+	ingestor, client := newFakeClientIngestor(t, PublishingConfig{})
+	require.NoError(t, ingestor.ConnectToRabbitMQ())
+	session := client.last().session()
+	assert.Nil(t, session.returns)
+
+	session.returns = make(chan amqp.Return, 1)
+	session.unroutable = "meter-data-queue"
+	require.NoError(t, ingestor.PublishToQueue(testReadings()), "without the flag the broker drops unroutable messages")
+	assert.Empty(t, session.returns)
+}
+
+func TestPublishFailure_UnreachableFailsAtOnce(t *testing.T) {
+	ingestor, channel := newRefusingIngestor(t, PublishingConfig{DeadLetterQueue: "meter-data-dead"}, PublishRetryConfig{})
+	channel.err = amqp.ErrClosed
+
+	_, err := ingestor.publishBody("", "meter-data-queue", []byte("[]"), Envelope{})
+	require.Error(t, err)
+	assert.Equal(t, "failed to publish message: "+amqp.ErrClosed.Error(), err.Error())
+	assert.Equal(t, publishUnreachable, publishFailureOf(err))
+	assert.Equal(t, 1.0, publishFailures(ingestor, publishUnreachable, publishActionFailed))
+	assert.Zero(t, publishFailures(ingestor, publishUnreachable, publishActionRetried))
+
+	ingestor.Close()
+	_, err = ingestor.publishBody("", "meter-data-queue", []byte("[]"), Envelope{})
+	assert.ErrorIs(t, err, ErrNotConnected)
+	assert.Equal(t, 2.0, publishFailures(ingestor, publishUnreachable, publishActionFailed))
+	assert.Empty(t, channel.messages(), "nothing is dead-lettered that never reached the broker")
+}
+
+// stuckChannel is a broker that stopped reading: a publish blocks until the
+// connection is closed, whatever its context
+type stuckChannel struct {
+	*fakeChannel
+	closed chan struct{}
+}
+
+func (c *stuckChannel) PublishWithContext(ctx context.Context, exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	<-c.closed
+	return amqp.ErrClosed
+}
+
+func (c *stuckChannel) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestPublishFailure_BlockedWriteTimesOut(t *testing.T) {
+	ingestor, _ := newRefusingIngestor(t, PublishingConfig{}, PublishRetryConfig{})
+	ingestor.config.RabbitMQ.PublishTimeout = Duration(50 * time.Millisecond)
+	channel := &stuckChannel{fakeChannel: &fakeChannel{}, closed: make(chan struct{})}
+	attachChannel(ingestor, channel, newConfirmTracker())
+	ingestor.connMu.Lock()
+	ingestor.conn = channel
+	ingestor.connMu.Unlock()
+
+	type result struct{ err error }
+	done := make(chan result, 1)
+	go func() {
+		_, err := ingestor.publishBody("", "meter-data-queue", []byte("[]"), Envelope{})
+		done <- result{err}
+	}()
+	select {
+	case r := <-done:
+		assert.ErrorIs(t, r.err, ErrPublishTimeout)
+		assert.Equal(t, publishUnreachable, publishFailureOf(r.err), "spooled like a dropped connection")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the publish outlives its timeout")
+	}
+	select {
+	case <-channel.closed:
+	default:
+		t.Fatal("the connection of the blocked write stays open")
+	}
+
+	assert.ErrorContains(t, (&Config{RabbitMQ: RabbitMQConfig{PublishTimeout: -1}}).Validate(), "rabbitmq.publish_timeout must not be negative")
+}
+
+func TestPublishFailure_TimedOutIsPublishedAgainWithItsMessageID(t *testing.T) {
+	ingestor, channel := newRefusingIngestor(t, PublishingConfig{}, PublishRetryConfig{ReconnectWait: Duration(time.Second)})
+	channel.silent = 1
+
+	messageID, err := ingestor.publishBody("", "meter-data-queue", []byte("[]"), Envelope{})
+	require.NoError(t, err)
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	assert.Equal(t, messageID, messages[0].Msg.MessageId, "consumers can drop the copy")
+	assert.Equal(t, messageID, messages[1].Msg.MessageId)
+	assert.Equal(t, 1.0, publishFailures(ingestor, publishTimedOut, publishActionRetried))
+
+	// A copy that times out as well fails the publish
+	channel.silent = 2
+	_, err = ingestor.publishBody("", "meter-data-queue", []byte("[]"), Envelope{})
+	assert.ErrorIs(t, err, ErrConfirmTimeout)
+	assert.Len(t, channel.messages(), 4)
+	assert.Equal(t, 1.0, publishFailures(ingestor, publishTimedOut, publishActionFailed))
+}
+
+func TestPublishFailure_TimedOutWaitsForTheConnection(t *testing.T) {
+	ingestor, _ := newRefusingIngestor(t, PublishingConfig{}, PublishRetryConfig{})
+	setState := func(state ConnState) {
+		ingestor.connMu.Lock()
+		defer ingestor.connMu.Unlock()
+		ingestor.connState = state
+	}
+
+	setState(StateDisconnected)
+	assert.False(t, ingestor.awaitReady(context.Background(), 100*time.Millisecond))
+	ready := make(chan bool)
+	go func() { ready <- ingestor.awaitReady(context.Background(), time.Minute) }()
+	setState(StateReady)
+	assert.True(t, <-ready)
+
+	// The wait ends with the cycle and when the ingestor closes
+	setState(StateDisconnected)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { ready <- ingestor.awaitReady(ctx, time.Minute) }()
+	cancel()
+	assert.False(t, <-ready)
+	setState(StateClosing)
+	assert.False(t, ingestor.awaitReady(context.Background(), time.Minute))
+}
+
+func TestPublishFailure_RetryWaitsEndWithTheCycle(t *testing.T) {
+	ingestor, channel := newRefusingIngestor(t, PublishingConfig{},
+		PublishRetryConfig{RejectedRetries: 5, RejectedBackoff: Duration(time.Minute)})
+	channel.refused = "meter-data-queue"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	data := WeatherData{weatherReading("moscow", map[string]interface{}{"temperature": 1.0})}
+	_, err := amqpSink{ingestor}.Deliver(ctx, &sinkBatch{data: data})
+	assert.ErrorIs(t, err, ErrPublishNacked, "the message fails as it failed last")
+	assert.Len(t, channel.messages(), 1)
+}
+
+func TestConfirmTracker_DropsReturnsNoConfirmAwaits(t *testing.T) {
+	returns := make(chan amqp.Return, 4)
+	tracker := newConfirmTracker()
+	tracker.returns = returns
+
+	// The confirm timed out before the return came in
+	first, _ := tracker.trackID("meter-data-queue", "msg-1")
+	tracker.forget(first)
+	returns <- amqp.Return{MessageId: "msg-1"}
+	_, ok := tracker.resolve(amqp.Confirmation{DeliveryTag: first, Ack: true})
+	assert.False(t, ok)
+
+	// The return came in before the confirm timed out
+	second, _ := tracker.trackID("meter-data-queue", "msg-2")
+	returns <- amqp.Return{MessageId: "msg-2"}
+	tracker.forget(second)
+
+	// The channel closed before the confirm came
+	third, _ := tracker.trackID("meter-data-queue", "msg-3")
+	returns <- amqp.Return{MessageId: "msg-3"}
+	tracker.forget(third)
+	tracker.trackID("meter-data-queue", "msg-4")
+	returns <- amqp.Return{MessageId: "msg-4"}
+	tracker.failAll(ErrConfirmsClosed)
+
+	tracker.mu.Lock()
+	defer tracker.mu.Unlock()
+	assert.Empty(t, tracker.returned)
+	assert.Empty(t, tracker.forgotten)
+}
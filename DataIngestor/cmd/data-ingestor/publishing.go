@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+// PublishingConfig controls how fetched data is turned into queue messages
+type PublishingConfig struct {
+	// Passthrough publishes the upstream response body byte-for-byte instead
+	// of re-marshaling the decoded readings. Enrichment is skipped.
+	Passthrough bool `yaml:"passthrough"`
+	// MessageRules set the priority and expiration of published messages
+	MessageRules []MessageRule `yaml:"message_rules"`
+	// Compression is none, gzip or zstd. Bodies smaller than
+	// CompressionMinBytes are published uncompressed.
+	Compression         string   `yaml:"compression"`
+	CompressionLevel    int      `yaml:"compression_level"`
+	CompressionMinBytes ByteSize `yaml:"compression_min_bytes"`
+	// FieldNaming is as_is, snake_case or camelCase. It renames the keys of
+	// the published JSON and the envelope headers, not the Go struct tags.
+	FieldNaming string `yaml:"field_naming"`
+	// FieldRenames maps a name, after FieldNaming, to the name it is
+	// published under
+	FieldRenames map[string]string `yaml:"field_renames"`
+	// BatchMode is none, tx to publish the messages of a cycle in an AMQP
+	// transaction, or single_message to publish the cycle as one message
+	BatchMode string `yaml:"batch_mode"`
+	// MaxMessageSize is the largest message body published, 0 for no limit.
+	// single_message batches above it are split; other messages fail to
+	// publish instead of being rejected by the broker.
+	MaxMessageSize ByteSize `yaml:"max_message_size"`
+	// DeadLetterQueue receives a description of every reading larger than
+	// MaxMessageSize on its own, and the messages the broker rejects or
+	// returns. Without one the former are only logged and the latter fail.
+	DeadLetterQueue string `yaml:"dead_letter_queue"`
+	// Security signs and encrypts the published messages
+	Security SecurityConfig `yaml:"security"`
+	// Ordering is none, or per_location to publish the readings of each
+	// location in the order they were fetched, over OrderingLanes lanes
+	// (16 by default)
+	Ordering      string `yaml:"ordering"`
+	OrderingLanes int    `yaml:"ordering_lanes"`
+	// Schema names the JSON Schema of every message of readings in its
+	// headers
+	Schema SchemaRefConfig `yaml:"schema"`
+}
+
+// Envelope is message-level metadata carried in the AMQP headers. Its JSON
+// form is how the spool keeps it.
+type Envelope struct {
+	// Replayed marks messages republished from an archive rather than fetched live
+	Replayed bool `json:"replayed,omitempty"`
+	// CorrelationID ties together every message published by one ingestion
+	// cycle. It is sent as the AMQP CorrelationId property.
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// Priority and TTL are sent as the AMQP Priority and Expiration properties
+	Priority uint8         `json:"priority,omitempty"`
+	TTL      time.Duration `json:"ttl,omitempty"`
+	// UpstreamHeaders are the captured response headers, sent as the
+	// upstream_headers AMQP header
+	UpstreamHeaders map[string]string `json:"upstream_headers,omitempty"`
+	// InstanceID is the instance that published the message, sent as the
+	// instance_id AMQP header
+	InstanceID string `json:"instance_id,omitempty"`
+	// BatchID and BatchSize identify the batch of a cycle and its number of
+	// readings with a batch mode, sent as the batch_id and batch_size AMQP
+	// headers
+	BatchID   string `json:"batch_id,omitempty"`
+	BatchSize int    `json:"batch_size,omitempty"`
+	// BatchPart and BatchParts number the messages of a batch that was split
+	// by size, from 1, sent as the batch_part and batch_parts AMQP headers
+	BatchPart  int `json:"batch_part,omitempty"`
+	BatchParts int `json:"batch_parts,omitempty"`
+	// DeadLetterReason is sent as the dead_letter_reason AMQP header
+	DeadLetterReason string `json:"dead_letter_reason,omitempty"`
+	// DeadLetterDetail is what the broker said when it refused the message,
+	// sent as the dead_letter_detail AMQP header
+	DeadLetterDetail string `json:"dead_letter_detail,omitempty"`
+	// Type is sent as the AMQP Type property
+	Type string `json:"type,omitempty"`
+	// MessageIDSeed derives the MessageIds from it and the message instead of
+	// drawing them at random, so publishing the same readings again repeats
+	// their MessageIds and consumers can drop the copies
+	MessageIDSeed string `json:"message_id_seed,omitempty"`
+	// repeatMessageID is the MessageId of a message published again whose
+	// first copy the broker may have
+	repeatMessageID string
+	// fromSpool marks a message the spool is publishing, which is not
+	// spooled again when it fails
+	fromSpool bool
+	// tx is the transaction of a message of a publishing.batch_mode tx batch
+	tx *txBatch
+	// ctx ends the retry waits of the publish, see publishWithPolicy; the
+	// context of the cycle the message is published for, if any
+	ctx context.Context
+	// Quality are the scores of the message's readings, sent as the
+	// quality_score and quality AMQP headers
+	Quality []QualityScore `json:"quality,omitempty"`
+	// Trigger is what started the ingestion of the readings, see triggerOf,
+	// sent as the trigger AMQP header
+	Trigger string `json:"trigger,omitempty"`
+	// SchemaURL and SchemaHash are where the schema of the body is served and
+	// its hash, sent as the x-schema-url and x-schema-hash AMQP headers
+	SchemaURL  string `json:"schema_url,omitempty"`
+	SchemaHash string `json:"schema_hash,omitempty"`
+	// SourceIDs are the upstream IDs of the readings whose IDs reading_ids
+	// replaced, in order, sent as the source_id AMQP header
+	SourceIDs []string `json:"source_ids,omitempty"`
+	// RoutingLabel is the routing key as configured, with its {location} and
+	// {date} placeholders, of a message whose routing key was resolved per
+	// message. Metrics are labelled with it, so the resolved keys don't make
+	// a series each.
+	RoutingLabel string `json:"routing_label,omitempty"`
+}
+
+// routingLabel returns the routing_key metric label of a message to
+// routingKey
+// context returns the context the publish waits with
+func (e Envelope) context() context.Context {
+	if e.ctx != nil {
+		return e.ctx
+	}
+	return context.Background()
+}
+
+func (e Envelope) routingLabel(routingKey string) string {
+	if e.RoutingLabel != "" {
+		return e.RoutingLabel
+	}
+	return routingKey
+}
+
+// messageID returns the MessageId of a message to exchange and routingKey
+func (e Envelope) messageID(exchange, routingKey string, body []byte) string {
+	if e.repeatMessageID != "" {
+		return e.repeatMessageID
+	}
+	if e.MessageIDSeed == "" {
+		return newMessageID()
+	}
+	h := sha256.New()
+	for _, part := range []string{e.MessageIDSeed, exchange, routingKey} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// Headers returns the envelope as an AMQP header table, or nil when empty
+func (e Envelope) Headers() amqp.Table {
+	headers := amqp.Table{}
+	if e.Replayed {
+		headers["replayed"] = true
+	}
+	if e.InstanceID != "" {
+		headers["instance_id"] = e.InstanceID
+	}
+	if e.Trigger != "" {
+		headers["trigger"] = e.Trigger
+	}
+	if e.BatchID != "" {
+		headers["batch_id"] = e.BatchID
+		headers["batch_size"] = e.BatchSize
+	}
+	if e.BatchParts > 0 {
+		headers["batch_part"] = e.BatchPart
+		headers["batch_parts"] = e.BatchParts
+	}
+	if e.DeadLetterReason != "" {
+		headers["dead_letter_reason"] = e.DeadLetterReason
+	}
+	if e.DeadLetterDetail != "" {
+		headers["dead_letter_detail"] = e.DeadLetterDetail
+	}
+	if len(e.Quality) > 0 {
+		headers["quality_score"], headers["quality"] = qualityHeaders(e.Quality)
+	}
+	if len(e.SourceIDs) > 0 {
+		ids := make([]interface{}, len(e.SourceIDs))
+		for i, id := range e.SourceIDs {
+			ids[i] = id
+		}
+		headers["source_id"] = ids
+	}
+	if e.SchemaURL != "" {
+		headers[headerSchemaURL] = e.SchemaURL
+		headers[headerSchemaHash] = e.SchemaHash
+	}
+	if len(e.UpstreamHeaders) > 0 {
+		upstream := amqp.Table{}
+		for name, value := range e.UpstreamHeaders {
+			upstream[name] = value
+		}
+		headers["upstream_headers"] = upstream
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// PublishRaw publishes the upstream body unchanged to the default queue. The
+// decoded copy is only used for logging so the message matches what the
+// upstream sent exactly.
+func (di *DataIngestor) PublishRaw(result *fetchResult) error {
+	_, err := di.publishRaw(result, Envelope{})
+	return err
+}
+
+func (di *DataIngestor) publishRaw(result *fetchResult, env Envelope) ([]string, error) {
+	messageID, err := di.publishBody("", di.config.RabbitMQ.QueueName, result.Body, env)
+	if err != nil {
+		return nil, err
+	}
+
+	di.log(logPublish).WithFields(logrus.Fields{
+		"count": len(*result.Data),
+		"bytes": len(result.Body),
+	}).Info("Raw data published to queue")
+	return []string{messageID}, nil
+}
+
+// newMessageID returns a random identifier for the AMQP MessageId property
+func newMessageID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
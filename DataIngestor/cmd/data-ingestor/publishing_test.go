@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// rawUpstreamBody is deliberately formatted in a way json.Marshal would not reproduce
+const rawUpstreamBody = `[ {"payload": {"energy": 1.50, "unit":"kWh"}, "name":"meter-1",  "type":"energy"} ]`
+
+func newUpstream(t *testing.T, contentType, body string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if contentType != "" {
+			w.Header().Set("Content-Type", contentType)
+		}
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestIngest_PassthroughPreservesBytes(t *testing.T) {
+	upstream := newUpstream(t, "application/json; charset=utf-8", rawUpstreamBody)
+
+	ingestor := NewDataIngestor(&Config{
+		API:        APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Publishing: PublishingConfig{Passthrough: true},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	require.Len(t, *result.Data, 1)
+	assert.Equal(t, "meter-1", (*result.Data)[0].Name)
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, []byte(rawUpstreamBody), messages[0].Msg.Body)
+	assert.Equal(t, []string{messages[0].Msg.MessageId}, result.MessageIDs)
+	assert.Equal(t, "meter-data-queue", messages[0].RoutingKey)
+}
+
+func TestIngest_DefaultRemarshals(t *testing.T) {
+	upstream := newUpstream(t, "application/json", rawUpstreamBody)
+
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.NotEqual(t, []byte(rawUpstreamBody), messages[0].Msg.Body)
+}
+
+func TestIngest_PassthroughInvalidBodyNotPublished(t *testing.T) {
+	upstream := newUpstream(t, "application/json", `{"not": "an array"}`)
+
+	ingestor := NewDataIngestor(&Config{
+		API:        APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Publishing: PublishingConfig{Passthrough: true},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+
+	_, err := ingestor.ingest(context.Background())
+	assert.ErrorContains(t, err, "failed to unmarshal response")
+	assert.Empty(t, channel.messages())
+}
+
+func TestFetch_Guards(t *testing.T) {
+	upstream := newUpstream(t, "text/html", "<html>maintenance</html>")
+	ingestor := NewDataIngestor(&Config{API: APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)}})
+	_, err := ingestor.FetchDataFromAPI(context.Background())
+	assert.ErrorContains(t, err, "unexpected content type")
+
+	upstream = newUpstream(t, "application/json", rawUpstreamBody)
+	ingestor = NewDataIngestor(&Config{API: APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second), MaxBodyBytes: 16}})
+	_, err = ingestor.FetchDataFromAPI(context.Background())
+	assert.ErrorContains(t, err, "exceeds 16 bytes")
+}
+
+func TestConfig_PassthroughWithRoutingRejected(t *testing.T) {
+	config := &Config{
+		Publishing: PublishingConfig{Passthrough: true},
+		Routing:    testRoutingConfig(false),
+	}
+	assert.ErrorContains(t, config.Validate(), "passthrough")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+)
+
+// sinkPubSub labels metrics for messages published to Google Pub/Sub
+const sinkPubSub = "pubsub"
+
+// defaultPubSubPublishTimeout bounds how long a cycle waits for Pub/Sub to
+// acknowledge its readings
+const defaultPubSubPublishTimeout = 30 * time.Second
+
+// ErrPubSubTimeout is returned when Pub/Sub does not acknowledge a reading
+// within pubsub.publish_timeout
+var ErrPubSubTimeout = errors.New("timed out waiting for Pub/Sub publish result")
+
+// PubSubConfig publishes every reading to a Google Pub/Sub topic next to
+// RabbitMQ
+type PubSubConfig struct {
+	Project string `yaml:"project"`
+	// Topic receives the readings. The Pub/Sub sink is disabled when it is empty.
+	Topic string `yaml:"topic"`
+	// CredentialsFile is a service account key file; Application Default
+	// Credentials are used when it is empty
+	CredentialsFile string `yaml:"credentials_file"`
+	// EnableMessageOrdering sets each reading's location as its ordering key
+	EnableMessageOrdering bool              `yaml:"enable_message_ordering"`
+	Batch                 PubSubBatchConfig `yaml:"batch"`
+	// PublishTimeout is how long a cycle waits for its publish results,
+	// including the client's own retries
+	PublishTimeout Duration `yaml:"publish_timeout"`
+}
+
+// PubSubBatchConfig controls client-side batching. A batch is sent once any
+// threshold is reached; unset thresholds keep the client defaults.
+type PubSubBatchConfig struct {
+	Count int      `yaml:"count"`
+	Bytes ByteSize `yaml:"bytes"`
+	Delay Duration `yaml:"delay"`
+}
+
+// Validate checks the topic and batch settings
+func (c PubSubConfig) Validate() error {
+	if c.Topic == "" {
+		return nil
+	}
+	switch {
+	case c.Project == "":
+		return fmt.Errorf("pubsub.project is required with pubsub.topic")
+	case strings.Contains(c.Topic, "/"):
+		return fmt.Errorf("pubsub.topic must be a topic id, not %q", c.Topic)
+	case c.Batch.Count < 0 || c.Batch.Bytes < 0 || c.Batch.Delay < 0:
+		return fmt.Errorf("pubsub.batch thresholds must not be negative")
+	case c.PublishTimeout < 0:
+		return fmt.Errorf("pubsub.publish_timeout must not be negative")
+	}
+	return nil
+}
+
+func (c PubSubConfig) publishTimeout() time.Duration {
+	if c.PublishTimeout <= 0 {
+		return defaultPubSubPublishTimeout
+	}
+	return time.Duration(c.PublishTimeout)
+}
+
+// PubSubSink publishes readings to a Pub/Sub topic, one message per reading
+type PubSubSink struct {
+	config  PubSubConfig
+	client  *pubsub.Client
+	topic   *pubsub.Topic
+	metrics *Metrics
+	naming  *fieldNamer
+}
+
+// NewPubSubSink connects to Pub/Sub, or returns nil when no topic is
+// configured. PUBSUB_EMULATOR_HOST points the client at an emulator.
+func NewPubSubSink(ctx context.Context, config PubSubConfig, metrics *Metrics, opts ...option.ClientOption) (*PubSubSink, error) {
+	if config.Topic == "" {
+		return nil, nil
+	}
+	if config.CredentialsFile != "" {
+		opts = append(opts, option.WithCredentialsFile(config.CredentialsFile))
+	}
+	client, err := pubsub.NewClient(ctx, config.Project, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Pub/Sub client: %w", err)
+	}
+
+	topic := client.Topic(config.Topic)
+	topic.EnableMessageOrdering = config.EnableMessageOrdering
+	if config.Batch.Count > 0 {
+		topic.PublishSettings.CountThreshold = config.Batch.Count
+	}
+	if config.Batch.Bytes > 0 {
+		topic.PublishSettings.ByteThreshold = int(config.Batch.Bytes)
+	}
+	if config.Batch.Delay > 0 {
+		topic.PublishSettings.DelayThreshold = time.Duration(config.Batch.Delay)
+	}
+	topic.PublishSettings.Timeout = config.publishTimeout()
+	return &PubSubSink{config: config, client: client, topic: topic, metrics: metrics}, nil
+}
+
+// ConnectPubSub creates the Pub/Sub sink when pubsub.topic is set. It fails
+// when the credentials cannot be found.
+func (di *DataIngestor) ConnectPubSub(ctx context.Context) error {
+	sink, err := NewPubSubSink(ctx, di.config.PubSub, di.metrics)
+	if err != nil {
+		return err
+	}
+	if sink != nil {
+		sink.naming = di.naming
+	}
+	di.pubsub = sink
+	return nil
+}
+
+// attributes carries the envelope and the reading's type and location as
+// message attributes, so subscriptions can filter on them. Captured response
+// headers keep their names behind the upstream_ prefix.
+func (s *PubSubSink) attributes(sensor SensorData, env Envelope) map[string]string {
+	attributes := map[string]string{
+		s.naming.name("content_type"): "application/json",
+		s.naming.name("type"):         sensor.Type,
+		s.naming.name("location"):     sensor.Location(),
+	}
+	if env.CorrelationID != "" {
+		attributes[s.naming.name("correlation_id")] = env.CorrelationID
+	}
+	if env.InstanceID != "" {
+		attributes[s.naming.name("instance_id")] = env.InstanceID
+	}
+	if env.Replayed {
+		attributes[s.naming.name("replayed")] = "true"
+	}
+	if env.Trigger != "" {
+		attributes[s.naming.name("trigger")] = env.Trigger
+	}
+	if env.Priority > 0 {
+		attributes[s.naming.name("priority")] = strconv.Itoa(int(env.Priority))
+	}
+	for name, value := range env.UpstreamHeaders {
+		attributes["upstream_"+name] = value
+	}
+	if sensor.Quality != nil {
+		attributes[s.naming.name("quality_score")] = strconv.Itoa(sensor.Quality.Score)
+	}
+	if sensor.ID != "" {
+		attributes[s.naming.name("source_id")] = sensor.SourceID
+	}
+	return attributes
+}
+
+// Publish sends one message per reading and waits for every publish result,
+// like a publisher confirm. Transient errors are retried by the client until
+// the publish timeout; any failure fails the whole call so the cycle is
+// retried.
+func (s *PubSubSink) Publish(ctx context.Context, data WeatherData, env Envelope) ([]string, error) {
+	serverIDs, _, err := s.publish(ctx, data, env)
+	return serverIDs, err
+}
+
+// publish is Publish that also reports which readings Pub/Sub acknowledged
+func (s *PubSubSink) publish(ctx context.Context, data WeatherData, env Envelope) ([]string, []bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.config.publishTimeout())
+	defer cancel()
+
+	type pending struct {
+		key    string
+		result *pubsub.PublishResult
+	}
+	results := make([]pending, 0, len(data))
+	for _, sensor := range data {
+		body, err := s.naming.marshal(sensor)
+		if err != nil {
+			return nil, make([]bool, len(data)), fmt.Errorf("failed to marshal reading: %w", err)
+		}
+		msg := &pubsub.Message{Data: body, Attributes: s.attributes(sensor, env)}
+		if s.config.EnableMessageOrdering {
+			msg.OrderingKey = sensor.Location()
+		}
+		s.metrics.MessageSize.WithLabelValues(sinkPubSub, s.config.Topic).Observe(float64(len(body)))
+		results = append(results, pending{key: msg.OrderingKey, result: s.topic.Publish(ctx, msg)})
+	}
+
+	var (
+		serverIDs []string
+		firstErr  error
+	)
+	acked := make([]bool, len(results))
+	for i, p := range results {
+		id, err := p.result.Get(ctx)
+		if err != nil {
+			// A failed publish pauses its ordering key; resume it so the
+			// retried cycle can publish the location again
+			if p.key != "" {
+				s.topic.ResumePublish(p.key)
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = ErrPubSubTimeout
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		s.metrics.PublishedMessages.WithLabelValues(sinkPubSub, s.config.Topic).Inc()
+		serverIDs = append(serverIDs, id)
+		acked[i] = true
+	}
+	if firstErr != nil {
+		return serverIDs, acked, fmt.Errorf("failed to publish to Pub/Sub topic %s: %w", s.config.Topic, firstErr)
+	}
+	return serverIDs, acked, nil
+}
+
+// Close flushes pending messages and closes the client
+func (s *PubSubSink) Close() error {
+	s.topic.Stop()
+	return s.client.Close()
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+const testPubSubProject = "weather-test"
+
+// newTestPubSub returns a sink connected to an in-process fake Pub/Sub
+// server. The topic is created unless createTopic is false.
+func newTestPubSub(t *testing.T, config PubSubConfig, createTopic bool, reactors ...pstest.ServerReactorOption) (*PubSubSink, *pstest.Server) {
+	t.Helper()
+	server := pstest.NewServer(reactors...)
+	t.Cleanup(func() { server.Close() })
+	opts := []option.ClientOption{
+		option.WithEndpoint(server.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+	}
+
+	config.Project = testPubSubProject
+	if config.Topic == "" {
+		config.Topic = "readings"
+	}
+	sink, err := NewPubSubSink(context.Background(), config, NewMetrics(prometheus.NewRegistry()), opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { sink.Close() })
+	if createTopic {
+		_, err := sink.client.CreateTopic(context.Background(), config.Topic)
+		require.NoError(t, err)
+	}
+	return sink, server
+}
+
+func TestPubSubSink_OrderingKeysAndAttributes(t *testing.T) {
+	sink, server := newTestPubSub(t, PubSubConfig{EnableMessageOrdering: true}, true)
+
+	data := WeatherData{
+		weatherReading("moscow", map[string]interface{}{"temperature": 1.0}),
+		weatherReading("berlin", map[string]interface{}{"temperature": 2.0}),
+		weatherReading("moscow", map[string]interface{}{"temperature": 3.0}),
+	}
+	env := Envelope{
+		CorrelationID:   "cycle-1",
+		InstanceID:      "ingestor-1",
+		Priority:        5,
+		UpstreamHeaders: map[string]string{"X-Station-Id": "st-42"},
+	}
+	ids, err := sink.Publish(context.Background(), data, env)
+	require.NoError(t, err)
+	assert.Len(t, ids, 3)
+
+	messages := server.Messages()
+	require.Len(t, messages, 3)
+	byKey := map[string][]float64{}
+	for _, msg := range messages {
+		var sensor SensorData
+		require.NoError(t, json.Unmarshal(msg.Data, &sensor))
+		assert.Equal(t, sensor.Name, msg.OrderingKey)
+		byKey[msg.OrderingKey] = append(byKey[msg.OrderingKey], sensor.Payload["temperature"].(float64))
+
+		assert.Equal(t, map[string]string{
+			"content_type":          "application/json",
+			"type":                  "weather",
+			"location":              sensor.Name,
+			"correlation_id":        "cycle-1",
+			"instance_id":           "ingestor-1",
+			"priority":              "5",
+			"upstream_X-Station-Id": "st-42",
+		}, msg.Attributes)
+	}
+	assert.Equal(t, map[string][]float64{"moscow": {1, 3}, "berlin": {2}}, byKey)
+	assert.Equal(t, 3.0, testutil.ToFloat64(sink.metrics.PublishedMessages.WithLabelValues(sinkPubSub, "readings")))
+}
+
+func TestPubSubSink_NoOrderingKeyByDefault(t *testing.T) {
+	sink, server := newTestPubSub(t, PubSubConfig{}, true)
+
+	_, err := sink.Publish(context.Background(), WeatherData{weatherReading("moscow", nil)}, Envelope{Replayed: true})
+	require.NoError(t, err)
+	messages := server.Messages()
+	require.Len(t, messages, 1)
+	assert.Empty(t, messages[0].OrderingKey)
+	assert.Equal(t, "true", messages[0].Attributes["replayed"])
+	assert.NotContains(t, messages[0].Attributes, "correlation_id")
+}
+
+func TestPubSubSink_FailedPublishResumesOrderingKey(t *testing.T) {
+	sink, server := newTestPubSub(t, PubSubConfig{EnableMessageOrdering: true}, false)
+	data := WeatherData{weatherReading("moscow", nil)}
+
+	_, err := sink.Publish(context.Background(), data, Envelope{})
+	assert.ErrorContains(t, err, "failed to publish to Pub/Sub topic readings")
+	assert.Equal(t, 0.0, testutil.ToFloat64(sink.metrics.PublishedMessages.WithLabelValues(sinkPubSub, "readings")))
+
+	// Without ResumePublish the key would stay paused after the failure
+	_, err = sink.client.CreateTopic(context.Background(), "readings")
+	require.NoError(t, err)
+	_, err = sink.Publish(context.Background(), data, Envelope{})
+	require.NoError(t, err)
+	assert.Len(t, server.Messages(), 1)
+}
+
+func TestPubSubSink_RetriesUntilPublishTimeout(t *testing.T) {
+	// Unavailable is retried by the client until the publish timeout
+	sink, server := newTestPubSub(t, PubSubConfig{PublishTimeout: Duration(300 * time.Millisecond)}, true,
+		pstest.WithErrorInjection("Publish", codes.Unavailable, "try again"))
+
+	start := time.Now()
+	_, err := sink.Publish(context.Background(), WeatherData{weatherReading("moscow", nil)}, Envelope{})
+	assert.ErrorIs(t, err, ErrPubSubTimeout)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Empty(t, server.Messages())
+}
+
+func TestNewPubSubSink_BatchSettings(t *testing.T) {
+	sink, _ := newTestPubSub(t, PubSubConfig{Batch: PubSubBatchConfig{
+		Count: 10,
+		Bytes: 64 << 10,
+		Delay: Duration(50 * time.Millisecond),
+	}}, true)
+	assert.Equal(t, 10, sink.topic.PublishSettings.CountThreshold)
+	assert.Equal(t, 64<<10, sink.topic.PublishSettings.ByteThreshold)
+	assert.Equal(t, 50*time.Millisecond, sink.topic.PublishSettings.DelayThreshold)
+	assert.Equal(t, defaultPubSubPublishTimeout, sink.topic.PublishSettings.Timeout)
+
+	defaults, _ := newTestPubSub(t, PubSubConfig{}, true)
+	assert.Equal(t, pubsub.DefaultPublishSettings.CountThreshold, defaults.topic.PublishSettings.CountThreshold)
+
+	disabled, err := NewPubSubSink(context.Background(), PubSubConfig{}, nil)
+	assert.NoError(t, err)
+	assert.Nil(t, disabled)
+}
+
+func TestPubSubConfig_Validate(t *testing.T) {
+	assert.NoError(t, PubSubConfig{}.Validate())
+	assert.NoError(t, PubSubConfig{Project: "p", Topic: "readings"}.Validate())
+
+	assert.EqualError(t, PubSubConfig{Topic: "readings"}.Validate(), "pubsub.project is required with pubsub.topic")
+	assert.ErrorContains(t, PubSubConfig{Project: "p", Topic: "projects/p/topics/readings"}.Validate(), "must be a topic id")
+	assert.ErrorContains(t, PubSubConfig{Project: "p", Topic: "t", Batch: PubSubBatchConfig{Count: -1}}.Validate(), "pubsub.batch")
+	assert.ErrorContains(t, PubSubConfig{Project: "p", Topic: "t", PublishTimeout: -1}.Validate(), "pubsub.publish_timeout")
+}
+
+func TestIngest_PublishesToPubSub(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	sink, server := newTestPubSub(t, PubSubConfig{EnableMessageOrdering: true}, true)
+	ingestor.pubsub = sink
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, channel.messages(), 1, "RabbitMQ still receives the readings")
+
+	messages := server.Messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "meter-1", messages[0].OrderingKey)
+	assert.Equal(t, result.CorrelationIDs[0], messages[0].Attributes["correlation_id"])
+	assert.Equal(t, ingestor.instanceID, messages[0].Attributes["instance_id"])
+}
+
+func TestIngest_FailsWhenPubSubRejects(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	sink, _ := newTestPubSub(t, PubSubConfig{}, false)
+	ingestor.pubsub = sink
+
+	_, err := ingestor.ingest(context.Background())
+	assert.ErrorContains(t, err, "failed to publish to Pub/Sub topic readings")
+}
+
+func TestIngest_PubSubFailureRetriesOnlyPubSub(t *testing.T) {
+	redis := miniredis.RunT(t)
+	upstream := dedupUpstream(t, dedupUpstreamBody)
+	config := ReadingDedupConfig{Redis: RedisDedupConfig{Addr: redis.Addr()}}
+	ingestor, channel := newDedupTestIngestor(t, upstream, config)
+	other, otherChannel := newDedupTestIngestor(t, upstream, config)
+	sink, server := newTestPubSub(t, PubSubConfig{}, false)
+	ingestor.pubsub = sink
+
+	_, err := ingestor.ingest(context.Background())
+	require.ErrorContains(t, err, "failed to publish to Pub/Sub topic readings")
+	require.Len(t, channel.messages(), 1)
+	assert.Len(t, redis.Keys(), 3, "readings RabbitMQ took stay claimed")
+
+	_, err = other.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, otherChannel.messages(), "no other instance publishes them again")
+
+	_, err = sink.client.CreateTopic(context.Background(), "readings")
+	require.NoError(t, err)
+	_, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, channel.messages(), 1, "the retry does not publish to RabbitMQ again")
+	assert.Len(t, server.Messages(), 3)
+}
+
+// TestPubSubSink_Emulator runs against the Pub/Sub emulator when
+// PUBSUB_EMULATOR_HOST is set, e.g. with
+// gcloud beta emulators pubsub start --host-port=localhost:8085
+func TestPubSubSink_Emulator(t *testing.T) {
+	if os.Getenv("PUBSUB_EMULATOR_HOST") == "" {
+		t.Skip("PUBSUB_EMULATOR_HOST is not set")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	topicID := fmt.Sprintf("readings-%d", time.Now().UnixNano())
+	config := PubSubConfig{Project: testPubSubProject, Topic: topicID, EnableMessageOrdering: true}
+	sink, err := NewPubSubSink(ctx, config, NewMetrics(prometheus.NewRegistry()))
+	require.NoError(t, err)
+	defer sink.Close()
+
+	topic, err := sink.client.CreateTopic(ctx, topicID)
+	require.NoError(t, err)
+	defer topic.Delete(context.Background())
+	sub, err := sink.client.CreateSubscription(ctx, topicID, pubsub.SubscriptionConfig{
+		Topic:                 topic,
+		EnableMessageOrdering: true,
+	})
+	require.NoError(t, err)
+	defer sub.Delete(context.Background())
+
+	var data WeatherData
+	for i := 0; i < 5; i++ {
+		data = append(data,
+			weatherReading("moscow", map[string]interface{}{"seq": float64(i)}),
+			weatherReading("berlin", map[string]interface{}{"seq": float64(i)}))
+	}
+	_, err = sink.Publish(ctx, data, Envelope{CorrelationID: "cycle-1", InstanceID: "ingestor-1"})
+	require.NoError(t, err)
+
+	var (
+		mu       sync.Mutex
+		received = map[string][]float64{}
+		count    int
+	)
+	receiveCtx, stop := context.WithCancel(ctx)
+	err = sub.Receive(receiveCtx, func(_ context.Context, msg *pubsub.Message) {
+		msg.Ack()
+		var sensor SensorData
+		if json.Unmarshal(msg.Data, &sensor) != nil {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, sensor.Name, msg.OrderingKey)
+		assert.Equal(t, sensor.Name, msg.Attributes["location"])
+		assert.Equal(t, "cycle-1", msg.Attributes["correlation_id"])
+		assert.Equal(t, "ingestor-1", msg.Attributes["instance_id"])
+		received[msg.OrderingKey] = append(received[msg.OrderingKey], sensor.Payload["seq"].(float64))
+		if count++; count == len(data) {
+			stop()
+		}
+	})
+	require.NoError(t, err)
+
+	want := []float64{0, 1, 2, 3, 4}
+	assert.Equal(t, map[string][]float64{"moscow": want, "berlin": want}, received)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Quality factors, the signals that lower a reading's score
+const (
+	qualityMissing    = "missing"
+	qualityOutOfRange = "out_of_range"
+	qualityStale      = "stale"
+	qualityReplayed   = "replayed"
+	qualitySlowFetch  = "slow_fetch"
+	// qualityPartialDelivery flags a reading some sink missed, see
+	// DeliveryConfig
+	qualityPartialDelivery = "partial_delivery"
+)
+
+// maxQualityScore is the score of a reading no factor applies to
+const maxQualityScore = 100
+
+const (
+	defaultQualityMaxAge    = 15 * time.Minute
+	defaultQualitySlowFetch = 5 * time.Second
+)
+
+// defaultQualityWeights are the points a factor takes off the score, per
+// field for missing and out_of_range
+var defaultQualityWeights = map[string]int{
+	qualityMissing:    20,
+	qualityOutOfRange: 30,
+	qualityStale:      20,
+	qualityReplayed:   10,
+	qualitySlowFetch:  10,
+	// Only set after delivery, for the readings' later consumers
+	qualityPartialDelivery: 10,
+}
+
+// QualityConfig scores every polled reading from 0 to 100
+type QualityConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// RequiredFields are the payload fields a reading should have; each one
+	// missing or null counts as missing
+	RequiredFields []string `yaml:"required_fields"`
+	// MaxAge is how old the reading's validation.timestamp_field may be
+	// before it is stale, 15 minutes by default
+	MaxAge Duration `yaml:"max_age"`
+	// SlowFetch is the upstream latency above which a fetch is slow, five
+	// seconds by default
+	SlowFetch Duration `yaml:"slow_fetch"`
+	// Weights override the points each factor takes off the score
+	Weights map[string]int `yaml:"weights"`
+}
+
+// Validate checks the weights and the thresholds
+func (c QualityConfig) Validate() error {
+	for factor, weight := range c.Weights {
+		if _, ok := defaultQualityWeights[factor]; !ok {
+			return fmt.Errorf("quality.weights: unknown factor %q", factor)
+		}
+		if weight < 0 || weight > maxQualityScore {
+			return fmt.Errorf("quality.weights.%s must be between 0 and %d, got %d", factor, maxQualityScore, weight)
+		}
+	}
+	if c.MaxAge < 0 || c.SlowFetch < 0 {
+		return fmt.Errorf("quality.max_age and quality.slow_fetch cannot be negative")
+	}
+	return nil
+}
+
+func (c QualityConfig) weight(factor string) int {
+	if weight, ok := c.Weights[factor]; ok {
+		return weight
+	}
+	return defaultQualityWeights[factor]
+}
+
+func (c QualityConfig) maxAge() time.Duration {
+	if c.MaxAge <= 0 {
+		return defaultQualityMaxAge
+	}
+	return time.Duration(c.MaxAge)
+}
+
+func (c QualityConfig) slowFetch() time.Duration {
+	if c.SlowFetch <= 0 {
+		return defaultQualitySlowFetch
+	}
+	return time.Duration(c.SlowFetch)
+}
+
+// QualityScore is a reading's score and the points each factor took off
+type QualityScore struct {
+	Score   int            `json:"score"`
+	Factors map[string]int `json:"factors,omitempty"`
+}
+
+// with returns the score with points more taken off for factor
+func (q QualityScore) with(factor string, points int) QualityScore {
+	if points <= 0 {
+		return q
+	}
+	factors := map[string]int{factor: points}
+	for name, p := range q.Factors {
+		factors[name] = p
+	}
+	q.Factors = factors
+	if q.Score -= points; q.Score < 0 {
+		q.Score = 0
+	}
+	return q
+}
+
+// qualitySignals are what a reading is scored on
+type qualitySignals struct {
+	// Missing and OutOfRange count the required fields missing from the
+	// payload and the fields out of their validation bounds
+	Missing    int
+	OutOfRange int
+	// Age is how old the reading's timestamp is, when it has one
+	Age         time.Duration
+	Timestamped bool
+	// Replayed is set for readings served from recorded fixtures
+	Replayed bool
+	// Latency is the upstream latency of the fetch the reading came in
+	Latency time.Duration
+}
+
+// score computes the score of a reading from its signals
+func (c QualityConfig) score(s qualitySignals) QualityScore {
+	factors := map[string]int{}
+	add := func(factor string, points int) {
+		if points > 0 {
+			factors[factor] = points
+		}
+	}
+	add(qualityMissing, s.Missing*c.weight(qualityMissing))
+	add(qualityOutOfRange, s.OutOfRange*c.weight(qualityOutOfRange))
+	if s.Timestamped && s.Age > c.maxAge() {
+		add(qualityStale, c.weight(qualityStale))
+	}
+	if s.Replayed {
+		add(qualityReplayed, c.weight(qualityReplayed))
+	}
+	if s.Latency > c.slowFetch() {
+		add(qualitySlowFetch, c.weight(qualitySlowFetch))
+	}
+
+	score := maxQualityScore
+	for _, points := range factors {
+		score -= points
+	}
+	if score < 0 {
+		score = 0
+	}
+	if len(factors) == 0 {
+		factors = nil
+	}
+	return QualityScore{Score: score, Factors: factors}
+}
+
+// fetchSignals are the signals shared by the readings of one fetch
+type fetchSignals struct {
+	Replayed bool
+	Latency  time.Duration
+}
+
+// scoreReadings sets the quality score of every reading
+func (di *DataIngestor) scoreReadings(data WeatherData, fetch fetchSignals, location string) {
+	config := di.config.Quality
+	now := time.Now()
+	for i := range data {
+		reading := &data[i]
+		signals := qualitySignals{Replayed: fetch.Replayed, Latency: fetch.Latency}
+		for _, field := range config.RequiredFields {
+			if reading.Payload[field] == nil {
+				signals.Missing++
+			}
+		}
+		if di.validationEnabled() {
+			signals.OutOfRange = len(di.checkReading(*reading, now))
+		}
+		if t, ok := readingTimestamp(*reading, di.config.Validation.timestampField()); ok {
+			signals.Age, signals.Timestamped = now.Sub(t), true
+		}
+		score := config.score(signals)
+		reading.Quality = &score
+		di.metrics.QualityScore.WithLabelValues(location).Observe(float64(score.Score))
+	}
+}
+
+// qualityOf returns the scores of the readings of one message, nil when
+// they were not scored
+func qualityOf(data WeatherData) []QualityScore {
+	var scores []QualityScore
+	for _, reading := range data {
+		if reading.Quality == nil {
+			return nil
+		}
+		scores = append(scores, *reading.Quality)
+	}
+	return scores
+}
+
+// qualityHeaders returns the quality_score header, the lowest score of the
+// message, and the quality header, the score and factors of every reading
+// in order
+func qualityHeaders(scores []QualityScore) (int, []interface{}) {
+	lowest := maxQualityScore
+	list := make([]interface{}, len(scores))
+	for i, score := range scores {
+		if score.Score < lowest {
+			lowest = score.Score
+		}
+		factors := amqp.Table{}
+		for factor, points := range score.Factors {
+			factors[factor] = points
+		}
+		list[i] = amqp.Table{"score": score.Score, "factors": factors}
+	}
+	return lowest, list
+}
+
+// qualityFields are the names routing conditions on the quality can
+// compare: the score and the points of each factor
+func qualityFields(score QualityScore) map[string]interface{} {
+	fields := map[string]interface{}{"score": float64(score.Score)}
+	for factor := range defaultQualityWeights {
+		fields[factor] = float64(score.Factors[factor])
+	}
+	return fields
+}
+
+// validQualityField reports whether routing conditions can compare field.
+// partial_delivery only covers the sinks before RabbitMQ by the time the
+// readings are routed, so it is left out.
+func validQualityField(field string) bool {
+	_, ok := defaultQualityWeights[field]
+	return ok && field != qualityPartialDelivery || field == "score"
+}
+
+// qualityFactorNames lists the factors routing conditions can compare, for
+// error messages
+func qualityFactorNames() []string {
+	names := make([]string, 0, len(defaultQualityWeights))
+	for factor := range defaultQualityWeights {
+		if factor != qualityPartialDelivery {
+			names = append(names, factor)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQualityScore(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  QualityConfig
+		signals qualitySignals
+		want    QualityScore
+	}{
+		{"perfect reading", QualityConfig{}, qualitySignals{Timestamped: true, Age: time.Minute, Latency: 100 * time.Millisecond}, QualityScore{Score: 100}},
+		{"no timestamp is not stale", QualityConfig{}, qualitySignals{Age: 24 * time.Hour}, QualityScore{Score: 100}},
+		{"one missing field", QualityConfig{}, qualitySignals{Missing: 1}, QualityScore{Score: 80, Factors: map[string]int{qualityMissing: 20}}},
+		{"missing counts per field", QualityConfig{}, qualitySignals{Missing: 3}, QualityScore{Score: 40, Factors: map[string]int{qualityMissing: 60}}},
+		{"out of range", QualityConfig{}, qualitySignals{OutOfRange: 1}, QualityScore{Score: 70, Factors: map[string]int{qualityOutOfRange: 30}}},
+		{"at the max age", QualityConfig{}, qualitySignals{Timestamped: true, Age: 15 * time.Minute}, QualityScore{Score: 100}},
+		{"past the max age", QualityConfig{}, qualitySignals{Timestamped: true, Age: 16 * time.Minute}, QualityScore{Score: 80, Factors: map[string]int{qualityStale: 20}}},
+		{"custom max age", QualityConfig{MaxAge: Duration(time.Minute)}, qualitySignals{Timestamped: true, Age: 2 * time.Minute}, QualityScore{Score: 80, Factors: map[string]int{qualityStale: 20}}},
+		{"replayed", QualityConfig{}, qualitySignals{Replayed: true}, QualityScore{Score: 90, Factors: map[string]int{qualityReplayed: 10}}},
+		{"slow fetch", QualityConfig{}, qualitySignals{Latency: 6 * time.Second}, QualityScore{Score: 90, Factors: map[string]int{qualitySlowFetch: 10}}},
+		{"at the slow fetch threshold", QualityConfig{}, qualitySignals{Latency: 5 * time.Second}, QualityScore{Score: 100}},
+		{"custom slow fetch", QualityConfig{SlowFetch: Duration(time.Second)}, qualitySignals{Latency: 2 * time.Second}, QualityScore{Score: 90, Factors: map[string]int{qualitySlowFetch: 10}}},
+		{
+			"factors add up",
+			QualityConfig{},
+			qualitySignals{Missing: 1, OutOfRange: 1, Timestamped: true, Age: time.Hour, Replayed: true},
+			QualityScore{Score: 20, Factors: map[string]int{qualityMissing: 20, qualityOutOfRange: 30, qualityStale: 20, qualityReplayed: 10}},
+		},
+		{
+			"the score does not go below zero",
+			QualityConfig{},
+			qualitySignals{Missing: 4, OutOfRange: 2, Latency: time.Minute},
+			QualityScore{Score: 0, Factors: map[string]int{qualityMissing: 80, qualityOutOfRange: 60, qualitySlowFetch: 10}},
+		},
+		{
+			"custom weights",
+			QualityConfig{Weights: map[string]int{qualityMissing: 5, qualityReplayed: 50}},
+			qualitySignals{Missing: 2, Replayed: true},
+			QualityScore{Score: 40, Factors: map[string]int{qualityMissing: 10, qualityReplayed: 50}},
+		},
+		{
+			"a zero weight ignores the factor",
+			QualityConfig{Weights: map[string]int{qualityReplayed: 0}},
+			qualitySignals{Replayed: true, Missing: 1},
+			QualityScore{Score: 80, Factors: map[string]int{qualityMissing: 20}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.config.score(tt.signals))
+		})
+	}
+}
+
+func TestQualityConfig_Validate(t *testing.T) {
+	assert.NoError(t, QualityConfig{Enabled: true, Weights: map[string]int{qualityStale: 0, qualityMissing: 100}}.Validate())
+	assert.ErrorContains(t, QualityConfig{Weights: map[string]int{"repaired": 10}}.Validate(), `unknown factor "repaired"`)
+	assert.ErrorContains(t, QualityConfig{Weights: map[string]int{qualityStale: -1}}.Validate(), "quality.weights.stale must be between 0 and 100")
+	assert.ErrorContains(t, QualityConfig{MaxAge: Duration(-time.Second)}.Validate(), "cannot be negative")
+
+	config := Config{Quality: QualityConfig{Enabled: true}, Publishing: PublishingConfig{Passthrough: true}}
+	assert.ErrorContains(t, config.Validate(), "quality cannot be combined with publishing.passthrough")
+
+	routing := RoutingConfig{Rules: []RoutingRule{{
+		Name:    "quarantine",
+		Match:   MatchCondition{Quality: []FieldCondition{{Field: "confidence", Op: "lt", Value: 50}}},
+		Targets: []RoutingTarget{{RoutingKey: "quarantine"}},
+	}}}
+	assert.ErrorContains(t, routing.Validate(), `unknown quality field "confidence", use score or one of missing, out_of_range, replayed, slow_fetch, stale`)
+	routing.Rules[0].Match.Quality[0] = FieldCondition{Field: "score", Op: "below", Value: 50}
+	assert.ErrorContains(t, routing.Validate(), `unknown operator "below" for quality field "score"`)
+}
+
+func TestQualityCondition_Matches(t *testing.T) {
+	low := MatchCondition{Quality: []FieldCondition{{Field: "score", Op: "lt", Value: 50}}}
+	stale := MatchCondition{Quality: []FieldCondition{{Field: qualityStale, Op: "gt", Value: 0}}}
+
+	scored := SensorData{Name: "meter-1", Quality: &QualityScore{Score: 30, Factors: map[string]int{qualityStale: 20, qualityOutOfRange: 50}}}
+	assert.True(t, low.Matches(scored))
+	assert.True(t, stale.Matches(scored))
+
+	scored.Quality = &QualityScore{Score: 90, Factors: map[string]int{qualityReplayed: 10}}
+	assert.False(t, low.Matches(scored))
+	assert.False(t, stale.Matches(scored), "a factor that did not apply is 0")
+
+	assert.False(t, low.Matches(SensorData{Name: "meter-1"}), "unscored readings never match")
+	assert.True(t, MatchCondition{}.Matches(SensorData{Name: "meter-1"}))
+}
+
+func TestQuality_ScoresAndRoutesReadings(t *testing.T) {
+	now := time.Now().UTC()
+	body := fmt.Sprintf(`[
+		{"type":"energy","name":"meter-1","payload":{"energy":5,"voltage":230,"timestamp":%q}},
+		{"type":"energy","name":"meter-2","payload":{"energy":7,"timestamp":%q}},
+		{"type":"energy","name":"meter-3","payload":{"energy":700,"timestamp":%q}}
+	]`, now.Format(time.RFC3339), now.Format(time.RFC3339), now.Add(-time.Hour).Format(time.RFC3339))
+	upstream := newUpstream(t, "application/json", body)
+
+	ingestor := NewDataIngestor(&Config{
+		API:        APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Validation: ValidationConfig{Bounds: map[string]Bounds{"energy": {Min: bound(0), Max: bound(100)}}, Action: validationKeep},
+		Quality:    QualityConfig{Enabled: true, RequiredFields: []string{"energy", "voltage"}},
+		Routing: RoutingConfig{Rules: []RoutingRule{{
+			Name:    "quarantine",
+			Match:   MatchCondition{Quality: []FieldCondition{{Field: "score", Op: "lt", Value: 50}}},
+			Targets: []RoutingTarget{{RoutingKey: "quarantine"}},
+		}}},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	require.Len(t, *result.Data, 3)
+	assert.Equal(t, 100, (*result.Data)[0].Quality.Score)
+	assert.Equal(t, QualityScore{Score: 80, Factors: map[string]int{qualityMissing: 20}}, *(*result.Data)[1].Quality)
+	assert.Equal(t, QualityScore{Score: 30, Factors: map[string]int{qualityMissing: 20, qualityOutOfRange: 30, qualityStale: 20}}, *(*result.Data)[2].Quality)
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	byKey := map[string]amqp.Publishing{}
+	for _, message := range messages {
+		byKey[message.RoutingKey] = message.Msg
+	}
+
+	quarantined := byKey["quarantine"]
+	assert.Contains(t, string(quarantined.Body), "meter-3")
+	assert.NotContains(t, string(quarantined.Body), "quality", "the score is in the envelope, not in the reading")
+	assert.Equal(t, 30, quarantined.Headers["quality_score"])
+	assert.Equal(t, []interface{}{amqp.Table{
+		"score":   30,
+		"factors": amqp.Table{qualityMissing: 20, qualityOutOfRange: 30, qualityStale: 20},
+	}}, quarantined.Headers["quality"])
+
+	rest := byKey["meter-data-queue"]
+	assert.Equal(t, 80, rest.Headers["quality_score"], "the lowest score of the message")
+	assert.Equal(t, []interface{}{
+		amqp.Table{"score": 100, "factors": amqp.Table{}},
+		amqp.Table{"score": 80, "factors": amqp.Table{qualityMissing: 20}},
+	}, rest.Headers["quality"])
+
+	metric := findMetric(t, ingestor, "data_ingestor_reading_quality_score", map[string]string{"location": "default"})
+	assert.Equal(t, uint64(3), metric.GetHistogram().GetSampleCount())
+	assert.Equal(t, 210.0, metric.GetHistogram().GetSampleSum())
+}
+
+func TestQuality_DisabledLeavesReadingsUnscored(t *testing.T) {
+	upstream := newUpstream(t, "application/json", `[{"type":"energy","name":"meter-1","payload":{"energy":5}}]`)
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, (*result.Data)[0].Quality)
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.NotContains(t, messages[0].Msg.Headers, "quality_score")
+}
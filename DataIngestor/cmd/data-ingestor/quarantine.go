@@ -0,0 +1,883 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultQuarantineStateFile  = "quarantine.json"
+	defaultQuarantineRetention  = 7 * 24 * time.Hour
+	defaultQuarantineMaxEntries = 10000
+	defaultQuarantineMaxBytes   = 16 << 20
+	// quarantineStateVersion is the version of the state files that were a
+	// single document, and quarantineLogVersion that of the log
+	quarantineStateVersion = 1
+	quarantineLogVersion   = 2
+)
+
+// Why quarantined readings were dropped unprocessed, as counted in
+// quarantine_evicted_total
+const (
+	evictedExpired  = "expired"
+	evictedCapacity = "capacity"
+)
+
+var errQuarantineNotFound = errors.New("quarantined reading not found")
+
+// QuarantineConfig keeps the readings that fail validation, and posted
+// records that cannot be decoded, instead of dropping them, so they can be
+// reprocessed once the rules are fixed
+type QuarantineConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// StateFile keeps the quarantined readings across restarts
+	StateFile string `yaml:"state_file"`
+	// Retention is how long a reading is kept, seven days by default
+	Retention Duration `yaml:"retention"`
+	// MaxEntries and MaxBytes cap the quarantine; the oldest readings make
+	// room for new ones. 10000 readings and 16MiB of raw readings by default.
+	MaxEntries int      `yaml:"max_entries"`
+	MaxBytes   ByteSize `yaml:"max_bytes"`
+}
+
+func (c QuarantineConfig) Validate() error {
+	if c.Retention < 0 {
+		return fmt.Errorf("quarantine.retention must not be negative")
+	}
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("quarantine.max_entries must not be negative")
+	}
+	if c.MaxBytes < 0 {
+		return fmt.Errorf("quarantine.max_bytes must not be negative")
+	}
+	return nil
+}
+
+// QuarantinedReading is an invalid reading with the bytes it came in and
+// why it was invalid
+type QuarantinedReading struct {
+	ID       string `json:"id"`
+	Location string `json:"location,omitempty"`
+	Trigger  string `json:"trigger"`
+	// Code and Reason are why the reading is invalid, as of the last check
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+	// Raw is the reading as it came in, byte for byte, or the whole
+	// response when it could not be decoded
+	Raw string `json:"raw"`
+	// Format is the format of the response, set when Raw is a response
+	Format        string    `json:"format,omitempty"`
+	QuarantinedAt time.Time `json:"quarantined_at"`
+	// Attempts counts the reprocessing runs that did not publish it
+	Attempts    int        `json:"attempts,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+}
+
+// Operations of the quarantine log
+const (
+	// quarantinePut adds a reading, or replaces the one with its ID
+	quarantinePut = "put"
+	// quarantineRemove drops the reading with an ID
+	quarantineRemove = "remove"
+)
+
+// quarantineCompactSlack is how many records the log may hold beyond twice
+// the readings before it is compacted
+const quarantineCompactSlack = 64
+
+// quarantineState is the state file format of version 1, a single JSON
+// document rewritten on every change. It is read to migrate it to the log.
+type quarantineState struct {
+	Version  int                   `json:"version"`
+	SavedAt  time.Time             `json:"saved_at"`
+	Readings []*QuarantinedReading `json:"readings"`
+}
+
+// quarantineLogRecord is one line of the state file. The first line holds
+// only the version; every other line is an operation.
+type quarantineLogRecord struct {
+	Version int                 `json:"version,omitempty"`
+	Op      string              `json:"op,omitempty"`
+	Reading *QuarantinedReading `json:"reading,omitempty"`
+	ID      string              `json:"id,omitempty"`
+}
+
+// quarantine holds the invalid readings, oldest first. The state file is an
+// append-only log of the changes, compacted to the readings it holds once
+// most of its records are stale.
+type quarantine struct {
+	config     QuarantineConfig
+	retention  time.Duration
+	maxEntries int
+	maxBytes   int64
+	logger     *logrus.Logger
+	metrics    *Metrics
+	now        func() time.Time
+
+	mu       sync.Mutex
+	readings []*QuarantinedReading
+	bytes    int64
+	// claimed are the readings being reprocessed
+	claimed map[string]bool
+	// log is the state file, open for appending, and records the number of
+	// operations in it
+	log     *os.File
+	records int
+}
+
+// newQuarantine returns nil unless quarantine.enabled is set
+func (di *DataIngestor) newQuarantine() *quarantine {
+	config := di.config.Quarantine
+	if !config.Enabled {
+		return nil
+	}
+	if config.StateFile == "" {
+		config.StateFile = defaultQuarantineStateFile
+	}
+	q := &quarantine{
+		config:     config,
+		retention:  time.Duration(config.Retention),
+		maxEntries: config.MaxEntries,
+		maxBytes:   int64(config.MaxBytes),
+		logger:     di.logger,
+		metrics:    di.metrics,
+		now:        time.Now,
+		claimed:    make(map[string]bool),
+	}
+	if q.retention <= 0 {
+		q.retention = defaultQuarantineRetention
+	}
+	if q.maxEntries <= 0 {
+		q.maxEntries = defaultQuarantineMaxEntries
+	}
+	if q.maxBytes <= 0 {
+		q.maxBytes = defaultQuarantineMaxBytes
+	}
+	q.restore()
+	return q
+}
+
+// restore replays the state file, or reads one of version 1, and compacts
+// it. A missing file is not an error; a torn last line, from a crash while
+// it was written, is left out.
+func (q *quarantine) restore() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.compact()
+
+	body, err := os.ReadFile(q.config.StateFile)
+	if errors.Is(err, os.ErrNotExist) || (err == nil && len(bytes.TrimSpace(body)) == 0) {
+		return
+	}
+	var readings []*QuarantinedReading
+	if err == nil {
+		readings, err = replayQuarantine(body)
+	}
+	if err != nil {
+		q.logger.WithError(err).Warn("Discarding quarantine state, the quarantined readings are lost")
+		return
+	}
+	for _, reading := range readings {
+		q.readings = append(q.readings, reading)
+		q.bytes += int64(len(reading.Raw))
+	}
+	q.prune()
+}
+
+// replayQuarantine returns the readings of a state file, oldest first
+func replayQuarantine(body []byte) ([]*QuarantinedReading, error) {
+	var legacy quarantineState
+	if json.Unmarshal(body, &legacy) == nil && legacy.Version == quarantineStateVersion {
+		return legacy.Readings, nil
+	}
+	lines := bytes.Split(body, []byte{'\n'})
+	var header quarantineLogRecord
+	if err := json.Unmarshal(lines[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Version != quarantineLogVersion {
+		return nil, fmt.Errorf("unsupported version %d", header.Version)
+	}
+	var order []string
+	byID := make(map[string]*QuarantinedReading)
+	for i, line := range lines[1:] {
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		var record quarantineLogRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			if i == len(lines)-2 {
+				break
+			}
+			return nil, fmt.Errorf("line %d: %w", i+2, err)
+		}
+		switch {
+		case record.Op == quarantinePut && record.Reading != nil:
+			if _, ok := byID[record.Reading.ID]; !ok {
+				order = append(order, record.Reading.ID)
+			}
+			byID[record.Reading.ID] = record.Reading
+		case record.Op == quarantineRemove:
+			delete(byID, record.ID)
+		}
+	}
+	readings := make([]*QuarantinedReading, 0, len(byID))
+	for _, id := range order {
+		if reading, ok := byID[id]; ok {
+			readings = append(readings, reading)
+			// A reading removed and put again keeps its first place
+			delete(byID, id)
+		}
+	}
+	return readings, nil
+}
+
+// prune drops the expired readings and those over the caps and returns the
+// IDs of those it dropped. Callers hold mu.
+func (q *quarantine) prune() []string {
+	now := q.now()
+	var dropped []string
+	kept := q.readings[:0]
+	for _, reading := range q.readings {
+		if now.Sub(reading.QuarantinedAt) > q.retention {
+			q.evict(reading, evictedExpired)
+			dropped = append(dropped, reading.ID)
+			continue
+		}
+		kept = append(kept, reading)
+	}
+	q.readings = kept
+	for len(q.readings) > 0 && (len(q.readings) > q.maxEntries || q.bytes > q.maxBytes) {
+		q.evict(q.readings[0], evictedCapacity)
+		dropped = append(dropped, q.readings[0].ID)
+		q.readings = q.readings[1:]
+	}
+	q.metrics.QuarantineReadings.Set(float64(len(q.readings)))
+	return dropped
+}
+
+// write appends records to the state file, and compacts it once most of
+// its records are stale. Callers hold mu.
+func (q *quarantine) write(records []quarantineLogRecord) {
+	if len(records) == 0 {
+		return
+	}
+	if q.log == nil {
+		// The last compaction failed
+		q.compact()
+		return
+	}
+	var lines []byte
+	for _, record := range records {
+		line, err := json.Marshal(record)
+		if err != nil {
+			q.logger.WithError(err).Error("Failed to save quarantine state")
+			return
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+	if _, err := q.log.Write(lines); err != nil {
+		q.logger.WithError(err).Error("Failed to save quarantine state")
+		q.log.Close()
+		q.log = nil
+		return
+	}
+	q.records += len(records)
+	if q.records > 2*len(q.readings)+quarantineCompactSlack {
+		q.compact()
+	}
+}
+
+// compact rewrites the state file with one record per reading and opens it
+// for appending. Callers hold mu.
+func (q *quarantine) compact() {
+	if q.log != nil {
+		q.log.Close()
+		q.log = nil
+	}
+	body, err := json.Marshal(quarantineLogRecord{Version: quarantineLogVersion})
+	if err != nil {
+		q.logger.WithError(err).Error("Failed to save quarantine state")
+		return
+	}
+	body = append(body, '\n')
+	for _, reading := range q.readings {
+		line, err := json.Marshal(quarantineLogRecord{Op: quarantinePut, Reading: reading})
+		if err != nil {
+			q.logger.WithError(err).Error("Failed to save quarantine state")
+			return
+		}
+		body = append(append(body, line...), '\n')
+	}
+	if err := writeFileAtomic(q.config.StateFile, body); err != nil {
+		q.logger.WithError(err).Error("Failed to save quarantine state")
+		return
+	}
+	log, err := os.OpenFile(q.config.StateFile, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		q.logger.WithError(err).Error("Failed to save quarantine state")
+		return
+	}
+	q.log, q.records = log, len(q.readings)
+}
+
+// close closes the state file
+func (q *quarantine) close() {
+	if q == nil {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.log != nil {
+		q.log.Close()
+		q.log = nil
+	}
+}
+
+func putRecords(readings ...*QuarantinedReading) []quarantineLogRecord {
+	records := make([]quarantineLogRecord, len(readings))
+	for i, reading := range readings {
+		records[i] = quarantineLogRecord{Op: quarantinePut, Reading: reading}
+	}
+	return records
+}
+
+func removeRecords(ids []string) []quarantineLogRecord {
+	records := make([]quarantineLogRecord, len(ids))
+	for i, id := range ids {
+		records[i] = quarantineLogRecord{Op: quarantineRemove, ID: id}
+	}
+	return records
+}
+
+// evict accounts for a reading dropped unprocessed. Callers hold mu and
+// remove it.
+func (q *quarantine) evict(reading *QuarantinedReading, reason string) {
+	q.bytes -= int64(len(reading.Raw))
+	q.metrics.QuarantineEvicted.WithLabelValues(reason).Inc()
+	q.logger.WithFields(logrus.Fields{
+		"id":       reading.ID,
+		"location": reading.Location,
+		"code":     reading.Code,
+		"reason":   reason,
+	}).Warn("Quarantined reading dropped unprocessed")
+}
+
+// hold quarantines readings and returns them with their IDs. A nil
+// quarantine holds nothing.
+func (q *quarantine) hold(readings []QuarantinedReading) []QuarantinedReading {
+	if q == nil || len(readings) == 0 {
+		return nil
+	}
+	now := q.now().UTC()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	added := make([]*QuarantinedReading, 0, len(readings))
+	for i := range readings {
+		readings[i].ID = newMessageID()
+		readings[i].QuarantinedAt = now
+		held := readings[i]
+		q.readings = append(q.readings, &held)
+		q.bytes += int64(len(held.Raw))
+		q.metrics.Quarantined.WithLabelValues(held.Code).Inc()
+		added = append(added, &held)
+	}
+	q.write(append(putRecords(added...), removeRecords(q.prune())...))
+	return readings
+}
+
+// holds reports whether a response of a location with the raw body is
+// quarantined already, so a response that fails every poll is held once
+func (q *quarantine) holds(location, raw string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, reading := range q.readings {
+		if reading.Format != "" && reading.Location == location && reading.Raw == raw {
+			return true
+		}
+	}
+	return false
+}
+
+// get returns a copy of a quarantined reading
+func (q *quarantine) get(id string) (QuarantinedReading, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, reading := range q.readings {
+		if reading.ID == id {
+			return *reading, true
+		}
+	}
+	return QuarantinedReading{}, false
+}
+
+// claim marks the readings as being reprocessed and returns those it could
+// claim, leaving out those another run claimed or that left the quarantine
+func (q *quarantine) claim(readings []QuarantinedReading) []QuarantinedReading {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	present := make(map[string]bool, len(q.readings))
+	for _, reading := range q.readings {
+		present[reading.ID] = true
+	}
+	claimed := make([]QuarantinedReading, 0, len(readings))
+	for _, reading := range readings {
+		if !present[reading.ID] || q.claimed[reading.ID] {
+			continue
+		}
+		q.claimed[reading.ID] = true
+		claimed = append(claimed, reading)
+	}
+	return claimed
+}
+
+// unclaim ends the reprocessing of the readings with ids
+func (q *quarantine) unclaim(ids []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for _, id := range ids {
+		delete(q.claimed, id)
+	}
+}
+
+// quarantineFilter selects quarantined readings; empty fields match every
+// reading
+type quarantineFilter struct {
+	Code    string
+	Trigger string
+	// Location is a glob pattern like in GET /history
+	Location string
+	Since    time.Time
+}
+
+func (f quarantineFilter) matches(reading *QuarantinedReading) bool {
+	switch {
+	case f.Code != "" && reading.Code != f.Code:
+		return false
+	case f.Trigger != "" && reading.Trigger != f.Trigger:
+		return false
+	case !f.Since.IsZero() && reading.QuarantinedAt.Before(f.Since):
+		return false
+	}
+	return globMatch(f.Location, reading.Location)
+}
+
+// list returns the readings matching filter, newest first
+func (q *quarantine) list(filter quarantineFilter) []QuarantinedReading {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	readings := []QuarantinedReading{}
+	for i := len(q.readings) - 1; i >= 0; i-- {
+		if filter.matches(q.readings[i]) {
+			readings = append(readings, *q.readings[i])
+		}
+	}
+	return readings
+}
+
+// remove deletes a reading, after it was published or discarded
+func (q *quarantine) remove(id string) (QuarantinedReading, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, reading := range q.readings {
+		if reading.ID == id {
+			q.bytes -= int64(len(reading.Raw))
+			q.readings = append(q.readings[:i], q.readings[i+1:]...)
+			q.metrics.QuarantineReadings.Set(float64(len(q.readings)))
+			q.write(removeRecords([]string{id}))
+			return *reading, true
+		}
+	}
+	return QuarantinedReading{}, false
+}
+
+// attempted records a reprocessing run that did not publish the readings.
+// Invalid ones take the code and reason of the current rules.
+func (q *quarantine) attempted(outcomes []QuarantineOutcome) {
+	now := q.now().UTC()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var changed []*QuarantinedReading
+	for _, outcome := range outcomes {
+		for _, reading := range q.readings {
+			if reading.ID != outcome.ID {
+				continue
+			}
+			reading.Attempts++
+			reading.LastAttempt = &now
+			if outcome.Status == recordInvalid {
+				reading.Code, reading.Reason = outcome.Code, outcome.Error
+			}
+			changed = append(changed, reading)
+		}
+	}
+	q.write(putRecords(changed...))
+}
+
+// quarantineReadings holds the readings validation dropped, as they came in,
+// and returns their entries
+func (di *DataIngestor) quarantineReadings(ctx context.Context, invalid []SensorData, reasons []string) []QuarantinedReading {
+	if di.quarantine == nil || len(invalid) == 0 {
+		return nil
+	}
+	held := make([]QuarantinedReading, 0, len(invalid))
+	for i, reading := range invalid {
+		raw := []byte(reading.Raw)
+		if raw == nil {
+			// Readings from a source that kept no bytes, e.g. a replay
+			var err error
+			if raw, err = json.Marshal(reading); err != nil {
+				continue
+			}
+		}
+		held = append(held, QuarantinedReading{
+			Location: reading.Location(),
+			Trigger:  triggerOf(ctx),
+			Code:     "out_of_range",
+			Reason:   reasons[i],
+			Raw:      string(raw),
+		})
+	}
+	return di.quarantine.hold(held)
+}
+
+// keepRaw sets the bytes each reading came in. JSON readings keep their
+// element of the response; XML and CSV readings, which can only be
+// reprocessed as JSON, keep the JSON of the reading as it was decoded,
+// before any stage changed it.
+func keepRaw(format string, body []byte, data WeatherData) {
+	if format == formatJSON {
+		var elements []json.RawMessage
+		if json.Unmarshal(body, &elements) == nil && len(elements) == len(data) {
+			for i := range data {
+				data[i].Raw = elements[i]
+			}
+			return
+		}
+	}
+	for i := range data {
+		if raw, err := json.Marshal(data[i]); err == nil {
+			data[i].Raw = raw
+		}
+	}
+}
+
+// quarantineResponse holds a polled response that could not be decoded,
+// once per location and body, so it can be reprocessed after the decoder or
+// the location's format is fixed
+func (di *DataIngestor) quarantineResponse(ctx context.Context, location, format string, body []byte, err error) {
+	if di.quarantine == nil || di.quarantine.holds(location, string(body)) {
+		return
+	}
+	di.quarantine.hold([]QuarantinedReading{{
+		Location: location,
+		Trigger:  triggerOf(ctx),
+		Code:     "undecodable",
+		Reason:   err.Error(),
+		Raw:      string(body),
+		Format:   format,
+	}})
+}
+
+// QuarantineOutcome is what reprocessing did with one quarantined reading.
+// Code is set for invalid and failed readings.
+type QuarantineOutcome struct {
+	ID         string   `json:"id"`
+	Status     string   `json:"status"`
+	Code       string   `json:"code,omitempty"`
+	Error      string   `json:"error,omitempty"`
+	MessageIDs []string `json:"message_ids,omitempty"`
+}
+
+// reprocess runs readings through the current stages and sinks, like posted
+// records. Published readings leave the quarantine. The readings must be
+// claimed, and are unclaimed once reprocessed.
+func (di *DataIngestor) reprocess(readings []QuarantinedReading) (RecordSummary, []QuarantineOutcome) {
+	ctx := di.withFeatures(withTrigger(context.Background(), triggerManual))
+	env := Envelope{CorrelationID: newMessageID(), Trigger: triggerManual}
+	correlationID := env.CorrelationID
+	summary := RecordSummary{Total: len(readings)}
+	outcomes := make([]QuarantineOutcome, 0, len(readings))
+	ids := make([]string, 0, len(readings))
+	var pending []QuarantineOutcome
+	for _, held := range readings {
+		ids = append(ids, held.ID)
+		var outcome QuarantineOutcome
+		if held.Format != "" {
+			outcome = di.reprocessResponse(ctx, held, env)
+		} else {
+			outcome = di.reprocessReading(ctx, held, env)
+		}
+		if outcome.Status == recordPublished {
+			di.quarantine.remove(held.ID)
+		}
+		switch outcome.Status {
+		case recordPublished:
+			summary.Published++
+		case recordInvalid:
+			summary.Invalid++
+			pending = append(pending, outcome)
+		case recordFailed:
+			summary.Failed++
+			pending = append(pending, outcome)
+		}
+		di.metrics.QuarantineReprocessed.WithLabelValues(outcome.Status).Inc()
+		outcomes = append(outcomes, outcome)
+	}
+	if len(pending) > 0 {
+		di.quarantine.attempted(pending)
+	}
+	di.quarantine.unclaim(ids)
+	di.logger.WithFields(logrus.Fields{
+		"correlation_id": correlationID,
+		"total":          summary.Total,
+		"published":      summary.Published,
+		"invalid":        summary.Invalid,
+		"failed":         summary.Failed,
+	}).Info("Quarantined readings reprocessed")
+	return summary, outcomes
+}
+
+// reprocessReading delivers one quarantined reading. One that is still
+// invalid stays where it is rather than being quarantined again.
+func (di *DataIngestor) reprocessReading(ctx context.Context, held QuarantinedReading, env Envelope) QuarantineOutcome {
+	ctx = withValidationDrops(ctx, &validationDrops{fromQuarantine: true})
+	outcome := QuarantineOutcome{ID: held.ID}
+	reading, code, reason := checkRecord(json.RawMessage(held.Raw))
+	if code != "" {
+		outcome.Status, outcome.Code, outcome.Error = recordInvalid, code, reason
+		return outcome
+	}
+	delivered := di.deliverRecord(ctx, reading, json.RawMessage(held.Raw), env)
+	outcome.Status, outcome.Code, outcome.Error, outcome.MessageIDs = delivered.Status, delivered.Code, delivered.Error, delivered.MessageIDs
+	if delivered.Status == recordDuplicate {
+		// Published before, here or by another instance
+		outcome.Status = recordPublished
+	}
+	return outcome
+}
+
+// reprocessResponse decodes a quarantined response with the location's
+// current format settings, a configured format winning over the one the
+// response came in, and delivers its readings one at a time. Readings that
+// are invalid get entries of their own, so the response leaves the
+// quarantine once it decodes and none of its readings failed to publish.
+func (di *DataIngestor) reprocessResponse(ctx context.Context, held QuarantinedReading, env Envelope) QuarantineOutcome {
+	outcome := QuarantineOutcome{ID: held.ID}
+	format, csv := di.config.API.Format, di.config.API.CSV
+	if src := di.sourceByName(held.Location); src != nil {
+		format, csv = src.format, src.csv
+	}
+	if format == "" {
+		format = held.Format
+	}
+	body := []byte(held.Raw)
+	data, _, err := decodeReadings(format, csv, body)
+	if err != nil {
+		outcome.Status, outcome.Code, outcome.Error = recordInvalid, "undecodable", err.Error()
+		return outcome
+	}
+	keepRaw(format, body, data)
+	outcome.Status = recordPublished
+	for _, reading := range data {
+		delivered := di.deliverRecord(ctx, reading, reading.Raw, env)
+		outcome.MessageIDs = append(outcome.MessageIDs, delivered.MessageIDs...)
+		if delivered.Status == recordFailed {
+			outcome.Status, outcome.Code, outcome.Error = recordFailed, delivered.Code, delivered.Error
+		}
+	}
+	return outcome
+}
+
+// quarantineDisabled answers 409 and returns true without a quarantine
+func (di *DataIngestor) quarantineDisabled(c *gin.Context) bool {
+	if di.quarantine != nil {
+		return false
+	}
+	c.JSON(http.StatusConflict, gin.H{
+		"error": "quarantine is disabled",
+	})
+	return true
+}
+
+// brokerNotReady answers 503 and returns true while nothing can be
+// published
+func (di *DataIngestor) brokerNotReady(c *gin.Context) bool {
+	if di.ConnectionState() == StateReady {
+		return false
+	}
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": "RabbitMQ is not connected, nothing was reprocessed; retry once the connection is ready",
+		"state": di.ConnectionState().String(),
+	})
+	return true
+}
+
+// quarantineQuery reads the filter of GET /quarantine and POST
+// /quarantine/reprocess from ?code=, ?trigger=, ?location= and ?since=
+func quarantineQuery(c *gin.Context) (quarantineFilter, bool) {
+	filter := quarantineFilter{Code: c.Query("code"), Trigger: c.Query("trigger"), Location: c.Query("location")}
+	if _, err := path.Match(filter.Location, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid location pattern: %v", err),
+		})
+		return filter, false
+	}
+	if filter.Trigger != "" && !validTrigger(filter.Trigger) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("unknown trigger %q", filter.Trigger),
+		})
+		return filter, false
+	}
+	if since := c.Query("since"); since != "" {
+		t, err := time.Parse(time.RFC3339, since)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"error": "since must be an RFC 3339 time",
+			})
+			return filter, false
+		}
+		filter.Since = t
+	}
+	return filter, true
+}
+
+// handleQuarantineList serves GET /quarantine, newest first, filtered like
+// quarantineQuery and limited by ?limit=
+func (di *DataIngestor) handleQuarantineList(c *gin.Context) {
+	if di.quarantineDisabled(c) {
+		return
+	}
+	filter, ok := quarantineQuery(c)
+	if !ok {
+		return
+	}
+	limit, err := queryInt(c, "limit", defaultHistoryLimit)
+	if err != nil || limit < 1 || limit > maxHistoryLimit {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit),
+		})
+		return
+	}
+	readings := di.quarantine.list(filter)
+	total := len(readings)
+	if total > limit {
+		readings = readings[:limit]
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"readings": readings,
+		"total":    total,
+	})
+}
+
+// handleQuarantineGet serves GET /quarantine/:id
+func (di *DataIngestor) handleQuarantineGet(c *gin.Context) {
+	if di.quarantineDisabled(c) {
+		return
+	}
+	reading, ok := di.quarantine.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": errQuarantineNotFound.Error(),
+		})
+		return
+	}
+	c.JSON(http.StatusOK, reading)
+}
+
+// handleQuarantineReprocess serves POST /quarantine/:id/reprocess: 200 when
+// the reading was published, 422 when it is still invalid, 502 when it could
+// not be published and 409 while another run reprocesses it. Only a
+// published reading leaves the quarantine.
+func (di *DataIngestor) handleQuarantineReprocess(c *gin.Context) {
+	if di.quarantineDisabled(c) {
+		return
+	}
+	reading, ok := di.quarantine.get(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": errQuarantineNotFound.Error(),
+		})
+		return
+	}
+	if di.brokerNotReady(c) {
+		return
+	}
+	claimed := di.quarantine.claim([]QuarantinedReading{reading})
+	if len(claimed) == 0 {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "quarantined reading is being reprocessed",
+		})
+		return
+	}
+	_, outcomes := di.reprocess(claimed)
+	outcome := outcomes[0]
+	switch outcome.Status {
+	case recordInvalid:
+		c.JSON(http.StatusUnprocessableEntity, outcome)
+	case recordFailed:
+		c.JSON(http.StatusBadGateway, outcome)
+	default:
+		c.JSON(http.StatusOK, outcome)
+	}
+}
+
+// handleQuarantineReprocessAll serves POST /quarantine/reprocess and
+// reprocesses every reading matching the filter of GET /quarantine, for
+// after a fix of the rules. The multi-status report is like the one of
+// posted records.
+func (di *DataIngestor) handleQuarantineReprocessAll(c *gin.Context) {
+	if di.quarantineDisabled(c) {
+		return
+	}
+	filter, ok := quarantineQuery(c)
+	if !ok || di.brokerNotReady(c) {
+		return
+	}
+	readings := di.quarantine.list(filter)
+	// Oldest first, in the order they came in
+	for i, j := 0, len(readings)-1; i < j; i, j = i+1, j-1 {
+		readings[i], readings[j] = readings[j], readings[i]
+	}
+	// Readings another run is reprocessing are left to it
+	summary, outcomes := di.reprocess(di.quarantine.claim(readings))
+	status := http.StatusOK
+	if summary.Published != summary.Total {
+		status = http.StatusMultiStatus
+	}
+	c.JSON(status, gin.H{
+		"summary":  summary,
+		"readings": outcomes,
+	})
+}
+
+// handleQuarantineDiscard serves DELETE /quarantine/:id
+func (di *DataIngestor) handleQuarantineDiscard(c *gin.Context) {
+	if di.quarantineDisabled(c) {
+		return
+	}
+	reading, ok := di.quarantine.remove(c.Param("id"))
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": errQuarantineNotFound.Error(),
+		})
+		return
+	}
+	di.logger.WithFields(logrus.Fields{
+		"id":       reading.ID,
+		"location": reading.Location,
+		"code":     reading.Code,
+	}).Info("Quarantined reading discarded")
+	c.Status(http.StatusNoContent)
+}
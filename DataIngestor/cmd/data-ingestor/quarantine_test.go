@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const quarantineMetadataYAML = `
+locations:
+  Moscow:
+    validation:
+      bounds:
+        temperature: {min: -45, max: 35}
+`
+
+// newQuarantineIngestor polls a Moscow reading above the location's bounds
+// and quarantines it
+func newQuarantineIngestor(t *testing.T, quarantine QuarantineConfig) (*DataIngestor, *fakeChannel, string) {
+	t.Helper()
+	dir := t.TempDir()
+	metadata := filepath.Join(dir, "locations.yaml")
+	require.NoError(t, os.WriteFile(metadata, []byte(quarantineMetadataYAML), 0o644))
+	if quarantine.StateFile == "" {
+		quarantine.StateFile = filepath.Join(dir, "quarantine.json")
+	}
+	quarantine.Enabled = true
+	upstream := newUpstream(t, "application/json", `[
+		{"type":"weather","name":"Moscow","payload":{"temperature":40}},
+		{"type":"weather","name":"Moscow","payload":{"temperature":20}}
+	]`)
+	ingestor := NewDataIngestor(&Config{
+		API:        APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Admin:      AdminConfig{Token: "letmein"},
+		Enrichment: EnrichmentConfig{MetadataFile: metadata},
+		Quarantine: quarantine,
+	})
+	require.NoError(t, ingestor.LoadEnrichment())
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel, metadata
+}
+
+func quarantineCall(router http.Handler, method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer letmein")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func listQuarantine(t *testing.T, router http.Handler, query string) []QuarantinedReading {
+	t.Helper()
+	w := quarantineCall(router, http.MethodGet, "/quarantine"+query)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		Readings []QuarantinedReading `json:"readings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	return body.Readings
+}
+
+func TestQuarantineConfig_Validate(t *testing.T) {
+	assert.NoError(t, QuarantineConfig{}.Validate())
+	assert.NoError(t, QuarantineConfig{Enabled: true, Retention: Duration(time.Hour), MaxEntries: 10, MaxBytes: 1024}.Validate())
+	assert.ErrorContains(t, QuarantineConfig{Retention: -1}.Validate(), "quarantine.retention")
+	assert.ErrorContains(t, QuarantineConfig{MaxEntries: -1}.Validate(), "quarantine.max_entries")
+	assert.ErrorContains(t, QuarantineConfig{MaxBytes: -1}.Validate(), "quarantine.max_bytes")
+}
+
+func TestQuarantine_ReprocessAfterTheBoundsAreRelaxed(t *testing.T) {
+	ingestor, channel, metadata := newQuarantineIngestor(t, QuarantineConfig{})
+	router := setupRoutes(ingestor)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	require.Len(t, channel.messages(), 1, "the valid reading is published")
+
+	readings := listQuarantine(t, router, "")
+	require.Len(t, readings, 1)
+	held := readings[0]
+	assert.Equal(t, "Moscow", held.Location)
+	assert.Equal(t, triggerPoll, held.Trigger)
+	assert.Equal(t, "out_of_range", held.Code)
+	assert.Equal(t, "temperature 40 is out of range", held.Reason)
+	assert.JSONEq(t, `{"type":"weather","name":"Moscow","payload":{"temperature":40}}`, held.Raw)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Quarantined.WithLabelValues("out_of_range")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.QuarantineReadings))
+
+	// The rules have not changed yet
+	w := quarantineCall(router, http.MethodPost, "/quarantine/"+held.ID+"/reprocess")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+	held = listQuarantine(t, router, "")[0]
+	assert.Equal(t, 1, held.Attempts)
+	require.NotNil(t, held.LastAttempt)
+
+	// Relax the bounds and reload the metadata, as SIGHUP does
+	require.NoError(t, os.WriteFile(metadata, []byte(`
+locations:
+  Moscow:
+    validation:
+      bounds:
+        temperature: {min: -45, max: 45}
+`), 0o644))
+	_, err = ingestor.enricher.Reload()
+	require.NoError(t, err)
+
+	w = quarantineCall(router, http.MethodPost, "/quarantine/"+held.ID+"/reprocess")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var outcome QuarantineOutcome
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &outcome))
+	assert.Equal(t, recordPublished, outcome.Status)
+	require.Len(t, outcome.MessageIDs, 1)
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	var published WeatherData
+	require.NoError(t, json.Unmarshal(messages[1].Msg.Body, &published))
+	assert.Equal(t, 40.0, published[0].Payload["temperature"])
+	assert.Equal(t, triggerManual, messages[1].Msg.Headers["trigger"])
+	assert.Empty(t, listQuarantine(t, router, ""), "a published reading leaves the quarantine")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.QuarantineReprocessed.WithLabelValues(recordPublished)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.QuarantineReprocessed.WithLabelValues(recordInvalid)))
+
+	w = quarantineCall(router, http.MethodPost, "/quarantine/"+held.ID+"/reprocess")
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestQuarantine_PostedRecordsFiltersAndBulk(t *testing.T) {
+	ingestor, channel, metadata := newQuarantineIngestor(t, QuarantineConfig{})
+	router := setupRoutes(ingestor)
+
+	code, results := postRecords(t, router, []string{
+		`{"type":"weather","name":"Moscow","payload":{"temperature":50}}`,
+		`"not a reading"`,
+		`{"type":"weather","name":"Moscow","payload":{"temperature":10}}`,
+	})
+	require.Equal(t, http.StatusMultiStatus, code)
+	require.NotEmpty(t, results.Records[0].QuarantineID)
+	require.NotEmpty(t, results.Records[1].QuarantineID)
+	assert.Empty(t, results.Records[2].QuarantineID)
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	assert.Len(t, listQuarantine(t, router, ""), 3)
+	assert.Len(t, listQuarantine(t, router, "?code=out_of_range"), 2)
+	assert.Len(t, listQuarantine(t, router, "?trigger=webhook"), 2)
+	assert.Len(t, listQuarantine(t, router, "?location=mos*&trigger=poll"), 1)
+	newest := listQuarantine(t, router, "?limit=1")
+	require.Len(t, newest, 1)
+	assert.Equal(t, triggerPoll, newest[0].Trigger, "newest first")
+	assert.Equal(t, http.StatusBadRequest, quarantineCall(router, http.MethodGet, "/quarantine?trigger=cron").Code)
+	assert.Equal(t, http.StatusBadRequest, quarantineCall(router, http.MethodGet, "/quarantine?since=yesterday").Code)
+
+	got := quarantineCall(router, http.MethodGet, "/quarantine/"+results.Records[1].QuarantineID)
+	require.Equal(t, http.StatusOK, got.Code)
+	var malformed QuarantinedReading
+	require.NoError(t, json.Unmarshal(got.Body.Bytes(), &malformed))
+	assert.Equal(t, "malformed", malformed.Code)
+	assert.JSONEq(t, `"not a reading"`, malformed.Raw)
+
+	// After a rules fix the bulk run publishes both out of range readings
+	require.NoError(t, os.WriteFile(metadata, []byte(strings.Replace(quarantineMetadataYAML, "max: 35", "max: 100", 1)), 0o644))
+	_, err = ingestor.enricher.Reload()
+	require.NoError(t, err)
+	published := len(channel.messages())
+	w := quarantineCall(router, http.MethodPost, "/quarantine/reprocess")
+	require.Equal(t, http.StatusMultiStatus, w.Code, w.Body.String())
+	var bulk struct {
+		Summary  RecordSummary       `json:"summary"`
+		Readings []QuarantineOutcome `json:"readings"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &bulk))
+	assert.Equal(t, RecordSummary{Total: 3, Published: 2, Invalid: 1}, bulk.Summary)
+	assert.Equal(t, results.Records[0].QuarantineID, bulk.Readings[0].ID, "oldest first")
+	assert.Len(t, channel.messages(), published+2)
+
+	left := listQuarantine(t, router, "")
+	require.Len(t, left, 1)
+	assert.Equal(t, malformed.ID, left[0].ID)
+
+	w = quarantineCall(router, http.MethodDelete, "/quarantine/"+malformed.ID)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.Empty(t, listQuarantine(t, router, ""))
+	w = quarantineCall(router, http.MethodDelete, "/quarantine/"+malformed.ID)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
+
+func TestQuarantine_RetentionCapsAndRestart(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "quarantine.json")
+	ingestor, _, _ := newQuarantineIngestor(t, QuarantineConfig{StateFile: stateFile, MaxEntries: 2})
+	now := time.Now().UTC().Truncate(time.Second)
+	ingestor.quarantine.now = func() time.Time { return now }
+
+	raw := `{"type":"weather","name":"Moscow","payload":{"temperature":40}}`
+	held := ingestor.quarantine.hold([]QuarantinedReading{
+		{Location: "Moscow", Code: "out_of_range", Raw: raw},
+		{Location: "Moscow", Code: "out_of_range", Raw: raw},
+		{Location: "Moscow", Code: "out_of_range", Raw: raw},
+	})
+	require.Len(t, held, 3)
+	kept := ingestor.quarantine.list(quarantineFilter{})
+	require.Len(t, kept, 2)
+	assert.Equal(t, held[2].ID, kept[0].ID)
+	assert.Equal(t, held[1].ID, kept[1].ID, "the oldest made room")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.QuarantineEvicted.WithLabelValues(evictedCapacity)))
+
+	restarted, _, _ := newQuarantineIngestor(t, QuarantineConfig{StateFile: stateFile, MaxEntries: 2})
+	assert.Equal(t, kept, restarted.quarantine.list(quarantineFilter{}), "kept across restarts")
+
+	// Raw bytes are capped as well
+	small, _, _ := newQuarantineIngestor(t, QuarantineConfig{MaxBytes: ByteSize(len(raw) + 1)})
+	small.quarantine.hold([]QuarantinedReading{{Code: "out_of_range", Raw: raw}, {Code: "out_of_range", Raw: raw}})
+	assert.Len(t, small.quarantine.list(quarantineFilter{}), 1)
+
+	// Expired readings are dropped on the next change
+	now = now.Add(defaultQuarantineRetention + time.Minute)
+	ingestor.quarantine.hold([]QuarantinedReading{{Code: "malformed", Raw: `42`}})
+	left := ingestor.quarantine.list(quarantineFilter{})
+	require.Len(t, left, 1)
+	assert.Equal(t, "malformed", left[0].Code)
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.QuarantineEvicted.WithLabelValues(evictedExpired)))
+}
+
+// stateLines returns the records of the quarantine state file
+func stateLines(t *testing.T, path string) []string {
+	t.Helper()
+	body, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return strings.Split(strings.TrimSuffix(string(body), "\n"), "\n")
+}
+
+func TestQuarantine_StateIsAnAppendOnlyLog(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "quarantine.json")
+	ingestor, _, _ := newQuarantineIngestor(t, QuarantineConfig{StateFile: stateFile})
+	raw := `{"type":"weather","name":"Moscow","payload":{"temperature":40}}`
+	held := ingestor.quarantine.hold([]QuarantinedReading{
+		{Location: "Moscow", Code: "out_of_range", Raw: raw},
+		{Location: "Moscow", Code: "out_of_range", Raw: raw},
+		{Location: "Moscow", Code: "out_of_range", Raw: raw},
+	})
+	_, ok := ingestor.quarantine.remove(held[1].ID)
+	require.True(t, ok)
+	ingestor.quarantine.attempted([]QuarantineOutcome{{ID: held[2].ID, Status: recordFailed}})
+
+	lines := stateLines(t, stateFile)
+	require.Len(t, lines, 6, "a header, three puts, a remove and a put")
+	assert.JSONEq(t, `{"version":2}`, lines[0])
+	assert.JSONEq(t, `{"op":"remove","id":"`+held[1].ID+`"}`, lines[4])
+
+	// A restart replays the log and compacts it
+	restarted, _, _ := newQuarantineIngestor(t, QuarantineConfig{StateFile: stateFile})
+	kept := restarted.quarantine.list(quarantineFilter{})
+	require.Len(t, kept, 2)
+	assert.Equal(t, held[2].ID, kept[0].ID)
+	assert.Equal(t, 1, kept[0].Attempts)
+	assert.Equal(t, held[0].ID, kept[1].ID)
+	assert.Len(t, stateLines(t, stateFile), 3)
+
+	// Churn is compacted away instead of growing the file
+	for i := 0; i < 200; i++ {
+		entry := restarted.quarantine.hold([]QuarantinedReading{{Location: "Moscow", Code: "out_of_range", Raw: raw}})
+		restarted.quarantine.remove(entry[0].ID)
+	}
+	assert.LessOrEqual(t, len(stateLines(t, stateFile)), 1+2*2+quarantineCompactSlack+2)
+	restarted.quarantine.close()
+	again, _, _ := newQuarantineIngestor(t, QuarantineConfig{StateFile: stateFile})
+	assert.Equal(t, kept, again.quarantine.list(quarantineFilter{}))
+
+	// A torn last line, from a crash while it was written, is left out
+	appendTo, err := os.OpenFile(stateFile, os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = appendTo.WriteString(`{"op":"put","reading":{"id":"torn"`)
+	require.NoError(t, err)
+	require.NoError(t, appendTo.Close())
+	torn, _, _ := newQuarantineIngestor(t, QuarantineConfig{StateFile: stateFile})
+	assert.Equal(t, kept, torn.quarantine.list(quarantineFilter{}))
+}
+
+func TestQuarantine_MigratesTheSingleDocumentState(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "quarantine.json")
+	at := time.Now().UTC().Truncate(time.Second)
+	legacy, err := json.Marshal(quarantineState{Version: quarantineStateVersion, SavedAt: at, Readings: []*QuarantinedReading{
+		{ID: "old", Location: "Moscow", Trigger: triggerPoll, Code: "out_of_range", Raw: `{}`, QuarantinedAt: at},
+	}})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(stateFile, legacy, 0o644))
+
+	ingestor, _, _ := newQuarantineIngestor(t, QuarantineConfig{StateFile: stateFile})
+	kept := ingestor.quarantine.list(quarantineFilter{})
+	require.Len(t, kept, 1)
+	assert.Equal(t, "old", kept[0].ID)
+	lines := stateLines(t, stateFile)
+	require.Len(t, lines, 2)
+	assert.JSONEq(t, `{"version":2}`, lines[0])
+}
+
+func TestQuarantine_KeepsTheBytesAReadingCameIn(t *testing.T) {
+	ingestor, _, _ := newQuarantineIngestor(t, QuarantineConfig{})
+	var err error
+	element := `{"name": "Moscow", "type": "weather", "payload": {"temperature": 40.0, "unit": "C"}}`
+	upstream := newUpstream(t, "application/json", `[`+element+`, {"type":"weather","name":"Moscow","payload":{"temperature":20}}]`)
+	ingestor.sources[0].baseURL = upstream.URL
+	ingestor.transformer, err = NewTransformer([]TransformConfig{{Assign: "temperature = temperature + 1"}}, ingestor.metrics, ingestor.logger)
+	require.NoError(t, err)
+
+	_, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	readings := ingestor.quarantine.list(quarantineFilter{})
+	require.Len(t, readings, 1)
+	assert.Equal(t, element, readings[0].Raw, "byte for byte, before the transforms")
+}
+
+func TestQuarantine_UndecodableResponses(t *testing.T) {
+	ingestor, channel, _ := newQuarantineIngestor(t, QuarantineConfig{})
+	router := setupRoutes(ingestor)
+	body := "type,name,temperature\nweather,Moscow,20\nweather,Moscow,40\n"
+	upstream := newUpstream(t, "application/json", body)
+	ingestor.sources[0].baseURL = upstream.URL
+
+	for i := 0; i < 2; i++ {
+		_, err := ingestor.ingest(context.Background())
+		require.Error(t, err)
+	}
+	readings := listQuarantine(t, router, "")
+	require.Len(t, readings, 1, "a response failing every poll is held once")
+	held := readings[0]
+	assert.Equal(t, "undecodable", held.Code)
+	assert.Equal(t, formatJSON, held.Format)
+	assert.Equal(t, body, held.Raw)
+	assert.Equal(t, triggerPoll, held.Trigger)
+
+	w := quarantineCall(router, http.MethodPost, "/quarantine/"+held.ID+"/reprocess")
+	assert.Equal(t, http.StatusUnprocessableEntity, w.Code, w.Body.String())
+
+	// The location is configured with the format it actually sends
+	ingestor.sources[0].format = formatCSV
+	w = quarantineCall(router, http.MethodPost, "/quarantine/"+held.ID+"/reprocess")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.Len(t, channel.messages(), 1, "the valid reading is published")
+	left := listQuarantine(t, router, "")
+	require.Len(t, left, 1, "the invalid reading is quarantined on its own")
+	assert.Equal(t, "out_of_range", left[0].Code)
+	assert.Empty(t, left[0].Format)
+}
+
+func TestQuarantine_ClaimedReadingsAreNotReprocessedTwice(t *testing.T) {
+	ingestor, channel, metadata := newQuarantineIngestor(t, QuarantineConfig{})
+	router := setupRoutes(ingestor)
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(metadata, []byte(strings.Replace(quarantineMetadataYAML, "max: 35", "max: 100", 1)), 0o644))
+	_, err = ingestor.enricher.Reload()
+	require.NoError(t, err)
+	held := listQuarantine(t, router, "")[0]
+	published := len(channel.messages())
+
+	// Another run is reprocessing it
+	require.Len(t, ingestor.quarantine.claim([]QuarantinedReading{held}), 1)
+	w := quarantineCall(router, http.MethodPost, "/quarantine/"+held.ID+"/reprocess")
+	assert.Equal(t, http.StatusConflict, w.Code, w.Body.String())
+	w = quarantineCall(router, http.MethodPost, "/quarantine/reprocess")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), `"total":0`)
+	assert.Len(t, channel.messages(), published)
+
+	ingestor.quarantine.unclaim([]string{held.ID})
+	w = quarantineCall(router, http.MethodPost, "/quarantine/"+held.ID+"/reprocess")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, channel.messages(), published+1)
+	assert.Empty(t, ingestor.quarantine.claim([]QuarantinedReading{held}), "a published reading cannot be claimed")
+}
+
+func TestQuarantine_Disabled(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+	assert.Equal(t, http.StatusConflict, quarantineCall(router, http.MethodGet, "/quarantine").Code)
+	assert.Equal(t, http.StatusConflict, quarantineCall(router, http.MethodPost, "/quarantine/reprocess").Code)
+	assert.Equal(t, http.StatusUnauthorized, httpCode(router, http.MethodGet, "/quarantine"))
+}
+
+func httpCode(router http.Handler, method, path string) int {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(method, path, nil))
+	return w.Code
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultReadingDedupTTL        = 10 * time.Minute
+	defaultReadingDedupMaxEntries = 10000
+	defaultRedisDedupKeyPrefix    = "data-ingestor:dedup:"
+	defaultRedisDedupTimeout      = 500 * time.Millisecond
+
+	redisFailOpen   = "open"
+	redisFailClosed = "closed"
+
+	dedupLevelLocal = "local"
+	dedupLevelRedis = "redis"
+)
+
+// ErrDedupUnavailable fails a cycle when Redis cannot be reached and
+// reading_dedup.redis.on_error is closed
+var ErrDedupUnavailable = errors.New("shared dedup cache is unavailable")
+
+// ReadingDedupConfig drops readings that were already published, by the
+// hash of their content. With Redis, instances fetching the same upstream
+// publish every reading once between them.
+type ReadingDedupConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// TTL is how long a published reading is remembered, 10m by default
+	TTL Duration `yaml:"ttl"`
+	// MaxEntries bounds the in-memory cache checked before Redis
+	MaxEntries int              `yaml:"max_entries"`
+	Redis      RedisDedupConfig `yaml:"redis"`
+}
+
+// RedisDedupConfig shares the claims between instances. Only the local
+// cache is used when Addr is empty.
+type RedisDedupConfig struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+	// KeyPrefix namespaces the claim keys
+	KeyPrefix string   `yaml:"key_prefix"`
+	Timeout   Duration `yaml:"timeout"`
+	// OnError is open to publish while Redis is unavailable, risking
+	// duplicates, or closed to fail the cycle so it is retried
+	OnError string `yaml:"on_error"`
+}
+
+// Validate checks the limits and the failure policy
+func (c ReadingDedupConfig) Validate() error {
+	if !c.Enabled {
+		if c.Redis.Addr != "" {
+			return fmt.Errorf("reading_dedup.redis requires reading_dedup.enabled")
+		}
+		return nil
+	}
+	if c.TTL < 0 || c.MaxEntries < 0 || c.Redis.Timeout < 0 {
+		return fmt.Errorf("reading_dedup.ttl, max_entries and redis.timeout must not be negative")
+	}
+	switch c.Redis.OnError {
+	case "", redisFailOpen, redisFailClosed:
+	default:
+		return fmt.Errorf("reading_dedup.redis.on_error must be %q or %q, got %q", redisFailOpen, redisFailClosed, c.Redis.OnError)
+	}
+	return nil
+}
+
+// readingHash identifies a reading by the canonical encoding of its type,
+// location and payload. Enrichment and envelope headers are not part of it.
+func readingHash(s SensorData) (string, error) {
+	body, err := json.Marshal(SensorData{Type: s.Type, Name: s.Name, Payload: s.Payload})
+	if err != nil {
+		return "", err
+	}
+	canonical, err := canonicalize(body)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// readingDedup claims readings before they are published: first in memory,
+// then in Redis with SET NX EX, so only the first instance to claim a reading
+// publishes it
+type readingDedup struct {
+	ttl        time.Duration
+	maxEntries int
+	redis      *redis.Client
+	keyPrefix  string
+	timeout    time.Duration
+	failClosed bool
+	owner      string
+	// key identifies a reading, readingHash unless reading_ids replaces the
+	// upstream IDs
+	key     func(SensorData) (string, error)
+	metrics *Metrics
+	logger  *logrus.Logger
+
+	mu sync.Mutex
+	// seen holds the hashes published by this instance until their expiry.
+	// All entries share the TTL, so order is their insertion order.
+	seen  map[string]time.Time
+	order []string
+}
+
+// dedupClaim is the set of readings one cycle claimed
+type dedupClaim struct {
+	hashes []string
+	// shared is set for the hashes whose Redis key this claim set, which
+	// are deleted when publishing fails
+	shared []bool
+}
+
+// add appends a claimed hash
+func (c *dedupClaim) add(hash string, shared bool) {
+	c.hashes = append(c.hashes, hash)
+	c.shared = append(c.shared, shared)
+}
+
+// split divides the claim into the readings keep is true for and the rest
+func (c *dedupClaim) split(keep func(hash string) bool) (kept, rest *dedupClaim) {
+	if c == nil {
+		return nil, nil
+	}
+	kept, rest = &dedupClaim{}, &dedupClaim{}
+	for i, hash := range c.hashes {
+		if keep(hash) {
+			kept.add(hash, c.shared[i])
+		} else {
+			rest.add(hash, c.shared[i])
+		}
+	}
+	return kept, rest
+}
+
+// newReadingDedup returns nil when reading dedup is disabled
+func newReadingDedup(config ReadingDedupConfig, owner string, metrics *Metrics, logger *logrus.Logger) *readingDedup {
+	if !config.Enabled {
+		return nil
+	}
+	d := &readingDedup{
+		ttl:        time.Duration(config.TTL),
+		maxEntries: config.MaxEntries,
+		keyPrefix:  config.Redis.KeyPrefix,
+		timeout:    time.Duration(config.Redis.Timeout),
+		failClosed: config.Redis.OnError == redisFailClosed,
+		owner:      owner,
+		key:        readingHash,
+		metrics:    metrics,
+		logger:     logger,
+		seen:       make(map[string]time.Time),
+	}
+	if d.ttl <= 0 {
+		d.ttl = defaultReadingDedupTTL
+	}
+	if d.maxEntries <= 0 {
+		d.maxEntries = defaultReadingDedupMaxEntries
+	}
+	if d.keyPrefix == "" {
+		d.keyPrefix = defaultRedisDedupKeyPrefix
+	}
+	if d.timeout <= 0 {
+		d.timeout = defaultRedisDedupTimeout
+	}
+	if config.Redis.Addr != "" {
+		d.redis = redis.NewClient(&redis.Options{
+			Addr:     config.Redis.Addr,
+			Password: config.Redis.Password,
+			DB:       config.Redis.DB,
+		})
+	}
+	return d
+}
+
+// claim returns the readings not published before, by this instance or,
+// with Redis, by any other. The readings of held, the claim of a failed
+// delivery being retried, are still claimed by this instance.
+func (d *readingDedup) claim(ctx context.Context, data WeatherData, held *dedupClaim) (WeatherData, *dedupClaim, error) {
+	heldShared := make(map[string]bool)
+	if held != nil {
+		for i, hash := range held.hashes {
+			heldShared[hash] = held.shared[i]
+		}
+	}
+	claim := &dedupClaim{}
+	unique := make(WeatherData, 0, len(data))
+	// fresh are the indexes in unique that are not held
+	var fresh []int
+	batch := make(map[string]bool, len(data))
+	d.mu.Lock()
+	now := time.Now()
+	d.expire(now)
+	for _, sensor := range data {
+		hash, err := d.key(sensor)
+		if err != nil {
+			d.mu.Unlock()
+			return nil, nil, fmt.Errorf("failed to hash reading: %w", err)
+		}
+		if batch[hash] {
+			d.metrics.DedupSuppressed.WithLabelValues(dedupLevelLocal).Inc()
+			continue
+		}
+		if shared, ok := heldShared[hash]; ok {
+			batch[hash] = true
+			unique = append(unique, sensor)
+			claim.add(hash, shared)
+			continue
+		}
+		if _, ok := d.seen[hash]; ok {
+			d.metrics.DedupSuppressed.WithLabelValues(dedupLevelLocal).Inc()
+			continue
+		}
+		batch[hash] = true
+		fresh = append(fresh, len(unique))
+		unique = append(unique, sensor)
+		claim.add(hash, false)
+	}
+	d.mu.Unlock()
+
+	if d.redis == nil || len(fresh) == 0 {
+		return unique, claim, nil
+	}
+	hashes := make([]string, len(fresh))
+	for i, index := range fresh {
+		hashes[i] = claim.hashes[index]
+	}
+	claimed, err := d.claimShared(ctx, hashes)
+	if err != nil {
+		if d.failClosed {
+			return nil, nil, fmt.Errorf("%w: %v", ErrDedupUnavailable, err)
+		}
+		d.logger.WithError(err).Warn("Shared dedup cache unavailable, publishing without it")
+		return unique, claim, nil
+	}
+
+	rejected := make(map[int]bool)
+	for i, index := range fresh {
+		if claimed[i] {
+			claim.shared[index] = true
+		} else {
+			rejected[index] = true
+		}
+	}
+	shared := make(WeatherData, 0, len(unique))
+	all := claim
+	claim = &dedupClaim{}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for i, sensor := range unique {
+		if rejected[i] {
+			d.metrics.DedupSuppressed.WithLabelValues(dedupLevelRedis).Inc()
+			// Another instance published it; don't ask Redis again
+			d.remember(all.hashes[i], now)
+			continue
+		}
+		shared = append(shared, sensor)
+		claim.add(all.hashes[i], all.shared[i])
+	}
+	return shared, claim, nil
+}
+
+// claimShared sets a key per hash unless it exists, in one round trip, and
+// reports which of them this instance set
+func (d *readingDedup) claimShared(ctx context.Context, hashes []string) ([]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	defer cancel()
+	start := time.Now()
+	pipe := d.redis.Pipeline()
+	cmds := make([]*redis.BoolCmd, len(hashes))
+	for i, hash := range hashes {
+		cmds[i] = pipe.SetNX(ctx, d.keyPrefix+hash, d.owner, d.ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	d.metrics.DedupClaimLatency.Observe(time.Since(start).Seconds())
+	if err != nil {
+		d.metrics.DedupRedisErrors.Inc()
+		return nil, err
+	}
+	claimed := make([]bool, len(cmds))
+	for i, cmd := range cmds {
+		claimed[i] = cmd.Val()
+	}
+	return claimed, nil
+}
+
+// commit remembers the claimed readings once they are published
+func (d *readingDedup) commit(claim *dedupClaim) {
+	if d == nil || claim == nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	for _, hash := range claim.hashes {
+		d.remember(hash, now)
+	}
+}
+
+// release gives up the claims of a cycle that failed to publish, so the
+// readings can be published on the next attempt, here or elsewhere
+func (d *readingDedup) release(claim *dedupClaim) {
+	if d == nil || claim == nil {
+		return
+	}
+	var keys []string
+	for i, hash := range claim.hashes {
+		if claim.shared[i] {
+			keys = append(keys, d.keyPrefix+hash)
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	if err := d.redis.Del(ctx, keys...).Err(); err != nil {
+		d.metrics.DedupRedisErrors.Inc()
+		d.logger.WithError(err).Warn("Failed to release dedup claims; the readings are skipped until they expire")
+	}
+}
+
+// remember must be called with mu held
+func (d *readingDedup) remember(hash string, now time.Time) {
+	if _, ok := d.seen[hash]; ok {
+		return
+	}
+	d.seen[hash] = now.Add(d.ttl)
+	d.order = append(d.order, hash)
+	for len(d.order) > d.maxEntries {
+		d.evict()
+	}
+}
+
+// expire drops the entries past their TTL; mu must be held
+func (d *readingDedup) expire(now time.Time) {
+	for len(d.order) > 0 && !now.Before(d.seen[d.order[0]]) {
+		d.evict()
+	}
+}
+
+func (d *readingDedup) evict() {
+	delete(d.seen, d.order[0])
+	d.order[0] = ""
+	d.order = d.order[1:]
+}
+
+// Close closes the Redis client
+func (d *readingDedup) Close() {
+	if d == nil || d.redis == nil {
+		return
+	}
+	d.redis.Close()
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dedupUpstreamBody = `[
+	{"type":"weather","name":"moscow","payload":{"temperature":-3.5,"at":"2026-03-01T09:00:00Z"}},
+	{"type":"weather","name":"berlin","payload":{"temperature":4,"at":"2026-03-01T09:00:00Z"}},
+	{"type":"weather","name":"paris","payload":{"temperature":7.5,"at":"2026-03-01T09:00:00Z"}}
+]`
+
+// newDedupTestIngestor returns an ingestor polling upstream with reading
+// dedup, shared through redis when addr is set
+func newDedupTestIngestor(t *testing.T, upstream string, dedup ReadingDedupConfig) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	dedup.Enabled = true
+	ingestor := NewDataIngestor(&Config{
+		API:          APIConfig{BaseURL: upstream, Timeout: Duration(5 * time.Second)},
+		RabbitMQ:     RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:      LoggingConfig{Level: "panic"},
+		ReadingDedup: dedup,
+	})
+	t.Cleanup(ingestor.dedup.Close)
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+func dedupUpstream(t *testing.T, body string) string {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream.URL
+}
+
+// dedupPublished decodes the readings of every message on channel
+func dedupPublished(t *testing.T, channel *fakeChannel) []string {
+	t.Helper()
+	var names []string
+	for _, msg := range channel.messages() {
+		var data WeatherData
+		require.NoError(t, json.Unmarshal(msg.Msg.Body, &data))
+		for _, sensor := range data {
+			names = append(names, sensor.Name)
+		}
+	}
+	return names
+}
+
+func TestReadingDedup_ActiveActive(t *testing.T) {
+	redis := miniredis.RunT(t)
+	upstream := dedupUpstream(t, dedupUpstreamBody)
+	config := ReadingDedupConfig{Redis: RedisDedupConfig{Addr: redis.Addr()}}
+	first, firstChannel := newDedupTestIngestor(t, upstream, config)
+	second, secondChannel := newDedupTestIngestor(t, upstream, config)
+
+	// Both replicas poll the same upstream several times
+	var wg sync.WaitGroup
+	for _, ingestor := range []*DataIngestor{first, second} {
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func(ingestor *DataIngestor) {
+				defer wg.Done()
+				_, err := ingestor.ingest(context.Background())
+				assert.NoError(t, err)
+			}(ingestor)
+		}
+	}
+	wg.Wait()
+
+	published := append(dedupPublished(t, firstChannel), dedupPublished(t, secondChannel)...)
+	assert.ElementsMatch(t, []string{"moscow", "berlin", "paris"}, published, "exactly one publish per reading")
+
+	suppressed := 0.0
+	for _, ingestor := range []*DataIngestor{first, second} {
+		suppressed += testutil.ToFloat64(ingestor.metrics.DedupSuppressed.WithLabelValues(dedupLevelLocal))
+		suppressed += testutil.ToFloat64(ingestor.metrics.DedupSuppressed.WithLabelValues(dedupLevelRedis))
+	}
+	assert.Equal(t, 15.0, suppressed, "6 cycles of 3 readings, 3 published")
+	assert.Len(t, redis.Keys(), 3)
+	assert.Positive(t, testutil.CollectAndCount(first.metrics.DedupClaimLatency))
+}
+
+func TestReadingDedup_LocalCacheIsFirst(t *testing.T) {
+	redis := miniredis.RunT(t)
+	ingestor, channel := newDedupTestIngestor(t, dedupUpstream(t, dedupUpstreamBody),
+		ReadingDedupConfig{Redis: RedisDedupConfig{Addr: redis.Addr()}})
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	commands := redis.CommandCount()
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, *result.Data)
+	assert.Empty(t, result.MessageIDs)
+	assert.Len(t, channel.messages(), 1)
+	assert.Equal(t, commands, redis.CommandCount(), "Redis is not asked about readings published here")
+	assert.Equal(t, 3.0, testutil.ToFloat64(ingestor.metrics.DedupSuppressed.WithLabelValues(dedupLevelLocal)))
+}
+
+func TestReadingDedup_WithoutRedis(t *testing.T) {
+	body := `[{"type":"weather","name":"moscow","payload":{"temperature":1}},
+		{"type":"weather","name":"moscow","payload":{"temperature":1.0}},
+		{"type":"weather","name":"moscow","payload":{"temperature":2}}]`
+	ingestor, channel := newDedupTestIngestor(t, dedupUpstream(t, body), ReadingDedupConfig{})
+
+	for i := 0; i < 2; i++ {
+		_, err := ingestor.ingest(context.Background())
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"moscow", "moscow"}, dedupPublished(t, channel), "duplicates in one response are dropped too")
+}
+
+func TestReadingDedup_ReleasesClaimsWhenPublishFails(t *testing.T) {
+	redis := miniredis.RunT(t)
+	upstream := dedupUpstream(t, dedupUpstreamBody)
+	config := ReadingDedupConfig{Redis: RedisDedupConfig{Addr: redis.Addr()}}
+	failing, failingChannel := newDedupTestIngestor(t, upstream, config)
+	failingChannel.err = errors.New("channel closed")
+	other, otherChannel := newDedupTestIngestor(t, upstream, config)
+
+	_, err := failing.ingest(context.Background())
+	require.Error(t, err)
+	assert.Empty(t, redis.Keys())
+
+	// The readings are neither lost for the other instance nor for a retry
+	_, err = other.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, dedupPublished(t, otherChannel), 3)
+}
+
+func TestReadingDedup_RedisUnavailable(t *testing.T) {
+	upstream := dedupUpstream(t, dedupUpstreamBody)
+	redis := miniredis.RunT(t)
+	addr := redis.Addr()
+	redis.Close()
+
+	open, openChannel := newDedupTestIngestor(t, upstream, ReadingDedupConfig{Redis: RedisDedupConfig{Addr: addr}})
+	_, err := open.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, dedupPublished(t, openChannel), 3, "fail open publishes, risking duplicates")
+	assert.Equal(t, 1.0, testutil.ToFloat64(open.metrics.DedupRedisErrors))
+
+	closed, closedChannel := newDedupTestIngestor(t, upstream, ReadingDedupConfig{Redis: RedisDedupConfig{Addr: addr, OnError: redisFailClosed}})
+	_, err = closed.ingest(context.Background())
+	assert.ErrorIs(t, err, ErrDedupUnavailable)
+	assert.Empty(t, closedChannel.messages())
+}
+
+func TestReadingDedup_ClaimsExpire(t *testing.T) {
+	redis := miniredis.RunT(t)
+	dedup := newReadingDedup(ReadingDedupConfig{
+		Enabled: true,
+		TTL:     Duration(time.Minute),
+		Redis:   RedisDedupConfig{Addr: redis.Addr(), KeyPrefix: "test:"},
+	}, "ingestor-test", NewMetrics(prometheus.NewRegistry()), logrus.New())
+	defer dedup.Close()
+	data := WeatherData{weatherReading("moscow", map[string]interface{}{"temperature": 1.0})}
+
+	unique, claim, err := dedup.claim(context.Background(), data, nil)
+	require.NoError(t, err)
+	require.Len(t, unique, 1)
+	hash, err := readingHash(data[0])
+	require.NoError(t, err)
+	owner, err := redis.Get("test:" + hash)
+	require.NoError(t, err)
+	assert.Equal(t, "ingestor-test", owner)
+	assert.Equal(t, time.Minute, redis.TTL("test:"+hash))
+
+	// Not yet committed: another cycle on this instance asks Redis, which
+	// already holds the claim
+	unique, _, err = dedup.claim(context.Background(), data, nil)
+	require.NoError(t, err)
+	assert.Empty(t, unique)
+
+	dedup.commit(claim)
+	redis.FastForward(2 * time.Minute)
+	dedup.mu.Lock()
+	dedup.expire(time.Now().Add(2 * time.Minute))
+	dedup.mu.Unlock()
+	unique, _, err = dedup.claim(context.Background(), data, nil)
+	require.NoError(t, err)
+	assert.Len(t, unique, 1)
+}
+
+func TestReadingDedup_LocalCacheIsBounded(t *testing.T) {
+	dedup := newReadingDedup(ReadingDedupConfig{Enabled: true, MaxEntries: 2}, "ingestor-test", NewMetrics(prometheus.NewRegistry()), logrus.New())
+	now := time.Now()
+	for _, hash := range []string{"a", "b", "c"} {
+		dedup.remember(hash, now)
+	}
+	assert.Equal(t, []string{"b", "c"}, dedup.order)
+	assert.Len(t, dedup.seen, 2)
+}
+
+func TestReadingHash(t *testing.T) {
+	a, err := readingHash(SensorData{Type: "weather", Name: "moscow", Payload: map[string]interface{}{"t": 1, "h": 80}})
+	require.NoError(t, err)
+	b, err := readingHash(SensorData{Type: "weather", Name: "moscow", Payload: map[string]interface{}{"h": 80.0, "t": 1.0},
+		Metadata: &LocationMetadata{Country: "RU"}, Headers: map[string]string{"X-Station-Id": "st-1"}})
+	require.NoError(t, err)
+	assert.Equal(t, a, b, "enrichment and headers don't change the hash")
+
+	c, err := readingHash(SensorData{Type: "weather", Name: "berlin", Payload: map[string]interface{}{"t": 1, "h": 80}})
+	require.NoError(t, err)
+	assert.NotEqual(t, a, c)
+}
+
+func TestReadingDedupConfig_Validate(t *testing.T) {
+	assert.NoError(t, ReadingDedupConfig{}.Validate())
+	assert.NoError(t, ReadingDedupConfig{Enabled: true, Redis: RedisDedupConfig{Addr: "redis:6379", OnError: redisFailClosed}}.Validate())
+	assert.ErrorContains(t, ReadingDedupConfig{Redis: RedisDedupConfig{Addr: "redis:6379"}}.Validate(), "requires reading_dedup.enabled")
+	assert.ErrorContains(t, ReadingDedupConfig{Enabled: true, TTL: -1}.Validate(), "must not be negative")
+	assert.ErrorContains(t, ReadingDedupConfig{Enabled: true, Redis: RedisDedupConfig{OnError: "maybe"}}.Validate(), "on_error")
+
+	config := &Config{ReadingDedup: ReadingDedupConfig{Enabled: true}, Publishing: PublishingConfig{Passthrough: true}}
+	assert.ErrorContains(t, config.Validate(), "passthrough")
+}
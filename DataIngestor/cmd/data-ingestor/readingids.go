@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Strategies for the IDs of the readings
+const (
+	// idUpstream keeps the ID the upstream sent
+	idUpstream = "upstream"
+	// idUUIDv7 generates a time-ordered UUID for every reading
+	idUUIDv7 = "uuidv7"
+	// idComposite derives a UUID from the location and the timestamp, so a
+	// reading keeps its ID however often it is fetched
+	idComposite = "composite"
+)
+
+const defaultReadingIDField = "id"
+
+// compositeMessageIDSeed derives the MessageIds from the message with
+// composite IDs, so a message of the same readings repeats its MessageId
+const compositeMessageIDSeed = "reading_ids/composite"
+
+// readingIDNamespace is the UUIDv5 namespace of the composite IDs. Changing
+// it changes every composite ID.
+var readingIDNamespace = [16]byte{
+	0x3b, 0x1f, 0x6c, 0x52, 0x8e, 0x4a, 0x4d, 0x07,
+	0x9c, 0x21, 0x5f, 0xe0, 0x7a, 0x38, 0xd4, 0x96,
+}
+
+// ReadingIDConfig replaces the IDs the upstream sends, for upstreams whose
+// IDs repeat. The replaced ID is published in the envelope as source_id.
+type ReadingIDConfig struct {
+	// Strategy is upstream, the default, uuidv7 or composite
+	Strategy string `yaml:"strategy"`
+	// Field is the payload field holding the ID, id by default
+	Field string `yaml:"field"`
+	// TimestampField is the payload field composite IDs are derived from,
+	// api.incremental.timestamp_field by default
+	TimestampField string `yaml:"timestamp_field"`
+}
+
+func (c ReadingIDConfig) Validate() error {
+	switch c.Strategy {
+	case "", idUpstream, idUUIDv7, idComposite:
+		return nil
+	}
+	return fmt.Errorf("reading_ids.strategy must be upstream, uuidv7 or composite, got %q", c.Strategy)
+}
+
+func (c ReadingIDConfig) replaces() bool {
+	return c.Strategy == idUUIDv7 || c.Strategy == idComposite
+}
+
+// readingIDs assigns the IDs of the readings. Nil keeps the upstream's.
+type readingIDs struct {
+	strategy       string
+	field          string
+	timestampField string
+	// now is replaced in tests
+	now func() time.Time
+}
+
+// newReadingIDs returns nil unless reading_ids replaces the upstream IDs
+func newReadingIDs(config ReadingIDConfig, timestampField string) *readingIDs {
+	if !config.replaces() {
+		return nil
+	}
+	ids := &readingIDs{
+		strategy:       config.Strategy,
+		field:          config.Field,
+		timestampField: config.TimestampField,
+		now:            time.Now,
+	}
+	if ids.field == "" {
+		ids.field = defaultReadingIDField
+	}
+	if ids.timestampField == "" {
+		ids.timestampField = timestampField
+	}
+	if ids.timestampField == "" {
+		ids.timestampField = defaultPartitionTimestampField
+	}
+	return ids
+}
+
+// assign replaces the ID of every reading and keeps the upstream's as its
+// SourceID. Composite IDs of readings without a timestamp are generated as
+// UUIDv7 instead.
+func (r *readingIDs) assign(data WeatherData) {
+	if r == nil {
+		return
+	}
+	now := r.now()
+	for i := range data {
+		reading := &data[i]
+		id := ""
+		if r.strategy == idComposite {
+			if at, ok := readingTimestamp(*reading, r.timestampField); ok {
+				id = compositeID(reading.Location(), at)
+			}
+		}
+		if id == "" {
+			id = newUUIDv7(now)
+		}
+		// The payload may be shared with the fetched response
+		payload := make(map[string]interface{}, len(reading.Payload)+1)
+		for key, value := range reading.Payload {
+			payload[key] = value
+		}
+		reading.SourceID = sourceID(payload[r.field])
+		payload[r.field] = id
+		reading.Payload, reading.ID = payload, id
+	}
+}
+
+// dedupKey identifies a reading for reading_dedup. Composite IDs identify
+// it as they are; otherwise it is the hash of the reading without its ID,
+// which is generated or, from the upstream, not to be trusted.
+func (r *readingIDs) dedupKey(s SensorData) (string, error) {
+	if r.strategy == idComposite {
+		if _, ok := readingTimestamp(s, r.timestampField); ok {
+			return "id:" + s.ID, nil
+		}
+	}
+	payload := make(map[string]interface{}, len(s.Payload))
+	for key, value := range s.Payload {
+		if key != r.field {
+			payload[key] = value
+		}
+	}
+	s.Payload = payload
+	return readingHash(s)
+}
+
+// messageIDSeed returns the seed of the MessageIds of messages published
+// without one
+func (r *readingIDs) messageIDSeed() string {
+	if r != nil && r.strategy == idComposite {
+		return compositeMessageIDSeed
+	}
+	return ""
+}
+
+// sourceID formats an upstream ID for the source_id header, empty when
+// there was none
+func sourceID(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	}
+	body, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(body)
+}
+
+// sourceIDsOf returns the upstream IDs of the readings of one message, nil
+// when their IDs were not replaced
+func sourceIDsOf(data WeatherData) []string {
+	var ids []string
+	for _, reading := range data {
+		if reading.ID == "" {
+			return nil
+		}
+		ids = append(ids, reading.SourceID)
+	}
+	return ids
+}
+
+// readingEnvelope adds what the envelope of a message tells about its
+// readings
+func (di *DataIngestor) readingEnvelope(env Envelope, data WeatherData) Envelope {
+	env.Quality = qualityOf(data)
+	env.SourceIDs = sourceIDsOf(data)
+	if env.MessageIDSeed == "" {
+		env.MessageIDSeed = di.ids.messageIDSeed()
+	}
+	if di.schema != nil {
+		env.SchemaURL = di.schema.url
+		env.SchemaHash, _ = di.schema.current()
+	}
+	return env
+}
+
+// newUUIDv7 returns a UUIDv7: the Unix milliseconds of now followed by
+// random bits, so IDs sort by the time they were generated at
+func newUUIDv7(now time.Time) string {
+	var b [16]byte
+	var ms [8]byte
+	binary.BigEndian.PutUint64(ms[:], uint64(now.UnixMilli()))
+	copy(b[:6], ms[2:])
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic(err)
+	}
+	b[6] = 0x70 | b[6]&0x0f
+	b[8] = 0x80 | b[8]&0x3f
+	return formatUUID(b)
+}
+
+// compositeID returns the UUIDv5 of a location and a time. The same instant
+// gives the same ID in every time zone and format.
+func compositeID(location string, at time.Time) string {
+	h := sha1.New()
+	h.Write(readingIDNamespace[:])
+	h.Write([]byte(location))
+	h.Write([]byte{0})
+	h.Write([]byte(at.UTC().Format(time.RFC3339Nano)))
+	var b [16]byte
+	copy(b[:], h.Sum(nil))
+	b[6] = 0x50 | b[6]&0x0f
+	b[8] = 0x80 | b[8]&0x3f
+	return formatUUID(b)
+}
+
+func formatUUID(b [16]byte) string {
+	s := hex.EncodeToString(b[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-([0-9a-f])[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// resettingUpstream serves the body it was last given, like an upstream
+// whose IDs start over after a deploy
+type resettingUpstream struct {
+	mu   sync.Mutex
+	body string
+}
+
+func (u *resettingUpstream) serve(body string) {
+	u.mu.Lock()
+	u.body = body
+	u.mu.Unlock()
+}
+
+func newIDTestIngestor(t *testing.T, ids ReadingIDConfig, dedup bool) (*DataIngestor, *fakeChannel, *resettingUpstream) {
+	t.Helper()
+	upstream := &resettingUpstream{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream.mu.Lock()
+		defer upstream.mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(upstream.body))
+	}))
+	t.Cleanup(server.Close)
+	ingestor := NewDataIngestor(&Config{
+		API:          APIConfig{BaseURL: server.URL, Timeout: Duration(5 * time.Second)},
+		RabbitMQ:     RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:      LoggingConfig{Level: "panic"},
+		ReadingDedup: ReadingDedupConfig{Enabled: dedup},
+		ReadingIDs:   ids,
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel, upstream
+}
+
+// publishedIDs returns the payload IDs of every published reading and the
+// source_id header of every message
+func publishedIDs(t *testing.T, channel *fakeChannel) (ids []interface{}, sources [][]interface{}) {
+	t.Helper()
+	for _, msg := range channel.messages() {
+		var data WeatherData
+		require.NoError(t, json.Unmarshal(msg.Msg.Body, &data))
+		for _, sensor := range data {
+			ids = append(ids, sensor.Payload["id"])
+		}
+		header, _ := msg.Msg.Headers["source_id"].([]interface{})
+		sources = append(sources, header)
+	}
+	return ids, sources
+}
+
+func idReading(location string, id interface{}, at string) SensorData {
+	payload := map[string]interface{}{"temperature": 4.5}
+	if id != nil {
+		payload["id"] = id
+	}
+	if at != "" {
+		payload["timestamp"] = at
+	}
+	return SensorData{Type: "weather", Name: location, Payload: payload}
+}
+
+func TestReadingIDConfig_Validate(t *testing.T) {
+	for _, strategy := range []string{"", idUpstream, idUUIDv7, idComposite} {
+		assert.NoError(t, ReadingIDConfig{Strategy: strategy}.Validate(), strategy)
+	}
+	assert.ErrorContains(t, ReadingIDConfig{Strategy: "serial"}.Validate(), "reading_ids.strategy")
+
+	config := Config{
+		API:        APIConfig{BaseURL: "http://localhost"},
+		RabbitMQ:   RabbitMQConfig{URL: "amqp://localhost", QueueName: "meter-data-queue"},
+		Publishing: PublishingConfig{Passthrough: true},
+		ReadingIDs: ReadingIDConfig{Strategy: idComposite},
+	}
+	assert.ErrorContains(t, config.Validate(), "reading_ids")
+}
+
+func TestReadingIDs_UpstreamKeepsTheIDs(t *testing.T) {
+	assert.Nil(t, newReadingIDs(ReadingIDConfig{}, ""))
+	assert.Nil(t, newReadingIDs(ReadingIDConfig{Strategy: idUpstream}, ""))
+
+	var ids *readingIDs
+	data := WeatherData{idReading("berlin", 1.0, "")}
+	ids.assign(data)
+	assert.Equal(t, 1.0, data[0].Payload["id"])
+	assert.Empty(t, data[0].ID)
+	assert.Nil(t, sourceIDsOf(data))
+	assert.Empty(t, ids.messageIDSeed())
+}
+
+func TestReadingIDs_UUIDv7(t *testing.T) {
+	ids := newReadingIDs(ReadingIDConfig{Strategy: idUUIDv7}, "")
+	now := time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)
+	ids.now = func() time.Time { return now }
+
+	data := make(WeatherData, 10000)
+	for i := range data {
+		// Every reading has the same upstream ID, as after a reset
+		data[i] = idReading("berlin", 1.0, "")
+	}
+	original := data[0].Payload
+	ids.assign(data)
+
+	seen := make(map[string]bool, len(data))
+	for _, sensor := range data {
+		match := uuidPattern.FindStringSubmatch(sensor.ID)
+		require.NotNil(t, match, sensor.ID)
+		assert.Equal(t, "7", match[1])
+		assert.Equal(t, sensor.ID, sensor.Payload["id"])
+		assert.Equal(t, "1", sensor.SourceID)
+		seen[sensor.ID] = true
+	}
+	assert.Len(t, seen, len(data), "every reading gets its own ID")
+	assert.Equal(t, 1.0, original["id"], "the fetched payload is not changed")
+
+	// IDs sort by the time they were generated at
+	later := WeatherData{idReading("berlin", 1.0, "")}
+	now = now.Add(time.Millisecond)
+	ids.assign(later)
+	sorted := []string{later[0].ID, data[0].ID}
+	sort.Strings(sorted)
+	assert.Equal(t, []string{data[0].ID, later[0].ID}, sorted)
+}
+
+func TestReadingIDs_Composite(t *testing.T) {
+	ids := newReadingIDs(ReadingIDConfig{Strategy: idComposite}, "")
+	data := WeatherData{
+		idReading("berlin", 1.0, "2026-03-01T09:00:00Z"),
+		// The same reading after the upstream's IDs were reset
+		idReading("berlin", 7.0, "2026-03-01T10:00:00+01:00"),
+		idReading("moscow", 1.0, "2026-03-01T09:00:00Z"),
+		idReading("berlin", 2.0, "2026-03-01T09:00:01Z"),
+		idReading("berlin", nil, ""),
+	}
+	ids.assign(data)
+
+	match := uuidPattern.FindStringSubmatch(data[0].ID)
+	require.NotNil(t, match, data[0].ID)
+	assert.Equal(t, "5", match[1])
+	assert.Equal(t, data[0].ID, data[1].ID, "the same instant in another zone, with another upstream ID")
+	assert.NotEqual(t, data[0].ID, data[2].ID, "another location")
+	assert.NotEqual(t, data[0].ID, data[3].ID, "another timestamp")
+	assert.Equal(t, []string{"1", "7", "1", "2", ""}, sourceIDsOf(data))
+
+	match = uuidPattern.FindStringSubmatch(data[4].ID)
+	require.NotNil(t, match, data[4].ID)
+	assert.Equal(t, "7", match[1], "readings without a timestamp get a UUIDv7")
+
+	// Stable across runs and instances
+	again := WeatherData{idReading("berlin", 3.0, "2026-03-01T09:00:00Z")}
+	newReadingIDs(ReadingIDConfig{Strategy: idComposite}, "").assign(again)
+	assert.Equal(t, data[0].ID, again[0].ID)
+	assert.Equal(t, compositeMessageIDSeed, ids.messageIDSeed())
+}
+
+func TestReadingIDs_CompositeSurvivesAnUpstreamReset(t *testing.T) {
+	ingestor, channel, upstream := newIDTestIngestor(t, ReadingIDConfig{Strategy: idComposite}, true)
+	upstream.serve(`[
+		{"type":"weather","name":"berlin","payload":{"id":1,"temperature":4,"timestamp":"2026-03-01T09:00:00Z"}},
+		{"type":"weather","name":"berlin","payload":{"id":2,"temperature":5,"timestamp":"2026-03-01T09:05:00Z"}}
+	]`)
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	// After their deploy the second reading comes again as 1, and a new one as 2
+	upstream.serve(`[
+		{"type":"weather","name":"berlin","payload":{"id":1,"temperature":5,"timestamp":"2026-03-01T09:05:00Z"}},
+		{"type":"weather","name":"berlin","payload":{"id":2,"temperature":6,"timestamp":"2026-03-01T09:10:00Z"}}
+	]`)
+	_, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	ids, sources := publishedIDs(t, channel)
+	require.Len(t, ids, 3, "the reading fetched again under another ID is dropped")
+	assert.Equal(t, []interface{}{
+		compositeID("berlin", time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)),
+		compositeID("berlin", time.Date(2026, 3, 1, 9, 5, 0, 0, time.UTC)),
+		compositeID("berlin", time.Date(2026, 3, 1, 9, 10, 0, 0, time.UTC)),
+	}, ids)
+	assert.Equal(t, [][]interface{}{{"1", "2"}, {"2"}}, sources)
+
+	// The history is keyed by the reading IDs and the event sequence
+	history, _, err := ingestor.stream.history(historyQuery{Limit: 10})
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.Equal(t, ids[2].(string)+"-3", history[2].ID)
+}
+
+func TestReadingIDs_CompositeMessageIDsRepeat(t *testing.T) {
+	ingestor, channel, upstream := newIDTestIngestor(t, ReadingIDConfig{Strategy: idComposite}, false)
+	upstream.serve(`[{"type":"weather","name":"berlin","payload":{"id":1,"temperature":4,"timestamp":"2026-03-01T09:00:00Z"}}]`)
+	for i := 0; i < 2; i++ {
+		_, err := ingestor.ingest(context.Background())
+		require.NoError(t, err)
+	}
+	upstream.serve(`[{"type":"weather","name":"berlin","payload":{"id":1,"temperature":5,"timestamp":"2026-03-01T09:05:00Z"}}]`)
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 3)
+	assert.Equal(t, messages[0].Msg.MessageId, messages[1].Msg.MessageId, "the same readings, the same MessageId")
+	assert.NotEqual(t, messages[0].Msg.MessageId, messages[2].Msg.MessageId)
+}
+
+func TestReadingIDs_UUIDv7DedupIgnoresTheIDs(t *testing.T) {
+	ingestor, channel, upstream := newIDTestIngestor(t, ReadingIDConfig{Strategy: idUUIDv7}, true)
+	upstream.serve(`[{"type":"weather","name":"berlin","payload":{"id":1,"temperature":4,"timestamp":"2026-03-01T09:00:00Z"}}]`)
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	upstream.serve(`[{"type":"weather","name":"berlin","payload":{"id":9,"temperature":4,"timestamp":"2026-03-01T09:00:00Z"}}]`)
+	_, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	ids, sources := publishedIDs(t, channel)
+	require.Len(t, ids, 1, "neither the generated nor the upstream ID makes a reading new")
+	assert.Regexp(t, uuidPattern, ids[0])
+	assert.Equal(t, [][]interface{}{{"1"}}, sources)
+
+	assert.Empty(t, ingestor.readingEnvelope(Envelope{}, nil).MessageIDSeed, "MessageIds stay random")
+}
+
+func TestReadingIDs_PubSubAttribute(t *testing.T) {
+	data := WeatherData{idReading("berlin", 1.0, "2026-03-01T09:00:00Z")}
+	sink := &PubSubSink{}
+	assert.NotContains(t, sink.attributes(data[0], Envelope{}), "source_id")
+
+	newReadingIDs(ReadingIDConfig{Strategy: idComposite}, "").assign(data)
+	assert.Equal(t, "1", sink.attributes(data[0], Envelope{})["source_id"])
+}
+
+func TestReadingIDs_CompositeEventIDsAreUnique(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		API:        APIConfig{Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Admin:      AdminConfig{Token: "letmein"},
+		ReadingIDs: ReadingIDConfig{Strategy: idComposite},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+	router := setupRoutes(ingestor)
+
+	// Without dedup, two readings of one station at one instant share
+	// their composite ID
+	for _, temperature := range []int{4, 5} {
+		w := postReadings(router, fmt.Sprintf(`[{"type":"weather","name":"berlin","payload":{"temperature":%d,"timestamp":"2026-03-01T09:00:00Z"}}]`, temperature))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	}
+	ids, _ := publishedIDs(t, channel)
+	require.Len(t, ids, 2)
+	assert.Equal(t, ids[0], ids[1])
+
+	code, response := getHistory(t, ingestor, "")
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, response.Readings, 2)
+	first, second := response.Readings[0].ID, response.Readings[1].ID
+	assert.NotEqual(t, first, second)
+	assert.Contains(t, first, ids[0])
+
+	code, response = getHistory(t, ingestor, "?after="+first)
+	require.Equal(t, http.StatusOK, code)
+	require.Len(t, response.Readings, 1, "the cursor neither skips nor repeats the second reading")
+	assert.Equal(t, second, response.Readings[0].ID)
+	assert.JSONEq(t, `{"type":"weather","name":"berlin","payload":{"id":"`+ids[1].(string)+`","temperature":5,"timestamp":"2026-03-01T09:00:00Z"}}`,
+		string(response.Readings[0].Reading))
+
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	resp := openStream(t, server.URL+"/stream", first)
+	events := readSSE(t, bufio.NewReader(resp.Body), 1)
+	assert.Equal(t, second, events[0].ID, "Last-Event-ID resumes after the first reading")
+}
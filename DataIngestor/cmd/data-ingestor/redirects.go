@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Redirect policies
+const (
+	// redirectReject fails a fetch answered with a 3xx
+	redirectReject = "reject"
+	// redirectFollow follows up to max_hops redirects on the same host
+	redirectFollow = "follow"
+)
+
+const defaultRedirectHops = 5
+
+// Outcomes of a redirect, as counted in upstream_redirects_total
+const (
+	redirectFollowed  = "followed"
+	redirectRejected  = "rejected"
+	redirectCrossHost = "cross_host"
+	redirectDowngrade = "downgrade"
+	redirectMaxHops   = "max_hops"
+)
+
+// ErrUpstreamRedirect fails a fetch the upstream answered with a redirect
+// that was not followed, e.g. to a maintenance page
+var ErrUpstreamRedirect = errors.New("upstream redirected the request")
+
+// RedirectConfig is what fetches do when the upstream answers with a 3xx
+type RedirectConfig struct {
+	// Policy is reject, the default, or follow
+	Policy string `yaml:"policy"`
+	// MaxHops is how many redirects one request follows, 5 by default
+	MaxHops int `yaml:"max_hops"`
+}
+
+func (c RedirectConfig) Validate() error {
+	switch c.Policy {
+	case "", redirectReject, redirectFollow:
+	default:
+		return fmt.Errorf("api.redirects.policy must be %q or %q, got %q", redirectReject, redirectFollow, c.Policy)
+	}
+	if c.MaxHops < 0 {
+		return fmt.Errorf("api.redirects.max_hops must not be negative")
+	}
+	return nil
+}
+
+func (c RedirectConfig) maxHops() int {
+	if c.MaxHops > 0 {
+		return c.MaxHops
+	}
+	return defaultRedirectHops
+}
+
+// redirectChain records the redirects of one upstream request
+type redirectChain struct {
+	hops []string
+	// blocked is why the last redirect was not followed
+	blocked string
+}
+
+type redirectChainKey struct{}
+
+func withRedirectChain(ctx context.Context, chain *redirectChain) context.Context {
+	return context.WithValue(ctx, redirectChainKey{}, chain)
+}
+
+func redirectChainOf(ctx context.Context) *redirectChain {
+	chain, _ := ctx.Value(redirectChainKey{}).(*redirectChain)
+	return chain
+}
+
+func (c *redirectChain) follow(req *http.Request) {
+	if c != nil {
+		c.hops = append(c.hops, req.URL.Redacted())
+	}
+}
+
+func (c *redirectChain) block(reason string) {
+	if c != nil {
+		c.blocked = reason
+	}
+}
+
+// checkRedirect is the CheckRedirect of the upstream client. A redirect
+// that is not followed returns its 3xx response, which sendUpstream turns
+// into ErrUpstreamRedirect.
+func (di *DataIngestor) checkRedirect(req *http.Request, via []*http.Request) error {
+	chain := redirectChainOf(req.Context())
+	config := di.config.API
+	crossHost := !strings.EqualFold(req.URL.Host, via[0].URL.Host)
+	// The API key must not leave TLS, not even for the same host
+	downgrade := strings.EqualFold(via[0].URL.Scheme, "https") && !strings.EqualFold(req.URL.Scheme, "https")
+	switch {
+	case config.Redirects.Policy != redirectFollow:
+		chain.block(redirectRejected)
+	case len(via) > config.Redirects.maxHops():
+		chain.block(redirectMaxHops)
+	case downgrade:
+		chain.block(redirectDowngrade)
+	case crossHost && !config.AllowCrossHostRedirects:
+		chain.block(redirectCrossHost)
+	default:
+		if crossHost {
+			// Go drops Authorization on its own, but not the API key
+			req.Header.Del("X-Api-Key")
+		}
+		chain.follow(req)
+		return nil
+	}
+	return http.ErrUseLastResponse
+}
+
+func isRedirect(status int) bool {
+	return status >= 300 && status < 400 && status != http.StatusNotModified
+}
+
+// redirectError counts and describes a redirect resp that was not followed
+func (di *DataIngestor) redirectError(src *source, resp *http.Response, chain *redirectChain) error {
+	reason := chain.blocked
+	if reason == "" {
+		// Replayed from a fixture, or answered without a Location
+		reason = redirectRejected
+	}
+	di.metrics.UpstreamRedirects.WithLabelValues(src.name, reason).Inc()
+	return fmt.Errorf("%w: status %d to %q (%s)", ErrUpstreamRedirect, resp.StatusCode, resp.Header.Get("Location"), reason)
+}
+
+// followedRedirects logs the redirects resp came through and records where
+// it came from for the cycle result
+func (di *DataIngestor) followedRedirects(ctx context.Context, src *source, resp *http.Response, chain *redirectChain) {
+	if len(chain.hops) == 0 {
+		return
+	}
+	final := resp.Request.URL.Redacted()
+	di.metrics.UpstreamRedirects.WithLabelValues(src.name, redirectFollowed).Add(float64(len(chain.hops)))
+	locationStatsOf(ctx).redirected(final)
+	logFor(ctx, logFetch).WithFields(logrus.Fields{
+		"location":  src.name,
+		"chain":     chain.hops,
+		"final_url": final,
+	}).Debug("Upstream redirect followed")
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// redirectingUpstream answers /meters with a redirect to target and records
+// every path it was asked for
+type redirectingUpstream struct {
+	server *httptest.Server
+	mu     sync.Mutex
+	paths  []string
+	apiKey []string
+}
+
+func newRedirectingUpstream(t *testing.T, status int, target func(base string) string) *redirectingUpstream {
+	t.Helper()
+	u := &redirectingUpstream{}
+	u.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.mu.Lock()
+		u.paths = append(u.paths, r.URL.Path)
+		u.apiKey = append(u.apiKey, r.Header.Get("X-Api-Key"))
+		u.mu.Unlock()
+		switch r.URL.Path {
+		case "/meters", "/loop":
+			http.Redirect(w, r, target(u.server.URL), status)
+		case "/maintenance":
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html><body>Down for maintenance</body></html>"))
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`))
+		}
+	}))
+	t.Cleanup(u.server.Close)
+	return u
+}
+
+func (u *redirectingUpstream) requests() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string(nil), u.paths...)
+}
+
+func newRedirectIngestor(t *testing.T, baseURL string, api APIConfig) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	api.BaseURL, api.Timeout, api.RetryCount = baseURL, Duration(time.Second), 2
+	ingestor := NewDataIngestor(&Config{
+		API:      api,
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "debug"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+func TestRedirectConfig_Validate(t *testing.T) {
+	assert.NoError(t, RedirectConfig{}.Validate())
+	assert.NoError(t, RedirectConfig{Policy: redirectFollow, MaxHops: 2}.Validate())
+	assert.ErrorContains(t, RedirectConfig{Policy: "always"}.Validate(), "api.redirects.policy")
+	assert.ErrorContains(t, RedirectConfig{MaxHops: -1}.Validate(), "max_hops")
+	assert.Equal(t, defaultRedirectHops, RedirectConfig{}.maxHops())
+}
+
+func TestRedirects_MaintenancePageIsAnUpstreamRedirect(t *testing.T) {
+	upstream := newRedirectingUpstream(t, http.StatusFound, func(base string) string { return "/maintenance" })
+	ingestor, channel := newRedirectIngestor(t, upstream.server.URL, APIConfig{})
+
+	result := ingestor.RunCycle(context.Background())
+	require.Len(t, result.Locations, 1)
+	outcome := result.Locations[0]
+	assert.Equal(t, outcomeFailed, outcome.Outcome)
+	assert.ErrorIs(t, outcome.err, ErrUpstreamRedirect, "not a decode error of the HTML page")
+	assert.Contains(t, outcome.Error, `status 302 to "/maintenance" (rejected)`)
+	assert.Zero(t, outcome.Retries, "a redirect is not retried")
+	assert.Equal(t, []string{"/meters"}, upstream.requests(), "the maintenance page is never fetched")
+	assert.Empty(t, channel.messages())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamRedirects.WithLabelValues("default", redirectRejected)))
+}
+
+func TestRedirects_FollowsOnTheSameHost(t *testing.T) {
+	upstream := newRedirectingUpstream(t, http.StatusMovedPermanently, func(base string) string { return "/v2/meters" })
+	ingestor, channel := newRedirectIngestor(t, upstream.server.URL, APIConfig{Redirects: RedirectConfig{Policy: redirectFollow}})
+	hook := test.NewLocal(ingestor.logger)
+
+	result := ingestor.RunCycle(context.Background())
+	outcome := result.Locations[0]
+	require.Equal(t, outcomePublished, outcome.Outcome, outcome.Error)
+	assert.Equal(t, upstream.server.URL+"/v2/meters", outcome.FinalURL)
+	assert.Len(t, channel.messages(), 1)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamRedirects.WithLabelValues("default", redirectFollowed)))
+
+	var followed *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Upstream redirect followed" {
+			followed = entry
+		}
+	}
+	require.NotNil(t, followed)
+	assert.Equal(t, logrus.DebugLevel, followed.Level)
+	assert.Equal(t, []string{upstream.server.URL + "/v2/meters"}, followed.Data["chain"])
+}
+
+func TestRedirects_StopsAfterMaxHops(t *testing.T) {
+	upstream := newRedirectingUpstream(t, http.StatusFound, func(base string) string { return "/loop" })
+	ingestor, _ := newRedirectIngestor(t, upstream.server.URL, APIConfig{Redirects: RedirectConfig{Policy: redirectFollow, MaxHops: 2}})
+
+	outcome := ingestor.RunCycle(context.Background()).Locations[0]
+	assert.ErrorIs(t, outcome.err, ErrUpstreamRedirect)
+	assert.Contains(t, outcome.Error, "(max_hops)")
+	assert.Equal(t, []string{"/meters", "/loop", "/loop"}, upstream.requests())
+}
+
+func TestRedirects_CrossHost(t *testing.T) {
+	other := newRedirectingUpstream(t, http.StatusFound, nil)
+	upstream := newRedirectingUpstream(t, http.StatusFound, func(string) string { return other.server.URL + "/v2/meters" })
+
+	// Blocked unless allowed, also when following
+	ingestor, _ := newRedirectIngestor(t, upstream.server.URL, APIConfig{Redirects: RedirectConfig{Policy: redirectFollow}})
+	outcome := ingestor.RunCycle(context.Background()).Locations[0]
+	assert.ErrorIs(t, outcome.err, ErrUpstreamRedirect)
+	assert.Contains(t, outcome.Error, "(cross_host)")
+	assert.Empty(t, other.requests())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamRedirects.WithLabelValues("default", redirectCrossHost)))
+
+	ingestor, channel := newRedirectIngestor(t, upstream.server.URL, APIConfig{
+		Redirects:               RedirectConfig{Policy: redirectFollow},
+		AllowCrossHostRedirects: true,
+	})
+	outcome = ingestor.RunCycle(context.Background()).Locations[0]
+	require.Equal(t, outcomePublished, outcome.Outcome, outcome.Error)
+	assert.Equal(t, other.server.URL+"/v2/meters", outcome.FinalURL)
+	assert.Len(t, channel.messages(), 1)
+	assert.Equal(t, []string{"/v2/meters"}, other.requests())
+	assert.Equal(t, []string{""}, other.apiKey, "the API key stays with the configured host")
+}
+
+func TestRedirects_SchemeDowngrade(t *testing.T) {
+	var mu sync.Mutex
+	var paths []string
+	upstream := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		http.Redirect(w, r, "http://"+r.Host+"/v2/meters", http.StatusMovedPermanently)
+	}))
+	t.Cleanup(upstream.Close)
+
+	// Blocked on the same host, and even with cross-host redirects allowed
+	ingestor, channel := newRedirectIngestor(t, upstream.URL, APIConfig{
+		Redirects:               RedirectConfig{Policy: redirectFollow},
+		AllowCrossHostRedirects: true,
+	})
+	ingestor.httpClient.Transport = upstream.Client().Transport
+	outcome := ingestor.RunCycle(context.Background()).Locations[0]
+	assert.ErrorIs(t, outcome.err, ErrUpstreamRedirect)
+	assert.Contains(t, outcome.Error, "(downgrade)")
+	assert.Empty(t, channel.messages())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamRedirects.WithLabelValues("default", redirectDowngrade)))
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/meters"}, paths, "the API key was not sent over plain HTTP")
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeReplayFixture archives three cycles five minutes apart
+func writeReplayFixture(t *testing.T) (string, time.Time) {
+	t.Helper()
+
+	dir := t.TempDir()
+	sink := NewFileSink(FileSinkConfig{Dir: dir, Rotate: rotateDaily})
+	start := time.Date(2024, 5, 3, 14, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, sink.Write(start.Add(time.Duration(i)*5*time.Minute), WeatherData{
+			{Type: "air_quality", Name: "moscow-1", Payload: map[string]interface{}{"co2": float64(400 + i)}},
+			{Type: "air_quality", Name: "berlin-1", Payload: map[string]interface{}{"co2": float64(500 + i)}},
+		}))
+	}
+	require.NoError(t, sink.Close())
+
+	// A malformed line is skipped. Written behind the sink's back, it voids
+	// the checksum, so the file is replayed unchecked like one written
+	// before checksums.
+	path := filepath.Join(dir, "weather-2024-05-03.ndjson")
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o644)
+	require.NoError(t, err)
+	file.WriteString("{not json\n")
+	file.Close()
+	require.NoError(t, os.Remove(path+checksumSuffix))
+
+	return path, start
+}
+
+func newReplayIngestor() (*DataIngestor, *fakeChannel) {
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	channel := &fakeChannel{}
+	withConfirms(ingestor, channel)
+	return ingestor, channel
+}
+
+func TestReplay_FullSpeed(t *testing.T) {
+	path, _ := writeReplayFixture(t)
+	ingestor, channel := newReplayIngestor()
+
+	count, err := ingestor.Replay(context.Background(), []string{path}, ReplayOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 6, count)
+
+	messages := channel.messages()
+	require.Len(t, messages, 3, "records received together are published together")
+	for _, msg := range messages {
+		assert.Equal(t, true, msg.Msg.Headers["replayed"])
+		var readings WeatherData
+		require.NoError(t, json.Unmarshal(msg.Msg.Body, &readings))
+		assert.Len(t, readings, 2)
+	}
+	assert.Equal(t, 6.0, testutil.ToFloat64(ingestor.metrics.ReplayedReadings))
+}
+
+func TestReplay_Filters(t *testing.T) {
+	path, start := writeReplayFixture(t)
+	ingestor, channel := newReplayIngestor()
+
+	count, err := ingestor.Replay(context.Background(), []string{path}, ReplayOptions{
+		From:     start.Add(5 * time.Minute),
+		To:       start.Add(10 * time.Minute),
+		Location: "moscow*",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	messages := channel.messages()
+	require.Len(t, messages, 2)
+	var readings WeatherData
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &readings))
+	require.Len(t, readings, 1)
+	assert.Equal(t, "moscow-1", readings[0].Name)
+	assert.Equal(t, 401.0, readings[0].Payload["co2"])
+}
+
+func TestReplay_RespectTimestamps(t *testing.T) {
+	path, _ := writeReplayFixture(t)
+	ingestor, _ := newReplayIngestor()
+
+	var waits []time.Duration
+	r := &replayer{
+		di:   ingestor,
+		opts: ReplayOptions{RespectTimestamps: true},
+		sleep: func(ctx context.Context, d time.Duration) error {
+			waits = append(waits, d)
+			return nil
+		},
+	}
+	count, err := r.run(context.Background(), []string{path})
+	require.NoError(t, err)
+	assert.Equal(t, 6, count)
+	assert.Equal(t, []time.Duration{5 * time.Minute, 5 * time.Minute}, waits)
+}
+
+func TestReplay_CancelledWhileWaiting(t *testing.T) {
+	path, _ := writeReplayFixture(t)
+	ingestor, channel := newReplayIngestor()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	count, err := ingestor.Replay(ctx, []string{path}, ReplayOptions{RespectTimestamps: true})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, 2, count)
+	assert.Len(t, channel.messages(), 1)
+}
+
+func TestRunReplay_Usage(t *testing.T) {
+	assert.ErrorContains(t, runReplay(context.Background(), nil), "usage")
+	assert.ErrorContains(t, runReplay(context.Background(), []string{"-from", "yesterday", "x.ndjson"}), "invalid -from")
+}
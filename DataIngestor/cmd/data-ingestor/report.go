@@ -0,0 +1,739 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/smtp"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// reportStateVersion is bumped when the state file format changes; older
+	// state is then discarded and the day starts over
+	reportStateVersion   = 1
+	reportMessageType    = "daily_report"
+	defaultReportAt      = "00:00"
+	defaultReportSubject = "data-ingestor daily report"
+	// reportRetryInterval is how often a report the broker or the mail
+	// server did not take is sent again
+	reportRetryInterval = time.Minute
+
+	reportSinkEmail = "email"
+)
+
+// ReportConfig publishes a daily digest of the persisted counters. A day
+// runs from one report time to the next in the report's time zone.
+type ReportConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// At is the local time of day the report is published, "00:00" by default
+	At string `yaml:"at"`
+	// Timezone is an IANA time zone name, UTC by default
+	Timezone   string `yaml:"timezone"`
+	Exchange   string `yaml:"exchange"`
+	RoutingKey string `yaml:"routing_key"`
+	// StateFile keeps the day's starting counters, uptime and gaps across
+	// restarts
+	StateFile string `yaml:"state_file"`
+	// GapThreshold is how long a location may publish nothing before it is
+	// reported as a gap, three poll intervals by default
+	GapThreshold Duration          `yaml:"gap_threshold"`
+	Email        ReportEmailConfig `yaml:"email"`
+}
+
+// ReportEmailConfig also mails the report as HTML when Host is set. The
+// password is optional and read from at most one of Password, PasswordEnv and
+// PasswordFile.
+type ReportEmailConfig struct {
+	Host         string   `yaml:"host"`
+	Port         int      `yaml:"port"`
+	Username     string   `yaml:"username"`
+	Password     string   `yaml:"password"`
+	PasswordEnv  string   `yaml:"password_env"`
+	PasswordFile string   `yaml:"password_file"`
+	From         string   `yaml:"from"`
+	To           []string `yaml:"to"`
+	Subject      string   `yaml:"subject"`
+}
+
+// Validate checks the schedule, the target and the mail settings. Reports
+// count from the persisted counters, so metrics snapshots are required.
+func (c ReportConfig) Validate(snapshots MetricsSnapshotConfig) error {
+	if !c.Enabled {
+		return nil
+	}
+	if _, _, _, err := c.schedule(); err != nil {
+		return err
+	}
+	if c.RoutingKey == "" {
+		return fmt.Errorf("report.routing_key is required")
+	}
+	if c.StateFile == "" || snapshots.StateFile == "" {
+		return fmt.Errorf("report.state_file and metrics_snapshot.state_file are required, so a restart continues the day's report")
+	}
+	if c.GapThreshold < 0 {
+		return fmt.Errorf("report.gap_threshold must not be negative")
+	}
+	email := c.Email
+	if email.Host == "" {
+		return nil
+	}
+	if email.Port <= 0 || email.Port > 65535 {
+		return fmt.Errorf("report.email.port must be from 1 to 65535, got %d", email.Port)
+	}
+	if email.From == "" || len(email.To) == 0 {
+		return fmt.Errorf("report.email.from and report.email.to are required")
+	}
+	sources := 0
+	for _, source := range []string{email.Password, email.PasswordEnv, email.PasswordFile} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return fmt.Errorf("report.email: set at most one of password, password_env and password_file")
+	}
+	if sources == 1 && email.Username == "" {
+		return fmt.Errorf("report.email.username is required with a password")
+	}
+	return nil
+}
+
+// schedule parses At and Timezone
+func (c ReportConfig) schedule() (hour, minute int, loc *time.Location, err error) {
+	at := c.At
+	if at == "" {
+		at = defaultReportAt
+	}
+	parsed, err := time.Parse("15:04", at)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("report.at must be a time of day like 06:30, got %q", c.At)
+	}
+	loc = time.UTC
+	if c.Timezone != "" {
+		if loc, err = time.LoadLocation(c.Timezone); err != nil {
+			return 0, 0, nil, fmt.Errorf("report.timezone: %w", err)
+		}
+	}
+	return parsed.Hour(), parsed.Minute(), loc, nil
+}
+
+// password resolves the SMTP password from its configured source
+func (c ReportEmailConfig) password() (string, error) {
+	switch {
+	case c.PasswordEnv != "":
+		password, ok := os.LookupEnv(c.PasswordEnv)
+		if !ok {
+			return "", fmt.Errorf("report.email: environment variable %s is not set", c.PasswordEnv)
+		}
+		return password, nil
+	case c.PasswordFile != "":
+		password, err := os.ReadFile(c.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("report.email: failed to read password file: %w", err)
+		}
+		return strings.TrimSpace(string(password)), nil
+	}
+	return c.Password, nil
+}
+
+// DailyReport is the published report. Counts are the increase of the
+// persisted counters between From and To.
+type DailyReport struct {
+	InstanceID string    `json:"instance_id"`
+	From       time.Time `json:"from"`
+	To         time.Time `json:"to"`
+	// Partial reports are requested over the admin API before the day ends
+	Partial  bool           `json:"partial"`
+	Readings ReportReadings `json:"readings"`
+	Errors   ReportErrors   `json:"errors"`
+	// UpstreamRequests is what the day cost the upstream; there is no
+	// request budget to compare it against
+	UpstreamRequests int64        `json:"upstream_requests"`
+	Uptime           ReportUptime `json:"uptime"`
+	Gaps             []ReadingGap `json:"gaps"`
+}
+
+// ReportReadings counts the published readings
+type ReportReadings struct {
+	Total      int64            `json:"total"`
+	ByLocation map[string]int64 `json:"by_location"`
+}
+
+// ReportErrors counts failures by kind, and failed fetches by location
+type ReportErrors struct {
+	Total      int64            `json:"total"`
+	ByKind     map[string]int64 `json:"by_kind"`
+	ByLocation map[string]int64 `json:"by_location"`
+}
+
+// ReportUptime is how long the service ran during the day
+type ReportUptime struct {
+	Seconds int64   `json:"seconds"`
+	Ratio   float64 `json:"ratio"`
+}
+
+// ReadingGap is a stretch in which a location published nothing for longer
+// than the gap threshold. Ongoing gaps had not ended when the report was made.
+type ReadingGap struct {
+	Location string    `json:"location"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Ongoing  bool      `json:"ongoing,omitempty"`
+}
+
+// reportErrorKinds are the counters summed into the error breakdown
+var reportErrorKinds = map[string]string{
+	"upstream_fetch_failures_total": "upstream",
+	"upstream_auth_failures_total":  "upstream_auth",
+	"upstream_malformed_rows_total": "malformed_rows",
+	"validation_failures_total":     "validation",
+	"transform_errors_total":        "transform",
+	"dead_letters_total":            "dead_letters",
+	"panics_total":                  "panics",
+}
+
+// reportState is the state file format
+type reportState struct {
+	Version     int                        `json:"version"`
+	SavedAt     time.Time                  `json:"saved_at"`
+	PeriodStart time.Time                  `json:"period_start"`
+	Baseline    map[string][]counterSample `json:"baseline"`
+	// UptimeSeconds is the uptime of the day's earlier processes
+	UptimeSeconds float64              `json:"uptime_seconds"`
+	LastReading   map[string]time.Time `json:"last_reading"`
+	Gaps          []ReadingGap         `json:"gaps"`
+	// Pending is a finished report not published yet
+	Pending *DailyReport `json:"pending,omitempty"`
+}
+
+// reporter aggregates the day and publishes the report at the report time
+type reporter struct {
+	config       ReportConfig
+	hour, minute int
+	loc          *time.Location
+	gapThreshold time.Duration
+	locations    []string
+	instanceID   string
+	metrics      *Metrics
+	logger       *logrus.Logger
+	// now, wait and sendMail are replaced in tests
+	now      func() time.Time
+	wait     func(ctx context.Context, d time.Duration) bool
+	sendMail func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+	publish  func(report *DailyReport) error
+
+	mu    sync.Mutex
+	state reportState
+	// runningSince is when this process started counting uptime
+	runningSince time.Time
+}
+
+// newReporter returns nil unless report.enabled is set. It continues the day
+// from the state file, and turns a day that ended while the service was down
+// into a pending report. Counters must have been restored before.
+func (di *DataIngestor) newReporter() *reporter {
+	config := di.config.Report
+	if !config.Enabled {
+		return nil
+	}
+	hour, minute, loc, err := config.schedule()
+	if err != nil {
+		di.logger.WithError(err).Error("Daily report disabled")
+		return nil
+	}
+	r := &reporter{
+		config:       config,
+		hour:         hour,
+		minute:       minute,
+		loc:          loc,
+		gapThreshold: time.Duration(config.GapThreshold),
+		instanceID:   di.instanceID,
+		metrics:      di.metrics,
+		logger:       di.logger,
+		now:          time.Now,
+		wait:         waitFor,
+		sendMail:     smtp.SendMail,
+		publish:      di.publishReport,
+	}
+	if r.gapThreshold <= 0 {
+		r.gapThreshold = 3 * di.config.API.pollInterval()
+	}
+	for _, src := range di.currentSources() {
+		r.locations = append(r.locations, src.name)
+	}
+	r.restore()
+	return r
+}
+
+// periodStart returns the last report time at or before now
+func (r *reporter) periodStart(now time.Time) time.Time {
+	local := now.In(r.loc)
+	start := time.Date(local.Year(), local.Month(), local.Day(), r.hour, r.minute, 0, 0, r.loc)
+	if start.After(local) {
+		start = time.Date(local.Year(), local.Month(), local.Day()-1, r.hour, r.minute, 0, 0, r.loc)
+	}
+	return start
+}
+
+// periodEnd returns the report time following start, which is not always 24
+// hours later when daylight saving time begins or ends
+func (r *reporter) periodEnd(start time.Time) time.Time {
+	local := start.In(r.loc)
+	return time.Date(local.Year(), local.Month(), local.Day()+1, r.hour, r.minute, 0, 0, r.loc)
+}
+
+// restore loads the state file, or starts the day afresh
+func (r *reporter) restore() {
+	now := r.now()
+	r.runningSince = now
+	state, err := loadReportState(r.config.StateFile)
+	if err != nil {
+		r.logger.WithError(err).Warn("Discarding daily report state, the report starts now")
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current := r.periodStart(now)
+	switch {
+	case state == nil:
+		r.startPeriod(current, now)
+		return
+	case state.PeriodStart.Equal(current):
+		upgradeSamples(state.Baseline)
+		r.state = *state
+		return
+	}
+	upgradeSamples(state.Baseline)
+	// The day of the state ended while the service was down
+	r.state = *state
+	if r.state.Pending == nil {
+		end := r.periodEnd(state.PeriodStart)
+		r.runningSince = end
+		r.state.Pending = r.build(end, false)
+	}
+	pending := r.state.Pending
+	r.startPeriod(current, now)
+	r.state.Pending = pending
+	r.logger.WithFields(logrus.Fields{"from": pending.From, "to": pending.To}).Info("Daily report of an earlier day is pending")
+}
+
+// startPeriod begins a new day at start; mu must be held
+func (r *reporter) startPeriod(start, now time.Time) {
+	baseline, err := r.metrics.gatherCounters()
+	if err != nil {
+		r.logger.WithError(err).Warn("Failed to gather the counters the daily report starts from")
+	}
+	last := r.state.LastReading
+	if last == nil {
+		last = make(map[string]time.Time)
+	}
+	r.state = reportState{
+		Version:     reportStateVersion,
+		PeriodStart: start,
+		Baseline:    baseline,
+		LastReading: last,
+	}
+	r.runningSince = now
+	if r.runningSince.Before(start) {
+		r.runningSince = start
+	}
+}
+
+// loadReportState reads the state file. A missing file is not an error.
+func loadReportState(path string) (*reportState, error) {
+	body, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read report state: %w", err)
+	}
+	var state reportState
+	if err := json.Unmarshal(body, &state); err != nil {
+		return nil, fmt.Errorf("failed to parse report state %s: %w", path, err)
+	}
+	if state.Version != reportStateVersion {
+		return nil, fmt.Errorf("report state %s has version %d, expected %d", path, state.Version, reportStateVersion)
+	}
+	return &state, nil
+}
+
+// save writes the state file, with the uptime up to now
+func (r *reporter) save() error {
+	if r == nil {
+		return nil
+	}
+	now := r.now()
+	r.mu.Lock()
+	state := r.state
+	state.SavedAt = now.UTC()
+	state.UptimeSeconds += now.Sub(r.runningSince).Seconds()
+	body, err := json.MarshalIndent(state, "", "  ")
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.config.StateFile, body); err != nil {
+		return fmt.Errorf("failed to write report state: %w", err)
+	}
+	return nil
+}
+
+// observe records that location published at at, closing a gap before it
+func (r *reporter) observe(location string, at time.Time) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	from := r.lastReading(location)
+	if at.Sub(from) > r.gapThreshold {
+		r.state.Gaps = append(r.state.Gaps, ReadingGap{Location: location, From: from, To: at})
+	}
+	r.state.LastReading[location] = at
+}
+
+// lastReading returns when location last published in the current day, or
+// when the day began; mu must be held
+func (r *reporter) lastReading(location string) time.Time {
+	if last := r.state.LastReading[location]; last.After(r.state.PeriodStart) {
+		return last
+	}
+	return r.state.PeriodStart
+}
+
+// build returns the report from the start of the day to end; mu must be held
+func (r *reporter) build(end time.Time, partial bool) *DailyReport {
+	report := &DailyReport{
+		InstanceID: r.instanceID,
+		From:       r.state.PeriodStart,
+		To:         end,
+		Partial:    partial,
+		Readings:   ReportReadings{ByLocation: map[string]int64{}},
+		Errors:     ReportErrors{ByKind: map[string]int64{}, ByLocation: map[string]int64{}},
+		Gaps:       append([]ReadingGap{}, r.state.Gaps...),
+	}
+	current, err := r.metrics.gatherCounters()
+	if err != nil {
+		r.logger.WithError(err).Warn("Failed to gather the counters of the daily report")
+	}
+	for name, samples := range current {
+		name = strings.TrimPrefix(name, metricsNamespace+"_")
+		for _, sample := range samples {
+			delta := counterIncrease(r.state.Baseline[metricsNamespace+"_"+name], sample)
+			if delta == 0 {
+				continue
+			}
+			switch name {
+			case "readings_published_total":
+				report.Readings.Total += delta
+				// Posted and replayed readings are of no location
+				if location := sample.Labels["location"]; location != "" {
+					report.Readings.ByLocation[location] += delta
+				}
+			case "upstream_fetches_total":
+				report.UpstreamRequests += delta
+			}
+			if kind, ok := reportErrorKinds[name]; ok {
+				report.Errors.Total += delta
+				report.Errors.ByKind[kind] += delta
+				if location, ok := sample.Labels["location"]; ok && name == "upstream_fetch_failures_total" {
+					report.Errors.ByLocation[location] += delta
+				}
+			}
+		}
+	}
+
+	uptime := r.state.UptimeSeconds
+	if end.After(r.runningSince) {
+		uptime += end.Sub(r.runningSince).Seconds()
+	}
+	report.Uptime.Seconds = int64(uptime)
+	if length := end.Sub(r.state.PeriodStart).Seconds(); length > 0 {
+		report.Uptime.Ratio = min(1, uptime/length)
+	}
+
+	for _, location := range r.locations {
+		if from := r.lastReading(location); end.Sub(from) > r.gapThreshold {
+			report.Gaps = append(report.Gaps, ReadingGap{Location: location, From: from, To: end, Ongoing: true})
+		}
+	}
+	sort.SliceStable(report.Gaps, func(i, j int) bool { return report.Gaps[i].From.Before(report.Gaps[j].From) })
+	return report
+}
+
+// counterIncrease returns how much sample grew since the baseline sample
+// with the same labels. A counter below its baseline was reset, and counts
+// from zero.
+func counterIncrease(baseline []counterSample, sample counterSample) int64 {
+	for _, base := range baseline {
+		if !sameLabels(base.Labels, sample.Labels) {
+			continue
+		}
+		if sample.Value >= base.Value {
+			return int64(sample.Value - base.Value)
+		}
+		break
+	}
+	return int64(sample.Value)
+}
+
+func sameLabels(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if b[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Partial returns the report of the day so far
+func (r *reporter) Partial() *DailyReport {
+	now := r.now()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.build(now, true)
+}
+
+// run publishes the report at every report time until ctx is cancelled,
+// retrying a pending report every minute
+func (r *reporter) run(ctx context.Context) {
+	for {
+		if r.flush() {
+			wait := r.periodEnd(r.currentStart()).Sub(r.now())
+			if wait < 0 {
+				wait = 0
+			}
+			if !r.wait(ctx, wait) {
+				return
+			}
+			r.closePeriod()
+			continue
+		}
+		if !r.wait(ctx, reportRetryInterval) {
+			return
+		}
+	}
+}
+
+func (r *reporter) currentStart() time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.state.PeriodStart
+}
+
+// closePeriod turns the day that just ended into the pending report and
+// starts the next
+func (r *reporter) closePeriod() {
+	now := r.now()
+	r.mu.Lock()
+	end := r.periodEnd(r.state.PeriodStart)
+	if now.Before(end) {
+		r.mu.Unlock()
+		return
+	}
+	pending := r.build(end, false)
+	r.state.UptimeSeconds = 0
+	r.startPeriod(r.periodStart(now), end)
+	r.state.Pending = pending
+	r.mu.Unlock()
+	if err := r.save(); err != nil {
+		r.logger.WithError(err).Warn("Failed to save daily report state")
+	}
+}
+
+// flush publishes the pending report, if any, and reports whether none is
+// left
+func (r *reporter) flush() bool {
+	r.mu.Lock()
+	pending := r.state.Pending
+	r.mu.Unlock()
+	if pending == nil {
+		return true
+	}
+	entry := r.logger.WithFields(logrus.Fields{"from": pending.From, "to": pending.To})
+	if err := r.deliver(pending); err != nil {
+		entry.WithError(err).Warn("Failed to publish daily report, retrying")
+		return false
+	}
+	r.mu.Lock()
+	if r.state.Pending == pending {
+		r.state.Pending = nil
+	}
+	r.mu.Unlock()
+	if err := r.save(); err != nil {
+		r.logger.WithError(err).Warn("Failed to save daily report state")
+	}
+	entry.WithField("readings", pending.Readings.Total).Info("Daily report published")
+	return true
+}
+
+// deliver publishes report and mails it. A report that was published but
+// could not be mailed is not published again.
+func (r *reporter) deliver(report *DailyReport) error {
+	if err := r.publish(report); err != nil {
+		r.metrics.Reports.WithLabelValues(sinkAMQP, "failed").Inc()
+		return err
+	}
+	r.metrics.Reports.WithLabelValues(sinkAMQP, "published").Inc()
+	if r.config.Email.Host == "" {
+		return nil
+	}
+	if err := r.mail(report); err != nil {
+		r.metrics.Reports.WithLabelValues(reportSinkEmail, "failed").Inc()
+		r.logger.WithError(err).Error("Failed to mail daily report")
+		return nil
+	}
+	r.metrics.Reports.WithLabelValues(reportSinkEmail, "published").Inc()
+	return nil
+}
+
+// mail sends report as HTML to the configured recipients
+func (r *reporter) mail(report *DailyReport) error {
+	config := r.config.Email
+	html, err := renderReport(report, r.loc)
+	if err != nil {
+		return err
+	}
+	subject := config.Subject
+	if subject == "" {
+		subject = defaultReportSubject
+	}
+	subject = fmt.Sprintf("%s %s", subject, report.From.In(r.loc).Format("2006-01-02"))
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", r.now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/html; charset=UTF-8\r\n\r\n")
+	msg.WriteString(html)
+
+	var auth smtp.Auth
+	if config.Username != "" {
+		password, err := config.password()
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", config.Username, password, config.Host)
+	}
+	addr := net.JoinHostPort(config.Host, strconv.Itoa(config.Port))
+	return r.sendMail(addr, auth, config.From, config.To, msg.Bytes())
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"percent": func(ratio float64) string { return strconv.FormatFloat(ratio*100, 'f', 2, 64) + "%" },
+}).Parse(`<!DOCTYPE html>
+<html><body>
+<h1>Daily report{{if .Report.Partial}} (partial){{end}}</h1>
+<p>{{.From}} to {{.To}}, instance {{.Report.InstanceID}}</p>
+<table>
+<tr><th>Readings published</th><td>{{.Report.Readings.Total}}</td></tr>
+<tr><th>Errors</th><td>{{.Report.Errors.Total}}</td></tr>
+<tr><th>Upstream requests</th><td>{{.Report.UpstreamRequests}}</td></tr>
+<tr><th>Uptime</th><td>{{percent .Report.Uptime.Ratio}}</td></tr>
+</table>
+<h2>Readings by location</h2>
+<table>
+{{range .Locations}}<tr><td>{{.Name}}</td><td>{{.Readings}}</td><td>{{.Errors}} failed fetches</td></tr>
+{{else}}<tr><td>No readings</td></tr>
+{{end}}</table>
+{{with .Report.Errors.ByKind}}<h2>Errors by kind</h2>
+<table>
+{{range $kind, $count := .}}<tr><td>{{$kind}}</td><td>{{$count}}</td></tr>
+{{end}}</table>
+{{end}}<h2>Gaps</h2>
+{{if .Gaps}}<table>
+{{range .Gaps}}<tr><td>{{.Location}}</td><td>{{.From}}</td><td>{{if .Ongoing}}ongoing{{else}}{{.To}}{{end}}</td></tr>
+{{end}}</table>
+{{else}}<p>None</p>
+{{end}}</body></html>
+`))
+
+// renderReport renders report as the HTML mail body, times in loc
+func renderReport(report *DailyReport, loc *time.Location) (string, error) {
+	const layout = "2006-01-02 15:04 MST"
+	type location struct {
+		Name             string
+		Readings, Errors int64
+	}
+	type gap struct {
+		Location string
+		From, To string
+		Ongoing  bool
+	}
+	data := struct {
+		Report    *DailyReport
+		From, To  string
+		Locations []location
+		Gaps      []gap
+	}{Report: report, From: report.From.In(loc).Format(layout), To: report.To.In(loc).Format(layout)}
+
+	names := map[string]bool{}
+	for name := range report.Readings.ByLocation {
+		names[name] = true
+	}
+	for name := range report.Errors.ByLocation {
+		names[name] = true
+	}
+	for name := range names {
+		data.Locations = append(data.Locations, location{Name: name, Readings: report.Readings.ByLocation[name], Errors: report.Errors.ByLocation[name]})
+	}
+	sort.Slice(data.Locations, func(i, j int) bool { return data.Locations[i].Name < data.Locations[j].Name })
+	for _, g := range report.Gaps {
+		data.Gaps = append(data.Gaps, gap{Location: g.Location, From: g.From.In(loc).Format(layout), To: g.To.In(loc).Format(layout), Ongoing: g.Ongoing})
+	}
+
+	var out bytes.Buffer
+	if err := reportTemplate.Execute(&out, data); err != nil {
+		return "", fmt.Errorf("failed to render report: %w", err)
+	}
+	return out.String(), nil
+}
+
+// publishReport publishes report to report.routing_key
+func (di *DataIngestor) publishReport(report *DailyReport) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return fmt.Errorf("failed to marshal report: %w", err)
+	}
+	_, err = di.publishBody(di.config.Report.Exchange, di.config.Report.RoutingKey, body, Envelope{Type: reportMessageType})
+	return err
+}
+
+// handleReport serves POST /admin/report, which publishes and mails the
+// report of the day so far, for testing the delivery. The day goes on.
+func (di *DataIngestor) handleReport(c *gin.Context) {
+	if di.report == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "the daily report is disabled",
+		})
+		return
+	}
+	report := di.report.Partial()
+	if err := di.report.deliver(report); err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	di.logger.Info("Partial daily report published by admin")
+	c.JSON(http.StatusOK, report)
+}
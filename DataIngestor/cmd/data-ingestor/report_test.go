@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/smtp"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var reportTestZone = mustLoadLocation("Europe/Berlin")
+
+func mustLoadLocation(name string) *time.Location {
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		panic(err)
+	}
+	return loc
+}
+
+// newReportTestIngestor reports on berlin and paris at 06:00 Berlin time,
+// with its state in dir and a clock the test moves
+func newReportTestIngestor(t *testing.T, dir string, now *time.Time, report ReportConfig) *DataIngestor {
+	t.Helper()
+	report.Enabled = true
+	report.At = "06:00"
+	report.Timezone = "Europe/Berlin"
+	report.RoutingKey = "reports.daily"
+	report.StateFile = filepath.Join(dir, "report.json")
+	config := &Config{
+		API: APIConfig{PollInterval: Duration(time.Minute), Locations: []LocationSource{
+			{Name: "berlin", BaseURL: "http://127.0.0.1:1"},
+			{Name: "paris", BaseURL: "http://127.0.0.1:1"},
+		}},
+		Logging:         LoggingConfig{Level: "panic"},
+		Admin:           AdminConfig{Token: "letmein"},
+		MetricsSnapshot: MetricsSnapshotConfig{StateFile: filepath.Join(dir, "metrics.json")},
+		Report:          report,
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+	require.NotNil(t, ingestor.report)
+	// Start over from the state file on the test's clock
+	ingestor.report.now = func() time.Time { return *now }
+	ingestor.report.restore()
+	return ingestor
+}
+
+func at(day, hour, minute int) time.Time {
+	return time.Date(2024, 5, day, hour, minute, 0, 0, reportTestZone)
+}
+
+func TestReport_Aggregates(t *testing.T) {
+	now := at(3, 10, 0)
+	// Counted before today's report started
+	ingestor := newReportTestIngestor(t, t.TempDir(), &now, ReportConfig{})
+	ingestor.metrics.ReadingsPublished.WithLabelValues("berlin", triggerPoll).Add(10)
+	ingestor.report.restore()
+
+	metrics := ingestor.metrics
+	metrics.ReadingsPublished.WithLabelValues("berlin", triggerPoll).Add(5)
+	metrics.ReadingsPublished.WithLabelValues("paris", triggerPoll).Add(3)
+	metrics.UpstreamFailures.WithLabelValues("paris").Add(2)
+	metrics.ValidationFailures.WithLabelValues("temperature", "range").Inc()
+	metrics.UpstreamFetches.WithLabelValues("berlin", triggerPoll).Add(7)
+	ingestor.report.observe("berlin", at(3, 10, 1))
+	ingestor.report.observe("paris", at(3, 10, 2))
+	ingestor.report.observe("berlin", at(3, 10, 2))
+	ingestor.report.observe("berlin", at(3, 10, 30))
+
+	now = at(3, 11, 0)
+	report := ingestor.report.Partial()
+	assert.True(t, report.Partial)
+	assert.WithinDuration(t, at(3, 6, 0), report.From, 0)
+	assert.WithinDuration(t, at(3, 11, 0), report.To, 0)
+	assert.Equal(t, ReportReadings{Total: 8, ByLocation: map[string]int64{"berlin": 5, "paris": 3}}, report.Readings)
+	assert.Equal(t, ReportErrors{
+		Total:      3,
+		ByKind:     map[string]int64{"upstream": 2, "validation": 1},
+		ByLocation: map[string]int64{"paris": 2},
+	}, report.Errors)
+	assert.Equal(t, int64(7), report.UpstreamRequests)
+	assert.Equal(t, ReportUptime{Seconds: 3600, Ratio: 0.2}, report.Uptime, "up one of the five hours")
+
+	// Nothing was published before the service started, berlin paused for
+	// 28 minutes and both have been silent since
+	gaps := []ReadingGap{
+		{Location: "berlin", From: at(3, 6, 0), To: at(3, 10, 1)},
+		{Location: "paris", From: at(3, 6, 0), To: at(3, 10, 2)},
+		{Location: "berlin", From: at(3, 10, 2), To: at(3, 10, 30)},
+		{Location: "paris", From: at(3, 10, 2), To: at(3, 11, 0), Ongoing: true},
+		{Location: "berlin", From: at(3, 10, 30), To: at(3, 11, 0), Ongoing: true},
+	}
+	require.Len(t, report.Gaps, len(gaps))
+	for i, gap := range gaps {
+		assert.Equal(t, gap.Location, report.Gaps[i].Location, i)
+		assert.WithinDuration(t, gap.From, report.Gaps[i].From, 0, i)
+		assert.WithinDuration(t, gap.To, report.Gaps[i].To, 0, i)
+		assert.Equal(t, gap.Ongoing, report.Gaps[i].Ongoing, i)
+	}
+
+	// A partial report leaves the day going on
+	ingestor.report.observe("paris", at(3, 11, 0))
+	gaps = ingestor.report.Partial().Gaps
+	require.Len(t, gaps, 5)
+	assert.False(t, gaps[3].Ongoing)
+}
+
+func TestReport_ResumesAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	now := at(3, 10, 0)
+	ingestor := newReportTestIngestor(t, dir, &now, ReportConfig{})
+	ingestor.metrics.ReadingsPublished.WithLabelValues("berlin", triggerPoll).Add(5)
+	ingestor.report.observe("berlin", at(3, 10, 30))
+	now = at(3, 11, 0)
+	ingestor.saveMetrics()
+
+	// Down for an hour
+	now = at(3, 12, 0)
+	restarted := newReportTestIngestor(t, dir, &now, ReportConfig{})
+	restarted.metrics.ReadingsPublished.WithLabelValues("berlin", triggerPoll).Add(2)
+	restarted.report.observe("berlin", at(3, 12, 1))
+
+	now = at(3, 13, 0)
+	report := restarted.report.Partial()
+	assert.Equal(t, int64(7), report.Readings.Total, "the day's readings before the restart count")
+	assert.Equal(t, int64(2*3600), report.Uptime.Seconds)
+	require.Len(t, report.Gaps, 4)
+	downtime := report.Gaps[2]
+	assert.WithinDuration(t, at(3, 10, 30), downtime.From, 0, "the downtime is a gap")
+	assert.WithinDuration(t, at(3, 12, 1), downtime.To, 0)
+
+	// The day ends and is published
+	channel := &fakeChannel{}
+	attachChannel(restarted, channel, nil)
+	now = at(4, 6, 0)
+	restarted.report.closePeriod()
+	require.True(t, restarted.report.flush())
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "reports.daily", messages[0].RoutingKey)
+	var published DailyReport
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &published))
+	assert.False(t, published.Partial)
+	assert.WithinDuration(t, at(4, 6, 0), published.To, 0)
+	assert.Equal(t, int64(7), published.Readings.Total)
+	assert.Equal(t, int64(19*3600), published.Uptime.Seconds, "from 10:00 to 11:00 and from 12:00 to 06:00")
+	assert.Equal(t, 1.0, testutil.ToFloat64(restarted.metrics.Reports.WithLabelValues(sinkAMQP, "published")))
+
+	// The next day starts from zero
+	now = at(4, 7, 0)
+	report = restarted.report.Partial()
+	assert.WithinDuration(t, at(4, 6, 0), report.From, 0)
+	assert.Zero(t, report.Readings.Total)
+	assert.Equal(t, int64(3600), report.Uptime.Seconds)
+}
+
+func TestReport_DayEndedWhileDown(t *testing.T) {
+	dir := t.TempDir()
+	now := at(3, 10, 0)
+	ingestor := newReportTestIngestor(t, dir, &now, ReportConfig{})
+	ingestor.metrics.ReadingsPublished.WithLabelValues("paris", triggerPoll).Add(4)
+	now = at(3, 20, 0)
+	ingestor.saveMetrics()
+
+	// Back the next morning, with the broker down at first
+	now = at(4, 8, 0)
+	restarted := newReportTestIngestor(t, dir, &now, ReportConfig{})
+	channel := &fakeChannel{err: errors.New("channel closed")}
+	attachChannel(restarted, channel, nil)
+	assert.False(t, restarted.report.flush())
+	assert.Equal(t, 1.0, testutil.ToFloat64(restarted.metrics.Reports.WithLabelValues(sinkAMQP, "failed")))
+
+	channel.mu.Lock()
+	channel.err = nil
+	channel.mu.Unlock()
+	require.True(t, restarted.report.flush())
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	var published DailyReport
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &published))
+	assert.WithinDuration(t, at(3, 6, 0), published.From, 0)
+	assert.WithinDuration(t, at(4, 6, 0), published.To, 0)
+	assert.Equal(t, int64(4), published.Readings.Total)
+	assert.Equal(t, int64(10*3600), published.Uptime.Seconds)
+
+	assert.WithinDuration(t, at(4, 6, 0), restarted.report.Partial().From, 0)
+	assert.True(t, restarted.report.flush(), "published once")
+	assert.Len(t, channel.messages(), 1)
+}
+
+func TestReport_Periods(t *testing.T) {
+	r := &reporter{hour: 6, loc: reportTestZone}
+	assert.WithinDuration(t, at(3, 6, 0), r.periodStart(at(3, 6, 0)), 0)
+	assert.WithinDuration(t, at(2, 6, 0), r.periodStart(at(3, 5, 59)), 0)
+	assert.WithinDuration(t, at(3, 6, 0), r.periodStart(at(3, 6, 0).UTC()), 0, "the clock's zone does not matter")
+
+	// Daylight saving time starts on March 31st and ends on October 27th
+	spring := time.Date(2024, 3, 30, 6, 0, 0, 0, reportTestZone)
+	assert.Equal(t, 23*time.Hour, r.periodEnd(spring).Sub(spring))
+	autumn := time.Date(2024, 10, 26, 6, 0, 0, 0, reportTestZone)
+	assert.Equal(t, 25*time.Hour, r.periodEnd(autumn).Sub(autumn))
+
+	hour, minute, loc, err := ReportConfig{}.schedule()
+	require.NoError(t, err)
+	assert.Equal(t, []int{0, 0}, []int{hour, minute})
+	assert.Equal(t, time.UTC, loc)
+}
+
+func TestReport_Email(t *testing.T) {
+	t.Setenv("REPORT_SMTP_PASSWORD", "hunter2")
+	now := at(3, 10, 0)
+	ingestor := newReportTestIngestor(t, t.TempDir(), &now, ReportConfig{Email: ReportEmailConfig{
+		Host:        "smtp.example.com",
+		Port:        587,
+		Username:    "reports",
+		PasswordEnv: "REPORT_SMTP_PASSWORD",
+		From:        "ingestor@example.com",
+		To:          []string{"ops@example.com", "data@example.com"},
+	}})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	ingestor.metrics.ReadingsPublished.WithLabelValues("berlin", triggerPoll).Add(5)
+	ingestor.metrics.UpstreamFailures.WithLabelValues("<paris>").Inc()
+
+	var addr string
+	var to []string
+	var msg []byte
+	var auth smtp.Auth
+	ingestor.report.sendMail = func(a string, au smtp.Auth, from string, t []string, m []byte) error {
+		addr, auth, to, msg = a, au, t, m
+		return nil
+	}
+	now = at(3, 11, 0)
+	require.NoError(t, ingestor.report.deliver(ingestor.report.Partial()))
+	assert.Equal(t, "smtp.example.com:587", addr)
+	assert.NotNil(t, auth)
+	assert.Equal(t, []string{"ops@example.com", "data@example.com"}, to)
+	body := string(msg)
+	assert.Contains(t, body, "Subject: data-ingestor daily report 2024-05-03\r\n")
+	assert.Contains(t, body, "Content-Type: text/html; charset=UTF-8\r\n")
+	assert.Contains(t, body, "<h1>Daily report (partial)</h1>")
+	assert.Contains(t, body, "<p>2024-05-03 06:00 CEST to 2024-05-03 11:00 CEST")
+	assert.Contains(t, body, "<tr><td>berlin</td><td>5</td><td>0 failed fetches</td></tr>")
+	assert.Contains(t, body, "<tr><td>&lt;paris&gt;</td><td>0</td><td>1 failed fetches</td></tr>")
+	assert.Contains(t, body, "<tr><td>upstream</td><td>1</td></tr>")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Reports.WithLabelValues(reportSinkEmail, "published")))
+
+	// A report the mail server refused was still published
+	ingestor.report.sendMail = func(string, smtp.Auth, string, []string, []byte) error {
+		return errors.New("554 rejected")
+	}
+	assert.NoError(t, ingestor.report.deliver(ingestor.report.Partial()))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Reports.WithLabelValues(reportSinkEmail, "failed")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.Reports.WithLabelValues(sinkAMQP, "published")))
+}
+
+func TestReport_AdminTrigger(t *testing.T) {
+	disabled := NewDataIngestor(&Config{Logging: LoggingConfig{Level: "panic"}, Admin: AdminConfig{Token: "letmein"}})
+	w := adminRequest(setupRoutes(disabled), http.MethodPost, "/admin/report")
+	assert.Equal(t, http.StatusConflict, w.Code)
+
+	now := at(3, 10, 0)
+	ingestor := newReportTestIngestor(t, t.TempDir(), &now, ReportConfig{})
+	router := setupRoutes(ingestor)
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	ingestor.metrics.ReadingsPublished.WithLabelValues("paris", triggerPoll).Add(3)
+
+	now = at(3, 10, 30)
+	w = adminRequest(router, http.MethodPost, "/admin/report")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var report DailyReport
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &report))
+	assert.True(t, report.Partial)
+	assert.Equal(t, int64(3), report.Readings.Total)
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "reports.daily", messages[0].RoutingKey)
+	assert.Equal(t, reportMessageType, messages[0].Msg.Type)
+
+	assert.Equal(t, int64(3), ingestor.report.Partial().Readings.Total, "the day goes on")
+
+	channel.mu.Lock()
+	channel.err = errors.New("channel closed")
+	channel.mu.Unlock()
+	w = adminRequest(router, http.MethodPost, "/admin/report")
+	assert.Equal(t, http.StatusBadGateway, w.Code)
+}
+
+func TestConfig_ValidateReport(t *testing.T) {
+	snapshots := MetricsSnapshotConfig{StateFile: "/var/lib/data-ingestor/metrics.json"}
+	valid := ReportConfig{Enabled: true, At: "06:30", Timezone: "Europe/Berlin", RoutingKey: "reports.daily", StateFile: "/var/lib/data-ingestor/report.json"}
+	assert.NoError(t, valid.Validate(snapshots))
+	assert.NoError(t, ReportConfig{}.Validate(MetricsSnapshotConfig{}))
+
+	email := valid
+	email.Email = ReportEmailConfig{Host: "smtp.example.com", Port: 25, From: "a@example.com", To: []string{"b@example.com"}}
+	assert.NoError(t, email.Validate(snapshots))
+
+	invalid := map[string]func(c *ReportConfig){
+		`report.at must be a time of day like 06:30, got "6pm"`: func(c *ReportConfig) { c.At = "6pm" },
+		"report.timezone: unknown time zone Mars/Olympus":       func(c *ReportConfig) { c.Timezone = "Mars/Olympus" },
+		"report.routing_key is required":                        func(c *ReportConfig) { c.RoutingKey = "" },
+		"report.state_file and metrics_snapshot.state_file":     func(c *ReportConfig) { c.StateFile = "" },
+		"report.email.port must be from 1 to 65535, got 0":      func(c *ReportConfig) { c.Email.Port = 0 },
+		"report.email.from and report.email.to are required":    func(c *ReportConfig) { c.Email.To = nil },
+		"set at most one of password, password_env and password_file": func(c *ReportConfig) {
+			c.Email.Username, c.Email.Password, c.Email.PasswordEnv = "a", "secret", "SMTP_PASSWORD"
+		},
+		"report.email.username is required with a password": func(c *ReportConfig) { c.Email.Password = "secret" },
+	}
+	for message, mutate := range invalid {
+		config := email
+		config.Email.To = append([]string{}, email.Email.To...)
+		mutate(&config)
+		assert.ErrorContains(t, config.Validate(snapshots), message)
+	}
+	assert.ErrorContains(t, valid.Validate(MetricsSnapshotConfig{}), "metrics_snapshot.state_file")
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSignatureHeader = "X-Signature"
+	defaultTimestampHeader = "X-Timestamp"
+
+	// secretRequestSigning is the secret label of api.signing.secret_file
+	secretRequestSigning = "request_signing"
+
+	// signingDecorator names the request decorator in the hook metrics
+	signingDecorator = "request_signing"
+)
+
+// Request parts a signature can cover, see stringToSign
+const (
+	signMethod    = "method"
+	signPath      = "path"
+	signQuery     = "query"
+	signTimestamp = "timestamp"
+	signBody      = "body"
+)
+
+var defaultSigningComponents = []string{signMethod, signPath, signTimestamp, signBody}
+
+// RequestSigningConfig signs every upstream request with HMAC-SHA256 over
+// the listed components and the time it was sent. The secret is read from
+// exactly one of SecretEnv and SecretFile.
+type RequestSigningConfig struct {
+	Enabled    bool   `yaml:"enabled"`
+	SecretEnv  string `yaml:"secret_env"`
+	SecretFile string `yaml:"secret_file"`
+	// SignatureHeader carries the hex signature, X-Signature by default
+	SignatureHeader string `yaml:"signature_header"`
+	// TimestampHeader carries the Unix time signed, X-Timestamp by default
+	TimestampHeader string `yaml:"timestamp_header"`
+	// Components are signed in this order, method, path, timestamp and
+	// body by default
+	Components []string `yaml:"components"`
+}
+
+func (c RequestSigningConfig) signatureHeader() string {
+	if c.SignatureHeader == "" {
+		return defaultSignatureHeader
+	}
+	return c.SignatureHeader
+}
+
+func (c RequestSigningConfig) timestampHeader() string {
+	if c.TimestampHeader == "" {
+		return defaultTimestampHeader
+	}
+	return c.TimestampHeader
+}
+
+func (c RequestSigningConfig) components() []string {
+	if len(c.Components) == 0 {
+		return defaultSigningComponents
+	}
+	return c.Components
+}
+
+// Validate checks the components and headers and that the secret can be
+// read, so a missing secret stops the service at startup instead of failing
+// every request
+func (c RequestSigningConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if (c.SecretEnv == "") == (c.SecretFile == "") {
+		return fmt.Errorf("api.signing: set exactly one of secret_env and secret_file")
+	}
+	if _, err := c.secret(); err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, component := range c.components() {
+		switch component {
+		case signMethod, signPath, signQuery, signTimestamp, signBody:
+		default:
+			return fmt.Errorf("api.signing.components: unknown component %q, expected %s, %s, %s, %s or %s",
+				component, signMethod, signPath, signQuery, signTimestamp, signBody)
+		}
+		if seen[component] {
+			return fmt.Errorf("api.signing.components: %s is listed twice", component)
+		}
+		seen[component] = true
+	}
+	for _, header := range []string{c.signatureHeader(), c.timestampHeader()} {
+		if !validHeaderName(header) {
+			return fmt.Errorf("api.signing: %q is not a valid header name", header)
+		}
+	}
+	if http.CanonicalHeaderKey(c.signatureHeader()) == http.CanonicalHeaderKey(c.timestampHeader()) {
+		return fmt.Errorf("api.signing: signature_header and timestamp_header must differ")
+	}
+	return nil
+}
+
+// secret reads the secret from its configured source
+func (c RequestSigningConfig) secret() ([]byte, error) {
+	if c.SecretEnv != "" {
+		secret := os.Getenv(c.SecretEnv)
+		if secret == "" {
+			return nil, fmt.Errorf("api.signing: environment variable %s is not set", c.SecretEnv)
+		}
+		return []byte(secret), nil
+	}
+	content, err := os.ReadFile(c.SecretFile)
+	if err != nil {
+		return nil, fmt.Errorf("api.signing: failed to read secret file: %w", err)
+	}
+	secret := bytes.TrimSpace(content)
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("api.signing: secret file %s is empty", c.SecretFile)
+	}
+	return secret, nil
+}
+
+// validHeaderName reports whether name is an HTTP token
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= 0x20 || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// stringToSign joins the components of a request sent at timestamp with
+// newlines: the method in upper case, the escaped path, the raw query, the
+// Unix timestamp and the hex SHA-256 of the body, empty bodies included
+func stringToSign(components []string, method, path, query, timestamp string, body []byte) string {
+	parts := make([]string, len(components))
+	for i, component := range components {
+		switch component {
+		case signMethod:
+			parts[i] = strings.ToUpper(method)
+		case signPath:
+			parts[i] = path
+		case signQuery:
+			parts[i] = query
+		case signTimestamp:
+			parts[i] = timestamp
+		case signBody:
+			sum := sha256.Sum256(body)
+			parts[i] = hex.EncodeToString(sum[:])
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// sign returns the hex HMAC-SHA256 of message
+func sign(secret []byte, message string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(message))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// requestSigner is the RequestDecorator of api.signing. Decorators run for
+// every attempt, so each retry is signed again with its own timestamp.
+type requestSigner struct {
+	config RequestSigningConfig
+	secret func() ([]byte, error)
+	logger func() *logrus.Entry
+	now    func() time.Time
+}
+
+// newRequestSigner returns nil without api.signing. A secret file is read
+// again every secrets.poll_interval.
+func (di *DataIngestor) newRequestSigner() *requestSigner {
+	config := di.config.API.Signing
+	if !config.Enabled {
+		return nil
+	}
+	s := &requestSigner{
+		config: config,
+		secret: config.secret,
+		logger: func() *logrus.Entry { return di.log(logFetch) },
+		now:    time.Now,
+	}
+	if config.SecretFile != "" {
+		s.secret = func() ([]byte, error) {
+			secret, err := di.secrets.value(config.SecretFile)
+			return []byte(secret), err
+		}
+	}
+	return s
+}
+
+// DecorateRequest sets the timestamp and signature headers. A request that
+// cannot be signed goes out unsigned, for the upstream to refuse.
+func (s *requestSigner) DecorateRequest(req *http.Request) {
+	body, err := requestBody(req)
+	if err != nil {
+		s.logger().WithError(err).Error("Failed to sign upstream request")
+		return
+	}
+	secret, err := s.secret()
+	if err != nil {
+		s.logger().WithError(err).Error("Failed to sign upstream request")
+		return
+	}
+	timestamp := strconv.FormatInt(s.now().Unix(), 10)
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	message := stringToSign(s.config.components(), req.Method, path, req.URL.RawQuery, timestamp, body)
+	req.Header.Set(s.config.timestampHeader(), timestamp)
+	req.Header.Set(s.config.signatureHeader(), sign(secret, message))
+}
+
+// requestBody returns the body of req without consuming it
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, nil
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read request body: %w", err)
+		}
+		defer body.Close()
+		return io.ReadAll(body)
+	}
+	content, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(content))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(content)), nil }
+	return content, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// signingVector is one entry of testdata/signing/vectors.json, the examples
+// of the gateway's signing spec. The file is never rewritten by the tests.
+type signingVector struct {
+	Name         string   `json:"name"`
+	Secret       string   `json:"secret"`
+	Method       string   `json:"method"`
+	URL          string   `json:"url"`
+	Timestamp    int64    `json:"timestamp"`
+	Body         string   `json:"body"`
+	Components   []string `json:"components"`
+	StringToSign string   `json:"string_to_sign"`
+	Signature    string   `json:"signature"`
+}
+
+func TestRequestSigning_Vectors(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "signing", "vectors.json"))
+	require.NoError(t, err)
+	var vectors []signingVector
+	require.NoError(t, json.Unmarshal(content, &vectors))
+	require.NotEmpty(t, vectors)
+
+	for _, v := range vectors {
+		signer := &requestSigner{
+			config: RequestSigningConfig{Components: v.Components},
+			secret: func() ([]byte, error) { return []byte(v.Secret), nil },
+			now:    func() time.Time { return time.Unix(v.Timestamp, 0) },
+		}
+		var body io.Reader
+		if v.Body != "" {
+			// Without GetBody, so the body is read and put back
+			body = io.NopCloser(strings.NewReader(v.Body))
+		}
+		req, err := http.NewRequest(v.Method, v.URL, body)
+		require.NoError(t, err, v.Name)
+		signer.DecorateRequest(req)
+
+		path := req.URL.EscapedPath()
+		if path == "" {
+			path = "/"
+		}
+		assert.Equal(t, v.StringToSign, stringToSign(signer.config.components(), v.Method, path, req.URL.RawQuery, strconv.FormatInt(v.Timestamp, 10), []byte(v.Body)), v.Name)
+		assert.Equal(t, v.Signature, req.Header.Get(defaultSignatureHeader), v.Name)
+		assert.Equal(t, strconv.FormatInt(v.Timestamp, 10), req.Header.Get(defaultTimestampHeader), v.Name)
+		if v.Body != "" {
+			sent, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, v.Body, string(sent), "the body is still sent")
+		}
+	}
+}
+
+// gatewayVerify checks a request as the gateway does
+func gatewayVerify(r *http.Request, secret string) bool {
+	body, _ := io.ReadAll(r.Body)
+	message := stringToSign(defaultSigningComponents, r.Method, r.URL.EscapedPath(), r.URL.RawQuery, r.Header.Get("X-Timestamp"), body)
+	return r.Header.Get("X-Signature") == sign([]byte(secret), message)
+}
+
+func TestRequestSigning_EveryRetryIsSignedAgain(t *testing.T) {
+	t.Setenv("GATEWAY_SECRET", "gateway-shared-secret")
+	var mu sync.Mutex
+	var timestamps []string
+	var requests atomic.Int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		timestamps = append(timestamps, r.Header.Get("X-Timestamp"))
+		mu.Unlock()
+		if !gatewayVerify(r, "gateway-shared-secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if requests.Add(1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"weather","name":"moscow-1","payload":{"temperature":-5}}]`))
+	}))
+	defer upstream.Close()
+
+	config := &Config{
+		API: APIConfig{
+			BaseURL: upstream.URL, Timeout: Duration(time.Second), RetryCount: 1, RetryBackoff: Duration(time.Millisecond),
+			Signing: RequestSigningConfig{Enabled: true, SecretEnv: "GATEWAY_SECRET"},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config, WithRequestDecorator("tenant", decoratorFunc(func(req *http.Request) {
+		req.URL.Path = "/tenants/north" + req.URL.Path
+	})))
+	require.Len(t, ingestor.hooks.decorators, 2)
+	signer := ingestor.hooks.decorators[1].hook.(*requestSigner)
+	var clock atomic.Int64
+	clock.Store(1714694400)
+	signer.now = func() time.Time { return time.Unix(clock.Add(30), 0) }
+
+	attachChannel(ingestor, &fakeChannel{}, nil)
+
+	outcome := ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	require.Equal(t, outcomePublished, outcome.Outcome, outcome.Error)
+	assert.Equal(t, int32(2), requests.Load(), "both attempts verified, the path of the other decorator included")
+	assert.Equal(t, []string{"1714694430", "1714694460"}, timestamps, "the retry has its own timestamp")
+}
+
+func TestRequestSigning_SecretFileRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signing-secret")
+	writeSecret(t, path, "first")
+	ingestor := NewDataIngestor(&Config{
+		API:     APIConfig{Signing: RequestSigningConfig{Enabled: true, SecretFile: path}},
+		Logging: LoggingConfig{Level: "panic"},
+	})
+	require.NoError(t, ingestor.ConfigureAuth())
+	signer := ingestor.hooks.decorators[0].hook.(*requestSigner)
+	signer.now = func() time.Time { return time.Unix(1714694400, 0) }
+	signed := func() string {
+		req := httptest.NewRequest(http.MethodGet, "http://gateway.internal/meters", nil)
+		signer.DecorateRequest(req)
+		return req.Header.Get("X-Signature")
+	}
+	message := stringToSign(defaultSigningComponents, http.MethodGet, "/meters", "", "1714694400", nil)
+	assert.Equal(t, sign([]byte("first"), message), signed())
+
+	writeSecret(t, path, "second")
+	ingestor.secrets.check()
+	assert.Equal(t, sign([]byte("second"), message), signed())
+}
+
+func TestRequestSigning_Validate(t *testing.T) {
+	t.Setenv("GATEWAY_SECRET", "s3cret")
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty")
+	require.NoError(t, os.WriteFile(empty, []byte("\n"), 0o600))
+
+	assert.NoError(t, RequestSigningConfig{}.Validate())
+	assert.NoError(t, RequestSigningConfig{Enabled: true, SecretEnv: "GATEWAY_SECRET", Components: []string{signQuery, signTimestamp}}.Validate())
+	for want, config := range map[string]RequestSigningConfig{
+		"exactly one of secret_env and secret_file": {Enabled: true},
+		"variable GATEWAY_MISSING is not set":       {Enabled: true, SecretEnv: "GATEWAY_MISSING"},
+		"failed to read secret file":                {Enabled: true, SecretFile: filepath.Join(dir, "missing")},
+		"is empty":                                  {Enabled: true, SecretFile: empty},
+		`unknown component "host"`:                  {Enabled: true, SecretEnv: "GATEWAY_SECRET", Components: []string{"host"}},
+		"body is listed twice":                      {Enabled: true, SecretEnv: "GATEWAY_SECRET", Components: []string{signBody, signBody}},
+		`"X Signature" is not a valid header name`:  {Enabled: true, SecretEnv: "GATEWAY_SECRET", SignatureHeader: "X Signature"},
+		"must differ":                               {Enabled: true, SecretEnv: "GATEWAY_SECRET", SignatureHeader: "x-timestamp"},
+	} {
+		err := config.Validate()
+		require.Error(t, err, want)
+		assert.Contains(t, err.Error(), want)
+		assert.NotContains(t, err.Error(), "s3cret")
+	}
+	assert.ErrorContains(t, (&Config{API: APIConfig{Signing: RequestSigningConfig{Enabled: true, SecretEnv: "GATEWAY_MISSING"}}}).Validate(),
+		"api.signing", "fails at startup, not with the first request")
+	assert.Empty(t, NewDataIngestor(&Config{Logging: LoggingConfig{Level: "panic"}}).hooks.decorators)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultResourceGuardCheckInterval = 10 * time.Second
+
+// Resources the guard samples
+const (
+	resourceGoroutines      = "goroutines"
+	resourceFileDescriptors = "file_descriptors"
+	resourceHeap            = "heap"
+)
+
+// Levels of a resource, by the threshold it is above
+const (
+	resourceLevelNormal = "normal"
+	resourceLevelSoft   = "soft"
+	resourceLevelHard   = "hard"
+)
+
+// Protective actions taken while a resource is above its hard threshold
+const (
+	resourceActionRejectStreams   = "reject_streams"
+	resourceActionRejectBackfills = "reject_backfills"
+)
+
+var resourceActions = []string{resourceActionRejectStreams, resourceActionRejectBackfills}
+
+// errResourceGuard is returned for what the resource guard rejects while a
+// resource is above its hard threshold
+var errResourceGuard = errors.New("the process is above a resource hard threshold, retry later")
+
+// ResourceGuardConfig samples the goroutines, open file descriptors and heap
+// of the process. A soft threshold only logs a warning; a hard threshold
+// takes the protective actions and dumps a goroutine profile, so a leak
+// degrades the service instead of getting it killed.
+type ResourceGuardConfig struct {
+	// CheckInterval is how often the process is sampled, 10s by default
+	CheckInterval   Duration           `yaml:"check_interval"`
+	Goroutines      ResourceThresholds `yaml:"goroutines"`
+	FileDescriptors ResourceThresholds `yaml:"file_descriptors"`
+	Heap            HeapThresholds     `yaml:"heap"`
+	// Actions are taken while any resource is above its hard threshold:
+	// reject_streams and reject_backfills, both by default
+	Actions []string `yaml:"actions"`
+}
+
+// ResourceThresholds are the soft and hard thresholds of a count; 0 leaves
+// a threshold out
+type ResourceThresholds struct {
+	Soft int `yaml:"soft"`
+	Hard int `yaml:"hard"`
+}
+
+// HeapThresholds are the soft and hard thresholds of the heap in use
+type HeapThresholds struct {
+	Soft ByteSize `yaml:"soft"`
+	Hard ByteSize `yaml:"hard"`
+}
+
+func (c ResourceGuardConfig) enabled() bool {
+	for _, limit := range c.limits() {
+		if limit.soft > 0 || limit.hard > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks that every soft threshold is below its hard one and that
+// the actions are known
+func (c ResourceGuardConfig) Validate() error {
+	if c.CheckInterval < 0 {
+		return fmt.Errorf("resource_guard.check_interval must not be negative")
+	}
+	for _, limit := range c.limits() {
+		if limit.soft < 0 || limit.hard < 0 {
+			return fmt.Errorf("resource_guard.%s thresholds must not be negative", limit.name)
+		}
+		if limit.soft > 0 && limit.hard > 0 && limit.soft >= limit.hard {
+			return fmt.Errorf("resource_guard.%s.soft must be below resource_guard.%s.hard", limit.name, limit.name)
+		}
+	}
+	for _, action := range c.Actions {
+		if !contains(resourceActions, action) {
+			return fmt.Errorf("resource_guard.actions: unknown action %q, use one of %v", action, resourceActions)
+		}
+	}
+	return nil
+}
+
+func (c ResourceGuardConfig) checkInterval() time.Duration {
+	if c.CheckInterval > 0 {
+		return time.Duration(c.CheckInterval)
+	}
+	return defaultResourceGuardCheckInterval
+}
+
+func (c ResourceGuardConfig) actions() []string {
+	if c.Actions == nil {
+		return resourceActions
+	}
+	return c.Actions
+}
+
+// resourceLimit is the thresholds of one resource
+type resourceLimit struct {
+	name       string
+	soft, hard int64
+}
+
+func (c ResourceGuardConfig) limits() []resourceLimit {
+	return []resourceLimit{
+		{resourceGoroutines, int64(c.Goroutines.Soft), int64(c.Goroutines.Hard)},
+		{resourceFileDescriptors, int64(c.FileDescriptors.Soft), int64(c.FileDescriptors.Hard)},
+		{resourceHeap, int64(c.Heap.Soft), int64(c.Heap.Hard)},
+	}
+}
+
+// resourceSample is one reading of the process. FileDescriptors is -1 where
+// they cannot be counted.
+type resourceSample struct {
+	Goroutines      int64
+	FileDescriptors int64
+	Heap            int64
+}
+
+func (s resourceSample) of(resource string) int64 {
+	switch resource {
+	case resourceGoroutines:
+		return s.Goroutines
+	case resourceFileDescriptors:
+		return s.FileDescriptors
+	default:
+		return s.Heap
+	}
+}
+
+func sampleResources() resourceSample {
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return resourceSample{
+		Goroutines:      int64(runtime.NumGoroutine()),
+		FileDescriptors: openFileDescriptors(),
+		Heap:            int64(stats.HeapAlloc),
+	}
+}
+
+// openFileDescriptors counts the entries of /proc/self/fd, less the one
+// reading it, or returns -1 without procfs
+func openFileDescriptors() int64 {
+	entries, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return int64(len(entries)) - 1
+}
+
+// resourceGuard samples the process and takes the protective actions while a
+// resource is above its hard threshold
+type resourceGuard struct {
+	interval time.Duration
+	limits   []resourceLimit
+	actions  []string
+	// dumpDir receives a goroutine profile per hard threshold crossing; no
+	// profile is written without one
+	dumpDir string
+	// sample reads the process; replaced in tests
+	sample  func() resourceSample
+	logger  *logrus.Logger
+	metrics *Metrics
+
+	// protecting is set while a resource is above its hard threshold
+	protecting atomic.Bool
+
+	mu        sync.Mutex
+	levels    map[string]string
+	last      resourceSample
+	checkedAt time.Time
+	dumps     []string
+}
+
+// newResourceGuard returns nil unless a resource_guard threshold is set
+func (di *DataIngestor) newResourceGuard() *resourceGuard {
+	config := di.config.ResourceGuard
+	if !config.enabled() {
+		return nil
+	}
+	g := &resourceGuard{
+		interval: config.checkInterval(),
+		actions:  config.actions(),
+		dumpDir:  di.config.Debug.CaptureDir,
+		sample:   sampleResources,
+		logger:   di.logger,
+		metrics:  di.metrics,
+		levels:   make(map[string]string),
+	}
+	for _, limit := range config.limits() {
+		if limit.soft > 0 || limit.hard > 0 {
+			g.limits = append(g.limits, limit)
+			g.levels[limit.name] = resourceLevelNormal
+		}
+	}
+	return g
+}
+
+// run samples the process every interval until ctx is cancelled
+func (g *resourceGuard) run(ctx context.Context) {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			g.check(now)
+		}
+	}
+}
+
+// level returns the level value reaches, or, to not flap around a
+// threshold, stays at from until value is 10% below it
+func (limit resourceLimit) level(value int64, from string) string {
+	reached := func(threshold int64, held bool) bool {
+		if threshold <= 0 {
+			return false
+		}
+		if held {
+			return value >= threshold-threshold/10
+		}
+		return value >= threshold
+	}
+	switch {
+	case reached(limit.hard, from == resourceLevelHard):
+		return resourceLevelHard
+	case reached(limit.soft, from != resourceLevelNormal):
+		return resourceLevelSoft
+	}
+	return resourceLevelNormal
+}
+
+// check samples the process, logs every resource that changed its level and
+// dumps a goroutine profile for every one that crossed its hard threshold
+func (g *resourceGuard) check(now time.Time) {
+	sample := g.sample()
+	g.metrics.Goroutines.Set(float64(sample.Goroutines))
+	if sample.FileDescriptors >= 0 {
+		g.metrics.OpenFileDescriptors.Set(float64(sample.FileDescriptors))
+	}
+	g.metrics.HeapBytes.Set(float64(sample.Heap))
+
+	type crossing struct {
+		limit    resourceLimit
+		from, to string
+		value    int64
+	}
+	var crossings []crossing
+	g.mu.Lock()
+	g.last, g.checkedAt = sample, now
+	protecting := false
+	for _, limit := range g.limits {
+		value := sample.of(limit.name)
+		if value < 0 {
+			continue
+		}
+		from := g.levels[limit.name]
+		to := limit.level(value, from)
+		if to != from {
+			g.levels[limit.name] = to
+			crossings = append(crossings, crossing{limit, from, to, value})
+		}
+		protecting = protecting || to == resourceLevelHard
+	}
+	g.mu.Unlock()
+	g.protecting.Store(protecting)
+	value := 0.0
+	if protecting {
+		value = 1
+	}
+	g.metrics.ResourceGuardProtecting.Set(value)
+
+	for _, c := range crossings {
+		entry := g.logger.WithFields(logrus.Fields{
+			"resource": c.limit.name,
+			"value":    c.value,
+			"soft":     c.limit.soft,
+			"hard":     c.limit.hard,
+		})
+		switch {
+		case c.to == resourceLevelHard:
+			g.metrics.ResourceCrossings.WithLabelValues(c.limit.name, resourceLevelHard).Inc()
+			entry.WithField("actions", g.actions).Error("Resource above its hard threshold, protecting the process")
+			g.dump(c.limit.name, now)
+		case c.to == resourceLevelSoft && c.from == resourceLevelNormal:
+			g.metrics.ResourceCrossings.WithLabelValues(c.limit.name, resourceLevelSoft).Inc()
+			entry.Warn("Resource above its soft threshold")
+		default:
+			entry.WithField("level", c.to).Info("Resource back below its threshold")
+		}
+	}
+}
+
+// dump writes the goroutine profile of a hard threshold crossing
+func (g *resourceGuard) dump(resource string, now time.Time) {
+	if g.dumpDir == "" {
+		return
+	}
+	path := filepath.Join(g.dumpDir, fmt.Sprintf("goroutines-%s-%s.pb.gz", now.UTC().Format("20060102T150405.000Z"), resource))
+	err := writeGoroutineProfile(path)
+	logger := g.logger.WithFields(logrus.Fields{"resource": resource, "path": path})
+	if err != nil {
+		logger.WithError(err).Error("Failed to write the goroutine profile")
+		return
+	}
+	g.mu.Lock()
+	g.dumps = append(g.dumps, path)
+	g.mu.Unlock()
+	g.metrics.GoroutineDumps.Inc()
+	logger.Warn("Goroutine profile written")
+}
+
+func writeGoroutineProfile(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := pprof.Lookup("goroutine").WriteTo(file, 0); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// rejects reports whether action is in effect
+func (g *resourceGuard) rejects(action string) bool {
+	return g != nil && g.protecting.Load() && contains(g.actions, action)
+}
+
+// ResourceGuardStatus is the resource guard state reported by /stats
+type ResourceGuardStatus struct {
+	// Levels is normal, soft or hard by resource
+	Levels          map[string]string `json:"levels"`
+	Protecting      bool              `json:"protecting"`
+	Goroutines      int64             `json:"goroutines"`
+	FileDescriptors int64             `json:"file_descriptors"`
+	HeapBytes       int64             `json:"heap_bytes"`
+	CheckedAt       time.Time         `json:"checked_at,omitempty"`
+	// Dumps are the goroutine profiles written since the service started
+	Dumps []string `json:"dumps,omitempty"`
+}
+
+// hard returns the resources above their hard threshold, sorted
+func (s *ResourceGuardStatus) hard() []string {
+	var resources []string
+	for resource, level := range s.Levels {
+		if level == resourceLevelHard {
+			resources = append(resources, resource)
+		}
+	}
+	sort.Strings(resources)
+	return resources
+}
+
+// Status returns the latest sample and levels
+func (g *resourceGuard) Status() *ResourceGuardStatus {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	levels := make(map[string]string, len(g.levels))
+	for resource, level := range g.levels {
+		levels[resource] = level
+	}
+	return &ResourceGuardStatus{
+		Levels:          levels,
+		Protecting:      g.protecting.Load(),
+		Goroutines:      g.last.Goroutines,
+		FileDescriptors: g.last.FileDescriptors,
+		HeapBytes:       g.last.Heap,
+		CheckedAt:       g.checkedAt,
+		Dumps:           append([]string(nil), g.dumps...),
+	}
+}
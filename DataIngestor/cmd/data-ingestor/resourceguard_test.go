@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newResourceGuardTestIngestor guards 100 soft and 200 hard goroutines, 50
+// and 100 file descriptors and a hard heap of 1000 bytes, with a guard that
+// reads the process from the returned sample
+func newResourceGuardTestIngestor(t *testing.T, actions []string) (*DataIngestor, *resourceSample, string) {
+	t.Helper()
+	dumps := filepath.Join(t.TempDir(), "captures")
+	config := &Config{
+		Logging:  LoggingConfig{Level: "panic"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Backfill: BackfillConfig{Enabled: true, StateFile: filepath.Join(t.TempDir(), "backfill.json")},
+		Debug:    DebugConfig{CaptureDir: dumps},
+		ResourceGuard: ResourceGuardConfig{
+			Goroutines:      ResourceThresholds{Soft: 100, Hard: 200},
+			FileDescriptors: ResourceThresholds{Soft: 50, Hard: 100},
+			Heap:            HeapThresholds{Hard: 1000},
+			Actions:         actions,
+		},
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+	require.NotNil(t, ingestor.resources)
+	sample := &resourceSample{Goroutines: 10, FileDescriptors: 10, Heap: 10}
+	ingestor.resources.sample = func() resourceSample { return *sample }
+	return ingestor, sample, dumps
+}
+
+func goroutineDumps(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func TestResourceGuard_Thresholds(t *testing.T) {
+	ingestor, sample, _ := newResourceGuardTestIngestor(t, nil)
+	guard := ingestor.resources
+	crossings := ingestor.metrics.ResourceCrossings
+	check := func() map[string]string {
+		guard.check(time.Now())
+		return guard.Status().Levels
+	}
+
+	assert.Equal(t, map[string]string{resourceGoroutines: resourceLevelNormal, resourceFileDescriptors: resourceLevelNormal, resourceHeap: resourceLevelNormal}, check())
+	assert.Equal(t, 10.0, testutil.ToFloat64(ingestor.metrics.Goroutines))
+	assert.Equal(t, 10.0, testutil.ToFloat64(ingestor.metrics.OpenFileDescriptors))
+	assert.Equal(t, 10.0, testutil.ToFloat64(ingestor.metrics.HeapBytes))
+
+	sample.Goroutines = 150
+	assert.Equal(t, resourceLevelSoft, check()[resourceGoroutines])
+	assert.False(t, guard.rejects(resourceActionRejectStreams), "a soft threshold only warns")
+	assert.Equal(t, 1.0, testutil.ToFloat64(crossings.WithLabelValues(resourceGoroutines, resourceLevelSoft)))
+
+	sample.Goroutines = 200
+	assert.Equal(t, resourceLevelHard, check()[resourceGoroutines])
+	assert.True(t, guard.rejects(resourceActionRejectStreams))
+	assert.True(t, guard.rejects(resourceActionRejectBackfills))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ResourceGuardProtecting))
+
+	// Held until 10% below the threshold
+	sample.Goroutines = 181
+	assert.Equal(t, resourceLevelHard, check()[resourceGoroutines])
+	sample.Goroutines = 179
+	assert.Equal(t, resourceLevelSoft, check()[resourceGoroutines])
+	assert.False(t, guard.rejects(resourceActionRejectStreams))
+	assert.Equal(t, 0.0, testutil.ToFloat64(ingestor.metrics.ResourceGuardProtecting))
+	sample.Goroutines = 91
+	assert.Equal(t, resourceLevelSoft, check()[resourceGoroutines])
+	sample.Goroutines = 89
+	assert.Equal(t, resourceLevelNormal, check()[resourceGoroutines])
+	assert.Equal(t, 1.0, testutil.ToFloat64(crossings.WithLabelValues(resourceGoroutines, resourceLevelSoft)), "not counted again on the way down")
+
+	// Any resource protects the process, a threshold left out is skipped
+	sample.Heap = 5000
+	levels := check()
+	assert.Equal(t, resourceLevelHard, levels[resourceHeap])
+	assert.True(t, guard.rejects(resourceActionRejectStreams))
+	sample.Heap = 850
+	assert.Equal(t, resourceLevelNormal, check()[resourceHeap], "no soft threshold to fall back to")
+
+	// Without procfs the descriptors are left alone
+	sample.FileDescriptors = -1
+	assert.Equal(t, resourceLevelNormal, check()[resourceFileDescriptors])
+	assert.Equal(t, 10.0, testutil.ToFloat64(ingestor.metrics.OpenFileDescriptors))
+}
+
+func TestResourceGuard_OneDumpPerCrossing(t *testing.T) {
+	ingestor, sample, dumps := newResourceGuardTestIngestor(t, nil)
+	guard := ingestor.resources
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	check := func(goroutines int64, after time.Duration) {
+		sample.Goroutines = goroutines
+		guard.check(start.Add(after))
+	}
+
+	check(250, 0)
+	check(300, time.Second)
+	check(185, 2*time.Second)
+	check(400, 3*time.Second)
+	assert.Equal(t, []string{"goroutines-20260301T120000.000Z-goroutines.pb.gz"}, goroutineDumps(t, dumps),
+		"one profile while the crossing lasts")
+
+	check(150, 4*time.Second)
+	check(250, 5*time.Second)
+	assert.Len(t, goroutineDumps(t, dumps), 2, "a new crossing dumps again")
+
+	// Two resources crossing together dump one profile each
+	sample.FileDescriptors = 100
+	check(100, 6*time.Second)
+	sample.FileDescriptors = 10
+	check(100, 7*time.Second)
+	sample.FileDescriptors = 200
+	check(100, 8*time.Second)
+	names := goroutineDumps(t, dumps)
+	assert.Len(t, names, 4)
+	assert.Equal(t, 4.0, testutil.ToFloat64(ingestor.metrics.GoroutineDumps))
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.ResourceCrossings.WithLabelValues(resourceFileDescriptors, resourceLevelHard)))
+	assert.Len(t, guard.Status().Dumps, 4)
+
+	content, err := os.ReadFile(filepath.Join(dumps, names[0]))
+	require.NoError(t, err)
+	assert.True(t, len(content) > 2 && content[0] == 0x1f && content[1] == 0x8b, "a gzipped pprof profile")
+
+	// Without a capture directory nothing is written
+	guard.dumpDir = ""
+	check(10, 9*time.Second)
+	check(250, 10*time.Second)
+	assert.Len(t, goroutineDumps(t, dumps), 4)
+}
+
+func TestResourceGuard_ProtectiveActions(t *testing.T) {
+	ingestor, sample, _ := newResourceGuardTestIngestor(t, []string{resourceActionRejectBackfills})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	router := setupRoutes(ingestor)
+	createBackfill := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/backfill", strings.NewReader(
+			`{"location":"default","from":"2026-03-01T00:00:00Z","to":"2026-03-01T02:00:00Z"}`))
+		req.Header.Set("Authorization", "Bearer letmein")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	sample.Goroutines = 500
+	ingestor.resources.check(time.Now())
+	w := createBackfill()
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), errResourceGuard.Error())
+	assert.False(t, ingestor.resources.rejects(resourceActionRejectStreams), "only the configured actions")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	assert.Equal(t, http.StatusOK, w.Code, "degraded, not unready")
+	var ready struct {
+		Degraded bool              `json:"degraded"`
+		Checks   map[string]string `json:"checks"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ready))
+	assert.True(t, ready.Degraded)
+	assert.Equal(t, "protecting: goroutines above the hard threshold", ready.Checks["resources"])
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		Resources ResourceGuardStatus `json:"resources"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.True(t, stats.Resources.Protecting)
+	assert.Equal(t, int64(500), stats.Resources.Goroutines)
+
+	sample.Goroutines = 10
+	ingestor.resources.check(time.Now())
+	assert.Equal(t, http.StatusAccepted, createBackfill().Code)
+}
+
+func TestResourceGuard_RejectsStreams(t *testing.T) {
+	ingestor, sample, _ := newResourceGuardTestIngestor(t, nil)
+	ingestor.logTail = newLogTail(0)
+	router := setupRoutes(ingestor)
+
+	sample.FileDescriptors = 100
+	ingestor.resources.check(time.Now())
+	for _, target := range []string{"/stream", "/debug/logs"} {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Authorization", "Bearer letmein")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code, target)
+		assert.Contains(t, w.Body.String(), errResourceGuard.Error(), target)
+	}
+}
+
+func TestResourceGuardConfig_Validate(t *testing.T) {
+	for config, message := range map[*ResourceGuardConfig]string{
+		{CheckInterval: Duration(-1)}:                                    "resource_guard.check_interval must not be negative",
+		{Goroutines: ResourceThresholds{Soft: -1}}:                       "resource_guard.goroutines thresholds must not be negative",
+		{FileDescriptors: ResourceThresholds{Soft: 100, Hard: 100}}:      "resource_guard.file_descriptors.soft must be below resource_guard.file_descriptors.hard",
+		{Heap: HeapThresholds{Hard: 1 << 30}, Actions: []string{"exit"}}: `unknown action "exit"`,
+	} {
+		assert.ErrorContains(t, config.Validate(), message)
+	}
+	assert.NoError(t, ResourceGuardConfig{Goroutines: ResourceThresholds{Hard: 100000}, Actions: []string{}}.Validate())
+	assert.False(t, ResourceGuardConfig{}.enabled())
+	assert.Empty(t, ResourceGuardConfig{Actions: []string{}}.actions(), "an empty list leaves the actions out")
+}
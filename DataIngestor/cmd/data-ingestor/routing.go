@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// RoutingConfig describes how readings are fanned out to exchanges and routing keys
+type RoutingConfig struct {
+	FirstMatchOnly bool          `yaml:"first_match_only"`
+	Rules          []RoutingRule `yaml:"rules"`
+}
+
+// RoutingRule publishes matching readings to one or more targets
+type RoutingRule struct {
+	Name    string          `yaml:"name"`
+	Match   MatchCondition  `yaml:"match"`
+	Targets []RoutingTarget `yaml:"targets"`
+}
+
+// MatchCondition selects readings by location, sensor type, payload fields
+// and captured response headers. An empty condition matches every reading.
+type MatchCondition struct {
+	Location string           `yaml:"location"`
+	Type     string           `yaml:"type"`
+	Fields   []FieldCondition `yaml:"fields"`
+	// Headers maps header names to globs their captured value must match
+	Headers map[string]string `yaml:"headers"`
+	// Quality compares the quality score, as the field score, or the points
+	// of a factor. Readings without a score never match.
+	Quality []FieldCondition `yaml:"quality"`
+}
+
+// FieldCondition compares a single payload field against a value
+type FieldCondition struct {
+	Field string      `yaml:"field"`
+	Op    string      `yaml:"op"`
+	Value interface{} `yaml:"value"`
+}
+
+// RoutingTarget is a destination exchange and routing key
+type RoutingTarget struct {
+	Exchange   string `yaml:"exchange"`
+	RoutingKey string `yaml:"routing_key"`
+}
+
+// Location returns the location a reading belongs to. The upstream identifies
+// each sensor by name, so the name doubles as its location.
+func (s SensorData) Location() string {
+	return s.Name
+}
+
+// Route is a group of readings destined for the same target
+type Route struct {
+	Rule   string
+	Target RoutingTarget
+	// Template is the target as configured when Target was resolved from
+	// its placeholders
+	Template *RoutingTarget
+	Readings []SensorData
+}
+
+// labels returns the target the metrics of the route are labelled with
+func (r Route) labels() RoutingTarget {
+	if r.Template != nil {
+		return *r.Template
+	}
+	return r.Target
+}
+
+// Router evaluates routing rules against readings
+type Router struct {
+	config RoutingConfig
+}
+
+// NewRouter creates a Router after validating the configured rules
+func NewRouter(config RoutingConfig) (*Router, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return &Router{config: config}, nil
+}
+
+// Validate checks that every rule has targets and well-formed conditions
+func (rc RoutingConfig) Validate() error {
+	for i, rule := range rc.Rules {
+		if rule.Name == "" {
+			return fmt.Errorf("routing rule %d: name is required", i)
+		}
+		if len(rule.Targets) == 0 {
+			return fmt.Errorf("routing rule %q: at least one target is required", rule.Name)
+		}
+		if err := rule.Match.validate(); err != nil {
+			return fmt.Errorf("routing rule %q: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func (mc MatchCondition) validate() error {
+	for _, pattern := range []string{mc.Location, mc.Type} {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	for name, pattern := range mc.Headers {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid glob %q for header %q: %w", pattern, name, err)
+		}
+	}
+	for _, fc := range mc.Fields {
+		if fc.Field == "" {
+			return fmt.Errorf("field condition is missing a field name")
+		}
+		if !validOps[fc.Op] {
+			return fmt.Errorf("unknown operator %q for field %q", fc.Op, fc.Field)
+		}
+	}
+	for _, fc := range mc.Quality {
+		if !validQualityField(fc.Field) {
+			return fmt.Errorf("unknown quality field %q, use score or one of %s", fc.Field, strings.Join(qualityFactorNames(), ", "))
+		}
+		if !validOps[fc.Op] {
+			return fmt.Errorf("unknown operator %q for quality field %q", fc.Op, fc.Field)
+		}
+	}
+	return nil
+}
+
+var validOps = map[string]bool{
+	"eq": true, "ne": true, "gt": true, "gte": true, "lt": true, "lte": true,
+}
+
+// Enabled reports whether any routing rules are configured
+func (r *Router) Enabled() bool {
+	return r != nil && len(r.config.Rules) > 0
+}
+
+// MatchingRules returns the rules that match a reading, in configuration order
+func (r *Router) MatchingRules(sensor SensorData) []RoutingRule {
+	var matched []RoutingRule
+	for _, rule := range r.config.Rules {
+		if !rule.Match.Matches(sensor) {
+			continue
+		}
+		matched = append(matched, rule)
+		if r.config.FirstMatchOnly {
+			break
+		}
+	}
+	return matched
+}
+
+// Plan groups readings by target. Readings that match no rule are sent to
+// the fallback target so nothing is silently dropped.
+func (r *Router) Plan(data WeatherData, fallback RoutingTarget) []Route {
+	var routes []Route
+	index := make(map[string]int)
+
+	add := func(rule string, target RoutingTarget, sensor SensorData) {
+		key := rule + "\x00" + target.Exchange + "\x00" + target.RoutingKey
+		i, ok := index[key]
+		if !ok {
+			i = len(routes)
+			index[key] = i
+			routes = append(routes, Route{Rule: rule, Target: target})
+		}
+		routes[i].Readings = append(routes[i].Readings, sensor)
+	}
+
+	for _, sensor := range data {
+		rules := r.MatchingRules(sensor)
+		if len(rules) == 0 {
+			add("", fallback, sensor)
+			continue
+		}
+		for _, rule := range rules {
+			for _, target := range rule.Targets {
+				add(rule.Name, target, sensor)
+			}
+		}
+	}
+	return routes
+}
+
+// Matches reports whether a reading satisfies every part of the condition
+func (mc MatchCondition) Matches(sensor SensorData) bool {
+	if !globMatch(mc.Location, sensor.Location()) || !globMatch(mc.Type, sensor.Type) {
+		return false
+	}
+	for _, fc := range mc.Fields {
+		if !fc.Matches(sensor.Payload) {
+			return false
+		}
+	}
+	// Missing headers never match, like missing fields
+	for name, pattern := range mc.Headers {
+		value, ok := sensor.Headers[http.CanonicalHeaderKey(name)]
+		if !ok || !globMatch(pattern, value) {
+			return false
+		}
+	}
+	if len(mc.Quality) > 0 {
+		if sensor.Quality == nil {
+			return false
+		}
+		fields := qualityFields(*sensor.Quality)
+		for _, fc := range mc.Quality {
+			if !fc.Matches(fields) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func globMatch(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, err := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return err == nil && ok
+}
+
+// Matches evaluates the comparison against a payload. Missing fields never match.
+func (fc FieldCondition) Matches(payload map[string]interface{}) bool {
+	actual, ok := payload[fc.Field]
+	if !ok {
+		return false
+	}
+
+	if a, ok := toFloat(actual); ok {
+		if b, ok := toFloat(fc.Value); ok {
+			switch fc.Op {
+			case "eq":
+				return a == b
+			case "ne":
+				return a != b
+			case "gt":
+				return a > b
+			case "gte":
+				return a >= b
+			case "lt":
+				return a < b
+			case "lte":
+				return a <= b
+			}
+			return false
+		}
+	}
+
+	equal := fmt.Sprint(actual) == fmt.Sprint(fc.Value)
+	switch fc.Op {
+	case "eq":
+		return equal
+	case "ne":
+		return !equal
+	}
+	return false
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch n := v.(type) {
+	case float64:
+		return n, true
+	case float32:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testRoutingConfig(firstMatchOnly bool) RoutingConfig {
+	return RoutingConfig{
+		FirstMatchOnly: firstMatchOnly,
+		Rules: []RoutingRule{
+			{
+				Name:    "moscow",
+				Match:   MatchCondition{Location: "moscow*"},
+				Targets: []RoutingTarget{{Exchange: "weather", RoutingKey: "weather.moscow"}},
+			},
+			{
+				Name: "alerts",
+				Match: MatchCondition{Fields: []FieldCondition{
+					{Field: "co2", Op: "gte", Value: 1000},
+				}},
+				Targets: []RoutingTarget{
+					{Exchange: "weather", RoutingKey: "weather.alerts"},
+					{Exchange: "alerts", RoutingKey: "co2"},
+				},
+			},
+		},
+	}
+}
+
+func TestFieldCondition_Matches(t *testing.T) {
+	payload := map[string]interface{}{
+		"co2":             1200.0,
+		"motion_detected": true,
+		"unit":            "ppm",
+	}
+
+	tests := []struct {
+		name string
+		cond FieldCondition
+		want bool
+	}{
+		{"gt true", FieldCondition{Field: "co2", Op: "gt", Value: 1000}, true},
+		{"gt false", FieldCondition{Field: "co2", Op: "gt", Value: 1200}, false},
+		{"gte boundary", FieldCondition{Field: "co2", Op: "gte", Value: 1200}, true},
+		{"lt", FieldCondition{Field: "co2", Op: "lt", Value: 1500.5}, true},
+		{"lte false", FieldCondition{Field: "co2", Op: "lte", Value: 100}, false},
+		{"eq number", FieldCondition{Field: "co2", Op: "eq", Value: 1200}, true},
+		{"ne number", FieldCondition{Field: "co2", Op: "ne", Value: 1200}, false},
+		{"eq bool", FieldCondition{Field: "motion_detected", Op: "eq", Value: true}, true},
+		{"eq string", FieldCondition{Field: "unit", Op: "eq", Value: "ppm"}, true},
+		{"ne string", FieldCondition{Field: "unit", Op: "ne", Value: "ppm"}, false},
+		{"gt on string never matches", FieldCondition{Field: "unit", Op: "gt", Value: "a"}, false},
+		{"missing field", FieldCondition{Field: "pm25", Op: "gt", Value: 0}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, tt.cond.Matches(payload))
+		})
+	}
+}
+
+func TestMatchCondition_Matches(t *testing.T) {
+	sensor := SensorData{Type: "air_quality", Name: "Moscow-Center", Payload: map[string]interface{}{"co2": 900.0}}
+
+	assert.True(t, MatchCondition{}.Matches(sensor))
+	assert.True(t, MatchCondition{Location: "moscow*"}.Matches(sensor), "glob is case-insensitive")
+	assert.True(t, MatchCondition{Location: "*", Type: "air_*"}.Matches(sensor))
+	assert.False(t, MatchCondition{Location: "berlin*"}.Matches(sensor))
+	assert.False(t, MatchCondition{Type: "energy"}.Matches(sensor))
+	assert.False(t, MatchCondition{
+		Location: "moscow*",
+		Fields:   []FieldCondition{{Field: "co2", Op: "gt", Value: 1000}},
+	}.Matches(sensor), "all parts of the condition must hold")
+}
+
+func TestRouter_OverlappingRules(t *testing.T) {
+	sensor := SensorData{Type: "air_quality", Name: "moscow-1", Payload: map[string]interface{}{"co2": 1500.0}}
+
+	router, err := NewRouter(testRoutingConfig(false))
+	require.NoError(t, err)
+	rules := router.MatchingRules(sensor)
+	require.Len(t, rules, 2)
+	assert.Equal(t, "moscow", rules[0].Name)
+	assert.Equal(t, "alerts", rules[1].Name)
+
+	router, err = NewRouter(testRoutingConfig(true))
+	require.NoError(t, err)
+	rules = router.MatchingRules(sensor)
+	require.Len(t, rules, 1)
+	assert.Equal(t, "moscow", rules[0].Name)
+}
+
+func TestRouter_Plan(t *testing.T) {
+	router, err := NewRouter(testRoutingConfig(false))
+	require.NoError(t, err)
+
+	data := WeatherData{
+		{Type: "air_quality", Name: "moscow-1", Payload: map[string]interface{}{"co2": 1500.0}},
+		{Type: "air_quality", Name: "moscow-2", Payload: map[string]interface{}{"co2": 300.0}},
+		{Type: "air_quality", Name: "berlin-1", Payload: map[string]interface{}{"co2": 1100.0}},
+		{Type: "energy", Name: "paris-1", Payload: map[string]interface{}{"energy": 5.0}},
+	}
+
+	routes := router.Plan(data, RoutingTarget{RoutingKey: "meter-data-queue"})
+
+	byKey := make(map[string][]string)
+	for _, route := range routes {
+		key := route.Rule + "|" + route.Target.Exchange + "|" + route.Target.RoutingKey
+		for _, sensor := range route.Readings {
+			byKey[key] = append(byKey[key], sensor.Name)
+		}
+	}
+
+	assert.Equal(t, map[string][]string{
+		"moscow|weather|weather.moscow": {"moscow-1", "moscow-2"},
+		"alerts|weather|weather.alerts": {"moscow-1", "berlin-1"},
+		"alerts|alerts|co2":             {"moscow-1", "berlin-1"},
+		"||meter-data-queue":            {"paris-1"},
+	}, byKey)
+}
+
+func TestRoutingConfig_Validate(t *testing.T) {
+	assert.NoError(t, testRoutingConfig(false).Validate())
+
+	tests := []struct {
+		name string
+		rule RoutingRule
+	}{
+		{"missing name", RoutingRule{Targets: []RoutingTarget{{RoutingKey: "a"}}}},
+		{"missing targets", RoutingRule{Name: "r"}},
+		{"bad glob", RoutingRule{Name: "r", Match: MatchCondition{Location: "[a"}, Targets: []RoutingTarget{{RoutingKey: "a"}}}},
+		{"bad op", RoutingRule{Name: "r", Match: MatchCondition{Fields: []FieldCondition{{Field: "co2", Op: "~"}}}, Targets: []RoutingTarget{{RoutingKey: "a"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Error(t, RoutingConfig{Rules: []RoutingRule{tt.rule}}.Validate())
+		})
+	}
+}
+
+func TestDataIngestor_PublishToQueue_Routed(t *testing.T) {
+	config := &Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Routing:  testRoutingConfig(false),
+	}
+	ingestor := NewDataIngestor(config)
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	data := WeatherData{
+		{Type: "air_quality", Name: "moscow-1", Payload: map[string]interface{}{"co2": 1500.0}},
+		{Type: "energy", Name: "paris-1", Payload: map[string]interface{}{"energy": 5.0}},
+	}
+	require.NoError(t, ingestor.PublishToQueue(&data))
+
+	messages := channel.messages()
+	require.Len(t, messages, 4)
+	for _, msg := range messages {
+		var readings WeatherData
+		require.NoError(t, json.Unmarshal(msg.Msg.Body, &readings))
+		assert.Len(t, readings, 1)
+	}
+
+	counter := ingestor.metrics.RoutingRulePublishes
+	assert.Equal(t, 1.0, testutil.ToFloat64(counter.WithLabelValues("moscow", "weather", "weather.moscow")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(counter.WithLabelValues("alerts", "alerts", "co2")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(counter.WithLabelValues("default", "", "meter-data-queue")))
+}
+
+func TestDataIngestor_PublishToQueue_NoRules(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"}})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	data := WeatherData{
+		{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}},
+		{Type: "energy", Name: "meter-2", Payload: map[string]interface{}{"energy": 2.0}},
+	}
+	require.NoError(t, ingestor.PublishToQueue(&data))
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "", messages[0].Exchange)
+	assert.Equal(t, "meter-data-queue", messages[0].RoutingKey)
+}
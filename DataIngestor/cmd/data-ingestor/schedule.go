@@ -0,0 +1,116 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxDueTicks bounds the ticks one cycle is measured against, so a cycle
+// that hung for hours does not record millions of samples
+const maxDueTicks = 1000
+
+// cycleSchedule holds the intended start times of one location's cycles.
+// Cycles start poll_interval after the intended start of the previous one,
+// not after it finished. A cycle that runs past the next intended start
+// holds up every tick it overran; the next cycle serves all of them, and
+// each is measured from its own intended start. Slow cycles then count once
+// per tick they held up instead of once, which is what a reader waiting for
+// fresh data sees.
+type cycleSchedule struct {
+	mu sync.Mutex
+	// next is the intended start of the next cycle, zero before polling
+	// started
+	next  time.Time
+	delay time.Duration
+}
+
+// start sets the intended start of the first cycle
+func (s *cycleSchedule) start(at time.Time, delay time.Duration) {
+	s.mu.Lock()
+	s.next, s.delay = at, delay
+	s.mu.Unlock()
+}
+
+// due returns the intended starts a cycle starting at now serves: the next
+// one and every later one that passed while the previous cycle ran
+func (s *cycleSchedule) due(now time.Time) []time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ticks := []time.Time{s.next}
+	for tick := s.next.Add(s.delay); !tick.After(now) && len(ticks) < maxDueTicks; tick = tick.Add(s.delay) {
+		ticks = append(ticks, tick)
+	}
+	return ticks
+}
+
+// advance schedules the next cycle delay after the last tick served. A delay
+// longer than interval slows polling down on purpose, for a backoff,
+// throttle or backpressure; the schedule then starts over at now, so the
+// wait is not counted as lag.
+func (s *cycleSchedule) advance(last, now time.Time, delay, interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.delay = delay
+	if delay > interval {
+		s.next = now.Add(delay)
+		return
+	}
+	s.next = last.Add(delay)
+}
+
+// wait returns how long until the intended start of the next cycle, zero
+// when it already passed
+func (s *cycleSchedule) wait(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if wait := s.next.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// behind returns how long ago the next cycle should have started. It grows
+// while a cycle overruns, before the overrun shows in any histogram.
+func (s *cycleSchedule) behind(now time.Time) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next.IsZero() || !now.After(s.next) {
+		return 0
+	}
+	return now.Sub(s.next)
+}
+
+// recordSchedule measures a cycle against every tick it served: the lag from
+// each intended start to the actual start and, for a cycle that published,
+// the latency from each intended start to the end. Every tick after the
+// first was missed and is also spent from the error budget.
+func (di *DataIngestor) recordSchedule(src *source, ticks []time.Time, started, finished time.Time, published bool) {
+	for _, tick := range ticks {
+		di.metrics.ScheduleLag.WithLabelValues(src.name).Observe(started.Sub(tick).Seconds())
+		if published {
+			di.metrics.CycleLatency.WithLabelValues(src.name).Observe(finished.Sub(tick).Seconds())
+		}
+	}
+	if missed := len(ticks) - 1; missed > 0 {
+		di.metrics.MissedTicks.WithLabelValues(src.name).Add(float64(missed))
+		di.budget.missed(missed)
+	}
+}
+
+// scheduleLag sets X-Schedule-Lag to how far behind schedule the locations
+// are, in seconds: the given location, or the furthest behind one
+func (di *DataIngestor) scheduleLag(c *gin.Context, location string, now time.Time) {
+	var lag time.Duration
+	for _, src := range di.currentSources() {
+		if location != "" && src.name != location {
+			continue
+		}
+		if behind := src.schedule.behind(now); behind > lag {
+			lag = behind
+		}
+	}
+	c.Header("X-Schedule-Lag", strconv.FormatFloat(lag.Seconds(), 'f', 3, 64))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCycleSchedule_DueServesMissedTicks(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var s cycleSchedule
+	s.start(start, 10*time.Second)
+
+	assert.Equal(t, []time.Time{start}, s.due(start.Add(time.Second)))
+
+	// The cycle of the first tick ran 35s, past the ticks at 10s, 20s and 30s
+	s.advance(start, start.Add(35*time.Second), 10*time.Second, 10*time.Second)
+	now := start.Add(35 * time.Second)
+	assert.Zero(t, s.wait(now), "the next tick already passed")
+	assert.Equal(t, 25*time.Second, s.behind(now))
+	ticks := s.due(now)
+	assert.Equal(t, []time.Time{start.Add(10 * time.Second), start.Add(20 * time.Second), start.Add(30 * time.Second)}, ticks)
+
+	// A fast cycle returns to the schedule
+	s.advance(ticks[2], now.Add(time.Second), 10*time.Second, 10*time.Second)
+	assert.Equal(t, 4*time.Second, s.wait(now.Add(time.Second)))
+	assert.Zero(t, s.behind(now.Add(time.Second)))
+}
+
+func TestCycleSchedule_DeliberateDelayStartsOver(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var s cycleSchedule
+	s.start(start, 10*time.Second)
+
+	// A backoff of 40s counts from the end of the cycle, not as lag
+	end := start.Add(15 * time.Second)
+	s.advance(start, end, 40*time.Second, 10*time.Second)
+	assert.Equal(t, 40*time.Second, s.wait(end))
+	assert.Len(t, s.due(end.Add(40*time.Second)), 1)
+}
+
+func TestCycleSchedule_BoundsDueTicks(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var s cycleSchedule
+	s.start(start, time.Millisecond)
+	assert.Len(t, s.due(start.Add(time.Hour)), maxDueTicks)
+}
+
+func TestRecordSchedule_SpendsErrorBudget(t *testing.T) {
+	ingestor, _, _ := newBudgetIngestor(t, "http://weakapp:8080", "")
+	src := ingestor.sources[0]
+	tick := time.Now().Add(-30 * time.Second)
+	ticks := []time.Time{tick, tick.Add(10 * time.Second), tick.Add(20 * time.Second)}
+
+	ingestor.recordSchedule(src, ticks, tick.Add(25*time.Second), tick.Add(30*time.Second), true)
+
+	window := ingestor.budget.Status().Window
+	assert.Equal(t, 2, window.MissedTicks)
+	assert.Equal(t, 2, window.Failures)
+	assert.Equal(t, 2, window.Fetches)
+	missed := findMetric(t, ingestor, "data_ingestor_cycle_missed_ticks_total", map[string]string{"location": defaultSourceName})
+	assert.Equal(t, 2.0, missed.GetCounter().GetValue())
+
+	lag := findMetric(t, ingestor, "data_ingestor_cycle_schedule_lag_seconds", map[string]string{"location": defaultSourceName})
+	assert.Equal(t, uint64(3), lag.GetHistogram().GetSampleCount())
+	assert.InDelta(t, 25+15+5, lag.GetHistogram().GetSampleSum(), 0.001)
+	latency := findMetric(t, ingestor, "data_ingestor_cycle_latency_seconds", map[string]string{"location": defaultSourceName})
+	assert.InDelta(t, 30+20+10, latency.GetHistogram().GetSampleSum(), 0.001)
+}
+
+func TestPollSource_SlowUpstreamShowsBacklog(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	const slow = 100 * time.Millisecond
+	var requests int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The first three fetches overrun several ticks each
+		if atomic.AddInt32(&requests, 1) <= 3 {
+			time.Sleep(slow)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(rawUpstreamBody))
+	}))
+	t.Cleanup(upstream.Close)
+
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(5 * time.Second), PollInterval: Duration(interval)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.pollSource(ctx, ingestor.sources[0])
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&requests) >= 8 }, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	location := map[string]string{"location": defaultSourceName}
+	naive := findMetric(t, ingestor, "data_ingestor_cycle_duration_seconds", nil).GetSummary()
+	lag := findMetric(t, ingestor, "data_ingestor_cycle_schedule_lag_seconds", location).GetHistogram()
+	latency := findMetric(t, ingestor, "data_ingestor_cycle_latency_seconds", location).GetHistogram()
+	missed := findMetric(t, ingestor, "data_ingestor_cycle_missed_ticks_total", location).GetCounter().GetValue()
+
+	// The naive summary has one sample per cycle, most of them fast
+	cycles := naive.GetSampleCount()
+	require.GreaterOrEqual(t, cycles, uint64(8))
+	assert.GreaterOrEqual(t, missed, 6.0, "every slow cycle held up several ticks")
+	assert.Equal(t, float64(cycles)+missed, float64(lag.GetSampleCount()), "one lag sample per tick")
+	assert.Equal(t, lag.GetSampleCount(), latency.GetSampleCount())
+
+	// The ticks held up waited for the slow cycles; the naive samples do not
+	// show that wait
+	var late uint64
+	for _, bucket := range lag.GetBucket() {
+		if bucket.GetUpperBound() == 0.01 {
+			late = lag.GetSampleCount() - bucket.GetCumulativeCount()
+		}
+	}
+	assert.GreaterOrEqual(t, float64(late), missed/2, "the held up ticks started late")
+	assert.Greater(t, latency.GetSampleSum(), naive.GetSampleSum()+lag.GetSampleSum()/2)
+}
+
+func TestLatest_ReportsScheduleLag(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.sources[0].schedule.start(time.Now().Add(-3*time.Second), time.Second)
+
+	req := httptest.NewRequest(http.MethodGet, "/weather/latest", nil)
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, req)
+	lag, err := strconv.ParseFloat(w.Header().Get("X-Schedule-Lag"), 64)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, lag, 3.0)
+
+	ingestor.sources[0].schedule.start(time.Now().Add(time.Second), time.Second)
+	w = httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, req)
+	assert.Equal(t, "0.000", w.Header().Get("X-Schedule-Lag"))
+}
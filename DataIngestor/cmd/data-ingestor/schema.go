@@ -0,0 +1,306 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// readingSchemaName is the schema of the messages of readings
+	readingSchemaName = "weather-reading"
+	// readingSchemaVersion is bumped when the published Go types change
+	// shape. The effective schema, with the configuration, is told apart by
+	// its hash.
+	readingSchemaVersion = "v1"
+	jsonSchemaDialect    = "https://json-schema.org/draft/2020-12/schema"
+)
+
+// AMQP headers of the schema of a message. They keep their names whatever
+// publishing.field_naming.
+const (
+	headerSchemaURL  = "x-schema-url"
+	headerSchemaHash = "x-schema-hash"
+)
+
+// SchemaRefConfig has every message of readings name the JSON Schema of its
+// body, served by the ingestor
+type SchemaRefConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// BaseURL is where consumers reach the ingestor's HTTP API, e.g.
+	// http://data-ingestor:8080
+	BaseURL string `yaml:"base_url"`
+}
+
+// validateSchemaRef checks publishing.schema
+func (c *Config) validateSchemaRef() error {
+	schema := c.Publishing.Schema
+	if !schema.Enabled {
+		return nil
+	}
+	base, err := url.Parse(schema.BaseURL)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return fmt.Errorf("publishing.schema.base_url must be an absolute http or https URL, got %q", schema.BaseURL)
+	}
+	if c.Publishing.Passthrough {
+		return fmt.Errorf("publishing.schema cannot be combined with publishing.passthrough, which publishes the upstream body as is")
+	}
+	return nil
+}
+
+// publishedSchema is the effective schema of the messages of readings
+type publishedSchema struct {
+	url string
+
+	mu   sync.RWMutex
+	hash string
+	// document is the JSON Schema as served
+	document []byte
+}
+
+// newPublishedSchema returns the schema of the configuration of di, nil
+// unless publishing.schema is enabled
+func newPublishedSchema(di *DataIngestor) *publishedSchema {
+	config := di.config.Publishing.Schema
+	if !config.Enabled {
+		return nil
+	}
+	path := "/schemas/" + readingSchemaName + "/" + readingSchemaVersion
+	if di.config.tenant != "" {
+		path = "/tenants/" + di.config.tenant + path
+	}
+	s := &publishedSchema{url: strings.TrimRight(config.BaseURL, "/") + path}
+	s.hash, s.document = di.renderSchema(s.url)
+	return s
+}
+
+// renderSchema returns the schema served at id with the stages in effect now,
+// and its hash
+func (di *DataIngestor) renderSchema(id string) (string, []byte) {
+	// Maps marshal with sorted keys, so the same configuration always hashes
+	// the same
+	document, _ := json.MarshalIndent(di.readingJSONSchema(id, di.features.snapshot()), "", "  ")
+	sum := sha256.Sum256(document)
+	return "sha256:" + hex.EncodeToString(sum[:]), document
+}
+
+// current returns the hash and the document of the schema
+func (s *publishedSchema) current() (string, []byte) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hash, s.document
+}
+
+// reloadSchema describes the messages anew after a config reload or a
+// pipeline stage toggle, so the hash of the next messages and the schema
+// served follow what they are published with
+func (di *DataIngestor) reloadSchema() {
+	s := di.schema
+	if s == nil {
+		return
+	}
+	hash, document := di.renderSchema(s.url)
+	s.mu.Lock()
+	previous := s.hash
+	s.hash, s.document = hash, document
+	s.mu.Unlock()
+	if hash != previous {
+		di.logger.WithFields(logrus.Fields{
+			"from": previous,
+			"to":   hash,
+		}).Info("Message schema changed")
+	}
+}
+
+// readingJSONSchema describes the body of the messages of readings as they
+// are published: field naming, renames, batching, enrichment, reading IDs,
+// transforms and the payload fields of schema_drift, null where a sentinel
+// can clear them, with the AMQP
+// properties and headers under x-amqp. Stages set switches off are left out.
+func (di *DataIngestor) readingJSONSchema(id string, set featureSet) map[string]interface{} {
+	n := di.naming
+	reading := structSchema(reflect.TypeOf(SensorData{}), n)
+	properties := reading["properties"].(map[string]interface{})
+
+	payload := map[string]interface{}{"type": jsonObject, "additionalProperties": true}
+	fields := map[string]interface{}{}
+	var required []string
+	for name, field := range di.config.SchemaDrift.Fields {
+		if di.config.nullable(name) {
+			fields[n.name(name)] = map[string]interface{}{"type": []string{field.Type, jsonNull}}
+		} else {
+			fields[n.name(name)] = map[string]interface{}{"type": field.Type}
+		}
+		if field.Required {
+			required = append(required, n.name(name))
+		}
+	}
+	if di.transformer != nil && !set.off(stageTransforms) {
+		for _, t := range di.transformer.transforms {
+			if t.field != "" {
+				fields[n.name(t.field)] = map[string]interface{}{"description": "Set by " + t.name}
+			}
+		}
+	}
+	if di.ids != nil {
+		fields[n.name(di.ids.field)] = map[string]interface{}{
+			"type":        jsonString,
+			"description": "The reading ID, " + di.ids.strategy,
+		}
+	}
+	if len(fields) > 0 {
+		payload["properties"] = fields
+	}
+	if len(required) > 0 {
+		sort.Strings(required)
+		payload["required"] = required
+	}
+	properties[n.name("payload")] = payload
+	metadata := n.name("location_metadata")
+	if di.config.Enrichment.MetadataFile == "" {
+		delete(properties, metadata)
+	} else {
+		properties[metadata] = structSchema(reflect.TypeOf(LocationMetadata{}), n)
+	}
+
+	readings := map[string]interface{}{"type": jsonArray, "items": map[string]interface{}{"$ref": "#/$defs/reading"}}
+	document := map[string]interface{}{
+		"$schema":     jsonSchemaDialect,
+		"$id":         id,
+		"title":       readingSchemaName + " " + readingSchemaVersion,
+		"description": "The body of a message of readings, after decompression and decryption",
+		"$defs":       map[string]interface{}{"reading": reading},
+		"x-amqp":      di.amqpSchema(set),
+	}
+	if di.config.Publishing.BatchMode == batchModeSingle {
+		document["type"] = jsonObject
+		document["required"] = []string{"batch_id", "count", "readings"}
+		document["properties"] = map[string]interface{}{
+			"batch_id": map[string]interface{}{"type": jsonString},
+			"count":    map[string]interface{}{"type": "integer"},
+			"readings": readings,
+		}
+	} else {
+		for key, value := range readings {
+			document[key] = value
+		}
+	}
+	return document
+}
+
+// structSchema describes the JSON of a struct by its json tags, keys
+// without omitempty being required
+func structSchema(t reflect.Type, n *fieldNamer) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		properties[n.name(name)] = map[string]interface{}{"type": jsonTypeOf(t.Field(i).Type)}
+		if options != "omitempty" {
+			required = append(required, n.name(name))
+		}
+	}
+	return map[string]interface{}{"type": jsonObject, "properties": properties, "required": required}
+}
+
+// amqpSchema describes the properties and headers of the messages of
+// readings with the configuration and the stages in effect
+func (di *DataIngestor) amqpSchema(set featureSet) map[string]interface{} {
+	config := di.config
+	headers := map[string]interface{}{}
+	header := func(name, jsonType, description string) {
+		if !strings.HasPrefix(name, "x-") {
+			name = di.naming.name(name)
+		}
+		headers[name] = map[string]interface{}{"type": jsonType, "description": description}
+	}
+	header(headerSchemaURL, jsonString, "Where this schema is served")
+	header(headerSchemaHash, jsonString, "The hash of this schema, which changes with the configuration")
+	header("instance_id", jsonString, "The instance that published the message")
+	headers[di.naming.name("trigger")] = map[string]interface{}{
+		"type":        jsonString,
+		"enum":        []string{triggerPoll, triggerManual, triggerWebhook, triggerBackfill, triggerReplay, triggerLoadTest, triggerPush},
+		"description": "What started the ingestion",
+	}
+	header("replayed", jsonBoolean, "Set on messages republished from an archive")
+	if config.Publishing.BatchMode != "" && config.Publishing.BatchMode != batchModeNone {
+		header("batch_id", jsonString, "The batch of the cycle")
+		header("batch_size", "integer", "The readings of the batch")
+	}
+	if config.Publishing.BatchMode == batchModeSingle && config.Publishing.MaxMessageSize > 0 {
+		header("batch_part", "integer", "The part of a split batch, from 1")
+		header("batch_parts", "integer", "The parts of a split batch")
+	}
+	if config.Quality.Enabled && !set.off(stageQuality) {
+		header("quality_score", "integer", "The lowest quality score of the readings")
+		header("quality", jsonArray, "The quality of every reading")
+	}
+	if config.ReadingIDs.replaces() {
+		header("source_id", jsonArray, "The upstream IDs of the readings, in order")
+	}
+	if len(config.API.CaptureHeaders) > 0 {
+		header("upstream_headers", jsonObject, "The captured response headers: "+strings.Join(config.API.CaptureHeaders, ", "))
+	}
+	// Added after the field naming, so they keep their names
+	security := config.Publishing.Security
+	if security.Signing.KeyID != "" {
+		headers[headerSignature] = map[string]interface{}{"type": jsonString, "description": "Ed25519 signature of the body as published and the security headers, base64"}
+		headers[headerSignatureKeyID] = map[string]interface{}{"type": jsonString}
+	}
+	if security.Encryption.KeyID != "" {
+		headers[headerEncryptionKeyID] = map[string]interface{}{"type": jsonString}
+		headers[headerEncryptionNonce] = map[string]interface{}{"type": jsonString, "description": "AES-GCM nonce, base64"}
+	}
+
+	properties := map[string]interface{}{
+		"content_type":   "application/json",
+		"delivery_mode":  "persistent",
+		"correlation_id": "The ingestion cycle",
+		"headers":        headers,
+	}
+	if compression := config.Publishing.Compression; compression != "" && compression != compressionNone {
+		properties["content_encoding"] = compression
+	}
+	if config.Publishing.BatchMode == batchModeSingle {
+		properties["type"] = batchMessageType
+	}
+	return properties
+}
+
+// handleSchema serves GET /schemas/weather-reading/{version}
+func (di *DataIngestor) handleSchema(c *gin.Context) {
+	if di.schema == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "publishing.schema is disabled",
+		})
+		return
+	}
+	if c.Param("version") != readingSchemaVersion {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("unknown schema version %q, the current one is %s", c.Param("version"), readingSchemaVersion),
+		})
+		return
+	}
+	hash, document := di.schema.current()
+	c.Header("ETag", `"`+hash+`"`)
+	c.Header("X-Schema-Hash", hash)
+	if c.GetHeader("If-None-Match") == `"`+hash+`"` {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/schema+json", document)
+}
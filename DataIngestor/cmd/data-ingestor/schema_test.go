@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// compileSchema compiles a served schema with a JSON Schema 2020-12
+// validator
+func compileSchema(t *testing.T, document []byte) *jsonschema.Schema {
+	t.Helper()
+	id, ok := decodeJSON(t, document).(map[string]interface{})["$id"].(string)
+	require.True(t, ok, "the schema has an $id")
+	compiler := jsonschema.NewCompiler()
+	compiler.Draft = jsonschema.Draft2020
+	require.NoError(t, compiler.AddResource(id, bytes.NewReader(document)))
+	schema, err := compiler.Compile(id)
+	require.NoError(t, err)
+	return schema
+}
+
+// schemaViolations returns the instance locations value breaks schema at
+func schemaViolations(t *testing.T, schema *jsonschema.Schema, value interface{}) []string {
+	t.Helper()
+	err := schema.Validate(value)
+	if err == nil {
+		return nil
+	}
+	var invalid *jsonschema.ValidationError
+	require.ErrorAs(t, err, &invalid)
+	var locations []string
+	var leaves func(e *jsonschema.ValidationError)
+	leaves = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			locations = append(locations, e.InstanceLocation)
+		}
+		for _, cause := range e.Causes {
+			leaves(cause)
+		}
+	}
+	leaves(invalid)
+	return locations
+}
+
+func decodeJSON(t *testing.T, body []byte) interface{} {
+	t.Helper()
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var value interface{}
+	require.NoError(t, dec.Decode(&value))
+	return value
+}
+
+// newSchemaIngestor publishes the readings of an upstream with
+// publishing.schema and the shaping of publishing
+func newSchemaIngestor(t *testing.T, publishing PublishingConfig) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"weather","name":"moscow-1","payload":{"temperature":-5,"humidity":80,"wind_speed":3.5}}]`))
+	}))
+	t.Cleanup(upstream.Close)
+	publishing.Schema = SchemaRefConfig{Enabled: true, BaseURL: "http://data-ingestor:8080/"}
+	config := &Config{
+		API:        APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:      AdminConfig{Token: "letmein"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Publishing: publishing,
+		Transforms: []TransformConfig{{Assign: "dew_point = temperature - (100 - humidity)/5"}},
+		ReadingIDs: ReadingIDConfig{Strategy: idUUIDv7},
+		SchemaDrift: SchemaDriftConfig{Fields: map[string]SchemaField{
+			"temperature": {Type: jsonNumber, Required: true},
+			"humidity":    {Type: jsonNumber},
+		}},
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+// fetchSchema serves the schema a message names in its headers
+func fetchSchema(t *testing.T, ingestor *DataIngestor, message publishedMessage) *httptest.ResponseRecorder {
+	t.Helper()
+	schemaURL, ok := message.Msg.Headers[headerSchemaURL].(string)
+	require.True(t, ok, "the message names its schema")
+	parsed, err := url.Parse(schemaURL)
+	require.NoError(t, err)
+	assert.Equal(t, "data-ingestor:8080", parsed.Host)
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, parsed.Path, nil))
+	return w
+}
+
+func TestSchemaRef_Validate(t *testing.T) {
+	assert.NoError(t, (&Config{}).validateSchemaRef())
+	valid := &Config{Publishing: PublishingConfig{Schema: SchemaRefConfig{Enabled: true, BaseURL: "https://ingest.example.com"}}}
+	assert.NoError(t, valid.validateSchemaRef())
+
+	for name, config := range map[string]*Config{
+		"must be an absolute http":   {Publishing: PublishingConfig{Schema: SchemaRefConfig{Enabled: true}}},
+		`got "data-ingestor:8080"`:   {Publishing: PublishingConfig{Schema: SchemaRefConfig{Enabled: true, BaseURL: "data-ingestor:8080"}}},
+		"publishing.passthrough":     {Publishing: PublishingConfig{Passthrough: true, Schema: SchemaRefConfig{Enabled: true, BaseURL: "http://ingest"}}},
+		"ftp://ingest.example.com/x": {Publishing: PublishingConfig{Schema: SchemaRefConfig{Enabled: true, BaseURL: "ftp://ingest.example.com/x"}}},
+	} {
+		assert.ErrorContains(t, config.validateSchemaRef(), name)
+	}
+}
+
+func TestSchema_PublishedPayloadMatchesTheServedSchema(t *testing.T) {
+	for name, publishing := range map[string]PublishingConfig{
+		"as is":          {},
+		"camelCase":      {FieldNaming: namingCamel, FieldRenames: map[string]string{"windSpeed": "wind"}},
+		"single_message": {FieldNaming: namingSnake, BatchMode: batchModeSingle},
+	} {
+		t.Run(name, func(t *testing.T) {
+			ingestor, channel := newSchemaIngestor(t, publishing)
+			require.Equal(t, outcomePublished, ingestor.ingestOnce(context.Background(), ingestor.sources[0]).Outcome)
+			messages := channel.messages()
+			require.Len(t, messages, 1)
+
+			w := fetchSchema(t, ingestor, messages[0])
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			assert.Equal(t, "application/schema+json", w.Header().Get("Content-Type"))
+			assert.Equal(t, messages[0].Msg.Headers[headerSchemaHash], w.Header().Get("X-Schema-Hash"))
+
+			schema, ok := decodeJSON(t, w.Body.Bytes()).(map[string]interface{})
+			require.True(t, ok)
+			body := decodeJSON(t, messages[0].Msg.Body)
+			assert.Empty(t, schemaViolations(t, compileSchema(t, w.Body.Bytes()), body))
+
+			// The headers are described too
+			headers := schema["x-amqp"].(map[string]interface{})["headers"].(map[string]interface{})
+			for header, value := range messages[0].Msg.Headers {
+				assert.Contains(t, headers, header)
+				if described := headers[header].(map[string]interface{}); described["enum"] != nil {
+					assert.Contains(t, described["enum"], value)
+				}
+			}
+		})
+	}
+}
+
+func TestSchema_ReflectsTheShaping(t *testing.T) {
+	ingestor, _ := newSchemaIngestor(t, PublishingConfig{FieldNaming: namingCamel})
+	hash, document := ingestor.schema.current()
+	schema := decodeJSON(t, document).(map[string]interface{})
+	reading := schema["$defs"].(map[string]interface{})["reading"].(map[string]interface{})
+	payload := reading["properties"].(map[string]interface{})["payload"].(map[string]interface{})
+	fields := payload["properties"].(map[string]interface{})
+	assert.Contains(t, fields, "dewPoint", "set by a transform")
+	assert.Contains(t, fields, "id", "set by reading_ids")
+	assert.Equal(t, []interface{}{"temperature"}, payload["required"])
+	assert.NotContains(t, reading["properties"], "locationMetadata", "without enrichment")
+
+	// A reading that breaks it is caught
+	broken := decodeJSON(t, []byte(`[{"type":"weather","name":"moscow-1","payload":{"humidity":"high"}}]`))
+	assert.ElementsMatch(t, []string{"/0/payload", "/0/payload/humidity"}, schemaViolations(t, compileSchema(t, document), broken),
+		"temperature is missing and humidity is not a number")
+
+	// The hash follows the configuration
+	same, _ := newSchemaIngestor(t, PublishingConfig{FieldNaming: namingCamel})
+	other, _ := newSchemaIngestor(t, PublishingConfig{FieldNaming: namingSnake})
+	sameHash, _ := same.schema.current()
+	otherHash, _ := other.schema.current()
+	assert.Equal(t, hash, sameHash)
+	assert.NotEqual(t, hash, otherHash)
+	assert.True(t, strings.HasPrefix(hash, "sha256:"))
+}
+
+func TestSchema_FollowsTheStagesInEffect(t *testing.T) {
+	ingestor, channel := newSchemaIngestor(t, PublishingConfig{})
+	router := setupRoutes(ingestor)
+	configured, _ := ingestor.schema.current()
+
+	toggle := httptest.NewRequest(http.MethodPatch, "/admin/features/transforms", strings.NewReader(`{"enabled":false}`))
+	toggle.Header.Set("Authorization", "Bearer letmein")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, toggle)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+
+	hash, document := ingestor.schema.current()
+	assert.NotEqual(t, configured, hash, "the schema is described anew")
+	assert.NotContains(t, string(document), "dew_point")
+	require.Equal(t, outcomePublished, ingestor.ingestOnce(context.Background(), ingestor.sources[0]).Outcome)
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, hash, messages[0].Msg.Headers[headerSchemaHash])
+	served := fetchSchema(t, ingestor, messages[0])
+	assert.Equal(t, hash, served.Header().Get("X-Schema-Hash"))
+	assert.Empty(t, schemaViolations(t, compileSchema(t, served.Body.Bytes()), decodeJSON(t, messages[0].Msg.Body)))
+
+	// A reload with nothing changed keeps it
+	ingestor.reloadSchema()
+	reloaded, _ := ingestor.schema.current()
+	assert.Equal(t, hash, reloaded)
+}
+
+func TestSchema_Endpoint(t *testing.T) {
+	ingestor, _ := newSchemaIngestor(t, PublishingConfig{})
+	router := setupRoutes(ingestor)
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := get("/schemas/weather-reading/v1", "")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "http://data-ingestor:8080/schemas/weather-reading/v1", decodeJSON(t, w.Body.Bytes()).(map[string]interface{})["$id"])
+	assert.Equal(t, http.StatusNotModified, get("/schemas/weather-reading/v1", w.Header().Get("ETag")).Code)
+	assert.Equal(t, http.StatusNotFound, get("/schemas/weather-reading/v2", "").Code)
+
+	disabled, _ := newAdminTestIngestor(t)
+	w = httptest.NewRecorder()
+	setupRoutes(disabled).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/schemas/weather-reading/v1", nil))
+	assert.Equal(t, http.StatusConflict, w.Code)
+}
+
+func TestSchema_TenantURL(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Publishing: PublishingConfig{Schema: SchemaRefConfig{Enabled: true, BaseURL: "http://data-ingestor:8080"}},
+		tenant:     "north",
+	})
+	assert.Equal(t, "http://data-ingestor:8080/tenants/north/schemas/weather-reading/v1", ingestor.schema.url)
+}
+
+func TestFieldNamer_KeepsTheXHeaders(t *testing.T) {
+	n := newFieldNamer(PublishingConfig{FieldNaming: namingCamel})
+	headers := n.table(Envelope{InstanceID: "vm-1", SchemaURL: "http://ingest/schemas/weather-reading/v1", SchemaHash: "sha256:00"}.Headers())
+	assert.Equal(t, "vm-1", headers["instanceId"])
+	assert.Equal(t, "sha256:00", headers[headerSchemaHash])
+	assert.Contains(t, headers, headerSchemaURL)
+}
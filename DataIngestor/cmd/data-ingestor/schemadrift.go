@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of schema drift
+const (
+	// driftNewKey is a key the schema does not know
+	driftNewKey = "new_key"
+	// driftMissingKey is an optional key no reading of a response carried
+	driftMissingKey = "missing_key"
+	// driftMissingRequired is a required key a reading did not carry
+	driftMissingRequired = "missing_required_key"
+	// driftTypeChange is a key with another JSON type than expected
+	driftTypeChange = "type_change"
+)
+
+var driftKinds = []string{driftNewKey, driftMissingKey, driftMissingRequired, driftTypeChange}
+
+// Severities of a drift kind
+const (
+	// severityWarn logs and counts the drift
+	severityWarn = "warn"
+	// severityNotReady also fails /ready while the latest response of a
+	// location has the drift
+	severityNotReady = "not_ready"
+)
+
+// JSON types of the schema
+const (
+	jsonString  = "string"
+	jsonNumber  = "number"
+	jsonBoolean = "boolean"
+	jsonObject  = "object"
+	jsonArray   = "array"
+	jsonNull    = "null"
+)
+
+const (
+	defaultDriftLogInterval = time.Hour
+	payloadPrefix           = "payload."
+)
+
+// SchemaDriftConfig compares every JSON response with the schema the
+// ingestor expects and reports the differences
+type SchemaDriftConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// Fields are the payload fields the upstream sends, by name. With
+	// fields, payload keys not among them are new keys; without, only the
+	// keys of SensorData are checked.
+	Fields map[string]SchemaField `yaml:"fields"`
+	// Severity maps a drift kind to warn, the default, or not_ready
+	Severity map[string]string `yaml:"severity"`
+	// LogInterval is how often the same drift is logged again, 1h by default
+	LogInterval Duration `yaml:"log_interval"`
+}
+
+// SchemaField is an expected field and its JSON type: string, number,
+// boolean, object or array
+type SchemaField struct {
+	Type     string `yaml:"type" json:"type"`
+	Required bool   `yaml:"required" json:"required"`
+}
+
+// Validate checks the field types and the severities
+func (c SchemaDriftConfig) Validate() error {
+	for name, field := range c.Fields {
+		if name == "" || strings.Contains(name, ".") {
+			return fmt.Errorf("schema_drift.fields: invalid field name %q", name)
+		}
+		switch field.Type {
+		case jsonString, jsonNumber, jsonBoolean, jsonObject, jsonArray:
+		default:
+			return fmt.Errorf("schema_drift.fields.%s.type must be string, number, boolean, object or array, got %q", name, field.Type)
+		}
+	}
+	for kind, severity := range c.Severity {
+		if !knownDriftKind(kind) {
+			return fmt.Errorf("schema_drift.severity: unknown drift kind %q, use one of %v", kind, driftKinds)
+		}
+		if severity != severityWarn && severity != severityNotReady {
+			return fmt.Errorf("schema_drift.severity.%s must be warn or not_ready, got %q", kind, severity)
+		}
+	}
+	if c.LogInterval < 0 {
+		return fmt.Errorf("schema_drift.log_interval must not be negative")
+	}
+	return nil
+}
+
+func knownDriftKind(kind string) bool {
+	for _, known := range driftKinds {
+		if known == kind {
+			return true
+		}
+	}
+	return false
+}
+
+func (c SchemaDriftConfig) severity(kind string) string {
+	if severity, ok := c.Severity[kind]; ok {
+		return severity
+	}
+	return severityWarn
+}
+
+func (c SchemaDriftConfig) logInterval() time.Duration {
+	if c.LogInterval > 0 {
+		return time.Duration(c.LogInterval)
+	}
+	return defaultDriftLogInterval
+}
+
+// readingSchema returns the keys of SensorData as decoded from JSON. Keys
+// without omitempty are required.
+func readingSchema() map[string]SchemaField {
+	schema := make(map[string]SchemaField)
+	t := reflect.TypeOf(SensorData{})
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		name, options, _ := strings.Cut(tag, ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		schema[name] = SchemaField{Type: jsonTypeOf(t.Field(i).Type), Required: options != "omitempty"}
+	}
+	return schema
+}
+
+// jsonTypeOf names the JSON type a Go type is decoded from
+func jsonTypeOf(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Ptr:
+		return jsonTypeOf(t.Elem())
+	case reflect.String:
+		return jsonString
+	case reflect.Bool:
+		return jsonBoolean
+	case reflect.Slice, reflect.Array:
+		return jsonArray
+	case reflect.Map, reflect.Struct:
+		return jsonObject
+	}
+	return jsonNumber
+}
+
+// jsonType names the JSON type of a raw value
+func jsonType(raw json.RawMessage) string {
+	for _, b := range raw {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		case '"':
+			return jsonString
+		case '{':
+			return jsonObject
+		case '[':
+			return jsonArray
+		case 't', 'f':
+			return jsonBoolean
+		case 'n':
+			return jsonNull
+		}
+		return jsonNumber
+	}
+	return jsonNull
+}
+
+// SchemaDrift is one difference between a response and the schema
+type SchemaDrift struct {
+	Kind  string `json:"kind"`
+	Field string `json:"field"`
+	// Expected and Actual are the JSON types of a type change; Expected is
+	// also set for missing keys
+	Expected string `json:"expected,omitempty"`
+	Actual   string `json:"actual,omitempty"`
+	// Readings is how many readings of the response had the drift
+	Readings int    `json:"readings"`
+	Severity string `json:"severity"`
+}
+
+// signature identifies a drift across responses and locations
+func (d SchemaDrift) signature() string {
+	switch d.Kind {
+	case driftTypeChange:
+		return fmt.Sprintf("%s:%s:%s->%s", d.Kind, d.Field, d.Expected, d.Actual)
+	}
+	return d.Kind + ":" + d.Field
+}
+
+// schemaDrift compares responses with the expected schema and keeps the
+// drift of the latest response of every location. A nil detector checks
+// nothing.
+type schemaDrift struct {
+	config SchemaDriftConfig
+	// schema holds the expected keys by path: the reading keys, and the
+	// payload fields under payload.
+	schema map[string]SchemaField
+	// closedPayload reports payload keys not in the schema as new
+	closedPayload bool
+	metrics       *Metrics
+
+	mu         sync.Mutex
+	locations  map[string]LocationSchema
+	signatures map[string]*DriftSignature
+}
+
+// LocationSchema is the drift of the latest checked response of a location
+type LocationSchema struct {
+	CheckedAt time.Time     `json:"checked_at"`
+	Drifts    []SchemaDrift `json:"drifts"`
+}
+
+// DriftSignature is a drift seen since startup
+type DriftSignature struct {
+	Signature string    `json:"signature"`
+	Kind      string    `json:"kind"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// loggedAt is when the signature was last logged
+	loggedAt time.Time
+}
+
+// newSchemaDrift returns nil unless schema_drift is enabled
+func newSchemaDrift(config SchemaDriftConfig, metrics *Metrics) *schemaDrift {
+	if !config.Enabled {
+		return nil
+	}
+	schema := readingSchema()
+	for name, field := range config.Fields {
+		schema[payloadPrefix+name] = field
+	}
+	return &schemaDrift{
+		config:        config,
+		schema:        schema,
+		closedPayload: len(config.Fields) > 0,
+		metrics:       metrics,
+		locations:     make(map[string]LocationSchema),
+		signatures:    make(map[string]*DriftSignature),
+	}
+}
+
+// compare returns the drift of a JSON response. Bodies that are not an
+// array of objects are left to the decoder to reject.
+func (s *schemaDrift) compare(body []byte) ([]SchemaDrift, bool) {
+	var readings []map[string]json.RawMessage
+	if err := json.Unmarshal(body, &readings); err != nil {
+		return nil, false
+	}
+	counts := make(map[string]*SchemaDrift)
+	add := func(kind, field, expected, actual string) {
+		drift := SchemaDrift{Kind: kind, Field: field, Expected: expected, Actual: actual}
+		key := drift.signature()
+		if counts[key] == nil {
+			drift.Severity = s.config.severity(kind)
+			counts[key] = &drift
+		}
+		counts[key].Readings++
+	}
+	present := make(map[string]int)
+	check := func(path string, raw json.RawMessage, closed bool) {
+		field, ok := s.schema[path]
+		if !ok {
+			if closed {
+				add(driftNewKey, path, "", jsonType(raw))
+			}
+			return
+		}
+		present[path]++
+		if actual := jsonType(raw); actual != field.Type {
+			add(driftTypeChange, path, field.Type, actual)
+		}
+	}
+
+	// payloads counts the readings with an object payload; the fields of
+	// any other payload are reported as its type change
+	payloads := 0
+	for _, reading := range readings {
+		for key, raw := range reading {
+			check(key, raw, true)
+		}
+		var payload map[string]json.RawMessage
+		raw, ok := reading["payload"]
+		isObject := ok && jsonType(raw) == jsonObject && json.Unmarshal(raw, &payload) == nil
+		if isObject {
+			payloads++
+			for key, raw := range payload {
+				check(payloadPrefix+key, raw, s.closedPayload)
+			}
+		}
+		for path, field := range s.schema {
+			if !field.Required {
+				continue
+			}
+			var ok bool
+			if name, inPayload := strings.CutPrefix(path, payloadPrefix); inPayload {
+				if !isObject {
+					continue
+				}
+				_, ok = payload[name]
+			} else {
+				_, ok = reading[path]
+			}
+			if !ok {
+				add(driftMissingRequired, path, field.Type, "")
+			}
+		}
+	}
+	// An optional payload field may be left out of some readings, but not
+	// out of all of them
+	for path, field := range s.schema {
+		if !field.Required && present[path] == 0 && payloads > 0 && strings.HasPrefix(path, payloadPrefix) {
+			add(driftMissingKey, path, field.Type, "")
+		}
+	}
+
+	drifts := make([]SchemaDrift, 0, len(counts))
+	for _, drift := range counts {
+		drifts = append(drifts, *drift)
+	}
+	sort.Slice(drifts, func(i, j int) bool { return drifts[i].signature() < drifts[j].signature() })
+	return drifts, true
+}
+
+// observe compares the response of a location, counts its drift and returns
+// the drift that was not logged within the log interval
+func (s *schemaDrift) observe(location string, body []byte, now time.Time) []SchemaDrift {
+	if s == nil {
+		return nil
+	}
+	drifts, ok := s.compare(body)
+	if !ok {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.locations[location] = LocationSchema{CheckedAt: now, Drifts: drifts}
+	var due []SchemaDrift
+	for _, drift := range drifts {
+		key := drift.signature()
+		s.metrics.SchemaDrift.WithLabelValues(location, drift.Kind, key).Inc()
+		seen := s.signatures[key]
+		if seen == nil {
+			seen = &DriftSignature{Signature: key, Kind: drift.Kind, FirstSeen: now}
+			s.signatures[key] = seen
+		}
+		seen.Count++
+		seen.LastSeen = now
+		if seen.loggedAt.IsZero() || now.Sub(seen.loggedAt) >= s.config.logInterval() {
+			seen.loggedAt = now
+			due = append(due, drift)
+		}
+	}
+	return due
+}
+
+// notReady returns the not_ready drift of the latest response of some
+// location, if any
+func (s *schemaDrift) notReady() (string, SchemaDrift, bool) {
+	if s == nil {
+		return "", SchemaDrift{}, false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	locations := make([]string, 0, len(s.locations))
+	for location := range s.locations {
+		locations = append(locations, location)
+	}
+	sort.Strings(locations)
+	for _, location := range locations {
+		for _, drift := range s.locations[location].Drifts {
+			if drift.Severity == severityNotReady {
+				return location, drift, true
+			}
+		}
+	}
+	return "", SchemaDrift{}, false
+}
+
+// SchemaDriftStatus is the body of GET /debug/schema-drift
+type SchemaDriftStatus struct {
+	Schema     map[string]SchemaField    `json:"schema"`
+	Locations  map[string]LocationSchema `json:"locations"`
+	Signatures []DriftSignature          `json:"signatures"`
+}
+
+func (s *schemaDrift) status() SchemaDriftStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := SchemaDriftStatus{
+		Schema:     s.schema,
+		Locations:  make(map[string]LocationSchema, len(s.locations)),
+		Signatures: make([]DriftSignature, 0, len(s.signatures)),
+	}
+	for location, checked := range s.locations {
+		status.Locations[location] = checked
+	}
+	for _, seen := range s.signatures {
+		status.Signatures = append(status.Signatures, *seen)
+	}
+	sort.Slice(status.Signatures, func(i, j int) bool { return status.Signatures[i].Signature < status.Signatures[j].Signature })
+	return status
+}
+
+// checkSchema compares a JSON response of src with the schema and logs new
+// drift
+func (di *DataIngestor) checkSchema(ctx context.Context, src *source, body []byte) {
+	for _, drift := range di.schemaDrift.observe(src.name, body, time.Now()) {
+		cycleTraceOf(ctx).decodeWarning(TraceNote{
+			Field:  drift.Field,
+			Action: "schema_drift",
+			Detail: fmt.Sprintf("%s: expected %s, got %s in %d readings", drift.Kind, drift.Expected, drift.Actual, drift.Readings),
+		})
+		di.log(logFetch).WithFields(logrus.Fields{
+			"location":  src.name,
+			"kind":      drift.Kind,
+			"field":     drift.Field,
+			"expected":  drift.Expected,
+			"actual":    drift.Actual,
+			"readings":  drift.Readings,
+			"severity":  drift.Severity,
+			"signature": drift.signature(),
+		}).Warn("Upstream schema drift")
+	}
+}
+
+// handleSchemaDrift serves GET /debug/schema-drift
+func (di *DataIngestor) handleSchemaDrift(c *gin.Context) {
+	if di.schemaDrift == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "schema drift detection is disabled",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, di.schemaDrift.status())
+}
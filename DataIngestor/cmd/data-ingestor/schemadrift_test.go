@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testSchemaDrift() *schemaDrift {
+	return newSchemaDrift(SchemaDriftConfig{
+		Enabled: true,
+		Fields: map[string]SchemaField{
+			"humidity":    {Type: jsonNumber, Required: true},
+			"temperature": {Type: jsonNumber},
+			"station":     {Type: jsonString},
+		},
+	}, NewMetrics(prometheus.NewRegistry()))
+}
+
+// driftsOf returns the signatures of the drift of body
+func driftsOf(t *testing.T, s *schemaDrift, body string) []string {
+	t.Helper()
+	drifts, ok := s.compare([]byte(body))
+	require.True(t, ok)
+	signatures := make([]string, len(drifts))
+	for i, drift := range drifts {
+		signatures[i] = drift.signature()
+	}
+	return signatures
+}
+
+func TestSchemaDriftConfig_Validate(t *testing.T) {
+	assert.NoError(t, SchemaDriftConfig{}.Validate())
+	assert.NoError(t, SchemaDriftConfig{
+		Fields:   map[string]SchemaField{"humidity": {Type: jsonNumber}},
+		Severity: map[string]string{driftMissingRequired: severityNotReady},
+	}.Validate())
+
+	for _, config := range []SchemaDriftConfig{
+		{Fields: map[string]SchemaField{"humidity": {Type: "float"}}},
+		{Fields: map[string]SchemaField{"payload.humidity": {Type: jsonNumber}}},
+		{Severity: map[string]string{"renamed": severityWarn}},
+		{Severity: map[string]string{driftNewKey: "page"}},
+		{LogInterval: Duration(-time.Second)},
+	} {
+		assert.Error(t, config.Validate(), "%+v", config)
+	}
+}
+
+func TestReadingSchema_FromSensorData(t *testing.T) {
+	schema := readingSchema()
+	assert.Equal(t, map[string]SchemaField{
+		"type":              {Type: jsonString, Required: true},
+		"name":              {Type: jsonString, Required: true},
+		"payload":           {Type: jsonObject, Required: true},
+		"location_metadata": {Type: jsonObject},
+	}, schema)
+}
+
+func TestSchemaDrift_MatchingResponse(t *testing.T) {
+	s := testSchemaDrift()
+	assert.Empty(t, driftsOf(t, s, `[
+		{"type":"weather","name":"berlin-1","payload":{"humidity":40,"temperature":21.5}},
+		{"type":"weather","name":"berlin-2","payload":{"humidity":41,"station":"tegel"}}
+	]`), "optional fields may be left out of some readings")
+}
+
+func TestSchemaDrift_NewKeys(t *testing.T) {
+	s := testSchemaDrift()
+	assert.Equal(t, []string{"new_key:payload.humid", "new_key:timestamp"},
+		driftsOf(t, s, `[{"type":"weather","name":"b","timestamp":"2024-03-01","payload":{"humidity":40,"humid":40,"temperature":20,"station":"tegel"}}]`))
+
+	// Without payload fields the payload is not checked
+	open := newSchemaDrift(SchemaDriftConfig{Enabled: true}, NewMetrics(prometheus.NewRegistry()))
+	assert.Empty(t, driftsOf(t, open, `[{"type":"weather","name":"b","payload":{"anything":1}}]`))
+}
+
+func TestSchemaDrift_MissingKeys(t *testing.T) {
+	s := testSchemaDrift()
+	// humid replaced humidity, and no reading carries temperature or station
+	drifts, ok := s.compare([]byte(`[
+		{"type":"weather","name":"b1","payload":{"humid":40}},
+		{"type":"weather","payload":{"humid":41}}
+	]`))
+	require.True(t, ok)
+	byKey := make(map[string]SchemaDrift)
+	for _, drift := range drifts {
+		byKey[drift.signature()] = drift
+	}
+	assert.Equal(t, 2, byKey["missing_required_key:payload.humidity"].Readings)
+	assert.Equal(t, 1, byKey["missing_required_key:name"].Readings)
+	assert.Equal(t, jsonNumber, byKey["missing_key:payload.temperature"].Expected)
+	assert.Contains(t, byKey, "missing_key:payload.station")
+	assert.Contains(t, byKey, "new_key:payload.humid")
+	assert.Len(t, byKey, 5)
+}
+
+func TestSchemaDrift_TypeChanges(t *testing.T) {
+	s := testSchemaDrift()
+	drifts, ok := s.compare([]byte(`[
+		{"type":"weather","name":"b1","payload":{"humidity":"40%","temperature":null,"station":"tegel"}},
+		{"type":"weather","name":7,"payload":{"humidity":"41%"}}
+	]`))
+	require.True(t, ok)
+	require.Len(t, drifts, 3)
+	assert.Equal(t, SchemaDrift{Kind: driftTypeChange, Field: "name", Expected: jsonString, Actual: jsonNumber, Readings: 1, Severity: severityWarn}, drifts[0])
+	assert.Equal(t, "type_change:payload.humidity:number->string", drifts[1].signature())
+	assert.Equal(t, 2, drifts[1].Readings)
+	assert.Equal(t, "type_change:payload.temperature:number->null", drifts[2].signature())
+}
+
+func TestSchemaDrift_SkipsNonArrays(t *testing.T) {
+	_, ok := testSchemaDrift().compare([]byte(`{"error":"maintenance"}`))
+	assert.False(t, ok)
+}
+
+func TestSchemaDrift_LogsOncePerSignaturePerInterval(t *testing.T) {
+	s := testSchemaDrift()
+	body := []byte(`[{"type":"weather","name":"b","payload":{"humidity":"40%","temperature":20,"station":"tegel"}}]`)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	assert.Len(t, s.observe("berlin", body, now), 1)
+	assert.Empty(t, s.observe("berlin", body, now.Add(time.Minute)))
+	assert.Empty(t, s.observe("moscow", body, now.Add(30*time.Minute)), "the signature is shared by the locations")
+	assert.Len(t, s.observe("berlin", body, now.Add(time.Hour)), 1)
+
+	status := s.status()
+	require.Len(t, status.Signatures, 1)
+	assert.Equal(t, 4, status.Signatures[0].Count)
+	assert.Equal(t, now, status.Signatures[0].FirstSeen)
+	assert.Equal(t, now.Add(time.Hour), status.Signatures[0].LastSeen)
+	assert.Len(t, status.Locations["moscow"].Drifts, 1)
+
+	// A matching response clears the location's drift, not the history
+	s.observe("berlin", []byte(`[{"type":"weather","name":"b","payload":{"humidity":40,"temperature":20,"station":"tegel"}}]`), now.Add(2*time.Hour))
+	assert.Empty(t, s.status().Locations["berlin"].Drifts)
+	assert.Len(t, s.status().Signatures, 1)
+}
+
+func newDriftIngestor(t *testing.T, body string, severity map[string]string) *DataIngestor {
+	t.Helper()
+	upstream := newUpstream(t, "application/json", body)
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Logging:  LoggingConfig{Level: "error"},
+		SchemaDrift: SchemaDriftConfig{
+			Enabled:  true,
+			Fields:   map[string]SchemaField{"energy": {Type: jsonNumber, Required: true}},
+			Severity: severity,
+		},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	return ingestor
+}
+
+func TestFetch_ReportsSchemaDrift(t *testing.T) {
+	ingestor := newDriftIngestor(t, `[{"type":"energy","name":"meter-1","payload":{"energy":"1kWh","phase":2}}]`, nil)
+	logger, hook := test.NewNullLogger()
+	ingestor.logger = logger
+
+	_, err := ingestor.fetchFrom(context.Background(), ingestor.sources[0])
+	require.NoError(t, err)
+	_, err = ingestor.fetchFrom(context.Background(), ingestor.sources[0])
+	require.NoError(t, err)
+
+	var logged []string
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Upstream schema drift" {
+			logged = append(logged, entry.Data["signature"].(string))
+			assert.Equal(t, defaultSourceName, entry.Data["location"])
+		}
+	}
+	assert.ElementsMatch(t, []string{"new_key:payload.phase", "type_change:payload.energy:number->string"}, logged, "logged once each")
+
+	counter := findMetric(t, ingestor, "data_ingestor_schema_drift_total", map[string]string{
+		"location":  defaultSourceName,
+		"kind":      driftTypeChange,
+		"signature": "type_change:payload.energy:number->string",
+	})
+	assert.Equal(t, 2.0, counter.GetCounter().GetValue())
+}
+
+func TestFetch_ReportsDriftTheDecoderRejects(t *testing.T) {
+	ingestor := newDriftIngestor(t, `[{"type":"energy","name":"meter-1","payload":"1kWh"}]`, nil)
+
+	_, err := ingestor.fetchFrom(context.Background(), ingestor.sources[0])
+	require.Error(t, err)
+	drifts := ingestor.schemaDrift.status().Locations[defaultSourceName].Drifts
+	require.Len(t, drifts, 1, "the fields of a payload that is no object are not checked")
+	assert.Equal(t, "type_change:payload:object->string", drifts[0].signature())
+}
+
+func TestReady_MissingRequiredKeyFlipsReadiness(t *testing.T) {
+	ready := func(ingestor *DataIngestor) (int, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+		var body map[string]interface{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return w.Code, body["checks"].(map[string]interface{})
+	}
+	missing := `[{"type":"energy","name":"meter-1","payload":{"power":1}}]`
+
+	// By default drift only warns
+	ingestor := newDriftIngestor(t, missing, nil)
+	ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	code, checks := ready(ingestor)
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotContains(t, checks, "schema")
+
+	ingestor = newDriftIngestor(t, missing, map[string]string{driftMissingRequired: severityNotReady})
+	ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	code, checks = ready(ingestor)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, "drift: missing_required_key:payload.energy in default", checks["schema"])
+}
+
+func TestSchemaDriftEndpoint(t *testing.T) {
+	get := func(ingestor *DataIngestor) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/debug/schema-drift", nil)
+		req.Header.Set("Authorization", "Bearer letmein")
+		w := httptest.NewRecorder()
+		setupRoutes(ingestor).ServeHTTP(w, req)
+		return w
+	}
+
+	disabled, _ := newAdminTestIngestor(t)
+	assert.Equal(t, http.StatusConflict, get(disabled).Code)
+
+	ingestor := newDriftIngestor(t, `[{"type":"energy","name":"meter-1","payload":{"energy":1,"phase":2}}]`, nil)
+	ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	w := get(ingestor)
+	require.Equal(t, http.StatusOK, w.Code)
+	var status SchemaDriftStatus
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.Equal(t, SchemaField{Type: jsonNumber, Required: true}, status.Schema["payload.energy"])
+	require.Len(t, status.Locations[defaultSourceName].Drifts, 1)
+	assert.Equal(t, driftNewKey, status.Locations[defaultSourceName].Drifts[0].Kind)
+	require.Len(t, status.Signatures, 1)
+	assert.Equal(t, "new_key:payload.phase", status.Signatures[0].Signature)
+}
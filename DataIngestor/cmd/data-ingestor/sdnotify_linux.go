@@ -0,0 +1,59 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotifier sends datagrams to the socket systemd passes in NOTIFY_SOCKET
+type sdNotifier struct {
+	addr *net.UnixAddr
+}
+
+func (n *sdNotifier) Notify(state string) error {
+	conn, err := net.DialUnix("unixgram", nil, n.addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// newSystemdNotifier returns nil when the process was not started by
+// systemd, and the watchdog interval of the unit, 0 when it has none
+func newSystemdNotifier() (lifecycleNotifier, time.Duration, error) {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil, 0, nil
+	}
+	// A leading @ is an abstract socket, which net handles the same way
+	notifier := &sdNotifier{addr: &net.UnixAddr{Name: socket, Net: "unixgram"}}
+
+	watchdog, err := systemdWatchdog(os.Getenv("WATCHDOG_USEC"), os.Getenv("WATCHDOG_PID"), os.Getpid())
+	if err != nil {
+		return nil, 0, err
+	}
+	return notifier, watchdog, nil
+}
+
+// systemdWatchdog parses WATCHDOG_USEC, which only applies to the process
+// named by WATCHDOG_PID when that is set
+func systemdWatchdog(usec, pid string, self int) (time.Duration, error) {
+	if usec == "" {
+		return 0, nil
+	}
+	if pid != "" && pid != strconv.Itoa(self) {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid WATCHDOG_USEC %q", usec)
+	}
+	return time.Duration(n) * time.Microsecond, nil
+}
@@ -0,0 +1,62 @@
+//go:build linux
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemdNotifier(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify.sock")
+	socket, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer socket.Close()
+
+	t.Setenv("NOTIFY_SOCKET", path)
+	t.Setenv("WATCHDOG_USEC", "30000000")
+	t.Setenv("WATCHDOG_PID", "")
+	logger, _ := test.NewNullLogger()
+	l := newLifecycle(DaemonConfig{SystemdNotify: true}, logger)
+	require.NotNil(t, l)
+	assert.Equal(t, 15*time.Second, l.watchdogInterval())
+
+	l.ready()
+	buf := make([]byte, 64)
+	require.NoError(t, socket.SetReadDeadline(time.Now().Add(time.Second)))
+	n, err := socket.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, sdReady, string(buf[:n]))
+}
+
+func TestSystemdNotifier_NotUnderSystemd(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	logger, _ := test.NewNullLogger()
+	assert.Nil(t, newLifecycle(DaemonConfig{SystemdNotify: true}, logger))
+}
+
+func TestSystemdWatchdog(t *testing.T) {
+	self := os.Getpid()
+	tests := []struct {
+		usec, pid string
+		want      time.Duration
+		err       bool
+	}{
+		{"", "", 0, false},
+		{"2000000", "", 2 * time.Second, false},
+		{"2000000", "not-us", 0, false}, // the watchdog of another process
+		{"soon", "", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := systemdWatchdog(tt.usec, tt.pid, self)
+		assert.Equal(t, tt.want, got, tt.usec)
+		assert.Equal(t, tt.err, err != nil, tt.usec)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package main
+
+import "time"
+
+// newSystemdNotifier returns nil: there is no systemd to notify
+func newSystemdNotifier() (lifecycleNotifier, time.Duration, error) {
+	return nil, 0, nil
+}
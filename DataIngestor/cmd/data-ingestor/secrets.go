@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/streadway/amqp"
+)
+
+const (
+	defaultSecretPollInterval = 10 * time.Second
+	// defaultAPIKey is sent as X-Api-Key without api.auth.api_key_file
+	defaultAPIKey = "supersecret"
+)
+
+// What a secret file authenticates, the secret label of
+// data_ingestor_secret_reloads_total
+const (
+	secretRabbitMQ = "rabbitmq"
+	secretAPIKey   = "api_key"
+	secretOAuth2   = "oauth2"
+)
+
+// Results of checking a secret file
+const (
+	secretRotated = "rotated"
+	secretFailed  = "failed"
+)
+
+// secretRef is a reference to the content of a file in rabbitmq.url and
+// rabbitmq.urls, e.g. amqp://ingest:${file:/run/secrets/rabbitmq}@rabbitmq/
+var secretRef = regexp.MustCompile(`\$\{file:([^}]+)\}`)
+
+// SecretsConfig is how the secret files are watched: rabbitmq.password_file,
+// api.auth.api_key_file, api.auth.oauth2.client_secret_file,
+// api.signing.secret_file and the ${file:...} references in the broker URLs
+type SecretsConfig struct {
+	// PollInterval is how often the files are read for a rotation, 10s by
+	// default
+	PollInterval Duration `yaml:"poll_interval"`
+}
+
+func (c SecretsConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval)
+	}
+	return defaultSecretPollInterval
+}
+
+// validateSecrets checks the poll interval and that the broker URLs leave
+// the password to rabbitmq.password_file
+func (c *Config) validateSecrets() error {
+	if c.Secrets.PollInterval < 0 {
+		return fmt.Errorf("secrets.poll_interval must not be negative")
+	}
+	if c.RabbitMQ.PasswordFile == "" {
+		return nil
+	}
+	for _, broker := range c.RabbitMQ.brokers() {
+		u, err := url.Parse(maskSecretRefs(broker))
+		if err != nil {
+			return fmt.Errorf("rabbitmq.password_file: invalid broker URL %s", brokerLabel(broker))
+		}
+		if u.User == nil || u.User.Username() == "" {
+			return fmt.Errorf("rabbitmq.password_file needs the user in the broker URL, e.g. amqp://ingest@rabbitmq:5672/")
+		}
+		if _, ok := u.User.Password(); ok {
+			return fmt.Errorf("rabbitmq.password_file replaces the password of the broker URL %s, leave it out", brokerLabel(broker))
+		}
+	}
+	return nil
+}
+
+// maskSecretRefs replaces the ${file:...} references of s, so it parses as a
+// URL without reading the files
+func maskSecretRefs(s string) string {
+	return secretRef.ReplaceAllString(s, "secret")
+}
+
+// secretFile is the content of a file a credential is read from
+type secretFile struct {
+	// uses are the config fields naming the file, with the kind of secret
+	// each reads from it
+	uses   []secretUse
+	path   string
+	value  []byte
+	sum    [sha256.Size]byte
+	loaded bool
+	// rotated rebuild what the file authenticates, by secret, once the
+	// content changed
+	rotated map[string]func()
+}
+
+// secretUse is a config field naming a secret file
+type secretUse struct {
+	field  string
+	secret string
+}
+
+// fields returns the config fields naming the file, for logs and errors
+func (f *secretFile) fields() string {
+	fields := make([]string, 0, len(f.uses))
+	for _, use := range f.uses {
+		if !contains(fields, use.field) {
+			fields = append(fields, use.field)
+		}
+	}
+	return strings.Join(fields, ", ")
+}
+
+// secrets returns the kinds of secret read from the file, each once
+func (f *secretFile) secrets() []string {
+	var secrets []string
+	for _, use := range f.uses {
+		if !contains(secrets, use.secret) {
+			secrets = append(secrets, use.secret)
+		}
+	}
+	return secrets
+}
+
+// secretFiles holds the secret files and reads them again every
+// secrets.poll_interval, rebuilding what a rotated secret authenticates.
+// Values are only kept here, never in the Config.
+type secretFiles struct {
+	logger   func() *logrus.Entry
+	metrics  *Metrics
+	interval time.Duration
+
+	mu    sync.Mutex
+	files map[string]*secretFile
+	order []string
+}
+
+// newSecretFiles registers the secret files of the configuration of di, nil
+// when there is none
+func newSecretFiles(di *DataIngestor) *secretFiles {
+	config := di.config
+	s := &secretFiles{
+		logger:   func() *logrus.Entry { return di.log(logIngestion) },
+		metrics:  di.metrics,
+		interval: config.Secrets.pollInterval(),
+		files:    make(map[string]*secretFile),
+	}
+	if path := config.RabbitMQ.PasswordFile; path != "" {
+		s.add("rabbitmq.password_file", secretRabbitMQ, path, di.rotateBrokerCredentials)
+	}
+	for _, broker := range config.RabbitMQ.brokers() {
+		for _, ref := range secretRef.FindAllStringSubmatch(broker, -1) {
+			s.add("rabbitmq.url", secretRabbitMQ, ref[1], di.rotateBrokerCredentials)
+		}
+	}
+	if path := config.API.Auth.APIKeyFile; path != "" {
+		// Every request reads the key, so there is nothing to rebuild
+		s.add("api.auth.api_key_file", secretAPIKey, path, nil)
+	}
+	if signing := config.API.Signing; signing.Enabled && signing.SecretFile != "" {
+		// Every request is signed with the current secret
+		s.add("api.signing.secret_file", secretRequestSigning, signing.SecretFile, nil)
+	}
+	if oauth2 := config.API.Auth.OAuth2; oauth2 != nil && oauth2.ClientSecretFile != "" {
+		s.add("api.auth.oauth2.client_secret_file", secretOAuth2, oauth2.ClientSecretFile, di.rotateOAuth2Secret)
+	}
+	if len(s.files) == 0 {
+		return nil
+	}
+	return s
+}
+
+// add registers the file at path for field. A file named by several fields
+// is read once, and counted and logged for all of them.
+func (s *secretFiles) add(field, secret, path string, rotated func()) {
+	file, ok := s.files[path]
+	if !ok {
+		file = &secretFile{path: path, rotated: make(map[string]func())}
+		s.files[path] = file
+		s.order = append(s.order, path)
+	}
+	use := secretUse{field: field, secret: secret}
+	known := false
+	for _, existing := range file.uses {
+		known = known || existing == use
+	}
+	if !known {
+		file.uses = append(file.uses, use)
+	}
+	if rotated != nil {
+		file.rotated[secret] = rotated
+	}
+}
+
+// load reads every file, failing on the first that cannot be read
+func (s *secretFiles) load() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range s.order {
+		if _, err := s.read(s.files[path]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// read reads a file and reports whether its content changed. Callers hold
+// mu.
+func (s *secretFiles) read(file *secretFile) (bool, error) {
+	content, err := os.ReadFile(file.path)
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", file.fields(), err)
+	}
+	value := bytes.TrimSpace(content)
+	sum := sha256.Sum256(value)
+	if file.loaded && sum == file.sum {
+		scrub(content)
+		return false, nil
+	}
+	// The previous value is overwritten rather than left to the collector
+	scrub(file.value)
+	file.value = append([]byte(nil), value...)
+	scrub(content)
+	changed := file.loaded
+	file.sum, file.loaded = sum, true
+	return changed, nil
+}
+
+func scrub(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// value returns the content of the file at path
+func (s *secretFiles) value(path string) (string, error) {
+	if s == nil {
+		return "", fmt.Errorf("secret file %s is not configured", path)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, ok := s.files[path]
+	if !ok {
+		return "", fmt.Errorf("secret file %s is not configured", path)
+	}
+	if !file.loaded {
+		if _, err := s.read(file); err != nil {
+			return "", err
+		}
+	}
+	return string(file.value), nil
+}
+
+// watch checks the files every poll interval until ctx is cancelled
+func (s *secretFiles) watch(ctx context.Context) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.check()
+		}
+	}
+}
+
+// check reads every file again and runs the rebuilds of the rotated ones,
+// once per secret. A file that cannot be read keeps its previous content.
+func (s *secretFiles) check() {
+	rebuilds := make(map[string]func())
+	s.mu.Lock()
+	for _, path := range s.order {
+		file := s.files[path]
+		logger := s.logger().WithFields(logrus.Fields{"field": file.fields(), "path": file.path})
+		changed, err := s.read(file)
+		switch {
+		case err != nil:
+			for _, secret := range file.secrets() {
+				s.metrics.SecretReloads.WithLabelValues(secret, secretFailed).Inc()
+			}
+			logger.WithError(err).Error("Failed to read secret file, keeping the current secret")
+		case changed:
+			for _, secret := range file.secrets() {
+				s.metrics.SecretReloads.WithLabelValues(secret, secretRotated).Inc()
+			}
+			logger.Warn("Secret rotated")
+			for secret, rebuild := range file.rotated {
+				rebuilds[secret] = rebuild
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, rebuild := range rebuilds {
+		rebuild()
+	}
+}
+
+// apiKey returns the X-Api-Key of upstream requests. A key file that cannot
+// be read fails the request rather than sending it without a key; once read,
+// the last good key is kept, see check.
+func (di *DataIngestor) apiKey() (string, error) {
+	path := di.config.API.Auth.APIKeyFile
+	if path == "" {
+		return defaultAPIKey, nil
+	}
+	key, err := di.secrets.value(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the API key: %w", err)
+	}
+	return key, nil
+}
+
+// brokerDialURL returns url with its ${file:...} references and
+// rabbitmq.password_file filled in. The result holds credentials and is
+// only handed to the AMQP client.
+func (di *DataIngestor) brokerDialURL(raw string) (string, error) {
+	var refErr error
+	resolved := secretRef.ReplaceAllStringFunc(raw, func(ref string) string {
+		value, err := di.secrets.value(secretRef.FindStringSubmatch(ref)[1])
+		if err != nil && refErr == nil {
+			refErr = err
+		}
+		return strings.ReplaceAll(url.QueryEscape(value), "+", "%20")
+	})
+	if refErr != nil {
+		return "", refErr
+	}
+	path := di.config.RabbitMQ.PasswordFile
+	if path == "" {
+		return resolved, nil
+	}
+	u, err := url.Parse(resolved)
+	if err != nil || u.User == nil {
+		return "", fmt.Errorf("invalid broker URL %s", brokerLabel(raw))
+	}
+	password, err := di.secrets.value(path)
+	if err != nil {
+		return "", err
+	}
+	u.User = url.UserPassword(u.User.Username(), password)
+	return u.String(), nil
+}
+
+// rotateBrokerCredentials reconnects to the active broker with the rotated
+// credentials, before the broker closes the connection. Messages published
+// meanwhile are confirmed on the previous connection, as with a fail back. A
+// connection that is down already picks them up with the next reconnect.
+func (di *DataIngestor) rotateBrokerCredentials() {
+	di.connMu.Lock()
+	state, index := di.connState, di.broker
+	di.connMu.Unlock()
+	if state != StateReady {
+		return
+	}
+	logger := di.log(logReconnect).WithField("broker", brokerLabel(di.brokerURL(index)))
+	if err := di.switchBroker(index); err != nil {
+		logger.WithError(err).Error("Failed to reconnect to RabbitMQ with the rotated credentials")
+		return
+	}
+	logger.Info("Reconnected to RabbitMQ with the rotated credentials")
+}
+
+// rotateOAuth2Secret builds the client credentials again with the rotated
+// secret; the next request fetches a token with it
+func (di *DataIngestor) rotateOAuth2Secret() {
+	if di.auth == nil {
+		return
+	}
+	if err := di.auth.swap(di.auth.configured()); err != nil {
+		di.log(logFetch).WithError(err).Error("Failed to rebuild the upstream credentials")
+	}
+}
+
+// brokerURIOf parses a broker URL with its secret references masked
+func brokerURIOf(raw string) (amqp.URI, error) {
+	return amqp.ParseURI(maskSecretRefs(raw))
+}
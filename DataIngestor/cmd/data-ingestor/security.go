@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// AMQP headers of signed and encrypted messages. They are added after field
+// naming, so their names never change.
+const (
+	headerSignature       = "signature"
+	headerSignatureKeyID  = "signature_key_id"
+	headerEncryptionKeyID = "encryption_key_id"
+	headerEncryptionNonce = "encryption_nonce"
+)
+
+var (
+	// ErrSignatureInvalid is returned for a message whose signature does not
+	// match its body
+	ErrSignatureInvalid = errors.New("message signature is invalid")
+	// ErrUnknownKey is returned for a message signed or encrypted with a key
+	// id that is not configured
+	ErrUnknownKey = errors.New("unknown key id")
+)
+
+// SecurityConfig signs and encrypts published messages for consumers across a
+// trust boundary. The same section holds the keys consumers verify and
+// decrypt with; a key id is only used to publish when it is set as key_id.
+type SecurityConfig struct {
+	Signing    SigningConfig    `yaml:"signing"`
+	Encryption EncryptionConfig `yaml:"encryption"`
+}
+
+// SigningConfig configures Ed25519 signatures over every message as it is
+// published, after compression and encryption
+type SigningConfig struct {
+	// KeyID enables signing with PrivateKey and is sent with the signature
+	KeyID      string    `yaml:"key_id"`
+	PrivateKey KeySource `yaml:"private_key"`
+	// PublicKeys by key id are what signatures are verified against. Once
+	// any is set, unsigned messages are rejected.
+	PublicKeys map[string]KeySource `yaml:"public_keys"`
+}
+
+// EncryptionConfig configures AES-GCM encryption of message bodies
+type EncryptionConfig struct {
+	// KeyID enables encryption with Keys[KeyID]
+	KeyID string `yaml:"key_id"`
+	// Keys by key id are 16, 24 or 32 bytes; every one of them can decrypt
+	Keys map[string]KeySource `yaml:"keys"`
+}
+
+// KeySource is a base64 key read from exactly one of Key, KeyEnv and KeyFile
+type KeySource struct {
+	Key     string `yaml:"key"`
+	KeyEnv  string `yaml:"key_env"`
+	KeyFile string `yaml:"key_file"`
+}
+
+func (k KeySource) validate() error {
+	sources := 0
+	for _, source := range []string{k.Key, k.KeyEnv, k.KeyFile} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("set exactly one of key, key_env and key_file")
+	}
+	return nil
+}
+
+// load resolves and decodes the key
+func (k KeySource) load() ([]byte, error) {
+	encoded := k.Key
+	switch {
+	case k.KeyEnv != "":
+		value, ok := os.LookupEnv(k.KeyEnv)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %s is not set", k.KeyEnv)
+		}
+		encoded = value
+	case k.KeyFile != "":
+		value, err := os.ReadFile(k.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		encoded = string(value)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("key is not valid base64: %w", err)
+	}
+	return key, nil
+}
+
+func (c SecurityConfig) enabled() bool {
+	return c.Signing.KeyID != "" || len(c.Signing.PublicKeys) > 0 ||
+		c.Encryption.KeyID != "" || len(c.Encryption.Keys) > 0
+}
+
+// Validate checks that every key has one source and that the key ids used to
+// publish are configured. Keys are only read when the ingestor starts.
+func (c SecurityConfig) Validate() error {
+	if c.Signing.KeyID != "" {
+		if err := c.Signing.PrivateKey.validate(); err != nil {
+			return fmt.Errorf("publishing.security.signing.private_key: %w", err)
+		}
+	}
+	for _, id := range sortedKeyIDs(c.Signing.PublicKeys) {
+		if err := c.Signing.PublicKeys[id].validate(); err != nil {
+			return fmt.Errorf("publishing.security.signing.public_keys.%s: %w", id, err)
+		}
+	}
+	for _, id := range sortedKeyIDs(c.Encryption.Keys) {
+		if err := c.Encryption.Keys[id].validate(); err != nil {
+			return fmt.Errorf("publishing.security.encryption.keys.%s: %w", id, err)
+		}
+	}
+	if id := c.Encryption.KeyID; id != "" {
+		if _, ok := c.Encryption.Keys[id]; !ok {
+			return fmt.Errorf("publishing.security.encryption.key_id %q is not in publishing.security.encryption.keys", id)
+		}
+	}
+	return nil
+}
+
+func sortedKeyIDs(keys map[string]KeySource) []string {
+	ids := make([]string, 0, len(keys))
+	for id := range keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// messageSecurity signs and encrypts published bodies, and verifies and
+// decrypts consumed ones
+type messageSecurity struct {
+	signKeyID  string
+	signKey    ed25519.PrivateKey
+	verifyKeys map[string]ed25519.PublicKey
+
+	encryptKeyID string
+	ciphers      map[string]cipher.AEAD
+	// nonces replaces crypto/rand for the test vectors
+	nonces io.Reader
+}
+
+// newMessageSecurity loads the configured keys. It returns nil when no key is
+// configured.
+func newMessageSecurity(config SecurityConfig) (*messageSecurity, error) {
+	if !config.enabled() {
+		return nil, nil
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	s := &messageSecurity{
+		signKeyID:    config.Signing.KeyID,
+		verifyKeys:   make(map[string]ed25519.PublicKey),
+		encryptKeyID: config.Encryption.KeyID,
+		ciphers:      make(map[string]cipher.AEAD),
+	}
+	if s.signKeyID != "" {
+		key, err := config.Signing.PrivateKey.load()
+		if err != nil {
+			return nil, fmt.Errorf("publishing.security.signing.private_key: %w", err)
+		}
+		switch len(key) {
+		case ed25519.SeedSize:
+			s.signKey = ed25519.NewKeyFromSeed(key)
+		case ed25519.PrivateKeySize:
+			s.signKey = ed25519.PrivateKey(key)
+		default:
+			return nil, fmt.Errorf("publishing.security.signing.private_key must be a %d byte seed or a %d byte key, got %d bytes",
+				ed25519.SeedSize, ed25519.PrivateKeySize, len(key))
+		}
+	}
+	for id, source := range config.Signing.PublicKeys {
+		key, err := source.load()
+		if err == nil && len(key) != ed25519.PublicKeySize {
+			err = fmt.Errorf("must be %d bytes, got %d", ed25519.PublicKeySize, len(key))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("publishing.security.signing.public_keys.%s: %w", id, err)
+		}
+		s.verifyKeys[id] = ed25519.PublicKey(key)
+	}
+	for id, source := range config.Encryption.Keys {
+		key, err := source.load()
+		if err != nil {
+			return nil, fmt.Errorf("publishing.security.encryption.keys.%s: %w", id, err)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("publishing.security.encryption.keys.%s: %w", id, err)
+		}
+		if s.ciphers[id], err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("publishing.security.encryption.keys.%s: %w", id, err)
+		}
+	}
+	return s, nil
+}
+
+// sealVersion starts the bytes seal authenticates, so a later scheme can't be
+// mistaken for this one
+const sealVersion = "data-ingestor-seal-v1"
+
+// sealedContext is what the signature and the AES-GCM tag cover next to the
+// body: the content encoding and the key id and nonce headers. None of them
+// can be swapped or stripped on the way without the message failing to open.
+func sealedContext(encoding string, headers amqp.Table) []byte {
+	field := func(name string) string {
+		value, _ := headers[name].(string)
+		return value
+	}
+	return []byte(strings.Join([]string{
+		sealVersion,
+		encoding,
+		field(headerEncryptionKeyID),
+		field(headerEncryptionNonce),
+		field(headerSignatureKeyID),
+	}, "\n"))
+}
+
+// signedBytes is what the signature covers: the sealed context and the body
+// as it is published
+func signedBytes(encoding string, headers amqp.Table, body []byte) []byte {
+	signed := append(sealedContext(encoding, headers), '\n')
+	return append(signed, body...)
+}
+
+// seal encrypts body, the message as encoded for the wire, and then signs the
+// result, so the signature says nothing about the plaintext. The key ids,
+// nonce and signature are added to headers.
+func (s *messageSecurity) seal(encoding string, body []byte, headers amqp.Table) ([]byte, amqp.Table, error) {
+	if s == nil || (s.signKey == nil && s.encryptKeyID == "") {
+		return body, headers, nil
+	}
+	if headers == nil {
+		headers = amqp.Table{}
+	}
+	if s.signKey != nil {
+		headers[headerSignatureKeyID] = s.signKeyID
+	}
+	if s.encryptKeyID != "" {
+		aead := s.ciphers[s.encryptKeyID]
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(s.random(), nonce); err != nil {
+			return nil, nil, fmt.Errorf("failed to encrypt message: %w", err)
+		}
+		headers[headerEncryptionKeyID] = s.encryptKeyID
+		headers[headerEncryptionNonce] = base64.StdEncoding.EncodeToString(nonce)
+		body = aead.Seal(nil, nonce, body, sealedContext(encoding, headers))
+	}
+	if s.signKey != nil {
+		headers[headerSignature] = base64.StdEncoding.EncodeToString(ed25519.Sign(s.signKey, signedBytes(encoding, headers, body)))
+	}
+	return body, headers, nil
+}
+
+func (s *messageSecurity) random() io.Reader {
+	if s.nonces != nil {
+		return s.nonces
+	}
+	return rand.Reader
+}
+
+// open reverses seal and the compression in between: it verifies the
+// signature of body as received, decrypts it and decodes it with encoding. A
+// nil messageSecurity still decodes plain messages.
+func (s *messageSecurity) open(encoding string, body []byte, headers amqp.Table) ([]byte, error) {
+	if s != nil && len(s.verifyKeys) > 0 {
+		if err := s.verify(encoding, body, headers); err != nil {
+			return nil, err
+		}
+	}
+	if id, ok := headers[headerEncryptionKeyID].(string); ok {
+		var aead cipher.AEAD
+		if s != nil {
+			aead = s.ciphers[id]
+		}
+		if aead == nil {
+			return nil, fmt.Errorf("%w: encrypted with %q", ErrUnknownKey, id)
+		}
+		nonce, err := headerBytes(headers, headerEncryptionNonce)
+		if err != nil {
+			return nil, err
+		}
+		if len(nonce) != aead.NonceSize() {
+			return nil, fmt.Errorf("invalid %s header", headerEncryptionNonce)
+		}
+		if body, err = aead.Open(nil, nonce, body, sealedContext(encoding, headers)); err != nil {
+			return nil, fmt.Errorf("failed to decrypt message with %q: %w", id, err)
+		}
+	}
+	return decodeBody(encoding, body)
+}
+
+// verify checks the signature of a message before anything else is done with
+// its body
+func (s *messageSecurity) verify(encoding string, body []byte, headers amqp.Table) error {
+	id, ok := headers[headerSignatureKeyID].(string)
+	if !ok {
+		return fmt.Errorf("%w: the message is not signed", ErrSignatureInvalid)
+	}
+	key, ok := s.verifyKeys[id]
+	if !ok {
+		return fmt.Errorf("%w: signed with %q", ErrUnknownKey, id)
+	}
+	signature, err := headerBytes(headers, headerSignature)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, signedBytes(encoding, headers, body), signature) {
+		return fmt.Errorf("%w: signed with %q", ErrSignatureInvalid, id)
+	}
+	return nil
+}
+
+func headerBytes(headers amqp.Table, name string) ([]byte, error) {
+	encoded, _ := headers[name].(string)
+	value, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(value) == 0 {
+		return nil, fmt.Errorf("invalid %s header", name)
+	}
+	return value, nil
+}
+
+// seal applies the configured signing and encryption to one message. It fails
+// every publish when the keys could not be loaded, rather than publishing in
+// the clear.
+func (di *DataIngestor) seal(encoding string, body []byte, headers amqp.Table) ([]byte, amqp.Table, error) {
+	if di.securityErr != nil {
+		return nil, nil, fmt.Errorf("publishing.security: %w", di.securityErr)
+	}
+	return di.security.seal(encoding, body, headers)
+}
+
+// runKeygen implements the keygen subcommand, which prints a new key for
+// publishing.security in base64
+func runKeygen(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	kind := flags.String("type", "ed25519", "ed25519 for a signing key pair, or aes for an encryption key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	out, err := generateKey(*kind)
+	if err != nil {
+		return err
+	}
+	fmt.Print(out)
+	return nil
+}
+
+func generateKey(kind string) (string, error) {
+	encode := base64.StdEncoding.EncodeToString
+	switch kind {
+	case "ed25519":
+		public, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("private_key: %s\npublic_key: %s\n", encode(private.Seed()), encode(public)), nil
+	case "aes":
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("key: %s\n", encode(key)), nil
+	}
+	return "", fmt.Errorf("-type must be ed25519 or aes, got %q", kind)
+}
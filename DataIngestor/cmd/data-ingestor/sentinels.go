@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+)
+
+// repairMissing is the trace action of a sentinel set to null
+const repairMissing = "missing"
+
+// SentinelRule is how the upstream encodes a missing value of a payload
+// field, e.g. -999 for a broken temperature sensor: listed values, numbers or
+// strings, and ranges of numbers, ends included
+type SentinelRule struct {
+	Values []interface{} `yaml:"values"`
+	Ranges []Bounds      `yaml:"ranges"`
+}
+
+// Validate checks the values and every range
+func (r SentinelRule) Validate() error {
+	for _, value := range r.Values {
+		if _, ok := value.(string); ok {
+			continue
+		}
+		if _, ok := toFloat(value); !ok {
+			return fmt.Errorf("value %v is not a number or a string", value)
+		}
+	}
+	for i, b := range r.Ranges {
+		if err := b.Validate(); err != nil {
+			return fmt.Errorf("ranges[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (r SentinelRule) empty() bool {
+	return len(r.Values) == 0 && len(r.Ranges) == 0
+}
+
+// matches reports whether value is one of the sentinels. Numbers compare by
+// value whatever their type, strings exactly.
+func (r SentinelRule) matches(value interface{}) bool {
+	number, numeric := toFloat(value)
+	text, isText := value.(string)
+	for _, sentinel := range r.Values {
+		if s, ok := sentinel.(string); ok {
+			if isText && s == text {
+				return true
+			}
+			continue
+		}
+		if n, ok := toFloat(sentinel); ok && numeric && n == number {
+			return true
+		}
+	}
+	if !numeric {
+		return false
+	}
+	for _, b := range r.Ranges {
+		if b.contains(number) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateSentinelMap checks the rules in field order so errors are stable.
+// An empty rule only makes sense to lift the global one for a location.
+func validateSentinelMap(sentinels map[string]SentinelRule, allowEmpty bool) error {
+	fields := make([]string, 0, len(sentinels))
+	for field := range sentinels {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		rule := sentinels[field]
+		if rule.empty() && !allowEmpty {
+			return fmt.Errorf("%s: values or ranges is required", field)
+		}
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// sentinelsEnabled reports whether any sentinel can apply
+func (di *DataIngestor) sentinelsEnabled() bool {
+	return len(di.config.Validation.Sentinels) > 0 || di.enricher != nil
+}
+
+// sentinel returns the rule for field of a reading at a location with local
+// sentinels, and the set it came from. A location rule replaces the global
+// one as a whole.
+func (di *DataIngestor) sentinel(local map[string]SentinelRule, field string) (SentinelRule, string, bool) {
+	if rule, ok := local[field]; ok {
+		return rule, boundsLocation, true
+	}
+	rule, ok := di.config.Validation.Sentinels[field]
+	return rule, boundsGlobal, ok
+}
+
+// clearSentinels sets the payload fields holding a sentinel to null, so the
+// interceptors, transforms, validation and quality see them as missing. Each
+// one is counted and traced as a repair.
+func (di *DataIngestor) clearSentinels(ctx context.Context, data WeatherData) WeatherData {
+	trace := cycleTraceOf(ctx)
+	global := di.config.Validation.Sentinels
+	for i, reading := range data {
+		var local map[string]SentinelRule
+		if di.enricher != nil {
+			if meta, ok := di.enricher.Lookup(reading.Location()); ok && meta.Validation != nil {
+				local = meta.Validation.Sentinels
+			}
+		}
+		if len(global) == 0 && len(local) == 0 {
+			continue
+		}
+
+		fields := make([]string, 0, len(reading.Payload))
+		for field := range reading.Payload {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+
+		cloned := false
+		for _, field := range fields {
+			value := reading.Payload[field]
+			if value == nil {
+				continue
+			}
+			rule, source, ok := di.sentinel(local, field)
+			if !ok || !rule.matches(value) {
+				continue
+			}
+			if !cloned {
+				reading, cloned = reading.clone(), true
+			}
+			reading.Payload[field] = nil
+			di.logger.WithFields(logrus.Fields{
+				"location":  reading.Location(),
+				"field":     field,
+				"value":     value,
+				"sentinels": source,
+			}).Debug("Sentinel set to null")
+			di.metrics.SentinelValues.WithLabelValues(field, source).Inc()
+			trace.repaired(TraceNote{
+				Reading: reading.Name,
+				Field:   field,
+				Action:  repairMissing,
+				Detail:  fmt.Sprintf("%v is a %s sentinel", value, source),
+			})
+		}
+		data[i] = reading
+	}
+	return data
+}
+
+// nullable reports whether a sentinel can set field to null. The metadata
+// file is reloaded at runtime, so with one any field can be.
+func (c *Config) nullable(field string) bool {
+	_, ok := c.Validation.Sentinels[field]
+	return ok || c.Enrichment.MetadataFile != ""
+}
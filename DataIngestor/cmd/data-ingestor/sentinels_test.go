@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"data-ingestor/pkg/hooks"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSentinelMetadataYAML = `
+locations:
+  moscow:
+    validation:
+      sentinels:
+        temperature: {values: [-9999]}
+  berlin:
+    validation:
+      sentinels:
+        pressure: {}
+        humidity: {values: ["N/A"], ranges: [{min: 200}]}
+  paris:
+    lat: 48.86
+`
+
+// newSentinelIngestor returns an ingestor with global sentinels of -999 for
+// temperature and 0 for pressure, the location overrides above and
+// temperature bounds of -60 to 50
+func newSentinelIngestor(t *testing.T) *DataIngestor {
+	t.Helper()
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.config.Validation = ValidationConfig{
+		Bounds: map[string]Bounds{"temperature": {Min: bound(-60), Max: bound(50)}},
+		Sentinels: map[string]SentinelRule{
+			"temperature": {Values: []interface{}{-999}},
+			"pressure":    {Values: []interface{}{0, "-"}},
+		},
+	}
+	enricher, _, _ := newTestEnricher(t, "locations.yaml", testSentinelMetadataYAML)
+	ingestor.enricher = enricher
+	return ingestor
+}
+
+func TestClearSentinels(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		location string
+		payload  map[string]interface{}
+		// want is the payload prepared, nil when validation dropped it
+		want    map[string]interface{}
+		cleared map[string]string
+	}{
+		{
+			name:     "global",
+			location: "paris",
+			payload:  map[string]interface{}{"temperature": -999.0, "pressure": 0.0, "humidity": 80.0},
+			want:     map[string]interface{}{"temperature": nil, "pressure": nil, "humidity": 80.0},
+			cleared:  map[string]string{"temperature": boundsGlobal, "pressure": boundsGlobal},
+		},
+		{
+			name:     "global string",
+			location: "paris",
+			payload:  map[string]interface{}{"pressure": "-"},
+			want:     map[string]interface{}{"pressure": nil},
+			cleared:  map[string]string{"pressure": boundsGlobal},
+		},
+		{
+			name:     "not a sentinel",
+			location: "paris",
+			payload:  map[string]interface{}{"temperature": -5.0, "pressure": 1013.0},
+			want:     map[string]interface{}{"temperature": -5.0, "pressure": 1013.0},
+		},
+		{
+			name:     "unknown location keeps the global ones",
+			location: "atlantis",
+			payload:  map[string]interface{}{"temperature": -999.0},
+			want:     map[string]interface{}{"temperature": nil},
+			cleared:  map[string]string{"temperature": boundsGlobal},
+		},
+		{
+			name:     "location replaces the global value",
+			location: "moscow",
+			payload:  map[string]interface{}{"temperature": -9999.0, "pressure": 0.0},
+			want:     map[string]interface{}{"temperature": nil, "pressure": nil},
+			cleared:  map[string]string{"temperature": boundsLocation, "pressure": boundsGlobal},
+		},
+		{
+			// -999 is not a sentinel of this firmware, so it is out of range
+			name:     "location replaced value falls to the bounds",
+			location: "moscow",
+			payload:  map[string]interface{}{"temperature": -999.0},
+		},
+		{
+			name:     "empty location rule lifts the global one",
+			location: "berlin",
+			payload:  map[string]interface{}{"pressure": 0.0},
+			want:     map[string]interface{}{"pressure": 0.0},
+		},
+		{
+			name:     "location range and string",
+			location: "berlin",
+			payload:  map[string]interface{}{"humidity": 250.0, "temperature": -999.0},
+			want:     map[string]interface{}{"humidity": nil, "temperature": nil},
+			cleared:  map[string]string{"humidity": boundsLocation, "temperature": boundsGlobal},
+		},
+		{
+			name:     "location string",
+			location: "berlin",
+			payload:  map[string]interface{}{"humidity": "N/A"},
+			want:     map[string]interface{}{"humidity": nil},
+			cleared:  map[string]string{"humidity": boundsLocation},
+		},
+		{
+			// The sentinel is below the bounds, but missing is not out of range
+			name:     "sentinel out of the bounds is kept as null",
+			location: "paris",
+			payload:  map[string]interface{}{"temperature": -999.0, "humidity": 60.0},
+			want:     map[string]interface{}{"temperature": nil, "humidity": 60.0},
+			cleared:  map[string]string{"temperature": boundsGlobal},
+		},
+		{
+			name:     "other values out of the bounds are still dropped",
+			location: "paris",
+			payload:  map[string]interface{}{"temperature": -998.0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ingestor := newSentinelIngestor(t)
+			ingestor.cycleTraces = newTraceStore(DebugConfig{Enabled: true, Trace: true}, StreamConfig{})
+			trace := ingestor.cycleTraces.start("c-1", tc.location, triggerPoll)
+			ctx := withCycleTrace(context.Background(), trace)
+
+			payload := make(map[string]interface{}, len(tc.payload))
+			for field, value := range tc.payload {
+				payload[field] = value
+			}
+			prepared := ingestor.prepareReadings(ctx, WeatherData{weatherReading(tc.location, payload)})
+			if tc.want == nil {
+				assert.Empty(t, prepared)
+				assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ValidationFailures.WithLabelValues("temperature", boundsGlobal)))
+			} else {
+				require.Len(t, prepared, 1)
+				assert.Equal(t, tc.want, prepared[0].Payload)
+				assert.Zero(t, testutil.CollectAndCount(ingestor.metrics.ValidationFailures))
+			}
+			assert.Equal(t, tc.payload, payload, "the decoded reading is left as it came")
+
+			record := trace.snapshot()
+			require.Len(t, record.Repairs, len(tc.cleared))
+			for _, note := range record.Repairs {
+				assert.Equal(t, repairMissing, note.Action)
+				assert.Equal(t, tc.location, note.Reading)
+				assert.Contains(t, note.Detail, tc.cleared[note.Field]+" sentinel")
+				assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.SentinelValues.WithLabelValues(note.Field, tc.cleared[note.Field])))
+			}
+		})
+	}
+}
+
+func TestSentinels_PublishedAsNullAndCountedMissing(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"weather","name":"moscow-1","payload":{"temperature":-999,"pressure":1013}}]`))
+	}))
+	defer upstream.Close()
+	ingestor := NewDataIngestor(&Config{
+		API:        APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:   RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Validation: ValidationConfig{Sentinels: map[string]SentinelRule{"temperature": {Values: []interface{}{-999}}}},
+		Quality:    QualityConfig{Enabled: true, RequiredFields: []string{"temperature", "pressure"}},
+	}, WithReadingInterceptor("completeness", hooks.CompletenessScore{Fields: []string{"temperature", "pressure"}, Field: "completeness"}))
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	require.Equal(t, outcomePublished, ingestor.ingestOnce(context.Background(), ingestor.sources[0]).Outcome)
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	var published []map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &published))
+	var payload map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(published[0]["payload"], &payload))
+	assert.Equal(t, "null", string(payload["temperature"]), "published as null, not left out")
+	assert.Equal(t, "0.5", string(payload["completeness"]), "the interceptors see it missing")
+	assert.EqualValues(t, 80, messages[0].Msg.Headers["quality_score"], "quality counts it missing")
+}
+
+func TestSentinels_Validate(t *testing.T) {
+	assert.NoError(t, ValidationConfig{Sentinels: map[string]SentinelRule{
+		"temperature": {Values: []interface{}{-999, -999.9}},
+		"status":      {Values: []interface{}{"N/A"}},
+		"pressure":    {Ranges: []Bounds{{Max: bound(0)}}},
+	}}.Validate())
+	for want, rule := range map[string]SentinelRule{
+		"temperature: values or ranges is required":         {},
+		"temperature: value true is not a number":           {Values: []interface{}{true}},
+		"temperature: ranges[0]: min or max is required":    {Ranges: []Bounds{{}}},
+		"temperature: ranges[0]: min 1 is greater than max": {Ranges: []Bounds{{Min: bound(1), Max: bound(0)}}},
+	} {
+		err := ValidationConfig{Sentinels: map[string]SentinelRule{"temperature": rule}}.Validate()
+		require.Error(t, err, want)
+		assert.Contains(t, err.Error(), "validation.sentinels."+want)
+	}
+	assert.NoError(t, (&LocationValidation{Sentinels: map[string]SentinelRule{"temperature": {}}}).Validate(), "lifts the global one")
+	assert.ErrorContains(t, (&Config{
+		Publishing: PublishingConfig{Passthrough: true},
+		Validation: ValidationConfig{Sentinels: map[string]SentinelRule{"temperature": {Values: []interface{}{-999}}}},
+	}).Validate(), "validation sentinels")
+}
+
+func TestSentinels_NullableInTheSchema(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		Logging:    LoggingConfig{Level: "panic"},
+		Validation: ValidationConfig{Sentinels: map[string]SentinelRule{"temperature": {Values: []interface{}{-999}}}},
+		SchemaDrift: SchemaDriftConfig{Fields: map[string]SchemaField{
+			"temperature": {Type: jsonNumber},
+			"humidity":    {Type: jsonNumber},
+		}},
+	})
+	reading := ingestor.readingJSONSchema("x", nil)["$defs"].(map[string]interface{})["reading"].(map[string]interface{})
+	fields := reading["properties"].(map[string]interface{})["payload"].(map[string]interface{})["properties"].(map[string]interface{})
+	assert.Equal(t, []string{jsonNumber, jsonNull}, fields["temperature"].(map[string]interface{})["type"])
+	assert.Equal(t, jsonNumber, fields["humidity"].(map[string]interface{})["type"])
+}
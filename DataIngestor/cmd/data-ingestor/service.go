@@ -0,0 +1,78 @@
+package main
+
+import "context"
+
+// serviceControl is a control request of the Windows service manager
+type serviceControl int
+
+const (
+	controlInterrogate serviceControl = iota
+	controlStop
+	controlShutdown
+)
+
+// serviceState is a state reported to the Windows service manager
+type serviceState int
+
+const (
+	serviceStartPending serviceState = iota
+	serviceRunning
+	serviceStopPending
+	serviceStopped
+)
+
+func (s serviceState) String() string {
+	switch s {
+	case serviceStartPending:
+		return "start pending"
+	case serviceRunning:
+		return "running"
+	case serviceStopPending:
+		return "stop pending"
+	default:
+		return "stopped"
+	}
+}
+
+// serveControls runs run until it returns. Stop and shutdown requests cancel
+// its context, which drains the same way as SIGTERM. Every state, and the
+// current one on interrogation, is reported to status.
+func serveControls(controls <-chan serviceControl, status func(serviceState), run func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	state := serviceStartPending
+	report := func(to serviceState) {
+		state = to
+		status(state)
+	}
+	report(serviceStartPending)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx)
+	}()
+	report(serviceRunning)
+
+	for {
+		select {
+		case err := <-done:
+			report(serviceStopped)
+			return err
+		case control, ok := <-controls:
+			if !ok {
+				controls = nil
+				continue
+			}
+			switch control {
+			case controlInterrogate:
+				status(state)
+			case controlStop, controlShutdown:
+				if state != serviceStopPending {
+					report(serviceStopPending)
+					cancel()
+				}
+			}
+		}
+	}
+}
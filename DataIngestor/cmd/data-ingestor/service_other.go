@@ -0,0 +1,10 @@
+//go:build !windows
+
+package main
+
+import "context"
+
+// runService returns false: there is no Windows service manager
+func runService(name string, run func(ctx context.Context) error) (bool, error) {
+	return false, nil
+}
@@ -0,0 +1,88 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"golang.org/x/sys/windows/svc"
+)
+
+// windowsService adapts the service manager's requests to serveControls
+type windowsService struct {
+	run func(ctx context.Context) error
+	err error
+}
+
+func (s *windowsService) Execute(args []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	controls := make(chan serviceControl)
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		for {
+			select {
+			case <-stopped:
+				return
+			case request := <-requests:
+				var control serviceControl
+				switch request.Cmd {
+				case svc.Interrogate:
+					control = controlInterrogate
+				case svc.Stop:
+					control = controlStop
+				case svc.Shutdown:
+					control = controlShutdown
+				default:
+					continue
+				}
+				select {
+				case controls <- control:
+				case <-stopped:
+					return
+				}
+			}
+		}
+	}()
+
+	s.err = serveControls(controls, func(state serviceState) {
+		changes <- windowsStatus(state)
+	}, s.run)
+	if s.err != nil {
+		return false, 1
+	}
+	return false, 0
+}
+
+// windowsStatus is the status reported for a state. The drain is given the
+// HTTP shutdown timeout plus the time to stop polling.
+func windowsStatus(state serviceState) svc.Status {
+	switch state {
+	case serviceStartPending:
+		return svc.Status{State: svc.StartPending}
+	case serviceRunning:
+		return svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	case serviceStopPending:
+		return svc.Status{State: svc.StopPending, WaitHint: uint32((2 * shutdownTimeout).Milliseconds())}
+	default:
+		return svc.Status{State: svc.Stopped}
+	}
+}
+
+// runService runs run under the Windows service manager. It returns false
+// without running anything when the process was not started by it, e.g.
+// from a console.
+func runService(name string, run func(ctx context.Context) error) (bool, error) {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		return false, fmt.Errorf("failed to detect the Windows service manager: %w", err)
+	}
+	if !isService {
+		return false, nil
+	}
+	service := &windowsService{run: run}
+	if err := svc.Run(name, service); err != nil {
+		return true, fmt.Errorf("failed to run as Windows service %s: %w", name, err)
+	}
+	return true, service.err
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ShardingConfig splits the locations between replicas without electing a
+// leader. Every replica is given the same membership, either as a count with
+// its own index or as an ordered list of member names, and polls only the
+// locations it owns. Ownership is decided by rendezvous hashing, so changing
+// the membership moves only the locations of the members added or removed.
+type ShardingConfig struct {
+	// Total is the number of replicas and Index this replica's, from 0
+	Index int `yaml:"index"`
+	Total int `yaml:"total"`
+	// Members names the replicas instead of Total, e.g. the pod names of a
+	// StatefulSet. Member is this replica's name, by default the instance_id
+	// or else the host name.
+	Members []string `yaml:"members"`
+	Member  string   `yaml:"member"`
+}
+
+func (c ShardingConfig) enabled() bool {
+	return c.Total > 0 || len(c.Members) > 0
+}
+
+// Validate checks that the membership is complete and includes this replica
+func (c ShardingConfig) Validate(instanceID string) error {
+	if !c.enabled() {
+		if c.Index != 0 || c.Member != "" {
+			return fmt.Errorf("sharding.index and sharding.member require sharding.total or sharding.members")
+		}
+		return nil
+	}
+	if c.Total > 0 && len(c.Members) > 0 {
+		return fmt.Errorf("sharding.total and sharding.members are mutually exclusive")
+	}
+	if c.Total < 0 {
+		return fmt.Errorf("sharding.total must not be negative")
+	}
+	if c.Total > 0 {
+		if c.Member != "" {
+			return fmt.Errorf("sharding.member requires sharding.members")
+		}
+		if c.Index < 0 || c.Index >= c.Total {
+			return fmt.Errorf("sharding.index must be from 0 to %d, got %d", c.Total-1, c.Index)
+		}
+		return nil
+	}
+	if c.Index != 0 {
+		return fmt.Errorf("sharding.index requires sharding.total; with sharding.members set sharding.member")
+	}
+	seen := make(map[string]bool, len(c.Members))
+	for i, member := range c.Members {
+		if member == "" {
+			return fmt.Errorf("sharding.members[%d] is empty", i)
+		}
+		if seen[member] {
+			return fmt.Errorf("sharding.members lists %q twice", member)
+		}
+		seen[member] = true
+	}
+	if member := c.member(instanceID); !seen[member] {
+		return fmt.Errorf("sharding.member %q is not in sharding.members", member)
+	}
+	return nil
+}
+
+// member returns the name of this replica in Members
+func (c ShardingConfig) member(instanceID string) string {
+	switch {
+	case c.Member != "":
+		return c.Member
+	case instanceID != "":
+		return instanceID
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// members returns the membership, naming the replicas of Total by index
+func (c ShardingConfig) members() []string {
+	if len(c.Members) > 0 {
+		return c.Members
+	}
+	members := make([]string, c.Total)
+	for i := range members {
+		members[i] = strconv.Itoa(i)
+	}
+	return members
+}
+
+// shardAssignment decides which replica owns a location
+type shardAssignment struct {
+	members []string
+	// member is this replica and self its index in members, -1 when it is
+	// not listed
+	member string
+	self   int
+	// locations are every known location, owned here or not. With
+	// api.discovery they change with the catalog, see setLocations.
+	mu        sync.RWMutex
+	locations map[string]bool
+}
+
+// newShardAssignment returns nil unless sharding is configured
+func newShardAssignment(config ShardingConfig, instanceID string, sources []*source) *shardAssignment {
+	if !config.enabled() {
+		return nil
+	}
+	s := &shardAssignment{members: config.members(), self: config.Index, locations: make(map[string]bool, len(sources))}
+	if len(config.Members) > 0 {
+		s.member, s.self = config.member(instanceID), -1
+		for i, name := range s.members {
+			if name == s.member {
+				s.self = i
+			}
+		}
+	} else {
+		s.member = strconv.Itoa(config.Index)
+	}
+	for _, src := range sources {
+		s.locations[src.name] = true
+	}
+	return s
+}
+
+// setLocations replaces the known locations with sources
+func (s *shardAssignment) setLocations(sources []*source) {
+	if s == nil {
+		return
+	}
+	locations := make(map[string]bool, len(sources))
+	for _, src := range sources {
+		locations[src.name] = true
+	}
+	s.mu.Lock()
+	s.locations = locations
+	s.mu.Unlock()
+}
+
+// known reports whether location is a location of any replica
+func (s *shardAssignment) known(location string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.locations[location]
+}
+
+// owner returns the index of the member owning location: the one whose hash
+// with the location is highest. Adding a member only takes locations from the
+// others, and removing one only hands its own locations out.
+func (s *shardAssignment) owner(location string) int {
+	best, bestScore := 0, uint64(0)
+	for i, member := range s.members {
+		if score := rendezvousScore(member, location); i == 0 || score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+func rendezvousScore(member, location string) uint64 {
+	h := sha256.New()
+	h.Write([]byte(member))
+	h.Write([]byte{0})
+	h.Write([]byte(location))
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// owns reports whether this replica polls location
+func (s *shardAssignment) owns(location string) bool {
+	return s == nil || s.owner(location) == s.self
+}
+
+// filter returns the sources this replica owns
+func (s *shardAssignment) filter(sources []*source) []*source {
+	if s == nil {
+		return sources
+	}
+	var owned []*source
+	for _, src := range sources {
+		if s.owns(src.name) {
+			owned = append(owned, src)
+		}
+	}
+	return owned
+}
+
+// ShardingStatus is reported by /ingestion/status
+type ShardingStatus struct {
+	Member    string   `json:"member"`
+	Index     int      `json:"index"`
+	Total     int      `json:"total"`
+	Locations int      `json:"locations"`
+	Owned     []string `json:"owned"`
+}
+
+func (s *shardAssignment) status() *ShardingStatus {
+	if s == nil {
+		return nil
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status := &ShardingStatus{Member: s.member, Index: s.self, Total: len(s.members), Locations: len(s.locations), Owned: []string{}}
+	for location := range s.locations {
+		if s.owns(location) {
+			status.Owned = append(status.Owned, location)
+		}
+	}
+	sort.Strings(status.Owned)
+	return status
+}
+
+// misdirected answers 421 with the owner when location is configured but
+// polled by another replica, so /weather/latest callers know where to ask.
+// It reports whether the response was written.
+func (s *shardAssignment) misdirected(c *gin.Context, location string) bool {
+	if s == nil || !s.known(location) || s.owns(location) {
+		return false
+	}
+	owner := s.owner(location)
+	c.JSON(http.StatusMisdirectedRequest, gin.H{
+		"error":       fmt.Sprintf("location %q is polled by sharding member %s", location, s.members[owner]),
+		"owner":       s.members[owner],
+		"owner_index": owner,
+	})
+	return true
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shardTestSources(count int) []*source {
+	sources := make([]*source, count)
+	for i := range sources {
+		sources[i] = &source{name: fmt.Sprintf("station-%03d", i)}
+	}
+	return sources
+}
+
+// shardOwners returns the owning member of every location
+func shardOwners(config ShardingConfig, sources []*source) map[string]string {
+	owners := make(map[string]string, len(sources))
+	for _, member := range config.members() {
+		replica := config
+		if len(config.Members) > 0 {
+			replica.Member = member
+		} else {
+			fmt.Sscan(member, &replica.Index)
+		}
+		for _, src := range newShardAssignment(replica, "", sources).filter(sources) {
+			_, taken := owners[src.name]
+			if taken {
+				panic(src.name + " is owned twice")
+			}
+			owners[src.name] = member
+		}
+	}
+	return owners
+}
+
+func TestShardAssignment_Coverage(t *testing.T) {
+	sources := shardTestSources(500)
+	owners := shardOwners(ShardingConfig{Total: 5}, sources)
+	require.Len(t, owners, 500, "every location is owned")
+
+	perMember := map[string]int{}
+	for _, member := range owners {
+		perMember[member]++
+	}
+	require.Len(t, perMember, 5)
+	for member, owned := range perMember {
+		assert.InDelta(t, 100, owned, 30, member)
+	}
+
+	// A single replica owns everything
+	assert.Len(t, newShardAssignment(ShardingConfig{Total: 1}, "", sources).filter(sources), 500)
+}
+
+func TestShardAssignment_Stable(t *testing.T) {
+	sources := shardTestSources(50)
+	first := shardOwners(ShardingConfig{Total: 4}, sources)
+
+	reversed := make([]*source, len(sources))
+	for i, src := range sources {
+		reversed[len(sources)-1-i] = src
+	}
+	assert.Equal(t, first, shardOwners(ShardingConfig{Total: 4}, reversed), "the order of the locations does not matter")
+	assert.Equal(t, first, shardOwners(ShardingConfig{Total: 4}, sources))
+
+	// The assignment is part of the deployment contract: replicas running
+	// different versions must agree on it
+	assignment := newShardAssignment(ShardingConfig{Members: []string{"ingestor-0", "ingestor-1", "ingestor-2"}, Member: "ingestor-0"}, "", sources)
+	pinned := map[string]int{"berlin": 1, "moscow": 1, "paris": 0, "station-000": 2, "station-001": 0}
+	for location, owner := range pinned {
+		assert.Equal(t, owner, assignment.owner(location), location)
+	}
+}
+
+func TestShardAssignment_MinimalMovement(t *testing.T) {
+	sources := shardTestSources(500)
+
+	// Growing from 5 to 6 replicas only hands the new one its share
+	before := shardOwners(ShardingConfig{Total: 5}, sources)
+	after := shardOwners(ShardingConfig{Total: 6}, sources)
+	moved := 0
+	for location, owner := range after {
+		if owner != before[location] {
+			moved++
+			assert.Equal(t, "5", owner, "%s moved between existing replicas", location)
+		}
+	}
+	assert.InDelta(t, 500/6, moved, 30)
+
+	// Removing a member from the middle only moves that member's locations
+	members := []string{"ingestor-a", "ingestor-b", "ingestor-c", "ingestor-d"}
+	before = shardOwners(ShardingConfig{Members: members}, sources)
+	after = shardOwners(ShardingConfig{Members: []string{"ingestor-a", "ingestor-c", "ingestor-d"}}, sources)
+	for location, owner := range before {
+		if owner != "ingestor-b" {
+			assert.Equal(t, owner, after[location], location)
+		}
+	}
+}
+
+func TestSharding_PollsOwnedLocations(t *testing.T) {
+	config := &Config{
+		Logging:  LoggingConfig{Level: "panic"},
+		API:      APIConfig{},
+		Sharding: ShardingConfig{Members: []string{"ingestor-0", "ingestor-1", "ingestor-2"}, Member: "ingestor-1"},
+	}
+	for _, src := range shardTestSources(30) {
+		config.API.Locations = append(config.API.Locations, LocationSource{Name: src.name, BaseURL: "http://127.0.0.1:1"})
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+
+	status := ingestor.shard.status()
+	require.NotEmpty(t, status.Owned)
+	require.Less(t, len(status.Owned), 30)
+	assert.Len(t, ingestor.sources, len(status.Owned))
+	for _, src := range ingestor.sources {
+		assert.Contains(t, status.Owned, src.name)
+	}
+	assert.Equal(t, float64(len(status.Owned)), testutil.ToFloat64(ingestor.metrics.ShardLocations))
+
+	router := setupRoutes(ingestor)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ingestion/status", nil))
+	var body struct {
+		Sharding ShardingStatus `json:"sharding"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, ShardingStatus{Member: "ingestor-1", Index: 1, Total: 3, Locations: 30, Owned: status.Owned}, body.Sharding)
+
+	// Readings of another replica's location are not here; the answer names
+	// the owner, whose /weather/latest shows whether it is fresh
+	var notOwned string
+	for _, location := range config.API.Locations {
+		if !ingestor.shard.owns(location.Name) {
+			notOwned = location.Name
+			break
+		}
+	}
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/weather/latest/"+notOwned, nil))
+	assert.Equal(t, http.StatusMisdirectedRequest, w.Code)
+	var misdirected struct {
+		Owner      string `json:"owner"`
+		OwnerIndex int    `json:"owner_index"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &misdirected))
+	assert.Equal(t, ingestor.shard.members[ingestor.shard.owner(notOwned)], misdirected.Owner)
+	assert.NotEqual(t, 1, misdirected.OwnerIndex)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/weather/latest/"+status.Owned[0], nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "an owned location without readings yet")
+}
+
+func TestConfig_ValidateSharding(t *testing.T) {
+	valid := []ShardingConfig{
+		{},
+		{Total: 3, Index: 2},
+		{Members: []string{"a", "b"}, Member: "b"},
+	}
+	for _, sharding := range valid {
+		assert.NoError(t, (&Config{Sharding: sharding}).Validate(), "%+v", sharding)
+	}
+	assert.NoError(t, (&Config{InstanceID: "b", Sharding: ShardingConfig{Members: []string{"a", "b"}}}).Validate(), "the instance id is the default member")
+
+	invalid := map[string]ShardingConfig{
+		"sharding.index must be from 0 to 2, got 3":                  {Total: 3, Index: 3},
+		"sharding.total and sharding.members are mutually exclusive": {Total: 2, Members: []string{"a"}},
+		`sharding.member "c" is not in sharding.members`:             {Members: []string{"a", "b"}, Member: "c"},
+		`sharding.members lists "a" twice`:                           {Members: []string{"a", "a"}, Member: "a"},
+		"require sharding.total or sharding.members":                 {Index: 1},
+		"sharding.member requires sharding.members":                  {Total: 2, Member: "a"},
+	}
+	for message, sharding := range invalid {
+		assert.ErrorContains(t, (&Config{Sharding: sharding}).Validate(), message)
+	}
+}
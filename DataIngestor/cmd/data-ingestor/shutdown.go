@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Exit statuses of the service, so the service manager can tell shutdowns
+// apart. 1 is any other fatal error, such as an invalid configuration, 2
+// invalid flags and 3 a panic (exitCodePanic).
+const (
+	exitCodeClean         = 0
+	exitCodeFailed        = 1
+	exitCodeDataRemaining = 4
+	exitCodeDrainTimeout  = 5
+	exitCodeStartupFailed = 6
+)
+
+// Outcomes of a run, from the least to the most severe
+const (
+	shutdownClean         = "clean"
+	shutdownDataRemaining = "data_remaining"
+	shutdownDrainTimeout  = "drain_timeout"
+	shutdownFailed        = "failed"
+	shutdownStartupFailed = "startup_failed"
+)
+
+// ShutdownReport is how a run ended. It is written to daemon.shutdown_report
+// when the process exits, and its ExitCode is the exit status.
+type ShutdownReport struct {
+	Outcome       string    `json:"outcome"`
+	ExitCode      int       `json:"exit_code"`
+	Error         string    `json:"error,omitempty"`
+	StartedAt     time.Time `json:"started_at"`
+	StoppedAt     time.Time `json:"stopped_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+	// DrainForced is set when requests were still running at the end of the
+	// drain timeout, ForcedConnections of them
+	DrainForced       bool             `json:"drain_forced"`
+	ForcedConnections int              `json:"forced_connections"`
+	Messages          ShutdownMessages `json:"messages"`
+	// InterruptedJobs are the backfill jobs resumed on the next start
+	InterruptedJobs []string `json:"interrupted_jobs"`
+
+	// err is why the service stopped on its own; startup marks a dependency
+	// that failed before the service ran
+	err     error
+	startup bool
+}
+
+// ShutdownMessages are the published messages awaiting their broker confirm
+// when the drain began: confirmed during the drain, or still unconfirmed
+// when the connection was closed. Spooled are the messages left in
+// rabbitmq.spool, published after the next start.
+type ShutdownMessages struct {
+	Drained   int    `json:"drained"`
+	Remaining int    `json:"remaining"`
+	Spooled   uint64 `json:"spooled,omitempty"`
+}
+
+// conclude sets the outcome and the exit code; the most severe condition
+// wins
+func (r *ShutdownReport) conclude(now time.Time) {
+	r.StoppedAt = now
+	r.UptimeSeconds = now.Sub(r.StartedAt).Seconds()
+	if r.err != nil {
+		r.Error = r.err.Error()
+	}
+	switch {
+	case r.startup:
+		r.Outcome, r.ExitCode = shutdownStartupFailed, exitCodeStartupFailed
+	case r.err != nil:
+		r.Outcome, r.ExitCode = shutdownFailed, exitCodeFailed
+	case r.DrainForced:
+		r.Outcome, r.ExitCode = shutdownDrainTimeout, exitCodeDrainTimeout
+	case r.Messages.Remaining > 0 || r.Messages.Spooled > 0:
+		r.Outcome, r.ExitCode = shutdownDataRemaining, exitCodeDataRemaining
+	default:
+		r.Outcome, r.ExitCode = shutdownClean, exitCodeClean
+	}
+	if r.InterruptedJobs == nil {
+		r.InterruptedJobs = []string{}
+	}
+}
+
+// drainConfirms waits up to the confirm timeout for the messages still
+// awaiting their broker confirm
+func (di *DataIngestor) drainConfirms() ShutdownMessages {
+	di.connMu.Lock()
+	tracker := di.confirms
+	di.connMu.Unlock()
+	if tracker == nil {
+		return ShutdownMessages{}
+	}
+	pending := tracker.outstanding()
+	if pending > 0 {
+		di.logger.WithField("messages", pending).Info("Waiting for publish confirms")
+		tracker.waitIdle(di.confirmTimeout())
+	}
+	remaining := tracker.outstanding()
+	return ShutdownMessages{Drained: pending - remaining, Remaining: remaining}
+}
+
+// startupFailed is the report of a run whose dependencies failed to start
+func (di *DataIngestor) startupFailed(err error) *ShutdownReport {
+	report := &ShutdownReport{StartedAt: di.started, err: err, startup: true}
+	di.finishRun(report)
+	return report
+}
+
+// finishRun concludes the report, logs it and writes
+// daemon.shutdown_report
+func (di *DataIngestor) finishRun(report *ShutdownReport) {
+	report.conclude(time.Now())
+	entry := di.logger.WithFields(logrus.Fields{
+		"outcome":   report.Outcome,
+		"exit_code": report.ExitCode,
+		"uptime":    time.Duration(report.UptimeSeconds * float64(time.Second)).Round(time.Second).String(),
+	})
+	if report.err != nil {
+		entry = entry.WithError(report.err)
+	}
+	entry.Info("Server exited")
+
+	path := di.config.Daemon.ShutdownReport
+	if path == "" {
+		return
+	}
+	body, err := json.MarshalIndent(report, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(path, body)
+	}
+	if err != nil {
+		di.logger.WithError(err).WithField("path", path).Error("Failed to write shutdown report")
+	}
+}
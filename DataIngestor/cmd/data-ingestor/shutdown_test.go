@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShutdownReport_ExitCodes(t *testing.T) {
+	started := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		report  ShutdownReport
+		outcome string
+		code    int
+	}{
+		{"clean", ShutdownReport{Messages: ShutdownMessages{Drained: 3}}, shutdownClean, exitCodeClean},
+		{"interrupted jobs resume", ShutdownReport{InterruptedJobs: []string{"job-1"}}, shutdownClean, exitCodeClean},
+		{"unconfirmed messages", ShutdownReport{Messages: ShutdownMessages{Remaining: 2}}, shutdownDataRemaining, exitCodeDataRemaining},
+		{"spooled messages", ShutdownReport{Messages: ShutdownMessages{Drained: 3, Spooled: 2}}, shutdownDataRemaining, exitCodeDataRemaining},
+		{"drain timeout", ShutdownReport{DrainForced: true, Messages: ShutdownMessages{Remaining: 2}}, shutdownDrainTimeout, exitCodeDrainTimeout},
+		{"server failed", ShutdownReport{err: errors.New("accept failed"), DrainForced: true}, shutdownFailed, exitCodeFailed},
+		{"startup failed", ShutdownReport{err: errors.New("no broker"), startup: true}, shutdownStartupFailed, exitCodeStartupFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report := tt.report
+			report.StartedAt = started
+			report.conclude(started.Add(90 * time.Second))
+			assert.Equal(t, tt.outcome, report.Outcome)
+			assert.Equal(t, tt.code, report.ExitCode)
+			assert.Equal(t, 90.0, report.UptimeSeconds)
+			assert.NotNil(t, report.InterruptedJobs, "written as an empty list")
+			if tt.report.err != nil {
+				assert.Equal(t, tt.report.err.Error(), report.Error)
+			}
+		})
+	}
+}
+
+func readShutdownReport(t *testing.T, path string) map[string]any {
+	t.Helper()
+	body, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var report map[string]any
+	require.NoError(t, json.Unmarshal(body, &report))
+	return report
+}
+
+func TestShutdown_ReportsRemainingMessagesAndJobs(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	upstream.holdAt(backfillStart)
+	dir := t.TempDir()
+	ingestor, _ := newBackfillIngestor(t, upstream.server.URL, filepath.Join(dir, "backfill.json"))
+	ingestor.config.Daemon.ShutdownReport = filepath.Join(dir, "shutdown.json")
+	ingestor.config.RabbitMQ.ConfirmTimeout = Duration(50 * time.Millisecond)
+
+	// One message is confirmed during the drain, the other never
+	tracker := newConfirmTracker()
+	attachChannel(ingestor, &fakeChannel{}, tracker)
+	confirmed, _ := tracker.track("meter-data-queue")
+	tracker.track("meter-data-queue")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		tracker.resolve(amqp.Confirmation{DeliveryTag: confirmed, Ack: true})
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := runIngestor(t, ctx, ingestor)
+	job := createBackfill(t, setupRoutes(ingestor), 2)
+	<-upstream.held
+	cancel()
+	require.NoError(t, <-done)
+
+	report := readShutdownReport(t, ingestor.config.Daemon.ShutdownReport)
+	assert.Equal(t, shutdownDataRemaining, report["outcome"])
+	assert.Equal(t, float64(exitCodeDataRemaining), report["exit_code"])
+	assert.Equal(t, map[string]any{"drained": 1.0, "remaining": 1.0}, report["messages"])
+	assert.Equal(t, []any{job.ID}, report["interrupted_jobs"])
+	assert.Equal(t, false, report["drain_forced"])
+	assert.Greater(t, report["uptime_seconds"], 0.0)
+	assert.NotContains(t, report, "error")
+}
+
+func TestShutdown_DrainTimeoutExitCode(t *testing.T) {
+	upstream := newSlowUpstream(t, 1)
+	t.Cleanup(func() { close(upstream.release) })
+	ingestor, _ := newLimitedIngestor(t, upstream, IngestLimitConfig{})
+	ingestor.drainTimeout = 50 * time.Millisecond
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan *ShutdownReport, 1)
+	go func() { done <- ingestor.run(ctx, listener) }()
+
+	go func() {
+		resp, err := http.Post("http://"+listener.Addr().String()+"/ingest", "application/json", nil)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-upstream.started
+	cancel()
+
+	report := <-done
+	assert.Equal(t, shutdownDrainTimeout, report.Outcome)
+	assert.Equal(t, exitCodeDrainTimeout, report.ExitCode)
+	assert.True(t, report.DrainForced)
+	assert.Equal(t, 1, report.ForcedConnections)
+	assert.NoError(t, report.err, "a forced drain is not a failure of Run")
+}
+
+func TestShutdown_StartupFailureReport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "shutdown.json")
+	ingestor := NewDataIngestor(&Config{
+		Enrichment: EnrichmentConfig{MetadataFile: filepath.Join(t.TempDir(), "missing.yaml")},
+		Daemon:     DaemonConfig{ShutdownReport: path},
+		Logging:    LoggingConfig{Level: "panic"},
+	})
+
+	err := ingestor.startDependencies()
+	require.ErrorContains(t, err, "failed to load enrichment")
+	assert.Equal(t, exitCodeStartupFailed, ingestor.startupFailed(err).ExitCode)
+
+	report := readShutdownReport(t, path)
+	assert.Equal(t, shutdownStartupFailed, report["outcome"])
+	assert.Equal(t, float64(exitCodeStartupFailed), report["exit_code"])
+	assert.Contains(t, report["error"], "failed to load enrichment")
+	assert.Equal(t, []any{}, report["interrupted_jobs"])
+}
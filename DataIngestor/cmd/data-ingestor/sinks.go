@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Sink is a destination the readings of a cycle are delivered to. The
+// delivery policy decides which of them must take the readings.
+type Sink interface {
+	// Name is the key of the sink in delivery.sinks, metrics and logs
+	Name() string
+	// Deliver hands the readings of batch to the sink and reports which of
+	// them it took
+	Deliver(ctx context.Context, batch *sinkBatch) ([]bool, error)
+}
+
+// sinkBatch is what a location cycle hands to one sink: the readings the
+// sink has not taken yet
+type sinkBatch struct {
+	fetched *fetchResult
+	data    WeatherData
+	env     Envelope
+	// messageIDs are set by the RabbitMQ sink
+	messageIDs []string
+}
+
+// sinks returns the configured sinks in delivery order
+func (di *DataIngestor) sinks() []Sink {
+	sinks := []Sink{amqpSink{di}}
+	if di.pubsub != nil {
+		sinks = append(sinks, pubsubSink{di})
+	}
+	if di.fileSink != nil {
+		sinks = append(sinks, fileSinkAdapter{di})
+	}
+	if di.notifier != nil {
+		sinks = append(sinks, webhookSink{di})
+	}
+	return sinks
+}
+
+// amqpSink publishes to RabbitMQ, all readings or none. With
+// publishing.passthrough it publishes the upstream body as it was fetched.
+type amqpSink struct{ di *DataIngestor }
+
+func (amqpSink) Name() string { return sinkAMQP }
+
+func (s amqpSink) Deliver(ctx context.Context, batch *sinkBatch) ([]bool, error) {
+	var err error
+	env := batch.env
+	env.ctx = ctx
+	if s.di.config.Publishing.Passthrough {
+		batch.messageIDs, err = s.di.publishRaw(batch.fetched, env)
+	} else {
+		batch.messageIDs, err = s.di.publishReadings(&batch.data, env)
+	}
+	if err != nil {
+		return taken(len(batch.data), false), fmt.Errorf("failed to publish data to queue: %w", err)
+	}
+	return taken(len(batch.data), true), nil
+}
+
+type pubsubSink struct{ di *DataIngestor }
+
+func (pubsubSink) Name() string { return sinkPubSub }
+
+func (s pubsubSink) Deliver(ctx context.Context, batch *sinkBatch) ([]bool, error) {
+	env := batch.env
+	env.InstanceID = s.di.instanceID
+	_, took, err := s.di.pubsub.publish(ctx, batch.data, env)
+	return took, err
+}
+
+type fileSinkAdapter struct{ di *DataIngestor }
+
+func (fileSinkAdapter) Name() string { return sinkFile }
+
+func (s fileSinkAdapter) Deliver(ctx context.Context, batch *sinkBatch) ([]bool, error) {
+	written, err := s.di.fileSink.write(time.Now(), batch.data)
+	took := make([]bool, len(batch.data))
+	for i := 0; i < written; i++ {
+		took[i] = true
+	}
+	if err != nil {
+		s.di.logger.WithError(err).Error("Failed to write data to file sink")
+	}
+	return took, err
+}
+
+type webhookSink struct{ di *DataIngestor }
+
+func (webhookSink) Name() string { return sinkWebhooks }
+
+func (s webhookSink) Deliver(ctx context.Context, batch *sinkBatch) ([]bool, error) {
+	took := s.di.notifier.Notify(batch.data)
+	if dropped := len(batch.data) - count(took); dropped > 0 {
+		return took, fmt.Errorf("%d readings were not queued for subscribers", dropped)
+	}
+	return took, nil
+}
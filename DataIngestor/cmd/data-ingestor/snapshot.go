@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// metricsSnapshotVersion is bumped when the file format changes; older
+	// snapshots are then discarded
+	metricsSnapshotVersion         = 1
+	defaultMetricsSnapshotInterval = 30 * time.Second
+)
+
+// MetricsSnapshotConfig persists the cumulative counters across restarts
+type MetricsSnapshotConfig struct {
+	// StateFile enables snapshots
+	StateFile string `yaml:"state_file"`
+	// Interval between snapshots, 30s by default. One is also written on
+	// shutdown.
+	Interval Duration `yaml:"interval"`
+}
+
+func (c MetricsSnapshotConfig) Validate() error {
+	if c.Interval < 0 {
+		return fmt.Errorf("metrics_snapshot.interval must not be negative")
+	}
+	return nil
+}
+
+// metricsSnapshot is the state file format
+type metricsSnapshot struct {
+	Version  int                        `json:"version"`
+	SavedAt  time.Time                  `json:"saved_at"`
+	Counters map[string][]counterSample `json:"counters"`
+}
+
+// counterSample is the value of one label combination of a counter
+type counterSample struct {
+	Labels map[string]string `json:"labels,omitempty"`
+	Value  float64           `json:"value"`
+}
+
+// addedLabels are the labels counters gained after snapshots were written,
+// with the value a sample saved without them restores to. Cycles, fetches
+// and readings were all polled before they were counted by trigger.
+var addedLabels = map[string]map[string]string{
+	"cycles_total":             {"trigger": triggerPoll},
+	"upstream_fetches_total":   {"trigger": triggerPoll},
+	"readings_published_total": {"trigger": triggerPoll},
+}
+
+// upgradeSamples gives the saved samples the labels their counters gained
+// since, so they restore and compare to the current ones
+func upgradeSamples(counters map[string][]counterSample) {
+	for name, samples := range counters {
+		added, ok := addedLabels[strings.TrimPrefix(name, metricsNamespace+"_")]
+		if !ok {
+			continue
+		}
+		for i := range samples {
+			for label, value := range added {
+				if _, ok := samples[i].Labels[label]; ok {
+					continue
+				}
+				if samples[i].Labels == nil {
+					samples[i].Labels = make(map[string]string, len(added))
+				}
+				samples[i].Labels[label] = value
+			}
+		}
+	}
+}
+
+// counters returns every counter by its full name. Gauges, histograms and
+// summaries describe the current process and are not persisted.
+func (m *Metrics) counters() map[string]prometheus.Collector {
+	counters := map[string]prometheus.Collector{
+		"routing_rule_publishes_total":       m.RoutingRulePublishes,
+		"replayed_readings_total":            m.ReplayedReadings,
+		"archive_corrupt_files_total":        m.ArchiveCorruptFiles,
+		"archive_files_removed_total":        m.ArchiveFilesRemoved,
+		"manual_ingest_gated_total":          m.ManualIngestGated,
+		"upstream_fetch_failures_total":      m.UpstreamFailures,
+		"upstream_no_data_total":             m.NoDataResponses,
+		"upstream_malformed_rows_total":      m.MalformedRows,
+		"upstream_auth_failures_total":       m.UpstreamAuthFailures,
+		"stream_dropped_clients_total":       m.StreamDroppedClients,
+		"transform_errors_total":             m.TransformErrors,
+		"transform_filtered_total":           m.TransformFiltered,
+		"validation_failures_total":          m.ValidationFailures,
+		"sentinel_values_total":              m.SentinelValues,
+		"panics_total":                       m.Panics,
+		"rabbitmq_failovers_total":           m.BrokerFailovers,
+		"rabbitmq_flow_waits_total":          m.FlowWaits,
+		"hook_panics_total":                  m.HookPanics,
+		"upstream_fetches_total":             m.UpstreamFetches,
+		"messages_published_total":           m.PublishedMessages,
+		"dedup_suppressed_total":             m.DedupSuppressed,
+		"dedup_redis_errors_total":           m.DedupRedisErrors,
+		"latest_requests_total":              m.LatestRequests,
+		"batches_total":                      m.Batches,
+		"batch_splits_total":                 m.BatchSplits,
+		"dead_letters_total":                 m.DeadLetters,
+		"memory_guard_steps_total":           m.MemoryGuardSteps,
+		"resource_threshold_crossings_total": m.ResourceCrossings,
+		"goroutine_dumps_total":              m.GoroutineDumps,
+		"health_checks_total":                m.HealthChecks,
+		"readings_published_total":           m.ReadingsPublished,
+		"reports_total":                      m.Reports,
+
+		"upstream_rate_limit_tokens_total":     m.RateLimitTokens,
+		"upstream_rate_limit_rejections_total": m.RateLimitRejections,
+		"upstream_bulk_requests_total":         m.UpstreamBulkRequests,
+		"upstream_bulk_missing_stations_total": m.BulkMissingStations,
+		"backfill_pages_total":                 m.BackfillPages,
+		"backfill_jobs_total":                  m.BackfillJobs,
+		"backfill_skipped_elements_total":      m.BackfillSkippedElements,
+		"backfill_yields_total":                m.BackfillYields,
+		"faults_injected_total":                m.FaultsInjected,
+		"error_budget_transitions_total":       m.BudgetTransitions,
+		"cycles_total":                         m.Cycles,
+		"upstream_switches_total":              m.UpstreamSwitches,
+		"reading_deliveries_total":             m.Deliveries,
+		"sink_missed_readings_total":           m.SinkMisses,
+		"cycle_missed_ticks_total":             m.MissedTicks,
+		"schema_drift_total":                   m.SchemaDrift,
+		"upstream_redirects_total":             m.UpstreamRedirects,
+		"websocket_reconnects_total":           m.WebSocketReconnects,
+		"websocket_frames_total":               m.WebSocketFrames,
+		"upstream_status_checks_total":         m.UpstreamStatusChecks,
+		"catalog_fetches_total":                m.CatalogFetches,
+		"catalog_changes_total":                m.CatalogChanges,
+		"spool_drained_total":                  m.SpoolDrained,
+		"spool_compacted_bytes_total":          m.SpoolCompactedBytes,
+		"quarantined_total":                    m.Quarantined,
+		"quarantine_reprocessed_total":         m.QuarantineReprocessed,
+		"quarantine_evicted_total":             m.QuarantineEvicted,
+		"upstream_diagnostics_total":           m.UpstreamDiagnostics,
+		"upstream_coalesced_fetches_total":     m.CoalescedFetches,
+		"aggregates_skipped_readings_total":    m.AggregatesSkipped,
+		"ordering_held_fetches_total":          m.OrderingHeld,
+		"http_compression_saved_bytes_total":   m.HTTPCompressionSaved,
+		"publish_failures_total":               m.PublishFailures,
+		"secret_reloads_total":                 m.SecretReloads,
+	}
+	full := make(map[string]prometheus.Collector, len(counters))
+	for name, collector := range counters {
+		full[metricsNamespace+"_"+name] = collector
+	}
+	return full
+}
+
+// gatherCounters returns the current value of every persisted counter
+func (m *Metrics) gatherCounters() (map[string][]counterSample, error) {
+	families, err := m.registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+	persisted := m.counters()
+	counters := make(map[string][]counterSample)
+	for _, family := range families {
+		if _, ok := persisted[family.GetName()]; !ok || family.GetType() != dto.MetricType_COUNTER {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			sample := counterSample{Value: metric.GetCounter().GetValue()}
+			if len(metric.GetLabel()) > 0 {
+				sample.Labels = make(map[string]string, len(metric.GetLabel()))
+				for _, pair := range metric.GetLabel() {
+					sample.Labels[pair.GetName()] = pair.GetValue()
+				}
+			}
+			counters[family.GetName()] = append(counters[family.GetName()], sample)
+		}
+	}
+	return counters, nil
+}
+
+// totals sums every persisted counter over its labels, keyed by the name
+// without the namespace, for GET /stats
+func (m *Metrics) totals() map[string]float64 {
+	totals := make(map[string]float64)
+	counters, err := m.gatherCounters()
+	if err != nil {
+		return totals
+	}
+	for name, samples := range counters {
+		key := strings.TrimPrefix(name, metricsNamespace+"_")
+		for _, sample := range samples {
+			totals[key] += sample.Value
+		}
+	}
+	return totals
+}
+
+// saveSnapshot writes the persisted counters to path
+func (m *Metrics) saveSnapshot(path string, now time.Time) error {
+	counters, err := m.gatherCounters()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	body, err := json.MarshalIndent(metricsSnapshot{
+		Version:  metricsSnapshotVersion,
+		SavedAt:  now.UTC(),
+		Counters: counters,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, body); err != nil {
+		return fmt.Errorf("failed to write metrics snapshot: %w", err)
+	}
+	return nil
+}
+
+// restoreSnapshot adds the counters saved at path to the current ones. A
+// missing file is not an error. A corrupt snapshot, or one of another
+// version, is rejected as a whole before anything is restored; samples of
+// counters whose labels changed since are skipped.
+func (m *Metrics) restoreSnapshot(path string, logger *logrus.Logger) (*metricsSnapshot, error) {
+	body, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read metrics snapshot: %w", err)
+	}
+	var snapshot metricsSnapshot
+	if err := json.Unmarshal(body, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse metrics snapshot %s: %w", path, err)
+	}
+	if snapshot.Version != metricsSnapshotVersion {
+		return nil, fmt.Errorf("metrics snapshot %s has version %d, expected %d", path, snapshot.Version, metricsSnapshotVersion)
+	}
+	for name, samples := range snapshot.Counters {
+		for _, sample := range samples {
+			if sample.Value < 0 || math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+				return nil, fmt.Errorf("metrics snapshot %s has invalid value %v for %s", path, sample.Value, name)
+			}
+		}
+	}
+
+	upgradeSamples(snapshot.Counters)
+	persisted := m.counters()
+	for name, samples := range snapshot.Counters {
+		collector, ok := persisted[name]
+		if !ok {
+			logger.WithField("metric", name).Warn("Skipping unknown counter in metrics snapshot")
+			continue
+		}
+		for _, sample := range samples {
+			if err := addSample(collector, sample); err != nil {
+				logger.WithField("metric", name).WithError(err).Warn("Skipping counter sample in metrics snapshot")
+			}
+		}
+	}
+	return &snapshot, nil
+}
+
+// addSample adds a saved value to a counter or one child of a counter vector
+func addSample(collector prometheus.Collector, sample counterSample) error {
+	switch c := collector.(type) {
+	case prometheus.Counter:
+		if len(sample.Labels) > 0 {
+			return fmt.Errorf("counter has no labels, snapshot has %v", sample.Labels)
+		}
+		c.Add(sample.Value)
+	case *prometheus.CounterVec:
+		counter, err := c.GetMetricWith(sample.Labels)
+		if err != nil {
+			return err
+		}
+		counter.Add(sample.Value)
+	default:
+		return fmt.Errorf("unsupported collector %T", collector)
+	}
+	return nil
+}
+
+// restoreMetrics continues the counters from the snapshot, if enabled
+func (di *DataIngestor) restoreMetrics() {
+	path := di.config.MetricsSnapshot.StateFile
+	if path == "" {
+		return
+	}
+	snapshot, err := di.metrics.restoreSnapshot(path, di.logger)
+	if err != nil {
+		di.logger.WithError(err).Warn("Discarding metrics snapshot, counters start from zero")
+		return
+	}
+	if snapshot != nil {
+		di.logger.WithField("saved_at", snapshot.SavedAt).Info("Counters restored from metrics snapshot")
+	}
+}
+
+// saveMetrics writes a snapshot, if enabled
+func (di *DataIngestor) saveMetrics() {
+	path := di.config.MetricsSnapshot.StateFile
+	if path == "" {
+		return
+	}
+	if err := di.metrics.saveSnapshot(path, time.Now()); err != nil {
+		di.logger.WithError(err).Warn("Failed to save metrics snapshot")
+	}
+	if err := di.report.save(); err != nil {
+		di.logger.WithError(err).Warn("Failed to save daily report state")
+	}
+}
+
+// snapshotMetrics saves a snapshot every interval until ctx is cancelled
+func (di *DataIngestor) snapshotMetrics(ctx context.Context) {
+	interval := time.Duration(di.config.MetricsSnapshot.Interval)
+	if interval <= 0 {
+		interval = defaultMetricsSnapshotInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			di.saveMetrics()
+		}
+	}
+}
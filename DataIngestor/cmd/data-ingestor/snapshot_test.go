@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSnapshotIngestor(t *testing.T, path string) (*DataIngestor, *test.Hook) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	logger, hook := test.NewNullLogger()
+	ingestor.logger = logger
+	ingestor.config.MetricsSnapshot.StateFile = path
+	ingestor.restoreMetrics()
+	return ingestor, hook
+}
+
+func counterValue(t *testing.T, di *DataIngestor, name string, labels map[string]string) float64 {
+	t.Helper()
+	metric := findMetric(t, di, name, labels)
+	if metric == nil {
+		return 0
+	}
+	return metric.GetCounter().GetValue()
+}
+
+func TestMetricsSnapshot_SaveAndRestore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	before := NewDataIngestor(&Config{
+		RabbitMQ:        RabbitMQConfig{QueueName: "meter-data-queue"},
+		MetricsSnapshot: MetricsSnapshotConfig{StateFile: path},
+		Logging:         LoggingConfig{Level: "error"},
+	})
+	attachChannel(before, &fakeChannel{}, nil)
+	data := WeatherData{{Type: "energy", Name: "meter-1", Payload: map[string]interface{}{"energy": 1.0}}}
+	require.NoError(t, before.PublishToQueue(&data))
+	require.NoError(t, before.PublishToQueue(&data))
+	before.metrics.UpstreamFetches.WithLabelValues("berlin", triggerPoll).Add(5)
+	before.metrics.UpstreamFailures.WithLabelValues("berlin").Inc()
+	before.metrics.UpstreamAuthFailures.Add(3)
+	before.saveMetrics()
+
+	after := NewDataIngestor(&Config{
+		RabbitMQ:        RabbitMQConfig{QueueName: "meter-data-queue"},
+		MetricsSnapshot: MetricsSnapshotConfig{StateFile: path},
+		Logging:         LoggingConfig{Level: "error"},
+	})
+	published := map[string]string{"sink": sinkAMQP, "routing_key": "meter-data-queue"}
+	assert.Equal(t, 2.0, counterValue(t, after, "data_ingestor_messages_published_total", published))
+	assert.Equal(t, 5.0, counterValue(t, after, "data_ingestor_upstream_fetches_total", map[string]string{"location": "berlin"}))
+	assert.Equal(t, 1.0, counterValue(t, after, "data_ingestor_upstream_fetch_failures_total", map[string]string{"location": "berlin"}))
+	assert.Equal(t, 3.0, counterValue(t, after, "data_ingestor_upstream_auth_failures_total", nil))
+
+	// Counting continues from the restored value
+	attachChannel(after, &fakeChannel{}, nil)
+	require.NoError(t, after.PublishToQueue(&data))
+	assert.Equal(t, 3.0, counterValue(t, after, "data_ingestor_messages_published_total", published))
+
+	w := httptest.NewRecorder()
+	setupRoutes(after).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		Totals map[string]float64 `json:"totals"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, 3.0, stats.Totals["messages_published_total"])
+	assert.Equal(t, 5.0, stats.Totals["upstream_fetches_total"])
+}
+
+func TestMetricsSnapshot_DiscardsBadSnapshots(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"corrupt", `{"version": 1, "counters": {`},
+		{"other version", `{"version": 99, "counters": {"data_ingestor_upstream_auth_failures_total": [{"value": 3}]}}`},
+		{"negative value", `{"version": 1, "counters": {"data_ingestor_upstream_auth_failures_total": [{"value": 3}], "data_ingestor_panics_total": [{"labels": {"where": "http"}, "value": -1}]}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "metrics.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.body), 0o644))
+
+			ingestor, hook := newSnapshotIngestor(t, path)
+			assert.Zero(t, counterValue(t, ingestor, "data_ingestor_upstream_auth_failures_total", nil), "nothing is restored")
+			require.NotNil(t, hook.LastEntry())
+			assert.Equal(t, logrus.WarnLevel, hook.LastEntry().Level)
+			assert.Equal(t, "Discarding metrics snapshot, counters start from zero", hook.LastEntry().Message)
+
+			// The next snapshot replaces the bad one
+			ingestor.saveMetrics()
+			_, err := ingestor.metrics.restoreSnapshot(path, ingestor.logger)
+			assert.NoError(t, err)
+		})
+	}
+}
+
+func TestMetricsSnapshot_SkipsChangedCounters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 1, "counters": {
+		"data_ingestor_upstream_auth_failures_total": [{"value": 3}],
+		"data_ingestor_upstream_fetches_total": [{"labels": {"city": "berlin"}, "value": 4}, {"labels": {"location": "berlin"}, "value": 2}],
+		"data_ingestor_removed_total": [{"value": 1}]
+	}}`), 0o644))
+
+	ingestor, hook := newSnapshotIngestor(t, path)
+	assert.Equal(t, 3.0, counterValue(t, ingestor, "data_ingestor_upstream_auth_failures_total", nil))
+	assert.Equal(t, 2.0, counterValue(t, ingestor, "data_ingestor_upstream_fetches_total", map[string]string{"location": "berlin"}))
+	warnings := 0
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == logrus.WarnLevel {
+			warnings++
+		}
+	}
+	assert.Equal(t, 2, warnings, "the relabelled sample and the removed counter")
+}
+
+func TestMetricsSnapshot_RestoresSamplesSavedBeforeTriggers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"version": 1, "counters": {
+		"data_ingestor_cycles_total": [{"labels": {"status": "succeeded"}, "value": 7}],
+		"data_ingestor_readings_published_total": [{"labels": {"location": "berlin"}, "value": 12}, {"labels": {"location": "berlin", "trigger": "manual"}, "value": 2}]
+	}}`), 0o644))
+
+	ingestor, _ := newSnapshotIngestor(t, path)
+	assert.Equal(t, 7.0, counterValue(t, ingestor, "data_ingestor_cycles_total", map[string]string{"status": "succeeded", "trigger": triggerPoll}))
+	assert.Equal(t, 12.0, counterValue(t, ingestor, "data_ingestor_readings_published_total", map[string]string{"location": "berlin", "trigger": triggerPoll}))
+	assert.Equal(t, 2.0, counterValue(t, ingestor, "data_ingestor_readings_published_total", map[string]string{"location": "berlin", "trigger": triggerManual}))
+}
+
+func TestMetricsSnapshot_MissingFile(t *testing.T) {
+	ingestor, hook := newSnapshotIngestor(t, filepath.Join(t.TempDir(), "metrics.json"))
+	assert.Empty(t, hook.AllEntries())
+	assert.Zero(t, counterValue(t, ingestor, "data_ingestor_upstream_auth_failures_total", nil))
+}
+
+func TestMetricsSnapshot_Periodic(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ingestor, _ := newSnapshotIngestor(t, path)
+	ingestor.config.MetricsSnapshot.Interval = Duration(10 * time.Millisecond)
+	ingestor.metrics.UpstreamAuthFailures.Inc()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go ingestor.snapshotMetrics(ctx)
+
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+	body, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var snapshot metricsSnapshot
+	require.NoError(t, json.Unmarshal(body, &snapshot))
+	assert.Equal(t, metricsSnapshotVersion, snapshot.Version)
+	assert.Equal(t, []counterSample{{Value: 1}}, snapshot.Counters["data_ingestor_upstream_auth_failures_total"])
+}
+
+func TestMetricsSnapshot_SavedOnShutdown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metrics.json")
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.config.MetricsSnapshot = MetricsSnapshotConfig{StateFile: path, Interval: Duration(time.Hour)}
+	ingestor.metrics.UpstreamAuthFailures.Inc()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- ingestor.Run(ctx, listener) }()
+	cancel()
+	require.NoError(t, <-done)
+
+	restored, _ := newSnapshotIngestor(t, path)
+	assert.Equal(t, 1.0, counterValue(t, restored, "data_ingestor_upstream_auth_failures_total", nil))
+}
+
+func TestMetricsSnapshot_CoversEveryCounter(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	persisted := make(map[prometheus.Collector]bool)
+	for _, collector := range metrics.counters() {
+		persisted[collector] = true
+	}
+
+	counterType := reflect.TypeOf((*prometheus.Counter)(nil)).Elem()
+	vectorType := reflect.TypeOf((*prometheus.CounterVec)(nil))
+	fields := reflect.ValueOf(metrics).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		field := fields.Type().Field(i)
+		if field.Type == counterType || field.Type == vectorType {
+			collector := fields.Field(i).Interface().(prometheus.Collector)
+			assert.True(t, persisted[collector], "%s must be added to Metrics.counters", field.Name)
+		}
+	}
+}
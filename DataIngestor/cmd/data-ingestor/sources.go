@@ -0,0 +1,510 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSourceName = "default"
+
+	defaultPollInterval    = 5 * time.Second
+	defaultMaxPollInterval = 5 * time.Minute
+	defaultRetryBackoff    = 500 * time.Millisecond
+)
+
+// ErrThrottled is returned while a location's upstream asked us to back off
+var ErrThrottled = errors.New("upstream is throttling requests")
+
+// sourceWebSocket is the name of the WebSocket source
+const sourceWebSocket = "websocket"
+
+// Source is an upstream that hands its readings over by itself instead of
+// being asked for them, like a WebSocket feed. While one is up the locations
+// are not polled.
+type Source interface {
+	// Name is the key of the source in logs
+	Name() string
+	// Run receives readings until ctx is cancelled
+	Run(ctx context.Context)
+	// Up reports whether the source is receiving
+	Up() bool
+}
+
+// pushSources returns the configured sources that push their readings
+func (di *DataIngestor) pushSources() []Source {
+	var sources []Source
+	if di.push != nil {
+		sources = append(sources, di.push)
+	}
+	return sources
+}
+
+// pushing reports whether a push source is up, so polling can stand by
+func (di *DataIngestor) pushing() bool {
+	for _, src := range di.pushSources() {
+		if src.Up() {
+			return true
+		}
+	}
+	return false
+}
+
+// LocationSource is one upstream endpoint, polled independently of the others
+type LocationSource struct {
+	Name    string `yaml:"name"`
+	BaseURL string `yaml:"base_url"`
+	// Format and CSV override api.format and api.csv for this location
+	Format string     `yaml:"format"`
+	CSV    *CSVConfig `yaml:"csv"`
+	// StationID is the upstream's id of the location with api.strategy:
+	// bulk, its name by default
+	StationID string `yaml:"station_id"`
+}
+
+// Validate checks the location list. Without locations the single base_url is used.
+func (c APIConfig) Validate() error {
+	seen := make(map[string]bool)
+	for i, location := range c.Locations {
+		if location.Name == "" {
+			return fmt.Errorf("api.locations[%d]: name is required", i)
+		}
+		if location.BaseURL == "" && !c.bulk() {
+			return fmt.Errorf("api.locations[%d] (%s): base_url is required", i, location.Name)
+		}
+		if location.BaseURL != "" {
+			if err := validateBaseURL(location.BaseURL); err != nil {
+				return fmt.Errorf("api.locations[%d] (%s): %w", i, location.Name, err)
+			}
+		}
+		if seen[location.Name] {
+			return fmt.Errorf("api.locations[%d]: duplicate name %q", i, location.Name)
+		}
+		seen[location.Name] = true
+		csv := c.CSV
+		if location.CSV != nil {
+			csv = *location.CSV
+		}
+		if err := validateFormat(location.Format, csv); err != nil {
+			return fmt.Errorf("api.locations[%d] (%s): %w", i, location.Name, err)
+		}
+	}
+	if c.BaseURL != "" {
+		if err := validateBaseURL(c.BaseURL); err != nil {
+			return fmt.Errorf("api: %w", err)
+		}
+	}
+	if err := validateFormat(c.Format, c.CSV); err != nil {
+		return fmt.Errorf("api: %w", err)
+	}
+	if err := validateCaptureHeaders(c.CaptureHeaders); err != nil {
+		return err
+	}
+	if err := c.AdaptiveTimeout.Validate(); err != nil {
+		return err
+	}
+	if err := c.RateLimit.Validate(); err != nil {
+		return err
+	}
+	if err := c.Trace.Validate(); err != nil {
+		return err
+	}
+	if err := c.validateStrategy(); err != nil {
+		return err
+	}
+	if err := c.Redirects.Validate(); err != nil {
+		return err
+	}
+	if err := c.WebSocket.Validate(); err != nil {
+		return err
+	}
+	if err := c.Maintenance.Validate(c.BaseURL); err != nil {
+		return err
+	}
+	if err := c.Discovery.Validate(c.BaseURL); err != nil {
+		return err
+	}
+	if err := c.Diagnostics.Validate(); err != nil {
+		return err
+	}
+	if err := c.Coalescing.Validate(); err != nil {
+		return err
+	}
+	if c.CircuitBreaker.FailureThreshold < 0 {
+		return fmt.Errorf("api.circuit_breaker.failure_threshold must not be negative")
+	}
+	return nil
+}
+
+// pollInterval returns the configured poll interval or the default
+func (c APIConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval)
+	}
+	return defaultPollInterval
+}
+
+// maxPollInterval returns the adaptive interval cap or the default
+func (c APIConfig) maxPollInterval() time.Duration {
+	if c.MaxPollInterval > 0 {
+		return time.Duration(c.MaxPollInterval)
+	}
+	return defaultMaxPollInterval
+}
+
+// retryBackoff returns the delay before the first retry or the default
+func (c APIConfig) retryBackoff() time.Duration {
+	if c.RetryBackoff > 0 {
+		return time.Duration(c.RetryBackoff)
+	}
+	return defaultRetryBackoff
+}
+
+// source holds the retry, breaker and throttling state of one location
+type source struct {
+	name   string
+	format string
+	csv    CSVConfig
+	// stationID identifies the location in bulk requests
+	stationID string
+
+	mu sync.Mutex
+	// baseURL may be switched while the service runs, see retarget
+	baseURL        string
+	breaker        circuitBreaker
+	throttledUntil time.Time
+	lastError      string
+	lastSuccess    time.Time
+	// diagnosed is set once the failure streak had its connectivity diagnostic
+	diagnosed bool
+
+	// timeouts is nil unless api.adaptive_timeout is enabled
+	timeouts *adaptiveTimeout
+	schedule cycleSchedule
+}
+
+// newSources returns one source per configured location, or a single source
+// for base_url when no locations are listed. With api.discovery the
+// configured locations are only the ones kept whatever the catalog lists.
+func newSources(config APIConfig) []*source {
+	locations := config.Locations
+	if len(locations) == 0 && !config.Discovery.enabled() {
+		locations = []LocationSource{{Name: defaultSourceName, BaseURL: config.BaseURL}}
+	}
+	sources := make([]*source, len(locations))
+	for i, location := range locations {
+		sources[i] = newSource(config, location)
+	}
+	return sources
+}
+
+// newSource returns the source of one location
+func newSource(config APIConfig, location LocationSource) *source {
+	src := &source{
+		name:      location.Name,
+		baseURL:   location.BaseURL,
+		format:    config.Format,
+		csv:       config.CSV,
+		stationID: location.StationID,
+		breaker:   newCircuitBreaker(config.CircuitBreaker),
+
+		timeouts: newAdaptiveTimeout(config.AdaptiveTimeout, time.Duration(config.Timeout)),
+	}
+	if src.baseURL == "" {
+		// Bulk locations may leave it out and fall back to api.base_url
+		src.baseURL = config.BaseURL
+	}
+	if src.stationID == "" {
+		src.stationID = location.Name
+	}
+	if location.Format != "" {
+		src.format = location.Format
+	}
+	if location.CSV != nil {
+		src.csv = *location.CSV
+	}
+	return src
+}
+
+// currentSources returns the locations this instance polls. With
+// api.discovery they change while the service runs; the slice is replaced
+// then, never changed in place, so callers may keep it.
+func (di *DataIngestor) currentSources() []*source {
+	di.sourcesMu.RLock()
+	defer di.sourcesMu.RUnlock()
+	return di.sources
+}
+
+// target returns the base URL the location is fetched from
+func (s *source) target() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.baseURL
+}
+
+// allow reports whether the location may be fetched now. An open breaker
+// lets a single probe through once its timeout has passed.
+func (s *source) allow(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Before(s.throttledUntil) {
+		return fmt.Errorf("%w until %s", ErrThrottled, s.throttledUntil.Format(time.RFC3339))
+	}
+	return s.breaker.allow(now)
+}
+
+// record updates the breaker with the outcome of a fetch and returns the
+// states before and after
+func (s *source) record(now time.Time, err error) (from, to breakerState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if retryAfter := retryAfterOf(err); retryAfter > 0 {
+		s.throttledUntil = now.Add(retryAfter)
+	}
+	if err == nil {
+		s.lastError = ""
+		s.lastSuccess = now
+		s.diagnosed = false
+	} else {
+		s.lastError = err.Error()
+	}
+	return s.breaker.record(now, err == nil)
+}
+
+// diagnoseOnce reports whether the current failure streak is still to be
+// diagnosed, and marks it as diagnosed
+func (s *source) diagnoseOnce() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.diagnosed {
+		return false
+	}
+	s.diagnosed = true
+	return true
+}
+
+// release ends a half-open probe without recording an outcome
+func (s *source) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.breaker.release()
+}
+
+// nextDelay returns how long to wait before polling the location again. The
+// interval doubles with each consecutive failure up to max, and never ends
+// before a throttle or an open breaker does.
+func (s *source) nextDelay(now time.Time, interval, max time.Duration) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delay := interval
+	for i := 0; i < s.breaker.failures && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if until := s.throttledUntil.Sub(now); until > delay {
+		delay = until
+	}
+	if until := s.breaker.reopensAt().Sub(now); until > delay {
+		delay = until
+	}
+	return delay
+}
+
+// SourceStatus is the state of one location as reported by GET /status
+type SourceStatus struct {
+	Breaker             string     `json:"breaker"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	ThrottledUntil      *time.Time `json:"throttled_until,omitempty"`
+}
+
+func (s *source) status(now time.Time) SourceStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := SourceStatus{
+		Breaker:             s.breaker.state.String(),
+		ConsecutiveFailures: s.breaker.failures,
+		LastError:           s.lastError,
+	}
+	if !s.lastSuccess.IsZero() {
+		lastSuccess := s.lastSuccess
+		status.LastSuccess = &lastSuccess
+	}
+	if s.breaker.state != breakerClosed {
+		openedAt := s.breaker.openedAt
+		status.OpenedAt = &openedAt
+	}
+	if now.Before(s.throttledUntil) {
+		throttledUntil := s.throttledUntil
+		status.ThrottledUntil = &throttledUntil
+	}
+	return status
+}
+
+// statusError is a non-200 upstream response
+type statusError struct {
+	Code       int
+	RetryAfter time.Duration
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("API returned status %d", e.Code)
+}
+
+// retryAfterOf returns the Retry-After delay an error carries, if any
+func retryAfterOf(err error) time.Duration {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.RetryAfter
+	}
+	return 0
+}
+
+// isRetryable reports whether a failed fetch is worth retrying right away:
+// network errors and server errors are; client errors, throttling and token
+// failures are not
+func isRetryable(err error) bool {
+	if errors.Is(err, ErrTokenAcquisition) || errors.Is(err, errStreamInterrupted) || errors.Is(err, errBulkUnsupported) {
+		return false
+	}
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.Code >= http.StatusInternalServerError && status.RetryAfter == 0
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// fetchSource fetches one location, retrying transient failures with
+// exponential backoff
+func (di *DataIngestor) fetchSource(ctx context.Context, src *source) (*fetchResult, error) {
+	var result *fetchResult
+	err := di.retryFetch(ctx, src.name, func(ctx context.Context) (err error) {
+		result, err = di.fetchFrom(ctx, src)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// retryFetch runs one fetch of location, retrying transient failures with
+// exponential backoff. Retries are made with the retry caller class.
+func (di *DataIngestor) retryFetch(ctx context.Context, location string, fetch func(ctx context.Context) error) error {
+	backoff := di.config.API.retryBackoff()
+	var failed error
+	for attempt := 0; ; attempt++ {
+		err := fetch(ctx)
+		if attempt > 0 && errors.Is(err, ErrUpstreamRateLimited) {
+			// The retry was turned away; the previous attempt's failure stands
+			return failed
+		}
+		if err == nil || attempt >= di.config.API.RetryCount || !isRetryable(err) {
+			return err
+		}
+		failed = err
+		locationStatsOf(ctx).retried()
+		if attempt == 0 {
+			ctx = withUpstreamClass(ctx, upstreamRetry)
+		}
+
+		logFor(ctx, logFetch).WithFields(logrus.Fields{
+			"location": location,
+			"attempt":  attempt + 1,
+		}).WithError(err).Warn("Fetch failed, retrying")
+		if err := sleepContext(ctx, backoff<<attempt); err != nil {
+			return err
+		}
+	}
+}
+
+// recordFetch feeds a fetch outcome to the location's breaker and metrics
+func (di *DataIngestor) recordFetch(ctx context.Context, src *source, err error) {
+	if errors.Is(err, ErrUpstreamRateLimited) {
+		// The upstream was not called
+		src.release()
+		return
+	}
+	di.metrics.UpstreamFetches.WithLabelValues(src.name, triggerOf(ctx)).Inc()
+	if errors.Is(err, ErrNoData) {
+		// Neither a success nor a failure: the streak is left as it was
+		src.release()
+		di.metrics.NoDataResponses.WithLabelValues(src.name).Inc()
+		return
+	}
+	if errors.Is(err, ErrTokenAcquisition) {
+		// The token endpoint failed, not the location's upstream
+		src.release()
+		di.metrics.UpstreamAuthFailures.Inc()
+		return
+	}
+	if err != nil && di.maintenance.active() {
+		// An expected failure: no streak, breaker or budget spent on it
+		src.release()
+		return
+	}
+
+	from, to := src.record(time.Now(), err)
+	di.budget.record(err != nil)
+	di.metrics.CircuitBreakerState.WithLabelValues(src.name).Set(float64(to))
+	if err != nil {
+		di.metrics.UpstreamFailures.WithLabelValues(src.name).Inc()
+		di.diagnoseFailure(ctx, src, err)
+	}
+	if from != to {
+		di.log(logFetch).WithFields(logrus.Fields{
+			"location": src.name,
+			"from":     from.String(),
+			"to":       to.String(),
+		}).Warn("Circuit breaker state changed")
+	}
+}
+
+// handleStatus reports the connection state and a per-location breakdown
+func (di *DataIngestor) handleStatus(c *gin.Context) {
+	now := time.Now()
+	sources := di.currentSources()
+	locations := make(map[string]SourceStatus, len(sources))
+	for _, src := range sources {
+		locations[src.name] = src.status(now)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"rabbitmq":  di.ConnectionState().String(),
+		"locations": locations,
+	})
+}
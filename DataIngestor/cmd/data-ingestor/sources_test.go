@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingUpstream serves status with body and counts requests
+func countingUpstream(t *testing.T, status int, body string, headers map[string]string) (*httptest.Server, *int32) {
+	t.Helper()
+
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		for name, value := range headers {
+			w.Header().Set(name, value)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+// newTwoLocationIngestor polls a healthy Berlin and a failing Moscow upstream
+func newTwoLocationIngestor(t *testing.T, api APIConfig) (*DataIngestor, *fakeChannel, *int32, *int32) {
+	t.Helper()
+
+	berlin, berlinHits := countingUpstream(t, http.StatusOK, `[{"type":"energy","name":"berlin-1","payload":{"energy":1}}]`, nil)
+	moscow, moscowHits := countingUpstream(t, http.StatusInternalServerError, `{"error":"boom"}`, nil)
+
+	api.Timeout = Duration(time.Second)
+	api.Locations = []LocationSource{
+		{Name: "berlin", BaseURL: berlin.URL},
+		{Name: "moscow", BaseURL: moscow.URL},
+	}
+	ingestor := NewDataIngestor(&Config{
+		API:      api,
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel, berlinHits, moscowHits
+}
+
+func TestIngest_LocationBreakersAreIndependent(t *testing.T) {
+	ingestor, channel, berlinHits, moscowHits := newTwoLocationIngestor(t, APIConfig{
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: Duration(time.Minute)},
+	})
+
+	for i := 0; i < 4; i++ {
+		result, err := ingestor.ingest(context.Background())
+		require.NoError(t, err)
+		require.Len(t, *result.Data, 1)
+		assert.Equal(t, "berlin-1", (*result.Data)[0].Name)
+		assert.Contains(t, result.SourceErrors, "moscow")
+	}
+
+	// Moscow's breaker opened after two failures; Berlin was never affected
+	assert.Equal(t, int32(4), atomic.LoadInt32(berlinHits))
+	assert.Equal(t, int32(2), atomic.LoadInt32(moscowHits))
+	assert.Len(t, channel.messages(), 4)
+
+	gauge := ingestor.metrics.CircuitBreakerState
+	assert.Equal(t, float64(breakerClosed), testutil.ToFloat64(gauge.WithLabelValues("berlin")))
+	assert.Equal(t, float64(breakerOpen), testutil.ToFloat64(gauge.WithLabelValues("moscow")))
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.UpstreamFailures.WithLabelValues("moscow")))
+}
+
+func TestStartIngestion_FailingLocationDoesNotStallOthers(t *testing.T) {
+	ingestor, _, berlinHits, moscowHits := newTwoLocationIngestor(t, APIConfig{
+		PollInterval:    Duration(10 * time.Millisecond),
+		MaxPollInterval: Duration(time.Second),
+		CircuitBreaker:  CircuitBreakerConfig{FailureThreshold: 3, OpenTimeout: Duration(time.Minute)},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		ingestor.StartIngestion(ctx)
+		close(done)
+	}()
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(berlinHits) >= 10 }, 2*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.LessOrEqual(t, atomic.LoadInt32(moscowHits), int32(3))
+	assert.Equal(t, "closed", ingestor.sources[0].status(time.Now()).Breaker)
+	assert.Equal(t, "open", ingestor.sources[1].status(time.Now()).Breaker)
+}
+
+func TestIngest_RetriesTransientFailures(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`))
+	}))
+	defer upstream.Close()
+
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second), RetryCount: 2, RetryBackoff: Duration(time.Millisecond)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+	assert.Equal(t, 0, ingestor.sources[0].status(time.Now()).ConsecutiveFailures)
+}
+
+func TestIngest_RetryAfterThrottlesLocation(t *testing.T) {
+	upstream, hits := countingUpstream(t, http.StatusTooManyRequests, ``, map[string]string{"Retry-After": "60"})
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second), RetryCount: 3, RetryBackoff: Duration(time.Millisecond)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+
+	_, err := ingestor.ingest(context.Background())
+	require.Error(t, err)
+	_, err = ingestor.ingest(context.Background())
+	assert.ErrorIs(t, err, ErrThrottled)
+
+	// Throttling is not retried, and the second cycle never reached the upstream
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+	status := ingestor.sources[0].status(time.Now())
+	require.NotNil(t, status.ThrottledUntil)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), *status.ThrottledUntil, 5*time.Second)
+}
+
+func TestSource_HalfOpenProbe(t *testing.T) {
+	now := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	src := newSources(APIConfig{
+		BaseURL:        "http://upstream",
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: Duration(time.Minute)},
+	})[0]
+	failure := errors.New("boom")
+
+	require.NoError(t, src.allow(now))
+	src.record(now, failure)
+	assert.ErrorIs(t, src.allow(now.Add(30*time.Second)), ErrCircuitOpen)
+
+	// After the timeout exactly one probe is let through
+	later := now.Add(time.Minute)
+	require.NoError(t, src.allow(later))
+	assert.ErrorIs(t, src.allow(later), ErrCircuitOpen)
+
+	// A failed probe reopens the breaker, a successful one closes it
+	from, to := src.record(later, failure)
+	assert.Equal(t, breakerHalfOpen, from)
+	assert.Equal(t, breakerOpen, to)
+	require.NoError(t, src.allow(later.Add(time.Minute)))
+	_, to = src.record(later.Add(time.Minute), nil)
+	assert.Equal(t, breakerClosed, to)
+}
+
+func TestSource_NextDelayAdapts(t *testing.T) {
+	now := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	src := newSources(APIConfig{
+		BaseURL:        "http://upstream",
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 10, OpenTimeout: Duration(time.Minute)},
+	})[0]
+	failure := errors.New("boom")
+
+	assert.Equal(t, 5*time.Second, src.nextDelay(now, 5*time.Second, time.Minute))
+	src.record(now, failure)
+	src.record(now, failure)
+	assert.Equal(t, 20*time.Second, src.nextDelay(now, 5*time.Second, time.Minute))
+	for i := 0; i < 5; i++ {
+		src.record(now, failure)
+	}
+	assert.Equal(t, time.Minute, src.nextDelay(now, 5*time.Second, time.Minute))
+
+	src.record(now, nil)
+	assert.Equal(t, 5*time.Second, src.nextDelay(now, 5*time.Second, time.Minute))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	assert.Equal(t, 120*time.Second, parseRetryAfter("120", now))
+	assert.Equal(t, 30*time.Second, parseRetryAfter(now.Add(30*time.Second).Format(http.TimeFormat), now))
+	assert.Zero(t, parseRetryAfter("", now))
+	assert.Zero(t, parseRetryAfter("soon", now))
+}
+
+func TestHandleStatus_PerLocation(t *testing.T) {
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{
+		CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: Duration(time.Minute)},
+	})
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		RabbitMQ  string                  `json:"rabbitmq"`
+		Locations map[string]SourceStatus `json:"locations"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "ready", body.RabbitMQ)
+	assert.Equal(t, "closed", body.Locations["berlin"].Breaker)
+	assert.NotNil(t, body.Locations["berlin"].LastSuccess)
+	assert.Equal(t, "open", body.Locations["moscow"].Breaker)
+	assert.Equal(t, 1, body.Locations["moscow"].ConsecutiveFailures)
+	assert.Contains(t, body.Locations["moscow"].LastError, "500")
+}
+
+func TestAPIConfig_Validate(t *testing.T) {
+	assert.NoError(t, APIConfig{BaseURL: "http://upstream"}.Validate())
+	assert.Error(t, APIConfig{Locations: []LocationSource{{Name: "berlin"}}}.Validate())
+	assert.Error(t, APIConfig{Locations: []LocationSource{
+		{Name: "berlin", BaseURL: "http://a"},
+		{Name: "berlin", BaseURL: "http://b"},
+	}}.Validate())
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultSpoolMaxBytes      = 256 << 20
+	defaultSpoolSegmentBytes  = 4 << 20
+	defaultSpoolDrainInterval = 5 * time.Second
+
+	spoolSegmentExt = ".spool"
+	spoolCursorFile = "cursor.json"
+)
+
+// What became of a spooled message, the result label of
+// data_ingestor_spool_drained_total
+const (
+	spoolPublished = "published"
+	spoolDropped   = "dropped"
+	spoolExpired   = "expired"
+	spoolEvicted   = "evicted"
+)
+
+// ErrSpoolFull is returned when a message does not fit in
+// rabbitmq.spool.max_bytes
+var ErrSpoolFull = errors.New("spool is full")
+
+// SpoolConfig keeps the messages that could not reach the broker on disk and
+// publishes them, in order, once the connection is ready again
+type SpoolConfig struct {
+	// Dir enables the spool; it holds the segment files and the cursor
+	Dir string `yaml:"dir"`
+	// MaxBytes caps the segment files, 256MiB by default. A message that
+	// does not fit fails like it would without the spool.
+	MaxBytes ByteSize `yaml:"max_bytes"`
+	// SegmentBytes is the size at which the next segment file is started,
+	// 4MiB by default
+	SegmentBytes ByteSize `yaml:"segment_bytes"`
+	// DrainInterval is how often the spool is published while the
+	// connection is ready, 5s by default
+	DrainInterval Duration `yaml:"drain_interval"`
+}
+
+func (c SpoolConfig) enabled() bool {
+	return c.Dir != ""
+}
+
+// Validate checks the sizes and the interval
+func (c SpoolConfig) Validate() error {
+	if c.MaxBytes < 0 || c.SegmentBytes < 0 {
+		return fmt.Errorf("rabbitmq.spool sizes must not be negative")
+	}
+	if c.MaxBytes > 0 && c.SegmentBytes > c.MaxBytes {
+		return fmt.Errorf("rabbitmq.spool.segment_bytes must not exceed max_bytes")
+	}
+	if c.DrainInterval < 0 {
+		return fmt.Errorf("rabbitmq.spool.drain_interval must not be negative")
+	}
+	if !c.enabled() && (c.MaxBytes > 0 || c.SegmentBytes > 0 || c.DrainInterval > 0) {
+		return fmt.Errorf("rabbitmq.spool needs rabbitmq.spool.dir")
+	}
+	return nil
+}
+
+// spoolEntry is one spooled message, a line of a segment file
+type spoolEntry struct {
+	Position   uint64    `json:"position"`
+	SpooledAt  time.Time `json:"spooled_at"`
+	Exchange   string    `json:"exchange,omitempty"`
+	RoutingKey string    `json:"routing_key"`
+	// MessageID is the MessageId the message is published with. It repeats
+	// the one of the first copy when the broker may have received it.
+	MessageID string `json:"message_id"`
+	// Reason is the error that sent the message to the spool
+	Reason   string   `json:"reason,omitempty"`
+	Envelope Envelope `json:"envelope"`
+	Body     []byte   `json:"body"`
+}
+
+// SpoolStatus is the spool as reported by /ingestion/status
+type SpoolStatus struct {
+	// Pending counts the messages still to be published
+	Pending  uint64 `json:"pending"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"max_bytes"`
+	Segments int    `json:"segments"`
+	// Next is the position the next spooled message gets; every message
+	// before Drained was published
+	Next      uint64     `json:"next"`
+	Drained   uint64     `json:"drained"`
+	LastDrain *time.Time `json:"last_drain,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+	// DropOldest is set while the disk guard drops files: the spool does
+	// not grow, and new messages push out the oldest
+	DropOldest bool `json:"drop_oldest,omitempty"`
+}
+
+// spoolSegment is a segment file, holding the messages from first up to
+// before next
+type spoolSegment struct {
+	path  string
+	first uint64
+	next  uint64
+	size  int64
+}
+
+// spool is an append-only log of messages split into segment files, named
+// after the position of their first message. The cursor file keeps the
+// position up to which they were published; segments before it are removed.
+type spool struct {
+	dir          string
+	maxBytes     int64
+	segmentBytes int64
+	interval     time.Duration
+	logger       func() *logrus.Entry
+	metrics      *Metrics
+
+	// drainMu lets one drain run at a time
+	drainMu sync.Mutex
+
+	mu        sync.Mutex
+	segments  []*spoolSegment
+	tail      *os.File
+	next      uint64
+	drained   uint64
+	bytes     int64
+	lastDrain time.Time
+	lastErr   string
+	// dropOldest caps the spool at dropLimit bytes, its size when the disk
+	// guard started dropping files, by evicting the oldest segments
+	dropOldest bool
+	dropLimit  int64
+}
+
+// newSpool opens rabbitmq.spool.dir, or returns nil without it. Messages
+// spooled before a restart are published once the connection is ready.
+func (di *DataIngestor) newSpool() *spool {
+	config := di.config.RabbitMQ.Spool
+	if !config.enabled() {
+		return nil
+	}
+	s := &spool{
+		dir:          config.Dir,
+		maxBytes:     int64(config.MaxBytes),
+		segmentBytes: int64(config.SegmentBytes),
+		interval:     time.Duration(config.DrainInterval),
+		logger:       func() *logrus.Entry { return di.log(logSpool) },
+		metrics:      di.metrics,
+	}
+	if s.maxBytes <= 0 {
+		s.maxBytes = defaultSpoolMaxBytes
+	}
+	if s.segmentBytes <= 0 {
+		s.segmentBytes = defaultSpoolSegmentBytes
+	}
+	if s.interval <= 0 {
+		s.interval = defaultSpoolDrainInterval
+	}
+	if err := s.open(); err != nil {
+		di.logger.WithError(err).Error("Spool disabled, rabbitmq.spool.dir cannot be opened")
+		return nil
+	}
+	if pending := s.pending(); pending > 0 {
+		di.log(logSpool).WithField("pending", pending).Info("Spooled messages restored, publishing them once connected")
+	}
+	return s
+}
+
+// open restores the segments and the cursor from dir
+func (s *spool) open() error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	names, err := filepath.Glob(filepath.Join(s.dir, "*"+spoolSegmentExt))
+	if err != nil {
+		return err
+	}
+	// Positions are zero-padded, so names sort in order
+	sort.Strings(names)
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), spoolSegmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		segment := &spoolSegment{path: name, first: first, next: first}
+		if err := s.scan(segment); err != nil {
+			return err
+		}
+		if segment.next == segment.first {
+			os.Remove(name)
+			continue
+		}
+		s.segments = append(s.segments, segment)
+		s.bytes += segment.size
+	}
+
+	var cursor struct {
+		Drained uint64 `json:"drained"`
+	}
+	body, err := os.ReadFile(filepath.Join(s.dir, spoolCursorFile))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+	case err != nil:
+		return err
+	default:
+		if err := json.Unmarshal(body, &cursor); err != nil {
+			return fmt.Errorf("failed to decode the spool cursor: %w", err)
+		}
+	}
+	s.drained, s.next = cursor.Drained, cursor.Drained
+	if n := len(s.segments); n > 0 {
+		s.next = s.segments[n-1].next
+		if s.drained < s.segments[0].first {
+			s.drained = s.segments[0].first
+		}
+		if s.drained > s.next {
+			s.drained = s.next
+		}
+	}
+	s.updateMetrics()
+	return nil
+}
+
+// scan finds the end of a restored segment. A line torn by a crash while it
+// was written is cut off.
+func (s *spool) scan(segment *spoolSegment) error {
+	body, err := os.ReadFile(segment.path)
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for len(body) > 0 {
+		end := bytes.IndexByte(body, '\n')
+		var entry struct {
+			Position uint64 `json:"position"`
+		}
+		if end < 0 || json.Unmarshal(body[:end], &entry) != nil {
+			s.logger().WithField("segment", segment.path).Warn("Cutting off a torn spool line")
+			if err := os.Truncate(segment.path, offset); err != nil {
+				return err
+			}
+			break
+		}
+		segment.next = entry.Position + 1
+		offset += int64(end + 1)
+		body = body[end+1:]
+	}
+	segment.size = offset
+	return nil
+}
+
+// append writes a message to the spool and returns its position
+func (s *spool) append(entry spoolEntry) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.Position = s.next
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode spooled message: %w", err)
+	}
+	line = append(line, '\n')
+	n := int64(len(line))
+	limit := s.maxBytes
+	if s.dropOldest && s.dropLimit < limit {
+		limit = s.dropLimit
+	}
+	if s.bytes+n > limit && !(s.dropOldest && s.evict(n, limit)) {
+		return 0, fmt.Errorf("%w, %d of %d bytes used", ErrSpoolFull, s.bytes, limit)
+	}
+	if err := s.roll(n); err != nil {
+		return 0, fmt.Errorf("failed to start a spool segment: %w", err)
+	}
+	if _, err := s.tail.Write(line); err != nil {
+		return 0, fmt.Errorf("failed to spool message: %w", err)
+	}
+	// The spool is for messages that would be lost otherwise
+	if err := s.tail.Sync(); err != nil {
+		return 0, fmt.Errorf("failed to spool message: %w", err)
+	}
+	segment := s.segments[len(s.segments)-1]
+	segment.size += n
+	segment.next = entry.Position + 1
+	s.next++
+	s.bytes += n
+	s.updateMetrics()
+	return entry.Position, nil
+}
+
+// roll opens a new tail segment when none is open or the next line does not
+// fit in it. Callers hold mu.
+func (s *spool) roll(n int64) error {
+	if s.tail != nil {
+		segment := s.segments[len(s.segments)-1]
+		if segment.size+n <= s.segmentBytes {
+			return nil
+		}
+		s.tail.Close()
+		s.tail = nil
+	}
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", s.next, spoolSegmentExt))
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	s.tail = file
+	s.segments = append(s.segments, &spoolSegment{path: path, first: s.next, next: s.next})
+	return nil
+}
+
+// drain publishes the pending messages in order and stops at the first that
+// publish fails. Drained segments are removed and the cursor is saved as it
+// goes, so a crash publishes at most a segment again, with the same
+// MessageIds.
+func (s *spool) drain(publish func(spoolEntry) error) (int, error) {
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	published := 0
+	err := s.drainSegments(func(entry spoolEntry) error {
+		if err := publish(entry); err != nil {
+			return err
+		}
+		published++
+		return nil
+	})
+
+	s.mu.Lock()
+	s.lastDrain = time.Now()
+	s.lastErr = ""
+	if err != nil {
+		s.lastErr = err.Error()
+	}
+	s.mu.Unlock()
+	if saveErr := s.saveCursor(); saveErr != nil && err == nil {
+		err = saveErr
+	}
+	return published, err
+}
+
+func (s *spool) drainSegments(publish func(spoolEntry) error) error {
+	for {
+		s.mu.Lock()
+		var segment spoolSegment
+		for _, sg := range s.segments {
+			if sg.next > s.drained {
+				segment = *sg
+				break
+			}
+		}
+		from := s.drained
+		s.mu.Unlock()
+		if segment.path == "" {
+			return nil
+		}
+
+		entries, err := readSpoolSegment(segment.path, from)
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			// Nothing readable is left in the segment
+			s.advance(segment.next)
+			continue
+		}
+		for _, entry := range entries {
+			if err := publish(entry); err != nil {
+				return err
+			}
+			s.advance(entry.Position + 1)
+		}
+	}
+}
+
+// advance marks the messages before position as published and removes the
+// segments that hold nothing else
+func (s *spool) advance(position uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Segments evicted meanwhile moved it on already
+	if position > s.drained {
+		s.drained = position
+	}
+	removed := false
+	for len(s.segments) > 0 && s.segments[0].next <= s.drained && s.segments[0].next > s.segments[0].first {
+		segment := s.segments[0]
+		if len(s.segments) == 1 && s.tail != nil {
+			s.tail.Close()
+			s.tail = nil
+		}
+		if err := os.Remove(segment.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger().WithError(err).WithField("segment", segment.path).Warn("Failed to remove a drained spool segment")
+			break
+		}
+		s.bytes -= segment.size
+		s.segments = s.segments[1:]
+		removed = true
+	}
+	s.updateMetrics()
+	if removed {
+		// Before the next segment is published, so a crash does not replay
+		// the whole of it
+		if err := s.saveCursorLocked(); err != nil {
+			s.logger().WithError(err).Warn("Failed to save the spool cursor")
+		}
+	}
+}
+
+// evict removes the oldest segments, but the one being appended to, until n
+// more bytes fit in limit. Their pending messages are dropped. Callers hold
+// mu.
+func (s *spool) evict(n, limit int64) bool {
+	evicted := uint64(0)
+	for s.bytes+n > limit && len(s.segments) > 0 && !(s.tail != nil && len(s.segments) == 1) {
+		segment := s.segments[0]
+		if err := os.Remove(segment.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger().WithError(err).WithField("segment", segment.path).Warn("Failed to evict a spool segment")
+			break
+		}
+		evicted += segment.next - max(segment.first, s.drained)
+		s.bytes -= segment.size
+		s.segments = s.segments[1:]
+		if s.drained < segment.next {
+			s.drained = segment.next
+		}
+	}
+	if evicted > 0 {
+		s.metrics.SpoolDrained.WithLabelValues(spoolEvicted).Add(float64(evicted))
+		s.logger().WithFields(logrus.Fields{
+			"evicted": evicted,
+			"bytes":   s.bytes,
+			"limit":   limit,
+		}).Warn("Disk nearly full, dropped the oldest spooled messages")
+		s.updateMetrics()
+	}
+	return s.bytes+n <= limit
+}
+
+// setDropOldest switches drop-oldest on, capping the spool at its current
+// size, or off again
+func (s *spool) setDropOldest(on bool) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch {
+	case on && !s.dropOldest:
+		s.dropOldest, s.dropLimit = true, s.bytes
+		s.logger().WithField("bytes", s.bytes).Warn("Spool switched to drop-oldest until the disk guard recovers")
+	case !on && s.dropOldest:
+		s.dropOldest = false
+		s.logger().Info("Spool no longer drops the oldest messages")
+	}
+}
+
+// compact rewrites the oldest segment once most of its messages are
+// published, without them, and merges the segments after it into the same
+// file while they fit in segment_bytes. The segment being appended to is
+// left as it is.
+func (s *spool) compact() {
+	if s == nil {
+		return
+	}
+	// No drain advances the cursor meanwhile
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+
+	s.mu.Lock()
+	sealed := len(s.segments)
+	if s.tail != nil {
+		sealed--
+	}
+	if sealed <= 0 {
+		s.mu.Unlock()
+		return
+	}
+	head := *s.segments[0]
+	drained := s.drained
+	var following []spoolSegment
+	for _, segment := range s.segments[1:sealed] {
+		following = append(following, *segment)
+	}
+	s.mu.Unlock()
+	if drained < head.first || drained >= head.next || (drained-head.first)*2 <= head.next-head.first {
+		return
+	}
+
+	body, err := readSpoolLines(head.path, drained)
+	merged := []spoolSegment{head}
+	for _, segment := range following {
+		if err != nil || int64(len(body))+segment.size > s.segmentBytes {
+			break
+		}
+		var lines []byte
+		if lines, err = readSpoolLines(segment.path, segment.first); err == nil {
+			body = append(body, lines...)
+			merged = append(merged, segment)
+		}
+	}
+	// A crash before the old files are removed leaves copies of messages
+	// behind the cursor, which are not published again
+	path := filepath.Join(s.dir, fmt.Sprintf("%020d%s", drained, spoolSegmentExt))
+	if err == nil {
+		err = writeFileAtomic(path, body)
+	}
+	if err != nil {
+		s.logger().WithError(err).Warn("Failed to compact the spool")
+		return
+	}
+
+	s.mu.Lock()
+	if len(s.segments) < len(merged) || s.segments[0].path != head.path {
+		// Evicted meanwhile
+		s.mu.Unlock()
+		os.Remove(path)
+		return
+	}
+	var freed int64
+	for _, segment := range merged {
+		freed += segment.size
+	}
+	freed -= int64(len(body))
+	compacted := &spoolSegment{path: path, first: drained, next: merged[len(merged)-1].next, size: int64(len(body))}
+	s.segments = append([]*spoolSegment{compacted}, s.segments[len(merged):]...)
+	s.bytes -= freed
+	s.updateMetrics()
+	s.mu.Unlock()
+
+	for _, segment := range merged {
+		if err := os.Remove(segment.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			s.logger().WithError(err).WithField("segment", segment.path).Warn("Failed to remove a compacted spool segment")
+		}
+	}
+	s.metrics.SpoolCompactedBytes.Add(float64(freed))
+	s.logger().WithFields(logrus.Fields{
+		"segments":    len(merged),
+		"freed_bytes": freed,
+		"pending":     s.pending(),
+	}).Info("Spool segments compacted")
+}
+
+// readSpoolLines returns the lines of a segment from position on, as they
+// were written
+func readSpoolLines(path string, from uint64) ([]byte, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool segment: %w", err)
+	}
+	var kept []byte
+	for len(body) > 0 {
+		end := bytes.IndexByte(body, '\n')
+		if end < 0 {
+			break
+		}
+		var entry struct {
+			Position uint64 `json:"position"`
+		}
+		if err := json.Unmarshal(body[:end], &entry); err != nil {
+			break
+		}
+		if entry.Position >= from {
+			kept = append(kept, body[:end+1]...)
+		}
+		body = body[end+1:]
+	}
+	return kept, nil
+}
+
+// readSpoolSegment returns the messages of a segment from position on
+func readSpoolSegment(path string, from uint64) ([]spoolEntry, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spool segment: %w", err)
+	}
+	var entries []spoolEntry
+	for _, line := range bytes.Split(body, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		var entry spoolEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			// Torn by a crash; scan cuts it off on the next start
+			break
+		}
+		if entry.Position >= from {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (s *spool) saveCursor() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.saveCursorLocked()
+}
+
+func (s *spool) saveCursorLocked() error {
+	body, err := json.Marshal(map[string]uint64{"drained": s.drained})
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(s.dir, spoolCursorFile), body); err != nil {
+		return fmt.Errorf("failed to write the spool cursor: %w", err)
+	}
+	return nil
+}
+
+// pending returns the number of messages still to be published
+func (s *spool) pending() uint64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.next - s.drained
+}
+
+// updateMetrics sets the spool gauges. Callers hold mu.
+func (s *spool) updateMetrics() {
+	s.metrics.SpoolMessages.Set(float64(s.next - s.drained))
+	s.metrics.SpoolBytes.Set(float64(s.bytes))
+}
+
+func (s *spool) status() *SpoolStatus {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &SpoolStatus{
+		Pending:    s.next - s.drained,
+		Bytes:      s.bytes,
+		MaxBytes:   s.maxBytes,
+		Segments:   len(s.segments),
+		Next:       s.next,
+		Drained:    s.drained,
+		LastError:  s.lastErr,
+		DropOldest: s.dropOldest,
+	}
+	if !s.lastDrain.IsZero() {
+		last := s.lastDrain
+		status.LastDrain = &last
+	}
+	return status
+}
+
+// close closes the tail segment and saves the cursor
+func (s *spool) close() {
+	if s == nil {
+		return
+	}
+	s.drainMu.Lock()
+	defer s.drainMu.Unlock()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.tail != nil {
+		s.tail.Close()
+		s.tail = nil
+	}
+	if err := s.saveCursorLocked(); err != nil {
+		s.logger().WithError(err).Warn("Failed to save the spool cursor")
+	}
+}
+
+// spoolable reports whether a failed publish goes to the spool: the broker
+// was out of reach, and the message is not one the spool is publishing
+// already. Transactions fail as a whole instead, and the next cycle fetches
+// their readings again.
+func (di *DataIngestor) spoolable(err error, env Envelope) bool {
+	return di.spool != nil && !env.fromSpool && env.tx == nil &&
+		publishFailureOf(err) == publishUnreachable
+}
+
+// spoolMessage writes a message whose publish failed to the spool. It keeps
+// messageID when the broker may have the first copy, and returns the
+// MessageId it will be published with.
+func (di *DataIngestor) spoolMessage(exchange, routingKey string, body []byte, env Envelope, messageID string, failure error) (string, error) {
+	if messageID == "" {
+		messageID = env.messageID(exchange, routingKey, body)
+	}
+	env.repeatMessageID = ""
+	position, err := di.spool.append(spoolEntry{
+		SpooledAt:  time.Now(),
+		Exchange:   exchange,
+		RoutingKey: routingKey,
+		MessageID:  messageID,
+		Reason:     failure.Error(),
+		Envelope:   env,
+		Body:       body,
+	})
+	if err != nil {
+		return "", err
+	}
+	spoolRequestOf(env.context()).add(position)
+	di.log(logSpool).WithFields(logrus.Fields{
+		"exchange":       exchange,
+		"routing_key":    routingKey,
+		"message_id":     messageID,
+		"correlation_id": env.CorrelationID,
+		"position":       position,
+	}).WithError(failure).Warn("Broker out of reach, message spooled")
+	return messageID, nil
+}
+
+// runSpool publishes the spool every drain interval while the connection is
+// ready, and compacts what is left of it, until ctx is cancelled
+func (di *DataIngestor) runSpool(ctx context.Context) {
+	ticker := time.NewTicker(di.spool.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			di.drainSpool()
+			di.spool.compact()
+		}
+	}
+}
+
+// drainSpool publishes the spooled messages once, if the connection is ready
+func (di *DataIngestor) drainSpool() {
+	if di.ConnectionState() != StateReady || di.spool.pending() == 0 {
+		return
+	}
+	published, err := di.spool.drain(di.publishSpooled)
+	entry := di.log(logSpool).WithFields(logrus.Fields{
+		"published": published,
+		"pending":   di.spool.pending(),
+	})
+	if err != nil {
+		entry.WithError(err).Warn("Spool drain stopped, retrying next interval")
+		return
+	}
+	if published > 0 {
+		entry.Info("Spooled messages published")
+	}
+}
+
+// publishSpooled publishes a spooled message with the MessageId it was
+// spooled with. It only fails while the broker is out of reach: a message
+// the broker refuses has been dead-lettered by the publish policy, or is
+// dropped.
+func (di *DataIngestor) publishSpooled(entry spoolEntry) error {
+	env := entry.Envelope
+	env.repeatMessageID = entry.MessageID
+	env.fromSpool = true
+	if env.TTL > 0 {
+		// The TTL ran while the message was spooled
+		left := env.TTL - time.Since(entry.SpooledAt)
+		if left <= 0 {
+			di.metrics.SpoolDrained.WithLabelValues(spoolExpired).Inc()
+			return nil
+		}
+		env.TTL = left
+	}
+	_, err := di.publishBody(entry.Exchange, entry.RoutingKey, entry.Body, env)
+	switch kind := publishFailureOf(err); {
+	case err == nil:
+		di.metrics.SpoolDrained.WithLabelValues(spoolPublished).Inc()
+	case kind == publishUnreachable || kind == publishTimedOut:
+		return err
+	default:
+		di.log(logSpool).WithFields(logrus.Fields{
+			"routing_key": entry.RoutingKey,
+			"message_id":  entry.MessageID,
+			"position":    entry.Position,
+		}).WithError(err).Error("Dropped a spooled message the broker refused")
+		di.metrics.SpoolDrained.WithLabelValues(spoolDropped).Inc()
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSpoolIngestor(t *testing.T, config SpoolConfig) *DataIngestor {
+	t.Helper()
+	if config.Dir == "" {
+		config.Dir = t.TempDir()
+	}
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue", Spool: config},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	require.NotNil(t, ingestor.spool)
+	t.Cleanup(ingestor.spool.close)
+	return ingestor
+}
+
+func spoolSegments(t *testing.T, dir string) []string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*"+spoolSegmentExt))
+	require.NoError(t, err)
+	return names
+}
+
+func TestSpool_PublishesOnceConnected(t *testing.T) {
+	dir := t.TempDir()
+	ingestor := newSpoolIngestor(t, SpoolConfig{Dir: dir})
+
+	// Not connected: the message goes to the spool instead of failing
+	messageID, err := ingestor.publishBody("", "meter-data-queue", []byte(`[{"name":"berlin-1"}]`), Envelope{CorrelationID: "cycle-1"})
+	require.NoError(t, err)
+	require.NotEmpty(t, messageID)
+	assert.EqualValues(t, 1, ingestor.spool.status().Pending)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.SpoolMessages))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.PublishFailures.WithLabelValues(publishUnreachable, publishActionSpooled)))
+	assert.Len(t, spoolSegments(t, dir), 1)
+
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	ingestor.drainSpool()
+
+	published := channel.messages()
+	require.Len(t, published, 1)
+	assert.Equal(t, messageID, published[0].Msg.MessageId, "the spool publishes the MessageId it handed out")
+	assert.Equal(t, "cycle-1", published[0].Msg.CorrelationId)
+	assert.JSONEq(t, `[{"name":"berlin-1"}]`, string(published[0].Msg.Body))
+
+	status := ingestor.spool.status()
+	assert.Zero(t, status.Pending)
+	assert.EqualValues(t, 1, status.Drained)
+	assert.Empty(t, status.LastError)
+	assert.Empty(t, spoolSegments(t, dir), "drained segments are removed")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.SpoolDrained.WithLabelValues(spoolPublished)))
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.SpoolBytes))
+}
+
+func TestSpool_RestoresAcrossRestart(t *testing.T) {
+	dir := t.TempDir()
+	first := newSpoolIngestor(t, SpoolConfig{Dir: dir})
+	for _, key := range []string{"a", "b", "c"} {
+		_, err := first.publishBody("", key, []byte(`[]`), Envelope{})
+		require.NoError(t, err)
+	}
+	// One is published before the restart
+	_, err := first.spool.drain(func(spoolEntry) error { return nil })
+	require.NoError(t, err)
+	_, err = first.publishBody("", "d", []byte(`[]`), Envelope{})
+	require.NoError(t, err)
+	first.spool.close()
+
+	second := newSpoolIngestor(t, SpoolConfig{Dir: dir})
+	status := second.spool.status()
+	assert.EqualValues(t, 1, status.Pending)
+	assert.EqualValues(t, 3, status.Drained)
+	assert.EqualValues(t, 4, status.Next)
+
+	// Positions go on after the restart
+	_, err = second.publishBody("", "e", []byte(`[]`), Envelope{})
+	require.NoError(t, err)
+	channel := &fakeChannel{}
+	attachChannel(second, channel, nil)
+	second.drainSpool()
+
+	var keys []string
+	for _, message := range channel.messages() {
+		keys = append(keys, message.RoutingKey)
+	}
+	assert.Equal(t, []string{"d", "e"}, keys)
+	assert.EqualValues(t, 5, second.spool.status().Drained)
+}
+
+func TestSpool_StopsAtTheFirstFailure(t *testing.T) {
+	dir := t.TempDir()
+	ingestor := newSpoolIngestor(t, SpoolConfig{Dir: dir, SegmentBytes: 300, MaxBytes: 900})
+	for {
+		_, err := ingestor.spool.append(spoolEntry{RoutingKey: "meter-data-queue", Body: []byte(`[{"name":"berlin-1"}]`)})
+		if errors.Is(err, ErrSpoolFull) {
+			break
+		}
+		require.NoError(t, err)
+	}
+	status := ingestor.spool.status()
+	require.Greater(t, status.Segments, 2, "segments roll at segment_bytes")
+	assert.LessOrEqual(t, status.Bytes, int64(900))
+
+	published := 0
+	_, err := ingestor.spool.drain(func(spoolEntry) error {
+		if published == 3 {
+			return ErrNotConnected
+		}
+		published++
+		return nil
+	})
+	require.ErrorIs(t, err, ErrNotConnected)
+	status = ingestor.spool.status()
+	assert.EqualValues(t, 3, status.Drained)
+	assert.Contains(t, status.LastError, "not connected")
+	assert.Len(t, spoolSegments(t, dir), status.Segments)
+
+	// The cursor survives a restart
+	ingestor.spool.close()
+	restored := newSpoolIngestor(t, SpoolConfig{Dir: dir, SegmentBytes: 300, MaxBytes: 900})
+	assert.EqualValues(t, 3, restored.spool.status().Drained)
+	assert.Equal(t, status.Pending, restored.spool.status().Pending)
+}
+
+func TestSpool_CompactsMostlyPublishedSegments(t *testing.T) {
+	dir := t.TempDir()
+	config := SpoolConfig{Dir: dir, SegmentBytes: 1000}
+	first := newSpoolIngestor(t, config)
+	for i := 0; i < 10; i++ {
+		_, err := first.spool.append(spoolEntry{RoutingKey: fmt.Sprintf("key-%02d", i), Body: []byte(`[]`)})
+		require.NoError(t, err)
+	}
+	require.Equal(t, 2, first.spool.status().Segments)
+	// Restarted, no segment is appended to
+	first.spool.close()
+	ingestor := newSpoolIngestor(t, config)
+
+	// Less than half of the first segment published: nothing to compact
+	_, err := ingestor.spool.drain(func(entry spoolEntry) error {
+		if entry.Position == 1 {
+			return ErrNotConnected
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, ErrNotConnected)
+	ingestor.spool.compact()
+	assert.Equal(t, 2, ingestor.spool.status().Segments)
+
+	stop := ingestor.spool.segments[0].next - 1
+	_, err = ingestor.spool.drain(func(entry spoolEntry) error {
+		if entry.Position == stop {
+			return ErrNotConnected
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, ErrNotConnected)
+	pending := ingestor.spool.status()
+	ingestor.spool.compact()
+
+	status := ingestor.spool.status()
+	assert.Equal(t, 1, status.Segments, "the segment after the first is merged into it")
+	assert.Less(t, status.Bytes, pending.Bytes)
+	assert.Equal(t, pending.Pending, status.Pending)
+	assert.Len(t, spoolSegments(t, dir), 1)
+	assert.Equal(t, float64(pending.Bytes-status.Bytes), testutil.ToFloat64(ingestor.metrics.SpoolCompactedBytes))
+
+	// The rest is published in order, after a restart too
+	ingestor.spool.close()
+	restored := newSpoolIngestor(t, config)
+	assert.Equal(t, status.Pending, restored.spool.status().Pending)
+	var keys []string
+	_, err = restored.spool.drain(func(entry spoolEntry) error {
+		keys = append(keys, entry.RoutingKey)
+		return nil
+	})
+	require.NoError(t, err)
+	var want []string
+	for i := int(stop); i < 10; i++ {
+		want = append(want, fmt.Sprintf("key-%02d", i))
+	}
+	assert.Equal(t, want, keys)
+}
+
+func TestSpool_DropsTheOldestWhileTheDiskIsFull(t *testing.T) {
+	dir := t.TempDir()
+	ingestor := newSpoolIngestor(t, SpoolConfig{Dir: dir, SegmentBytes: 300})
+	for i := 0; i < 6; i++ {
+		_, err := ingestor.spool.append(spoolEntry{RoutingKey: fmt.Sprintf("key-%02d", i), Body: []byte(`[]`)})
+		require.NoError(t, err)
+	}
+	before := ingestor.spool.status()
+	require.Greater(t, before.Segments, 2)
+
+	ingestor.spool.setDropOldest(true)
+	assert.True(t, ingestor.spool.status().DropOldest)
+	for i := 6; i < 12; i++ {
+		_, err := ingestor.spool.append(spoolEntry{RoutingKey: fmt.Sprintf("key-%02d", i), Body: []byte(`[]`)})
+		require.NoError(t, err)
+	}
+	status := ingestor.spool.status()
+	assert.LessOrEqual(t, status.Bytes, before.Bytes, "the spool does not grow")
+	assert.Equal(t, float64(12-status.Pending), testutil.ToFloat64(ingestor.metrics.SpoolDrained.WithLabelValues(spoolEvicted)))
+	var keys []string
+	_, err := ingestor.spool.drain(func(entry spoolEntry) error {
+		keys = append(keys, entry.RoutingKey)
+		return nil
+	})
+	require.NoError(t, err)
+	require.NotEmpty(t, keys)
+	assert.Equal(t, "key-11", keys[len(keys)-1], "the newest are kept")
+	assert.NotContains(t, keys, "key-00")
+
+	// Back below the threshold, the spool takes up to max_bytes again
+	ingestor.spool.setDropOldest(false)
+	for i := 0; i < 6; i++ {
+		_, err := ingestor.spool.append(spoolEntry{RoutingKey: "key", Body: []byte(`[]`)})
+		require.NoError(t, err)
+	}
+	assert.EqualValues(t, 6, ingestor.spool.status().Pending)
+}
+
+func TestSpool_CutsOffTornLine(t *testing.T) {
+	dir := t.TempDir()
+	first := newSpoolIngestor(t, SpoolConfig{Dir: dir})
+	_, err := first.publishBody("", "meter-data-queue", []byte(`[]`), Envelope{})
+	require.NoError(t, err)
+	first.spool.close()
+
+	segments := spoolSegments(t, dir)
+	require.Len(t, segments, 1)
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0o644)
+	require.NoError(t, err)
+	_, err = file.WriteString(`{"position":1,"exchange":`)
+	require.NoError(t, err)
+	require.NoError(t, file.Close())
+
+	second := newSpoolIngestor(t, SpoolConfig{Dir: dir})
+	assert.EqualValues(t, 1, second.spool.status().Pending)
+	channel := &fakeChannel{}
+	attachChannel(second, channel, nil)
+	second.drainSpool()
+	assert.Len(t, channel.messages(), 1)
+}
+
+func TestSpool_DropsExpiredMessages(t *testing.T) {
+	ingestor := newSpoolIngestor(t, SpoolConfig{})
+	_, err := ingestor.spool.append(spoolEntry{
+		SpooledAt:  time.Now().Add(-time.Minute),
+		RoutingKey: "meter-data-queue",
+		MessageID:  "expired",
+		Envelope:   Envelope{TTL: time.Second},
+		Body:       []byte(`[]`),
+	})
+	require.NoError(t, err)
+
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	ingestor.drainSpool()
+	assert.Empty(t, channel.messages())
+	assert.Zero(t, ingestor.spool.pending())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.SpoolDrained.WithLabelValues(spoolExpired)))
+}
+
+func TestSpool_KeepsMessagesUnconfirmedByTheFailover(t *testing.T) {
+	ingestor := newSpoolIngestor(t, SpoolConfig{})
+	// The secondary never confirms before it is closed
+	secondary := &fakeChannel{}
+	tracker := newConfirmTracker()
+	attachChannel(ingestor, secondary, tracker)
+
+	type result struct {
+		messageID string
+		err       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		messageID, err := ingestor.publishBody("", "meter-data-queue", []byte(`[]`), Envelope{})
+		done <- result{messageID, err}
+	}()
+	require.Eventually(t, func() bool { return tracker.outstanding() == 1 }, time.Second, time.Millisecond)
+
+	// What listenConfirms does when switchBroker closes the secondary
+	primary := &fakeChannel{}
+	attachChannel(ingestor, primary, nil)
+	tracker.failAll(ErrConfirmsClosed)
+
+	published := <-done
+	require.NoError(t, published.err)
+	first := secondary.messages()
+	require.Len(t, first, 1)
+	assert.Equal(t, first[0].Msg.MessageId, published.messageID)
+
+	ingestor.drainSpool()
+	again := primary.messages()
+	require.Len(t, again, 1)
+	assert.Equal(t, first[0].Msg.MessageId, again[0].Msg.MessageId, "the broker may have the first copy")
+}
+
+func TestSpoolConfig_Validate(t *testing.T) {
+	assert.NoError(t, SpoolConfig{}.Validate())
+	assert.NoError(t, SpoolConfig{Dir: "spool", MaxBytes: 1 << 20, SegmentBytes: 1 << 10}.Validate())
+	assert.Error(t, SpoolConfig{MaxBytes: 1 << 20}.Validate())
+	assert.Error(t, SpoolConfig{Dir: "spool", MaxBytes: 1 << 10, SegmentBytes: 1 << 20}.Validate())
+	assert.Error(t, SpoolConfig{Dir: "spool", MaxBytes: -1}.Validate())
+	assert.Error(t, SpoolConfig{Dir: "spool", DrainInterval: Duration(-time.Second)}.Validate())
+}
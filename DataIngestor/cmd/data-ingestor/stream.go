@@ -0,0 +1,356 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultStreamBufferSize = 1000
+	defaultRecentLimit      = 100
+	streamHeartbeatInterval = 15 * time.Second
+	// streamClientBuffer is how many events a client may fall behind before
+	// it is dropped
+	streamClientBuffer = 64
+)
+
+// errStreamClosed is returned when subscribing after the hub was closed
+var errStreamClosed = errors.New("stream is closed")
+
+// StreamConfig configures the live reading stream at GET /stream
+type StreamConfig struct {
+	// BufferSize is the number of recent readings kept for Last-Event-ID replay
+	BufferSize int `yaml:"buffer_size"`
+}
+
+// streamEvent is one published reading as sent to SSE clients
+type streamEvent struct {
+	ID       string
+	Location string
+	// Trigger is what started the ingestion of the reading
+	Trigger string
+	// CorrelationID is the cycle that published the reading
+	CorrelationID string
+	Data          []byte
+	// Time is when the reading was broadcast, for GET /history
+	Time time.Time
+}
+
+// streamShutdownRetry is the reconnection delay sent to clients in the
+// shutdown event, long enough for a restart
+const streamShutdownRetry = 5 * time.Second
+
+// streamClient is one connected SSE client. The hub closes events when the
+// client is unsubscribed or dropped.
+type streamClient struct {
+	location string
+	events   chan streamEvent
+	// shutdown is set before events is closed when the hub shuts down
+	shutdown bool
+}
+
+// streamHub fans published readings out to SSE clients and keeps a ring
+// buffer of the most recent ones. Broadcasting never blocks: a client whose
+// buffer is full is dropped.
+type streamHub struct {
+	metrics   *Metrics
+	heartbeat time.Duration
+	now       func() time.Time
+
+	mu      sync.Mutex
+	ring    []streamEvent
+	next    int
+	full    bool
+	clients map[*streamClient]struct{}
+	closed  bool
+	// seq counts the events broadcast, for the ids of readings with IDs
+	seq uint64
+	// shedding rejects new clients while the memory guard drops streams
+	shedding bool
+
+	// serving counts the handlers still writing to a client, which hold up
+	// the HTTP server shutdown
+	serving atomic.Int64
+}
+
+func newStreamHub(config StreamConfig, metrics *Metrics) *streamHub {
+	return &streamHub{
+		metrics:   metrics,
+		heartbeat: streamHeartbeatInterval,
+		now:       time.Now,
+		ring:      make([]streamEvent, config.bufferSize()),
+		clients:   make(map[*streamClient]struct{}),
+	}
+}
+
+// Broadcast sends every reading of one cycle to the matching clients. Event
+// ids are the cycle's correlation id followed by the reading index or, when
+// reading_ids replaced the upstream's, the reading's ID followed by the
+// sequence number of the event in the hub. A reading ID repeats when the
+// reading is fetched again without dedup; its event ids don't.
+func (h *streamHub) Broadcast(correlationID, trigger string, data WeatherData) {
+	now := h.now().UTC()
+	events := make([]streamEvent, 0, len(data))
+	readingIDs := make([]string, 0, len(data))
+	for i, reading := range data {
+		body, err := json.Marshal(reading)
+		if err != nil {
+			continue
+		}
+		readingIDs = append(readingIDs, reading.ID)
+		events = append(events, streamEvent{
+			ID:            fmt.Sprintf("%s-%d", correlationID, i),
+			Location:      reading.Location(),
+			Trigger:       trigger,
+			CorrelationID: correlationID,
+			Data:          body,
+			Time:          now,
+		})
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, event := range events {
+		h.seq++
+		if readingIDs[i] != "" {
+			event.ID = fmt.Sprintf("%s-%d", readingIDs[i], h.seq)
+		}
+		h.ring[h.next] = event
+		h.next = (h.next + 1) % len(h.ring)
+		if h.next == 0 {
+			h.full = true
+		}
+
+		for client := range h.clients {
+			if !globMatch(client.location, event.Location) {
+				continue
+			}
+			select {
+			case client.events <- event:
+			default:
+				h.remove(client)
+				h.metrics.StreamDroppedClients.Inc()
+			}
+		}
+	}
+}
+
+// buffered returns the ring contents, oldest first. Callers hold mu.
+func (h *streamHub) buffered() []streamEvent {
+	if !h.full {
+		return h.ring[:h.next]
+	}
+	return append(append([]streamEvent{}, h.ring[h.next:]...), h.ring[:h.next]...)
+}
+
+// recent returns up to limit of the newest buffered readings matching the
+// location glob and trigger, oldest first. The empty trigger matches all.
+func (h *streamHub) recent(location, trigger string, limit int) []streamEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := h.buffered()
+	var matched []streamEvent
+	for i := len(events) - 1; i >= 0 && len(matched) < limit; i-- {
+		if globMatch(location, events[i].Location) && (trigger == "" || events[i].Trigger == trigger) {
+			matched = append(matched, events[i])
+		}
+	}
+	for i, j := 0, len(matched)-1; i < j; i, j = i+1, j-1 {
+		matched[i], matched[j] = matched[j], matched[i]
+	}
+	return matched
+}
+
+// subscribe registers a client for readings matching the location glob. When
+// lastEventID is still in the ring buffer, the events after it are returned
+// for replay; registering and reading the backlog happen atomically so no
+// event is missed or sent twice.
+func (h *streamHub) subscribe(location, lastEventID string) (*streamClient, []streamEvent, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, nil, errStreamClosed
+	}
+	if h.shedding {
+		return nil, nil, errStreamShed
+	}
+
+	var backlog []streamEvent
+	if lastEventID != "" {
+		events := h.buffered()
+		for i := range events {
+			if events[i].ID != lastEventID {
+				continue
+			}
+			for _, event := range events[i+1:] {
+				if globMatch(location, event.Location) {
+					backlog = append(backlog, event)
+				}
+			}
+			break
+		}
+	}
+
+	client := &streamClient{location: location, events: make(chan streamEvent, streamClientBuffer)}
+	h.clients[client] = struct{}{}
+	h.metrics.StreamClients.Inc()
+	return client, backlog, nil
+}
+
+// unsubscribe removes a client; it is a no-op for clients already dropped
+func (h *streamHub) unsubscribe(client *streamClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.remove(client)
+}
+
+func (h *streamHub) remove(client *streamClient) {
+	if _, ok := h.clients[client]; !ok {
+		return
+	}
+	delete(h.clients, client)
+	close(client.events)
+	h.metrics.StreamClients.Dec()
+}
+
+// Close rejects new clients and disconnects the connected ones after a
+// final shutdown event, so open streams do not hold up the HTTP server
+// shutdown. It returns the number of clients disconnected.
+func (h *streamHub) Close() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	disconnected := len(h.clients)
+	for client := range h.clients {
+		client.shutdown = true
+		h.remove(client)
+	}
+	return disconnected
+}
+
+// handleStream serves published readings as Server-Sent Events
+func (di *DataIngestor) handleStream(c *gin.Context) {
+	location := c.Query("location")
+	if _, err := path.Match(location, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid location pattern: %v", err),
+		})
+		return
+	}
+
+	if di.resources.rejects(resourceActionRejectStreams) {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": errResourceGuard.Error(),
+		})
+		return
+	}
+	client, backlog, err := di.stream.subscribe(location, c.GetHeader("Last-Event-ID"))
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	defer di.stream.unsubscribe(client)
+	di.stream.serving.Add(1)
+	defer di.stream.serving.Add(-1)
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	for _, event := range backlog {
+		writeStreamEvent(w, event)
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(di.stream.heartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-client.events:
+			if !ok {
+				if client.shutdown {
+					writeShutdownEvent(w)
+					w.Flush()
+				}
+				return
+			}
+			writeStreamEvent(w, event)
+			w.Flush()
+		case <-heartbeat.C:
+			fmt.Fprintf(w, ": heartbeat %s\n\n", di.instanceID)
+			w.Flush()
+		}
+	}
+}
+
+// recentReading is one entry of the GET /recent response
+type recentReading struct {
+	ID      string          `json:"id"`
+	Trigger string          `json:"trigger,omitempty"`
+	Reading json.RawMessage `json:"reading"`
+}
+
+// handleRecent serves the newest published readings from the stream buffer,
+// GET /recent?limit=&location=&trigger=
+func (di *DataIngestor) handleRecent(c *gin.Context) {
+	location := c.Query("location")
+	if _, err := path.Match(location, ""); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid location pattern: %v", err),
+		})
+		return
+	}
+	trigger, err := triggerFilter(c.Query("trigger"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	limit, err := queryInt(c, "limit", defaultRecentLimit)
+	if err != nil || limit < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": "limit must be a positive integer",
+		})
+		return
+	}
+
+	readings := []recentReading{}
+	for _, event := range di.stream.recent(location, trigger, limit) {
+		readings = append(readings, recentReading{ID: event.ID, Trigger: event.Trigger, Reading: event.Data})
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"readings": readings,
+	})
+}
+
+func writeStreamEvent(w gin.ResponseWriter, event streamEvent) {
+	fmt.Fprintf(w, "id: %s\nevent: reading\ndata: %s\n\n", event.ID, event.Data)
+}
+
+// writeShutdownEvent tells a client the stream ends because the service is
+// stopping, and to reconnect after a delay. It has no id, so Last-Event-ID
+// keeps pointing at the last reading.
+func writeShutdownEvent(w gin.ResponseWriter) {
+	fmt.Fprintf(w, "event: shutdown\nretry: %d\ndata: {\"message\":\"server is shutting down\"}\n\n", streamShutdownRetry.Milliseconds())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type sseEvent struct {
+	ID   string
+	Data string
+}
+
+// readSSE parses events from an SSE body, skipping comments
+func readSSE(t *testing.T, reader *bufio.Reader, n int) []sseEvent {
+	t.Helper()
+
+	var events []sseEvent
+	var current sseEvent
+	for len(events) < n {
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			if current.ID != "" {
+				events = append(events, current)
+			}
+			current = sseEvent{}
+		case strings.HasPrefix(line, "id: "):
+			current.ID = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			current.Data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+	return events
+}
+
+func newStreamTestServer(t *testing.T) (*DataIngestor, *httptest.Server) {
+	t.Helper()
+
+	upstream := newUpstream(t, "application/json",
+		`[{"type":"energy","name":"berlin-1","payload":{"energy":1}},{"type":"energy","name":"moscow-1","payload":{"energy":2}}]`)
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+
+	server := httptest.NewServer(setupRoutes(ingestor))
+	t.Cleanup(func() {
+		ingestor.stream.Close()
+		server.Close()
+	})
+	return ingestor, server
+}
+
+func openStream(t *testing.T, url, lastEventID string) *http.Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	t.Cleanup(func() { resp.Body.Close() })
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	return resp
+}
+
+func waitForClients(t *testing.T, ingestor *DataIngestor, n float64) {
+	t.Helper()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(ingestor.metrics.StreamClients) == n
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestStream_PushesPublishedReadings(t *testing.T) {
+	ingestor, server := newStreamTestServer(t)
+	resp := openStream(t, server.URL+"/stream?location=berlin-*", "")
+	waitForClients(t, ingestor, 1)
+
+	result, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	_, err = ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	events := readSSE(t, bufio.NewReader(resp.Body), 2)
+	assert.Equal(t, result.CorrelationIDs[0]+"-0", events[0].ID)
+
+	var reading SensorData
+	require.NoError(t, json.Unmarshal([]byte(events[0].Data), &reading))
+	assert.Equal(t, "berlin-1", reading.Name)
+	assert.NotEqual(t, events[0].ID, events[1].ID)
+}
+
+func TestStream_LastEventIDReplay(t *testing.T) {
+	ingestor, server := newStreamTestServer(t)
+
+	first, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+	second, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	// Resuming after the first reading replays the three that followed it
+	resp := openStream(t, server.URL+"/stream", first.CorrelationIDs[0]+"-0")
+	events := readSSE(t, bufio.NewReader(resp.Body), 3)
+	assert.Equal(t, first.CorrelationIDs[0]+"-1", events[0].ID)
+	assert.Equal(t, second.CorrelationIDs[0]+"-0", events[1].ID)
+	assert.Equal(t, second.CorrelationIDs[0]+"-1", events[2].ID)
+}
+
+func TestStream_HeartbeatAndDisconnect(t *testing.T) {
+	ingestor, server := newStreamTestServer(t)
+	ingestor.stream.heartbeat = 10 * time.Millisecond
+
+	resp := openStream(t, server.URL+"/stream", "")
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, ": heartbeat "+ingestor.instanceID+"\n", line, "heartbeats carry the instance id")
+
+	resp.Body.Close()
+	waitForClients(t, ingestor, 0)
+}
+
+func TestStreamHub_DropsSlowClients(t *testing.T) {
+	hub := newStreamHub(StreamConfig{BufferSize: 10}, NewMetrics(prometheus.NewRegistry()))
+	slow, _, err := hub.subscribe("", "")
+	require.NoError(t, err)
+
+	// Nobody reads from slow, so it is dropped once its buffer overflows
+	// instead of blocking the broadcast
+	data := WeatherData{{Type: "energy", Name: "meter-1"}}
+	for i := 0; i <= streamClientBuffer; i++ {
+		hub.Broadcast(newMessageID(), triggerPoll, data)
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(hub.metrics.StreamDroppedClients))
+	assert.Equal(t, 0.0, testutil.ToFloat64(hub.metrics.StreamClients))
+	for range slow.events {
+	}
+
+	// The ring buffer only keeps the most recent readings
+	hub.mu.Lock()
+	assert.Len(t, hub.buffered(), 10)
+	hub.mu.Unlock()
+
+	hub.Close()
+	_, _, err = hub.subscribe("", "")
+	assert.ErrorIs(t, err, errStreamClosed)
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultStreamChunkSize   = 500
+	defaultStreamMaxElements = 1000000
+)
+
+// Policies for array elements that are no reading
+const (
+	streamSkip  = "skip"
+	streamAbort = "abort"
+)
+
+var (
+	errTooManyElements = errors.New("response has more elements than backfill.streaming.max_elements")
+	// errStreamInterrupted is a streamed response that failed after some of
+	// its readings were published. It is not retried, as the retry would
+	// publish them again.
+	errStreamInterrupted = errors.New("stream interrupted after readings were published")
+)
+
+// BackfillStreamingConfig decodes backfill pages element by element instead
+// of reading the whole response first, so pages of any size are published in
+// bounded memory
+type BackfillStreamingConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ChunkSize is the number of readings published together, 500 by default
+	ChunkSize int `yaml:"chunk_size"`
+	// OnError is skip to count and leave out elements that are no reading,
+	// the default, or abort to fail the page
+	OnError string `yaml:"on_error"`
+	// MaxElements fails pages with more elements, one million by default
+	MaxElements int `yaml:"max_elements"`
+}
+
+func (c BackfillStreamingConfig) Validate() error {
+	if c.ChunkSize < 0 {
+		return fmt.Errorf("backfill.streaming.chunk_size must not be negative")
+	}
+	if c.MaxElements < 0 {
+		return fmt.Errorf("backfill.streaming.max_elements must not be negative")
+	}
+	switch c.OnError {
+	case "", streamSkip, streamAbort:
+	default:
+		return fmt.Errorf("backfill.streaming.on_error must be skip or abort, got %q", c.OnError)
+	}
+	return nil
+}
+
+func (c BackfillStreamingConfig) chunkSize() int {
+	if c.ChunkSize > 0 {
+		return c.ChunkSize
+	}
+	return defaultStreamChunkSize
+}
+
+func (c BackfillStreamingConfig) maxElements() int {
+	if c.MaxElements > 0 {
+		return c.MaxElements
+	}
+	return defaultStreamMaxElements
+}
+
+// streamCounts is what a streamed response held
+type streamCounts struct {
+	Elements int
+	Skipped  int
+}
+
+// decodeStream decodes a JSON array of readings from r and hands them to
+// publish in chunks, decoding the next element only once the chunk before
+// was handed on. Elements that are valid JSON but no reading are skipped or
+// fail the stream as config says; malformed JSON always fails it.
+func decodeStream(r io.Reader, config BackfillStreamingConfig, publish func(WeatherData) error) (streamCounts, error) {
+	var counts streamCounts
+	dec := json.NewDecoder(r)
+	if token, err := dec.Token(); err != nil {
+		return counts, fmt.Errorf("failed to decode response: %w", err)
+	} else if token != json.Delim('[') {
+		return counts, fmt.Errorf("response is not a JSON array")
+	}
+
+	size, max := config.chunkSize(), config.maxElements()
+	flush := func(chunk WeatherData) error {
+		if len(chunk) == 0 {
+			return nil
+		}
+		return publish(chunk)
+	}
+	chunk := make(WeatherData, 0, size)
+	for dec.More() {
+		if counts.Elements == max {
+			return counts, fmt.Errorf("%w (%d)", errTooManyElements, max)
+		}
+		index := counts.Elements
+		counts.Elements++
+		var reading SensorData
+		err := dec.Decode(&reading)
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			// The decoder has read past the element and can go on
+			if config.OnError == streamAbort {
+				return counts, fmt.Errorf("element %d is not a reading: %w", index, err)
+			}
+			counts.Skipped++
+			continue
+		}
+		if err != nil {
+			return counts, fmt.Errorf("failed to decode element %d: %w", index, err)
+		}
+		chunk = append(chunk, reading)
+		if len(chunk) == size {
+			if err := flush(chunk); err != nil {
+				return counts, err
+			}
+			// The chunk may still be referenced by the publisher
+			chunk = make(WeatherData, 0, size)
+		}
+	}
+	if _, err := dec.Token(); err != nil {
+		return counts, fmt.Errorf("failed to decode response: %w", err)
+	}
+	return counts, flush(chunk)
+}
+
+// streamFrom fetches one response of src and hands its readings to publish
+// in chunks with the captured headers. JSON arrays are decoded as they are
+// read and are not bound by api.max_body_bytes; other bodies are read and
+// decoded whole, as by fetchFrom.
+func (di *DataIngestor) streamFrom(ctx context.Context, src *source, config BackfillStreamingConfig, publish func(WeatherData, map[string]string) error) (streamCounts, error) {
+	maxBody := int64(di.config.API.MaxBodyBytes)
+	if maxBody <= 0 {
+		maxBody = defaultMaxBodyBytes
+	}
+	call, err := di.callUpstream(ctx, src, maxBody+1)
+	if err != nil {
+		return streamCounts{}, err
+	}
+	defer call.close()
+	resp := call.resp
+
+	body := bufio.NewReader(resp.Body)
+	first, err := firstByte(body)
+	if err != nil {
+		return streamCounts{}, fmt.Errorf("failed to read response body: %w", err)
+	}
+	format, formatErr := responseFormat(src.format, resp.Header.Get("Content-Type"))
+	if resp.StatusCode != http.StatusOK || first != '[' || formatErr != nil || format != formatJSON {
+		fetched, err := di.readResponse(ctx, src, call, body, maxBody)
+		if err != nil {
+			return streamCounts{}, err
+		}
+		return streamCounts{Elements: len(*fetched.Data)}, publish(*fetched.Data, fetched.Headers)
+	}
+
+	headers := captureHeaders(di.config.API.CaptureHeaders, resp.Header)
+	counts, err := decodeStream(body, config, func(data WeatherData) error {
+		if headers != nil {
+			for i := range data {
+				data[i].Headers = headers
+			}
+		}
+		return publish(data, headers)
+	})
+	call.trace.readDone()
+	latency := time.Since(call.start)
+	di.observeLatency(src, latency)
+	logFor(ctx, logFetch).WithFields(logrus.Fields{
+		"location":   src.name,
+		"status":     resp.StatusCode,
+		"elements":   counts.Elements,
+		"latency_ms": latency.Milliseconds(),
+	}).Debug("Upstream responded")
+	if counts.Skipped > 0 {
+		di.metrics.BackfillSkippedElements.WithLabelValues(src.name).Add(float64(counts.Skipped))
+	}
+	return counts, err
+}
+
+// firstByte returns the first byte of r that is no whitespace, without
+// consuming it, or 0 when r holds nothing else
+func firstByte(r *bufio.Reader) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b, r.UnreadByte()
+	}
+}
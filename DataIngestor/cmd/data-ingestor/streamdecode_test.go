@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readingsArray returns a JSON array of n readings
+func readingsArray(n int) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"type":"weather","name":"berlin-%d","payload":{"temperature":%d.5,"humidity":61,"station":"tempelhof"}}`, i, i%40)
+	}
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// collectStream decodes body and returns the size of every chunk published
+func collectStream(body string, config BackfillStreamingConfig) ([]int, streamCounts, error) {
+	var chunks []int
+	counts, err := decodeStream(strings.NewReader(body), config, func(data WeatherData) error {
+		chunks = append(chunks, len(data))
+		return nil
+	})
+	return chunks, counts, err
+}
+
+func TestBackfillStreamingConfig_Validate(t *testing.T) {
+	assert.NoError(t, BackfillStreamingConfig{}.Validate())
+	assert.NoError(t, BackfillStreamingConfig{OnError: streamAbort, ChunkSize: 10, MaxElements: 100}.Validate())
+	assert.ErrorContains(t, BackfillStreamingConfig{OnError: "ignore"}.Validate(), "on_error must be skip or abort")
+	assert.ErrorContains(t, BackfillStreamingConfig{ChunkSize: -1}.Validate(), "chunk_size must not be negative")
+	assert.ErrorContains(t, BackfillConfig{Streaming: BackfillStreamingConfig{MaxElements: -1}}.Validate(), "max_elements must not be negative")
+}
+
+func TestDecodeStream_Chunks(t *testing.T) {
+	chunks, counts, err := collectStream(string(readingsArray(5)), BackfillStreamingConfig{ChunkSize: 2})
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 2, 1}, chunks)
+	assert.Equal(t, streamCounts{Elements: 5}, counts)
+
+	chunks, counts, err = collectStream(" [ ] ", BackfillStreamingConfig{})
+	require.NoError(t, err)
+	assert.Empty(t, chunks)
+	assert.Zero(t, counts.Elements)
+}
+
+func TestDecodeStream_ErrorPolicy(t *testing.T) {
+	body := `[
+		{"type":"weather","name":"berlin-1","payload":{"temperature":21.5}},
+		"not a reading",
+		{"type":"weather","name":7},
+		{"type":"weather","name":"berlin-2","payload":{"temperature":22}}
+	]`
+
+	t.Run("skip", func(t *testing.T) {
+		chunks, counts, err := collectStream(body, BackfillStreamingConfig{ChunkSize: 1})
+		require.NoError(t, err)
+		assert.Equal(t, []int{1, 1}, chunks)
+		assert.Equal(t, streamCounts{Elements: 4, Skipped: 2}, counts)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		chunks, counts, err := collectStream(body, BackfillStreamingConfig{ChunkSize: 1, OnError: streamAbort})
+		assert.ErrorContains(t, err, "element 1 is not a reading")
+		assert.Equal(t, []int{1}, chunks, "the readings before the element were published")
+		assert.Equal(t, 2, counts.Elements)
+	})
+
+	t.Run("malformed JSON always fails", func(t *testing.T) {
+		chunks, _, err := collectStream(`[{"type":"weather","name":"berlin-1"}, {"type": ]`, BackfillStreamingConfig{ChunkSize: 1})
+		assert.ErrorContains(t, err, "failed to decode element 1")
+		assert.Equal(t, []int{1}, chunks)
+
+		_, _, err = collectStream(`[{"type":"weather","name":"berlin-1"}`, BackfillStreamingConfig{})
+		assert.ErrorContains(t, err, "unexpected end of JSON input")
+	})
+
+	t.Run("no array", func(t *testing.T) {
+		_, _, err := collectStream(`{"readings": []}`, BackfillStreamingConfig{})
+		assert.ErrorContains(t, err, "response is not a JSON array")
+	})
+}
+
+func TestDecodeStream_MaxElements(t *testing.T) {
+	_, _, err := collectStream(string(readingsArray(3)), BackfillStreamingConfig{MaxElements: 3})
+	assert.NoError(t, err)
+
+	chunks, counts, err := collectStream(string(readingsArray(4)), BackfillStreamingConfig{ChunkSize: 2, MaxElements: 3})
+	assert.ErrorIs(t, err, errTooManyElements)
+	assert.Equal(t, []int{2}, chunks)
+	assert.Equal(t, 3, counts.Elements)
+}
+
+func TestDecodeStream_StopsWhenPublishFails(t *testing.T) {
+	failed := errors.New("broker gone")
+	calls := 0
+	counts, err := decodeStream(bytes.NewReader(readingsArray(10)), BackfillStreamingConfig{ChunkSize: 2}, func(WeatherData) error {
+		calls++
+		return failed
+	})
+	assert.ErrorIs(t, err, failed)
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, 2, counts.Elements, "nothing is decoded past the failed chunk")
+}
+
+// newStreamingIngestor returns a backfill ingestor with streamed pages from
+// an upstream answering every request with handler
+func newStreamingIngestor(t *testing.T, config BackfillStreamingConfig, handler http.HandlerFunc) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	ingestor, channel := newBackfillIngestor(t, server.URL, filepath.Join(t.TempDir(), "backfill.json"))
+	config.Enabled = true
+	ingestor.config.Backfill.Streaming = config
+	return ingestor, channel
+}
+
+func TestBackfill_StreamedPage(t *testing.T) {
+	body := readingsArray(1200)
+	body = append(append([]byte(`[42,`), body[1:len(body)-1]...), `,{"name":[]}]`...)
+	ingestor, channel := newStreamingIngestor(t, BackfillStreamingConfig{ChunkSize: 500}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	// Streamed pages are not bound by the body limit
+	ingestor.config.API.MaxBodyBytes = 1024
+
+	page := ingestor.backfillPage(context.Background(), ingestor.sources[0], "job-1", backfillStart, backfillStart.Add(time.Hour))
+	assert.Equal(t, pagePublished, page.Outcome, page.Error)
+	assert.Equal(t, 1200, page.Readings)
+	assert.Equal(t, 3, page.Messages, "one message per chunk")
+	assert.Equal(t, 2, page.Skipped)
+	assert.Len(t, channel.messages(), 3)
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.BackfillSkippedElements.WithLabelValues(defaultSourceName)))
+	assert.Equal(t, 1200.0, testutil.ToFloat64(ingestor.metrics.ReadingsPublished.WithLabelValues(defaultSourceName, triggerBackfill)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamFetches.WithLabelValues(defaultSourceName, triggerBackfill)))
+
+	// The page is published again with the same MessageIds
+	again := ingestor.backfillPage(context.Background(), ingestor.sources[0], "job-1", backfillStart, backfillStart.Add(time.Hour))
+	require.Equal(t, pagePublished, again.Outcome)
+	messages := channel.messages()
+	require.Len(t, messages, 6)
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, messages[i].Msg.MessageId, messages[i+3].Msg.MessageId)
+	}
+}
+
+func TestBackfill_StreamedPageAborts(t *testing.T) {
+	ingestor, channel := newStreamingIngestor(t, BackfillStreamingConfig{ChunkSize: 1, OnError: streamAbort}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `[{"type":"weather","name":"berlin-1"},{"type":1}]`)
+	})
+
+	page := ingestor.backfillPage(context.Background(), ingestor.sources[0], "job-1", backfillStart, backfillStart.Add(time.Hour))
+	assert.Equal(t, pageFailed, page.Outcome)
+	assert.Contains(t, page.Error, "element 1 is not a reading")
+	assert.Equal(t, 1, page.Readings)
+	assert.Len(t, channel.messages(), 1)
+}
+
+func TestBackfill_StreamedPageNotRetriedOncePublished(t *testing.T) {
+	var requests int32
+	ingestor, channel := newStreamingIngestor(t, BackfillStreamingConfig{ChunkSize: 2}, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Header().Set("Content-Type", "application/json")
+		body := readingsArray(3)
+		// The connection breaks off in the third reading
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		w.Write(body[:len(body)-20])
+	})
+	ingestor.config.API.RetryCount = 2
+	ingestor.config.API.RetryBackoff = Duration(time.Millisecond)
+
+	page := ingestor.backfillPage(context.Background(), ingestor.sources[0], "job-1", backfillStart, backfillStart.Add(time.Hour))
+	assert.Equal(t, pageFailed, page.Outcome)
+	assert.Contains(t, page.Error, errStreamInterrupted.Error())
+	assert.Equal(t, 2, page.Readings)
+	assert.Len(t, channel.messages(), 1)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+func TestBackfill_StreamedPageFallsBack(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		status      int
+		body        string
+		outcome     string
+		readings    int
+	}{
+		{"no content", "", http.StatusNoContent, "", pageNoData, 0},
+		{"empty object", "application/json", http.StatusOK, `{}`, pageNoData, 0},
+		{"csv", "text/csv", http.StatusOK, "type,name,temperature\nweather,berlin-1,21.5\n", pagePublished, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ingestor, _ := newStreamingIngestor(t, BackfillStreamingConfig{}, func(w http.ResponseWriter, r *http.Request) {
+				if tt.contentType != "" {
+					w.Header().Set("Content-Type", tt.contentType)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			})
+			ingestor.sources[0].csv = CSVConfig{Columns: map[string]string{"type": "type", "name": "name"}}
+
+			page := ingestor.backfillPage(context.Background(), ingestor.sources[0], "job-1", backfillStart, backfillStart.Add(time.Hour))
+			assert.Equal(t, tt.outcome, page.Outcome, page.Error)
+			assert.Equal(t, tt.readings, page.Readings)
+		})
+	}
+}
+
+// BenchmarkDecode_50k compares decoding a 50k-record page whole with
+// streaming it in chunks. live-B is the most heap in use after a GC while
+// the page was being decoded.
+func BenchmarkDecode_50k(b *testing.B) {
+	body := readingsArray(50000)
+	slice := func(checkpoint func()) {
+		read, err := io.ReadAll(bytes.NewReader(body))
+		if err != nil {
+			b.Fatal(err)
+		}
+		var data WeatherData
+		if err := json.Unmarshal(read, &data); err != nil {
+			b.Fatal(err)
+		}
+		checkpoint()
+		runtime.KeepAlive(read)
+		runtime.KeepAlive(data)
+	}
+	stream := func(checkpoint func()) {
+		_, err := decodeStream(bytes.NewReader(body), BackfillStreamingConfig{}, func(WeatherData) error {
+			checkpoint()
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	for _, bench := range []struct {
+		name   string
+		decode func(checkpoint func())
+	}{{"slice", slice}, {"stream", stream}} {
+		b.Run(bench.name, func(b *testing.B) {
+			var stats runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&stats)
+			base, peak := stats.HeapAlloc, uint64(0)
+			bench.decode(func() {
+				runtime.GC()
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > peak {
+					peak = stats.HeapAlloc
+				}
+			})
+			live := 0.0
+			if peak > base {
+				live = float64(peak - base)
+			}
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				bench.decode(func() {})
+			}
+			b.ReportMetric(live, "live-B")
+		})
+	}
+}
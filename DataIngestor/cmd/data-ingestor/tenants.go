@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// defaultTenant names the top-level configuration, whose routes are also
+	// served unscoped
+	defaultTenant = "default"
+	tenantLabel   = "tenant"
+)
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+// TenantConfig is one tenant of a shared deployment. The tenant runs its own
+// pipeline with everything not set here taken from the top-level
+// configuration.
+type TenantConfig struct {
+	API APIConfig `yaml:"api"`
+	// QueuePrefix is prepended to the queue name and to the routing keys of
+	// the routing rules
+	QueuePrefix string `yaml:"queue_prefix"`
+	// AuthKeys are accepted in the X-API-Key header under /tenants/{name}.
+	// The tenant's endpoints are open like the unscoped ones when empty.
+	AuthKeys []string `yaml:"auth_keys"`
+	// Admin replaces the top-level admin token for the tenant's admin API
+	Admin AdminConfig `yaml:"admin"`
+	// Validation replaces the top-level validation section
+	Validation *ValidationConfig `yaml:"validation"`
+
+	// err is why the tenant could not be decoded, reported when it starts
+	err error
+}
+
+// UnmarshalYAML keeps a tenant that fails to decode from failing the whole
+// configuration; the error is reported for that tenant only
+func (c *TenantConfig) UnmarshalYAML(value *yaml.Node) error {
+	type plain TenantConfig
+	var decoded plain
+	if err := value.Decode(&decoded); err != nil {
+		*c = TenantConfig{err: fmt.Errorf("failed to unmarshal config: %w", err)}
+		return nil
+	}
+	*c = TenantConfig(decoded)
+	return nil
+}
+
+// tenantConfig derives the configuration a tenant runs with. Webhooks,
+// Pub/Sub, the debug endpoints and the daemon settings stay with the default
+// tenant; archive and snapshot files and Redis dedup keys get a per-tenant
+// name.
+func (c *Config) tenantConfig(name string) (*Config, error) {
+	if name == defaultTenant {
+		return nil, fmt.Errorf("tenant name %q is reserved for the top-level configuration", defaultTenant)
+	}
+	if !tenantNamePattern.MatchString(name) {
+		return nil, fmt.Errorf("tenant name must be lowercase letters, digits and '-', got %q", name)
+	}
+	tc := c.Tenants[name]
+	if tc.err != nil {
+		return nil, tc.err
+	}
+	if tc.QueuePrefix == "" {
+		return nil, fmt.Errorf("queue_prefix is required")
+	}
+
+	derived := *c
+	derived.tenant = name
+	derived.Tenants = nil
+	derived.warnings = nil
+	derived.profile = ""
+	derived.API = tc.API
+	derived.RabbitMQ.QueueName = tc.QueuePrefix + c.RabbitMQ.QueueName
+	derived.Routing = c.Routing.withPrefix(tc.QueuePrefix)
+	if c.RabbitMQ.Partitioning.Count > 0 {
+		prefix := c.RabbitMQ.Partitioning.RoutingKeyPrefix
+		if prefix == "" {
+			prefix = defaultPartitionRoutingKeyPrefix
+		}
+		derived.RabbitMQ.Partitioning.RoutingKeyPrefix = tc.QueuePrefix + prefix
+		state := c.RabbitMQ.Partitioning.StateFile
+		if state == "" {
+			state = defaultPartitionStateFile
+		}
+		derived.RabbitMQ.Partitioning.StateFile = state + "." + name
+	}
+	if tc.Validation != nil {
+		derived.Validation = *tc.Validation
+	}
+	if tc.Admin.Token != "" {
+		derived.Admin = tc.Admin
+	}
+	if c.InstanceID != "" {
+		derived.InstanceID = c.InstanceID + "-" + name
+	}
+	if c.FileSink.Dir != "" {
+		derived.FileSink.Dir = filepath.Join(c.FileSink.Dir, name)
+	}
+	if c.MetricsSnapshot.StateFile != "" {
+		derived.MetricsSnapshot.StateFile = c.MetricsSnapshot.StateFile + "." + name
+	}
+	if c.Report.Enabled {
+		derived.Report.StateFile = c.Report.StateFile + "." + name
+		derived.Report.RoutingKey = tc.QueuePrefix + c.Report.RoutingKey
+	}
+	if c.Backfill.Enabled {
+		state := c.Backfill.StateFile
+		if state == "" {
+			state = defaultBackfillStateFile
+		}
+		derived.Backfill.StateFile = state + "." + name
+	}
+	if c.Quarantine.Enabled {
+		state := c.Quarantine.StateFile
+		if state == "" {
+			state = defaultQuarantineStateFile
+		}
+		derived.Quarantine.StateFile = state + "." + name
+	}
+	if c.CycleJournal.StateFile != "" {
+		derived.CycleJournal.StateFile = c.CycleJournal.StateFile + "." + name
+	}
+	if c.Aggregates.Enabled {
+		state := c.Aggregates.StateFile
+		if state == "" {
+			state = defaultAggregatesStateFile
+		}
+		derived.Aggregates.StateFile = state + "." + name
+	}
+	if c.ReadingDedup.Redis.Addr != "" {
+		prefix := c.ReadingDedup.Redis.KeyPrefix
+		if prefix == "" {
+			prefix = defaultRedisDedupKeyPrefix
+		}
+		derived.ReadingDedup.Redis.KeyPrefix = prefix + name + ":"
+	}
+	derived.Subscribers = nil
+	derived.PubSub = PubSubConfig{}
+	derived.Debug = DebugConfig{}
+	derived.Daemon = DaemonConfig{}
+	// The heap is shared, so the default tenant's guard covers every tenant
+	derived.MemoryGuard = MemoryGuardConfig{}
+
+	if state := derived.API.Incremental.StateFile; derived.API.Incremental.Enabled && state != "" && state == c.API.Incremental.StateFile {
+		return nil, fmt.Errorf("api.incremental.state_file %s is already used by the default tenant", state)
+	}
+	if err := derived.Validate(); err != nil {
+		return nil, err
+	}
+	return &derived, nil
+}
+
+// withPrefix returns the routing rules with prefix prepended to every
+// routing key
+func (c RoutingConfig) withPrefix(prefix string) RoutingConfig {
+	if len(c.Rules) == 0 {
+		return c
+	}
+	rules := make([]RoutingRule, len(c.Rules))
+	for i, rule := range c.Rules {
+		rule.Targets = append([]RoutingTarget(nil), rule.Targets...)
+		for j := range rule.Targets {
+			rule.Targets[j].RoutingKey = prefix + rule.Targets[j].RoutingKey
+		}
+		rules[i] = rule
+	}
+	c.Rules = rules
+	return c
+}
+
+// tenantHook adds the tenant to every log entry of a tenant's ingestor
+type tenantHook struct {
+	name string
+}
+
+func (h tenantHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h tenantHook) Fire(entry *logrus.Entry) error {
+	entry.Data[tenantLabel] = h.name
+	return nil
+}
+
+// tenant is one configured tenant. A tenant that failed to start keeps its
+// error and answers 503.
+type tenant struct {
+	name     string
+	authKeys []string
+	ingestor *DataIngestor
+	handler  http.Handler
+	err      error
+	// stop ends the tenant's workers; set while running
+	stop func()
+}
+
+// authorized reports whether key is one of the tenant's keys
+func (t *tenant) authorized(key string) bool {
+	if len(t.authKeys) == 0 {
+		return true
+	}
+	for _, want := range t.authKeys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(want)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// SetupTenants starts an ingestor for every configured tenant: each loads its
+// location metadata, resolves its upstream credentials and connects to
+// RabbitMQ. A tenant that fails is logged and disabled; the others start
+// regardless.
+func (di *DataIngestor) SetupTenants() {
+	di.setupTenants((*DataIngestor).ConnectToRabbitMQ)
+}
+
+// setupTenants is SetupTenants with the broker connection replaceable in tests
+func (di *DataIngestor) setupTenants(connect func(*DataIngestor) error) {
+	if len(di.config.Tenants) == 0 {
+		return
+	}
+	names := make([]string, 0, len(di.config.Tenants))
+	for name := range di.config.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	di.tenants = make(map[string]*tenant, len(names))
+	prefixes := map[string]string{}
+	for _, name := range names {
+		t := &tenant{name: name, authKeys: di.config.Tenants[name].AuthKeys}
+		di.tenants[name] = t
+		logger := di.logger.WithField(tenantLabel, name)
+		if t.err = di.startTenant(t, prefixes, connect); t.err != nil {
+			logger.WithError(t.err).Error("Tenant disabled")
+			continue
+		}
+		logger.WithField("queue", t.ingestor.config.RabbitMQ.QueueName).Info("Tenant started")
+	}
+}
+
+func (di *DataIngestor) startTenant(t *tenant, prefixes map[string]string, connect func(*DataIngestor) error) error {
+	config, err := di.config.configured().tenantConfig(t.name)
+	if err != nil {
+		return fmt.Errorf("invalid config: %w", err)
+	}
+	prefix := di.config.Tenants[t.name].QueuePrefix
+	if other, ok := prefixes[prefix]; ok {
+		return fmt.Errorf("queue_prefix %q is already used by tenant %s", prefix, other)
+	}
+	prefixes[prefix] = t.name
+
+	ingestor := NewDataIngestor(config)
+	if err := ingestor.LoadEnrichment(); err != nil {
+		ingestor.Close()
+		return err
+	}
+	if err := ingestor.ConfigureAuth(); err != nil {
+		ingestor.Close()
+		return fmt.Errorf("failed to configure upstream auth: %w", err)
+	}
+	if err := connect(ingestor); err != nil {
+		ingestor.Close()
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	ingestor.memory = di.memory
+	ingestor.resources = di.resources
+	t.ingestor = ingestor
+	t.handler = setupRoutes(ingestor)
+	return nil
+}
+
+// runningTenants returns the tenants that started, by name
+func (di *DataIngestor) runningTenants() []*tenant {
+	var running []*tenant
+	for _, t := range di.tenants {
+		if t.ingestor != nil {
+			running = append(running, t)
+		}
+	}
+	sort.Slice(running, func(i, j int) bool { return running[i].name < running[j].name })
+	return running
+}
+
+// startTenants starts the workers of every running tenant
+func (di *DataIngestor) startTenants() {
+	for _, t := range di.runningTenants() {
+		t.stop = t.ingestor.startWorkers()
+	}
+}
+
+// stopTenants stops polling for every tenant and disconnects their stream
+// clients, so the HTTP server can drain
+func (di *DataIngestor) stopTenants() {
+	for _, t := range di.runningTenants() {
+		if t.stop != nil {
+			t.stop()
+		}
+		t.ingestor.stream.Close()
+	}
+}
+
+// closeTenants saves the tenants' metrics and closes their connections
+func (di *DataIngestor) closeTenants() {
+	for _, t := range di.runningTenants() {
+		t.ingestor.saveMetrics()
+		t.ingestor.Close()
+	}
+}
+
+// handleTenant serves /tenants/{name}/... with the routes of that tenant.
+// The default tenant is served by engine, the top-level routes.
+func (di *DataIngestor) handleTenant(engine *gin.Engine) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name, path := c.Param("tenant"), c.Param("path")
+		c.Request.URL.Path = path
+		c.Request.URL.RawPath = ""
+		if name == defaultTenant {
+			engine.HandleContext(c)
+			return
+		}
+
+		t, ok := di.tenants[name]
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{
+				"error": fmt.Sprintf("unknown tenant %q", name),
+			})
+			return
+		}
+		if !t.authorized(c.GetHeader("X-API-Key")) {
+			c.JSON(http.StatusUnauthorized, gin.H{
+				"error": "invalid API key",
+			})
+			return
+		}
+		if t.err != nil {
+			c.JSON(http.StatusServiceUnavailable, gin.H{
+				"error": fmt.Sprintf("tenant %s is disabled: %v", name, t.err),
+			})
+			return
+		}
+		if path == "/admin/shutdown" {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error": "shutdown stops every tenant; use POST /admin/shutdown",
+			})
+			return
+		}
+		t.handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
+
+// tenantMetrics serves the metrics of every tenant, each labelled with its
+// tenant, the top-level ones as "default"
+func (di *DataIngestor) tenantMetrics() gin.HandlerFunc {
+	gatherers := prometheus.Gatherers{tenantGatherer{name: defaultTenant, gatherer: di.metrics.registry}}
+	for _, t := range di.runningTenants() {
+		gatherers = append(gatherers, tenantGatherer{name: t.name, gatherer: t.ingestor.metrics.registry})
+	}
+	return gin.WrapH(promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
+}
+
+// tenantGatherer adds the tenant label to every metric of a registry
+type tenantGatherer struct {
+	name     string
+	gatherer prometheus.Gatherer
+}
+
+func (g tenantGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			label, value := tenantLabel, g.name
+			metric.Label = append(metric.Label, &dto.LabelPair{Name: &label, Value: &value})
+			sort.Slice(metric.Label, func(i, j int) bool {
+				return metric.Label[i].GetName() < metric.Label[j].GetName()
+			})
+		}
+	}
+	return families, err
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func tenantUpstream(t *testing.T, location string) string {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"energy","name":"` + location + `","payload":{"energy":1}}]`))
+	}))
+	t.Cleanup(upstream.Close)
+	return upstream.URL
+}
+
+// newTenantTestIngestor sets up the default ingestor and its tenants, each
+// connected to its own fake channel, keyed by tenant
+func newTenantTestIngestor(t *testing.T, tenants map[string]TenantConfig) (*DataIngestor, map[string]*fakeChannel) {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: tenantUpstream(t, "meter-1"), Timeout: Duration(5 * time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Logging:  LoggingConfig{Level: "panic"},
+		Tenants:  tenants,
+	})
+	channels := map[string]*fakeChannel{defaultTenant: {}}
+	attachChannel(ingestor, channels[defaultTenant], nil)
+	ingestor.setupTenants(func(tenant *DataIngestor) error {
+		channel := &fakeChannel{}
+		channels[tenant.config.tenant] = channel
+		attachChannel(tenant, channel, nil)
+		return nil
+	})
+	for _, tenant := range ingestor.runningTenants() {
+		tenant.ingestor.logger.SetOutput(io.Discard)
+	}
+	return ingestor, channels
+}
+
+func serveTenant(router http.Handler, method, path string, header map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestConfig_TenantConfig(t *testing.T) {
+	bounds := ValidationConfig{Bounds: map[string]Bounds{"energy": {Min: bound(0)}}}
+	config := &Config{
+		InstanceID: "ingestor-1",
+		API:        APIConfig{BaseURL: "http://shared.example.com"},
+		RabbitMQ:   RabbitMQConfig{QueueName: "readings"},
+		Routing: RoutingConfig{Rules: []RoutingRule{{
+			Name:    "alerts",
+			Targets: []RoutingTarget{{Exchange: "weather", RoutingKey: "alerts"}},
+		}}},
+		Admin:           AdminConfig{Token: "shared"},
+		FileSink:        FileSinkConfig{Dir: "/var/lib/ingestor/archive"},
+		MetricsSnapshot: MetricsSnapshotConfig{StateFile: "/var/lib/ingestor/metrics.json"},
+		Report:          ReportConfig{Enabled: true, RoutingKey: "reports.daily", StateFile: "/var/lib/ingestor/report.json"},
+		Backfill:        BackfillConfig{Enabled: true},
+		Subscribers:     []SubscriberConfig{{URL: "http://hooks.example.com"}},
+		Debug:           DebugConfig{Enabled: true},
+		Tenants: map[string]TenantConfig{
+			"acme": {
+				API:         APIConfig{BaseURL: "http://acme.example.com"},
+				QueuePrefix: "acme.",
+				Validation:  &bounds,
+			},
+			"globex": {
+				API:         APIConfig{BaseURL: "http://globex.example.com"},
+				QueuePrefix: "globex.",
+				Admin:       AdminConfig{Token: "globex-admin"},
+			},
+		},
+	}
+
+	acme, err := config.tenantConfig("acme")
+	require.NoError(t, err)
+	assert.Equal(t, "acme", acme.tenant)
+	assert.Equal(t, "http://acme.example.com", acme.API.BaseURL)
+	assert.Equal(t, "acme.readings", acme.RabbitMQ.QueueName)
+	assert.Equal(t, "acme.alerts", acme.Routing.Rules[0].Targets[0].RoutingKey)
+	assert.Equal(t, "alerts", config.Routing.Rules[0].Targets[0].RoutingKey, "the top-level rules are unchanged")
+	assert.Equal(t, bounds, acme.Validation)
+	assert.Equal(t, "shared", acme.Admin.Token)
+	assert.Equal(t, "ingestor-1-acme", acme.InstanceID)
+	assert.Equal(t, filepath.Join("/var/lib/ingestor/archive", "acme"), acme.FileSink.Dir)
+	assert.Equal(t, "/var/lib/ingestor/metrics.json.acme", acme.MetricsSnapshot.StateFile)
+	assert.Equal(t, "/var/lib/ingestor/report.json.acme", acme.Report.StateFile)
+	assert.Equal(t, "acme.reports.daily", acme.Report.RoutingKey)
+	assert.Equal(t, "backfill.json.acme", acme.Backfill.StateFile)
+	assert.Empty(t, acme.Subscribers)
+	assert.False(t, acme.Debug.Enabled)
+	assert.Nil(t, acme.Tenants)
+
+	globex, err := config.tenantConfig("globex")
+	require.NoError(t, err)
+	assert.Equal(t, "globex-admin", globex.Admin.Token)
+	assert.Empty(t, globex.Validation.Bounds)
+}
+
+func TestConfig_TenantConfigErrors(t *testing.T) {
+	config := &Config{
+		API:      APIConfig{Incremental: IncrementalConfig{Enabled: true, StateFile: "cursors.json", TimestampField: "ts"}},
+		RabbitMQ: RabbitMQConfig{QueueName: "readings"},
+		Tenants: map[string]TenantConfig{
+			defaultTenant: {QueuePrefix: "d."},
+			"Acme":        {QueuePrefix: "acme."},
+			"noprefix":    {},
+			"cursors": {QueuePrefix: "c.", API: APIConfig{
+				Incremental: IncrementalConfig{Enabled: true, StateFile: "cursors.json", TimestampField: "ts"},
+			}},
+			"invalid": {QueuePrefix: "i.", Validation: &ValidationConfig{Action: "explode"}},
+		},
+	}
+	tests := map[string]string{
+		defaultTenant: "reserved",
+		"Acme":        "lowercase",
+		"noprefix":    "queue_prefix is required",
+		"cursors":     "already used by the default tenant",
+		"invalid":     "validation.action",
+	}
+	for name, want := range tests {
+		_, err := config.tenantConfig(name)
+		assert.ErrorContains(t, err, want, name)
+	}
+}
+
+func TestLoadConfig_BrokenTenantDoesNotFailConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`
+rabbitmq:
+  queue_name: readings
+tenants:
+  acme:
+    queue_prefix: acme.
+    api:
+      base_url: http://acme.example.com
+      timeout: 5s
+  broken:
+    queue_prefix: broken.
+    api:
+      timeout: [5s]
+`), 0o644))
+
+	config, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Len(t, config.Tenants, 2)
+
+	acme, err := config.tenantConfig("acme")
+	require.NoError(t, err)
+	assert.Equal(t, Duration(5*time.Second), acme.API.Timeout)
+	_, err = config.tenantConfig("broken")
+	assert.ErrorContains(t, err, "failed to unmarshal config")
+}
+
+func TestSetupTenants_BrokenTenantDoesNotStopOthers(t *testing.T) {
+	ingestor, channels := newTenantTestIngestor(t, map[string]TenantConfig{
+		"acme":    {QueuePrefix: "acme.", API: APIConfig{BaseURL: tenantUpstream(t, "acme-1")}},
+		"broken":  {QueuePrefix: "broken.", Validation: &ValidationConfig{Action: "explode"}},
+		"copycat": {QueuePrefix: "acme.", API: APIConfig{BaseURL: tenantUpstream(t, "copycat-1")}},
+		"globex":  {QueuePrefix: "globex.", API: APIConfig{BaseURL: tenantUpstream(t, "globex-1")}},
+	})
+
+	running := ingestor.runningTenants()
+	require.Len(t, running, 2)
+	assert.Equal(t, "acme", running[0].name)
+	assert.Equal(t, "globex", running[1].name)
+	assert.ErrorContains(t, ingestor.tenants["broken"].err, "validation.action")
+	assert.ErrorContains(t, ingestor.tenants["copycat"].err, `queue_prefix "acme." is already used by tenant acme`)
+	assert.NotContains(t, channels, "broken")
+
+	router := setupRoutes(ingestor)
+	w := serveTenant(router, http.MethodGet, "/tenants/broken/health", nil)
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+	assert.Contains(t, w.Body.String(), "tenant broken is disabled")
+	assert.Equal(t, http.StatusOK, serveTenant(router, http.MethodGet, "/tenants/globex/health", nil).Code)
+}
+
+func TestSetupTenants_ConnectFailureDisablesTenant(t *testing.T) {
+	ingestor := NewDataIngestor(&Config{
+		RabbitMQ: RabbitMQConfig{QueueName: "readings"},
+		Logging:  LoggingConfig{Level: "panic"},
+		Tenants: map[string]TenantConfig{
+			"acme":   {QueuePrefix: "acme."},
+			"globex": {QueuePrefix: "globex."},
+		},
+	})
+	ingestor.setupTenants(func(tenant *DataIngestor) error {
+		if tenant.config.tenant == "acme" {
+			return errors.New("connection refused")
+		}
+		attachChannel(tenant, &fakeChannel{}, nil)
+		return nil
+	})
+	assert.EqualError(t, ingestor.tenants["acme"].err, "failed to connect to RabbitMQ: connection refused")
+	assert.NoError(t, ingestor.tenants["globex"].err)
+}
+
+func TestTenantRoutes_ScopedAndAuthorized(t *testing.T) {
+	ingestor, _ := newTenantTestIngestor(t, map[string]TenantConfig{
+		"acme": {QueuePrefix: "acme.", AuthKeys: []string{"acme-key", "acme-key-2"}, API: APIConfig{BaseURL: tenantUpstream(t, "acme-1")}},
+		"open": {QueuePrefix: "open.", API: APIConfig{BaseURL: tenantUpstream(t, "open-1")}},
+	})
+	router := setupRoutes(ingestor)
+
+	assert.Equal(t, http.StatusUnauthorized, serveTenant(router, http.MethodGet, "/tenants/acme/health", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, serveTenant(router, http.MethodGet, "/tenants/acme/health", map[string]string{"X-API-Key": "wrong"}).Code)
+	assert.Equal(t, http.StatusOK, serveTenant(router, http.MethodGet, "/tenants/acme/health", map[string]string{"X-API-Key": "acme-key-2"}).Code)
+	assert.Equal(t, http.StatusOK, serveTenant(router, http.MethodGet, "/tenants/open/health", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serveTenant(router, http.MethodGet, "/tenants/initech/health", nil).Code)
+	assert.Equal(t, http.StatusNotFound, serveTenant(router, http.MethodGet, "/tenants/acme/nowhere", map[string]string{"X-API-Key": "acme-key"}).Code)
+
+	// Admin routes still take the admin token, which the tenant inherits
+	assert.Equal(t, http.StatusUnauthorized, serveTenant(router, http.MethodPost, "/tenants/open/admin/pause", nil).Code)
+	assert.Equal(t, http.StatusOK, serveTenant(router, http.MethodPost, "/tenants/open/admin/pause", map[string]string{"Authorization": "Bearer letmein"}).Code)
+	assert.True(t, ingestor.tenants["open"].ingestor.paused.Load())
+	assert.False(t, ingestor.paused.Load(), "the default tenant keeps polling")
+
+	w := serveTenant(router, http.MethodPost, "/tenants/open/admin/shutdown", map[string]string{"Authorization": "Bearer letmein"})
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	// The unscoped routes and /tenants/default are the default tenant
+	for _, path := range []string{"/health", "/tenants/default/health"} {
+		w := serveTenant(router, http.MethodGet, path, nil)
+		assert.Equal(t, http.StatusOK, w.Code, path)
+		assert.Contains(t, w.Body.String(), ingestor.instanceID, path)
+	}
+}
+
+func TestTenants_PublishToOwnQueues(t *testing.T) {
+	ingestor, channels := newTenantTestIngestor(t, map[string]TenantConfig{
+		"acme": {QueuePrefix: "acme.", API: APIConfig{BaseURL: tenantUpstream(t, "acme-1")}},
+	})
+	router := setupRoutes(ingestor)
+
+	w := serveTenant(router, http.MethodPost, "/tenants/acme/ingest", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Contains(t, w.Body.String(), "acme-1")
+	assert.Empty(t, channels[defaultTenant].messages())
+	messages := channels["acme"].messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "acme.meter-data-queue", messages[0].RoutingKey)
+
+	w = serveTenant(router, http.MethodPost, "/ingest", nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	messages = channels[defaultTenant].messages()
+	require.Len(t, messages, 1)
+	assert.Equal(t, "meter-data-queue", messages[0].RoutingKey)
+	assert.Len(t, channels["acme"].messages(), 1)
+}
+
+func TestTenants_MetricsLabelledByTenant(t *testing.T) {
+	ingestor, _ := newTenantTestIngestor(t, map[string]TenantConfig{
+		"acme": {QueuePrefix: "acme.", API: APIConfig{BaseURL: tenantUpstream(t, "acme-1")}},
+	})
+	router := setupRoutes(ingestor)
+	require.Equal(t, http.StatusOK, serveTenant(router, http.MethodPost, "/tenants/acme/ingest", nil).Code)
+	require.Equal(t, http.StatusOK, serveTenant(router, http.MethodPost, "/ingest", nil).Code)
+
+	w := serveTenant(router, http.MethodGet, "/metrics", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(t, body, `data_ingestor_messages_published_total{routing_key="acme.meter-data-queue",sink="amqp",tenant="acme"} 1`)
+	assert.Contains(t, body, `data_ingestor_messages_published_total{routing_key="meter-data-queue",sink="amqp",tenant="default"} 1`)
+
+	// Scoped, the tenant's own metrics without the label
+	w = serveTenant(router, http.MethodGet, "/tenants/acme/metrics", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `data_ingestor_messages_published_total{routing_key="acme.meter-data-queue",sink="amqp"} 1`)
+	assert.False(t, strings.Contains(w.Body.String(), `tenant="default"`))
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultAdaptiveWindow          = 100
+	defaultAdaptiveMinSamples      = 20
+	defaultAdaptivePercentile      = 0.99
+	defaultAdaptiveMultiplier      = 3
+	defaultAdaptiveMin             = time.Second
+	defaultAdaptiveMax             = time.Minute
+	defaultAdaptiveChangeThreshold = 0.2
+)
+
+// AdaptiveTimeoutConfig derives the per-attempt upstream timeout from recent
+// fetch latencies: a percentile of the window times Multiplier, bounded by
+// Min and Max. Until MinSamples latencies are known api.timeout applies.
+type AdaptiveTimeoutConfig struct {
+	Enabled    bool     `yaml:"enabled"`
+	Window     int      `yaml:"window"`
+	MinSamples int      `yaml:"min_samples"`
+	Percentile float64  `yaml:"percentile"`
+	Multiplier float64  `yaml:"multiplier"`
+	Min        Duration `yaml:"min"`
+	Max        Duration `yaml:"max"`
+	// ChangeThreshold is the relative change of the timeout that is logged
+	ChangeThreshold float64 `yaml:"change_threshold"`
+}
+
+// Validate checks the window and bounds
+func (c AdaptiveTimeoutConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	c = c.withDefaults()
+	switch {
+	case c.Window < 1 || c.MinSamples < 1:
+		return fmt.Errorf("api.adaptive_timeout.window and min_samples must be positive")
+	case c.MinSamples > c.Window:
+		return fmt.Errorf("api.adaptive_timeout.min_samples must not exceed the window of %d", c.Window)
+	case c.Percentile <= 0 || c.Percentile > 1:
+		return fmt.Errorf("api.adaptive_timeout.percentile must be in (0, 1], got %v", c.Percentile)
+	case c.Multiplier < 1:
+		return fmt.Errorf("api.adaptive_timeout.multiplier must be at least 1, got %v", c.Multiplier)
+	case c.Min < 0 || c.Min > c.Max:
+		return fmt.Errorf("api.adaptive_timeout.min must be between 0 and max (%s)", c.Max)
+	case c.ChangeThreshold < 0:
+		return fmt.Errorf("api.adaptive_timeout.change_threshold must not be negative")
+	}
+	return nil
+}
+
+// withDefaults fills in unset values
+func (c AdaptiveTimeoutConfig) withDefaults() AdaptiveTimeoutConfig {
+	if c.Window == 0 {
+		c.Window = defaultAdaptiveWindow
+	}
+	if c.MinSamples == 0 {
+		c.MinSamples = defaultAdaptiveMinSamples
+		if c.MinSamples > c.Window {
+			c.MinSamples = c.Window
+		}
+	}
+	if c.Percentile == 0 {
+		c.Percentile = defaultAdaptivePercentile
+	}
+	if c.Multiplier == 0 {
+		c.Multiplier = defaultAdaptiveMultiplier
+	}
+	if c.Min == 0 {
+		c.Min = Duration(defaultAdaptiveMin)
+	}
+	if c.Max == 0 {
+		c.Max = Duration(defaultAdaptiveMax)
+	}
+	if c.ChangeThreshold == 0 {
+		c.ChangeThreshold = defaultAdaptiveChangeThreshold
+	}
+	return c
+}
+
+// TimeoutStats is the effective upstream timeout of one location in /stats
+type TimeoutStats struct {
+	TimeoutMS int64 `json:"timeout_ms"`
+	// Adaptive is false while too few latencies are known and api.timeout applies
+	Adaptive     bool  `json:"adaptive"`
+	Samples      int   `json:"samples"`
+	PercentileMS int64 `json:"percentile_ms,omitempty"`
+}
+
+// adaptiveTimeout keeps a sliding window of fetch latencies for one location
+type adaptiveTimeout struct {
+	config AdaptiveTimeoutConfig
+	static time.Duration
+
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+	// reported is the timeout last logged
+	reported time.Duration
+}
+
+// newAdaptiveTimeout returns nil when adaptive timeouts are disabled
+func newAdaptiveTimeout(config AdaptiveTimeoutConfig, static time.Duration) *adaptiveTimeout {
+	if !config.Enabled {
+		return nil
+	}
+	config = config.withDefaults()
+	if static <= 0 {
+		static = time.Duration(config.Max)
+	}
+	return &adaptiveTimeout{
+		config:   config,
+		static:   static,
+		samples:  make([]time.Duration, 0, config.Window),
+		reported: static,
+	}
+}
+
+// observe adds a latency, replacing the oldest once the window is full. It
+// returns the new timeout and whether it moved by more than the change
+// threshold since it was last reported.
+func (a *adaptiveTimeout) observe(latency time.Duration) (from, to time.Duration, changed bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.samples) < a.config.Window {
+		a.samples = append(a.samples, latency)
+	} else {
+		a.samples[a.next] = latency
+	}
+	a.next = (a.next + 1) % a.config.Window
+
+	from, to = a.reported, a.current()
+	if math.Abs(float64(to-from))/float64(from) > a.config.ChangeThreshold {
+		a.reported = to
+		return from, to, from != to
+	}
+	return from, to, false
+}
+
+// reset forgets the latencies, for a location that moved to another host
+func (a *adaptiveTimeout) reset() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.samples, a.next, a.reported = a.samples[:0], 0, a.static
+}
+
+// timeout returns the timeout for the next attempt
+func (a *adaptiveTimeout) timeout() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.current()
+}
+
+// current computes the timeout from the window. Callers hold mu.
+func (a *adaptiveTimeout) current() time.Duration {
+	if len(a.samples) < a.config.MinSamples {
+		return a.static
+	}
+	timeout := time.Duration(float64(a.percentile()) * a.config.Multiplier)
+	if min := time.Duration(a.config.Min); timeout < min {
+		timeout = min
+	}
+	if max := time.Duration(a.config.Max); timeout > max {
+		timeout = max
+	}
+	return timeout
+}
+
+// percentile returns the nearest-rank percentile of the window. Callers hold mu.
+func (a *adaptiveTimeout) percentile() time.Duration {
+	if len(a.samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), a.samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	rank := int(math.Ceil(a.config.Percentile*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func (a *adaptiveTimeout) stats() TimeoutStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := TimeoutStats{
+		TimeoutMS: a.current().Milliseconds(),
+		Adaptive:  len(a.samples) >= a.config.MinSamples,
+		Samples:   len(a.samples),
+	}
+	if len(a.samples) > 0 {
+		stats.PercentileMS = a.percentile().Milliseconds()
+	}
+	return stats
+}
+
+// attemptTimeout returns the timeout of the next fetch from src, zero when
+// the HTTP client's static timeout applies
+func (s *source) attemptTimeout() time.Duration {
+	if s.timeouts == nil {
+		return 0
+	}
+	return s.timeouts.timeout()
+}
+
+// observeLatency feeds a completed fetch to the location's adaptive timeout
+// and logs when the timeout moved by more than the change threshold
+func (di *DataIngestor) observeLatency(src *source, latency time.Duration) {
+	if src.timeouts == nil {
+		return
+	}
+	from, to, changed := src.timeouts.observe(latency)
+	di.metrics.UpstreamTimeout.WithLabelValues(src.name).Set(to.Seconds())
+	if changed {
+		di.log(logFetch).WithFields(logrus.Fields{
+			"location": src.name,
+			"from":     from.String(),
+			"to":       to.String(),
+		}).Info("Upstream timeout adjusted")
+	}
+}
+
+// clientTimeout is the HTTP client timeout, which with adaptive timeouts
+// only caps the per-attempt ones
+func (c APIConfig) clientTimeout() time.Duration {
+	if !c.AdaptiveTimeout.Enabled {
+		return time.Duration(c.Timeout)
+	}
+	limit := time.Duration(c.AdaptiveTimeout.withDefaults().Max)
+	if static := time.Duration(c.Timeout); static > limit {
+		limit = static
+	}
+	return limit
+}
+
+// timeoutStats returns the effective timeout per location, or nil when
+// adaptive timeouts are disabled
+func (di *DataIngestor) timeoutStats() map[string]TimeoutStats {
+	if !di.config.API.AdaptiveTimeout.Enabled {
+		return nil
+	}
+	sources := di.currentSources()
+	stats := make(map[string]TimeoutStats, len(sources))
+	for _, src := range sources {
+		stats[src.name] = src.timeouts.stats()
+	}
+	return stats
+}
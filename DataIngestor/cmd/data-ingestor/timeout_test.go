@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAdaptiveConfig() AdaptiveTimeoutConfig {
+	return AdaptiveTimeoutConfig{
+		Enabled:         true,
+		Window:          10,
+		MinSamples:      5,
+		Percentile:      0.9,
+		Multiplier:      2,
+		Min:             Duration(200 * time.Millisecond),
+		Max:             Duration(5 * time.Second),
+		ChangeThreshold: 0.25,
+	}
+}
+
+func observeAll(a *adaptiveTimeout, latencies ...time.Duration) {
+	for _, latency := range latencies {
+		a.observe(latency)
+	}
+}
+
+func TestAdaptiveTimeout_FallsBackUntilMinSamples(t *testing.T) {
+	a := newAdaptiveTimeout(testAdaptiveConfig(), 30*time.Second)
+
+	observeAll(a, 400*time.Millisecond, 400*time.Millisecond, 400*time.Millisecond, 400*time.Millisecond)
+	assert.Equal(t, 30*time.Second, a.timeout(), "four samples are not enough")
+	assert.False(t, a.stats().Adaptive)
+
+	a.observe(400 * time.Millisecond)
+	assert.Equal(t, 800*time.Millisecond, a.timeout())
+	assert.Equal(t, TimeoutStats{TimeoutMS: 800, Adaptive: true, Samples: 5, PercentileMS: 400}, a.stats())
+}
+
+func TestAdaptiveTimeout_Bounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		latency time.Duration
+		want    time.Duration
+	}{
+		{"below min", 50 * time.Millisecond, 200 * time.Millisecond},
+		{"at min", 100 * time.Millisecond, 200 * time.Millisecond},
+		{"between", 1 * time.Second, 2 * time.Second},
+		{"at max", 2500 * time.Millisecond, 5 * time.Second},
+		{"above max", 10 * time.Second, 5 * time.Second},
+	}
+	for _, tt := range tests {
+		a := newAdaptiveTimeout(testAdaptiveConfig(), 30*time.Second)
+		observeAll(a, tt.latency, tt.latency, tt.latency, tt.latency, tt.latency)
+		assert.Equal(t, tt.want, a.timeout(), tt.name)
+	}
+}
+
+func TestAdaptiveTimeout_PercentileOfSlidingWindow(t *testing.T) {
+	a := newAdaptiveTimeout(testAdaptiveConfig(), 30*time.Second)
+
+	// Nine fast fetches and one slow one: the 90th percentile is the ninth
+	for i := 0; i < 9; i++ {
+		a.observe(100 * time.Millisecond)
+	}
+	a.observe(2 * time.Second)
+	assert.Equal(t, 200*time.Millisecond, a.timeout())
+
+	// A second slow fetch pushes the percentile up
+	a.observe(2 * time.Second)
+	assert.Equal(t, 4*time.Second, a.timeout())
+
+	// Ten more fast ones slide both slow fetches out of the window
+	for i := 0; i < 10; i++ {
+		a.observe(300 * time.Millisecond)
+	}
+	assert.Equal(t, 600*time.Millisecond, a.timeout())
+	assert.Equal(t, 10, a.stats().Samples)
+}
+
+func TestAdaptiveTimeout_ReportsChangesAboveThreshold(t *testing.T) {
+	a := newAdaptiveTimeout(testAdaptiveConfig(), 30*time.Second)
+	observeAll(a, time.Second, time.Second, time.Second, time.Second)
+
+	from, to, changed := a.observe(time.Second)
+	assert.True(t, changed)
+	assert.Equal(t, 30*time.Second, from)
+	assert.Equal(t, 2*time.Second, to)
+
+	// 2s to 2.4s is a 20% change, below the 25% threshold
+	for i := 0; i < 5; i++ {
+		_, _, changed = a.observe(1200 * time.Millisecond)
+		assert.False(t, changed)
+	}
+	assert.Equal(t, 2400*time.Millisecond, a.timeout())
+
+	// The threshold is measured from the last reported timeout, 2s
+	a.observe(1500 * time.Millisecond)
+	_, to, changed = a.observe(1500 * time.Millisecond)
+	assert.True(t, changed)
+	assert.Equal(t, 3*time.Second, to)
+}
+
+func TestAdaptiveTimeoutConfig_Validate(t *testing.T) {
+	assert.NoError(t, AdaptiveTimeoutConfig{}.Validate())
+	assert.NoError(t, AdaptiveTimeoutConfig{Enabled: true}.Validate(), "defaults are valid")
+	assert.NoError(t, AdaptiveTimeoutConfig{Enabled: true, Window: 5}.Validate(), "min_samples defaults to at most the window")
+
+	for name, config := range map[string]AdaptiveTimeoutConfig{
+		"min_samples":      {Enabled: true, Window: 5, MinSamples: 10},
+		"percentile":       {Enabled: true, Percentile: 1.5},
+		"multiplier":       {Enabled: true, Multiplier: 0.5},
+		"min":              {Enabled: true, Min: Duration(time.Minute), Max: Duration(time.Second)},
+		"change_threshold": {Enabled: true, ChangeThreshold: -1},
+	} {
+		assert.ErrorContains(t, config.Validate(), "api.adaptive_timeout."+name, name)
+	}
+}
+
+func TestClientTimeout(t *testing.T) {
+	assert.Equal(t, 30*time.Second, APIConfig{Timeout: Duration(30 * time.Second)}.clientTimeout())
+
+	adaptive := APIConfig{Timeout: Duration(30 * time.Second), AdaptiveTimeout: AdaptiveTimeoutConfig{Enabled: true}}
+	assert.Equal(t, defaultAdaptiveMax, adaptive.clientTimeout(), "capped by the adaptive max")
+	adaptive.Timeout = Duration(2 * time.Minute)
+	assert.Equal(t, 2*time.Minute, adaptive.clientTimeout(), "the static fallback still fits")
+}
+
+func TestFetch_AdaptiveTimeoutAppliesPerAttempt(t *testing.T) {
+	var slow atomic.Bool
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`))
+	}))
+	defer upstream.Close()
+
+	config := testAdaptiveConfig()
+	config.Min = Duration(50 * time.Millisecond)
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL:         upstream.URL,
+			Timeout:         Duration(5 * time.Second),
+			AdaptiveTimeout: config,
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	logger, hook := test.NewNullLogger()
+	ingestor.logger = logger
+	src := ingestor.sources[0]
+
+	for i := 0; i < 5; i++ {
+		_, err := ingestor.fetchFrom(context.Background(), src)
+		require.NoError(t, err)
+	}
+	require.True(t, src.timeouts.stats().Adaptive)
+	assert.Equal(t, 50*time.Millisecond, src.attemptTimeout(), "fast local fetches hit the minimum")
+	require.NotNil(t, hook.LastEntry())
+	assert.Equal(t, "Upstream timeout adjusted", hook.LastEntry().Message)
+
+	slow.Store(true)
+	start := time.Now()
+	_, err := ingestor.fetchFrom(context.Background(), src)
+	require.Error(t, err)
+	var netErr net.Error
+	assert.True(t, errors.As(err, &netErr) && netErr.Timeout(), "%v", err)
+	assert.Less(t, time.Since(start), time.Second, "the adaptive timeout cut the attempt short")
+	assert.True(t, isRetryable(err))
+	assert.Equal(t, 5, src.timeouts.stats().Samples, "timed out attempts are not samples")
+}
+
+func TestStats_ReportsEffectiveTimeouts(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+	get := func() map[string]json.RawMessage {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+		var body map[string]json.RawMessage
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+		return body
+	}
+	assert.Equal(t, "null", string(get()["timeouts"]), "adaptive timeouts are off")
+
+	ingestor.config.API.AdaptiveTimeout = testAdaptiveConfig()
+	ingestor.sources = newSources(ingestor.config.API)
+	observeAll(ingestor.sources[0].timeouts, time.Second, time.Second, time.Second, time.Second, time.Second)
+	var timeouts map[string]TimeoutStats
+	require.NoError(t, json.Unmarshal(get()["timeouts"], &timeouts))
+	assert.Equal(t, map[string]TimeoutStats{
+		defaultSourceName: {TimeoutMS: 2000, Adaptive: true, Samples: 5, PercentileMS: 1000},
+	}, timeouts)
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxTraceExcerpt bounds debug.trace_excerpt, which is kept for every cycle
+// the history holds
+const maxTraceExcerpt = 64 << 10
+
+// defaultTraceMaxBytes is debug.trace_max_bytes by default
+const defaultTraceMaxBytes = 8 << 20
+
+// Outcomes of a traced publish besides the kinds of publish failures
+const (
+	traceConfirmed = "confirmed"
+	// tracePublished is a publish without confirms: sent, not acked
+	tracePublished = "published"
+	traceError     = "error"
+)
+
+// cycleTrace is what one ingestion cycle did, from the upstream response to
+// the publish confirms, recorded under its correlation id for
+// GET /debug/trace/{correlation_id}. Its methods do nothing on a nil trace.
+type cycleTrace struct {
+	mu     sync.Mutex
+	record TraceRecord
+	// excerpt is how much of the upstream body is kept
+	excerpt int
+}
+
+// TraceRecord is the GET /debug/trace/{correlation_id} response
+type TraceRecord struct {
+	CorrelationID string         `json:"correlation_id"`
+	Location      string         `json:"location"`
+	Trigger       string         `json:"trigger"`
+	Started       time.Time      `json:"started"`
+	Upstream      *TraceUpstream `json:"upstream,omitempty"`
+	// DecodeWarnings are schema drift and skipped CSV rows
+	DecodeWarnings []TraceNote `json:"decode_warnings"`
+	// Repairs are the sentinels set to null before validation
+	Repairs []TraceNote `json:"repairs"`
+	// Validation are the readings out of range, kept or dropped
+	Validation []TraceNote `json:"validation"`
+	// Transforms are the fields the transforms changed, reading by reading
+	Transforms []TraceNote    `json:"transforms"`
+	Routing    []TraceRoute   `json:"routing"`
+	Publishes  []TracePublish `json:"publishes"`
+	Error      string         `json:"error,omitempty"`
+	// Readings are the published readings of the cycle still in the history
+	Readings []historyReading `json:"readings"`
+}
+
+// TraceUpstream is the upstream response of a cycle
+type TraceUpstream struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Bytes       int    `json:"bytes"`
+	LatencyMS   int64  `json:"latency_ms"`
+	Replayed    bool   `json:"replayed,omitempty"`
+	// Excerpt is the start of the body, with debug.trace_excerpt
+	Excerpt   string `json:"excerpt,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+// TraceNote is something a stage did to a reading
+type TraceNote struct {
+	Reading string `json:"reading,omitempty"`
+	Field   string `json:"field,omitempty"`
+	Action  string `json:"action"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// TraceRoute is where a group of readings was sent
+type TraceRoute struct {
+	// Rule is the routing rule, default for readings no rule matched, or
+	// empty without routing rules
+	Rule       string   `json:"rule,omitempty"`
+	Exchange   string   `json:"exchange,omitempty"`
+	RoutingKey string   `json:"routing_key"`
+	Readings   []string `json:"readings"`
+}
+
+// TracePublish is one attempt to publish a message
+type TracePublish struct {
+	Exchange   string `json:"exchange,omitempty"`
+	RoutingKey string `json:"routing_key"`
+	MessageID  string `json:"message_id,omitempty"`
+	Type       string `json:"type,omitempty"`
+	// Attempt counts the publishes of the same body to the same target,
+	// from 1
+	Attempt    int       `json:"attempt"`
+	Started    time.Time `json:"started"`
+	DurationMS int64     `json:"duration_ms"`
+	// Outcome is confirmed, published without confirms, or the kind of the
+	// failure, see publishFailureOf
+	Outcome string `json:"outcome"`
+	Error   string `json:"error,omitempty"`
+	// PayloadSHA256 is the hash of the body before compression and
+	// encryption, as consumers read it
+	PayloadSHA256 string `json:"payload_sha256"`
+}
+
+// traceStore keeps the traces of as many cycles as the history keeps
+// readings, stream.buffer_size, the oldest making way. The excerpts of all
+// of them together are held to debug.trace_max_bytes: the oldest traces lose
+// theirs first.
+type traceStore struct {
+	excerpt  int
+	maxBytes int
+
+	mu   sync.Mutex
+	ring []string
+	next int
+	byID map[string]*cycleTrace
+	// bytes is the size of the excerpts kept
+	bytes int
+}
+
+// newTraceStore returns nil unless debug.enabled and debug.trace are set
+func newTraceStore(config DebugConfig, stream StreamConfig) *traceStore {
+	if !config.Enabled || !config.Trace {
+		return nil
+	}
+	return &traceStore{
+		excerpt:  int(config.TraceExcerpt),
+		maxBytes: config.traceMaxBytes(),
+		ring:     make([]string, stream.bufferSize()),
+		byID:     make(map[string]*cycleTrace),
+	}
+}
+
+// start begins the trace of a cycle. It is kept once the cycle publishes.
+func (s *traceStore) start(correlationID, location, trigger string) *cycleTrace {
+	if s == nil {
+		return nil
+	}
+	return &cycleTrace{excerpt: s.excerpt, record: TraceRecord{
+		CorrelationID: correlationID,
+		Location:      location,
+		Trigger:       trigger,
+		Started:       time.Now().UTC(),
+	}}
+}
+
+// keep stores t under its correlation id
+func (s *traceStore) keep(t *cycleTrace) {
+	if s == nil || t == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if oldest, ok := s.byID[s.ring[s.next]]; ok {
+		s.bytes -= oldest.excerptBytes()
+		delete(s.byID, s.ring[s.next])
+	}
+	s.ring[s.next] = t.record.CorrelationID
+	s.next = (s.next + 1) % len(s.ring)
+	s.byID[t.record.CorrelationID] = t
+	s.bytes += t.excerptBytes()
+	// Oldest first, the newest trace keeping its excerpt
+	for i := 0; s.bytes > s.maxBytes && i < len(s.ring)-1; i++ {
+		if trace, ok := s.byID[s.ring[(s.next+i)%len(s.ring)]]; ok {
+			s.bytes -= trace.dropExcerpt()
+		}
+	}
+}
+
+// restore keeps a trace read back from the cycle journal
+func (s *traceStore) restore(record TraceRecord) {
+	if s == nil || record.CorrelationID == "" {
+		return
+	}
+	s.keep(&cycleTrace{excerpt: s.excerpt, record: record})
+}
+
+// lookup returns the trace of a correlation id, nil if it is not kept
+func (s *traceStore) lookup(correlationID string) *cycleTrace {
+	if s == nil || correlationID == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.byID[correlationID]
+}
+
+type cycleTraceKey struct{}
+
+// withCycleTrace has the stages run with ctx record into t
+func withCycleTrace(ctx context.Context, t *cycleTrace) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, cycleTraceKey{}, t)
+}
+
+// cycleTraceOf returns the trace of ctx, nil when the cycle is not traced
+func cycleTraceOf(ctx context.Context) *cycleTrace {
+	t, _ := ctx.Value(cycleTraceKey{}).(*cycleTrace)
+	return t
+}
+
+func (t *cycleTrace) upstream(resp *http.Response, body []byte, latency time.Duration, replayed bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	upstream := &TraceUpstream{
+		Status:      resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Bytes:       len(body),
+		LatencyMS:   latency.Milliseconds(),
+		Replayed:    replayed,
+	}
+	if t.excerpt > 0 {
+		excerpt := body
+		if len(excerpt) > t.excerpt {
+			excerpt, upstream.Truncated = excerpt[:t.excerpt], true
+		}
+		upstream.Excerpt = string(excerpt)
+	}
+	t.record.Upstream = upstream
+}
+
+func (t *cycleTrace) decodeWarning(note TraceNote) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record.DecodeWarnings = append(t.record.DecodeWarnings, note)
+}
+
+func (t *cycleTrace) repaired(note TraceNote) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record.Repairs = append(t.record.Repairs, note)
+}
+
+func (t *cycleTrace) validated(note TraceNote) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record.Validation = append(t.record.Validation, note)
+}
+
+// transformed records how the transforms changed a reading: the fields set,
+// changed and removed, or that it was filtered out when after is empty
+func (t *cycleTrace) transformed(before SensorData, after WeatherData) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(after) == 0 {
+		t.record.Transforms = append(t.record.Transforms, TraceNote{Reading: before.Name, Action: "filtered"})
+		return
+	}
+	payload := after[0].Payload
+	fields := make([]string, 0, len(payload))
+	for field := range payload {
+		fields = append(fields, field)
+	}
+	for field := range before.Payload {
+		if _, ok := payload[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		old, had := before.Payload[field]
+		value, has := payload[field]
+		note := TraceNote{Reading: before.Name, Field: field}
+		switch {
+		case !had:
+			note.Action, note.Detail = "set", fmt.Sprint(value)
+		case !has:
+			note.Action, note.Detail = "removed", fmt.Sprint(old)
+		case !reflect.DeepEqual(old, value):
+			note.Action, note.Detail = "changed", fmt.Sprintf("%v -> %v", old, value)
+		default:
+			continue
+		}
+		t.record.Transforms = append(t.record.Transforms, note)
+	}
+}
+
+func (t *cycleTrace) routed(route TraceRoute, readings WeatherData) {
+	if t == nil {
+		return
+	}
+	route.Readings = make([]string, len(readings))
+	for i, reading := range readings {
+		route.Readings[i] = reading.Name
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record.Routing = append(t.record.Routing, route)
+}
+
+func (t *cycleTrace) published(attempt TracePublish) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	attempt.Attempt = 1
+	for _, previous := range t.record.Publishes {
+		if previous.Exchange == attempt.Exchange && previous.RoutingKey == attempt.RoutingKey &&
+			previous.PayloadSHA256 == attempt.PayloadSHA256 {
+			attempt.Attempt++
+		}
+	}
+	t.record.Publishes = append(t.record.Publishes, attempt)
+}
+
+// excerptBytes returns the size of the upstream excerpt of t
+func (t *cycleTrace) excerptBytes() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.record.Upstream == nil {
+		return 0
+	}
+	return len(t.record.Upstream.Excerpt)
+}
+
+// dropExcerpt removes the upstream excerpt of t and returns its size
+func (t *cycleTrace) dropExcerpt() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	upstream := t.record.Upstream
+	if upstream == nil || upstream.Excerpt == "" {
+		return 0
+	}
+	size := len(upstream.Excerpt)
+	dropped := *upstream
+	dropped.Excerpt, dropped.Truncated = "", true
+	t.record.Upstream = &dropped
+	return size
+}
+
+func (t *cycleTrace) failed(err error) {
+	if t == nil || err == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.record.Error = err.Error()
+}
+
+// snapshot copies the record
+func (t *cycleTrace) snapshot() TraceRecord {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	record := t.record
+	record.DecodeWarnings = append([]TraceNote{}, record.DecodeWarnings...)
+	record.Repairs = append([]TraceNote{}, record.Repairs...)
+	record.Validation = append([]TraceNote{}, record.Validation...)
+	record.Transforms = append([]TraceNote{}, record.Transforms...)
+	record.Routing = append([]TraceRoute{}, record.Routing...)
+	record.Publishes = append([]TracePublish{}, record.Publishes...)
+	return record
+}
+
+// transformTraced runs the transforms over data, a reading at a time so the
+// trace of ctx can tell what they did to each
+func (di *DataIngestor) transformTraced(ctx context.Context, data WeatherData) WeatherData {
+	trace := cycleTraceOf(ctx)
+	if trace == nil {
+		return di.transformer.Apply(data)
+	}
+	out := make(WeatherData, 0, len(data))
+	for _, reading := range data {
+		result := di.transformer.Apply(WeatherData{reading})
+		trace.transformed(reading, result)
+		out = append(out, result...)
+	}
+	return out
+}
+
+// publishTraced publishes one message, recording the attempt with the trace
+// of its correlation id
+func (di *DataIngestor) publishTraced(exchange, routingKey string, body []byte, env Envelope) (string, error) {
+	trace := di.cycleTraces.lookup(env.CorrelationID)
+	if trace == nil {
+		return di.publishMessage(exchange, routingKey, body, env)
+	}
+	start := time.Now()
+	messageID, err := di.publishMessage(exchange, routingKey, body, env)
+	sum := sha256.Sum256(body)
+	attempt := TracePublish{
+		Exchange:      exchange,
+		RoutingKey:    routingKey,
+		MessageID:     messageID,
+		Type:          env.Type,
+		Started:       start.UTC(),
+		DurationMS:    time.Since(start).Milliseconds(),
+		Outcome:       publishFailureOf(err),
+		PayloadSHA256: hex.EncodeToString(sum[:]),
+	}
+	switch {
+	case err == nil:
+		attempt.Outcome = tracePublished
+		if _, confirms, _ := di.activeChannel(); confirms != nil {
+			attempt.Outcome = traceConfirmed
+		}
+	case attempt.Outcome == "":
+		attempt.Outcome = traceError
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	trace.published(attempt)
+	return messageID, err
+}
+
+// handleTrace serves GET /debug/trace/{correlation_id}
+func (di *DataIngestor) handleTrace(c *gin.Context) {
+	if di.cycleTraces == nil {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": "debug.trace is disabled",
+		})
+		return
+	}
+	correlationID := c.Param("correlation_id")
+	trace := di.cycleTraces.lookup(correlationID)
+	if trace == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("no trace of correlation id %q, it is unknown or no longer kept", correlationID),
+		})
+		return
+	}
+	record := trace.snapshot()
+	record.Readings = []historyReading{}
+	for _, event := range di.stream.ofCorrelation(correlationID) {
+		record.Readings = append(record.Readings, historyReading{ID: event.ID, Time: event.Time, Reading: event.Data})
+	}
+	c.JSON(http.StatusOK, record)
+}
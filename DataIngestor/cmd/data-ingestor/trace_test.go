@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const traceUpstreamBody = `[{"type":"weather","name":"moscow-1","payload":{"temperature":75,"humidity":120}},` +
+	`{"type":"weather","name":"berlin-1","payload":{"temperature":20,"humidity":40}}]`
+
+// newTraceIngestor traces the cycles of an upstream whose hot readings are
+// clamped by a transform and routed to alerts, confirming publishes with
+// channel
+func newTraceIngestor(t *testing.T, debug DebugConfig) (*DataIngestor, *refusingChannel) {
+	t.Helper()
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(traceUpstreamBody))
+	}))
+	t.Cleanup(upstream.Close)
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{
+			QueueName:      "meter-data-queue",
+			ConfirmTimeout: Duration(20 * time.Millisecond),
+			PublishRetry:   PublishRetryConfig{ReconnectWait: Duration(time.Second)},
+		},
+		Admin:      AdminConfig{Token: "letmein"},
+		Logging:    LoggingConfig{Level: "panic"},
+		Debug:      debug,
+		Transforms: []TransformConfig{{Assign: "temperature = temperature > 60 ? 60 : temperature"}},
+		Validation: ValidationConfig{Action: validationKeep, Bounds: map[string]Bounds{
+			"humidity": {Min: bound(0), Max: bound(100)},
+		}},
+		Routing: RoutingConfig{FirstMatchOnly: true, Rules: []RoutingRule{{
+			Name:    "hot",
+			Match:   MatchCondition{Fields: []FieldCondition{{Field: "temperature", Op: "gte", Value: 60}}},
+			Targets: []RoutingTarget{{RoutingKey: "alerts"}},
+		}}},
+	})
+	channel := &refusingChannel{fakeChannel: &fakeChannel{}, confirms: make(chan amqp.Confirmation, 100)}
+	tracker := newConfirmTracker()
+	attachChannel(ingestor, channel, tracker)
+	go ingestor.listenConfirms(tracker, channel.confirms)
+	t.Cleanup(func() { close(channel.confirms) })
+	return ingestor, channel
+}
+
+func getTrace(t *testing.T, ingestor *DataIngestor, correlationID string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodGet, "/debug/trace/"+correlationID, nil)
+	req.Header.Set("Authorization", "Bearer letmein")
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, req)
+	return w
+}
+
+func TestTrace_RepairedReroutedAndRetried(t *testing.T) {
+	ingestor, channel := newTraceIngestor(t, DebugConfig{Enabled: true, Trace: true, TraceExcerpt: 32})
+	// The first message goes unconfirmed and is published again
+	channel.silent = 1
+
+	outcome := ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	require.Equal(t, outcomePublished, outcome.Outcome, outcome.Error)
+	require.NotEmpty(t, outcome.CorrelationID)
+
+	w := getTrace(t, ingestor, outcome.CorrelationID)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var trace TraceRecord
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &trace))
+	assert.Equal(t, outcome.CorrelationID, trace.CorrelationID)
+	assert.Equal(t, triggerPoll, trace.Trigger)
+
+	require.NotNil(t, trace.Upstream)
+	assert.Equal(t, http.StatusOK, trace.Upstream.Status)
+	assert.Equal(t, len(traceUpstreamBody), trace.Upstream.Bytes)
+	assert.Equal(t, traceUpstreamBody[:32], trace.Upstream.Excerpt)
+	assert.True(t, trace.Upstream.Truncated)
+
+	// Repaired by the transform, then kept by validation with a warning
+	assert.Equal(t, []TraceNote{{Reading: "moscow-1", Field: "temperature", Action: "changed", Detail: "75 -> 60"}}, trace.Transforms)
+	assert.Equal(t, []TraceNote{{Reading: "moscow-1", Field: "humidity", Action: validationKeep, Detail: "120 is out of the global bounds"}}, trace.Validation)
+
+	// Rerouted by its rule
+	assert.ElementsMatch(t, []TraceRoute{
+		{Rule: "hot", RoutingKey: "alerts", Readings: []string{"moscow-1"}},
+		{Rule: "default", RoutingKey: "meter-data-queue", Readings: []string{"berlin-1"}},
+	}, trace.Routing)
+
+	// Retried with the same MessageId after the confirm timed out
+	messages := channel.messages()
+	require.Len(t, messages, 3)
+	require.Len(t, trace.Publishes, 3)
+	first, retry := trace.Publishes[0], trace.Publishes[1]
+	assert.Equal(t, publishTimedOut, first.Outcome)
+	assert.Contains(t, first.Error, ErrConfirmTimeout.Error())
+	assert.Equal(t, 1, first.Attempt)
+	assert.Equal(t, traceConfirmed, retry.Outcome)
+	assert.Equal(t, 2, retry.Attempt)
+	assert.Equal(t, first.MessageID, retry.MessageID)
+	assert.Equal(t, first.RoutingKey, retry.RoutingKey)
+	assert.Equal(t, traceConfirmed, trace.Publishes[2].Outcome)
+	assert.Equal(t, 1, trace.Publishes[2].Attempt)
+	for i, publish := range trace.Publishes {
+		sum := sha256.Sum256(messages[i].Msg.Body)
+		assert.Equal(t, hex.EncodeToString(sum[:]), publish.PayloadSHA256)
+		assert.Equal(t, outcome.CorrelationID, messages[i].Msg.CorrelationId)
+	}
+
+	// The readings as published, from the history
+	require.Len(t, trace.Readings, 2)
+	var reading SensorData
+	require.NoError(t, json.Unmarshal(trace.Readings[0].Reading, &reading))
+	assert.Equal(t, "moscow-1", reading.Name)
+	assert.EqualValues(t, 60, reading.Payload["temperature"])
+}
+
+func TestTrace_FailedCycle(t *testing.T) {
+	ingestor, channel := newTraceIngestor(t, DebugConfig{Enabled: true, Trace: true})
+	channel.err = amqp.ErrClosed
+
+	outcome := ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	require.Equal(t, outcomeFailed, outcome.Outcome)
+	require.NotEmpty(t, outcome.CorrelationID, "a failed publish can be traced too")
+
+	var trace TraceRecord
+	w := getTrace(t, ingestor, outcome.CorrelationID)
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &trace))
+	assert.Equal(t, outcome.Error, trace.Error)
+	require.Len(t, trace.Publishes, 1)
+	assert.Equal(t, publishUnreachable, trace.Publishes[0].Outcome)
+	assert.Empty(t, trace.Upstream.Excerpt, "without debug.trace_excerpt")
+	assert.Empty(t, trace.Readings)
+}
+
+func TestTrace_Endpoint(t *testing.T) {
+	ingestor, _ := newTraceIngestor(t, DebugConfig{Enabled: true, Trace: true})
+	assert.Equal(t, http.StatusNotFound, getTrace(t, ingestor, "unknown").Code)
+
+	disabled, _ := newTraceIngestor(t, DebugConfig{Enabled: true})
+	outcome := disabled.ingestOnce(context.Background(), disabled.sources[0])
+	require.Equal(t, outcomePublished, outcome.Outcome)
+	assert.Equal(t, http.StatusConflict, getTrace(t, disabled, outcome.CorrelationID).Code)
+	assert.Nil(t, newTraceStore(DebugConfig{Trace: true}, StreamConfig{}), "needs debug.enabled")
+
+	assert.NoError(t, DebugConfig{TraceExcerpt: maxTraceExcerpt}.Validate())
+	assert.ErrorContains(t, DebugConfig{TraceExcerpt: maxTraceExcerpt + 1}.Validate(), "debug.trace_excerpt")
+	assert.ErrorContains(t, DebugConfig{TraceMaxBytes: -1}.Validate(), "debug.trace_max_bytes")
+	assert.Equal(t, defaultTraceMaxBytes, DebugConfig{}.traceMaxBytes())
+}
+
+func TestTraceStore_FollowsTheHistorySize(t *testing.T) {
+	store := newTraceStore(DebugConfig{Enabled: true, Trace: true}, StreamConfig{BufferSize: 2})
+	for _, id := range []string{"a", "b", "c"} {
+		store.keep(store.start(id, "moscow-1", triggerPoll))
+	}
+	assert.Nil(t, store.lookup("a"), "the oldest makes way")
+	assert.NotNil(t, store.lookup("b"))
+	assert.NotNil(t, store.lookup("c"))
+	assert.Nil(t, store.lookup(""))
+}
+
+func TestTraceStore_CapsTheExcerpts(t *testing.T) {
+	store := newTraceStore(DebugConfig{Enabled: true, Trace: true, TraceExcerpt: 10, TraceMaxBytes: 25}, StreamConfig{BufferSize: 10})
+	resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}}
+	for _, id := range []string{"a", "b", "c"} {
+		trace := store.start(id, "moscow-1", triggerPoll)
+		trace.upstream(resp, []byte(`[{"name":"`+id+`-station"}]`), time.Millisecond, false)
+		store.keep(trace)
+	}
+	oldest := store.lookup("a").snapshot()
+	assert.Empty(t, oldest.Upstream.Excerpt, "the oldest trace loses its excerpt first")
+	assert.True(t, oldest.Upstream.Truncated)
+	assert.NotEmpty(t, store.lookup("b").snapshot().Upstream.Excerpt)
+	assert.NotEmpty(t, store.lookup("c").snapshot().Upstream.Excerpt)
+	assert.Equal(t, 20, store.bytes)
+
+	// Traces that make way give their bytes back
+	for _, id := range []string{"d", "e", "f", "g", "h", "i", "j", "k", "l", "m"} {
+		store.keep(store.start(id, "moscow-1", triggerPoll))
+	}
+	assert.Zero(t, store.bytes)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/ast"
+	"github.com/expr-lang/expr/file"
+	"github.com/expr-lang/expr/parser"
+	"github.com/expr-lang/expr/vm"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// TransformConfig is one entry of the transforms list. Exactly one of Filter
+// and Assign is set.
+type TransformConfig struct {
+	// Filter is a boolean expression; readings for which it is false are dropped
+	Filter string `yaml:"filter"`
+	// Assign sets a payload field, e.g. "dew_point = temperature - (100 - humidity)/5"
+	Assign string `yaml:"assign"`
+
+	// line and column locate the entry in the config file for error messages
+	line, column int
+}
+
+// UnmarshalYAML records where the entry is in the config file
+func (t *TransformConfig) UnmarshalYAML(node *yaml.Node) error {
+	type plain TransformConfig
+	if err := node.Decode((*plain)(t)); err != nil {
+		return err
+	}
+	t.line, t.column = node.Line, node.Column
+	return nil
+}
+
+// name identifies the entry in errors and metric labels
+func (t TransformConfig) name(index int) string {
+	return fmt.Sprintf("transforms[%d]", index)
+}
+
+// assignPattern splits "field = expression", leaving "==" comparisons alone
+var assignPattern = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*=([^=].*)$`)
+
+// transform is a compiled TransformConfig
+type transform struct {
+	name    string
+	filter  *vm.Program
+	field   string
+	program *vm.Program
+}
+
+// Transformer applies the configured transforms to readings before they are
+// published. Expressions only see the reading: its payload fields plus type,
+// name and the captured response headers as headers.
+type Transformer struct {
+	transforms []transform
+	metrics    *Metrics
+	logger     *logrus.Logger
+}
+
+// compileTransforms compiles every entry, reporting the config position of
+// the first one that does not compile
+func compileTransforms(configs []TransformConfig) ([]transform, error) {
+	transforms := make([]transform, 0, len(configs))
+	for i, config := range configs {
+		t := transform{name: config.name(i)}
+
+		var source string
+		var err error
+		switch {
+		case config.Filter != "" && config.Assign != "":
+			err = errors.New("set either filter or assign, not both")
+		case config.Filter != "":
+			source = config.Filter
+			t.filter, err = compileTransform(source, expr.AsBool())
+		case config.Assign != "":
+			match := assignPattern.FindStringSubmatch(config.Assign)
+			if match == nil {
+				err = fmt.Errorf("assign must look like \"field = expression\", got %q", config.Assign)
+				break
+			}
+			if match[1] == "type" || match[1] == "name" {
+				err = fmt.Errorf("assign cannot change the reading %s", match[1])
+				break
+			}
+			t.field, source = match[1], match[2]
+			t.program, err = compileTransform(source)
+		default:
+			err = errors.New("filter or assign is required")
+		}
+		if err != nil {
+			return nil, transformError(config, i, source, err)
+		}
+		transforms = append(transforms, t)
+	}
+	return transforms, nil
+}
+
+// compileTransform compiles one expression against the reading environment.
+// Payload fields are not known up front, so unknown names evaluate to nil;
+// calls are limited to the expression language's built-in functions.
+func compileTransform(source string, options ...expr.Option) (*vm.Program, error) {
+	tree, err := parser.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	sandbox := &sandboxVisitor{}
+	ast.Walk(&tree.Node, sandbox)
+	if sandbox.err != nil {
+		return nil, sandbox.err.Bind(file.NewSource(source))
+	}
+
+	env := map[string]interface{}{"type": "", "name": "", "headers": map[string]string{}}
+	return expr.Compile(source, append([]expr.Option{
+		expr.Env(env),
+		expr.AllowUndefinedVariables(),
+	}, options...)...)
+}
+
+// sandboxVisitor rejects calls to anything but built-in functions, which the
+// parser already turned into BuiltinNodes
+type sandboxVisitor struct {
+	err *file.Error
+}
+
+func (v *sandboxVisitor) Visit(node *ast.Node) {
+	if call, ok := (*node).(*ast.CallNode); ok && v.err == nil {
+		v.err = &file.Error{
+			Location: call.Location(),
+			Message:  "only built-in functions may be called",
+		}
+	}
+}
+
+// transformError formats a compile error with the entry's config position and,
+// for expression errors, the position within the expression
+func transformError(config TransformConfig, index int, source string, err error) error {
+	where := config.name(index)
+	if config.line > 0 {
+		where = fmt.Sprintf("%s (line %d, column %d)", where, config.line, config.column)
+	}
+
+	var exprErr *file.Error
+	if errors.As(err, &exprErr) {
+		return fmt.Errorf("%s: %s at line %d, column %d of %q",
+			where, exprErr.Message, exprErr.Line, exprErr.Column+1, source)
+	}
+	return fmt.Errorf("%s: %w", where, err)
+}
+
+// NewTransformer compiles the transforms, returning nil when there are none
+func NewTransformer(configs []TransformConfig, metrics *Metrics, logger *logrus.Logger) (*Transformer, error) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+	transforms, err := compileTransforms(configs)
+	if err != nil {
+		return nil, err
+	}
+	return &Transformer{transforms: transforms, metrics: metrics, logger: logger}, nil
+}
+
+// Apply runs the transforms in order and returns the readings to publish. A
+// reading whose evaluation fails is passed through unmodified.
+func (t *Transformer) Apply(data WeatherData) WeatherData {
+	out := make(WeatherData, 0, len(data))
+	for _, reading := range data {
+		result, keep, err := t.apply(reading)
+		if err != nil {
+			t.logger.WithFields(logrus.Fields{
+				"name": reading.Name,
+				"type": reading.Type,
+			}).WithError(err).Warn("Transform failed, passing reading through unmodified")
+			out = append(out, reading)
+			continue
+		}
+		if keep {
+			out = append(out, result)
+		}
+	}
+	return out
+}
+
+// apply transforms a single reading, working on a copy of its payload
+func (t *Transformer) apply(reading SensorData) (SensorData, bool, error) {
+	payload := make(map[string]interface{}, len(reading.Payload)+1)
+	for key, value := range reading.Payload {
+		payload[key] = value
+	}
+	reading.Payload = payload
+
+	for _, tr := range t.transforms {
+		env := make(map[string]interface{}, len(payload)+3)
+		for key, value := range payload {
+			env[key] = value
+		}
+		env["type"] = reading.Type
+		env["name"] = reading.Name
+		env["headers"] = headerEnv(reading.Headers)
+
+		if tr.filter != nil {
+			keep, err := expr.Run(tr.filter, env)
+			if err != nil {
+				t.metrics.TransformErrors.WithLabelValues(tr.name).Inc()
+				return reading, false, fmt.Errorf("%s: %w", tr.name, err)
+			}
+			if keep != true {
+				t.metrics.TransformFiltered.WithLabelValues(tr.name).Inc()
+				return reading, false, nil
+			}
+			continue
+		}
+
+		value, err := expr.Run(tr.program, env)
+		if err != nil {
+			t.metrics.TransformErrors.WithLabelValues(tr.name).Inc()
+			return reading, false, fmt.Errorf("%s: %w", tr.name, err)
+		}
+		payload[tr.field] = value
+	}
+	return reading, true, nil
+}
+
+// headerEnv returns the captured headers for expressions, which index them by
+// canonical name, e.g. headers["X-Data-Quality"]
+func headerEnv(headers map[string]string) map[string]string {
+	if headers == nil {
+		return map[string]string{}
+	}
+	return headers
+}
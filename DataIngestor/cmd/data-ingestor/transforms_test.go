@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTransformer(t *testing.T, configs ...TransformConfig) *Transformer {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+	transformer, err := NewTransformer(configs, NewMetrics(prometheus.NewRegistry()), logger)
+	require.NoError(t, err)
+	return transformer
+}
+
+func weatherReading(name string, payload map[string]interface{}) SensorData {
+	return SensorData{Type: "weather", Name: name, Payload: payload}
+}
+
+func TestTransformer_Filters(t *testing.T) {
+	tests := []struct {
+		name   string
+		filter string
+		kept   []string
+	}{
+		{"threshold", "humidity >= 50", []string{"berlin-1"}},
+		{"by location", `name startsWith "moscow"`, []string{"moscow-1"}},
+		{"by type", `type == "weather"`, []string{"berlin-1", "moscow-1"}},
+		{"missing field compares as nil", "pressure != nil", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transformer := newTestTransformer(t, TransformConfig{Filter: tt.filter})
+			out := transformer.Apply(WeatherData{
+				weatherReading("berlin-1", map[string]interface{}{"temperature": 20.0, "humidity": 60.0}),
+				weatherReading("moscow-1", map[string]interface{}{"temperature": -5.0, "humidity": 30.0}),
+			})
+
+			var kept []string
+			for _, reading := range out {
+				kept = append(kept, reading.Name)
+			}
+			assert.Equal(t, tt.kept, kept)
+		})
+	}
+}
+
+func TestTransformer_ComputedFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		assign []string
+		field  string
+		want   interface{}
+	}{
+		{"dew point", []string{"dew_point = temperature - (100 - humidity)/5"}, "dew_point", 12.0},
+		{"rename", []string{"temp_c = temperature"}, "temp_c", 20.0},
+		{"chained", []string{"f = temperature * 9 / 5 + 32", "hot = f > 60"}, "hot", true},
+		{"overwrite", []string{"humidity = humidity / 100"}, "humidity", 0.6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var configs []TransformConfig
+			for _, assign := range tt.assign {
+				configs = append(configs, TransformConfig{Assign: assign})
+			}
+			transformer := newTestTransformer(t, configs...)
+
+			original := map[string]interface{}{"temperature": 20.0, "humidity": 60.0}
+			out := transformer.Apply(WeatherData{weatherReading("berlin-1", original)})
+			require.Len(t, out, 1)
+			assert.Equal(t, tt.want, out[0].Payload[tt.field])
+			assert.Equal(t, 60.0, original["humidity"], "the input payload is not modified")
+		})
+	}
+}
+
+func TestTransformer_EvaluationErrorPassesThrough(t *testing.T) {
+	transformer := newTestTransformer(t,
+		TransformConfig{Assign: "scaled = temperature * 2"},
+		TransformConfig{Assign: "ratio = humidity / label"},
+	)
+
+	reading := weatherReading("berlin-1", map[string]interface{}{"temperature": 20.0, "humidity": 60.0, "label": "x"})
+	out := transformer.Apply(WeatherData{reading})
+
+	require.Len(t, out, 1)
+	assert.NotContains(t, out[0].Payload, "scaled", "a failed reading is passed through unmodified")
+	assert.Equal(t, 1.0, testutil.ToFloat64(transformer.metrics.TransformErrors.WithLabelValues("transforms[1]")))
+}
+
+func TestCompileTransforms_Errors(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  TransformConfig
+		wantErr string
+	}{
+		{"syntax", TransformConfig{Filter: "humidity >= "}, "column"},
+		{"unknown function", TransformConfig{Filter: `exec("rm")`}, "only built-in functions"},
+		{"method call", TransformConfig{Assign: `x = name.Split(",")`}, "only built-in functions"},
+		{"filter not boolean", TransformConfig{Filter: "len(name)"}, "expected bool"},
+		{"not an assignment", TransformConfig{Assign: "temperature == 1"}, "field = expression"},
+		{"reserved field", TransformConfig{Assign: "name = 1"}, "cannot change"},
+		{"both", TransformConfig{Filter: "true", Assign: "a = 1"}, "not both"},
+		{"empty", TransformConfig{}, "required"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := compileTransforms([]TransformConfig{tt.config})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "transforms[0]")
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestLoadConfig_TransformErrorPosition(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`rabbitmq:
+  queue_name: q
+transforms:
+  - filter: "humidity >= 10"
+  - assign: "dew_point = temperature -"
+`), 0o644))
+
+	_, err := LoadConfig(path)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "transforms[1] (line 5, column 5)")
+	assert.Contains(t, err.Error(), "line 1, column")
+}
+
+func TestIngest_AppliesTransformsBeforePublish(t *testing.T) {
+	upstream := newUpstream(t, "application/json", `[
+		{"type":"weather","name":"berlin-1","payload":{"temperature":20,"humidity":60}},
+		{"type":"weather","name":"moscow-1","payload":{"temperature":-5,"humidity":5}}
+	]`)
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+		Transforms: []TransformConfig{
+			{Filter: "humidity >= 10"},
+			{Assign: "dew_point = temperature - (100 - humidity)/5"},
+		},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	var published WeatherData
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &published))
+	require.Len(t, published, 1)
+	assert.Equal(t, "berlin-1", published[0].Name)
+	assert.Equal(t, 12.0, published[0].Payload["dew_point"])
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.TransformFiltered.WithLabelValues("transforms[0]")))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Triggers of an ingestion: what made the service fetch or publish readings.
+// The trigger is carried in the context from the entry point down to the
+// sinks, and labels the logs, the envelope and the counters, so polled
+// readings can be told apart from everything else.
+const (
+	triggerPoll     = "poll"
+	triggerManual   = "manual"
+	triggerWebhook  = "webhook"
+	triggerBackfill = "backfill"
+	triggerReplay   = "replay"
+	triggerLoadTest = "loadtest"
+	triggerPush     = "push"
+)
+
+// triggers lists every trigger, for validating filters
+var triggers = []string{triggerPoll, triggerManual, triggerWebhook, triggerBackfill, triggerReplay, triggerLoadTest, triggerPush}
+
+// ingestTriggerHeader marks a POST /ingest as part of a load test
+const ingestTriggerHeader = "X-Ingest-Trigger"
+
+type triggerKey struct{}
+
+// withTrigger marks the ingestion done with ctx as started by trigger
+func withTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, triggerKey{}, trigger)
+}
+
+// triggerOf returns the trigger of ctx, poll by default
+func triggerOf(ctx context.Context) string {
+	if trigger, ok := ctx.Value(triggerKey{}).(string); ok {
+		return trigger
+	}
+	return triggerPoll
+}
+
+// validTrigger reports whether trigger is one of the known triggers
+func validTrigger(trigger string) bool {
+	for _, known := range triggers {
+		if trigger == known {
+			return true
+		}
+	}
+	return false
+}
+
+// triggerFilter reads the trigger query parameter of /stats and /recent; the
+// empty filter matches every trigger
+func triggerFilter(query string) (string, error) {
+	if query == "" || validTrigger(query) {
+		return query, nil
+	}
+	return "", fmt.Errorf("unknown trigger %q, expected one of %s", query, strings.Join(triggers, ", "))
+}
+
+// manualTrigger returns the trigger of an on-demand POST /ingest: manual,
+// unless the caller marks it as part of a load test. Load tests then draw
+// from the loadtest upstream class and are counted apart.
+func manualTrigger(header string) (trigger, class string, err error) {
+	switch header {
+	case "", triggerManual:
+		return triggerManual, upstreamManual, nil
+	case triggerLoadTest:
+		return triggerLoadTest, upstreamLoadTest, nil
+	}
+	return "", "", fmt.Errorf("%s must be manual or loadtest, got %q", ingestTriggerHeader, header)
+}
+
+// TriggerStats is what one trigger did, in GET /stats
+type TriggerStats struct {
+	Cycles            float64 `json:"cycles"`
+	ReadingsPublished float64 `json:"readings_published"`
+	UpstreamFetches   float64 `json:"upstream_fetches"`
+}
+
+// triggerStats sums the trigger-labelled counters by trigger. With a filter
+// only that trigger is returned.
+func (m *Metrics) triggerStats(filter string) map[string]TriggerStats {
+	stats := make(map[string]TriggerStats)
+	for _, trigger := range triggers {
+		if filter == "" || filter == trigger {
+			stats[trigger] = TriggerStats{}
+		}
+	}
+	counters, err := m.gatherCounters()
+	if err != nil {
+		return stats
+	}
+	for name, samples := range counters {
+		for _, sample := range samples {
+			trigger, ok := sample.Labels["trigger"]
+			if !ok {
+				continue
+			}
+			entry, ok := stats[trigger]
+			if !ok {
+				continue
+			}
+			switch strings.TrimPrefix(name, metricsNamespace+"_") {
+			case "cycles_total":
+				entry.Cycles += sample.Value
+			case "readings_published_total":
+				entry.ReadingsPublished += sample.Value
+			case "upstream_fetches_total":
+				entry.UpstreamFetches += sample.Value
+			}
+			stats[trigger] = entry
+		}
+	}
+	return stats
+}
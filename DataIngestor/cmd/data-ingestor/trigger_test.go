@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// messageTriggers returns the trigger header of every published message
+func messageTriggers(channel *fakeChannel) []interface{} {
+	var triggers []interface{}
+	for _, msg := range channel.messages() {
+		triggers = append(triggers, msg.Msg.Headers["trigger"])
+	}
+	return triggers
+}
+
+func postIngestAs(router http.Handler, trigger string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/ingest", nil)
+	if trigger != "" {
+		req.Header.Set(ingestTriggerHeader, trigger)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestTriggerOf(t *testing.T) {
+	assert.Equal(t, triggerPoll, triggerOf(context.Background()))
+	assert.Equal(t, triggerReplay, triggerOf(withTrigger(context.Background(), triggerReplay)))
+
+	for _, header := range []string{"", "manual"} {
+		trigger, class, err := manualTrigger(header)
+		require.NoError(t, err)
+		assert.Equal(t, triggerManual, trigger)
+		assert.Equal(t, upstreamManual, class)
+	}
+	trigger, class, err := manualTrigger("loadtest")
+	require.NoError(t, err)
+	assert.Equal(t, triggerLoadTest, trigger)
+	assert.Equal(t, upstreamLoadTest, class)
+	_, _, err = manualTrigger("poll")
+	assert.ErrorContains(t, err, "X-Ingest-Trigger must be manual or loadtest")
+
+	_, err = triggerFilter("cron")
+	assert.ErrorContains(t, err, `unknown trigger "cron"`)
+}
+
+func TestTrigger_Poll(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	ingestor.config.API.PollInterval = Duration(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.StartIngestion(ctx)
+	}()
+	require.Eventually(t, func() bool { return len(channel.messages()) > 0 }, 5*time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, triggerPoll, messageTriggers(channel)[0])
+	assert.GreaterOrEqual(t, testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleSucceeded), triggerPoll)), 1.0)
+	assert.GreaterOrEqual(t, testutil.ToFloat64(ingestor.metrics.UpstreamFetches.WithLabelValues(defaultSourceName, triggerPoll)), 1.0)
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleSucceeded), triggerManual)))
+}
+
+func TestTrigger_ManualAndLoadTest(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	logger, hook := test.NewNullLogger()
+	ingestor.logger = logger
+	router := setupRoutes(ingestor)
+	require.NoError(t, ingestor.logLevels.set("fetch", "debug"))
+
+	w := postIngestAs(router, "")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var body struct {
+		Trigger string `json:"trigger"`
+	}
+	w = postIngestAs(router, triggerLoadTest)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, triggerLoadTest, body.Trigger)
+
+	assert.Equal(t, []interface{}{triggerManual, triggerLoadTest}, messageTriggers(channel))
+	for _, trigger := range []string{triggerManual, triggerLoadTest} {
+		assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleSucceeded), trigger)), trigger)
+		assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ReadingsPublished.WithLabelValues(defaultSourceName, trigger)), trigger)
+		assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamFetches.WithLabelValues(defaultSourceName, trigger)), trigger)
+	}
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.ReadingsPublished.WithLabelValues(defaultSourceName, triggerPoll)))
+
+	var logged []interface{}
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Upstream responded" {
+			logged = append(logged, entry.Data["trigger"])
+		}
+	}
+	assert.Equal(t, []interface{}{triggerManual, triggerLoadTest}, logged)
+
+	w = postIngestAs(router, triggerBackfill)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Len(t, channel.messages(), 2)
+}
+
+func TestTrigger_LatestRefreshIsManual(t *testing.T) {
+	ingestor, channel := newAdminTestIngestor(t)
+	w := getLatest(setupRoutes(ingestor), "/weather/latest?refresh=true", http.Header{"Authorization": {"Bearer letmein"}})
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, []interface{}{triggerManual}, messageTriggers(channel))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleSucceeded), triggerManual)))
+}
+
+func TestTrigger_Webhook(t *testing.T) {
+	ingestor, channel := newRecordsIngestor(t)
+	code, _ := postRecords(t, setupRoutes(ingestor), []string{meterReading(1), meterReading(2)})
+	require.Equal(t, http.StatusOK, code)
+
+	assert.Equal(t, []interface{}{triggerWebhook, triggerWebhook}, messageTriggers(channel))
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.ReadingsPublished.WithLabelValues("", triggerWebhook)))
+	for _, event := range ingestor.stream.recent("", "", 10) {
+		assert.Equal(t, triggerWebhook, event.Trigger)
+	}
+}
+
+func TestTrigger_Backfill(t *testing.T) {
+	upstream := newHistoryUpstream(t)
+	ingestor, channel := newBackfillIngestor(t, upstream.server.URL, filepath.Join(t.TempDir(), "backfill.json"))
+	runBackfill(t, ingestor)
+
+	created := createBackfill(t, setupRoutes(ingestor), 2)
+	job := waitForJob(t, ingestor, created.ID, jobCompleted)
+
+	assert.Equal(t, []interface{}{triggerBackfill, triggerBackfill}, messageTriggers(channel))
+	assert.Equal(t, float64(job.Readings), testutil.ToFloat64(ingestor.metrics.ReadingsPublished.WithLabelValues(defaultSourceName, triggerBackfill)))
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.UpstreamFetches.WithLabelValues(defaultSourceName, triggerBackfill)))
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.UpstreamFetches.WithLabelValues(defaultSourceName, triggerPoll)))
+}
+
+func TestTrigger_Replay(t *testing.T) {
+	path, _ := writeReplayFixture(t)
+	ingestor, channel := newReplayIngestor()
+
+	_, err := ingestor.Replay(context.Background(), []string{path}, ReplayOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{triggerReplay, triggerReplay, triggerReplay}, messageTriggers(channel))
+	assert.Equal(t, 6.0, testutil.ToFloat64(ingestor.metrics.ReadingsPublished.WithLabelValues("", triggerReplay)))
+}
+
+func TestRecent_FiltersByTrigger(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.stream.Broadcast("cycle-1", triggerPoll, WeatherData{{Type: "weather", Name: "berlin-1"}})
+	ingestor.stream.Broadcast("cycle-2", triggerBackfill, WeatherData{{Type: "weather", Name: "berlin-2"}})
+	router := setupRoutes(ingestor)
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/recent"+query, nil))
+		return w
+	}
+	var body struct {
+		Readings []recentReading `json:"readings"`
+	}
+	w := get("?trigger=backfill")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Len(t, body.Readings, 1)
+	assert.Equal(t, "cycle-2-0", body.Readings[0].ID)
+	assert.Equal(t, triggerBackfill, body.Readings[0].Trigger)
+
+	require.NoError(t, json.Unmarshal(get("").Body.Bytes(), &body))
+	assert.Len(t, body.Readings, 2)
+	assert.Equal(t, http.StatusBadRequest, get("?trigger=cron").Code)
+}
+
+func TestStats_ByTrigger(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	router := setupRoutes(ingestor)
+	ingestor.ingestOnce(withTrigger(context.Background(), triggerPoll), ingestor.sources[0])
+	require.Equal(t, http.StatusOK, postIngestAs(router, "").Code)
+	require.Equal(t, http.StatusOK, postIngestAs(router, "").Code)
+
+	get := func(query string) (int, map[string]TriggerStats) {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats"+query, nil))
+		var body struct {
+			Triggers map[string]TriggerStats `json:"triggers"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Code, body.Triggers
+	}
+	code, triggers := get("")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, triggers, 7)
+	assert.Equal(t, TriggerStats{Cycles: 1, ReadingsPublished: 1, UpstreamFetches: 1}, triggers[triggerPoll])
+	assert.Equal(t, TriggerStats{Cycles: 2, ReadingsPublished: 2, UpstreamFetches: 2}, triggers[triggerManual])
+
+	code, triggers = get("?trigger=manual")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, map[string]TriggerStats{triggerManual: {Cycles: 2, ReadingsPublished: 2, UpstreamFetches: 2}}, triggers)
+
+	code, _ = get("?trigger=cron")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
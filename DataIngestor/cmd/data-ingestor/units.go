@@ -0,0 +1,271 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// minDuration is the shortest duration a config value can sensibly have;
+// anything shorter is taken for a unit mistake
+const minDuration = time.Millisecond
+
+// Duration is a config duration written as "30s" or "5m". Bare numbers are
+// still read as seconds, with a deprecation warning.
+type Duration time.Duration
+
+// UnmarshalYAML parses Go duration syntax, falling back to seconds for bare numbers
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: duration must be a string like \"30s\"", node.Line)
+	}
+	value := strings.TrimSpace(node.Value)
+	if parsed, err := time.ParseDuration(value); err == nil {
+		*d = Duration(parsed)
+		return nil
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return fmt.Errorf("line %d: invalid duration %q, use a unit like \"30s\" or \"5m\"", node.Line, node.Value)
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+// bareDurationWarning is the deprecation warning for a duration written as
+// a bare number of seconds
+func bareDurationWarning(node *yaml.Node) (string, bool) {
+	value := strings.TrimSpace(node.Value)
+	if _, err := time.ParseDuration(value); err == nil {
+		return "", false
+	}
+	seconds, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return "", false
+	}
+	d := time.Duration(seconds * float64(time.Second))
+	return fmt.Sprintf("line %d: duration %s has no unit and is read as %s; bare numbers are deprecated, write %q",
+		node.Line, value, d, d.String()), true
+}
+
+// MarshalYAML writes the duration in Go syntax
+func (d Duration) MarshalYAML() (interface{}, error) {
+	return d.String(), nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// ByteSize is a config size in bytes, written as a bare number of bytes or
+// with a unit: B, KB, MB and GB are powers of 1000, KiB, MiB and GiB powers
+// of 1024
+type ByteSize int64
+
+// byteUnits are the size suffixes, longest first so "KiB" is not read as "B"
+var byteUnits = []struct {
+	suffix string
+	size   int64
+}{
+	{"kib", 1 << 10}, {"mib", 1 << 20}, {"gib", 1 << 30},
+	{"kb", 1000}, {"mb", 1000 * 1000}, {"gb", 1000 * 1000 * 1000},
+	{"b", 1},
+}
+
+// ParseByteSize parses "512", "512KiB" or "1.5 MB"
+func ParseByteSize(s string) (ByteSize, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range byteUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value, multiplier = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix)), unit.size
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid size %q, use bytes or a unit like \"512KiB\" or \"1MB\"", s)
+	}
+	size := n * float64(multiplier)
+	if size > math.MaxInt64 || size < math.MinInt64 {
+		return 0, fmt.Errorf("size %q is out of range", s)
+	}
+	return ByteSize(math.Round(size)), nil
+}
+
+// UnmarshalYAML parses a size with ParseByteSize
+func (b *ByteSize) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: size must be a number of bytes or a string like \"1MB\"", node.Line)
+	}
+	size, err := ParseByteSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", node.Line, err)
+	}
+	*b = size
+	return nil
+}
+
+func (b ByteSize) String() string {
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GiB", 1 << 30}, {"MiB", 1 << 20}, {"KiB", 1 << 10}} {
+		if b != 0 && int64(b)%unit.size == 0 {
+			return strconv.FormatInt(int64(b)/unit.size, 10) + unit.suffix
+		}
+	}
+	return strconv.FormatInt(int64(b), 10) + "B"
+}
+
+// decodeConfig decodes a config document, returning the deprecation warnings
+// raised by its values
+func decodeConfig(node *yaml.Node, config *Config) ([]string, error) {
+	if err := node.Decode(config); err != nil {
+		return nil, err
+	}
+	var warnings []string
+	unitWarnings(node, reflect.TypeOf(config), &warnings)
+	return warnings, nil
+}
+
+// unitWarnings walks a document alongside the type it was decoded into and
+// warns about every Duration in it written without a unit
+func unitWarnings(node *yaml.Node, t reflect.Type, warnings *[]string) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			unitWarnings(child, t, warnings)
+		}
+		return
+	case yaml.AliasNode:
+		unitWarnings(node.Alias, t, warnings)
+		return
+	}
+
+	switch {
+	case t == durationType:
+		if node.Kind == yaml.ScalarNode {
+			if warning, ok := bareDurationWarning(node); ok {
+				*warnings = append(*warnings, warning)
+			}
+		}
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i].Value, node.Content[i+1]
+			if key == "<<" {
+				// A merge key brings in the keys of another mapping
+				unitWarnings(value, t, warnings)
+			} else if field, ok := fields[key]; ok {
+				unitWarnings(value, field, warnings)
+			}
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			unitWarnings(node.Content[i], t.Elem(), warnings)
+		}
+	case (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) && node.Kind == yaml.SequenceNode:
+		for _, child := range node.Content {
+			unitWarnings(child, t.Elem(), warnings)
+		}
+	case t.Kind() == reflect.Struct && node.Kind == yaml.SequenceNode:
+		// The mappings of a merge key
+		for _, child := range node.Content {
+			unitWarnings(child, t, warnings)
+		}
+	}
+}
+
+// yamlFields maps the YAML keys of a struct to the types of their fields,
+// with the keys of inlined structs
+func yamlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if !field.IsExported() || name == "-" {
+			continue
+		}
+		if hasYAMLOption(options, "inline") {
+			inner := field.Type
+			for inner.Kind() == reflect.Ptr {
+				inner = inner.Elem()
+			}
+			if inner.Kind() == reflect.Struct {
+				for key, fieldType := range yamlFields(inner) {
+					fields[key] = fieldType
+				}
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func hasYAMLOption(options, option string) bool {
+	for _, o := range strings.Split(options, ",") {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+var durationType = reflect.TypeOf(Duration(0))
+
+// validateUnits rejects durations so short they are probably in the wrong
+// unit, e.g. a timeout of 30ns. It walks every Duration in the config and
+// reports the first one by its YAML path.
+func validateUnits(v reflect.Value, path string) error {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return validateUnits(v.Elem(), path)
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if !field.IsExported() || name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			if path != "" {
+				name = path + "." + name
+			}
+			if err := validateUnits(v.Field(i), name); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := validateUnits(v.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Int64:
+		if v.Type() != durationType {
+			return nil
+		}
+		if d := time.Duration(v.Int()); d > 0 && d < minDuration {
+			return fmt.Errorf("%s is %s, which is probably a unit mistake; write it like \"30s\" or \"500ms\"", path, d)
+		}
+	}
+	return nil
+}
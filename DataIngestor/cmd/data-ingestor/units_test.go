@@ -0,0 +1,170 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDuration_UnmarshalYAML(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want time.Duration
+		warn bool
+		err  string
+	}{
+		{`30s`, 30 * time.Second, false, ""},
+		{`"5m"`, 5 * time.Minute, false, ""},
+		{`1h30m`, 90 * time.Minute, false, ""},
+		{`250ms`, 250 * time.Millisecond, false, ""},
+		{`0`, 0, false, ""},
+		{`30`, 30 * time.Second, true, ""},
+		{`"30"`, 30 * time.Second, true, ""},
+		{`1.5`, 1500 * time.Millisecond, true, ""},
+		{`soon`, 0, false, `line 1: invalid duration "soon", use a unit like "30s" or "5m"`},
+		{`[30s]`, 0, false, `line 1: duration must be a string like "30s"`},
+	}
+	for _, tt := range tests {
+		var config struct {
+			Timeout Duration `yaml:"timeout"`
+		}
+		var node yaml.Node
+		require.NoError(t, yaml.Unmarshal([]byte("timeout: "+tt.yaml), &node), tt.yaml)
+		err := node.Decode(&config)
+		var warnings []string
+		unitWarnings(&node, reflect.TypeOf(config), &warnings)
+
+		if tt.err != "" {
+			assert.ErrorContains(t, err, tt.err, tt.yaml)
+			continue
+		}
+		require.NoError(t, err, tt.yaml)
+		assert.Equal(t, Duration(tt.want), config.Timeout, tt.yaml)
+		assert.Equal(t, tt.warn, len(warnings) == 1, tt.yaml)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want ByteSize
+		err  bool
+	}{
+		{"1024", 1024, false},
+		{"0", 0, false},
+		{"10B", 10, false},
+		{"1KB", 1000, false},
+		{"1MB", 1000 * 1000, false},
+		{"2GB", 2 * 1000 * 1000 * 1000, false},
+		{"512KiB", 512 << 10, false},
+		{"1.5 MiB", 3 << 19, false},
+		{"1gib", 1 << 30, false},
+		{" 64 kib ", 64 << 10, false},
+		{"1TB", 0, true},
+		{"MB", 0, true},
+		{"ten", 0, true},
+		{"1e30GiB", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseByteSize(tt.in)
+		assert.Equal(t, tt.err, err != nil, "%q: %v", tt.in, err)
+		assert.Equal(t, tt.want, got, tt.in)
+	}
+}
+
+func TestByteSize_UnmarshalYAMLAndString(t *testing.T) {
+	var config struct {
+		Limit ByteSize `yaml:"limit"`
+	}
+	require.NoError(t, yaml.Unmarshal([]byte(`limit: 10MiB`), &config))
+	assert.Equal(t, ByteSize(10<<20), config.Limit)
+	require.NoError(t, yaml.Unmarshal([]byte(`limit: 10485760`), &config))
+	assert.Equal(t, ByteSize(10<<20), config.Limit, "bare numbers are bytes")
+
+	err := yaml.Unmarshal([]byte("\nlimit: lots"), &config)
+	assert.ErrorContains(t, err, `line 2: invalid size "lots"`)
+
+	assert.Equal(t, "10MiB", ByteSize(10<<20).String())
+	assert.Equal(t, "1000B", ByteSize(1000).String())
+	assert.Equal(t, "0B", ByteSize(0).String())
+}
+
+func TestDecodeConfig_WarnsInNestedSections(t *testing.T) {
+	var node yaml.Node
+	require.NoError(t, yaml.Unmarshal([]byte(`defaults: &defaults
+  timeout: 2
+subscribers:
+  - url: http://a.example.com
+    timeout: 5s
+  - url: http://b.example.com
+    <<: *defaults
+tenants:
+  acme:
+    api:
+      timeout: 1.5
+`), &node))
+
+	var config Config
+	warnings, err := decodeConfig(&node, &config)
+	require.NoError(t, err)
+	assert.Equal(t, Duration(2*time.Second), config.Subscribers[1].Timeout)
+	require.Len(t, warnings, 2)
+	assert.Contains(t, warnings[0], "line 2: duration 2 has no unit")
+	assert.Contains(t, warnings[1], "line 11: duration 1.5 has no unit and is read as 1.5s")
+
+	// Each decode has warnings of its own
+	var other Config
+	warnings, err = decodeConfig(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode}}}, &other)
+	require.NoError(t, err)
+	assert.Empty(t, warnings)
+}
+
+func TestValidateUnits_FlagsProbableUnitMistakes(t *testing.T) {
+	config := &Config{API: APIConfig{Timeout: 30}}
+	assert.EqualError(t, config.Validate(),
+		`api.timeout is 30ns, which is probably a unit mistake; write it like "30s" or "500ms"`)
+
+	config = &Config{Subscribers: []SubscriberConfig{{URL: "http://example.com", Timeout: Duration(time.Second)}, {Timeout: Duration(time.Microsecond)}}}
+	err := validateUnits(reflect.ValueOf(config).Elem(), "")
+	assert.ErrorContains(t, err, "subscribers[1].timeout is 1µs")
+
+	config = &Config{API: APIConfig{Timeout: Duration(time.Millisecond), CircuitBreaker: CircuitBreakerConfig{OpenTimeout: Duration(-time.Second)}}}
+	assert.NoError(t, validateUnits(reflect.ValueOf(config).Elem(), ""), "negative values are left to each section")
+}
+
+func TestLoadConfig_BareDurationsWarn(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(`api:
+  base_url: "http://weakapp:5000"
+  timeout: 30
+  max_body_bytes: 1MiB
+rabbitmq:
+  queue_name: q
+  confirm_timeout: 5s
+publishing:
+  compression: gzip
+  compression_min_bytes: 2KiB
+`), 0o644))
+
+	config, err := LoadConfig(path)
+	require.NoError(t, err)
+	assert.Equal(t, Duration(30*time.Second), config.API.Timeout, "read as seconds, not nanoseconds")
+	assert.Equal(t, ByteSize(1<<20), config.API.MaxBodyBytes)
+	assert.Equal(t, ByteSize(2<<10), config.Publishing.CompressionMinBytes)
+	require.Len(t, config.warnings, 1)
+	assert.Equal(t, `line 3: duration 30 has no unit and is read as 30s; bare numbers are deprecated, write "30s"`, config.warnings[0])
+
+	// The warnings are logged once the logger is set up
+	config.Logging.File = filepath.Join(t.TempDir(), "ingestor.log")
+	ingestor := NewDataIngestor(config)
+	defer ingestor.logFile.Close()
+	logged, err := os.ReadFile(config.Logging.File)
+	require.NoError(t, err)
+	assert.Contains(t, string(logged), "Config: line 3: duration 30 has no unit")
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrUpstreamRateLimited is returned when the outbound rate limit turns an
+// upstream call away; the call never reached the upstream
+var ErrUpstreamRateLimited = errors.New("upstream rate limit exceeded")
+
+// Caller classes of upstream calls
+const (
+	upstreamPoll     = "poll"
+	upstreamRetry    = "retry"
+	upstreamManual   = "manual"
+	upstreamHealth   = "health"
+	upstreamBackfill = "backfill"
+	upstreamLoadTest = "loadtest"
+)
+
+const (
+	rateLimitWait   = "wait"
+	rateLimitReject = "reject"
+)
+
+// upstreamClasses are the caller classes and their defaults. Health probes
+// don't queue behind the ingestion; a probe that finds no token is skipped.
+var upstreamClasses = map[string]RateLimitClassConfig{
+	upstreamPoll:     {Weight: 1, Policy: rateLimitWait},
+	upstreamRetry:    {Weight: 1, Policy: rateLimitWait},
+	upstreamManual:   {Weight: 1, Policy: rateLimitWait},
+	upstreamHealth:   {Weight: 1, Policy: rateLimitReject},
+	upstreamBackfill: {Weight: 1, Policy: rateLimitWait},
+	upstreamLoadTest: {Weight: 1, Policy: rateLimitWait},
+}
+
+// UpstreamRateLimitConfig is a token bucket every upstream call passes
+// through, whichever location or path it comes from
+type UpstreamRateLimitConfig struct {
+	// Rate is the sustained calls per second; 0 disables the limit
+	Rate float64 `yaml:"rate"`
+	// Burst is the bucket size, Rate rounded up by default
+	Burst int `yaml:"burst"`
+	// Classes override the defaults of poll, retry, manual, health,
+	// backfill and loadtest
+	Classes map[string]RateLimitClassConfig `yaml:"classes"`
+}
+
+// RateLimitClassConfig is how one caller class uses the bucket
+type RateLimitClassConfig struct {
+	// Rate gives the class a bucket of its own with this many calls per
+	// second, so it neither eats into nor waits for the shared one. 0 draws
+	// from the shared bucket.
+	Rate float64 `yaml:"rate"`
+	// Burst is the size of the class' own bucket, Rate rounded up by default
+	Burst int `yaml:"burst"`
+	// Weight is the tokens one call costs, 1 by default
+	Weight float64 `yaml:"weight"`
+	// Policy is wait, the default, or reject when no token is left
+	Policy string `yaml:"policy"`
+	// MaxWait turns away a waiting call that would wait longer; 0 waits as
+	// long as the caller does
+	MaxWait Duration `yaml:"max_wait"`
+}
+
+func (c UpstreamRateLimitConfig) Validate() error {
+	if c.Rate < 0 || math.IsInf(c.Rate, 0) || math.IsNaN(c.Rate) {
+		return fmt.Errorf("api.rate_limit.rate must be a positive number of calls per second")
+	}
+	if c.Burst < 0 {
+		return fmt.Errorf("api.rate_limit.burst must not be negative")
+	}
+	if c.Rate == 0 {
+		if c.Burst > 0 || len(c.Classes) > 0 {
+			return fmt.Errorf("api.rate_limit.burst and api.rate_limit.classes require api.rate_limit.rate")
+		}
+		return nil
+	}
+	burst := float64(c.burst())
+	for name, class := range c.Classes {
+		if _, ok := upstreamClasses[name]; !ok {
+			return fmt.Errorf("api.rate_limit.classes: unknown class %q, expected one of poll, retry, manual, health, backfill or loadtest", name)
+		}
+		switch class.Policy {
+		case "", rateLimitWait, rateLimitReject:
+		default:
+			return fmt.Errorf("api.rate_limit.classes.%s.policy must be wait or reject, got %q", name, class.Policy)
+		}
+		if class.Weight < 0 {
+			return fmt.Errorf("api.rate_limit.classes.%s.weight must not be negative", name)
+		}
+		if class.Rate < 0 || math.IsInf(class.Rate, 0) || math.IsNaN(class.Rate) {
+			return fmt.Errorf("api.rate_limit.classes.%s.rate must be a positive number of calls per second", name)
+		}
+		if class.Burst < 0 {
+			return fmt.Errorf("api.rate_limit.classes.%s.burst must not be negative", name)
+		}
+		if class.Burst > 0 && class.Rate == 0 {
+			return fmt.Errorf("api.rate_limit.classes.%s.burst requires api.rate_limit.classes.%s.rate", name, name)
+		}
+		limit := burst
+		if class.Rate > 0 {
+			limit = float64(class.burst())
+		}
+		if class.Weight > limit {
+			return fmt.Errorf("api.rate_limit.classes.%s.weight (%g) exceeds the burst (%g), so no call could pass", name, class.Weight, limit)
+		}
+		if class.MaxWait < 0 {
+			return fmt.Errorf("api.rate_limit.classes.%s.max_wait must not be negative", name)
+		}
+	}
+	return nil
+}
+
+func (c UpstreamRateLimitConfig) burst() int {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	return int(math.Max(1, math.Ceil(c.Rate)))
+}
+
+func (c RateLimitClassConfig) burst() int {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	return int(math.Max(1, math.Ceil(c.Rate)))
+}
+
+// class returns the settings of a caller class with the defaults applied
+func (c UpstreamRateLimitConfig) class(name string) RateLimitClassConfig {
+	class := upstreamClasses[name]
+	override := c.Classes[name]
+	if override.Weight > 0 {
+		class.Weight = override.Weight
+	}
+	if override.Policy != "" {
+		class.Policy = override.Policy
+	}
+	class.MaxWait = override.MaxWait
+	class.Rate, class.Burst = override.Rate, override.Burst
+	return class
+}
+
+// upstreamLimiter hands out tokens in the order they are asked for. A call
+// that has to wait reserves its tokens up front, so later callers queue
+// behind it and the aggregate rate holds however many paths call at once.
+type upstreamLimiter struct {
+	rate    float64
+	burst   float64
+	classes map[string]RateLimitClassConfig
+	// own are the buckets of the classes with a rate of their own
+	own     map[string]*upstreamLimiter
+	metrics *Metrics
+	// now is replaced in tests
+	now func() time.Time
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	// closed releases every waiting caller at shutdown
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// newUpstreamLimiter returns nil unless api.rate_limit.rate is set
+func newUpstreamLimiter(config UpstreamRateLimitConfig, metrics *Metrics) *upstreamLimiter {
+	if config.Rate <= 0 {
+		return nil
+	}
+	l := &upstreamLimiter{
+		rate:    config.Rate,
+		burst:   float64(config.burst()),
+		classes: make(map[string]RateLimitClassConfig, len(upstreamClasses)),
+		metrics: metrics,
+		now:     time.Now,
+		closed:  make(chan struct{}),
+	}
+	for name := range upstreamClasses {
+		class := config.class(name)
+		l.classes[name] = class
+		if class.Rate > 0 {
+			if l.own == nil {
+				l.own = make(map[string]*upstreamLimiter)
+			}
+			own := &upstreamLimiter{rate: class.Rate, burst: float64(class.burst())}
+			own.now = func() time.Time { return l.now() }
+			own.tokens = own.burst
+			own.last = own.now()
+			l.own[name] = own
+		}
+	}
+	l.tokens = l.burst
+	l.last = l.now()
+	return l
+}
+
+// bucket returns the bucket class draws from
+func (l *upstreamLimiter) bucket(class string) *upstreamLimiter {
+	if own, ok := l.own[class]; ok {
+		return own
+	}
+	return l
+}
+
+// reserve takes weight tokens and returns how long the caller has to wait
+// for them. Nothing is taken when the wait would exceed max (with max >= 0).
+func (l *upstreamLimiter) reserve(weight float64, max time.Duration) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if elapsed := now.Sub(l.last); elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed.Seconds()*l.rate)
+		l.last = now
+	}
+	wait := time.Duration(0)
+	if missing := weight - l.tokens; missing > 0 {
+		wait = time.Duration(math.Ceil(missing / l.rate * float64(time.Second)))
+	}
+	if max >= 0 && wait > max {
+		return wait, false
+	}
+	l.tokens -= weight
+	return wait, true
+}
+
+// cancel gives back the tokens of a reservation the caller did not wait for
+func (l *upstreamLimiter) cancel(weight float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = math.Min(l.burst, l.tokens+weight)
+}
+
+// wait blocks until the class may call the upstream. It fails with
+// ErrUpstreamRateLimited when the class' policy turns the call away or the
+// limiter is closed, and with the context's error when the caller gives up.
+func (l *upstreamLimiter) wait(ctx context.Context, class string) error {
+	if l == nil {
+		return nil
+	}
+	settings, ok := l.classes[class]
+	if !ok {
+		settings = l.classes[upstreamPoll]
+	}
+	select {
+	case <-l.closed:
+		return fmt.Errorf("%w: shutting down", ErrUpstreamRateLimited)
+	default:
+	}
+
+	max := time.Duration(-1)
+	switch {
+	case settings.Policy == rateLimitReject:
+		max = 0
+	case settings.MaxWait > 0:
+		max = time.Duration(settings.MaxWait)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); max < 0 || remaining < max {
+			max = remaining
+		}
+	}
+	bucket := l.bucket(class)
+	delay, ok := bucket.reserve(settings.Weight, max)
+	if !ok {
+		l.metrics.RateLimitRejections.WithLabelValues(class).Inc()
+		return fmt.Errorf("%w for %s calls, next token in %s", ErrUpstreamRateLimited, class, delay.Round(time.Millisecond))
+	}
+	if delay > 0 {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			bucket.cancel(settings.Weight)
+			return ctx.Err()
+		case <-l.closed:
+			bucket.cancel(settings.Weight)
+			return fmt.Errorf("%w: shutting down", ErrUpstreamRateLimited)
+		}
+	}
+	l.metrics.RateLimitTokens.WithLabelValues(class).Add(settings.Weight)
+	return nil
+}
+
+// close releases the waiting callers and turns every later call away
+func (l *upstreamLimiter) close() {
+	if l == nil {
+		return
+	}
+	l.closeOnce.Do(func() { close(l.closed) })
+}
+
+// RateLimitStatus is the rate limit section of /ingestion/status
+type RateLimitStatus struct {
+	Rate   float64 `json:"rate"`
+	Burst  float64 `json:"burst"`
+	Tokens float64 `json:"tokens"`
+	// Classes are the buckets of the classes with a rate of their own
+	Classes map[string]*RateLimitStatus `json:"classes,omitempty"`
+}
+
+func (l *upstreamLimiter) status() *RateLimitStatus {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	tokens := math.Min(l.burst, l.tokens+l.now().Sub(l.last).Seconds()*l.rate)
+	l.mu.Unlock()
+	status := &RateLimitStatus{Rate: l.rate, Burst: l.burst, Tokens: math.Round(tokens*100) / 100}
+	for name, own := range l.own {
+		if status.Classes == nil {
+			status.Classes = make(map[string]*RateLimitStatus, len(l.own))
+		}
+		status.Classes[name] = own.status()
+	}
+	return status
+}
+
+type upstreamClassKey struct{}
+
+// withUpstreamClass marks the upstream calls made with ctx as class
+func withUpstreamClass(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, upstreamClassKey{}, class)
+}
+
+// upstreamClassOf returns the caller class of ctx, poll by default
+func upstreamClassOf(ctx context.Context) string {
+	if class, ok := ctx.Value(upstreamClassKey{}).(string); ok {
+		return class
+	}
+	return upstreamPoll
+}
+
+// waitUpstream takes a token for a call to the upstream. Replayed fixtures
+// don't reach the upstream and pass freely.
+func (di *DataIngestor) waitUpstream(ctx context.Context) error {
+	if di.fixtures != nil && di.fixtures.replay {
+		return nil
+	}
+	return di.upstreamLimit.wait(ctx, upstreamClassOf(ctx))
+}
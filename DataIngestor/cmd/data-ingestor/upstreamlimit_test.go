@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamLimiter_Reserve(t *testing.T) {
+	now := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	limiter := newUpstreamLimiter(UpstreamRateLimitConfig{Rate: 10, Burst: 2}, NewMetrics(prometheus.NewRegistry()))
+	limiter.now = func() time.Time { return now }
+	limiter.last = now
+
+	for i := 0; i < 2; i++ {
+		wait, ok := limiter.reserve(1, -1)
+		require.True(t, ok)
+		assert.Zero(t, wait, "the burst")
+	}
+	wait, ok := limiter.reserve(1, -1)
+	require.True(t, ok)
+	assert.Equal(t, 100*time.Millisecond, wait)
+	wait, ok = limiter.reserve(2, -1)
+	require.True(t, ok)
+	assert.Equal(t, 300*time.Millisecond, wait, "queued behind the earlier reservation, at twice the cost")
+
+	_, ok = limiter.reserve(1, 350*time.Millisecond)
+	assert.False(t, ok, "nothing is taken for a wait longer than allowed")
+	wait, ok = limiter.reserve(1, 400*time.Millisecond)
+	require.True(t, ok)
+	assert.Equal(t, 400*time.Millisecond, wait)
+
+	// The bucket refills at the rate, up to the burst
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, 2.0, limiter.status().Tokens)
+	limiter.cancel(1)
+	assert.Equal(t, 2.0, limiter.status().Tokens)
+}
+
+func TestUpstreamLimiter_Policies(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	limiter := newUpstreamLimiter(UpstreamRateLimitConfig{Rate: 1, Burst: 3, Classes: map[string]RateLimitClassConfig{
+		upstreamRetry:  {Weight: 2},
+		upstreamManual: {Policy: rateLimitReject},
+	}}, metrics)
+	ctx := context.Background()
+
+	require.NoError(t, limiter.wait(ctx, upstreamRetry))
+	assert.Equal(t, 2.0, testutil.ToFloat64(metrics.RateLimitTokens.WithLabelValues(upstreamRetry)))
+	require.NoError(t, limiter.wait(ctx, upstreamManual))
+
+	err := limiter.wait(ctx, upstreamManual)
+	assert.ErrorIs(t, err, ErrUpstreamRateLimited)
+	assert.ErrorContains(t, err, "for manual calls, next token in")
+	assert.ErrorIs(t, limiter.wait(ctx, upstreamHealth), ErrUpstreamRateLimited, "health probes reject by default")
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.RateLimitRejections.WithLabelValues(upstreamManual)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.RateLimitRejections.WithLabelValues(upstreamHealth)))
+
+	// A waiting caller whose deadline comes before its token is turned away
+	// at once
+	short, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	assert.ErrorIs(t, limiter.wait(short, upstreamPoll), ErrUpstreamRateLimited)
+	assert.Less(t, time.Since(start), 50*time.Millisecond)
+
+	assert.NoError(t, (*upstreamLimiter)(nil).wait(ctx, upstreamPoll), "no limit without api.rate_limit")
+}
+
+func TestUpstreamLimiter_ReleasesWaitersAtShutdown(t *testing.T) {
+	limiter := newUpstreamLimiter(UpstreamRateLimitConfig{Rate: 0.1, Burst: 1}, NewMetrics(prometheus.NewRegistry()))
+	require.NoError(t, limiter.wait(context.Background(), upstreamPoll))
+
+	// A cancelled caller gives its reservation back
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- limiter.wait(ctx, upstreamPoll) }()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	assert.ErrorIs(t, <-errs, context.Canceled)
+	assert.InDelta(t, 0, limiter.status().Tokens, 0.01)
+
+	var waiters sync.WaitGroup
+	released := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		waiters.Add(1)
+		go func() {
+			defer waiters.Done()
+			released <- limiter.wait(context.WithoutCancel(context.Background()), upstreamPoll)
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	limiter.close()
+	waiters.Wait()
+	close(released)
+	for err := range released {
+		assert.ErrorIs(t, err, ErrUpstreamRateLimited)
+	}
+	assert.ErrorContains(t, limiter.wait(context.Background(), upstreamManual), "shutting down")
+	limiter.close()
+}
+
+// TestUpstreamLimiter_AggregateRate polls three locations as fast as it can
+// while manual ingestions and health probes fire at once, and checks that
+// the upstream never sees more than the shared rate
+func TestUpstreamLimiter_AggregateRate(t *testing.T) {
+	const rate, burst = 40.0, 4
+	var mu sync.Mutex
+	var calls []time.Time
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		calls = append(calls, time.Now())
+		n := len(calls)
+		mu.Unlock()
+		// Some polls fail and are retried
+		if r.Method == http.MethodGet && n%4 == 0 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer upstream.Close()
+
+	config := &Config{
+		API: APIConfig{
+			Timeout:      Duration(time.Second),
+			PollInterval: Duration(time.Millisecond),
+			RetryCount:   1,
+			RetryBackoff: Duration(time.Millisecond),
+			RateLimit:    UpstreamRateLimitConfig{Rate: rate, Burst: burst},
+		},
+		Logging: LoggingConfig{Level: "panic"},
+	}
+	for i := 0; i < 3; i++ {
+		config.API.Locations = append(config.API.Locations, LocationSource{Name: fmt.Sprintf("station-%d", i), BaseURL: upstream.URL})
+	}
+	require.NoError(t, config.Validate())
+	ingestor := NewDataIngestor(config)
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	router := setupRoutes(ingestor)
+
+	start := time.Now()
+	ctx, cancel := context.WithCancel(context.Background())
+	polling := make(chan struct{})
+	go func() {
+		ingestor.StartIngestion(ctx)
+		close(polling)
+	}()
+	var manual atomic.Int32
+	var others sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		others.Add(1)
+		go func() {
+			defer others.Done()
+			for time.Since(start) < time.Second {
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ingest", nil))
+				manual.Add(1)
+			}
+		}()
+	}
+	others.Add(1)
+	go func() {
+		defer others.Done()
+		for time.Since(start) < time.Second {
+			ingestor.probeUpstream(context.Background())
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	others.Wait()
+
+	// Polling cycles outlive the context to drain; waiting for a token ends
+	// with the limiter
+	cancel()
+	ingestor.upstreamLimit.close()
+	select {
+	case <-polling:
+	case <-time.After(time.Second):
+		t.Fatal("polling did not stop at shutdown")
+	}
+	elapsed := time.Since(start)
+
+	mu.Lock()
+	defer mu.Unlock()
+	limit := burst + rate*elapsed.Seconds()
+	assert.LessOrEqual(t, float64(len(calls)), limit+1, "%d calls in %s", len(calls), elapsed)
+	assert.Greater(t, float64(len(calls)), rate*0.5, "the limit is used")
+	assert.Greater(t, manual.Load(), int32(0))
+
+	tokens := 0.0
+	for _, class := range []string{upstreamPoll, upstreamRetry, upstreamManual, upstreamHealth} {
+		tokens += testutil.ToFloat64(ingestor.metrics.RateLimitTokens.WithLabelValues(class))
+	}
+	assert.Equal(t, float64(len(calls)), tokens, "every call took a token")
+	assert.Greater(t, testutil.ToFloat64(ingestor.metrics.RateLimitRejections.WithLabelValues(upstreamHealth)), 0.0)
+}
+
+func TestUpstreamLimiter_ManualAndRetryCalls(t *testing.T) {
+	var hits atomic.Int32
+	status := atomic.Int32{}
+	status.Store(http.StatusNoContent)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer upstream.Close()
+
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second), RetryCount: 2, RetryBackoff: Duration(time.Millisecond),
+			RateLimit: UpstreamRateLimitConfig{Rate: 0.01, Burst: 2, Classes: map[string]RateLimitClassConfig{
+				upstreamManual: {Policy: rateLimitReject},
+				upstreamRetry:  {Policy: rateLimitReject},
+			}}},
+		Logging: LoggingConfig{Level: "panic"},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	router := setupRoutes(ingestor)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ingest", nil))
+	assert.Equal(t, http.StatusNoContent, w.Code)
+
+	// The retry finds the bucket empty; the upstream's failure is reported
+	status.Store(http.StatusBadGateway)
+	_, err := ingestor.fetchSource(context.Background(), ingestor.sources[0])
+	var upstreamErr *statusError
+	require.True(t, errors.As(err, &upstreamErr), "%v", err)
+	assert.Equal(t, http.StatusBadGateway, upstreamErr.Code)
+	assert.Equal(t, int32(2), hits.Load())
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.RateLimitRejections.WithLabelValues(upstreamRetry)))
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ingest", nil))
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.Contains(t, w.Body.String(), "upstream rate limit exceeded for manual calls")
+	assert.Equal(t, int32(2), hits.Load())
+	assert.Zero(t, ingestor.sources[0].status(time.Now()).ConsecutiveFailures, "a call that was not made is no failure")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamFetches.WithLabelValues(ingestor.sources[0].name, triggerManual)), "the first POST /ingest")
+}
+
+func TestUpstreamLimiter_OwnBuckets(t *testing.T) {
+	now := time.Date(2024, 5, 3, 12, 0, 0, 0, time.UTC)
+	limiter := newUpstreamLimiter(UpstreamRateLimitConfig{Rate: 10, Burst: 1, Classes: map[string]RateLimitClassConfig{
+		upstreamPoll:     {Policy: rateLimitReject},
+		upstreamBackfill: {Rate: 0.5, Burst: 2, Policy: rateLimitReject},
+	}}, NewMetrics(prometheus.NewRegistry()))
+	limiter.now = func() time.Time { return now }
+	limiter.last = now
+	limiter.own[upstreamBackfill].last = now
+	ctx := context.Background()
+
+	require.NoError(t, limiter.wait(ctx, upstreamPoll))
+	assert.ErrorIs(t, limiter.wait(ctx, upstreamPoll), ErrUpstreamRateLimited)
+
+	// The backfill neither waits for the drained shared bucket nor takes
+	// from it
+	require.NoError(t, limiter.wait(ctx, upstreamBackfill))
+	require.NoError(t, limiter.wait(ctx, upstreamBackfill))
+	assert.ErrorIs(t, limiter.wait(ctx, upstreamBackfill), ErrUpstreamRateLimited)
+
+	now = now.Add(100 * time.Millisecond)
+	require.NoError(t, limiter.wait(ctx, upstreamPoll), "the shared bucket refilled")
+	assert.ErrorIs(t, limiter.wait(ctx, upstreamBackfill), ErrUpstreamRateLimited, "the backfill's did not")
+
+	status := limiter.status()
+	assert.Equal(t, 10.0, status.Rate)
+	require.Contains(t, status.Classes, upstreamBackfill)
+	assert.Equal(t, 0.5, status.Classes[upstreamBackfill].Rate)
+	assert.Equal(t, 2.0, status.Classes[upstreamBackfill].Burst)
+	assert.Equal(t, 0.05, status.Classes[upstreamBackfill].Tokens)
+	assert.NotContains(t, status.Classes, upstreamManual)
+}
+
+func TestConfig_ValidateUpstreamRateLimit(t *testing.T) {
+	valid := []UpstreamRateLimitConfig{
+		{},
+		{Rate: 0.5},
+		{Rate: 10, Burst: 20, Classes: map[string]RateLimitClassConfig{
+			upstreamRetry:  {Weight: 4, Policy: rateLimitWait, MaxWait: Duration(time.Second)},
+			upstreamHealth: {Policy: rateLimitWait},
+		}},
+		{Rate: 1, Classes: map[string]RateLimitClassConfig{
+			upstreamBackfill: {Rate: 0.1, Weight: 3, Burst: 3},
+			upstreamLoadTest: {Rate: 20},
+		}},
+	}
+	for _, config := range valid {
+		assert.NoError(t, config.Validate(), "%+v", config)
+	}
+	assert.Equal(t, 1, UpstreamRateLimitConfig{Rate: 0.5}.burst())
+	assert.Equal(t, 3, UpstreamRateLimitConfig{Rate: 2.5}.burst())
+
+	invalid := map[string]UpstreamRateLimitConfig{
+		"api.rate_limit.rate must be a positive number":                    {Rate: -1},
+		"api.rate_limit.burst and api.rate_limit.classes require":          {Burst: 5},
+		`unknown class "replay"`:                                           {Rate: 1, Classes: map[string]RateLimitClassConfig{"replay": {}}},
+		`api.rate_limit.classes.poll.policy must be wait or reject`:        {Rate: 1, Classes: map[string]RateLimitClassConfig{upstreamPoll: {Policy: "drop"}}},
+		"api.rate_limit.classes.retry.weight (3) exceeds the burst (2)":    {Rate: 1, Burst: 2, Classes: map[string]RateLimitClassConfig{upstreamRetry: {Weight: 3}}},
+		"api.rate_limit.classes.manual.rate must be a positive number":     {Rate: 1, Classes: map[string]RateLimitClassConfig{upstreamManual: {Rate: -2}}},
+		"api.rate_limit.classes.manual.burst requires":                     {Rate: 1, Classes: map[string]RateLimitClassConfig{upstreamManual: {Burst: 2}}},
+		"api.rate_limit.classes.backfill.weight (2) exceeds the burst (1)": {Rate: 5, Classes: map[string]RateLimitClassConfig{upstreamBackfill: {Rate: 0.5, Weight: 2}}},
+	}
+	for message, config := range invalid {
+		assert.ErrorContains(t, config.Validate(), message)
+	}
+	assert.ErrorContains(t, (&Config{API: APIConfig{RateLimit: UpstreamRateLimitConfig{Rate: -1}}}).Validate(), "api.rate_limit.rate")
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+// errAuthNotConfigured is returned when new credentials are given but the
+// upstream client was built without OAuth2
+var errAuthNotConfigured = errors.New("api.auth.oauth2 is not configured; adding or removing auth needs a restart")
+
+// validateBaseURL rejects base URLs no request can be built from: they need
+// an http or https scheme and a host, and the /meters path is appended, so
+// they may not carry a query or fragment
+func validateBaseURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("invalid base_url %q: %w", raw, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid base_url %q: scheme must be http or https", raw)
+	}
+	if u.Host == "" {
+		return fmt.Errorf("invalid base_url %q: host is missing", raw)
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid base_url %q: query and fragment are not allowed", raw)
+	}
+	return nil
+}
+
+// validateEndpointURL checks the URL of an upstream endpoint besides the
+// readings, field in errors: an http(s) URL, or a path on baseURL
+func validateEndpointURL(field, raw, baseURL string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+	if u.IsAbs() {
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s must be an http:// or https:// URL or a path, got %q", field, raw)
+		}
+	} else if baseURL == "" {
+		return fmt.Errorf("%s %q is a path, which needs api.base_url", field, raw)
+	}
+	return nil
+}
+
+// resolveEndpointURL resolves the URL of an upstream endpoint against baseURL
+func resolveEndpointURL(raw, baseURL string) string {
+	u, err := url.Parse(raw)
+	if err != nil || u.IsAbs() {
+		return raw
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return raw
+	}
+	return base.ResolveReference(u).String()
+}
+
+// UpstreamChange switches the upstream of one location while the service
+// runs, the body of PUT /admin/upstream
+type UpstreamChange struct {
+	// Location may be left out when there is a single location
+	Location string `json:"location"`
+	BaseURL  string `json:"base_url"`
+	// OAuth2 replaces the client credentials of api.auth.oauth2
+	OAuth2 *OAuth2Config `json:"oauth2"`
+	// ResetCursor forgets the location's incremental fetch cursor, for an
+	// upstream that does not share the old one's timeline
+	ResetCursor bool `json:"reset_cursor"`
+}
+
+// switchUpstream validates change and applies it. New cycles use the new
+// target; requests already sent to the old one complete. The breaker,
+// throttle and adaptive timeout of the location describe the old host and
+// start over. The credentials are shared by every location, so a change of
+// only them needs no location. It returns the location, nil then, and the
+// base URL switched from.
+func (di *DataIngestor) switchUpstream(change UpstreamChange) (*source, string, error) {
+	change.BaseURL = strings.TrimRight(change.BaseURL, "/")
+	if change.BaseURL == "" && change.OAuth2 == nil {
+		return nil, "", fmt.Errorf("base_url or oauth2 is required")
+	}
+	var src *source
+	if change.BaseURL != "" || change.ResetCursor {
+		var err error
+		if src, err = di.changedSource(change.Location); err != nil {
+			return nil, "", err
+		}
+	}
+	if change.BaseURL != "" {
+		if err := validateBaseURL(change.BaseURL); err != nil {
+			return nil, "", err
+		}
+	}
+	if change.ResetCursor && di.cursors == nil {
+		return nil, "", fmt.Errorf("reset_cursor needs incremental fetching")
+	}
+	if change.OAuth2 != nil {
+		if di.auth == nil {
+			return nil, "", errAuthNotConfigured
+		}
+		if err := change.OAuth2.Validate(); err != nil {
+			return nil, "", err
+		}
+		if err := di.auth.swap(change.OAuth2); err != nil {
+			return nil, "", err
+		}
+		di.logger.WithField("token_url", change.OAuth2.TokenURL).Warn("Upstream credentials changed")
+	}
+	if src == nil {
+		return nil, "", nil
+	}
+
+	from := src.target()
+	if change.BaseURL != "" && change.BaseURL != strings.TrimRight(from, "/") {
+		src.retarget(change.BaseURL)
+		di.metrics.CircuitBreakerState.WithLabelValues(src.name).Set(float64(breakerClosed))
+		di.metrics.UpstreamSwitches.WithLabelValues(src.name).Inc()
+		di.logger.WithFields(logrus.Fields{
+			"location": src.name,
+			"from":     from,
+			"to":       change.BaseURL,
+		}).Warn("Upstream base URL changed")
+	}
+	if change.ResetCursor {
+		if err := di.cursors.reset(src.name); err != nil {
+			return nil, "", err
+		}
+		di.logger.WithField("location", src.name).Warn("Cursor reset")
+	}
+	return src, from, nil
+}
+
+// changedSource returns the location a change is for
+func (di *DataIngestor) changedSource(location string) (*source, error) {
+	if location == "" {
+		sources := di.currentSources()
+		switch len(sources) {
+		case 0:
+			return nil, fmt.Errorf("no location is polled")
+		case 1:
+			return sources[0], nil
+		}
+		return nil, fmt.Errorf("location is required with several locations")
+	}
+	src := di.sourceByName(location)
+	if src == nil {
+		return nil, fmt.Errorf("unknown location %q", location)
+	}
+	return src, nil
+}
+
+// retarget points the location at a new base URL. The failure streak,
+// throttle and latencies of the old host are dropped.
+func (s *source) retarget(baseURL string) {
+	s.mu.Lock()
+	s.baseURL = baseURL
+	s.breaker = newCircuitBreaker(s.breaker.config)
+	s.throttledUntil = time.Time{}
+	s.lastError = ""
+	s.diagnosed = false
+	s.mu.Unlock()
+	if s.timeouts != nil {
+		s.timeouts.reset()
+	}
+}
+
+// handleUpstream serves PUT /admin/upstream
+func (di *DataIngestor) handleUpstream(c *gin.Context) {
+	var change UpstreamChange
+	if err := c.ShouldBindJSON(&change); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("invalid upstream change: %v", err),
+		})
+		return
+	}
+	if change.Location != "" && di.sourceByName(change.Location) == nil {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("unknown location %q", change.Location),
+		})
+		return
+	}
+	src, from, err := di.switchUpstream(change)
+	if errors.Is(err, errAuthNotConfigured) {
+		c.JSON(http.StatusConflict, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	response := gin.H{
+		"message":      "upstream changed",
+		"auth_changed": change.OAuth2 != nil,
+	}
+	if src != nil {
+		response["location"] = src.name
+		response["from"] = from
+		response["base_url"] = src.target()
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// reloadUpstreams applies the base URLs, that of the bulk endpoint too, and
+// the OAuth2 credentials of a reloaded config. Locations that were added or removed, and auth that was added or
+// removed, need a restart. With api.discovery the catalog decides on the
+// discovered locations, so only the configured ones are compared.
+func (di *DataIngestor) reloadUpstreams(config *Config) error {
+	reloaded := newSources(config.API)
+	if polled := len(di.currentSources()); !config.API.Discovery.enabled() && len(reloaded) != polled {
+		return fmt.Errorf("api.locations changed from %d to %d locations; that needs a restart", polled, len(reloaded))
+	}
+	var changes []UpstreamChange
+	for _, next := range reloaded {
+		src := di.sourceByName(next.name)
+		if src == nil {
+			return fmt.Errorf("location %q was added; that needs a restart", next.name)
+		}
+		if strings.TrimRight(next.baseURL, "/") != strings.TrimRight(src.target(), "/") {
+			changes = append(changes, UpstreamChange{Location: src.name, BaseURL: next.baseURL})
+		}
+	}
+
+	updated := config.API.Auth.OAuth2
+	if (di.auth == nil) != (updated == nil) {
+		return errAuthNotConfigured
+	}
+	if updated != nil && !reflect.DeepEqual(di.auth.configured(), updated) {
+		changes = append(changes, UpstreamChange{OAuth2: updated})
+	}
+
+	// Everything was validated with the config; apply it all
+	for _, change := range changes {
+		if _, _, err := di.switchUpstream(change); err != nil {
+			return err
+		}
+	}
+	// The bulk requests go to api.base_url
+	next := strings.TrimRight(config.API.BaseURL, "/")
+	if from := di.bulkSource.target(); next != "" && next != strings.TrimRight(from, "/") {
+		di.bulkSource.retarget(next)
+		di.logger.WithFields(logrus.Fields{
+			"location": bulkSourceName,
+			"from":     from,
+			"to":       next,
+		}).Warn("Upstream base URL changed")
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func putUpstream(t *testing.T, ingestor *DataIngestor, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPut, "/admin/upstream", strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer letmein")
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, req)
+	return w
+}
+
+func TestValidateBaseURL(t *testing.T) {
+	assert.NoError(t, validateBaseURL("http://weakapp:8080"))
+	assert.NoError(t, validateBaseURL("https://weakapp.example.com/v2"))
+	for _, raw := range []string{
+		"weakapp:8080",
+		"ftp://weakapp",
+		"http://",
+		"http://weakapp/?key=1",
+		"http://weakapp/#meters",
+		"http://weak app",
+	} {
+		assert.Error(t, validateBaseURL(raw), raw)
+	}
+
+	assert.ErrorContains(t, APIConfig{BaseURL: "weakapp:8080"}.Validate(), "invalid base_url")
+	assert.ErrorContains(t, APIConfig{Locations: []LocationSource{{Name: "berlin", BaseURL: "http://"}}}.Validate(), "api.locations[0] (berlin): invalid base_url")
+}
+
+func TestUpstream_SwitchMidRun(t *testing.T) {
+	old, oldHits := countingUpstream(t, http.StatusOK, `[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`, nil)
+	next, nextHits := countingUpstream(t, http.StatusOK, `[{"type":"energy","name":"meter-1","payload":{"energy":2}}]`, nil)
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: old.URL, Timeout: Duration(time.Second), PollInterval: Duration(5 * time.Millisecond)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Admin:    AdminConfig{Token: "letmein"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.StartIngestion(ctx)
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(oldHits) >= 3 }, 5*time.Second, time.Millisecond)
+
+	w := putUpstream(t, ingestor, `{"base_url":"`+next.URL+`/"}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"message":"upstream changed","auth_changed":false,"location":"default","from":"`+old.URL+`","base_url":"`+next.URL+`"}`, w.Body.String())
+	switched := atomic.LoadInt32(oldHits)
+
+	require.Eventually(t, func() bool { return atomic.LoadInt32(nextHits) >= 3 }, 5*time.Second, time.Millisecond)
+	cancel()
+	<-done
+
+	assert.Equal(t, switched, atomic.LoadInt32(oldHits), "new cycles use the new upstream")
+	total := int(atomic.LoadInt32(oldHits) + atomic.LoadInt32(nextHits))
+	assert.Len(t, channel.messages(), total, "every cycle published")
+	assert.Equal(t, float64(total), testutil.ToFloat64(ingestor.metrics.Cycles.WithLabelValues(string(CycleSucceeded), triggerPoll)))
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.UpstreamFailures.WithLabelValues(defaultSourceName)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamSwitches.WithLabelValues(defaultSourceName)))
+}
+
+func TestUpstream_InFlightRequestCompletes(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	old := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`))
+	}))
+	defer old.Close()
+	next, nextHits := countingUpstream(t, http.StatusOK, `[{"type":"energy","name":"meter-1","payload":{"energy":2}}]`, nil)
+	ingestor, channel := newAdminTestIngestor(t)
+	ingestor.sources[0].retarget(old.URL)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	}()
+	<-started
+	_, _, err := ingestor.switchUpstream(UpstreamChange{BaseURL: next.URL})
+	require.NoError(t, err)
+	close(release)
+	wg.Wait()
+
+	messages := channel.messages()
+	require.Len(t, messages, 1, "the request to the old upstream was published")
+	assert.Contains(t, string(messages[0].Msg.Body), `"energy":1`)
+	assert.Zero(t, atomic.LoadInt32(nextHits))
+
+	ingestor.ingestOnce(context.Background(), ingestor.sources[0])
+	assert.EqualValues(t, 1, atomic.LoadInt32(nextHits))
+	assert.Len(t, channel.messages(), 2)
+}
+
+func TestUpstream_SwitchDropsOldHostState(t *testing.T) {
+	failing, _ := countingUpstream(t, http.StatusBadGateway, `{"error":"bad gateway"}`, map[string]string{"Retry-After": "60"})
+	healthy, _ := countingUpstream(t, http.StatusOK, `[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`, nil)
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL:         failing.URL,
+			Timeout:         Duration(time.Second),
+			CircuitBreaker:  CircuitBreakerConfig{FailureThreshold: 1, OpenTimeout: Duration(time.Minute)},
+			AdaptiveTimeout: AdaptiveTimeoutConfig{Enabled: true, MinSamples: 1},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	src := ingestor.sources[0]
+
+	_, err := ingestor.ingest(context.Background())
+	require.Error(t, err)
+	status := src.status(time.Now())
+	require.Equal(t, "open", status.Breaker)
+	require.NotNil(t, status.ThrottledUntil)
+
+	_, _, err = ingestor.switchUpstream(UpstreamChange{BaseURL: healthy.URL})
+	require.NoError(t, err)
+	status = src.status(time.Now())
+	assert.Equal(t, SourceStatus{Breaker: "closed"}, status)
+	assert.Zero(t, src.timeouts.stats().Samples)
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.CircuitBreakerState.WithLabelValues(defaultSourceName)))
+
+	_, err = ingestor.ingest(context.Background())
+	assert.NoError(t, err)
+}
+
+func TestUpstream_RejectsBadChanges(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	before := ingestor.sources[0].target()
+
+	for _, tc := range []struct {
+		body   string
+		status int
+		want   string
+	}{
+		{`{"base_url":"weakapp:8080"}`, http.StatusBadRequest, "scheme must be http or https"},
+		{`{"base_url":"http://weakapp?key=1"}`, http.StatusBadRequest, "query and fragment"},
+		{`{}`, http.StatusBadRequest, "base_url or oauth2 is required"},
+		{`{"base_url":"http://weakapp","reset_cursor":true}`, http.StatusBadRequest, "needs incremental fetching"},
+		{`{"location":"moscow","base_url":"http://weakapp"}`, http.StatusNotFound, "unknown location"},
+		{`{"oauth2":{"token_url":"http://auth","client_id":"ingestor","client_secret":"x"}}`, http.StatusConflict, "needs a restart"},
+		{`[`, http.StatusBadRequest, "invalid upstream change"},
+	} {
+		w := putUpstream(t, ingestor, tc.body)
+		assert.Equal(t, tc.status, w.Code, tc.body)
+		assert.Contains(t, w.Body.String(), tc.want, tc.body)
+	}
+	assert.Equal(t, before, ingestor.sources[0].target(), "nothing was applied")
+
+	several, _, _, _ := newTwoLocationIngestor(t, APIConfig{})
+	_, _, err := several.switchUpstream(UpstreamChange{BaseURL: "http://weakapp"})
+	assert.ErrorContains(t, err, "location is required")
+}
+
+func TestUpstream_ResetCursor(t *testing.T) {
+	ingestor, _ := newAdminTestIngestor(t)
+	ingestor.cursors = newCursorStore(IncrementalConfig{StateFile: t.TempDir() + "/cursor.json"})
+	ingestor.cursors.cursors[defaultSourceName] = time.Now()
+
+	w := putUpstream(t, ingestor, `{"base_url":"http://weakapp-2:8080","reset_cursor":true}`)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Empty(t, ingestor.cursors.cursors)
+	assert.Equal(t, "http://weakapp-2:8080", ingestor.sources[0].target())
+}
+
+func TestUpstream_SwapsCredentials(t *testing.T) {
+	first, firstTokens := newTokenEndpoint(t, 3600)
+	second, secondTokens := newTokenEndpoint(t, 3600)
+	upstream := newAuthUpstream(t, func(token string) bool { return token != "" })
+	ingestor := newAuthIngestor(t, upstream.URL, &OAuth2Config{
+		TokenURL: firstTokens.URL, ClientID: "ingestor", ClientSecret: testClientSecret,
+	})
+	_, err := ingestor.FetchDataFromAPI(context.Background())
+	require.NoError(t, err)
+
+	_, _, err = ingestor.switchUpstream(UpstreamChange{OAuth2: &OAuth2Config{TokenURL: secondTokens.URL, ClientID: "ingestor"}})
+	assert.ErrorContains(t, err, "exactly one of client_secret")
+
+	src, _, err := ingestor.switchUpstream(UpstreamChange{OAuth2: &OAuth2Config{
+		TokenURL: secondTokens.URL, ClientID: "ingestor", ClientSecret: testClientSecret,
+	}})
+	require.NoError(t, err)
+	assert.Nil(t, src, "the credentials are not tied to a location")
+	_, err = ingestor.FetchDataFromAPI(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, first.count())
+	assert.Equal(t, 1, second.count(), "the cached token was dropped")
+}
+
+func TestUpstream_ReloadFromConfig(t *testing.T) {
+	ingestor, _, _, _ := newTwoLocationIngestor(t, APIConfig{})
+	berlin := ingestor.sources[0].target()
+
+	reloaded := &Config{API: APIConfig{Locations: []LocationSource{
+		{Name: "berlin", BaseURL: berlin + "/"},
+		{Name: "moscow", BaseURL: "http://moscow-2:8080"},
+	}}}
+	require.NoError(t, ingestor.reloadUpstreams(reloaded))
+	assert.Equal(t, berlin, ingestor.sources[0].target(), "a trailing slash is no change")
+	assert.Equal(t, "http://moscow-2:8080", ingestor.sources[1].target())
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.UpstreamSwitches.WithLabelValues("berlin")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.UpstreamSwitches.WithLabelValues("moscow")))
+
+	reloaded.API.Locations[1].Name = "oslo"
+	assert.ErrorContains(t, ingestor.reloadUpstreams(reloaded), `location "oslo" was added`)
+	reloaded.API.Locations = reloaded.API.Locations[:1]
+	assert.ErrorContains(t, ingestor.reloadUpstreams(reloaded), "needs a restart")
+
+	reloaded = &Config{API: APIConfig{
+		Locations: []LocationSource{{Name: "berlin", BaseURL: berlin}, {Name: "moscow", BaseURL: "http://moscow-2:8080"}},
+		Auth:      AuthConfig{OAuth2: &OAuth2Config{TokenURL: "http://auth", ClientID: "ingestor", ClientSecret: "x"}},
+	}}
+	assert.ErrorIs(t, ingestor.reloadUpstreams(reloaded), errAuthNotConfigured)
+}
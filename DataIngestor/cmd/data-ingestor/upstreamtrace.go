@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const defaultSlowRequest = time.Second
+
+// Phases of an upstream request
+const (
+	phaseDNS     = "dns"
+	phaseConnect = "connect"
+	phaseTLS     = "tls"
+	phaseTTFB    = "ttfb"
+	phaseBody    = "body"
+)
+
+// TraceConfig times every phase of the upstream requests
+type TraceConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// SlowRequest is the total duration from which a request is logged
+	// with its phases and kept for /stats, 1s by default
+	SlowRequest Duration `yaml:"slow_request"`
+}
+
+// Validate checks the slow request threshold
+func (c TraceConfig) Validate() error {
+	if c.SlowRequest < 0 {
+		return fmt.Errorf("api.trace.slow_request must not be negative")
+	}
+	return nil
+}
+
+func (c TraceConfig) slowRequest() time.Duration {
+	if c.SlowRequest <= 0 {
+		return defaultSlowRequest
+	}
+	return time.Duration(c.SlowRequest)
+}
+
+// SlowRequest is the phase breakdown of a slow upstream request, in /stats
+type SlowRequest struct {
+	Location string    `json:"location"`
+	Time     time.Time `json:"time"`
+	Total    string    `json:"total"`
+	// Phases are the durations of the phases that took place; a reused
+	// connection has no dns, connect or tls phase
+	Phases map[string]string `json:"phases"`
+	Reused bool              `json:"reused"`
+}
+
+// requestTrace collects the httptrace events of one upstream request. The
+// dial callbacks may run on other goroutines, so events are guarded.
+type requestTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	wrote        time.Time
+	firstByte    time.Time
+	bodyDone     time.Time
+	reused       bool
+}
+
+// traceRequest attaches a trace to req with api.trace.enabled. The trace is
+// nil otherwise, which leaves the request untouched.
+func (di *DataIngestor) traceRequest(req *http.Request) (*http.Request, *requestTrace) {
+	if !di.config.API.Trace.Enabled {
+		return req, nil
+	}
+	t := &requestTrace{start: time.Now()}
+	mark := func(at *time.Time) {
+		t.mu.Lock()
+		*at = time.Now()
+		t.mu.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { mark(&t.dnsStart) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { mark(&t.dnsDone) },
+		ConnectStart: func(string, string) {
+			// Dual-stack dials start several connects; the first one counts
+			t.mu.Lock()
+			if t.connectStart.IsZero() {
+				t.connectStart = time.Now()
+			}
+			t.mu.Unlock()
+		},
+		ConnectDone:       func(string, string, error) { mark(&t.connectDone) },
+		TLSHandshakeStart: func() { mark(&t.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { mark(&t.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			t.mu.Lock()
+			t.gotConn, t.reused = time.Now(), info.Reused
+			t.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { mark(&t.wrote) },
+		GotFirstResponseByte: func() { mark(&t.firstByte) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace)), t
+}
+
+// readDone marks the end of the body read
+func (t *requestTrace) readDone() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	t.bodyDone = time.Now()
+	t.mu.Unlock()
+}
+
+// total is the duration up to the end of the body read, or up to now when
+// the body was not read
+func (t *requestTrace) total() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.bodyDone.IsZero() {
+		return time.Since(t.start)
+	}
+	return t.bodyDone.Sub(t.start)
+}
+
+// phases returns the duration of every phase that both started and
+// finished. Time to first byte counts from the written request.
+func (t *requestTrace) phases() map[string]time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	phases := map[string]time.Duration{}
+	add := func(phase string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() && !to.Before(from) {
+			phases[phase] = to.Sub(from)
+		}
+	}
+	add(phaseDNS, t.dnsStart, t.dnsDone)
+	add(phaseConnect, t.connectStart, t.connectDone)
+	add(phaseTLS, t.tlsStart, t.tlsDone)
+	sent := t.wrote
+	if sent.IsZero() {
+		sent = t.gotConn
+	}
+	add(phaseTTFB, sent, t.firstByte)
+	add(phaseBody, t.firstByte, t.bodyDone)
+	return phases
+}
+
+// upstreamTraces keeps the most recent slow request for /stats
+type upstreamTraces struct {
+	mu   sync.Mutex
+	last *SlowRequest
+}
+
+func (u *upstreamTraces) set(slow SlowRequest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.last = &slow
+}
+
+// lastSlow returns the most recent slow request, nil when there was none
+func (u *upstreamTraces) lastSlow() *SlowRequest {
+	if u == nil {
+		return nil
+	}
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.last
+}
+
+// finishTrace observes the phases of a traced request and logs the
+// breakdown when the request was slow. Requests that never reached the
+// network, like replayed fixtures, have no phases and are skipped.
+func (di *DataIngestor) finishTrace(src *source, t *requestTrace) {
+	if t == nil {
+		return
+	}
+	phases := t.phases()
+	if len(phases) == 0 {
+		return
+	}
+	for phase, d := range phases {
+		di.metrics.UpstreamPhase.WithLabelValues(src.name, phase).Observe(d.Seconds())
+	}
+	total := t.total()
+	if total < di.config.API.Trace.slowRequest() {
+		return
+	}
+	t.mu.Lock()
+	reused := t.reused
+	t.mu.Unlock()
+
+	slow := SlowRequest{
+		Location: src.name,
+		Time:     t.start.UTC(),
+		Total:    total.String(),
+		Phases:   make(map[string]string, len(phases)),
+		Reused:   reused,
+	}
+	fields := logrus.Fields{
+		"location": src.name,
+		"total_ms": total.Milliseconds(),
+		"reused":   reused,
+	}
+	for phase, d := range phases {
+		slow.Phases[phase] = d.String()
+		fields[phase+"_ms"] = d.Milliseconds()
+	}
+	di.traces.set(slow)
+	di.log(logFetch).WithFields(fields).Debug("Slow upstream request")
+}
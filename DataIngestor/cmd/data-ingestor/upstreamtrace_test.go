@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const traceDelay = 100 * time.Millisecond
+
+// newTracedIngestor fetches from upstream with tracing on and requests of
+// 50ms and more counted as slow
+func newTracedIngestor(t *testing.T, upstream string) *DataIngestor {
+	t.Helper()
+	ingestor := NewDataIngestor(&Config{
+		API: APIConfig{
+			BaseURL: upstream,
+			Timeout: Duration(5 * time.Second),
+			Trace:   TraceConfig{Enabled: true, SlowRequest: Duration(50 * time.Millisecond)},
+		},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+	})
+	require.NotNil(t, ingestor.traces)
+	return ingestor
+}
+
+// slowBodyUpstream sends the headers right away and the body after the delay
+func slowBodyUpstream(t *testing.T, delay time.Duration) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(delay)
+		w.Write([]byte(rawUpstreamBody))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// phaseCount is the number of observations of phase
+func phaseCount(t *testing.T, ingestor *DataIngestor, phase string) uint64 {
+	t.Helper()
+	metric := findMetric(t, ingestor, "data_ingestor_upstream_phase_duration_seconds", map[string]string{"location": defaultSourceName, "phase": phase})
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestTrace_DisabledByDefault(t *testing.T) {
+	upstream := newUpstream(t, "application/json", rawUpstreamBody)
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+	})
+	assert.Nil(t, ingestor.traces)
+
+	req := httptest.NewRequest(http.MethodGet, upstream.URL, nil)
+	traced, trace := ingestor.traceRequest(req)
+	assert.Same(t, req, traced)
+	assert.Nil(t, trace)
+
+	_, err := ingestor.fetchFrom(context.Background(), ingestor.sources[0])
+	require.NoError(t, err)
+	assert.Zero(t, testutil.CollectAndCount(ingestor.metrics.UpstreamPhase))
+	assert.Nil(t, ingestor.traces.lastSlow())
+}
+
+func TestTrace_Validate(t *testing.T) {
+	assert.NoError(t, TraceConfig{}.Validate())
+	assert.Error(t, TraceConfig{SlowRequest: Duration(-time.Second)}.Validate())
+	assert.Error(t, (&Config{API: APIConfig{Trace: TraceConfig{SlowRequest: Duration(-time.Second)}}}).Validate())
+	assert.Equal(t, time.Second, TraceConfig{}.slowRequest())
+}
+
+func TestTrace_AttributesSlowConnect(t *testing.T) {
+	upstream := newUpstream(t, "application/json", rawUpstreamBody)
+	ingestor := newTracedIngestor(t, upstream.URL)
+	// Control runs inside the dial, after the connect phase started
+	dialer := &net.Dialer{Control: func(string, string, syscall.RawConn) error {
+		time.Sleep(traceDelay)
+		return nil
+	}}
+	ingestor.httpClient.Transport = &http.Transport{DialContext: dialer.DialContext}
+
+	_, err := ingestor.fetchFrom(context.Background(), ingestor.sources[0])
+	require.NoError(t, err)
+
+	slow := ingestor.traces.lastSlow()
+	require.NotNil(t, slow)
+	assert.Equal(t, defaultSourceName, slow.Location)
+	assert.False(t, slow.Reused)
+	connect, err := time.ParseDuration(slow.Phases[phaseConnect])
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, connect, traceDelay)
+	ttfb, err := time.ParseDuration(slow.Phases[phaseTTFB])
+	require.NoError(t, err)
+	assert.Less(t, ttfb, traceDelay)
+	assert.NotContains(t, slow.Phases, phaseDNS, "127.0.0.1 needs no lookup")
+	assert.NotContains(t, slow.Phases, phaseTLS)
+}
+
+func TestTrace_AttributesSlowBody(t *testing.T) {
+	ingestor := newTracedIngestor(t, slowBodyUpstream(t, traceDelay).URL)
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	ingestor.logger = logger
+
+	_, err := ingestor.fetchFrom(context.Background(), ingestor.sources[0])
+	require.NoError(t, err)
+
+	slow := ingestor.traces.lastSlow()
+	require.NotNil(t, slow)
+	body, err := time.ParseDuration(slow.Phases[phaseBody])
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, body, traceDelay)
+	ttfb, err := time.ParseDuration(slow.Phases[phaseTTFB])
+	require.NoError(t, err)
+	assert.Less(t, ttfb, traceDelay)
+
+	var logged *logrus.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Message == "Slow upstream request" {
+			logged = entry
+		}
+	}
+	require.NotNil(t, logged)
+	assert.Equal(t, logrus.DebugLevel, logged.Level)
+	assert.GreaterOrEqual(t, logged.Data["body_ms"], traceDelay.Milliseconds())
+	assert.Contains(t, logged.Data, "connect_ms")
+	assert.Contains(t, logged.Data, "total_ms")
+}
+
+func TestTrace_FastRequestsAreOnlyObserved(t *testing.T) {
+	upstream := newUpstream(t, "application/json", rawUpstreamBody)
+	ingestor := newTracedIngestor(t, upstream.URL)
+	logger, hook := test.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	ingestor.logger = logger
+
+	for i := 0; i < 2; i++ {
+		_, err := ingestor.fetchFrom(context.Background(), ingestor.sources[0])
+		require.NoError(t, err)
+	}
+	assert.Nil(t, ingestor.traces.lastSlow())
+	for _, entry := range hook.AllEntries() {
+		assert.NotEqual(t, "Slow upstream request", entry.Message)
+	}
+
+	assert.EqualValues(t, 1, phaseCount(t, ingestor, phaseConnect), "the second request reused the connection")
+	assert.EqualValues(t, 2, phaseCount(t, ingestor, phaseTTFB))
+	assert.EqualValues(t, 2, phaseCount(t, ingestor, phaseBody))
+}
+
+func TestTrace_SlowRequestInStats(t *testing.T) {
+	ingestor := newTracedIngestor(t, slowBodyUpstream(t, traceDelay).URL)
+	router := setupRoutes(ingestor)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	assert.Contains(t, w.Body.String(), `"slow_request":null`)
+
+	_, err := ingestor.fetchFrom(context.Background(), ingestor.sources[0])
+	require.NoError(t, err)
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	var stats struct {
+		SlowRequest *SlowRequest `json:"slow_request"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	require.NotNil(t, stats.SlowRequest)
+	assert.Equal(t, defaultSourceName, stats.SlowRequest.Location)
+	assert.Contains(t, stats.SlowRequest.Phases, phaseBody)
+}
+
+func TestTrace_ReplayedFixturesAreSkipped(t *testing.T) {
+	ingestor := newTracedIngestor(t, "http://127.0.0.1:1")
+	req := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:1/meters", nil)
+	_, trace := ingestor.traceRequest(req)
+	trace.readDone()
+	ingestor.finishTrace(ingestor.sources[0], trace)
+	assert.Zero(t, testutil.CollectAndCount(ingestor.metrics.UpstreamPhase))
+	assert.Nil(t, ingestor.traces.lastSlow())
+}
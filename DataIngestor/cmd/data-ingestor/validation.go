@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Validation actions
+const (
+	validationDrop = "drop"
+	validationKeep = "keep"
+)
+
+// Bound sets a violation can come from, from least to most specific
+const (
+	boundsGlobal   = "global"
+	boundsLocation = "location"
+	boundsSeason   = "season"
+)
+
+// defaultValidationTimestampField is the payload field seasons are matched against
+const defaultValidationTimestampField = "timestamp"
+
+// Bounds is the accepted range of a payload field. Either end may be left open.
+type Bounds struct {
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+}
+
+// Validate checks that the range is not empty
+func (b Bounds) Validate() error {
+	if b.Min == nil && b.Max == nil {
+		return fmt.Errorf("min or max is required")
+	}
+	if b.Min != nil && b.Max != nil && *b.Min > *b.Max {
+		return fmt.Errorf("min %v is greater than max %v", *b.Min, *b.Max)
+	}
+	return nil
+}
+
+// contains reports whether value is within the range, ends included
+func (b Bounds) contains(value float64) bool {
+	return (b.Min == nil || value >= *b.Min) && (b.Max == nil || value <= *b.Max)
+}
+
+// ValidationConfig configures range checks on reading payload fields. The
+// global bounds apply to every location; the metadata file can override them
+// per location and season.
+type ValidationConfig struct {
+	Bounds map[string]Bounds `yaml:"bounds"`
+	// Sentinels are the values the upstream sends for a missing field; they
+	// are set to null before the interceptors, transforms and bounds
+	Sentinels map[string]SentinelRule `yaml:"sentinels"`
+	// Action is drop (default) to discard readings out of range or keep to
+	// only log and count them
+	Action string `yaml:"action"`
+	// TimestampField is the payload field whose month selects the season;
+	// readings without one use the current month
+	TimestampField string `yaml:"timestamp_field"`
+}
+
+// Validate checks the action and every range
+func (c ValidationConfig) Validate() error {
+	switch c.Action {
+	case "", validationDrop, validationKeep:
+	default:
+		return fmt.Errorf("validation.action must be %q or %q, got %q", validationDrop, validationKeep, c.Action)
+	}
+	if err := validateBoundsMap(c.Bounds); err != nil {
+		return fmt.Errorf("validation.bounds.%w", err)
+	}
+	if err := validateSentinelMap(c.Sentinels, false); err != nil {
+		return fmt.Errorf("validation.sentinels.%w", err)
+	}
+	return nil
+}
+
+func (c ValidationConfig) action() string {
+	if c.Action == "" {
+		return validationDrop
+	}
+	return c.Action
+}
+
+func (c ValidationConfig) timestampField() string {
+	if c.TimestampField == "" {
+		return defaultValidationTimestampField
+	}
+	return c.TimestampField
+}
+
+// LocationValidation overrides the global bounds and sentinels for one
+// location in the metadata file. Fields without an override keep the global
+// ones; an empty sentinel rule lifts the global one.
+type LocationValidation struct {
+	Bounds    map[string]Bounds       `yaml:"bounds"`
+	Seasons   []SeasonBounds          `yaml:"seasons"`
+	Sentinels map[string]SentinelRule `yaml:"sentinels"`
+}
+
+// SeasonBounds applies in the listed months (1-12) and takes precedence over
+// the location's static bounds
+type SeasonBounds struct {
+	Months []int             `yaml:"months"`
+	Bounds map[string]Bounds `yaml:"bounds"`
+}
+
+// Validate checks every range, month and sentinel
+func (v *LocationValidation) Validate() error {
+	if err := validateBoundsMap(v.Bounds); err != nil {
+		return fmt.Errorf("bounds.%w", err)
+	}
+	if err := validateSentinelMap(v.Sentinels, true); err != nil {
+		return fmt.Errorf("sentinels.%w", err)
+	}
+	for i, season := range v.Seasons {
+		if len(season.Months) == 0 {
+			return fmt.Errorf("seasons[%d]: months is required", i)
+		}
+		for _, month := range season.Months {
+			if month < 1 || month > 12 {
+				return fmt.Errorf("seasons[%d]: month %d is not between 1 and 12", i, month)
+			}
+		}
+		if err := validateBoundsMap(season.Bounds); err != nil {
+			return fmt.Errorf("seasons[%d].bounds.%w", i, err)
+		}
+	}
+	return nil
+}
+
+// bounds returns the most specific range for field in month and the bound
+// set it came from
+func (v *LocationValidation) bounds(field string, month time.Month) (Bounds, string, bool) {
+	if v == nil {
+		return Bounds{}, "", false
+	}
+	for _, season := range v.Seasons {
+		if b, ok := season.Bounds[field]; ok && season.covers(month) {
+			return b, boundsSeason, true
+		}
+	}
+	if b, ok := v.Bounds[field]; ok {
+		return b, boundsLocation, true
+	}
+	return Bounds{}, "", false
+}
+
+func (s SeasonBounds) covers(month time.Month) bool {
+	for _, m := range s.Months {
+		if time.Month(m) == month {
+			return true
+		}
+	}
+	return false
+}
+
+// validateBoundsMap checks the ranges in field order so errors are stable
+func validateBoundsMap(bounds map[string]Bounds) error {
+	fields := make([]string, 0, len(bounds))
+	for field := range bounds {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		if err := bounds[field].Validate(); err != nil {
+			return fmt.Errorf("%s: %w", field, err)
+		}
+	}
+	return nil
+}
+
+// violation is a payload field out of the range that applied to it
+type violation struct {
+	Field  string
+	Value  float64
+	Range  Bounds
+	Source string
+}
+
+// checkReading returns the fields of the reading out of range. Location
+// bounds come from the metadata file; unknown locations use the global ones.
+func (di *DataIngestor) checkReading(reading SensorData, now time.Time) []violation {
+	var local *LocationValidation
+	if di.enricher != nil {
+		if meta, ok := di.enricher.Lookup(reading.Location()); ok {
+			local = meta.Validation
+		}
+	}
+	global := di.config.Validation.Bounds
+	if len(global) == 0 && local == nil {
+		return nil
+	}
+
+	month := now.UTC().Month()
+	if t, ok := readingTimestamp(reading, di.config.Validation.timestampField()); ok {
+		month = t.UTC().Month()
+	}
+
+	fields := make([]string, 0, len(reading.Payload))
+	for field := range reading.Payload {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+
+	var violations []violation
+	for _, field := range fields {
+		value, ok := toFloat(reading.Payload[field])
+		if !ok {
+			continue
+		}
+		b, source, ok := local.bounds(field, month)
+		if !ok {
+			if b, ok = global[field]; !ok {
+				continue
+			}
+			source = boundsGlobal
+		}
+		if !b.contains(value) {
+			violations = append(violations, violation{Field: field, Value: value, Range: b, Source: source})
+		}
+	}
+	return violations
+}
+
+// violationReason describes the violations of a reading for the record
+// outcome and the quarantine
+func violationReason(violations []violation) string {
+	reasons := make([]string, len(violations))
+	for i, v := range violations {
+		reasons[i] = fmt.Sprintf("%s %v is out of range", v.Field, v.Value)
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// validateReadings checks every reading against its bounds, logging and
+// counting each violation with the bound set that fired. With the drop
+// action readings with a violation are left out of the result, and kept in
+// the quarantine when it is enabled.
+func (di *DataIngestor) validateReadings(ctx context.Context, data WeatherData) WeatherData {
+	drop := di.config.Validation.action() == validationDrop
+	trace := cycleTraceOf(ctx)
+	now := time.Now()
+	out := make(WeatherData, 0, len(data))
+	var invalid []SensorData
+	var reasons []string
+	defer func() {
+		drops := validationDropsOf(ctx)
+		var held []QuarantinedReading
+		if drops == nil || !drops.fromQuarantine {
+			held = di.quarantineReadings(ctx, invalid, reasons)
+		}
+		drops.add(reasons, held)
+	}()
+	for _, reading := range data {
+		violations := di.checkReading(reading, now)
+		for _, v := range violations {
+			fields := logrus.Fields{
+				"location": reading.Location(),
+				"type":     reading.Type,
+				"field":    v.Field,
+				"value":    v.Value,
+				"bounds":   v.Source,
+			}
+			if v.Range.Min != nil {
+				fields["min"] = *v.Range.Min
+			}
+			if v.Range.Max != nil {
+				fields["max"] = *v.Range.Max
+			}
+			di.logger.WithFields(fields).Warn("Reading out of range")
+			di.metrics.ValidationFailures.WithLabelValues(v.Field, v.Source).Inc()
+			action := validationKeep
+			if drop {
+				action = validationDrop
+			}
+			trace.validated(TraceNote{
+				Reading: reading.Name,
+				Field:   v.Field,
+				Action:  action,
+				Detail:  fmt.Sprintf("%v is out of the %s bounds", v.Value, v.Source),
+			})
+		}
+		if drop && len(violations) > 0 {
+			invalid = append(invalid, reading)
+			reasons = append(reasons, violationReason(violations))
+			continue
+		}
+		out = append(out, reading)
+	}
+	return out
+}
+
+type validationDropsKey struct{}
+
+// validationDrops collects why validation dropped readings, for callers that
+// answer per reading
+type validationDrops struct {
+	reasons []string
+	// held are the quarantine entries of the dropped readings
+	held []QuarantinedReading
+	// fromQuarantine is set for reprocessed readings, which the quarantine
+	// still holds
+	fromQuarantine bool
+}
+
+// withValidationDrops has the readings validation drops with ctx recorded in
+// drops
+func withValidationDrops(ctx context.Context, drops *validationDrops) context.Context {
+	return context.WithValue(ctx, validationDropsKey{}, drops)
+}
+
+// validationDropsOf returns the drops of ctx, nil when nobody collects them
+func validationDropsOf(ctx context.Context) *validationDrops {
+	drops, _ := ctx.Value(validationDropsKey{}).(*validationDrops)
+	return drops
+}
+
+func (d *validationDrops) add(reasons []string, held []QuarantinedReading) {
+	if d != nil {
+		d.reasons = append(d.reasons, reasons...)
+		d.held = append(d.held, held...)
+	}
+}
+
+// validationEnabled reports whether any bounds can apply
+func (di *DataIngestor) validationEnabled() bool {
+	return len(di.config.Validation.Bounds) > 0 || di.enricher != nil
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testValidationMetadataYAML = `
+locations:
+  Moscow:
+    lat: 55.75
+    lon: 37.62
+    validation:
+      bounds:
+        temperature: {min: -45, max: 35}
+      seasons:
+        - months: [12, 1, 2]
+          bounds:
+            temperature: {min: -45, max: 8}
+  Berlin:
+    lat: 52.52
+    lon: 13.40
+`
+
+func bound(v float64) *float64 { return &v }
+
+// newValidatingIngestor returns an ingestor with global temperature and
+// humidity bounds and the Moscow overrides above
+func newValidatingIngestor(t *testing.T, action string) (*DataIngestor, *test.Hook) {
+	t.Helper()
+	ingestor, _ := newAdminTestIngestor(t)
+	logger, hook := test.NewNullLogger()
+	ingestor.logger = logger
+	ingestor.config.Validation = ValidationConfig{
+		Action: action,
+		Bounds: map[string]Bounds{
+			"temperature": {Min: bound(-60), Max: bound(50)},
+			"humidity":    {Min: bound(0), Max: bound(100)},
+		},
+	}
+	enricher, _, _ := newTestEnricher(t, "locations.yaml", testValidationMetadataYAML)
+	ingestor.enricher = enricher
+	return ingestor, hook
+}
+
+func reading(name string, temperature float64, timestamp string) SensorData {
+	return weatherReading(name, map[string]interface{}{
+		"temperature": temperature,
+		"humidity":    50.0,
+		"timestamp":   timestamp,
+	})
+}
+
+func TestValidateReadings_PrefersLocationBounds(t *testing.T) {
+	ingestor, hook := newValidatingIngestor(t, "")
+
+	july := "2024-07-15T12:00:00Z"
+	data := WeatherData{
+		reading("moscow", 40, july),    // within global, above Moscow's 35
+		reading("berlin", 40, july),    // Berlin has no overrides
+		reading("atlantis", 40, july),  // unknown location
+		reading("atlantis", 55, july),  // above global
+		reading("MSK-unknown", 30, ""), // unknown, within global
+	}
+	kept := ingestor.validateReadings(context.Background(), data)
+
+	var names []string
+	for _, r := range kept {
+		names = append(names, r.Name)
+	}
+	assert.Equal(t, []string{"berlin", "atlantis", "MSK-unknown"}, names)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ValidationFailures.WithLabelValues("temperature", boundsLocation)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ValidationFailures.WithLabelValues("temperature", boundsGlobal)))
+
+	entries := hook.AllEntries()
+	require.Len(t, entries, 2)
+	assert.Equal(t, "Reading out of range", entries[0].Message)
+	assert.Equal(t, "moscow", entries[0].Data["location"])
+	assert.Equal(t, boundsLocation, entries[0].Data["bounds"])
+	assert.Equal(t, 35.0, entries[0].Data["max"])
+	assert.Equal(t, boundsGlobal, entries[1].Data["bounds"])
+	assert.Equal(t, 50.0, entries[1].Data["max"])
+}
+
+func TestValidateReadings_Seasons(t *testing.T) {
+	ingestor, hook := newValidatingIngestor(t, "")
+
+	kept := ingestor.validateReadings(context.Background(), WeatherData{
+		reading("moscow", 10, "2024-01-15T12:00:00Z"), // above the winter max
+		reading("moscow", 10, "2024-07-15T12:00:00Z"),
+		reading("moscow", 10, "1721044800"), // July as Unix seconds
+	})
+	assert.Len(t, kept, 2)
+	require.Len(t, hook.AllEntries(), 1)
+	assert.Equal(t, boundsSeason, hook.LastEntry().Data["bounds"])
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.ValidationFailures.WithLabelValues("temperature", boundsSeason)))
+
+	// Fields a location does not override keep the global bounds
+	r := reading("moscow", 0, "2024-01-15T12:00:00Z")
+	r.Payload["humidity"] = 120.0
+	assert.Equal(t, []violation{{Field: "humidity", Value: 120, Range: Bounds{Min: bound(0), Max: bound(100)}, Source: boundsGlobal}},
+		ingestor.checkReading(r, time.Now()))
+}
+
+func TestValidateReadings_KeepAction(t *testing.T) {
+	ingestor, hook := newValidatingIngestor(t, validationKeep)
+
+	kept := ingestor.validateReadings(context.Background(), WeatherData{reading("moscow", 40, "2024-07-15T12:00:00Z")})
+	assert.Len(t, kept, 1, "out of range readings are only reported")
+	assert.Len(t, hook.AllEntries(), 1)
+}
+
+func TestValidateReadings_LocationBoundsWithoutGlobal(t *testing.T) {
+	ingestor, _ := newValidatingIngestor(t, "")
+	ingestor.config.Validation.Bounds = nil
+
+	kept := ingestor.validateReadings(context.Background(), WeatherData{
+		reading("moscow", 40, "2024-07-15T12:00:00Z"),
+		reading("berlin", 400, "2024-07-15T12:00:00Z"),
+	})
+	require.Len(t, kept, 1)
+	assert.Equal(t, "berlin", kept[0].Name, "no bounds apply to Berlin")
+}
+
+func TestIngest_DropsOutOfRangeReadings(t *testing.T) {
+	upstream := newUpstream(t, "application/json", `[
+		{"type":"weather","name":"moscow","payload":{"temperature":40}},
+		{"type":"weather","name":"berlin","payload":{"temperature":40}}
+	]`)
+	ingestor := NewDataIngestor(&Config{
+		API:      APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "error"},
+		Validation: ValidationConfig{Bounds: map[string]Bounds{
+			"temperature": {Min: bound(-60), Max: bound(50)},
+		}},
+	})
+	enricher, _, _ := newTestEnricher(t, "locations.yaml", testValidationMetadataYAML)
+	ingestor.enricher = enricher
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	messages := channel.messages()
+	require.Len(t, messages, 1)
+	var published WeatherData
+	require.NoError(t, json.Unmarshal(messages[0].Msg.Body, &published))
+	require.Len(t, published, 1)
+	assert.Equal(t, "berlin", published[0].Name)
+	assert.NotContains(t, string(messages[0].Msg.Body), "validation", "bounds are not published")
+}
+
+func TestValidationConfig_Validate(t *testing.T) {
+	assert.NoError(t, ValidationConfig{}.Validate())
+	assert.NoError(t, ValidationConfig{Action: validationKeep, Bounds: map[string]Bounds{"humidity": {Max: bound(100)}}}.Validate())
+
+	err := ValidationConfig{Action: "reject"}.Validate()
+	assert.EqualError(t, err, `validation.action must be "drop" or "keep", got "reject"`)
+	err = ValidationConfig{Bounds: map[string]Bounds{"temperature": {Min: bound(10), Max: bound(0)}}}.Validate()
+	assert.EqualError(t, err, "validation.bounds.temperature: min 10 is greater than max 0")
+	err = ValidationConfig{Bounds: map[string]Bounds{"temperature": {}}}.Validate()
+	assert.EqualError(t, err, "validation.bounds.temperature: min or max is required")
+
+	config := &Config{Publishing: PublishingConfig{Passthrough: true}, Validation: ValidationConfig{
+		Bounds: map[string]Bounds{"temperature": {Max: bound(50)}},
+	}}
+	assert.ErrorContains(t, config.Validate(), "passthrough cannot be combined with validation")
+}
+
+func TestEnricher_RejectsInvalidLocationBounds(t *testing.T) {
+	enricher, path, _ := newTestEnricher(t, "locations.yaml", testValidationMetadataYAML)
+
+	tests := map[string]string{
+		"month": `
+locations:
+  Moscow:
+    validation:
+      seasons:
+        - months: [13]
+          bounds: {temperature: {max: 8}}
+`,
+		"range": `
+locations:
+  Moscow:
+    validation:
+      bounds: {temperature: {min: 5, max: -5}}
+`,
+	}
+	want := map[string]string{
+		"month": `location "Moscow": validation.seasons[0]: month 13 is not between 1 and 12`,
+		"range": `location "Moscow": validation.bounds.temperature: min 5 is greater than max -5`,
+	}
+	for name, content := range tests {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+		_, err := enricher.Reload()
+		assert.EqualError(t, err, want[name], name)
+	}
+
+	// The previous bounds stay in effect
+	meta, ok := enricher.Lookup("moscow")
+	require.True(t, ok)
+	require.NotNil(t, meta.Validation)
+	assert.Equal(t, 35.0, *meta.Validation.Bounds["temperature"].Max)
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SignatureHeader carries the HMAC-SHA256 of the request body as
+	// "sha256=<hex>", keyed with the shared secret
+	SignatureHeader = "X-Signature-256"
+
+	defaultSubscriberTimeout    = 5 * time.Second
+	defaultSubscriberMaxRetries = 3
+	defaultSubscriberBackoff    = 200 * time.Millisecond
+	subscriberQueueSize         = 256
+)
+
+// SubscriberConfig is an HTTP endpoint that receives every published reading
+type SubscriberConfig struct {
+	// Name identifies the subscriber in /stats; defaults to the URL
+	Name   string `yaml:"name"`
+	URL    string `yaml:"url"`
+	Secret string `yaml:"secret"`
+	// Timeout bounds a single delivery attempt
+	Timeout Duration `yaml:"timeout"`
+	// Locations are globs matched against the reading location; empty means all
+	Locations []string `yaml:"locations"`
+	// MaxRetries is the number of retries after a failed attempt; 0 uses the default of 3
+	MaxRetries     int                  `yaml:"max_retries"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker"`
+}
+
+// validateSubscribers checks URLs and that names are unique
+func validateSubscribers(subscribers []SubscriberConfig) error {
+	seen := make(map[string]bool)
+	for i, config := range subscribers {
+		u, err := url.Parse(config.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("subscribers[%d]: url must be an absolute http(s) URL, got %q", i, config.URL)
+		}
+		for _, pattern := range config.Locations {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("subscribers[%d]: invalid glob %q: %w", i, pattern, err)
+			}
+		}
+		if config.MaxRetries < 0 {
+			return fmt.Errorf("subscribers[%d]: max_retries must not be negative", i)
+		}
+		name := subscriberName(config)
+		if seen[name] {
+			return fmt.Errorf("subscribers[%d]: duplicate subscriber %q", i, name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+func subscriberName(config SubscriberConfig) string {
+	if config.Name != "" {
+		return config.Name
+	}
+	return config.URL
+}
+
+// signPayload returns the SignatureHeader value for body
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notifier pushes published readings to HTTP subscribers. Every subscriber
+// has its own bounded queue, worker and breaker, so a slow or dead
+// subscriber only loses its own deliveries.
+type Notifier struct {
+	logger      *logrus.Logger
+	subscribers []*subscriber
+	// naming renames the fields of delivered readings like published ones
+	naming *fieldNamer
+	// shedding drops every notification while the memory guard sheds queues
+	shedding atomic.Bool
+}
+
+// subscriber is the delivery state of one SubscriberConfig
+type subscriber struct {
+	name    string
+	config  SubscriberConfig
+	client  *http.Client
+	queue   chan []byte
+	backoff time.Duration
+
+	mu           sync.Mutex
+	breaker      circuitBreaker
+	delivered    int64
+	failed       int64
+	dropped      int64
+	retries      int64
+	lastError    string
+	lastDelivery time.Time
+}
+
+// NewNotifier returns a Notifier, or nil when no subscribers are configured
+func NewNotifier(configs []SubscriberConfig, logger *logrus.Logger) *Notifier {
+	if len(configs) == 0 {
+		return nil
+	}
+
+	n := &Notifier{logger: logger}
+	for _, config := range configs {
+		if config.Timeout <= 0 {
+			config.Timeout = Duration(defaultSubscriberTimeout)
+		}
+		if config.MaxRetries == 0 {
+			config.MaxRetries = defaultSubscriberMaxRetries
+		}
+		n.subscribers = append(n.subscribers, &subscriber{
+			name:    subscriberName(config),
+			config:  config,
+			client:  &http.Client{Timeout: time.Duration(config.Timeout)},
+			queue:   make(chan []byte, subscriberQueueSize),
+			backoff: defaultSubscriberBackoff,
+			breaker: newCircuitBreaker(config.CircuitBreaker),
+		})
+	}
+	return n
+}
+
+// Run delivers queued readings until ctx is cancelled
+func (n *Notifier) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, sub := range n.subscribers {
+		wg.Add(1)
+		go func(sub *subscriber) {
+			defer wg.Done()
+			n.work(ctx, sub)
+		}(sub)
+	}
+	wg.Wait()
+}
+
+// Notify queues every reading for the subscribers whose location filter
+// matches. It never blocks: readings for a full queue or an open breaker are
+// dropped. It reports the readings every matching subscriber queued.
+func (n *Notifier) Notify(data WeatherData) []bool {
+	queued := make([]bool, len(data))
+	for i, reading := range data {
+		var body []byte
+		queued[i] = true
+		for _, sub := range n.subscribers {
+			if !sub.wants(reading.Location()) {
+				continue
+			}
+			if n.shedding.Load() {
+				sub.drop()
+				queued[i] = false
+				continue
+			}
+			if body == nil {
+				var err error
+				if body, err = n.naming.marshal(reading); err != nil {
+					n.logger.WithError(err).Error("Failed to marshal reading for subscribers")
+					queued[i] = false
+					return queued
+				}
+			}
+			if !sub.enqueue(body) {
+				queued[i] = false
+			}
+		}
+	}
+	return queued
+}
+
+func (s *subscriber) wants(location string) bool {
+	if len(s.config.Locations) == 0 {
+		return true
+	}
+	for _, pattern := range s.config.Locations {
+		if globMatch(pattern, location) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *subscriber) enqueue(body []byte) bool {
+	s.mu.Lock()
+	open := s.breaker.state == breakerOpen && time.Now().Before(s.breaker.reopensAt())
+	s.mu.Unlock()
+
+	if !open {
+		select {
+		case s.queue <- body:
+			return true
+		default:
+		}
+	}
+	s.drop()
+	return false
+}
+
+func (s *subscriber) drop() {
+	s.mu.Lock()
+	s.dropped++
+	s.mu.Unlock()
+}
+
+// work drains one subscriber's queue
+func (n *Notifier) work(ctx context.Context, sub *subscriber) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case body := <-sub.queue:
+			sub.mu.Lock()
+			err := sub.breaker.allow(time.Now())
+			if err != nil {
+				sub.dropped++
+			}
+			sub.mu.Unlock()
+			if err != nil {
+				continue
+			}
+
+			err = sub.deliver(ctx, body)
+			sub.mu.Lock()
+			from, to := sub.breaker.record(time.Now(), err == nil)
+			if err == nil {
+				sub.delivered++
+				sub.lastDelivery = time.Now()
+			} else {
+				sub.failed++
+				sub.lastError = err.Error()
+			}
+			sub.mu.Unlock()
+
+			if err != nil {
+				n.logger.WithField("subscriber", sub.name).WithError(err).Warn("Failed to deliver reading to subscriber")
+			}
+			if from != to {
+				n.logger.WithFields(logrus.Fields{
+					"subscriber": sub.name,
+					"from":       from.String(),
+					"to":         to.String(),
+				}).Warn("Subscriber circuit breaker state changed")
+			}
+		}
+	}
+}
+
+// deliver POSTs body, retrying up to MaxRetries times with exponential backoff
+func (s *subscriber) deliver(ctx context.Context, body []byte) error {
+	for attempt := 0; ; attempt++ {
+		err := s.post(ctx, body)
+		if err == nil || attempt >= s.config.MaxRetries {
+			return err
+		}
+
+		s.mu.Lock()
+		s.retries++
+		s.mu.Unlock()
+		if err := sleepContext(ctx, s.backoff<<attempt); err != nil {
+			return err
+		}
+	}
+}
+
+func (s *subscriber) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.Secret != "" {
+		req.Header.Set(SignatureHeader, signPayload(s.config.Secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make request: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("subscriber returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SubscriberStats is the delivery summary of one subscriber in GET /stats
+type SubscriberStats struct {
+	URL          string     `json:"url"`
+	Breaker      string     `json:"breaker"`
+	Queued       int        `json:"queued"`
+	Delivered    int64      `json:"delivered"`
+	Failed       int64      `json:"failed"`
+	Dropped      int64      `json:"dropped"`
+	Retries      int64      `json:"retries"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+}
+
+// Stats returns the delivery summary of every subscriber by name
+func (n *Notifier) Stats() map[string]SubscriberStats {
+	stats := make(map[string]SubscriberStats, len(n.subscribers))
+	for _, sub := range n.subscribers {
+		sub.mu.Lock()
+		entry := SubscriberStats{
+			URL:       sub.config.URL,
+			Breaker:   sub.breaker.state.String(),
+			Queued:    len(sub.queue),
+			Delivered: sub.delivered,
+			Failed:    sub.failed,
+			Dropped:   sub.dropped,
+			Retries:   sub.retries,
+			LastError: sub.lastError,
+		}
+		if !sub.lastDelivery.IsZero() {
+			lastDelivery := sub.lastDelivery
+			entry.LastDelivery = &lastDelivery
+		}
+		sub.mu.Unlock()
+		stats[sub.name] = entry
+	}
+	return stats
+}
+
+// handleStats reports delivery and manual ingestion statistics
+func (di *DataIngestor) handleStats(c *gin.Context) {
+	trigger, err := triggerFilter(c.Query("trigger"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	subscribers := map[string]SubscriberStats{}
+	if di.notifier != nil {
+		subscribers = di.notifier.Stats()
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"subscribers":  subscribers,
+		"rabbitmq":     di.brokerStatus(),
+		"ingest":       di.ingestLimit.Stats(),
+		"totals":       di.metrics.totals(),
+		"triggers":     di.metrics.triggerStats(trigger),
+		"timeouts":     di.timeoutStats(),
+		"memory":       di.memory.Status(),
+		"resources":    di.resources.Status(),
+		"dependencies": di.health.Results(),
+		"slow_request": di.traces.lastSlow(),
+	})
+}
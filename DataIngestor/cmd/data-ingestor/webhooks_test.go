@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingSubscriber captures POSTed bodies and their signature headers
+type recordingSubscriber struct {
+	mu         sync.Mutex
+	bodies     [][]byte
+	signatures []string
+}
+
+func (r *recordingSubscriber) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	r.bodies = append(r.bodies, body)
+	r.signatures = append(r.signatures, req.Header.Get(SignatureHeader))
+	r.mu.Unlock()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (r *recordingSubscriber) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.bodies)
+}
+
+func newNotifierIngestor(t *testing.T, subscribers []SubscriberConfig, upstreamBody string) *DataIngestor {
+	t.Helper()
+
+	upstream := newUpstream(t, "application/json", upstreamBody)
+	ingestor := NewDataIngestor(&Config{
+		API:         APIConfig{BaseURL: upstream.URL, Timeout: Duration(time.Second)},
+		RabbitMQ:    RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:     LoggingConfig{Level: "error"},
+		Subscribers: subscribers,
+	})
+	attachChannel(ingestor, &fakeChannel{}, nil)
+	for _, sub := range ingestor.notifier.subscribers {
+		sub.backoff = time.Millisecond
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go ingestor.notifier.Run(ctx)
+	return ingestor
+}
+
+func TestNotifier_DeliversSignedReadings(t *testing.T) {
+	all := &recordingSubscriber{}
+	berlinOnly := &recordingSubscriber{}
+	allServer := httptest.NewServer(all)
+	defer allServer.Close()
+	berlinServer := httptest.NewServer(berlinOnly)
+	defer berlinServer.Close()
+
+	ingestor := newNotifierIngestor(t, []SubscriberConfig{
+		{Name: "all", URL: allServer.URL, Secret: "s3cret"},
+		{Name: "berlin", URL: berlinServer.URL, Locations: []string{"berlin-*"}},
+	}, `[{"type":"energy","name":"berlin-1","payload":{"energy":1}},{"type":"energy","name":"moscow-1","payload":{"energy":2}}]`)
+
+	_, err := ingestor.ingest(context.Background())
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool { return all.count() == 2 && berlinOnly.count() == 1 }, time.Second, 5*time.Millisecond)
+
+	var reading SensorData
+	require.NoError(t, json.Unmarshal(berlinOnly.bodies[0], &reading))
+	assert.Equal(t, "berlin-1", reading.Name)
+	assert.Empty(t, berlinOnly.signatures[0])
+
+	for i, body := range all.bodies {
+		assert.Equal(t, signPayload("s3cret", body), all.signatures[i])
+	}
+
+	stats := ingestor.notifier.Stats()
+	assert.Equal(t, int64(2), stats["all"].Delivered)
+	assert.Equal(t, int64(1), stats["berlin"].Delivered)
+}
+
+func TestNotifier_DeadSubscriberOpensBreaker(t *testing.T) {
+	var hits int32
+	dead := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer dead.Close()
+	healthy := &recordingSubscriber{}
+	healthyServer := httptest.NewServer(healthy)
+	defer healthyServer.Close()
+
+	ingestor := newNotifierIngestor(t, []SubscriberConfig{
+		{Name: "dead", URL: dead.URL, MaxRetries: 1, CircuitBreaker: CircuitBreakerConfig{FailureThreshold: 2, OpenTimeout: Duration(time.Minute)}},
+		{Name: "healthy", URL: healthyServer.URL},
+	}, `[{"type":"energy","name":"meter-1","payload":{"energy":1}}]`)
+
+	for i := 0; i < 5; i++ {
+		_, err := ingestor.ingest(context.Background())
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		stats := ingestor.notifier.Stats()["dead"]
+		return healthy.count() == 5 && stats.Failed+stats.Dropped == 5
+	}, 2*time.Second, 5*time.Millisecond)
+
+	stats := ingestor.notifier.Stats()["dead"]
+	assert.Equal(t, "open", stats.Breaker)
+	assert.Equal(t, int64(2), stats.Failed)
+	assert.Equal(t, int64(2), stats.Retries)
+	assert.Contains(t, stats.LastError, "500")
+	// Two deliveries, each tried twice; nothing reached it once the breaker opened
+	assert.Equal(t, int32(4), atomic.LoadInt32(&hits))
+}
+
+func TestNotifier_FullQueueDrops(t *testing.T) {
+	notifier := NewNotifier([]SubscriberConfig{{Name: "slow", URL: "http://127.0.0.1:1"}}, nil)
+	data := make(WeatherData, subscriberQueueSize+10)
+	for i := range data {
+		data[i] = SensorData{Type: "energy", Name: "meter-1"}
+	}
+
+	// No worker is running, so Notify must not block once the queue is full
+	notifier.Notify(data)
+	stats := notifier.Stats()["slow"]
+	assert.Equal(t, subscriberQueueSize, stats.Queued)
+	assert.Equal(t, int64(10), stats.Dropped)
+}
+
+func TestHandleStats(t *testing.T) {
+	subscriber := httptest.NewServer(&recordingSubscriber{})
+	defer subscriber.Close()
+	ingestor := newNotifierIngestor(t, []SubscriberConfig{{URL: subscriber.URL}}, `[]`)
+
+	w := httptest.NewRecorder()
+	setupRoutes(ingestor).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	var body struct {
+		Subscribers map[string]SubscriberStats `json:"subscribers"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	require.Contains(t, body.Subscribers, subscriber.URL)
+	assert.Equal(t, "closed", body.Subscribers[subscriber.URL].Breaker)
+}
+
+func TestValidateSubscribers(t *testing.T) {
+	assert.NoError(t, validateSubscribers([]SubscriberConfig{{URL: "https://tools.internal/hook"}}))
+	assert.Error(t, validateSubscribers([]SubscriberConfig{{URL: "tools.internal/hook"}}))
+	assert.Error(t, validateSubscribers([]SubscriberConfig{{URL: "http://a/hook", Locations: []string{"["}}}))
+	assert.Error(t, validateSubscribers([]SubscriberConfig{
+		{Name: "a", URL: "http://a/hook"},
+		{Name: "a", URL: "http://b/hook"},
+	}))
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	defaultWebSocketPingInterval = 15 * time.Second
+	defaultWebSocketBackoff      = time.Second
+	defaultWebSocketMaxBackoff   = time.Minute
+	// webSocketHandshakeTimeout bounds connecting and the opening handshake
+	webSocketHandshakeTimeout = 10 * time.Second
+)
+
+// Outcomes of a pushed frame
+const (
+	frameOK             = "ok"
+	frameMalformed      = "malformed"
+	frameUnknownStation = "unknown_station"
+)
+
+// webSocketGapHeader carries when the WebSocket upstream disconnected on
+// GET /weather/latest while it is down
+const webSocketGapHeader = "X-Upstream-Gap-Since"
+
+// WebSocketConfig receives the readings an upstream pushes over a
+// WebSocket, one JSON reading or array of readings per frame
+type WebSocketConfig struct {
+	// URL is the ws:// or wss:// feed; without it every location is polled
+	URL string `yaml:"url"`
+	// PingInterval is how often a ping is sent, 15s by default
+	PingInterval Duration `yaml:"ping_interval"`
+	// Timeout drops a connection nothing arrived on, not even a pong, for
+	// this long; three ping intervals by default
+	Timeout Duration `yaml:"timeout"`
+	// Backoff is the first wait before reconnecting, 1s by default. It
+	// doubles with every failed attempt up to MaxBackoff, 1m by default.
+	Backoff    Duration `yaml:"backoff"`
+	MaxBackoff Duration `yaml:"max_backoff"`
+	// PollFallback polls the locations while the socket is down; without it
+	// they are not polled at all
+	PollFallback bool `yaml:"poll_fallback"`
+}
+
+func (c WebSocketConfig) enabled() bool {
+	return c.URL != ""
+}
+
+func (c WebSocketConfig) Validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+		return fmt.Errorf("api.websocket.url must be a ws:// or wss:// URL, got %q", c.URL)
+	}
+	if c.PingInterval < 0 || c.Timeout < 0 || c.Backoff < 0 || c.MaxBackoff < 0 {
+		return fmt.Errorf("api.websocket: ping_interval, timeout, backoff and max_backoff must not be negative")
+	}
+	if c.Timeout > 0 && time.Duration(c.Timeout) <= c.pingInterval() {
+		return fmt.Errorf("api.websocket.timeout must be longer than the ping_interval")
+	}
+	return nil
+}
+
+func (c WebSocketConfig) pingInterval() time.Duration {
+	if c.PingInterval > 0 {
+		return time.Duration(c.PingInterval)
+	}
+	return defaultWebSocketPingInterval
+}
+
+func (c WebSocketConfig) timeout() time.Duration {
+	if c.Timeout > 0 {
+		return time.Duration(c.Timeout)
+	}
+	return 3 * c.pingInterval()
+}
+
+func (c WebSocketConfig) backoff() time.Duration {
+	if c.Backoff > 0 {
+		return time.Duration(c.Backoff)
+	}
+	return defaultWebSocketBackoff
+}
+
+func (c WebSocketConfig) maxBackoff() time.Duration {
+	if c.MaxBackoff > 0 {
+		return time.Duration(c.MaxBackoff)
+	}
+	return defaultWebSocketMaxBackoff
+}
+
+// pushSource receives the readings the upstream pushes over a WebSocket and
+// tracks the gaps while it is disconnected
+type pushSource struct {
+	di     *DataIngestor
+	config WebSocketConfig
+	// proxy picks the proxy of the connection, the one from HTTPS_PROXY or
+	// HTTP_PROXY like for every upstream request
+	proxy func(*http.Request) (*url.URL, error)
+
+	connected atomic.Bool
+	mu        sync.Mutex
+	// downSince is when the socket was last lost, or when the service
+	// started before it first connected
+	downSince  time.Time
+	reconnects int
+}
+
+func newPushSource(di *DataIngestor, config WebSocketConfig) *pushSource {
+	if !config.enabled() {
+		return nil
+	}
+	return &pushSource{di: di, config: config, proxy: http.ProxyFromEnvironment, downSince: time.Now()}
+}
+
+// up reports whether the socket is connected, so polling can stand by
+func (p *pushSource) up() bool {
+	return p != nil && p.connected.Load()
+}
+
+// gap returns since when the socket is down
+func (p *pushSource) gap() (time.Time, bool) {
+	if p == nil || p.connected.Load() {
+		return time.Time{}, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.downSince, true
+}
+
+func (p *pushSource) setConnected(connected bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !connected && p.connected.Load() {
+		p.downSince = time.Now()
+		p.reconnects++
+	}
+	p.connected.Store(connected)
+	value := 0.0
+	if connected {
+		value = 1
+	}
+	p.di.metrics.WebSocketConnected.Set(value)
+}
+
+// WebSocketStatus is the websocket entry of GET /ingestion/status
+type WebSocketStatus struct {
+	Connected bool       `json:"connected"`
+	GapSince  *time.Time `json:"gap_since,omitempty"`
+	// Reconnects counts the connections lost since the service started
+	Reconnects   int  `json:"reconnects"`
+	PollFallback bool `json:"poll_fallback"`
+}
+
+func (p *pushSource) status() *WebSocketStatus {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := &WebSocketStatus{
+		Connected:    p.connected.Load(),
+		Reconnects:   p.reconnects,
+		PollFallback: p.config.PollFallback,
+	}
+	if !status.Connected {
+		since := p.downSince
+		status.GapSince = &since
+	}
+	return status
+}
+
+// Name is the key of the WebSocket source in logs
+func (p *pushSource) Name() string { return sourceWebSocket }
+
+// Up reports whether the socket is connected
+func (p *pushSource) Up() bool {
+	return p.up()
+}
+
+// Run connects and reconnects until ctx is cancelled
+func (p *pushSource) Run(ctx context.Context) {
+	logger := p.di.log(logFetch)
+	wait := p.config.backoff()
+	for {
+		received, err := p.session(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			wait = p.config.backoff()
+		}
+		p.di.metrics.WebSocketReconnects.Inc()
+		logger.WithError(err).WithField("retry_in", wait.String()).Warn("WebSocket upstream disconnected")
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+		if wait *= 2; wait > p.config.maxBackoff() {
+			wait = p.config.maxBackoff()
+		}
+	}
+}
+
+// session runs one connection until it drops. received reports whether
+// any frame arrived, which resets the backoff.
+func (p *pushSource) session(ctx context.Context) (received bool, err error) {
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	p.setConnected(true)
+	defer p.setConnected(false)
+	p.di.log(logFetch).WithField("url", p.config.URL).Info("WebSocket upstream connected")
+
+	// Every frame and every pong moves the read deadline, so a connection
+	// nothing arrives on for the timeout fails its read
+	timeout := p.config.timeout()
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(timeout))
+	})
+	done := make(chan struct{})
+	defer close(done)
+	go p.keepalive(conn, done)
+
+	for {
+		frame, err := p.read(conn)
+		if errors.Is(err, errFrameTooLarge) {
+			p.di.metrics.WebSocketFrames.WithLabelValues(frameMalformed).Inc()
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return received, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				p.di.log(logFetch).WithField("timeout", timeout.String()).Warn("WebSocket upstream went quiet, reconnecting")
+			}
+			return received, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		received = true
+		p.handle(ctx, frame)
+	}
+}
+
+// errFrameTooLarge is returned for a frame bigger than api.max_body_bytes
+var errFrameTooLarge = errors.New("frame exceeds api.max_body_bytes")
+
+// read returns the next data frame. A frame over api.max_body_bytes, 10MiB
+// by default, is not buffered; its rest is skipped by the next read.
+func (p *pushSource) read(conn *websocket.Conn) ([]byte, error) {
+	_, r, err := conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	limit := int64(p.di.config.API.MaxBodyBytes)
+	if limit <= 0 {
+		limit = defaultMaxBodyBytes
+	}
+	frame, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(frame)) > limit {
+		return nil, errFrameTooLarge
+	}
+	return frame, nil
+}
+
+// keepalive sends a ping control frame every ping interval until done is
+// closed. The upstream's pongs are read by the session.
+func (p *pushSource) keepalive(conn *websocket.Conn, done <-chan struct{}) {
+	ticker := time.NewTicker(p.config.pingInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(p.config.pingInterval())); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// dial connects with the headers of every upstream request: the API key,
+// the instance identification, the request decorators and, with OAuth2,
+// the bearer token. It goes through the proxy the upstream requests use.
+func (p *pushSource) dial(ctx context.Context) (*websocket.Conn, error) {
+	location, _ := url.Parse(p.config.URL)
+	target := *location
+	target.Scheme = "http"
+	if location.Scheme == "wss" {
+		target.Scheme = "https"
+	}
+	// The decorators see the request as an HTTP one
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.di.apiKey()
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Api-Key", key)
+	p.di.tagRequest(req)
+	req = p.di.decorateRequest(req)
+	if p.di.auth != nil {
+		token, err := p.di.auth.currentToken(ctx, "")
+		if err != nil {
+			return nil, err
+		}
+		token.SetAuthHeader(req)
+	}
+
+	dialer := websocket.Dialer{Proxy: p.proxy, HandshakeTimeout: webSocketHandshakeTimeout}
+	conn, resp, err := dialer.DialContext(ctx, p.config.URL, req.Header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("WebSocket handshake failed: %s", resp.Status)
+		}
+		return nil, fmt.Errorf("failed to connect to the WebSocket upstream: %w", err)
+	}
+	return conn, nil
+}
+
+// handle publishes the readings of one frame, each with the location its
+// station_id names. A feed of a single location may leave station_id out.
+func (p *pushSource) handle(ctx context.Context, frame []byte) {
+	di := p.di
+	entries, err := decodeFrame(frame)
+	if err != nil {
+		di.metrics.WebSocketFrames.WithLabelValues(frameMalformed).Inc()
+		di.log(logFetch).WithError(err).Debug("Skipping malformed WebSocket frame")
+		return
+	}
+	sources := di.currentSources()
+	byStation := make(map[string]*source, len(sources))
+	for _, src := range sources {
+		byStation[src.stationID] = src
+	}
+	readings := make(map[*source]WeatherData)
+	var order []*source
+	for _, entry := range entries {
+		src, ok := byStation[entry.StationID]
+		if !ok && entry.StationID == "" && len(sources) == 1 {
+			src, ok = sources[0], true
+		}
+		if !ok {
+			// Not a location of this instance, or unknown to the config
+			di.metrics.WebSocketFrames.WithLabelValues(frameUnknownStation).Inc()
+			continue
+		}
+		if _, seen := readings[src]; !seen {
+			order = append(order, src)
+		}
+		readings[src] = append(readings[src], entry.SensorData)
+	}
+	if len(order) == 0 {
+		return
+	}
+	di.metrics.WebSocketFrames.WithLabelValues(frameOK).Inc()
+	ctx = withTrigger(ctx, triggerPush)
+	for _, src := range order {
+		data := readings[src]
+		// Handed to the location as a bulk fetch is, so it skips the fetch
+		fetches := map[string]*bulkFetch{src.name: {fetched: &fetchResult{Data: &data, Body: frame}}}
+		result, err := di.ingestSource(withBulkFetches(ctx, fetches), src)
+		logger := di.log(logIngestion).WithFields(logrus.Fields{"location": src.name, "trigger": triggerPush})
+		if err != nil {
+			logger.WithError(err).Error("Failed to publish pushed readings")
+			continue
+		}
+		logger.WithField("count", len(*result.Data)).Debug("Pushed readings published")
+	}
+}
+
+// decodeFrame decodes a frame holding a reading or an array of readings.
+// Array elements that are no reading are left out; a frame without any
+// reading is malformed.
+func decodeFrame(frame []byte) ([]bulkEntry, error) {
+	frame = bytes.TrimSpace(frame)
+	if len(frame) > 0 && frame[0] != '[' {
+		var entry bulkEntry
+		if err := json.Unmarshal(frame, &entry); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal frame: %w", err)
+		}
+		return []bulkEntry{entry}, nil
+	}
+	var elements []json.RawMessage
+	if err := json.Unmarshal(frame, &elements); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal frame: %w", err)
+	}
+	entries := make([]bulkEntry, 0, len(elements))
+	for _, element := range elements {
+		var entry bulkEntry
+		if err := json.Unmarshal(element, &entry); err == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if len(entries) == 0 && len(elements) > 0 {
+		return nil, errors.New("frame holds no reading")
+	}
+	return entries, nil
+}
+
+// markGap adds when the WebSocket upstream disconnected to a response
+func (di *DataIngestor) markGap(c *gin.Context) {
+	if since, ok := di.push.gap(); ok {
+		c.Header(webSocketGapHeader, since.UTC().Format(time.RFC3339))
+	}
+}
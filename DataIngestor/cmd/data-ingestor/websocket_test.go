@@ -0,0 +1,429 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pushUpstream is an in-process WebSocket feed. Every connection is handed
+// to the test through conns; it stays open until the test closes it or the
+// client goes away. Every ping the client sends is signalled on pings.
+type pushUpstream struct {
+	server *httptest.Server
+	conns  chan *websocket.Conn
+	pings  chan struct{}
+	// down refuses new connections, like a provider in an outage
+	down atomic.Bool
+	// deaf stops reading new connections, so their pings go unanswered
+	deaf atomic.Bool
+
+	mu      sync.Mutex
+	headers []http.Header
+}
+
+func newPushUpstream(t *testing.T) *pushUpstream {
+	t.Helper()
+	u := &pushUpstream{conns: make(chan *websocket.Conn, 4), pings: make(chan struct{}, 64)}
+	var upgrader websocket.Upgrader
+	u.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u.down.Load() {
+			http.Error(w, "maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		u.mu.Lock()
+		u.headers = append(u.headers, r.Header.Clone())
+		u.mu.Unlock()
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		ws.SetPingHandler(func(data string) error {
+			select {
+			case u.pings <- struct{}{}:
+			default:
+			}
+			return ws.WriteControl(websocket.PongMessage, []byte(data), time.Now().Add(time.Second))
+		})
+		deaf := u.deaf.Load()
+		u.conns <- ws
+		if deaf {
+			return
+		}
+		// Reading answers the client's pings
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(u.server.Close)
+	return u
+}
+
+func (u *pushUpstream) url() string {
+	return "ws" + strings.TrimPrefix(u.server.URL, "http") + "/stream"
+}
+
+func (u *pushUpstream) accept(t *testing.T) *websocket.Conn {
+	t.Helper()
+	select {
+	case ws := <-u.conns:
+		return ws
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ingestor did not connect")
+		return nil
+	}
+}
+
+// awaitPings waits for n pings of the client, which it sends every ping
+// interval
+func (u *pushUpstream) awaitPings(t *testing.T, n int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		select {
+		case <-u.pings:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d of %d pings", i, n)
+		}
+	}
+}
+
+func push(t *testing.T, ws *websocket.Conn, frame string) {
+	t.Helper()
+	require.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte(frame)))
+}
+
+// connectProxy tunnels CONNECT requests to their target and sends every
+// target on tunnels
+func connectProxy(t *testing.T) (*httptest.Server, chan string) {
+	t.Helper()
+	tunnels := make(chan string, 4)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		client, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			target.Close()
+			return
+		}
+		tunnels <- r.Host
+		client.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(target, client)
+			target.Close()
+		}()
+		io.Copy(client, target)
+		client.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy, tunnels
+}
+
+const pushAPIKey = "push-test-key"
+
+func newPushIngestor(t *testing.T, api APIConfig) (*DataIngestor, *fakeChannel) {
+	t.Helper()
+	api.Timeout = Duration(time.Second)
+	api.Auth.APIKeyFile = filepath.Join(t.TempDir(), "api-key")
+	writeSecret(t, api.Auth.APIKeyFile, pushAPIKey)
+	ingestor := NewDataIngestor(&Config{
+		API:      api,
+		RabbitMQ: RabbitMQConfig{QueueName: "meter-data-queue"},
+		Logging:  LoggingConfig{Level: "panic"},
+	})
+	channel := &fakeChannel{}
+	attachChannel(ingestor, channel, nil)
+	return ingestor, channel
+}
+
+func runPush(t *testing.T, ingestor *DataIngestor) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ingestor.StartIngestion(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func publishedLocations(t *testing.T, channel *fakeChannel) []string {
+	t.Helper()
+	var names []string
+	for _, msg := range channel.messages() {
+		var data WeatherData
+		require.NoError(t, json.Unmarshal(msg.Msg.Body, &data))
+		for _, reading := range data {
+			names = append(names, reading.Name)
+		}
+	}
+	return names
+}
+
+func TestWebSocketConfig_Validate(t *testing.T) {
+	assert.NoError(t, WebSocketConfig{}.Validate())
+	assert.NoError(t, WebSocketConfig{URL: "wss://feed.example.com/stream", PingInterval: Duration(time.Second), Timeout: Duration(5 * time.Second)}.Validate())
+	assert.ErrorContains(t, WebSocketConfig{URL: "https://feed.example.com/stream"}.Validate(), "ws:// or wss://")
+	assert.ErrorContains(t, WebSocketConfig{URL: "ws://feed", Backoff: -1}.Validate(), "must not be negative")
+	assert.ErrorContains(t, WebSocketConfig{URL: "ws://feed", Timeout: Duration(time.Second)}.Validate(), "longer than the ping_interval")
+
+	config := Config{
+		API:        APIConfig{BaseURL: "http://localhost", WebSocket: WebSocketConfig{URL: "ws://localhost/stream"}},
+		RabbitMQ:   RabbitMQConfig{URL: "amqp://localhost", QueueName: "meter-data-queue"},
+		Publishing: PublishingConfig{Passthrough: true},
+	}
+	assert.ErrorContains(t, config.Validate(), "api.websocket")
+}
+
+func TestDecodeFrame(t *testing.T) {
+	entries, err := decodeFrame([]byte(`{"station_id":"b1","type":"weather","name":"berlin-1","payload":{"temperature":4}}`))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "b1", entries[0].StationID)
+
+	entries, err = decodeFrame([]byte(` [{"type":"weather","name":"a"}, 42, {"type":"weather","name":"b"}] `))
+	require.NoError(t, err)
+	assert.Len(t, entries, 2, "elements that are no reading are left out")
+
+	_, err = decodeFrame([]byte(`[42]`))
+	assert.Error(t, err)
+	_, err = decodeFrame([]byte(`<html>`))
+	assert.Error(t, err)
+}
+
+func TestWebSocket_PublishesPushedReadings(t *testing.T) {
+	upstream := newPushUpstream(t)
+	ingestor, channel := newPushIngestor(t, APIConfig{
+		Locations: []LocationSource{
+			{Name: "berlin", BaseURL: "http://127.0.0.1:1", StationID: "b1"},
+			{Name: "moscow", BaseURL: "http://127.0.0.1:1", StationID: "m1"},
+		},
+		WebSocket: WebSocketConfig{URL: upstream.url()},
+	})
+	runPush(t, ingestor)
+	ws := upstream.accept(t)
+
+	push(t, ws, `{"station_id":"b1","type":"weather","name":"berlin-1","payload":{"temperature":4}}`)
+	push(t, ws, `not json`)
+	push(t, ws, `{"station_id":"x9","type":"weather","name":"paris-1","payload":{"temperature":9}}`)
+	push(t, ws, `[{"station_id":"m1","type":"weather","name":"moscow-1","payload":{"temperature":-5}},{"station_id":"b1","type":"weather","name":"berlin-2","payload":{"temperature":5}}]`)
+
+	require.Eventually(t, func() bool { return len(channel.messages()) == 3 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"berlin-1", "moscow-1", "berlin-2"}, publishedLocations(t, channel))
+	for _, msg := range channel.messages() {
+		assert.Equal(t, triggerPush, msg.Msg.Headers["trigger"])
+	}
+	assert.Equal(t, 2.0, testutil.ToFloat64(ingestor.metrics.WebSocketFrames.WithLabelValues(frameOK)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.WebSocketFrames.WithLabelValues(frameMalformed)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.WebSocketFrames.WithLabelValues(frameUnknownStation)))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.WebSocketConnected))
+
+	upstream.mu.Lock()
+	headers := upstream.headers[0]
+	upstream.mu.Unlock()
+	assert.Equal(t, pushAPIKey, headers.Get("X-Api-Key"))
+	assert.Equal(t, ingestor.instanceID, headers.Get("X-Instance-Id"))
+	assert.Contains(t, headers.Get("User-Agent"), "data-ingestor/")
+}
+
+func TestWebSocket_ReconnectsAfterADisconnect(t *testing.T) {
+	upstream := newPushUpstream(t)
+	var polls atomic.Int32
+	poll := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		polls.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"type":"weather","name":"berlin-poll","payload":{"temperature":1}}]`))
+	}))
+	t.Cleanup(poll.Close)
+	ingestor, channel := newPushIngestor(t, APIConfig{
+		BaseURL:      poll.URL,
+		PollInterval: Duration(20 * time.Millisecond),
+		WebSocket: WebSocketConfig{
+			URL:          upstream.url(),
+			PingInterval: Duration(10 * time.Millisecond),
+			Backoff:      Duration(10 * time.Millisecond),
+			MaxBackoff:   Duration(20 * time.Millisecond),
+			PollFallback: true,
+		},
+	})
+	router := setupRoutes(ingestor)
+	runPush(t, ingestor)
+	ws := upstream.accept(t)
+	push(t, ws, `{"type":"weather","name":"berlin-1","payload":{"temperature":4}}`)
+	require.Eventually(t, func() bool {
+		names := publishedLocations(t, channel)
+		return len(names) > 0 && names[len(names)-1] == "berlin-1"
+	}, 5*time.Second, 5*time.Millisecond)
+
+	// Polling stands by while the socket is up; a poll may have been in
+	// flight when it connected. The pings tell the time: five of them span
+	// more than two poll intervals.
+	upstream.awaitPings(t, 3)
+	before := polls.Load()
+	upstream.awaitPings(t, 5)
+	assert.Equal(t, before, polls.Load(), "no polls while connected")
+
+	// The provider drops the connection and refuses new ones for a while
+	upstream.down.Store(true)
+	ws.Close()
+	require.Eventually(t, func() bool { return !ingestor.push.up() }, 5*time.Second, 5*time.Millisecond)
+	since, ok := ingestor.push.gap()
+	require.True(t, ok)
+	require.Eventually(t, func() bool { return polls.Load() > before }, 5*time.Second, 5*time.Millisecond, "polling stands in")
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(ingestor.metrics.WebSocketReconnects) >= 2
+	}, 5*time.Second, 5*time.Millisecond, "the drop and at least one refused attempt")
+
+	req := httptest.NewRequest(http.MethodGet, "/weather/latest/berlin-1", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	assert.Equal(t, since.UTC().Format(time.RFC3339), w.Header().Get(webSocketGapHeader))
+	req = httptest.NewRequest(http.MethodGet, "/ingestion/status", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	var status struct {
+		WebSocket WebSocketStatus `json:"websocket"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &status))
+	assert.False(t, status.WebSocket.Connected)
+	require.NotNil(t, status.WebSocket.GapSince)
+	assert.Equal(t, 1, status.WebSocket.Reconnects)
+
+	upstream.down.Store(false)
+	ws = upstream.accept(t)
+	push(t, ws, `{"type":"weather","name":"berlin-2","payload":{"temperature":5}}`)
+	require.Eventually(t, func() bool {
+		names := publishedLocations(t, channel)
+		return len(names) > 0 && names[len(names)-1] == "berlin-2"
+	}, 5*time.Second, 5*time.Millisecond)
+	assert.True(t, ingestor.push.up())
+	_, ok = ingestor.push.gap()
+	assert.False(t, ok, "the gap ends with the reconnect")
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/weather/latest/berlin-2", nil))
+	assert.Empty(t, w.Header().Get(webSocketGapHeader))
+}
+
+func TestWebSocket_PongsKeepAQuietConnection(t *testing.T) {
+	upstream := newPushUpstream(t)
+	ingestor, _ := newPushIngestor(t, APIConfig{
+		BaseURL: "http://127.0.0.1:1",
+		WebSocket: WebSocketConfig{
+			URL:          upstream.url(),
+			PingInterval: Duration(10 * time.Millisecond),
+			Timeout:      Duration(50 * time.Millisecond),
+		},
+	})
+	runPush(t, ingestor)
+	upstream.accept(t)
+
+	// No frame arrives, but the ping control frames are answered for well
+	// past the timeout
+	upstream.awaitPings(t, 20)
+	assert.True(t, ingestor.push.up())
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.WebSocketReconnects))
+	upstream.mu.Lock()
+	assert.Len(t, upstream.headers, 1)
+	upstream.mu.Unlock()
+}
+
+func TestWebSocket_UnansweredPingsDropTheConnection(t *testing.T) {
+	upstream := newPushUpstream(t)
+	upstream.deaf.Store(true)
+	ingestor, _ := newPushIngestor(t, APIConfig{
+		BaseURL: "http://127.0.0.1:1",
+		WebSocket: WebSocketConfig{
+			URL:          upstream.url(),
+			PingInterval: Duration(10 * time.Millisecond),
+			Timeout:      Duration(50 * time.Millisecond),
+			Backoff:      Duration(10 * time.Millisecond),
+		},
+	})
+	runPush(t, ingestor)
+	upstream.accept(t)
+
+	// Nothing reads the connection, so no pong comes back
+	upstream.deaf.Store(false)
+	upstream.accept(t)
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.WebSocketReconnects))
+}
+
+func TestWebSocket_ConnectsThroughTheProxy(t *testing.T) {
+	upstream := newPushUpstream(t)
+	proxy, tunnels := connectProxy(t)
+	ingestor, channel := newPushIngestor(t, APIConfig{
+		BaseURL:   "http://127.0.0.1:1",
+		WebSocket: WebSocketConfig{URL: upstream.url()},
+	})
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	ingestor.push.proxy = http.ProxyURL(proxyURL)
+	runPush(t, ingestor)
+
+	ws := upstream.accept(t)
+	select {
+	case target := <-tunnels:
+		assert.Equal(t, strings.TrimPrefix(upstream.server.URL, "http://"), target)
+	default:
+		t.Fatal("the connection did not go through the proxy")
+	}
+	push(t, ws, `{"type":"weather","name":"berlin-1","payload":{"temperature":4}}`)
+	require.Eventually(t, func() bool { return len(channel.messages()) == 1 }, 5*time.Second, 5*time.Millisecond)
+}
+
+func TestWebSocket_OversizedFramesAreSkipped(t *testing.T) {
+	upstream := newPushUpstream(t)
+	ingestor, channel := newPushIngestor(t, APIConfig{
+		BaseURL:      "http://127.0.0.1:1",
+		MaxBodyBytes: 256,
+		WebSocket:    WebSocketConfig{URL: upstream.url()},
+	})
+	runPush(t, ingestor)
+	ws := upstream.accept(t)
+
+	push(t, ws, `{"type":"weather","name":"berlin-1","payload":{"note":"`+strings.Repeat("x", 512)+`"}}`)
+	push(t, ws, `{"type":"weather","name":"berlin-2","payload":{"temperature":4}}`)
+	require.Eventually(t, func() bool { return len(channel.messages()) == 1 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, []string{"berlin-2"}, publishedLocations(t, channel))
+	assert.Equal(t, 1.0, testutil.ToFloat64(ingestor.metrics.WebSocketFrames.WithLabelValues(frameMalformed)))
+	assert.Zero(t, testutil.ToFloat64(ingestor.metrics.WebSocketReconnects), "the connection survives the frame")
+}
+
+func TestWebSocket_IsASource(t *testing.T) {
+	ingestor, _ := newPushIngestor(t, APIConfig{BaseURL: "http://127.0.0.1:1", WebSocket: WebSocketConfig{URL: "ws://127.0.0.1:1/stream"}})
+	sources := ingestor.pushSources()
+	require.Len(t, sources, 1)
+	assert.Equal(t, sourceWebSocket, sources[0].Name())
+	assert.False(t, ingestor.pushing())
+
+	ingestor, _ = newPushIngestor(t, APIConfig{BaseURL: "http://127.0.0.1:1"})
+	assert.Empty(t, ingestor.pushSources())
+	assert.False(t, ingestor.pushing())
+}
@@ -0,0 +1,457 @@
+// Package client is a typed client for the data-ingestor HTTP API.
+//
+// It uses the standard library only, so services can depend on it without
+// pulling in the server's dependencies.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultRetries    = 3
+	defaultRetryDelay = 500 * time.Millisecond
+	// maxRetryDelay caps the delay between retries, including Retry-After
+	maxRetryDelay = 30 * time.Second
+)
+
+// Errors an *APIError matches with errors.Is, by status code
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrUnavailable  = errors.New("service unavailable")
+	// ErrTooManyRequests is returned when too many manual ingestions are
+	// already running
+	ErrTooManyRequests = errors.New("too many requests")
+	// ErrGone is returned by History when the readings being paged through
+	// left the ingestor's buffer
+	ErrGone = errors.New("gone")
+)
+
+// APIError is an error response of the ingestor. Use errors.As to inspect it,
+// or errors.Is with ErrUnavailable and the other sentinel errors.
+type APIError struct {
+	StatusCode int
+	// Message is the error field of the response body
+	Message string
+	// State is the RabbitMQ connection state, when the response carries it
+	State string
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("data-ingestor: %d %s", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("data-ingestor: %d %s: %s", e.StatusCode, http.StatusText(e.StatusCode), e.Message)
+}
+
+// Is matches the sentinel error for the status code
+func (e *APIError) Is(target error) bool {
+	switch e.StatusCode {
+	case http.StatusUnauthorized:
+		return target == ErrUnauthorized
+	case http.StatusForbidden:
+		return target == ErrForbidden
+	case http.StatusNotFound:
+		return target == ErrNotFound
+	case http.StatusConflict:
+		return target == ErrConflict
+	case http.StatusServiceUnavailable:
+		return target == ErrUnavailable
+	case http.StatusTooManyRequests:
+		return target == ErrTooManyRequests
+	case http.StatusGone:
+		return target == ErrGone
+	}
+	return false
+}
+
+// Client calls one ingestor. It is safe for concurrent use.
+type Client struct {
+	baseURL    string
+	httpClient *http.Client
+	adminToken string
+	retries    int
+	retryDelay time.Duration
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client used for requests
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithAdminToken sets the token sent as "Authorization: Bearer <token>"
+func WithAdminToken(token string) Option {
+	return func(c *Client) { c.adminToken = token }
+}
+
+// WithRetries sets how many times a 503 or 429 response is retried and the delay
+// before the first retry, which doubles with every further retry. A
+// Retry-After header takes precedence over the delay.
+func WithRetries(retries int, delay time.Duration) Option {
+	return func(c *Client) {
+		c.retries = retries
+		c.retryDelay = delay
+	}
+}
+
+// New returns a client for the ingestor at baseURL, e.g. http://data-ingestor:8080
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		httpClient: http.DefaultClient,
+		retries:    defaultRetries,
+		retryDelay: defaultRetryDelay,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Reading is one published sensor reading
+type Reading struct {
+	Type     string                 `json:"type"`
+	Name     string                 `json:"name"`
+	Payload  map[string]interface{} `json:"payload"`
+	Metadata map[string]interface{} `json:"location_metadata,omitempty"`
+}
+
+// IngestOptions are the options of IngestNow
+type IngestOptions struct {
+	// IdempotencyKey makes retries of the same ingestion safe: the ingestor
+	// runs it once and answers repeats from its cache
+	IdempotencyKey string
+}
+
+// IngestResult is the outcome of IngestNow
+type IngestResult struct {
+	// NoData is set when no location had data yet; nothing was published
+	NoData         bool              `json:"-"`
+	Message        string            `json:"message"`
+	Readings       []Reading         `json:"data"`
+	MessageIDs     []string          `json:"message_ids"`
+	CorrelationIDs []string          `json:"correlation_ids"`
+	SourceErrors   map[string]string `json:"source_errors,omitempty"`
+	// Status is succeeded, or degraded when some locations failed or were
+	// skipped
+	Status    string            `json:"status"`
+	Locations []LocationOutcome `json:"locations"`
+	// Gaps are the locations missing from the upstream's bulk response
+	Gaps []string `json:"gaps,omitempty"`
+	// Replayed is set when the response came from the idempotency cache
+	Replayed bool `json:"-"`
+}
+
+// LocationOutcome is what one location did in an ingestion
+type LocationOutcome struct {
+	Location string `json:"location"`
+	// Outcome is published, no_data, skipped or failed
+	Outcome       string   `json:"outcome"`
+	Readings      int      `json:"readings"`
+	MessageIDs    []string `json:"message_ids,omitempty"`
+	CorrelationID string   `json:"correlation_id,omitempty"`
+	DurationMS    int64    `json:"duration_ms"`
+	Retries       int      `json:"retries"`
+	Bytes         int      `json:"bytes"`
+	// Delivery is how the readings reached the sinks, once they were tried
+	Delivery *DeliveryResult `json:"delivery,omitempty"`
+	Error    string          `json:"error,omitempty"`
+}
+
+// DeliveryResult is how the readings of one location were delivered under
+// the service's delivery policy
+type DeliveryResult struct {
+	Delivered int `json:"delivered"`
+	// Partial readings satisfied the policy but some sink missed them
+	Partial         int            `json:"partial"`
+	Failed          int            `json:"failed"`
+	PartialReadings []string       `json:"partial_readings,omitempty"`
+	Sinks           []SinkDelivery `json:"sinks"`
+}
+
+// SinkDelivery is what one sink took of the readings
+type SinkDelivery struct {
+	Sink string `json:"sink"`
+	// Policy is required, quorum or best_effort
+	Policy   string `json:"policy"`
+	Readings int    `json:"readings"`
+	Error    string `json:"error,omitempty"`
+}
+
+// IngestNow triggers one ingestion cycle, like POST /ingest
+func (c *Client) IngestNow(ctx context.Context, opts IngestOptions) (*IngestResult, error) {
+	header := http.Header{}
+	if opts.IdempotencyKey != "" {
+		header.Set("Idempotency-Key", opts.IdempotencyKey)
+	}
+	resp, err := c.do(ctx, http.MethodPost, "/ingest", header)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNoContent {
+		return &IngestResult{NoData: true}, nil
+	}
+	var result IngestResult
+	if err := decode(resp, &result); err != nil {
+		return nil, err
+	}
+	result.Replayed = resp.Header.Get("Idempotent-Replayed") == "true"
+	return &result, nil
+}
+
+// SubscriberStats is the delivery summary of one webhook subscriber
+type SubscriberStats struct {
+	URL          string     `json:"url"`
+	Breaker      string     `json:"breaker"`
+	Queued       int        `json:"queued"`
+	Delivered    int64      `json:"delivered"`
+	Failed       int64      `json:"failed"`
+	Dropped      int64      `json:"dropped"`
+	Retries      int64      `json:"retries"`
+	LastError    string     `json:"last_error,omitempty"`
+	LastDelivery *time.Time `json:"last_delivery,omitempty"`
+}
+
+// BrokerStats describes the RabbitMQ broker being published to
+type BrokerStats struct {
+	State     string `json:"state"`
+	Active    string `json:"active"`
+	Primary   bool   `json:"primary"`
+	Failovers int    `json:"failovers"`
+}
+
+// IngestStats describes the manual ingestions of POST /ingest
+type IngestStats struct {
+	MaxInFlight int   `json:"max_in_flight"`
+	InFlight    int64 `json:"in_flight"`
+	Waiting     int64 `json:"waiting"`
+	Rejected    int64 `json:"rejected"`
+}
+
+// Stats is the response of GET /stats
+type Stats struct {
+	Subscribers map[string]SubscriberStats `json:"subscribers"`
+	RabbitMQ    BrokerStats                `json:"rabbitmq"`
+	Ingest      IngestStats                `json:"ingest"`
+	// Totals are the ingestor's counters summed over their labels, by metric
+	// name without the data_ingestor_ prefix
+	Totals map[string]float64 `json:"totals"`
+	// Timeouts are the effective upstream timeouts by location; nil unless
+	// adaptive timeouts are enabled
+	Timeouts map[string]TimeoutStats `json:"timeouts"`
+	// Triggers are the cycles, published readings and upstream fetches by
+	// what started them: poll, manual, webhook, backfill, replay or loadtest
+	Triggers map[string]TriggerStats `json:"triggers"`
+}
+
+// TriggerStats is what the ingestions of one trigger did
+type TriggerStats struct {
+	Cycles            float64 `json:"cycles"`
+	ReadingsPublished float64 `json:"readings_published"`
+	UpstreamFetches   float64 `json:"upstream_fetches"`
+}
+
+// TimeoutStats is the per-attempt timeout of one upstream location
+type TimeoutStats struct {
+	TimeoutMS    int64 `json:"timeout_ms"`
+	Adaptive     bool  `json:"adaptive"`
+	Samples      int   `json:"samples"`
+	PercentileMS int64 `json:"percentile_ms"`
+}
+
+// Stats returns delivery statistics, like GET /stats
+func (c *Client) Stats(ctx context.Context) (*Stats, error) {
+	var stats Stats
+	if err := c.get(ctx, "/stats", &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// Health is the response of GET /health
+type Health struct {
+	Status    string    `json:"status"`
+	Timestamp time.Time `json:"timestamp"`
+	Service   string    `json:"service"`
+	Version   string    `json:"version"`
+	// InstanceID identifies the ingestor instance, as in its X-Instance-Id
+	InstanceID string `json:"instance_id"`
+	// RabbitMQ is the connection state: disconnected, connecting, ready or closing
+	RabbitMQ string `json:"rabbitmq"`
+}
+
+// Health returns the service health, like GET /health
+func (c *Client) Health(ctx context.Context) (*Health, error) {
+	var health Health
+	if err := c.get(ctx, "/health", &health); err != nil {
+		return nil, err
+	}
+	return &health, nil
+}
+
+// RecentReading is a published reading with its stream event id
+type RecentReading struct {
+	ID string `json:"id"`
+	// Trigger is what started the ingestion of the reading, such as poll,
+	// manual or backfill. Readings from Stream leave it empty.
+	Trigger string  `json:"trigger,omitempty"`
+	Reading Reading `json:"reading"`
+}
+
+// Recent returns up to limit of the newest published readings, oldest first,
+// like GET /recent. location is a glob such as "berlin-*"; empty matches all.
+// A limit of 0 uses the server default.
+func (c *Client) Recent(ctx context.Context, limit int, location string) ([]RecentReading, error) {
+	query := url.Values{}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	if location != "" {
+		query.Set("location", location)
+	}
+	path := "/recent"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	var response struct {
+		Readings []RecentReading `json:"readings"`
+	}
+	if err := c.get(ctx, path, &response); err != nil {
+		return nil, err
+	}
+	return response.Readings, nil
+}
+
+// Pause stops polling the upstream, like POST /admin/pause. It needs the
+// admin token.
+func (c *Client) Pause(ctx context.Context) error {
+	return c.post(ctx, "/admin/pause")
+}
+
+// Resume restarts polling after Pause, like POST /admin/resume. It needs the
+// admin token.
+func (c *Client) Resume(ctx context.Context) error {
+	return c.post(ctx, "/admin/resume")
+}
+
+func (c *Client) post(ctx context.Context, path string) error {
+	resp, err := c.do(ctx, http.MethodPost, path, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (c *Client) get(ctx context.Context, path string, v interface{}) error {
+	resp, err := c.do(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decode(resp, v)
+}
+
+// do sends a request, retrying 503 and 429 responses. Any other response is
+// returned as is for a 2xx status and as an *APIError otherwise.
+func (c *Client) do(ctx context.Context, method, path string, header http.Header) (*http.Response, error) {
+	delay := c.retryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		for key, values := range header {
+			req.Header[key] = values
+		}
+		if req.Header.Get("Accept") == "" {
+			req.Header.Set("Accept", "application/json")
+		}
+		if c.adminToken != "" {
+			req.Header.Set("Authorization", "Bearer "+c.adminToken)
+		}
+
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		apiErr := readError(resp)
+		retryable := resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests
+		if !retryable || attempt >= c.retries {
+			return nil, apiErr
+		}
+		wait := delay
+		if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After")); ok {
+			wait = retryAfter
+		}
+		if wait > maxRetryDelay {
+			wait = maxRetryDelay
+		}
+		delay *= 2
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// readError decodes the {"error": ...} envelope of an error response
+func readError(resp *http.Response) *APIError {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+	var envelope struct {
+		Error string `json:"error"`
+		State string `json:"state"`
+	}
+	if json.Unmarshal(body, &envelope) == nil {
+		apiErr.Message, apiErr.State = envelope.Error, envelope.State
+	} else {
+		apiErr.Message = string(bytes.TrimSpace(body))
+	}
+	return apiErr
+}
+
+func decode(resp *http.Response, v interface{}) error {
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("data-ingestor: failed to decode response: %w", err)
+	}
+	return nil
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds
+func parseRetryAfter(value string) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
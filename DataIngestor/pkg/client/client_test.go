@@ -0,0 +1,123 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// statusServer answers with the given statuses in turn, repeating the last one
+func statusServer(t *testing.T, statuses ...int) (*httptest.Server, *int32) {
+	t.Helper()
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(atomic.AddInt32(&hits, 1)) - 1
+		if i >= len(statuses) {
+			i = len(statuses) - 1
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(statuses[i])
+		if statuses[i] >= 300 {
+			w.Write([]byte(`{"error":"RabbitMQ is not connected","state":"connecting"}`))
+			return
+		}
+		w.Write([]byte(`{"status":"healthy","service":"data-ingestor","rabbitmq":"ready"}`))
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func TestClient_RetriesUnavailable(t *testing.T) {
+	server, hits := statusServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK)
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+
+	health, err := c.Health(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ready", health.RabbitMQ)
+	assert.Equal(t, int32(3), atomic.LoadInt32(hits))
+}
+
+func TestClient_GivesUpAfterRetries(t *testing.T) {
+	server, hits := statusServer(t, http.StatusServiceUnavailable)
+	c := New(server.URL, WithRetries(2, time.Millisecond))
+
+	_, err := c.Health(context.Background())
+	assert.ErrorIs(t, err, ErrUnavailable)
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusServiceUnavailable, apiErr.StatusCode)
+	assert.Equal(t, "RabbitMQ is not connected", apiErr.Message)
+	assert.Equal(t, "connecting", apiErr.State)
+	assert.Equal(t, int32(3), atomic.LoadInt32(hits))
+}
+
+func TestClient_RetriesTooManyRequests(t *testing.T) {
+	server, hits := statusServer(t, http.StatusTooManyRequests, http.StatusOK)
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+
+	_, err := c.Health(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(hits))
+
+	server, _ = statusServer(t, http.StatusTooManyRequests)
+	_, err = New(server.URL, WithRetries(0, time.Millisecond)).Health(context.Background())
+	assert.ErrorIs(t, err, ErrTooManyRequests)
+}
+
+func TestClient_DoesNotRetryOtherErrors(t *testing.T) {
+	server, hits := statusServer(t, http.StatusInternalServerError)
+	c := New(server.URL, WithRetries(3, time.Millisecond))
+
+	_, err := c.Health(context.Background())
+	var apiErr *APIError
+	require.True(t, errors.As(err, &apiErr))
+	assert.Equal(t, http.StatusInternalServerError, apiErr.StatusCode)
+	assert.NotErrorIs(t, err, ErrUnavailable)
+	assert.Equal(t, int32(1), atomic.LoadInt32(hits))
+}
+
+func TestClient_CancelledWhileWaitingToRetry(t *testing.T) {
+	server, _ := statusServer(t, http.StatusServiceUnavailable)
+	c := New(server.URL, WithRetries(3, time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := c.Health(ctx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestClient_HonoursRetryAfter(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"status":"healthy"}`))
+	}))
+	defer server.Close()
+	c := New(server.URL, WithRetries(1, time.Hour))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := c.Health(ctx)
+	require.NoError(t, err)
+}
+
+func TestAPIError_Is(t *testing.T) {
+	assert.ErrorIs(t, &APIError{StatusCode: http.StatusUnauthorized}, ErrUnauthorized)
+	assert.ErrorIs(t, &APIError{StatusCode: http.StatusNotFound}, ErrNotFound)
+	assert.NotErrorIs(t, &APIError{StatusCode: http.StatusNotFound}, ErrConflict)
+	assert.ErrorIs(t, &APIError{StatusCode: http.StatusGone}, ErrGone)
+	assert.Equal(t, "data-ingestor: 409 Conflict: backpressure is disabled", (&APIError{StatusCode: http.StatusConflict, Message: "backpressure is disabled"}).Error())
+}
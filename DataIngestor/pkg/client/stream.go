@@ -0,0 +1,247 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// historyPageSize is the number of readings History requests per page, the
+// most the ingestor serves at once
+const historyPageSize = 1000
+
+// Stream is a subscription to GET /stream. Readings arrive on C, which is
+// closed when the context is done or the ingestor rejects a reconnect; Err
+// then tells which.
+type Stream struct {
+	C <-chan RecentReading
+
+	mu  sync.Mutex
+	err error
+}
+
+// Err returns why C was closed: the context error, or an *APIError for a
+// reconnect the ingestor rejected. It is nil while C is open.
+func (s *Stream) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Stream) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// Stream subscribes to the published readings, like GET /stream. location
+// is a glob such as "berlin-*"; empty matches all.
+//
+// The first connect happens before Stream returns, so a bad pattern or an
+// unreachable ingestor is returned right away. When the stream ends later,
+// including for a restart of the ingestor, Stream reconnects with
+// Last-Event-ID, so readings published in between are not lost as long as
+// the ingestor still buffers them. Reconnects wait the delay of
+// WithRetries, doubling up to 30s while they fail, or the retry delay the
+// ingestor asked for. The HTTP client should have no Timeout, which would
+// end every stream after it.
+func (c *Client) Stream(ctx context.Context, location string) (*Stream, error) {
+	resp, err := c.connectStream(ctx, location, "")
+	if err != nil {
+		return nil, err
+	}
+	readings := make(chan RecentReading)
+	s := &Stream{C: readings}
+	go c.runStream(ctx, s, readings, location, resp)
+	return s, nil
+}
+
+func (c *Client) connectStream(ctx context.Context, location, lastEventID string) (*http.Response, error) {
+	header := http.Header{}
+	header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		header.Set("Last-Event-ID", lastEventID)
+	}
+	path := "/stream"
+	if location != "" {
+		path += "?" + url.Values{"location": {location}}.Encode()
+	}
+	return c.do(ctx, http.MethodGet, path, header)
+}
+
+// runStream reads resp and every reconnect after it until the context is
+// done or a reconnect is rejected
+func (c *Client) runStream(ctx context.Context, s *Stream, readings chan<- RecentReading, location string, resp *http.Response) {
+	defer close(readings)
+
+	base := c.retryDelay
+	if base <= 0 {
+		base = defaultRetryDelay
+	}
+	delay := base
+	var lastEventID string
+	for {
+		result := readStream(ctx, resp.Body, readings, &lastEventID)
+		resp.Body.Close()
+		if result.received {
+			delay = base
+		}
+
+		for {
+			wait := delay
+			if result.retry > 0 {
+				wait, result.retry = result.retry, 0
+			}
+			if wait > maxRetryDelay {
+				wait = maxRetryDelay
+			}
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				s.setErr(ctx.Err())
+				return
+			case <-timer.C:
+			}
+			delay *= 2
+			if delay > maxRetryDelay {
+				delay = maxRetryDelay
+			}
+
+			var err error
+			resp, err = c.connectStream(ctx, location, lastEventID)
+			if err == nil {
+				break
+			}
+			if ctx.Err() != nil {
+				s.setErr(ctx.Err())
+				return
+			}
+			var apiErr *APIError
+			if errors.As(err, &apiErr) && !reconnectable(apiErr.StatusCode) {
+				s.setErr(err)
+				return
+			}
+		}
+	}
+}
+
+// reconnectable reports whether a stream rejected with status may accept a
+// later reconnect: the ingestor is restarting, shedding or overloaded
+func reconnectable(status int) bool {
+	return status >= 500 || status == http.StatusTooManyRequests
+}
+
+// streamResult is how one connection of a stream ended
+type streamResult struct {
+	// retry is the reconnect delay the ingestor asked for
+	retry time.Duration
+	// received is set when at least one reading arrived
+	received bool
+}
+
+// readStream parses server-sent events from body until it ends, sending
+// reading events to readings and tracking the id of the last one
+func readStream(ctx context.Context, body io.Reader, readings chan<- RecentReading, lastEventID *string) streamResult {
+	var result streamResult
+	reader := bufio.NewReader(body)
+	var event, id string
+	var data []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			// A partial event at the end of the stream is discarded
+			return result
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if id != "" {
+				*lastEventID = id
+			}
+			if (event == "" || event == "reading") && len(data) > 0 {
+				reading := RecentReading{ID: *lastEventID}
+				if json.Unmarshal([]byte(strings.Join(data, "\n")), &reading.Reading) == nil {
+					select {
+					case readings <- reading:
+						result.received = true
+					case <-ctx.Done():
+						return result
+					}
+				}
+			}
+			event, id, data = "", "", nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// A comment, like the heartbeat
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			data = append(data, value)
+		case "id":
+			id = value
+		case "retry":
+			if ms, err := strconv.Atoi(value); err == nil && ms >= 0 {
+				result.retry = time.Duration(ms) * time.Millisecond
+			}
+		}
+	}
+}
+
+// HistoryReading is a published reading with its stream event id and the
+// time it was published
+type HistoryReading struct {
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Reading Reading   `json:"reading"`
+}
+
+// History returns the readings published in [from, to), oldest first,
+// paging through GET /history. A zero from or to leaves that end open, and
+// location is a glob like for Recent. The ingestor only keeps its most
+// recent readings; when they move out of its buffer while paging, History
+// returns an error matching ErrGone.
+func (c *Client) History(ctx context.Context, from, to time.Time, location string) ([]HistoryReading, error) {
+	query := url.Values{}
+	if !from.IsZero() {
+		query.Set("from", from.UTC().Format(time.RFC3339Nano))
+	}
+	if !to.IsZero() {
+		query.Set("to", to.UTC().Format(time.RFC3339Nano))
+	}
+	if location != "" {
+		query.Set("location", location)
+	}
+	query.Set("limit", strconv.Itoa(historyPageSize))
+
+	readings := []HistoryReading{}
+	for {
+		var page struct {
+			Readings []HistoryReading `json:"readings"`
+			Next     string           `json:"next"`
+		}
+		if err := c.get(ctx, "/history?"+query.Encode(), &page); err != nil {
+			return nil, err
+		}
+		readings = append(readings, page.Readings...)
+		if page.Next == "" {
+			return readings, nil
+		}
+		query.Set("after", page.Next)
+	}
+}
@@ -0,0 +1,145 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// sseServer answers the nth connection with bodies[n], or with a 400 error
+// envelope once they run out, and records the Last-Event-ID of every
+// connection
+func sseServer(t *testing.T, bodies ...string) (*httptest.Server, func() []string) {
+	t.Helper()
+	var mu sync.Mutex
+	var lastEventIDs []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		n := len(lastEventIDs)
+		lastEventIDs = append(lastEventIDs, r.Header.Get("Last-Event-ID"))
+		mu.Unlock()
+
+		if n >= len(bodies) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"error":"invalid location pattern: syntax error in pattern"}`))
+			return
+		}
+		assert.Equal(t, "text/event-stream", r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, bodies[n])
+	}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), lastEventIDs...)
+	}
+}
+
+func receive(t *testing.T, s *Stream) (RecentReading, bool) {
+	t.Helper()
+	select {
+	case reading, ok := <-s.C:
+		return reading, ok
+	case <-time.After(5 * time.Second):
+		t.Fatal("no reading received")
+		return RecentReading{}, false
+	}
+}
+
+func TestStream_ParsesAndReconnects(t *testing.T) {
+	server, lastEventIDs := sseServer(t,
+		": heartbeat ingestor-1\n\n"+
+			"id: c1-0\nevent: reading\ndata: {\"type\":\"weather\",\"name\":\"berlin-1\",\n"+
+			"data: \"payload\":{\"temperature\":21.5}}\n\n"+
+			"event: shutdown\nretry: 10\ndata: {\"message\":\"server is shutting down\"}\n\n",
+		"id: c2-0\nevent: reading\ndata: {\"type\":\"weather\",\"name\":\"berlin-2\"}\n\n"+
+			"id: c2-1\nevent: reading\ndata: {\"type\":\"weather\",\"na",
+	)
+	c := New(server.URL, WithRetries(0, time.Millisecond))
+
+	s, err := c.Stream(context.Background(), "berlin-*")
+	require.NoError(t, err)
+
+	reading, ok := receive(t, s)
+	require.True(t, ok)
+	assert.Equal(t, "c1-0", reading.ID)
+	assert.Equal(t, "berlin-1", reading.Reading.Name)
+	assert.Equal(t, 21.5, reading.Reading.Payload["temperature"], "data lines are joined")
+
+	reading, ok = receive(t, s)
+	require.True(t, ok)
+	assert.Equal(t, "c2-0", reading.ID)
+
+	_, ok = receive(t, s)
+	assert.False(t, ok, "the partial event is dropped and the rejected reconnect ends the stream")
+	assert.ErrorContains(t, s.Err(), "invalid location pattern")
+	var apiErr *APIError
+	require.ErrorAs(t, s.Err(), &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, []string{"", "c1-0", "c2-0"}, lastEventIDs())
+}
+
+func TestStream_FirstConnectError(t *testing.T) {
+	server, _ := sseServer(t)
+	_, err := New(server.URL).Stream(context.Background(), "[")
+	var apiErr *APIError
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+}
+
+func TestStream_StopsWhenCanceled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s, err := New(server.URL).Stream(ctx, "")
+	require.NoError(t, err)
+	cancel()
+
+	_, ok := receive(t, s)
+	assert.False(t, ok)
+	assert.ErrorIs(t, s.Err(), context.Canceled)
+}
+
+func TestStream_BacksOffBetweenReconnects(t *testing.T) {
+	var mu sync.Mutex
+	var connects []time.Time
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		connects = append(connects, time.Now())
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/event-stream")
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	_, err := New(server.URL, WithRetries(0, 20*time.Millisecond)).Stream(ctx, "")
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(connects) >= 4
+	}, 5*time.Second, 5*time.Millisecond)
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	// Streams that end without a reading wait 20ms, 40ms and 80ms
+	assert.GreaterOrEqual(t, connects[3].Sub(connects[0]), 140*time.Millisecond)
+}
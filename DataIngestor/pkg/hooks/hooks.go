@@ -0,0 +1,157 @@
+// Package hooks is the extension API of the data-ingestor pipeline.
+//
+// A hook package registers its hooks from init, and the service runs them
+// once its build imports the package, with a blank import in
+// cmd/data-ingestor/plugins.go:
+//
+//	package audit
+//
+//	func init() {
+//		hooks.RegisterPublishObserver("audit", auditLog{})
+//	}
+//
+// It uses the standard library only, so hook packages can depend on it
+// without pulling in the service's dependencies.
+package hooks
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// Reading is a decoded reading as interceptors see it
+type Reading struct {
+	Type    string
+	Name    string
+	Payload map[string]interface{}
+	// Headers are the captured headers of the response the reading came in.
+	// Changes to them are not kept.
+	Headers map[string]string
+}
+
+// RequestDecorator changes the outbound upstream request, e.g. to add headers
+type RequestDecorator interface {
+	DecorateRequest(req *http.Request)
+}
+
+// ReadingInterceptor inspects and changes a decoded reading before it is
+// transformed and published. Returning false drops the reading.
+type ReadingInterceptor interface {
+	InterceptReading(reading *Reading) bool
+}
+
+// PublishObserver is told about every message published to RabbitMQ, after
+// the broker confirmed or rejected it. It must not keep body.
+type PublishObserver interface {
+	ObservePublish(body []byte, outcome PublishOutcome)
+}
+
+// PublishOutcome describes one publish attempt
+type PublishOutcome struct {
+	Exchange   string
+	RoutingKey string
+	MessageID  string
+	// Err is nil when the broker confirmed the message, or when it was
+	// spooled to be published once the broker is back, which Spooled tells
+	Err     error
+	Spooled bool
+}
+
+// Named is a registered hook with the name that labels its metrics and logs
+type Named[T any] struct {
+	Name string
+	Hook T
+}
+
+var registry struct {
+	mu           sync.Mutex
+	names        map[string]bool
+	decorators   []Named[RequestDecorator]
+	interceptors []Named[ReadingInterceptor]
+	observers    []Named[PublishObserver]
+}
+
+// register claims name, which must be unique across every kind
+func register(name string) {
+	if name == "" {
+		panic("hooks: a hook needs a name")
+	}
+	if registry.names == nil {
+		registry.names = make(map[string]bool)
+	}
+	if registry.names[name] {
+		panic(fmt.Sprintf("hooks: %q is registered twice", name))
+	}
+	registry.names[name] = true
+}
+
+// RegisterRequestDecorator registers a request decorator. Hooks of one kind
+// run in registration order. It panics when name is empty or taken.
+func RegisterRequestDecorator(name string, decorator RequestDecorator) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	register(name)
+	registry.decorators = append(registry.decorators, Named[RequestDecorator]{name, decorator})
+}
+
+// RegisterReadingInterceptor registers a reading interceptor
+func RegisterReadingInterceptor(name string, interceptor ReadingInterceptor) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	register(name)
+	registry.interceptors = append(registry.interceptors, Named[ReadingInterceptor]{name, interceptor})
+}
+
+// RegisterPublishObserver registers a publish observer
+func RegisterPublishObserver(name string, observer PublishObserver) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	register(name)
+	registry.observers = append(registry.observers, Named[PublishObserver]{name, observer})
+}
+
+// RequestDecorators returns the registered request decorators in order
+func RequestDecorators() []Named[RequestDecorator] {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return append([]Named[RequestDecorator](nil), registry.decorators...)
+}
+
+// ReadingInterceptors returns the registered reading interceptors in order
+func ReadingInterceptors() []Named[ReadingInterceptor] {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return append([]Named[ReadingInterceptor](nil), registry.interceptors...)
+}
+
+// PublishObservers returns the registered publish observers in order
+func PublishObservers() []Named[PublishObserver] {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	return append([]Named[PublishObserver](nil), registry.observers...)
+}
+
+// CompletenessScore is an example ReadingInterceptor. It stores the share of
+// Fields present in the payload, from 0 to 1, in the Field payload field.
+type CompletenessScore struct {
+	Fields []string
+	Field  string
+}
+
+func (c CompletenessScore) InterceptReading(reading *Reading) bool {
+	if len(c.Fields) == 0 {
+		return true
+	}
+	present := 0
+	for _, field := range c.Fields {
+		if value, ok := reading.Payload[field]; ok && value != nil {
+			present++
+		}
+	}
+	if reading.Payload == nil {
+		reading.Payload = make(map[string]interface{})
+	}
+	reading.Payload[c.Field] = float64(present) / float64(len(c.Fields))
+	return true
+}
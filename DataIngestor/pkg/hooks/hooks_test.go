@@ -0,0 +1,42 @@
+package hooks
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type decoratorFunc func(req *http.Request)
+
+func (f decoratorFunc) DecorateRequest(req *http.Request) { f(req) }
+
+func TestRegister_KeepsOrderAndNames(t *testing.T) {
+	RegisterRequestDecorator("first", decoratorFunc(func(*http.Request) {}))
+	RegisterRequestDecorator("second", decoratorFunc(func(*http.Request) {}))
+	RegisterReadingInterceptor("completeness", CompletenessScore{Fields: []string{"temperature"}, Field: "completeness"})
+
+	decorators := RequestDecorators()
+	require.Len(t, decorators, 2)
+	assert.Equal(t, "first", decorators[0].Name)
+	assert.Equal(t, "second", decorators[1].Name)
+	require.Len(t, ReadingInterceptors(), 1)
+	assert.Empty(t, PublishObservers())
+
+	// Names are unique across kinds, since they label the hook metrics
+	assert.Panics(t, func() { RegisterReadingInterceptor("first", CompletenessScore{}) })
+	assert.Panics(t, func() { RegisterPublishObserver("", nil) })
+}
+
+func TestCompletenessScore(t *testing.T) {
+	score := CompletenessScore{Fields: []string{"temperature", "humidity", "pressure", "wind"}, Field: "quality"}
+
+	reading := Reading{Payload: map[string]interface{}{"temperature": 21.5, "humidity": 60.0, "wind": nil}}
+	assert.True(t, score.InterceptReading(&reading))
+	assert.Equal(t, 0.5, reading.Payload["quality"])
+
+	empty := Reading{}
+	score.InterceptReading(&empty)
+	assert.Equal(t, 0.0, empty.Payload["quality"])
+}